@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/sys/unix"
+
+	"github.com/application-research/estuary/alerts"
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util"
+)
+
+const (
+	alertPinFailureRate   = "pin_failure_rate"
+	alertShuttleOffline   = "shuttle_offline"
+	alertDiskSpace        = "disk_space"
+	alertDealFailures     = "deal_failures"
+	alertDiskPressure     = "disk_pressure"
+	alertStuckDeals       = "stuck_deals"
+	alertDatacapLow       = "datacap_low"
+	alertDatacapExhausted = "datacap_exhausted"
+	alertPaychSettling    = "paych_settling"
+)
+
+func newAlertManager(cfg *config.Estuary) *alerts.Manager {
+	var notifiers []alerts.Notifier
+	if cfg.Alerts.SlackWebhookURL != "" {
+		notifiers = append(notifiers, &alerts.SlackNotifier{WebhookURL: cfg.Alerts.SlackWebhookURL})
+	}
+	if cfg.Alerts.PagerDutyRoutingKey != "" {
+		notifiers = append(notifiers, &alerts.PagerDutyNotifier{RoutingKey: cfg.Alerts.PagerDutyRoutingKey})
+	}
+	if cfg.Alerts.WebhookURL != "" {
+		notifiers = append(notifiers, &alerts.WebhookNotifier{URL: cfg.Alerts.WebhookURL})
+	}
+	return alerts.NewManager(cfg.Hostname, cfg.Alerts.RepeatInterval, notifiers...)
+}
+
+// alertChecker periodically evaluates the configured alert conditions and
+// hands the results to the alert manager, which takes care of deduplicating
+// and delivering notifications
+type alertChecker struct {
+	s *Server
+
+	// lk is held for the duration of a check so the config can't change
+	// halfway through one
+	lk  sync.Mutex
+	cfg config.Alerts
+
+	// when each shuttle was first seen disconnected
+	offlineSince map[string]time.Time
+}
+
+func newAlertChecker(s *Server) *alertChecker {
+	return &alertChecker{
+		s:            s,
+		cfg:          s.estuaryCfg.Alerts,
+		offlineSince: make(map[string]time.Time),
+	}
+}
+
+func (ac *alertChecker) setConfig(cfg config.Alerts) {
+	ac.lk.Lock()
+	defer ac.lk.Unlock()
+	ac.cfg = cfg
+}
+
+func (ac *alertChecker) check(ctx context.Context) error {
+	ac.lk.Lock()
+	defer ac.lk.Unlock()
+
+	if ac.cfg.PinFailureRate.Enabled {
+		if err := ac.checkPinFailureRate(ctx); err != nil {
+			log.Errorf("failed to check pin failure rate: %s", err)
+		}
+	}
+	if ac.cfg.ShuttleOffline.Enabled {
+		if err := ac.checkShuttlesOffline(ctx); err != nil {
+			log.Errorf("failed to check for offline shuttles: %s", err)
+		}
+	}
+	if ac.cfg.DiskSpace.Enabled {
+		if err := ac.checkDiskSpace(ctx); err != nil {
+			log.Errorf("failed to check disk space: %s", err)
+		}
+	}
+	if ac.cfg.DealFailures.Enabled {
+		if err := ac.checkDealFailures(ctx); err != nil {
+			log.Errorf("failed to check deal failures: %s", err)
+		}
+	}
+	if ac.cfg.StuckDeals.Enabled {
+		if err := ac.checkStuckDeals(ctx); err != nil {
+			log.Errorf("failed to check stuck deals: %s", err)
+		}
+	}
+	if ac.cfg.Integrity.Enabled {
+		if err := ac.checkIntegrity(ctx); err != nil {
+			log.Errorf("failed to check content integrity: %s", err)
+		}
+	}
+	return nil
+}
+
+func (ac *alertChecker) checkPinFailureRate(ctx context.Context) error {
+	th := ac.cfg.PinFailureRate
+
+	var res struct {
+		Failed int64
+		Total  int64
+	}
+	// contents get updated for all sorts of reasons, only the ones that
+	// finished pinning or failed to in the window count
+	if err := ac.s.DB.WithContext(ctx).Model(&util.Content{}).
+		Select("COALESCE(SUM(CASE WHEN failed THEN 1 ELSE 0 END), 0) as failed, COUNT(1) as total").
+		Where("NOT aggregate AND pin_finished_at > ?", time.Now().Add(-th.Window)).
+		Scan(&res).Error; err != nil {
+		return err
+	}
+
+	if res.Total < th.MinSamples || res.Total == 0 {
+		ac.s.alerts.Resolve(ctx, alertPinFailureRate)
+		return nil
+	}
+
+	rate := float64(res.Failed) / float64(res.Total)
+	if rate <= th.MaxRate {
+		ac.s.alerts.Resolve(ctx, alertPinFailureRate)
+		return nil
+	}
+
+	ac.s.alerts.Fire(ctx, alertPinFailureRate, alertPinFailureRate, alerts.SeverityCritical,
+		fmt.Sprintf("%d of %d pins (%.1f%%) failed in the last %s", res.Failed, res.Total, rate*100, th.Window))
+	return nil
+}
+
+func (ac *alertChecker) checkShuttlesOffline(ctx context.Context) error {
+	var shuttles []Shuttle
+	if err := ac.s.DB.WithContext(ctx).Find(&shuttles).Error; err != nil {
+		return err
+	}
+
+	now := time.Now()
+	firing := make(map[string]bool)
+	for _, sh := range shuttles {
+		if ac.s.CM.shuttleIsOnline(sh.Handle) {
+			delete(ac.offlineSince, sh.Handle)
+			continue
+		}
+
+		since, ok := ac.offlineSince[sh.Handle]
+		if !ok {
+			since = now
+			ac.offlineSince[sh.Handle] = since
+		}
+
+		if now.Sub(since) < ac.cfg.ShuttleOffline.After {
+			continue
+		}
+
+		key := alertShuttleOffline + ":" + sh.Handle
+		firing[key] = true
+		ac.s.alerts.Fire(ctx, key, alertShuttleOffline, alerts.SeverityCritical,
+			fmt.Sprintf("shuttle %s (%s) has been offline since %s", sh.Handle, sh.Host, since.Format(time.RFC3339)))
+	}
+
+	ac.s.alerts.ResolveMissing(ctx, alertShuttleOffline, firing)
+	return nil
+}
+
+func (ac *alertChecker) checkDiskSpace(ctx context.Context) error {
+	minFree := ac.cfg.DiskSpace.MinFreePercent
+	firing := make(map[string]bool)
+
+	check := func(name string, size, free uint64) {
+		if size == 0 {
+			return
+		}
+
+		pct := float64(free) / float64(size) * 100
+		if pct >= minFree {
+			return
+		}
+
+		key := alertDiskSpace + ":" + name
+		firing[key] = true
+		ac.s.alerts.Fire(ctx, key, alertDiskSpace, alerts.SeverityWarning,
+			fmt.Sprintf("blockstore on %s has %.1f%% free space left (%d of %d bytes)", name, pct, free, size))
+	}
+
+	var st unix.Statfs_t
+	if err := unix.Statfs(ac.s.Node.Config.Blockstore, &st); err != nil {
+		return err
+	}
+	check("primary", st.Blocks*uint64(st.Bsize), st.Bavail*uint64(st.Bsize))
+
+	for _, sc := range ac.s.CM.shuttleConnStates() {
+		if sc.Online {
+			check(sc.Handle, sc.BlockstoreSize, sc.BlockstoreFree)
+		}
+	}
+
+	ac.s.alerts.ResolveMissing(ctx, alertDiskSpace, firing)
+	return nil
+}
+
+func (ac *alertChecker) checkDealFailures(ctx context.Context) error {
+	th := ac.cfg.DealFailures
+
+	var failures int64
+	if err := ac.s.DB.WithContext(ctx).Model(&dfeRecord{}).
+		Where("created_at > ?", time.Now().Add(-th.Window)).
+		Count(&failures).Error; err != nil {
+		return err
+	}
+
+	if failures <= th.MaxFailures {
+		ac.s.alerts.Resolve(ctx, alertDealFailures)
+		return nil
+	}
+
+	ac.s.alerts.Fire(ctx, alertDealFailures, alertDealFailures, alerts.SeverityWarning,
+		fmt.Sprintf("%d deal failures recorded in the last %s", failures, th.Window))
+	return nil
+}
+
+// checkStuckDeals escalates content whose deals keep getting stuck no matter
+// which provider they are failed over to
+func (ac *alertChecker) checkStuckDeals(ctx context.Context) error {
+	th := ac.cfg.StuckDeals
+
+	var rows []struct {
+		Content   uint
+		Failovers int64
+	}
+	if err := ac.s.DB.WithContext(ctx).Model(&dfeRecord{}).
+		Select("content, COUNT(1) as failovers").
+		Where("phase IN ? AND created_at > ?", []string{"stuck-" + stuckPhaseTransfer, "stuck-" + stuckPhasePublish}, time.Now().Add(-th.Window)).
+		Group("content").
+		Having("COUNT(1) >= ?", th.MaxFailovers).
+		Scan(&rows).Error; err != nil {
+		return err
+	}
+
+	firing := make(map[string]bool)
+	for _, r := range rows {
+		key := fmt.Sprintf("%s:%d", alertStuckDeals, r.Content)
+		firing[key] = true
+		ac.s.alerts.Fire(ctx, key, alertStuckDeals, alerts.SeverityWarning,
+			fmt.Sprintf("%d deals for content %d were failed over for being stuck in the last %s, it needs to be looked at", r.Failovers, r.Content, th.Window))
+	}
+
+	ac.s.alerts.ResolveMissing(ctx, alertStuckDeals, firing)
+	return nil
+}
+
+func (s *Server) onDiskPressureChange(level util.DiskPressureLevel, usage []util.DirUsage) {
+	ctx := context.Background()
+	if level == util.DiskPressureNone {
+		s.alerts.Resolve(ctx, alertDiskPressure)
+		return
+	}
+
+	summary := fmt.Sprintf("content intake is set to %s due to low disk space:", level)
+	for _, du := range usage {
+		summary += fmt.Sprintf(" %s %.1f%% free;", du.Path, du.FreePercent)
+	}
+	s.alerts.Fire(ctx, alertDiskPressure, alertDiskPressure, alerts.SeverityCritical, summary)
+}
+
+type diskPressureResponse struct {
+	Level string          `json:"level"`
+	Dirs  []util.DirUsage `json:"dirs"`
+}
+
+// handleAdminGetDiskPressure godoc
+// @Summary      Get disk pressure status
+// @Description  This endpoint returns the free space of the blockstore and data directories and whether content intake is currently throttled or paused because of it.
+// @Tags         admin
+// @Produce      json
+// @Success      200  {object}  diskPressureResponse
+// @Router       /admin/disk-pressure [get]
+func (s *Server) handleAdminGetDiskPressure(c echo.Context) error {
+	return c.JSON(http.StatusOK, &diskPressureResponse{
+		Level: s.diskMon.Level().String(),
+		Dirs:  s.diskMon.Usage(),
+	})
+}
+
+// handleAdminGetAlerts godoc
+// @Summary      Get active alerts
+// @Description  This endpoint returns every operational alert that is currently firing.
+// @Tags         admin
+// @Produce      json
+// @Success      200  {array}  alerts.Alert
+// @Router       /admin/alerts [get]
+func (s *Server) handleAdminGetAlerts(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.alerts.Active())
+}
@@ -0,0 +1,167 @@
+package alerts
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("alerts")
+
+type Severity string
+
+const (
+	SeverityWarning  Severity = "warning"
+	SeverityCritical Severity = "critical"
+)
+
+type Status string
+
+const (
+	StatusFiring   Status = "firing"
+	StatusResolved Status = "resolved"
+)
+
+// Alert describes a single operational condition. Key identifies the
+// condition (eg. "shuttle_offline:shuttle-1") so repeated notifications for
+// the same problem can be deduplicated by the receiving service.
+type Alert struct {
+	Key      string    `json:"key"`
+	Name     string    `json:"name"`
+	Severity Severity  `json:"severity"`
+	Status   Status    `json:"status"`
+	Summary  string    `json:"summary"`
+	Source   string    `json:"source"`
+	Since    time.Time `json:"since"`
+	Time     time.Time `json:"time"`
+}
+
+// Notifier delivers alerts to an external service
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, a *Alert) error
+}
+
+type activeAlert struct {
+	alert    Alert
+	notified time.Time
+}
+
+// Manager tracks which alerts are currently firing and sends notifications
+// when an alert starts firing, every repeatInterval while it keeps firing,
+// and once when it resolves.
+type Manager struct {
+	source         string
+	repeatInterval time.Duration
+	notifiers      []Notifier
+
+	lk     sync.Mutex
+	active map[string]*activeAlert
+}
+
+func NewManager(source string, repeatInterval time.Duration, notifiers ...Notifier) *Manager {
+	return &Manager{
+		source:         source,
+		repeatInterval: repeatInterval,
+		notifiers:      notifiers,
+		active:         make(map[string]*activeAlert),
+	}
+}
+
+func (m *Manager) Enabled() bool {
+	return len(m.notifiers) > 0
+}
+
+// Fire records that the condition identified by key is currently happening
+func (m *Manager) Fire(ctx context.Context, key, name string, sev Severity, summary string) {
+	now := time.Now()
+
+	m.lk.Lock()
+	aa, ok := m.active[key]
+	if !ok {
+		aa = &activeAlert{
+			alert: Alert{
+				Key:    key,
+				Name:   name,
+				Source: m.source,
+				Since:  now,
+			},
+		}
+		m.active[key] = aa
+	}
+	aa.alert.Severity = sev
+	aa.alert.Summary = summary
+	aa.alert.Status = StatusFiring
+	aa.alert.Time = now
+
+	send := !ok || now.Sub(aa.notified) >= m.repeatInterval
+	if send {
+		aa.notified = now
+	}
+	a := aa.alert
+	m.lk.Unlock()
+
+	if send {
+		m.notify(ctx, &a)
+	}
+}
+
+// Resolve records that the condition identified by key is no longer
+// happening, notifying if it was previously firing
+func (m *Manager) Resolve(ctx context.Context, key string) {
+	m.lk.Lock()
+	aa, ok := m.active[key]
+	if ok {
+		delete(m.active, key)
+	}
+	m.lk.Unlock()
+
+	if !ok {
+		return
+	}
+
+	a := aa.alert
+	a.Status = StatusResolved
+	a.Time = time.Now()
+	m.notify(ctx, &a)
+}
+
+// ResolveMissing resolves every active alert with the given name whose key is not in firing
+func (m *Manager) ResolveMissing(ctx context.Context, name string, firing map[string]bool) {
+	var stale []string
+	m.lk.Lock()
+	for k, aa := range m.active {
+		if aa.alert.Name == name && !firing[k] {
+			stale = append(stale, k)
+		}
+	}
+	m.lk.Unlock()
+
+	for _, k := range stale {
+		m.Resolve(ctx, k)
+	}
+}
+
+// Active returns all alerts that are currently firing
+func (m *Manager) Active() []Alert {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	out := make([]Alert, 0, len(m.active))
+	for _, aa := range m.active {
+		out = append(out, aa.alert)
+	}
+	return out
+}
+
+func (m *Manager) notify(ctx context.Context, a *Alert) {
+	log.Warnw("alert", "key", a.Key, "status", a.Status, "summary", a.Summary)
+
+	for _, n := range m.notifiers {
+		if err := n.Notify(ctx, a); err != nil {
+			log.Errorf("failed to send %s alert %s via %s: %s", a.Status, a.Key, n.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package alerts
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recorder struct {
+	lk   sync.Mutex
+	sent []Alert
+}
+
+func (r *recorder) Name() string { return "recorder" }
+
+func (r *recorder) Notify(ctx context.Context, a *Alert) error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.sent = append(r.sent, *a)
+	return nil
+}
+
+func (r *recorder) take() []Alert {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	sent := r.sent
+	r.sent = nil
+	return sent
+}
+
+func TestFireAndResolve(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	r := &recorder{}
+	m := NewManager("node-1", time.Hour, r)
+	assert.True(m.Enabled())
+
+	m.Fire(ctx, "disk_space:primary", "disk_space", SeverityWarning, "5% free")
+	sent := r.take()
+	if assert.Len(sent, 1) {
+		assert.Equal("disk_space:primary", sent[0].Key)
+		assert.Equal(StatusFiring, sent[0].Status)
+		assert.Equal("node-1", sent[0].Source)
+		assert.Equal("5% free", sent[0].Summary)
+	}
+
+	// firing again within the repeat interval only updates the alert
+	m.Fire(ctx, "disk_space:primary", "disk_space", SeverityCritical, "1% free")
+	assert.Empty(r.take())
+	active := m.Active()
+	if assert.Len(active, 1) {
+		assert.Equal(SeverityCritical, active[0].Severity)
+		assert.Equal("1% free", active[0].Summary)
+		assert.Equal(sent[0].Since, active[0].Since)
+	}
+
+	m.Resolve(ctx, "disk_space:primary")
+	sent = r.take()
+	if assert.Len(sent, 1) {
+		assert.Equal(StatusResolved, sent[0].Status)
+		assert.Equal("1% free", sent[0].Summary)
+	}
+	assert.Empty(m.Active())
+
+	// resolving what isn't firing sends nothing
+	m.Resolve(ctx, "disk_space:primary")
+	m.Resolve(ctx, "shuttle_offline:shuttle-1")
+	assert.Empty(r.take())
+}
+
+func TestRepeat(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	r := &recorder{}
+	m := NewManager("node-1", 50*time.Millisecond, r)
+
+	m.Fire(ctx, "deal_failures", "deal_failures", SeverityWarning, "12 deal failures")
+	m.Fire(ctx, "deal_failures", "deal_failures", SeverityWarning, "13 deal failures")
+	assert.Len(r.take(), 1)
+
+	time.Sleep(60 * time.Millisecond)
+	m.Fire(ctx, "deal_failures", "deal_failures", SeverityWarning, "14 deal failures")
+	sent := r.take()
+	if assert.Len(sent, 1) {
+		assert.Equal(StatusFiring, sent[0].Status)
+		assert.Equal("14 deal failures", sent[0].Summary)
+	}
+
+	// the repeat interval starts over from the repeated notification
+	m.Fire(ctx, "deal_failures", "deal_failures", SeverityWarning, "15 deal failures")
+	assert.Empty(r.take())
+
+	// an alert that fires again after resolving is new
+	m.Resolve(ctx, "deal_failures")
+	m.Fire(ctx, "deal_failures", "deal_failures", SeverityWarning, "16 deal failures")
+	sent = r.take()
+	if assert.Len(sent, 2) {
+		assert.Equal(StatusResolved, sent[0].Status)
+		assert.Equal(StatusFiring, sent[1].Status)
+	}
+}
+
+func TestResolveMissing(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	r := &recorder{}
+	m := NewManager("node-1", time.Hour, r)
+
+	m.Fire(ctx, "shuttle_offline:shuttle-1", "shuttle_offline", SeverityCritical, "shuttle-1 is offline")
+	m.Fire(ctx, "shuttle_offline:shuttle-2", "shuttle_offline", SeverityCritical, "shuttle-2 is offline")
+	m.Fire(ctx, "disk_space:primary", "disk_space", SeverityWarning, "5% free")
+	r.take()
+
+	m.ResolveMissing(ctx, "shuttle_offline", map[string]bool{"shuttle_offline:shuttle-2": true})
+	sent := r.take()
+	if assert.Len(sent, 1) {
+		assert.Equal("shuttle_offline:shuttle-1", sent[0].Key)
+		assert.Equal(StatusResolved, sent[0].Status)
+	}
+
+	keys := make(map[string]bool)
+	for _, a := range m.Active() {
+		keys[a.Key] = true
+	}
+	assert.Equal(map[string]bool{"shuttle_offline:shuttle-2": true, "disk_space:primary": true}, keys)
+}
@@ -0,0 +1,121 @@
+package alerts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+var httpClient = &http.Client{Timeout: time.Second * 15}
+
+func postJSON(ctx context.Context, url string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected response status %d: %s", resp.StatusCode, string(msg))
+	}
+	return nil
+}
+
+// SlackNotifier posts alerts to a slack incoming webhook
+type SlackNotifier struct {
+	WebhookURL string
+}
+
+func (n *SlackNotifier) Name() string {
+	return "slack"
+}
+
+func (n *SlackNotifier) Notify(ctx context.Context, a *Alert) error {
+	icon := ":rotating_light:"
+	if a.Status == StatusResolved {
+		icon = ":white_check_mark:"
+	} else if a.Severity == SeverityWarning {
+		icon = ":warning:"
+	}
+
+	text := fmt.Sprintf("%s *[%s] %s* (%s)\n%s", icon, a.Status, a.Name, a.Source, a.Summary)
+	return postJSON(ctx, n.WebhookURL, map[string]string{"text": text})
+}
+
+// PagerDutyNotifier sends alerts to the PagerDuty events v2 api, using the
+// alert key as the dedup key so resolves close the right incident
+type PagerDutyNotifier struct {
+	RoutingKey string
+}
+
+func (n *PagerDutyNotifier) Name() string {
+	return "pagerduty"
+}
+
+type pagerDutyPayload struct {
+	Summary   string `json:"summary"`
+	Source    string `json:"source"`
+	Severity  string `json:"severity"`
+	Timestamp string `json:"timestamp"`
+	Component string `json:"component"`
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+func (n *PagerDutyNotifier) Notify(ctx context.Context, a *Alert) error {
+	ev := &pagerDutyEvent{
+		RoutingKey:  n.RoutingKey,
+		EventAction: "trigger",
+		DedupKey:    a.Source + ":" + a.Key,
+	}
+
+	if a.Status == StatusResolved {
+		ev.EventAction = "resolve"
+	} else {
+		ev.Payload = &pagerDutyPayload{
+			Summary:   a.Summary,
+			Source:    a.Source,
+			Severity:  string(a.Severity),
+			Timestamp: a.Time.Format(time.RFC3339),
+			Component: a.Name,
+		}
+	}
+	return postJSON(ctx, pagerDutyEventsURL, ev)
+}
+
+// WebhookNotifier posts the alert as json to an arbitrary url
+type WebhookNotifier struct {
+	URL string
+}
+
+func (n *WebhookNotifier) Name() string {
+	return "webhook"
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, a *Alert) error {
+	return postJSON(ctx, n.URL, a)
+}
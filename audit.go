@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/application-research/estuary/alerts"
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/audit"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const alertIntegrity = "integrity"
+
+// repairFetchTimeout bounds how long the blocks a content failed its audit
+// on are looked for on the network before they are retrieved from deals
+const repairFetchTimeout = 10 * time.Minute
+
+// contentAudit is how the blocks sampled from a content held up
+type contentAudit struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	Content      uint   `gorm:"index" json:"content"`
+	Location     string `json:"location"`
+	Checked      int    `json:"checked"`
+	Missing      int    `json:"missing"`
+	Corrupt      int    `json:"corrupt"`
+	SizeMismatch int    `json:"sizeMismatch"`
+	// IndexMismatch is how many blocks weren't where the CAR index of the
+	// content has them
+	IndexMismatch int `json:"indexMismatch"`
+	// Problems is the json of the blocks that failed
+	Problems    string `json:"problems,omitempty"`
+	RepairError string `json:"repairError,omitempty"`
+}
+
+// auditContents samples blocks of contents picked at random and checks
+// them where they are stored, and against the CAR index of the content
+// when one was stored. Shuttles report back with an AuditResult.
+func (s *Server) auditContents(ctx context.Context) error {
+	cfg := s.estuaryCfg.Audit
+
+	var conts []util.Content
+	if err := s.DB.WithContext(ctx).Select("id, location, cid").
+		Where("active AND NOT offloaded AND NOT pinning").
+		Order("RANDOM()").
+		Limit(cfg.Contents).
+		Find(&conts).Error; err != nil {
+		return err
+	}
+
+	byShuttle := make(map[string][]drpc.ContentAudit)
+	for _, cont := range conts {
+		var rows []struct {
+			Cid  util.DbCID
+			Size int
+		}
+		if err := s.DB.WithContext(ctx).Table("obj_refs").
+			Select("objects.cid, objects.size").
+			Joins("JOIN objects ON objects.id = obj_refs.object").
+			Where("obj_refs.content = ?", cont.ID).
+			Order("RANDOM()").
+			Limit(cfg.Blocks).
+			Scan(&rows).Error; err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			continue
+		}
+		blks := make([]audit.Block, 0, len(rows))
+		for _, r := range rows {
+			blks = append(blks, audit.Block{Cid: r.Cid.CID, Size: r.Size})
+		}
+
+		if cont.Location != constants.ContentLocationLocal {
+			byShuttle[cont.Location] = append(byShuttle[cont.Location], drpc.ContentAudit{Content: cont.ID, Root: cont.Cid.CID, Blocks: blks})
+			continue
+		}
+
+		res, err := audit.Check(ctx, s.CM.Blockstore.Get, cont.ID, blks)
+		if err != nil {
+			log.Errorf("failed to audit content %d: %s", cont.ID, err)
+			continue
+		}
+		if err := audit.CheckStoredIndex(res, s.CM.carIndexes, cont.Cid.CID, blks); err != nil {
+			log.Errorf("failed to check car index of content %d: %s", cont.ID, err)
+		}
+		s.CM.recordAudit(ctx, constants.ContentLocationLocal, res)
+	}
+
+	for handle, audits := range byShuttle {
+		if !s.CM.shuttleIsOnline(handle) {
+			continue
+		}
+		if err := s.CM.sendShuttleCommand(ctx, handle, &drpc.Command{
+			Op: drpc.CMD_AuditContent,
+			Params: drpc.CmdParams{
+				AuditContent: &drpc.AuditContent{Audits: audits},
+			},
+		}); err != nil {
+			log.Errorf("failed to send audit to shuttle %s: %s", handle, err)
+		}
+	}
+	return nil
+}
+
+func (cm *ContentManager) handleRpcAuditResult(ctx context.Context, handle string, param *drpc.AuditResult) error {
+	for i := range param.Results {
+		cm.recordAudit(ctx, handle, &param.Results[i])
+	}
+	return nil
+}
+
+// recordAudit stores the result of an audit, and repairs the content if
+// blocks of it were missing or corrupt
+func (cm *ContentManager) recordAudit(ctx context.Context, location string, res *audit.Result) {
+	row := contentAudit{
+		Content:  res.Content,
+		Location: location,
+		Checked:  res.Checked,
+	}
+	for _, p := range res.Problems {
+		switch p.Kind {
+		case audit.Missing:
+			row.Missing++
+		case audit.Corrupt:
+			row.Corrupt++
+		case audit.SizeMismatch:
+			row.SizeMismatch++
+		case audit.IndexMismatch:
+			row.IndexMismatch++
+		}
+	}
+	if len(res.Problems) > 0 {
+		b, err := json.Marshal(res.Problems)
+		if err != nil {
+			log.Errorf("failed to encode audit problems of content %d: %s", res.Content, err)
+		}
+		row.Problems = string(b)
+	}
+
+	if err := cm.DB.WithContext(ctx).Create(&row).Error; err != nil {
+		log.Errorf("failed to record audit of content %d: %s", res.Content, err)
+		return
+	}
+	if row.Missing+row.Corrupt == 0 {
+		return
+	}
+
+	log.Warnw("content failed its audit", "content", res.Content, "location", location, "missing", row.Missing, "corrupt", row.Corrupt)
+	go func() {
+		if err := cm.repairContent(context.Background(), location, res.Content, audit.Damaged(res.Problems)); err != nil {
+			cm.recordRepairError(res.Content, err)
+		}
+	}()
+}
+
+// repairContent fetches the blocks a content failed its audit on again.
+// They are looked for on the network first, with the origins of the content
+// as a hint, and otherwise retrieved from the deals of the content or of the
+// aggregate it is in. Corrupt blocks are only dropped once a good copy is in
+// hand or a retrieval from deals is about to write them again. Content on a
+// shuttle is repaired by the shuttle, which answers with a RepairFailed if
+// it can't.
+func (cm *ContentManager) repairContent(ctx context.Context, location string, contID uint, problems []audit.Problem) error {
+	var cont util.Content
+	if err := cm.DB.First(&cont, "id = ?", contID).Error; err != nil {
+		return err
+	}
+
+	var origins []*peer.AddrInfo
+	if cont.Origins != "" {
+		_ = json.Unmarshal([]byte(cont.Origins), &origins) // origins are only a hint
+	}
+
+	withDeals, deals, err := cm.repairDeals(ctx, cont)
+	if err != nil {
+		return err
+	}
+
+	if location != constants.ContentLocationLocal {
+		return cm.sendShuttleCommand(ctx, location, &drpc.Command{
+			Op: drpc.CMD_RepairContent,
+			Params: drpc.CmdParams{
+				RepairContent: &drpc.RepairContent{
+					Content:  contID,
+					Problems: problems,
+					Peers:    origins,
+					Root:     withDeals.Cid.CID,
+					Deals:    deals,
+				},
+			},
+		})
+	}
+
+	fctx, cancel := context.WithTimeout(ctx, repairFetchTimeout)
+	err = audit.Repair(fctx, cm.Blockstore, cm.fetchFromPeers(origins), problems)
+	cancel()
+	if err == nil {
+		log.Infof("repaired content %d from the network", contID)
+		return nil
+	}
+	if len(deals) == 0 {
+		return fmt.Errorf("fetching the blocks from the network failed and content %d has no deals to retrieve it from: %w", contID, err)
+	}
+
+	log.Warnf("failed to repair content %d from the network, retrieving content %d from its deals: %s", contID, withDeals.ID, err)
+	if err := audit.DropCorrupt(ctx, cm.Blockstore, problems); err != nil {
+		return err
+	}
+	return cm.retrieveContent(ctx, withDeals.ID)
+}
+
+// repairDeals returns the content whose deals a content can be retrieved
+// from, the content itself or the aggregate it is in, and those deals
+func (cm *ContentManager) repairDeals(ctx context.Context, cont util.Content) (util.Content, []drpc.StorageDeal, error) {
+	deals, err := cm.activeStorageDeals(ctx, cont.ID)
+	if err != nil || len(deals) > 0 || cont.AggregatedIn == 0 {
+		return cont, deals, err
+	}
+
+	var agg util.Content
+	if err := cm.DB.First(&agg, "id = ?", cont.AggregatedIn).Error; err != nil {
+		return cont, nil, err
+	}
+	deals, err = cm.activeStorageDeals(ctx, agg.ID)
+	return agg, deals, err
+}
+
+// fetchFromPeers fetches blocks over bitswap after connecting to peers,
+// which are only tried first, providers of the blocks are looked for too
+func (cm *ContentManager) fetchFromPeers(peers []*peer.AddrInfo) audit.Getter {
+	var connected bool
+	return func(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+		if !connected {
+			connected = true
+			for _, p := range peers {
+				if err := cm.Host.Connect(ctx, *p); err != nil {
+					log.Debugf("failed to connect to origin %s: %s", p.ID, err)
+				}
+			}
+		}
+		return cm.Node.Bitswap.GetBlock(ctx, c)
+	}
+}
+
+// recordRepairError stores why the repair after the last audit of a content
+// failed
+func (cm *ContentManager) recordRepairError(contID uint, err error) {
+	log.Errorf("failed to repair content %d after its audit: %s", contID, err)
+	if err := cm.DB.Model(&contentAudit{}).
+		Where("id = (SELECT MAX(id) FROM content_audits WHERE content = ?)", contID).
+		Update("repair_error", err.Error()).Error; err != nil {
+		log.Errorf("failed to record repair of content %d: %s", contID, err)
+	}
+}
+
+func (cm *ContentManager) handleRpcRepairFailed(ctx context.Context, handle string, param *drpc.RepairFailed) error {
+	cm.recordRepairError(param.Content, fmt.Errorf("shuttle %s: %s", handle, param.Reason))
+	return nil
+}
+
+// checkIntegrity alerts about content whose last audit found blocks missing
+// or corrupt
+func (ac *alertChecker) checkIntegrity(ctx context.Context) error {
+	th := ac.cfg.Integrity
+
+	var failed []contentAudit
+	if err := ac.s.DB.WithContext(ctx).
+		Where("created_at > ? AND missing + corrupt > 0", time.Now().Add(-th.Window)).
+		Where("NOT EXISTS (SELECT 1 FROM content_audits later WHERE later.content = content_audits.content AND later.created_at > content_audits.created_at)").
+		Find(&failed).Error; err != nil {
+		return err
+	}
+
+	firing := make(map[string]bool)
+	for _, a := range failed {
+		key := fmt.Sprintf("%s:%d", alertIntegrity, a.Content)
+		firing[key] = true
+		summary := fmt.Sprintf("%d of %d blocks sampled from content %d on %s were missing and %d corrupt", a.Missing, a.Checked, a.Content, a.Location, a.Corrupt)
+		if a.RepairError != "" {
+			summary += fmt.Sprintf(", repairing it failed: %s", a.RepairError)
+		}
+		ac.s.alerts.Fire(ctx, key, alertIntegrity, alerts.SeverityWarning, summary)
+	}
+
+	ac.s.alerts.ResolveMissing(ctx, alertIntegrity, firing)
+	return nil
+}
+
+// handleAdminListAudits godoc
+// @Summary      List content audits
+// @Description  This endpoint lists the latest audits of the blocks of stored contents, only the ones that found problems with failed=true.
+// @Tags         admin
+// @Produce      json
+// @Param        failed  query     bool  false  "Only audits that found problems"
+// @Param        limit   query     int   false  "Limit (default 100)"
+// @Success      200     {array}   contentAudit
+// @Router       /admin/cm/audits [get]
+func (s *Server) handleAdminListAudits(c echo.Context) error {
+	limit := 100
+	if l := c.QueryParam("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_QUERY_PARAM_VALUE,
+				Details: "limit must be a positive number",
+			}
+		}
+		limit = n
+	}
+
+	q := s.DB.Model(&contentAudit{})
+	if c.QueryParam("failed") == "true" {
+		q = q.Where("missing + corrupt + size_mismatch + index_mismatch > 0")
+	}
+
+	var audits []contentAudit
+	if err := q.Order("created_at desc").Limit(limit).Find(&audits).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, audits)
+}
@@ -2,10 +2,9 @@ package autoretrieve
 
 import (
 	"context"
-	"crypto/rand"
 	"fmt"
 	"io"
-	"math/big"
+	"strconv"
 	"strings"
 	"time"
 
@@ -30,10 +29,21 @@ type Autoretrieve struct {
 	Token             string `gorm:"unique"`
 	LastConnection    time.Time
 	LastAdvertisement time.Time
+	// LastAdvertisedSeq is the id in the queue of the last content
+	// advertised to the server
+	LastAdvertisedSeq uint
 	PubKey            string `gorm:"unique"`
 	Addresses         string
 }
 
+// QueuedContent is content to advertise to the autoretrieve servers, as it
+// is pinned or its deals change. Each server is sent the queue in order.
+type QueuedContent struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	ContentID uint `gorm:"index"`
+}
+
 type HeartbeatAutoretrieveResponse struct {
 	Handle            string         `json:"handle"`
 	LastConnection    time.Time      `json:"lastConnection"`
@@ -77,20 +87,36 @@ func (m *EstuaryMhIterator) Next() (multihash.Multihash, error) {
 	return curCid.Hash(), nil
 }
 
-// findNewContents takes a time.Time struct `since` and queries all CIDs
-// associated to active util.Content entries created after that time
-// Returns a list of the cid.CID created after `since`
-// Returns an error if failed
-func findNewCids(db *gorm.DB, lastAdvertisement time.Time) ([]cid.Cid, error) {
-	var newCids []cid.Cid
-	err := db.Raw(constants.QueryNewCIDs, lastAdvertisement).
-		Scan(&newCids).
-		Error
-	if err != nil {
-		return nil, fmt.Errorf("unable to query new CIDs from database: %s", err)
+// queuedCids returns the cids of the content queued after seq from and up
+// to seq to
+func queuedCids(db *gorm.DB, from, to uint) ([]cid.Cid, error) {
+	var cids []cid.Cid
+	if err := db.Raw(constants.QueryQueuedCIDs, from, to).Scan(&cids).Error; err != nil {
+		return nil, fmt.Errorf("unable to query queued CIDs from database: %s", err)
 	}
+	return cids, nil
+}
 
-	return newCids, nil
+// contextID is the context of the advertisement of a range of the queue.
+// Context ids are at most 64 bytes.
+func contextID(ar Autoretrieve, from, to uint) []byte {
+	return []byte(fmt.Sprintf("%s_%d_%d", ar.Handle, from, to))
+}
+
+func parseContextID(id []byte) (from, to uint, err error) {
+	parts := strings.Split(string(id), "_")
+	if len(parts) != 3 {
+		return 0, 0, fmt.Errorf("invalid context id %q", id)
+	}
+	f, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid context id %q", id)
+	}
+	t, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid context id %q", id)
+	}
+	return uint(f), uint(t), nil
 }
 
 // newIndexProvider creates a new index-provider engine to send announcements to storetheindex
@@ -111,39 +137,51 @@ func NewAutoretrieveEngine(ctx context.Context, cfg *config.Estuary, db *gorm.DB
 	// this needs to keep running continuously because storetheindex
 	// will come to fetch for advertisements "when it feels like it"
 	newEngine.RegisterMultihashLister(func(ctx context.Context, contextID []byte) (provider.MultihashIterator, error) {
+		if isIPNIContextID(contextID) {
+			cids, err := newEngine.ipniCids(ctx, contextID)
+			if err != nil {
+				return nil, err
+			}
+			if len(cids) == 0 {
+				return nil, fmt.Errorf("no new CIDs to announce")
+			}
+			return &EstuaryMhIterator{Cids: cids}, nil
+		}
 
-		// contextID = autoretrievehandle_randomnumber
-		arHandle := strings.Split(string(contextID), "_")[0]
-		// arHandle := contextID // contextID is the autoretrieve handle
-
-		// get the autoretrieve entry from the database
-		var ar Autoretrieve
-		err = db.Find(&ar, "handle = ?", arHandle).Error
+		// contextID = autoretrievehandle_from_to
+		from, to, err := parseContextID(contextID)
 		if err != nil {
 			return nil, err
 		}
 
-		// find all new content entries since the last time we advertised for this autoretrieve server
-		log.Debugf("Querying for new CIDs now (this could take a while)")
-		newCids, err := findNewCids(db, ar.LastAdvertisement)
+		log.Debugf("Querying for queued CIDs now (this could take a while)")
+		cids, err := queuedCids(db, from, to)
 		if err != nil {
 			return nil, err
 		}
-
-		if len(newCids) == 0 {
+		if len(cids) == 0 {
 			return nil, fmt.Errorf("no new CIDs to announce")
 		}
 
-		log.Infof("announcing %d new CIDs", len(newCids))
-
+		log.Infof("announcing %d new CIDs", len(cids))
 		return &EstuaryMhIterator{
-			Cids: newCids,
+			Cids: cids,
 		}, nil
 	})
 
 	newEngine.context = ctx
 	newEngine.TickInterval = time.Duration(cfg.Node.IndexerTickInterval) * time.Minute
 	newEngine.db = db
+	newEngine.batchSize = cfg.Autoretrieve.BatchSize
+	if newEngine.batchSize <= 0 {
+		newEngine.batchSize = 1000
+	}
+	newEngine.batchDelay = cfg.Autoretrieve.BatchDelay
+	newEngine.queued = make(chan struct{}, 1)
+
+	if err := backfillQueue(db); err != nil {
+		return nil, err
+	}
 
 	// start engine
 	if err := newEngine.Start(newEngine.context); err != nil {
@@ -153,14 +191,65 @@ func NewAutoretrieveEngine(ctx context.Context, cfg *config.Estuary, db *gorm.DB
 	return newEngine, nil
 }
 
-func (arEng *AutoretrieveEngine) announceForAR(ar Autoretrieve) error {
-	// TODO: every contextID needs to be unique but we can't use more than 64 chars for it. Make this better (fix the code in RegisterMultihashLister when we change this)
-	nBig, err := rand.Int(rand.Reader, big.NewInt(10000000000))
-	if err != nil {
-		panic(err)
+// the backfill queues this many contents per insert
+const backfillBatch = 5000
+
+// backfillQueue queues all active content when the queue is new, so
+// content pinned before there was a queue is advertised too
+func backfillQueue(db *gorm.DB) error {
+	var n int64
+	if err := db.Model(&QueuedContent{}).Limit(1).Count(&n).Error; err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	var last uint
+	for {
+		var ids []uint
+		if err := db.Raw("SELECT id FROM contents WHERE active AND deleted_at IS NULL AND id > ? ORDER BY id LIMIT ?", last, backfillBatch).
+			Scan(&ids).Error; err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		queued := make([]QueuedContent, 0, len(ids))
+		for _, id := range ids {
+			queued = append(queued, QueuedContent{ContentID: id})
+		}
+		if err := db.Create(&queued).Error; err != nil {
+			return err
+		}
+		last = ids[len(ids)-1]
 	}
-	newContextID := []byte(ar.Handle + "_" + nBig.String())
+}
 
+// Enqueue queues content to be advertised to the autoretrieve servers in
+// the next batch. Content is queued again when it changes, to be
+// advertised again.
+func (arEng *AutoretrieveEngine) Enqueue(ctx context.Context, contents ...uint) error {
+	if len(contents) == 0 {
+		return nil
+	}
+	queued := make([]QueuedContent, 0, len(contents))
+	for _, c := range contents {
+		queued = append(queued, QueuedContent{ContentID: c})
+	}
+	if err := arEng.db.WithContext(ctx).Create(&queued).Error; err != nil {
+		return err
+	}
+
+	select {
+	case arEng.queued <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// announceForAR advertises the queue to ar from where it is at, in batches
+func (arEng *AutoretrieveEngine) announceForAR(ar Autoretrieve) error {
 	retrievalAddresses := []string{}
 	providerID := ""
 	for _, fullAddr := range strings.Split(ar.Addresses, ",") {
@@ -179,64 +268,103 @@ func (arEng *AutoretrieveEngine) announceForAR(ar Autoretrieve) error {
 		return fmt.Errorf("no retrieval addresses for autoretrieve %s, skipping", ar.Handle)
 	}
 
-	log.Infof("sending announcement to %s", ar.Handle)
-	adCid, err := arEng.NotifyPut(context.Background(), newContextID, providerID, retrievalAddresses, metadata.New(metadata.Bitswap{}))
-	if err != nil {
-		return fmt.Errorf("could not announce new CIDs: %s", err)
-	}
+	for {
+		var seqs []uint
+		if err := arEng.db.Model(&QueuedContent{}).Where("id > ?", ar.LastAdvertisedSeq).
+			Order("id asc").Limit(arEng.batchSize).Pluck("id", &seqs).Error; err != nil {
+			return fmt.Errorf("unable to query the advertisement queue: %s", err)
+		}
+		if len(seqs) == 0 {
+			return nil
+		}
+		from, to := ar.LastAdvertisedSeq, seqs[len(seqs)-1]
 
-	// update lastAdvertisement time on database
-	if err := arEng.db.Model(&Autoretrieve{}).Where("token = ?", ar.Token).UpdateColumn("last_advertisement", time.Now()).Error; err != nil {
-		return fmt.Errorf("unable to update advertisement time on database: %s", err)
-	}
+		// content removed since it was queued leaves nothing to advertise
+		cids, err := queuedCids(arEng.db, from, to)
+		if err != nil {
+			return err
+		}
+		if len(cids) > 0 {
+			log.Infof("sending announcement to %s", ar.Handle)
+			ctxID := contextID(ar, from, to)
+			adCid, err := arEng.NotifyPut(context.Background(), ctxID, providerID, retrievalAddresses, metadata.New(metadata.Bitswap{}))
+			if err != nil && err != provider.ErrAlreadyAdvertised {
+				return fmt.Errorf("could not announce new CIDs: %s", err)
+			}
+			log.Infof("announced %d new CIDs: %s", len(cids), adCid)
+			if err := RecordAdvertised(context.Background(), arEng.db, ctxID, from, to); err != nil {
+				return err
+			}
+		}
 
-	log.Infof("announced new CIDs: %s", adCid)
-	return nil
+		if err := arEng.db.Model(&Autoretrieve{}).Where("token = ?", ar.Token).UpdateColumns(map[string]interface{}{
+			"last_advertisement":  time.Now(),
+			"last_advertised_seq": to,
+		}).Error; err != nil {
+			return fmt.Errorf("unable to update advertisement time on database: %s", err)
+		}
+		ar.LastAdvertisedSeq = to
+	}
 }
 
+// Run advertises to the autoretrieve servers that are online every tick,
+// and a batch delay after content is queued
 func (arEng *AutoretrieveEngine) Run() {
-	var autoretrieves []Autoretrieve
-	var lastTickTime time.Time
-	var curTime time.Time
-
-	// start ticker
 	ticker := time.NewTicker(arEng.TickInterval)
 	defer ticker.Stop()
 
 	for {
-		curTime = time.Now()
-		lastTickTime = curTime.Add(-arEng.TickInterval)
 		// Find all autoretrieve servers that are online (that sent heartbeat)
-		err := arEng.db.Find(&autoretrieves, "last_connection > ?", lastTickTime).Error
-		if err != nil {
+		var autoretrieves []Autoretrieve
+		lastTickTime := time.Now().Add(-arEng.TickInterval)
+		if err := arEng.db.Find(&autoretrieves, "last_connection > ?", lastTickTime).Error; err != nil {
 			log.Errorf("unable to query autoretrieve servers from database: %s", err)
-			return
-		}
-		if len(autoretrieves) == 0 {
+		} else if len(autoretrieves) == 0 {
 			log.Infof("no autoretrieve servers online")
-			// wait for next tick, or quit
-			select {
-			case <-ticker.C:
-				continue
-			case <-arEng.context.Done():
-				break
+		} else {
+			log.Infof("announcing new CIDs to %d autoretrieve servers", len(autoretrieves))
+			for _, ar := range autoretrieves {
+				if err := arEng.announceForAR(ar); err != nil {
+					log.Error(err)
+				}
 			}
 		}
 
-		log.Infof("announcing new CIDs to %d autoretrieve servers", len(autoretrieves))
-		// send announcement with new CIDs for each autoretrieve server
-		for _, ar := range autoretrieves {
-			if err = arEng.announceForAR(ar); err != nil {
-				log.Error(err)
+		// wait for next tick or a batch to fill up, or quit
+		select {
+		case <-ticker.C:
+		case <-arEng.queued:
+			if !arEng.waitForBatch() {
+				return
 			}
+		case <-arEng.context.Done():
+			return
+		}
+	}
+}
+
+// waitForBatch waits for the batch delay, or less if a batch fills up,
+// false if the engine was stopped
+func (arEng *AutoretrieveEngine) waitForBatch() bool {
+	timer := time.NewTimer(arEng.batchDelay)
+	defer timer.Stop()
+	for {
+		var n int64
+		// servers that are offline don't hold a batch up, nor does the queue
+		// fill a batch when none is online
+		if err := arEng.db.Model(&QueuedContent{}).
+			Where("id > (SELECT COALESCE(MIN(last_advertised_seq), (SELECT COALESCE(MAX(id), 0) FROM queued_contents)) FROM autoretrieves WHERE deleted_at IS NULL AND last_connection > ?)",
+				time.Now().Add(-arEng.TickInterval)).
+			Count(&n).Error; err == nil && int(n) >= arEng.batchSize {
+			return true
 		}
 
-		// wait for next tick, or quit
 		select {
-		case <-ticker.C:
-			continue
+		case <-timer.C:
+			return true
+		case <-arEng.queued:
 		case <-arEng.context.Done():
-			break
+			return false
 		}
 	}
 }
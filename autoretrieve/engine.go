@@ -51,6 +51,11 @@ type AutoretrieveEngine struct {
 	context      context.Context
 	TickInterval time.Duration
 	db           *gorm.DB
+
+	batchSize  int
+	batchDelay time.Duration
+	// queued is signalled when content is queued
+	queued chan struct{}
 }
 
 // var _ provider.Interface = (*AutoretrieveEngine)(nil)
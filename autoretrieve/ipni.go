@@ -0,0 +1,149 @@
+package autoretrieve
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	provider "github.com/filecoin-project/index-provider"
+	"github.com/filecoin-project/index-provider/metadata"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"gorm.io/gorm"
+)
+
+// IPNIProvider is the node advertised to the indexers as the provider of
+// the content held on it
+type IPNIProvider struct {
+	ID        uint `gorm:"primarykey"`
+	UpdatedAt time.Time
+
+	Location string `gorm:"uniqueIndex"`
+	PeerID   string
+	// LastAdvertisedSeq is the id in the queue of the last content
+	// advertised for the provider
+	LastAdvertisedSeq uint
+}
+
+const ipniContextPrefix = "ipni"
+
+// IPNIContextID is the context of an advertisement of the content queued
+// in a range of the queue
+func IPNIContextID(from, to uint) []byte {
+	return []byte(fmt.Sprintf("%s_%d_%d", ipniContextPrefix, from, to))
+}
+
+// ParseIPNIContextID returns the range of the queue an advertisement was
+// made for
+func ParseIPNIContextID(id []byte) (from, to uint, err error) {
+	parts := strings.Split(string(id), "_")
+	if len(parts) != 3 || parts[0] != ipniContextPrefix {
+		return 0, 0, fmt.Errorf("invalid context id %q", id)
+	}
+	var n [2]uint
+	for i, p := range parts[1:] {
+		v, err := strconv.ParseUint(p, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid context id %q", id)
+		}
+		n[i] = uint(v)
+	}
+	return n[0], n[1], nil
+}
+
+func isIPNIContextID(id []byte) bool {
+	return strings.HasPrefix(string(id), ipniContextPrefix+"_")
+}
+
+// PublicAddrs returns the addresses the indexers can hand out to clients,
+// private and loopback ones are of no use to anyone else
+func PublicAddrs(addrs []multiaddr.Multiaddr) []string {
+	var out []string
+	for _, a := range addrs {
+		if manet.IsPublicAddr(a) {
+			out = append(out, a.String())
+		}
+	}
+	return out
+}
+
+// queuedLocalCids returns the cids of the content held on the primary
+// queued after seq from and up to seq to
+func queuedLocalCids(db *gorm.DB, from, to uint) ([]cid.Cid, error) {
+	var cids []cid.Cid
+	if err := db.Raw(constants.QueryQueuedCIDsAt, from, to, constants.ContentLocationLocal).Scan(&cids).Error; err != nil {
+		return nil, fmt.Errorf("unable to query queued CIDs from database: %s", err)
+	}
+	return cids, nil
+}
+
+func (arEng *AutoretrieveEngine) ipniCids(ctx context.Context, contextID []byte) ([]cid.Cid, error) {
+	from, to, err := ParseIPNIContextID(contextID)
+	if err != nil {
+		return nil, err
+	}
+	return queuedLocalCids(arEng.db.WithContext(ctx), from, to)
+}
+
+// AnnounceIPNI advertises the content queued since the last announcement
+// that is held on the primary, with the primary as its provider so the
+// advertisements are signed by the node that serves the content, in
+// batches
+func (arEng *AutoretrieveEngine) AnnounceIPNI(ctx context.Context, id peer.ID, addrs []string) error {
+	if len(addrs) == 0 {
+		return fmt.Errorf("no public addresses to advertise")
+	}
+
+	p := IPNIProvider{Location: constants.ContentLocationLocal}
+	if err := arEng.db.WithContext(ctx).Where("location = ?", p.Location).FirstOrCreate(&p).Error; err != nil {
+		return err
+	}
+	if p.PeerID != "" && p.PeerID != id.String() {
+		// a node with a new identity is a new provider, all of its content
+		// is advertised again
+		p.LastAdvertisedSeq = 0
+	}
+
+	for {
+		var seqs []uint
+		if err := arEng.db.WithContext(ctx).Model(&QueuedContent{}).Where("id > ?", p.LastAdvertisedSeq).
+			Order("id asc").Limit(arEng.batchSize).Pluck("id", &seqs).Error; err != nil {
+			return fmt.Errorf("unable to query the advertisement queue: %s", err)
+		}
+		if len(seqs) == 0 {
+			return nil
+		}
+		from, to := p.LastAdvertisedSeq, seqs[len(seqs)-1]
+
+		cids, err := queuedLocalCids(arEng.db.WithContext(ctx), from, to)
+		if err != nil {
+			return err
+		}
+		if len(cids) > 0 {
+			ctxID := IPNIContextID(from, to)
+			adCid, err := arEng.NotifyPut(ctx, ctxID, id.String(), addrs, metadata.New(metadata.Bitswap{}))
+			if err != nil && err != provider.ErrAlreadyAdvertised {
+				return fmt.Errorf("could not advertise content: %s", err)
+			}
+			log.Infof("advertised %d CIDs to the indexers: %s", len(cids), adCid)
+			if err := RecordAdvertised(ctx, arEng.db, ctxID, from, to); err != nil {
+				return err
+			}
+		}
+
+		if err := arEng.db.WithContext(ctx).Model(&IPNIProvider{}).Where("id = ?", p.ID).UpdateColumns(map[string]interface{}{
+			"peer_id":             id.String(),
+			"last_advertised_seq": to,
+			"updated_at":          time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+		p.LastAdvertisedSeq = to
+		p.PeerID = id.String()
+	}
+}
@@ -0,0 +1,94 @@
+package autoretrieve
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	provider "github.com/filecoin-project/index-provider"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// AdvertisedRange is a range of an advertisement queue that was advertised
+// under a context, so the advertisement can be removed once content in it
+// is removed
+type AdvertisedRange struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	ContextID string `gorm:"uniqueIndex"`
+	FromSeq   uint
+	ToSeq     uint `gorm:"index"`
+}
+
+// RecordAdvertised records that the range (from, to] of a queue was
+// advertised under contextID
+func RecordAdvertised(ctx context.Context, db *gorm.DB, contextID []byte, from, to uint) error {
+	return db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&AdvertisedRange{
+		ContextID: string(contextID),
+		FromSeq:   from,
+		ToSeq:     to,
+	}).Error
+}
+
+// RemoveAdvertised publishes the removal of the advertisements of the
+// ranges holding any of seqs, and returns those ranges so what else was
+// advertised in them can be queued again
+func (arEng *AutoretrieveEngine) RemoveAdvertised(ctx context.Context, db *gorm.DB, seqs []uint) ([]AdvertisedRange, error) {
+	var removed []AdvertisedRange
+	for _, seq := range seqs {
+		var ranges []AdvertisedRange
+		if err := db.WithContext(ctx).Find(&ranges, "from_seq < ? AND to_seq >= ?", seq, seq).Error; err != nil {
+			return removed, err
+		}
+		for _, r := range ranges {
+			if _, err := arEng.NotifyRemove(ctx, []byte(r.ContextID)); err != nil && err != provider.ErrContextIDNotFound {
+				return removed, fmt.Errorf("could not remove advertisement %s: %s", r.ContextID, err)
+			}
+			if err := db.WithContext(ctx).Delete(&AdvertisedRange{}, r.ID).Error; err != nil {
+				return removed, err
+			}
+			removed = append(removed, r)
+		}
+	}
+	return removed, nil
+}
+
+// Retract removes the advertisements of removed contents, to the
+// autoretrieve servers and the indexers, and queues the rest of the content
+// they were advertised along with to be advertised again
+func (arEng *AutoretrieveEngine) Retract(ctx context.Context, contents ...uint) error {
+	if len(contents) == 0 {
+		return nil
+	}
+
+	var seqs []uint
+	if err := arEng.db.WithContext(ctx).Model(&QueuedContent{}).Where("content_id IN ?", contents).Pluck("id", &seqs).Error; err != nil {
+		return err
+	}
+	ranges, err := arEng.RemoveAdvertised(ctx, arEng.db, seqs)
+	if err != nil {
+		return err
+	}
+	if err := arEng.db.WithContext(ctx).Where("content_id IN ?", contents).Delete(&QueuedContent{}).Error; err != nil {
+		return err
+	}
+
+	seen := make(map[uint]bool)
+	var requeue []uint
+	for _, r := range ranges {
+		var ids []uint
+		if err := arEng.db.WithContext(ctx).Model(&QueuedContent{}).Where("id > ? AND id <= ?", r.FromSeq, r.ToSeq).
+			Distinct().Pluck("content_id", &ids).Error; err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if !seen[id] {
+				seen[id] = true
+				requeue = append(requeue, id)
+			}
+		}
+	}
+	return arEng.Enqueue(ctx, requeue...)
+}
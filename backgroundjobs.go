@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/application-research/estuary/jobs"
+	"github.com/application-research/estuary/util"
+)
+
+const maxConcurrentJobs = 4
+
+// registerJobs registers all of the periodic background work of the node
+// with the job scheduler, so it can be inspected and controlled from the
+// admin api
+func (s *Server) registerJobs() {
+	cfg := s.estuaryCfg
+
+	s.jobs.Register(&jobs.Job{
+		Name:        "node-metrics",
+		Description: "samples deal, shuttle, blockstore and transfer metrics",
+		Interval:    nodeMetricsInterval,
+		RunOnStart:  true,
+		Run:         s.recordNodeMetrics,
+	})
+
+	s.jobs.Register(&jobs.Job{
+		Name:        "usage-recorder",
+		Description: "records a sample of every users usage for the usage history",
+		Interval:    usageSampleInterval,
+		LeaderOnly:  true,
+		Run:         s.recordUsage,
+	})
+
+	if cfg.Billing.Enabled {
+		s.jobs.Register(&jobs.Job{
+			Name:        "usage-billing",
+			Description: "reports the usage of every account to the billing systems once a month is over",
+			Interval:    time.Hour,
+			LeaderOnly:  true,
+			Run:         s.billUsage,
+		})
+	}
+
+	if s.egress != nil {
+		s.jobs.Register(&jobs.Job{
+			Name:        "egress-flush",
+			Description: "adds the bytes served since the last flush to the egress records of users",
+			Interval:    cfg.Egress.FlushInterval,
+			Run:         s.egress.flush,
+		})
+	}
+
+	if s.notifier != nil {
+		s.jobs.Register(&jobs.Job{
+			Name:        "notification-checks",
+			Description: "queues emails about failed pins, missing deals, nearly used quotas and expiring api keys",
+			Interval:    cfg.Notifications.CheckInterval,
+			LeaderOnly:  true,
+			Run:         s.checkNotifications,
+		})
+		s.jobs.Register(&jobs.Job{
+			Name:        "notification-emails",
+			Description: "mails the queued notifications of each user",
+			Interval:    cfg.Notifications.SendInterval,
+			LeaderOnly:  true,
+			Run:         s.notifier.send,
+		})
+	}
+
+	if cfg.Denylist.Enabled {
+		s.jobs.Register(&jobs.Job{
+			Name:        "denylist-refresh",
+			Description: "reloads the denylists and the entries operators added",
+			Interval:    cfg.Denylist.RefreshInterval,
+			RunOnStart:  true,
+			Run:         s.CM.denylist.refresh,
+		})
+	}
+
+	if s.CM.scanner != nil {
+		s.jobs.Register(&jobs.Job{
+			Name:        "content-scans",
+			Description: "retries scans of content that failed or were cut short",
+			Interval:    cfg.Scanning.Timeout,
+			LeaderOnly:  true,
+			Run:         s.runScans,
+		})
+	}
+
+	if cfg.IPNI.Enabled {
+		s.jobs.Register(&jobs.Job{
+			Name:        "ipni-announce",
+			Description: "advertises the content held on the primary to the network indexers",
+			Interval:    cfg.IPNI.Interval,
+			LeaderOnly:  true,
+			Run:         s.announceIPNI,
+		})
+	}
+
+	if cfg.Reprovide.Enabled {
+		s.jobs.Register(&jobs.Job{
+			Name:        "reprovide",
+			Description: "provides the contents that are due, recent and most requested first",
+			Interval:    cfg.Reprovide.RoundInterval,
+			LeaderOnly:  true,
+			Run:         s.CM.reprovide,
+		})
+	}
+
+	if s.cdn != nil {
+		s.jobs.Register(&jobs.Job{
+			Name:        "cdn-register",
+			Description: "registers newly pinned public content with the retrieval cdn",
+			Interval:    cfg.CDN.RegisterInterval,
+			LeaderOnly:  true,
+			Run:         s.registerCDN,
+		})
+		s.jobs.Register(&jobs.Job{
+			Name:        "cdn-deregister",
+			Description: "deregisters content that was deleted, made private or denylisted from the retrieval cdn",
+			Interval:    cfg.CDN.RegisterInterval,
+			LeaderOnly:  true,
+			Run:         s.deregisterCDN,
+		})
+	}
+
+	if s.retrievals != nil {
+		s.jobs.Register(&jobs.Job{
+			Name:        "retrieval-flush",
+			Description: "adds the retrievals since the last flush to the hourly retrieval counts",
+			Interval:    cfg.Tiering.FlushInterval,
+			Run:         s.retrievals.flush,
+		})
+	}
+
+	if cfg.Tiering.Enabled {
+		s.jobs.Register(&jobs.Job{
+			Name:        "content-tiering",
+			Description: "marks often retrieved content hot and the rest cold, and brings back hot content that was offloaded",
+			Interval:    cfg.Tiering.Interval,
+			LeaderOnly:  true,
+			Run:         s.tierContents,
+		})
+	}
+
+	if cfg.ColdOffload.Enabled {
+		s.jobs.Register(&jobs.Job{
+			Name:        "cold-offload",
+			Description: "unpins the local copies of content with sealed deals that wasn't retrieved for a while",
+			Interval:    cfg.ColdOffload.Interval,
+			LeaderOnly:  true,
+			Run: func(ctx context.Context) error {
+				if err := s.offloadCold(ctx); err != nil {
+					return err
+				}
+				return s.pruneRetrievals(ctx)
+			},
+		})
+	}
+
+	if cfg.DealProgress.Enabled {
+		s.jobs.Register(&jobs.Job{
+			Name:        "deal-progress",
+			Description: "asks storage providers for the transfer and sealing state of deals that aren't sealed yet",
+			Interval:    cfg.DealProgress.Interval,
+			LeaderOnly:  true,
+			Run:         s.pollDealProgress,
+		})
+	}
+
+	if cfg.Redeal.Enabled {
+		s.jobs.Register(&jobs.Job{
+			Name:        "redeal",
+			Description: "puts content whose deals all ran out or failed back into the deal pipeline",
+			Interval:    cfg.Redeal.Interval,
+			LeaderOnly:  true,
+			Run:         s.redealContents,
+		})
+	}
+
+	if cfg.Audit.Enabled {
+		s.jobs.Register(&jobs.Job{
+			Name:        "integrity-audit",
+			Description: "checks blocks sampled from stored contents for ones that went missing or no longer match their cid",
+			Interval:    cfg.Audit.Interval,
+			LeaderOnly:  true,
+			Run:         s.auditContents,
+		})
+	}
+
+	s.jobs.Register(&jobs.Job{
+		Name:        "purges",
+		Description: "runs purges of content that were not started or were cut short",
+		Interval:    time.Minute,
+		LeaderOnly:  true,
+		Run:         s.runPurges,
+	})
+
+	s.jobs.Register(&jobs.Job{
+		Name:        "feature-flags-refresh",
+		Description: "picks up feature flag changes made through other instances",
+		Interval:    featureFlagRefreshInterval,
+		Run:         s.flags.Refresh,
+	})
+
+	s.jobs.Register(&jobs.Job{
+		Name:        "garbage-collect",
+		Description: "removes blocks that are no longer referenced by any content from the blockstore",
+		Run:         s.CM.GarbageCollect,
+	})
+
+	// with filecoin storage disabled no deals are made until an operator
+	// resumes these
+	s.jobs.Register(&jobs.Job{
+		Name:        "deal-checks",
+		Description: "checks the contents queued for a check and makes the deals they are missing",
+		Interval:    contentCheckInterval,
+		RunOnStart:  true,
+		LeaderOnly:  true,
+		Paused:      cfg.DisableFilecoinStorage,
+		Run:         s.CM.checkContents,
+	})
+	s.jobs.Register(&jobs.Job{
+		Name:        "staging-aggregation",
+		Description: "aggregates staging zones that are ready into content for deals",
+		Interval:    time.Minute * 5,
+		LeaderOnly:  true,
+		Paused:      cfg.DisableFilecoinStorage,
+		Run:         s.CM.aggregateReadyStagingZones,
+	})
+
+	if s.alerts.Enabled() {
+		s.alertChecker = newAlertChecker(s)
+		s.jobs.Register(&jobs.Job{
+			Name:        "alert-checks",
+			Description: "evaluates alert conditions and sends notifications",
+			Interval:    cfg.Alerts.CheckInterval,
+			LeaderOnly:  true,
+			Run:         s.alertChecker.check,
+		})
+	}
+
+	if cfg.DiskPressure.Enabled {
+		s.diskMon.OnChange = s.onDiskPressureChange
+		s.jobs.Register(&jobs.Job{
+			Name:        "disk-pressure",
+			Description: "checks free disk space and throttles content intake when it runs low",
+			Interval:    cfg.DiskPressure.CheckInterval,
+			RunOnStart:  true,
+			Run: func(ctx context.Context) error {
+				s.diskMon.Check()
+				return nil
+			},
+		})
+	}
+
+	if s.CM.remotePins != nil {
+		s.jobs.Register(&jobs.Job{
+			Name:        "remote-pin-status",
+			Description: "polls the remote pinning service for the status of delegated pins",
+			Interval:    cfg.RemotePinning.PollInterval,
+			LeaderOnly:  true,
+			Run:         s.CM.pollRemotePins,
+		})
+	}
+
+	if s.CM.cluster != nil {
+		s.jobs.Register(&jobs.Job{
+			Name:        "cluster-pin-status",
+			Description: "polls ipfs-cluster for the status of the pins submitted to it",
+			Interval:    cfg.Cluster.PollInterval,
+			LeaderOnly:  true,
+			Run:         s.CM.pollClusterPins,
+		})
+	}
+
+	s.jobs.Register(&jobs.Job{
+		Name:        "boost-transfer-expiry",
+		Description: "drops the expired links storage providers fetch deal data with",
+		Interval:    time.Hour,
+		LeaderOnly:  true,
+		Run:         s.CM.expireBoostTransfers,
+	})
+
+	if cfg.OIDC.Enabled {
+		s.jobs.Register(&jobs.Job{
+			Name:        "oidc-login-expiry",
+			Description: "drops identity provider logins users never came back from",
+			Interval:    time.Hour,
+			LeaderOnly:  true,
+			Run:         s.expireOIDCLogins,
+		})
+	}
+
+	if cfg.SIWE.Enabled {
+		s.jobs.Register(&jobs.Job{
+			Name:        "siwe-nonce-expiry",
+			Description: "drops the used sign in with ethereum nonces once they expired",
+			Interval:    time.Hour,
+			LeaderOnly:  true,
+			Run:         s.expireSIWENonces,
+		})
+	}
+
+	if cfg.Deal.Datacap.Enabled && cfg.Deal.Verified {
+		s.jobs.Register(&jobs.Job{
+			Name:        "datacap-refresh",
+			Description: "keeps the datacap left to the node up to date for deal making",
+			Interval:    cfg.Deal.Datacap.CheckInterval,
+			Run:         s.refreshDatacapJob,
+		})
+		s.jobs.Register(&jobs.Job{
+			Name:        "datacap-check",
+			Description: "checks the datacap left to the node and alerts when it runs low or runs out",
+			Interval:    cfg.Deal.Datacap.CheckInterval,
+			LeaderOnly:  true,
+			Run:         s.checkDatacap,
+		})
+	}
+
+	if s.CM.fvm != nil {
+		s.jobs.Register(&jobs.Job{
+			Name:        "fvm-deal-attestations",
+			Description: "sends deal attestations to the fvm contract and checks their transactions",
+			Interval:    cfg.FVM.PollInterval,
+			LeaderOnly:  true,
+			Run:         s.CM.sendDealAttestations,
+		})
+	}
+
+	if cfg.PaidRetrieval.Enabled {
+		s.jobs.Register(&jobs.Job{
+			Name:        "paych-settle",
+			Description: "submits the retrieval vouchers of payment channels that are settling and alerts on them",
+			Interval:    cfg.PaidRetrieval.SettleCheckInterval,
+			LeaderOnly:  true,
+			Run:         s.submitSettlingVouchers,
+		})
+	}
+
+	if cfg.S3.Enabled {
+		s.jobs.Register(&jobs.Job{
+			Name:        "s3-upload-expiry",
+			Description: "drops s3 multipart uploads that were never completed",
+			Interval:    time.Hour,
+			Run:         s.expireS3Uploads,
+		})
+	}
+}
+
+// handleAdminListJobs godoc
+// @Summary      List background jobs
+// @Description  This endpoint lists every background job of the node with its schedule and the result of its last run.
+// @Tags         admin
+// @Produce      json
+// @Success      200  {array}  jobs.Status
+// @Router       /admin/jobs [get]
+func (s *Server) handleAdminListJobs(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.jobs.Status())
+}
+
+// handleAdminJobAction godoc
+// @Summary      Control a background job
+// @Description  This endpoint pauses, resumes or immediately runs a background job. Action must be one of pause, resume or run.
+// @Tags         admin
+// @Produce      json
+// @Param        name    path  string  true  "Job name"
+// @Param        action  path  string  true  "pause, resume or run"
+// @Success      200  {object}  jobs.Status
+// @Router       /admin/jobs/{name}/{action} [post]
+func (s *Server) handleAdminJobAction(c echo.Context) error {
+	name := c.Param("name")
+
+	var err error
+	switch c.Param("action") {
+	case "pause":
+		err = s.jobs.Pause(name)
+	case "resume":
+		err = s.jobs.Resume(name)
+	case "run":
+		err = s.jobs.Trigger(name)
+	default:
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "action must be one of pause, resume or run",
+		}
+	}
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+
+	st, err := s.jobs.JobStatus(name)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, st)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/application-research/estuary/autoretrieve"
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/featureflags"
+	"github.com/application-research/estuary/pinner"
+	"github.com/application-research/estuary/util"
+)
+
+// backupTables lists the tables that make up the state of the node, in the
+// order they are restored. The pin queue of the node is rebuilt on startup
+// from contents that are still pinning, so it comes along with the contents
+// table, and pins that failed for good are in the dead-letter queue. The
+// shared pin queue is included when it lives in the node's own database.
+func backupTables(cfg *config.Estuary) []util.BackupTable {
+	tables := []util.BackupTable{
+		{Name: "users", Model: &User{}},
+		{Name: "auth_tokens", Model: &AuthToken{}},
+		{Name: "invite_codes", Model: &InviteCode{}},
+		{Name: "user_origins", Model: &userOrigin{}},
+		{Name: "shuttles", Model: &Shuttle{}},
+		{Name: "contents", Model: &util.Content{}},
+		{Name: "objects", Model: &util.Object{}},
+		{Name: "obj_refs", Model: &util.ObjRef{}},
+		{Name: "collections", Model: &Collection{}},
+		{Name: "collection_refs", Model: &CollectionRef{}},
+		{Name: "organizations", Model: &Organization{}},
+		{Name: "org_members", Model: &orgMember{}},
+		{Name: "content_deals", Model: &contentDeal{}},
+		{Name: "dfe_records", Model: &dfeRecord{}},
+		{Name: "piece_comm_records", Model: &PieceCommRecord{}},
+		{Name: "proposal_records", Model: &proposalRecord{}},
+		{Name: "retrieval_failure_records", Model: &util.RetrievalFailureRecord{}},
+		{Name: "retrieval_success_records", Model: &retrievalSuccessRecord{}},
+		{Name: "storage_miners", Model: &storageMiner{}},
+		{Name: "miner_storage_asks", Model: &minerStorageAsk{}},
+		{Name: "user_usage_records", Model: &userUsageRecord{}},
+		{Name: "monthly_usages", Model: &monthlyUsage{}},
+		{Name: "egress_records", Model: &egressRecord{}},
+		{Name: "org_egress_records", Model: &orgEgressRecord{}},
+		{Name: "notifications", Model: &notification{}},
+		{Name: "notification_settings", Model: &notificationSettings{}},
+		{Name: "encrypted_contents", Model: &encryptedContent{}},
+		{Name: "purge_requests", Model: &purgeRequest{}},
+		{Name: "denylist_entries", Model: &denylistEntry{}},
+		{Name: "denylist_blocks", Model: &denylistBlock{}},
+		{Name: "content_scans", Model: &contentScan{}},
+		{Name: "content_provides", Model: &contentProvide{}},
+		{Name: "retrieval_allowances", Model: &retrievalAllowance{}},
+		{Name: "paych_channels", Model: &paychChannel{}},
+		{Name: "paych_vouchers", Model: &paychVoucher{}},
+		{Name: "cdn_registrations", Model: &cdnRegistration{}},
+		{Name: "shuttle_bandwidths", Model: &shuttleBandwidth{}},
+		{Name: "shuttle_bandwidth_limits", Model: &shuttleBandwidthLimit{}},
+		{Name: "content_retrievals", Model: &contentRetrieval{}},
+		{Name: "content_tiers", Model: &contentTier{}},
+		{Name: "content_restores", Model: &contentRestore{}},
+		{Name: "deal_progresses", Model: &dealProgress{}},
+		{Name: "user_provider_rules", Model: &userProviderRule{}},
+		{Name: "deal_constraints", Model: &dealConstraint{}},
+		{Name: "content_retentions", Model: &contentRetention{}},
+		{Name: "content_redeals", Model: &contentRedeal{}},
+		{Name: "content_audits", Model: &contentAudit{}},
+		{Name: "content_dag_stats", Model: &contentDagStat{}},
+		{Name: "share_links", Model: &shareLink{}},
+		{Name: "content_names", Model: &contentName{}},
+		{Name: "content_name_versions", Model: &contentNameVersion{}},
+		{Name: "billing_accounts", Model: &billingAccount{}},
+		{Name: "content_events", Model: &contentEvent{}},
+		{Name: "storage_receipts", Model: &storageReceipt{}},
+		{Name: "dead_letters", Model: &deadLetter{}},
+		{Name: "autoretrieves", Model: &autoretrieve.Autoretrieve{}},
+		{Name: "queued_contents", Model: &autoretrieve.QueuedContent{}},
+		{Name: "ipni_providers", Model: &autoretrieve.IPNIProvider{}},
+		{Name: "advertised_ranges", Model: &autoretrieve.AdvertisedRange{}},
+		{Name: "feature_flags", Model: &featureflags.Flag{}},
+		{Name: "feature_flag_overrides", Model: &featureflags.UserOverride{}},
+	}
+
+	if cfg.PinQueue.Shared && cfg.PinQueue.DatabaseConnString == "" {
+		tables = append(tables, util.BackupTable{Name: "pin_queue_entries", Model: pinner.SharedQueueModel()})
+	}
+	return tables
+}
+
+// handleAdminBackup godoc
+// @Summary      Download a backup of the node
+// @Description  This endpoint streams a gzipped archive of the node's database tables, including its pin queues, that can be loaded on a new host with the restore command. Rows written while the backup runs may or may not be included, drain the node first for a consistent snapshot.
+// @Tags         admin
+// @Produce      application/gzip
+// @Success      200
+// @Router       /admin/backup [get]
+func (s *Server) handleAdminBackup(c echo.Context) error {
+	name := fmt.Sprintf("estuary-backup-%s.jsonl.gz", time.Now().UTC().Format("20060102-150405"))
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/gzip")
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", name))
+	res.WriteHeader(http.StatusOK)
+
+	man, err := util.WriteBackup(c.Request().Context(), s.DB, res, s.estuaryCfg.Hostname, backupTables(s.estuaryCfg))
+	if err != nil {
+		// the headers are already out, all that can be done is to cut the
+		// archive short so that restoring it fails
+		log.Errorf("backup failed: %s", err)
+		return nil
+	}
+
+	log.Infof("backup written: %v", man.Rows)
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/bwlimit"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// shuttleBandwidth is what a shuttle received and sent in an hour
+type shuttleBandwidth struct {
+	ID     uint      `gorm:"primarykey" json:"-"`
+	Handle string    `gorm:"uniqueIndex:idx_shuttle_bw_hour" json:"-"`
+	Hour   time.Time `gorm:"uniqueIndex:idx_shuttle_bw_hour" json:"hour"`
+	Ingest int64     `json:"ingest"`
+	Egress int64     `json:"egress"`
+}
+
+// shuttleBandwidthLimit is the caps set for a shuttle, as bwlimit.Limits
+// json
+type shuttleBandwidthLimit struct {
+	ID        uint `gorm:"primarykey"`
+	UpdatedAt time.Time
+
+	Handle string `gorm:"uniqueIndex"`
+	Limits string
+}
+
+// recordShuttleBandwidth adds what a shuttle reports to the hour it is in.
+// The totals it reports start over when it restarts.
+func (cm *ContentManager) recordShuttleBandwidth(ctx context.Context, handle string, ingest, egress int64) error {
+	if ingest == 0 && egress == 0 {
+		return nil
+	}
+	row := shuttleBandwidth{
+		Handle: handle,
+		Hour:   time.Now().UTC().Truncate(time.Hour),
+		Ingest: ingest,
+		Egress: egress,
+	}
+	return cm.DB.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "handle"}, {Name: "hour"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"ingest": gorm.Expr("shuttle_bandwidths.ingest + ?", ingest),
+			"egress": gorm.Expr("shuttle_bandwidths.egress + ?", egress),
+		}),
+	}).Create(&row).Error
+}
+
+func (cm *ContentManager) shuttleBandwidthLimits(ctx context.Context, handle string) (*bwlimit.Limits, error) {
+	var row shuttleBandwidthLimit
+	if err := cm.DB.WithContext(ctx).First(&row, "handle = ?", handle).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &bwlimit.Limits{}, nil
+		}
+		return nil, err
+	}
+	var l bwlimit.Limits
+	if err := json.Unmarshal([]byte(row.Limits), &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// sendBandwidthLimits tells a shuttle the caps set for it
+func (cm *ContentManager) sendBandwidthLimits(ctx context.Context, handle string) error {
+	l, err := cm.shuttleBandwidthLimits(ctx, handle)
+	if err != nil {
+		return err
+	}
+	return cm.sendShuttleCommand(ctx, handle, &drpc.Command{
+		Op: drpc.CMD_SetBandwidthLimits,
+		Params: drpc.CmdParams{
+			SetBandwidthLimits: &drpc.SetBandwidthLimits{Limits: *l},
+		},
+	})
+}
+
+type shuttleBandwidthResponse struct {
+	Limits bwlimit.Limits     `json:"limits"`
+	Usage  []shuttleBandwidth `json:"usage"`
+}
+
+func (s *Server) shuttleByHandle(c echo.Context) (*Shuttle, error) {
+	var sh Shuttle
+	if err := s.DB.First(&sh, "handle = ?", c.Param("handle")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("shuttle %s was not found", c.Param("handle")),
+			}
+		}
+		return nil, err
+	}
+	return &sh, nil
+}
+
+// handleAdminGetShuttleBandwidth godoc
+// @Summary      Get the bandwidth of a shuttle
+// @Description  This endpoint returns the bandwidth caps set for a shuttle and what it received and sent each hour of the last day.
+// @Tags         admin
+// @Produce      json
+// @Param        handle  path      string  true  "Shuttle handle"
+// @Success      200     {object}  shuttleBandwidthResponse
+// @Router       /admin/shuttle/{handle}/bandwidth [get]
+func (s *Server) handleAdminGetShuttleBandwidth(c echo.Context) error {
+	sh, err := s.shuttleByHandle(c)
+	if err != nil {
+		return err
+	}
+
+	l, err := s.CM.shuttleBandwidthLimits(c.Request().Context(), sh.Handle)
+	if err != nil {
+		return err
+	}
+	resp := shuttleBandwidthResponse{Limits: *l}
+	if err := s.DB.Where("handle = ? AND hour >= ?", sh.Handle, time.Now().UTC().Add(-24*time.Hour).Truncate(time.Hour)).
+		Order("hour").Find(&resp.Usage).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// handleAdminSetShuttleBandwidth godoc
+// @Summary      Set the bandwidth caps of a shuttle
+// @Description  This endpoint sets the ingest and egress caps of a shuttle, in bytes per second, with windows of the week that override them. The shuttle applies them right away if it is connected, or once it connects.
+// @Tags         admin
+// @Accept       json
+// @Param        handle  path  string          true  "Shuttle handle"
+// @Param        body    body  bwlimit.Limits  true  "Limits"
+// @Router       /admin/shuttle/{handle}/bandwidth [put]
+func (s *Server) handleAdminSetShuttleBandwidth(c echo.Context) error {
+	sh, err := s.shuttleByHandle(c)
+	if err != nil {
+		return err
+	}
+
+	var l bwlimit.Limits
+	if err := c.Bind(&l); err != nil {
+		return err
+	}
+	if err := l.Validate(); err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	row := shuttleBandwidthLimit{Handle: sh.Handle, Limits: string(b)}
+	if err := s.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "handle"}},
+		DoUpdates: clause.AssignmentColumns([]string{"limits", "updated_at"}),
+	}).Create(&row).Error; err != nil {
+		return err
+	}
+
+	if err := s.CM.sendBandwidthLimits(c.Request().Context(), sh.Handle); err != nil && !errors.Is(err, ErrNoShuttleConnection) {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
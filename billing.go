@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/billing"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const usagePeriodFormat = "2006-01"
+
+// usageAccount is a user or an organization, the zero value stands for
+// every account
+type usageAccount struct {
+	UserID uint
+	OrgID  uint
+}
+
+// monthlyUsage is the usage of an account over a month that is over, kept
+// until it was reported to every billing system
+type monthlyUsage struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	Period string `gorm:"uniqueIndex:idx_monthly_usage"`
+	UserID uint   `gorm:"uniqueIndex:idx_monthly_usage"`
+	OrgID  uint   `gorm:"uniqueIndex:idx_monthly_usage"`
+
+	ByteHours int64
+	Deals     int64
+	Egress    int64
+	Reported  bool
+}
+
+// billingAccount is how an account is billed in Stripe
+type billingAccount struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	UserID uint `gorm:"uniqueIndex:idx_billing_account"`
+	OrgID  uint `gorm:"uniqueIndex:idx_billing_account"`
+
+	StripeStorageItem string
+	StripeEgressItem  string
+	StripeDealsItem   string
+}
+
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func scopeUsage(db *gorm.DB, acct usageAccount) *gorm.DB {
+	switch {
+	case acct.UserID > 0:
+		return db.Where("user_id = ? AND org_id = 0", acct.UserID)
+	case acct.OrgID > 0:
+		return db.Where("org_id = ?", acct.OrgID)
+	default:
+		return db
+	}
+}
+
+// aggregateUsage sums up the usage samples of the month starting at start:
+// bytes pinned for every sampled hour, the bytes served in it and the deals
+// made in it. Content in the collections of an organization is billed to it
+// and not to its owner.
+func (s *Server) aggregateUsage(ctx context.Context, start time.Time, acct usageAccount) ([]*monthlyUsage, error) {
+	db := s.DB.WithContext(ctx)
+	end := start.AddDate(0, 1, 0)
+	period := start.Format(usagePeriodFormat)
+
+	out := make(map[usageAccount]*monthlyUsage)
+	get := func(a usageAccount) *monthlyUsage {
+		m, ok := out[a]
+		if !ok {
+			m = &monthlyUsage{Period: period, UserID: a.UserID, OrgID: a.OrgID}
+			out[a] = m
+		}
+		return m
+	}
+
+	var samples []usageQuery
+	if err := scopeUsage(db.Model(&userUsageRecord{}), acct).
+		Select("user_id, org_id, SUM(bytes_pinned - COALESCE(org_bytes_pinned, 0)) as value").
+		Where("created_at >= ? AND created_at < ?", start, end).
+		Group("user_id, org_id").Scan(&samples).Error; err != nil {
+		return nil, err
+	}
+	hours := int64(usageSampleInterval / time.Hour)
+	for _, q := range samples {
+		get(usageAccount{UserID: q.UserID, OrgID: q.OrgID}).ByteHours = q.Value * hours
+	}
+
+	// egress is what the egress meter counted, the bytes served of content
+	// of organizations are taken off its owner
+	if acct.OrgID == 0 {
+		eq := db.Model(&egressRecord{}).
+			Select("user_id, SUM(bytes) as value").
+			Where("hour >= ? AND hour < ?", start, end).
+			Group("user_id")
+		oq := db.Model(&orgEgressRecord{}).
+			Select("user_id, SUM(bytes) as value").
+			Where("hour >= ? AND hour < ?", start, end).
+			Group("user_id")
+		if acct.UserID > 0 {
+			eq = eq.Where("user_id = ?", acct.UserID)
+			oq = oq.Where("user_id = ?", acct.UserID)
+		}
+		var served, orgServed []usageQuery
+		if err := eq.Scan(&served).Error; err != nil {
+			return nil, err
+		}
+		if err := oq.Scan(&orgServed).Error; err != nil {
+			return nil, err
+		}
+		for _, q := range served {
+			get(usageAccount{UserID: q.UserID}).Egress += q.Value
+		}
+		for _, q := range orgServed {
+			m := get(usageAccount{UserID: q.UserID})
+			m.Egress -= q.Value
+			if m.Egress < 0 {
+				m.Egress = 0
+			}
+		}
+	}
+	if acct.UserID == 0 {
+		oq := db.Model(&orgEgressRecord{}).
+			Select("org_id, SUM(bytes) as value").
+			Where("hour >= ? AND hour < ?", start, end).
+			Group("org_id")
+		if acct.OrgID > 0 {
+			oq = oq.Where("org_id = ?", acct.OrgID)
+		}
+		var served []usageQuery
+		if err := oq.Scan(&served).Error; err != nil {
+			return nil, err
+		}
+		for _, q := range served {
+			get(usageAccount{OrgID: q.OrgID}).Egress = q.Value
+		}
+	}
+
+	if acct.OrgID == 0 {
+		dq := db.Model(&contentDeal{}).
+			Select("user_id, COUNT(1) as value").
+			Where("deal_id > 0 AND created_at >= ? AND created_at < ? AND content NOT IN (?)", start, end, s.allOrgContents()).
+			Group("user_id")
+		if acct.UserID > 0 {
+			dq = dq.Where("user_id = ?", acct.UserID)
+		}
+		var deals []usageQuery
+		if err := dq.Scan(&deals).Error; err != nil {
+			return nil, err
+		}
+		for _, q := range deals {
+			get(usageAccount{UserID: q.UserID}).Deals = q.Value
+		}
+	}
+
+	res := make([]*monthlyUsage, 0, len(out))
+	for _, m := range out {
+		if m.OrgID > 0 {
+			if err := db.Model(&contentDeal{}).
+				Where("deal_id > 0 AND created_at >= ? AND created_at < ? AND content IN (?)", start, end, s.orgContents(m.OrgID)).
+				Count(&m.Deals).Error; err != nil {
+				return nil, err
+			}
+		}
+		res = append(res, m)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].OrgID != res[j].OrgID {
+			return res[i].OrgID < res[j].OrgID
+		}
+		return res[i].UserID < res[j].UserID
+	})
+	return res, nil
+}
+
+// toBillingUsage names the accounts of usage and adds how they are billed
+func (s *Server) toBillingUsage(ctx context.Context, usage []*monthlyUsage) ([]billing.Usage, error) {
+	db := s.DB.WithContext(ctx)
+
+	var uids, oids []uint
+	for _, m := range usage {
+		if m.OrgID > 0 {
+			oids = append(oids, m.OrgID)
+		} else {
+			uids = append(uids, m.UserID)
+		}
+	}
+
+	var users []User
+	if err := db.Select("id, username").Find(&users, "id IN ?", uids).Error; err != nil {
+		return nil, err
+	}
+	usernames := make(map[uint]string)
+	for _, u := range users {
+		usernames[u.ID] = u.Username
+	}
+
+	var orgs []Organization
+	if err := db.Find(&orgs, "id IN ?", oids).Error; err != nil {
+		return nil, err
+	}
+	orgsByID := make(map[uint]Organization)
+	for _, o := range orgs {
+		orgsByID[o.ID] = o
+	}
+
+	var accounts []billingAccount
+	if err := db.Find(&accounts, "user_id IN ? OR org_id IN ?", uids, oids).Error; err != nil {
+		return nil, err
+	}
+	items := make(map[usageAccount]*billing.StripeItems)
+	for _, a := range accounts {
+		items[usageAccount{UserID: a.UserID, OrgID: a.OrgID}] = &billing.StripeItems{
+			Storage: a.StripeStorageItem,
+			Egress:  a.StripeEgressItem,
+			Deals:   a.StripeDealsItem,
+		}
+	}
+
+	out := make([]billing.Usage, 0, len(usage))
+	for _, m := range usage {
+		u := billing.Usage{
+			Period:    m.Period,
+			ByteHours: m.ByteHours,
+			Deals:     m.Deals,
+			Egress:    m.Egress,
+		}
+		if m.OrgID > 0 {
+			o := orgsByID[m.OrgID]
+			u.Account = "org:" + o.UUID
+			u.Name = o.Name
+			u.Stripe = items[usageAccount{OrgID: m.OrgID}]
+		} else {
+			u.Account = fmt.Sprintf("user:%d", m.UserID)
+			u.Name = usernames[m.UserID]
+			u.Stripe = items[usageAccount{UserID: m.UserID}]
+		}
+		out = append(out, u)
+	}
+	return out, nil
+}
+
+func (s *Server) billingReporters() []billing.Reporter {
+	cfg := s.estuaryCfg.Billing
+	client := &http.Client{Timeout: cfg.Timeout}
+
+	var out []billing.Reporter
+	if cfg.WebhookURL != "" {
+		out = append(out, &billing.WebhookReporter{URL: cfg.WebhookURL, Secret: cfg.WebhookSecret, Client: client})
+	}
+	if cfg.StripeAPIKey != "" {
+		out = append(out, &billing.StripeReporter{APIKey: cfg.StripeAPIKey, URL: cfg.StripeURL, Client: client})
+	}
+	return out
+}
+
+// billUsage aggregates the usage of the last month once it is over, and
+// reports the usage that wasn't reported yet to every billing system
+func (s *Server) billUsage(ctx context.Context) error {
+	db := s.DB.WithContext(ctx)
+
+	start := monthStart(time.Now()).AddDate(0, -1, 0)
+	var count int64
+	if err := db.Model(&monthlyUsage{}).Where("period = ?", start.Format(usagePeriodFormat)).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		usage, err := s.aggregateUsage(ctx, start, usageAccount{})
+		if err != nil {
+			return err
+		}
+		if len(usage) > 0 {
+			if err := db.CreateInBatches(usage, 500).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	var pending []*monthlyUsage
+	if err := db.Order("period, id").Find(&pending, "NOT reported").Error; err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	usage, err := s.toBillingUsage(ctx, pending)
+	if err != nil {
+		return err
+	}
+	for _, r := range s.billingReporters() {
+		if err := r.Report(ctx, usage); err != nil {
+			return fmt.Errorf("reporting usage to %s: %w", r.Name(), err)
+		}
+	}
+
+	ids := make([]uint, 0, len(pending))
+	for _, m := range pending {
+		ids = append(ids, m.ID)
+	}
+	return db.Model(&monthlyUsage{}).Where("id IN ?", ids).Update("reported", true).Error
+}
+
+// exportUsage writes the usage of the month in the month query param, the
+// current month by default, as csv
+func (s *Server) exportUsage(c echo.Context, acct usageAccount) error {
+	start := monthStart(time.Now())
+	if m := c.QueryParam("month"); m != "" {
+		t, err := time.Parse(usagePeriodFormat, m)
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_QUERY_PARAM_VALUE,
+				Details: fmt.Sprintf("month must look like 2006-01: %s", err),
+			}
+		}
+		start = t
+	}
+
+	ctx := c.Request().Context()
+	monthly, err := s.aggregateUsage(ctx, start, acct)
+	if err != nil {
+		return err
+	}
+	usage, err := s.toBillingUsage(ctx, monthly)
+	if err != nil {
+		return err
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "text/csv")
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"usage-%s.csv\"", start.Format(usagePeriodFormat)))
+	c.Response().WriteHeader(http.StatusOK)
+
+	w := csv.NewWriter(c.Response())
+	if err := w.Write([]string{"period", "account", "name", "byte_hours", "deals", "egress_bytes"}); err != nil {
+		return err
+	}
+	for _, u := range usage {
+		if err := w.Write([]string{
+			u.Period,
+			u.Account,
+			u.Name,
+			strconv.FormatInt(u.ByteHours, 10),
+			strconv.FormatInt(u.Deals, 10),
+			strconv.FormatInt(u.Egress, 10),
+		}); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// handleExportUserUsage godoc
+// @Summary      Export monthly usage of the user
+// @Description  This endpoint returns the usage of the user in a month as csv: bytes pinned times hours, deals made and bytes served.
+// @Tags         User
+// @Produce      text/csv
+// @Param        month  query  string  false  "Month (2006-01), defaults to the current one"
+// @Router       /user/usage/export [get]
+func (s *Server) handleExportUserUsage(c echo.Context, u *User) error {
+	return s.exportUsage(c, usageAccount{UserID: u.ID})
+}
+
+// handleExportOrgUsage godoc
+// @Summary      Export monthly usage of an organization
+// @Description  This endpoint returns the usage of the collections of an organization in a month as csv: bytes pinned times hours, deals made and bytes served.
+// @Tags         orgs
+// @Produce      text/csv
+// @Param        org    path   string  true   "Organization UUID"
+// @Param        month  query  string  false  "Month (2006-01), defaults to the current one"
+// @Router       /orgs/{org}/usage/export [get]
+func (s *Server) handleExportOrgUsage(c echo.Context, u *User) error {
+	org, _, err := s.getOrg(c.Request().Context(), u, c.Param("org"), orgRoleAdmin)
+	if err != nil {
+		return err
+	}
+	return s.exportUsage(c, usageAccount{OrgID: org.ID})
+}
+
+// handleAdminExportUsage godoc
+// @Summary      Export monthly usage of every account
+// @Description  This endpoint returns the usage of every user and organization in a month as csv.
+// @Tags         admin
+// @Produce      text/csv
+// @Param        month  query  string  false  "Month (2006-01), defaults to the current one"
+// @Router       /admin/usage/export [get]
+func (s *Server) handleAdminExportUsage(c echo.Context) error {
+	return s.exportUsage(c, usageAccount{})
+}
+
+// handleAdminSetBillingAccount godoc
+// @Summary      Set how an account is billed
+// @Description  This endpoint sets the Stripe subscription items the monthly usage of a user or an organization is reported to. Usage without an item is not reported to Stripe.
+// @Tags         admin
+// @Accept       json
+// @Param        kind  path  string               true  "users or orgs"
+// @Param        id    path  string               true  "User ID or organization UUID"
+// @Param        body  body  billing.StripeItems  true  "Subscription items"
+// @Router       /admin/billing/{kind}/{id} [put]
+func (s *Server) handleAdminSetBillingAccount(c echo.Context) error {
+	var items billing.StripeItems
+	if err := c.Bind(&items); err != nil {
+		return err
+	}
+
+	var acct usageAccount
+	switch c.Param("kind") {
+	case "users":
+		uid, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: "user id must be a number",
+			}
+		}
+		var u User
+		if err := s.DB.Select("id").First(&u, "id = ?", uid).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return &util.HttpError{
+					Code:    http.StatusNotFound,
+					Reason:  util.ERR_USER_NOT_FOUND,
+					Details: fmt.Sprintf("user %d does not exist", uid),
+				}
+			}
+			return err
+		}
+		acct.UserID = u.ID
+	case "orgs":
+		var org Organization
+		if err := s.DB.First(&org, "uuid = ?", c.Param("id")).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return orgNotFound(c.Param("id"))
+			}
+			return err
+		}
+		acct.OrgID = org.ID
+	default:
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "accounts are users or orgs",
+		}
+	}
+
+	a := billingAccount{UserID: acct.UserID, OrgID: acct.OrgID}
+	if err := s.DB.Where("user_id = ? AND org_id = ?", acct.UserID, acct.OrgID).
+		Assign(map[string]interface{}{
+			"stripe_storage_item": items.Storage,
+			"stripe_egress_item":  items.Egress,
+			"stripe_deals_item":   items.Deals,
+		}).
+		FirstOrCreate(&a).Error; err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
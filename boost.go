@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/carindex"
+	"github.com/application-research/estuary/util/piece"
+	"github.com/application-research/filclient"
+	smtypes "github.com/filecoin-project/boost/storagemarket/types"
+	boosttypes "github.com/filecoin-project/boost/transport/types"
+	"github.com/filecoin-project/go-address"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// how Boost providers get the data of a deal
+const (
+	// the provider pulls the data over libp2p
+	dealTransferLibp2p = "libp2p"
+	// the provider pulls the data over http from /deal-data
+	dealTransferHTTP = "http"
+	// the data gets to the provider out of band and is imported there
+	dealTransferOffline = "offline"
+)
+
+// Boost providers that speak the transports protocol can fetch over http
+const transportsProtocol = protocol.ID("/fil/storage/transports/1.0.0")
+
+// boostTransfer lets a provider fetch the data of a deal with Token, until
+// ExpiresAt
+type boostTransfer struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	Token     string `gorm:"uniqueIndex"`
+	Deal      uint   `gorm:"index"`
+	Content   uint
+	Size      uint64
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+// dealTransferFor picks how a Boost provider gets the data of content, the
+// provider can pick for itself with its deal transfer setting
+func (cm *ContentManager) dealTransferFor(ctx context.Context, m miner, content util.Content) string {
+	local := content.Location == constants.ContentLocationLocal
+
+	var sm storageMiner
+	if err := cm.DB.First(&sm, "address = ?", m.address.String()).Error; err == nil {
+		switch sm.DealTransfer {
+		case dealTransferOffline:
+			return dealTransferOffline
+		case dealTransferHTTP:
+			// only the primary node serves deal data over http
+			if local {
+				return dealTransferHTTP
+			}
+		case dealTransferLibp2p:
+			return dealTransferLibp2p
+		}
+	}
+
+	if !cm.boostCfg.HttpTransfer || !local {
+		return dealTransferLibp2p
+	}
+	pid, err := cm.FilClient.ConnectToMiner(ctx, m.address)
+	if err != nil {
+		return dealTransferLibp2p
+	}
+	protos, err := cm.Node.Host.Peerstore().SupportsProtocols(pid, string(transportsProtocol))
+	if err != nil || len(protos) == 0 {
+		return dealTransferLibp2p
+	}
+	return dealTransferHTTP
+}
+
+// boostDealParams are the deal params of the Boost deal protocol with the
+// IsOffline flag of later Boost versions, which older ones ignore
+type boostDealParams struct {
+	smtypes.DealParams
+	IsOffline bool
+}
+
+func (p *boostDealParams) MarshalCBOR(w io.Writer) error {
+	var buf bytes.Buffer
+	if err := p.DealParams.MarshalCBOR(&buf); err != nil {
+		return err
+	}
+
+	// the params are a map of four fields, make room for a fifth
+	b := buf.Bytes()
+	if b[0] != 0xa4 {
+		return fmt.Errorf("unexpected encoding of deal params")
+	}
+	b[0] = 0xa5
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+
+	scratch := make([]byte, 9)
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len("IsOffline"))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, "IsOffline"); err != nil {
+		return err
+	}
+	return cbg.WriteBool(w, p.IsOffline)
+}
+
+// sendBoostProposal proposes a deal whose data the provider fetches over
+// http or imports offline
+func (cm *ContentManager) sendBoostProposal(ctx context.Context, pp *pendingProposal) (func() error, bool, error) {
+	netprop := pp.prop
+	xfer := &boostTransfer{
+		Token:     uuid.New().String(),
+		Deal:      pp.deal.ID,
+		Content:   pp.content.ID,
+		Size:      netprop.Piece.RawBlockSize,
+		ExpiresAt: time.Now().Add(cm.boostCfg.TransferExpiry),
+	}
+	if err := cm.DB.Create(xfer).Error; err != nil {
+		return nil, false, err
+	}
+	cleanup := func() error {
+		return cm.DB.Delete(&boostTransfer{}, xfer.ID).Error
+	}
+
+	params := &boostDealParams{
+		DealParams: smtypes.DealParams{
+			DealUUID:           pp.dealUUID,
+			ClientDealProposal: *netprop.DealProposal,
+			DealDataRoot:       netprop.Piece.Root,
+		},
+	}
+	switch pp.deal.Transfer {
+	case dealTransferHTTP:
+		tp, err := json.Marshal(boosttypes.HttpRequest{
+			URL:     cm.dealDataURL(xfer.Deal),
+			Headers: map[string]string{"Authorization": "Bearer " + xfer.Token},
+		})
+		if err != nil {
+			return cleanup, false, err
+		}
+		params.Transfer = smtypes.Transfer{
+			Type:     dealTransferHTTP,
+			ClientID: fmt.Sprintf("%d", pp.deal.ID),
+			Params:   tp,
+			Size:     netprop.Piece.RawBlockSize,
+		}
+	case dealTransferOffline:
+		params.IsOffline = true
+	default:
+		return cleanup, false, fmt.Errorf("unknown deal transfer %q", pp.deal.Transfer)
+	}
+
+	propPhase, err := cm.proposeToBoost(ctx, pp.miner.address, params)
+	return cleanup, propPhase, err
+}
+
+// proposeToBoost sends deal params over the Boost deal protocol, the
+// returned bool is set when the provider rejected the proposal
+func (cm *ContentManager) proposeToBoost(ctx context.Context, maddr address.Address, params *boostDealParams) (bool, error) {
+	pid, err := cm.FilClient.ConnectToMiner(ctx, maddr)
+	if err != nil {
+		return false, err
+	}
+	s, err := cm.Node.Host.NewStream(ctx, pid, filclient.DealProtocolv120)
+	if err != nil {
+		return false, fmt.Errorf("opening stream to miner: %w", err)
+	}
+	defer s.Close() //nolint:errcheck
+
+	if dl, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(dl)
+	}
+	if err := cborutil.WriteCborRPC(s, params); err != nil {
+		return false, fmt.Errorf("failed to send request: %w", err)
+	}
+	var resp smtypes.DealResponse
+	if err := cborutil.ReadCborRPC(s, &resp); err != nil {
+		return false, fmt.Errorf("failed to read response: %w", err)
+	}
+	if !resp.Accepted {
+		return true, fmt.Errorf("deal proposal rejected: %s", resp.Message)
+	}
+	return false, nil
+}
+
+func (cm *ContentManager) dealDataURL(deal uint) string {
+	return fmt.Sprintf("%s/deal-data/%d", strings.TrimSuffix(cm.hostname, "/"), deal)
+}
+
+// expireBoostTransfers drops the transfers that can no longer be used
+func (cm *ContentManager) expireBoostTransfers(ctx context.Context) error {
+	return cm.DB.WithContext(ctx).Where("expires_at < ?", time.Now()).Delete(&boostTransfer{}).Error
+}
+
+var errRangeWritten = errors.New("range written")
+
+// rangeWriter drops the first skip bytes written to it and passes on the n
+// after them, then stops the write, for serving ranges
+type rangeWriter struct {
+	w    io.Writer
+	skip uint64
+	n    uint64
+}
+
+func (rw *rangeWriter) Write(b []byte) (int, error) {
+	if rw.skip >= uint64(len(b)) {
+		rw.skip -= uint64(len(b))
+		return len(b), nil
+	}
+	written := len(b)
+	b = b[rw.skip:]
+	rw.skip = 0
+
+	var err error
+	if uint64(len(b)) >= rw.n {
+		b = b[:rw.n]
+		err = errRangeWritten
+	}
+	n, werr := rw.w.Write(b)
+	rw.n -= uint64(n)
+	if werr != nil {
+		return 0, werr
+	}
+	return written, err
+}
+
+// handleServeDealData godoc
+// @Summary      Get the data of a deal
+// @Description  This endpoint serves the CAR of a deal to the storage provider it was proposed to, with the token handed out in the proposal as bearer token. A single byte range can be asked for, eg. to resume a transfer.
+// @Tags         deals
+// @Produce      application/vnd.ipld.car
+// @Param        deal  path  int  true  "Deal id"
+// @Router       /deal-data/{deal} [get]
+func (s *Server) handleServeDealData(c echo.Context) error {
+	token := strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+	var xfer boostTransfer
+	if err := s.DB.First(&xfer, "token = ?", token).Error; err != nil || c.Param("deal") != strconv.Itoa(int(xfer.Deal)) || time.Now().After(xfer.ExpiresAt) {
+		return &util.HttpError{
+			Code:   http.StatusUnauthorized,
+			Reason: util.ERR_NOT_AUTHORIZED,
+		}
+	}
+
+	content, err := s.CM.getContent(xfer.Content)
+	if err != nil {
+		return err
+	}
+	if content.Location != constants.ContentLocationLocal {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_CONTENT_NOT_FOUND,
+			Details: "the content of this deal is not on this node",
+		}
+	}
+
+	// several ranges get all of it, like the car gateway does
+	resp := c.Response()
+	start, end := uint64(0), xfer.Size
+	status := http.StatusOK
+	if rng := c.Request().Header.Get("Range"); rng != "" && !strings.Contains(rng, ",") {
+		first, last, ok := carindex.ParseRange(rng, xfer.Size)
+		if !ok {
+			resp.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", xfer.Size))
+			return c.NoContent(http.StatusRequestedRangeNotSatisfiable)
+		}
+		start, end = first, last
+		status = http.StatusPartialContent
+		resp.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, xfer.Size))
+	}
+
+	resp.Header().Set(echo.HeaderContentType, "application/vnd.ipld.car")
+	resp.Header().Set("Accept-Ranges", "bytes")
+	resp.Header().Set(echo.HeaderContentLength, strconv.FormatUint(end-start, 10))
+
+	if err := s.DB.Model(contentDeal{}).Where("id = ? AND (transfer_started IS NULL OR transfer_started < ?)", xfer.Deal, time.Unix(1, 0)).
+		UpdateColumn("transfer_started", time.Now()).Error; err != nil {
+		log.Warnf("failed to record transfer start of deal %d: %s", xfer.Deal, err)
+	}
+
+	resp.WriteHeader(status)
+	// with the layout of the car the range is written from its first block
+	// on, without walking the dag up to there
+	ctx := c.Request().Context()
+	rw := &rangeWriter{w: resp, n: end - start}
+	var werr error
+	if l, err := s.CM.carIndexes.Get(content.Cid.CID); err == nil && l.Size() == xfer.Size {
+		werr = l.WriteFrom(ctx, s.CM.Blockstore.Get, start, rw)
+	} else {
+		rw.skip = start
+		werr = piece.WriteCar(ctx, content.Cid.CID, s.CM.Blockstore, rw)
+	}
+	// the car writer doesn't always wrap the error of the writer, whether
+	// the range was written is known from what is left of it
+	if werr != nil && rw.n > 0 {
+		log.Errorf("failed to serve data of deal %d: %s", xfer.Deal, werr)
+		return nil
+	}
+
+	// a range short of the end leaves the rest of the transfer to come
+	if end < xfer.Size {
+		return nil
+	}
+
+	if err := s.DB.Model(contentDeal{}).Where("id = ?", xfer.Deal).UpdateColumn("transfer_finished", time.Now()).Error; err != nil {
+		log.Warnf("failed to record transfer end of deal %d: %s", xfer.Deal, err)
+	}
+	return nil
+}
+
+type offlineDeal struct {
+	Deal      uint      `json:"deal"`
+	DealUUID  string    `json:"dealUuid"`
+	Content   uint      `json:"content"`
+	Cid       string    `json:"cid"`
+	CarSize   uint64    `json:"carSize"`
+	URL       string    `json:"url"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// handleGetOfflineDeals godoc
+// @Summary      Get offline deals of a storage provider
+// @Description  This endpoint lists the offline deals proposed to a storage provider that haven't made it on chain, with where to download their data from. Only the owner of the storage provider can see them.
+// @Tags         deals
+// @Produce      json
+// @Param        miner  path  string  true  "Storage provider"
+// @Success      200  {array}  offlineDeal
+// @Router       /deals/offline/{miner} [get]
+func (s *Server) handleGetOfflineDeals(c echo.Context, u *User) error {
+	m, err := address.NewFromString(c.Param("miner"))
+	if err != nil {
+		return err
+	}
+
+	var sm storageMiner
+	if err := s.DB.First(&sm, "address = ?", m.String()).Error; err != nil {
+		return err
+	}
+	if !(u.Perm >= util.PermLevelAdmin || sm.Owner == u.ID) {
+		return &util.HttpError{
+			Code:   http.StatusUnauthorized,
+			Reason: util.ERR_MINER_NOT_OWNED,
+		}
+	}
+
+	var deals []contentDeal
+	if err := s.DB.Find(&deals, "miner = ? AND transfer = ? AND deal_id = 0 AND NOT failed", m.String(), dealTransferOffline).Error; err != nil {
+		return err
+	}
+
+	out := make([]offlineDeal, 0, len(deals))
+	for _, d := range deals {
+		var xfer boostTransfer
+		if err := s.DB.First(&xfer, "deal = ?", d.ID).Error; err != nil {
+			continue
+		}
+		content, err := s.CM.getContent(d.Content)
+		if err != nil {
+			return err
+		}
+		out = append(out, offlineDeal{
+			Deal:      d.ID,
+			DealUUID:  d.DealUUID,
+			Content:   d.Content,
+			Cid:       content.Cid.CID.String(),
+			CarSize:   xfer.Size,
+			URL:       s.CM.dealDataURL(d.ID),
+			Token:     xfer.Token,
+			ExpiresAt: xfer.ExpiresAt,
+		})
+	}
+	return c.JSON(http.StatusOK, out)
+}
@@ -0,0 +1,87 @@
+package build
+
+import (
+	"fmt"
+
+	"github.com/filecoin-project/go-address"
+)
+
+// Network holds the defaults for a filecoin network
+type Network struct {
+	Name           string
+	AddressNetwork address.Network
+	// Genesis is the cid of the genesis block, empty for networks that get
+	// reset
+	Genesis       string
+	ApiURL        string
+	DatabaseValue string
+	DefaultMiners []string
+	// MaxActorsVersion, if set, is the newest actors version the node runs
+	// against, the newest this build knows otherwise
+	MaxActorsVersion int
+}
+
+// Networks are the networks estuary knows the defaults of
+var Networks = map[string]Network{
+	"mainnet": {
+		Name:           "mainnet",
+		AddressNetwork: address.Mainnet,
+		Genesis:        "bafy2bzacecnamqgqmifpluoeldx7zzglxcljo6oja4vrmtj7432rphldpdmm2",
+		ApiURL:         "wss://api.chain.love",
+		DatabaseValue:  "sqlite=estuary.db",
+		DefaultMiners:  mainnetMinerStrs,
+	},
+	"calibnet": {
+		Name:           "calibnet",
+		AddressNetwork: address.Testnet,
+		ApiURL:         "https://api.calibration.node.glif.io",
+		DatabaseValue:  "sqlite=estuary_calibnet.db",
+		DefaultMiners:  calibnetMinerStrs,
+	},
+	"devnet": {
+		Name:           "devnet",
+		AddressNetwork: address.Testnet,
+		ApiURL:         "ws://127.0.0.1:1234",
+		DatabaseValue:  "sqlite=estuary_devnet.db",
+	},
+}
+
+// DefaultNetwork is the network picked at build time, mainnet unless built
+// with the calibnet tag
+var DefaultNetwork = Networks[defaultNetworkName]
+
+// CurrentNetwork is the network the node runs on
+var CurrentNetwork Network
+
+func init() {
+	if err := SetNetwork(DefaultNetwork); err != nil {
+		panic(err)
+	}
+	SetDefaultDatabaseValue(DefaultNetwork.DatabaseValue)
+}
+
+// LookupNetwork returns the defaults of the named network
+func LookupNetwork(name string) (Network, error) {
+	n, ok := Networks[name]
+	if !ok {
+		return Network{}, fmt.Errorf("unknown network %q", name)
+	}
+	return n, nil
+}
+
+// SetNetwork switches address formatting and the default miners over to n
+func SetNetwork(n Network) error {
+	var miners []address.Address
+	for _, s := range n.DefaultMiners {
+		a, err := address.NewFromString(s)
+		if err != nil {
+			return fmt.Errorf("invalid default miner %q: %w", s, err)
+		}
+		miners = append(miners, a)
+	}
+
+	SetAddressNetwork(n.AddressNetwork)
+	DefaultMiners = miners
+	CurrentNetwork = n
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/carindex"
+	"github.com/application-research/estuary/util/piece"
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+)
+
+// carLayout returns where the blocks are in the CAR of root. Layouts are
+// stored when the piece of a content is computed, for content whose piece
+// was computed before that one is built and stored now.
+func (cm *ContentManager) carLayout(ctx context.Context, root cid.Cid) (*carindex.Layout, error) {
+	l, err := cm.carIndexes.Get(root)
+	if err == nil {
+		return l, nil
+	}
+	if !errors.Is(err, carindex.ErrNotFound) {
+		return nil, err
+	}
+
+	l, err = piece.Layout(ctx, root, cm.Blockstore)
+	if err != nil {
+		return nil, err
+	}
+	if err := cm.carIndexes.Put(l); err != nil {
+		log.Warnf("failed to store car index of %s: %s", root, err)
+	}
+	return l, nil
+}
+
+// dropCarIndex deletes the layout of root once no content stored here has
+// it as its root any more
+func (cm *ContentManager) dropCarIndex(ctx context.Context, root cid.Cid) {
+	var count int64
+	if err := cm.DB.WithContext(ctx).Model(&util.Content{}).
+		Where("cid = ? AND location = ? AND NOT offloaded", util.DbCID{CID: root}, constants.ContentLocationLocal).
+		Count(&count).Error; err != nil {
+		log.Errorf("failed to check for content of car index %s: %s", root, err)
+		return
+	}
+	if count > 0 {
+		return
+	}
+	if err := cm.carIndexes.Delete(root); err != nil {
+		log.Errorf("failed to delete car index of %s: %s", root, err)
+	}
+}
+
+// dropStaleCarIndexes deletes the layouts of roots no content stored here
+// has any more
+func (cm *ContentManager) dropStaleCarIndexes(ctx context.Context) error {
+	roots, err := cm.carIndexes.Roots()
+	if err != nil {
+		return err
+	}
+	for _, root := range roots {
+		cm.dropCarIndex(ctx, root)
+	}
+	return nil
+}
+
+// handleGetCarIndex godoc
+// @Summary      Get the CAR index of a content
+// @Description  This endpoint returns the CARv2 index of the CAR the deals of a content are made with, a multihash sorted index of where every block is in it. It goes along with the CAR to read blocks from it without scanning it. Content on a shuttle is redirected to the shuttle.
+// @Tags         content
+// @Produce      octet-stream
+// @Param        id   path      int  true  "Content ID"
+// @Success      200  {file}    binary
+// @Router       /content/{id}/car-index [get]
+func (s *Server) handleGetCarIndex(c echo.Context, u *User) error {
+	content, err := s.getOwnContent(c, u)
+	if err != nil {
+		return err
+	}
+	if content.Offloaded {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_CONTENT_NOT_FOUND,
+			Details: fmt.Sprintf("content %d was offloaded", content.ID),
+		}
+	}
+
+	if content.Location != constants.ContentLocationLocal {
+		host := s.CM.shuttleHostName(content.Location)
+		if host == "" || !s.CM.shuttleIsOnline(content.Location) {
+			return &util.HttpError{
+				Code:    http.StatusServiceUnavailable,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("the shuttle content %d is on is offline", content.ID),
+			}
+		}
+		return c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("https://%s/content/car-index/%d", host, content.ID))
+	}
+
+	l, err := s.CM.carLayout(c.Request().Context(), content.Cid.CID)
+	if err != nil {
+		return err
+	}
+	return writeCarIndex(c, l)
+}
+
+// writeCarIndex responds with the CARv2 index of a CAR
+func writeCarIndex(c echo.Context, l *carindex.Layout) error {
+	resp := c.Response()
+	resp.Header().Set(echo.HeaderContentType, echo.MIMEOctetStream)
+	resp.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%s.car.idx", l.Root))
+	resp.Header().Set("X-Car-Size", strconv.FormatUint(l.Size(), 10))
+	resp.WriteHeader(http.StatusOK)
+	return l.WriteIndex(resp)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/cdn"
+	"github.com/ipfs/go-cid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// request counts are kept for at most this many cids
+const cdnHeatKeys = 100000
+
+// content that failed to register is tried again after this long
+const cdnRetryAfter = time.Hour
+
+// shuttles report at most this many requests they served without asking
+// with an access check
+const maxReportedHits = 100000
+
+// cdnDenylisted is the error of content that is not registered because it
+// is denylisted
+const cdnDenylisted = "denylisted"
+
+// cdnRegistration records that a content was registered with the cdn
+type cdnRegistration struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	Content    uint       `gorm:"uniqueIndex"`
+	Cid        util.DbCID `gorm:"index"`
+	Registered bool
+	Failures   int
+	LastError  string
+}
+
+// cdnState is the cdn client and the request counts, nil when the cdn is
+// off
+type cdnState struct {
+	client *cdn.Client
+	heat   *cdn.Heat
+	// sweepFrom is the registration the next pass looking for denylisted
+	// content starts after
+	sweepFrom uint
+}
+
+// registerCDN registers the public content pinned since the last run
+func (s *Server) registerCDN(ctx context.Context) error {
+	cfg := s.estuaryCfg.CDN
+
+	var conts []util.Content
+	if err := s.DB.WithContext(ctx).Model(&util.Content{}).
+		Select("contents.id, contents.cid").
+		Joins("LEFT JOIN cdn_registrations ON cdn_registrations.content = contents.id").
+		Where("contents.active AND NOT contents.private AND NOT contents.quarantined AND NOT contents.offloaded").
+		Where("cdn_registrations.id IS NULL OR (NOT cdn_registrations.registered AND cdn_registrations.updated_at < ?)", time.Now().Add(-cdnRetryAfter)).
+		Order("contents.id").
+		Limit(cfg.BatchSize).
+		Find(&conts).Error; err != nil {
+		return err
+	}
+	if len(conts) == 0 {
+		return nil
+	}
+
+	// denylisted content is recorded as failed, so it doesn't hold up the
+	// content after it
+	var allowed []util.Content
+	var listed []cdnRegistration
+	for _, c := range conts {
+		if s.CM.denylist.listed(c.Cid.CID) {
+			listed = append(listed, cdnRegistration{Content: c.ID, Cid: c.Cid, LastError: cdnDenylisted})
+			continue
+		}
+		allowed = append(allowed, c)
+	}
+	if len(listed) > 0 {
+		if err := s.DB.WithContext(ctx).Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "content"}},
+			DoUpdates: clause.AssignmentColumns([]string{"registered", "last_error", "updated_at"}),
+		}).Create(&listed).Error; err != nil {
+			return err
+		}
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	cids := make([]cid.Cid, 0, len(allowed))
+	for _, c := range allowed {
+		cids = append(cids, c.Cid.CID)
+	}
+	rerr := s.cdn.client.Register(ctx, cids)
+
+	rows := make([]cdnRegistration, 0, len(allowed))
+	for _, c := range allowed {
+		row := cdnRegistration{Content: c.ID, Cid: c.Cid, Registered: rerr == nil}
+		if rerr != nil {
+			row.Failures = 1
+			row.LastError = rerr.Error()
+		}
+		rows = append(rows, row)
+	}
+	upsert := clause.OnConflict{
+		Columns:   []clause.Column{{Name: "content"}},
+		DoUpdates: clause.AssignmentColumns([]string{"registered", "last_error", "updated_at"}),
+	}
+	if rerr != nil {
+		upsert.DoUpdates = clause.Assignments(map[string]interface{}{
+			"failures":   gorm.Expr("cdn_registrations.failures + 1"),
+			"last_error": rerr.Error(),
+			"updated_at": time.Now(),
+		})
+	}
+	if err := s.DB.WithContext(ctx).Clauses(upsert).Create(&rows).Error; err != nil {
+		return err
+	}
+	return rerr
+}
+
+// deregisterCDN deregisters content the cdn must no longer serve: deleted,
+// made private or quarantined since it was registered, or denylisted.
+// Denylists are checked against a batch of the registrations each run,
+// going around all of them.
+func (s *Server) deregisterCDN(ctx context.Context) error {
+	cfg := s.estuaryCfg.CDN
+	db := s.DB.WithContext(ctx)
+
+	var gone []cdnRegistration
+	if err := db.Model(&cdnRegistration{}).
+		Select("cdn_registrations.*").
+		Joins("LEFT JOIN contents ON contents.id = cdn_registrations.content").
+		Where("cdn_registrations.registered").
+		Where("contents.id IS NULL OR contents.deleted_at IS NOT NULL OR NOT contents.active OR contents.private OR contents.quarantined").
+		Order("cdn_registrations.id").
+		Limit(cfg.BatchSize).
+		Find(&gone).Error; err != nil {
+		return err
+	}
+	if err := s.dropCDN(ctx, gone, false); err != nil {
+		return err
+	}
+
+	var batch []cdnRegistration
+	if err := db.Where("registered AND id > ?", s.cdn.sweepFrom).Order("id").Limit(cfg.BatchSize).Find(&batch).Error; err != nil {
+		return err
+	}
+	var listed []cdnRegistration
+	for _, r := range batch {
+		if s.CM.denylist.listed(r.Cid.CID) {
+			listed = append(listed, r)
+		}
+	}
+	if err := s.dropCDN(ctx, listed, true); err != nil {
+		return err
+	}
+	if len(batch) < cfg.BatchSize {
+		s.cdn.sweepFrom = 0
+	} else {
+		s.cdn.sweepFrom = batch[len(batch)-1].ID
+	}
+	return nil
+}
+
+// deregisterCDNCid deregisters c right away, for content an operator just
+// denylisted
+func (s *Server) deregisterCDNCid(ctx context.Context, c cid.Cid) error {
+	var rows []cdnRegistration
+	if err := s.DB.WithContext(ctx).Find(&rows, "cid = ? AND registered", util.DbCID{CID: c}).Error; err != nil {
+		return err
+	}
+	return s.dropCDN(ctx, rows, true)
+}
+
+// dropCDN deregisters the cids of rows, except those other content the cdn
+// may still serve has too. Rows of denylisted content are kept as failed,
+// so they are not registered again, the others are deleted.
+func (s *Server) dropCDN(ctx context.Context, rows []cdnRegistration, denylisted bool) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	db := s.DB.WithContext(ctx)
+
+	ids := make([]uint, 0, len(rows))
+	dbcids := make([]util.DbCID, 0, len(rows))
+	for _, r := range rows {
+		ids = append(ids, r.ID)
+		dbcids = append(dbcids, r.Cid)
+	}
+
+	shared := make(map[cid.Cid]bool)
+	if !denylisted {
+		// the same data pinned as other content keeps being served
+		var kept []util.DbCID
+		if err := db.Model(&cdnRegistration{}).Distinct("cdn_registrations.cid").
+			Joins("JOIN contents ON contents.id = cdn_registrations.content").
+			Where("cdn_registrations.cid IN ? AND cdn_registrations.registered AND cdn_registrations.id NOT IN ?", dbcids, ids).
+			Where("contents.active AND NOT contents.private AND NOT contents.quarantined AND contents.deleted_at IS NULL").
+			Pluck("cdn_registrations.cid", &kept).Error; err != nil {
+			return err
+		}
+		for _, c := range kept {
+			shared[c.CID] = true
+		}
+	}
+
+	var cids []cid.Cid
+	seen := make(map[cid.Cid]bool)
+	for _, r := range rows {
+		if seen[r.Cid.CID] || shared[r.Cid.CID] {
+			continue
+		}
+		seen[r.Cid.CID] = true
+		cids = append(cids, r.Cid.CID)
+	}
+	if len(cids) > 0 {
+		if err := s.cdn.client.Deregister(ctx, cids); err != nil {
+			return err
+		}
+	}
+
+	if denylisted {
+		return db.Model(&cdnRegistration{}).Where("id IN ?", ids).UpdateColumns(map[string]interface{}{
+			"registered": false,
+			"last_error": cdnDenylisted,
+			"updated_at": time.Now(),
+		}).Error
+	}
+	return db.Where("id IN ?", ids).Delete(&cdnRegistration{}).Error
+}
+
+// cdnRedirect returns the cdn a retrieval of cc should go to, if cc is
+// registered with it and hot. hits are the requests for cc to count, more
+// than one when a shuttle served some without asking.
+func (s *Server) cdnRedirect(ctx context.Context, cc cid.Cid, private bool, hits int) (string, error) {
+	if s.cdn == nil || private {
+		return "", nil
+	}
+	if s.cdn.heat.Add(cc, hits, time.Now()) < s.estuaryCfg.CDN.HotRequests {
+		return "", nil
+	}
+
+	var n int64
+	if err := s.DB.WithContext(ctx).Model(&cdnRegistration{}).
+		Where("cid = ? AND registered", util.DbCID{CID: cc}).Count(&n).Error; err != nil {
+		return "", err
+	}
+	if n == 0 {
+		return "", nil
+	}
+	return s.estuaryCfg.CDN.BaseURL, nil
+}
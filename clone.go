@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+type cloneContentBody struct {
+	// Name defaults to the name of the content cloned
+	Name string `json:"name"`
+	util.ContentInCollection
+}
+
+// canClone checks that u may clone a content: their own in the namespace
+// of their key, one that isn't private, or one in a collection of an
+// organization u is in
+func (s *Server) canClone(ctx context.Context, u *User, src *util.Content) error {
+	if src.UserID == u.ID {
+		return checkContentOwner(u, src)
+	}
+	if !src.Private {
+		return nil
+	}
+
+	var shared int64
+	if err := s.DB.WithContext(ctx).Model(CollectionRef{}).
+		Joins("JOIN collections ON collections.id = collection_refs.collection").
+		Joins("JOIN org_members ON org_members.org_id = collections.org_id").
+		Where("collection_refs.content = ? AND org_members.user_id = ?", src.ID, u.ID).
+		Count(&shared).Error; err != nil {
+		return err
+	}
+	if shared == 0 {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_CONTENT_NOT_FOUND,
+			Details: fmt.Sprintf("content with ID(%d) was not found", src.ID),
+		}
+	}
+	return nil
+}
+
+// handleCloneContent godoc
+// @Summary      Clone a content into your account
+// @Description  This endpoint adds the content of another user to your account, without fetching it again: the content is public, or shared in a collection of an organization you are in, and not quarantined. Encrypted content stays encrypted with the same key. The clone is yours, it counts towards your usage and the quota of the organization of the collection it is put in, and gets deals of its own.
+// @Tags         content
+// @Accept       json
+// @Produce      json
+// @Param        id    path      int               true  "Content ID"
+// @Param        body  body      cloneContentBody  false  "Name and collection of the clone"
+// @Success      200   {object}  util.ContentAddResponse
+// @Router       /content/{id}/clone [post]
+func (s *Server) handleCloneContent(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+	if s.isContentAddingDisabled(u) {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_CONTENT_ADDING_DISABLED,
+			Details: "adding content to this node is not allowed at the moment",
+		}
+	}
+
+	srcID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid content id: %s", c.Param("id")),
+		}
+	}
+
+	var body cloneContentBody
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+	}
+
+	var src util.Content
+	if err := s.DB.WithContext(ctx).First(&src, "id = ?", srcID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("content with ID(%d) was not found", srcID),
+			}
+		}
+		return err
+	}
+	if err := s.canClone(ctx, u, &src); err != nil {
+		return err
+	}
+
+	switch {
+	case !src.Active || src.Offloaded:
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("content %d is not stored on this node", src.ID),
+		}
+	case src.DagSplit || src.Aggregate:
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("content %d was split or is an aggregate, only content as it was added can be cloned", src.ID),
+		}
+	case src.Location == constants.ContentLocationRemote || src.Location == constants.ContentLocationCluster:
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("content %d is pinned elsewhere, pin its cid instead", src.ID),
+		}
+	}
+	if err := s.CM.denylist.check(ctx, src.Cid.CID, denyPin, u.ID, c.RealIP()); err != nil {
+		return err
+	}
+	// flagged content, and content still waiting for its scan, stays
+	// where it is
+	if err := s.checkQuarantine(ctx, src.Cid.CID); err != nil {
+		return err
+	}
+
+	var enc []encryptedContent
+	if err := s.DB.WithContext(ctx).Find(&enc, "content_id = ?", src.ID).Error; err != nil {
+		return err
+	}
+	if err := s.checkPinSize(c, u, src.Cid.CID); err != nil {
+		return err
+	}
+	if err := checkUCANMaxSize(u, src.Size); err != nil {
+		return err
+	}
+
+	name := src.Name
+	if body.Name != "" {
+		name = body.Name
+	}
+
+	var cols []*CollectionRef
+	if body.CollectionID != "" {
+		col, err := s.getCollectionForUpload(ctx, u, body.CollectionID)
+		if err != nil {
+			return err
+		}
+		if err := s.checkOrgQuota(ctx, col, src.Size); err != nil {
+			return err
+		}
+		path := "/" + name
+		if body.CollectionDir != "" {
+			p, err := sanitizePath(body.CollectionDir)
+			if err != nil {
+				return err
+			}
+			path = p
+			if strings.HasSuffix(p, "/") {
+				path = p + name
+			}
+		}
+		cols = append(cols, &CollectionRef{Collection: col.ID, Path: &path})
+	}
+
+	clone := util.Content{
+		Cid:         src.Cid,
+		Name:        name,
+		UserID:      u.ID,
+		Namespace:   u.namespace(),
+		Description: src.Description,
+		Size:        src.Size,
+		Type:        src.Type,
+		Replication: s.CM.replicationFactor(),
+		Location:    src.Location,
+	}
+	// a shuttle has to know the clone is pinned too, it is pinned there
+	// again from the blocks it already has
+	local := src.Location == constants.ContentLocationLocal
+	if local {
+		clone.Active = true
+	} else {
+		clone.Pinning = true
+	}
+
+	if err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&clone).Error; err != nil {
+			return err
+		}
+		// the clone is the same ciphertext, decrypted with the same key
+		for _, e := range enc {
+			e.ContentID = clone.ID
+			e.CreatedAt = time.Time{}
+			if err := tx.Create(&e).Error; err != nil {
+				return err
+			}
+		}
+		if local {
+			if err := tx.Exec("INSERT INTO obj_refs (content, object) SELECT ?, object FROM obj_refs WHERE content = ?", clone.ID, src.ID).Error; err != nil {
+				return err
+			}
+		}
+		for _, col := range cols {
+			col.Content = clone.ID
+			if err := tx.Create(col).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	s.CM.recordContentEvent(ctx, eventContentAdded, clone.ID, map[string]interface{}{"clonedFrom": src.ID})
+
+	if local {
+		s.CM.queueMgr.add(clone.ID, 0)
+	} else if err := s.CM.pinContentOnShuttle(ctx, clone, nil, 0, clone.Location, true); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, &util.ContentAddResponse{
+		Cid:          clone.Cid.CID.String(),
+		RetrievalURL: util.CreateRetrievalURL(clone.Cid.CID.String()),
+		EstuaryId:    clone.ID,
+		Providers:    s.CM.pinDelegatesForContent(clone),
+	})
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/cluster"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"gorm.io/gorm"
+)
+
+const eventPinClustered = "pin.clustered"
+
+// ClusterPin is content pinned on ipfs-cluster, Peers is the number of
+// cluster peers that have it pinned
+type ClusterPin struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	Content uint                `gorm:"uniqueIndex" json:"content"`
+	Status  types.PinningStatus `gorm:"index" json:"status"`
+	Peers   int                 `json:"peers"`
+	Error   string              `json:"error"`
+}
+
+// pinContentOnCluster submits content to the cluster
+func (cm *ContentManager) pinContentOnCluster(ctx context.Context, cont util.Content, origins []*peer.AddrInfo) error {
+	opts := cluster.PinOptions{
+		Name:           cont.Name,
+		ReplicationMin: cm.clusterCfg.ReplicationMin,
+		ReplicationMax: cm.clusterCfg.ReplicationMax,
+	}
+	for _, o := range origins {
+		addrs, err := peer.AddrInfoToP2pAddrs(o)
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			opts.Origins = append(opts.Origins, a.String())
+		}
+	}
+
+	if err := cm.cluster.Pin(ctx, cont.Cid.CID, opts); err != nil {
+		return fmt.Errorf("pinning on cluster: %w", err)
+	}
+
+	if err := cm.DB.Create(&ClusterPin{
+		Content: cont.ID,
+		Status:  types.PinningStatusQueued,
+	}).Error; err != nil {
+		return err
+	}
+	cm.recordContentEvent(ctx, eventPinClustered, cont.ID, nil)
+	return nil
+}
+
+// refreshClusterPin gets the status of a pin from the cluster and records it
+func (cm *ContentManager) refreshClusterPin(ctx context.Context, cp *ClusterPin) error {
+	var cont util.Content
+	if err := cm.DB.First(&cont, "id = ?", cp.Content).Error; err != nil {
+		return err
+	}
+
+	status, peers := types.PinningStatusFailed, 0
+	var reason string
+	gpi, err := cm.cluster.Status(ctx, cont.Cid.CID)
+	switch {
+	case errors.Is(err, cluster.ErrNotFound):
+		reason = "not tracked by the cluster"
+	case err != nil:
+		return err
+	default:
+		status, peers = gpi.PinningStatus(cm.clusterCfg.ReplicationMin)
+		if errs := gpi.Errors(); len(errs) > 0 {
+			b, err := json.Marshal(errs)
+			if err != nil {
+				return err
+			}
+			reason = string(b)
+		}
+	}
+
+	if err := cm.DB.Model(ClusterPin{}).Where("id = ?", cp.ID).UpdateColumns(map[string]interface{}{
+		"status": status,
+		"peers":  peers,
+		"error":  reason,
+	}).Error; err != nil {
+		return err
+	}
+	statusChanged := status != cp.Status
+	cp.Status, cp.Peers, cp.Error = status, peers, reason
+	if !statusChanged {
+		return nil
+	}
+
+	// the cluster holds the content, not this node, so it never becomes
+	// active here, it stops pinning once the cluster is done with it
+	switch status {
+	case types.PinningStatusPinned:
+		return cm.DB.Model(util.Content{}).Where("id = ?", cp.Content).UpdateColumns(map[string]interface{}{
+			"pinning":         false,
+			"failed":          false,
+			"pin_finished_at": time.Now(),
+		}).Error
+	case types.PinningStatusFailed:
+		return cm.DB.Model(util.Content{}).Where("id = ?", cp.Content).UpdateColumns(map[string]interface{}{
+			"pinning":         false,
+			"failed":          true,
+			"pin_finished_at": time.Now(),
+		}).Error
+	}
+	return nil
+}
+
+// clusterPeers returns the number of cluster peers that had content pinned
+// when the cluster was last polled
+func (cm *ContentManager) clusterPeers(ctx context.Context, contID uint) (int, error) {
+	var cp ClusterPin
+	if err := cm.DB.WithContext(ctx).First(&cp, "content = ?", contID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return cp.Peers, nil
+}
+
+// pollClusterPins checks on the pins the cluster hasn't finished yet
+func (cm *ContentManager) pollClusterPins(ctx context.Context) error {
+	var pending []*ClusterPin
+	if err := cm.DB.Find(&pending, "status in ?", []types.PinningStatus{types.PinningStatusQueued, types.PinningStatusPinning}).Error; err != nil {
+		return err
+	}
+
+	for _, cp := range pending {
+		if err := cm.refreshClusterPin(ctx, cp); err != nil {
+			log.Warnf("failed to refresh cluster pin of content %d: %s", cp.Content, err)
+		}
+	}
+	return nil
+}
+
+// clusterPinStatus is the status of content pinned on the cluster
+func (cm *ContentManager) clusterPinStatus(cont util.Content) (*types.IpfsPinStatusResponse, error) {
+	var cp ClusterPin
+	if err := cm.DB.First(&cp, "content = ?", cont.ID).Error; err != nil {
+		return nil, err
+	}
+
+	meta := make(map[string]interface{})
+	if cont.PinMeta != "" {
+		if err := json.Unmarshal([]byte(cont.PinMeta), &meta); err != nil {
+			log.Warnf("content %d has invalid pinmeta: %s", cont.ID, err)
+		}
+	}
+
+	info := map[string]interface{}{
+		"cluster_peers": cp.Peers,
+	}
+	if cp.Error != "" {
+		info["cluster_error"] = cp.Error
+	}
+
+	return &types.IpfsPinStatusResponse{
+		RequestID: fmt.Sprintf("%d", cont.ID),
+		Status:    cp.Status,
+		Created:   cont.CreatedAt,
+		Pin: types.IpfsPin{
+			CID:  cont.Cid.CID.String(),
+			Name: cont.Name,
+			Meta: meta,
+		},
+		Delegates: []string{},
+		Info:      info,
+	}, nil
+}
+
+// unpinFromCluster removes content from the cluster, unless other content
+// with the same cid still has it pinned there
+func (cm *ContentManager) unpinFromCluster(ctx context.Context, cont util.Content) error {
+	var cp ClusterPin
+	if err := cm.DB.First(&cp, "content = ?", cont.ID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	var others int64
+	if err := cm.DB.Model(util.Content{}).Where("cid = ? AND location = ? AND id != ?", cont.Cid.CID.Bytes(), constants.ContentLocationCluster, cont.ID).Count(&others).Error; err != nil {
+		return err
+	}
+
+	if others == 0 {
+		if cm.cluster == nil {
+			log.Warnf("content %d is pinned on a cluster that is no longer configured, leaving it", cont.ID)
+		} else if err := cm.cluster.Unpin(ctx, cont.Cid.CID); err != nil {
+			return err
+		}
+	}
+	return cm.DB.Delete(&ClusterPin{}, cp.ID).Error
+}
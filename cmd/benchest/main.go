@@ -38,6 +38,7 @@ func getApp() *cli.App {
 		benchAddFileCmd,
 		benchFetchFileCmd,
 		benchAddResultCmd,
+		benchPinQueueCmd,
 	}
 
 	return app
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/application-research/estuary/pinner"
+	"github.com/application-research/estuary/pinner/bench"
+	cli "github.com/urfave/cli/v2"
+)
+
+var benchPinQueueCmd = &cli.Command{
+	Name:  "pin-queue",
+	Usage: "run synthetic pin operations through a local pin manager and report how the queue keeps up",
+	Flags: []cli.Flag{
+		&cli.IntFlag{
+			Name:  "ops",
+			Usage: "number of pin operations to queue",
+			Value: 1000,
+		},
+		&cli.IntFlag{
+			Name:  "users",
+			Usage: "number of users to spread the operations over",
+			Value: 10,
+		},
+		&cli.Float64Flag{
+			Name:  "rate",
+			Usage: "operations queued per second, 0 queues them all at once",
+			Value: 0,
+		},
+		&cli.Int64Flag{
+			Name:  "min-size",
+			Usage: "smallest content size in bytes",
+			Value: 1 << 20,
+		},
+		&cli.Int64Flag{
+			Name:  "max-size",
+			Usage: "largest content size in bytes",
+			Value: 64 << 20,
+		},
+		&cli.Float64Flag{
+			Name:  "high-priority",
+			Usage: "fraction of operations that skip the per user limiter",
+		},
+		&cli.IntFlag{
+			Name:  "workers",
+			Usage: "number of pin workers",
+			Value: 50,
+		},
+		&cli.IntFlag{
+			Name:  "max-active-per-user",
+			Usage: "per user limit on operations running at once",
+			Value: pinner.DefaultOpts.MaxActivePerUser,
+		},
+		&cli.DurationFlag{
+			Name:  "latency",
+			Usage: "simulated time to the first block of every operation",
+			Value: time.Millisecond * 200,
+		},
+		&cli.Int64Flag{
+			Name:  "bandwidth",
+			Usage: "simulated bytes per second each operation fetches at, 0 for no limit",
+			Value: 10 << 20,
+		},
+		&cli.Float64Flag{
+			Name:  "failure-rate",
+			Usage: "fraction of operations that fail",
+		},
+		&cli.StringFlag{
+			Name:  "shared-queue",
+			Usage: "postgres connection string to run the operations through a shared queue instead of the in memory one",
+		},
+		&cli.StringFlag{
+			Name:  "shared-queue-encoding",
+			Usage: "encoding of the shared queue entries",
+			Value: pinner.EncodingJSON,
+		},
+		&cli.Int64Flag{
+			Name:  "seed",
+			Usage: "seed for the generated sizes and failures",
+			Value: 1,
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer cancel()
+
+		b := bench.New(bench.Config{
+			Ops:          cctx.Int("ops"),
+			Users:        cctx.Int("users"),
+			Rate:         cctx.Float64("rate"),
+			MinSize:      cctx.Int64("min-size"),
+			MaxSize:      cctx.Int64("max-size"),
+			HighPriority: cctx.Float64("high-priority"),
+			Workers:      cctx.Int("workers"),
+			Seed:         cctx.Int64("seed"),
+		})
+
+		opts := &pinner.PinManagerOpts{
+			MaxActivePerUser: cctx.Int("max-active-per-user"),
+		}
+		if dbstr := cctx.String("shared-queue"); dbstr != "" {
+			db, err := openDB(dbstr)
+			if err != nil {
+				return fmt.Errorf("failed to open db: %w", err)
+			}
+
+			name := fmt.Sprintf("bench-%d", time.Now().UnixNano())
+			sq, err := pinner.NewSharedQueue(db, name, time.Minute, cctx.String("shared-queue-encoding"))
+			if err != nil {
+				return err
+			}
+			opts.SharedQueue = sq
+			opts.PollInterval = time.Millisecond * 100
+		}
+
+		report, err := b.Run(ctx, b.SimulatedPinFunc(bench.Sim{
+			Latency:     cctx.Duration("latency"),
+			Bandwidth:   cctx.Int64("bandwidth"),
+			FailureRate: cctx.Float64("failure-rate"),
+		}), opts)
+		if err != nil {
+			return err
+		}
+
+		out, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	},
+}
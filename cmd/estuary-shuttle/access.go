@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/gateway"
+	"github.com/labstack/echo/v4"
+)
+
+// retrievals the primary allowed are not checked again for this long
+const accessCacheTTL = time.Minute
+
+// warmingError is returned for content that is being restored from its
+// deals, with the status the primary returned
+type warmingError struct {
+	body       []byte
+	retryAfter string
+}
+
+func (e *warmingError) Error() string {
+	return "content is being restored"
+}
+
+// cachedAccess is a retrieval the primary allowed, with the requests served
+// without asking it since, which the next check reports for the heat of
+// the cdn
+type cachedAccess struct {
+	expires time.Time
+	hits    int64
+}
+
+// retrievalAccess is what the primary allowed a retrieval with
+type retrievalAccess struct {
+	// cdn is where hot content is redirected to
+	cdn string
+	// ticket is reported back with how serving went, for the primary to
+	// meter it and refund its charge if it failed
+	ticket string
+}
+
+// checkRetrievalAccess asks the primary whether the dag the gateway path
+// p is in may be retrieved, with the access token of the request. Private
+// content is only served with a valid token, denylisted content not at all.
+// Hot content is sent to the cdn the primary returns, offloaded content is
+// reported as warming.
+func (d *Shuttle) checkRetrievalAccess(c echo.Context, p string) (*retrievalAccess, error) {
+	proto, cc, segs, err := gateway.ParsePath(p)
+	if err != nil || proto != "ipfs" {
+		// the gateway handler deals with these
+		return &retrievalAccess{}, nil
+	}
+
+	token := c.QueryParam("access-token")
+	if token == "" {
+		token = c.Request().Header.Get("X-Estuary-Access-Token")
+	}
+	voucher := c.QueryParam("paych-voucher")
+	if voucher == "" {
+		voucher = c.Request().Header.Get("X-Estuary-Paych-Voucher")
+	}
+
+	// retrievals with a selector are always checked, they take an api key
+	// and are priced by what they select
+	selective := c.QueryParam("selector") != ""
+	key := p + "|" + token
+	var hits int64
+	if v, ok := d.accessCache.Get(key); ok && !selective {
+		ca := v.(*cachedAccess)
+		if time.Now().Before(ca.expires) {
+			atomic.AddInt64(&ca.hits, 1)
+			return &retrievalAccess{}, nil
+		}
+		hits = atomic.SwapInt64(&ca.hits, 0)
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), time.Second*15)
+	defer cancel()
+
+	// paid retrievals are priced by what the path resolves to, the primary
+	// prices the whole dag when it isn't sent. It is checked against the
+	// denylist too, with the path
+	var target string
+	if len(segs) > 0 {
+		if t, err := d.gwayHandler.Resolve(ctx, p); err == nil {
+			target = t.String()
+		}
+	}
+
+	var selected int64
+	if selective {
+		req := c.Request().Clone(ctx)
+		req.URL.Path = p
+		selected, err = d.gwayHandler.SelectedSize(ctx, req)
+		if err != nil {
+			code := gateway.ErrorCode(err)
+			return nil, &util.HttpError{
+				Code:    code,
+				Reason:  http.StatusText(code),
+				Details: err.Error(),
+			}
+		}
+	}
+
+	scheme := "https"
+	if d.dev {
+		scheme = "http"
+	}
+	// the remote address goes into the audit log of retrievals the
+	// denylist blocks, and is what free retrievals are counted against
+	u := fmt.Sprintf("%s://%s/shuttle/access/%s?access-token=%s&remote=%s&paych-voucher=%s&target=%s&path=%s&hits=%d&selective=%t&selected=%d", scheme, d.estuaryHost, cc,
+		url.QueryEscape(token), url.QueryEscape(c.RealIP()), url.QueryEscape(voucher), target, url.QueryEscape(strings.Join(segs, "/")), hits, selective, selected)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+d.shuttleToken)
+	if auth, err := util.ExtractAuth(c); err == nil {
+		req.Header.Set(constants.ClientAuthHeader, auth)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// paid and metered retrievals, and hot content, are checked every
+		// time
+		if resp.Header.Get("Cache-Control") != "no-store" && !selective {
+			d.accessCache.Add(key, &cachedAccess{expires: time.Now().Add(accessCacheTTL)})
+		}
+		return &retrievalAccess{
+			cdn:    resp.Header.Get(constants.CDNHeader),
+			ticket: resp.Header.Get(constants.RetrievalTicketHeader),
+		}, nil
+	case http.StatusAccepted:
+		// offloaded content the primary is bringing back
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		if err != nil {
+			return nil, err
+		}
+		return nil, &warmingError{body: body, retryAfter: resp.Header.Get("Retry-After")}
+	case http.StatusPaymentRequired, http.StatusTooManyRequests:
+		// over the egress caps, or not paid for
+		if ra := resp.Header.Get("Retry-After"); ra != "" {
+			c.Response().Header().Set("Retry-After", ra)
+		}
+		var herr util.HttpErrorResponse
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&herr); err != nil || herr.Error.Reason == "" {
+			herr.Error = util.HttpError{Reason: util.ERR_PAYMENT_REQUIRED, Details: fmt.Sprintf("retrieving %s must be paid for", cc)}
+		}
+		herr.Error.Code = resp.StatusCode
+		return nil, &herr.Error
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, &util.HttpError{
+			Code:    resp.StatusCode,
+			Reason:  util.ERR_NOT_AUTHORIZED,
+			Details: fmt.Sprintf("%s is private, a valid access token is required", cc),
+		}
+	case http.StatusUnavailableForLegalReasons:
+		return nil, &util.HttpError{
+			Code:    resp.StatusCode,
+			Reason:  util.ERR_CONTENT_BLOCKED,
+			Details: fmt.Sprintf("%s is blocked by the denylist or quarantined", cc),
+		}
+	default:
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("checking access with the primary failed with status %d: %s", resp.StatusCode, msg)
+	}
+}
+
+// reportServed tells the primary how serving a retrieval it gave a ticket
+// for went: the bytes sent, and the status, a failure is refunded
+func (d *Shuttle) reportServed(ticket string, status int, size int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	body, err := json.Marshal(map[string]interface{}{"status": status, "bytes": size})
+	if err != nil {
+		log.Errorf("failed to report retrieval %s: %s", ticket, err)
+		return
+	}
+
+	scheme := "https"
+	if d.dev {
+		scheme = "http"
+	}
+	u := fmt.Sprintf("%s://%s/shuttle/access/served/%s", scheme, d.estuaryHost, url.PathEscape(ticket))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		log.Errorf("failed to report retrieval %s: %s", ticket, err)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+d.shuttleToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Errorf("failed to report retrieval %s: %s", ticket, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Errorf("reporting retrieval %s failed with status %d", ticket, resp.StatusCode)
+	}
+}
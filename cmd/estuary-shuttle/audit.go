@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util/audit"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// repairFetchTimeout bounds how long the blocks a content failed its audit
+// on are looked for on the network before they are retrieved from deals
+const repairFetchTimeout = 10 * time.Minute
+
+// handleRpcAuditContent checks the blocks the primary sampled, and against
+// the CAR index of the content when one is stored, and reports back.
+// Nothing is deleted here, the primary asks for a repair.
+func (s *Shuttle) handleRpcAuditContent(ctx context.Context, req *drpc.AuditContent) error {
+	if req == nil {
+		return fmt.Errorf("audit content command had nil params")
+	}
+
+	go func() {
+		ctx := context.Background()
+		results := make([]audit.Result, 0, len(req.Audits))
+		for _, a := range req.Audits {
+			res, err := audit.Check(ctx, s.Node.Blockstore.Get, a.Content, a.Blocks)
+			if err != nil {
+				log.Errorf("failed to audit content %d: %s", a.Content, err)
+				continue
+			}
+			if a.Root.Defined() {
+				if err := audit.CheckStoredIndex(res, s.carIndexes, a.Root, a.Blocks); err != nil {
+					log.Errorf("failed to check car index of content %d: %s", a.Content, err)
+				}
+			}
+			results = append(results, *res)
+		}
+
+		if err := s.sendRpcMessage(ctx, &drpc.Message{
+			Op: drpc.OP_AuditResult,
+			Params: drpc.MsgParams{
+				AuditResult: &drpc.AuditResult{Results: results},
+			},
+		}); err != nil {
+			log.Errorf("failed to send audit results: %s", err)
+		}
+	}()
+	return nil
+}
+
+// handleRpcRepairContent fetches the blocks a content failed its audit on
+// again, from the network and otherwise from the deals the primary sent
+func (s *Shuttle) handleRpcRepairContent(ctx context.Context, req *drpc.RepairContent) error {
+	if req == nil {
+		return fmt.Errorf("repair content command had nil params")
+	}
+
+	go func() {
+		ctx := context.Background()
+		if err := s.repairContent(ctx, req); err != nil {
+			log.Errorf("failed to repair content %d: %s", req.Content, err)
+			if err := s.sendRpcMessage(ctx, &drpc.Message{
+				Op: drpc.OP_RepairFailed,
+				Params: drpc.MsgParams{
+					RepairFailed: &drpc.RepairFailed{Content: req.Content, Reason: err.Error()},
+				},
+			}); err != nil {
+				log.Errorf("failed to report failed repair of content %d: %s", req.Content, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// repairContent only drops corrupt blocks once a good copy is in hand or a
+// retrieval from deals is about to write them again
+func (s *Shuttle) repairContent(ctx context.Context, req *drpc.RepairContent) error {
+	fctx, cancel := context.WithTimeout(ctx, repairFetchTimeout)
+	err := audit.Repair(fctx, s.Node.Blockstore, s.fetchFromPeers(req.Peers), req.Problems)
+	cancel()
+	if err == nil {
+		log.Infof("repaired content %d from the network", req.Content)
+		return nil
+	}
+	if len(req.Deals) == 0 {
+		return fmt.Errorf("fetching the blocks from the network failed and there are no deals to retrieve them from: %w", err)
+	}
+
+	log.Warnf("failed to repair content %d from the network, retrieving %s from its deals: %s", req.Content, req.Root, err)
+	if err := audit.DropCorrupt(ctx, s.Node.Blockstore, req.Problems); err != nil {
+		return err
+	}
+	for _, deal := range req.Deals {
+		ask, err := s.Filc.RetrievalQuery(ctx, deal.Miner, req.Root)
+		if err != nil {
+			log.Errorw("failed to query retrieval", "miner", deal.Miner, "content", req.Root, "err", err)
+			continue
+		}
+		if err := s.tryRetrieve(ctx, deal.Miner, req.Root, ask, nil); err != nil {
+			log.Errorw("failed to retrieve content", "miner", deal.Miner, "content", req.Root, "err", err)
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("failed to retrieve %s with any miner we have deals with", req.Root)
+}
+
+// fetchFromPeers fetches blocks over bitswap after connecting to peers,
+// which are only tried first, providers of the blocks are looked for too
+func (s *Shuttle) fetchFromPeers(peers []*peer.AddrInfo) audit.Getter {
+	var connected bool
+	return func(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+		if !connected {
+			connected = true
+			for _, p := range peers {
+				if err := s.Node.Host.Connect(ctx, *p); err != nil {
+					log.Debugf("failed to connect to origin %s: %s", p.ID, err)
+				}
+			}
+		}
+		return s.Node.Bitswap.GetBlock(ctx, c)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/application-research/estuary/autoretrieve"
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/pinner"
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+)
+
+// backupTables lists the tables that make up the state of the shuttle. Its
+// pin queue is rebuilt on startup from pins that are still pinning, so it
+// comes along with the pins table, as does the shared pin queue when it
+// lives in the shuttle's own database.
+func backupTables(cfg *config.Shuttle) []util.BackupTable {
+	tables := []util.BackupTable{
+		{Name: "pins", Model: &Pin{}},
+		{Name: "objects", Model: &Object{}},
+		{Name: "obj_refs", Model: &ObjRef{}},
+		{Name: "ipni_queueds", Model: &IPNIQueued{}},
+		{Name: "ipni_states", Model: &IPNIState{}},
+		{Name: "advertised_ranges", Model: &autoretrieve.AdvertisedRange{}},
+	}
+
+	if cfg.PinQueue.Shared && cfg.PinQueue.DatabaseConnString == "" {
+		tables = append(tables, util.BackupTable{Name: "pin_queue_entries", Model: pinner.SharedQueueModel()})
+	}
+	return tables
+}
+
+// handleBackup godoc
+// @Summary      Download a backup of the shuttle
+// @Description  This endpoint streams a gzipped archive of the shuttle's database tables, including its pin queues, that can be loaded on a new host with the restore command. Drain the shuttle first for a consistent snapshot.
+// @Tags         admin
+// @Produce      application/gzip
+// @Success      200
+// @Router       /admin/backup [get]
+func (s *Shuttle) handleBackup(c echo.Context) error {
+	name := fmt.Sprintf("shuttle-backup-%s.jsonl.gz", time.Now().UTC().Format("20060102-150405"))
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/gzip")
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", name))
+	res.WriteHeader(http.StatusOK)
+
+	man, err := util.WriteBackup(c.Request().Context(), s.DB, res, s.shuttleConfig.Hostname, backupTables(s.shuttleConfig))
+	if err != nil {
+		// the archive is cut short, so restoring it fails
+		log.Errorf("backup failed: %s", err)
+		return nil
+	}
+
+	log.Infof("backup written: %v", man.Rows)
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util/bwlimit"
+	"github.com/labstack/echo/v4"
+)
+
+// bandwidth meters the http traffic of the shuttle and holds it, and the
+// libp2p streams of its node, to the caps the primary set
+type bandwidth struct {
+	limiter *bwlimit.Limiter
+	// started is when the totals started counting from
+	started time.Time
+
+	lk     sync.Mutex
+	limits bwlimit.Limits
+}
+
+func (s *Shuttle) handleRpcSetBandwidthLimits(ctx context.Context, req *drpc.SetBandwidthLimits) error {
+	if req == nil {
+		return fmt.Errorf("set bandwidth limits command had nil params")
+	}
+	if err := req.Limits.Validate(); err != nil {
+		return fmt.Errorf("invalid bandwidth limits: %w", err)
+	}
+	s.bw.lk.Lock()
+	s.bw.limits = req.Limits
+	s.bw.lk.Unlock()
+
+	s.applyBandwidthLimits(time.Now())
+	return nil
+}
+
+func (s *Shuttle) applyBandwidthLimits(now time.Time) {
+	s.bw.lk.Lock()
+	ingest, egress := s.bw.limits.At(now)
+	s.bw.lk.Unlock()
+	s.bw.limiter.Set(ingest, egress)
+}
+
+// runBandwidthSchedule moves the caps along with their schedule
+func (s *Shuttle) runBandwidthSchedule(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.applyBandwidthLimits(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// bandwidthTotals returns what the shuttle received and sent over libp2p and
+// http since it started
+func (s *Shuttle) bandwidthTotals() (uint64, uint64) {
+	in, out := s.bw.limiter.Totals()
+	if s.Node.Bwc != nil {
+		st := s.Node.Bwc.GetBandwidthTotals()
+		in += uint64(st.TotalIn)
+		out += uint64(st.TotalOut)
+	}
+	return in, out
+}
+
+type limitedBody struct {
+	io.Reader
+	io.Closer
+}
+
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+	l   *bwlimit.Limiter
+}
+
+func (w *limitedResponseWriter) Write(p []byte) (int, error) {
+	if err := w.l.Egress(w.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *limitedResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// bandwidthMiddleware meters and throttles request bodies as ingest and
+// responses as egress
+func (s *Shuttle) bandwidthMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		req := c.Request()
+		if req.Body != nil {
+			req.Body = &limitedBody{Reader: s.bw.limiter.Reader(ctx, req.Body), Closer: req.Body}
+		}
+		c.Response().Writer = &limitedResponseWriter{ResponseWriter: c.Response().Writer, ctx: ctx, l: s.bw.limiter}
+		return next(c)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/carindex"
+	"github.com/application-research/estuary/util/piece"
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+)
+
+// ownPin returns the active pin of the content in the path, if it is the
+// user's
+func (s *Shuttle) ownPin(c echo.Context, u *User) (*Pin, error) {
+	return s.ownPinByParam(c, u, "cont")
+}
+
+func (s *Shuttle) ownPinByParam(c echo.Context, u *User, param string) (*Pin, error) {
+	cont, err := strconv.Atoi(c.Param(param))
+	if err != nil {
+		return nil, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid content id: %s", c.Param(param)),
+		}
+	}
+
+	var pin Pin
+	if err := s.DB.First(&pin, "content = ? AND active", cont).Error; err != nil || (pin.UserID != u.ID && u.Perms < util.PermLevelAdmin) {
+		return nil, &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_CONTENT_NOT_FOUND,
+			Details: fmt.Sprintf("content %d is not pinned here", cont),
+		}
+	}
+	return &pin, nil
+}
+
+// carLayout returns where the blocks are in the CAR of root, building and
+// storing it if the piece was computed before layouts were kept
+func (s *Shuttle) carLayout(ctx context.Context, root cid.Cid) (*carindex.Layout, error) {
+	l, err := s.carIndexes.Get(root)
+	if errors.Is(err, carindex.ErrNotFound) {
+		l, err = piece.Layout(ctx, root, s.Node.Blockstore)
+		if err == nil {
+			if perr := s.carIndexes.Put(l); perr != nil {
+				log.Warnf("failed to store car index of %s: %s", root, perr)
+			}
+		}
+	}
+	return l, err
+}
+
+// dropCarIndex deletes the layout of root once no pin here has it as its
+// root any more
+func (s *Shuttle) dropCarIndex(ctx context.Context, root cid.Cid) {
+	var count int64
+	if err := s.DB.WithContext(ctx).Model(&Pin{}).Where("cid = ?", util.DbCID{CID: root}).Count(&count).Error; err != nil {
+		log.Errorf("failed to check for pins of car index %s: %s", root, err)
+		return
+	}
+	if count > 0 {
+		return
+	}
+	if err := s.carIndexes.Delete(root); err != nil {
+		log.Errorf("failed to delete car index of %s: %s", root, err)
+	}
+}
+
+// dropStaleCarIndexes deletes the layouts of roots no pin here has any more
+func (s *Shuttle) dropStaleCarIndexes(ctx context.Context) error {
+	roots, err := s.carIndexes.Roots()
+	if err != nil {
+		return err
+	}
+	for _, root := range roots {
+		s.dropCarIndex(ctx, root)
+	}
+	return nil
+}
+
+// handleGetCarIndex serves the CARv2 index of the CAR of a content pinned
+// here, which the primary redirects to
+func (s *Shuttle) handleGetCarIndex(c echo.Context, u *User) error {
+	pin, err := s.ownPin(c, u)
+	if err != nil {
+		return err
+	}
+
+	l, err := s.carLayout(c.Request().Context(), pin.Cid.CID)
+	if err != nil {
+		return err
+	}
+
+	resp := c.Response()
+	resp.Header().Set(echo.HeaderContentType, echo.MIMEOctetStream)
+	resp.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%s.car.idx", l.Root))
+	resp.Header().Set("X-Car-Size", strconv.FormatUint(l.Size(), 10))
+	resp.WriteHeader(http.StatusOK)
+	return l.WriteIndex(resp)
+}
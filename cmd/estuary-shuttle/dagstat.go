@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util/dagstat"
+	"github.com/labstack/echo/v4"
+)
+
+// handleGetDagStat describes the DAG of a content pinned here, which the
+// primary redirects to. The stat is sent to the primary to keep once it is
+// computed, so the primary answers from then on.
+func (s *Shuttle) handleGetDagStat(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+	pin, err := s.ownPin(c, u)
+	if err != nil {
+		return err
+	}
+
+	content := pin.Content
+	job := s.dagStats.Start(pin.Cid.CID, dagstat.JobTimeout, func(st *dagstat.Stat, err error) {
+		if err != nil {
+			log.Warnf("failed to compute dag stat of content %d: %s", content, err)
+			return
+		}
+		if err := s.sendRpcMessage(context.Background(), &drpc.Message{
+			Op: drpc.OP_DagStat,
+			Params: drpc.MsgParams{
+				DagStat: &drpc.DagStat{Content: content, Stat: *st},
+			},
+		}); err != nil {
+			log.Warnf("failed to send dag stat of content %d: %s", content, err)
+		}
+	})
+	select {
+	case <-job.Done:
+	case <-time.After(dagstat.JobWait):
+		return c.JSON(http.StatusAccepted, map[string]bool{"computing": true})
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if job.Err != nil {
+		return job.Err
+	}
+	return c.JSON(http.StatusOK, job.Stat)
+}
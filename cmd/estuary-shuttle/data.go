@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
 	"time"
 
+	"github.com/application-research/estuary/autoretrieve"
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/pinner"
 	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
+	"github.com/pkg/errors"
 	"gorm.io/gorm"
 )
 
@@ -32,6 +38,9 @@ type Pin struct {
 
 	DagSplit  bool `json:"dagSplit"`
 	SplitFrom uint `json:"splitFrom"`
+
+	// Private pins are neither served over bitswap nor announced
+	Private bool `json:"private"`
 }
 
 type Object struct {
@@ -49,8 +58,8 @@ type ObjRef struct {
 	//Offloaded bool
 }
 
-func setupDatabase(dbval string) (*gorm.DB, error) {
-	db, err := util.SetupDatabase(dbval)
+func setupDatabase(dbval string, dbcfg config.Database) (*gorm.DB, error) {
+	db, err := util.SetupDatabase(dbval, util.DatabaseOptions(dbcfg))
 	if err != nil {
 		return nil, err
 	}
@@ -61,12 +70,95 @@ func setupDatabase(dbval string) (*gorm.DB, error) {
 	return db, nil
 }
 
+// setupPinQueue opens the shared pin queue if one is configured, in the
+// nodes own database unless the queue is given a database of its own
+func setupPinQueue(db *gorm.DB, cfg config.PinQueue, dbcfg config.Database) (*pinner.SharedQueue, error) {
+	if !cfg.Shared {
+		return nil, nil
+	}
+
+	if cfg.DatabaseConnString != "" {
+		qdb, err := util.SetupDatabase(cfg.DatabaseConnString, util.DatabaseOptions(dbcfg))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open pin queue database")
+		}
+		db = qdb
+	}
+	return pinner.NewSharedQueue(db, cfg.Name, cfg.LeaseTimeout, cfg.Encoding)
+}
+
 func migrateSchemas(db *gorm.DB) error {
 	if err := db.AutoMigrate(
 		&Pin{},
 		&Object{},
-		&ObjRef{}); err != nil {
+		&ObjRef{},
+		&IPNIQueued{},
+		&IPNIState{},
+		&autoretrieve.AdvertisedRange{}); err != nil {
 		return err
 	}
 	return nil
 }
+
+// insertObjects writes the objects of a pin and the refs linking them to it.
+// On postgres both are bulk loaded with COPY, elsewhere the batched inserts
+// share a single transaction rather than committing every batch.
+func (d *Shuttle) insertObjects(ctx context.Context, pin uint, objects []*Object) error {
+	if util.SupportsCopy(d.DB) {
+		cids := make([]util.DbCID, len(objects))
+		sizes := make([]int, len(objects))
+		for i, o := range objects {
+			cids[i] = o.Cid
+			sizes[i] = o.Size
+		}
+
+		ids, err := util.CopyObjects(ctx, d.DB, cids, sizes, util.CopyObjectsOpts{
+			RefColumn: "pin",
+			Owner:     pin,
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to copy objects into db")
+		}
+
+		for i, id := range ids {
+			objects[i].ID = id
+		}
+		return nil
+	}
+
+	return d.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.CreateInBatches(objects, 300).Error; err != nil {
+			return errors.Wrap(err, "failed to create objects in db")
+		}
+
+		refs := make([]ObjRef, len(objects))
+		for i := range refs {
+			refs[i].Pin = pin
+			refs[i].Object = objects[i].ID
+		}
+
+		if err := tx.CreateInBatches(refs, 500).Error; err != nil {
+			return errors.Wrap(err, "failed to create refs")
+		}
+		return nil
+	})
+}
+
+// dagSizeCacheSize is how many DAG size estimates are kept
+const dagSizeCacheSize = 100000
+
+// lookupDagSize returns the size of a pin of the same root that is already
+// complete
+func (s *Shuttle) lookupDagSize(ctx context.Context, c cid.Cid) (int64, bool, error) {
+	var sizes []int64
+	if err := s.DB.WithContext(ctx).Model(&Pin{}).
+		Where("cid = ? AND active AND size > 0", c.Bytes()).
+		Limit(1).
+		Pluck("size", &sizes).Error; err != nil {
+		return 0, false, err
+	}
+	if len(sizes) == 0 {
+		return 0, false, nil
+	}
+	return sizes[0], true, nil
+}
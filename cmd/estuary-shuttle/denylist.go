@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/util/denylist"
+	"github.com/ipfs/go-cid"
+)
+
+// the denylist of the primary is fetched this often
+const denylistRefresh = time.Minute * 10
+
+// shuttleDenylist is the denylist of the primary as of its last fetch, the
+// gateway and bitswap don't serve the blocks in it
+type shuttleDenylist struct {
+	lk   sync.RWMutex
+	list *denylist.List
+}
+
+func (sd *shuttleDenylist) listed(c cid.Cid) bool {
+	sd.lk.RLock()
+	defer sd.lk.RUnlock()
+	if sd.list == nil {
+		return false
+	}
+	_, ok := sd.list.Lookup(c)
+	return ok
+}
+
+func (d *Shuttle) fetchDenylist(ctx context.Context) (*denylist.List, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	scheme := "https"
+	if d.dev {
+		scheme = "http"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s/shuttle/denylist", scheme, d.estuaryHost), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+d.shuttleToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching the denylist failed with status %d", resp.StatusCode)
+	}
+
+	l := denylist.New()
+	if err := l.Parse(resp.Body, "primary"); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// runDenylistRefresh keeps the denylist up to date with the primary. Until
+// it was fetched once nothing is blocked but what the primary turns away in
+// access checks.
+func (d *Shuttle) runDenylistRefresh(ctx context.Context) {
+	ticker := time.NewTicker(denylistRefresh)
+	defer ticker.Stop()
+	for {
+		l, err := d.fetchDenylist(ctx)
+		if err != nil {
+			log.Errorf("failed to fetch the denylist: %s", err)
+		} else {
+			d.denylist.lk.Lock()
+			d.denylist.list = l
+			d.denylist.lk.Unlock()
+			d.withheld.Forget()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
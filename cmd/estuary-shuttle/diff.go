@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/application-research/estuary/util/dagdiff"
+	"github.com/ipfs/go-blockservice"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// blockDelta counts the blocks, and their bytes, that pin to has and pin
+// from doesn't, by cid
+func blockDelta(ctx context.Context, db *gorm.DB, from, to uint) (int, int64, error) {
+	var res struct {
+		Blocks int
+		Bytes  int64
+	}
+	err := db.WithContext(ctx).Raw(`SELECT COUNT(1) AS blocks, COALESCE(SUM(size), 0) AS bytes FROM (
+		SELECT objects.cid, MAX(objects.size) AS size FROM obj_refs JOIN objects ON objects.id = obj_refs.object
+		WHERE obj_refs.pin = ? AND objects.cid NOT IN (
+			SELECT objects.cid FROM obj_refs JOIN objects ON objects.id = obj_refs.object WHERE obj_refs.pin = ?)
+		GROUP BY objects.cid) AS delta`, to, from).Scan(&res).Error
+	return res.Blocks, res.Bytes, err
+}
+
+// handleGetContentDiff compares the DAGs of two contents pinned here, which
+// the primary redirects to
+func (s *Shuttle) handleGetContentDiff(c echo.Context, u *User) error {
+	from, err := s.ownPin(c, u)
+	if err != nil {
+		return err
+	}
+	to, err := s.ownPinByParam(c, u, "to")
+	if err != nil {
+		return err
+	}
+
+	dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, offline.Exchange(s.Node.Blockstore)))
+	ctx := c.Request().Context()
+	diff, err := dagdiff.Compare(ctx, dserv, from.Cid.CID, to.Cid.CID, dagdiff.Options{})
+	if err != nil {
+		return err
+	}
+	if diff.BlocksAdded, diff.BytesAdded, err = blockDelta(ctx, s.DB, from.ID, to.ID); err != nil {
+		return err
+	}
+	if diff.BlocksRemoved, diff.BytesRemoved, err = blockDelta(ctx, s.DB, to.ID, from.ID); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, diff)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+const defaultDrainDeadline = time.Minute * 30
+
+type drainBody struct {
+	// Deadline is how long to wait for in flight work, eg 30m
+	Deadline string `json:"deadline"`
+	// Exit shuts the shuttle down once drained
+	Exit bool `json:"exit"`
+}
+
+// handleDrain godoc
+// @Summary      Drain the shuttle
+// @Description  This endpoint starts draining the shuttle ahead of maintenance. New uploads and new work sent by the primary are refused, the primary node stops placing content on it, and in flight pins and data transfers are given until the deadline to finish. Queued pins are resumed when the shuttle starts again. With exit set the shuttle shuts down once drained.
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        body  body  drainBody  true  "Drain options"
+// @Success      202  {object}  util.DrainStatus
+// @Router       /admin/drain [post]
+func (s *Shuttle) handleDrain(c echo.Context) error {
+	var body drainBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	deadline := defaultDrainDeadline
+	if body.Deadline != "" {
+		d, err := time.ParseDuration(body.Deadline)
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: "invalid deadline: " + err.Error(),
+			}
+		}
+		deadline = d
+	}
+
+	ctx, cancel, err := s.drain.Begin(deadline)
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusConflict,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+
+	go func() {
+		defer cancel()
+		s.drain.Finish(s.runDrain(ctx))
+
+		// once the api server is down ServeAPI returns, and the deferred
+		// closes of the queue store, buffered blocks and libp2p host run on the
+		// way out
+		if body.Exit {
+			s.drain.SetPhase("shutting down")
+			if err := s.shutdownAPI(); err != nil {
+				log.Errorf("failed to shut down api server: %s", err)
+			}
+		}
+	}()
+
+	return c.JSON(http.StatusAccepted, s.drain.Status())
+}
+
+// handleDrainStatus godoc
+// @Summary      Get drain progress
+// @Description  This endpoint returns whether the shuttle is draining and which phase the drain is in.
+// @Tags         admin
+// @Produce      json
+// @Success      200  {object}  util.DrainStatus
+// @Router       /admin/drain [get]
+func (s *Shuttle) handleDrainStatus(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.drain.Status())
+}
+
+// runDrain lets the work in flight on the shuttle finish, intake is already
+// being refused by the time it runs
+func (s *Shuttle) runDrain(ctx context.Context) error {
+	// tell the primary right away rather than at the next periodic update,
+	// so it stops placing content here
+	s.drain.SetPhase("notifying primary")
+	upd, err := s.getUpdatePacket()
+	if err != nil {
+		return err
+	}
+	if err := s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_ShuttleUpdate,
+		Params: drpc.MsgParams{
+			ShuttleUpdate: upd,
+		},
+	}); err != nil {
+		log.Errorf("failed to notify primary of drain: %s", err)
+	}
+
+	s.drain.SetPhase("waiting for pins")
+	if err := s.PinMgr.Drain(ctx); err != nil {
+		return err
+	}
+
+	if err := s.drain.Wait(ctx, "waiting for data transfers", func() (bool, error) {
+		txs, err := s.Filc.TransfersInProgress(ctx)
+		if err != nil {
+			return false, err
+		}
+		for _, xfer := range txs {
+			if xfer.Status == datatransfer.Ongoing {
+				return false, nil
+			}
+		}
+		return true, nil
+	}); err != nil {
+		return err
+	}
+
+	// with a queue store the queue is written out and restored as is on
+	// startup, otherwise queued pins stay marked as pinning and are picked
+	// up again by refreshPinQueue
+	s.drain.SetPhase("checkpointing queues")
+	queued, ok, err := s.PinMgr.Checkpoint()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		var count int64
+		if err := s.DB.Model(&Pin{}).Where("active = false and pinning = true").Count(&count).Error; err != nil {
+			return err
+		}
+		queued = int(count)
+	}
+	log.Infof("drain: %d queued pins will be resumed on restart", queued)
+	return nil
+}
+
+func (s *Shuttle) shutdownAPI() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	err := s.echo.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return s.echo.Close()
+	}
+	return err
+}
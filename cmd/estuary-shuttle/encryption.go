@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/encrypt"
+	"github.com/labstack/echo/v4"
+)
+
+// encryptionKey returns the key an upload carries to be encrypted with, nil
+// when it carries none. The wrapped key of the content is kept by the
+// primary, which serves the decrypted downloads.
+func (s *Shuttle) encryptionKey(c echo.Context) ([]byte, error) {
+	hv := c.Request().Header.Get(encrypt.Header)
+	if hv == "" {
+		return nil, nil
+	}
+	if !s.shuttleConfig.Encryption.Enabled {
+		return nil, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "content encryption is not enabled on this node",
+		}
+	}
+
+	key, err := encrypt.ParseKey(hv)
+	if err != nil {
+		return nil, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid %s: %s", encrypt.Header, err),
+		}
+	}
+	return key, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/inclusion"
+	"github.com/labstack/echo/v4"
+)
+
+type inclusionProofResponse struct {
+	Proof *inclusion.Proof `json:"proof"`
+}
+
+// handleGetInclusionProof proves that a content is in the piece of an
+// aggregate pinned here, which the primary redirects to
+func (s *Shuttle) handleGetInclusionProof(c echo.Context, u *User) error {
+	agg, err := s.ownPinByParam(c, u, "agg")
+	if err != nil {
+		return err
+	}
+	pin, err := s.ownPin(c, u)
+	if err != nil {
+		return err
+	}
+	if !agg.Aggregate {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("content %d is not an aggregate", agg.Content),
+		}
+	}
+
+	ctx := c.Request().Context()
+	l, err := s.carLayout(ctx, agg.Cid.CID)
+	if err != nil {
+		return err
+	}
+	proof, err := inclusion.Prove(ctx, l, s.Node.Blockstore.Get, pin.Cid.CID)
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("content %d is not in aggregate %d: %s", pin.Content, agg.Content, err),
+		}
+	}
+	return c.JSON(http.StatusOK, inclusionProofResponse{Proof: proof})
+}
@@ -4,42 +4,73 @@ import (
 	"context"
 
 	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util/bwlimit"
+	"github.com/application-research/estuary/util/provide"
+	"github.com/application-research/estuary/util/withhold"
 	"github.com/ipfs/go-cid"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	"gorm.io/gorm"
 )
 
 type Initializer struct {
-	cfg *config.Node
-	db  *gorm.DB
+	cfg      *config.Node
+	db       *gorm.DB
+	bs       blockstore.Blockstore
+	withheld *withhold.Filter
+	bw       *bwlimit.Limiter
 }
 
-func (init Initializer) Config() *config.Node {
+func (init *Initializer) Config() *config.Node {
 	return init.cfg
 }
 
-func (init Initializer) BlockstoreWrap(blk blockstore.Blockstore) (blockstore.Blockstore, error) {
+func (init *Initializer) BlockstoreWrap(blk blockstore.Blockstore) (blockstore.Blockstore, error) {
+	init.bs = blk
 	return blk, nil
 }
 
-func (init Initializer) KeyProviderFunc(ctx context.Context) (<-chan cid.Cid, error) {
+func (init *Initializer) Withheld(ctx context.Context, c cid.Cid) bool {
+	return init.withheld.Withheld(ctx, c)
+}
+
+func (init *Initializer) Bandwidth() *bwlimit.Limiter {
+	return init.bw
+}
+
+func (init *Initializer) KeyProviderFunc(ctx context.Context) (<-chan cid.Cid, error) {
 	log.Infof("running key provider func")
 	out := make(chan cid.Cid)
 	go func() {
 		defer close(out)
 
+		policy, err := init.cfg.Provide.Policy()
+		if err != nil {
+			log.Errorf("invalid provide config: %s", err)
+			return
+		}
+
 		var pins []Pin
-		if err := init.db.Find(&pins, "active").Error; err != nil {
+		// private pins aren't announced
+		if err := init.db.Find(&pins, "active AND NOT private").Error; err != nil {
 			log.Errorf("failed to load pins for reproviding: %s", err)
 			return
 		}
-		log.Infof("key provider func returning %d values", len(pins))
+		log.Infof("key provider func providing %d pins", len(pins))
 
-		for _, c := range pins {
+		send := func(c cid.Cid) error {
 			select {
-			case out <- c.Cid.CID:
+			case out <- c:
+				return nil
 			case <-ctx.Done():
-				return
+				return ctx.Err()
+			}
+		}
+		for _, p := range pins {
+			if err := provide.Keys(ctx, init.bs, policy.For(p.Size), p.Cid.CID, send); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Warnf("failed to reprovide pin %d: %s", p.ID, err)
 			}
 		}
 	}()
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/autoretrieve"
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util"
+	provider "github.com/filecoin-project/index-provider"
+	"github.com/filecoin-project/index-provider/metadata"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/host"
+	"gorm.io/gorm"
+)
+
+const ipniBatchSize = 1000
+
+// IPNIQueued is a pin queued to be advertised to the indexers, in the order
+// pins became active here
+type IPNIQueued struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	Pin       uint `gorm:"index"`
+}
+
+// IPNIState is how far the queue was advertised, and by which identity
+type IPNIState struct {
+	ID        uint `gorm:"primarykey"`
+	UpdatedAt time.Time
+
+	PeerID            string
+	LastAdvertisedSeq uint
+}
+
+// newIPNIEngine starts the index provider engine the shuttle advertises its
+// own content with, signed with the key of its host, nil unless enabled
+func newIPNIEngine(ctx context.Context, cfg *config.Shuttle, db *gorm.DB, h host.Host, ds datastore.Batching) (*autoretrieve.AutoretrieveEngine, error) {
+	if !cfg.IPNI.Enabled {
+		return nil, nil
+	}
+
+	eng, err := autoretrieve.New(
+		autoretrieve.WithHost(h),
+		autoretrieve.WithPublisherKind(autoretrieve.DataTransferPublisher),
+		autoretrieve.WithDirectAnnounce(cfg.Node.IndexerURL),
+		autoretrieve.WithDatastore(ds),
+	)
+	if err != nil {
+		return nil, err
+	}
+	eng.RegisterMultihashLister(func(ctx context.Context, contextID []byte) (provider.MultihashIterator, error) {
+		from, to, err := autoretrieve.ParseIPNIContextID(contextID)
+		if err != nil {
+			return nil, err
+		}
+		cids, err := ipniQueuedCids(db.WithContext(ctx), from, to)
+		if err != nil {
+			return nil, err
+		}
+		if len(cids) == 0 {
+			return nil, fmt.Errorf("no new CIDs to announce")
+		}
+		return &autoretrieve.EstuaryMhIterator{Cids: cids}, nil
+	})
+
+	if err := backfillIPNIQueue(db); err != nil {
+		return nil, err
+	}
+	if err := eng.Start(ctx); err != nil {
+		return nil, err
+	}
+	return eng, nil
+}
+
+// backfillIPNIQueue queues everything already pinned when nothing was
+// advertised yet, so pins made before the queue existed are advertised too
+func backfillIPNIQueue(db *gorm.DB) error {
+	var n int64
+	if err := db.Model(&IPNIState{}).Count(&n).Error; err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	if err := db.Model(&IPNIQueued{}).Limit(1).Count(&n).Error; err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	var last uint
+	for {
+		var ids []uint
+		if err := db.Model(&Pin{}).Where("active AND NOT private AND id > ?", last).Order("id").Limit(ipniBatchSize).
+			Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		queued := make([]IPNIQueued, 0, len(ids))
+		for _, id := range ids {
+			queued = append(queued, IPNIQueued{Pin: id})
+		}
+		if err := db.Create(&queued).Error; err != nil {
+			return err
+		}
+		last = ids[len(ids)-1]
+	}
+}
+
+// ipniQueuedCids returns the cids of the active public pins queued after
+// seq from and up to seq to
+func ipniQueuedCids(db *gorm.DB, from, to uint) ([]cid.Cid, error) {
+	var dbcids []util.DbCID
+	if err := db.Raw(`SELECT DISTINCT objects.cid FROM objects JOIN obj_refs ON objects.id = obj_refs.object
+		WHERE obj_refs.pin IN (SELECT pin FROM ipni_queueds WHERE id > ? AND id <= ?)
+		AND obj_refs.pin IN (SELECT id FROM pins WHERE active AND NOT private)`, from, to).Scan(&dbcids).Error; err != nil {
+		return nil, fmt.Errorf("unable to query queued CIDs from database: %s", err)
+	}
+	cids := make([]cid.Cid, 0, len(dbcids))
+	for _, c := range dbcids {
+		cids = append(cids, c.CID)
+	}
+	return cids, nil
+}
+
+// queueIPNI queues pins that became active to be advertised
+func (s *Shuttle) queueIPNI(ctx context.Context, pins ...uint) {
+	if s.ipni == nil || len(pins) == 0 {
+		return
+	}
+	queued := make([]IPNIQueued, 0, len(pins))
+	for _, p := range pins {
+		queued = append(queued, IPNIQueued{Pin: p})
+	}
+	if err := s.DB.WithContext(ctx).Create(&queued).Error; err != nil {
+		log.Errorf("failed to queue pins for advertisement: %s", err)
+	}
+}
+
+// retractIPNI removes the advertisements of an unpinned pin, and queues the
+// rest of what was advertised along with it to be advertised again
+func (s *Shuttle) retractIPNI(ctx context.Context, pin uint) {
+	if s.ipni == nil {
+		return
+	}
+	if err := s.retractIPNIPin(ctx, pin); err != nil {
+		log.Errorf("failed to remove the advertisements of pin %d: %s", pin, err)
+	}
+}
+
+func (s *Shuttle) retractIPNIPin(ctx context.Context, pin uint) error {
+	var seqs []uint
+	if err := s.DB.WithContext(ctx).Model(&IPNIQueued{}).Where("pin = ?", pin).Pluck("id", &seqs).Error; err != nil {
+		return err
+	}
+	ranges, err := s.ipni.RemoveAdvertised(ctx, s.DB, seqs)
+	if err != nil {
+		return err
+	}
+	if err := s.DB.WithContext(ctx).Where("pin = ?", pin).Delete(&IPNIQueued{}).Error; err != nil {
+		return err
+	}
+
+	seen := make(map[uint]bool)
+	var requeue []uint
+	for _, r := range ranges {
+		var pins []uint
+		if err := s.DB.WithContext(ctx).Model(&IPNIQueued{}).Where("id > ? AND id <= ?", r.FromSeq, r.ToSeq).
+			Distinct().Pluck("pin", &pins).Error; err != nil {
+			return err
+		}
+		for _, p := range pins {
+			if !seen[p] {
+				seen[p] = true
+				requeue = append(requeue, p)
+			}
+		}
+	}
+	s.queueIPNI(ctx, requeue...)
+	return nil
+}
+
+func (s *Shuttle) runIPNI(ctx context.Context) {
+	if s.ipni == nil {
+		return
+	}
+
+	ticker := time.NewTicker(s.ipniInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.announceIPNI(ctx); err != nil {
+			log.Errorf("failed to advertise content to the indexers: %s", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// announceIPNI advertises the pins queued since the last announcement, with
+// the shuttle as their provider and publisher, in batches
+func (s *Shuttle) announceIPNI(ctx context.Context) error {
+	addrs := autoretrieve.PublicAddrs(s.Node.Host.Addrs())
+	if len(addrs) == 0 {
+		return fmt.Errorf("no public addresses to advertise")
+	}
+	id := s.Node.Host.ID().String()
+
+	var st IPNIState
+	if err := s.DB.WithContext(ctx).FirstOrCreate(&st).Error; err != nil {
+		return err
+	}
+	if st.PeerID != "" && st.PeerID != id {
+		// a node with a new identity is a new provider, all of its content
+		// is advertised again
+		st.LastAdvertisedSeq = 0
+	}
+
+	for {
+		var seqs []uint
+		if err := s.DB.WithContext(ctx).Model(&IPNIQueued{}).Where("id > ?", st.LastAdvertisedSeq).
+			Order("id asc").Limit(ipniBatchSize).Pluck("id", &seqs).Error; err != nil {
+			return fmt.Errorf("unable to query the advertisement queue: %s", err)
+		}
+		if len(seqs) == 0 {
+			return nil
+		}
+		from, to := st.LastAdvertisedSeq, seqs[len(seqs)-1]
+
+		cids, err := ipniQueuedCids(s.DB.WithContext(ctx), from, to)
+		if err != nil {
+			return err
+		}
+		if len(cids) > 0 {
+			ctxID := autoretrieve.IPNIContextID(from, to)
+			adCid, err := s.ipni.NotifyPut(ctx, ctxID, id, addrs, metadata.New(metadata.Bitswap{}))
+			if err != nil && err != provider.ErrAlreadyAdvertised {
+				return fmt.Errorf("could not advertise content: %s", err)
+			}
+			log.Infof("advertised %d CIDs to the indexers: %s", len(cids), adCid)
+			if err := autoretrieve.RecordAdvertised(ctx, s.DB, ctxID, from, to); err != nil {
+				return err
+			}
+		}
+
+		if err := s.DB.WithContext(ctx).Model(&IPNIState{}).Where("id = ?", st.ID).UpdateColumns(map[string]interface{}{
+			"peer_id":             id,
+			"last_advertised_seq": to,
+			"updated_at":          time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+		st.LastAdvertisedSeq = to
+		st.PeerID = id
+	}
+}
@@ -20,22 +20,41 @@ import (
 	"time"
 
 	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/faults"
 	"github.com/application-research/estuary/node/modules/peering"
 	"github.com/application-research/estuary/pinner/types"
 
+	"github.com/application-research/estuary/autoretrieve"
+	"github.com/application-research/estuary/build"
 	"github.com/application-research/estuary/config"
 	estumetrics "github.com/application-research/estuary/metrics"
+	"github.com/application-research/estuary/util/bwlimit"
+	"github.com/application-research/estuary/util/carindex"
+	"github.com/application-research/estuary/util/cdn"
+	"github.com/application-research/estuary/util/dagsize"
+	"github.com/application-research/estuary/util/dagstat"
+	"github.com/application-research/estuary/util/denylist"
+	"github.com/application-research/estuary/util/encrypt"
+	"github.com/application-research/estuary/util/fetchstats"
 	"github.com/application-research/estuary/util/gateway"
+	"github.com/application-research/estuary/util/gsfetch"
+	"github.com/application-research/estuary/util/httpfetch"
+	"github.com/application-research/estuary/util/piece"
+	"github.com/application-research/estuary/util/requestid"
+	"github.com/application-research/estuary/util/scan"
 	"github.com/application-research/filclient/retrievehelper"
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
 	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
 	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
 	"go.opentelemetry.io/otel/trace"
 
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/urfave/cli/v2"
+	"go.opencensus.io/stats/view"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/net/websocket"
@@ -48,6 +67,10 @@ import (
 	"github.com/application-research/estuary/pinner"
 	"github.com/application-research/estuary/stagingbs"
 	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/dagwalk"
+	"github.com/application-research/estuary/util/providers"
+	"github.com/application-research/estuary/util/sessionpool"
+	"github.com/application-research/estuary/util/withhold"
 	"github.com/application-research/filclient"
 	"github.com/cenkalti/backoff/v4"
 	"github.com/filecoin-project/go-address"
@@ -86,6 +109,10 @@ const (
 
 //#nosec G104 - it's not common to treat SetLogLevel error return
 func before(cctx *cli.Context) error {
+	if err := util.SetupLogFormat(util.LogFormat); err != nil {
+		return err
+	}
+
 	level := util.LogLevel
 
 	logging.SetLogLevel("dt-impl", level)
@@ -117,12 +144,18 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Shuttle
 		switch name {
 		case "node-api-url":
 			cfg.Node.ApiURL = cctx.String("node-api-url")
+		case "network":
+			cfg.Network.Name = cctx.String("network")
 		case "datadir":
 			cfg.DataDir = cctx.String("datadir")
 		case "blockstore":
 			cfg.Node.Blockstore = cctx.String("blockstore")
 		case "no-blockstore-cache":
 			cfg.Node.NoBlockstoreCache = cctx.Bool("no-blockstore-cache")
+		case "block-cache-size":
+			cfg.Node.BlockCache.Size = cctx.Int64("block-cache-size")
+		case "write-batch-size":
+			cfg.Node.WriteBatch.MaxBlocks = cctx.Int("write-batch-size")
 		case "write-log-truncate":
 			cfg.Node.WriteLogTruncate = cctx.Bool("write-log-truncate")
 		case "write-log-flush":
@@ -135,6 +168,36 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Shuttle
 			}
 		case "database":
 			cfg.DatabaseConnString = cctx.String("database")
+		case "database-max-conns":
+			cfg.Database.MaxOpenConns = cctx.Int("database-max-conns")
+		case "database-statement-timeout":
+			cfg.Database.StatementTimeout = cctx.Duration("database-statement-timeout")
+		case "database-read-replica":
+			cfg.Database.ReadReplicaConnString = cctx.String("database-read-replica")
+		case "shared-pin-queue":
+			cfg.PinQueue.Shared = cctx.Bool("shared-pin-queue")
+		case "pin-queue-name":
+			cfg.PinQueue.Name = cctx.String("pin-queue-name")
+		case "pin-queue-encoding":
+			cfg.PinQueue.Encoding = cctx.String("pin-queue-encoding")
+		case "fetch-workers":
+			cfg.PinQueue.Fetch.Workers = cctx.Int("fetch-workers")
+		case "fetch-max-workers":
+			cfg.PinQueue.Fetch.MaxWorkers = cctx.Int("fetch-max-workers")
+		case "fetch-want-batch-size":
+			cfg.PinQueue.Fetch.WantBatchSize = cctx.Int("fetch-want-batch-size")
+		case "pin-transport":
+			t, err := gsfetch.ParseTransport(cctx.String("pin-transport"))
+			if err != nil {
+				return err
+			}
+			cfg.PinQueue.Fetch.Transport = string(t)
+		case "gateway-fallback":
+			cfg.PinQueue.GatewayFallback.Enabled = cctx.Bool("gateway-fallback")
+		case "fallback-gateways":
+			cfg.PinQueue.GatewayFallback.Gateways = cctx.StringSlice("fallback-gateways")
+		case "lookup-indexer-url":
+			cfg.Node.LookupIndexerURL = cctx.String("lookup-indexer-url")
 		case "apilisten":
 			cfg.ApiListen = cctx.String("apilisten")
 		case "libp2p-websockets":
@@ -163,6 +226,14 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Shuttle
 			cfg.Jaeger.ProviderUrl = cctx.String("jaeger-provider-url")
 		case "jaeger-sampler-ratio":
 			cfg.Jaeger.SamplerRatio = cctx.Float64("jaeger-sampler-ratio")
+		case "otlp-tracing":
+			cfg.Otlp.EnableTracing = cctx.Bool("otlp-tracing")
+		case "otlp-endpoint":
+			cfg.Otlp.Endpoint = cctx.String("otlp-endpoint")
+		case "otlp-insecure":
+			cfg.Otlp.Insecure = cctx.Bool("otlp-insecure")
+		case "otlp-sampler-ratio":
+			cfg.Otlp.SamplerRatio = cctx.Float64("otlp-sampler-ratio")
 		case "logging":
 			cfg.Logging.ApiEndpointLogging = cctx.Bool("logging")
 		case "bitswap-max-work-per-peer":
@@ -179,6 +250,8 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Shuttle
 			cfg.Private = cctx.Bool("private")
 		case "dev":
 			cfg.Dev = cctx.Bool("dev")
+		case "no-pin-queue-snapshot":
+			cfg.PinQueue.Snapshot.Enabled = !cctx.Bool("no-pin-queue-snapshot")
 		case "no-reload-pin-queue":
 			cfg.NoReloadPinQueue = cctx.Bool("no-reload-pin-queue")
 		default:
@@ -206,6 +279,7 @@ func main() {
 
 	app.Flags = []cli.Flag{
 		util.FlagLogLevel,
+		util.FlagLogFormat,
 		&cli.StringFlag{
 			Name:  "repo",
 			Value: "~/.lotus",
@@ -216,6 +290,11 @@ func main() {
 			Value:   cfg.Node.ApiURL,
 			EnvVars: []string{"FULLNODE_API_INFO"},
 		},
+		&cli.StringFlag{
+			Name:  "network",
+			Value: cfg.Network.Name,
+			Usage: "filecoin network to make deals on: mainnet, calibnet or devnet",
+		},
 		&cli.StringFlag{
 			Name:  "config",
 			Usage: "specify configuration file location",
@@ -227,6 +306,72 @@ func main() {
 			Value:   cfg.DatabaseConnString,
 			EnvVars: []string{"ESTUARY_SHUTTLE_DATABASE"},
 		},
+		&cli.IntFlag{
+			Name:  "database-max-conns",
+			Usage: "maximum number of open connections to the database",
+			Value: cfg.Database.MaxOpenConns,
+		},
+		&cli.DurationFlag{
+			Name:  "database-statement-timeout",
+			Usage: "abort database queries that run longer than this (postgres only)",
+			Value: cfg.Database.StatementTimeout,
+		},
+		&cli.StringFlag{
+			Name:    "database-read-replica",
+			Usage:   "specify connection string for a read replica that listing and status queries are sent to",
+			Value:   cfg.Database.ReadReplicaConnString,
+			EnvVars: []string{"ESTUARY_SHUTTLE_DATABASE_READ_REPLICA"},
+		},
+		&cli.BoolFlag{
+			Name:  "shared-pin-queue",
+			Usage: "keep the pin queue in the database so every node configured with the same queue name works through it",
+			Value: cfg.PinQueue.Shared,
+		},
+		&cli.StringFlag{
+			Name:  "pin-queue-encoding",
+			Usage: "how shared pin queue entries are stored: json, compact, snappy or zstd",
+			Value: cfg.PinQueue.Encoding,
+		},
+		&cli.StringFlag{
+			Name:  "pin-queue-name",
+			Usage: "name of the shared pin queue to consume from",
+			Value: cfg.PinQueue.Name,
+		},
+		&cli.IntFlag{
+			Name:  "fetch-workers",
+			Usage: "number of blocks of a pin fetched in parallel when it starts",
+			Value: cfg.PinQueue.Fetch.Workers,
+		},
+		&cli.IntFlag{
+			Name:  "fetch-max-workers",
+			Usage: "number of parallel block fetches a large pin can grow to",
+			Value: cfg.PinQueue.Fetch.MaxWorkers,
+		},
+		&cli.IntFlag{
+			Name:  "fetch-want-batch-size",
+			Usage: "number of blocks each fetch worker of a pin requests at once",
+			Value: cfg.PinQueue.Fetch.WantBatchSize,
+		},
+		&cli.StringFlag{
+			Name:  "pin-transport",
+			Usage: "how pins are fetched: auto, bitswap or graphsync",
+			Value: cfg.PinQueue.Fetch.Transport,
+		},
+		&cli.BoolFlag{
+			Name:  "gateway-fallback",
+			Usage: "fetch pins that stalled from trusted http gateways instead of peer to peer",
+			Value: cfg.PinQueue.GatewayFallback.Enabled,
+		},
+		&cli.StringSliceFlag{
+			Name:  "fallback-gateways",
+			Usage: "trusted http gateways to fetch pins that stalled from",
+			Value: cli.NewStringSlice(cfg.PinQueue.GatewayFallback.Gateways...),
+		},
+		&cli.StringFlag{
+			Name:  "lookup-indexer-url",
+			Usage: "network indexer to look up providers at alongside the dht, empty to only use the dht",
+			Value: cfg.Node.LookupIndexerURL,
+		},
 		&cli.StringFlag{
 			Name:  "blockstore",
 			Usage: "specify blockstore parameters",
@@ -289,6 +434,16 @@ func main() {
 			Usage: "disable blockstore caching",
 			Value: cfg.Node.NoBlockstoreCache,
 		},
+		&cli.Int64Flag{
+			Name:  "block-cache-size",
+			Usage: "bytes of recently read blocks to keep in memory, 0 to disable",
+			Value: cfg.Node.BlockCache.Size,
+		},
+		&cli.IntFlag{
+			Name:  "write-batch-size",
+			Usage: "number of blocks to buffer and write to the blockstore together, 0 to write every block as it comes in",
+			Value: cfg.Node.WriteBatch.MaxBlocks,
+		},
 		&cli.BoolFlag{
 			Name:  "private",
 			Usage: "sets shuttle as private",
@@ -299,6 +454,11 @@ func main() {
 			Usage: "disallow new content ingestion on this node",
 			Value: cfg.Content.DisableLocalAdding,
 		},
+		&cli.BoolFlag{
+			Name:  "no-pin-queue-snapshot",
+			Usage: "do not keep the pin queue on disk, rebuild it from the database on start",
+			Value: !cfg.PinQueue.Snapshot.Enabled,
+		},
 		&cli.BoolFlag{
 			Name:  "no-reload-pin-queue",
 			Usage: "disable reloading pin queue on shuttle start",
@@ -333,6 +493,26 @@ func main() {
 			Usage: "If less than 1 probabilistic metrics will be used.",
 			Value: cfg.Jaeger.SamplerRatio,
 		},
+		&cli.BoolFlag{
+			Name:  "otlp-tracing",
+			Usage: "enables exporting traces to an OTLP/HTTP collector",
+			Value: cfg.Otlp.EnableTracing,
+		},
+		&cli.StringFlag{
+			Name:  "otlp-endpoint",
+			Usage: "sets the OTLP/HTTP collector endpoint (host:port)",
+			Value: cfg.Otlp.Endpoint,
+		},
+		&cli.BoolFlag{
+			Name:  "otlp-insecure",
+			Usage: "send traces to the OTLP collector without TLS",
+			Value: cfg.Otlp.Insecure,
+		},
+		&cli.Float64Flag{
+			Name:  "otlp-sampler-ratio",
+			Usage: "If less than 1 probabilistic metrics will be used.",
+			Value: cfg.Otlp.SamplerRatio,
+		},
 		&cli.BoolFlag{
 			Name:  "libp2p-websockets",
 			Usage: "enable adding libp2p websockets listen addr",
@@ -365,6 +545,97 @@ func main() {
 				}
 				return cfg.Save(configFile)
 			},
+		}, {
+			Name:      "backup",
+			Usage:     "Writes the shuttle's database tables and pin queues to an archive that can be restored on a new host",
+			ArgsUsage: "<output file>",
+			Action: func(cctx *cli.Context) error {
+				if cctx.Args().Len() != 1 {
+					return errors.New("must specify the file to write the backup to")
+				}
+
+				if err := cfg.Load(cctx.String("config")); err != nil && err != config.ErrNotInitialized {
+					return err
+				}
+
+				if err := overrideSetOptions(app.Flags, cctx, cfg); err != nil {
+					return err
+				}
+
+				db, err := setupDatabase(cfg.DatabaseConnString, cfg.Database)
+				if err != nil {
+					return err
+				}
+
+				fi, err := os.Create(cctx.Args().First())
+				if err != nil {
+					return err
+				}
+				defer fi.Close()
+
+				man, err := util.WriteBackup(cctx.Context, db, fi, cfg.Hostname, backupTables(cfg))
+				if err != nil {
+					return err
+				}
+
+				for _, t := range man.Tables {
+					fmt.Printf("%s: %d rows\n", t, man.Rows[t])
+				}
+				return fi.Close()
+			},
+		}, {
+			Name:      "restore",
+			Usage:     "Loads a backup archive into the shuttle's database, run it before starting the shuttle",
+			ArgsUsage: "<backup file>",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "force",
+					Usage: "restore into a database that already has pins",
+				},
+			},
+			Action: func(cctx *cli.Context) error {
+				if cctx.Args().Len() != 1 {
+					return errors.New("must specify the backup file to restore")
+				}
+
+				if err := cfg.Load(cctx.String("config")); err != nil && err != config.ErrNotInitialized {
+					return err
+				}
+
+				if err := overrideSetOptions(app.Flags, cctx, cfg); err != nil {
+					return err
+				}
+
+				db, err := setupDatabase(cfg.DatabaseConnString, cfg.Database)
+				if err != nil {
+					return err
+				}
+
+				var pins int64
+				if err := db.Model(&Pin{}).Count(&pins).Error; err != nil {
+					return err
+				}
+				if pins > 0 && !cctx.Bool("force") {
+					return fmt.Errorf("database already has %d pins, pass --force to restore into it anyway", pins)
+				}
+
+				fi, err := os.Open(cctx.Args().First())
+				if err != nil {
+					return err
+				}
+				defer fi.Close()
+
+				man, err := util.RestoreBackup(cctx.Context, db, fi, backupTables(cfg))
+				if err != nil {
+					return err
+				}
+
+				fmt.Printf("restored backup of %s taken %s\n", man.Node, man.Created.Format(time.RFC3339))
+				for _, t := range man.Tables {
+					fmt.Printf("%s: %d rows\n", t, man.Rows[t])
+				}
+				return nil
+			},
 		},
 	}
 
@@ -383,7 +654,19 @@ func main() {
 			return err
 		}
 
-		db, err := setupDatabase(cfg.DatabaseConnString)
+		network, err := cfg.Network.Resolve()
+		if err != nil {
+			return err
+		}
+		if err := build.SetNetwork(network); err != nil {
+			return err
+		}
+
+		if err := util.ApplyLogLevels(cfg.Logging.Levels); err != nil {
+			return err
+		}
+
+		db, err := setupDatabase(cfg.DatabaseConnString, cfg.Database)
 		if err != nil {
 			return err
 		}
@@ -392,12 +675,45 @@ func main() {
 			cfg.Node.ListenAddrs = append(cfg.Node.ListenAddrs, config.DefaultWebsocketAddr)
 		}
 
-		init := Initializer{&cfg.Node, db}
-		nd, err := node.Setup(context.TODO(), init)
+		// blocks of private pins aren't served over bitswap, nor are
+		// denylisted blocks
+		dl := &shuttleDenylist{}
+		withheld, err := withhold.New(func(ctx context.Context, c cid.Cid) (bool, error) {
+			if dl.listed(c) {
+				return true, nil
+			}
+			return isPrivateCid(ctx, db, c)
+		}, withheldCacheSize, withheldCacheTTL)
 		if err != nil {
 			return err
 		}
 
+		// the caps hold for http and libp2p alike
+		bwLimiter := bwlimit.New()
+		init := Initializer{cfg: &cfg.Node, db: db, withheld: withheld, bw: bwLimiter}
+		nd, err := node.Setup(context.TODO(), &init)
+		if err != nil {
+			return err
+		}
+		defer nd.Host.Close() //nolint:errcheck
+		defer func() {
+			if err := nd.GraphsyncFetcher.Close(); err != nil {
+				log.Errorf("failed to close graphsync fetcher: %s", err)
+			}
+		}()
+		if nd.WriteBatcher != nil {
+			defer func() {
+				if err := nd.WriteBatcher.Close(); err != nil {
+					log.Errorf("failed to flush buffered blocks: %s", err)
+				}
+			}()
+		}
+
+		if err = view.Register(estumetrics.DefaultViews...); err != nil {
+			log.Fatalf("Cannot register the OpenCensus view: %v", err)
+			return err
+		}
+
 		// send a CLI context to lotus that contains only the node "api-url" flag set, so that other flags don't accidentally conflict with lotus cli flags
 		// https://github.com/filecoin-project/lotus/blob/731da455d46cb88ee5de9a70920a2d29dec9365c/cli/util/api.go#L37
 		flset := flag.NewFlagSet("lotus", flag.ExitOnError)
@@ -414,6 +730,16 @@ func main() {
 		}
 		defer closer()
 
+		if network.Genesis != "" {
+			gen, err := api.ChainGetGenesis(cctx.Context)
+			if err != nil {
+				return fmt.Errorf("failed to get genesis: %w", err)
+			}
+			if gc := gen.Cids()[0].String(); gc != network.Genesis {
+				return fmt.Errorf("chain api is not on %s, its genesis is %s instead of %s", network.Name, gc, network.Genesis)
+			}
+		}
+
 		defaddr, err := nd.Wallet.GetDefault()
 		if err != nil {
 			return err
@@ -427,6 +753,14 @@ func main() {
 
 		metCtx := metrics.CtxScope(context.Background(), "shuttle")
 		activeCommp := metrics.NewCtx(metCtx, "active_commp", "number of active piece commitment calculations ongoing").Gauge()
+		carIndexes, err := carindex.NewStore(filepath.Join(cfg.DataDir, "car-indexes"))
+		if err != nil {
+			return err
+		}
+		dagStats, err := dagstat.New(merkledag.NewDAGService(blockservice.New(nd.Blockstore, offline.Exchange(nd.Blockstore))), dagstat.Options{})
+		if err != nil {
+			return err
+		}
 		commpMemo := memo.NewMemoizer(func(ctx context.Context, k string, v interface{}) (interface{}, error) {
 			activeCommp.Inc()
 			defer activeCommp.Dec()
@@ -438,17 +772,31 @@ func main() {
 				return nil, err
 			}
 
-			commpcid, carSize, size, err := filclient.GeneratePieceCommitmentFFI(ctx, c, nd.Blockstore)
+			// the contents in an aggregate that had their own pieces
+			// computed aren't walked
+			var aggr int64
+			if err := db.Model(&Pin{}).Where("cid = ? AND aggregate", util.DbCID{CID: c}).Limit(1).Count(&aggr).Error; err != nil {
+				return nil, err
+			}
+			var pc *piece.Piece
+			if aggr > 0 {
+				pc, err = piece.GenerateAggregate(ctx, c, nd.Blockstore, carIndexes.Lookup)
+			} else {
+				pc, err = piece.Generate(ctx, c, nd.Blockstore)
+			}
 			if err != nil {
 				return nil, err
 			}
 
-			log.Infof("commp generation over %d bytes took: %s", size, time.Since(start))
+			log.Infof("commp generation over %d bytes (%d blocks) took: %s", pc.CarSize, pc.Blocks, time.Since(start))
+			if err := carIndexes.Put(pc.Layout); err != nil {
+				log.Warnf("failed to store car index of %s: %s", c, err)
+			}
 
 			res := &commpResult{
-				CommP:   commpcid,
-				Size:    size,
-				CarSize: carSize,
+				CommP:   pc.PieceCID,
+				Size:    pc.PieceSize,
+				CarSize: pc.CarSize,
 			}
 
 			return res, nil
@@ -465,6 +813,10 @@ func main() {
 		if err != nil {
 			return err
 		}
+		accessCache, err := lru.New(10000)
+		if err != nil {
+			return err
+		}
 
 		if cfg.Jaeger.EnableTracing {
 			tp, err := estumetrics.NewJaegerTraceProvider("estuary-shuttle",
@@ -475,6 +827,34 @@ func main() {
 			otel.SetTracerProvider(tp)
 		}
 
+		// setup tracing to an otlp collector if enabled, this takes precedence over jaeger
+		if cfg.Otlp.EnableTracing {
+			tp, err := estumetrics.NewOtlpTraceProvider(cctx.Context, "estuary-shuttle",
+				cfg.Otlp.Endpoint, cfg.Otlp.Insecure, cfg.Otlp.SamplerRatio)
+			if err != nil {
+				return err
+			}
+			otel.SetTracerProvider(tp)
+			defer func() {
+				if err := tp.Shutdown(context.Background()); err != nil {
+					log.Errorf("failed to flush traces: %s", err)
+				}
+			}()
+		}
+		estumetrics.SetupPropagation()
+
+		ipni, err := newIPNIEngine(context.Background(), cfg, db, nd.Host, nd.Datastore)
+		if err != nil {
+			return err
+		}
+		if ipni != nil {
+			defer func() {
+				if err := ipni.Shutdown(); err != nil {
+					log.Errorf("failed to shut down the index provider engine: %s", err)
+				}
+			}()
+		}
+
 		s := &Shuttle{
 			Node:        nd,
 			Api:         api,
@@ -482,18 +862,28 @@ func main() {
 			Filc:        filc,
 			StagingMgr:  sbm,
 			Private:     cfg.Private,
-			gwayHandler: gateway.NewGatewayHandler(nd.Blockstore),
+			gwayHandler: gateway.NewGatewayHandler(denylist.Blockstore(nd.Blockstore, dl.listed)),
 
 			Tracer: otel.Tracer(fmt.Sprintf("shuttle_%s", cfg.Hostname)),
 
-			commpMemo: commpMemo,
+			commpMemo:  commpMemo,
+			carIndexes: carIndexes,
+			dagStats:   dagStats,
+			scanner:    newScanner(cfg.Scanning),
+			scanCfg:    cfg.Scanning,
+
+			ipni:         ipni,
+			ipniInterval: cfg.IPNI.Interval,
 
 			trackingChannels: make(map[string]*chanTrack),
 			inflightCids:     make(map[cid.Cid]uint),
 			splitsInProgress: make(map[uint]bool),
 
-			outgoing:  make(chan *drpc.Message),
-			authCache: cache,
+			outgoing:    make(chan *drpc.Message),
+			authCache:   cache,
+			accessCache: accessCache,
+			withheld:    withheld,
+			denylist:    dl,
 
 			hostname:           cfg.Hostname,
 			estuaryHost:        cfg.EstuaryRemote.Api,
@@ -502,18 +892,93 @@ func main() {
 			disableLocalAdding: cfg.Content.DisableLocalAdding,
 			dev:                cfg.Dev,
 			shuttleConfig:      cfg,
+			diskMon:            util.NewDiskMonitor(util.DiskPressureOptions(cfg.DiskPressure), cfg.Node.Blockstore, cfg.DataDir, cfg.StagingDataDir),
+			bw:                 bandwidth{limiter: bwLimiter, started: time.Now()},
+		}
+		s.gwayHandler.UseCarIndexes(carIndexes)
+		s.sessions = sessionpool.New(s.newFetchSession, nd.Host.ConnManager(), cfg.PinQueue.SessionIdleTimeout)
+		defer s.sessions.Close()
+		if gf := cfg.PinQueue.GatewayFallback; gf.Enabled {
+			s.gateways = httpfetch.New(gf.Gateways, gf.Timeout)
 		}
+		s.importDefaults, err = util.ImportDefaults(cfg.Content.CidVersion, cfg.Content.HashFunction, cfg.Content.InlineLimit)
+		if err != nil {
+			return errors.Wrap(err, "invalid content config")
+		}
+		s.dagSizes, err = dagsize.New(dagsize.Options{
+			CacheSize: dagSizeCacheSize,
+			Local:     nd.Blockstore.Get,
+			Lookup:    s.lookupDagSize,
+		})
+		if err != nil {
+			return err
+		}
+
+		pinQueue, err := setupPinQueue(db, cfg.PinQueue, cfg.Database)
+		if err != nil {
+			return err
+		}
+
+		var queueStore *pinner.QueueStore
+		if cfg.PinQueue.Snapshot.Enabled && pinQueue == nil {
+			queueStore, err = pinner.OpenQueueStore(filepath.Join(cfg.DataDir, "pinqueue"))
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := queueStore.Close(); err != nil {
+					log.Errorf("failed to snapshot pin queue: %s", err)
+				}
+			}()
+			go queueStore.Run(cctx.Context, cfg.PinQueue.Snapshot.Interval)
+		}
+
+		var dedupeIndex *pinner.DedupeIndex
+		if cfg.PinQueue.Dedupe.OnDisk && pinQueue == nil {
+			dedupeIndex, err = pinner.OpenDedupeIndex(filepath.Join(cfg.DataDir, "pinqueue-dedupe"))
+			if err != nil {
+				return err
+			}
+		}
+
 		s.PinMgr = pinner.NewPinManager(s.doPinning, s.onPinStatusUpdate, &pinner.PinManagerOpts{
-			MaxActivePerUser: 30,
+			MaxActivePerUser: cfg.PinQueue.MaxActivePerUser,
+			SharedQueue:      pinQueue,
+			Store:            queueStore,
+			DedupeIndex:      dedupeIndex,
+			DedupeBloomSize:  cfg.PinQueue.Dedupe.BloomSize,
+			PollInterval:     cfg.PinQueue.PollInterval,
+			StallTimeout:     cfg.PinQueue.StallTimeout,
+			MaxStallRestarts: cfg.PinQueue.MaxStallRestarts,
+			StallDropOrigins: cfg.PinQueue.StallDropOrigins,
+			ProviderTimeout:  cfg.PinQueue.ProviderCheck.Timeout,
 		})
 
-		go s.PinMgr.Run(100)
+		if cfg.PinQueue.ProviderCheck.Enabled {
+			s.PinMgr.ProviderFunc = s.pinProviderFunc(cfg.PinQueue.ProviderCheck)
+		}
+		go s.PinMgr.Run(cfg.PinQueue.Workers)
+		defer func() {
+			if err := s.PinMgr.Close(); err != nil {
+				log.Errorf("failed to close pin manager: %s", err)
+			}
+		}()
+
+		if cfg.DiskPressure.Enabled {
+			go s.diskMon.Run(cctx.Context)
+		}
+
+		s.reloadedCfg = cfg
+		go util.WatchConfig(cctx.Context, cctx.String("config"), configPollInterval, func() error {
+			return s.reloadConfig(cctx, app.Flags)
+		})
 
-		if !cfg.NoReloadPinQueue {
+		if !cfg.NoReloadPinQueue && !s.restorePinQueue() {
 			if err := s.refreshPinQueue(); err != nil {
 				log.Errorf("failed to refresh pin queue: %s", err)
 			}
 		}
+		s.PinMgr.Reloaded()
 
 		// Subscribe to legacy markets data transfer events (go-data-transfer)
 		s.Filc.SubscribeToDataTransferEvents(func(event datatransfer.Event, st datatransfer.ChannelState) {
@@ -585,7 +1050,7 @@ func main() {
 		go func() {
 			http.Handle("/debug/metrics", estumetrics.Exporter())
 			http.HandleFunc("/debug/stack", func(w http.ResponseWriter, r *http.Request) {
-				if err := writeAllGoroutineStacks(w); err != nil {
+				if err := util.WriteAllGoroutineStacks(w); err != nil {
 					log.Error(err)
 				}
 			})
@@ -604,6 +1069,9 @@ func main() {
 				log.Errorf("failed to run rpc connection: %s", err)
 			}
 		}()
+		go s.runBandwidthSchedule(cctx.Context)
+		go s.runDenylistRefresh(cctx.Context)
+		go s.runIPNI(cctx.Context)
 
 		blockstoreSize := metrics.NewCtx(metCtx, "blockstore_size", "total size of blockstore filesystem directory").Gauge()
 		blockstoreFree := metrics.NewCtx(metCtx, "blockstore_free", "free space in blockstore filesystem directory").Gauge()
@@ -769,8 +1237,31 @@ type Shuttle struct {
 	shuttleToken  string
 
 	commpMemo *memo.Memoizer
+	// carIndexes keeps where the blocks are in the CARs of the pieces
+	// computed here
+	carIndexes *carindex.Store
+	// dagStats describes the DAGs of content, keeping the stats of the
+	// subtrees it went through
+	dagStats *dagstat.Calculator
+	// scanner scans the content pinned here for the primary, nil unless
+	// enabled
+	scanner scan.Scanner
+	scanCfg config.Scanning
+
+	// ipni advertises the content pinned here to the indexers, nil unless
+	// enabled
+	ipni         *autoretrieve.AutoretrieveEngine
+	ipniInterval time.Duration
 
 	authCache *lru.TwoQueueCache
+	// accessCache holds the retrievals the primary allowed, until they
+	// expire
+	accessCache *lru.Cache
+	// withheld keeps the blocks of private pins from bitswap
+	withheld *withhold.Filter
+	// denylist is the denylist of the primary, kept off the gateway and
+	// bitswap
+	denylist *shuttleDenylist
 
 	retrLk               sync.Mutex
 	retrievalsInProgress map[uint]*retrievalProgress
@@ -779,6 +1270,29 @@ type Shuttle struct {
 	inflightCidsLk sync.Mutex
 
 	shuttleConfig *config.Shuttle
+
+	diskMon *util.DiskMonitor
+
+	sessions *sessionpool.Pool
+	// gateways is where pins that stalled are fetched from, nil unless the
+	// gateway fallback is enabled
+	gateways *httpfetch.Fetcher
+	// dagSizes estimates the size of pins before they are fetched
+	dagSizes *dagsize.Estimator
+	// importDefaults is how uploads are imported unless they ask otherwise
+	importDefaults util.ImportOptions
+
+	// pinFailures holds why pins failed until the primary is told about it
+	pinFailures sync.Map
+
+	// reloadLk guards reloadedCfg, the most recently applied config
+	reloadLk    sync.Mutex
+	reloadedCfg *config.Shuttle
+
+	drain util.Drain
+	echo  *echo.Echo
+
+	bw bandwidth
 }
 
 func (d *Shuttle) isInflight(c cid.Cid) bool {
@@ -1034,36 +1548,72 @@ func withUser(f func(echo.Context, *User) error) func(echo.Context) error {
 
 func (s *Shuttle) ServeAPI() error {
 	e := echo.New()
+	s.echo = e
+
+	ipx, err := util.IPExtractor(s.shuttleConfig.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	e.IPExtractor = ipx
 
 	if s.shuttleConfig.Logging.ApiEndpointLogging {
 		e.Use(middleware.Logger())
 	}
 
 	e.Use(middleware.CORS())
+	e.Use(requestid.Middleware)
+	e.Use(s.bandwidthMiddleware)
 	e.Use(s.tracingMiddleware)
+	e.Use(util.MetricsMiddleware)
 	e.Use(util.AppVersionMiddleware(s.shuttleConfig.AppVersion))
 
 	e.HTTPErrorHandler = util.ErrorHandler
 
+	phandle := promhttp.Handler()
+	e.GET("/metrics", func(e echo.Context) error {
+		phandle.ServeHTTP(e.Response().Writer, e.Request())
+		return nil
+	})
+
 	e.GET("/health", s.handleHealth)
 	e.GET("/net/addrs", s.handleGetNetAddress)
 	e.GET("/viewer", withUser(s.handleGetViewer), s.AuthRequired(util.PermLevelUser))
 
-	e.GET("/gw/:path", func(e echo.Context) error {
-		p := "/" + e.Param("path")
+	e.GET("/gw/*", func(e echo.Context) error {
+		p := "/" + e.Param("*")
+		acc, err := s.checkRetrievalAccess(e, p)
+		if err != nil {
+			var werr *warmingError
+			if errors.As(err, &werr) {
+				e.Response().Header().Set("Cache-Control", "no-store")
+				e.Response().Header().Set("Retry-After", werr.retryAfter)
+				return e.JSONBlob(http.StatusAccepted, werr.body)
+			}
+			return err
+		}
+		if acc.cdn != "" {
+			return e.Redirect(http.StatusTemporaryRedirect, cdn.RedirectURL(acc.cdn, p, e.QueryParams()))
+		}
 
 		req := e.Request().Clone(e.Request().Context())
 		req.URL.Path = p
 
-		s.gwayHandler.ServeHTTP(e.Response().Writer, req)
+		s.gwayHandler.ServeHTTP(e.Response(), req)
+		if acc.ticket != "" {
+			go s.reportServed(acc.ticket, e.Response().Status, e.Response().Size)
+		}
 		return nil
 	})
 
 	content := e.Group("/content")
 	content.Use(s.AuthRequired(util.PermLevelUpload))
-	content.POST("/add", withUser(s.handleAdd))
-	content.POST("/add-car", util.WithContentLengthCheck(withUser(s.handleAddCar)))
+	content.POST("/add", withUser(s.handleAdd), s.diskMon.Middleware, s.drain.Middleware)
+	content.POST("/add-car", util.WithContentLengthCheck(withUser(s.handleAddCar)), s.diskMon.Middleware, s.drain.Middleware)
 	content.GET("/read/:cont", withUser(s.handleReadContent))
+	content.GET("/car-index/:cont", withUser(s.handleGetCarIndex))
+	content.GET("/inclusion-proof/:agg/:cont", withUser(s.handleGetInclusionProof))
+	content.GET("/dag-stat/:cont", withUser(s.handleGetDagStat))
+	content.GET("/diff/:cont/:to", withUser(s.handleGetContentDiff))
 	content.POST("/importdeal", withUser(s.handleImportDeal))
 	//content.POST("/add-ipfs", withUser(d.handleAddIpfs))
 
@@ -1072,6 +1622,7 @@ func (s *Shuttle) ServeAPI() error {
 	admin.GET("/health/:cid", s.handleContentHealthCheck)
 	admin.POST("/resend/pincomplete/:content", s.handleResendPinComplete)
 	admin.POST("/loglevel", s.handleLogLevel)
+	admin.GET("/loglevel", s.handleGetLogLevels)
 	admin.POST("/transfers/restartall", s.handleRestartAllTransfers)
 	admin.GET("/transfers/list", s.handleListAllTransfers)
 	admin.GET("/transfers/:miner", s.handleMinerTransferDiagnostics)
@@ -1080,8 +1631,21 @@ func (s *Shuttle) ServeAPI() error {
 	admin.POST("/garbage/collect", s.handleGarbageCollect)
 	admin.GET("/net/rcmgr/stats", s.handleRcmgrStats)
 	admin.GET("/system/config", s.handleGetSystemConfig)
-
-	return e.Start(s.shuttleConfig.ApiListen)
+	admin.GET("/debug/pprof/:prof", util.ServeProfile)
+	admin.GET("/debug/cpuprofile", util.ServeCpuProfile)
+	admin.GET("/debug/stack", util.ServeGoroutineStacks)
+	admin.GET("/debug/state", s.handleDebugState)
+	admin.GET("/drain", s.handleDrainStatus)
+	admin.POST("/drain", s.handleDrain)
+	admin.GET("/backup", s.handleBackup)
+	admin.GET("/faults", s.handleListFaults)
+	admin.PUT("/faults/:point", s.handleSetFault)
+	admin.DELETE("/faults/:point", s.handleClearFault)
+
+	if err := e.Start(s.shuttleConfig.ApiListen); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
 }
 
 func (s *Shuttle) tracingMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
@@ -1103,7 +1667,9 @@ func (s *Shuttle) tracingMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 			attrs = append(attrs, attribute.String("ClientReqID", reqid))
 		}
 
-		tctx, span := s.Tracer.Start(context.Background(),
+		// continue the callers trace if they sent a traceparent header
+		pctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(r.Header))
+		tctx, span := s.Tracer.Start(pctx,
 			"HTTP "+r.Method+" "+c.Path(),
 			trace.WithAttributes(attrs...),
 		)
@@ -1132,25 +1698,93 @@ func (s *Shuttle) tracingMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 type logLevelBody struct {
 	System string `json:"system"`
 	Level  string `json:"level"`
+	Regex  bool   `json:"regex"`
 }
 
+// handleLogLevel godoc
+// @Summary      Set the log level of a subsystem
+// @Description  This endpoint changes the log level of a logging subsystem at runtime. System may be "*" for all subsystems, or a regular expression if regex is set.
+// @Tags         admin
+// @Produce      json
+// @Param        body body logLevelBody true "Subsystem and level"
+// @Router       /admin/loglevel [post]
 func (s *Shuttle) handleLogLevel(c echo.Context) error {
 	var body logLevelBody
 	if err := c.Bind(&body); err != nil {
 		return err
 	}
 
-	//#nosec G104 - it's not common to treat SetLogLevel error return
-	logging.SetLogLevel(body.System, body.Level)
+	if err := util.SetLogLevel(body.System, body.Level, body.Regex); err != nil {
+		return err
+	}
 
 	return c.JSON(http.StatusOK, map[string]interface{}{})
 }
 
+// handleGetLogLevels godoc
+// @Summary      Get log levels
+// @Description  This endpoint lists every logging subsystem and its current level.
+// @Tags         admin
+// @Produce      json
+// @Router       /admin/loglevel [get]
+func (s *Shuttle) handleGetLogLevels(c echo.Context) error {
+	return c.JSON(http.StatusOK, util.GetLogLevels())
+}
+
+type shuttleDebugState struct {
+	Goroutines           int                      `json:"goroutines"`
+	PinQueue             *pinner.PinQueueSnapshot `json:"pinQueue"`
+	TrackingChannels     int                      `json:"trackingChannels"`
+	SplitsInProgress     int                      `json:"splitsInProgress"`
+	RetrievalsInProgress int                      `json:"retrievalsInProgress"`
+	InflightCids         int                      `json:"inflightCids"`
+	OutgoingQueueLength  int                      `json:"outgoingQueueLength"`
+}
+
+// handleDebugState godoc
+// @Summary      Get a snapshot of internal state
+// @Description  This endpoint returns a snapshot of the pin queue, transfers and rpc queue, to help diagnose a hung shuttle.
+// @Tags         admin
+// @Produce      json
+// @Success      200  {object}  shuttleDebugState
+// @Router       /admin/debug/state [get]
+func (s *Shuttle) handleDebugState(c echo.Context) error {
+	st := &shuttleDebugState{
+		Goroutines:          runtime.NumGoroutine(),
+		PinQueue:            s.PinMgr.Snapshot(),
+		OutgoingQueueLength: len(s.outgoing),
+	}
+
+	s.tcLk.Lock()
+	st.TrackingChannels = len(s.trackingChannels)
+	s.tcLk.Unlock()
+
+	s.splitLk.Lock()
+	st.SplitsInProgress = len(s.splitsInProgress)
+	s.splitLk.Unlock()
+
+	s.retrLk.Lock()
+	st.RetrievalsInProgress = len(s.retrievalsInProgress)
+	s.retrLk.Unlock()
+
+	s.inflightCidsLk.Lock()
+	st.InflightCids = len(s.inflightCids)
+	s.inflightCidsLk.Unlock()
+
+	return c.JSON(http.StatusOK, st)
+}
+
 // handleAdd godoc
 // @Summary      Upload a file
 // @Description  This endpoint uploads a file.
 // @Tags         content
 // @Produce      json
+// @Param        chunker query string false "Chunker: size (default), rabin, buzhash or a full chunker spec"
+// @Param        chunk-size query string false "Chunk size in bytes, the average size for rabin"
+// @Param        cid-version query int false "CID version, 0 or 1"
+// @Param        hash query string false "Hash function: sha2-256, sha2-512, sha3-256 or blake2b-256"
+// @Param        inline-limit query int false "Blocks up to this size are inlined as identity CIDs, 0 to turn off"
+// @Param        X-Estuary-Encryption-Key header string false "Base64 key to encrypt the content with before it is stored"
 // @Router       /content/add [post]
 func (s *Shuttle) handleAdd(c echo.Context, u *User) error {
 	ctx := c.Request().Context()
@@ -1163,6 +1797,11 @@ func (s *Shuttle) handleAdd(c echo.Context, u *User) error {
 		}
 	}
 
+	kek, err := s.encryptionKey(c)
+	if err != nil {
+		return err
+	}
+
 	form, err := c.MultipartForm()
 	if err != nil {
 		return err
@@ -1191,6 +1830,15 @@ func (s *Shuttle) handleAdd(c echo.Context, u *User) error {
 	}
 	defer fi.Close()
 
+	importOpts, err := util.ImportOptionsFromParams(s.importDefaults, util.ImportParamsFrom(c.FormValue))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid import options: %s", err),
+		}
+	}
+
 	cic := util.ContentInCollection{
 		CollectionID:  c.QueryParam(ColUuid),
 		CollectionDir: c.QueryParam(ColDir),
@@ -1212,12 +1860,23 @@ func (s *Shuttle) handleAdd(c echo.Context, u *User) error {
 	bserv := blockservice.New(bs, nil)
 	dserv := merkledag.NewDAGService(bserv)
 
-	nd, err := s.importFile(ctx, dserv, fi)
+	var data io.Reader = fi
+	var enc *util.ContentEncryption
+	if kek != nil {
+		var wrapped []byte
+		data, wrapped, err = encrypt.EncryptNewKey(fi, kek)
+		if err != nil {
+			return err
+		}
+		enc = &util.ContentEncryption{WrappedKey: wrapped, Size: mpf.Size}
+	}
+
+	nd, err := s.importFile(ctx, dserv, data, importOpts)
 	if err != nil {
 		return err
 	}
 
-	contid, err := s.createContent(ctx, u, nd.Cid(), filename, cic)
+	contid, err := s.createContent(ctx, u, nd.Cid(), filename, importOpts.Chunker, cic, enc)
 	if err != nil {
 		return err
 	}
@@ -1243,7 +1902,7 @@ func (s *Shuttle) handleAdd(c echo.Context, u *User) error {
 		return xerrors.Errorf("failed to move data from staging to main blockstore: %w", err)
 	}
 
-	if err := s.Provide(ctx, nd.Cid()); err != nil {
+	if err := s.Provide(ctx, contid, nd.Cid()); err != nil {
 		log.Warnf("failed to provide: %+v", err)
 	}
 
@@ -1255,7 +1914,9 @@ func (s *Shuttle) handleAdd(c echo.Context, u *User) error {
 	})
 }
 
-func (s *Shuttle) Provide(ctx context.Context, c cid.Cid) error {
+// Provide announces the root of a content right away, and queues the rest of
+// the blocks the provide policy asks for
+func (s *Shuttle) Provide(ctx context.Context, contid uint, c cid.Cid) error {
 	subCtx, cancel := context.WithTimeout(ctx, time.Second*15)
 	defer cancel()
 
@@ -1276,6 +1937,16 @@ func (s *Shuttle) Provide(ctx context.Context, c cid.Cid) error {
 			return
 		}
 		log.Debugf("providing complete")
+
+		if s.Node.ProvidePolicy.RootsOnly() {
+			return
+		}
+		var size int64
+		if err := s.DB.Model(&Pin{}).Where("content = ?", contid).Pluck("size", &size).Error; err != nil {
+			log.Errorf("failed to get the size of content %d: %s", contid, err)
+			return
+		}
+		s.Node.ProvideDag(context.Background(), c, size)
 	}()
 
 	return nil
@@ -1351,10 +2022,10 @@ func (s *Shuttle) handleAddCar(c echo.Context, u *User) error {
 
 	root := header.Roots[0]
 
-	contid, err := s.createContent(ctx, u, root, filename, util.ContentInCollection{
+	contid, err := s.createContent(ctx, u, root, filename, "", util.ContentInCollection{
 		CollectionID:  c.QueryParam(ColUuid),
 		CollectionDir: c.QueryParam(ColDir),
-	})
+	}, nil)
 	if err != nil {
 		return err
 	}
@@ -1380,7 +2051,7 @@ func (s *Shuttle) handleAddCar(c echo.Context, u *User) error {
 		return xerrors.Errorf("failed to move data from staging to main blockstore: %w", err)
 	}
 
-	if err := s.Provide(ctx, root); err != nil {
+	if err := s.Provide(ctx, contid, root); err != nil {
 		log.Warn(err)
 	}
 
@@ -1407,7 +2078,7 @@ func (s *Shuttle) addrsForShuttle() []string {
 	return out
 }
 
-func (s *Shuttle) createContent(ctx context.Context, u *User, root cid.Cid, filename string, cic util.ContentInCollection) (uint, error) {
+func (s *Shuttle) createContent(ctx context.Context, u *User, root cid.Cid, filename string, chunker string, cic util.ContentInCollection, enc *util.ContentEncryption) (uint, error) {
 	log.Debugf("createContent> cid: %v, filename: %s, collection: %+v", root, filename, cic)
 
 	data, err := json.Marshal(util.ContentCreateBody{
@@ -1415,6 +2086,8 @@ func (s *Shuttle) createContent(ctx context.Context, u *User, root cid.Cid, file
 		Root:                root.String(),
 		Name:                filename,
 		Location:            s.shuttleHandle,
+		Chunker:             chunker,
+		Encryption:          enc,
 	})
 	if err != nil {
 		return 0, err
@@ -1509,6 +2182,10 @@ func (s *Shuttle) shuttleCreateContent(ctx context.Context, uid uint, root cid.C
 	return rbody.ID, nil
 }
 
+func (d *Shuttle) newFetchSession(ctx context.Context) ipld.NodeGetter {
+	return merkledag.NewDAGService(blockservice.New(d.Node.Blockstore, d.Node.Bitswap)).Session(ctx)
+}
+
 // TODO: mostly copy paste from estuary, dedup code
 func (d *Shuttle) doPinning(ctx context.Context, op *pinner.PinningOperation, cb pinner.PinProgressCB) error {
 	ctx, span := d.Tracer.Start(ctx, "doPinning")
@@ -1520,11 +2197,64 @@ func (d *Shuttle) doPinning(ctx context.Context, op *pinner.PinningOperation, cb
 		}
 	}
 
-	bserv := blockservice.New(d.Node.Blockstore, d.Node.Bitswap)
-	dserv := merkledag.NewDAGService(bserv)
-	dsess := dserv.Session(ctx)
+	dsess, release := d.sessions.Get(sessionpool.Key(fmt.Sprintf("user:%d", op.UserId), op.Peers), op.Peers)
+	defer release()
+
+	fstats := fetchstats.NewRecorder(fetchstats.DefaultStallThreshold)
+	op.SetFetchStats(fstats)
+	untrack := d.Node.FetchTracer.Track(fstats)
+	defer func() {
+		untrack()
+		go d.sendPinFetchStatsMessage(context.TODO(), op.ContId, fstats.Stats())
+	}()
+
+	if err := faults.Check(ctx, faults.SlowFetch); err != nil {
+		return errors.Wrapf(err, "failed to fetch - contID(%d), cid(%s)", op.ContId, op.Obj.String())
+	}
+
+	progress := pinner.NewPrefetchProgress(cb)
+	var getter ipld.NodeGetter
+	var fetched bool
+	if d.gateways != nil && op.NumStalls() > 0 {
+		// fetching peer to peer stalled before, try the gateways instead
+		getter, fetched = d.gateways.Fallback(ctx, op.Obj, d.Node.Blockstore, progress.Prefetched)
+	} else {
+		t := gsfetch.FromMeta(op.Meta, d.pinTransport())
+		if len(op.SourceURLs) > 0 {
+			// content moving between estuary nodes is streamed straight out
+			// of the blockstore of the node that has it
+			fetched = httpfetch.FetchFromURLs(ctx, op.SourceURLs, op.Obj, d.Node.Blockstore, progress.Prefetched)
+		}
+		if !fetched && t == gsfetch.TransportAuto {
+			// a single verified car beats both when an origin serves one
+			fetched = httpfetch.FetchFromOrigins(ctx, op.Peers, op.Obj, d.Node.Blockstore, progress.Prefetched)
+		}
+		if !fetched {
+			var err error
+			fetched, err = d.Node.GraphsyncFetcher.FetchWith(ctx, t, op.Peers, op.Obj, progress.Prefetched)
+			if err != nil {
+				if d.gateways == nil {
+					return errors.Wrapf(err, "failed to fetch over graphsync - contID(%d), cid(%s)", op.ContId, op.Obj.String())
+				}
+				// the walk gets what is missing from the gateways
+				log.Warnf("failed to fetch %s, falling back to the gateways: %s", op.Obj, err)
+			}
+		}
+		getter = fstats.Getter(dsess)
+		if d.gateways != nil {
+			getter = d.gateways.WithFallback(getter, d.Node.Blockstore)
+		}
+	}
+	// the walk finds the blocks fetched so far locally, and they were
+	// counted already
+	cb = progress.Walk(fetched)
+
+	// for the progress of the pin to be reported against
+	if est, err := d.dagSizes.Estimate(ctx, op.Obj, dagsize.NodeGetter(getter)); err == nil {
+		op.SetEstimate(est)
+	}
 
-	if err := d.addDatabaseTrackingToContent(ctx, op.ContId, dsess, d.Node.Blockstore, op.Obj, cb); err != nil {
+	if err := d.addDatabaseTrackingToContent(ctx, op.ContId, getter, d.Node.Blockstore, op.Obj, cb); err != nil {
 		// pinning failed, we wont try again. mark pin as dead
 		/* maybe its fine if we retry later?
 		if err := d.DB.Model(Pin{}).Where("content = ?", op.ContId).UpdateColumns(map[string]interface{}{
@@ -1545,7 +2275,7 @@ func (d *Shuttle) doPinning(ctx context.Context, op *pinner.PinningOperation, cb
 		}
 	*/
 
-	if err := d.Provide(ctx, op.Obj); err != nil {
+	if err := d.Provide(ctx, op.ContId, op.Obj); err != nil {
 		return errors.Wrapf(err, "failed to provide - contID(%d), cid(%s)", op.ContId, op.Obj.String())
 	}
 	return nil
@@ -1587,6 +2317,15 @@ func (d *Shuttle) addDatabaseTrackingToContent(ctx context.Context, contid uint,
 	var objects []*Object
 	var totalSize int64
 	cset := cid.NewSet()
+	visit := func(c cid.Cid) bool {
+		if !cset.Visit(c) {
+			return false
+		}
+		d.inflightCidsLk.Lock()
+		d.inflightCids[c]++
+		d.inflightCidsLk.Unlock()
+		return true
+	}
 
 	defer func() {
 		d.inflightCidsLk.Lock()
@@ -1605,16 +2344,8 @@ func (d *Shuttle) addDatabaseTrackingToContent(ctx context.Context, contid uint,
 		d.inflightCidsLk.Unlock()
 	}()
 
-	err := merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
-		d.inflightCidsLk.Lock()
-		d.inflightCids[c]++
-		d.inflightCidsLk.Unlock()
-
-		node, err := dserv.Get(ctx, c)
-		if err != nil {
-			return nil, errors.Wrap(err, "failed to Get CID node")
-		}
-
+	err := dagwalk.Walk(ctx, dserv, root, visit, func(ctx context.Context, node ipld.Node) ([]*ipld.Link, error) {
+		c := node.Cid()
 		cb(int64(len(node.RawData())))
 
 		select {
@@ -1636,7 +2367,7 @@ func (d *Shuttle) addDatabaseTrackingToContent(ctx context.Context, contid uint,
 		}
 
 		return util.FilterUnwalkableLinks(node.Links()), nil
-	}, root, cset.Visit, merkledag.Concurrent())
+	}, d.dagFetchOptions())
 	if err != nil {
 		return errors.Wrap(err, "failed to walk DAG")
 	}
@@ -1646,8 +2377,12 @@ func (d *Shuttle) addDatabaseTrackingToContent(ctx context.Context, contid uint,
 		attribute.Int("numObjects", len(objects)),
 	)
 
-	if err := d.DB.CreateInBatches(objects, 300).Error; err != nil {
-		return errors.Wrap(err, "failed to create objects in db")
+	if err := d.Node.FlushWrites(ctx); err != nil {
+		return errors.Wrap(err, "failed to flush blocks")
+	}
+
+	if err := d.insertObjects(ctx, dbpin.ID, objects); err != nil {
+		return err
 	}
 
 	if err := d.DB.Model(Pin{}).Where("content = ?", contid).UpdateColumns(map[string]interface{}{
@@ -1657,25 +2392,43 @@ func (d *Shuttle) addDatabaseTrackingToContent(ctx context.Context, contid uint,
 	}).Error; err != nil {
 		return errors.Wrap(err, "failed to update content in database")
 	}
-
-	refs := make([]ObjRef, len(objects))
-	for i := range refs {
-		refs[i].Pin = dbpin.ID
-		refs[i].Object = objects[i].ID
-	}
-
-	if err := d.DB.CreateInBatches(refs, 500).Error; err != nil {
-		return errors.Wrap(err, "failed to create refs")
-	}
+	d.queueIPNI(ctx, dbpin.ID)
+	d.dagSizes.Hint(root, totalSize, dagsize.SourceMeasured)
 
 	d.sendPinCompleteMessage(ctx, dbpin.Content, totalSize, objects)
 
 	return nil
 }
 
+// pinProviderFunc checks that pins without origins have providers before
+// they are queued, content already in the blockstore needs none
+func (d *Shuttle) pinProviderFunc(cfg config.ProviderCheck) pinner.ProviderFunc {
+	finder := &providers.Finder{
+		Routing: d.Node.FullRT,
+		Indexer: d.Node.Indexer,
+	}
+	return func(ctx context.Context, op *pinner.PinningOperation) (bool, error) {
+		if has, err := d.Node.Blockstore.Has(ctx, op.Obj); err == nil && has {
+			return true, nil
+		}
+
+		found, err := finder.HasProviders(ctx, op.Obj)
+		if err == nil && !found {
+			// the pin manager fails the pin next, let the primary know why
+			d.pinFailures.Store(op.ContId, pinner.FailureNoProviders)
+		}
+		return found, err
+	}
+}
+
 func (d *Shuttle) onPinStatusUpdate(cont uint, location string, status types.PinningStatus) error {
 	log.Debugf("updating pin status: %d %s", cont, status)
+	var reason string
 	if status == types.PinningStatusFailed {
+		if r, ok := d.pinFailures.LoadAndDelete(cont); ok {
+			reason = r.(string)
+		}
+
 		if err := d.DB.Model(Pin{}).Where("content = ?", cont).UpdateColumns(map[string]interface{}{
 			"pinning": false,
 			"active":  false,
@@ -1692,6 +2445,7 @@ func (d *Shuttle) onPinStatusUpdate(cont uint, location string, status types.Pin
 				UpdatePinStatus: &drpc.UpdatePinStatus{
 					DBID:   cont,
 					Status: status,
+					Reason: reason,
 				},
 			},
 		}); err != nil {
@@ -1701,6 +2455,21 @@ func (d *Shuttle) onPinStatusUpdate(cont uint, location string, status types.Pin
 	return nil
 }
 
+// restorePinQueue queues the pins kept by the pin queue store from before
+// the restart. It returns false if the store had nothing and the queue has to
+// be refreshed from the database.
+func (s *Shuttle) restorePinQueue() bool {
+	ops, found, err := s.PinMgr.Restore()
+	if err != nil {
+		log.Errorf("failed to restore pin queue: %s", err)
+		return false
+	}
+	if found {
+		log.Infof("restored %d pins from the pin queue snapshot", len(ops))
+	}
+	return found
+}
+
 func (s *Shuttle) refreshPinQueue() error {
 	var toPin []Pin
 	if err := s.DB.Find(&toPin, "active = false and pinning = true").Error; err != nil {
@@ -1744,11 +2513,14 @@ func (s *Shuttle) addPinToQueue(p Pin, peers []*peer.AddrInfo, replace uint) {
 	s.PinMgr.Add(op)
 }
 
-func (s *Shuttle) importFile(ctx context.Context, dserv ipld.DAGService, fi io.Reader) (ipld.Node, error) {
-	_, span := s.Tracer.Start(ctx, "importFile")
+func (s *Shuttle) importFile(ctx context.Context, dserv ipld.DAGService, fi io.Reader, opts util.ImportOptions) (ipld.Node, error) {
+	_, span := s.Tracer.Start(ctx, "importFile", trace.WithAttributes(
+		attribute.String("chunker", opts.Chunker),
+		attribute.Int("cidVersion", opts.CidVersion),
+	))
 	defer span.End()
 
-	return util.ImportFile(dserv, fi)
+	return util.ImportFileWithOptions(dserv, fi, opts)
 }
 
 func (s *Shuttle) dumpBlockstoreTo(ctx context.Context, from, to blockstore.Blockstore) error {
@@ -1792,6 +2564,10 @@ func (s *Shuttle) getUpdatePacket() (*drpc.ShuttleUpdate, error) {
 	var upd drpc.ShuttleUpdate
 
 	upd.PinQueueSize = s.PinMgr.PinQueueSize()
+	upd.Draining = s.drain.Draining()
+	upd.IntakePaused = s.diskMon.Level() == util.DiskPressurePause
+	upd.IngestBytes, upd.EgressBytes = s.bandwidthTotals()
+	upd.StartedAt = s.bw.started
 
 	var st unix.Statfs_t
 	if err := unix.Statfs(s.Node.StorageDir, &st); err != nil {
@@ -1854,6 +2630,8 @@ func (s *Shuttle) Unpin(ctx context.Context, contid uint) error {
 	if err := s.DB.Delete(Pin{}, pin.ID).Error; err != nil {
 		return err
 	}
+	s.dropCarIndex(ctx, pin.Cid.CID)
+	s.retractIPNI(ctx, pin.ID)
 
 	if err := s.clearUnreferencedObjects(ctx, objs); err != nil {
 		return err
@@ -1953,15 +2731,16 @@ func (s *Shuttle) GarbageCollect(ctx context.Context) error {
 	}
 
 	log.Infof("garbage collect deleted %d blocks", count)
-	return nil
+	return s.dropStaleCarIndexes(ctx)
 }
 
 // handleReadContent godoc
 // @Summary      Read content
-// @Description  This endpoint reads content from the blockstore
+// @Description  This endpoint reads content from the blockstore, ranges of it included. With format=car it is the CAR of the content, served from its CAR index.
 // @Tags         content
 // @Produce      json
 // @Param        cont path string true "CID"
+// @Param        format query string false "car for the CAR of the content"
 // @Router       /content/read/{cont} [get]
 func (s *Shuttle) handleReadContent(c echo.Context, u *User) error {
 	cont, err := strconv.Atoi(c.Param("cont"))
@@ -1974,6 +2753,16 @@ func (s *Shuttle) handleReadContent(c echo.Context, u *User) error {
 		return err
 	}
 
+	// the car is served from its layout, reading only the blocks of the
+	// range asked for
+	if c.QueryParam("format") == "car" {
+		l, err := s.carLayout(c.Request().Context(), pin.Cid.CID)
+		if err != nil {
+			return err
+		}
+		return carindex.Serve(c.Response(), c.Request(), l, s.Node.Blockstore.Get)
+	}
+
 	bserv := blockservice.New(s.Node.Blockstore, offline.Exchange(s.Node.Blockstore))
 	dserv := merkledag.NewDAGService(bserv)
 
@@ -1991,10 +2780,8 @@ func (s *Shuttle) handleReadContent(c echo.Context, u *User) error {
 		})
 	}
 
-	_, err = io.Copy(c.Response(), r)
-	if err != nil {
-		return err
-	}
+	// ranges seek through the dag rather than reading it up to there
+	http.ServeContent(c.Response(), c.Request(), pin.Cid.CID.String(), time.Time{}, r)
 	return nil
 }
 
@@ -2093,24 +2880,6 @@ func (s *Shuttle) handleGetViewer(c echo.Context, u *User) error {
 	})
 }
 
-func writeAllGoroutineStacks(w io.Writer) error {
-	buf := make([]byte, 64<<20)
-	for i := 0; ; i++ {
-		n := runtime.Stack(buf, true)
-		if n < len(buf) {
-			buf = buf[:n]
-			break
-		}
-		if len(buf) >= 1<<30 {
-			// Filled 1 GB - stop there.
-			break
-		}
-		buf = make([]byte, 2*len(buf))
-	}
-	_, err := w.Write(buf)
-	return err
-}
-
 func (s *Shuttle) handleRestartAllTransfers(e echo.Context) error {
 	ctx := e.Request().Context()
 
@@ -2268,7 +3037,7 @@ func (s *Shuttle) handleImportDeal(c echo.Context, u *User) error {
 		break
 	}
 
-	contid, err := s.createContent(ctx, u, cc, body.Name, body.ContentInCollection)
+	contid, err := s.createContent(ctx, u, cc, body.Name, "", body.ContentInCollection, nil)
 	if err != nil {
 		return err
 	}
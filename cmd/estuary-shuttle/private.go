@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/ipfs/go-cid"
+	"gorm.io/gorm"
+)
+
+// whether blocks are private is looked up once in this long for bitswap,
+// for this many blocks at most
+const (
+	withheldCacheTTL  = time.Minute
+	withheldCacheSize = 100000
+)
+
+// isPrivateCid reports whether a cid is only pinned here as private
+// content, as the root of a pin or a block in its dag
+func isPrivateCid(ctx context.Context, db *gorm.DB, cc cid.Cid) (bool, error) {
+	var res struct {
+		Total   int64
+		Private int64
+	}
+	if err := db.WithContext(ctx).Model(&Pin{}).
+		Select("COUNT(1) AS total, COALESCE(SUM(CASE WHEN private THEN 1 ELSE 0 END), 0) AS private").
+		Where("active AND NOT aggregate").
+		Where("cid = ? OR id IN (SELECT obj_refs.pin FROM obj_refs JOIN objects ON objects.id = obj_refs.object WHERE objects.cid = ?)",
+			cc.Bytes(), cc.Bytes()).
+		Scan(&res).Error; err != nil {
+		return false, err
+	}
+	return res.Total > 0 && res.Private == res.Total, nil
+}
+
+func (s *Shuttle) handleRpcSetContentPrivate(ctx context.Context, req *drpc.SetContentPrivate) error {
+	if req == nil {
+		return fmt.Errorf("set content private command had nil params")
+	}
+	if err := s.DB.WithContext(ctx).Model(&Pin{}).Where("content IN ?", req.Contents).
+		Update("private", req.Private).Error; err != nil {
+		return err
+	}
+	s.withheld.Forget()
+	return nil
+}
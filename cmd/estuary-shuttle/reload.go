@@ -0,0 +1,97 @@
+package main
+
+import (
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/dagwalk"
+	"github.com/application-research/estuary/util/gsfetch"
+)
+
+const configPollInterval = time.Second * 10
+
+// reloadableSettings are the top level config sections that applyConfig
+// picks up on a running shuttle, anything else needs a restart
+var reloadableSettings = map[string]bool{
+	"logging":       true,
+	"pin_queue":     true,
+	"disk_pressure": true,
+}
+
+// reloadConfig reads the config file again, applies any flags given on the
+// command line over it just like on startup, and applies the result
+func (d *Shuttle) reloadConfig(cctx *cli.Context, flags []cli.Flag) error {
+	cfg := config.NewShuttle(d.shuttleConfig.AppVersion)
+	if err := cfg.Load(cctx.String("config")); err != nil && err != config.ErrNotInitialized {
+		return err
+	}
+
+	if err := overrideSetOptions(flags, cctx, cfg); err != nil {
+		return err
+	}
+	return d.applyConfig(cfg)
+}
+
+// applyConfig changes the log levels, pin workers and other pin queue
+// settings and disk pressure thresholds of the running shuttle to those of
+// cfg
+func (d *Shuttle) applyConfig(cfg *config.Shuttle) error {
+	d.reloadLk.Lock()
+	defer d.reloadLk.Unlock()
+
+	if err := util.ApplyLogLevels(cfg.Logging.Levels); err != nil {
+		return err
+	}
+
+	d.PinMgr.SetWorkers(cfg.PinQueue.Workers)
+	d.PinMgr.SetMaxActivePerUser(cfg.PinQueue.MaxActivePerUser)
+	d.PinMgr.SetStallOptions(cfg.PinQueue.StallTimeout, cfg.PinQueue.MaxStallRestarts, cfg.PinQueue.StallDropOrigins)
+	d.sessions.SetIdleTimeout(cfg.PinQueue.SessionIdleTimeout)
+	d.diskMon.SetConfig(util.DiskPressureOptions(cfg.DiskPressure))
+
+	changed, err := config.ChangedSections(d.reloadedCfg, cfg, reloadableSettings)
+	if err != nil {
+		log.Errorf("failed to compare configs: %s", err)
+	} else if len(changed) > 0 {
+		log.Warnf("config changes to %v are not applied until the shuttle is restarted", changed)
+	}
+
+	d.reloadedCfg = cfg
+	log.Infof("applied reloaded config")
+	return nil
+}
+
+// pinTransport is the transport of pins that don't ask for one
+func (d *Shuttle) pinTransport() gsfetch.Transport {
+	d.reloadLk.Lock()
+	defer d.reloadLk.Unlock()
+
+	if d.reloadedCfg == nil {
+		return gsfetch.TransportAuto
+	}
+	t, err := gsfetch.ParseTransport(d.reloadedCfg.PinQueue.Fetch.Transport)
+	if err != nil {
+		return gsfetch.TransportAuto
+	}
+	return t
+}
+
+// dagFetchOptions returns the fan-out pins are currently fetched with
+func (d *Shuttle) dagFetchOptions() dagwalk.Options {
+	d.reloadLk.Lock()
+	defer d.reloadLk.Unlock()
+
+	if d.reloadedCfg == nil {
+		return dagwalk.Options{}
+	}
+	f := d.reloadedCfg.PinQueue.Fetch
+	return dagwalk.Options{
+		Workers:       f.Workers,
+		MaxWorkers:    f.MaxWorkers,
+		ScaleEvery:    f.ScaleEvery,
+		WantBatchSize: f.WantBatchSize,
+	}
+}
@@ -26,7 +26,7 @@ type retrievalProgress struct {
 	endErr error
 }
 
-func (s *Shuttle) retrieveContent(ctx context.Context, contentToFetch uint, root cid.Cid, deals []drpc.StorageDeal) error {
+func (s *Shuttle) retrieveContent(ctx context.Context, contentToFetch uint, userID uint, root cid.Cid, deals []drpc.StorageDeal) error {
 	ctx, span := s.Tracer.Start(ctx, "retrieveContent", trace.WithAttributes(
 		attribute.Int("content", int(contentToFetch)),
 	))
@@ -59,7 +59,7 @@ func (s *Shuttle) retrieveContent(ctx context.Context, contentToFetch uint, root
 		close(prog.wait)
 	}()
 
-	if err := s.runRetrieval(ctx, contentToFetch, deals, root, nil); err != nil {
+	if err := s.runRetrieval(ctx, contentToFetch, userID, deals, root, nil); err != nil {
 		prog.endErr = err
 		return err
 	}
@@ -67,7 +67,7 @@ func (s *Shuttle) retrieveContent(ctx context.Context, contentToFetch uint, root
 	return nil
 }
 
-func (s *Shuttle) runRetrieval(ctx context.Context, contentToFetch uint, deals []drpc.StorageDeal, root cid.Cid, sel ipld.Node) error {
+func (s *Shuttle) runRetrieval(ctx context.Context, contentToFetch uint, userID uint, deals []drpc.StorageDeal, root cid.Cid, sel ipld.Node) error {
 	ctx, span := s.Tracer.Start(ctx, "runRetrieval")
 	defer span.End()
 
@@ -77,7 +77,7 @@ func (s *Shuttle) runRetrieval(ctx context.Context, contentToFetch uint, deals [
 	}
 
 	// we already have this data locally
-	if pin.ID > 0 {
+	if pin.ID > 0 && pin.Active {
 		objects, err := s.objectsForPin(ctx, pin.ID)
 		if err != nil {
 			// weird case... probably should handle better?
@@ -88,6 +88,20 @@ func (s *Shuttle) runRetrieval(ctx context.Context, contentToFetch uint, deals [
 		return nil
 	}
 
+	// content that was offloaded lost its pin, the retrieved dag is tracked
+	// under a new one
+	if pin.ID == 0 {
+		pin = Pin{
+			Content: contentToFetch,
+			Cid:     util.DbCID{CID: root},
+			UserID:  userID,
+			Pinning: true,
+		}
+		if err := s.DB.Create(&pin).Error; err != nil {
+			return err
+		}
+	}
+
 	for _, deal := range deals {
 		log.Infow("attempting retrieval deal", "content", contentToFetch, "miner", deal.Miner, "selector", sel != nil)
 
@@ -133,12 +147,43 @@ func (s *Shuttle) runRetrieval(ctx context.Context, contentToFetch uint, deals [
 	return fmt.Errorf("failed to retrieve with any miner we have deals with")
 }
 
+// recordRetrievalFailure tells the primary a retrieval failed, for the
+// reputation of the miner
 func (s *Shuttle) recordRetrievalFailure(rec *util.RetrievalFailureRecord) {
-
+	s.sendRetrievalResult(&drpc.RetrievalResult{
+		Content: rec.Content,
+		Cid:     rec.Cid.CID,
+		Miner:   rec.Miner,
+		Phase:   rec.Phase,
+		Error:   rec.Message,
+	})
 }
 
+// recordRetrievalSuccess tells the primary how a retrieval went, for the
+// reputation of the miner
 func (s *Shuttle) recordRetrievalSuccess(c cid.Cid, maddr address.Address, stats *filclient.RetrievalStats) {
+	s.sendRetrievalResult(&drpc.RetrievalResult{
+		Cid:          c,
+		Miner:        maddr.String(),
+		Peer:         stats.Peer.String(),
+		Size:         stats.Size,
+		DurationMs:   stats.Duration.Milliseconds(),
+		AverageSpeed: stats.AverageSpeed,
+		TotalPayment: stats.TotalPayment.String(),
+		NumPayments:  stats.NumPayments,
+		AskPrice:     stats.AskPrice.String(),
+	})
+}
 
+func (s *Shuttle) sendRetrievalResult(res *drpc.RetrievalResult) {
+	if err := s.sendRpcMessage(context.Background(), &drpc.Message{
+		Op: drpc.OP_RetrievalResult,
+		Params: drpc.MsgParams{
+			RetrievalResult: res,
+		},
+	}); err != nil {
+		log.Errorf("failed to send retrieval result for %s from %s: %s", res.Cid, res.Miner, err)
+	}
 }
 
 func (s *Shuttle) tryRetrieve(ctx context.Context, maddr address.Address, c cid.Cid, ask *retrievalmarket.QueryResponse, sel ipld.Node) error {
@@ -9,6 +9,8 @@ import (
 	"github.com/application-research/estuary/pinner/types"
 	"github.com/application-research/estuary/util"
 	dagsplit "github.com/application-research/estuary/util/dagsplit"
+	"github.com/application-research/estuary/util/fetchstats"
+	"github.com/application-research/estuary/util/requestid"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/go-state-types/abi"
 	blocks "github.com/ipfs/go-block-format"
@@ -16,6 +18,7 @@ import (
 	"github.com/ipfs/go-cid"
 	cbor "github.com/ipfs/go-ipld-cbor"
 	"github.com/ipfs/go-merkledag"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/xerrors"
@@ -23,7 +26,7 @@ import (
 )
 
 func (d *Shuttle) handleRpcCmd(cmd *drpc.Command) error {
-	ctx := context.TODO()
+	ctx := requestid.WithID(context.TODO(), cmd.RequestID)
 
 	// If the command contains a trace continue it here.
 	if cmd.HasTraceCarrier() {
@@ -33,6 +36,17 @@ func (d *Shuttle) handleRpcCmd(cmd *drpc.Command) error {
 	}
 
 	log.Debugf("handling rpc command: %s", cmd.Op)
+
+	// new work is refused while draining, the primary sends the pins again
+	// when the shuttle reconnects after the restart
+	if d.drain.Draining() {
+		switch cmd.Op {
+		case drpc.CMD_AddPin, drpc.CMD_TakeContent, drpc.CMD_AggregateContent, drpc.CMD_SplitContent,
+			drpc.CMD_RetrieveContent, drpc.CMD_StartTransfer:
+			return fmt.Errorf("refusing %s command while draining", cmd.Op)
+		}
+	}
+
 	switch cmd.Op {
 	case drpc.CMD_AddPin:
 		return d.handleRpcAddPin(ctx, cmd.Params.AddPin)
@@ -58,6 +72,18 @@ func (d *Shuttle) handleRpcCmd(cmd *drpc.Command) error {
 		return d.handleRpcSplitContent(ctx, cmd.Params.SplitContent)
 	case drpc.CMD_RestartTransfer:
 		return d.handleRpcRestartTransfer(ctx, cmd.Params.RestartTransfer)
+	case drpc.CMD_SetBandwidthLimits:
+		return d.handleRpcSetBandwidthLimits(ctx, cmd.Params.SetBandwidthLimits)
+	case drpc.CMD_AuditContent:
+		return d.handleRpcAuditContent(ctx, cmd.Params.AuditContent)
+	case drpc.CMD_RepairContent:
+		return d.handleRpcRepairContent(ctx, cmd.Params.RepairContent)
+	case drpc.CMD_SetContentPrivate:
+		return d.handleRpcSetContentPrivate(ctx, cmd.Params.SetContentPrivate)
+	case drpc.CMD_WarmContent:
+		return d.handleRpcWarmContent(ctx, cmd.Params.WarmContent)
+	case drpc.CMD_ScanContent:
+		return d.handleRpcScanContent(ctx, cmd.Params.ScanContent)
 	default:
 		return fmt.Errorf("unrecognized command op: %q", cmd.Op)
 	}
@@ -67,6 +93,7 @@ func (d *Shuttle) sendRpcMessage(ctx context.Context, msg *drpc.Message) error {
 	// if a span is contained in `ctx` its SpanContext will be carried in the message, otherwise
 	// a noopspan context will be carried and ignored by the receiver.
 	msg.TraceCarrier = drpc.NewTraceCarrier(trace.SpanFromContext(ctx).SpanContext())
+	msg.RequestID = requestid.FromContext(ctx)
 	log.Debugf("sending rpc message: %s", msg.Op)
 	select {
 	case d.outgoing <- msg:
@@ -77,12 +104,31 @@ func (d *Shuttle) sendRpcMessage(ctx context.Context, msg *drpc.Message) error {
 }
 
 func (d *Shuttle) handleRpcAddPin(ctx context.Context, apo *drpc.AddPin) error {
+	// the primary stops sending pins once an update tells it intake is
+	// paused, those sent before fail so they can be retried from the
+	// dead-letter queue instead of being left pinning
+	if d.diskMon.Level() == util.DiskPressurePause {
+		if err := d.sendRpcMessage(ctx, &drpc.Message{
+			Op: drpc.OP_UpdatePinStatus,
+			Params: drpc.MsgParams{
+				UpdatePinStatus: &drpc.UpdatePinStatus{
+					DBID:   apo.DBID,
+					Status: types.PinningStatusFailed,
+					Reason: "shuttle is low on disk space, pin intake is paused",
+				},
+			},
+		}); err != nil {
+			log.Errorf("failed to send pin status update: %s", err)
+		}
+		return fmt.Errorf("refusing pin of content %d while low on disk space", apo.DBID)
+	}
+
 	d.addPinLk.Lock()
 	defer d.addPinLk.Unlock()
-	return d.addPin(ctx, apo.DBID, apo.Cid, apo.UserId, false)
+	return d.addPin(ctx, apo.DBID, apo.Cid, apo.UserId, apo.Peers, nil, apo.Meta, false)
 }
 
-func (d *Shuttle) addPin(ctx context.Context, contid uint, data cid.Cid, user uint, skipLimiter bool) error {
+func (d *Shuttle) addPin(ctx context.Context, contid uint, data cid.Cid, user uint, peers []*peer.AddrInfo, sources []string, meta string, skipLimiter bool) error {
 	ctx, span := d.Tracer.Start(ctx, "addPin", trace.WithAttributes(
 		attribute.Int64("contID", int64(contid)),
 		attribute.Int64("userID", int64(user)),
@@ -158,8 +204,13 @@ func (d *Shuttle) addPin(ctx context.Context, contid uint, data cid.Cid, user ui
 		Obj:         data,
 		ContId:      contid,
 		UserId:      user,
+		Peers:       peers,
+		SourceURLs:  sources,
+		Meta:        meta,
 		Status:      types.PinningStatusQueued,
 		SkipLimiter: skipLimiter,
+		SpanContext: trace.SpanContextFromContext(ctx),
+		RequestID:   requestid.FromContext(ctx),
 	}
 
 	d.PinMgr.Add(op)
@@ -265,6 +316,20 @@ func (d *Shuttle) sendPinCompleteMessage(ctx context.Context, cont uint, size in
 	}
 }
 
+func (d *Shuttle) sendPinFetchStatsMessage(ctx context.Context, cont uint, st *fetchstats.Stats) {
+	if err := d.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_PinFetchStats,
+		Params: drpc.MsgParams{
+			PinFetchStats: &drpc.PinFetchStats{
+				DBID:  cont,
+				Stats: st,
+			},
+		},
+	}); err != nil {
+		log.Errorf("failed to send pin fetch stats message for content %d: %s", cont, err)
+	}
+}
+
 func (d *Shuttle) handleRpcTakeContent(ctx context.Context, cmd *drpc.TakeContent) error {
 	ctx, span := d.Tracer.Start(ctx, "handleTakeContent")
 	defer span.End()
@@ -272,6 +337,11 @@ func (d *Shuttle) handleRpcTakeContent(ctx context.Context, cmd *drpc.TakeConten
 	d.addPinLk.Lock()
 	defer d.addPinLk.Unlock()
 
+	sources := make([]*peer.AddrInfo, 0, len(cmd.Sources))
+	for i := range cmd.Sources {
+		sources = append(sources, &cmd.Sources[i])
+	}
+
 	for _, c := range cmd.Contents {
 		var count int64
 		err := d.DB.Model(Pin{}).Where("content = ?", c.ID).Limit(1).Count(&count).Error
@@ -285,9 +355,15 @@ func (d *Shuttle) handleRpcTakeContent(ctx context.Context, cmd *drpc.TakeConten
 			continue
 		}
 
-		if err := d.addPin(ctx, c.ID, c.Cid, c.UserID, true); err != nil {
+		if err := d.addPin(ctx, c.ID, c.Cid, c.UserID, sources, cmd.SourceURLs, "", true); err != nil {
 			return err
 		}
+		if c.Private {
+			if err := d.DB.Model(&Pin{}).Where("content = ?", c.ID).Update("private", true).Error; err != nil {
+				return err
+			}
+			d.withheld.Forget()
+		}
 	}
 
 	return nil
@@ -373,6 +449,7 @@ func (d *Shuttle) handleRpcAggregateContent(ctx context.Context, cmd *drpc.Aggre
 	if err := d.DB.Create(ref).Error; err != nil {
 		return err
 	}
+	d.queueIPNI(ctx, pin.ID)
 
 	go d.sendPinCompleteMessage(ctx, cmd.DBID, totalSize, nil)
 	return nil
@@ -507,8 +584,17 @@ func (s *Shuttle) handleRpcReqTxStatus(ctx context.Context, req *drpc.ReqTxStatu
 
 func (s *Shuttle) handleRpcRetrieveContent(ctx context.Context, req *drpc.RetrieveContent) error {
 	go func() {
-		if err := s.retrieveContent(ctx, req.Content, req.Cid, req.Deals); err != nil {
+		if err := s.retrieveContent(ctx, req.Content, req.UserID, req.Cid, req.Deals); err != nil {
 			log.Errorf("failed to retrieve content: %s", err)
+			// the primary is waiting on it to answer restores
+			if err := s.sendRpcMessage(context.Background(), &drpc.Message{
+				Op: drpc.OP_RetrieveFailed,
+				Params: drpc.MsgParams{
+					RetrieveFailed: &drpc.RetrieveFailed{Content: req.Content, Reason: err.Error()},
+				},
+			}); err != nil {
+				log.Errorf("failed to report failed retrieval of content %d: %s", req.Content, err)
+			}
 		}
 	}()
 	return nil
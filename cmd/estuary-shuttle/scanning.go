@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util/scan"
+	"github.com/ipfs/go-blockservice"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+)
+
+func newScanner(cfg config.Scanning) scan.Scanner {
+	if !cfg.Enabled {
+		return nil
+	}
+	s := scan.New(cfg.URL, cfg.Command)
+	if s == nil {
+		log.Warn("content scanning is enabled without a scanner url or command, nothing is scanned")
+	}
+	return s
+}
+
+// handleRpcScanContent scans a content pinned here, from the blocks stored
+// here only, and sends the verdict to the primary
+func (s *Shuttle) handleRpcScanContent(ctx context.Context, req *drpc.ScanContent) error {
+	if req == nil {
+		return fmt.Errorf("scan content command had nil params")
+	}
+
+	go func() {
+		res := &drpc.ScanResult{Content: req.Content}
+		if s.scanner == nil {
+			res.Error = "scanning is not enabled on the shuttle"
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), s.scanCfg.Timeout)
+			defer cancel()
+
+			dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, offline.Exchange(s.Node.Blockstore)))
+			verdict, err := scan.Dag(ctx, s.scanner, dserv, req.Cid)
+			if err != nil {
+				res.Error = err.Error()
+			} else {
+				res.Flagged = verdict.Flagged
+				res.Reason = verdict.Reason
+			}
+		}
+
+		if err := s.sendRpcMessage(context.Background(), &drpc.Message{
+			Op:     drpc.OP_ScanResult,
+			Params: drpc.MsgParams{ScanResult: res},
+		}); err != nil {
+			log.Errorf("failed to send scan result of content %d: %s", req.Content, err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
+)
+
+// at most this many blocks of hot content are read into the block cache
+// per warm command
+const maxWarmBlocks = 100000
+
+func (s *Shuttle) handleRpcWarmContent(ctx context.Context, req *drpc.WarmContent) error {
+	if req == nil {
+		return fmt.Errorf("warm content command had nil params")
+	}
+	if s.Node.BlockCache == nil {
+		return nil
+	}
+
+	cids := make([]cid.Cid, 0, maxWarmBlocks)
+	for _, cont := range req.Contents {
+		var objs []util.DbCID
+		if err := s.DB.WithContext(ctx).Model(&ObjRef{}).
+			Joins("JOIN objects ON objects.id = obj_refs.object").
+			Joins("JOIN pins ON pins.id = obj_refs.pin").
+			Where("pins.content = ? AND pins.active", cont).
+			Order("obj_refs.id").
+			Limit(maxWarmBlocks-len(cids)).
+			Pluck("objects.cid", &objs).Error; err != nil {
+			return err
+		}
+		for _, o := range objs {
+			cids = append(cids, o.CID)
+		}
+		if len(cids) >= maxWarmBlocks {
+			break
+		}
+	}
+
+	n, err := s.Node.BlockCache.Warm(ctx, cids)
+	if err != nil {
+		return err
+	}
+	log.Debugf("warmed %d blocks of %d hot contents", n, len(req.Contents))
+	return nil
+}
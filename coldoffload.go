@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/application-research/estuary/util"
+)
+
+// offloadCold unpins the local copies of content that has enough sealed
+// verified deals that haven't ended and wasn't retrieved for the idle
+// period. The content, its objects and its deals are kept, so it can be
+// brought back.
+func (s *Server) offloadCold(ctx context.Context) error {
+	cfg := s.estuaryCfg.ColdOffload
+	idleSince := time.Now().Add(-cfg.Idle)
+	head, err := s.Api.ChainHead(ctx)
+	if err != nil {
+		return err
+	}
+
+	var ids []uint
+	if err := s.DB.WithContext(ctx).Model(&util.Content{}).
+		Where("active AND NOT offloaded AND NOT pinning AND NOT failed AND (aggregate OR NOT aggregated_in > 0)").
+		Where("created_at < ?", idleSince).
+		Where("id NOT IN (?)", hotTiers(s.DB.Model(&contentTier{}).Select("content"))).
+		Where("NOT EXISTS (SELECT 1 FROM content_retrievals WHERE content_retrievals.cid = contents.cid AND content_retrievals.hour >= ?)", idleSince.UTC().Truncate(time.Hour)).
+		Where("NOT EXISTS (SELECT 1 FROM objects WHERE objects.cid = contents.cid AND objects.last_access >= ?)", idleSince).
+		Where(`(SELECT COUNT(*) FROM content_deals WHERE content_deals.content = contents.id AND content_deals.deleted_at IS NULL
+			AND deal_id > 0 AND verified AND NOT failed AND NOT slashed AND sealed_at > on_chain_at
+			AND (end_epoch = 0 OR end_epoch > ?))
+			>= CASE WHEN ? > 0 THEN ? WHEN replication > 0 THEN replication ELSE 1 END`, int64(head.Height()), cfg.MinDeals, cfg.MinDeals).
+		Order("id").
+		Limit(cfg.BatchSize).
+		Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	removed, err := s.CM.OffloadContents(ctx, ids)
+	if err != nil {
+		return err
+	}
+	log.Infow("offloaded cold content", "contents", len(ids), "blocksRemoved", removed)
+	return nil
+}
+
+// pruneRetrievals drops the retrieval counts that neither tiering nor the
+// cold offload look at anymore
+func (s *Server) pruneRetrievals(ctx context.Context) error {
+	keep := s.estuaryCfg.Tiering.HotWindow
+	if s.estuaryCfg.ColdOffload.Enabled && s.estuaryCfg.ColdOffload.Idle > keep {
+		keep = s.estuaryCfg.ColdOffload.Idle
+	}
+	since := time.Now().UTC().Add(-keep).Truncate(time.Hour)
+	return s.DB.WithContext(ctx).Where("hour < ?", since).Delete(&contentRetrieval{}).Error
+}
@@ -12,6 +12,10 @@ type Collection struct {
 	Description string `json:"description"`
 	UserID      uint   `json:"userId"`
 	CID         string `json:"cid"`
+	// OrgID is the organization sharing the collection, if any
+	OrgID uint `gorm:"index" json:"orgId,omitempty"`
+	// Namespace is the namespace of the api key that created the collection
+	Namespace string `gorm:"index" json:"namespace,omitempty"`
 }
 
 type CollectionRef struct {
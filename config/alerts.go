@@ -0,0 +1,66 @@
+package config
+
+import "time"
+
+type Alerts struct {
+	// CheckInterval is how often alert conditions are evaluated
+	CheckInterval time.Duration `json:"check_interval"`
+	// RepeatInterval is how often a notification is re-sent for an alert that keeps firing
+	RepeatInterval time.Duration `json:"repeat_interval"`
+
+	SlackWebhookURL     string `json:"slack_webhook_url"`
+	PagerDutyRoutingKey string `json:"pagerduty_routing_key"`
+	WebhookURL          string `json:"webhook_url"`
+
+	PinFailureRate PinFailureRateAlert `json:"pin_failure_rate"`
+	ShuttleOffline ShuttleOfflineAlert `json:"shuttle_offline"`
+	DiskSpace      DiskSpaceAlert      `json:"disk_space"`
+	DealFailures   DealFailuresAlert   `json:"deal_failures"`
+	StuckDeals     StuckDealsAlert     `json:"stuck_deals"`
+	Integrity      IntegrityAlert      `json:"integrity"`
+}
+
+// PinFailureRateAlert fires when the fraction of pins that failed within
+// Window is above MaxRate, once at least MinSamples pins have finished
+type PinFailureRateAlert struct {
+	Enabled    bool          `json:"enabled"`
+	MaxRate    float64       `json:"max_rate"`
+	Window     time.Duration `json:"window"`
+	MinSamples int64         `json:"min_samples"`
+}
+
+// ShuttleOfflineAlert fires when a shuttle has been disconnected for longer than After
+type ShuttleOfflineAlert struct {
+	Enabled bool          `json:"enabled"`
+	After   time.Duration `json:"after"`
+}
+
+// DiskSpaceAlert fires when the blockstore of the node or of any shuttle has
+// less than MinFreePercent of its space left
+type DiskSpaceAlert struct {
+	Enabled        bool    `json:"enabled"`
+	MinFreePercent float64 `json:"min_free_percent"`
+}
+
+// DealFailuresAlert fires when more than MaxFailures deal failures were recorded within Window
+type DealFailuresAlert struct {
+	Enabled     bool          `json:"enabled"`
+	MaxFailures int64         `json:"max_failures"`
+	Window      time.Duration `json:"window"`
+}
+
+// StuckDealsAlert fires for a content once MaxFailovers of its deals were
+// failed for being stuck within Window, when moving them to other providers
+// evidently isn't helping
+type StuckDealsAlert struct {
+	Enabled      bool          `json:"enabled"`
+	MaxFailovers int64         `json:"max_failovers"`
+	Window       time.Duration `json:"window"`
+}
+
+// IntegrityAlert fires for a content whose last audit within Window found
+// blocks missing or corrupt
+type IntegrityAlert struct {
+	Enabled bool          `json:"enabled"`
+	Window  time.Duration `json:"window"`
+}
@@ -0,0 +1,15 @@
+package config
+
+import "time"
+
+// Audit checks Blocks blocks sampled from each of Contents stored contents
+// picked at random every Interval, on the node and on the shuttles, for
+// blocks that went missing or no longer match their cid. Blocks that fail
+// are fetched again from the network, or the content is retrieved again
+// from its deals or those of its aggregate.
+type Audit struct {
+	Enabled  bool          `json:"enabled"`
+	Interval time.Duration `json:"interval"`
+	Contents int           `json:"contents"`
+	Blocks   int           `json:"blocks"`
+}
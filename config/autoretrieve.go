@@ -0,0 +1,11 @@
+package config
+
+import "time"
+
+// Autoretrieve batches the content announced to autoretrieve servers: a
+// batch goes out BatchDelay after content is queued, or once BatchSize
+// contents are queued, whichever is first
+type Autoretrieve struct {
+	BatchSize  int           `json:"batch_size"`
+	BatchDelay time.Duration `json:"batch_delay"`
+}
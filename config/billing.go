@@ -0,0 +1,15 @@
+package config
+
+import "time"
+
+// Billing reports the usage of every user and organization each month, once
+// the month is over, to WebhookURL and to Stripe with a StripeAPIKey.
+// Webhook bodies are signed with WebhookSecret.
+type Billing struct {
+	Enabled       bool          `json:"enabled"`
+	WebhookURL    string        `json:"webhook_url"`
+	WebhookSecret string        `json:"webhook_secret"`
+	StripeAPIKey  string        `json:"stripe_api_key"`
+	StripeURL     string        `json:"stripe_url"`
+	Timeout       time.Duration `json:"timeout"`
+}
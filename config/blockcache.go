@@ -0,0 +1,6 @@
+package config
+
+type BlockCache struct {
+	Size         int64 `json:"size"`
+	MaxBlockSize int   `json:"max_block_size"`
+}
@@ -0,0 +1,13 @@
+package config
+
+import "time"
+
+// Boost sets how data gets to storage providers running Boost. With
+// HttpTransfer they fetch content that is on this node over plain http from
+// the hostname, instead of over libp2p, if they support it. The links
+// handed out for http transfers and offline deals stay valid for
+// TransferExpiry.
+type Boost struct {
+	HttpTransfer   bool          `json:"http_transfer"`
+	TransferExpiry time.Duration `json:"transfer_expiry"`
+}
@@ -0,0 +1,20 @@
+package config
+
+import "time"
+
+// CDN registers pinned public content with an external retrieval CDN at
+// RegisterURL, and redirects gateway requests for registered content that
+// got HotRequests requests within HotWindow to BaseURL. Content that is
+// deleted, made private or denylisted is deregistered at DeregisterURL.
+type CDN struct {
+	Enabled          bool          `json:"enabled"`
+	RegisterURL      string        `json:"register_url"`
+	DeregisterURL    string        `json:"deregister_url"`
+	APIKey           string        `json:"api_key"`
+	BaseURL          string        `json:"base_url"`
+	HotRequests      int           `json:"hot_requests"`
+	HotWindow        time.Duration `json:"hot_window"`
+	RegisterInterval time.Duration `json:"register_interval"`
+	BatchSize        int           `json:"batch_size"`
+	Timeout          time.Duration `json:"timeout"`
+}
@@ -0,0 +1,25 @@
+package config
+
+import "time"
+
+// Cluster makes an existing ipfs-cluster a place pins can go, through its
+// REST API at Endpoint. It authenticates with Username and Password if set,
+// with Token as bearer token otherwise. With Preferred every pin goes to the
+// cluster, otherwise the cluster takes the pins the local node would have
+// taken when no shuttle is available. ReplicationMin and ReplicationMax are
+// passed on with every pin, 0 leaves them to the cluster, and a pin counts as
+// pinned once ReplicationMin peers have it. Pins are checked on every
+// PollInterval until the cluster has pinned or failed them. Timeout bounds
+// a single request.
+type Cluster struct {
+	Enabled        bool          `json:"enabled"`
+	Endpoint       string        `json:"endpoint"`
+	Username       string        `json:"username"`
+	Password       string        `json:"password"`
+	Token          string        `json:"token"`
+	Preferred      bool          `json:"preferred"`
+	ReplicationMin int           `json:"replication_min"`
+	ReplicationMax int           `json:"replication_max"`
+	PollInterval   time.Duration `json:"poll_interval"`
+	Timeout        time.Duration `json:"timeout"`
+}
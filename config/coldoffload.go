@@ -0,0 +1,14 @@
+package config
+
+import "time"
+
+// ColdOffload unpins the local copies of content that has MinDeals sealed
+// deals and wasn't retrieved for Idle, so it is only served from its deals.
+// With MinDeals 0, content needs as many deals as its replication.
+type ColdOffload struct {
+	Enabled   bool          `json:"enabled"`
+	MinDeals  int           `json:"min_deals"`
+	Idle      time.Duration `json:"idle"`
+	Interval  time.Duration `json:"interval"`
+	BatchSize int           `json:"batch_size"`
+}
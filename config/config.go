@@ -7,6 +7,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 
 	"github.com/facebookgo/atomicfile"
 )
@@ -61,4 +63,42 @@ func save(cfg interface{}, filename string) error {
 	return encode(cfg, f)
 }
 
+// ChangedSections lists the top level sections, by their json names, that
+// differ between the configs a and b, leaving out those in skip
+func ChangedSections(a, b interface{}, skip map[string]bool) ([]string, error) {
+	am, err := sections(a)
+	if err != nil {
+		return nil, err
+	}
+	bm, err := sections(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for k, v := range bm {
+		if skip[k] {
+			continue
+		}
+		if !reflect.DeepEqual(am[k], v) {
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func sections(cfg interface{}) (map[string]interface{}, error) {
+	buf, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 var ErrEmptyPath = errors.New("node not initialized, please run configure")
@@ -5,6 +5,8 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/application-research/estuary/build"
+	"github.com/filecoin-project/go-address"
 	"github.com/libp2p/go-libp2p-core/network"
 	rcmgr "github.com/libp2p/go-libp2p-resource-manager"
 	"github.com/stretchr/testify/assert"
@@ -72,6 +74,46 @@ func TestShuttleDefaultSanity(t *testing.T) {
 	checkNodeConfig(t, &config.Node)
 }
 
+func TestNetworkDefaults(t *testing.T) {
+	assert := assert.New(t)
+	defer build.SetNetwork(build.DefaultNetwork) //nolint:errcheck
+
+	config := NewEstuary("test-version")
+	config.Network.Name = "calibnet"
+	assert.NoError(config.SetRequiredOptions())
+	assert.Equal("sqlite=estuary_calibnet.db", config.DatabaseConnString)
+	assert.Equal(build.Networks["calibnet"].ApiURL, config.Node.ApiURL)
+	// loading the config leaves the network of the process alone
+	assert.Equal(build.DefaultNetwork.AddressNetwork, address.CurrentNetwork)
+
+	net, err := config.Network.Resolve()
+	assert.NoError(err)
+	assert.NoError(build.SetNetwork(net))
+	assert.Equal(address.Testnet, address.CurrentNetwork)
+	assert.Len(build.DefaultMiners, 3)
+
+	config = NewEstuary("test-version")
+	config.Network = Network{Name: "devnet", DefaultMiners: []string{"t01000"}, AddressPrefix: "f"}
+	config.DatabaseConnString = "sqlite=devnet.db"
+	assert.NoError(config.SetRequiredOptions())
+	assert.Equal("sqlite=devnet.db", config.DatabaseConnString)
+	net, err = config.Network.Resolve()
+	assert.NoError(err)
+	assert.NoError(build.SetNetwork(net))
+	assert.Equal(address.Mainnet, address.CurrentNetwork)
+	assert.Equal("f01000", build.DefaultMiners[0].String())
+
+	shuttle := NewShuttle("test-version")
+	shuttle.Network.Name = "calibnet"
+	assert.NoError(shuttle.SetRequiredOptions())
+	assert.Equal(build.Networks["calibnet"].ApiURL, shuttle.Node.ApiURL)
+
+	config.Network = Network{Name: "nonet"}
+	assert.Error(config.SetRequiredOptions())
+	config.Network = Network{Name: "devnet", AddressPrefix: "x"}
+	assert.Error(config.SetRequiredOptions())
+}
+
 func TestApplyLimits(t *testing.T) {
 	assert := assert.New(t)
 	config := NewShuttle("test-version").Node.Limits
@@ -1,6 +1,17 @@
 package config
 
+// Content controls how content is added. Uploads are imported with CIDs of
+// CidVersion hashed with HashFunction unless they ask for something else.
+// Blocks of up to InlineLimit bytes are inlined into the CIDs linking to
+// them as identity CIDs rather than stored, zero turns that off.
+// Directories of committed collections with more than DirectoryFanout
+// entries are sharded as HAMTs.
 type Content struct {
-	DisableLocalAdding  bool `json:"disable_local_adding"`
-	DisableGlobalAdding bool `json:"disable_global_adding"` // not valid for shuttle
+	DisableLocalAdding  bool   `json:"disable_local_adding"`
+	DisableGlobalAdding bool   `json:"disable_global_adding"` // not valid for shuttle
+	DedupeAcrossUsers   bool   `json:"dedupe_across_users"`   // not valid for shuttle
+	CidVersion          int    `json:"cid_version"`
+	HashFunction        string `json:"hash_function"`
+	InlineLimit         int    `json:"inline_limit"`
+	DirectoryFanout     int    `json:"directory_fanout"` // not valid for shuttle
 }
@@ -0,0 +1,11 @@
+package config
+
+// CORS is which origins browsers can call the api from. AllowOrigins is
+// handed to the cors middleware. Users can bind their api keys to origins,
+// after which browsers on any other origin can't use them, except for the
+// TrustedOrigins, like the web ui of the node.
+type CORS struct {
+	AllowOrigins   []string `json:"allow_origins"`
+	TrustedOrigins []string `json:"trusted_origins"`
+	MaxUserOrigins int      `json:"max_user_origins"`
+}
@@ -0,0 +1,16 @@
+package config
+
+import "time"
+
+type Database struct {
+	MaxOpenConns    int           `json:"max_open_conns"`
+	MaxIdleConns    int           `json:"max_idle_conns"`
+	ConnMaxIdleTime time.Duration `json:"conn_max_idle_time"`
+	ConnMaxLifetime time.Duration `json:"conn_max_lifetime"`
+	// StatementTimeout aborts any single query that runs longer than this,
+	// only supported on postgres. Zero disables it.
+	StatementTimeout time.Duration `json:"statement_timeout"`
+	// ReadReplicaConnString is an optional 'DBTYPE=PARAMS' connection string
+	// of a read replica that read only listing and status queries are sent to
+	ReadReplicaConnString string `json:"read_replica_conn_string"`
+}
@@ -0,0 +1,15 @@
+package config
+
+import "time"
+
+// Datacap tracks the datacap left to the node as a Fil+ client, checked on
+// chain every CheckInterval. An alert fires once less than WarnBelow bytes
+// are left, and verified deals are no longer proposed below StopBelow,
+// deals are made unverified instead until the allocation is topped up,
+// with a critical alert firing meanwhile.
+type Datacap struct {
+	Enabled       bool          `json:"enabled"`
+	CheckInterval time.Duration `json:"check_interval"`
+	WarnBelow     int64         `json:"warn_below"`
+	StopBelow     int64         `json:"stop_below"`
+}
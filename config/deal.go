@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	"github.com/application-research/filclient"
 	"github.com/libp2p/go-libp2p-core/protocol"
 )
@@ -20,4 +22,55 @@ type Deal struct {
 	Disable                      bool                 `json:"disable"`
 	Verified                     bool                 `json:"verified"`
 	EnabledDealProtocolsVersions map[protocol.ID]bool `json:"enabled_deal_protocol_versions"`
+	Stuck                        StuckDeals           `json:"stuck"`
+	Batch                        DealBatch            `json:"batch"`
+	Snap                         SnapDeals            `json:"snap"`
+	Renewal                      DealRenewal          `json:"renewal"`
+	Datacap                      Datacap              `json:"datacap"`
+	Boost                        Boost                `json:"boost"`
+}
+
+// SnapDeals proposes deals that start StartDelay from now, rather than the
+// week sealing a new sector can take, to storage providers that said they
+// put deals into committed capacity sectors with snap deals. With
+// AggregatesOnly only aggregated content is proposed that way. Storage
+// providers that take snap deals are picked first for that content.
+type SnapDeals struct {
+	Enabled        bool          `json:"enabled"`
+	StartDelay     time.Duration `json:"start_delay"`
+	AggregatesOnly bool          `json:"aggregates_only"`
+}
+
+// DealBatch controls how proposals are sent to storage providers. When
+// enabled, proposals for the same provider are queued and sent Pace apart
+// over one connection, which is kept for Idle after the last proposal,
+// instead of every proposal dialing the provider on its own.
+type DealBatch struct {
+	Enabled bool          `json:"enabled"`
+	Pace    time.Duration `json:"pace"`
+	Idle    time.Duration `json:"idle"`
+}
+
+// StuckDeals controls how deals that stop moving are handled. A deal whose
+// transfer hasn't finished within TransferTimeout, or that hasn't been
+// published on chain within PublishTimeout of its transfer finishing, is
+// stuck. A stuck transfer is restarted and a stuck publish is given another
+// timeout, up to MaxRetries times, after which the deal is failed so it gets
+// made again with another provider.
+type StuckDeals struct {
+	Enabled         bool          `json:"enabled"`
+	TransferTimeout time.Duration `json:"transfer_timeout"`
+	PublishTimeout  time.Duration `json:"publish_timeout"`
+	MaxRetries      int           `json:"max_retries"`
+}
+
+// DealRenewal proposes a replacement for a deal Before it ends, while the
+// old deal is still active. Users can pick their own lead time between
+// MinBefore and MaxBefore, or turn renewal off for their content, in which
+// case deals are only replaced once they have run out.
+type DealRenewal struct {
+	Enabled   bool          `json:"enabled"`
+	Before    time.Duration `json:"before"`
+	MinBefore time.Duration `json:"min_before"`
+	MaxBefore time.Duration `json:"max_before"`
 }
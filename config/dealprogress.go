@@ -0,0 +1,17 @@
+package config
+
+import "time"
+
+// DealProgress asks storage providers for the state of deals that aren't
+// sealed yet every Interval, BatchSize deals at a time, so their transfer
+// and sealing progress can be shown before they are active on chain. Deals
+// proposed more than MaxAge ago, or that the provider said failed, aren't
+// asked about anymore.
+type DealProgress struct {
+	Enabled     bool          `json:"enabled"`
+	MaxAge      time.Duration `json:"max_age"`
+	Interval    time.Duration `json:"interval"`
+	BatchSize   int           `json:"batch_size"`
+	Concurrency int           `json:"concurrency"`
+	Timeout     time.Duration `json:"timeout"`
+}
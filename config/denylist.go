@@ -0,0 +1,13 @@
+package config
+
+import "time"
+
+// Denylist blocks pinning, serving and dealing of listed content. Sources
+// are urls or paths of lists in the badbits format, like
+// https://badbits.dwebops.pub/denylist.json, and are reloaded every
+// RefreshInterval. Operators can also list content through the admin api.
+type Denylist struct {
+	Enabled         bool          `json:"enabled"`
+	Sources         []string      `json:"sources"`
+	RefreshInterval time.Duration `json:"refresh_interval"`
+}
@@ -0,0 +1,16 @@
+package config
+
+import "time"
+
+// DiskPressure controls how content intake reacts to the blockstore and data
+// directories filling up. Below ThrottleFreePercent free space new uploads
+// and pins are rate limited to ThrottleRate per second, below
+// PauseFreePercent they are rejected outright until space is freed.
+type DiskPressure struct {
+	Enabled             bool          `json:"enabled"`
+	ThrottleFreePercent float64       `json:"throttle_free_percent"`
+	PauseFreePercent    float64       `json:"pause_free_percent"`
+	ThrottleRate        float64       `json:"throttle_rate"`
+	CheckInterval       time.Duration `json:"check_interval"`
+	RetryAfter          time.Duration `json:"retry_after"`
+}
@@ -0,0 +1,36 @@
+package config
+
+import "time"
+
+// Egress meters the bytes the gateway and the s3 api serve, against the
+// user whose content they are, flushing the counts every FlushInterval.
+// Users are on the plan set for them or DefaultPlan. Once over the
+// DailyBytes of their plan their content is turned away with a 429 until
+// the next day, over MonthlyBytes with a 402 until the next month.
+type Egress struct {
+	Enabled       bool          `json:"enabled"`
+	FlushInterval time.Duration `json:"flush_interval"`
+	DefaultPlan   string        `json:"default_plan"`
+	Plans         []EgressPlan  `json:"plans"`
+}
+
+// EgressPlan caps how many bytes of the content of a user are served, 0
+// for no cap
+type EgressPlan struct {
+	Name         string `json:"name"`
+	DailyBytes   int64  `json:"daily_bytes"`
+	MonthlyBytes int64  `json:"monthly_bytes"`
+}
+
+// Plan returns the plan called name, or the default plan
+func (e *Egress) Plan(name string) EgressPlan {
+	if name == "" {
+		name = e.DefaultPlan
+	}
+	for _, p := range e.Plans {
+		if p.Name == name {
+			return p
+		}
+	}
+	return EgressPlan{Name: name}
+}
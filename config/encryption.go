@@ -0,0 +1,7 @@
+package config
+
+// Encryption lets users upload content encrypted with a key they pass along,
+// which Estuary doesn't keep, so only ciphertext is stored and dealt.
+type Encryption struct {
+	Enabled bool `json:"enabled"`
+}
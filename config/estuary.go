@@ -2,6 +2,7 @@ package config
 
 import (
 	"path/filepath"
+	"time"
 
 	"github.com/application-research/estuary/node/modules/peering"
 	"github.com/application-research/filclient"
@@ -11,25 +12,66 @@ import (
 )
 
 type Estuary struct {
-	AppVersion             string    `json:"app_version"`
-	DatabaseConnString     string    `json:"database_conn_string"`
-	StagingDataDir         string    `json:"staging_data_dir"`
-	ServerCacheDir         string    `json:"server_cache_dir"`
-	DataDir                string    `json:"data_dir"`
-	ApiListen              string    `json:"api_listen"`
-	EnableAutoRetrieve     bool      `json:"enable_autoretrieve"`
-	LightstepToken         string    `json:"lightstep_token"`
-	Hostname               string    `json:"hostname"`
-	Node                   Node      `json:"node"`
-	Jaeger                 Jaeger    `json:"jaeger"`
-	Deal                   Deal      `json:"deal"`
-	Content                Content   `json:"content"`
-	LowMem                 bool      `json:"low_mem"`
-	DisableFilecoinStorage bool      `json:"disable_filecoin_storage"`
-	Replication            int       `json:"replication"`
-	Logging                Logging   `json:"logging"`
-	FilClient              FilClient `json:"fil_client"`
-	ShuttleMessageHandlers int       `json:"shuttle_message_Handlers"`
+	AppVersion             string                 `json:"app_version"`
+	DatabaseConnString     string                 `json:"database_conn_string"`
+	Database               Database               `json:"database"`
+	StagingDataDir         string                 `json:"staging_data_dir"`
+	ServerCacheDir         string                 `json:"server_cache_dir"`
+	DataDir                string                 `json:"data_dir"`
+	ApiListen              string                 `json:"api_listen"`
+	EnableAutoRetrieve     bool                   `json:"enable_autoretrieve"`
+	EnableLeaderElection   bool                   `json:"enable_leader_election"`
+	LightstepToken         string                 `json:"lightstep_token"`
+	Hostname               string                 `json:"hostname"`
+	TrustedProxies         []string               `json:"trusted_proxies"`
+	Network                Network                `json:"network"`
+	Node                   Node                   `json:"node"`
+	Jaeger                 Jaeger                 `json:"jaeger"`
+	Otlp                   Otlp                   `json:"otlp"`
+	Alerts                 Alerts                 `json:"alerts"`
+	EventStream            EventStream            `json:"event_stream"`
+	DiskPressure           DiskPressure           `json:"disk_pressure"`
+	PinQueue               PinQueue               `json:"pin_queue"`
+	RemotePinning          RemotePinning          `json:"remote_pinning"`
+	Cluster                Cluster                `json:"cluster"`
+	S3                     S3                     `json:"s3"`
+	FVM                    FVM                    `json:"fvm"`
+	Receipts               Receipts               `json:"receipts"`
+	OIDC                   OIDC                   `json:"oidc"`
+	SIWE                   SIWE                   `json:"siwe"`
+	UCAN                   UCAN                   `json:"ucan"`
+	CORS                   CORS                   `json:"cors"`
+	Orgs                   Orgs                   `json:"orgs"`
+	Billing                Billing                `json:"billing"`
+	Egress                 Egress                 `json:"egress"`
+	Notifications          Notifications          `json:"notifications"`
+	Encryption             Encryption             `json:"encryption"`
+	PrivateRetrieval       PrivateRetrieval       `json:"private_retrieval"`
+	Denylist               Denylist               `json:"denylist"`
+	Scanning               Scanning               `json:"scanning"`
+	Autoretrieve           Autoretrieve           `json:"autoretrieve"`
+	IPNI                   IPNI                   `json:"ipni"`
+	Reprovide              Reprovide              `json:"reprovide"`
+	PaidRetrieval          PaidRetrieval          `json:"paid_retrieval"`
+	CDN                    CDN                    `json:"cdn"`
+	Tiering                Tiering                `json:"tiering"`
+	ColdOffload            ColdOffload            `json:"cold_offload"`
+	Restore                Restore                `json:"restore"`
+	DealProgress           DealProgress           `json:"deal_progress"`
+	Reputation             Reputation             `json:"reputation"`
+	ProviderLists          ProviderLists          `json:"provider_lists"`
+	Redeal                 Redeal                 `json:"redeal"`
+	Audit                  Audit                  `json:"audit"`
+	RateLimit              RateLimit              `json:"rate_limit"`
+	FeatureFlags           map[string]FeatureFlag `json:"feature_flags"`
+	Deal                   Deal                   `json:"deal"`
+	Content                Content                `json:"content"`
+	LowMem                 bool                   `json:"low_mem"`
+	DisableFilecoinStorage bool                   `json:"disable_filecoin_storage"`
+	Replication            int                    `json:"replication"`
+	Logging                Logging                `json:"logging"`
+	FilClient              FilClient              `json:"fil_client"`
+	ShuttleMessageHandlers int                    `json:"shuttle_message_Handlers"`
 }
 
 func (cfg *Estuary) Load(filename string) error {
@@ -53,7 +95,20 @@ func (cfg *Estuary) SetRequiredOptions() error {
 	if cfg.Node.Blockstore == "" {
 		cfg.Node.Blockstore = filepath.Join(cfg.DataDir, "estuary-blocks")
 	}
-	return nil
+
+	net, err := cfg.Network.Resolve()
+	if err != nil {
+		return err
+	}
+	// settings left at the defaults of the network estuary was built for
+	// take those of the configured one
+	if cfg.DatabaseConnString == build.DefaultNetwork.DatabaseValue {
+		cfg.DatabaseConnString = net.DatabaseValue
+	}
+	if cfg.Node.ApiURL == build.DefaultNetwork.ApiURL {
+		cfg.Node.ApiURL = net.ApiURL
+	}
+	return cfg.ProviderLists.Validate()
 }
 
 func NewEstuary(appVersion string) *Estuary {
@@ -77,11 +132,62 @@ func NewEstuary(appVersion string) *Estuary {
 				filclient.DealProtocolv110: true,
 				filclient.DealProtocolv120: true,
 			},
+			Stuck: StuckDeals{
+				Enabled:         true,
+				TransferTimeout: time.Hour * 12,
+				PublishTimeout:  time.Hour * 24,
+				MaxRetries:      2,
+			},
+			Batch: DealBatch{
+				Enabled: true,
+				Pace:    time.Second * 2,
+				Idle:    time.Minute * 5,
+			},
+			Snap: SnapDeals{
+				Enabled:        false,
+				StartDelay:     time.Hour * 48,
+				AggregatesOnly: true,
+			},
+			Renewal: DealRenewal{
+				Enabled:   true,
+				Before:    time.Hour * 24 * 21,
+				MinBefore: time.Hour * 24 * 7,
+				MaxBefore: time.Hour * 24 * 180,
+			},
+			Datacap: Datacap{
+				Enabled:       true,
+				CheckInterval: time.Hour,
+				WarnBelow:     10 << 40,
+				StopBelow:     64 << 30,
+			},
+			Boost: Boost{
+				HttpTransfer:   false,
+				TransferExpiry: time.Hour * 24 * 7,
+			},
+		},
+
+		FilClient: FilClient{
+			ProviderConns: ProviderConns{
+				MaxDials:    16,
+				BackoffBase: time.Second * 30,
+				BackoffMax:  time.Minute * 30,
+				AddrTTL:     time.Hour,
+			},
 		},
 
 		Content: Content{
 			DisableLocalAdding:  false,
 			DisableGlobalAdding: false,
+			CidVersion:          1,
+			HashFunction:        "sha2-256",
+			InlineLimit:         32,
+			DirectoryFanout:     1000,
+		},
+
+		Database: Database{
+			MaxOpenConns:    99,
+			MaxIdleConns:    80,
+			ConnMaxIdleTime: time.Hour,
 		},
 
 		Jaeger: Jaeger{
@@ -90,6 +196,314 @@ func NewEstuary(appVersion string) *Estuary {
 			SamplerRatio:  1,
 		},
 
+		Otlp: Otlp{
+			EnableTracing: false,
+			Endpoint:      "localhost:4318",
+			Insecure:      true,
+			SamplerRatio:  1,
+		},
+
+		Alerts: Alerts{
+			CheckInterval:  time.Minute,
+			RepeatInterval: time.Hour,
+			PinFailureRate: PinFailureRateAlert{
+				Enabled:    true,
+				MaxRate:    0.25,
+				Window:     time.Hour,
+				MinSamples: 20,
+			},
+			ShuttleOffline: ShuttleOfflineAlert{
+				Enabled: true,
+				After:   time.Minute * 10,
+			},
+			DiskSpace: DiskSpaceAlert{
+				Enabled:        true,
+				MinFreePercent: 10,
+			},
+			DealFailures: DealFailuresAlert{
+				Enabled:     true,
+				MaxFailures: 100,
+				Window:      time.Hour,
+			},
+			StuckDeals: StuckDealsAlert{
+				Enabled:      true,
+				MaxFailovers: 3,
+				Window:       time.Hour * 24 * 7,
+			},
+			Integrity: IntegrityAlert{
+				Enabled: true,
+				Window:  time.Hour * 24 * 7,
+			},
+		},
+
+		EventStream: EventStream{
+			Servers:       []string{},
+			Topic:         "estuary.events",
+			Serialization: "json",
+			QueueSize:     10000,
+		},
+
+		PinQueue: PinQueue{
+			Workers:            50,
+			MaxActivePerUser:   20,
+			Shared:             false,
+			Name:               "primary",
+			LeaseTimeout:       time.Minute * 2,
+			Encoding:           "json",
+			PollInterval:       time.Second * 5,
+			StallTimeout:       time.Minute * 5,
+			MaxStallRestarts:   2,
+			SessionIdleTimeout: time.Minute,
+			Fetch: DagFetch{
+				Workers:       32,
+				MaxWorkers:    128,
+				ScaleEvery:    10000,
+				WantBatchSize: 1,
+				Transport:     "auto",
+			},
+			ProviderCheck: ProviderCheck{
+				Enabled: true,
+				Timeout: time.Second * 30,
+			},
+			GatewayFallback: GatewayFallback{
+				Enabled:  false,
+				Gateways: []string{"https://ipfs.io", "https://dweb.link"},
+				Timeout:  time.Hour,
+			},
+			Snapshot: QueueSnapshot{
+				Enabled:  true,
+				Interval: time.Minute,
+			},
+			Dedupe: QueueDedupe{
+				OnDisk:    false,
+				BloomSize: 1000000,
+			},
+		},
+
+		RemotePinning: RemotePinning{
+			Enabled:          false,
+			DelegateWhenFull: true,
+			DelegateFailed:   true,
+			PollInterval:     time.Minute,
+			Timeout:          time.Second * 30,
+		},
+
+		Cluster: Cluster{
+			Enabled:      false,
+			Preferred:    false,
+			PollInterval: time.Second * 30,
+			Timeout:      time.Second * 30,
+		},
+
+		S3: S3{
+			Enabled:      false,
+			Region:       "us-east-1",
+			UploadExpiry: time.Hour * 24,
+		},
+
+		Network: Network{
+			Name: build.DefaultNetwork.Name,
+		},
+
+		Receipts: Receipts{
+			Enabled:    true,
+			AfterDeals: true,
+		},
+
+		OIDC: OIDC{
+			Enabled:     false,
+			AllowSignup: false,
+			LinkByEmail: false,
+			LoginExpiry: time.Minute * 10,
+			Timeout:     time.Second * 10,
+		},
+
+		SIWE: SIWE{
+			Enabled:       false,
+			ChainIDs:      []int64{1, 314}, // ethereum and filecoin mainnet
+			AllowSignup:   true,
+			NonceExpiry:   time.Minute * 10,
+			SessionExpiry: time.Hour * 24,
+		},
+
+		UCAN: UCAN{
+			Enabled:       false,
+			AccountExpiry: time.Hour * 24 * 365,
+		},
+
+		CORS: CORS{
+			AllowOrigins:   []string{"*"},
+			TrustedOrigins: []string{},
+			MaxUserOrigins: 20,
+		},
+
+		Orgs: Orgs{
+			DefaultQuota: 0,
+			MaxMembers:   100,
+		},
+
+		Billing: Billing{
+			Enabled:   false,
+			StripeURL: "https://api.stripe.com",
+			Timeout:   time.Second * 30,
+		},
+
+		Egress: Egress{
+			Enabled:       false,
+			FlushInterval: time.Minute,
+			Plans:         []EgressPlan{},
+		},
+
+		Notifications: Notifications{
+			Enabled: false,
+			SMTP: SMTP{
+				Port: 587,
+				From: "Estuary <noreply@estuary.tech>",
+			},
+			CheckInterval:       time.Minute * 15,
+			SendInterval:        time.Minute,
+			MaxAttempts:         5,
+			KeyExpiryWarning:    time.Hour * 24 * 7,
+			QuotaWarningPercent: 90,
+			ReplicaGracePeriod:  time.Hour * 24 * 3,
+		},
+
+		Encryption: Encryption{
+			Enabled: false,
+		},
+
+		PrivateRetrieval: PrivateRetrieval{
+			DefaultTokenExpiry: time.Hour * 24,
+			MaxTokenExpiry:     time.Hour * 24 * 30,
+		},
+
+		Denylist: Denylist{
+			Enabled:         true,
+			RefreshInterval: time.Hour,
+		},
+
+		Scanning: Scanning{
+			Enabled:     false,
+			Timeout:     time.Minute * 10,
+			MaxAttempts: 3,
+		},
+
+		Autoretrieve: Autoretrieve{
+			BatchSize:  1000,
+			BatchDelay: time.Second * 30,
+		},
+
+		IPNI: IPNI{
+			Enabled:  false,
+			Interval: time.Minute * 5,
+		},
+
+		Reprovide: Reprovide{
+			Enabled:       false,
+			Interval:      time.Hour * 22,
+			RoundInterval: time.Minute,
+			BatchSize:     1000,
+			RecentWindow:  time.Hour * 24,
+		},
+
+		PaidRetrieval: PaidRetrieval{
+			Enabled:             false,
+			PricePerGiB:         "0.0001",
+			FreeBytesPerDay:     1 << 30,
+			SettleCheckInterval: time.Minute * 30,
+		},
+
+		CDN: CDN{
+			Enabled:          false,
+			HotRequests:      10,
+			HotWindow:        time.Minute * 10,
+			RegisterInterval: time.Minute,
+			BatchSize:        500,
+			Timeout:          time.Second * 30,
+		},
+
+		Tiering: Tiering{
+			Enabled:       false,
+			HotRetrievals: 100,
+			HotWindow:     time.Hour * 24 * 7,
+			FlushInterval: time.Minute,
+			Interval:      time.Minute * 10,
+			MaxRefreshes:  10,
+			MaxWarm:       20,
+		},
+
+		ColdOffload: ColdOffload{
+			Enabled:   false,
+			MinDeals:  0,
+			Idle:      time.Hour * 24 * 30,
+			Interval:  time.Hour,
+			BatchSize: 100,
+		},
+
+		Restore: Restore{
+			Enabled:    false,
+			Timeout:    time.Hour * 6,
+			RetryAfter: time.Second * 30,
+		},
+
+		DealProgress: DealProgress{
+			Enabled:     false,
+			MaxAge:      time.Hour * 24 * 7,
+			Interval:    time.Minute * 5,
+			BatchSize:   200,
+			Concurrency: 10,
+			Timeout:     time.Second * 10,
+		},
+
+		Reputation: Reputation{
+			Window:          time.Hour * 24 * 90,
+			SealTarget:      time.Hour * 48,
+			LatencyTarget:   time.Second * 30,
+			MinScore:        0.25,
+			MinObservations: 20,
+		},
+
+		ProviderLists: ProviderLists{
+			Plans: []ProviderPlan{},
+		},
+
+		Redeal: Redeal{
+			Enabled:    false,
+			Interval:   time.Hour * 6,
+			BatchSize:  100,
+			RetryAfter: time.Hour * 24,
+			Retention:  0,
+		},
+
+		Audit: Audit{
+			Enabled:  false,
+			Interval: time.Hour,
+			Contents: 20,
+			Blocks:   16,
+		},
+
+		FVM: FVM{
+			Enabled:      false,
+			Endpoint:     "https://api.node.glif.io/rpc/v1",
+			PollInterval: time.Second * 30,
+			MaxAttempts:  5,
+			Timeout:      time.Second * 30,
+		},
+
+		RateLimit: RateLimit{
+			RequestsPerSecond: 0,
+			Burst:             100,
+		},
+
+		DiskPressure: DiskPressure{
+			Enabled:             true,
+			ThrottleFreePercent: 10,
+			PauseFreePercent:    3,
+			ThrottleRate:        1,
+			CheckInterval:       time.Second * 30,
+			RetryAfter:          time.Minute * 5,
+		},
+
 		Logging: Logging{
 			ApiEndpointLogging: false,
 		},
@@ -104,11 +518,22 @@ func NewEstuary(appVersion string) *Estuary {
 			HardFlushWriteLog: false,
 			WriteLogTruncate:  false,
 			NoBlockstoreCache: false,
+			BlockCache: BlockCache{
+				Size:         256 << 20,
+				MaxBlockSize: 1 << 20,
+			},
+			WriteBatch: WriteBatch{
+				MaxBlocks:     256,
+				MaxBytes:      16 << 20,
+				FlushInterval: time.Second,
+			},
 
 			IndexerURL:          "https://cid.contact",
 			IndexerTickInterval: 720,
+			LookupIndexerURL:    "https://cid.contact",
 
-			ApiURL: "wss://api.chain.love",
+			ApiURL:    build.DefaultNetwork.ApiURL,
+			LotusMode: "auto",
 
 			Bitswap: Bitswap{
 				MaxOutstandingBytesPerPeer: 5 << 20,
@@ -148,6 +573,9 @@ func NewEstuary(appVersion string) *Estuary {
 				LowWater:  2000,
 				HighWater: 3000,
 			},
+			Provide: Provide{
+				Strategy: "roots",
+			},
 		},
 		ShuttleMessageHandlers: 30,
 	}
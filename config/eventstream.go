@@ -0,0 +1,19 @@
+package config
+
+// EventStream publishes the content event log to a message broker as it is
+// written, for operators that feed pin and deal events into their own data
+// pipelines
+type EventStream struct {
+	// Backend is "kafka" or "nats", nothing is published when it is empty
+	Backend string `json:"backend"`
+	// Servers are the kafka brokers or the nats server urls
+	Servers []string `json:"servers"`
+	// Topic is the kafka topic events are written to. With nats every event
+	// type gets its own subject under it, eg. <topic>.deal.made
+	Topic string `json:"topic"`
+	// Serialization is "json" or "cbor"
+	Serialization string `json:"serialization"`
+	// QueueSize is how many events can wait to be published before new ones
+	// are dropped
+	QueueSize int `json:"queue_size"`
+}
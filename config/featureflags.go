@@ -0,0 +1,8 @@
+package config
+
+// FeatureFlag is the rollout a feature flag starts out with, as a percentage
+// of users it is enabled for. Once a flag is changed from the admin api the
+// value stored in the database is used instead.
+type FeatureFlag struct {
+	RolloutPercent int `json:"rollout_percent"`
+}
@@ -4,6 +4,18 @@ import "time"
 
 type FilClient struct {
 	EventRateLimiter EventRateLimiter `json:"event_rate_limiter"`
+	ProviderConns    ProviderConns    `json:"provider_conns"`
+}
+
+// ProviderConns controls dialing storage providers. At most MaxDials
+// providers are dialed at once, and a provider that can't be dialed isn't
+// tried again for BackoffBase, doubling with every failure up to BackoffMax.
+// Provider addresses are looked up on chain again after AddrTTL.
+type ProviderConns struct {
+	MaxDials    int           `json:"max_dials"`
+	BackoffBase time.Duration `json:"backoff_base"`
+	BackoffMax  time.Duration `json:"backoff_max"`
+	AddrTTL     time.Duration `json:"addr_ttl"`
 }
 
 type EventRateLimiter struct {
@@ -0,0 +1,22 @@
+package config
+
+import "time"
+
+// FVM sends an attestation to the smart contract at Contract, on the
+// Filecoin EVM, when a deal is published and again when its sector is
+// sealed, so that contracts can act on content being stored. Transactions
+// go through the ethereum JSON-RPC API at Endpoint, signed with the hex
+// encoded secp256k1 key in KeyFile, whose address pays for gas. ChainID 0
+// asks the node for it. Attestations are sent and their transactions
+// checked every PollInterval, an attestation is given up after MaxAttempts
+// failed sends. Timeout bounds a single request.
+type FVM struct {
+	Enabled      bool          `json:"enabled"`
+	Endpoint     string        `json:"endpoint"`
+	Contract     string        `json:"contract"`
+	KeyFile      string        `json:"key_file"`
+	ChainID      int64         `json:"chain_id"`
+	PollInterval time.Duration `json:"poll_interval"`
+	MaxAttempts  int           `json:"max_attempts"`
+	Timeout      time.Duration `json:"timeout"`
+}
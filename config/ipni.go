@@ -0,0 +1,11 @@
+package config
+
+import "time"
+
+// IPNI advertises the content held on a node to the network indexers, with
+// the node as its provider, every Interval. Only public addresses are
+// advertised.
+type IPNI struct {
+	Enabled  bool          `json:"enabled"`
+	Interval time.Duration `json:"interval"`
+}
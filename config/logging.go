@@ -2,4 +2,7 @@ package config
 
 type Logging struct {
 	ApiEndpointLogging bool `json:"api_endpoint_logging"`
+	// Levels sets the log level of individual subsystems, "*" sets all of
+	// them. Changes are picked up when the config is reloaded.
+	Levels map[string]string `json:"levels"`
 }
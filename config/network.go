@@ -0,0 +1,48 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/application-research/estuary/build"
+	"github.com/filecoin-project/go-address"
+)
+
+// Network is the filecoin network deals are made on. Name picks the
+// defaults of a known network (mainnet, calibnet or devnet), the other
+// fields override them when set.
+type Network struct {
+	Name             string   `json:"name"`
+	AddressPrefix    string   `json:"address_prefix"`
+	Genesis          string   `json:"genesis"`
+	DefaultMiners    []string `json:"default_miners"`
+	MaxActorsVersion int      `json:"max_actors_version"`
+}
+
+// Resolve returns the defaults of the named network with the overrides
+// applied
+func (cfg Network) Resolve() (build.Network, error) {
+	n, err := build.LookupNetwork(cfg.Name)
+	if err != nil {
+		return n, err
+	}
+
+	switch cfg.AddressPrefix {
+	case "":
+	case address.MainnetPrefix:
+		n.AddressNetwork = address.Mainnet
+	case address.TestnetPrefix:
+		n.AddressNetwork = address.Testnet
+	default:
+		return n, fmt.Errorf("invalid address prefix %q, must be %s or %s", cfg.AddressPrefix, address.MainnetPrefix, address.TestnetPrefix)
+	}
+	if cfg.Genesis != "" {
+		n.Genesis = cfg.Genesis
+	}
+	if len(cfg.DefaultMiners) > 0 {
+		n.DefaultMiners = cfg.DefaultMiners
+	}
+	if cfg.MaxActorsVersion != 0 {
+		n.MaxActorsVersion = cfg.MaxActorsVersion
+	}
+	return n, nil
+}
@@ -16,6 +16,7 @@ type Node struct {
 	NoBlockstoreCache         bool                  `json:"no_blockstore_cache"`
 	NoLimiter                 bool                  `json:"no_limiter"`
 	IndexerURL                string                `json:"indexer_url"`
+	LookupIndexerURL          string                `json:"lookup_indexer_url"`
 	Blockstore                string                `json:"blockstore"`
 	WriteLogDir               string                `json:"write_log_dir"`
 	Libp2pKeyFile             string                `json:"libp2p_key_file"`
@@ -23,8 +24,14 @@ type Node struct {
 	WalletDir                 string                `json:"wallet_dir"`
 	ApiURL                    string                `json:"api_url"`
 	Bitswap                   Bitswap               `json:"bitswap"`
+	BlockCache                BlockCache            `json:"block_cache"`
+	WriteBatch                WriteBatch            `json:"write_batch"`
 	Limits                    Limits                `json:"limits"`
 	ConnectionManager         ConnectionManager     `json:"connection_manager"`
+	Provide                   Provide               `json:"provide"`
+	// LotusMode is how ApiURL is used: "full" for a full lotus node, "lite"
+	// for a public lotus gateway, or "auto" to find out on startup
+	LotusMode string `json:"lotus_mode"`
 }
 
 func (cfg *Node) GetLimiter() *rcmgr.BasicLimiter {
@@ -0,0 +1,34 @@
+package config
+
+import "time"
+
+// Notifications emails users about events on their account: pins that
+// failed, content with fewer deals than it should have, quotas that are
+// nearly used up and api keys about to expire. Events are looked for every
+// CheckInterval and mailed every SendInterval, sending failed mails again
+// up to MaxAttempts times. Templates in TemplateDir, named <event>.tmpl,
+// replace the default ones.
+type Notifications struct {
+	Enabled       bool          `json:"enabled"`
+	SMTP          SMTP          `json:"smtp"`
+	CheckInterval time.Duration `json:"check_interval"`
+	SendInterval  time.Duration `json:"send_interval"`
+	MaxAttempts   int           `json:"max_attempts"`
+	TemplateDir   string        `json:"template_dir"`
+	// KeyExpiryWarning is how long before they expire api keys are warned about
+	KeyExpiryWarning time.Duration `json:"key_expiry_warning"`
+	// QuotaWarningPercent is how much of a quota is used when it is warned about
+	QuotaWarningPercent float64 `json:"quota_warning_percent"`
+	// ReplicaGracePeriod is how long content has to get its deals made
+	// before it is reported as under replicated
+	ReplicaGracePeriod time.Duration `json:"replica_grace_period"`
+}
+
+type SMTP struct {
+	Host        string `json:"host"`
+	Port        int    `json:"port"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	From        string `json:"from"`
+	ImplicitTLS bool   `json:"implicit_tls"`
+}
@@ -0,0 +1,45 @@
+package config
+
+import "time"
+
+// OIDC lets users log in through OpenID Connect or OAuth2 providers, in
+// addition to their password. Users without an account are signed up on
+// their first login with AllowSignup, and with LinkByEmail a verified email
+// that matches an existing user logs into that user. Plans map groups of
+// the provider to what users in them get, applied on every login.
+type OIDC struct {
+	Enabled     bool           `json:"enabled"`
+	Providers   []OIDCProvider `json:"providers"`
+	AllowSignup bool           `json:"allow_signup"`
+	LinkByEmail bool           `json:"link_by_email"`
+	Plans       []OIDCPlan     `json:"plans"`
+	// RedirectURLs are the prefixes a login may send users back to with
+	// their token
+	RedirectURLs []string      `json:"redirect_urls"`
+	LoginExpiry  time.Duration `json:"login_expiry"`
+	Timeout      time.Duration `json:"timeout"`
+}
+
+// OIDCProvider is an identity provider. With Issuer set its endpoints are
+// discovered, providers that only do OAuth2, like GitHub, need AuthURL,
+// TokenURL and UserInfoURL instead.
+type OIDCProvider struct {
+	Name         string   `json:"name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	AuthURL      string   `json:"auth_url"`
+	TokenURL     string   `json:"token_url"`
+	UserInfoURL  string   `json:"user_info_url"`
+	Scopes       []string `json:"scopes"`
+	GroupsClaim  string   `json:"groups_claim"`
+}
+
+// OIDCPlan is what users in Group get: the permission level Perm (upload,
+// user or admin) and the feature flags in FeatureFlags. The first plan
+// matching a group of the user is used.
+type OIDCPlan struct {
+	Group        string   `json:"group"`
+	Perm         string   `json:"perm"`
+	FeatureFlags []string `json:"feature_flags"`
+}
@@ -0,0 +1,8 @@
+package config
+
+// Orgs are organizations of users sharing collections. New organizations
+// get DefaultQuota bytes, 0 for no quota, and can have up to MaxMembers.
+type Orgs struct {
+	DefaultQuota int64 `json:"default_quota"`
+	MaxMembers   int   `json:"max_members"`
+}
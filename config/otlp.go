@@ -0,0 +1,8 @@
+package config
+
+type Otlp struct {
+	EnableTracing bool    `json:"enable_tracing"`
+	Endpoint      string  `json:"endpoint"`
+	Insecure      bool    `json:"insecure"`
+	SamplerRatio  float64 `json:"sampler_ratio"`
+}
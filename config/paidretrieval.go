@@ -0,0 +1,16 @@
+package config
+
+import "time"
+
+// PaidRetrieval charges for content the gateways of the primary and of the
+// shuttles serve, PricePerGiB FIL per GiB of the content requested. Each
+// client address gets FreeBytesPerDay for free, beyond that requests carry
+// a payment channel voucher to the wallet of the primary. Channels are
+// checked every SettleCheckInterval, and the vouchers of those their payer
+// started settling are submitted.
+type PaidRetrieval struct {
+	Enabled             bool          `json:"enabled"`
+	PricePerGiB         string        `json:"price_per_gib"`
+	FreeBytesPerDay     int64         `json:"free_bytes_per_day"`
+	SettleCheckInterval time.Duration `json:"settle_check_interval"`
+}
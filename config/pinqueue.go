@@ -0,0 +1,109 @@
+package config
+
+import "time"
+
+// PinQueue controls how pins are queued. Workers is how many pins are in
+// progress at once, MaxActivePerUser caps the pins of a single user in
+// progress at once and MaxQueuedPerUser, if set, the pins a user can have
+// waiting before new ones are refused, all of them can be changed by
+// reloading the config. By default each node keeps its queue in memory. With Shared set
+// the queue is a table in the database named by DatabaseConnString (the
+// node's own database if empty), and every node configured with the same
+// Name consumes from it, each pin being claimed by exactly one of them. A
+// node that stops renewing its claims for LeaseTimeout has its pins handed
+// to the others. Encoding is how the origins and metadata of shared queue
+// entries are stored: "json", or packed as "compact", "snappy" or "zstd" to
+// keep large backlogs small. Nodes read entries in any encoding.
+//
+// A pin that hasn't fetched anything for StallTimeout is cancelled and
+// restarted, up to MaxStallRestarts times before it is failed. With
+// StallDropOrigins the restart leaves out the origins the pin was given, and
+// with RedispatchStalled the primary moves stalled local pins to a shuttle.
+//
+// Pins with the same origins, or of the same user when they have none, share
+// a bitswap session, which is kept for SessionIdleTimeout after the last of
+// them finishes. Zero gives every pin a session of its own.
+//
+// With ProviderCheck enabled, pins that come without origins are only queued
+// once the dht or the lookup indexer of the node know of a provider of their
+// root, and fail as having no providers otherwise.
+//
+// With GatewayFallback enabled, a pin restarted after stalling is fetched
+// from the trusted HTTP gateways in Gateways instead of peer to peer, and
+// the blocks a pin fails to get peer to peer are fetched from them too.
+//
+// With Snapshot enabled the in memory queue is kept on disk under the data
+// dir, journaled as it changes and snapshotted every Snapshot.Interval, so a
+// restarted node loads it back instead of rebuilding it from the database.
+// A node started without reloading its queue drops what was stored. It is
+// not used with Shared.
+//
+// Pins already queued or running are not queued again. The in memory queue
+// remembers them in memory, or with Dedupe.OnDisk in a leveldb under the data
+// dir behind a bloom filter sized for Dedupe.BloomSize pins, which bounds
+// memory for queues of millions of pins. The leveldb is kept across restarts,
+// the pins reloaded on start take their keys back and the rest are dropped.
+// The shared queue dedupes in the database.
+type PinQueue struct {
+	Workers            int             `json:"workers"`
+	MaxActivePerUser   int             `json:"max_active_per_user"`
+	MaxQueuedPerUser   int64           `json:"max_queued_per_user"`
+	Shared             bool            `json:"shared"`
+	Name               string          `json:"name"`
+	DatabaseConnString string          `json:"database_conn_string"`
+	LeaseTimeout       time.Duration   `json:"lease_timeout"`
+	Encoding           string          `json:"encoding"`
+	PollInterval       time.Duration   `json:"poll_interval"`
+	StallTimeout       time.Duration   `json:"stall_timeout"`
+	MaxStallRestarts   int             `json:"max_stall_restarts"`
+	StallDropOrigins   bool            `json:"stall_drop_origins"`
+	RedispatchStalled  bool            `json:"redispatch_stalled"`
+	SessionIdleTimeout time.Duration   `json:"session_idle_timeout"`
+	Fetch              DagFetch        `json:"fetch"`
+	ProviderCheck      ProviderCheck   `json:"provider_check"`
+	GatewayFallback    GatewayFallback `json:"gateway_fallback"`
+	Snapshot           QueueSnapshot   `json:"snapshot"`
+	Dedupe             QueueDedupe     `json:"dedupe"`
+}
+
+type QueueSnapshot struct {
+	Enabled  bool          `json:"enabled"`
+	Interval time.Duration `json:"interval"`
+}
+
+type QueueDedupe struct {
+	OnDisk    bool `json:"on_disk"`
+	BloomSize int  `json:"bloom_size"`
+}
+
+type ProviderCheck struct {
+	Enabled bool          `json:"enabled"`
+	Timeout time.Duration `json:"timeout"`
+}
+
+// GatewayFallback is tried gateway by gateway, first for a CAR of the whole
+// DAG and then block by block. Timeout bounds a single request, a whole CAR
+// included.
+type GatewayFallback struct {
+	Enabled  bool          `json:"enabled"`
+	Gateways []string      `json:"gateways"`
+	Timeout  time.Duration `json:"timeout"`
+}
+
+// DagFetch tunes how the DAG of a single pin is fetched. A pin starts out
+// with Workers parallel fetches and doubles them every ScaleEvery blocks up
+// to MaxWorkers, so small pins stay cheap while huge ones get the fan-out
+// they need. WantBatchSize is how many blocks a worker asks for at once.
+//
+// Transport is how pins are fetched: "bitswap", "graphsync" from their
+// origins, or "auto" to fetch a verified CAR from origins with http
+// addresses, then over graphsync, and leave it to bitswap if none of the
+// origins serve it. A pin can pick its own with the "transport" key of its
+// meta.
+type DagFetch struct {
+	Workers       int    `json:"workers"`
+	MaxWorkers    int    `json:"max_workers"`
+	ScaleEvery    int    `json:"scale_every"`
+	WantBatchSize int    `json:"want_batch_size"`
+	Transport     string `json:"transport"`
+}
@@ -0,0 +1,12 @@
+package config
+
+import "time"
+
+// PrivateRetrieval signs the access tokens private content is retrieved
+// with. Without a Secret, one is derived from the key of the node, which
+// only works with a single primary instance.
+type PrivateRetrieval struct {
+	Secret             string        `json:"secret"`
+	DefaultTokenExpiry time.Duration `json:"default_token_expiry"`
+	MaxTokenExpiry     time.Duration `json:"max_token_expiry"`
+}
@@ -0,0 +1,33 @@
+package config
+
+import "github.com/application-research/estuary/util/provide"
+
+// Provide is which blocks of each content the node announces to the dht:
+// "roots", "dirs" for the roots and every directory, or "all". SizeClasses
+// override Strategy for content up to their MaxSize, the smallest fitting
+// class is used.
+type Provide struct {
+	Strategy    string         `json:"strategy"`
+	SizeClasses []ProvideClass `json:"size_classes"`
+}
+
+type ProvideClass struct {
+	MaxSize  int64  `json:"max_size"`
+	Strategy string `json:"strategy"`
+}
+
+func (cfg Provide) Policy() (provide.Policy, error) {
+	def, err := provide.ParseStrategy(cfg.Strategy)
+	if err != nil {
+		return provide.Policy{}, err
+	}
+	var classes []provide.Class
+	for _, c := range cfg.SizeClasses {
+		s, err := provide.ParseStrategy(c.Strategy)
+		if err != nil {
+			return provide.Policy{}, err
+		}
+		classes = append(classes, provide.Class{MaxSize: c.MaxSize, Strategy: s})
+	}
+	return provide.NewPolicy(def, classes), nil
+}
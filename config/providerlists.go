@@ -0,0 +1,47 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/filecoin-project/go-address"
+)
+
+// ProviderLists restricts which storage providers the content of the users
+// on a plan can be dealt to. Users are on the plan set for them or the
+// default plan of Egress. A plan with an Allow list only deals with those
+// providers, and never with the ones in its Deny list.
+type ProviderLists struct {
+	Plans []ProviderPlan `json:"plans"`
+}
+
+type ProviderPlan struct {
+	Name  string   `json:"name"`
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// Plan returns the lists of the plan called name, empty if there are none
+func (p *ProviderLists) Plan(name string) ProviderPlan {
+	for _, pl := range p.Plans {
+		if pl.Name == name {
+			return pl
+		}
+	}
+	return ProviderPlan{Name: name}
+}
+
+// Validate checks that every provider in the lists of the plans is an id
+// address, so none of them is dropped when deals are made
+func (p *ProviderLists) Validate() error {
+	for _, pl := range p.Plans {
+		for _, list := range [][]string{pl.Allow, pl.Deny} {
+			for _, m := range list {
+				a, err := address.NewFromString(m)
+				if err != nil || a.Protocol() != address.ID {
+					return fmt.Errorf("provider %q of plan %q is not a storage provider id address", m, pl.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
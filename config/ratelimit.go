@@ -0,0 +1,9 @@
+package config
+
+// RateLimit limits how fast each user can call the api, to a sustained
+// RequestsPerSecond with bursts of up to Burst requests. A RequestsPerSecond
+// of zero turns the limit off. Admins are not limited.
+type RateLimit struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+}
@@ -0,0 +1,9 @@
+package config
+
+// Receipts are statements that the node stores some content, signed with
+// the node's libp2p key. One is issued once the content is pinned, and with
+// AfterDeals set another each time one of its deals goes active.
+type Receipts struct {
+	Enabled    bool `json:"enabled"`
+	AfterDeals bool `json:"after_deals"`
+}
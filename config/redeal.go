@@ -0,0 +1,16 @@
+package config
+
+import "time"
+
+// Redeal puts content back into the deal pipeline once all of its deals ran
+// out or failed, bringing offloaded content back from its deals first. A
+// content is retried every RetryAfter while that doesn't work. Content is
+// kept on deals for Retention after it was added, forever when 0, unless a
+// retention of its own was set.
+type Redeal struct {
+	Enabled    bool          `json:"enabled"`
+	Interval   time.Duration `json:"interval"`
+	BatchSize  int           `json:"batch_size"`
+	RetryAfter time.Duration `json:"retry_after"`
+	Retention  time.Duration `json:"retention"`
+}
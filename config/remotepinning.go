@@ -0,0 +1,20 @@
+package config
+
+import "time"
+
+// RemotePinning delegates pins the node can't take to a remote service that
+// implements the IPFS Pinning Service API at Endpoint, authenticated with
+// Token. With DelegateWhenFull a pin is delegated when no shuttle has room
+// for it and it can't be pinned locally either, with DelegateFailed a pin
+// that failed here, after its stall restarts, is delegated instead of
+// failing, unless it can't succeed anywhere. Delegated pins are checked on every PollInterval until the
+// service has pinned or failed them. Timeout bounds a single request.
+type RemotePinning struct {
+	Enabled          bool          `json:"enabled"`
+	Endpoint         string        `json:"endpoint"`
+	Token            string        `json:"token"`
+	DelegateWhenFull bool          `json:"delegate_when_full"`
+	DelegateFailed   bool          `json:"delegate_failed"`
+	PollInterval     time.Duration `json:"poll_interval"`
+	Timeout          time.Duration `json:"timeout"`
+}
@@ -0,0 +1,15 @@
+package config
+
+import "time"
+
+// Reprovide replaces reproviding every content at once with rounds of
+// BatchSize contents every RoundInterval. A content is due Interval after it
+// was last provided, content added within RecentWindow goes first, then the
+// most requested.
+type Reprovide struct {
+	Enabled       bool          `json:"enabled"`
+	Interval      time.Duration `json:"interval"`
+	RoundInterval time.Duration `json:"round_interval"`
+	BatchSize     int           `json:"batch_size"`
+	RecentWindow  time.Duration `json:"recent_window"`
+}
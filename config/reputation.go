@@ -0,0 +1,15 @@
+package config
+
+import "time"
+
+// Reputation scores storage providers from their deals and retrievals
+// within Window. Deals are made with the best scored providers first, and
+// providers with MinObservations deals and retrievals that score under
+// MinScore get none until enough of them are older than Window.
+type Reputation struct {
+	Window          time.Duration `json:"window"`
+	SealTarget      time.Duration `json:"seal_target"`
+	LatencyTarget   time.Duration `json:"latency_target"`
+	MinScore        float64       `json:"min_score"`
+	MinObservations int           `json:"min_observations"`
+}
@@ -0,0 +1,13 @@
+package config
+
+import "time"
+
+// Restore retrieves offloaded content from its deals when it is requested
+// from a gateway, which answers 202 with a Retry-After of RetryAfter while
+// the content warms up. A restore that hasn't finished within Timeout is
+// started again on the next request.
+type Restore struct {
+	Enabled    bool          `json:"enabled"`
+	Timeout    time.Duration `json:"timeout"`
+	RetryAfter time.Duration `json:"retry_after"`
+}
@@ -0,0 +1,14 @@
+package config
+
+import "time"
+
+// S3 serves an S3 compatible api under /s3, buckets are the collections of
+// the user and objects the files in them. Requests are signed with the
+// username as access key and one of the user's api keys as secret key.
+// Region is the region clients have to sign for. Multipart uploads that
+// aren't completed within UploadExpiry are dropped.
+type S3 struct {
+	Enabled      bool          `json:"enabled"`
+	Region       string        `json:"region"`
+	UploadExpiry time.Duration `json:"upload_expiry"`
+}
@@ -0,0 +1,16 @@
+package config
+
+import "time"
+
+// Scanning runs content past an external scanner once it is fetched and
+// before it is pinned. URL is an http scanner, Command one run for each
+// content, only one of them is used, URL first. Flagged content is
+// quarantined until an admin reviews it. Shuttles scan the content pinned
+// on them with their own scanner, MaxAttempts is only used on the primary.
+type Scanning struct {
+	Enabled     bool          `json:"enabled"`
+	URL         string        `json:"url"`
+	Command     []string      `json:"command"`
+	Timeout     time.Duration `json:"timeout"`
+	MaxAttempts int           `json:"max_attempts"`
+}
@@ -3,7 +3,9 @@ package config
 import (
 	"errors"
 	"path/filepath"
+	"time"
 
+	"github.com/application-research/estuary/build"
 	"github.com/application-research/estuary/node/modules/peering"
 )
 
@@ -18,19 +20,28 @@ type EstuaryRemote struct {
 type Shuttle struct {
 	AppVersion         string        `json:"app_version"`
 	DatabaseConnString string        `json:"database_conn_string"`
+	Database           Database      `json:"database"`
 	StagingDataDir     string        `json:"staging_data_dir"`
 	DataDir            string        `json:"data_dir"`
 	ApiListen          string        `json:"api_listen"`
 	Hostname           string        `json:"hostname"`
+	TrustedProxies     []string      `json:"trusted_proxies"`
 	Private            bool          `json:"private"`
 	Dev                bool          `json:"dev"`
 	NoReloadPinQueue   bool          `json:"no_reload_pin_queue"`
 	Node               Node          `json:"node"`
 	Jaeger             Jaeger        `json:"jaeger"`
+	Otlp               Otlp          `json:"otlp"`
 	Content            Content       `json:"content"`
+	DiskPressure       DiskPressure  `json:"disk_pressure"`
+	PinQueue           PinQueue      `json:"pin_queue"`
 	Logging            Logging       `json:"logging"`
 	EstuaryRemote      EstuaryRemote `json:"estuary_remote"`
 	FilClient          FilClient     `json:"fil_client"`
+	Network            Network       `json:"network"`
+	Scanning           Scanning      `json:"scanning"`
+	IPNI               IPNI          `json:"ipni"`
+	Encryption         Encryption    `json:"encryption"`
 }
 
 func (cfg *Shuttle) Load(filename string) error {
@@ -66,6 +77,14 @@ func (cfg *Shuttle) SetRequiredOptions() error {
 	} else if cfg.Node.Blockstore[0] != '/' && cfg.Node.Blockstore[0] != ':' {
 		cfg.Node.Blockstore = filepath.Join(cfg.DataDir, cfg.Node.Blockstore)
 	}
+
+	net, err := cfg.Network.Resolve()
+	if err != nil {
+		return err
+	}
+	if cfg.Node.ApiURL == build.DefaultNetwork.ApiURL {
+		cfg.Node.ApiURL = net.ApiURL
+	}
 	return nil
 }
 
@@ -80,8 +99,21 @@ func NewShuttle(appVersion string) *Shuttle {
 		Dev:                false,
 		NoReloadPinQueue:   false,
 
+		Network: Network{
+			Name: build.DefaultNetwork.Name,
+		},
+
 		Content: Content{
 			DisableLocalAdding: false,
+			CidVersion:         1,
+			HashFunction:       "sha2-256",
+			InlineLimit:        32,
+		},
+
+		Database: Database{
+			MaxOpenConns:    99,
+			MaxIdleConns:    80,
+			ConnMaxIdleTime: time.Hour,
 		},
 
 		Jaeger: Jaeger{
@@ -90,10 +122,77 @@ func NewShuttle(appVersion string) *Shuttle {
 			SamplerRatio:  1,
 		},
 
+		Otlp: Otlp{
+			EnableTracing: false,
+			Endpoint:      "localhost:4318",
+			Insecure:      true,
+			SamplerRatio:  1,
+		},
+
+		PinQueue: PinQueue{
+			Workers:            100,
+			MaxActivePerUser:   30,
+			Shared:             false,
+			Name:               "shuttle",
+			LeaseTimeout:       time.Minute * 2,
+			Encoding:           "json",
+			PollInterval:       time.Second * 5,
+			StallTimeout:       time.Minute * 5,
+			MaxStallRestarts:   2,
+			SessionIdleTimeout: time.Minute,
+			Fetch: DagFetch{
+				Workers:       32,
+				MaxWorkers:    128,
+				ScaleEvery:    10000,
+				WantBatchSize: 1,
+				Transport:     "auto",
+			},
+			ProviderCheck: ProviderCheck{
+				Enabled: true,
+				Timeout: time.Second * 30,
+			},
+			GatewayFallback: GatewayFallback{
+				Enabled:  false,
+				Gateways: []string{"https://ipfs.io", "https://dweb.link"},
+				Timeout:  time.Hour,
+			},
+			Snapshot: QueueSnapshot{
+				Enabled:  true,
+				Interval: time.Minute,
+			},
+			Dedupe: QueueDedupe{
+				OnDisk:    false,
+				BloomSize: 1000000,
+			},
+		},
+
+		DiskPressure: DiskPressure{
+			Enabled:             true,
+			ThrottleFreePercent: 10,
+			PauseFreePercent:    3,
+			ThrottleRate:        1,
+			CheckInterval:       time.Second * 30,
+			RetryAfter:          time.Minute * 5,
+		},
+
 		Logging: Logging{
 			ApiEndpointLogging: false,
 		},
 
+		Scanning: Scanning{
+			Enabled: false,
+			Timeout: time.Minute * 10,
+		},
+
+		IPNI: IPNI{
+			Enabled:  false,
+			Interval: time.Minute * 5,
+		},
+
+		Encryption: Encryption{
+			Enabled: false,
+		},
+
 		Node: Node{
 			AnnounceAddrs: []string{},
 			ListenAddrs: []string{
@@ -107,8 +206,20 @@ func NewShuttle(appVersion string) *Shuttle {
 			HardFlushWriteLog: false,
 			WriteLogTruncate:  false,
 			NoBlockstoreCache: false,
+			BlockCache: BlockCache{
+				Size:         256 << 20,
+				MaxBlockSize: 1 << 20,
+			},
+			WriteBatch: WriteBatch{
+				MaxBlocks:     256,
+				MaxBytes:      16 << 20,
+				FlushInterval: time.Second,
+			},
+
+			IndexerURL:       "https://cid.contact",
+			LookupIndexerURL: "https://cid.contact",
 
-			ApiURL: "wss://api.chain.love",
+			ApiURL: build.DefaultNetwork.ApiURL,
 
 			Bitswap: Bitswap{
 				MaxOutstandingBytesPerPeer: 5 << 20,
@@ -148,6 +259,9 @@ func NewShuttle(appVersion string) *Shuttle {
 				LowWater:  2000,
 				HighWater: 3000,
 			},
+			Provide: Provide{
+				Strategy: "roots",
+			},
 		},
 
 		EstuaryRemote: EstuaryRemote{
@@ -0,0 +1,17 @@
+package config
+
+import "time"
+
+// SIWE lets users sign in with an ethereum wallet (EIP-4361). Messages have
+// to be for Domain, the host of the hostname when empty, with a URI on it,
+// for one of ChainIDs and use a nonce handed out no longer than NonceExpiry
+// ago. Wallets without a user are signed up with AllowSignup. Sign ins last
+// SessionExpiry, longer lived api keys can be created with them.
+type SIWE struct {
+	Enabled       bool          `json:"enabled"`
+	Domain        string        `json:"domain"`
+	ChainIDs      []int64       `json:"chain_ids"`
+	AllowSignup   bool          `json:"allow_signup"`
+	NonceExpiry   time.Duration `json:"nonce_expiry"`
+	SessionExpiry time.Duration `json:"session_expiry"`
+}
@@ -0,0 +1,18 @@
+package config
+
+import "time"
+
+// Tiering counts gateway retrievals of each cid, and marks content that was
+// retrieved HotRetrievals times within HotWindow as hot. Hot content is kept
+// pinned and brought back if it was offloaded, and the blocks of the MaxWarm
+// hottest are read into the block cache of the primary or shuttle they are
+// on. Cold content can be offloaded and served from its deals.
+type Tiering struct {
+	Enabled       bool          `json:"enabled"`
+	HotRetrievals int64         `json:"hot_retrievals"`
+	HotWindow     time.Duration `json:"hot_window"`
+	FlushInterval time.Duration `json:"flush_interval"`
+	Interval      time.Duration `json:"interval"`
+	MaxRefreshes  int           `json:"max_refreshes"`
+	MaxWarm       int           `json:"max_warm"`
+}
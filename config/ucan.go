@@ -0,0 +1,11 @@
+package config
+
+import "time"
+
+// UCAN lets users hand out narrowly scoped upload capabilities as UCANs.
+// Users register an account key and get an account UCAN from the node,
+// valid for AccountExpiry, that they delegate from.
+type UCAN struct {
+	Enabled       bool          `json:"enabled"`
+	AccountExpiry time.Duration `json:"account_expiry"`
+}
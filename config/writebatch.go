@@ -0,0 +1,11 @@
+package config
+
+import "time"
+
+// WriteBatch buffers block writes and writes them out together, MaxBlocks of
+// 0 writes every block as it comes in
+type WriteBatch struct {
+	MaxBlocks     int           `json:"max_blocks"`
+	MaxBytes      int64         `json:"max_bytes"`
+	FlushInterval time.Duration `json:"flush_interval"`
+}
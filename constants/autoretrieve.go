@@ -1,9 +1,15 @@
 package constants
 
-const QueryNewCIDs string = "select objects.cid from objects left join obj_refs on objects.id = obj_refs.object where obj_refs.content in (select id from contents where created_at > ?);"
+// QueryQueuedCIDs lists the cids of the active content queued for
+// advertisement in a range of the queue, private content is left out
+const QueryQueuedCIDs string = "select distinct objects.cid from objects join obj_refs on objects.id = obj_refs.object where obj_refs.content in (select content_id from queued_contents where id > ? and id <= ?) and obj_refs.content in (select id from contents where active and not private and deleted_at is null);"
+
+// QueryQueuedCIDsAt is QueryQueuedCIDs for the content at a location
+const QueryQueuedCIDsAt string = "select distinct objects.cid from objects join obj_refs on objects.id = obj_refs.object where obj_refs.content in (select content_id from queued_contents where id > ? and id <= ?) and obj_refs.content in (select id from contents where active and not private and deleted_at is null and location = ?);"
 
 const KeyToCidMapPrefix = "map/keyCid/"
 const CidToKeyMapPrefix = "map/cidKey/"
 const KeyToMetadataMapPrefix = "map/keyMD/"
 const LatestAdvKey = "sync/adv/"
+
 const LinksCachePath = "/cache/links"
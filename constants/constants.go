@@ -8,6 +8,26 @@ import (
 
 const DefaultContentSizeLimit = 34_000_000_000
 const ContentLocationLocal = "local"
+
+// ContentLocationRemote is the location of content delegated to a remote
+// pinning service
+const ContentLocationRemote = "remote"
+
+// ContentLocationCluster is the location of content pinned on ipfs-cluster
+const ContentLocationCluster = "cluster"
+
+// RetrievalTicketHeader is set by the primary on the access checks of
+// retrievals it charged or meters, shuttles report how serving them went
+// with it
+const RetrievalTicketHeader = "X-Estuary-Retrieval-Ticket"
+
+// ClientAuthHeader carries the api key a gateway request to a shuttle came
+// with on its access check, for the owner of offloaded content to restore it
+const ClientAuthHeader = "X-Estuary-Client-Auth"
+
+// CDNHeader is set by the primary on the access checks of hot content, for
+// the shuttle to redirect the retrieval to the cdn at its value
+const CDNHeader = "X-Estuary-Cdn"
 const TopMinerSel = 15
 const BucketingEnabled = true
 const MinSafeDealLifetime = (2880 * 21) // three weeks
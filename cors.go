@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// userOrigin is an origin browsers can use an api key of the user from,
+// KeyID, or all keys of the user without origins of their own when it is 0.
+// Keys without any can be used from every origin.
+type userOrigin struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	UserID uint   `gorm:"index;uniqueIndex:idx_user_origin"`
+	KeyID  uint   `gorm:"uniqueIndex:idx_user_origin"`
+	Origin string `gorm:"uniqueIndex:idx_user_origin"`
+}
+
+// the origins of a user are checked on every request, and reloaded this
+// often
+const userOriginsRefresh = time.Minute
+
+type cachedUserOrigins struct {
+	origins []userOrigin
+	loaded  time.Time
+}
+
+func (s *Server) userOrigins(ctx context.Context, uid uint) ([]userOrigin, error) {
+	if v, ok := s.originsCache.Get(uid); ok {
+		co := v.(*cachedUserOrigins)
+		if time.Since(co.loaded) < userOriginsRefresh {
+			return co.origins, nil
+		}
+	}
+
+	var origins []userOrigin
+	if err := s.DB.WithContext(ctx).Find(&origins, "user_id = ?", uid).Error; err != nil {
+		return nil, err
+	}
+	s.originsCache.Add(uid, &cachedUserOrigins{origins: origins, loaded: time.Now()})
+	return origins, nil
+}
+
+// keyOrigins returns the origins bound to key, or the ones of all keys when
+// it has none of its own
+func keyOrigins(origins []userOrigin, key uint) []userOrigin {
+	var own, all []userOrigin
+	for _, o := range origins {
+		switch {
+		case key != 0 && o.KeyID == key:
+			own = append(own, o)
+		case o.KeyID == 0:
+			all = append(all, o)
+		}
+	}
+	if len(own) > 0 {
+		return own
+	}
+	return all
+}
+
+// normalizeOrigin checks that o is a scheme and host, as in an Origin
+// header, and lower cases it. The host can start with *. to match all of
+// its subdomains.
+func normalizeOrigin(o string) (string, error) {
+	u, err := url.Parse(strings.ToLower(strings.TrimSpace(o)))
+	if err != nil {
+		return "", fmt.Errorf("invalid origin %q", o)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" || u.RawQuery != "" || u.User != nil {
+		return "", fmt.Errorf("origin %q must be a scheme and a host, like https://example.com", o)
+	}
+	if strings.Contains(strings.TrimPrefix(u.Host, "*."), "*") {
+		return "", fmt.Errorf("origin %q can only have a wildcard at the start of the host", o)
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// originMatches reports whether the normalized origin o allows requests
+// from origin
+func originMatches(o, origin string) bool {
+	if o == origin {
+		return true
+	}
+	i := strings.Index(o, "://*.")
+	if i < 0 {
+		return false
+	}
+	scheme, suffix := o[:i+3], o[i+4:]
+	return strings.HasPrefix(origin, scheme) && strings.HasSuffix(origin, suffix) && len(origin) > len(scheme)+len(suffix)
+}
+
+// checkOrigin rejects browser requests using a key of u from origins u
+// didn't allow for it
+func (s *Server) checkOrigin(c echo.Context, u *User) error {
+	origin := strings.ToLower(c.Request().Header.Get(echo.HeaderOrigin))
+	if origin == "" {
+		return nil
+	}
+	for _, o := range s.estuaryCfg.CORS.TrustedOrigins {
+		if n, err := normalizeOrigin(o); err == nil && originMatches(n, origin) {
+			return nil
+		}
+	}
+
+	all, err := s.userOrigins(c.Request().Context(), u.ID)
+	if err != nil {
+		return err
+	}
+	origins := keyOrigins(all, u.authToken.ID)
+	if len(origins) == 0 {
+		return nil
+	}
+	for _, o := range origins {
+		if originMatches(o.Origin, origin) {
+			return nil
+		}
+	}
+	return &util.HttpError{
+		Code:    http.StatusForbidden,
+		Reason:  util.ERR_NOT_AUTHORIZED,
+		Details: fmt.Sprintf("api key can not be used from %s", origin),
+	}
+}
+
+type userOriginsBody struct {
+	Origins []string `json:"origins"`
+}
+
+// originsKey returns the id of the api key of u the key query param names,
+// 0 for all keys of u when there is none
+func (s *Server) originsKey(c echo.Context, u *User) (uint, error) {
+	token := c.QueryParam("key")
+	if token == "" {
+		return 0, nil
+	}
+	var key AuthToken
+	if err := s.DB.Scopes(inNamespace(u)).Select("id").First(&key, "\"user\" = ? AND token = ?", u.ID, token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_RECORD_NOT_FOUND,
+				Details: "no such api key",
+			}
+		}
+		return 0, err
+	}
+	return key.ID, nil
+}
+
+// handleGetUserOrigins godoc
+// @Summary      Get allowed origins
+// @Description  This endpoint returns the origins browsers can use the user's api keys from, or one key with its own origins. Keys can be used from every origin while there are none.
+// @Tags         User
+// @Produce      json
+// @Param        key  query     string  false  "API key the origins are bound to, all keys without origins of their own when left out"
+// @Success      200  {object}  userOriginsBody
+// @Router       /user/origins [get]
+func (s *Server) handleGetUserOrigins(c echo.Context, u *User) error {
+	key, err := s.originsKey(c, u)
+	if err != nil {
+		return err
+	}
+
+	var origins []userOrigin
+	if err := s.DB.Order("origin").Find(&origins, "user_id = ? AND key_id = ?", u.ID, key).Error; err != nil {
+		return err
+	}
+
+	out := userOriginsBody{Origins: []string{}}
+	for _, o := range origins {
+		out.Origins = append(out.Origins, o.Origin)
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+// handleSetUserOrigins godoc
+// @Summary      Set allowed origins
+// @Description  This endpoint replaces the origins browsers can use the user's api keys from, for example https://app.example.com or https://*.example.com. With a key, the origins are bound to that key alone, in place of the ones of all keys. An empty list lets keys be used from every origin.
+// @Tags         User
+// @Accept       json
+// @Produce      json
+// @Param        key   query     string           false  "API key to bind the origins to"
+// @Param        body  body      userOriginsBody  true  "Origins"
+// @Success      200   {object}  userOriginsBody
+// @Router       /user/origins [put]
+func (s *Server) handleSetUserOrigins(c echo.Context, u *User) error {
+	var body userOriginsBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	key, err := s.originsKey(c, u)
+	if err != nil {
+		return err
+	}
+
+	if max := s.estuaryCfg.CORS.MaxUserOrigins; len(body.Origins) > max {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("at most %d origins can be allowed", max),
+		}
+	}
+
+	seen := make(map[string]bool)
+	origins := []userOrigin{}
+	for _, o := range body.Origins {
+		n, err := normalizeOrigin(o)
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: err.Error(),
+			}
+		}
+		if !seen[n] {
+			seen[n] = true
+			origins = append(origins, userOrigin{UserID: u.ID, KeyID: key, Origin: n})
+		}
+	}
+
+	if err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ? AND key_id = ?", u.ID, key).Delete(&userOrigin{}).Error; err != nil {
+			return err
+		}
+		if len(origins) == 0 {
+			return nil
+		}
+		return tx.Create(&origins).Error
+	}); err != nil {
+		return err
+	}
+	s.originsCache.Remove(u.ID)
+	return s.handleGetUserOrigins(c, u)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/application-research/estuary/pinner"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/dagsize"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/labstack/echo/v4"
+)
+
+// dagSizeCacheSize is how many DAG size estimates are kept
+const dagSizeCacheSize = 100000
+
+// lookupDagSize returns the size of content with the same root that is
+// already pinned
+func (cm *ContentManager) lookupDagSize(ctx context.Context, c cid.Cid) (int64, bool, error) {
+	var sizes []int64
+	if err := cm.DB.WithContext(ctx).Model(&util.Content{}).
+		Where("cid = ? AND active AND size > 0", c.Bytes()).
+		Limit(1).
+		Pluck("size", &sizes).Error; err != nil {
+		return 0, false, err
+	}
+	if len(sizes) == 0 {
+		return 0, false, nil
+	}
+	return sizes[0], true, nil
+}
+
+func (cm *ContentManager) overSizeLimit(u *User, est dagsize.Estimate) bool {
+	return !u.FlagSplitContent() && est.Size > cm.contentSizeLimit
+}
+
+// checkPinSize turns away a pin whose DAG is already known to be over the
+// content size limit for a user whose content isn't split, the same as an
+// upload that large would be. It only goes by what the node knows without
+// fetching anything, the rest is checked once the pin starts.
+func (s *Server) checkPinSize(c echo.Context, u *User, obj cid.Cid) error {
+	est, ok, err := s.CM.dagSizes.Peek(c.Request().Context(), obj)
+	if err != nil {
+		log.Warnf("failed to estimate size of %s: %s", obj, err)
+		return nil
+	}
+	if !ok || !s.CM.overSizeLimit(u, est) {
+		return nil
+	}
+	return &util.HttpError{
+		Code:    http.StatusBadRequest,
+		Reason:  util.ERR_CONTENT_SIZE_OVER_LIMIT,
+		Details: fmt.Sprintf("content is estimated at %d bytes, over the size limit of %d bytes, and content splitting is not enabled", est.Size, s.CM.contentSizeLimit),
+	}
+}
+
+// errPinOverSizeLimit fails pins estimated larger than any content can be
+var errPinOverSizeLimit = errors.New("pin is over the content size limit")
+
+// estimatePin estimates the size of the DAG of a pin from its root block,
+// for its progress to be reported against, and fails it if it is too large
+// to ever be made a deal for
+func (cm *ContentManager) estimatePin(ctx context.Context, op *pinner.PinningOperation, ng ipld.NodeGetter) error {
+	est, err := cm.dagSizes.Estimate(ctx, op.Obj, dagsize.NodeGetter(ng))
+	if err != nil {
+		// the fetch will run into the same problem and report it
+		log.Debugf("failed to estimate size of %s: %s", op.Obj, err)
+		return nil
+	}
+	op.SetEstimate(est)
+
+	// the user only matters for pins over the limit, most pins don't need
+	// to look them up
+	if est.Size > cm.contentSizeLimit {
+		var u User
+		if err := cm.DB.Select("id, flags").First(&u, "id = ?", op.UserId).Error; err != nil {
+			return err
+		}
+		if cm.overSizeLimit(&u, est) {
+			return fmt.Errorf("%w: content is estimated at %d bytes, over the size limit of %d bytes, and content splitting is not enabled", errPinOverSizeLimit, est.Size, cm.contentSizeLimit)
+		}
+	}
+	if max := pinMaxSize(op.Meta); max > 0 && est.Size > max {
+		return fmt.Errorf("%w: content is estimated at %d bytes, it was pinned with a cap of %d", errPinOverMaxSize, est.Size, max)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/dagstat"
+	"github.com/ipfs/go-blockservice"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+func newDagStats(bs blockstore.Blockstore) (*dagstat.Calculator, error) {
+	dserv := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+	return dagstat.New(dserv, dagstat.Options{})
+}
+
+// contentDagStat is the stat of the DAG of a content, which never changes
+// once it is computed
+type contentDagStat struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"computedAt"`
+
+	Content  uint  `gorm:"uniqueIndex" json:"-"`
+	Size     int64 `json:"size"`
+	Blocks   int   `json:"blocks"`
+	MaxDepth int   `json:"maxDepth"`
+	// Largest is the json of the largest files
+	Largest string `json:"-"`
+}
+
+type dagStatResponse struct {
+	dagstat.Stat
+	ComputedAt time.Time `json:"computedAt"`
+}
+
+// saveDagStat keeps the stat of the DAG of a content, the first one kept
+// stays
+func saveDagStat(ctx context.Context, db *gorm.DB, content uint, st *dagstat.Stat) (*contentDagStat, error) {
+	largest, err := json.Marshal(st.Largest)
+	if err != nil {
+		return nil, err
+	}
+	row := &contentDagStat{
+		Content:  content,
+		Size:     st.Size,
+		Blocks:   st.Blocks,
+		MaxDepth: st.MaxDepth,
+		Largest:  string(largest),
+	}
+	if err := db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(row).Error; err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+func (cm *ContentManager) handleRpcDagStat(ctx context.Context, handle string, param *drpc.DagStat) error {
+	var cont util.Content
+	if err := cm.DB.WithContext(ctx).Select("id, location").First(&cont, "id = ?", param.Content).Error; err != nil {
+		return err
+	}
+	if cont.Location != handle {
+		return fmt.Errorf("content %d is not on shuttle %s", param.Content, handle)
+	}
+	_, err := saveDagStat(ctx, cm.DB, param.Content, &param.Stat)
+	return err
+}
+
+func (r *contentDagStat) response() (*dagStatResponse, error) {
+	resp := &dagStatResponse{
+		Stat: dagstat.Stat{
+			Size:     r.Size,
+			Blocks:   r.Blocks,
+			MaxDepth: r.MaxDepth,
+			Largest:  []dagstat.File{},
+		},
+		ComputedAt: r.CreatedAt,
+	}
+	if r.Largest != "" {
+		if err := json.Unmarshal([]byte(r.Largest), &resp.Largest); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// handleGetDagStat godoc
+// @Summary      Describe the DAG of a content
+// @Description  This endpoint returns the total size, the number of blocks and the depth of the DAG of a content, and its largest files. It is computed once in the background and kept, a 202 means it is still being computed and to come back later. Content on a shuttle is redirected to the shuttle.
+// @Tags         content
+// @Produce      json
+// @Param        id   path      int  true  "Content ID"
+// @Success      200  {object}  dagStatResponse
+// @Success      202  {object}  map[string]bool
+// @Router       /content/{id}/dag-stat [get]
+func (s *Server) handleGetDagStat(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+	content, err := s.getOwnContent(c, u)
+	if err != nil {
+		return err
+	}
+
+	var row contentDagStat
+	err = s.DB.WithContext(ctx).First(&row, "content = ?", content.ID).Error
+	if err == nil {
+		resp, err := row.response()
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, resp)
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	if content.Offloaded {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_CONTENT_NOT_FOUND,
+			Details: fmt.Sprintf("content %d was offloaded", content.ID),
+		}
+	}
+	if content.Location != constants.ContentLocationLocal {
+		host := s.CM.shuttleHostName(content.Location)
+		if host == "" || !s.CM.shuttleIsOnline(content.Location) {
+			return &util.HttpError{
+				Code:    http.StatusServiceUnavailable,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("the shuttle content %d is on is offline", content.ID),
+			}
+		}
+		return c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("https://%s/content/dag-stat/%d", host, content.ID))
+	}
+
+	// the walk outlives the request, it is kept for the next one when
+	// it takes longer
+	job := s.dagStats.Start(content.Cid.CID, dagstat.JobTimeout, func(st *dagstat.Stat, err error) {
+		if err != nil {
+			log.Warnf("failed to compute dag stat of content %d: %s", content.ID, err)
+			return
+		}
+		if _, err := saveDagStat(context.Background(), s.DB, content.ID, st); err != nil {
+			log.Warnf("failed to keep dag stat of content %d: %s", content.ID, err)
+		}
+	})
+	select {
+	case <-job.Done:
+	case <-time.After(dagstat.JobWait):
+		return c.JSON(http.StatusAccepted, map[string]bool{"computing": true})
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if job.Err != nil {
+		return job.Err
+	}
+	return c.JSON(http.StatusOK, &dagStatResponse{Stat: *job.Stat, ComputedAt: time.Now()})
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/alerts"
+	"github.com/application-research/estuary/util"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/labstack/echo/v4"
+)
+
+// datacapAllocation is the datacap used by a verified deal, recorded when
+// the deal is published
+type datacapAllocation struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	Deal    uint   `gorm:"uniqueIndex" json:"deal"`
+	Content uint   `gorm:"index" json:"content"`
+	UserID  uint   `gorm:"index" json:"userId"`
+	Miner   string `gorm:"index" json:"miner"`
+	DealID  int64  `json:"dealId"`
+	Size    int64  `json:"size"`
+}
+
+// datacapStatus is the datacap left to the node as of the last check
+type datacapStatus struct {
+	lk        sync.Mutex
+	remaining *big.Int
+	checkedAt time.Time
+}
+
+// datacapExhausted reports whether the node is too low on datacap to make
+// verified deals, it is false until the datacap was checked once
+func (cm *ContentManager) datacapExhausted() bool {
+	if !cm.datacapCfg.Enabled {
+		return false
+	}
+
+	cm.datacap.lk.Lock()
+	defer cm.datacap.lk.Unlock()
+	return cm.datacap.remaining != nil && cm.datacap.remaining.Cmp(big.NewInt(cm.datacapCfg.StopBelow)) < 0
+}
+
+// refreshDatacap gets the datacap left to the client address from chain
+func (cm *ContentManager) refreshDatacap(ctx context.Context) (*big.Int, error) {
+	dc, err := cm.Api.StateVerifiedClientStatus(ctx, cm.FilClient.ClientAddr, types.EmptyTSK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get datacap of %s: %w", cm.FilClient.ClientAddr, err)
+	}
+
+	// addresses that aren't verified clients have none
+	remaining := new(big.Int)
+	if dc != nil {
+		remaining.Set(dc.Int)
+	}
+
+	wasExhausted := cm.datacapExhausted()
+	cm.datacap.lk.Lock()
+	cm.datacap.remaining = remaining
+	cm.datacap.checkedAt = time.Now()
+	cm.datacap.lk.Unlock()
+
+	if exhausted := cm.datacapExhausted(); exhausted && !wasExhausted {
+		log.Warnf("%s has %s of datacap left, deals are proposed unverified and paid for until it is topped up",
+			cm.FilClient.ClientAddr, types.SizeStr(types.BigInt{Int: remaining}))
+	} else if !exhausted && wasExhausted {
+		log.Infof("%s has datacap again, verified deals are proposed again", cm.FilClient.ClientAddr)
+	}
+	return remaining, nil
+}
+
+// refreshDatacapJob keeps the datacap left up to date on every node that
+// makes deals, alerts are left to the leader
+func (s *Server) refreshDatacapJob(ctx context.Context) error {
+	_, err := s.CM.refreshDatacap(ctx)
+	return err
+}
+
+func (cm *ContentManager) recordDatacapAllocation(d *contentDeal, dealID int64) {
+	prop, err := cm.getProposalRecord(d.PropCid.CID)
+	if err != nil {
+		log.Errorf("failed to get proposal of deal %d to record its datacap: %s", d.ID, err)
+		return
+	}
+
+	if err := cm.DB.Create(&datacapAllocation{
+		Deal:    d.ID,
+		Content: d.Content,
+		UserID:  d.UserID,
+		Miner:   d.Miner,
+		DealID:  dealID,
+		Size:    int64(prop.Proposal.PieceSize),
+	}).Error; err != nil {
+		log.Errorf("failed to record datacap allocation of deal %d: %s", d.ID, err)
+	}
+}
+
+// checkDatacap refreshes the datacap left and alerts when it runs low, and
+// louder once deals fall back to unverified ones that are paid for
+func (s *Server) checkDatacap(ctx context.Context) error {
+	remaining, err := s.CM.refreshDatacap(ctx)
+	if err != nil {
+		return err
+	}
+	left := fmt.Sprintf("%s has %s of datacap left", s.CM.FilClient.ClientAddr, types.SizeStr(types.BigInt{Int: remaining}))
+
+	if s.CM.datacapExhausted() {
+		s.alerts.Fire(ctx, alertDatacapExhausted, alertDatacapExhausted, alerts.SeverityCritical,
+			left+", deals are proposed unverified and paid for until it is topped up")
+	} else {
+		s.alerts.Resolve(ctx, alertDatacapExhausted)
+	}
+
+	if remaining.Cmp(big.NewInt(s.CM.datacapCfg.WarnBelow)) >= 0 {
+		s.alerts.Resolve(ctx, alertDatacapLow)
+		return nil
+	}
+	s.alerts.Fire(ctx, alertDatacapLow, alertDatacapLow, alerts.SeverityWarning, left)
+	return nil
+}
+
+type datacapMinerUsage struct {
+	Miner string `json:"miner"`
+	Deals int64  `json:"deals"`
+	Size  int64  `json:"size"`
+}
+
+type datacapResponse struct {
+	Client    string              `json:"client"`
+	Remaining string              `json:"remaining,omitempty"`
+	CheckedAt time.Time           `json:"checkedAt,omitempty"`
+	WarnBelow int64               `json:"warnBelow"`
+	StopBelow int64               `json:"stopBelow"`
+	Exhausted bool                `json:"exhausted"`
+	Used      int64               `json:"used"`
+	Miners    []datacapMinerUsage `json:"miners"`
+}
+
+// handleAdminGetDatacap godoc
+// @Summary      Get datacap status
+// @Description  This endpoint returns the datacap left to the node as a Fil+ client and how much of it each storage provider was given.
+// @Tags         admin
+// @Produce      json
+// @Success      200  {object}  datacapResponse
+// @Router       /admin/datacap [get]
+func (s *Server) handleAdminGetDatacap(c echo.Context) error {
+	cfg := s.CM.datacapCfg
+	resp := datacapResponse{
+		Client:    s.CM.FilClient.ClientAddr.String(),
+		WarnBelow: cfg.WarnBelow,
+		StopBelow: cfg.StopBelow,
+		Exhausted: s.CM.datacapExhausted(),
+		Miners:    []datacapMinerUsage{},
+	}
+
+	s.CM.datacap.lk.Lock()
+	if s.CM.datacap.remaining != nil {
+		resp.Remaining = s.CM.datacap.remaining.String()
+		resp.CheckedAt = s.CM.datacap.checkedAt
+	}
+	s.CM.datacap.lk.Unlock()
+
+	if err := s.DB.Model(&datacapAllocation{}).
+		Select("miner, COUNT(1) as deals, SUM(size) as size").
+		Group("miner").
+		Order("size desc").
+		Scan(&resp.Miners).Error; err != nil {
+		return err
+	}
+	for _, m := range resp.Miners {
+		resp.Used += m.Size
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// handleAdminGetDatacapLedger godoc
+// @Summary      Get datacap ledger
+// @Description  This endpoint returns the verified deals that used datacap, newest first.
+// @Tags         admin
+// @Produce      json
+// @Param        miner   query  string  false  "Only return allocations to this storage provider"
+// @Param        limit   query  int     false  "Max number of allocations to return"
+// @Param        offset  query  int     false  "Number of allocations to skip"
+// @Success      200  {array}  datacapAllocation
+// @Router       /admin/datacap/ledger [get]
+func (s *Server) handleAdminGetDatacapLedger(c echo.Context) error {
+	limit, offset := 100, 0
+	if limstr := c.QueryParam("limit"); limstr != "" {
+		l, err := strconv.Atoi(limstr)
+		if err != nil || l <= 0 {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_QUERY_PARAM_VALUE,
+				Details: "limit must be a positive number",
+			}
+		}
+		limit = l
+	}
+	if offstr := c.QueryParam("offset"); offstr != "" {
+		o, err := strconv.Atoi(offstr)
+		if err != nil || o < 0 {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_QUERY_PARAM_VALUE,
+				Details: "offset must not be negative",
+			}
+		}
+		offset = o
+	}
+
+	q := s.DB.Model(&datacapAllocation{})
+	if m := c.QueryParam("miner"); m != "" {
+		q = q.Where("miner = ?", m)
+	}
+
+	allocs := []datacapAllocation{}
+	if err := q.Order("id desc").Limit(limit).Offset(offset).Find(&allocs).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, allocs)
+}
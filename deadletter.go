@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// deadLetter is a pin that failed for good, wherever it was pinned. It is
+// kept with why it failed until it is retried or its content is removed, so
+// failed pins can be looked into and queued again, and it goes along with
+// node backups.
+type deadLetter struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	Content  uint   `gorm:"uniqueIndex" json:"content"`
+	UserID   uint   `gorm:"index" json:"userId"`
+	Location string `json:"location"`
+	Error    string `json:"error"`
+}
+
+// recordDeadLetter keeps content contID, whose pin at location just failed,
+// in the dead-letter queue. reason is why it failed, if known.
+func (cm *ContentManager) recordDeadLetter(contID uint, location string, reason string) {
+	var cont util.Content
+	if err := cm.DB.Select("id, user_id").First(&cont, "id = ?", contID).Error; err != nil {
+		log.Errorf("failed to add content %d to the dead-letter queue: %s", contID, err)
+		return
+	}
+
+	dl := &deadLetter{
+		CreatedAt: time.Now(),
+		Content:   contID,
+		UserID:    cont.UserID,
+		Location:  location,
+		Error:     reason,
+	}
+	if err := cm.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "content"}},
+		DoUpdates: clause.AssignmentColumns([]string{"created_at", "location", "error"}),
+	}).Create(dl).Error; err != nil {
+		log.Errorf("failed to add content %d to the dead-letter queue: %s", contID, err)
+	}
+}
+
+func (cm *ContentManager) dropDeadLetter(ctx context.Context, contID uint) {
+	if err := cm.DB.WithContext(ctx).Where("content = ?", contID).Delete(&deadLetter{}).Error; err != nil {
+		log.Errorf("failed to remove content %d from the dead-letter queue: %s", contID, err)
+	}
+}
+
+// retryDeadLetter queues the pin of content contID again, where it was last
+// pinned
+func (cm *ContentManager) retryDeadLetter(ctx context.Context, contID uint) error {
+	var dl deadLetter
+	if err := cm.DB.WithContext(ctx).First(&dl, "content = ?", contID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("content %d is not in the dead-letter queue", contID),
+			}
+		}
+		return err
+	}
+
+	// only content still marked as failed is picked up, a pin of the same
+	// content made since then has it pinning or active
+	res := cm.DB.WithContext(ctx).Model(util.Content{}).Where("id = ? AND failed AND NOT active", contID).UpdateColumns(map[string]interface{}{
+		"pinning": true,
+		"failed":  false,
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	cm.dropDeadLetter(ctx, contID)
+	if res.RowsAffected == 0 {
+		return &util.HttpError{
+			Code:    http.StatusConflict,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("content %d is no longer failed", contID),
+		}
+	}
+
+	var cont util.Content
+	if err := cm.DB.WithContext(ctx).First(&cont, "id = ?", contID).Error; err != nil {
+		return err
+	}
+
+	var origins []*peer.AddrInfo
+	if cont.Origins != "" {
+		_ = json.Unmarshal([]byte(cont.Origins), &origins) // origins are a nice to have
+	}
+
+	if cont.Location == constants.ContentLocationLocal {
+		cm.addPinToQueue(ctx, cont, origins, 0, true)
+		return nil
+	}
+	return cm.pinContentOnShuttle(ctx, cont, origins, 0, cont.Location, true)
+}
+
+// handleAdminListDeadLetters godoc
+// @Summary      List the dead-letter queue
+// @Description  This endpoint lists the pins that failed for good, newest first, with where they were pinned and why they failed.
+// @Tags         admin
+// @Produce      json
+// @Param        user    query  int  false  "User ID"
+// @Param        limit   query  int  false  "Most pins listed, 100 by default"
+// @Param        offset  query  int  false  "Offset"
+// @Success      200  {array}  deadLetter
+// @Router       /admin/pin-queue/dead-letter [get]
+func (s *Server) handleAdminListDeadLetters(c echo.Context) error {
+	q := s.DB.WithContext(c.Request().Context()).Model(&deadLetter{}).Order("created_at desc")
+	if u := c.QueryParam("user"); u != "" {
+		user, err := strconv.ParseUint(u, 10, 64)
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid user: %s", u),
+			}
+		}
+		q = q.Where("user_id = ?", user)
+	}
+
+	limit := defaultPinQueueListLimit
+	if l := c.QueryParam("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid limit: %s", l),
+			}
+		}
+		limit = n
+	}
+	var offset int
+	if o := c.QueryParam("offset"); o != "" {
+		n, err := strconv.Atoi(o)
+		if err != nil || n < 0 {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid offset: %s", o),
+			}
+		}
+		offset = n
+	}
+
+	out := make([]deadLetter, 0)
+	if err := q.Limit(limit).Offset(offset).Find(&out).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+// handleAdminRetryDeadLetter godoc
+// @Summary      Retry a pin from the dead-letter queue
+// @Description  This endpoint takes a failed pin off the dead-letter queue and queues it again where it was pinned before.
+// @Tags         admin
+// @Param        content  path  int  true  "Content ID"
+// @Router       /admin/pin-queue/dead-letter/{content}/retry [post]
+func (s *Server) handleAdminRetryDeadLetter(c echo.Context) error {
+	id, err := pinQueueContentParam(c)
+	if err != nil {
+		return err
+	}
+	if err := s.CM.retryDeadLetter(c.Request().Context(), id); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
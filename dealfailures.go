@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/dealfailure"
+	"github.com/filecoin-project/go-address"
+	"github.com/labstack/echo/v4"
+)
+
+// unretryableFailureWindow is how long a miner that failed a deal for a
+// reason retrying won't fix is left out of the deals for that content
+const unretryableFailureWindow = time.Hour * 24 * 7
+
+func unretryableReasons() []string {
+	var out []string
+	for _, r := range dealfailure.Reasons {
+		if !dealfailure.Retryable(r) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// unretryableMiners returns the miners whose deals for a content recently
+// failed for reasons that trying again with them won't fix
+func (cm *ContentManager) unretryableMiners(ctx context.Context, content uint) ([]address.Address, error) {
+	var miners []string
+	if err := cm.DB.WithContext(ctx).Model(&dfeRecord{}).
+		Distinct("miner").
+		Where("content = ? AND reason IN ? AND created_at > ?", content, unretryableReasons(), time.Now().Add(-unretryableFailureWindow)).
+		Pluck("miner", &miners).Error; err != nil {
+		return nil, err
+	}
+
+	out := make([]address.Address, 0, len(miners))
+	for _, m := range miners {
+		a, err := address.NewFromString(m)
+		if err != nil {
+			continue
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+type failureReasonCount struct {
+	Miner  string `json:"miner"`
+	Reason string `json:"reason"`
+	Count  int64  `json:"count"`
+}
+
+// failureReasonCounts counts the deal failures since a time by miner and
+// reason, of one miner if miner isn't empty
+func (s *Server) failureReasonCounts(ctx context.Context, miner string, since time.Time) ([]failureReasonCount, error) {
+	q := util.ReadReplica(s.DB).WithContext(ctx).Model(&dfeRecord{}).
+		Select("miner, reason, COUNT(*) AS count").
+		Where("created_at > ?", since)
+	if miner != "" {
+		q = q.Where("miner = ?", miner)
+	}
+
+	var out []failureReasonCount
+	if err := q.Group("miner, reason").Order("count desc").Scan(&out).Error; err != nil {
+		return nil, err
+	}
+	for i := range out {
+		// failures recorded before they were classified
+		if out[i].Reason == "" {
+			out[i].Reason = dealfailure.Unknown
+		}
+	}
+	return out, nil
+}
+
+// handleAdminGetFailureReasons godoc
+// @Summary      Deal failures by cause
+// @Description  This endpoint counts the deal failures of every miner by their cause, such as a rejected price, too little collateral, a stalled transfer, a sealing fault or an expired proposal.
+// @Tags         admin
+// @Produce      json
+// @Param        days  query     int  false  "Days to count the failures of (default 30)"
+// @Success      200   {array}   failureReasonCount
+// @Router       /admin/miners/failure-reasons [get]
+func (s *Server) handleAdminGetFailureReasons(c echo.Context) error {
+	days := 30
+	if d := c.QueryParam("days"); d != "" {
+		n, err := strconv.Atoi(d)
+		if err != nil || n <= 0 {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_QUERY_PARAM_VALUE,
+				Details: "days must be a positive number",
+			}
+		}
+		days = n
+	}
+
+	counts, err := s.failureReasonCounts(c.Request().Context(), "", time.Now().Add(-time.Hour*24*time.Duration(days)))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, counts)
+}
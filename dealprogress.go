@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/util/dealphase"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// dealProgress is what the provider last said about a deal that isn't
+// sealed yet
+type dealProgress struct {
+	ID      uint `gorm:"primarykey" json:"-"`
+	Deal    uint `gorm:"uniqueIndex" json:"-"`
+	Content uint `gorm:"index" json:"-"`
+
+	Phase         string    `json:"phase"`
+	ProviderState string    `json:"providerState"`
+	Message       string    `json:"message,omitempty"`
+	BytesSent     uint64    `json:"bytesSent"`
+	CheckedAt     time.Time `json:"checkedAt"`
+	CheckErrors   int       `json:"checkErrors,omitempty"`
+	LastError     string    `json:"lastError,omitempty"`
+}
+
+// recordDealProgress stores the state the provider returned for a deal, or
+// that asking for it failed. sent is left as it was when 0.
+func (cm *ContentManager) recordDealProgress(ctx context.Context, d contentDeal, provds *storagemarket.ProviderDealState, sent uint64, perr error) {
+	row := dealProgress{
+		Deal:      d.ID,
+		Content:   d.Content,
+		BytesSent: sent,
+		CheckedAt: time.Now(),
+	}
+	upd := map[string]interface{}{"checked_at": row.CheckedAt}
+	if sent > 0 {
+		upd["bytes_sent"] = sent
+	}
+	if perr != nil {
+		row.Phase = dealphase.Proposed
+		row.CheckErrors = 1
+		row.LastError = perr.Error()
+		upd["check_errors"] = gorm.Expr("deal_progresses.check_errors + 1")
+		upd["last_error"] = row.LastError
+	} else {
+		row.Phase = dealphase.Of(provds.State)
+		row.ProviderState = dealphase.Name(provds.State)
+		row.Message = provds.Message
+		upd["phase"] = row.Phase
+		upd["provider_state"] = row.ProviderState
+		upd["message"] = row.Message
+		upd["check_errors"] = 0
+		upd["last_error"] = ""
+	}
+
+	if err := cm.DB.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "deal"}},
+		DoUpdates: clause.Assignments(upd),
+	}).Create(&row).Error; err != nil {
+		log.Errorf("failed to record progress of deal %d: %s", d.ID, err)
+	}
+}
+
+// recordDealState keeps the state a provider returned when checking a
+// deal, if it changed since it was last kept
+func (cm *ContentManager) recordDealState(ctx context.Context, d contentDeal, provds *storagemarket.ProviderDealState) {
+	if !cm.dealProgressCfg.Enabled {
+		return
+	}
+
+	row := dealProgress{
+		Deal:          d.ID,
+		Content:       d.Content,
+		Phase:         dealphase.Of(provds.State),
+		ProviderState: dealphase.Name(provds.State),
+		Message:       provds.Message,
+		CheckedAt:     time.Now(),
+	}
+	if err := cm.DB.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "deal"}},
+		DoUpdates: clause.AssignmentColumns([]string{"phase", "provider_state", "message", "checked_at"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			gorm.Expr("deal_progresses.provider_state <> excluded.provider_state OR deal_progresses.message <> excluded.message"),
+		}},
+	}).Create(&row).Error; err != nil {
+		log.Errorf("failed to record progress of deal %d: %s", d.ID, err)
+	}
+}
+
+// pollDealProgress asks the providers of the deals that were checked the
+// longest ago for their state, and how much of their data was sent
+func (s *Server) pollDealProgress(ctx context.Context) error {
+	cfg := s.estuaryCfg.DealProgress
+	cutoff := time.Now().Add(-cfg.MaxAge)
+
+	if err := s.pruneDealProgress(ctx, cutoff); err != nil {
+		return err
+	}
+
+	var deals []contentDeal
+	if err := s.DB.WithContext(ctx).Model(&contentDeal{}).
+		Select("content_deals.*").
+		Joins("LEFT JOIN deal_progresses ON deal_progresses.deal = content_deals.id").
+		Where("NOT content_deals.failed AND NOT content_deals.slashed AND content_deals.created_at > ?", cutoff).
+		Where("content_deals.deal_id = 0 OR NOT content_deals.sealed_at > content_deals.on_chain_at").
+		Where("deal_progresses.phase IS NULL OR deal_progresses.phase <> ?", dealphase.Failed).
+		Order("deal_progresses.checked_at IS NOT NULL, deal_progresses.checked_at").
+		Limit(cfg.BatchSize).
+		Find(&deals).Error; err != nil {
+		return err
+	}
+
+	sem := make(chan struct{}, cfg.Concurrency)
+	var wg sync.WaitGroup
+	for _, d := range deals {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(d contentDeal) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			provds, sent, err := s.checkDealProgress(ctx, d)
+			s.CM.recordDealProgress(ctx, d, provds, sent, err)
+		}(d)
+	}
+	wg.Wait()
+	return nil
+}
+
+// pruneDealProgress drops the progress of deals that are sealed, failed or
+// too old to be polled, which is never shown again
+func (s *Server) pruneDealProgress(ctx context.Context, cutoff time.Time) error {
+	done := s.DB.Model(&contentDeal{}).Select("id").
+		Where("failed OR slashed OR created_at <= ? OR (deal_id <> 0 AND sealed_at > on_chain_at)", cutoff)
+	return s.DB.WithContext(ctx).Where("deal IN (?)", done).Delete(&dealProgress{}).Error
+}
+
+func (s *Server) checkDealProgress(ctx context.Context, d contentDeal) (*storagemarket.ProviderDealState, uint64, error) {
+	var sent uint64
+	content, err := s.CM.getContent(d.Content)
+	if err != nil {
+		return nil, 0, err
+	}
+	if chanst, err := s.CM.GetTransferStatus(ctx, &d, content); err == nil && chanst != nil {
+		sent = chanst.Sent
+	}
+
+	maddr, err := d.MinerAddr()
+	if err != nil {
+		return nil, sent, err
+	}
+	var dealUUID *uuid.UUID
+	if d.DealUUID != "" {
+		parsed, err := uuid.Parse(d.DealUUID)
+		if err != nil {
+			return nil, sent, fmt.Errorf("parsing deal uuid %s: %w", d.DealUUID, err)
+		}
+		dealUUID = &parsed
+	}
+
+	subctx, cancel := context.WithTimeout(ctx, s.estuaryCfg.DealProgress.Timeout)
+	defer cancel()
+	if err := s.CM.connectProvider(subctx, maddr); err != nil {
+		return nil, sent, err
+	}
+	provds, err := s.FilClient.DealStatus(subctx, maddr, d.PropCid.CID, dealUUID)
+	if err != nil {
+		return nil, sent, err
+	}
+	if provds == nil {
+		return nil, sent, fmt.Errorf("provider returned no deal state")
+	}
+	return provds, sent, nil
+}
+
+// dealProgresses returns the progress of deals by their id
+func (s *Server) dealProgresses(ctx context.Context, ids []uint) (map[uint]*dealProgress, error) {
+	var rows []*dealProgress
+	if err := s.DB.WithContext(ctx).Find(&rows, "deal IN ?", ids).Error; err != nil {
+		return nil, err
+	}
+	out := make(map[uint]*dealProgress, len(rows))
+	for _, r := range rows {
+		out[r.Deal] = r
+	}
+	return out, nil
+}
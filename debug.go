@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/application-research/estuary/eventstream"
+	"github.com/application-research/estuary/pinner"
+	"github.com/application-research/estuary/util/blockcache"
+	"github.com/application-research/estuary/util/dealbatch"
+	"github.com/application-research/estuary/util/sessionpool"
+	"github.com/application-research/estuary/util/spconn"
+	"github.com/labstack/echo/v4"
+)
+
+type shuttleConnState struct {
+	Handle         string `json:"handle"`
+	Hostname       string `json:"hostname"`
+	PeerID         string `json:"peerId"`
+	Online         bool   `json:"online"`
+	Private        bool   `json:"private"`
+	SpaceLow       bool   `json:"spaceLow"`
+	Draining       bool   `json:"draining"`
+	IntakePaused   bool   `json:"intakePaused"`
+	BlockstoreSize uint64 `json:"blockstoreSize"`
+	BlockstoreFree uint64 `json:"blockstoreFree"`
+	PinCount       int64  `json:"pinCount"`
+	PinQueueLength int64  `json:"pinQueueLength"`
+}
+
+type dealWorkerState struct {
+	ToCheckLength        int              `json:"toCheckLength"`
+	ToCheckCapacity      int              `json:"toCheckCapacity"`
+	RecheckQueueLength   int              `json:"recheckQueueLength"`
+	NextRecheck          time.Time        `json:"nextRecheck"`
+	StagingZones         int              `json:"stagingZones"`
+	RetrievalsInProgress int              `json:"retrievalsInProgress"`
+	DealMakingDisabled   bool             `json:"dealMakingDisabled"`
+	Proposals            *dealbatch.Stats `json:"proposals,omitempty"`
+	ProviderConns        spconn.Stats     `json:"providerConns"`
+}
+
+type debugStateResponse struct {
+	Leader      bool                     `json:"leader"`
+	Goroutines  int                      `json:"goroutines"`
+	PinQueue    *pinner.PinQueueSnapshot `json:"pinQueue"`
+	PinJobs     int                      `json:"pinJobs"`
+	Shuttles    []shuttleConnState       `json:"shuttles"`
+	DealWorkers dealWorkerState          `json:"dealWorkers"`
+	EventStream eventstream.Stats        `json:"eventStream"`
+	Sessions    sessionpool.Stats        `json:"sessions"`
+	BlockCache  *blockcache.Stats        `json:"blockCache,omitempty"`
+}
+
+func (cm *ContentManager) shuttleConnStates() []shuttleConnState {
+	cm.shuttlesLk.Lock()
+	defer cm.shuttlesLk.Unlock()
+
+	out := make([]shuttleConnState, 0, len(cm.shuttles))
+	for _, sc := range cm.shuttles {
+		var online bool
+		select {
+		case <-sc.ctx.Done():
+		default:
+			online = true
+		}
+
+		out = append(out, shuttleConnState{
+			Handle:         sc.handle,
+			Hostname:       sc.hostname,
+			PeerID:         sc.addrInfo.ID.String(),
+			Online:         online,
+			Private:        sc.private,
+			SpaceLow:       sc.spaceLow,
+			Draining:       sc.draining,
+			IntakePaused:   sc.intakePaused,
+			BlockstoreSize: sc.blockstoreSize,
+			BlockstoreFree: sc.blockstoreFree,
+			PinCount:       sc.pinCount,
+			PinQueueLength: sc.pinQueueLength,
+		})
+	}
+	return out
+}
+
+func (cm *ContentManager) dealWorkerState() dealWorkerState {
+	st := dealWorkerState{
+		ToCheckLength:      len(cm.ToCheck),
+		ToCheckCapacity:    cap(cm.ToCheck),
+		DealMakingDisabled: cm.dealMakingDisabled(),
+		ProviderConns:      cm.spConns.Stats(),
+	}
+
+	if cm.proposals != nil {
+		ps := cm.proposals.Stats()
+		st.Proposals = &ps
+	}
+
+	cm.queueMgr.qlk.Lock()
+	st.RecheckQueueLength = cm.queueMgr.queue.Len()
+	st.NextRecheck = cm.queueMgr.nextEvent
+	cm.queueMgr.qlk.Unlock()
+
+	cm.bucketLk.Lock()
+	for _, zones := range cm.buckets {
+		st.StagingZones += len(zones)
+	}
+	cm.bucketLk.Unlock()
+
+	cm.retrLk.Lock()
+	st.RetrievalsInProgress = len(cm.retrievalsInProgress)
+	cm.retrLk.Unlock()
+
+	return st
+}
+
+// handleAdminDebugState godoc
+// @Summary      Get a snapshot of internal state
+// @Description  This endpoint returns a snapshot of the pin queue, shuttle connections and deal workers, to help diagnose a hung node.
+// @Tags         admin
+// @Produce      json
+// @Success      200  {object}  debugStateResponse
+// @Router       /admin/debug/state [get]
+func (s *Server) handleAdminDebugState(c echo.Context) error {
+	s.CM.pinLk.Lock()
+	pinJobs := len(s.CM.pinJobs)
+	s.CM.pinLk.Unlock()
+
+	var bcstats *blockcache.Stats
+	if s.Node.BlockCache != nil {
+		st := s.Node.BlockCache.Stats()
+		bcstats = &st
+	}
+
+	return c.JSON(http.StatusOK, &debugStateResponse{
+		Leader:      s.elector.IsLeader(),
+		Goroutines:  runtime.NumGoroutine(),
+		PinQueue:    s.CM.pinMgr.Snapshot(),
+		PinJobs:     pinJobs,
+		Shuttles:    s.CM.shuttleConnStates(),
+		DealWorkers: s.CM.dealWorkerState(),
+		EventStream: s.CM.events.Stats(),
+		Sessions:    s.sessions.Stats(),
+		BlockCache:  bcstats,
+	})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+type dedupeStats struct {
+	// LogicalBytes is the sum of the sizes of every block referenced by
+	// active content, counting a block once per content that references it
+	LogicalBytes int64 `json:"logicalBytes"`
+	// UniqueBytes is the sum of the sizes of the distinct blocks referenced by
+	// active content, i.e. what is actually held in the blockstore
+	UniqueBytes  int64   `json:"uniqueBytes"`
+	SavedBytes   int64   `json:"savedBytes"`
+	DedupeRatio  float64 `json:"dedupeRatio"`
+	NumContents  int64   `json:"numContents"`
+	NumObjects   int64   `json:"numObjects"`
+	NumObjectRef int64   `json:"numObjectRefs"`
+}
+
+// aggregates reference the same objects as the contents inside of them, so
+// they are left out to avoid counting those blocks twice
+func dedupeScope(db *gorm.DB, userID uint) *gorm.DB {
+	q := db.Table("obj_refs").
+		Joins("inner join contents on obj_refs.content = contents.id").
+		Where("contents.active AND NOT contents.aggregate AND contents.deleted_at IS NULL")
+	if userID > 0 {
+		q = q.Where("contents.user_id = ?", userID)
+	}
+	return q
+}
+
+// getDedupeStats computes the dedupe savings for a single user, or for the
+// whole node if userID is zero.
+func (s *Server) getDedupeStats(userID uint) (*dedupeStats, error) {
+	stats, err := s.queryDedupeStats(userID, false)
+	if err != nil {
+		return nil, err
+	}
+	if st, ok := stats[0]; ok {
+		return st, nil
+	}
+	return &dedupeStats{}, nil
+}
+
+// getDedupeStatsPerUser computes the dedupe savings of every user with
+// active content, keyed by user id
+func (s *Server) getDedupeStatsPerUser() (map[uint]*dedupeStats, error) {
+	return s.queryDedupeStats(0, true)
+}
+
+// queryDedupeStats sums the blocks referenced by the content in scope, as
+// one set or grouped by the user the content is of. Blocks are unique per
+// group, so a block pinned by two users counts for each of them.
+func (s *Server) queryDedupeStats(userID uint, perUser bool) (map[uint]*dedupeStats, error) {
+	db := util.ReadReplica(s.DB)
+
+	owner := "0"
+	if perUser {
+		owner = "contents.user_id"
+	}
+
+	var logical []struct {
+		UserID       uint
+		LogicalBytes int64
+		NumObjectRef int64
+		NumContents  int64
+	}
+	lq := dedupeScope(db, userID).
+		Joins("inner join objects on obj_refs.object = objects.id").
+		Select(owner + " as user_id, COALESCE(SUM(objects.size), 0) as logical_bytes, COUNT(1) as num_object_ref, COUNT(DISTINCT obj_refs.content) as num_contents")
+	if perUser {
+		lq = lq.Group("contents.user_id")
+	}
+	if err := lq.Scan(&logical).Error; err != nil {
+		return nil, err
+	}
+
+	var unique []struct {
+		UserID      uint
+		UniqueBytes int64
+		NumObjects  int64
+	}
+	if err := db.Table("(?) as refs", dedupeScope(db, userID).Select("DISTINCT "+owner+" as user_id, obj_refs.object")).
+		Joins("inner join objects on refs.object = objects.id").
+		Select("refs.user_id, COALESCE(SUM(objects.size), 0) as unique_bytes, COUNT(1) as num_objects").
+		Group("refs.user_id").
+		Scan(&unique).Error; err != nil {
+		return nil, err
+	}
+
+	stats := make(map[uint]*dedupeStats, len(logical))
+	for _, l := range logical {
+		stats[l.UserID] = &dedupeStats{
+			LogicalBytes: l.LogicalBytes,
+			NumObjectRef: l.NumObjectRef,
+			NumContents:  l.NumContents,
+		}
+	}
+	for _, u := range unique {
+		st, ok := stats[u.UserID]
+		if !ok {
+			continue
+		}
+		st.UniqueBytes = u.UniqueBytes
+		st.NumObjects = u.NumObjects
+		st.SavedBytes = st.LogicalBytes - st.UniqueBytes
+		if st.UniqueBytes > 0 {
+			st.DedupeRatio = float64(st.LogicalBytes) / float64(st.UniqueBytes)
+		}
+	}
+	return stats, nil
+}
+
+// handleGetUserDedupeStats godoc
+// @Summary      Get deduplication savings for the user
+// @Description  This endpoint reports how many logical bytes the user has pinned versus the unique bytes actually stored for them.
+// @Tags         User
+// @Produce      json
+// @Success      200  {object}  dedupeStats
+// @Router       /user/stats/dedupe [get]
+func (s *Server) handleGetUserDedupeStats(c echo.Context, u *User) error {
+	st, err := s.getDedupeStats(u.ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, st)
+}
+
+type adminDedupeStatsResponse struct {
+	Global *dedupeStats          `json:"global"`
+	Users  map[uint]*dedupeStats `json:"users,omitempty"`
+}
+
+// handleAdminGetDedupeStats godoc
+// @Summary      Get deduplication savings
+// @Description  This endpoint reports node wide deduplication savings. Pass ?user=all to also get a breakdown for every user with active content, or ?user=<id> for a single user.
+// @Tags         admin
+// @Produce      json
+// @Param        user  query  string  false  "'all' or a user id"
+// @Success      200  {object}  adminDedupeStatsResponse
+// @Router       /admin/stats/dedupe [get]
+func (s *Server) handleAdminGetDedupeStats(c echo.Context) error {
+	global, err := s.getDedupeStats(0)
+	if err != nil {
+		return err
+	}
+
+	resp := &adminDedupeStatsResponse{
+		Global: global,
+	}
+
+	switch uq := c.QueryParam("user"); uq {
+	case "":
+	case "all":
+		users, err := s.getDedupeStatsPerUser()
+		if err != nil {
+			return err
+		}
+		resp.Users = users
+	default:
+		uid, err := strconv.Atoi(uq)
+		if err != nil {
+			return err
+		}
+		st, err := s.getDedupeStats(uint(uid))
+		if err != nil {
+			return err
+		}
+		resp.Users = map[uint]*dedupeStats{uint(uid): st}
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
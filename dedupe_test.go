@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestDedupeStats(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	assert.NoError(err)
+	assert.NoError(db.AutoMigrate(&util.Content{}, &util.Object{}, &util.ObjRef{}))
+
+	c, _ := cid.Decode("bafkqaaa")
+	objs := []*util.Object{{Size: 100}, {Size: 200}, {Size: 400}}
+	for _, o := range objs {
+		o.Cid = util.DbCID{CID: c}
+		assert.NoError(db.Create(o).Error)
+	}
+	a, b, d := objs[0].ID, objs[1].ID, objs[2].ID
+
+	pin := func(cont *util.Content, objs ...uint) {
+		cont.Cid = util.DbCID{CID: c}
+		assert.NoError(db.Create(cont).Error)
+		for _, o := range objs {
+			assert.NoError(db.Create(&util.ObjRef{Content: cont.ID, Object: o}).Error)
+		}
+	}
+	pin(&util.Content{UserID: 1, Active: true}, a, b)
+	pin(&util.Content{UserID: 1, Active: true}, a)
+	pin(&util.Content{UserID: 2, Active: true}, a, d)
+	// aggregates, inactive and deleted content aren't counted
+	pin(&util.Content{UserID: 1, Active: true, Aggregate: true}, a, b)
+	pin(&util.Content{UserID: 2}, d)
+	deleted := &util.Content{UserID: 2, Active: true}
+	pin(deleted, b)
+	assert.NoError(db.Delete(deleted).Error)
+
+	s := &Server{DB: db}
+
+	global, err := s.getDedupeStats(0)
+	assert.NoError(err)
+	assert.Equal(&dedupeStats{
+		LogicalBytes: 900,
+		UniqueBytes:  700,
+		SavedBytes:   200,
+		DedupeRatio:  900.0 / 700.0,
+		NumContents:  3,
+		NumObjects:   3,
+		NumObjectRef: 5,
+	}, global)
+
+	user1 := &dedupeStats{
+		LogicalBytes: 400,
+		UniqueBytes:  300,
+		SavedBytes:   100,
+		DedupeRatio:  400.0 / 300.0,
+		NumContents:  2,
+		NumObjects:   2,
+		NumObjectRef: 3,
+	}
+	user2 := &dedupeStats{
+		LogicalBytes: 500,
+		UniqueBytes:  500,
+		DedupeRatio:  1,
+		NumContents:  1,
+		NumObjects:   2,
+		NumObjectRef: 2,
+	}
+
+	st, err := s.getDedupeStats(1)
+	assert.NoError(err)
+	assert.Equal(user1, st)
+
+	st, err = s.getDedupeStats(3)
+	assert.NoError(err)
+	assert.Equal(&dedupeStats{}, st)
+
+	// a block pinned by both users counts for each of them
+	users, err := s.getDedupeStatsPerUser()
+	assert.NoError(err)
+	assert.Equal(map[uint]*dedupeStats{1: user1, 2: user2}, users)
+}
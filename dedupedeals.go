@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+// With DedupeAcrossUsers set, content pinned by several users is stored and
+// dealt once. A pin of a root that is already here goes to the node that
+// keeps it, and only the oldest content with that root and size makes deals,
+// which stand for the others too. Every user keeps their own content row, so
+// quotas and deletion work per user as before. When the content holding the
+// deals is removed, the deals pass to the next oldest one.
+
+// dealOwner returns the content whose deals cover content, the oldest active
+// content with the same root and size. It is content itself when it isn't
+// shared or dedupe is off.
+func (cm *ContentManager) dealOwner(ctx context.Context, content util.Content) (util.Content, error) {
+	if !cm.dedupeAcrossUsers {
+		return content, nil
+	}
+
+	var owner util.Content
+	err := cm.DB.WithContext(ctx).Order("id asc").
+		First(&owner, "cid = ? AND size = ? AND active AND NOT failed AND id <= ?", content.Cid.CID.Bytes(), content.Size, content.ID).Error
+	switch {
+	case err == nil:
+		if owner.ID == content.ID || owner.UserID == content.UserID {
+			return owner, nil
+		}
+		// the deals of another user only cover content while they are with
+		// providers its own user may deal with
+		ok, err := cm.dealsAllowed(ctx, owner.ID, content.UserID)
+		if err != nil {
+			return util.Content{}, err
+		}
+		if !ok {
+			return content, nil
+		}
+		return owner, nil
+	case xerrors.Is(err, gorm.ErrRecordNotFound):
+		return content, nil
+	default:
+		return util.Content{}, err
+	}
+}
+
+// sharedContentLocation returns the node already keeping an active copy of
+// obj, if it can take more pins, so another copy isn't fetched elsewhere
+func (cm *ContentManager) sharedContentLocation(ctx context.Context, obj cid.Cid) (string, error) {
+	if !cm.dedupeAcrossUsers {
+		return "", nil
+	}
+
+	var locs []string
+	if err := cm.DB.WithContext(ctx).Model(&util.Content{}).Distinct().
+		Where("cid = ? AND active AND NOT offloaded", obj.Bytes()).
+		Pluck("location", &locs).Error; err != nil {
+		return "", err
+	}
+
+	for _, loc := range locs {
+		if loc == constants.ContentLocationLocal {
+			if !cm.localContentAddingDisabled {
+				return loc, nil
+			}
+			continue
+		}
+
+		cm.shuttlesLk.Lock()
+		sh, ok := cm.shuttles[loc]
+		usable := ok && !sh.draining && !sh.spaceLow
+		cm.shuttlesLk.Unlock()
+		if usable && cm.shuttleIsOnline(loc) {
+			return loc, nil
+		}
+	}
+	return "", nil
+}
+
+// handDealsOver moves the deals of removed content to the next oldest
+// content with the same root, which is checked right away so it takes over
+// keeping them up. The deals stay with the user who made them, the user of
+// the next content only sees how many there are.
+func (cm *ContentManager) handDealsOver(ctx context.Context, removed util.Content) error {
+	if !cm.dedupeAcrossUsers {
+		return nil
+	}
+
+	var next util.Content
+	err := cm.DB.WithContext(ctx).Order("id asc").
+		First(&next, "cid = ? AND size = ? AND active AND NOT failed AND id != ?", removed.Cid.CID.Bytes(), removed.Size, removed.ID).Error
+	switch {
+	case err == nil:
+	case xerrors.Is(err, gorm.ErrRecordNotFound):
+		return nil
+	default:
+		return err
+	}
+
+	res := cm.DB.WithContext(ctx).Model(&contentDeal{}).Where("content = ?", removed.ID).UpdateColumn("content", next.ID)
+	if res.Error != nil {
+		return xerrors.Errorf("failed to hand deals of content %d over to %d: %w", removed.ID, next.ID, res.Error)
+	}
+
+	if res.RowsAffected > 0 {
+		log.Infow("handed deals of removed content over", "content", removed.ID, "to", next.ID, "deals", res.RowsAffected)
+	}
+	cm.ToCheck <- next.ID
+	return nil
+}
+
+// sharedReplication is the highest replication asked for by any of the
+// contents sharing the deals of owner
+func (cm *ContentManager) sharedReplication(ctx context.Context, owner util.Content) (int, error) {
+	var repl int
+	if err := cm.DB.WithContext(ctx).Model(&util.Content{}).
+		Where("cid = ? AND size = ? AND active AND NOT failed", owner.Cid.CID.Bytes(), owner.Size).
+		Select("COALESCE(MAX(replication), 0)").Scan(&repl).Error; err != nil {
+		return 0, err
+	}
+	return repl, nil
+}
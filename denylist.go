@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/denylist"
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// what a blocked attempt was
+const (
+	denyPin   = "pin"
+	denyServe = "serve"
+	denyDeal  = "deal"
+)
+
+// entries added by operators are listed under this source
+const denylistOperator = "operator"
+
+// denylistEntry is content an operator listed, by cid or by anchor
+type denylistEntry struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	Cid     string
+	Anchor  string `gorm:"uniqueIndex"`
+	Reason  string
+	AddedBy uint
+}
+
+// denylistBlock is the audit record of an attempt the denylist blocked
+type denylistBlock struct {
+	ID        uint      `gorm:"primarykey"`
+	CreatedAt time.Time `gorm:"index"`
+
+	Cid    string `gorm:"index"`
+	Action string
+	Source string
+	UserID uint
+	Remote string
+}
+
+// contentDenylist holds the lists of each source and of the operators
+type contentDenylist struct {
+	db  *gorm.DB
+	cfg config.Denylist
+
+	lk       sync.RWMutex
+	sources  map[string]*denylist.List
+	operator *denylist.List
+}
+
+func newContentDenylist(db *gorm.DB, cfg config.Denylist) *contentDenylist {
+	return &contentDenylist{
+		db:       db,
+		cfg:      cfg,
+		sources:  make(map[string]*denylist.List),
+		operator: denylist.New(),
+	}
+}
+
+// lookup returns the source c is listed by, if it is
+func (dl *contentDenylist) lookup(c cid.Cid) (string, bool) {
+	return dl.lookupPath(c, "")
+}
+
+// lookupPath returns the source the path p in c is listed by, if it is
+func (dl *contentDenylist) lookupPath(c cid.Cid, p string) (string, bool) {
+	if !dl.cfg.Enabled {
+		return "", false
+	}
+
+	dl.lk.RLock()
+	defer dl.lk.RUnlock()
+
+	if src, ok := dl.operator.LookupPath(c, p); ok {
+		return src, true
+	}
+	for _, l := range dl.sources {
+		if src, ok := l.LookupPath(c, p); ok {
+			return src, true
+		}
+	}
+	return "", false
+}
+
+// listed reports whether the block c is listed, for the blockstores of the
+// gateway and of bitswap
+func (dl *contentDenylist) listed(c cid.Cid) bool {
+	_, ok := dl.lookup(c)
+	return ok
+}
+
+// anchors returns the anchors of every list, for shuttles to enforce them
+func (dl *contentDenylist) anchors() []string {
+	dl.lk.RLock()
+	defer dl.lk.RUnlock()
+
+	out := dl.operator.Anchors()
+	for _, l := range dl.sources {
+		out = append(out, l.Anchors()...)
+	}
+	return out
+}
+
+// check fails with 451 if c is listed, and records the attempt
+func (dl *contentDenylist) check(ctx context.Context, c cid.Cid, action string, uid uint, remote string) error {
+	return dl.checkPath(ctx, c, "", action, uid, remote)
+}
+
+// checkPath fails with 451 if c or the path p in it is listed, and records
+// the attempt
+func (dl *contentDenylist) checkPath(ctx context.Context, c cid.Cid, p string, action string, uid uint, remote string) error {
+	src, ok := dl.lookupPath(c, p)
+	if !ok {
+		return nil
+	}
+
+	log.Warnw("blocked by the denylist", "cid", c, "action", action, "source", src, "user", uid, "remote", remote)
+	if err := dl.db.WithContext(ctx).Create(&denylistBlock{
+		Cid:    c.String(),
+		Action: action,
+		Source: src,
+		UserID: uid,
+		Remote: remote,
+	}).Error; err != nil {
+		log.Errorf("failed to record blocked %s of %s: %s", action, c, err)
+	}
+
+	return &util.HttpError{
+		Code:    http.StatusUnavailableForLegalReasons,
+		Reason:  util.ERR_CONTENT_BLOCKED,
+		Details: fmt.Sprintf("%s is blocked by the denylist", c),
+	}
+}
+
+type denylistAnchor struct {
+	Anchor string `json:"anchor"`
+}
+
+// handleShuttleGetDenylist returns the anchors of every list, in the json
+// format of badbits, for shuttles to keep the content off their gateways
+// and bitswap
+func (s *Server) handleShuttleGetDenylist(c echo.Context) error {
+	if !s.estuaryCfg.Denylist.Enabled {
+		return c.JSON(http.StatusOK, []denylistAnchor{})
+	}
+	anchors := s.CM.denylist.anchors()
+	out := make([]denylistAnchor, 0, len(anchors))
+	for _, a := range anchors {
+		out = append(out, denylistAnchor{Anchor: a})
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+func readDenylistSource(ctx context.Context, src string) (*denylist.List, error) {
+	var r io.ReadCloser
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("fetching denylist failed with status %d", resp.StatusCode)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(src)
+		if err != nil {
+			return nil, err
+		}
+		r = f
+	}
+	defer r.Close()
+
+	l := denylist.New()
+	if err := l.Parse(r, src); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// refresh reloads the sources and the operator entries. A source that
+// can't be read keeps the entries it had.
+func (dl *contentDenylist) refresh(ctx context.Context) error {
+	var entries []denylistEntry
+	if err := dl.db.WithContext(ctx).Find(&entries).Error; err != nil {
+		return err
+	}
+	op := denylist.New()
+	for _, e := range entries {
+		if err := op.AddAnchor(e.Anchor, denylistOperator); err != nil {
+			log.Warnf("skipping denylist entry %d: %s", e.ID, err)
+		}
+	}
+	dl.lk.Lock()
+	dl.operator = op
+	dl.lk.Unlock()
+
+	var failed []string
+	for _, src := range dl.cfg.Sources {
+		l, err := readDenylistSource(ctx, src)
+		if err != nil {
+			log.Errorf("failed to load denylist %s: %s", src, err)
+			failed = append(failed, src)
+			continue
+		}
+		dl.lk.Lock()
+		dl.sources[src] = l
+		dl.lk.Unlock()
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to load denylists: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+type denylistEntryBody struct {
+	// Cid or Anchor is listed, anchors as in the badbits format
+	Cid    string `json:"cid"`
+	Anchor string `json:"anchor"`
+	Reason string `json:"reason"`
+}
+
+// handleAdminListDenylist godoc
+// @Summary      List denylist entries
+// @Description  This endpoint lists the content operators have added to the denylist.
+// @Tags         admin
+// @Produce      json
+// @Success      200  {array}  denylistEntry
+// @Router       /admin/denylist [get]
+func (s *Server) handleAdminListDenylist(c echo.Context) error {
+	var entries []denylistEntry
+	if err := s.DB.Order("id desc").Find(&entries).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, entries)
+}
+
+// handleAdminAddDenylist godoc
+// @Summary      Add to the denylist
+// @Description  This endpoint blocks pinning, serving and dealing of a content, by cid or by badbits anchor.
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        body  body      denylistEntryBody  true  "Entry"
+// @Success      200   {object}  denylistEntry
+// @Router       /admin/denylist [post]
+func (s *Server) handleAdminAddDenylist(c echo.Context, u *User) error {
+	var body denylistEntryBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	entry := denylistEntry{Reason: body.Reason, AddedBy: u.ID}
+	l := denylist.New()
+	switch {
+	case body.Cid != "":
+		cc, err := cid.Decode(body.Cid)
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid cid: %s", err),
+			}
+		}
+		entry.Cid = cc.String()
+		entry.Anchor = denylist.Anchor(cc)
+	case body.Anchor != "":
+		if err := l.AddAnchor(body.Anchor, denylistOperator); err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: err.Error(),
+			}
+		}
+		entry.Anchor = strings.ToLower(strings.TrimSpace(body.Anchor))
+	default:
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "a cid or an anchor is required",
+		}
+	}
+
+	if err := s.DB.Where("anchor = ?", entry.Anchor).FirstOrCreate(&entry).Error; err != nil {
+		return err
+	}
+
+	s.CM.denylist.lk.Lock()
+	if err := s.CM.denylist.operator.AddAnchor(entry.Anchor, denylistOperator); err != nil {
+		log.Warnf("skipping denylist entry %d: %s", entry.ID, err)
+	}
+	s.CM.denylist.lk.Unlock()
+	// bitswap stops serving the blocks right away, and so does the cdn
+	s.withheld.Forget()
+	if cc, err := cid.Decode(entry.Cid); err == nil && s.cdn != nil {
+		if err := s.deregisterCDNCid(c.Request().Context(), cc); err != nil {
+			log.Warnf("failed to deregister %s from the cdn: %s", cc, err)
+		}
+	}
+
+	return c.JSON(http.StatusOK, entry)
+}
+
+// handleAdminRemoveDenylist godoc
+// @Summary      Remove from the denylist
+// @Description  This endpoint removes an entry operators added to the denylist. Content listed by a source stays blocked.
+// @Tags         admin
+// @Param        id  path  int  true  "Entry ID"
+// @Router       /admin/denylist/{id} [delete]
+func (s *Server) handleAdminRemoveDenylist(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	var entry denylistEntry
+	if err := s.DB.First(&entry, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("denylist entry %d was not found", id),
+			}
+		}
+		return err
+	}
+	if err := s.DB.Delete(&entry).Error; err != nil {
+		return err
+	}
+
+	// the sources are left as they are
+	if err := s.CM.denylist.refresh(c.Request().Context()); err != nil {
+		log.Warnf("failed to refresh the denylist: %s", err)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// handleAdminListDenylistBlocks godoc
+// @Summary      List blocked attempts
+// @Description  This endpoint returns the audit log of pins, retrievals and deals the denylist blocked, newest first.
+// @Tags         admin
+// @Produce      json
+// @Param        limit  query     int  false  "Limit (default 100)"
+// @Success      200    {array}   denylistBlock
+// @Router       /admin/denylist/blocks [get]
+func (s *Server) handleAdminListDenylistBlocks(c echo.Context) error {
+	limit := 100
+	if l := c.QueryParam("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_QUERY_PARAM_VALUE,
+				Details: "limit must be a positive number",
+			}
+		}
+		limit = n
+	}
+
+	var blocks []denylistBlock
+	if err := s.DB.Order("id desc").Limit(limit).Find(&blocks).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, blocks)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/dagdiff"
+	"github.com/ipfs/go-blockservice"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// blockDelta counts the blocks, and their bytes, that content to has and
+// content from doesn't, by cid
+func blockDelta(ctx context.Context, db *gorm.DB, from, to uint) (int, int64, error) {
+	var res struct {
+		Blocks int
+		Bytes  int64
+	}
+	err := db.WithContext(ctx).Raw(`SELECT COUNT(1) AS blocks, COALESCE(SUM(size), 0) AS bytes FROM (
+		SELECT objects.cid, MAX(objects.size) AS size FROM obj_refs JOIN objects ON objects.id = obj_refs.object
+		WHERE obj_refs.content = ? AND objects.cid NOT IN (
+			SELECT objects.cid FROM obj_refs JOIN objects ON objects.id = obj_refs.object WHERE obj_refs.content = ?)
+		GROUP BY objects.cid) AS delta`, to, from).Scan(&res).Error
+	return res.Blocks, res.Bytes, err
+}
+
+// handleGetContentDiff godoc
+// @Summary      Compare two contents
+// @Description  This endpoint compares the DAG of a content with the one of another, eg. two versions of a dataset. It lists the files that were added, removed or changed with how many bytes they grew by, and counts the blocks only one of them has. Both have to be stored on the same node, contents on a shuttle are redirected to the shuttle.
+// @Tags         content
+// @Produce      json
+// @Param        id   path      int  true  "Content ID to compare from"
+// @Param        to   path      int  true  "Content ID to compare to"
+// @Success      200  {object}  dagdiff.Diff
+// @Router       /content/{id}/diff/{to} [get]
+func (s *Server) handleGetContentDiff(c echo.Context, u *User) error {
+	from, err := s.getOwnContent(c, u)
+	if err != nil {
+		return err
+	}
+	toID, err := strconv.Atoi(c.Param("to"))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid content id: %s", c.Param("to")),
+		}
+	}
+	to, err := s.getOwnContentByID(u, toID)
+	if err != nil {
+		return err
+	}
+
+	for _, cont := range []*util.Content{from, to} {
+		if cont.Offloaded {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("content %d was offloaded", cont.ID),
+			}
+		}
+	}
+	if from.Location != to.Location {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("content %d is stored on %s and content %d on %s, only contents stored on the same node can be compared", from.ID, from.Location, to.ID, to.Location),
+		}
+	}
+
+	if from.Location != constants.ContentLocationLocal {
+		host := s.CM.shuttleHostName(from.Location)
+		if host == "" || !s.CM.shuttleIsOnline(from.Location) {
+			return &util.HttpError{
+				Code:    http.StatusServiceUnavailable,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("the shuttle content %d is on is offline", from.ID),
+			}
+		}
+		return c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("https://%s/content/diff/%d/%d", host, from.ID, to.ID))
+	}
+
+	dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, offline.Exchange(s.Node.Blockstore)))
+	ctx := c.Request().Context()
+	diff, err := dagdiff.Compare(ctx, dserv, from.Cid.CID, to.Cid.CID, dagdiff.Options{})
+	if err != nil {
+		return err
+	}
+	if diff.BlocksAdded, diff.BytesAdded, err = blockDelta(ctx, s.DB, from.ID, to.ID); err != nil {
+		return err
+	}
+	if diff.BlocksRemoved, diff.BytesRemoved, err = blockDelta(ctx, s.DB, to.ID, from.ID); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, diff)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/labstack/echo/v4"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/util"
+)
+
+const defaultDrainDeadline = time.Minute * 30
+
+type drainBody struct {
+	// Deadline is how long to wait for in flight work, eg 30m
+	Deadline string `json:"deadline"`
+	// Exit shuts the node down once drained
+	Exit bool `json:"exit"`
+}
+
+// handleAdminDrain godoc
+// @Summary      Drain the node
+// @Description  This endpoint starts draining the node ahead of maintenance. New uploads and pins are refused, deal making is stopped, and queued deal proposals, in flight pins and data transfers are given until the deadline to finish. Queued pins are resumed when the node starts again. With exit set the node shuts down once drained.
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        body  body  drainBody  true  "Drain options"
+// @Success      202  {object}  util.DrainStatus
+// @Router       /admin/drain [post]
+func (s *Server) handleAdminDrain(c echo.Context) error {
+	var body drainBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	deadline := defaultDrainDeadline
+	if body.Deadline != "" {
+		d, err := time.ParseDuration(body.Deadline)
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: "invalid deadline: " + err.Error(),
+			}
+		}
+		deadline = d
+	}
+
+	ctx, cancel, err := s.drain.Begin(deadline)
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusConflict,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+
+	go func() {
+		defer cancel()
+		s.drain.Finish(s.runDrain(ctx))
+
+		// once the api server is down ServeAPI returns, and the deferred
+		// closes of the queue store, buffered blocks and libp2p host run on the
+		// way out
+		if body.Exit {
+			s.drain.SetPhase("shutting down")
+			if err := s.shutdownAPI(); err != nil {
+				log.Errorf("failed to shut down api server: %s", err)
+			}
+		}
+	}()
+
+	return c.JSON(http.StatusAccepted, s.drain.Status())
+}
+
+// handleAdminDrainStatus godoc
+// @Summary      Get drain progress
+// @Description  This endpoint returns whether the node is draining and which phase the drain is in.
+// @Tags         admin
+// @Produce      json
+// @Success      200  {object}  util.DrainStatus
+// @Router       /admin/drain [get]
+func (s *Server) handleAdminDrainStatus(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.drain.Status())
+}
+
+// runDrain stops the node from taking on new work and waits for the work in
+// flight to finish. Intake is already being refused by the time it runs.
+func (s *Server) runDrain(ctx context.Context) error {
+	s.drain.SetPhase("stopping deal making")
+	s.CM.setDealMakingEnabled(false)
+
+	// proposals already queued still go out, their transfers are waited
+	// for below
+	if s.CM.proposals != nil {
+		if err := s.drain.Wait(ctx, "waiting for deal proposals", func() (bool, error) {
+			return s.CM.proposals.Pending() == 0, nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	s.drain.SetPhase("waiting for pins")
+	if err := s.CM.pinMgr.Drain(ctx); err != nil {
+		return err
+	}
+
+	if err := s.drain.Wait(ctx, "waiting for data transfers", func() (bool, error) {
+		txs, err := s.FilClient.TransfersInProgress(ctx)
+		if err != nil {
+			return false, err
+		}
+		for _, xfer := range txs {
+			if xfer.Status == datatransfer.Ongoing {
+				return false, nil
+			}
+		}
+		return true, nil
+	}); err != nil {
+		return err
+	}
+
+	// with a queue store the queue is written out and restored as is on
+	// startup, otherwise the contents of queued pins are still marked as
+	// pinning along with their origins, so refreshPinQueue picks them back up
+	s.drain.SetPhase("checkpointing queues")
+	queued, ok, err := s.CM.pinMgr.Checkpoint()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		var count int64
+		if err := s.DB.Model(&util.Content{}).
+			Where("pinning and not active and not failed and location = ?", constants.ContentLocationLocal).
+			Count(&count).Error; err != nil {
+			return err
+		}
+		queued = int(count)
+	}
+	log.Infof("drain: %d queued pins will be resumed on restart", queued)
+	return nil
+}
+
+func (s *Server) shutdownAPI() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	err := s.echo.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return s.echo.Close()
+	}
+	return err
+}
@@ -1,7 +1,13 @@
 package drpc
 
 import (
+	"time"
+
 	"github.com/application-research/estuary/pinner/types"
+	"github.com/application-research/estuary/util/audit"
+	"github.com/application-research/estuary/util/bwlimit"
+	"github.com/application-research/estuary/util/dagstat"
+	"github.com/application-research/estuary/util/fetchstats"
 	"github.com/application-research/filclient"
 	"github.com/filecoin-project/go-address"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
@@ -25,6 +31,8 @@ type Command struct {
 	Op           string
 	Params       CmdParams
 	TraceCarrier *TraceCarrier `json:",omitempty"`
+	// RequestID is the id of the api request the command was sent for
+	RequestID string `json:",omitempty"`
 }
 
 // HasTraceCarrier returns true iff Command `c` contains a trace.
@@ -45,6 +53,12 @@ type CmdParams struct {
 	RetrieveContent        *RetrieveContent        `json:",omitempty"`
 	UnpinContent           *UnpinContent           `json:",omitempty"`
 	RestartTransfer        *RestartTransfer        `json:",omitempty"`
+	SetBandwidthLimits     *SetBandwidthLimits     `json:",omitempty"`
+	AuditContent           *AuditContent           `json:",omitempty"`
+	RepairContent          *RepairContent          `json:",omitempty"`
+	SetContentPrivate      *SetContentPrivate      `json:",omitempty"`
+	WarmContent            *WarmContent            `json:",omitempty"`
+	ScanContent            *ScanContent            `json:",omitempty"`
 }
 
 const CMD_ComputeCommP = "ComputeCommP"
@@ -60,6 +74,7 @@ type AddPin struct {
 	UserId uint
 	Cid    cid.Cid
 	Peers  []*peer.AddrInfo
+	Meta   string
 }
 
 const CMD_TakeContent = "TakeContent"
@@ -67,6 +82,9 @@ const CMD_TakeContent = "TakeContent"
 type TakeContent struct {
 	Contents []ContentFetch
 	Sources  []peer.AddrInfo
+	// SourceURLs are the gateways of the sources, the content is streamed
+	// from them as cars when they can be reached
+	SourceURLs []string
 }
 
 const CMD_AggregateContent = "AggregateContent"
@@ -129,6 +147,7 @@ type StorageDeal struct {
 
 type RetrieveContent struct {
 	Content uint
+	UserID  uint
 	Cid     cid.Cid
 	Deals   []StorageDeal
 }
@@ -145,10 +164,74 @@ type RestartTransfer struct {
 	ChanID datatransfer.ChannelID
 }
 
+const CMD_SetBandwidthLimits = "SetBandwidthLimits"
+
+type SetBandwidthLimits struct {
+	Limits bwlimit.Limits
+}
+
+const CMD_AuditContent = "AuditContent"
+
+// AuditContent asks for the blocks sampled from contents to be checked,
+// the shuttle answers with an AuditResult
+type AuditContent struct {
+	Audits []ContentAudit
+}
+
+type ContentAudit struct {
+	Content uint
+	// Root is the cid of the content, the blocks are checked against the
+	// CAR index of it when there is one
+	Root   cid.Cid
+	Blocks []audit.Block
+}
+
+const CMD_RepairContent = "RepairContent"
+
+// RepairContent asks for the blocks a content failed its audit on to be
+// fetched again, from Peers or whoever provides them and otherwise by
+// retrieving Root from Deals. Root is the content or the aggregate it is
+// in, whichever the deals were made for. A RepairFailed is sent back when
+// neither works.
+type RepairContent struct {
+	Content  uint
+	Problems []audit.Problem
+	Peers    []*peer.AddrInfo
+	Root     cid.Cid
+	Deals    []StorageDeal
+}
+
+const CMD_SetContentPrivate = "SetContentPrivate"
+
+// SetContentPrivate makes contents private, so their blocks are neither
+// served over bitswap nor announced, or public again
+type SetContentPrivate struct {
+	Contents []uint
+	Private  bool
+}
+
+const CMD_WarmContent = "WarmContent"
+
+// WarmContent asks for the blocks of hot contents to be read into the
+// block cache, hottest first, so the gateway serves them from memory
+type WarmContent struct {
+	Contents []uint
+}
+
+const CMD_ScanContent = "ScanContent"
+
+// ScanContent asks for a content pinned on the shuttle to be scanned there,
+// the verdict comes back as a ScanResult
+type ScanContent struct {
+	Content uint
+	Cid     cid.Cid
+}
+
 type ContentFetch struct {
-	ID     uint
-	Cid    cid.Cid
-	UserID uint
+	ID      uint
+	Cid     cid.Cid
+	UserID  uint
+	Private bool
 }
 
 type Message struct {
@@ -156,6 +239,8 @@ type Message struct {
 	Params       MsgParams
 	TraceCarrier *TraceCarrier `json:",omitempty"`
 	Handle       string
+	// RequestID is the id of the api request the message relates to
+	RequestID string `json:",omitempty"`
 }
 
 // HasTraceCarrier returns true iff Message `m` contains a trace.
@@ -172,6 +257,13 @@ type MsgParams struct {
 	ShuttleUpdate   *ShuttleUpdate   `json:",omitempty"`
 	GarbageCheck    *GarbageCheck    `json:",omitempty"`
 	SplitComplete   *SplitComplete   `json:",omitempty"`
+	PinFetchStats   *PinFetchStats   `json:",omitempty"`
+	AuditResult     *AuditResult     `json:",omitempty"`
+	RetrieveFailed  *RetrieveFailed  `json:",omitempty"`
+	RepairFailed    *RepairFailed    `json:",omitempty"`
+	DagStat         *DagStat         `json:",omitempty"`
+	RetrievalResult *RetrievalResult `json:",omitempty"`
+	ScanResult      *ScanResult      `json:",omitempty"`
 }
 
 const OP_UpdatePinStatus = "UpdatePinStatus"
@@ -179,6 +271,9 @@ const OP_UpdatePinStatus = "UpdatePinStatus"
 type UpdatePinStatus struct {
 	DBID   uint
 	Status types.PinningStatus
+	// Reason is why a failed pin failed, when there is more to say than the
+	// status does
+	Reason string
 }
 
 type PinObj struct {
@@ -230,6 +325,17 @@ type ShuttleUpdate struct {
 	BlockstoreFree uint64
 	NumPins        int64
 	PinQueueSize   int
+	// Draining is set once the shuttle is being drained for maintenance and
+	// should not be given new content
+	Draining bool
+	// IntakePaused is set while the shuttle is so low on disk space that it
+	// refuses new pins
+	IntakePaused bool
+	// IngestBytes and EgressBytes are what the shuttle received and sent,
+	// over libp2p and http, since it started at StartedAt
+	IngestBytes uint64
+	EgressBytes uint64
+	StartedAt   time.Time
 }
 
 const OP_GarbageCheck = "GarbageCheck"
@@ -243,3 +349,81 @@ const OP_SplitComplete = "SplitComplete"
 type SplitComplete struct {
 	ID uint
 }
+
+const OP_PinFetchStats = "PinFetchStats"
+
+// PinFetchStats reports how the blocks of a pin were fetched, it is sent
+// once the fetch is over whether or not it succeeded
+type PinFetchStats struct {
+	DBID  uint
+	Stats *fetchstats.Stats
+}
+
+const OP_AuditResult = "AuditResult"
+
+// AuditResult is how the blocks an AuditContent asked about held up.
+// Nothing is deleted until a RepairContent asks for the blocks to be
+// fetched again.
+type AuditResult struct {
+	Results []audit.Result
+}
+
+const OP_RetrieveFailed = "RetrieveFailed"
+
+// RetrieveFailed is sent when a RetrieveContent could not get the content
+// back from any of its deals
+type RetrieveFailed struct {
+	Content uint
+	Reason  string
+}
+
+const OP_RepairFailed = "RepairFailed"
+
+// RepairFailed is sent when the blocks of a RepairContent could be fetched
+// neither from peers nor from deals
+type RepairFailed struct {
+	Content uint
+	Reason  string
+}
+
+const OP_RetrievalResult = "RetrievalResult"
+
+// RetrievalResult is how a retrieval from a storage provider went, for its
+// reputation. Phase and Error are set when it failed, the stats when it
+// succeeded.
+type RetrievalResult struct {
+	Content uint
+	Cid     cid.Cid
+	Miner   string
+
+	Phase string
+	Error string
+
+	Peer         string
+	Size         uint64
+	DurationMs   int64
+	AverageSpeed uint64
+	TotalPayment string
+	NumPayments  int
+	AskPrice     string
+}
+
+const OP_ScanResult = "ScanResult"
+
+// ScanResult is the verdict of the scanner on a content, or why it couldn't
+// be scanned
+type ScanResult struct {
+	Content uint
+	Flagged bool
+	Reason  string
+	Error   string
+}
+
+const OP_DagStat = "DagStat"
+
+// DagStat is the stat of the DAG of a content, sent once a shuttle
+// computed it so the primary keeps it
+type DagStat struct {
+	Content uint
+	Stat    dagstat.Stat
+}
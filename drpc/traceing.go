@@ -1,6 +1,7 @@
 package drpc
 
 import (
+	"encoding/hex"
 	"encoding/json"
 
 	"go.opentelemetry.io/otel/trace"
@@ -17,9 +18,10 @@ Context: https://github.com/open-telemetry/opentelemetry-go/issues/1927#issuecom
 func NewTraceCarrier(sc trace.SpanContext) *TraceCarrier {
 	if sc.IsValid() {
 		return &TraceCarrier{
-			TraceID: sc.TraceID(),
-			SpanID:  sc.SpanID(),
-			Remote:  sc.IsRemote(),
+			TraceID:    sc.TraceID(),
+			SpanID:     sc.SpanID(),
+			TraceFlags: sc.TraceFlags(),
+			Remote:     sc.IsRemote(),
 		}
 	}
 	return nil
@@ -27,9 +29,10 @@ func NewTraceCarrier(sc trace.SpanContext) *TraceCarrier {
 
 // TraceCarrier is a wrapper that allows trace.SpanContext's to be round-tripped through JSON.
 type TraceCarrier struct {
-	TraceID trace.TraceID `json:"traceID"`
-	SpanID  trace.SpanID  `json:"spanID"`
-	Remote  bool          `json:"remote"`
+	TraceID    trace.TraceID    `json:"traceID"`
+	SpanID     trace.SpanID     `json:"spanID"`
+	TraceFlags trace.TraceFlags `json:"traceFlags"`
+	Remote     bool             `json:"remote"`
 }
 
 //MarshalJSON converts TraceCarrier to a trace.SpanContext and marshals it to JSON.
@@ -54,21 +57,34 @@ func (c *TraceCarrier) UnmarshalJSON(b []byte) error {
 	}
 	c.Remote = data.Remote
 
+	// older peers do not send flags, in which case the trace is treated as unsampled
+	if data.TraceFlags != "" {
+		flags, err := hex.DecodeString(data.TraceFlags)
+		if err != nil {
+			return err
+		}
+		if len(flags) == 1 {
+			c.TraceFlags = trace.TraceFlags(flags[0])
+		}
+	}
+
 	return nil
 }
 
 // AsSpanContext converts TraceCarrier to a trace.SpanContext.
 func (c *TraceCarrier) AsSpanContext() trace.SpanContext {
 	return trace.NewSpanContext(trace.SpanContextConfig{
-		TraceID: c.TraceID,
-		SpanID:  c.SpanID,
-		Remote:  c.Remote,
+		TraceID:    c.TraceID,
+		SpanID:     c.SpanID,
+		TraceFlags: c.TraceFlags,
+		Remote:     c.Remote,
 	})
 }
 
 // carrierInfo is a helper used to deserialize a SpanContext from JSON.
 type traceCarrierInfo struct {
-	TraceID string
-	SpanID  string
-	Remote  bool
+	TraceID    string
+	SpanID     string
+	TraceFlags string
+	Remote     bool
 }
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// egress totals of users are reloaded from the database at most this often
+const egressTotalsRefresh = time.Minute
+
+// who the retrievals of a cid are counted against is looked up at most this
+// often, for this many cids
+const (
+	egressLookupTTL      = time.Minute
+	egressLookupsTracked = 10000
+)
+
+// egressRecord is how many bytes counted against a user were served in
+// an hour
+type egressRecord struct {
+	ID     uint      `gorm:"primarykey" json:"-"`
+	UserID uint      `gorm:"uniqueIndex:idx_egress_hour" json:"-"`
+	Hour   time.Time `gorm:"uniqueIndex:idx_egress_hour" json:"hour"`
+	Bytes  int64     `json:"bytes"`
+}
+
+// orgEgressRecord is how many bytes of the content of a user in the
+// collections of an organization were served in an hour. They count against
+// the plan of the user, but are billed to the organization.
+type orgEgressRecord struct {
+	ID     uint      `gorm:"primarykey"`
+	OrgID  uint      `gorm:"uniqueIndex:idx_org_egress_hour"`
+	UserID uint      `gorm:"uniqueIndex:idx_org_egress_hour"`
+	Hour   time.Time `gorm:"uniqueIndex:idx_org_egress_hour"`
+	Bytes  int64
+}
+
+type egressKey struct {
+	user uint
+	org  uint
+	hour time.Time
+}
+
+type egressTotals struct {
+	plan   string
+	day    int64
+	month  int64
+	loaded time.Time
+}
+
+// egressMeter counts bytes served in memory, and adds them to the egress
+// records of their users when flushed
+type egressMeter struct {
+	db *gorm.DB
+
+	lk      sync.Mutex
+	pending map[egressKey]int64
+	totals  map[uint]*egressTotals
+
+	// lookups caches the owners of content, by cid and requesting user
+	lookups *lru.Cache
+}
+
+// egressLookup is who the retrievals of a cid were found to be counted
+// against
+type egressLookup struct {
+	user   uint
+	org    uint
+	loaded time.Time
+}
+
+func newEgressMeter(db *gorm.DB) (*egressMeter, error) {
+	lookups, err := lru.New(egressLookupsTracked)
+	if err != nil {
+		return nil, err
+	}
+	return &egressMeter{
+		db:      db,
+		pending: make(map[egressKey]int64),
+		totals:  make(map[uint]*egressTotals),
+		lookups: lookups,
+	}, nil
+}
+
+func (m *egressMeter) add(uid, org uint, n int64) {
+	if n <= 0 {
+		return
+	}
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.pending[egressKey{user: uid, org: org, hour: time.Now().UTC().Truncate(time.Hour)}] += n
+}
+
+func (m *egressMeter) flush(ctx context.Context) error {
+	m.lk.Lock()
+	pending := m.pending
+	m.pending = make(map[egressKey]int64)
+	m.lk.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	users := make(map[egressKey]int64)
+	var orgRecs []orgEgressRecord
+	for k, n := range pending {
+		users[egressKey{user: k.user, hour: k.hour}] += n
+		if k.org > 0 {
+			orgRecs = append(orgRecs, orgEgressRecord{OrgID: k.org, UserID: k.user, Hour: k.hour, Bytes: n})
+		}
+	}
+	recs := make([]egressRecord, 0, len(users))
+	for k, n := range users {
+		recs = append(recs, egressRecord{UserID: k.user, Hour: k.hour, Bytes: n})
+	}
+	err := m.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_id"}, {Name: "hour"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{"bytes": gorm.Expr("egress_records.bytes + excluded.bytes")}),
+		}).CreateInBatches(recs, 500).Error; err != nil {
+			return err
+		}
+		if len(orgRecs) == 0 {
+			return nil
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "org_id"}, {Name: "user_id"}, {Name: "hour"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{"bytes": gorm.Expr("org_egress_records.bytes + excluded.bytes")}),
+		}).CreateInBatches(orgRecs, 500).Error
+	})
+
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	if err != nil {
+		// keep the counts for the next flush
+		for k, n := range pending {
+			m.pending[k] += n
+		}
+		return err
+	}
+	m.totals = make(map[uint]*egressTotals)
+	return nil
+}
+
+// served returns the plan of a user and how many bytes of their content
+// were served today and this month
+func (m *egressMeter) served(ctx context.Context, uid uint) (string, int64, int64, error) {
+	now := time.Now().UTC()
+	day := now.Truncate(time.Hour * 24)
+	month := monthStart(now)
+
+	m.lk.Lock()
+	t, ok := m.totals[uid]
+	m.lk.Unlock()
+
+	if !ok || time.Since(t.loaded) > egressTotalsRefresh || t.loaded.Before(day) {
+		t = &egressTotals{loaded: time.Now()}
+
+		var u User
+		if err := m.db.WithContext(ctx).Select("id, plan").First(&u, "id = ?", uid).Error; err != nil {
+			return "", 0, 0, err
+		}
+		t.plan = u.Plan
+
+		if err := m.db.WithContext(ctx).Model(&egressRecord{}).
+			Select("COALESCE(SUM(CASE WHEN hour >= ? THEN bytes ELSE 0 END), 0), COALESCE(SUM(bytes), 0)", day).
+			Where("user_id = ? AND hour >= ?", uid, month).
+			Row().Scan(&t.day, &t.month); err != nil {
+			return "", 0, 0, err
+		}
+
+		m.lk.Lock()
+		m.totals[uid] = t
+		m.lk.Unlock()
+	}
+
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	dayBytes, monthBytes := t.day, t.month
+	for k, n := range m.pending {
+		if k.user != uid || k.hour.Before(month) {
+			continue
+		}
+		monthBytes += n
+		if !k.hour.Before(day) {
+			dayBytes += n
+		}
+	}
+	return t.plan, dayBytes, monthBytes, nil
+}
+
+// checkEgress turns away requests for the content of a user over the caps
+// of their plan
+func (s *Server) checkEgress(c echo.Context, uid uint) error {
+	name, day, month, err := s.egress.served(c.Request().Context(), uid)
+	if err != nil {
+		return err
+	}
+	plan := s.estuaryCfg.Egress.Plan(name)
+
+	now := time.Now().UTC()
+	if plan.MonthlyBytes > 0 && month >= plan.MonthlyBytes {
+		return util.PaymentRequired(c, util.ERR_EGRESS_LIMIT,
+			util.LimitInfo{Limit: plan.MonthlyBytes, Reset: monthStart(now).AddDate(0, 1, 0).Sub(now)},
+			fmt.Sprintf("the %d bytes of the %s plan for this month were served", plan.MonthlyBytes, plan.Name))
+	}
+	if plan.DailyBytes > 0 && day >= plan.DailyBytes {
+		return util.TooManyRequests(c, util.ERR_EGRESS_LIMIT,
+			util.LimitInfo{Limit: plan.DailyBytes, Reset: now.Truncate(time.Hour * 24).Add(time.Hour * 24).Sub(now)},
+			fmt.Sprintf("the %d bytes of the %s plan for today were served", plan.DailyBytes, plan.Name))
+	}
+	return nil
+}
+
+// meterEgress serves the content of a user with serve, if they are under
+// their caps, and counts the bytes it wrote against them, and the org the
+// content is billed to if there is one
+func (s *Server) meterEgress(c echo.Context, uid, org uint, serve func() error) error {
+	if s.egress == nil || uid == 0 {
+		return serve()
+	}
+	if err := s.checkEgress(c, uid); err != nil {
+		return err
+	}
+
+	// counted on the way out, responses cut off half way included
+	before := c.Response().Size
+	defer func() {
+		s.egress.add(uid, org, c.Response().Size-before)
+	}()
+	return serve()
+}
+
+// contentOwner returns the user who first pinned a cid that is still
+// pinned, 0 if none, and the org that content is billed to. With a user, it
+// looks for content of that user only.
+func (s *Server) contentOwner(ctx context.Context, c cid.Cid, uid uint) (uint, uint, error) {
+	key := fmt.Sprintf("%s|%d", c, uid)
+	if v, ok := s.egress.lookups.Get(key); ok {
+		if l := v.(*egressLookup); time.Since(l.loaded) < egressLookupTTL {
+			return l.user, l.org, nil
+		}
+	}
+
+	l := &egressLookup{user: uid, loaded: time.Now()}
+	q := s.DB.WithContext(ctx).Select("id, user_id").Order("id").Where("cid = ? AND active", util.DbCID{CID: c})
+	if uid > 0 {
+		q = q.Where("user_id = ?", uid)
+	}
+	var cont util.Content
+	err := q.First(&cont).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+	case err != nil:
+		return 0, 0, err
+	default:
+		l.user = cont.UserID
+		l.org, err = s.contentOrg(ctx, cont.ID)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	s.egress.lookups.Add(key, l)
+	return l.user, l.org, nil
+}
+
+// egressAccount returns who the bytes of a gateway retrieval of cc are
+// counted against: the user of the api key auth the request came with, or
+// the owner of private content retrieved with an access token, which they
+// handed out. Anonymous retrievals of public content are not counted
+// against anyone, so that no one can use up the caps of someone else.
+func (s *Server) egressAccount(ctx context.Context, cc cid.Cid, auth string, private bool) (uint, uint, error) {
+	if s.egress == nil {
+		return 0, 0, nil
+	}
+	if auth != "" {
+		if u, err := s.checkTokenAuth(auth); err == nil {
+			return s.contentOwner(ctx, cc, u.ID)
+		}
+	}
+	if private {
+		return s.contentOwner(ctx, cc, 0)
+	}
+	return 0, 0, nil
+}
+
+type egressResponse struct {
+	Plan    config.EgressPlan `json:"plan"`
+	Today   int64             `json:"today"`
+	Month   int64             `json:"month"`
+	History []egressRecord    `json:"history"`
+}
+
+// handleGetUserEgress godoc
+// @Summary      Get bytes served of the user's content
+// @Description  This endpoint returns the egress plan of the user, how many bytes were served on their account today and this month, and hourly counts.
+// @Tags         User
+// @Produce      json
+// @Param        begin     query     string  false  "Start of the range (2006-01-02T15:04), defaults to 7 days ago"
+// @Param        duration  query     string  false  "Length of the range, eg 24h"
+// @Success      200       {object}  egressResponse
+// @Router       /user/egress [get]
+func (s *Server) handleGetUserEgress(c echo.Context, u *User) error {
+	if s.egress == nil {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "egress is not metered on this node",
+		}
+	}
+
+	begin := time.Now().Add(-time.Hour * 24 * 7)
+	end := time.Now()
+	if beg := c.QueryParam("begin"); beg != "" {
+		ts, err := time.Parse("2006-01-02T15:04", beg)
+		if err != nil {
+			return err
+		}
+		begin = ts
+	}
+	if dur := c.QueryParam("duration"); dur != "" {
+		d, err := time.ParseDuration(dur)
+		if err != nil {
+			return err
+		}
+		end = begin.Add(d)
+	}
+
+	name, day, month, err := s.egress.served(c.Request().Context(), u.ID)
+	if err != nil {
+		return err
+	}
+
+	resp := &egressResponse{
+		Plan:    s.estuaryCfg.Egress.Plan(name),
+		Today:   day,
+		Month:   month,
+		History: []egressRecord{},
+	}
+	if err := util.ReadReplica(s.DB).Order("hour").
+		Find(&resp.History, "user_id = ? AND hour >= ? AND hour <= ?", u.ID, begin, end).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+type userPlanBody struct {
+	Plan string `json:"plan"`
+}
+
+// handleAdminSetUserPlan godoc
+// @Summary      Set the egress plan of a user
+// @Description  This endpoint puts a user on one of the configured egress plans, or back on the default plan with an empty plan.
+// @Tags         admin
+// @Accept       json
+// @Param        id    path  int           true  "User ID"
+// @Param        body  body  userPlanBody  true  "Plan"
+// @Router       /admin/users/{id}/plan [put]
+func (s *Server) handleAdminSetUserPlan(c echo.Context) error {
+	uid, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "user id must be a number",
+		}
+	}
+
+	var body userPlanBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if body.Plan != "" {
+		found := false
+		for _, p := range s.estuaryCfg.Egress.Plans {
+			found = found || p.Name == body.Plan
+		}
+		if !found {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("there is no plan %q", body.Plan),
+			}
+		}
+	}
+
+	res := s.DB.Model(&User{}).Where("id = ?", uid).Update("plan", body.Plan)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_USER_NOT_FOUND,
+			Details: fmt.Sprintf("user %d does not exist", uid),
+		}
+	}
+	if s.egress != nil {
+		s.egress.lk.Lock()
+		delete(s.egress.totals, uint(uid))
+		s.egress.lk.Unlock()
+	}
+	return c.NoContent(http.StatusOK)
+}
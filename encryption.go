@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/encrypt"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-merkledag"
+	uio "github.com/ipfs/go-unixfs/io"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const encryptionKeyHeader = encrypt.Header
+
+// encryptedContent is content that was encrypted at upload, with a key of
+// its own wrapped with the key of the user
+type encryptedContent struct {
+	ContentID  uint `gorm:"primarykey"`
+	CreatedAt  time.Time
+	WrappedKey []byte
+	// Size is the size of the plaintext
+	Size int64
+}
+
+// encryptionKey returns the key a request carries, nil when it carries none
+func (s *Server) encryptionKey(c echo.Context) ([]byte, error) {
+	hv := c.Request().Header.Get(encryptionKeyHeader)
+	if hv == "" {
+		return nil, nil
+	}
+	if !s.estuaryCfg.Encryption.Enabled {
+		return nil, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "content encryption is not enabled on this node",
+		}
+	}
+
+	key, err := encrypt.ParseKey(hv)
+	if err != nil {
+		return nil, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid %s: %s", encryptionKeyHeader, err),
+		}
+	}
+	return key, nil
+}
+
+// createContent tracks a new content along with the key it was encrypted
+// with when enc is set, in one transaction, so encrypted content is never
+// tracked without its key
+func (cm *ContentManager) createContent(ctx context.Context, content *util.Content, enc *util.ContentEncryption) error {
+	return cm.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(content).Error; err != nil {
+			return err
+		}
+		if enc == nil {
+			return nil
+		}
+		return tx.Create(&encryptedContent{
+			ContentID:  content.ID,
+			WrappedKey: enc.WrappedKey,
+			Size:       enc.Size,
+		}).Error
+	})
+}
+
+// handleDecryptContent godoc
+// @Summary      Download decrypted content
+// @Description  This endpoint serves content that was encrypted at upload, decrypted with the key it was uploaded with, passed in the X-Estuary-Encryption-Key header.
+// @Tags         content
+// @Produce      octet-stream
+// @Param        id                        path    int     true  "Content ID"
+// @Param        X-Estuary-Encryption-Key  header  string  true  "Base64 encryption key"
+// @Router       /content/{id}/decrypt [get]
+func (s *Server) handleDecryptContent(c echo.Context, u *User) error {
+	content, err := s.getOwnContent(c, u)
+	if err != nil {
+		return err
+	}
+
+	if err := s.CM.denylist.check(c.Request().Context(), content.Cid.CID, denyServe, u.ID, c.RealIP()); err != nil {
+		return err
+	}
+
+	var enc encryptedContent
+	if err := s.DB.First(&enc, "content_id = ?", content.ID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("content %d is not encrypted", content.ID),
+			}
+		}
+		return err
+	}
+
+	kek, err := s.encryptionKey(c)
+	if err != nil {
+		return err
+	}
+	if kek == nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("the %s header is required", encryptionKeyHeader),
+		}
+	}
+	key, err := encrypt.UnwrapKey(kek, enc.WrappedKey)
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  util.ERR_NOT_AUTHORIZED,
+			Details: "the key is not the one the content was encrypted with",
+		}
+	}
+
+	// content that is on a shuttle is fetched from it
+	ctx := c.Request().Context()
+	dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, s.Node.Bitswap))
+	nd, err := dserv.Get(ctx, content.Cid.CID)
+	if err != nil {
+		return err
+	}
+	dr, err := uio.NewDagReader(ctx, nd, dserv)
+	if err != nil {
+		return err
+	}
+	plain, err := encrypt.Decrypt(dr, key)
+	if err != nil {
+		return err
+	}
+
+	org, err := s.contentOrg(ctx, content.ID)
+	if err != nil {
+		return err
+	}
+
+	h := c.Response().Header()
+	h.Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", content.Name))
+	h.Set(echo.HeaderContentLength, strconv.FormatInt(enc.Size, 10))
+	return s.meterEgress(c, u.ID, org, func() error {
+		// a failure half way through can only cut the response short
+		return c.Stream(http.StatusOK, echo.MIMEOctetStream, plain)
+	})
+}
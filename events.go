@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/eventstream"
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	eventContentAdded   = "content.added"
+	eventContentPinned  = "content.pinned"
+	eventDealMade       = "deal.made"
+	eventDealFailed     = "deal.failed"
+	eventContentDeleted = "content.deleted"
+	eventPinStalled     = "pin.stalled"
+	eventOffloaded      = "content.offloaded"
+)
+
+const (
+	defaultEventsLimit = 100
+	maxEventsLimit     = 1000
+)
+
+// eventSettleDelay holds back the newest events from consumers. Ids are
+// handed out when a row is inserted but rows become visible when their
+// transaction commits, so a consumer that read right up to the newest event
+// could move its cursor past an event with a lower id that was still being
+// committed.
+const eventSettleDelay = time.Second * 2
+
+// contentEvent is an entry in the append only log of changes to contents,
+// consumers page through it by id so they don't have to poll whole tables
+// to find out what changed
+type contentEvent struct {
+	ID        uint      `gorm:"primarykey"`
+	CreatedAt time.Time `gorm:"index"`
+	Type      string    `gorm:"index"`
+	Content   uint      `gorm:"index"`
+	UserID    uint      `gorm:"index"`
+	Cid       util.DbCID
+	Data      string
+}
+
+type contentEventResponse struct {
+	ID        uint            `json:"id"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Type      string          `json:"type"`
+	Content   uint            `json:"content"`
+	UserID    uint            `json:"userId"`
+	Cid       util.DbCID      `json:"cid"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+type contentEventsResponse struct {
+	Events []contentEventResponse `json:"events"`
+	// Cursor is passed back on the next request to get the events that
+	// follow, it stays the same when there are no new events
+	Cursor uint `json:"cursor"`
+}
+
+// recordContentEvent appends an event for a content to the log and hands it
+// to the event stream if one is configured, the user and cid are taken from
+// the content row. The log is best effort, failing to record an event never
+// fails the operation it describes.
+func (cm *ContentManager) recordContentEvent(ctx context.Context, typ string, contID uint, data map[string]interface{}) {
+	var dstr string
+	if len(data) > 0 {
+		b, err := json.Marshal(data)
+		if err != nil {
+			log.Errorf("failed to encode %s event data for content %d: %s", typ, contID, err)
+			return
+		}
+		dstr = string(b)
+	}
+
+	// deleted contents still get their event
+	var cont util.Content
+	if err := cm.DB.WithContext(ctx).Unscoped().Select("id", "user_id", "cid").First(&cont, "id = ?", contID).Error; err != nil {
+		log.Errorf("failed to look up content %d for %s event: %s", contID, typ, err)
+		return
+	}
+
+	ev := &contentEvent{
+		Type:    typ,
+		Content: contID,
+		UserID:  cont.UserID,
+		Cid:     cont.Cid,
+		Data:    dstr,
+	}
+	if err := cm.DB.WithContext(ctx).Create(ev).Error; err != nil {
+		log.Errorf("failed to record %s event for content %d: %s", typ, contID, err)
+		return
+	}
+
+	sev := &eventstream.Event{
+		ID:      ev.ID,
+		Type:    ev.Type,
+		Time:    ev.CreatedAt,
+		Source:  cm.hostname,
+		Content: ev.Content,
+		UserID:  ev.UserID,
+		Data:    data,
+	}
+	if ev.Cid.CID.Defined() {
+		sev.Cid = ev.Cid.CID.String()
+	}
+	cm.events.Publish(sev)
+}
+
+// newEventStream sets up publishing of content events to the configured
+// broker, it returns nil when no broker is configured
+func newEventStream(cfg config.EventStream) (*eventstream.Stream, error) {
+	codec, err := eventstream.CodecFor(cfg.Serialization)
+	if err != nil {
+		return nil, err
+	}
+
+	var pub eventstream.Publisher
+	switch cfg.Backend {
+	case "":
+		return nil, nil
+	case "kafka":
+		pub = eventstream.NewKafkaPublisher(cfg.Servers, cfg.Topic)
+	case "nats":
+		np, err := eventstream.NewNatsPublisher(cfg.Servers, cfg.Topic)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to nats: %w", err)
+		}
+		pub = np
+	default:
+		return nil, fmt.Errorf("unknown event stream backend %q, must be kafka or nats", cfg.Backend)
+	}
+	return eventstream.NewStream(pub, codec, cfg.QueueSize), nil
+}
+
+func parseEventsQuery(c echo.Context) (uint, int, error) {
+	var cursor uint
+	if cstr := c.QueryParam("cursor"); cstr != "" {
+		cv, err := strconv.ParseUint(cstr, 10, 64)
+		if err != nil {
+			return 0, 0, &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_QUERY_PARAM_VALUE,
+				Details: "cursor must be an event id",
+			}
+		}
+		cursor = uint(cv)
+	}
+
+	limit := defaultEventsLimit
+	if limstr := c.QueryParam("limit"); limstr != "" {
+		l, err := strconv.Atoi(limstr)
+		if err != nil || l <= 0 {
+			return 0, 0, &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_QUERY_PARAM_VALUE,
+				Details: "limit must be a positive number",
+			}
+		}
+		limit = l
+	}
+	if limit > maxEventsLimit {
+		limit = maxEventsLimit
+	}
+	return cursor, limit, nil
+}
+
+func (s *Server) listContentEvents(c echo.Context, userID uint, typ string) error {
+	cursor, limit, err := parseEventsQuery(c)
+	if err != nil {
+		return err
+	}
+
+	q := s.DB.WithContext(c.Request().Context()).
+		Where("id > ? AND created_at < ?", cursor, time.Now().Add(-eventSettleDelay))
+	if userID != 0 {
+		q = q.Where("user_id = ?", userID)
+	}
+	if typ != "" {
+		q = q.Where("type = ?", typ)
+	}
+
+	var events []contentEvent
+	if err := q.Order("id asc").Limit(limit).Find(&events).Error; err != nil {
+		return err
+	}
+
+	resp := contentEventsResponse{
+		Events: make([]contentEventResponse, 0, len(events)),
+		Cursor: cursor,
+	}
+	for _, ev := range events {
+		er := contentEventResponse{
+			ID:        ev.ID,
+			CreatedAt: ev.CreatedAt,
+			Type:      ev.Type,
+			Content:   ev.Content,
+			UserID:    ev.UserID,
+			Cid:       ev.Cid,
+		}
+		if ev.Data != "" {
+			er.Data = json.RawMessage(ev.Data)
+		}
+		resp.Events = append(resp.Events, er)
+		resp.Cursor = ev.ID
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// handleGetContentEvents godoc
+// @Summary      Get content events
+// @Description  This endpoint returns the changes to the user's contents in the order they happened. Pass the returned cursor back to get the events that follow.
+// @Tags         content
+// @Produce      json
+// @Param        cursor  query  int     false  "Id of the last event already consumed"
+// @Param        limit   query  int     false  "Max number of events to return"
+// @Param        type    query  string  false  "Only return events of this type"
+// @Success      200  {object}  contentEventsResponse
+// @Router       /content/events [get]
+func (s *Server) handleGetContentEvents(c echo.Context, u *User) error {
+	return s.listContentEvents(c, u.ID, c.QueryParam("type"))
+}
+
+// handleAdminGetContentEvents godoc
+// @Summary      Get content events for all users
+// @Description  This endpoint returns the changes to all contents in the order they happened, for systems like billing or search indexes that follow the node. Pass the returned cursor back to get the events that follow.
+// @Tags         admin
+// @Produce      json
+// @Param        cursor  query  int     false  "Id of the last event already consumed"
+// @Param        limit   query  int     false  "Max number of events to return"
+// @Param        type    query  string  false  "Only return events of this type"
+// @Success      200  {object}  contentEventsResponse
+// @Router       /admin/events [get]
+func (s *Server) handleAdminGetContentEvents(c echo.Context) error {
+	return s.listContentEvents(c, 0, c.QueryParam("type"))
+}
@@ -0,0 +1,293 @@
+package eventstream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cbor "github.com/ipfs/go-ipld-cbor"
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("eventstream")
+
+const (
+	maxBatchSize   = 100
+	maxAttempts    = 5
+	initialBackoff = time.Second
+	maxBackoff     = time.Second * 30
+)
+
+// Event describes a change in the lifecycle of a content, like it being
+// pinned or a deal for it being made
+type Event struct {
+	ID      uint                   `json:"id"`
+	Type    string                 `json:"type"`
+	Time    time.Time              `json:"time"`
+	Source  string                 `json:"source"`
+	Content uint                   `json:"content"`
+	UserID  uint                   `json:"userId"`
+	Cid     string                 `json:"cid,omitempty"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// Message is an encoded event ready to be handed to a broker
+type Message struct {
+	Type        string
+	ContentType string
+	// Key groups the events of a content, brokers that partition topics
+	// keep events with the same key in order
+	Key   []byte
+	Value []byte
+}
+
+// Publisher delivers messages to a broker
+type Publisher interface {
+	Name() string
+	Publish(ctx context.Context, msgs []*Message) error
+	Close() error
+}
+
+// Codec is the serialization events are published in
+type Codec interface {
+	Name() string
+	ContentType() string
+	Marshal(ev *Event) ([]byte, error)
+}
+
+// CodecFor returns the codec with the given name, json is used when the
+// name is empty
+func CodecFor(name string) (Codec, error) {
+	switch name {
+	case "", "json":
+		return jsonCodec{}, nil
+	case "cbor":
+		return cborCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown event serialization %q, must be json or cbor", name)
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+func (jsonCodec) Marshal(ev *Event) ([]byte, error) {
+	return json.Marshal(ev)
+}
+
+type cborCodec struct{}
+
+func (cborCodec) Name() string {
+	return "cbor"
+}
+
+func (cborCodec) ContentType() string {
+	return "application/cbor"
+}
+
+// Marshal encodes the event as a cbor map with the same keys as the json
+// encoding, the time is an RFC 3339 string in both
+func (cborCodec) Marshal(ev *Event) ([]byte, error) {
+	m := map[string]interface{}{
+		"id":      uint64(ev.ID),
+		"type":    ev.Type,
+		"time":    ev.Time.UTC().Format(time.RFC3339Nano),
+		"source":  ev.Source,
+		"content": uint64(ev.Content),
+		"userId":  uint64(ev.UserID),
+	}
+	if ev.Cid != "" {
+		m["cid"] = ev.Cid
+	}
+	if len(ev.Data) > 0 {
+		// round trip the data through json so it only holds the plain
+		// types the cbor encoder knows about
+		b, err := json.Marshal(ev.Data)
+		if err != nil {
+			return nil, err
+		}
+		var data map[string]interface{}
+		if err := json.Unmarshal(b, &data); err != nil {
+			return nil, err
+		}
+		m["data"] = data
+	}
+	return cbor.DumpObject(m)
+}
+
+type Stats struct {
+	Published uint64 `json:"published"`
+	Dropped   uint64 `json:"dropped"`
+	Failed    uint64 `json:"failed"`
+	Queued    int    `json:"queued"`
+}
+
+// Stream publishes events in the background so that a slow or unreachable
+// broker never holds up the operation an event describes. Events are
+// dropped when the queue is full, and after a batch has failed to publish
+// maxAttempts times.
+type Stream struct {
+	pub   Publisher
+	codec Codec
+	queue chan *Event
+
+	published uint64
+	dropped   uint64
+	failed    uint64
+
+	closeOnce sync.Once
+	closing   chan struct{}
+	done      chan struct{}
+}
+
+func NewStream(pub Publisher, codec Codec, queueSize int) *Stream {
+	return &Stream{
+		pub:     pub,
+		codec:   codec,
+		queue:   make(chan *Event, queueSize),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Publish queues an event, it is safe to call on a nil stream
+func (s *Stream) Publish(ev *Event) {
+	if s == nil {
+		return
+	}
+
+	select {
+	case s.queue <- ev:
+	default:
+		if n := atomic.AddUint64(&s.dropped, 1); n == 1 || n%1000 == 0 {
+			log.Warnf("event queue for %s is full, %d events dropped so far", s.pub.Name(), n)
+		}
+	}
+}
+
+func (s *Stream) Stats() Stats {
+	if s == nil {
+		return Stats{}
+	}
+	return Stats{
+		Published: atomic.LoadUint64(&s.published),
+		Dropped:   atomic.LoadUint64(&s.dropped),
+		Failed:    atomic.LoadUint64(&s.failed),
+		Queued:    len(s.queue),
+	}
+}
+
+// Run publishes queued events until the stream is closed, then flushes
+// whatever is left in the queue
+func (s *Stream) Run(ctx context.Context) {
+	defer close(s.done)
+
+	for {
+		var first *Event
+		select {
+		case first = <-s.queue:
+		case <-s.closing:
+			s.flush(ctx)
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		s.send(ctx, s.batch(first))
+	}
+}
+
+// batch collects the events that are already queued behind ev
+func (s *Stream) batch(ev *Event) []*Event {
+	evs := []*Event{ev}
+	for len(evs) < maxBatchSize {
+		select {
+		case ev := <-s.queue:
+			evs = append(evs, ev)
+		default:
+			return evs
+		}
+	}
+	return evs
+}
+
+func (s *Stream) flush(ctx context.Context) {
+	for {
+		select {
+		case ev := <-s.queue:
+			s.send(ctx, s.batch(ev))
+		default:
+			return
+		}
+	}
+}
+
+func (s *Stream) send(ctx context.Context, evs []*Event) {
+	msgs := make([]*Message, 0, len(evs))
+	for _, ev := range evs {
+		b, err := s.codec.Marshal(ev)
+		if err != nil {
+			log.Errorf("failed to encode %s event %d: %s", ev.Type, ev.ID, err)
+			atomic.AddUint64(&s.failed, 1)
+			continue
+		}
+		msgs = append(msgs, &Message{
+			Type:        ev.Type,
+			ContentType: s.codec.ContentType(),
+			Key:         []byte(strconv.FormatUint(uint64(ev.Content), 10)),
+			Value:       b,
+		})
+	}
+	if len(msgs) == 0 {
+		return
+	}
+
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		err := s.pub.Publish(ctx, msgs)
+		if err == nil {
+			atomic.AddUint64(&s.published, uint64(len(msgs)))
+			return
+		}
+		if attempt >= maxAttempts || ctx.Err() != nil {
+			log.Errorf("giving up publishing %d events to %s: %s", len(msgs), s.pub.Name(), err)
+			atomic.AddUint64(&s.failed, uint64(len(msgs)))
+			return
+		}
+
+		log.Warnf("failed to publish %d events to %s (attempt %d): %s", len(msgs), s.pub.Name(), attempt, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Close stops accepting events, waits for the queued ones to be published
+// and closes the publisher
+func (s *Stream) Close() error {
+	if s == nil {
+		return nil
+	}
+
+	s.closeOnce.Do(func() {
+		close(s.closing)
+	})
+	<-s.done
+	return s.pub.Close()
+}
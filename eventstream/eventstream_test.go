@@ -0,0 +1,100 @@
+package eventstream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/assert"
+)
+
+type testPublisher struct {
+	lk       sync.Mutex
+	msgs     []*Message
+	failures int
+}
+
+func (p *testPublisher) Name() string {
+	return "test"
+}
+
+func (p *testPublisher) Publish(ctx context.Context, msgs []*Message) error {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	if p.failures > 0 {
+		p.failures--
+		return fmt.Errorf("broker unavailable")
+	}
+	p.msgs = append(p.msgs, msgs...)
+	return nil
+}
+
+func (p *testPublisher) Close() error {
+	return nil
+}
+
+func TestStream(t *testing.T) {
+	assert := assert.New(t)
+
+	pub := &testPublisher{failures: 1}
+	s := NewStream(pub, jsonCodec{}, 10)
+	for i := uint(1); i <= 12; i++ {
+		s.Publish(&Event{ID: i, Type: "content.pinned", Content: i})
+	}
+	assert.Equal(uint64(2), s.Stats().Dropped)
+
+	go s.Run(context.Background())
+	assert.NoError(s.Close())
+
+	assert.Len(pub.msgs, 10)
+	for i, m := range pub.msgs {
+		var ev Event
+		assert.NoError(json.Unmarshal(m.Value, &ev))
+		assert.Equal(uint(i+1), ev.ID, "events are published in order")
+		assert.Equal(fmt.Sprint(ev.Content), string(m.Key))
+		assert.Equal("content.pinned", m.Type)
+	}
+	assert.Equal(uint64(10), s.Stats().Published)
+
+	var nilStream *Stream
+	nilStream.Publish(&Event{})
+	assert.NoError(nilStream.Close())
+}
+
+func TestCodecs(t *testing.T) {
+	assert := assert.New(t)
+
+	ev := &Event{
+		ID:      7,
+		Type:    "deal.made",
+		Time:    time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC),
+		Source:  "estuary-1",
+		Content: 3,
+		UserID:  2,
+		Cid:     "bafkqaaa",
+		Data:    map[string]interface{}{"miner": "f01234", "dealId": int64(99)},
+	}
+
+	_, err := CodecFor("avro")
+	assert.Error(err)
+
+	c, err := CodecFor("cbor")
+	assert.NoError(err)
+	b, err := c.Marshal(ev)
+	assert.NoError(err)
+
+	var out map[string]interface{}
+	assert.NoError(cbor.DecodeInto(b, &out))
+	assert.Equal("deal.made", out["type"])
+	assert.Equal("2022-06-01T12:00:00Z", out["time"])
+	assert.Equal("f01234", out["data"].(map[string]interface{})["miner"])
+
+	c, err = CodecFor("")
+	assert.NoError(err)
+	assert.Equal("json", c.Name())
+}
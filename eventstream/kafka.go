@@ -0,0 +1,47 @@
+package eventstream
+
+import (
+	"context"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaPublisher writes events to a kafka topic, keyed by content so the
+// events of a content land on the same partition in order
+type KafkaPublisher struct {
+	w *kafka.Writer
+}
+
+func NewKafkaPublisher(brokers []string, topic string) *KafkaPublisher {
+	return &KafkaPublisher{
+		w: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+		},
+	}
+}
+
+func (p *KafkaPublisher) Name() string {
+	return "kafka"
+}
+
+func (p *KafkaPublisher) Publish(ctx context.Context, msgs []*Message) error {
+	kmsgs := make([]kafka.Message, 0, len(msgs))
+	for _, m := range msgs {
+		kmsgs = append(kmsgs, kafka.Message{
+			Key:   m.Key,
+			Value: m.Value,
+			Headers: []kafka.Header{
+				{Key: "type", Value: []byte(m.Type)},
+				{Key: "content-type", Value: []byte(m.ContentType)},
+			},
+		})
+	}
+	return p.w.WriteMessages(ctx, kmsgs...)
+}
+
+func (p *KafkaPublisher) Close() error {
+	return p.w.Close()
+}
@@ -0,0 +1,54 @@
+package eventstream
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const natsFlushTimeout = time.Second * 10
+
+// NatsPublisher publishes each event on a subject of its own under a prefix,
+// eg. estuary.events.deal.failed, so consumers can subscribe to just the
+// events they care about
+type NatsPublisher struct {
+	nc     *nats.Conn
+	prefix string
+}
+
+func NewNatsPublisher(servers []string, prefix string) (*NatsPublisher, error) {
+	nc, err := nats.Connect(strings.Join(servers, ","),
+		nats.Name("estuary"),
+		nats.MaxReconnects(-1),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &NatsPublisher{nc: nc, prefix: prefix}, nil
+}
+
+func (p *NatsPublisher) Name() string {
+	return "nats"
+}
+
+func (p *NatsPublisher) Publish(ctx context.Context, msgs []*Message) error {
+	for _, m := range msgs {
+		msg := nats.NewMsg(p.prefix + "." + m.Type)
+		msg.Data = m.Value
+		msg.Header.Set("Content-Type", m.ContentType)
+		msg.Header.Set("Estuary-Content", string(m.Key))
+		if err := p.nc.PublishMsg(msg); err != nil {
+			return err
+		}
+	}
+	// publishing only buffers, flushing makes sure the server got them
+	ctx, cancel := context.WithTimeout(ctx, natsFlushTimeout)
+	defer cancel()
+	return p.nc.FlushWithContext(ctx)
+}
+
+func (p *NatsPublisher) Close() error {
+	return p.nc.Drain()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+
+	"github.com/application-research/estuary/faults"
+	"github.com/application-research/estuary/util"
+)
+
+func faultsError(err error) error {
+	if errors.Is(err, faults.ErrDisabled) {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_FAULTS_DISABLED,
+			Details: err.Error(),
+		}
+	}
+	return &util.HttpError{
+		Code:    http.StatusBadRequest,
+		Reason:  util.ERR_INVALID_INPUT,
+		Details: err.Error(),
+	}
+}
+
+// handleAdminListFaults godoc
+// @Summary      List injected faults
+// @Description  This endpoint lists the faults currently injected into the node. Fault injection is only available in binaries built with the faults tag.
+// @Tags         admin
+// @Produce      json
+// @Success      200  {array}  faults.Fault
+// @Router       /admin/faults [get]
+func (s *Server) handleAdminListFaults(c echo.Context) error {
+	if !faults.Enabled {
+		return faultsError(faults.ErrDisabled)
+	}
+	return c.JSON(http.StatusOK, faults.List())
+}
+
+// handleAdminSetFault godoc
+// @Summary      Inject a fault
+// @Description  This endpoint injects a fault at one of the points shuttle-disconnect, slow-fetch, blockstore-write or db-timeout, replacing any fault already there. Fault injection is only available in binaries built with the faults tag.
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        point  path  string        true  "Injection point"
+// @Param        body   body  faults.Fault  true  "Fault to inject"
+// @Success      200  {array}  faults.Fault
+// @Router       /admin/faults/{point} [put]
+func (s *Server) handleAdminSetFault(c echo.Context) error {
+	var f faults.Fault
+	if err := c.Bind(&f); err != nil {
+		return err
+	}
+	f.Point = c.Param("point")
+
+	if err := faults.Set(f); err != nil {
+		return faultsError(err)
+	}
+
+	log.Warnf("injecting fault at %s", f.Point)
+	return c.JSON(http.StatusOK, faults.List())
+}
+
+// handleAdminClearFault godoc
+// @Summary      Clear an injected fault
+// @Description  This endpoint removes the fault injected at a point.
+// @Tags         admin
+// @Produce      json
+// @Param        point  path  string  true  "Injection point"
+// @Success      200  {array}  faults.Fault
+// @Router       /admin/faults/{point} [delete]
+func (s *Server) handleAdminClearFault(c echo.Context) error {
+	if err := faults.Clear(c.Param("point")); err != nil {
+		return faultsError(err)
+	}
+	return c.JSON(http.StatusOK, faults.List())
+}
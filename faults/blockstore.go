@@ -0,0 +1,36 @@
+package faults
+
+import (
+	"context"
+
+	blocks "github.com/ipfs/go-block-format"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+// Blockstore wraps a blockstore so that writes fail while a fault is
+// installed at the BlockstoreWrite point. In regular builds the blockstore
+// is returned as is.
+func Blockstore(bs blockstore.Blockstore) blockstore.Blockstore {
+	if !Enabled {
+		return bs
+	}
+	return &faultyBlockstore{Blockstore: bs}
+}
+
+type faultyBlockstore struct {
+	blockstore.Blockstore
+}
+
+func (fb *faultyBlockstore) Put(ctx context.Context, blk blocks.Block) error {
+	if err := Check(ctx, BlockstoreWrite); err != nil {
+		return err
+	}
+	return fb.Blockstore.Put(ctx, blk)
+}
+
+func (fb *faultyBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	if err := Check(ctx, BlockstoreWrite); err != nil {
+		return err
+	}
+	return fb.Blockstore.PutMany(ctx, blks)
+}
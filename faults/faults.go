@@ -0,0 +1,55 @@
+// Package faults injects failures into a running node so that retry and
+// repair behavior can be exercised before a real outage does it. It is only
+// active in binaries built with the faults build tag, in regular builds
+// every check is a no-op and faults can't be set.
+package faults
+
+import (
+	"errors"
+	"time"
+)
+
+// Points where faults can be injected
+const (
+	// ShuttleDisconnect drops the websocket connection of a shuttle when it
+	// next sends a message to the primary node
+	ShuttleDisconnect = "shuttle-disconnect"
+	// SlowFetch delays, or fails, fetching the dag of content being pinned
+	SlowFetch = "slow-fetch"
+	// BlockstoreWrite fails writes to the blockstore
+	BlockstoreWrite = "blockstore-write"
+	// DBTimeout fails database statements as if they timed out
+	DBTimeout = "db-timeout"
+)
+
+// Points lists every injection point
+var Points = []string{ShuttleDisconnect, SlowFetch, BlockstoreWrite, DBTimeout}
+
+var ErrDisabled = errors.New("fault injection is not built into this binary, rebuild with -tags faults")
+
+var ErrUnknownPoint = errors.New("unknown fault injection point")
+
+// Fault describes what happens when an injection point is hit. Each hit
+// waits for Delay and then fails with Error, either of which may be left
+// out. Probability is the share of hits that are affected, between 0 and 1
+// with zero meaning all of them, and Count limits how many hits are
+// affected before the fault clears itself, zero means no limit.
+type Fault struct {
+	Point       string        `json:"point"`
+	Error       string        `json:"error,omitempty"`
+	Delay       time.Duration `json:"delay,omitempty"`
+	Probability float64       `json:"probability,omitempty"`
+	Count       int           `json:"count,omitempty"`
+
+	// Hits counts how many times the fault has been injected
+	Hits int `json:"hits"`
+}
+
+func validPoint(point string) bool {
+	for _, p := range Points {
+		if p == point {
+			return true
+		}
+	}
+	return false
+}
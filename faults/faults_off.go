@@ -0,0 +1,24 @@
+//go:build !faults
+// +build !faults
+
+package faults
+
+import "context"
+
+const Enabled = false
+
+func Set(f Fault) error {
+	return ErrDisabled
+}
+
+func Clear(point string) error {
+	return ErrDisabled
+}
+
+func List() []Fault {
+	return nil
+}
+
+func Check(ctx context.Context, point string) error {
+	return nil
+}
@@ -0,0 +1,98 @@
+//go:build faults
+// +build faults
+
+package faults
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const Enabled = true
+
+var (
+	lk     sync.Mutex
+	faults = make(map[string]*Fault)
+)
+
+// Set installs a fault at its injection point, replacing any fault already
+// there
+func Set(f Fault) error {
+	if !validPoint(f.Point) {
+		return fmt.Errorf("%w: %q", ErrUnknownPoint, f.Point)
+	}
+	if f.Probability < 0 || f.Probability > 1 {
+		return fmt.Errorf("probability must be between 0 and 1, got %f", f.Probability)
+	}
+	if f.Error == "" && f.Delay == 0 {
+		return errors.New("a fault needs an error, a delay or both")
+	}
+
+	f.Hits = 0
+
+	lk.Lock()
+	defer lk.Unlock()
+	faults[f.Point] = &f
+	return nil
+}
+
+// Clear removes the fault at an injection point
+func Clear(point string) error {
+	lk.Lock()
+	defer lk.Unlock()
+	delete(faults, point)
+	return nil
+}
+
+// List returns the faults currently installed
+func List() []Fault {
+	lk.Lock()
+	defer lk.Unlock()
+
+	out := make([]Fault, 0, len(faults))
+	for _, f := range faults {
+		out = append(out, *f)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Point < out[j].Point
+	})
+	return out
+}
+
+// Check is called at an injection point, it waits for the delay of a fault
+// installed there and returns its error
+func Check(ctx context.Context, point string) error {
+	lk.Lock()
+	f, ok := faults[point]
+	if !ok || (f.Probability > 0 && rand.Float64() >= f.Probability) {
+		lk.Unlock()
+		return nil
+	}
+
+	f.Hits++
+	if f.Count > 0 && f.Hits >= f.Count {
+		delete(faults, point)
+	}
+	delay, msg := f.Delay, f.Error
+	lk.Unlock()
+
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+
+	if msg != "" {
+		return fmt.Errorf("injected fault at %s: %s", point, msg)
+	}
+	return nil
+}
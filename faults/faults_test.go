@@ -0,0 +1,36 @@
+//go:build faults
+// +build faults
+
+package faults
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	assert.NoError(Check(ctx, BlockstoreWrite))
+
+	assert.ErrorIs(Set(Fault{Point: "nowhere", Error: "boom"}), ErrUnknownPoint)
+	assert.Error(Set(Fault{Point: BlockstoreWrite}))
+
+	assert.NoError(Set(Fault{Point: BlockstoreWrite, Error: "disk on fire", Count: 2}))
+	assert.Error(Check(ctx, BlockstoreWrite))
+	assert.Error(Check(ctx, BlockstoreWrite))
+	assert.NoError(Check(ctx, BlockstoreWrite), "the fault clears itself after count hits")
+	assert.Empty(List())
+
+	assert.NoError(Set(Fault{Point: SlowFetch, Delay: time.Hour}))
+	cctx, cancel := context.WithTimeout(ctx, time.Millisecond*10)
+	defer cancel()
+	assert.ErrorIs(Check(cctx, SlowFetch), context.DeadlineExceeded)
+
+	assert.NoError(Clear(SlowFetch))
+	assert.NoError(Check(ctx, SlowFetch))
+}
@@ -0,0 +1,52 @@
+package faults
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+)
+
+// GormPlugin fails database statements while a fault is installed at the
+// DBTimeout point, the statement is not run
+type GormPlugin struct{}
+
+func (GormPlugin) Name() string {
+	return "estuary:faults"
+}
+
+func (p GormPlugin) Initialize(db *gorm.DB) error {
+	if !Enabled {
+		return nil
+	}
+
+	cb := db.Callback()
+	hooks := []struct {
+		op       string
+		register func(string, func(*gorm.DB)) error
+	}{
+		{"create", cb.Create().Before("gorm:create").Register},
+		{"query", cb.Query().Before("gorm:query").Register},
+		{"update", cb.Update().Before("gorm:update").Register},
+		{"delete", cb.Delete().Before("gorm:delete").Register},
+		{"row", cb.Row().Before("gorm:row").Register},
+		{"raw", cb.Raw().Before("gorm:raw").Register},
+	}
+
+	for _, h := range hooks {
+		if err := h.register(p.Name()+":"+h.op, injectDBTimeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func injectDBTimeout(db *gorm.DB) {
+	ctx := db.Statement.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if err := Check(ctx, DBTimeout); err != nil {
+		db.AddError(err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/featureflags"
+	"github.com/application-research/estuary/util"
+)
+
+const featureFlagRefreshInterval = time.Second * 30
+
+// feature flags gating subsystems of the node, checks that aren't made on
+// behalf of a user only pass once a flag is rolled out to everyone
+const (
+	flagCopyObjects  = "copy-objects"
+	flagDealBatching = "deal-batching"
+	flagOriginFetch  = "origin-fetch"
+)
+
+var knownFeatureFlags = []featureflags.Flag{
+	{
+		Name:           flagCopyObjects,
+		Description:    "bulk load the objects of new content with COPY on postgres instead of batched inserts",
+		RolloutPercent: 100,
+	},
+	{
+		Name:           flagDealBatching,
+		Description:    "send the deal proposals of a user's content through the per provider proposal queue, when deal.batch is enabled, instead of one at a time",
+		RolloutPercent: 100,
+	},
+	{
+		Name:           flagOriginFetch,
+		Description:    "fetch the pins of a user with the transport set in pin_queue.fetch, as a car or over graphsync from their origins, instead of only over bitswap",
+		RolloutPercent: 100,
+	},
+}
+
+// newFeatureFlags sets up the flag manager with the known flags, with their
+// rollout taken from the config where it sets one. Flags only named in the
+// config are included too, so new flags can be tried out before they get a
+// description.
+func newFeatureFlags(db *gorm.DB, cfg map[string]config.FeatureFlag) (*featureflags.Manager, error) {
+	defaults := make([]featureflags.Flag, 0, len(knownFeatureFlags)+len(cfg))
+	seen := make(map[string]bool)
+	for _, f := range knownFeatureFlags {
+		if c, ok := cfg[f.Name]; ok {
+			f.RolloutPercent = c.RolloutPercent
+		}
+		defaults = append(defaults, f)
+		seen[f.Name] = true
+	}
+	for name, c := range cfg {
+		if !seen[name] {
+			defaults = append(defaults, featureflags.Flag{Name: name, RolloutPercent: c.RolloutPercent})
+		}
+	}
+	return featureflags.NewManager(db, defaults...)
+}
+
+// handleAdminListFeatureFlags godoc
+// @Summary      List feature flags
+// @Description  This endpoint lists every feature flag with its rollout percentage and per user overrides.
+// @Tags         admin
+// @Produce      json
+// @Success      200  {array}  featureflags.FlagStatus
+// @Router       /admin/feature-flags [get]
+func (s *Server) handleAdminListFeatureFlags(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.flags.List())
+}
+
+type setFeatureFlagBody struct {
+	RolloutPercent int    `json:"rolloutPercent"`
+	Description    string `json:"description"`
+}
+
+// handleAdminSetFeatureFlag godoc
+// @Summary      Set the rollout of a feature flag
+// @Description  This endpoint sets the percentage of users a feature flag is enabled for, 0 turns it off and 100 turns it on for everyone.
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        name  path  string              true  "Flag name"
+// @Param        body  body  setFeatureFlagBody  true  "Rollout"
+// @Success      200  {array}  featureflags.FlagStatus
+// @Router       /admin/feature-flags/{name} [put]
+func (s *Server) handleAdminSetFeatureFlag(c echo.Context) error {
+	var body setFeatureFlagBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	if body.RolloutPercent < 0 || body.RolloutPercent > 100 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "rolloutPercent must be between 0 and 100",
+		}
+	}
+
+	if err := s.flags.Set(c.Request().Context(), featureflags.Flag{
+		Name:           c.Param("name"),
+		Description:    body.Description,
+		RolloutPercent: body.RolloutPercent,
+	}); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, s.flags.List())
+}
+
+// handleAdminResetFeatureFlag godoc
+// @Summary      Reset a feature flag
+// @Description  This endpoint reverts a feature flag to the rollout it has in the config, user overrides are kept.
+// @Tags         admin
+// @Produce      json
+// @Param        name  path  string  true  "Flag name"
+// @Success      200  {array}  featureflags.FlagStatus
+// @Router       /admin/feature-flags/{name} [delete]
+func (s *Server) handleAdminResetFeatureFlag(c echo.Context) error {
+	if err := s.flags.Reset(c.Request().Context(), c.Param("name")); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, s.flags.List())
+}
+
+type setFeatureFlagUserBody struct {
+	Enabled bool `json:"enabled"`
+}
+
+// handleAdminSetFeatureFlagUser godoc
+// @Summary      Override a feature flag for a user
+// @Description  This endpoint turns a feature flag on or off for a single user regardless of its rollout.
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        name  path  string                  true  "Flag name"
+// @Param        user  path  int                     true  "User ID"
+// @Param        body  body  setFeatureFlagUserBody  true  "Override"
+// @Success      200  {array}  featureflags.FlagStatus
+// @Router       /admin/feature-flags/{name}/users/{user} [put]
+func (s *Server) handleAdminSetFeatureFlagUser(c echo.Context) error {
+	uid, err := strconv.Atoi(c.Param("user"))
+	if err != nil {
+		return err
+	}
+
+	var body setFeatureFlagUserBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	if err := s.flags.SetUserOverride(c.Request().Context(), c.Param("name"), uint(uid), body.Enabled); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, s.flags.List())
+}
+
+// handleAdminClearFeatureFlagUser godoc
+// @Summary      Remove a users feature flag override
+// @Description  This endpoint returns a user to the regular rollout of a feature flag.
+// @Tags         admin
+// @Produce      json
+// @Param        name  path  string  true  "Flag name"
+// @Param        user  path  int     true  "User ID"
+// @Success      200  {array}  featureflags.FlagStatus
+// @Router       /admin/feature-flags/{name}/users/{user} [delete]
+func (s *Server) handleAdminClearFeatureFlagUser(c echo.Context) error {
+	uid, err := strconv.Atoi(c.Param("user"))
+	if err != nil {
+		return err
+	}
+
+	if err := s.flags.ClearUserOverride(c.Request().Context(), c.Param("name"), uint(uid)); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, s.flags.List())
+}
@@ -0,0 +1,230 @@
+package featureflags
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Flag gates a subsystem behind a gradual rollout. A flag is on for a share
+// of users given by RolloutPercent, users are assigned to the share by
+// hashing their id with the flag name so that the same users stay in it as
+// the percentage is raised. Per user overrides take precedence over the
+// rollout, so a flag can be turned on for a few users to try it out, or off
+// for a user it causes problems for.
+type Flag struct {
+	Name           string    `gorm:"primarykey" json:"name"`
+	Description    string    `json:"description"`
+	RolloutPercent int       `json:"rolloutPercent"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+}
+
+func (Flag) TableName() string {
+	return "feature_flags"
+}
+
+// UserOverride forces a flag on or off for a single user
+type UserOverride struct {
+	Flag    string `gorm:"primarykey" json:"flag"`
+	UserID  uint   `gorm:"primarykey" json:"userId"`
+	Enabled bool   `json:"enabled"`
+}
+
+func (UserOverride) TableName() string {
+	return "feature_flag_overrides"
+}
+
+// FlagStatus describes a flag as it is currently evaluated
+type FlagStatus struct {
+	Flag
+	// Default is set when the flag comes from the defaults rather than from
+	// the database
+	Default   bool          `json:"default"`
+	Overrides map[uint]bool `json:"overrides"`
+}
+
+// Manager evaluates flags. Flags stored in the database take precedence
+// over the defaults it was created with, and are cached in memory so that
+// checking a flag doesn't hit the database, call Refresh periodically to
+// pick up changes made by other instances.
+type Manager struct {
+	db       *gorm.DB
+	defaults map[string]Flag
+
+	lk        sync.RWMutex
+	flags     map[string]Flag
+	overrides map[string]map[uint]bool
+}
+
+func NewManager(db *gorm.DB, defaults ...Flag) (*Manager, error) {
+	if err := db.AutoMigrate(&Flag{}, &UserOverride{}); err != nil {
+		return nil, fmt.Errorf("failed to migrate feature flags: %w", err)
+	}
+
+	m := &Manager{
+		db:        db,
+		defaults:  make(map[string]Flag, len(defaults)),
+		flags:     make(map[string]Flag),
+		overrides: make(map[string]map[uint]bool),
+	}
+	for _, f := range defaults {
+		m.defaults[f.Name] = f
+	}
+
+	if err := m.Refresh(context.Background()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Refresh reloads the flags and overrides from the database
+func (m *Manager) Refresh(ctx context.Context) error {
+	var flags []Flag
+	if err := m.db.WithContext(ctx).Find(&flags).Error; err != nil {
+		return err
+	}
+
+	var overrides []UserOverride
+	if err := m.db.WithContext(ctx).Find(&overrides).Error; err != nil {
+		return err
+	}
+
+	fm := make(map[string]Flag, len(flags))
+	for _, f := range flags {
+		fm[f.Name] = f
+	}
+
+	om := make(map[string]map[uint]bool)
+	for _, o := range overrides {
+		if om[o.Flag] == nil {
+			om[o.Flag] = make(map[uint]bool)
+		}
+		om[o.Flag][o.UserID] = o.Enabled
+	}
+
+	m.lk.Lock()
+	m.flags = fm
+	m.overrides = om
+	m.lk.Unlock()
+	return nil
+}
+
+// Enabled reports whether the named flag is on for a user. Checks that
+// aren't tied to a user should pass zero, which is on only once the flag is
+// rolled out to everyone or has an override for user zero. Unknown flags are
+// always off.
+func (m *Manager) Enabled(name string, userID uint) bool {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	if on, ok := m.overrides[name][userID]; ok {
+		return on
+	}
+
+	f, ok := m.flags[name]
+	if !ok {
+		f, ok = m.defaults[name]
+		if !ok {
+			return false
+		}
+	}
+
+	switch {
+	case f.RolloutPercent >= 100:
+		return true
+	case f.RolloutPercent <= 0 || userID == 0:
+		return false
+	default:
+		return bucket(name, userID) < f.RolloutPercent
+	}
+}
+
+// bucket assigns a user a stable number between 0 and 99 for a flag
+func bucket(name string, userID uint) int {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s:%d", name, userID)
+	return int(h.Sum32() % 100)
+}
+
+// List returns every known flag, from the database or the defaults, along
+// with its user overrides
+func (m *Manager) List() []FlagStatus {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	out := make([]FlagStatus, 0, len(m.defaults)+len(m.flags))
+	add := func(f Flag, def bool) {
+		ov := make(map[uint]bool, len(m.overrides[f.Name]))
+		for u, on := range m.overrides[f.Name] {
+			ov[u] = on
+		}
+		out = append(out, FlagStatus{Flag: f, Default: def, Overrides: ov})
+	}
+
+	for _, f := range m.flags {
+		add(f, false)
+	}
+	for name, f := range m.defaults {
+		if _, ok := m.flags[name]; !ok {
+			add(f, true)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// Set stores the rollout of a flag in the database, overriding its default
+func (m *Manager) Set(ctx context.Context, f Flag) error {
+	if f.RolloutPercent < 0 || f.RolloutPercent > 100 {
+		return fmt.Errorf("rollout percent must be between 0 and 100, got %d", f.RolloutPercent)
+	}
+	if f.Description == "" {
+		m.lk.RLock()
+		if cur, ok := m.flags[f.Name]; ok {
+			f.Description = cur.Description
+		} else {
+			f.Description = m.defaults[f.Name].Description
+		}
+		m.lk.RUnlock()
+	}
+
+	if err := m.db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&f).Error; err != nil {
+		return err
+	}
+	return m.Refresh(ctx)
+}
+
+// Reset removes a flag from the database so that it reverts to its
+// default, user overrides are kept
+func (m *Manager) Reset(ctx context.Context, name string) error {
+	if err := m.db.WithContext(ctx).Delete(&Flag{}, "name = ?", name).Error; err != nil {
+		return err
+	}
+	return m.Refresh(ctx)
+}
+
+// SetUserOverride forces a flag on or off for one user
+func (m *Manager) SetUserOverride(ctx context.Context, name string, userID uint, enabled bool) error {
+	o := &UserOverride{Flag: name, UserID: userID, Enabled: enabled}
+	if err := m.db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(o).Error; err != nil {
+		return err
+	}
+	return m.Refresh(ctx)
+}
+
+// ClearUserOverride returns a user to the flag's regular rollout
+func (m *Manager) ClearUserOverride(ctx context.Context, name string, userID uint) error {
+	if err := m.db.WithContext(ctx).Delete(&UserOverride{}, "flag = ? AND user_id = ?", name, userID).Error; err != nil {
+		return err
+	}
+	return m.Refresh(ctx)
+}
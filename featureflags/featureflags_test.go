@@ -0,0 +1,64 @@
+package featureflags
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestRollout(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	assert.NoError(err)
+
+	m, err := NewManager(db, Flag{Name: "new-thing", Description: "a new thing", RolloutPercent: 0})
+	assert.NoError(err)
+
+	assert.False(m.Enabled("new-thing", 1))
+	assert.False(m.Enabled("unknown", 1))
+
+	assert.NoError(m.Set(ctx, Flag{Name: "new-thing", RolloutPercent: 50}))
+
+	var on int
+	for u := uint(1); u <= 1000; u++ {
+		if m.Enabled("new-thing", u) {
+			on++
+		}
+	}
+	assert.InDelta(500, on, 100)
+	assert.False(m.Enabled("new-thing", 0), "system wide checks need a full rollout")
+
+	// raising the percentage keeps everyone who already had the flag
+	var before []uint
+	for u := uint(1); u <= 100; u++ {
+		if m.Enabled("new-thing", u) {
+			before = append(before, u)
+		}
+	}
+	assert.NoError(m.Set(ctx, Flag{Name: "new-thing", RolloutPercent: 80}))
+	for _, u := range before {
+		assert.True(m.Enabled("new-thing", u))
+	}
+
+	assert.NoError(m.SetUserOverride(ctx, "new-thing", before[0], false))
+	assert.False(m.Enabled("new-thing", before[0]))
+
+	assert.NoError(m.Reset(ctx, "new-thing"))
+	assert.False(m.Enabled("new-thing", 2))
+	assert.False(m.Enabled("new-thing", before[0]))
+
+	assert.NoError(m.SetUserOverride(ctx, "new-thing", 2, true))
+	assert.True(m.Enabled("new-thing", 2))
+	assert.NoError(m.ClearUserOverride(ctx, "new-thing", 2))
+	assert.False(m.Enabled("new-thing", 2))
+
+	flags := m.List()
+	assert.Len(flags, 1)
+	assert.True(flags[0].Default)
+	assert.Equal("a new thing", flags[0].Description)
+}
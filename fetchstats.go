@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/application-research/estuary/util/fetchstats"
+	"gorm.io/gorm/clause"
+)
+
+// pinFetchStats keeps the bitswap stats of the last fetch of a pin so they
+// can still be seen in its status once the fetch is over
+type pinFetchStats struct {
+	Content   uint `gorm:"primarykey"`
+	UpdatedAt time.Time
+	Location  string
+	Stats     string
+}
+
+func (cm *ContentManager) saveFetchStats(ctx context.Context, contID uint, location string, st *fetchstats.Stats) {
+	b, err := json.Marshal(st)
+	if err != nil {
+		log.Errorf("failed to encode fetch stats of content %d: %s", contID, err)
+		return
+	}
+
+	if err := cm.DB.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&pinFetchStats{
+		Content:  contID,
+		Location: location,
+		Stats:    string(b),
+	}).Error; err != nil {
+		log.Errorf("failed to save fetch stats of content %d: %s", contID, err)
+	}
+}
+
+// addFetchStats adds the saved fetch stats of a pin to its status, unless
+// the status already has the stats of a fetch in progress
+func (cm *ContentManager) addFetchStats(ctx context.Context, contID uint, st *types.IpfsPinStatusResponse) {
+	if _, ok := st.Info["fetch_stats"]; ok {
+		return
+	}
+
+	var rec pinFetchStats
+	if err := cm.DB.WithContext(ctx).Limit(1).Find(&rec, "content = ?", contID).Error; err != nil {
+		log.Warnf("failed to load fetch stats of content %d: %s", contID, err)
+		return
+	}
+	if rec.Content == 0 {
+		return
+	}
+
+	var fs fetchstats.Stats
+	if err := json.Unmarshal([]byte(rec.Stats), &fs); err != nil {
+		log.Warnf("content %d has invalid fetch stats: %s", contID, err)
+		return
+	}
+	st.Info["fetch_stats"] = &fs
+}
+
+func (cm *ContentManager) handleRpcPinFetchStats(ctx context.Context, handle string, param *drpc.PinFetchStats) error {
+	if param.Stats == nil {
+		return nil
+	}
+	cm.saveFetchStats(ctx, param.DBID, handle, param.Stats)
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/fvm"
+	"github.com/filecoin-project/go-address"
+	"gorm.io/gorm/clause"
+)
+
+const eventDealAttested = "deal.attested"
+
+// where an attestation is at
+const (
+	attestationPending   = "pending"
+	attestationSent      = "sent"
+	attestationConfirmed = "confirmed"
+	attestationFailed    = "failed"
+)
+
+// DealAttestation is an attestation of the status of a deal to the fvm
+// contract, sent in the transaction TxHash
+type DealAttestation struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	Content  uint   `gorm:"index" json:"content"`
+	Deal     uint   `gorm:"uniqueIndex:idx_deal_attestation" json:"deal"`
+	Status   uint8  `gorm:"uniqueIndex:idx_deal_attestation" json:"status"`
+	State    string `gorm:"index" json:"state"`
+	TxHash   string `json:"txHash"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error"`
+}
+
+// queueDealAttestation records that the status of a deal is to be attested,
+// it is sent by the next run of sendDealAttestations. Checks of the same deal
+// that overlap can queue a status twice, only the first is kept.
+func (cm *ContentManager) queueDealAttestation(d *contentDeal, status uint8) {
+	if cm.fvm == nil {
+		return
+	}
+	if err := cm.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&DealAttestation{
+		Content: d.Content,
+		Deal:    d.ID,
+		Status:  status,
+		State:   attestationPending,
+	}).Error; err != nil {
+		log.Errorf("failed to queue attestation of deal %d: %s", d.ID, err)
+	}
+}
+
+// sendDealAttestations checks on the attestations that were sent and sends
+// the pending ones
+func (cm *ContentManager) sendDealAttestations(ctx context.Context) error {
+	var sent []*DealAttestation
+	if err := cm.DB.Find(&sent, "state = ?", attestationSent).Error; err != nil {
+		return err
+	}
+	for _, da := range sent {
+		ok, err := cm.fvm.Confirmed(ctx, da.TxHash)
+		switch {
+		case errors.Is(err, fvm.ErrPending):
+			continue
+		case err != nil:
+			log.Warnf("failed to get receipt of attestation %d: %s", da.ID, err)
+			continue
+		case ok:
+			if err := cm.DB.Model(da).UpdateColumn("state", attestationConfirmed).Error; err != nil {
+				return err
+			}
+			cm.recordContentEvent(ctx, eventDealAttested, da.Content, map[string]interface{}{
+				"deal":   da.Deal,
+				"status": da.Status,
+				"txHash": da.TxHash,
+			})
+		default:
+			if err := cm.attestationFailed(da, fmt.Errorf("transaction %s reverted", da.TxHash)); err != nil {
+				return err
+			}
+		}
+	}
+
+	var pending []*DealAttestation
+	if err := cm.DB.Order("id asc").Limit(100).Find(&pending, "state = ?", attestationPending).Error; err != nil {
+		return err
+	}
+	for _, da := range pending {
+		hash, err := cm.attest(ctx, da)
+		if err != nil {
+			if err := cm.attestationFailed(da, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := cm.DB.Model(da).UpdateColumns(map[string]interface{}{
+			"state":    attestationSent,
+			"tx_hash":  hash,
+			"attempts": da.Attempts + 1,
+		}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cm *ContentManager) attest(ctx context.Context, da *DealAttestation) (string, error) {
+	var d contentDeal
+	if err := cm.DB.First(&d, "id = ?", da.Deal).Error; err != nil {
+		return "", err
+	}
+	var cont util.Content
+	if err := cm.DB.Unscoped().First(&cont, "id = ?", da.Content).Error; err != nil {
+		return "", err
+	}
+
+	maddr, err := address.NewFromString(d.Miner)
+	if err != nil {
+		return "", err
+	}
+	provider, err := address.IDFromAddress(maddr)
+	if err != nil {
+		return "", fmt.Errorf("provider %s has no actor id: %w", d.Miner, err)
+	}
+
+	return cm.fvm.Attest(ctx, fvm.Attestation{
+		Cid:      cont.Cid.CID.Bytes(),
+		DealID:   uint64(d.DealID),
+		Provider: provider,
+		Status:   da.Status,
+	})
+}
+
+// attestationFailed sends the attestation again on the next run, until it
+// has been tried MaxAttempts times
+func (cm *ContentManager) attestationFailed(da *DealAttestation, aerr error) error {
+	log.Warnf("failed to attest deal %d: %s", da.Deal, aerr)
+
+	state, attempts := attestationPending, da.Attempts
+	if da.State == attestationPending {
+		attempts++
+	}
+	if attempts >= cm.fvmCfg.MaxAttempts {
+		state = attestationFailed
+	}
+	return cm.DB.Model(da).UpdateColumns(map[string]interface{}{
+		"state":    state,
+		"attempts": attempts,
+		"error":    aerr.Error(),
+	}).Error
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/application-research/estuary/constants"
 	"github.com/application-research/estuary/util"
 	"github.com/ipfs/go-cid"
 	"golang.org/x/xerrors"
@@ -27,7 +28,7 @@ func (cm *ContentManager) GarbageCollect(ctx context.Context) error {
 		}
 	}
 
-	return nil
+	return cm.dropStaleCarIndexes(ctx)
 }
 
 func (cm *ContentManager) maybeRemoveObject(ctx context.Context, c cid.Cid) (bool, error) {
@@ -78,9 +79,25 @@ func (cm *ContentManager) removeContent(ctx context.Context, contID uint, now bo
 	cm.contentLk.Lock()
 	defer cm.contentLk.Unlock()
 
+	var cont util.Content
+	if err := cm.DB.Find(&cont, "id = ?", contID).Error; err != nil {
+		return fmt.Errorf("failed to get content to remove: %w", err)
+	}
+
 	if err := cm.DB.Delete(&util.Content{}, contID).Error; err != nil {
 		return fmt.Errorf("failed to delete content from db: %w", err)
 	}
+	cm.recordContentEvent(ctx, eventContentDeleted, contID, nil)
+	cm.retract(ctx, contID)
+	cm.dropDeadLetter(ctx, contID)
+
+	// content removed before has nothing left to hand over
+	if cont.ID != 0 {
+		if err := cm.handDealsOver(ctx, cont); err != nil {
+			log.Errorf("failed to hand deals of removed content over: %s", err)
+		}
+		cm.dropCarIndex(ctx, cont.Cid.CID)
+	}
 
 	var objIds []struct {
 		Object uint
@@ -146,35 +163,63 @@ func (cm *ContentManager) removeContent(ctx context.Context, contID uint, now bo
 }
 
 func (cm *ContentManager) unpinContent(ctx context.Context, contid uint) error {
+	_, _, err := cm.reclaimContent(ctx, contid)
+	return err
+}
+
+// reclaimContent unpins a content, and returns how many of its blocks were
+// deleted here and how many are kept for other content
+func (cm *ContentManager) reclaimContent(ctx context.Context, contid uint) (int, int, error) {
 	var pin util.Content
 	if err := cm.DB.First(&pin, "id = ?", contid).Error; err != nil {
-		return err
+		return 0, 0, err
+	}
+
+	switch pin.Location {
+	case constants.ContentLocationRemote:
+		if err := cm.removeRemotePin(ctx, pin.ID); err != nil {
+			return 0, 0, err
+		}
+	case constants.ContentLocationCluster:
+		if err := cm.unpinFromCluster(ctx, pin); err != nil {
+			return 0, 0, err
+		}
 	}
 
 	objs, err := cm.objectsForPin(ctx, pin.ID)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 
 	if err := cm.DB.Delete(&util.Content{ID: pin.ID}).Error; err != nil {
-		return err
+		return 0, 0, err
 	}
+	cm.recordContentEvent(ctx, eventContentDeleted, pin.ID, nil)
+	cm.dropCarIndex(ctx, pin.Cid.CID)
+	cm.retract(ctx, pin.ID)
 
 	if err := cm.DB.Where("content = ?", pin.ID).Delete(&util.ObjRef{}).Error; err != nil {
-		return err
+		return 0, 0, err
 	}
 
 	if err := cm.clearUnreferencedObjects(ctx, objs); err != nil {
-		return err
+		return 0, 0, err
 	}
 
+	var reclaimed, kept int
 	for _, o := range objs {
 		// TODO: this is safe, but... slow?
-		if _, err := cm.deleteIfNotPinned(ctx, o); err != nil {
-			return err
+		deleted, err := cm.deleteIfNotPinned(ctx, o)
+		if err != nil {
+			return reclaimed, kept, err
+		}
+		if deleted {
+			reclaimed++
+		} else {
+			kept++
 		}
 	}
-	return nil
+	return reclaimed, kept, nil
 }
 
 func (cm *ContentManager) deleteIfNotPinned(ctx context.Context, o *util.Object) (bool, error) {
@@ -11,11 +11,9 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"net/http"
-	httpprof "net/http/pprof"
 	"net/url"
 	"os"
 	"path/filepath"
-	"runtime/pprof"
 	"sort"
 	"strconv"
 	"strings"
@@ -28,9 +26,16 @@ import (
 
 	"github.com/application-research/estuary/autoretrieve"
 	drpc "github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/faults"
 	esmetrics "github.com/application-research/estuary/metrics"
 	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/carindex"
+	"github.com/application-research/estuary/util/cdn"
+	"github.com/application-research/estuary/util/dagwalk"
+	"github.com/application-research/estuary/util/dirtree"
+	"github.com/application-research/estuary/util/encrypt"
 	"github.com/application-research/estuary/util/gateway"
+	"github.com/application-research/estuary/util/requestid"
 	"github.com/application-research/filclient"
 	"github.com/filecoin-project/go-address"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
@@ -49,9 +54,7 @@ import (
 	exchange "github.com/ipfs/go-ipfs-exchange-interface"
 	offline "github.com/ipfs/go-ipfs-exchange-offline"
 	ipld "github.com/ipfs/go-ipld-format"
-	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipfs/go-merkledag"
-	"github.com/ipfs/go-unixfs"
 	uio "github.com/ipfs/go-unixfs/io"
 	"github.com/ipld/go-car"
 	"github.com/labstack/echo/v4"
@@ -66,8 +69,10 @@ import (
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 
+	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
 	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
 	"go.opentelemetry.io/otel/trace"
 
@@ -97,25 +102,41 @@ import (
 func (s *Server) ServeAPI() error {
 
 	e := echo.New()
+	s.echo = e
 
 	e.Binder = new(binder)
 
+	// client addresses are what free retrievals are counted against, and
+	// go into the audit logs
+	ipx, err := util.IPExtractor(s.estuaryCfg.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	e.IPExtractor = ipx
+
 	if s.estuaryCfg.Logging.ApiEndpointLogging {
 		e.Use(middleware.Logger())
 	}
 
+	e.Use(requestid.Middleware)
 	e.Use(s.tracingMiddleware)
+	e.Use(util.MetricsMiddleware)
 	e.Use(util.AppVersionMiddleware(s.estuaryCfg.AppVersion))
 	e.HTTPErrorHandler = util.ErrorHandler
 
-	e.GET("/debug/pprof/:prof", serveProfile)
-	e.GET("/debug/cpuprofile", serveCpuProfile)
+	e.GET("/debug/pprof/:prof", util.ServeProfile, s.AuthRequired(util.PermLevelAdmin))
+	e.GET("/debug/cpuprofile", util.ServeCpuProfile, s.AuthRequired(util.PermLevelAdmin))
+	e.GET("/debug/stack", util.ServeGoroutineStacks, s.AuthRequired(util.PermLevelAdmin))
 
 	phandle := promhttp.Handler()
 	e.GET("/debug/metrics/prometheus", func(e echo.Context) error {
 		phandle.ServeHTTP(e.Response().Writer, e.Request())
 		return nil
 	})
+	e.GET("/metrics", func(e echo.Context) error {
+		phandle.ServeHTTP(e.Response().Writer, e.Request())
+		return nil
+	})
 
 	exporter := esmetrics.Exporter()
 	e.GET("/debug/metrics/opencensus", func(e echo.Context) error {
@@ -123,48 +144,103 @@ func (s *Server) ServeAPI() error {
 		return nil
 	})
 
-	e.Use(middleware.CORS())
+	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins: s.estuaryCfg.CORS.AllowOrigins,
+	}))
 
 	e.POST("/register", s.handleRegisterUser)
 	e.POST("/login", s.handleLoginUser)
+	e.GET("/auth/oidc", s.handleGetOIDCProviders)
+	e.GET("/auth/oidc/:provider/login", s.handleOIDCLogin)
+	e.GET("/auth/oidc/:provider/callback", s.handleOIDCCallback)
+	e.GET("/auth/siwe/nonce", s.handleGetSIWENonce)
+	e.POST("/auth/siwe/login", s.handleSIWELogin)
 	e.GET("/health", s.handleHealth)
 
 	e.GET("/viewer", withUser(s.handleGetViewer), s.AuthRequired(util.PermLevelUpload))
 
 	e.GET("/retrieval-candidates/:cid", s.handleGetRetrievalCandidates)
 
-	e.GET("/gw/:path", s.handleGateway)
+	e.GET("/gw/*", s.handleGateway)
+	e.GET("/share/:token", s.handleServeShareLink)
+	e.GET("/share/:token/*", s.handleServeShareLink)
 
 	user := e.Group("/user")
 	user.Use(s.AuthRequired(util.PermLevelUser))
 	user.GET("/api-keys", withUser(s.handleUserGetApiKeys))
 	user.POST("/api-keys", withUser(s.handleUserCreateApiKey))
 	user.DELETE("/api-keys/:key", withUser(s.handleUserRevokeApiKey))
-	user.GET("/export", withUser(s.handleUserExportData))
-	user.PUT("/password", withUser(s.handleUserChangePassword))
-	user.PUT("/address", withUser(s.handleUserChangeAddress))
+	user.GET("/export", withUser(accountWide(s.handleUserExportData)))
+	user.PUT("/password", withUser(accountWide(s.handleUserChangePassword)))
+	user.PUT("/address", withUser(accountWide(s.handleUserChangeAddress)))
 	user.GET("/stats", withUser(s.handleGetUserStats))
+	user.GET("/stats/dedupe", withUser(accountWide(s.handleGetUserDedupeStats)))
+	user.GET("/usage", withUser(accountWide(s.handleGetUserUsage)))
+	user.GET("/usage/export", withUser(accountWide(s.handleExportUserUsage)))
+	user.GET("/egress", withUser(accountWide(s.handleGetUserEgress)))
+	user.GET("/notifications", withUser(accountWide(s.handleGetNotificationSettings)))
+	user.PUT("/notifications", withUser(accountWide(s.handlePutNotificationSettings)))
+	user.POST("/notifications/verify", withUser(accountWide(s.handleVerifyNotificationEmail)))
+	user.GET("/renewal-policy", withUser(accountWide(s.handleGetRenewalPolicy)))
+	user.PUT("/renewal-policy", withUser(accountWide(s.handleSetRenewalPolicy)))
+	user.GET("/origins", withUser(accountWide(s.handleGetUserOrigins)))
+	user.PUT("/origins", withUser(accountWide(s.handleSetUserOrigins)))
+	user.GET("/providers", withUser(accountWide(s.handleGetUserProviders)))
+	user.PUT("/providers", withUser(accountWide(s.handleSetUserProviders)))
+	user.GET("/share-links", withUser(s.handleListShareLinks))
+	user.POST("/share-links", withUser(s.handleCreateShareLink))
+	user.DELETE("/share-links/:token", withUser(s.handleDeleteShareLink))
+	user.POST("/ucan", withUser(accountWide(s.handleSetUCANAccountKey)))
+	user.DELETE("/ucan", withUser(accountWide(s.handleRevokeUCANAccountKey)))
+	user.GET("/identities", withUser(accountWide(s.handleGetUserIdentities)))
+	user.POST("/identities/wallet", withUser(accountWide(s.handleLinkWallet)))
+	user.POST("/identities/:provider", withUser(accountWide(s.handleLinkUserIdentity)))
+	user.DELETE("/identities/:provider", withUser(accountWide(s.handleUnlinkUserIdentity)))
 
 	userMiner := user.Group("/miner")
-	userMiner.POST("/claim", withUser(s.handleUserClaimMiner))
-	userMiner.GET("/claim/:miner", withUser(s.handleUserGetClaimMinerMsg))
-	userMiner.POST("/suspend/:miner", withUser(s.handleSuspendMiner))
-	userMiner.PUT("/unsuspend/:miner", withUser(s.handleUnsuspendMiner))
-	userMiner.PUT("/set-info/:miner", withUser(s.handleMinersSetInfo))
+	userMiner.POST("/claim", withUser(accountWide(s.handleUserClaimMiner)))
+	userMiner.GET("/claim/:miner", withUser(accountWide(s.handleUserGetClaimMinerMsg)))
+	userMiner.POST("/suspend/:miner", withUser(accountWide(s.handleSuspendMiner)))
+	userMiner.PUT("/unsuspend/:miner", withUser(accountWide(s.handleUnsuspendMiner)))
+	userMiner.PUT("/set-info/:miner", withUser(accountWide(s.handleMinersSetInfo)))
 
 	contmeta := e.Group("/content")
 	uploads := contmeta.Group("", s.AuthRequired(util.PermLevelUpload))
-	uploads.POST("/add", withUser(s.handleAdd))
-	uploads.POST("/add-ipfs", withUser(s.handleAddIpfs))
-	uploads.POST("/add-car", util.WithContentLengthCheck(withUser(s.handleAddCar)))
+	uploads.POST("/add", withUser(s.handleAdd), s.diskMon.Middleware, s.drain.Middleware)
+	uploads.POST("/add-ipfs", withUser(s.handleAddIpfs), s.diskMon.Middleware, s.drain.Middleware)
+	uploads.POST("/add-car", util.WithContentLengthCheck(withUser(s.handleAddCar)), s.diskMon.Middleware, s.drain.Middleware)
 	uploads.POST("/create", withUser(s.handleCreateContent))
+	uploads.POST("/:id/clone", withUser(s.handleCloneContent))
 	uploads.DELETE("/remove", withUser(s.handleRemove))
 
 	content := contmeta.Group("", s.AuthRequired(util.PermLevelUser))
 	content.GET("/by-cid/:cid", s.handleGetContentByCid)
+	content.GET("/names", withUser(s.handleListContentNames))
+	content.POST("/names", withUser(s.handleCreateContentName))
+	content.GET("/names/:name", withUser(s.handleGetContentName))
+	content.DELETE("/names/:name", withUser(s.handleDeleteContentName))
+	content.GET("/names/:name/versions", withUser(s.handleListContentVersions))
+	content.POST("/names/:name/versions", withUser(s.handleAddContentVersion))
+	content.GET("/names/:name/versions/:version", withUser(s.handleGetContentVersion))
+	content.POST("/names/:name/rollback", withUser(s.handleRollbackContentName))
+	content.GET("/names/:name/data", withUser(s.handleFetchContentName))
+	content.GET("/names/:name/data/*", withUser(s.handleFetchContentName))
 	content.GET("/stats", withUser(s.handleStats))
 	content.GET("/ensure-replication/:datacid", s.handleEnsureReplication)
 	content.GET("/status/:id", withUser(s.handleContentStatus))
+	content.GET("/:id/decrypt", withUser(s.handleDecryptContent))
+	content.PUT("/:id/private", withUser(s.handleSetContentPrivate))
+	content.GET("/:id/retention", withUser(s.handleGetContentRetention))
+	content.PUT("/:id/retention", withUser(s.handleSetContentRetention))
+	content.GET("/:id/inclusion-proof", withUser(s.handleGetInclusionProof))
+	content.GET("/:id/car-index", withUser(s.handleGetCarIndex))
+	content.GET("/:id/dag-stat", withUser(s.handleGetDagStat))
+	content.GET("/:id/diff/:to", withUser(s.handleGetContentDiff))
+	content.POST("/:id/access-tokens", withUser(s.handleCreateAccessToken))
+	content.POST("/:id/purge", withUser(s.handlePurgeContent))
+	content.GET("/:id/scans", withUser(s.handleGetContentScans))
+	content.POST("/:id/appeal", withUser(s.handleAppealScan))
+	content.GET("/purges/:id", withUser(s.handleGetPurge))
 	content.GET("/list", withUser(s.handleListContent))
 	content.GET("/deals", withUser(s.handleListContentWithDeals))
 	content.GET("/failures/:content", withUser(s.handleGetContentFailures))
@@ -172,6 +248,11 @@ func (s *Server) ServeAPI() error {
 	content.GET("/staging-zones", withUser(s.handleGetStagingZoneForUser))
 	content.GET("/aggregated/:content", withUser(s.handleGetAggregatedForContent))
 	content.GET("/all-deals", withUser(s.handleGetAllDealsForUser))
+	content.GET("/events", withUser(accountWide(s.handleGetContentEvents)))
+	content.GET("/receipts/:content", withUser(s.handleGetContentReceipts))
+
+	// storage providers fetch deal data with the token of the deal
+	e.GET("/deal-data/:deal", s.handleServeDealData)
 
 	// TODO: the commented out routes here are still fairly useful, but maybe
 	// need to have some sort of 'super user' permission level in order to use
@@ -182,6 +263,8 @@ func (s *Server) ServeAPI() error {
 	deals.GET("/status-by-proposal/:propcid", withUser(s.handleGetDealStatusByPropCid))
 	deals.GET("/query/:miner", s.handleQueryAsk)
 	deals.POST("/make/:miner", withUser(s.handleMakeDeal))
+	deals.GET("/expiring", withUser(s.handleGetExpiringDeals))
+	deals.GET("/offline/:miner", withUser(s.handleGetOfflineDeals))
 	//deals.POST("/transfer/start/:miner/:propcid/:datacid", s.handleTransferStart)
 	deals.GET("/transfer/status/:id", s.handleTransferStatusByID)
 	deals.POST("/transfer/status", s.handleTransferStatus)
@@ -201,16 +284,33 @@ func (s *Server) ServeAPI() error {
 	cols.GET("/content", withUser(s.handleGetCollectionContents))
 	cols.POST("/:coluuid/commit", withUser(s.handleCommitCollection))
 
+	orgs := e.Group("/orgs")
+	orgs.Use(s.AuthRequired(util.PermLevelUser))
+	orgs.GET("", withUser(accountWide(s.handleListOrgs)))
+	orgs.POST("", withUser(accountWide(s.handleCreateOrg)))
+	orgs.GET("/:org", withUser(accountWide(s.handleGetOrg)))
+	orgs.DELETE("/:org", withUser(accountWide(s.handleDeleteOrg)))
+	orgs.GET("/:org/members", withUser(accountWide(s.handleGetOrgMembers)))
+	orgs.PUT("/:org/members/:username", withUser(accountWide(s.handleSetOrgMember)))
+	orgs.DELETE("/:org/members/:username", withUser(accountWide(s.handleRemoveOrgMember)))
+	orgs.GET("/:org/collections", withUser(s.handleListOrgCollections))
+	orgs.POST("/:org/collections", withUser(s.handleCreateOrgCollection))
+	orgs.GET("/:org/usage/export", withUser(accountWide(s.handleExportOrgUsage)))
+
 	colfs := cols.Group("/fs")
-	colfs.POST("/add", withUser(s.handleColfsAdd))
+	colfs.POST("/add", withUser(s.handleColfsAdd), s.diskMon.Middleware, s.drain.Middleware)
+
+	if s.estuaryCfg.S3.Enabled {
+		s.registerS3Routes(e)
+	}
 
 	pinning := e.Group("/pinning")
 	pinning.Use(openApiMiddleware)
 	pinning.Use(s.AuthRequired(util.PermLevelUser))
 	pinning.GET("/pins", withUser(s.handleListPins))
-	pinning.POST("/pins", withUser(s.handleAddPin))
+	pinning.POST("/pins", withUser(s.handleAddPin), s.diskMon.Middleware, s.drain.Middleware)
 	pinning.GET("/pins/:pinid", withUser(s.handleGetPin))
-	pinning.POST("/pins/:pinid", withUser(s.handleReplacePin))
+	pinning.POST("/pins/:pinid", withUser(s.handleReplacePin), s.diskMon.Middleware, s.drain.Middleware)
 	pinning.DELETE("/pins/:pinid", withUser(s.handleDeletePin))
 
 	// explicitly public, for now
@@ -220,6 +320,10 @@ func (s *Server) ServeAPI() error {
 	public.GET("/by-cid/:cid", s.handleGetContentByCid)
 	public.GET("/deals/failures", s.handlePublicStorageFailures)
 	public.GET("/info", s.handleGetPublicNodeInfo)
+	public.GET("/retrieval/price/:cid", s.handleGetRetrievalPrice)
+	public.GET("/retrieval/restore/:cid", s.handleGetRestoreStatus)
+	public.POST("/receipts/verify", s.handleVerifyReceipt)
+	public.GET("/ucan", s.handleGetUCANNode)
 	public.GET("/miners", s.handlePublicGetMinerStats)
 
 	metrics := public.Group("/metrics")
@@ -239,11 +343,51 @@ func (s *Server) ServeAPI() error {
 	admin := e.Group("/admin")
 	admin.Use(s.AuthRequired(util.PermLevelAdmin))
 	admin.GET("/balance", s.handleAdminBalance)
+	admin.GET("/denylist", s.handleAdminListDenylist)
+	admin.POST("/denylist", withUser(s.handleAdminAddDenylist))
+	admin.DELETE("/denylist/:id", s.handleAdminRemoveDenylist)
+	admin.GET("/denylist/blocks", s.handleAdminListDenylistBlocks)
+	admin.GET("/scans", s.handleAdminListScans)
+	admin.POST("/scans/:id/review", withUser(s.handleAdminReviewScan))
+	admin.GET("/reprovide", s.handleAdminReprovideHealth)
+	admin.GET("/retrieval/channels", s.handleAdminListPaychs)
 	admin.POST("/add-escrow/:amt", s.handleAdminAddEscrow)
 	admin.GET("/dealstats", s.handleDealStats)
+	admin.GET("/deals/stuck", s.handleAdminGetStuckDeals)
+	admin.GET("/deals/expiring", s.handleAdminGetExpiringDeals)
+	admin.GET("/datacap", s.handleAdminGetDatacap)
+	admin.GET("/datacap/ledger", s.handleAdminGetDatacapLedger)
+	admin.GET("/chain", s.handleAdminGetChain)
+	admin.PUT("/orgs/:org/quota", s.handleAdminSetOrgQuota)
+	admin.GET("/usage/export", s.handleAdminExportUsage)
+	admin.PUT("/billing/:kind/:id", s.handleAdminSetBillingAccount)
 	admin.GET("/disk-info", s.handleDiskSpaceCheck)
+	admin.GET("/disk-pressure", s.handleAdminGetDiskPressure)
 	admin.GET("/stats", s.handleAdminStats)
+	admin.GET("/stats/dedupe", s.handleAdminGetDedupeStats)
 	admin.GET("/system/config", withUser(s.handleGetSystemConfig))
+	admin.GET("/debug/state", s.handleAdminDebugState)
+	admin.GET("/alerts", s.handleAdminGetAlerts)
+	admin.GET("/jobs", s.handleAdminListJobs)
+	admin.POST("/jobs/:name/:action", s.handleAdminJobAction)
+	admin.GET("/drain", s.handleAdminDrainStatus)
+	admin.POST("/drain", s.handleAdminDrain)
+	admin.GET("/pin-queue", s.handleAdminListPinQueue)
+	admin.GET("/pin-queue/stats", s.handleAdminGetPinQueueStats)
+	admin.DELETE("/pin-queue/:content", s.handleAdminCancelPin)
+	admin.POST("/pin-queue/:content/boost", s.handleAdminBoostPin)
+	admin.GET("/pin-queue/dead-letter", s.handleAdminListDeadLetters)
+	admin.POST("/pin-queue/dead-letter/:content/retry", s.handleAdminRetryDeadLetter)
+	admin.GET("/backup", s.handleAdminBackup)
+	admin.GET("/events", s.handleAdminGetContentEvents)
+	admin.GET("/faults", s.handleAdminListFaults)
+	admin.PUT("/faults/:point", s.handleAdminSetFault)
+	admin.DELETE("/faults/:point", s.handleAdminClearFault)
+	admin.GET("/feature-flags", s.handleAdminListFeatureFlags)
+	admin.PUT("/feature-flags/:name", s.handleAdminSetFeatureFlag)
+	admin.DELETE("/feature-flags/:name", s.handleAdminResetFeatureFlag)
+	admin.PUT("/feature-flags/:name/users/:user", s.handleAdminSetFeatureFlagUser)
+	admin.DELETE("/feature-flags/:name/users/:user", s.handleAdminClearFeatureFlagUser)
 
 	// miners
 	admin.POST("/miners/add/:miner", s.handleAdminAddMiner)
@@ -253,6 +397,8 @@ func (s *Server) ServeAPI() error {
 	admin.PUT("/miners/set-info/:miner", withUser(s.handleMinersSetInfo))
 	admin.GET("/miners", s.handleAdminGetMiners)
 	admin.GET("/miners/stats", s.handleAdminGetMinerStats)
+	admin.GET("/miners/reputation", s.handleAdminGetMinerReputations)
+	admin.GET("/miners/failure-reasons", s.handleAdminGetFailureReasons)
 	admin.GET("/miners/transfers/:miner", s.handleMinerTransferDiagnostics)
 
 	admin.GET("/cm/progress", s.handleAdminGetProgress)
@@ -263,6 +409,10 @@ func (s *Server) ServeAPI() error {
 	admin.POST("/cm/offload/:content", s.handleOffloadContent)
 	admin.POST("/cm/offload/collect", s.handleRunOffloadingCollection)
 	admin.GET("/cm/refresh/:content", s.handleRefreshContent)
+	admin.GET("/cm/tiers", s.handleAdminListTiers)
+	admin.GET("/cm/audits", s.handleAdminListAudits)
+	admin.GET("/cm/tier/:content", s.handleAdminGetContentTier)
+	admin.PUT("/cm/tier/:content", s.handleAdminSetContentTier)
 	admin.POST("/cm/gc", s.handleRunGc)
 	admin.POST("/cm/move", s.handleMoveContent)
 	admin.GET("/cm/buckets", s.handleGetBucketDiag)
@@ -293,13 +443,17 @@ func (s *Server) ServeAPI() error {
 
 	admin.GET("/fixdeals", s.handleFixupDeals)
 	admin.POST("/loglevel", s.handleLogLevel)
+	admin.GET("/loglevel", s.handleGetLogLevels)
 
 	users := admin.Group("/users")
 	users.GET("", s.handleAdminGetUsers)
+	users.PUT("/:id/plan", s.handleAdminSetUserPlan)
 
 	shuttle := admin.Group("/shuttle")
 	shuttle.POST("/init", s.handleShuttleInit)
 	shuttle.GET("/list", s.handleShuttleList)
+	shuttle.GET("/:handle/bandwidth", s.handleAdminGetShuttleBandwidth)
+	shuttle.PUT("/:handle/bandwidth", s.handleAdminSetShuttleBandwidth)
 
 	ar := admin.Group("/autoretrieve")
 	ar.POST("/init", s.handleAutoretrieveInit)
@@ -309,11 +463,17 @@ func (s *Server) ServeAPI() error {
 
 	e.GET("/shuttle/conn", s.handleShuttleConnection)
 	e.POST("/shuttle/content/create", s.handleShuttleCreateContent, s.withShuttleAuth())
+	e.GET("/shuttle/access/:cid", s.handleShuttleCheckAccess, s.withShuttleAuth())
+	e.GET("/shuttle/denylist", s.handleShuttleGetDenylist, s.withShuttleAuth())
+	e.POST("/shuttle/access/served/:ticket", s.handleShuttleRetrievalServed, s.withShuttleAuth())
 
 	if os.Getenv("ENABLE_SWAGGER_ENDPOINT") == "true" {
 		e.GET("/swagger/*", echoSwagger.WrapHandler)
 	}
-	return e.Start(s.estuaryCfg.ApiListen)
+	if err := e.Start(s.estuaryCfg.ApiListen); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
 }
 
 type binder struct{}
@@ -323,27 +483,6 @@ func (b binder) Bind(i interface{}, c echo.Context) error {
 	return json.NewDecoder(c.Request().Body).Decode(i)
 }
 
-func serveCpuProfile(c echo.Context) error {
-	if err := pprof.StartCPUProfile(c.Response()); err != nil {
-		return err
-	}
-
-	defer pprof.StopCPUProfile()
-
-	select {
-	case <-c.Request().Context().Done():
-		return c.Request().Context().Err()
-	case <-time.After(time.Second * 30):
-	}
-
-	return nil
-}
-
-func serveProfile(c echo.Context) error {
-	httpprof.Handler(c.Param("prof")).ServeHTTP(c.Response().Writer, c.Request())
-	return nil
-}
-
 type statsResp struct {
 	ID              uint    `json:"id"`
 	Cid             cid.Cid `json:"cid"`
@@ -401,7 +540,7 @@ func (s *Server) handleStats(c echo.Context, u *User) error {
 	}
 
 	var contents []util.Content
-	if err := s.DB.Limit(limit).Offset(offset).Order("created_at desc").Find(&contents, "user_id = ? and active", u.ID).Error; err != nil {
+	if err := util.ReadReplica(s.DB).Limit(limit).Offset(offset).Order("created_at desc").Scopes(inNamespace(u)).Find(&contents, "user_id = ? and active", u.ID).Error; err != nil {
 		return err
 	}
 
@@ -623,11 +762,13 @@ func (s *Server) handleAddIpfs(c echo.Context, u *User) error {
 	}
 
 	var cols []*CollectionRef
+	var col *Collection
 	if params.CollectionID != "" {
-		var srchCol Collection
-		if err := s.DB.First(&srchCol, "uuid = ? and user_id = ?", params.CollectionID, u.ID).Error; err != nil {
+		srchCol, err := s.getCollectionForUpload(ctx, u, params.CollectionID)
+		if err != nil {
 			return err
 		}
+		col = srchCol
 
 		// if dir is "" or nil, put the file on the root dir (/filename)
 		defaultPath := "/" + filename
@@ -673,7 +814,7 @@ func (s *Server) handleAddIpfs(c echo.Context, u *User) error {
 
 	if c.QueryParam("ignore-dupes") == "true" {
 		var count int64
-		if err := s.DB.Model(util.Content{}).Where("cid = ? and user_id = ?", rcid.Bytes(), u.ID).Count(&count).Error; err != nil {
+		if err := s.DB.Model(util.Content{}).Scopes(inNamespace(u)).Where("cid = ? and user_id = ?", rcid.Bytes(), u.ID).Count(&count).Error; err != nil {
 			return err
 		}
 		if count > 0 {
@@ -681,8 +822,32 @@ func (s *Server) handleAddIpfs(c echo.Context, u *User) error {
 		}
 	}
 
+	if err := s.checkPinQuota(c, u); err != nil {
+		return err
+	}
+
+	if err := s.checkPinSize(c, u, rcid); err != nil {
+		return err
+	}
+
+	// the size of a pin is only known once it is fetched, a cap on it is
+	// checked against what is known now and again once it is pinned
+	var meta map[string]interface{}
+	if u.ucanMaxSize > 0 {
+		if est, ok, err := s.CM.dagSizes.Peek(ctx, rcid); err == nil && ok {
+			if err := checkUCANMaxSize(u, est.Size); err != nil {
+				return err
+			}
+		}
+		meta = map[string]interface{}{pinMetaMaxSize: u.ucanMaxSize}
+	}
+	meta, err = s.capPinToOrgQuota(ctx, col, meta)
+	if err != nil {
+		return err
+	}
+
 	makeDeal := true
-	pinstatus, err := s.CM.pinContent(ctx, u.ID, rcid, filename, cols, origins, 0, nil, makeDeal)
+	pinstatus, err := s.CM.pinContent(ctx, u.ID, u.namespace(), rcid, filename, cols, origins, 0, meta, makeDeal)
 	if err != nil {
 		return err
 	}
@@ -772,7 +937,7 @@ func (s *Server) handleAddCar(c echo.Context, u *User) error {
 	bserv := blockservice.New(sbs, nil)
 	dserv := merkledag.NewDAGService(bserv)
 
-	cont, err := s.CM.addDatabaseTracking(ctx, u, dserv, rootCID, filename, s.CM.Replication)
+	cont, err := s.CM.addDatabaseTracking(ctx, u, dserv, rootCID, filename, s.CM.replicationFactor(), "", nil)
 	if err != nil {
 		return err
 	}
@@ -790,6 +955,7 @@ func (s *Server) handleAddCar(c echo.Context, u *User) error {
 		if err := s.Node.Provider.Provide(rootCID); err != nil {
 			log.Warnf("failed to announce providers: %s", err)
 		}
+		s.CM.provideDag(context.Background(), cont.ID, rootCID)
 	}()
 
 	return c.JSON(http.StatusOK, &util.ContentAddResponse{
@@ -816,6 +982,12 @@ func (s *Server) loadCar(ctx context.Context, bs blockstore.Blockstore, r io.Rea
 // @Param        file formData file true "File to upload"
 // @Param        coluuid path string false "Collection UUID"
 // @Param        dir path string false "Directory"
+// @Param        chunker query string false "Chunker: size (default), rabin, buzhash or a full chunker spec"
+// @Param        chunk-size query string false "Chunk size in bytes, the average size for rabin"
+// @Param        cid-version query int false "CID version, 0 or 1"
+// @Param        hash query string false "Hash function: sha2-256, sha2-512, sha3-256 or blake2b-256"
+// @Param        inline-limit query int false "Blocks up to this size are inlined as identity CIDs, 0 to turn off"
+// @Param        X-Estuary-Encryption-Key header string false "Base64 key to encrypt the content with before it is stored"
 // @Router       /content/add [post]
 func (s *Server) handleAdd(c echo.Context, u *User) error {
 	ctx, span := s.tracer.Start(c.Request().Context(), "handleAdd", trace.WithAttributes(attribute.Int("user", int(u.ID))))
@@ -825,6 +997,11 @@ func (s *Server) handleAdd(c echo.Context, u *User) error {
 		return err
 	}
 
+	kek, err := s.encryptionKey(c)
+	if err != nil {
+		return err
+	}
+
 	if s.CM.localContentAddingDisabled {
 		return s.redirectContentAdding(c, u)
 	}
@@ -855,6 +1032,15 @@ func (s *Server) handleAdd(c echo.Context, u *User) error {
 		filename = fvname
 	}
 
+	importOpts, err := util.ImportOptionsFromParams(s.importDefaults, util.ImportParamsFrom(c.FormValue))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid import options: %s", err),
+		}
+	}
+
 	fi, err := mpf.Open()
 	if err != nil {
 		return err
@@ -862,7 +1048,18 @@ func (s *Server) handleAdd(c echo.Context, u *User) error {
 
 	defer fi.Close()
 
-	replication := s.CM.Replication
+	var data io.Reader = fi
+	var enc *util.ContentEncryption
+	if kek != nil {
+		var wrapped []byte
+		data, wrapped, err = encrypt.EncryptNewKey(fi, kek)
+		if err != nil {
+			return err
+		}
+		enc = &util.ContentEncryption{WrappedKey: wrapped, Size: mpf.Size}
+	}
+
+	replication := s.CM.replicationFactor()
 	replVal := c.FormValue("replication")
 	if replVal != "" {
 		parsed, err := strconv.Atoi(replVal)
@@ -876,12 +1073,12 @@ func (s *Server) handleAdd(c echo.Context, u *User) error {
 	coluuid := c.QueryParam("coluuid")
 	var col *Collection
 	if coluuid != "" {
-		var srchCol Collection
-		if err := s.DB.First(&srchCol, "uuid = ? and user_id = ?", coluuid, u.ID).Error; err != nil {
+		srchCol, err := s.getCollectionForUpload(c.Request().Context(), u, coluuid)
+		if err != nil {
 			return err
 		}
 
-		col = &srchCol
+		col = srchCol
 	}
 
 	defaultPath := "/"
@@ -911,11 +1108,22 @@ func (s *Server) handleAdd(c echo.Context, u *User) error {
 	bserv := blockservice.New(bs, nil)
 	dserv := merkledag.NewDAGService(bserv)
 
-	nd, err := s.importFile(ctx, dserv, fi)
+	nd, err := s.importFile(ctx, dserv, data, importOpts)
 	if err != nil {
 		return err
 	}
 
+	// the size of an upload is only known once it is imported
+	if col != nil {
+		size, err := nd.Size()
+		if err != nil {
+			return err
+		}
+		if err := s.checkOrgQuota(ctx, col, int64(size)); err != nil {
+			return err
+		}
+	}
+
 	if c.QueryParam("ignore-dupes") == "true" {
 		isDup, err := s.isDupCIDContent(c, nd.Cid(), u)
 		if err != nil || isDup {
@@ -923,7 +1131,7 @@ func (s *Server) handleAdd(c echo.Context, u *User) error {
 		}
 	}
 
-	content, err := s.CM.addDatabaseTracking(ctx, u, dserv, nd.Cid(), filename, replication)
+	content, err := s.CM.addDatabaseTracking(ctx, u, dserv, nd.Cid(), filename, replication, importOpts.Chunker, enc)
 	if err != nil {
 		return xerrors.Errorf("encountered problem computing object references: %w", err)
 	}
@@ -961,6 +1169,7 @@ func (s *Server) handleAdd(c echo.Context, u *User) error {
 		if err := s.Node.Provider.Provide(nd.Cid()); err != nil {
 			log.Warnf("failed to announce providers: %s", err)
 		}
+		s.CM.provideDag(context.Background(), content.ID, nd.Cid())
 	}()
 
 	return c.JSON(http.StatusOK, &util.ContentAddResponse{
@@ -988,12 +1197,12 @@ func (s *Server) handleRemove(c echo.Context, u *User) error {
 	coluuid := c.QueryParam("coluuid")
 	var col *Collection
 	if coluuid != "" {
-		var srchCol Collection
-		if err := s.DB.First(&srchCol, "uuid = ? and user_id = ?", coluuid, u.ID).Error; err != nil {
+		srchCol, err := s.getCollection(c.Request().Context(), u, coluuid, orgRoleUploader)
+		if err != nil {
 			return err
 		}
 
-		col = &srchCol
+		col = srchCol
 	}
 	
 	defaultPath := "/"
@@ -1063,11 +1272,14 @@ func (s *Server) redirectContentAdding(c echo.Context, u *User) error {
 	return nil
 }
 
-func (s *Server) importFile(ctx context.Context, dserv ipld.DAGService, fi io.Reader) (ipld.Node, error) {
-	_, span := s.tracer.Start(ctx, "importFile")
+func (s *Server) importFile(ctx context.Context, dserv ipld.DAGService, fi io.Reader, opts util.ImportOptions) (ipld.Node, error) {
+	_, span := s.tracer.Start(ctx, "importFile", trace.WithAttributes(
+		attribute.String("chunker", opts.Chunker),
+		attribute.Int("cidVersion", opts.CidVersion),
+	))
 	defer span.End()
 
-	return util.ImportFile(dserv, fi)
+	return util.ImportFileWithOptions(dserv, fi, opts)
 }
 
 var noDataTimeout = time.Minute * 10
@@ -1099,6 +1311,16 @@ func (cm *ContentManager) addDatabaseTrackingToContent(ctx context.Context, cont
 	var objlk sync.Mutex
 	var objects []*util.Object
 	cset := cid.NewSet()
+	visit := func(c cid.Cid) bool {
+		if !cset.Visit(c) {
+			return false
+		}
+		// track the cid as soon as it is visited so gc leaves it alone
+		cm.inflightCidsLk.Lock()
+		cm.inflightCids[c]++
+		cm.inflightCidsLk.Unlock()
+		return true
+	}
 
 	defer func() {
 		cm.inflightCidsLk.Lock()
@@ -1117,17 +1339,8 @@ func (cm *ContentManager) addDatabaseTrackingToContent(ctx context.Context, cont
 		cm.inflightCidsLk.Unlock()
 	}()
 
-	err := merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
-		// cset.Visit gets called first, so if we reach here we should immediately track the CID
-		cm.inflightCidsLk.Lock()
-		cm.inflightCids[c]++
-		cm.inflightCidsLk.Unlock()
-
-		node, err := dserv.Get(ctx, c)
-		if err != nil {
-			return nil, err
-		}
-
+	err := dagwalk.Walk(ctx, dserv, root, visit, func(ctx context.Context, node ipld.Node) ([]*ipld.Link, error) {
+		c := node.Cid()
 		cb(int64(len(node.RawData())))
 
 		select {
@@ -1147,7 +1360,7 @@ func (cm *ContentManager) addDatabaseTrackingToContent(ctx context.Context, cont
 		}
 
 		return util.FilterUnwalkableLinks(node.Links()), nil
-	}, root, cset.Visit, merkledag.Concurrent())
+	}, cm.dagFetchOptions())
 
 	if err != nil {
 		return err
@@ -1155,23 +1368,30 @@ func (cm *ContentManager) addDatabaseTrackingToContent(ctx context.Context, cont
 	return cm.addObjectsToDatabase(ctx, cont, dserv, root, objects, constants.ContentLocationLocal)
 }
 
-func (cm *ContentManager) addDatabaseTracking(ctx context.Context, u *User, dserv ipld.NodeGetter, root cid.Cid, filename string, replication int) (*util.Content, error) {
+func (cm *ContentManager) addDatabaseTracking(ctx context.Context, u *User, dserv ipld.NodeGetter, root cid.Cid, filename string, replication int, chunker string, enc *util.ContentEncryption) (*util.Content, error) {
 	ctx, span := cm.tracer.Start(ctx, "computeObjRefs")
 	defer span.End()
 
+	if err := cm.denylist.check(ctx, root, denyPin, u.ID, ""); err != nil {
+		return nil, err
+	}
+
 	content := &util.Content{
 		Cid:         util.DbCID{CID: root},
 		Name:        filename,
 		Active:      false,
 		Pinning:     true,
 		UserID:      u.ID,
+		Namespace:   u.namespace(),
 		Replication: replication,
 		Location:    constants.ContentLocationLocal,
+		Chunker:     chunker,
 	}
 
-	if err := cm.DB.Create(content).Error; err != nil {
+	if err := cm.createContent(ctx, content, enc); err != nil {
 		return nil, xerrors.Errorf("failed to track new content in database: %w", err)
 	}
+	cm.recordContentEvent(ctx, eventContentAdded, content.ID, nil)
 
 	if err := cm.addDatabaseTrackingToContent(ctx, content.ID, dserv, root, func(int64) {}); err != nil {
 		return nil, err
@@ -1249,7 +1469,7 @@ func (s *Server) handleEnsureReplication(c echo.Context) error {
 // @Router       /content/list [get]
 func (s *Server) handleListContent(c echo.Context, u *User) error {
 	var contents []util.Content
-	if err := s.DB.Find(&contents, "active and user_id = ?", u.ID).Error; err != nil {
+	if err := util.ReadReplica(s.DB).Scopes(inNamespace(u)).Find(&contents, "active and user_id = ?", u.ID).Error; err != nil {
 		return err
 	}
 
@@ -1290,7 +1510,7 @@ func (s *Server) handleListContentWithDeals(c echo.Context, u *User) error {
 	}
 
 	var contents []util.Content
-	if err := s.DB.Limit(limit).Offset(offset).Order("id desc").Find(&contents, "active and user_id = ? and not aggregated_in > 0", u.ID).Error; err != nil {
+	if err := util.ReadReplica(s.DB).Limit(limit).Offset(offset).Order("id desc").Scopes(inNamespace(u)).Find(&contents, "active and user_id = ? and not aggregated_in > 0", u.ID).Error; err != nil {
 		return err
 	}
 
@@ -1301,7 +1521,7 @@ func (s *Server) handleListContentWithDeals(c echo.Context, u *User) error {
 				Content: cont,
 			}
 			if cont.Aggregate {
-				if err := s.DB.Model(util.Content{}).Where("aggregated_in = ?", cont.ID).Count(&ec.AggregatedFiles).Error; err != nil {
+				if err := util.ReadReplica(s.DB).Model(util.Content{}).Where("aggregated_in = ?", cont.ID).Count(&ec.AggregatedFiles).Error; err != nil {
 					return err
 				}
 
@@ -1323,6 +1543,9 @@ type dealStatus struct {
 	Deal           contentDeal             `json:"deal"`
 	TransferStatus *filclient.ChannelState `json:"transfer"`
 	OnChainState   *onChainDealState       `json:"onChainState"`
+	// Progress is what the provider last said about a deal that isn't
+	// sealed yet
+	Progress *dealProgress `json:"progress,omitempty"`
 }
 
 // handleContentStatus godoc
@@ -1344,12 +1567,36 @@ func (s *Server) handleContentStatus(c echo.Context, u *User) error {
 		return err
 	}
 
-	if err := util.IsContentOwner(u.ID, content.UserID); err != nil {
+	if err := checkContentOwner(u, &content); err != nil {
 		return err
 	}
 
+	// content deduped with older content of another user is covered by the
+	// deals made for that, those are only counted
+	dealContent, err := s.CM.dealOwner(ctx, content)
+	if err != nil {
+		return err
+	}
+	var sharedDeals int64
+	if dealContent.ID != content.ID {
+		if err := util.ReadReplica(s.DB).Model(&contentDeal{}).
+			Where("content = ? AND deal_id > 0 AND NOT failed AND NOT slashed", dealContent.ID).
+			Count(&sharedDeals).Error; err != nil {
+			return err
+		}
+	}
+
 	var deals []contentDeal
-	if err := s.DB.Find(&deals, "content = ?", content.ID).Error; err != nil {
+	if err := util.ReadReplica(s.DB).Find(&deals, "content = ?", content.ID).Error; err != nil {
+		return err
+	}
+
+	ids := make([]uint, 0, len(deals))
+	for _, d := range deals {
+		ids = append(ids, d.ID)
+	}
+	progress, err := s.dealProgresses(ctx, ids)
+	if err != nil {
 		return err
 	}
 
@@ -1361,7 +1608,8 @@ func (s *Server) handleContentStatus(c echo.Context, u *User) error {
 			defer wg.Done()
 			d := deals[i]
 			dstatus := dealStatus{
-				Deal: d,
+				Deal:     d,
+				Progress: progress[d.ID],
 			}
 
 			chanst, err := s.CM.GetTransferStatus(ctx, &d, &content)
@@ -1395,15 +1643,32 @@ func (s *Server) handleContentStatus(c echo.Context, u *User) error {
 	})
 
 	var failCount int64
-	if err := s.DB.Model(&dfeRecord{}).Where("content = ?", content.ID).Count(&failCount).Error; err != nil {
+	if err := util.ReadReplica(s.DB).Model(&dfeRecord{}).Where("content = ?", content.ID).Count(&failCount).Error; err != nil {
 		return err
 	}
 
-	return c.JSON(http.StatusOK, map[string]interface{}{
+	resp := map[string]interface{}{
 		"content":       content,
 		"deals":         ds,
+		"sharedDeals":   sharedDeals,
 		"failuresCount": failCount,
-	})
+	}
+	var constraints []dealConstraint
+	if err := util.ReadReplica(s.DB).Find(&constraints, "content = ?", content.ID).Error; err != nil {
+		return err
+	}
+	if len(constraints) > 0 {
+		resp["dealConstraint"] = constraints[0]
+	}
+	// content on ipfs-cluster is replicated across the cluster peers too
+	if content.Location == constants.ContentLocationCluster {
+		peers, err := s.CM.clusterPeers(ctx, content.ID)
+		if err != nil {
+			return err
+		}
+		resp["clusterPeers"] = peers
+	}
+	return c.JSON(http.StatusOK, resp)
 }
 
 // handleGetDealStatus godoc
@@ -1473,9 +1738,15 @@ func (s *Server) dealStatusByID(ctx context.Context, dealid uint) (*dealStatus,
 		log.Errorf("failed to get transfer status: %s", err)
 	}
 
+	progress, err := s.dealProgresses(ctx, []uint{deal.ID})
+	if err != nil {
+		return nil, err
+	}
+
 	dstatus := dealStatus{
 		Deal:           deal,
 		TransferStatus: chanst,
+		Progress:       progress[deal.ID],
 	}
 
 	if deal.DealID > 0 {
@@ -1524,7 +1795,7 @@ func (s *Server) calcSelector(aggregatedIn uint, contentID uint) (string, error)
 
 // handleGetContentByCid godoc
 // @Summary      Get Content by Cid
-// @Description  This endpoint returns the content associated with a CID
+// @Description  This endpoint returns the content associated with a CID. Private content is left out.
 // @Tags         public
 // @Produce      json
 // @Param 		cid path string true "Cid"
@@ -1545,7 +1816,7 @@ func (s *Server) handleGetContentByCid(c echo.Context) error {
 	v1 := cid.NewCidV1(obj.Prefix().Codec, obj.Hash())
 
 	var contents []util.Content
-	if err := s.DB.Find(&contents, "(cid=? or cid=?) and active", v0.Bytes(), v1.Bytes()).Error; err != nil {
+	if err := s.DB.Find(&contents, "(cid=? or cid=?) and active and not private", v0.Bytes(), v1.Bytes()).Error; err != nil {
 		return err
 	}
 
@@ -1805,6 +2076,10 @@ func (s *Server) handleDealStatus(c echo.Context) error {
 		}
 		dealUUID = &parsed
 	}
+	if err := s.CM.connectProvider(ctx, addr); err != nil {
+		return xerrors.Errorf("connecting to miner: %w", err)
+	}
+
 	status, err := s.FilClient.DealStatus(ctx, addr, propCid, dealUUID)
 	if err != nil {
 		return xerrors.Errorf("getting deal status: %w", err)
@@ -2031,6 +2306,8 @@ type minerResp struct {
 	Suspended       bool            `json:"suspended"`
 	SuspendedReason string          `json:"suspendedReason,omitempty"`
 	Version         string          `json:"version"`
+	SnapDeals       bool            `json:"snapDeals"`
+	DealTransfer    string          `json:"dealTransfer,omitempty"`
 }
 
 // handleAdminGetMiners godoc
@@ -2052,6 +2329,8 @@ func (s *Server) handleAdminGetMiners(c echo.Context) error {
 		out[i].SuspendedReason = m.SuspendedReason
 		out[i].Name = m.Name
 		out[i].Version = m.Version
+		out[i].SnapDeals = m.SnapDeals
+		out[i].DealTransfer = m.DealTransfer
 	}
 
 	return c.JSON(http.StatusOK, out)
@@ -2076,7 +2355,9 @@ func (s *Server) handleAdminGetMinerStats(c echo.Context) error {
 }
 
 type minerSetInfoParams struct {
-	Name string `json:"name"`
+	Name         string  `json:"name"`
+	SnapDeals    *bool   `json:"snapDeals,omitempty"`
+	DealTransfer *string `json:"dealTransfer,omitempty"`
 }
 
 func (s *Server) handleMinersSetInfo(c echo.Context, u *User) error {
@@ -2102,7 +2383,23 @@ func (s *Server) handleMinersSetInfo(c echo.Context, u *User) error {
 		return err
 	}
 
-	if err := s.DB.Model(storageMiner{}).Where("address = ?", m.String()).Update("name", params.Name).Error; err != nil {
+	updates := map[string]interface{}{"name": params.Name}
+	if params.SnapDeals != nil {
+		updates["snap_deals"] = *params.SnapDeals
+	}
+	if params.DealTransfer != nil {
+		switch *params.DealTransfer {
+		case "", dealTransferLibp2p, dealTransferHTTP, dealTransferOffline:
+		default:
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: "dealTransfer must be empty, libp2p, http or offline",
+			}
+		}
+		updates["deal_transfer"] = *params.DealTransfer
+	}
+	if err := s.DB.Model(storageMiner{}).Where("address = ?", m.String()).UpdateColumns(updates).Error; err != nil {
 		return err
 	}
 
@@ -2238,6 +2535,11 @@ func (s *Server) handleDealStats(c echo.Context) error {
 			}
 			dealUUID = &parsed
 		}
+		if err := s.CM.connectProvider(ctx, maddr); err != nil {
+			log.Errorf("checking deal status failed (%s): %s", maddr, err)
+			continue
+		}
+
 		st, err := s.FilClient.DealStatus(ctx, maddr, d.PropCid.CID, dealUUID)
 		if err != nil {
 			log.Errorf("checking deal status failed (%s): %s", maddr, err)
@@ -2403,6 +2705,7 @@ func (s *Server) handleEstimateDealCost(c echo.Context) error {
 // @Tags         public,net
 // @Produce      json
 // @Param miner query string false "Filter by miner"
+// @Param reason query string false "Filter by cause of the failure"
 // @Router       /public/miners/failures/{miner} [get]
 func (s *Server) handleGetMinerFailures(c echo.Context) error {
 	maddr, err := address.NewFromString(c.Param("miner"))
@@ -2410,8 +2713,13 @@ func (s *Server) handleGetMinerFailures(c echo.Context) error {
 		return err
 	}
 
+	q := s.DB.Limit(1000).Order("created_at desc").Where("miner = ?", maddr.String())
+	if r := c.QueryParam("reason"); r != "" {
+		q = q.Where("reason = ?", r)
+	}
+
 	var merrs []dfeRecord
-	if err := s.DB.Limit(1000).Order("created_at desc").Find(&merrs, "miner = ?", maddr.String()).Error; err != nil {
+	if err := q.Find(&merrs).Error; err != nil {
 		return err
 	}
 
@@ -2429,6 +2737,12 @@ type minerStatsResp struct {
 	SuspendedReason string          `json:"suspendedReason"`
 
 	ChainInfo *minerChainInfo `json:"chainInfo"`
+
+	// Reputation is how deals with the miner and retrievals from it went
+	Reputation *minerDealStats `json:"reputation,omitempty"`
+
+	// FailureReasons counts the deal failures of the last 30 days by cause
+	FailureReasons map[string]int64 `json:"failureReasons,omitempty"`
 }
 
 type minerChainInfo struct {
@@ -2497,6 +2811,20 @@ func (s *Server) handleGetMinerStats(c echo.Context) error {
 		return err
 	}
 
+	reps, err := s.CM.minerReputations()
+	if err != nil {
+		return err
+	}
+
+	counts, err := s.failureReasonCounts(c.Request().Context(), maddr.String(), time.Now().Add(-time.Hour*24*30))
+	if err != nil {
+		return err
+	}
+	reasons := make(map[string]int64, len(counts))
+	for _, fc := range counts {
+		reasons[fc.Reason] += fc.Count
+	}
+
 	return c.JSON(http.StatusOK, &minerStatsResp{
 		Miner:           maddr,
 		UsedByEstuary:   true,
@@ -2507,6 +2835,8 @@ func (s *Server) handleGetMinerStats(c echo.Context) error {
 		Name:            m.Name,
 		Version:         m.Version,
 		ChainInfo:       &ci,
+		Reputation:      reps[maddr],
+		FailureReasons:  reasons,
 	})
 }
 
@@ -2580,7 +2910,7 @@ func (s *Server) handleGetContentBandwidth(c echo.Context, u *User) error {
 		return err
 	}
 
-	if err := util.IsContentOwner(u.ID, content.UserID); err != nil {
+	if err := checkContentOwner(u, &content); err != nil {
 		return err
 	}
 
@@ -2618,7 +2948,7 @@ func (s *Server) handleGetAggregatedForContent(c echo.Context, u *User) error {
 		return err
 	}
 
-	if err := util.IsContentOwner(u.ID, content.UserID); err != nil {
+	if err := checkContentOwner(u, &content); err != nil {
 		return err
 	}
 
@@ -2643,6 +2973,10 @@ func (s *Server) handleGetContentFailures(c echo.Context, u *User) error {
 		return err
 	}
 
+	if _, err := s.getOwnContentByID(u, cont); err != nil {
+		return err
+	}
+
 	var errs []dfeRecord
 	if err := s.DB.Find(&errs, "content = ?", cont).Error; err != nil {
 		return err
@@ -2760,6 +3094,16 @@ func (s *Server) handleReadLocalContent(c echo.Context) error {
 		return err
 	}
 
+	// the car is served from its layout, reading only the blocks of the
+	// range asked for
+	if c.QueryParam("format") == "car" {
+		l, err := s.CM.carLayout(c.Request().Context(), content.Cid.CID)
+		if err != nil {
+			return err
+		}
+		return carindex.Serve(c.Response(), c.Request(), l, s.Node.Blockstore.Get)
+	}
+
 	bserv := blockservice.New(s.Node.Blockstore, offline.Exchange(s.Node.Blockstore))
 	dserv := merkledag.NewDAGService(bserv)
 
@@ -2777,10 +3121,8 @@ func (s *Server) handleReadLocalContent(c echo.Context) error {
 		})
 	}
 
-	_, err = io.Copy(c.Response(), r)
-	if err != nil {
-		return err
-	}
+	// ranges seek through the dag rather than reading it up to there
+	http.ServeContent(c.Response(), c.Request(), content.Cid.CID.String(), time.Time{}, r)
 	return nil
 }
 
@@ -2836,13 +3178,22 @@ func (s *Server) AuthRequired(level int) echo.MiddlewareFunc {
 			defer span.End()
 			c.SetRequest(c.Request().WithContext(ctx))
 
-			u, err := s.checkTokenAuth(auth)
+			var u *User
+			if s.isUCAN(auth) {
+				u, err = s.checkUCANAuth(c, auth)
+			} else {
+				u, err = s.checkTokenAuth(auth)
+			}
 			if err != nil {
 				return err
 			}
 
 			span.SetAttributes(attribute.Int("user", int(u.ID)))
 
+			if err := s.checkOrigin(c, u); err != nil {
+				return err
+			}
+
 			if u.authToken.UploadOnly && level >= util.PermLevelUser {
 				log.Warnw("api key is upload only", "user", u.ID, "perm", u.Perm, "required", level)
 
@@ -2854,6 +3205,10 @@ func (s *Server) AuthRequired(level int) echo.MiddlewareFunc {
 			}
 
 			if u.Perm >= level {
+				if err := s.limits.checkRequest(c, u); err != nil {
+					return err
+				}
+
 				c.Set("user", u)
 				return next(c)
 			}
@@ -2934,9 +3289,10 @@ func (s *Server) handleRegisterUser(c echo.Context) error {
 	}
 
 	authToken := &AuthToken{
-		Token:  "EST" + uuid.New().String() + "ARY",
-		User:   newUser.ID,
-		Expiry: time.Now().Add(time.Hour * 24 * 7),
+		Token:   "EST" + uuid.New().String() + "ARY",
+		User:    newUser.ID,
+		Expiry:  time.Now().Add(time.Hour * 24 * 7),
+		Session: true,
 	}
 
 	if err := s.DB.Create(authToken).Error; err != nil {
@@ -2990,7 +3346,7 @@ func (s *Server) handleLoginUser(c echo.Context) error {
 		}
 	}
 
-	authToken, err := s.newAuthTokenForUser(&user, time.Now().Add(time.Hour*24*30), nil)
+	authToken, err := s.newAuthTokenForUser(&user, time.Now().Add(time.Hour*24*30), nil, "", true)
 	if err != nil {
 		return err
 	}
@@ -3066,17 +3422,17 @@ type userStatsResponse struct {
 // @Router       /user/stats [get]
 func (s *Server) handleGetUserStats(c echo.Context, u *User) error {
 	var stats userStatsResponse
-	if err := s.DB.Raw(` SELECT
-						(SELECT SUM(size) FROM contents where user_id = ? AND aggregated_in = 0 AND active) as total_size,
-						(SELECT COUNT(1) FROM contents where user_id = ? AND active) as num_pins`,
-		u.ID, u.ID).Scan(&stats).Error; err != nil {
+	if err := util.ReadReplica(s.DB).Raw(` SELECT
+						(SELECT SUM(size) FROM contents where user_id = ? AND (? = '' OR namespace = ?) AND aggregated_in = 0 AND active) as total_size,
+						(SELECT COUNT(1) FROM contents where user_id = ? AND (? = '' OR namespace = ?) AND active) as num_pins`,
+		u.ID, u.namespace(), u.namespace(), u.ID, u.namespace(), u.namespace()).Scan(&stats).Error; err != nil {
 		return err
 	}
 
 	return c.JSON(http.StatusOK, stats)
 }
 
-func (s *Server) newAuthTokenForUser(user *User, expiry time.Time, perms []string) (*AuthToken, error) {
+func (s *Server) newAuthTokenForUser(user *User, expiry time.Time, perms []string, namespace string, session bool) (*AuthToken, error) {
 	if len(perms) > 1 {
 		return nil, fmt.Errorf("invalid perms")
 	}
@@ -3098,6 +3454,8 @@ func (s *Server) newAuthTokenForUser(user *User, expiry time.Time, perms []strin
 		User:       user.ID,
 		Expiry:     expiry,
 		UploadOnly: uploadOnly,
+		Namespace:  namespace,
+		Session:    session,
 	}
 
 	if err := s.DB.Create(authToken).Error; err != nil {
@@ -3120,8 +3478,8 @@ func (s *Server) handleGetViewer(c echo.Context, u *User) error {
 		Address:  u.Address.Addr.String(),
 		Miners:   s.getMinersOwnedByUser(u),
 		Settings: util.UserSettings{
-			Replication:           s.CM.Replication,
-			Verified:              s.CM.VerifiedDeal,
+			Replication:           s.CM.replicationFactor(),
+			Verified:              s.CM.verifiedDeals(),
 			DealDuration:          constants.DealDuration,
 			MaxStagingWait:        constants.MaxStagingZoneLifetime,
 			FileStagingThreshold:  int64(constants.IndividualDealThreshold),
@@ -3201,8 +3559,9 @@ func (s *Server) handleHealth(c echo.Context) error {
 }
 
 type getApiKeysResp struct {
-	Token  string    `json:"token"`
-	Expiry time.Time `json:"expiry"`
+	Token     string    `json:"token"`
+	Expiry    time.Time `json:"expiry"`
+	Namespace string    `json:"namespace,omitempty"`
 }
 
 // handleUserRevokeApiKey godoc
@@ -3215,7 +3574,7 @@ type getApiKeysResp struct {
 func (s *Server) handleUserRevokeApiKey(c echo.Context, u *User) error {
 	kval := c.Param("key")
 
-	if err := s.DB.Delete(&AuthToken{}, "\"user\" = ? AND token = ?", u.ID, kval).Error; err != nil {
+	if err := s.DB.Scopes(inNamespace(u)).Delete(&AuthToken{}, "\"user\" = ? AND token = ?", u.ID, kval).Error; err != nil {
 		return err
 	}
 
@@ -3227,6 +3586,7 @@ func (s *Server) handleUserRevokeApiKey(c echo.Context, u *User) error {
 // @Description  This endpoint is used to create API keys for a user. In estuary, each user is given an API key to access all features.
 // @Tags         User
 // @Produce      json
+// @Param        namespace  query  string  false  "Namespace to confine the key to"
 // @Success      200  {object}  getApiKeysResp
 // @Failure      400  {object}  util.HttpError
 // @Failure      404  {object}  util.HttpError
@@ -3251,14 +3611,35 @@ func (s *Server) handleUserCreateApiKey(c echo.Context, u *User) error {
 		perms = strings.Split(p, ",")
 	}
 
-	authToken, err := s.newAuthTokenForUser(u, expiry, perms)
+	// keys of a namespace only make keys of the same namespace
+	ns := c.QueryParam("namespace")
+	if ns == "" {
+		ns = u.namespace()
+	}
+	if ns != "" && !validNamespace(ns) {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_QUERY_PARAM_VALUE,
+			Details: fmt.Sprintf("invalid namespace %q, namespaces are up to 64 lowercase letters, digits, '.', '_' and '-'", ns),
+		}
+	}
+	if !u.sees(ns) {
+		return &util.HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  util.ERR_NOT_AUTHORIZED,
+			Details: "keys of a namespace can not make keys for other namespaces",
+		}
+	}
+
+	authToken, err := s.newAuthTokenForUser(u, expiry, perms, ns, false)
 	if err != nil {
 		return err
 	}
 
 	return c.JSON(http.StatusOK, &getApiKeysResp{
-		Token:  authToken.Token,
-		Expiry: authToken.Expiry,
+		Token:     authToken.Token,
+		Expiry:    authToken.Expiry,
+		Namespace: authToken.Namespace,
 	})
 }
 
@@ -3274,15 +3655,16 @@ func (s *Server) handleUserCreateApiKey(c echo.Context, u *User) error {
 // @Router       /user/api-keys [get]
 func (s *Server) handleUserGetApiKeys(c echo.Context, u *User) error {
 	var keys []AuthToken
-	if err := s.DB.Find(&keys, "auth_tokens.user = ?", u.ID).Error; err != nil {
+	if err := s.DB.Scopes(inNamespace(u)).Find(&keys, "auth_tokens.user = ?", u.ID).Error; err != nil {
 		return err
 	}
 
 	out := []getApiKeysResp{}
 	for _, k := range keys {
 		out = append(out, getApiKeysResp{
-			Token:  k.Token,
-			Expiry: k.Expiry,
+			Token:     k.Token,
+			Expiry:    k.Expiry,
+			Namespace: k.Namespace,
 		})
 	}
 
@@ -3316,6 +3698,7 @@ func (s *Server) handleCreateCollection(c echo.Context, u *User) error {
 		Name:        body.Name,
 		Description: body.Description,
 		UserID:      u.ID,
+		Namespace:   u.namespace(),
 	}
 
 	if err := s.DB.Create(col).Error; err != nil {
@@ -3338,7 +3721,8 @@ func (s *Server) handleCreateCollection(c echo.Context, u *User) error {
 // @Router       /collections/list [get]
 func (s *Server) handleListCollections(c echo.Context, u *User) error {
 	var cols []Collection
-	if err := s.DB.Find(&cols, "user_id = ?", u.ID).Error; err != nil {
+	if err := s.DB.Scopes(inNamespace(u)).Find(&cols, "(user_id = ? OR org_id IN (?))", u.ID,
+		s.DB.Model(&orgMember{}).Select("org_id").Where("user_id = ?", u.ID)).Error; err != nil {
 		return err
 	}
 
@@ -3374,13 +3758,13 @@ func (s *Server) handleAddContentsToCollection(c echo.Context, u *User) error {
 		return fmt.Errorf("too many cids specified: %d (max 128)", len(params.Cids))
 	}
 
-	var col Collection
-	if err := s.DB.First(&col, "uuid = ? and user_id = ?", params.CollectionID, u.ID).Error; err != nil {
-		return fmt.Errorf("no collection found by that uuid for your user: %w", err)
+	col, err := s.getCollectionForUpload(c.Request().Context(), u, params.CollectionID)
+	if err != nil {
+		return err
 	}
 
 	var contents []util.Content
-	if err := s.DB.Find(&contents, "id in ? and user_id = ?", params.Contents, u.ID).Error; err != nil {
+	if err := s.DB.Scopes(inNamespace(u)).Find(&contents, "id in ? and user_id = ?", params.Contents, u.ID).Error; err != nil {
 		return err
 	}
 
@@ -3391,7 +3775,7 @@ func (s *Server) handleAddContentsToCollection(c echo.Context, u *User) error {
 		}
 
 		var cont util.Content
-		if err := s.DB.First(&cont, "cid = ? and user_id = ?", util.DbCID{CID: cc}, u.ID).Error; err != nil {
+		if err := s.DB.Scopes(inNamespace(u)).First(&cont, "cid = ? and user_id = ?", util.DbCID{CID: cc}, u.ID).Error; err != nil {
 			return fmt.Errorf("failed to find content by given cid %s: %w", cc, err)
 		}
 
@@ -3428,8 +3812,8 @@ func (s *Server) handleAddContentsToCollection(c echo.Context, u *User) error {
 func (s *Server) handleCommitCollection(c echo.Context, u *User) error {
 	colid := c.Param("coluuid")
 
-	var col Collection
-	if err := s.DB.First(&col, "uuid = ? and user_id = ?", colid, u.ID).Error; err != nil {
+	col, err := s.getCollection(c.Request().Context(), u, colid, orgRoleUploader)
+	if err != nil {
 		return err
 	}
 
@@ -3464,44 +3848,40 @@ func (s *Server) handleCommitCollection(c echo.Context, u *User) error {
 		origins = append(origins, ai)
 	}
 
-	bserv := blockservice.New(s.Node.Blockstore, nil)
-	dserv := merkledag.NewDAGService(bserv)
-
-	// create DAG respecting directory structure
-	collectionNode := unixfs.EmptyDirNode()
+	// create DAG respecting directory structure, large directories are
+	// sharded so collections can hold any number of contents
+	tree := dirtree.New(s.estuaryCfg.Content.DirectoryFanout)
 	for _, c := range contents {
 		dirs, err := util.DirsFromPath(c.Path, c.Name)
 		if err != nil {
 			return err
 		}
 
-		lastDirNode, err := util.EnsurePathIsLinked(dirs, collectionNode, dserv)
-		if err != nil {
-			return err
-		}
-		err = lastDirNode.AddRawLink(c.Name, &ipld.Link{
-			Size: uint64(c.Size),
-			Cid:  c.Cid.CID,
-		})
-		if err != nil {
-			return err
+		if err := tree.Add(dirs, c.Name, c.Cid.CID, uint64(c.Size)); err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("cannot add %s to the collection: %s", c.Path, err),
+			}
 		}
 	}
 
-	if err := dserv.Add(context.Background(), collectionNode); err != nil {
+	// write the directories to the local blockstore
+	collectionCid, err := tree.Build(c.Request().Context(), s.Node.Blockstore)
+	if err != nil {
 		return err
-	} // add new CID to local blockstore
+	}
 
 	// update DB with new collection CID
-	col.CID = collectionNode.Cid().String()
-	if err := s.DB.Model(Collection{}).Where("id = ?", col.ID).UpdateColumn("c_id", collectionNode.Cid().String()).Error; err != nil {
+	col.CID = collectionCid.String()
+	if err := s.DB.Model(Collection{}).Where("id = ?", col.ID).UpdateColumn("c_id", collectionCid.String()).Error; err != nil {
 		return err
 	}
 
 	ctx := c.Request().Context()
 	makeDeal := false
 
-	pinstatus, err := s.CM.pinContent(ctx, u.ID, collectionNode.Cid(), collectionNode.Cid().String(), nil, origins, 0, nil, makeDeal)
+	pinstatus, err := s.CM.pinContent(ctx, u.ID, u.namespace(), collectionCid, collectionCid.String(), nil, origins, 0, nil, makeDeal)
 	if err != nil {
 		return err
 	}
@@ -3520,8 +3900,8 @@ func (s *Server) handleCommitCollection(c echo.Context, u *User) error {
 func (s *Server) handleGetCollectionContents(c echo.Context, u *User) error {
 	coluuid := c.QueryParam("coluuid")
 
-	var col Collection
-	if err := s.DB.First(&col, "uuid = ? and user_id = ?", coluuid, u.ID).Error; err != nil {
+	col, err := s.getCollection(c.Request().Context(), u, coluuid, orgRoleViewer)
+	if err != nil {
 		return err
 	}
 
@@ -3648,22 +4028,12 @@ func getRelativePath(r util.ContentWithPath, queryDir string) (string, error) {
 func (s *Server) handleDeleteCollection(c echo.Context, u *User) error {
 	coluuid := c.Param("coluuid")
 
-	var col Collection
-	if err := s.DB.First(&col, "uuid = ?", coluuid).Error; err != nil {
-		if xerrors.Is(err, gorm.ErrRecordNotFound) {
-			return &util.HttpError{
-				Code:    http.StatusNotFound,
-				Reason:  util.ERR_CONTENT_NOT_FOUND,
-				Details: fmt.Sprintf("collection with ID(%s) was not found", coluuid),
-			}
-		}
-	}
-
-	if err := util.IsCollectionOwner(u.ID, col.UserID); err != nil {
+	col, err := s.getCollection(c.Request().Context(), u, coluuid, orgRoleAdmin)
+	if err != nil {
 		return err
 	}
 
-	if err := s.DB.Delete(&col).Error; err != nil {
+	if err := s.DB.Delete(col).Error; err != nil {
 		return err
 	}
 	return c.NoContent(http.StatusOK)
@@ -3675,6 +4045,7 @@ func (s *Server) tracingMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 		r := c.Request()
 
 		attrs := []attribute.KeyValue{
+			attribute.String("requestId", requestid.Get(c)),
 			semconv.HTTPMethodKey.String(r.Method),
 			semconv.HTTPRouteKey.String(r.URL.Path),
 			semconv.HTTPClientIPKey.String(r.RemoteAddr),
@@ -3688,7 +4059,9 @@ func (s *Server) tracingMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 			attrs = append(attrs, attribute.String("ClientReqID", reqid))
 		}
 
-		tctx, span := s.tracer.Start(context.Background(),
+		// continue the callers trace if they sent a traceparent header
+		pctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(r.Header))
+		tctx, span := s.tracer.Start(pctx,
 			"HTTP "+r.Method+" "+c.Path(),
 			trace.WithAttributes(attrs...),
 		)
@@ -4090,6 +4463,7 @@ func (s *Server) handleGetAllDealsForUser(c echo.Context, u *User) error {
 	var deals []dealQuery
 	if err := s.DB.Model(contentDeal{}).
 		Where("deal_id > 0 AND (? OR (on_chain_at >= ? AND on_chain_at <= ?)) AND user_id = ?", all, begin, begin.Add(duration), u.ID).
+		Where("? = '' OR contents.namespace = ?", u.namespace(), u.namespace()).
 		Joins("left join contents on content_deals.content = contents.id").
 		Select("deal_id, contents.id as contentid, cid, aggregate").
 		Scan(&deals).Error; err != nil {
@@ -4483,6 +4857,11 @@ func (s *Server) handleShuttleConnection(c echo.Context) error {
 				return
 			}
 
+			if err := faults.Check(c.Request().Context(), faults.ShuttleDisconnect); err != nil {
+				log.Warnf("dropping connection to shuttle %s: %s", shuttle.Handle, err)
+				return
+			}
+
 			go func(msg *drpc.Message) {
 				msg.Handle = shuttle.Handle
 				s.CM.IncomingRPCMessages <- msg
@@ -4626,20 +5005,39 @@ func (s *Server) handleDebugGetAllDeals(c echo.Context) error {
 type logLevelBody struct {
 	System string `json:"system"`
 	Level  string `json:"level"`
+	Regex  bool   `json:"regex"`
 }
 
+// handleLogLevel godoc
+// @Summary      Set the log level of a subsystem
+// @Description  This endpoint changes the log level of a logging subsystem at runtime. System may be "*" for all subsystems, or a regular expression if regex is set.
+// @Tags         admin
+// @Produce      json
+// @Param        body body logLevelBody true "Subsystem and level"
+// @Router       /admin/loglevel [post]
 func (s *Server) handleLogLevel(c echo.Context) error {
 	var body logLevelBody
 	if err := c.Bind(&body); err != nil {
 		return err
 	}
 
-	//#nosec G104 - it's not common to treat SetLogLevel error return
-	logging.SetLogLevel(body.System, body.Level)
+	if err := util.SetLogLevel(body.System, body.Level, body.Regex); err != nil {
+		return err
+	}
 
 	return c.JSON(http.StatusOK, map[string]interface{}{})
 }
 
+// handleGetLogLevels godoc
+// @Summary      Get log levels
+// @Description  This endpoint lists every logging subsystem and its current level.
+// @Tags         admin
+// @Produce      json
+// @Router       /admin/loglevel [get]
+func (s *Server) handleGetLogLevels(c echo.Context) error {
+	return c.JSON(http.StatusOK, util.GetLogLevels())
+}
+
 // handlePublicStorageFailures godoc
 // @Summary      Get storage failures
 // @Description  This endpoint returns a list of storage failures
@@ -4715,6 +5113,16 @@ func (s *Server) handleCreateContent(c echo.Context, u *User) error {
 	if err != nil {
 		return err
 	}
+	if err := s.CM.denylist.check(c.Request().Context(), rootCID, denyPin, u.ID, c.RealIP()); err != nil {
+		return err
+	}
+	if req.Encryption != nil && !s.estuaryCfg.Encryption.Enabled {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "content encryption is not enabled on this node",
+		}
+	}
 
 	if c.QueryParam("ignore-dupes") == "true" {
 		isDup, err := s.isDupCIDContent(c, rootCID, u)
@@ -4723,13 +5131,10 @@ func (s *Server) handleCreateContent(c echo.Context, u *User) error {
 		}
 	}
 
-	var col Collection
+	col := &Collection{}
 	if req.CollectionID != "" {
-		if err := s.DB.First(&col, "uuid = ?", req.CollectionID).Error; err != nil {
-			return err
-		}
-
-		if err := util.IsCollectionOwner(u.ID, col.UserID); err != nil {
+		col, err = s.getCollectionForUpload(c.Request().Context(), u, req.CollectionID)
+		if err != nil {
 			return err
 		}
 	}
@@ -4740,13 +5145,16 @@ func (s *Server) handleCreateContent(c echo.Context, u *User) error {
 		Active:      false,
 		Pinning:     false,
 		UserID:      u.ID,
-		Replication: s.CM.Replication,
+		Namespace:   u.namespace(),
+		Replication: s.CM.replicationFactor(),
 		Location:    req.Location,
+		Chunker:     req.Chunker,
 	}
 
-	if err := s.DB.Create(content).Error; err != nil {
+	if err := s.CM.createContent(c.Request().Context(), content, req.Encryption); err != nil {
 		return err
 	}
+	s.CM.recordContentEvent(c.Request().Context(), eventContentAdded, content.ID, nil)
 
 	if req.CollectionID != "" {
 		if req.CollectionDir == "" {
@@ -4920,7 +5328,8 @@ type contCheck struct {
 
 func (s *Server) handleAdminGetProgress(c echo.Context) error {
 	var out progressResponse
-	if err := s.DB.Model(util.Content{}).Where("not aggregated_in > 0 AND (pinning OR active) AND not failed").Count(&out.TotalTopLevel).Error; err != nil {
+	// content on the cluster never becomes active here
+	if err := s.DB.Model(util.Content{}).Where("not aggregated_in > 0 AND (pinning OR active OR location = ?) AND not failed", constants.ContentLocationCluster).Count(&out.TotalTopLevel).Error; err != nil {
 		return err
 	}
 
@@ -4929,17 +5338,21 @@ func (s *Server) handleAdminGetProgress(c echo.Context) error {
 	}
 
 	var conts []contCheck
-	if err := s.DB.Model(util.Content{}).Where("not aggregated_in > 0 and active").
-		Select("id, (?) as num_deals",
+	if err := s.DB.Model(util.Content{}).Where("not aggregated_in > 0 and (active or (location = ? and not failed))", constants.ContentLocationCluster).
+		Select("id, (?) + COALESCE((?), 0) as num_deals",
 			s.DB.Model(contentDeal{}).
 				Where("content = contents.id and deal_id > 0 and not failed").
 				Select("count(1)"),
+			// the peers of a cluster holding the content are replicas too
+			s.DB.Model(ClusterPin{}).
+				Where("content = contents.id").
+				Select("peers"),
 		).Scan(&conts).Error; err != nil {
 		return err
 	}
 
 	for _, c := range conts {
-		if c.NumDeals >= s.CM.Replication {
+		if c.NumDeals >= s.CM.replicationFactor() {
 			out.GoodContents = append(out.GoodContents, c.ID)
 		} else if c.NumDeals > 0 {
 			out.InProgress = append(out.InProgress, c.ID)
@@ -5106,6 +5519,9 @@ func (s *Server) handleShuttleCreateContent(c echo.Context) error {
 			},
 		})
 	}
+	if err := s.CM.denylist.check(c.Request().Context(), root, denyPin, req.User, ""); err != nil {
+		return err
+	}
 
 	content := &util.Content{
 		Cid:         util.DbCID{CID: root},
@@ -5113,18 +5529,35 @@ func (s *Server) handleShuttleCreateContent(c echo.Context) error {
 		Active:      false,
 		Pinning:     false,
 		UserID:      req.User,
-		Replication: s.CM.Replication,
+		Replication: s.CM.replicationFactor(),
 		Location:    req.Location,
 	}
 
+	if req.Namespace != "" && !validNamespace(req.Namespace) {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid namespace: %s", req.Namespace),
+		}
+	}
+	content.Namespace = req.Namespace
+
 	if req.DagSplitRoot != 0 {
 		content.DagSplit = true
 		content.SplitFrom = req.DagSplitRoot
+
+		// the pieces of a split dag are in the namespace of the whole
+		var parent util.Content
+		if err := s.DB.Select("id, namespace").First(&parent, "id = ?", req.DagSplitRoot).Error; err != nil {
+			return err
+		}
+		content.Namespace = parent.Namespace
 	}
 
 	if err := s.DB.Create(content).Error; err != nil {
 		return err
 	}
+	s.CM.recordContentEvent(c.Request().Context(), eventContentAdded, content.ID, nil)
 
 	return c.JSON(http.StatusOK, util.ContentCreateResponse{
 		ID: content.ID,
@@ -5299,12 +5732,8 @@ func (s *Server) handleColfsAdd(c echo.Context, u *User) error {
 	contid := c.QueryParam("content")
 	npath := c.QueryParam("path")
 
-	var col Collection
-	if err := s.DB.First(&col, "uuid = ?", coluuid).Error; err != nil {
-		return err
-	}
-
-	if err := util.IsCollectionOwner(u.ID, col.UserID); err != nil {
+	col, err := s.getCollectionForUpload(c.Request().Context(), u, coluuid)
+	if err != nil {
 		return err
 	}
 
@@ -5313,7 +5742,7 @@ func (s *Server) handleColfsAdd(c echo.Context, u *User) error {
 		return err
 	}
 
-	if err := util.IsContentOwner(u.ID, content.UserID); err != nil {
+	if err := checkContentOwner(u, &content); err != nil {
 		return err
 	}
 
@@ -5341,31 +5770,134 @@ func (s *Server) handleRunGc(c echo.Context) error {
 }
 
 func (s *Server) handleGateway(c echo.Context) error {
-	npath := "/" + c.Param("path")
+	ctx := c.Request().Context()
+	npath := "/" + c.Param("*")
 	proto, cc, segs, err := gateway.ParsePath(npath)
 	if err != nil {
 		return err
 	}
 
-	redir, err := s.checkGatewayRedirect(proto, cc, segs)
+	// walking a selector is costly, it takes an api key
+	sel := c.QueryParam("selector")
+	if sel != "" {
+		auth, err := util.ExtractAuth(c)
+		if err != nil {
+			return err
+		}
+		if _, err := s.checkTokenAuth(auth); err != nil {
+			return err
+		}
+	}
+
+	var private bool
+	target := cc
+	if proto == "ipfs" {
+		if err := s.CM.denylist.checkPath(ctx, cc, strings.Join(segs, "/"), denyServe, 0, c.RealIP()); err != nil {
+			return err
+		}
+		// what the path resolves to may be listed on its own
+		target = s.retrievalTarget(ctx, cc, npath)
+		if err := s.CM.denylist.check(ctx, target, denyServe, 0, c.RealIP()); err != nil {
+			return err
+		}
+		if err := s.checkQuarantine(ctx, cc); err != nil {
+			return err
+		}
+		private, err = s.checkRetrievalAccess(ctx, cc, accessToken(c))
+		if err != nil {
+			return err
+		}
+		s.retrievals.hit(cc)
+
+		// hot content goes to the cdn, once it is paid for. Selectors are
+		// only served here
+		base, err := s.cdnRedirect(ctx, cc, private, 1)
+		if err != nil {
+			return err
+		}
+		if base != "" && sel == "" {
+			if _, err := s.chargeRetrieval(ctx, target, 0, c.RealIP(), paychVoucherParamOrHeader(c)); err != nil {
+				return err
+			}
+			return c.Redirect(http.StatusTemporaryRedirect, cdn.RedirectURL(base, npath, c.QueryParams()))
+		}
+	}
+
+	redir, err := s.checkGatewayRedirect(proto, cc, segs, private)
 	if err != nil {
 		return err
 	}
 
 	if redir == "" {
-
-		req := c.Request().Clone(c.Request().Context())
+		req := c.Request().Clone(ctx)
 		req.URL.Path = npath
 
-		s.gwayHandler.ServeHTTP(c.Response().Writer, req)
-		return nil
+		// retrievals redirected to a shuttle are charged when it checks
+		// access
+		var charge *retrievalCharge
+		auth, _ := util.ExtractAuth(c)
+		if proto == "ipfs" {
+			var selected int64
+			if sel != "" && s.estuaryCfg.PaidRetrieval.Enabled {
+				selected, err = s.selectedSize(ctx, req)
+				if err != nil {
+					return err
+				}
+			}
+			charge, err = s.chargeRetrieval(ctx, target, selected, c.RealIP(), paychVoucherParamOrHeader(c))
+			if err != nil {
+				return err
+			}
+
+			// offloaded content is brought back from its deals first, for
+			// its owner or the retrieval that pays for it
+			r, started, err := s.warmOffloaded(ctx, cc, charge.paid(), auth)
+			if err != nil {
+				s.refundRetrieval(ctx, charge)
+				return err
+			}
+			if r != nil {
+				if !started {
+					s.refundRetrieval(ctx, charge)
+				}
+				return s.serveWarming(c, r)
+			}
+		}
+
+		var uid, org uint
+		if proto == "ipfs" {
+			uid, org, err = s.egressAccount(ctx, cc, auth, private)
+			if err != nil {
+				s.refundRetrieval(ctx, charge)
+				return err
+			}
+		}
+		err = s.meterEgress(c, uid, org, func() error {
+			s.gwayHandler.ServeHTTP(c.Response(), req)
+			return nil
+		})
+		if err != nil || c.Response().Status >= http.StatusBadRequest {
+			s.refundRetrieval(ctx, charge)
+		}
+		return err
+	}
+	// keep the format of car and raw block requests, and the access token
+	// of private content
+	q := c.Request().URL.Query()
+	if private && q.Get(accessTokenParam) == "" {
+		q.Set(accessTokenParam, accessToken(c))
+	}
+	if len(q) > 0 {
+		redir += "?" + q.Encode()
 	}
 	return c.Redirect(307, redir)
 }
 
 const bestGateway = "dweb.link"
 
-func (s *Server) checkGatewayRedirect(proto string, cc cid.Cid, segs []string) (string, error) {
+// checkGatewayRedirect returns where a gateway request is served, empty
+// when it is served here. Private content is never sent to public gateways.
+func (s *Server) checkGatewayRedirect(proto string, cc cid.Cid, segs []string, private bool) (string, error) {
 	if proto != "ipfs" {
 		return fmt.Sprintf("https://%s/%s/%s/%s", bestGateway, proto, cc, strings.Join(segs, "/")), nil
 	}
@@ -5383,6 +5915,9 @@ func (s *Server) checkGatewayRedirect(proto string, cc cid.Cid, segs []string) (
 	}
 
 	if !s.CM.shuttleIsOnline(cont.Location) {
+		if private {
+			return "", nil
+		}
 		return fmt.Sprintf("https://%s/%s/%s/%s", bestGateway, proto, cc, strings.Join(segs, "/")), nil
 	}
 
@@ -5396,7 +5931,7 @@ func (s *Server) checkGatewayRedirect(proto string, cc cid.Cid, segs []string) (
 
 func (s *Server) isDupCIDContent(c echo.Context, rootCID cid.Cid, u *User) (bool, error) {
 	var count int64
-	if err := s.DB.Model(util.Content{}).Where("cid = ? and user_id = ?", rootCID.Bytes(), u.ID).Count(&count).Error; err != nil {
+	if err := s.DB.Model(util.Content{}).Scopes(inNamespace(u)).Where("cid = ? and user_id = ?", rootCID.Bytes(), u.ID).Count(&count).Error; err != nil {
 		return false, err
 	}
 	if count > 0 {
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/inclusion"
+	"github.com/labstack/echo/v4"
+)
+
+type inclusionDeal struct {
+	Miner  string `json:"miner"`
+	DealID int64  `json:"dealId"`
+}
+
+type inclusionProofResponse struct {
+	Proof *inclusion.Proof `json:"proof"`
+	// Deals are the deals on chain for the piece
+	Deals []inclusionDeal `json:"deals"`
+}
+
+// handleGetInclusionProof godoc
+// @Summary      Get the inclusion proof of aggregated content
+// @Description  This endpoint returns the proof that a content stored in an aggregate is inside the piece the deals of the aggregate were made for: the data segment index of the aggregate, where every content is in the CAR the piece was computed over, and the Merkle paths from the leaves of the content's range up to the piece commitment, along with the deals of the piece. The whole aggregate is read to build it. Aggregates on a shuttle are redirected to the shuttle, which leaves out the deals.
+// @Tags         content
+// @Produce      json
+// @Param        id   path      int  true  "Content ID"
+// @Success      200  {object}  inclusionProofResponse
+// @Router       /content/{id}/inclusion-proof [get]
+func (s *Server) handleGetInclusionProof(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+	content, err := s.getOwnContent(c, u)
+	if err != nil {
+		return err
+	}
+	if content.AggregatedIn == 0 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("content %d was not aggregated, its deals are for a piece of its own", content.ID),
+		}
+	}
+
+	var agg util.Content
+	if err := s.DB.First(&agg, "id = ?", content.AggregatedIn).Error; err != nil {
+		return err
+	}
+
+	pcr, err := s.CM.lookupPieceCommRecord(agg.Cid.CID)
+	if err != nil {
+		return err
+	}
+	if pcr == nil {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_RECORD_NOT_FOUND,
+			Details: fmt.Sprintf("the piece of aggregate %d was not computed yet", agg.ID),
+		}
+	}
+
+	if agg.Location != constants.ContentLocationLocal {
+		host := s.CM.shuttleHostName(agg.Location)
+		if host == "" || !s.CM.shuttleIsOnline(agg.Location) {
+			return &util.HttpError{
+				Code:    http.StatusServiceUnavailable,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("the shuttle aggregate %d is on is offline", agg.ID),
+			}
+		}
+		return c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("https://%s/content/inclusion-proof/%d/%d", host, agg.ID, content.ID))
+	}
+
+	l, err := s.CM.carLayout(ctx, agg.Cid.CID)
+	if err != nil {
+		return err
+	}
+	proof, err := inclusion.Prove(ctx, l, s.CM.Blockstore.Get, content.Cid.CID)
+	if err != nil {
+		return err
+	}
+	if !proof.PieceCID.Equals(pcr.Piece.CID) {
+		return fmt.Errorf("the car of aggregate %d hashes to piece %s, not %s", agg.ID, proof.PieceCID, pcr.Piece.CID)
+	}
+
+	var deals []contentDeal
+	if err := s.DB.Find(&deals, "content = ? AND deal_id > 0 AND NOT failed AND NOT slashed", agg.ID).Error; err != nil {
+		return err
+	}
+	resp := inclusionProofResponse{Proof: proof, Deals: []inclusionDeal{}}
+	for _, d := range deals {
+		resp.Deals = append(resp.Deals, inclusionDeal{Miner: d.Miner, DealID: d.DealID})
+	}
+	return c.JSON(http.StatusOK, resp)
+}
@@ -5,6 +5,9 @@ import (
 
 	"github.com/application-research/estuary/config"
 	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/bwlimit"
+	"github.com/application-research/estuary/util/provide"
+	"github.com/application-research/estuary/util/withhold"
 	"github.com/ipfs/go-cid"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	"gorm.io/gorm"
@@ -14,6 +17,9 @@ type Initializer struct {
 	cfg            *config.Node
 	db             *gorm.DB
 	trackingBstore *TrackingBlockstore
+	// scheduledReprovide leaves reproviding to the reprovide job
+	scheduledReprovide bool
+	withheld           *withhold.Filter
 }
 
 func (init *Initializer) Config() *config.Node {
@@ -25,24 +31,55 @@ func (init *Initializer) BlockstoreWrap(bs blockstore.Blockstore) (blockstore.Bl
 	return init.trackingBstore, nil
 }
 
+func (init *Initializer) Withheld(ctx context.Context, c cid.Cid) bool {
+	return init.withheld.Withheld(ctx, c)
+}
+
+// Bandwidth is nil, the node has no caps
+func (init *Initializer) Bandwidth() *bwlimit.Limiter {
+	return nil
+}
+
 func (init *Initializer) KeyProviderFunc(rpctx context.Context) (<-chan cid.Cid, error) {
 	log.Infof("running key provider func")
 	out := make(chan cid.Cid)
+	if init.scheduledReprovide {
+		close(out)
+		return out, nil
+	}
 	go func() {
 		defer close(out)
 
+		policy, err := init.cfg.Provide.Policy()
+		if err != nil {
+			log.Errorf("invalid provide config: %s", err)
+			return
+		}
+
 		var contents []util.Content
-		if err := init.db.Find(&contents, "active").Error; err != nil {
+		// private content isn't announced
+		if err := init.db.Find(&contents, "active AND NOT private").Error; err != nil {
 			log.Errorf("failed to load contents for reproviding: %s", err)
 			return
 		}
-		log.Infof("key provider func returning %d values", len(contents))
+		log.Infof("key provider func providing %d contents", len(contents))
 
-		for _, c := range contents {
+		send := func(c cid.Cid) error {
 			select {
-			case out <- c.Cid.CID:
+			case out <- c:
+				return nil
 			case <-rpctx.Done():
-				return
+				return rpctx.Err()
+			}
+		}
+		for _, c := range contents {
+			// the blocks are read underneath the tracking so reproviding
+			// doesn't count as access
+			if err := provide.Keys(rpctx, init.trackingBstore.bs, policy.For(c.Size), c.Cid.CID, send); err != nil {
+				if rpctx.Err() != nil {
+					return
+				}
+				log.Warnf("failed to reprovide content %d: %s", c.ID, err)
 			}
 		}
 	}()
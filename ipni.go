@@ -0,0 +1,18 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/application-research/estuary/autoretrieve"
+)
+
+// announceIPNI advertises the content held on the primary that was queued
+// since the last run to the indexers. Shuttles advertise their own content,
+// signed with their own keys.
+func (s *Server) announceIPNI(ctx context.Context) error {
+	if s.Node.ArEngine == nil {
+		return fmt.Errorf("no index provider engine to advertise with")
+	}
+	return s.Node.ArEngine.AnnounceIPNI(ctx, s.Node.Host.ID(), autoretrieve.PublicAddrs(s.Node.Host.Addrs()))
+}
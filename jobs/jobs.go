@@ -0,0 +1,318 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("jobs")
+
+type Func func(ctx context.Context) error
+
+// Job is a unit of background work. Jobs with an Interval are run
+// periodically by the scheduler, jobs without one only run when triggered.
+type Job struct {
+	Name        string
+	Description string
+	Interval    time.Duration
+	// RunOnStart runs the job as soon as the scheduler starts instead of
+	// waiting for the first interval to pass
+	RunOnStart bool
+	// LeaderOnly jobs are skipped on instances that are not the leader, for
+	// work that must only happen once across all instances
+	LeaderOnly bool
+	// Paused registers the job paused, it only runs once it is resumed
+	Paused bool
+	Run    Func
+}
+
+type Status struct {
+	Name         string        `json:"name"`
+	Description  string        `json:"description"`
+	Interval     time.Duration `json:"interval"`
+	LeaderOnly   bool          `json:"leaderOnly"`
+	Paused       bool          `json:"paused"`
+	Running      bool          `json:"running"`
+	Runs         int64         `json:"runs"`
+	Failures     int64         `json:"failures"`
+	LastStart    time.Time     `json:"lastStart,omitempty"`
+	LastEnd      time.Time     `json:"lastEnd,omitempty"`
+	LastDuration time.Duration `json:"lastDuration"`
+	LastError    string        `json:"lastError,omitempty"`
+	NextRun      time.Time     `json:"nextRun,omitempty"`
+}
+
+type jobState struct {
+	job        *Job
+	status     Status
+	trigger    chan struct{}
+	reschedule chan struct{}
+}
+
+// Scheduler runs registered jobs on their intervals, never runs more than
+// one instance of the same job at a time, and limits how many different jobs
+// may run concurrently
+type Scheduler struct {
+	lk   sync.Mutex
+	jobs map[string]*jobState
+
+	sem chan struct{}
+	ctx context.Context
+
+	isLeader func() bool
+}
+
+func NewScheduler(maxConcurrent int) *Scheduler {
+	return &Scheduler{
+		jobs: make(map[string]*jobState),
+		sem:  make(chan struct{}, maxConcurrent),
+		isLeader: func() bool {
+			return true
+		},
+	}
+}
+
+// SetLeaderFunc sets how the scheduler finds out whether this instance is
+// the leader, by default it always is
+func (s *Scheduler) SetLeaderFunc(f func() bool) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.isLeader = f
+}
+
+// Register adds a job to the scheduler, jobs registered after Start begin
+// running immediately
+func (s *Scheduler) Register(j *Job) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if _, ok := s.jobs[j.Name]; ok {
+		panic(fmt.Sprintf("job %q registered twice", j.Name))
+	}
+
+	js := &jobState{
+		job: j,
+		status: Status{
+			Name:        j.Name,
+			Description: j.Description,
+			Interval:    j.Interval,
+			LeaderOnly:  j.LeaderOnly,
+			Paused:      j.Paused,
+		},
+		trigger:    make(chan struct{}, 1),
+		reschedule: make(chan struct{}, 1),
+	}
+	s.jobs[j.Name] = js
+
+	if s.ctx != nil {
+		go s.loop(s.ctx, js)
+	}
+}
+
+func (s *Scheduler) Start(ctx context.Context) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	s.ctx = ctx
+	for _, js := range s.jobs {
+		go s.loop(ctx, js)
+	}
+}
+
+func (s *Scheduler) loop(ctx context.Context, js *jobState) {
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	schedule := func() {
+		if ticker != nil {
+			ticker.Stop()
+			ticker, tick = nil, nil
+		}
+		if interval := s.interval(js); interval > 0 {
+			ticker = time.NewTicker(interval)
+			tick = ticker.C
+		}
+		s.setNextRun(js)
+	}
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+
+	schedule()
+
+	if js.job.RunOnStart {
+		s.run(ctx, js)
+	}
+
+	for {
+		select {
+		case <-tick:
+			s.run(ctx, js)
+		case <-js.trigger:
+			s.run(ctx, js)
+		case <-js.reschedule:
+			schedule()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Scheduler) run(ctx context.Context, js *jobState) {
+	s.lk.Lock()
+	skip := js.status.Paused || (js.job.LeaderOnly && !s.isLeader())
+	s.lk.Unlock()
+	if skip {
+		s.setNextRun(js)
+		return
+	}
+
+	select {
+	case s.sem <- struct{}{}:
+	case <-ctx.Done():
+		return
+	}
+	defer func() { <-s.sem }()
+
+	start := time.Now()
+	s.lk.Lock()
+	js.status.Running = true
+	js.status.LastStart = start
+	s.lk.Unlock()
+
+	err := js.job.Run(ctx)
+
+	end := time.Now()
+	s.lk.Lock()
+	js.status.Running = false
+	js.status.Runs++
+	js.status.LastEnd = end
+	js.status.LastDuration = end.Sub(start)
+	js.status.LastError = ""
+	if err != nil {
+		js.status.Failures++
+		js.status.LastError = err.Error()
+	}
+	s.lk.Unlock()
+
+	if err != nil {
+		log.Errorf("job %s failed after %s: %s", js.job.Name, end.Sub(start), err)
+	}
+	s.setNextRun(js)
+}
+
+func (s *Scheduler) interval(js *jobState) time.Duration {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return js.status.Interval
+}
+
+func (s *Scheduler) setNextRun(js *jobState) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if js.status.Interval > 0 {
+		js.status.NextRun = time.Now().Add(js.status.Interval)
+	} else {
+		js.status.NextRun = time.Time{}
+	}
+}
+
+func (s *Scheduler) get(name string) (*jobState, error) {
+	js, ok := s.jobs[name]
+	if !ok {
+		return nil, fmt.Errorf("no such job: %q", name)
+	}
+	return js, nil
+}
+
+// Pause stops a job from being run until it is resumed, a run that is
+// already in progress is allowed to finish
+func (s *Scheduler) Pause(name string) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	js, err := s.get(name)
+	if err != nil {
+		return err
+	}
+	js.status.Paused = true
+	return nil
+}
+
+func (s *Scheduler) Resume(name string) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	js, err := s.get(name)
+	if err != nil {
+		return err
+	}
+	js.status.Paused = false
+	return nil
+}
+
+// SetInterval changes how often a job is run, the next run is an interval
+// from now. An interval of zero leaves the job to be triggered manually.
+func (s *Scheduler) SetInterval(name string, interval time.Duration) error {
+	s.lk.Lock()
+	js, err := s.get(name)
+	if err == nil && js.status.Interval != interval {
+		js.status.Interval = interval
+		select {
+		case js.reschedule <- struct{}{}:
+		default:
+		}
+	}
+	s.lk.Unlock()
+	return err
+}
+
+// Trigger runs a job as soon as possible, outside of its regular schedule.
+// Triggering a job that is already running queues at most one more run.
+func (s *Scheduler) Trigger(name string) error {
+	s.lk.Lock()
+	js, err := s.get(name)
+	s.lk.Unlock()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case js.trigger <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *Scheduler) Status() []Status {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	out := make([]Status, 0, len(s.jobs))
+	for _, js := range s.jobs {
+		out = append(out, js.status)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+func (s *Scheduler) JobStatus(name string) (*Status, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	js, err := s.get(name)
+	if err != nil {
+		return nil, err
+	}
+	st := js.status
+	return &st, nil
+}
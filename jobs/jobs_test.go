@@ -0,0 +1,129 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func waitForRuns(t *testing.T, s *Scheduler, name string, runs int64) *Status {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		st, err := s.JobStatus(name)
+		assert.NoError(t, err)
+		if st.Runs >= runs && !st.Running {
+			return st
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	t.Fatalf("job %s did not reach %d runs", name, runs)
+	return nil
+}
+
+func TestTriggerAndPause(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	calls := make(chan struct{}, 10)
+	s := NewScheduler(1)
+	s.Register(&Job{
+		Name: "manual",
+		Run: func(ctx context.Context) error {
+			calls <- struct{}{}
+			return errors.New("boom")
+		},
+	})
+	s.Start(ctx)
+
+	assert.NoError(s.Trigger("manual"))
+	st := waitForRuns(t, s, "manual", 1)
+	assert.Equal(int64(1), st.Failures)
+	assert.Equal("boom", st.LastError)
+
+	assert.NoError(s.Pause("manual"))
+	assert.NoError(s.Trigger("manual"))
+	time.Sleep(time.Millisecond * 50)
+	assert.Len(calls, 1)
+
+	assert.NoError(s.Resume("manual"))
+	assert.NoError(s.Trigger("manual"))
+	waitForRuns(t, s, "manual", 2)
+
+	assert.Error(s.Trigger("missing"))
+}
+
+func TestInterval(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := NewScheduler(2)
+	s.Register(&Job{
+		Name:       "periodic",
+		Interval:   time.Millisecond * 10,
+		RunOnStart: true,
+		Run: func(ctx context.Context) error {
+			return nil
+		},
+	})
+	s.Start(ctx)
+
+	st := waitForRuns(t, s, "periodic", 3)
+	assert.Equal(t, int64(0), st.Failures)
+	assert.False(t, st.NextRun.IsZero())
+}
+
+func TestSetInterval(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := NewScheduler(1)
+	s.Register(&Job{
+		Name:     "slow",
+		Interval: time.Hour,
+		Run: func(ctx context.Context) error {
+			return nil
+		},
+	})
+	s.Start(ctx)
+
+	assert.NoError(t, s.SetInterval("slow", time.Millisecond*10))
+	st := waitForRuns(t, s, "slow", 2)
+	assert.Equal(t, time.Millisecond*10, st.Interval)
+
+	assert.Error(t, s.SetInterval("missing", time.Second))
+}
+
+func TestRegisterPaused(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	calls := make(chan struct{}, 10)
+	s := NewScheduler(1)
+	s.Register(&Job{
+		Name:       "held",
+		Interval:   time.Millisecond * 10,
+		RunOnStart: true,
+		Paused:     true,
+		Run: func(ctx context.Context) error {
+			calls <- struct{}{}
+			return nil
+		},
+	})
+	s.Start(ctx)
+
+	time.Sleep(time.Millisecond * 50)
+	assert.Len(calls, 0)
+	st, err := s.JobStatus("held")
+	assert.NoError(err)
+	assert.True(st.Paused)
+
+	assert.NoError(s.Resume("held"))
+	waitForRuns(t, s, "held", 1)
+}
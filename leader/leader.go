@@ -0,0 +1,170 @@
+package leader
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"gorm.io/gorm"
+)
+
+var log = logging.Logger("leader")
+
+const (
+	retryInterval  = time.Second * 10
+	healthInterval = time.Second * 5
+)
+
+// Elector decides which of several api instances sharing a database runs
+// the singleton background workers. On postgres leadership is a session
+// level advisory lock held on a dedicated connection, so it is released as
+// soon as the leader exits or loses its connection. Any other database can
+// only be used by a single instance, which is always the leader.
+type Elector struct {
+	db  *gorm.DB
+	key int64
+
+	// OnLost is called if leadership is lost after being acquired, workers
+	// started on election cannot safely keep running past this point
+	OnLost func()
+
+	lk      sync.Mutex
+	leader  bool
+	elected chan struct{}
+}
+
+func NewElector(db *gorm.DB, name string) *Elector {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte("estuary-leader:" + name))
+
+	return &Elector{
+		db:      db,
+		key:     int64(h.Sum64()),
+		elected: make(chan struct{}),
+	}
+}
+
+// NewStaticElector returns an elector that is always the leader, used when
+// leader election is disabled
+func NewStaticElector() *Elector {
+	e := &Elector{elected: make(chan struct{})}
+	e.becomeLeader()
+	return e
+}
+
+func (e *Elector) IsLeader() bool {
+	e.lk.Lock()
+	defer e.lk.Unlock()
+	return e.leader
+}
+
+// Elected is closed once this instance becomes the leader
+func (e *Elector) Elected() <-chan struct{} {
+	return e.elected
+}
+
+func (e *Elector) becomeLeader() {
+	e.lk.Lock()
+	defer e.lk.Unlock()
+
+	if !e.leader {
+		e.leader = true
+		close(e.elected)
+	}
+}
+
+// Run campaigns for leadership until ctx is cancelled
+func (e *Elector) Run(ctx context.Context) {
+	if e.db == nil {
+		return
+	}
+
+	if e.db.Dialector.Name() != "postgres" {
+		log.Infof("leader election requires postgres, assuming leadership on %s", e.db.Dialector.Name())
+		e.becomeLeader()
+		return
+	}
+
+	sqldb, err := e.db.DB()
+	if err != nil {
+		log.Errorf("failed to get database handle for leader election: %s", err)
+		return
+	}
+
+	for {
+		conn, ok := e.tryAcquire(ctx, sqldb)
+		if ok {
+			log.Infof("acquired leadership")
+			e.becomeLeader()
+			e.hold(ctx, conn)
+			return
+		}
+
+		select {
+		case <-time.After(retryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (e *Elector) tryAcquire(ctx context.Context, sqldb *sql.DB) (*sql.Conn, bool) {
+	conn, err := sqldb.Conn(ctx)
+	if err != nil {
+		log.Warnf("failed to get connection for leader election: %s", err)
+		return nil, false
+	}
+
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", e.key).Scan(&acquired); err != nil {
+		log.Warnf("failed to try leader lock: %s", err)
+		conn.Close()
+		return nil, false
+	}
+
+	if !acquired {
+		conn.Close()
+		return nil, false
+	}
+	return conn, true
+}
+
+// hold keeps the connection holding the lock alive, and gives up
+// leadership if it is lost
+func (e *Elector) hold(ctx context.Context, conn *sql.Conn) {
+	defer func() {
+		// closing a sql.Conn returns it to the pool, so the lock has to be
+		// released explicitly or it would stay held by an idle connection
+		uctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		if _, err := conn.ExecContext(uctx, "SELECT pg_advisory_unlock($1)", e.key); err != nil {
+			log.Warnf("failed to release leader lock: %s", err)
+		}
+		conn.Close()
+	}()
+
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := conn.PingContext(ctx); err != nil {
+				log.Errorf("lost leader lock connection: %s", err)
+				e.lk.Lock()
+				e.leader = false
+				e.lk.Unlock()
+
+				if e.OnLost != nil {
+					e.OnLost()
+				}
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/application-research/estuary/build"
+	"github.com/application-research/estuary/util"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/network"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/actors"
+	"github.com/filecoin-project/lotus/chain/types"
+	lcli "github.com/filecoin-project/lotus/cli"
+	"github.com/labstack/echo/v4"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	lotusModeAuto = "auto"
+	lotusModeFull = "full"
+	lotusModeLite = "lite"
+)
+
+// liteLookback is how many epochs back a lotus gateway searches for
+// messages, deals published before that are only found through the deal id
+// the storage provider reports
+const liteLookback = abi.ChainEpoch(20)
+
+// liteDegraded lists what doesn't work as well against a lotus gateway
+var liteDegraded = []string{
+	fmt.Sprintf("publish messages are only searched %d epochs back, deal ids older than that come from the storage provider", liteLookback),
+	"/admin/fixdeals is unavailable",
+}
+
+// connectLotus opens the chain api at apiURL. In auto mode the full node
+// api is tried first and the gateway api is used if apiURL doesn't serve it.
+func connectLotus(ctx context.Context, apiURL, mode string) (api.Gateway, func(), string, error) {
+	// send a CLI context to lotus that contains only the node "api-url" flag set, so that other flags don't accidentally conflict with lotus cli flags
+	// https://github.com/filecoin-project/lotus/blob/731da455d46cb88ee5de9a70920a2d29dec9365c/cli/util/api.go#L37
+	flset := flag.NewFlagSet("lotus", flag.ExitOnError)
+	flset.String("api-url", "", "node api url")
+	if err := flset.Set("api-url", apiURL); err != nil {
+		return nil, nil, "", err
+	}
+	ncctx := cli.NewContext(cli.NewApp(), flset, nil)
+	ncctx.Context = ctx
+
+	switch mode {
+	case lotusModeFull, lotusModeAuto:
+		full, closer, err := lcli.GetFullNodeAPIV1(ncctx)
+		if err == nil {
+			// gateways answer Version too, so ask for something only full
+			// nodes serve
+			_, err = full.StateNetworkName(ctx)
+			if err == nil {
+				return full, closer, lotusModeFull, nil
+			}
+			closer()
+		}
+		if mode == lotusModeFull {
+			return nil, nil, "", fmt.Errorf("%s does not serve the full node api: %w", apiURL, err)
+		}
+		log.Infof("%s does not serve the full node api, running in lite mode: %s", apiURL, err)
+	case lotusModeLite:
+	default:
+		return nil, nil, "", fmt.Errorf("invalid lotus mode %q, must be one of auto, full or lite", mode)
+	}
+
+	gw, closer, err := lcli.GetGatewayAPI(ncctx)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	for _, d := range liteDegraded {
+		log.Warnf("lite mode: %s", d)
+	}
+	return gw, closer, lotusModeLite, nil
+}
+
+// checkNetwork makes sure the chain api is on the network n and runs actors
+// this build can read the deals of
+func checkNetwork(ctx context.Context, capi api.Gateway, n build.Network) error {
+	if n.Genesis != "" {
+		gen, err := capi.ChainGetGenesis(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get genesis: %w", err)
+		}
+		if gc := gen.Cids()[0].String(); gc != n.Genesis {
+			return fmt.Errorf("chain api is not on %s, its genesis is %s instead of %s", n.Name, gc, n.Genesis)
+		}
+	}
+
+	nv, av, err := actorsVersion(ctx, capi)
+	if err != nil {
+		return err
+	}
+	if av < 0 {
+		// deal making mostly goes through the storage providers and the
+		// market actor methods that rarely change, so keep going
+		log.Warnf("%s is at network version %d, which is newer than this build knows, upgrade estuary", n.Name, nv)
+		return nil
+	}
+
+	max := n.MaxActorsVersion
+	if max == 0 {
+		max = actors.LatestVersion
+	}
+	if int(av) > max {
+		return fmt.Errorf("%s runs actors v%d, the node is configured to run against up to v%d", n.Name, av, max)
+	}
+	return nil
+}
+
+// actorsVersion returns the network version of the chain and the actors
+// version it runs, which is -1 for network versions this build doesn't know
+func actorsVersion(ctx context.Context, capi api.Gateway) (network.Version, actors.Version, error) {
+	nv, err := capi.StateNetworkVersion(ctx, types.EmptyTSK)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get network version: %w", err)
+	}
+	av, err := actors.VersionForNetwork(nv)
+	if err != nil {
+		return nv, -1, nil
+	}
+	return nv, av, nil
+}
+
+type chainResponse struct {
+	Network        string    `json:"network"`
+	Mode           string    `json:"mode"`
+	Height         int64     `json:"height"`
+	HeadTime       time.Time `json:"headTime"`
+	NetworkVersion int       `json:"networkVersion"`
+	// ActorsVersion is -1 when the network version is newer than this
+	// build knows
+	ActorsVersion int      `json:"actorsVersion"`
+	Degraded      []string `json:"degraded"`
+}
+
+// handleAdminGetChain godoc
+// @Summary      Get chain api status
+// @Description  This endpoint returns the network the node is on, whether it talks to a full lotus node or a lotus gateway, the chain head it sees and what doesn't work in lite mode.
+// @Tags         admin
+// @Produce      json
+// @Success      200  {object}  chainResponse
+// @Router       /admin/chain [get]
+func (s *Server) handleAdminGetChain(c echo.Context) error {
+	ctx := c.Request().Context()
+	head, err := s.Api.ChainHead(ctx)
+	if err != nil {
+		return err
+	}
+	nv, av, err := actorsVersion(ctx, s.Api)
+	if err != nil {
+		return err
+	}
+
+	resp := chainResponse{
+		Network:        build.CurrentNetwork.Name,
+		Mode:           s.lotusMode,
+		Height:         int64(head.Height()),
+		HeadTime:       time.Unix(int64(head.MinTimestamp()), 0),
+		NetworkVersion: int(nv),
+		ActorsVersion:  int(av),
+		Degraded:       []string{},
+	}
+	if s.lotusMode == lotusModeLite {
+		resp.Degraded = liteDegraded
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// requireFullNode fails requests that need more chain history than a lotus
+// gateway keeps
+func (s *Server) requireFullNode() error {
+	if s.lotusMode != lotusModeLite {
+		return nil
+	}
+	return &util.HttpError{
+		Code:    http.StatusNotImplemented,
+		Reason:  util.ERR_FULL_NODE_REQUIRED,
+		Details: "this needs a full lotus node, the node is running against a lotus gateway",
+	}
+}
@@ -4,11 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/application-research/estuary/constants"
@@ -17,21 +17,35 @@ import (
 
 	"go.opencensus.io/stats/view"
 
+	"github.com/application-research/estuary/alerts"
 	"github.com/application-research/estuary/autoretrieve"
 	"github.com/application-research/estuary/build"
 	"github.com/application-research/estuary/config"
 	drpc "github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/featureflags"
+	"github.com/application-research/estuary/jobs"
+	"github.com/application-research/estuary/leader"
 	"github.com/application-research/estuary/metrics"
 	"github.com/application-research/estuary/node"
 	"github.com/application-research/estuary/pinner"
 	"github.com/application-research/estuary/stagingbs"
 	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/cdn"
+	"github.com/application-research/estuary/util/dagstat"
+	"github.com/application-research/estuary/util/denylist"
 	"github.com/application-research/estuary/util/gateway"
+	"github.com/application-research/estuary/util/gsfetch"
+	"github.com/application-research/estuary/util/httpfetch"
+	"github.com/application-research/estuary/util/oidc"
+	"github.com/application-research/estuary/util/sessionpool"
+	"github.com/application-research/estuary/util/withhold"
 	"github.com/application-research/filclient"
 	"github.com/google/uuid"
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/ipfs/go-cid"
 	gsimpl "github.com/ipfs/go-graphsync/impl"
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/labstack/echo/v4"
 	"github.com/libp2p/go-libp2p-core/protocol"
 	routed "github.com/libp2p/go-libp2p/p2p/host/routed"
 	"github.com/mitchellh/go-homedir"
@@ -43,7 +57,6 @@ import (
 
 	datatransfer "github.com/filecoin-project/go-data-transfer"
 	"github.com/filecoin-project/lotus/api"
-	lcli "github.com/filecoin-project/lotus/cli"
 	cli "github.com/urfave/cli/v2"
 
 	"gorm.io/gorm"
@@ -62,9 +75,19 @@ type storageMiner struct {
 	Version         string
 	Location        string
 	Owner           uint
+	// SnapDeals is set for providers that put deals into committed
+	// capacity sectors with snap deals
+	SnapDeals bool
+	// DealTransfer is how Boost providers get the data of deals, picked
+	// automatically when empty
+	DealTransfer string
 }
 
 func before(cctx *cli.Context) error {
+	if err := util.SetupLogFormat(util.LogFormat); err != nil {
+		return err
+	}
+
 	level := util.LogLevel
 
 	_ = logging.SetLogLevel("dt-impl", level)
@@ -94,12 +117,20 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Estuary
 		switch name {
 		case "node-api-url":
 			cfg.Node.ApiURL = cctx.String("node-api-url")
+		case "network":
+			cfg.Network.Name = cctx.String("network")
+		case "lotus-mode":
+			cfg.Node.LotusMode = cctx.String("lotus-mode")
 		case "datadir":
 			cfg.DataDir = cctx.String("datadir")
 		case "blockstore":
 			cfg.Node.Blockstore = cctx.String("blockstore")
 		case "no-blockstore-cache":
 			cfg.Node.NoBlockstoreCache = cctx.Bool("no-blockstore-cache")
+		case "block-cache-size":
+			cfg.Node.BlockCache.Size = cctx.Int64("block-cache-size")
+		case "write-batch-size":
+			cfg.Node.WriteBatch.MaxBlocks = cctx.Int("write-batch-size")
 		case "write-log-truncate":
 			cfg.Node.WriteLogTruncate = cctx.Bool("write-log-truncate")
 		case "write-log-flush":
@@ -114,6 +145,40 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Estuary
 			}
 		case "database":
 			cfg.DatabaseConnString = cctx.String("database")
+		case "database-max-conns":
+			cfg.Database.MaxOpenConns = cctx.Int("database-max-conns")
+		case "database-statement-timeout":
+			cfg.Database.StatementTimeout = cctx.Duration("database-statement-timeout")
+		case "database-read-replica":
+			cfg.Database.ReadReplicaConnString = cctx.String("database-read-replica")
+		case "shared-pin-queue":
+			cfg.PinQueue.Shared = cctx.Bool("shared-pin-queue")
+		case "pin-queue-name":
+			cfg.PinQueue.Name = cctx.String("pin-queue-name")
+		case "pin-queue-encoding":
+			cfg.PinQueue.Encoding = cctx.String("pin-queue-encoding")
+		case "fetch-workers":
+			cfg.PinQueue.Fetch.Workers = cctx.Int("fetch-workers")
+		case "fetch-max-workers":
+			cfg.PinQueue.Fetch.MaxWorkers = cctx.Int("fetch-max-workers")
+		case "fetch-want-batch-size":
+			cfg.PinQueue.Fetch.WantBatchSize = cctx.Int("fetch-want-batch-size")
+		case "pin-transport":
+			t, err := gsfetch.ParseTransport(cctx.String("pin-transport"))
+			if err != nil {
+				return err
+			}
+			cfg.PinQueue.Fetch.Transport = string(t)
+		case "gateway-fallback":
+			cfg.PinQueue.GatewayFallback.Enabled = cctx.Bool("gateway-fallback")
+		case "fallback-gateways":
+			cfg.PinQueue.GatewayFallback.Gateways = cctx.StringSlice("fallback-gateways")
+		case "lookup-indexer-url":
+			cfg.Node.LookupIndexerURL = cctx.String("lookup-indexer-url")
+		case "max-queued-pins-per-user":
+			cfg.PinQueue.MaxQueuedPerUser = cctx.Int64("max-queued-pins-per-user")
+		case "api-rate-limit":
+			cfg.RateLimit.RequestsPerSecond = cctx.Float64("api-rate-limit")
 		case "apilisten":
 			cfg.ApiListen = cctx.String("apilisten")
 		case "announce":
@@ -150,8 +215,18 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Estuary
 			cfg.Deal.Verified = cctx.Bool("verified-deal")
 		case "fail-deals-on-transfer-failure":
 			cfg.Deal.FailOnTransferFailure = cctx.Bool("fail-deals-on-transfer-failure")
+		case "max-provider-dials":
+			cfg.FilClient.ProviderConns.MaxDials = cctx.Int("max-provider-dials")
+		case "deal-proposal-pace":
+			cfg.Deal.Batch.Pace = cctx.Duration("deal-proposal-pace")
+		case "no-pin-queue-snapshot":
+			cfg.PinQueue.Snapshot.Enabled = !cctx.Bool("no-pin-queue-snapshot")
+		case "no-deal-batching":
+			cfg.Deal.Batch.Enabled = !cctx.Bool("no-deal-batching")
 		case "disable-local-content-adding":
 			cfg.Content.DisableLocalAdding = cctx.Bool("disable-local-content-adding")
+		case "dedupe-across-users":
+			cfg.Content.DedupeAcrossUsers = cctx.Bool("dedupe-across-users")
 		case "disable-content-adding":
 			cfg.Content.DisableGlobalAdding = cctx.Bool("disable-content-adding")
 		case "jaeger-tracing":
@@ -160,10 +235,20 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Estuary
 			cfg.Jaeger.ProviderUrl = cctx.String("jaeger-provider-url")
 		case "jaeger-sampler-ratio":
 			cfg.Jaeger.SamplerRatio = cctx.Float64("jaeger-sampler-ratio")
+		case "otlp-tracing":
+			cfg.Otlp.EnableTracing = cctx.Bool("otlp-tracing")
+		case "otlp-endpoint":
+			cfg.Otlp.Endpoint = cctx.String("otlp-endpoint")
+		case "otlp-insecure":
+			cfg.Otlp.Insecure = cctx.Bool("otlp-insecure")
+		case "otlp-sampler-ratio":
+			cfg.Otlp.SamplerRatio = cctx.Float64("otlp-sampler-ratio")
 		case "logging":
 			cfg.Logging.ApiEndpointLogging = cctx.Bool("logging")
 		case "enable-auto-retrieve":
 			cfg.EnableAutoRetrieve = cctx.Bool("enable-auto-retrieve")
+		case "leader-election":
+			cfg.EnableLeaderElection = cctx.Bool("leader-election")
 		case "bitswap-max-work-per-peer":
 			cfg.Node.Bitswap.MaxOutstandingBytesPerPeer = cctx.Int64("bitswap-max-work-per-peer")
 		case "bitswap-target-message-size":
@@ -174,6 +259,20 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Estuary
 			cfg.Node.IndexerURL = cctx.String("indexer-url")
 		case "indexer-tick-interval":
 			cfg.Node.IndexerTickInterval = cctx.Int("indexer-tick-interval")
+		case "alert-slack-webhook":
+			cfg.Alerts.SlackWebhookURL = cctx.String("alert-slack-webhook")
+		case "alert-pagerduty-key":
+			cfg.Alerts.PagerDutyRoutingKey = cctx.String("alert-pagerduty-key")
+		case "alert-webhook":
+			cfg.Alerts.WebhookURL = cctx.String("alert-webhook")
+		case "event-stream-backend":
+			cfg.EventStream.Backend = cctx.String("event-stream-backend")
+		case "event-stream-servers":
+			cfg.EventStream.Servers = cctx.StringSlice("event-stream-servers")
+		case "event-stream-topic":
+			cfg.EventStream.Topic = cctx.String("event-stream-topic")
+		case "event-stream-serialization":
+			cfg.EventStream.Serialization = cctx.String("event-stream-serialization")
 
 		case "deal-protocol-version":
 			dprs := make(map[protocol.ID]bool, 0)
@@ -216,6 +315,7 @@ func main() {
 
 	app.Flags = []cli.Flag{
 		util.FlagLogLevel,
+		util.FlagLogFormat,
 		&cli.StringFlag{
 			Name:  "repo",
 			Value: "~/.lotus",
@@ -226,6 +326,16 @@ func main() {
 			Usage:   "lotus api gateway url",
 			EnvVars: []string{"FULLNODE_API_INFO"},
 		},
+		&cli.StringFlag{
+			Name:  "network",
+			Value: cfg.Network.Name,
+			Usage: "filecoin network to make deals on: mainnet, calibnet or devnet",
+		},
+		&cli.StringFlag{
+			Name:  "lotus-mode",
+			Value: cfg.Node.LotusMode,
+			Usage: "full for a full lotus node, lite for a lotus gateway, auto to detect which one node-api-url is",
+		},
 		&cli.StringFlag{
 			Name:  "config",
 			Usage: "specify configuration file location",
@@ -237,6 +347,82 @@ func main() {
 			Value:   cfg.DatabaseConnString,
 			EnvVars: []string{"ESTUARY_DATABASE"},
 		},
+		&cli.IntFlag{
+			Name:  "database-max-conns",
+			Usage: "maximum number of open connections to the database",
+			Value: cfg.Database.MaxOpenConns,
+		},
+		&cli.DurationFlag{
+			Name:  "database-statement-timeout",
+			Usage: "abort database queries that run longer than this (postgres only)",
+			Value: cfg.Database.StatementTimeout,
+		},
+		&cli.StringFlag{
+			Name:    "database-read-replica",
+			Usage:   "specify connection string for a read replica that listing and status queries are sent to",
+			Value:   cfg.Database.ReadReplicaConnString,
+			EnvVars: []string{"ESTUARY_DATABASE_READ_REPLICA"},
+		},
+		&cli.BoolFlag{
+			Name:  "shared-pin-queue",
+			Usage: "keep the pin queue in the database so every node configured with the same queue name works through it",
+			Value: cfg.PinQueue.Shared,
+		},
+		&cli.StringFlag{
+			Name:  "pin-queue-encoding",
+			Usage: "how shared pin queue entries are stored: json, compact, snappy or zstd",
+			Value: cfg.PinQueue.Encoding,
+		},
+		&cli.StringFlag{
+			Name:  "pin-queue-name",
+			Usage: "name of the shared pin queue to consume from",
+			Value: cfg.PinQueue.Name,
+		},
+		&cli.IntFlag{
+			Name:  "fetch-workers",
+			Usage: "number of blocks of a pin fetched in parallel when it starts",
+			Value: cfg.PinQueue.Fetch.Workers,
+		},
+		&cli.IntFlag{
+			Name:  "fetch-max-workers",
+			Usage: "number of parallel block fetches a large pin can grow to",
+			Value: cfg.PinQueue.Fetch.MaxWorkers,
+		},
+		&cli.IntFlag{
+			Name:  "fetch-want-batch-size",
+			Usage: "number of blocks each fetch worker of a pin requests at once",
+			Value: cfg.PinQueue.Fetch.WantBatchSize,
+		},
+		&cli.StringFlag{
+			Name:  "pin-transport",
+			Usage: "how pins are fetched: auto, bitswap or graphsync",
+			Value: cfg.PinQueue.Fetch.Transport,
+		},
+		&cli.BoolFlag{
+			Name:  "gateway-fallback",
+			Usage: "fetch pins that stalled from trusted http gateways instead of peer to peer",
+			Value: cfg.PinQueue.GatewayFallback.Enabled,
+		},
+		&cli.StringSliceFlag{
+			Name:  "fallback-gateways",
+			Usage: "trusted http gateways to fetch pins that stalled from",
+			Value: cli.NewStringSlice(cfg.PinQueue.GatewayFallback.Gateways...),
+		},
+		&cli.StringFlag{
+			Name:  "lookup-indexer-url",
+			Usage: "network indexer to look up providers at alongside the dht, empty to only use the dht",
+			Value: cfg.Node.LookupIndexerURL,
+		},
+		&cli.Int64Flag{
+			Name:  "max-queued-pins-per-user",
+			Usage: "refuse new pins from users with this many pins waiting in the queue, 0 for no limit",
+			Value: cfg.PinQueue.MaxQueuedPerUser,
+		},
+		&cli.Float64Flag{
+			Name:  "api-rate-limit",
+			Usage: "requests per second each user may make to the api, 0 for no limit",
+			Value: cfg.RateLimit.RequestsPerSecond,
+		},
 		&cli.StringFlag{
 			Name:    "apilisten",
 			Usage:   "address for the api server to listen on",
@@ -266,7 +452,7 @@ func main() {
 		},
 		&cli.BoolFlag{
 			Name:  "no-storage-cron",
-			Usage: "run estuary without processing files into deals",
+			Usage: "run estuary without processing files into deals, until the deal-checks and staging-aggregation jobs are resumed",
 			Value: cfg.DisableFilecoinStorage,
 		},
 		&cli.BoolFlag{
@@ -280,6 +466,11 @@ func main() {
 			Value:  cfg.EnableAutoRetrieve,
 			Hidden: true,
 		},
+		&cli.BoolFlag{
+			Name:  "leader-election",
+			Usage: "elect a leader to run the deal maker and other singleton workers, for running multiple instances against one postgres database",
+			Value: cfg.EnableLeaderElection,
+		},
 		&cli.StringFlag{
 			Name:    "lightstep-token",
 			Usage:   "specify lightstep access token for enabling trace exports",
@@ -296,6 +487,26 @@ func main() {
 			Usage: "consider deals failed when the transfer to the miner fails",
 			Value: cfg.Deal.FailOnTransferFailure,
 		},
+		&cli.IntFlag{
+			Name:  "max-provider-dials",
+			Usage: "maximum number of storage providers to dial at the same time",
+			Value: cfg.FilClient.ProviderConns.MaxDials,
+		},
+		&cli.DurationFlag{
+			Name:  "deal-proposal-pace",
+			Usage: "time to wait between two deal proposals to the same storage provider",
+			Value: cfg.Deal.Batch.Pace,
+		},
+		&cli.BoolFlag{
+			Name:  "no-pin-queue-snapshot",
+			Usage: "do not keep the pin queue on disk, rebuild it from the database on start",
+			Value: !cfg.PinQueue.Snapshot.Enabled,
+		},
+		&cli.BoolFlag{
+			Name:  "no-deal-batching",
+			Usage: "send every deal proposal on its own instead of queueing them per storage provider",
+			Value: !cfg.Deal.Batch.Enabled,
+		},
 		&cli.BoolFlag{
 			Name:  "disable-deal-making",
 			Usage: "do not create any new deals (existing deals will still be processed)",
@@ -316,6 +527,11 @@ func main() {
 			Usage: "disallow new content ingestion on this node (shuttles are unaffected)",
 			Value: cfg.Content.DisableLocalAdding,
 		},
+		&cli.BoolFlag{
+			Name:  "dedupe-across-users",
+			Usage: "store and make deals for content pinned by several users only once",
+			Value: cfg.Content.DedupeAcrossUsers,
+		},
 		&cli.StringFlag{
 			Name:  "blockstore",
 			Usage: "specify blockstore parameters",
@@ -336,6 +552,16 @@ func main() {
 			Usage: "disable blockstore caching",
 			Value: cfg.Node.NoBlockstoreCache,
 		},
+		&cli.Int64Flag{
+			Name:  "block-cache-size",
+			Usage: "bytes of recently read blocks to keep in memory, 0 to disable",
+			Value: cfg.Node.BlockCache.Size,
+		},
+		&cli.IntFlag{
+			Name:  "write-batch-size",
+			Usage: "number of blocks to buffer and write to the blockstore together, 0 to write every block as it comes in",
+			Value: cfg.Node.WriteBatch.MaxBlocks,
+		},
 		&cli.IntFlag{
 			Name:  "replication",
 			Usage: "sets replication factor",
@@ -361,6 +587,26 @@ func main() {
 			Usage: "If less than 1 probabilistic metrics will be used.",
 			Value: cfg.Jaeger.SamplerRatio,
 		},
+		&cli.BoolFlag{
+			Name:  "otlp-tracing",
+			Usage: "enables exporting traces to an OTLP/HTTP collector",
+			Value: cfg.Otlp.EnableTracing,
+		},
+		&cli.StringFlag{
+			Name:  "otlp-endpoint",
+			Usage: "sets the OTLP/HTTP collector endpoint (host:port)",
+			Value: cfg.Otlp.Endpoint,
+		},
+		&cli.BoolFlag{
+			Name:  "otlp-insecure",
+			Usage: "send traces to the OTLP collector without TLS",
+			Value: cfg.Otlp.Insecure,
+		},
+		&cli.Float64Flag{
+			Name:  "otlp-sampler-ratio",
+			Usage: "If less than 1 probabilistic metrics will be used.",
+			Value: cfg.Otlp.SamplerRatio,
+		},
 		&cli.Int64Flag{
 			Name:  "bitswap-max-work-per-peer",
 			Usage: "sets the bitswap max work per peer",
@@ -390,6 +636,41 @@ func main() {
 			Usage: "sets the indexer advertisement interval in minutes",
 			Value: cfg.Node.IndexerTickInterval,
 		},
+		&cli.StringFlag{
+			Name:  "alert-slack-webhook",
+			Usage: "slack incoming webhook url to send operational alerts to",
+			Value: cfg.Alerts.SlackWebhookURL,
+		},
+		&cli.StringFlag{
+			Name:  "alert-pagerduty-key",
+			Usage: "PagerDuty events v2 routing key to send operational alerts to",
+			Value: cfg.Alerts.PagerDutyRoutingKey,
+		},
+		&cli.StringFlag{
+			Name:  "alert-webhook",
+			Usage: "url that operational alerts are posted to as json",
+			Value: cfg.Alerts.WebhookURL,
+		},
+		&cli.StringFlag{
+			Name:  "event-stream-backend",
+			Usage: "publish content events to 'kafka' or 'nats'",
+			Value: cfg.EventStream.Backend,
+		},
+		&cli.StringSliceFlag{
+			Name:  "event-stream-servers",
+			Usage: "kafka brokers or nats server urls to publish content events to",
+			Value: cli.NewStringSlice(cfg.EventStream.Servers...),
+		},
+		&cli.StringFlag{
+			Name:  "event-stream-topic",
+			Usage: "kafka topic or nats subject prefix content events are published on",
+			Value: cfg.EventStream.Topic,
+		},
+		&cli.StringFlag{
+			Name:  "event-stream-serialization",
+			Usage: "serialization of published content events, 'json' or 'cbor'",
+			Value: cfg.EventStream.Serialization,
+		},
 	}
 	app.Commands = []*cli.Command{
 		{
@@ -435,7 +716,7 @@ func main() {
 					return errors.New("setup password cannot be empty")
 				}
 
-				db, err := setupDatabase(cfg.DatabaseConnString)
+				db, err := setupDatabase(cfg.DatabaseConnString, cfg.Database)
 				if err != nil {
 					return err
 				}
@@ -496,7 +777,99 @@ func main() {
 				}
 				return cfg.Save(configFile)
 			},
+		}, {
+			Name:      "backup",
+			Usage:     "Writes the node's database tables and pin queues to an archive that can be restored on a new host",
+			ArgsUsage: "<output file>",
+			Action: func(cctx *cli.Context) error {
+				if cctx.Args().Len() != 1 {
+					return errors.New("must specify the file to write the backup to")
+				}
+
+				if err := cfg.Load(cctx.String("config")); err != nil && err != config.ErrNotInitialized {
+					return err
+				}
+
+				if err := overrideSetOptions(app.Flags, cctx, cfg); err != nil {
+					return err
+				}
+
+				db, err := setupDatabase(cfg.DatabaseConnString, cfg.Database)
+				if err != nil {
+					return err
+				}
+
+				fi, err := os.Create(cctx.Args().First())
+				if err != nil {
+					return err
+				}
+				defer fi.Close()
+
+				man, err := util.WriteBackup(cctx.Context, db, fi, cfg.Hostname, backupTables(cfg))
+				if err != nil {
+					return err
+				}
+
+				for _, t := range man.Tables {
+					fmt.Printf("%s: %d rows\n", t, man.Rows[t])
+				}
+				return fi.Close()
+			},
+		}, {
+			Name:      "restore",
+			Usage:     "Loads a backup archive into the node's database, run it before starting the node",
+			ArgsUsage: "<backup file>",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "force",
+					Usage: "restore into a database that already has users",
+				},
+			},
+			Action: func(cctx *cli.Context) error {
+				if cctx.Args().Len() != 1 {
+					return errors.New("must specify the backup file to restore")
+				}
+
+				if err := cfg.Load(cctx.String("config")); err != nil && err != config.ErrNotInitialized {
+					return err
+				}
+
+				if err := overrideSetOptions(app.Flags, cctx, cfg); err != nil {
+					return err
+				}
+
+				db, err := setupDatabase(cfg.DatabaseConnString, cfg.Database)
+				if err != nil {
+					return err
+				}
+
+				var users int64
+				if err := db.Model(&User{}).Count(&users).Error; err != nil {
+					return err
+				}
+				if users > 0 && !cctx.Bool("force") {
+					return fmt.Errorf("database already has %d users, pass --force to restore into it anyway", users)
+				}
+
+				fi, err := os.Open(cctx.Args().First())
+				if err != nil {
+					return err
+				}
+				defer fi.Close()
+
+				man, err := util.RestoreBackup(cctx.Context, db, fi, backupTables(cfg))
+				if err != nil {
+					return err
+				}
+
+				fmt.Printf("restored backup of %s taken %s\n", man.Node, man.Created.Format(time.RFC3339))
+				for _, t := range man.Tables {
+					fmt.Printf("%s: %d rows\n", t, man.Rows[t])
+				}
+				return nil
+			},
 		},
+		pinQueueCommand(cfg, app.Flags),
 	}
 	app.Action = func(cctx *cli.Context) error {
 		log.Infof("estuary version: %s", appVersion)
@@ -509,16 +882,59 @@ func main() {
 			return err
 		}
 
-		db, err := setupDatabase(cfg.DatabaseConnString)
+		network, err := cfg.Network.Resolve()
 		if err != nil {
 			return err
 		}
+		if err := build.SetNetwork(network); err != nil {
+			return err
+		}
 
-		init := Initializer{&cfg.Node, db, nil}
+		if err := util.ApplyLogLevels(cfg.Logging.Levels); err != nil {
+			return err
+		}
+
+		db, err := setupDatabase(cfg.DatabaseConnString, cfg.Database)
+		if err != nil {
+			return err
+		}
+
+		// blocks of private content aren't served over bitswap, nor are
+		// denylisted blocks
+		dl := newContentDenylist(db, cfg.Denylist)
+		withheld, err := withhold.New(func(ctx context.Context, c cid.Cid) (bool, error) {
+			if dl.listed(c) {
+				return true, nil
+			}
+			return isPrivateCid(ctx, db, c)
+		}, withheldCacheSize, withheldCacheTTL)
+		if err != nil {
+			return err
+		}
+
+		init := Initializer{
+			cfg:                &cfg.Node,
+			db:                 db,
+			scheduledReprovide: cfg.Reprovide.Enabled,
+			withheld:           withheld,
+		}
 		nd, err := node.Setup(cctx.Context, &init)
 		if err != nil {
 			return err
 		}
+		defer nd.Host.Close() //nolint:errcheck
+		defer func() {
+			if err := nd.GraphsyncFetcher.Close(); err != nil {
+				log.Errorf("failed to close graphsync fetcher: %s", err)
+			}
+		}()
+		if nd.WriteBatcher != nil {
+			defer func() {
+				if err := nd.WriteBatcher.Close(); err != nil {
+					log.Errorf("failed to flush buffered blocks: %s", err)
+				}
+			}()
+		}
 
 		if err = view.Register(metrics.DefaultViews...); err != nil {
 			log.Fatalf("Cannot register the OpenCensus view: %v", err)
@@ -535,21 +951,15 @@ func main() {
 			return err
 		}
 
-		// send a CLI context to lotus that contains only the node "api-url" flag set, so that other flags don't accidentally conflict with lotus cli flags
-		// https://github.com/filecoin-project/lotus/blob/731da455d46cb88ee5de9a70920a2d29dec9365c/cli/util/api.go#L37
-		flset := flag.NewFlagSet("lotus", flag.ExitOnError)
-		flset.String("api-url", "", "node api url")
-		err = flset.Set("api-url", cfg.Node.ApiURL)
+		api, closer, lotusMode, err := connectLotus(cctx.Context, cfg.Node.ApiURL, cfg.Node.LotusMode)
 		if err != nil {
 			return err
 		}
+		defer closer()
 
-		ncctx := cli.NewContext(cli.NewApp(), flset, nil)
-		api, closer, err := lcli.GetGatewayAPI(ncctx)
-		if err != nil {
+		if err := checkNetwork(cctx.Context, api, build.CurrentNetwork); err != nil {
 			return err
 		}
-		defer closer()
 
 		// setup tracing to jaeger if enabled
 		if cfg.Jaeger.EnableTracing {
@@ -561,22 +971,143 @@ func main() {
 			otel.SetTracerProvider(tp)
 		}
 
+		// setup tracing to an otlp collector if enabled, this takes precedence over jaeger
+		if cfg.Otlp.EnableTracing {
+			tp, err := metrics.NewOtlpTraceProvider(cctx.Context, "estuary",
+				cfg.Otlp.Endpoint, cfg.Otlp.Insecure, cfg.Otlp.SamplerRatio)
+			if err != nil {
+				return err
+			}
+			otel.SetTracerProvider(tp)
+			defer func() {
+				if err := tp.Shutdown(context.Background()); err != nil {
+					log.Errorf("failed to flush traces: %s", err)
+				}
+			}()
+		}
+		metrics.SetupPropagation()
+
 		s := &Server{
 			DB:          db,
 			Node:        nd,
 			Api:         api,
+			lotusMode:   lotusMode,
 			StagingMgr:  sbmgr,
 			tracer:      otel.Tracer("api"),
 			cacher:      memo.NewCacher(),
-			gwayHandler: gateway.NewGatewayHandler(nd.Blockstore),
+			gwayHandler: gateway.NewGatewayHandler(denylist.Blockstore(nd.Blockstore, dl.listed)),
 			estuaryCfg:  cfg,
+			alerts:      newAlertManager(cfg),
+			diskMon:     util.NewDiskMonitor(util.DiskPressureOptions(cfg.DiskPressure), cfg.Node.Blockstore, cfg.DataDir, cfg.StagingDataDir),
+			jobs:        jobs.NewScheduler(maxConcurrentJobs),
+			elector:     leader.NewStaticElector(),
+			withheld:    withheld,
+		}
+		s.sessions = sessionpool.New(s.newFetchSession, nd.Host.ConnManager(), cfg.PinQueue.SessionIdleTimeout)
+		defer s.sessions.Close()
+		if gf := cfg.PinQueue.GatewayFallback; gf.Enabled {
+			s.gateways = httpfetch.New(gf.Gateways, gf.Timeout)
+		}
+		s.oidc = setupOIDC(cctx.Context, cfg.OIDC)
+		s.ucanUsers, err = lru.New(10000)
+		if err != nil {
+			return err
+		}
+		s.originsCache, err = lru.New(10000)
+		if err != nil {
+			return err
+		}
+		s.shareAttempts, err = lru.New(shareLinkAttemptsTracked)
+		if err != nil {
+			return err
+		}
+		s.retrievalTickets, err = lru.New(retrievalTicketsTracked)
+		if err != nil {
+			return err
+		}
+		if cfg.Egress.Enabled {
+			s.egress, err = newEgressMeter(db)
+			if err != nil {
+				return err
+			}
+		}
+		if cfg.CDN.Enabled {
+			s.cdn = &cdnState{
+				client: cdn.NewClient(cfg.CDN.RegisterURL, cfg.CDN.DeregisterURL, cfg.CDN.APIKey, cfg.CDN.Timeout),
+				heat:   cdn.NewHeat(cfg.CDN.HotWindow, cdnHeatKeys),
+			}
+		}
+		if cfg.Tiering.Enabled || cfg.ColdOffload.Enabled {
+			s.retrievals = newRetrievalMeter(db)
+		}
+		s.dagStats, err = newDagStats(nd.Blockstore)
+		if err != nil {
+			return err
+		}
+		s.accessSecret, err = accessSecret(cfg.PrivateRetrieval.Secret, nd.Host.Peerstore().PrivKey(nd.Host.ID()))
+		if err != nil {
+			return err
+		}
+		if cfg.Notifications.Enabled {
+			s.notifier, err = newNotifier(db, cfg.Notifications, cfg.Hostname)
+			if err != nil {
+				return fmt.Errorf("invalid notifications config: %w", err)
+			}
+		}
+		s.importDefaults, err = util.ImportDefaults(cfg.Content.CidVersion, cfg.Content.HashFunction, cfg.Content.InlineLimit)
+		if err != nil {
+			return fmt.Errorf("invalid content config: %w", err)
+		}
+
+		pinQueue, err := setupPinQueue(db, cfg.PinQueue, cfg.Database)
+		if err != nil {
+			return err
+		}
+
+		var queueStore *pinner.QueueStore
+		if cfg.PinQueue.Snapshot.Enabled && pinQueue == nil {
+			queueStore, err = pinner.OpenQueueStore(filepath.Join(cfg.DataDir, "pinqueue"))
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := queueStore.Close(); err != nil {
+					log.Errorf("failed to snapshot pin queue: %s", err)
+				}
+			}()
+			go queueStore.Run(cctx.Context, cfg.PinQueue.Snapshot.Interval)
+		}
+
+		var dedupeIndex *pinner.DedupeIndex
+		if cfg.PinQueue.Dedupe.OnDisk && pinQueue == nil {
+			dedupeIndex, err = pinner.OpenDedupeIndex(filepath.Join(cfg.DataDir, "pinqueue-dedupe"))
+			if err != nil {
+				return err
+			}
 		}
 
 		// TODO: this is an ugly self referential hack... should fix
 		pinmgr := pinner.NewPinManager(s.doPinning, s.PinStatusFunc, &pinner.PinManagerOpts{
-			MaxActivePerUser: 20,
+			MaxActivePerUser: cfg.PinQueue.MaxActivePerUser,
+			SharedQueue:      pinQueue,
+			Store:            queueStore,
+			DedupeIndex:      dedupeIndex,
+			DedupeBloomSize:  cfg.PinQueue.Dedupe.BloomSize,
+			PollInterval:     cfg.PinQueue.PollInterval,
+			StallTimeout:     cfg.PinQueue.StallTimeout,
+			MaxStallRestarts: cfg.PinQueue.MaxStallRestarts,
+			StallDropOrigins: cfg.PinQueue.StallDropOrigins,
+			ProviderTimeout:  cfg.PinQueue.ProviderCheck.Timeout,
 		})
-		go pinmgr.Run(50)
+		if cfg.PinQueue.ProviderCheck.Enabled {
+			pinmgr.ProviderFunc = s.pinProviderFunc(cfg.PinQueue.ProviderCheck)
+		}
+		go pinmgr.Run(cfg.PinQueue.Workers)
+		defer func() {
+			if err := pinmgr.Close(); err != nil {
+				log.Errorf("failed to close pin manager: %s", err)
+			}
+		}()
 
 		rhost := routed.Wrap(nd.Host, nd.FilDht)
 
@@ -622,6 +1153,38 @@ func main() {
 			return err
 		}
 		s.CM = cm
+		if cm.proposals != nil {
+			// proposals still queued are abandoned, their content is
+			// checked again on startup
+			defer cm.proposals.Close()
+		}
+		s.gwayHandler.UseCarIndexes(cm.carIndexes)
+		pinmgr.StallFunc = cm.onPinStalled
+		cm.denylist = dl
+		if lotusMode == lotusModeLite {
+			cm.msgLookback = liteLookback
+		}
+
+		flags, err := newFeatureFlags(db, cfg.FeatureFlags)
+		if err != nil {
+			return err
+		}
+		s.flags = flags
+		cm.flags = flags
+
+		events, err := newEventStream(cfg.EventStream)
+		if err != nil {
+			return err
+		}
+		if events != nil {
+			cm.events = events
+			go events.Run(cctx.Context)
+			defer func() {
+				if err := events.Close(); err != nil {
+					log.Errorf("failed to close event stream: %s", err)
+				}
+			}()
+		}
 
 		fc.SetPieceCommFunc(cm.getPieceCommitment)
 		s.FilClient = fc
@@ -630,17 +1193,44 @@ func main() {
 			init.trackingBstore.SetCidReqFunc(cm.RefreshContentForCid)
 		}
 
-		go cm.ContentWatcher()
+		if cfg.EnableLeaderElection {
+			s.elector = leader.NewElector(db, "estuary")
+			s.elector.OnLost = func() {
+				// the deal maker and pin dispatcher can't be stopped once
+				// started, exit rather than risk running them twice
+				log.Fatalf("lost leadership, exiting")
+			}
+			go s.elector.Run(cctx.Context)
+		}
+		s.jobs.SetLeaderFunc(s.elector.IsLeader)
+
+		s.registerJobs()
+		s.jobs.Start(cctx.Context)
+
+		s.limits.set(cfg.RateLimit, cfg.PinQueue)
+		s.reloadedCfg = cfg
+		go util.WatchConfig(cctx.Context, cctx.String("config"), configPollInterval, func() error {
+			return s.reloadConfig(cctx, app.Flags)
+		})
 		go cm.handleShuttleMessages(cctx.Context, cfg.ShuttleMessageHandlers) // register workers/handlers to process shuttle rpc messages from a channel(queue)
 
-		// refresh pin queue for local contents
-		if !cm.globalContentAddingDisabled {
-			go func() {
+		// singleton workers only run on the leader when multiple instances share the database
+		go func() {
+			select {
+			case <-s.elector.Elected():
+			case <-cctx.Context.Done():
+				return
+			}
+
+			// refresh pin queue for local contents, unless it was kept from
+			// before the restart
+			if !cm.globalContentAddingDisabled && !cm.restorePinQueue() {
 				if err := cm.refreshPinQueue(cctx.Context, constants.ContentLocationLocal); err != nil {
 					log.Errorf("failed to refresh pin queue: %s", err)
 				}
-			}()
-		}
+			}
+			pinmgr.Reloaded()
+		}()
 
 		s.Node.ArEngine, err = autoretrieve.NewAutoretrieveEngine(context.Background(), cfg, s.DB, s.Node.Host, s.Node.Datastore)
 		if err != nil {
@@ -666,8 +1256,8 @@ func main() {
 	}
 }
 
-func setupDatabase(dbConnStr string) (*gorm.DB, error) {
-	db, err := util.SetupDatabase(dbConnStr)
+func setupDatabase(dbConnStr string, dbcfg config.Database) (*gorm.DB, error) {
+	db, err := util.SetupDatabase(dbConnStr, util.DatabaseOptions(dbcfg))
 	if err != nil {
 		return nil, err
 	}
@@ -696,6 +1286,23 @@ func setupDatabase(dbConnStr string) (*gorm.DB, error) {
 	return db, nil
 }
 
+// setupPinQueue opens the shared pin queue if one is configured, in the
+// nodes own database unless the queue is given a database of its own
+func setupPinQueue(db *gorm.DB, cfg config.PinQueue, dbcfg config.Database) (*pinner.SharedQueue, error) {
+	if !cfg.Shared {
+		return nil, nil
+	}
+
+	if cfg.DatabaseConnString != "" {
+		qdb, err := util.SetupDatabase(cfg.DatabaseConnString, util.DatabaseOptions(dbcfg))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open pin queue database: %w", err)
+		}
+		db = qdb
+	}
+	return pinner.NewSharedQueue(db, cfg.Name, cfg.LeaseTimeout, cfg.Encoding)
+}
+
 func migrateSchemas(db *gorm.DB) error {
 	if err := db.AutoMigrate(
 		&util.Content{},
@@ -715,6 +1322,60 @@ func migrateSchemas(db *gorm.DB) error {
 		&AuthToken{},
 		&InviteCode{},
 		&Shuttle{},
+		&userUsageRecord{},
+		&contentEvent{},
+		&pinFetchStats{},
+		&RemotePin{},
+		&ClusterPin{},
+		&S3Object{},
+		&S3Upload{},
+		&S3UploadPart{},
+		&DealAttestation{},
+		&renewalPolicy{},
+		&datacapAllocation{},
+		&boostTransfer{},
+		&storageReceipt{},
+		&deadLetter{},
+		&userIdentity{},
+		&userOrigin{},
+		&Organization{},
+		&orgMember{},
+		&monthlyUsage{},
+		&egressRecord{},
+		&orgEgressRecord{},
+		&notification{},
+		&notificationSettings{},
+		&encryptedContent{},
+		&purgeRequest{},
+		&denylistEntry{},
+		&denylistBlock{},
+		&contentScan{},
+		&autoretrieve.QueuedContent{},
+		&autoretrieve.IPNIProvider{},
+		&autoretrieve.AdvertisedRange{},
+		&contentProvide{},
+		&retrievalAllowance{},
+		&paychChannel{},
+		&paychVoucher{},
+		&cdnRegistration{},
+		&shuttleBandwidth{},
+		&shuttleBandwidthLimit{},
+		&contentRetrieval{},
+		&contentTier{},
+		&contentRestore{},
+		&dealProgress{},
+		&userProviderRule{},
+		&dealConstraint{},
+		&contentRetention{},
+		&contentRedeal{},
+		&contentAudit{},
+		&contentDagStat{},
+		&shareLink{},
+		&contentName{},
+		&contentNameVersion{},
+		&billingAccount{},
+		&oidcLogin{},
+		&siweNonce{},
 		&autoretrieve.Autoretrieve{}); err != nil {
 		return err
 	}
@@ -730,10 +1391,68 @@ type Server struct {
 	Api        api.Gateway
 	CM         *ContentManager
 	StagingMgr *stagingbs.StagingBSMgr
+	// lotusMode is lotusModeFull or lotusModeLite
+	lotusMode string
 
 	gwayHandler *gateway.GatewayHandler
 
 	cacher *memo.Cacher
+
+	alerts       *alerts.Manager
+	alertChecker *alertChecker
+	diskMon      *util.DiskMonitor
+	limits       apiLimits
+	jobs         *jobs.Scheduler
+	elector      *leader.Elector
+	flags        *featureflags.Manager
+	drain        util.Drain
+	sessions     *sessionpool.Pool
+	// gateways is where pins that stalled are fetched from, nil unless the
+	// gateway fallback is enabled
+	gateways *httpfetch.Fetcher
+	// oidc are the identity providers users can log in with, by name
+	oidc map[string]*oidc.Provider
+	// ucanUsers caches the users UCANs are checked against
+	ucanUsers *lru.Cache
+	// originsCache caches the origins api keys can be used from, by user
+	originsCache *lru.Cache
+	// shareAttempts limits the password attempts on share links, by link
+	shareAttempts *lru.Cache
+	// retrievalTickets are the retrievals shuttles are serving, until they
+	// report how that went
+	retrievalTickets *lru.Cache
+
+	// egress counts the bytes served on the account of users, nil when
+	// egress is not metered
+	egress *egressMeter
+
+	// cdn is where hot content is redirected to, nil when it is off
+	cdn *cdnState
+
+	// retrievals counts gateway retrievals for tiering and the cold
+	// offload, nil when both are off
+	retrievals *retrievalMeter
+
+	// dagStats describes the DAGs of content, keeping the stats of the
+	// subtrees it went through
+	dagStats *dagstat.Calculator
+
+	// notifier emails users about events on their account, nil when
+	// notifications are off
+	notifier *notifier
+
+	// accessSecret signs the access tokens of private content
+	accessSecret []byte
+	// withheld keeps the blocks of private content from bitswap
+	withheld *withhold.Filter
+	// importDefaults is how uploads are imported unless they ask otherwise
+	importDefaults util.ImportOptions
+
+	echo *echo.Echo
+
+	// reloadLk guards reloadedCfg, the most recently applied config
+	reloadLk    sync.Mutex
+	reloadedCfg *config.Estuary
 }
 
 func (s *Server) GarbageCollect(ctx context.Context) error {
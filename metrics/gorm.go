@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"gorm.io/gorm"
+)
+
+const gormStartKey = "estuary:metrics_start"
+
+// GormPlugin records the duration of every database query in the
+// DBQueryDuration measure, tagged by operation and table.
+type GormPlugin struct{}
+
+func (GormPlugin) Name() string {
+	return "estuary:metrics"
+}
+
+func (p GormPlugin) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	hooks := []struct {
+		op     string
+		before func(string, func(*gorm.DB)) error
+		after  func(string, func(*gorm.DB)) error
+	}{
+		{"create", cb.Create().Before("gorm:create").Register, cb.Create().After("gorm:create").Register},
+		{"query", cb.Query().Before("gorm:query").Register, cb.Query().After("gorm:query").Register},
+		{"update", cb.Update().Before("gorm:update").Register, cb.Update().After("gorm:update").Register},
+		{"delete", cb.Delete().Before("gorm:delete").Register, cb.Delete().After("gorm:delete").Register},
+		{"row", cb.Row().Before("gorm:row").Register, cb.Row().After("gorm:row").Register},
+		{"raw", cb.Raw().Before("gorm:raw").Register, cb.Raw().After("gorm:raw").Register},
+	}
+
+	for _, h := range hooks {
+		if err := h.before(p.Name()+":before_"+h.op, startTimer); err != nil {
+			return err
+		}
+		if err := h.after(p.Name()+":after_"+h.op, recordDuration(h.op)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func startTimer(db *gorm.DB) {
+	db.InstanceSet(gormStartKey, time.Now())
+}
+
+func recordDuration(op string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		v, ok := db.InstanceGet(gormStartKey)
+		if !ok {
+			return
+		}
+		start, ok := v.(time.Time)
+		if !ok {
+			return
+		}
+
+		table := db.Statement.Table
+		if table == "" {
+			table = "unknown"
+		}
+
+		ctx, _ := tag.New(db.Statement.Context,
+			tag.Upsert(Op, op),
+			tag.Upsert(DBTable, table),
+		)
+		stats.Record(ctx, DBQueryDuration.M(SinceInMilliseconds(start)))
+	}
+}
@@ -14,15 +14,6 @@ var log = logging.Logger("metrics")
 // based on https://github.com/open-telemetry/opentelemetry-go/blob/v0.20.0/example/jaeger/main.go
 func NewJaegerTraceProvider(serviceName, agentEndpoint string, sampleRatio float64) (*sdktrace.TracerProvider, error) {
 	log.Infow("creating jaeger trace provider", "serviceName", serviceName, "ratio", sampleRatio, "endpoint", agentEndpoint)
-	var sampler sdktrace.Sampler
-	if sampleRatio < 1 && sampleRatio > 0 {
-		sampler = sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))
-	} else if sampleRatio == 1 {
-		sampler = sdktrace.AlwaysSample()
-	} else {
-		sampler = sdktrace.NeverSample()
-	}
-
 	exp, err := jaeger.New(jaeger.WithCollectorEndpoint(jaeger.WithEndpoint(agentEndpoint)))
 	if err != nil {
 		return nil, err
@@ -30,7 +21,7 @@ func NewJaegerTraceProvider(serviceName, agentEndpoint string, sampleRatio float
 	tp := sdktrace.NewTracerProvider(
 		// Always be sure to batch in production.
 		sdktrace.WithBatcher(exp),
-		sdktrace.WithSampler(sampler),
+		sdktrace.WithSampler(newSampler(sampleRatio)),
 		sdktrace.WithResource(resource.NewWithAttributes(
 			semconv.SchemaURL,
 			semconv.ServiceNameKey.String(serviceName),
@@ -38,3 +29,12 @@ func NewJaegerTraceProvider(serviceName, agentEndpoint string, sampleRatio float
 	)
 	return tp, nil
 }
+
+func newSampler(sampleRatio float64) sdktrace.Sampler {
+	if sampleRatio < 1 && sampleRatio > 0 {
+		return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))
+	} else if sampleRatio == 1 {
+		return sdktrace.AlwaysSample()
+	}
+	return sdktrace.NeverSample()
+}
@@ -27,6 +27,16 @@ var (
 	Direction, _  = tag.NewKey("direction")
 	UseFD, _      = tag.NewKey("use_fd")
 	Op, _         = tag.NewKey("op")
+
+	// estuary
+	Route, _      = tag.NewKey("route")
+	Method, _     = tag.NewKey("method")
+	StatusCode, _ = tag.NewKey("status_code")
+	DealState, _  = tag.NewKey("deal_state")
+	Shuttle, _    = tag.NewKey("shuttle")
+	DBTable, _    = tag.NewKey("table")
+	Priority, _   = tag.NewKey("priority")
+	PinStatus, _  = tag.NewKey("pin_status")
 )
 
 // Measures
@@ -43,8 +53,40 @@ var (
 	RcmgrProto  = stats.Int64("rcmgr/proto", "Number of allowed streams attached to a protocol", stats.UnitDimensionless)
 	RcmgrSvc    = stats.Int64("rcmgr/svc", "Number of streams attached to a service", stats.UnitDimensionless)
 	RcmgrMem    = stats.Int64("rcmgr/mem", "Number of memory reservations", stats.UnitDimensionless)
+
+	// estuary
+	DealCount          = stats.Int64("deals/count", "Number of deals by state", stats.UnitDimensionless)
+	ShuttlesConnected  = stats.Int64("shuttles/connected", "Number of shuttles currently connected", stats.UnitDimensionless)
+	ShuttleOnline      = stats.Int64("shuttles/online", "Whether a given shuttle is connected (1) or not (0)", stats.UnitDimensionless)
+	BlockstoreSize     = stats.Int64("blockstore/size", "Total size of the blockstore filesystem", stats.UnitBytes)
+	BlockstoreFree     = stats.Int64("blockstore/free", "Free space in the blockstore filesystem", stats.UnitBytes)
+	TransfersActive    = stats.Int64("transfers/active", "Number of data transfers in progress", stats.UnitDimensionless)
+	TransferBytesSent  = stats.Int64("transfers/sent_bytes", "Bytes sent by data transfers in progress", stats.UnitBytes)
+	TransferBytesRecvd = stats.Int64("transfers/received_bytes", "Bytes received by data transfers in progress", stats.UnitBytes)
+	DBQueryDuration    = stats.Float64("db/query_duration_ms", "Duration of database queries", stats.UnitMilliseconds)
+
+	// pin queue
+	PinQueueWait    = stats.Float64("pinning/queue_wait_seconds", "Time a pin operation waited in the queue before being dispatched to a worker", stats.UnitSeconds)
+	PinTimeToPin    = stats.Float64("pinning/time_to_pin_seconds", "Time from a pin operation being queued until it completed or failed", stats.UnitSeconds)
+	PinQueueLength  = stats.Int64("pinning/queue_length", "Number of pin operations waiting to be dispatched", stats.UnitDimensionless)
+	PinBacklogAge   = stats.Float64("pinning/backlog_age_seconds", "Age of the oldest pin operation waiting to be dispatched", stats.UnitSeconds)
+	PinActiveWorker = stats.Int64("pinning/active", "Number of pin operations currently running", stats.UnitDimensionless)
+
+	// reprovide
+	ReprovideProvided  = stats.Int64("reprovide/provided", "Number of contents reprovided", stats.UnitDimensionless)
+	ReprovideFailed    = stats.Int64("reprovide/failed", "Number of contents a reprovide round failed for", stats.UnitDimensionless)
+	ReprovideLag       = stats.Float64("reprovide/lag_seconds", "How long past due a content was when it was reprovided", stats.UnitSeconds)
+	ReprovideBacklog   = stats.Int64("reprovide/backlog", "Number of contents due to be reprovided", stats.UnitDimensionless)
+	ReprovideOldestAge = stats.Float64("reprovide/oldest_age_seconds", "Time since the least recently provided content was provided", stats.UnitSeconds)
 )
 
+// latencyDistribution is shared by the api and db duration views, in milliseconds
+var latencyDistribution = view.Distribution(1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000)
+
+// queueDistribution covers pin operations, which take anywhere from a second
+// to a day, in seconds
+var queueDistribution = view.Distribution(1, 5, 15, 30, 60, 120, 300, 600, 900, 1800, 3600, 7200, 14400, 43200, 86400)
+
 var (
 	InfoView = &view.View{
 		Name:        "info",
@@ -89,6 +131,117 @@ var (
 		Measure:     RcmgrMem,
 		Aggregation: view.Count(),
 	}
+
+	// estuary
+	APIRequestDurationView = &view.View{
+		Measure:     APIRequestDuration,
+		Aggregation: latencyDistribution,
+		TagKeys:     []tag.Key{Route, Method, StatusCode},
+	}
+
+	DealCountView = &view.View{
+		Measure:     DealCount,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{DealState},
+	}
+
+	ShuttlesConnectedView = &view.View{
+		Measure:     ShuttlesConnected,
+		Aggregation: view.LastValue(),
+	}
+
+	ShuttleOnlineView = &view.View{
+		Measure:     ShuttleOnline,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{Shuttle},
+	}
+
+	BlockstoreSizeView = &view.View{
+		Measure:     BlockstoreSize,
+		Aggregation: view.LastValue(),
+	}
+
+	BlockstoreFreeView = &view.View{
+		Measure:     BlockstoreFree,
+		Aggregation: view.LastValue(),
+	}
+
+	TransfersActiveView = &view.View{
+		Measure:     TransfersActive,
+		Aggregation: view.LastValue(),
+	}
+
+	TransferBytesSentView = &view.View{
+		Measure:     TransferBytesSent,
+		Aggregation: view.LastValue(),
+	}
+
+	TransferBytesRecvdView = &view.View{
+		Measure:     TransferBytesRecvd,
+		Aggregation: view.LastValue(),
+	}
+
+	DBQueryDurationView = &view.View{
+		Measure:     DBQueryDuration,
+		Aggregation: latencyDistribution,
+		TagKeys:     []tag.Key{Op, DBTable},
+	}
+
+	// pin queue
+	PinQueueWaitView = &view.View{
+		Measure:     PinQueueWait,
+		Aggregation: queueDistribution,
+		TagKeys:     []tag.Key{Priority},
+	}
+
+	PinTimeToPinView = &view.View{
+		Measure:     PinTimeToPin,
+		Aggregation: queueDistribution,
+		TagKeys:     []tag.Key{Priority, PinStatus},
+	}
+
+	PinQueueLengthView = &view.View{
+		Measure:     PinQueueLength,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{Priority},
+	}
+
+	PinBacklogAgeView = &view.View{
+		Measure:     PinBacklogAge,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{Priority},
+	}
+
+	PinActiveWorkerView = &view.View{
+		Measure:     PinActiveWorker,
+		Aggregation: view.LastValue(),
+	}
+
+	// reprovide
+	ReprovideProvidedView = &view.View{
+		Measure:     ReprovideProvided,
+		Aggregation: view.Sum(),
+	}
+
+	ReprovideFailedView = &view.View{
+		Measure:     ReprovideFailed,
+		Aggregation: view.Sum(),
+	}
+
+	ReprovideLagView = &view.View{
+		Measure:     ReprovideLag,
+		Aggregation: queueDistribution,
+	}
+
+	ReprovideBacklogView = &view.View{
+		Measure:     ReprovideBacklog,
+		Aggregation: view.LastValue(),
+	}
+
+	ReprovideOldestAgeView = &view.View{
+		Measure:     ReprovideOldestAge,
+		Aggregation: view.LastValue(),
+	}
 )
 
 // DefaultViews is an array of OpenCensus views for metric gathering purposes
@@ -101,6 +254,26 @@ var DefaultViews = func() []*view.View {
 		RcmgrProtoView,
 		RcmgrSvcView,
 		RcmgrMemView,
+		APIRequestDurationView,
+		DealCountView,
+		ShuttlesConnectedView,
+		ShuttleOnlineView,
+		BlockstoreSizeView,
+		BlockstoreFreeView,
+		TransfersActiveView,
+		TransferBytesSentView,
+		TransferBytesRecvdView,
+		DBQueryDurationView,
+		PinQueueWaitView,
+		PinTimeToPinView,
+		PinQueueLengthView,
+		PinBacklogAgeView,
+		PinActiveWorkerView,
+		ReprovideProvidedView,
+		ReprovideFailedView,
+		ReprovideLagView,
+		ReprovideBacklogView,
+		ReprovideOldestAgeView,
 	}
 	views = append(views, blockstore.DefaultViews...)
 	views = append(views, rpcmetrics.DefaultViews...)
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+)
+
+// NewOtlpTraceProvider returns a new and configured TracerProvider that exports
+// spans to an OTLP/HTTP collector at endpoint (host:port).
+func NewOtlpTraceProvider(ctx context.Context, serviceName, endpoint string, insecure bool, sampleRatio float64) (*sdktrace.TracerProvider, error) {
+	log.Infow("creating otlp trace provider", "serviceName", serviceName, "ratio", sampleRatio, "endpoint", endpoint)
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	exp, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(newSampler(sampleRatio)),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String(serviceName),
+		)),
+	)
+	return tp, nil
+}
+
+// SetupPropagation makes the W3C trace context the global propagator, so
+// spans started by callers (traceparent header) are continued by our http
+// handlers.
+func SetupPropagation() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"gorm.io/gorm"
+)
+
+// Names are stable handles on content that changes, like tags on the
+// releases of a dataset. Every version of a name is a content of its own,
+// so earlier versions stay pinned and can be fetched or rolled back to.
+
+var contentNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+type contentName struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	UserID    uint   `gorm:"uniqueIndex:idx_content_name" json:"-"`
+	Namespace string `gorm:"uniqueIndex:idx_content_name" json:"namespace,omitempty"`
+	Name      string `gorm:"uniqueIndex:idx_content_name" json:"name"`
+	// Version is the latest version, the one the name points at
+	Version int `json:"version"`
+}
+
+type contentNameVersion struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	NameID  uint   `gorm:"uniqueIndex:idx_content_name_version" json:"-"`
+	Version int    `gorm:"uniqueIndex:idx_content_name_version" json:"version"`
+	Content uint   `gorm:"index" json:"content"`
+	Note    string `json:"note,omitempty"`
+	// RollbackOf is the version this one rolled back to
+	RollbackOf int `json:"rollbackOf,omitempty"`
+}
+
+type contentVersionBody struct {
+	// Content is a content of the user, or Cid is pinned as a new one
+	Content uint     `json:"content"`
+	Cid     string   `json:"cid"`
+	Origins []string `json:"origins"`
+	Note    string   `json:"note"`
+}
+
+type createContentNameBody struct {
+	Name string `json:"name"`
+	contentVersionBody
+}
+
+type rollbackContentNameBody struct {
+	Version int    `json:"version"`
+	Note    string `json:"note"`
+}
+
+type contentVersionResponse struct {
+	contentNameVersion
+	Cid    string `json:"cid"`
+	Status string `json:"status"`
+}
+
+type contentNameResponse struct {
+	contentName
+	Current *contentVersionResponse `json:"current"`
+}
+
+// getContentName finds the name of the user in the namespace of their key
+func (s *Server) getContentName(ctx context.Context, u *User, name string) (*contentName, error) {
+	var cn contentName
+	if err := s.DB.WithContext(ctx).First(&cn, "user_id = ? AND namespace = ? AND name = ?", u.ID, u.namespace(), name).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("name %s was not found", name),
+			}
+		}
+		return nil, err
+	}
+	return &cn, nil
+}
+
+// getContentVersion finds a version of a name, its latest when version is 0
+func (s *Server) getContentVersion(ctx context.Context, cn *contentName, version int) (*contentNameVersion, error) {
+	if version == 0 {
+		version = cn.Version
+	}
+	var v contentNameVersion
+	if err := s.DB.WithContext(ctx).First(&v, "name_id = ? AND version = ?", cn.ID, version).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("name %s has no version %d", cn.Name, version),
+			}
+		}
+		return nil, err
+	}
+	return &v, nil
+}
+
+func (s *Server) contentVersionResponses(ctx context.Context, versions []contentNameVersion) ([]*contentVersionResponse, error) {
+	ids := make([]uint, 0, len(versions))
+	for _, v := range versions {
+		ids = append(ids, v.Content)
+	}
+	var contents []util.Content
+	if err := s.DB.WithContext(ctx).Find(&contents, "id in ?", ids).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]util.Content, len(contents))
+	for _, cont := range contents {
+		byID[cont.ID] = cont
+	}
+
+	out := make([]*contentVersionResponse, 0, len(versions))
+	for _, v := range versions {
+		resp := &contentVersionResponse{contentNameVersion: v, Status: "removed"}
+		if cont, ok := byID[v.Content]; ok {
+			resp.Cid = cont.Cid.CID.String()
+			switch {
+			case cont.Active:
+				resp.Status = "pinned"
+			case cont.Pinning:
+				resp.Status = "pinning"
+			case cont.Failed:
+				resp.Status = "failed"
+			}
+		}
+		out = append(out, resp)
+	}
+	return out, nil
+}
+
+func (s *Server) contentNameResponse(ctx context.Context, cn *contentName) (*contentNameResponse, error) {
+	out, err := s.contentNameResponses(ctx, []contentName{*cn})
+	if err != nil {
+		return nil, err
+	}
+	return out[0], nil
+}
+
+// contentNameResponses looks the current versions of names up all at once
+func (s *Server) contentNameResponses(ctx context.Context, names []contentName) ([]*contentNameResponse, error) {
+	ids := make([]uint, 0, len(names))
+	for _, cn := range names {
+		ids = append(ids, cn.ID)
+	}
+	var current []contentNameVersion
+	if err := s.DB.WithContext(ctx).Model(&contentNameVersion{}).
+		Joins("JOIN content_names ON content_names.id = content_name_versions.name_id AND content_names.version = content_name_versions.version").
+		Where("content_names.id IN ?", ids).
+		Find(&current).Error; err != nil {
+		return nil, err
+	}
+	versions, err := s.contentVersionResponses(ctx, current)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[uint]*contentVersionResponse, len(versions))
+	for _, v := range versions {
+		byName[v.NameID] = v
+	}
+
+	out := make([]*contentNameResponse, 0, len(names))
+	for _, cn := range names {
+		// Current is nil for a name left without a version
+		out = append(out, &contentNameResponse{contentName: cn, Current: byName[cn.ID]})
+	}
+	return out, nil
+}
+
+// versionContent returns the content a new version points at, pinning its
+// cid when it isn't a content of the user yet, in which case pinned is set
+func (s *Server) versionContent(c echo.Context, u *User, name string, body *contentVersionBody) (contID uint, pinned bool, err error) {
+	if (body.Content == 0) == (body.Cid == "") {
+		return 0, false, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "either a content or a cid has to be given",
+		}
+	}
+	if body.Content != 0 {
+		content, err := s.getOwnContentByID(u, int(body.Content))
+		if err != nil {
+			return 0, false, err
+		}
+		return content.ID, false, nil
+	}
+
+	if err := util.ErrorIfContentAddingDisabled(s.isContentAddingDisabled(u)); err != nil {
+		return 0, false, err
+	}
+	obj, err := cid.Decode(body.Cid)
+	if err != nil {
+		return 0, false, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid cid: %s", body.Cid),
+		}
+	}
+	var origins []*peer.AddrInfo
+	for _, p := range body.Origins {
+		ai, err := peer.AddrInfoFromString(p)
+		if err != nil {
+			return 0, false, err
+		}
+		origins = append(origins, ai)
+	}
+	if err := s.checkPinQuota(c, u); err != nil {
+		return 0, false, err
+	}
+	if err := s.checkPinSize(c, u, obj); err != nil {
+		return 0, false, err
+	}
+
+	status, err := s.CM.pinContent(c.Request().Context(), u.ID, u.namespace(), obj, name, nil, origins, 0, nil, true)
+	if err != nil {
+		return 0, false, err
+	}
+	id, err := strconv.ParseUint(status.RequestID, 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return uint(id), true, nil
+}
+
+// dropVersionContent unpins the content pinned for a version that could not
+// be added after all
+func (s *Server) dropVersionContent(contID uint) {
+	if err := s.DB.Model(&util.Content{}).Where("id = ?", contID).Update("replace", true).Error; err != nil {
+		log.Errorf("failed to mark content %d for removal: %s", contID, err)
+	}
+	go func() {
+		if err := s.CM.unpinContent(context.Background(), contID); err != nil {
+			log.Errorf("could not unpinContent(%d): %s", contID, err)
+		}
+	}()
+}
+
+// namedContent returns the names that have contID as a version, and those
+// of them it is the current version of
+func (s *Server) namedContent(ctx context.Context, contID uint) (names []contentName, current []contentName, err error) {
+	if err := s.DB.WithContext(ctx).Model(&contentName{}).
+		Where("id IN (?)", s.DB.Model(&contentNameVersion{}).Select("name_id").Where("content = ?", contID)).
+		Find(&names).Error; err != nil {
+		return nil, nil, err
+	}
+	var currentIDs []uint
+	if err := s.DB.WithContext(ctx).Model(&contentNameVersion{}).
+		Joins("JOIN content_names ON content_names.id = content_name_versions.name_id AND content_names.version = content_name_versions.version").
+		Where("content_name_versions.content = ?", contID).
+		Pluck("content_names.id", &currentIDs).Error; err != nil {
+		return nil, nil, err
+	}
+	for _, cn := range names {
+		for _, id := range currentIDs {
+			if cn.ID == id {
+				current = append(current, cn)
+			}
+		}
+	}
+	return names, current, nil
+}
+
+// checkNotNamed refuses to remove a content that is a version of a name,
+// the versions of a name stay pinned until the name is deleted
+func (s *Server) checkNotNamed(ctx context.Context, contID uint) error {
+	names, _, err := s.namedContent(ctx, contID)
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		return &util.HttpError{
+			Code:    http.StatusConflict,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("content %d is a version of name %s, delete the name first", contID, names[0].Name),
+		}
+	}
+	return nil
+}
+
+// appendContentVersion makes v the latest version of cn
+func (s *Server) appendContentVersion(ctx context.Context, cn *contentName, v *contentNameVersion) error {
+	return s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// bumping the version first keeps concurrent appends apart
+		if err := tx.Model(&contentName{}).Where("id = ?", cn.ID).UpdateColumns(map[string]interface{}{
+			"version":    gorm.Expr("version + 1"),
+			"updated_at": time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+		var updated contentName
+		if err := tx.First(&updated, "id = ?", cn.ID).Error; err != nil {
+			return err
+		}
+		v.NameID = cn.ID
+		v.Version = updated.Version
+		if err := tx.Create(v).Error; err != nil {
+			return err
+		}
+		*cn = updated
+		return nil
+	})
+}
+
+// handleCreateContentName godoc
+// @Summary      Name a content
+// @Description  This endpoint creates a name pointing at a content, or at a cid that is pinned for it. The name stays the same as new versions are added to it, and earlier versions stay pinned.
+// @Tags         content
+// @Accept       json
+// @Produce      json
+// @Param        body  body      createContentNameBody  true  "Name and its first version"
+// @Success      200   {object}  contentNameResponse
+// @Router       /content/names [post]
+func (s *Server) handleCreateContentName(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+	var body createContentNameBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if !contentNameRegexp.MatchString(body.Name) {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "names are letters, digits, dots, dashes and underscores",
+		}
+	}
+
+	var taken int64
+	if err := s.DB.WithContext(ctx).Model(&contentName{}).Where("user_id = ? AND namespace = ? AND name = ?", u.ID, u.namespace(), body.Name).Count(&taken).Error; err != nil {
+		return err
+	}
+	if taken > 0 {
+		return &util.HttpError{
+			Code:    http.StatusConflict,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("name %s already exists", body.Name),
+		}
+	}
+
+	contID, pinned, err := s.versionContent(c, u, body.Name, &body.contentVersionBody)
+	if err != nil {
+		return err
+	}
+
+	// the name and its first version are created together, or not at all
+	cn := &contentName{
+		UserID:    u.ID,
+		Namespace: u.namespace(),
+		Name:      body.Name,
+		Version:   1,
+	}
+	if err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(cn).Error; err != nil {
+			return err
+		}
+		return tx.Create(&contentNameVersion{NameID: cn.ID, Version: 1, Content: contID, Note: body.Note}).Error
+	}); err != nil {
+		if pinned {
+			s.dropVersionContent(contID)
+		}
+		return err
+	}
+
+	resp, err := s.contentNameResponse(ctx, cn)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// handleListContentNames godoc
+// @Summary      List names
+// @Description  This endpoint lists the names of the user in the namespace of the api key, and the version each points at.
+// @Tags         content
+// @Produce      json
+// @Success      200  {array}  contentNameResponse
+// @Router       /content/names [get]
+func (s *Server) handleListContentNames(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+	// names are looked up in the namespace of the key, root keys included
+	var names []contentName
+	if err := s.DB.WithContext(ctx).Order("name").Find(&names, "user_id = ? AND namespace = ?", u.ID, u.namespace()).Error; err != nil {
+		return err
+	}
+
+	out, err := s.contentNameResponses(ctx, names)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+// handleGetContentName godoc
+// @Summary      Get a name
+// @Description  This endpoint returns a name and the version it points at.
+// @Tags         content
+// @Produce      json
+// @Param        name  path      string  true  "Name"
+// @Success      200   {object}  contentNameResponse
+// @Router       /content/names/{name} [get]
+func (s *Server) handleGetContentName(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+	cn, err := s.getContentName(ctx, u, c.Param("name"))
+	if err != nil {
+		return err
+	}
+	resp, err := s.contentNameResponse(ctx, cn)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// handleDeleteContentName godoc
+// @Summary      Delete a name
+// @Description  This endpoint deletes a name and its history. The contents of its versions are not removed, they can be once no name has them as a version.
+// @Tags         content
+// @Param        name  path  string  true  "Name"
+// @Router       /content/names/{name} [delete]
+func (s *Server) handleDeleteContentName(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+	cn, err := s.getContentName(ctx, u, c.Param("name"))
+	if err != nil {
+		return err
+	}
+	if err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("name_id = ?", cn.ID).Delete(&contentNameVersion{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(cn).Error
+	}); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// handleListContentVersions godoc
+// @Summary      List the versions of a name
+// @Description  This endpoint lists the versions of a name, latest first.
+// @Tags         content
+// @Produce      json
+// @Param        name  path  string  true  "Name"
+// @Success      200   {array}  contentVersionResponse
+// @Router       /content/names/{name}/versions [get]
+func (s *Server) handleListContentVersions(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+	cn, err := s.getContentName(ctx, u, c.Param("name"))
+	if err != nil {
+		return err
+	}
+	var versions []contentNameVersion
+	if err := s.DB.WithContext(ctx).Order("version desc").Find(&versions, "name_id = ?", cn.ID).Error; err != nil {
+		return err
+	}
+	out, err := s.contentVersionResponses(ctx, versions)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+// handleAddContentVersion godoc
+// @Summary      Add a version to a name
+// @Description  This endpoint points a name at a new version: a content of the user, or a cid that is pinned for it. The earlier versions stay pinned.
+// @Tags         content
+// @Accept       json
+// @Produce      json
+// @Param        name  path      string              true  "Name"
+// @Param        body  body      contentVersionBody  true  "The new version"
+// @Success      200   {object}  contentNameResponse
+// @Router       /content/names/{name}/versions [post]
+func (s *Server) handleAddContentVersion(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+	cn, err := s.getContentName(ctx, u, c.Param("name"))
+	if err != nil {
+		return err
+	}
+	var body contentVersionBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	contID, pinned, err := s.versionContent(c, u, cn.Name, &body)
+	if err != nil {
+		return err
+	}
+	if err := s.appendContentVersion(ctx, cn, &contentNameVersion{Content: contID, Note: body.Note}); err != nil {
+		if pinned {
+			s.dropVersionContent(contID)
+		}
+		return err
+	}
+
+	resp, err := s.contentNameResponse(ctx, cn)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// handleRollbackContentName godoc
+// @Summary      Roll a name back
+// @Description  This endpoint points a name back at the content of an earlier version. The rollback is added as a new version, so the history keeps every version.
+// @Tags         content
+// @Accept       json
+// @Produce      json
+// @Param        name  path      string                   true  "Name"
+// @Param        body  body      rollbackContentNameBody  true  "Version to roll back to"
+// @Success      200   {object}  contentNameResponse
+// @Router       /content/names/{name}/rollback [post]
+func (s *Server) handleRollbackContentName(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+	cn, err := s.getContentName(ctx, u, c.Param("name"))
+	if err != nil {
+		return err
+	}
+	var body rollbackContentNameBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if body.Version <= 0 || body.Version >= cn.Version {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("version must be an earlier version of %s, from 1 to %d", cn.Name, cn.Version-1),
+		}
+	}
+
+	v, err := s.getContentVersion(ctx, cn, body.Version)
+	if err != nil {
+		return err
+	}
+	var content util.Content
+	if err := s.DB.WithContext(ctx).First(&content, "id = ? AND active", v.Content).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("the content of version %d is not pinned anymore", v.Version),
+			}
+		}
+		return err
+	}
+
+	if err := s.appendContentVersion(ctx, cn, &contentNameVersion{Content: v.Content, Note: body.Note, RollbackOf: v.Version}); err != nil {
+		return err
+	}
+	resp, err := s.contentNameResponse(ctx, cn)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// handleGetContentVersion godoc
+// @Summary      Get a version of a name
+// @Description  This endpoint returns a version of a name and the content it points at.
+// @Tags         content
+// @Produce      json
+// @Param        name     path      string  true  "Name"
+// @Param        version  path      int     true  "Version"
+// @Success      200      {object}  contentVersionResponse
+// @Router       /content/names/{name}/versions/{version} [get]
+func (s *Server) handleGetContentVersion(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+	cn, err := s.getContentName(ctx, u, c.Param("name"))
+	if err != nil {
+		return err
+	}
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil || version <= 0 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid version: %s", c.Param("version")),
+		}
+	}
+	v, err := s.getContentVersion(ctx, cn, version)
+	if err != nil {
+		return err
+	}
+	out, err := s.contentVersionResponses(ctx, []contentNameVersion{*v})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, out[0])
+}
+
+// handleFetchContentName godoc
+// @Summary      Fetch the content of a name
+// @Description  This endpoint serves the content a name points at through the gateway, or the content of an earlier version with the version query parameter. Paths below it go into the DAG of the content.
+// @Tags         content
+// @Param        name     path   string  true   "Name"
+// @Param        version  query  int     false  "Version, the latest when not set"
+// @Router       /content/names/{name}/data [get]
+func (s *Server) handleFetchContentName(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+	cn, err := s.getContentName(ctx, u, c.Param("name"))
+	if err != nil {
+		return err
+	}
+
+	var version int
+	if q := c.QueryParam("version"); q != "" {
+		version, err = strconv.Atoi(q)
+		if err != nil || version <= 0 {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid version: %s", q),
+			}
+		}
+	}
+	v, err := s.getContentVersion(ctx, cn, version)
+	if err != nil {
+		return err
+	}
+
+	var content util.Content
+	if err := s.DB.WithContext(ctx).First(&content, "id = ? AND active", v.Content).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("the content of version %d of %s is not pinned", v.Version, cn.Name),
+			}
+		}
+		return err
+	}
+	return s.serveThroughGateway(c, &content, strings.Trim(c.Param("*"), "/"))
+}
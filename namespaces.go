@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Namespaces isolate the applications an account backs from each other. An
+// api key bound to a namespace creates content and collections in it, and
+// sees nothing outside of it. Keys without a namespace see the whole
+// account.
+
+var namespaceRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+func validNamespace(ns string) bool {
+	return namespaceRegexp.MatchString(ns)
+}
+
+// namespace is the namespace of the key the user authenticated with, empty
+// for the whole account
+func (u *User) namespace() string {
+	return u.authToken.Namespace
+}
+
+// sees reports whether the key the user authenticated with can see things
+// in namespace ns
+func (u *User) sees(ns string) bool {
+	return u.namespace() == "" || u.namespace() == ns
+}
+
+// inNamespace limits a query of content or collections to the namespace of
+// the key the user authenticated with
+func inNamespace(u *User) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if u.namespace() == "" {
+			return db
+		}
+		return db.Where("namespace = ?", u.namespace())
+	}
+}
+
+// accountWide wraps handlers of settings and data of the whole account,
+// which keys bound to a namespace can't use
+func accountWide(f func(echo.Context, *User) error) func(echo.Context, *User) error {
+	return func(c echo.Context, u *User) error {
+		if u.namespace() != "" {
+			return &util.HttpError{
+				Code:    http.StatusForbidden,
+				Reason:  util.ERR_NOT_AUTHORIZED,
+				Details: "api keys bound to a namespace can't use account wide endpoints",
+			}
+		}
+		return f(c, u)
+	}
+}
+
+// checkContentOwner checks that content is the user's, and in the
+// namespace of their key. Content in other namespaces is not found.
+func checkContentOwner(u *User, content *util.Content) error {
+	if err := util.IsContentOwner(u.ID, content.UserID); err != nil {
+		return err
+	}
+	if !u.sees(content.Namespace) {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_CONTENT_NOT_FOUND,
+			Details: fmt.Sprintf("content with ID(%d) was not found", content.ID),
+		}
+	}
+	return nil
+}
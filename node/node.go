@@ -13,9 +13,17 @@ import (
 
 	"github.com/application-research/estuary/autoretrieve"
 	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/faults"
 
 	rcmgr "github.com/application-research/estuary/node/modules/lp2p"
+	"github.com/application-research/estuary/util/batchbs"
+	"github.com/application-research/estuary/util/blockcache"
+	"github.com/application-research/estuary/util/bwlimit"
+	"github.com/application-research/estuary/util/fetchstats"
+	"github.com/application-research/estuary/util/gsfetch"
 	migratebs "github.com/application-research/estuary/util/migratebs"
+	"github.com/application-research/estuary/util/provide"
+	"github.com/application-research/estuary/util/providers"
 	"github.com/application-research/filclient/keystore"
 	autobatch "github.com/application-research/go-bs-autobatch"
 	lmdb "github.com/filecoin-project/go-bs-lmdb"
@@ -91,6 +99,12 @@ type EstuaryBlockstore interface {
 type NodeInitializer interface {
 	BlockstoreWrap(blockstore.Blockstore) (blockstore.Blockstore, error)
 	KeyProviderFunc(context.Context) (<-chan cid.Cid, error)
+	// Withheld reports whether a block is kept from peers asking for it
+	// over bitswap
+	Withheld(context.Context, cid.Cid) bool
+	// Bandwidth holds the libp2p streams of the node to its caps, nil for
+	// no caps
+	Bandwidth() *bwlimit.Limiter
 	Config() *config.Node
 }
 
@@ -109,6 +123,19 @@ type Node struct {
 	Blockstore      blockstore.Blockstore
 	Bitswap         *bitswap.Bitswap
 	NotifBlockstore *NotifyBlockstore
+	// FetchTracer attributes the blocks bitswap receives to the pins that
+	// asked for them
+	FetchTracer *fetchstats.Tracer
+	// GraphsyncFetcher fetches pins from their origins over graphsync
+	GraphsyncFetcher *gsfetch.Fetcher
+	// WriteBatcher buffers block writes, nil when every write goes straight
+	// to the blockstore
+	WriteBatcher *batchbs.Blockstore
+	// BlockCache keeps hot blocks in memory, nil when it is disabled
+	BlockCache *blockcache.Blockstore
+	// Indexer is the network indexer providers are looked up at alongside
+	// the dht, nil when none is configured
+	Indexer *providers.IndexerClient
 
 	Wallet *wallet.LocalWallet
 
@@ -116,11 +143,18 @@ type Node struct {
 	Peering  *peering.EstuaryPeeringService
 	Config   *config.Node
 	ArEngine *autoretrieve.AutoretrieveEngine
+	// ProvidePolicy picks which blocks of a content are provided by its size
+	ProvidePolicy provide.Policy
 }
 
 func Setup(ctx context.Context, init NodeInitializer) (*Node, error) {
 	cfg := init.Config()
 
+	provPolicy, err := cfg.Provide.Policy()
+	if err != nil {
+		return nil, xerrors.Errorf("invalid provide config: %w", err)
+	}
+
 	peerkey, err := loadOrInitPeerKey(cfg.Libp2pKeyFile)
 	if err != nil {
 		return nil, err
@@ -173,6 +207,13 @@ func Setup(ctx context.Context, init NodeInitializer) (*Node, error) {
 	}
 
 	h, err := libp2p.New(opts...)
+	if err != nil {
+		return nil, err
+	}
+	bwl := init.Bandwidth()
+	if bwl != nil {
+		h = bwlimit.Host(h, bwl)
+	}
 
 	//	peering service
 	peerServ := peering.NewEstuaryPeeringService(h)
@@ -231,10 +272,21 @@ func Setup(ctx context.Context, init NodeInitializer) (*Node, error) {
 		return nil, err
 	}
 
-	mbs, stordir, err := loadBlockstore(cfg.Blockstore, cfg.WriteLogDir, cfg.HardFlushWriteLog, cfg.WriteLogTruncate, cfg.NoBlockstoreCache)
+	mbs, bcache, stordir, err := loadBlockstore(cfg.Blockstore, cfg.WriteLogDir, cfg.HardFlushWriteLog, cfg.WriteLogTruncate, cfg.NoBlockstoreCache, cfg.BlockCache)
 	if err != nil {
 		return nil, err
 	}
+	mbs = faults.Blockstore(mbs)
+
+	var batcher *batchbs.Blockstore
+	if cfg.WriteBatch.MaxBlocks > 0 {
+		batcher = batchbs.New(mbs, batchbs.Options{
+			MaxBlocks:     cfg.WriteBatch.MaxBlocks,
+			MaxBytes:      cfg.WriteBatch.MaxBytes,
+			FlushInterval: cfg.WriteBatch.FlushInterval,
+		})
+		mbs = batcher
+	}
 
 	var blkst blockstore.Blockstore = mbs
 	wrapper, err := init.BlockstoreWrap(blkst)
@@ -243,7 +295,12 @@ func Setup(ctx context.Context, init NodeInitializer) (*Node, error) {
 	}
 	blkst = wrapper
 
-	bsnet := bsnet.NewFromIpfsHost(h, frt)
+	var indexer *providers.IndexerClient
+	if cfg.LookupIndexerURL != "" {
+		indexer = providers.NewIndexerClient(cfg.LookupIndexerURL)
+	}
+
+	bsnet := bsnet.NewFromIpfsHost(h, providers.NewRouter(frt, indexer))
 
 	peerwork := cfg.Bitswap.MaxOutstandingBytesPerPeer
 	if peerwork == 0 {
@@ -260,8 +317,27 @@ func Setup(ctx context.Context, init NodeInitializer) (*Node, error) {
 		bsopts = append(bsopts, bitswap.WithTargetMessageSize(tms))
 	}
 
+	fetchTracer := fetchstats.NewTracer()
+	bsopts = append(bsopts, bitswap.WithTracer(fetchTracer))
+
 	bsctx := metri.CtxScope(ctx, "estuary.exch")
-	bswap := bitswap.New(bsctx, bsnet, blkst, bsopts...)
+	// blocks bitswap fetches go to blkst, only what it serves is filtered
+	bswap := bitswap.New(bsctx, bsnet, &withheldBlockstore{Blockstore: blkst, withheld: init.Withheld}, bsopts...)
+
+	// the fetch host shares the limits and connection count of the node
+	gsHost, err := libp2p.New(
+		libp2p.NoListenAddrs,
+		libp2p.ConnectionManager(cmgr),
+		libp2p.BandwidthReporter(bwc),
+		libp2p.ResourceManager(rcm),
+	)
+	if err != nil {
+		return nil, xerrors.Errorf("setup graphsync fetch host: %w", err)
+	}
+	if bwl != nil {
+		gsHost = bwlimit.Host(gsHost, bwl)
+	}
+	gsFetcher := gsfetch.New(ctx, gsHost, blkst)
 
 	wallet, err := setupWallet(cfg.WalletDir)
 	if err != nil {
@@ -291,16 +367,49 @@ func Setup(ctx context.Context, init NodeInitializer) (*Node, error) {
 		Host:       h,
 		Blockstore: mbs,
 		//Lmdb:       lmdbs,
-		Datastore:  ds,
-		Bitswap:    bswap.(*bitswap.Bitswap),
-		Wallet:     wallet,
-		Bwc:        bwc,
-		Config:     cfg,
-		StorageDir: stordir,
-		Peering:    peerServ,
+		Datastore:   ds,
+		Bitswap:     bswap.(*bitswap.Bitswap),
+		FetchTracer: fetchTracer,
+		Indexer:     indexer,
+		BlockCache:  bcache,
+		Wallet:      wallet,
+		Bwc:         bwc,
+		Config:      cfg,
+		StorageDir:  stordir,
+		Peering:     peerServ,
+
+		GraphsyncFetcher: gsFetcher,
+		WriteBatcher:     batcher,
+		ProvidePolicy:    provPolicy,
 	}, nil
 }
 
+// ProvideDag queues the blocks under root the provide policy asks for content
+// of size, the root itself is left to the caller
+func (nd *Node) ProvideDag(ctx context.Context, root cid.Cid, size int64) {
+	s := nd.ProvidePolicy.For(size)
+	if s == provide.Roots {
+		return
+	}
+	if err := provide.Keys(ctx, nd.Blockstore, s, root, func(c cid.Cid) error {
+		if c == root {
+			return nil
+		}
+		return nd.Provider.Provide(c)
+	}); err != nil {
+		log.Warnf("failed to provide the dag under %s: %s", root, err)
+	}
+}
+
+// FlushWrites writes out any buffered blocks, it must be called before
+// recording that content is stored
+func (nd *Node) FlushWrites(ctx context.Context) error {
+	if nd.WriteBatcher == nil {
+		return nil
+	}
+	return nd.WriteBatcher.Flush(ctx)
+}
+
 // Converting the public key to a multiaddress.
 func toMultiAddress(addr string) (multiaddr.Multiaddr, error) {
 	a, err := multiaddr.NewMultiaddr(addr)
@@ -433,10 +542,10 @@ func constructBlockstore(bscfg string) (EstuaryBlockstore, string, error) {
 	}
 }
 
-func loadBlockstore(bscfg string, wal string, flush, walTruncate, nocache bool) (blockstore.Blockstore, string, error) {
+func loadBlockstore(bscfg string, wal string, flush, walTruncate, nocache bool, bccfg config.BlockCache) (blockstore.Blockstore, *blockcache.Blockstore, string, error) {
 	bstore, dir, err := constructBlockstore(bscfg)
 	if err != nil {
-		return nil, "", err
+		return nil, nil, "", err
 	}
 
 	if wal != "" {
@@ -445,22 +554,22 @@ func loadBlockstore(bscfg string, wal string, flush, walTruncate, nocache bool)
 
 		writelog, err := badgerbs.Open(opts)
 		if err != nil {
-			return nil, "", err
+			return nil, nil, "", err
 		}
 
 		ab, err := autobatch.NewBlockstore(bstore, writelog, 200, 200, flush)
 		if err != nil {
-			return nil, "", err
+			return nil, nil, "", err
 		}
 
 		if flush {
 			if err := ab.Flush(context.Background()); err != nil {
-				return nil, "", err
+				return nil, nil, "", err
 			}
 		}
 
 		if walTruncate {
-			return nil, "", fmt.Errorf("truncation and full flush complete, halting execution")
+			return nil, nil, "", fmt.Errorf("truncation and full flush complete, halting execution")
 		}
 
 		bstore = ab
@@ -477,17 +586,25 @@ func loadBlockstore(bscfg string, wal string, flush, walTruncate, nocache bool)
 			HasARCCacheSize: 8 << 20,
 		})
 		if err != nil {
-			return nil, "", err
+			return nil, nil, "", err
 		}
 		bstore = &deleteManyWrap{cbstore}
 	}
 
+	// the block cache sits under the notifying blockstore so everything
+	// reading blocks, from the gateway to deal transfers, shares it
+	var bcache *blockcache.Blockstore
+	if bccfg.Size > 0 {
+		bcache = blockcache.New(bstore, bccfg.Size, bccfg.MaxBlockSize)
+		bstore = bcache
+	}
+
 	notifbs := NewNotifBs(bstore)
 	mbs := bsm.New("estuary.repo", notifbs)
 
 	var blkst blockstore.Blockstore = mbs
 
-	return blkst, dir, nil
+	return blkst, bcache, dir, nil
 }
 
 func loadOrInitPeerKey(kf string) (crypto.PrivKey, error) {
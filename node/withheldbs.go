@@ -0,0 +1,32 @@
+package node
+
+import (
+	"context"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+// withheldBlockstore is the blockstore bitswap serves peers from, the
+// blocks withheld looks as if they aren't there
+type withheldBlockstore struct {
+	blockstore.Blockstore
+	withheld func(context.Context, cid.Cid) bool
+}
+
+var _ blockstore.Blockstore = (*withheldBlockstore)(nil)
+
+func (wb *withheldBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if wb.withheld(ctx, c) {
+		return nil, blockstore.ErrNotFound
+	}
+	return wb.Blockstore.Get(ctx, c)
+}
+
+func (wb *withheldBlockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	if wb.withheld(ctx, c) {
+		return -1, blockstore.ErrNotFound
+	}
+	return wb.Blockstore.GetSize(ctx, c)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"golang.org/x/sys/unix"
+
+	"github.com/application-research/estuary/metrics"
+)
+
+const nodeMetricsInterval = time.Second * 30
+
+// recordNodeMetrics samples node wide state (deals, shuttles, blockstore,
+// transfers) into the opencensus measures exported on /metrics, it is run
+// every nodeMetricsInterval. Request latencies and db query latencies are
+// recorded inline as they happen.
+func (s *Server) recordNodeMetrics(ctx context.Context) error {
+	s.recordDealMetrics(ctx)
+	s.recordShuttleMetrics(ctx)
+	s.recordBlockstoreMetrics(ctx)
+	s.recordTransferMetrics(ctx)
+	return nil
+}
+
+func (s *Server) recordDealMetrics(ctx context.Context) {
+	var counts []struct {
+		State string
+		Count int64
+	}
+	if err := s.DB.Model(&contentDeal{}).Select(`CASE
+			WHEN slashed THEN 'slashed'
+			WHEN failed THEN 'failed'
+			WHEN deal_id > 0 AND sealed_at > on_chain_at THEN 'sealed'
+			WHEN deal_id > 0 THEN 'onchain'
+			WHEN dt_chan != '' THEN 'transferring'
+			ELSE 'proposed'
+		END as state, COUNT(1) as count`).
+		Group("state").Scan(&counts).Error; err != nil {
+		log.Errorf("failed to collect deal metrics: %s", err)
+		return
+	}
+
+	for _, c := range counts {
+		if err := stats.RecordWithTags(ctx,
+			[]tag.Mutator{tag.Upsert(metrics.DealState, c.State)},
+			metrics.DealCount.M(c.Count),
+		); err != nil {
+			log.Errorf("failed to record deal metrics: %s", err)
+		}
+	}
+}
+
+func (s *Server) recordShuttleMetrics(ctx context.Context) {
+	var shuttles []Shuttle
+	if err := s.DB.Find(&shuttles).Error; err != nil {
+		log.Errorf("failed to collect shuttle metrics: %s", err)
+		return
+	}
+
+	var connected int64
+	for _, sh := range shuttles {
+		var online int64
+		if s.CM.shuttleIsOnline(sh.Handle) {
+			online = 1
+			connected++
+		}
+
+		if err := stats.RecordWithTags(ctx,
+			[]tag.Mutator{tag.Upsert(metrics.Shuttle, sh.Handle)},
+			metrics.ShuttleOnline.M(online),
+		); err != nil {
+			log.Errorf("failed to record shuttle metrics: %s", err)
+		}
+	}
+	stats.Record(ctx, metrics.ShuttlesConnected.M(connected))
+}
+
+func (s *Server) recordBlockstoreMetrics(ctx context.Context) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(s.Node.Config.Blockstore, &st); err != nil {
+		log.Errorf("failed to collect blockstore metrics: %s", err)
+		return
+	}
+
+	stats.Record(ctx,
+		metrics.BlockstoreSize.M(int64(st.Blocks*uint64(st.Bsize))),
+		metrics.BlockstoreFree.M(int64(st.Bavail*uint64(st.Bsize))),
+	)
+}
+
+func (s *Server) recordTransferMetrics(ctx context.Context) {
+	txs, err := s.FilClient.TransfersInProgress(ctx)
+	if err != nil {
+		log.Errorf("failed to collect transfer metrics: %s", err)
+		return
+	}
+
+	var active, sent, received int64
+	for _, xfer := range txs {
+		if xfer.Status == datatransfer.Ongoing {
+			active++
+		}
+		sent += int64(xfer.Sent)
+		received += int64(xfer.Received)
+	}
+
+	stats.Record(ctx,
+		metrics.TransfersActive.M(active),
+		metrics.TransferBytesSent.M(sent),
+		metrics.TransferBytesRecvd.M(received),
+	)
+}
@@ -0,0 +1,690 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/mail"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// the events users are emailed about
+const (
+	notifyPinFailed   = "pin_failed"
+	notifyReplicasLow = "replicas_low"
+	notifyQuota       = "quota"
+	notifyKeyExpiring = "key_expiring"
+)
+
+var notificationKinds = []string{notifyPinFailed, notifyReplicasLow, notifyQuota, notifyKeyExpiring}
+
+// failed pins are only reported for this long after they failed, so turning
+// notifications on does not mail out every pin that ever failed
+const pinFailedLookback = time.Hour * 24
+
+// at most this many notifications are queued per check, and sent per send
+const notificationBatch = 1000
+
+// an email override is only used once it is verified with the token mailed
+// to it, within this long
+const emailVerifyExpiry = time.Hour * 24
+
+const emailVerifyTemplate = `Subject: Verify your email for Estuary notifications
+
+Hi {{.Username}},
+
+Notifications for your account were asked to be mailed to this address.
+Verify it by sending the following token to POST /user/notifications/verify:
+
+  {{index .Items 0}}
+
+The token expires in 24 hours. If you did not ask for this, ignore this
+email and nothing is mailed here.
+
+{{.Hostname}}
+`
+
+var defaultNotificationTemplates = map[string]string{
+	notifyPinFailed: `Subject: {{.Count}} {{if eq .Count 1}}pin{{else}}pins{{end}} failed on Estuary
+
+Hi {{.Username}},
+
+Estuary gave up on pinning the following content:
+
+{{range .Items}}  - {{.}}
+{{end}}
+You may want to check that the content is still provided, and pin it again.
+
+{{.Hostname}}
+`,
+	notifyReplicasLow: `Subject: {{.Count}} of your files {{if eq .Count 1}}has{{else}}have{{end}} fewer deals than wanted
+
+Hi {{.Username}},
+
+The following content has fewer active storage deals than its replication
+target. Estuary keeps making deals for it, no action is needed unless you
+want to change the target.
+
+{{range .Items}}  - {{.}}
+{{end}}
+{{.Hostname}}
+`,
+	notifyQuota: `Subject: A quota on Estuary is nearly used up
+
+Hi {{.Username}},
+
+{{range .Items}}  - {{.}}
+{{end}}
+Once a quota is used up, uploads or retrievals are turned away until it is
+raised or the next period starts.
+
+{{.Hostname}}
+`,
+	notifyKeyExpiring: `Subject: {{.Count}} {{if eq .Count 1}}API key expires{{else}}API keys expire{{end}} soon
+
+Hi {{.Username}},
+
+{{range .Items}}  - {{.}}
+{{end}}
+Requests with an expired key are refused, create a new key before then.
+
+{{.Hostname}}
+`,
+}
+
+// notification is an event a user is emailed about. Key identifies the
+// event within its kind, so each one is only mailed once.
+type notification struct {
+	ID        uint      `gorm:"primarykey"`
+	CreatedAt time.Time `gorm:"index"`
+
+	UserID uint   `gorm:"uniqueIndex:idx_notification"`
+	Kind   string `gorm:"uniqueIndex:idx_notification"`
+	Key    string `gorm:"uniqueIndex:idx_notification"`
+	// Item is the line the event is listed with in the email
+	Item string
+
+	SentAt   *time.Time `gorm:"index"`
+	Attempts int
+	Error    string
+}
+
+// notificationSettings are the notification preferences of a user. Mail
+// goes to Email, or the email of the user when empty. A new Email is kept in
+// PendingEmail until it is verified.
+type notificationSettings struct {
+	UserID uint `gorm:"primarykey"`
+	Email  string
+
+	PendingEmail string
+	VerifyToken  string
+	VerifyExpiry time.Time
+
+	MutePinFailed   bool
+	MuteReplicasLow bool
+	MuteQuota       bool
+	MuteKeyExpiring bool
+}
+
+func (ns *notificationSettings) muted(kind string) bool {
+	switch kind {
+	case notifyPinFailed:
+		return ns.MutePinFailed
+	case notifyReplicasLow:
+		return ns.MuteReplicasLow
+	case notifyQuota:
+		return ns.MuteQuota
+	case notifyKeyExpiring:
+		return ns.MuteKeyExpiring
+	default:
+		return false
+	}
+}
+
+func (ns *notificationSettings) setMuted(kind string, muted bool) {
+	switch kind {
+	case notifyPinFailed:
+		ns.MutePinFailed = muted
+	case notifyReplicasLow:
+		ns.MuteReplicasLow = muted
+	case notifyQuota:
+		ns.MuteQuota = muted
+	case notifyKeyExpiring:
+		ns.MuteKeyExpiring = muted
+	}
+}
+
+type notifier struct {
+	db        *gorm.DB
+	cfg       config.Notifications
+	hostname  string
+	sender    *mail.Sender
+	templates map[string]*mail.Template
+	verify    *mail.Template
+}
+
+func newNotifier(db *gorm.DB, cfg config.Notifications, hostname string) (*notifier, error) {
+	n := &notifier{
+		db:       db,
+		cfg:      cfg,
+		hostname: hostname,
+		sender: &mail.Sender{
+			Host:        cfg.SMTP.Host,
+			Port:        cfg.SMTP.Port,
+			Username:    cfg.SMTP.Username,
+			Password:    cfg.SMTP.Password,
+			From:        cfg.SMTP.From,
+			ImplicitTLS: cfg.SMTP.ImplicitTLS,
+		},
+		templates: make(map[string]*mail.Template),
+	}
+
+	for _, kind := range notificationKinds {
+		text := defaultNotificationTemplates[kind]
+		if cfg.TemplateDir != "" {
+			b, err := ioutil.ReadFile(filepath.Join(cfg.TemplateDir, kind+".tmpl"))
+			switch {
+			case err == nil:
+				text = string(b)
+			case !errors.Is(err, os.ErrNotExist):
+				return nil, err
+			}
+		}
+
+		tmpl, err := mail.ParseTemplate(kind, text)
+		if err != nil {
+			return nil, err
+		}
+		n.templates[kind] = tmpl
+	}
+
+	verify, err := mail.ParseTemplate("verify_email", emailVerifyTemplate)
+	if err != nil {
+		return nil, err
+	}
+	n.verify = verify
+	return n, nil
+}
+
+// mailVerification mails the token that verifies an email override to it
+func (n *notifier) mailVerification(ctx context.Context, u *User, to, token string) error {
+	subject, body, err := n.verify.Execute(&notificationData{
+		Username: u.Username,
+		Hostname: n.hostname,
+		Count:    1,
+		Items:    []string{token},
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	return n.sender.Send(ctx, to, subject, body)
+}
+
+// queue records events to be mailed, leaving out the ones users muted and
+// the ones that were queued before
+func (n *notifier) queue(ctx context.Context, events []notification) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	uids := make([]uint, 0, len(events))
+	for _, ev := range events {
+		uids = append(uids, ev.UserID)
+	}
+	var settings []notificationSettings
+	if err := n.db.WithContext(ctx).Find(&settings, "user_id IN ?", uids).Error; err != nil {
+		return err
+	}
+	byUser := make(map[uint]*notificationSettings, len(settings))
+	for i := range settings {
+		byUser[settings[i].UserID] = &settings[i]
+	}
+
+	queued := make([]notification, 0, len(events))
+	for _, ev := range events {
+		if ns, ok := byUser[ev.UserID]; ok && ns.muted(ev.Kind) {
+			continue
+		}
+		queued = append(queued, ev)
+	}
+	if len(queued) == 0 {
+		return nil
+	}
+	return n.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(queued, 500).Error
+}
+
+type notificationData struct {
+	Username string
+	Hostname string
+	Count    int
+	Items    []string
+}
+
+// send mails the queued events, one mail per user and kind
+func (n *notifier) send(ctx context.Context) error {
+	var pending []notification
+	if err := n.db.WithContext(ctx).Order("id").Limit(notificationBatch).
+		Find(&pending, "sent_at IS NULL AND attempts < ?", n.cfg.MaxAttempts).Error; err != nil {
+		return err
+	}
+
+	type group struct {
+		user uint
+		kind string
+	}
+	var order []group
+	groups := make(map[group][]notification)
+	for _, p := range pending {
+		g := group{user: p.UserID, kind: p.Kind}
+		if _, ok := groups[g]; !ok {
+			order = append(order, g)
+		}
+		groups[g] = append(groups[g], p)
+	}
+
+	for _, g := range order {
+		notes := groups[g]
+		ids := make([]uint, 0, len(notes))
+		items := make([]string, 0, len(notes))
+		for _, note := range notes {
+			ids = append(ids, note.ID)
+			items = append(items, note.Item)
+		}
+
+		err := n.mail(ctx, g.user, g.kind, items)
+		updates := map[string]interface{}{"sent_at": time.Now()}
+		if err != nil {
+			log.Warnf("failed to mail %s notification to user %d: %s", g.kind, g.user, err)
+			updates = map[string]interface{}{
+				"attempts": gorm.Expr("attempts + 1"),
+				"error":    err.Error(),
+			}
+		}
+		if err := n.db.WithContext(ctx).Model(&notification{}).Where("id IN ?", ids).Updates(updates).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *notifier) mail(ctx context.Context, uid uint, kind string, items []string) error {
+	var user User
+	if err := n.db.WithContext(ctx).First(&user, "id = ?", uid).Error; err != nil {
+		return err
+	}
+
+	to := user.UserEmail
+	var ns notificationSettings
+	if err := n.db.WithContext(ctx).Find(&ns, "user_id = ?", uid).Error; err != nil {
+		return err
+	}
+	if ns.Email != "" {
+		to = ns.Email
+	}
+	if to == "" || ns.muted(kind) {
+		// nowhere to send it, or muted since it was queued
+		return nil
+	}
+
+	tmpl, ok := n.templates[kind]
+	if !ok {
+		return fmt.Errorf("no template for %s notifications", kind)
+	}
+	subject, body, err := tmpl.Execute(&notificationData{
+		Username: user.Username,
+		Hostname: n.hostname,
+		Count:    len(items),
+		Items:    items,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	return n.sender.Send(ctx, to, subject, body)
+}
+
+// checkNotifications looks for the events users are mailed about and
+// queues them
+func (s *Server) checkNotifications(ctx context.Context) error {
+	for _, check := range []struct {
+		kind string
+		find func(context.Context) ([]notification, error)
+	}{
+		{notifyPinFailed, s.findFailedPins},
+		{notifyReplicasLow, s.findUnderReplicated},
+		{notifyQuota, s.findQuotasNearlyUsed},
+		{notifyKeyExpiring, s.findExpiringKeys},
+	} {
+		events, err := check.find(ctx)
+		if err != nil {
+			return fmt.Errorf("checking %s notifications: %w", check.kind, err)
+		}
+		if err := s.notifier.queue(ctx, events); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func contentItem(c util.Content) string {
+	if c.Name == "" {
+		return c.Cid.CID.String()
+	}
+	return fmt.Sprintf("%s (%s)", c.Cid.CID, c.Name)
+}
+
+func (s *Server) findFailedPins(ctx context.Context) ([]notification, error) {
+	var conts []util.Content
+	if err := s.DB.WithContext(ctx).Select("id, user_id, cid, name").Order("id").Limit(notificationBatch).
+		Find(&conts, "failed AND NOT active AND NOT pinning AND updated_at > ?", time.Now().Add(-pinFailedLookback)).Error; err != nil {
+		return nil, err
+	}
+
+	events := make([]notification, 0, len(conts))
+	for _, c := range conts {
+		events = append(events, notification{
+			UserID: c.UserID,
+			Kind:   notifyPinFailed,
+			Key:    fmt.Sprintf("content:%d", c.ID),
+			Item:   contentItem(c),
+		})
+	}
+	return events, nil
+}
+
+type underReplicated struct {
+	util.Content
+	Deals        int
+	ClusterPeers int
+	Target       int
+}
+
+// findUnderReplicated reports content with fewer replicas than its
+// replication target, once a month while it stays that way. Deals and the
+// cluster peers holding content pinned on ipfs-cluster both count.
+func (s *Server) findUnderReplicated(ctx context.Context) ([]notification, error) {
+	var conts []underReplicated
+	if err := s.DB.WithContext(ctx).Model(&util.Content{}).
+		Select("contents.id, contents.user_id, contents.cid, contents.name, COALESCE(deals.count, 0) AS deals, COALESCE(cluster_pins.peers, 0) AS cluster_peers, CASE WHEN contents.replication > 0 THEN contents.replication ELSE ? END AS target", s.CM.replicationFactor()).
+		Joins("LEFT JOIN (?) AS deals ON deals.content = contents.id", s.DB.Model(&contentDeal{}).
+			Select("content, COUNT(1) AS count").
+			Where("deal_id > 0 AND NOT failed AND NOT slashed").
+			Group("content")).
+		Joins("LEFT JOIN cluster_pins ON cluster_pins.content = contents.id").
+		Where("(contents.active OR (contents.location = ? AND NOT contents.failed)) AND contents.aggregated_in = 0 AND NOT contents.aggregate AND NOT contents.dag_split AND contents.created_at < ?",
+			constants.ContentLocationCluster, time.Now().Add(-s.estuaryCfg.Notifications.ReplicaGracePeriod)).
+		Where("COALESCE(deals.count, 0) + COALESCE(cluster_pins.peers, 0) < CASE WHEN contents.replication > 0 THEN contents.replication ELSE ? END", s.CM.replicationFactor()).
+		Order("contents.id").Limit(notificationBatch).
+		Scan(&conts).Error; err != nil {
+		return nil, err
+	}
+
+	month := time.Now().UTC().Format("2006-01")
+	events := make([]notification, 0, len(conts))
+	for _, c := range conts {
+		events = append(events, notification{
+			UserID: c.UserID,
+			Kind:   notifyReplicasLow,
+			Key:    fmt.Sprintf("content:%d:%s", c.ID, month),
+			Item:   underReplicatedItem(c),
+		})
+	}
+	return events, nil
+}
+
+func underReplicatedItem(c underReplicated) string {
+	if c.ClusterPeers > 0 {
+		return fmt.Sprintf("%s: %d of %d replicas, %d deals and %d cluster peers", contentItem(c.Content), c.Deals+c.ClusterPeers, c.Target, c.Deals, c.ClusterPeers)
+	}
+	return fmt.Sprintf("%s: %d of %d deals", contentItem(c.Content), c.Deals, c.Target)
+}
+
+// findQuotasNearlyUsed reports organization quotas to their admins, and
+// monthly egress caps to their users, once a month
+func (s *Server) findQuotasNearlyUsed(ctx context.Context) ([]notification, error) {
+	cfg := s.estuaryCfg.Notifications
+	month := time.Now().UTC().Format("2006-01")
+	nearlyUsed := func(used, quota int64) bool {
+		return quota > 0 && float64(used) >= float64(quota)*cfg.QuotaWarningPercent/100
+	}
+
+	var events []notification
+
+	var orgs []Organization
+	if err := s.DB.WithContext(ctx).Find(&orgs, "quota > 0").Error; err != nil {
+		return nil, err
+	}
+	for _, org := range orgs {
+		usage, err := s.orgUsage(ctx, org.ID)
+		if err != nil {
+			return nil, err
+		}
+		if !nearlyUsed(usage, org.Quota) {
+			continue
+		}
+
+		var admins []orgMember
+		if err := s.DB.WithContext(ctx).Find(&admins, "org_id = ? AND role IN ?", org.ID, []string{orgRoleAdmin, orgRoleOwner}).Error; err != nil {
+			return nil, err
+		}
+		for _, m := range admins {
+			events = append(events, notification{
+				UserID: m.UserID,
+				Kind:   notifyQuota,
+				Key:    fmt.Sprintf("org:%s:%s", org.UUID, month),
+				Item:   fmt.Sprintf("organization %s uses %d of its %d bytes", org.Name, usage, org.Quota),
+			})
+		}
+	}
+
+	if s.egress != nil {
+		var served []struct {
+			UserID uint
+			Plan   string
+			Bytes  int64
+		}
+		if err := s.DB.WithContext(ctx).Model(&egressRecord{}).
+			Select("egress_records.user_id, users.plan, SUM(egress_records.bytes) AS bytes").
+			Joins("JOIN users ON users.id = egress_records.user_id").
+			Where("egress_records.hour >= ?", monthStart(time.Now())).
+			Group("egress_records.user_id, users.plan").
+			Scan(&served).Error; err != nil {
+			return nil, err
+		}
+		for _, sv := range served {
+			plan := s.estuaryCfg.Egress.Plan(sv.Plan)
+			if !nearlyUsed(sv.Bytes, plan.MonthlyBytes) {
+				continue
+			}
+			events = append(events, notification{
+				UserID: sv.UserID,
+				Kind:   notifyQuota,
+				Key:    "egress:" + month,
+				Item:   fmt.Sprintf("%d of the %d bytes of the %s plan were served this month", sv.Bytes, plan.MonthlyBytes, plan.Name),
+			})
+		}
+	}
+	return events, nil
+}
+
+func (s *Server) findExpiringKeys(ctx context.Context) ([]notification, error) {
+	now := time.Now()
+	var keys []AuthToken
+	if err := s.DB.WithContext(ctx).Order("id").Limit(notificationBatch).
+		Find(&keys, "NOT session AND expiry > ? AND expiry < ?", now, now.Add(s.estuaryCfg.Notifications.KeyExpiryWarning)).Error; err != nil {
+		return nil, err
+	}
+
+	events := make([]notification, 0, len(keys))
+	for _, k := range keys {
+		events = append(events, notification{
+			UserID: k.User,
+			Kind:   notifyKeyExpiring,
+			Key:    fmt.Sprintf("key:%d", k.ID),
+			Item:   fmt.Sprintf("the API key created %s expires %s", k.CreatedAt.UTC().Format("2006-01-02"), k.Expiry.UTC().Format(time.RFC1123)),
+		})
+	}
+	return events, nil
+}
+
+type notificationSettingsBody struct {
+	// Email overrides the email of the user, once it is verified
+	Email string `json:"email"`
+	// PendingEmail is an override waiting to be verified
+	PendingEmail string `json:"pendingEmail,omitempty"`
+	// Events maps the events to whether they are mailed
+	Events map[string]bool `json:"events"`
+}
+
+type verifyEmailBody struct {
+	Token string `json:"token"`
+}
+
+// handleGetNotificationSettings godoc
+// @Summary      Get notification preferences
+// @Description  This endpoint returns where notifications of the user are mailed to, and which events they are mailed about: pin_failed, replicas_low, quota and key_expiring.
+// @Tags         User
+// @Produce      json
+// @Success      200  {object}  notificationSettingsBody
+// @Router       /user/notifications [get]
+func (s *Server) handleGetNotificationSettings(c echo.Context, u *User) error {
+	var ns notificationSettings
+	if err := s.DB.Find(&ns, "user_id = ?", u.ID).Error; err != nil {
+		return err
+	}
+
+	resp := &notificationSettingsBody{
+		Email:  ns.Email,
+		Events: make(map[string]bool),
+	}
+	if ns.PendingEmail != "" && time.Now().Before(ns.VerifyExpiry) {
+		resp.PendingEmail = ns.PendingEmail
+	}
+	if resp.Email == "" {
+		resp.Email = u.UserEmail
+	}
+	for _, kind := range notificationKinds {
+		resp.Events[kind] = !ns.muted(kind)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// handlePutNotificationSettings godoc
+// @Summary      Set notification preferences
+// @Description  This endpoint sets the email notifications of the user are mailed to, and turns events on or off. Events left out keep their setting. A new email is only mailed to once it is verified with the token this mails to it, an empty one goes back to the email of the account.
+// @Tags         User
+// @Accept       json
+// @Param        body  body  notificationSettingsBody  true  "Preferences"
+// @Router       /user/notifications [put]
+func (s *Server) handlePutNotificationSettings(c echo.Context, u *User) error {
+	var body notificationSettingsBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if body.Email != "" && !mail.ValidAddress(body.Email) {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid email: %q", body.Email),
+		}
+	}
+
+	var ns notificationSettings
+	if err := s.DB.Find(&ns, "user_id = ?", u.ID).Error; err != nil {
+		return err
+	}
+	ns.UserID = u.ID
+
+	var verifyTo string
+	switch {
+	case body.Email == "" || body.Email == u.UserEmail:
+		ns.Email = ""
+		ns.PendingEmail = ""
+		ns.VerifyToken = ""
+	case body.Email != ns.Email:
+		if s.notifier == nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: "notifications are not enabled on this node",
+			}
+		}
+		ns.PendingEmail = body.Email
+		ns.VerifyToken = uuid.New().String()
+		ns.VerifyExpiry = time.Now().Add(emailVerifyExpiry)
+		verifyTo = body.Email
+	}
+
+	for kind, on := range body.Events {
+		if _, ok := defaultNotificationTemplates[kind]; !ok {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("unknown event: %q", kind),
+			}
+		}
+		ns.setMuted(kind, !on)
+	}
+
+	if err := s.DB.Save(&ns).Error; err != nil {
+		return err
+	}
+	if verifyTo != "" {
+		if err := s.notifier.mailVerification(c.Request().Context(), u, verifyTo, ns.VerifyToken); err != nil {
+			return fmt.Errorf("failed to mail the verification token: %w", err)
+		}
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// handleVerifyNotificationEmail godoc
+// @Summary      Verify the notification email
+// @Description  This endpoint verifies the email set with PUT /user/notifications with the token mailed to it, after which notifications are mailed there.
+// @Tags         User
+// @Accept       json
+// @Param        body  body  verifyEmailBody  true  "Token"
+// @Router       /user/notifications/verify [post]
+func (s *Server) handleVerifyNotificationEmail(c echo.Context, u *User) error {
+	var body verifyEmailBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	var ns notificationSettings
+	if err := s.DB.Find(&ns, "user_id = ?", u.ID).Error; err != nil {
+		return err
+	}
+	if ns.PendingEmail == "" || ns.VerifyToken == "" || body.Token != ns.VerifyToken || time.Now().After(ns.VerifyExpiry) {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "invalid or expired verification token",
+		}
+	}
+
+	if err := s.DB.Model(&notificationSettings{}).Where("user_id = ?", u.ID).Updates(map[string]interface{}{
+		"email":         ns.PendingEmail,
+		"pending_email": "",
+		"verify_token":  "",
+	}).Error; err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/application-research/estuary/constants"
 	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
 	"golang.org/x/xerrors"
 )
 
@@ -126,6 +127,7 @@ func (cm *ContentManager) OffloadContents(ctx context.Context, conts []uint) (in
 	defer span.End()
 
 	var local []uint
+	var localRoots []cid.Cid
 
 	remote := make(map[string][]uint)
 
@@ -139,6 +141,7 @@ func (cm *ContentManager) OffloadContents(ctx context.Context, conts []uint) (in
 
 		if cont.Location == constants.ContentLocationLocal {
 			local = append(local, cont.ID)
+			localRoots = append(localRoots, cont.Cid.CID)
 		} else {
 			remote[cont.Location] = append(remote[cont.Location], cont.ID)
 		}
@@ -154,6 +157,7 @@ func (cm *ContentManager) OffloadContents(ctx context.Context, conts []uint) (in
 		if err := cm.DB.Model(&util.ObjRef{}).Where("content = ?", c).Update("offloaded", 1).Error; err != nil {
 			return 0, err
 		}
+		cm.recordContentEvent(ctx, eventOffloaded, c, map[string]interface{}{"location": cont.Location})
 
 		if cont.Aggregate {
 			if err := cm.DB.Model(&util.Content{}).Where("aggregated_in = ?", c).Update("offloaded", true).Error; err != nil {
@@ -177,6 +181,7 @@ func (cm *ContentManager) OffloadContents(ctx context.Context, conts []uint) (in
 			for _, c := range children {
 				if cont.Location == constants.ContentLocationLocal {
 					local = append(local, c.ID)
+					localRoots = append(localRoots, c.Cid.CID)
 				} else {
 					remote[cont.Location] = append(remote[cont.Location], c.ID)
 				}
@@ -190,6 +195,10 @@ func (cm *ContentManager) OffloadContents(ctx context.Context, conts []uint) (in
 		}
 	}
 
+	for _, root := range localRoots {
+		cm.dropCarIndex(ctx, root)
+	}
+
 	var deleteCount int
 	for _, c := range local {
 		objs, err := cm.objectsForPin(ctx, c)
@@ -224,6 +233,9 @@ func (cm *ContentManager) getRemovalCandidates(ctx context.Context, all bool, lo
 	defer span.End()
 
 	q := cm.DB.Model(util.Content{}).Where("active and not offloaded and (aggregate or not aggregated_in > 0)")
+
+	// hot content stays pinned
+	q = q.Where("id not in (?)", hotTiers(cm.DB.Model(&contentTier{}).Select("content")))
 	if loc != "" {
 		q = q.Where("location = ?", loc)
 	}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/oidc"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// userIdentity links a user to their account at an identity provider
+type userIdentity struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	UserID   uint   `gorm:"index" json:"-"`
+	Provider string `gorm:"uniqueIndex:idx_user_identity" json:"provider"`
+	Subject  string `gorm:"uniqueIndex:idx_user_identity" json:"subject"`
+	Email    string `json:"email"`
+}
+
+// oidcLogin is a login in progress at a provider, looked up by the state
+// the user comes back with. UserID is set when a logged in user links an
+// identity.
+type oidcLogin struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	State    string `gorm:"uniqueIndex"`
+	Nonce    string
+	Provider string
+	UserID   uint
+	Redirect string
+	Expiry   time.Time
+}
+
+var usernameInvalid = regexp.MustCompile(`[^a-z0-9_.-]+`)
+
+// oidcStateCookie holds the state of the login the browser started, the
+// callback only finishes logins started by the same browser
+const oidcStateCookie = "estuary_oidc_state"
+
+// setupOIDC sets up the providers users can log in with, providers that
+// can't be reached are left out
+func setupOIDC(ctx context.Context, cfg config.OIDC) map[string]*oidc.Provider {
+	providers := make(map[string]*oidc.Provider)
+	if !cfg.Enabled {
+		return providers
+	}
+
+	for _, pc := range cfg.Providers {
+		p, err := oidc.New(ctx, oidc.Config{
+			Name:         pc.Name,
+			Issuer:       pc.Issuer,
+			ClientID:     pc.ClientID,
+			ClientSecret: pc.ClientSecret,
+			AuthURL:      pc.AuthURL,
+			TokenURL:     pc.TokenURL,
+			UserInfoURL:  pc.UserInfoURL,
+			Scopes:       pc.Scopes,
+			GroupsClaim:  pc.GroupsClaim,
+			Timeout:      cfg.Timeout,
+		})
+		if err != nil {
+			log.Errorf("failed to set up login provider %s: %s", pc.Name, err)
+			continue
+		}
+		providers[pc.Name] = p
+	}
+	return providers
+}
+
+func (s *Server) oidcProvider(c echo.Context) (*oidc.Provider, error) {
+	p, ok := s.oidc[c.Param("provider")]
+	if !ok {
+		return nil, &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("no login provider named %q", c.Param("provider")),
+		}
+	}
+	return p, nil
+}
+
+func (s *Server) oidcRedirectURL(provider string) string {
+	return fmt.Sprintf("%s/auth/oidc/%s/callback", strings.TrimSuffix(s.estuaryCfg.Hostname, "/"), url.PathEscape(provider))
+}
+
+// startOIDCLogin records a login, binds it to the browser and returns
+// where to send the user
+func (s *Server) startOIDCLogin(c echo.Context, p *oidc.Provider, userID uint, redirect string) (string, error) {
+	login := &oidcLogin{
+		State:    uuid.New().String(),
+		Nonce:    uuid.New().String(),
+		Provider: p.Name(),
+		UserID:   userID,
+		Redirect: redirect,
+		Expiry:   time.Now().Add(s.estuaryCfg.OIDC.LoginExpiry),
+	}
+	if err := s.DB.WithContext(c.Request().Context()).Create(login).Error; err != nil {
+		return "", err
+	}
+
+	c.SetCookie(&http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    login.State,
+		Path:     "/auth/oidc",
+		Expires:  login.Expiry,
+		Secure:   strings.HasPrefix(s.estuaryCfg.Hostname, "https://"),
+		HttpOnly: true,
+		// the provider sends the user back with a top level navigation
+		SameSite: http.SameSiteLaxMode,
+	})
+	return p.AuthCodeURL(login.State, login.Nonce, s.oidcRedirectURL(p.Name())), nil
+}
+
+// handleGetOIDCProviders godoc
+// @Summary      List login providers
+// @Description  This endpoint returns the names of the identity providers users can log in with.
+// @Tags         User
+// @Produce      json
+// @Success      200  {array}  string
+// @Router       /auth/oidc [get]
+func (s *Server) handleGetOIDCProviders(c echo.Context) error {
+	names := []string{}
+	for _, pc := range s.estuaryCfg.OIDC.Providers {
+		if _, ok := s.oidc[pc.Name]; ok {
+			names = append(names, pc.Name)
+		}
+	}
+	return c.JSON(http.StatusOK, names)
+}
+
+// handleOIDCLogin godoc
+// @Summary      Log in with an identity provider
+// @Description  This endpoint sends the user to the identity provider to log in. Once they are back, they are sent on to the redirect url with their token in the url fragment, or get it as json without one.
+// @Tags         User
+// @Param        provider  path   string  true   "Provider name"
+// @Param        redirect  query  string  false  "Where to send the user with their token"
+// @Router       /auth/oidc/{provider}/login [get]
+func (s *Server) handleOIDCLogin(c echo.Context) error {
+	p, err := s.oidcProvider(c)
+	if err != nil {
+		return err
+	}
+
+	redirect := c.QueryParam("redirect")
+	if redirect != "" && !s.oidcRedirectAllowed(redirect) {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "redirect url is not allowed",
+		}
+	}
+
+	u, err := s.startOIDCLogin(c, p, 0, redirect)
+	if err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusFound, u)
+}
+
+// oidcRedirectAllowed checks a redirect against the configured urls, it
+// must have the same scheme and host and be under the same path
+func (s *Server) oidcRedirectAllowed(redirect string) bool {
+	return redirectAllowed(redirect, s.estuaryCfg.OIDC.RedirectURLs)
+}
+
+func redirectAllowed(redirect string, allowed []string) bool {
+	ru, err := url.Parse(redirect)
+	if err != nil || ru.User != nil || ru.Opaque != "" || ru.Host == "" {
+		return false
+	}
+
+	for _, a := range allowed {
+		au, err := url.Parse(a)
+		if err != nil || au.Host == "" {
+			continue
+		}
+		if !strings.EqualFold(ru.Scheme, au.Scheme) || !strings.EqualFold(ru.Host, au.Host) {
+			continue
+		}
+		prefix := strings.TrimSuffix(au.Path, "/")
+		if ru.Path == prefix || strings.HasPrefix(ru.Path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// handleOIDCCallback godoc
+// @Summary      Finish logging in with an identity provider
+// @Description  This endpoint is where the identity provider sends users back to. It logs them in, signs them up or links the identity to the user that started the login.
+// @Tags         User
+// @Produce      json
+// @Param        provider  path   string  true  "Provider name"
+// @Param        code      query  string  true  "Authorization code"
+// @Param        state     query  string  true  "Login state"
+// @Success      200  {object}  loginResponse
+// @Router       /auth/oidc/{provider}/callback [get]
+func (s *Server) handleOIDCCallback(c echo.Context) error {
+	ctx := c.Request().Context()
+	p, err := s.oidcProvider(c)
+	if err != nil {
+		return err
+	}
+
+	// a state is only good for one try, in the browser that started it
+	state := c.QueryParam("state")
+	cookie, err := c.Cookie(oidcStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return &util.HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  util.ERR_INVALID_AUTH,
+			Details: "login was not started in this browser",
+		}
+	}
+	c.SetCookie(&http.Cookie{
+		Name:    oidcStateCookie,
+		Path:    "/auth/oidc",
+		MaxAge:  -1,
+		Expires: time.Unix(0, 0),
+	})
+
+	var login oidcLogin
+	if err := s.DB.First(&login, "state = ?", state).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusForbidden,
+				Reason:  util.ERR_INVALID_AUTH,
+				Details: "unknown login",
+			}
+		}
+		return err
+	}
+	if err := s.DB.Delete(&login).Error; err != nil {
+		return err
+	}
+	if login.Provider != p.Name() || login.Expiry.Before(time.Now()) {
+		return &util.HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  util.ERR_INVALID_AUTH,
+			Details: "login expired",
+		}
+	}
+
+	if e := c.QueryParam("error"); e != "" {
+		return &util.HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  util.ERR_INVALID_AUTH,
+			Details: fmt.Sprintf("%s: %s", e, c.QueryParam("error_description")),
+		}
+	}
+
+	id, err := p.Exchange(ctx, c.QueryParam("code"), login.Nonce, s.oidcRedirectURL(p.Name()))
+	if err != nil {
+		log.Warnf("login with %s failed: %s", p.Name(), err)
+		return &util.HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  util.ERR_INVALID_AUTH,
+			Details: "identity provider did not confirm the login",
+		}
+	}
+
+	user, err := s.oidcUser(ctx, p.Name(), id, login.UserID)
+	if err != nil {
+		return err
+	}
+	if err := s.applyOIDCPlan(ctx, user, id.Groups); err != nil {
+		return err
+	}
+
+	if login.UserID != 0 {
+		return c.JSON(http.StatusOK, map[string]string{})
+	}
+
+	authToken, err := s.newAuthTokenForUser(user, time.Now().Add(time.Hour*24*30), nil, "", true)
+	if err != nil {
+		return err
+	}
+
+	if login.Redirect != "" {
+		v := url.Values{}
+		v.Set("token", authToken.Token)
+		v.Set("expiry", authToken.Expiry.Format(time.RFC3339))
+		return c.Redirect(http.StatusFound, login.Redirect+"#"+v.Encode())
+	}
+	return c.JSON(http.StatusOK, &loginResponse{
+		Token:  authToken.Token,
+		Expiry: authToken.Expiry,
+	})
+}
+
+// oidcUser finds the user an identity belongs to. Identities that aren't
+// linked yet are linked to linkTo if set, to the user with the same
+// verified email with LinkByEmail, or to a new user with AllowSignup.
+func (s *Server) oidcUser(ctx context.Context, provider string, id *oidc.Identity, linkTo uint) (*User, error) {
+	cfg := s.estuaryCfg.OIDC
+
+	var ident userIdentity
+	err := s.DB.WithContext(ctx).First(&ident, "provider = ? AND subject = ?", provider, id.Subject).Error
+	switch {
+	case err == nil:
+		if linkTo != 0 && ident.UserID != linkTo {
+			return nil, &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: "this login is linked to another user",
+			}
+		}
+		var user User
+		if err := s.DB.WithContext(ctx).First(&user, ident.UserID).Error; err != nil {
+			return nil, err
+		}
+		return &user, nil
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return nil, err
+	}
+
+	var user User
+	switch {
+	case linkTo != 0:
+		if err := s.DB.WithContext(ctx).First(&user, linkTo).Error; err != nil {
+			return nil, err
+		}
+	case cfg.LinkByEmail && id.EmailVerified && id.Email != "" &&
+		s.DB.WithContext(ctx).First(&user, "lower(user_email) = ?", strings.ToLower(id.Email)).Error == nil:
+	case cfg.AllowSignup:
+		u, err := s.oidcSignup(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		user = *u
+	default:
+		return nil, &util.HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  util.ERR_USER_NOT_FOUND,
+			Details: "no user is linked to this login",
+		}
+	}
+
+	if err := s.DB.WithContext(ctx).Create(&userIdentity{
+		UserID:   user.ID,
+		Provider: provider,
+		Subject:  id.Subject,
+		Email:    id.Email,
+	}).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// oidcSignup creates a user for an identity, the user has a random
+// password so that it can only log in through its identities
+func (s *Server) oidcSignup(ctx context.Context, id *oidc.Identity) (*User, error) {
+	base := strings.ToLower(id.Name)
+	if base == "" {
+		base = strings.ToLower(strings.Split(id.Email, "@")[0])
+	}
+	base = strings.Trim(usernameInvalid.ReplaceAllString(base, "-"), "-")
+	if base == "" {
+		base = "user"
+	}
+
+	username := base
+	for i := 2; ; i++ {
+		var count int64
+		if err := s.DB.WithContext(ctx).Model(&User{}).Where("username = ?", username).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			break
+		}
+		if i > 10 {
+			username = base + "-" + uuid.New().String()[:8]
+			break
+		}
+		username = fmt.Sprintf("%s-%d", base, i)
+	}
+
+	salt := uuid.New().String()
+	user := &User{
+		Username:  username,
+		UUID:      uuid.New().String(),
+		Salt:      salt,
+		PassHash:  util.GetPasswordHash(uuid.New().String(), salt),
+		UserEmail: id.Email,
+		Perm:      util.PermLevelUser,
+	}
+	if err := s.DB.WithContext(ctx).Create(user).Error; err != nil {
+		return nil, &util.HttpError{
+			Code:   http.StatusInternalServerError,
+			Reason: util.ERR_USER_CREATION_FAILED,
+		}
+	}
+	return user, nil
+}
+
+// applyOIDCPlan gives the user what the first plan matching their groups
+// grants, users in no planned group are left as they are
+func (s *Server) applyOIDCPlan(ctx context.Context, user *User, groups []string) error {
+	in := make(map[string]bool, len(groups))
+	for _, g := range groups {
+		in[g] = true
+	}
+
+	for _, plan := range s.estuaryCfg.OIDC.Plans {
+		if !in[plan.Group] {
+			continue
+		}
+
+		perm, ok := map[string]int{
+			"upload": util.PermLevelUpload,
+			"user":   util.PermLevelUser,
+			"admin":  util.PermLevelAdmin,
+		}[plan.Perm]
+		if ok && perm != user.Perm {
+			if err := s.DB.WithContext(ctx).Model(&User{}).Where("id = ?", user.ID).Update("perm", perm).Error; err != nil {
+				return err
+			}
+			user.Perm = perm
+		}
+		if !ok && plan.Perm != "" {
+			log.Warnf("plan for group %s has invalid perm %q", plan.Group, plan.Perm)
+		}
+
+		for _, f := range plan.FeatureFlags {
+			if err := s.flags.SetUserOverride(ctx, f, user.ID, true); err != nil {
+				log.Warnf("failed to enable feature %s for user %d: %s", f, user.ID, err)
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// handleGetUserIdentities godoc
+// @Summary      List linked logins
+// @Description  This endpoint returns the identity provider logins linked to the user.
+// @Tags         User
+// @Produce      json
+// @Success      200  {array}  userIdentity
+// @Router       /user/identities [get]
+func (s *Server) handleGetUserIdentities(c echo.Context, u *User) error {
+	idents := []userIdentity{}
+	if err := s.DB.Find(&idents, "user_id = ?", u.ID).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, idents)
+}
+
+type linkIdentityResponse struct {
+	URL string `json:"url"`
+}
+
+// handleLinkUserIdentity godoc
+// @Summary      Link a login
+// @Description  This endpoint starts linking a login at an identity provider to the user. The user logs in at the returned url, in the browser that made this request since the login is bound to it with a cookie, after which they can log in through the provider.
+// @Tags         User
+// @Produce      json
+// @Param        provider  path  string  true  "Provider name"
+// @Success      200  {object}  linkIdentityResponse
+// @Router       /user/identities/{provider} [post]
+func (s *Server) handleLinkUserIdentity(c echo.Context, u *User) error {
+	p, err := s.oidcProvider(c)
+	if err != nil {
+		return err
+	}
+
+	authURL, err := s.startOIDCLogin(c, p, u.ID, "")
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, &linkIdentityResponse{URL: authURL})
+}
+
+// handleUnlinkUserIdentity godoc
+// @Summary      Unlink a login
+// @Description  This endpoint removes the user's logins at an identity provider.
+// @Tags         User
+// @Param        provider  path  string  true  "Provider name"
+// @Router       /user/identities/{provider} [delete]
+func (s *Server) handleUnlinkUserIdentity(c echo.Context, u *User) error {
+	if err := s.DB.Where("user_id = ? AND provider = ?", u.ID, c.Param("provider")).Delete(&userIdentity{}).Error; err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// expireOIDCLogins drops logins users never came back from
+func (s *Server) expireOIDCLogins(ctx context.Context) error {
+	return s.DB.WithContext(ctx).Where("expiry < ?", time.Now()).Delete(&oidcLogin{}).Error
+}
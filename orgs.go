@@ -0,0 +1,681 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// roles of organization members, each can do what the ones before it can
+const (
+	orgRoleViewer   = "viewer"
+	orgRoleUploader = "uploader"
+	orgRoleAdmin    = "admin"
+	orgRoleOwner    = "owner"
+)
+
+var orgRoleRanks = map[string]int{
+	orgRoleViewer:   1,
+	orgRoleUploader: 2,
+	orgRoleAdmin:    3,
+	orgRoleOwner:    4,
+}
+
+// Organization lets a team of users share collections and a storage quota.
+// Quota is in bytes, 0 for no quota.
+type Organization struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	UUID  string `gorm:"uniqueIndex" json:"uuid"`
+	Name  string `json:"name"`
+	Quota int64  `json:"quota"`
+}
+
+type orgMember struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	OrgID  uint `gorm:"uniqueIndex:idx_org_member"`
+	UserID uint `gorm:"index;uniqueIndex:idx_org_member"`
+	Role   string
+}
+
+func orgNotFound(id string) error {
+	return &util.HttpError{
+		Code:    http.StatusNotFound,
+		Reason:  util.ERR_INVALID_INPUT,
+		Details: fmt.Sprintf("organization %s was not found", id),
+	}
+}
+
+// getOrg finds an organization u is a member of with at least role
+func (s *Server) getOrg(ctx context.Context, u *User, id string, role string) (*Organization, *orgMember, error) {
+	var org Organization
+	if err := s.DB.WithContext(ctx).First(&org, "uuid = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, orgNotFound(id)
+		}
+		return nil, nil, err
+	}
+
+	m, err := s.checkOrgRole(ctx, u, org.ID, role)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &org, m, nil
+}
+
+// checkOrgRole checks that u is a member of the organization with at least
+// role, admins of the node can do anything
+func (s *Server) checkOrgRole(ctx context.Context, u *User, orgID uint, role string) (*orgMember, error) {
+	var m orgMember
+	if err := s.DB.WithContext(ctx).First(&m, "org_id = ? AND user_id = ?", orgID, u.ID).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		if u.Perm >= util.PermLevelAdmin {
+			return &orgMember{OrgID: orgID, UserID: u.ID, Role: orgRoleOwner}, nil
+		}
+		return nil, &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "organization was not found",
+		}
+	}
+
+	if orgRoleRanks[m.Role] < orgRoleRanks[role] {
+		return nil, &util.HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  util.ERR_NOT_AUTHORIZED,
+			Details: fmt.Sprintf("this needs the %s role in the organization, you are %s", role, m.Role),
+		}
+	}
+	return &m, nil
+}
+
+// getCollection finds a collection u can use with at least role: one of
+// their own, or one of an organization they are a member of
+func (s *Server) getCollection(ctx context.Context, u *User, coluuid string, role string) (*Collection, error) {
+	var col Collection
+	if err := s.DB.WithContext(ctx).First(&col, "uuid = ?", coluuid).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("collection with ID(%s) was not found", coluuid),
+			}
+		}
+		return nil, err
+	}
+
+	if !u.sees(col.Namespace) {
+		return nil, &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_CONTENT_NOT_FOUND,
+			Details: fmt.Sprintf("collection with ID(%s) was not found", coluuid),
+		}
+	}
+
+	if col.OrgID == 0 {
+		if err := util.IsCollectionOwner(u.ID, col.UserID); err != nil {
+			return nil, err
+		}
+		return &col, nil
+	}
+
+	if _, err := s.checkOrgRole(ctx, u, col.OrgID, role); err != nil {
+		return nil, err
+	}
+	return &col, nil
+}
+
+// getCollectionForUpload is getCollection for adding content, which also
+// needs the organization of the collection to be under its quota
+func (s *Server) getCollectionForUpload(ctx context.Context, u *User, coluuid string) (*Collection, error) {
+	col, err := s.getCollection(ctx, u, coluuid, orgRoleUploader)
+	if err != nil {
+		return nil, err
+	}
+	left, limited, err := s.orgQuotaLeft(ctx, col)
+	if err != nil {
+		return nil, err
+	}
+	if limited && left <= 0 {
+		return nil, &util.HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  util.ERR_QUOTA_EXCEEDED,
+			Details: "the organization of the collection has used up its quota",
+		}
+	}
+	return col, nil
+}
+
+// orgQuotaLeft is how many bytes the organization of a collection has left
+// of its quota, false if the collection has no quota to keep to
+func (s *Server) orgQuotaLeft(ctx context.Context, col *Collection) (int64, bool, error) {
+	if col == nil || col.OrgID == 0 {
+		return 0, false, nil
+	}
+
+	var org Organization
+	if err := s.DB.WithContext(ctx).First(&org, "id = ?", col.OrgID).Error; err != nil {
+		return 0, false, err
+	}
+	if org.Quota <= 0 {
+		return 0, false, nil
+	}
+	usage, err := s.orgUsage(ctx, org.ID)
+	if err != nil {
+		return 0, false, err
+	}
+	return org.Quota - usage, true, nil
+}
+
+// checkOrgQuota turns away content of size bytes that doesn't fit in what
+// is left of the quota of the organization of col
+func (s *Server) checkOrgQuota(ctx context.Context, col *Collection, size int64) error {
+	left, limited, err := s.orgQuotaLeft(ctx, col)
+	if err != nil {
+		return err
+	}
+	if limited && size > left {
+		return &util.HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  util.ERR_QUOTA_EXCEEDED,
+			Details: fmt.Sprintf("content is %d bytes, the organization of the collection has %d bytes of its quota left", size, left),
+		}
+	}
+	return nil
+}
+
+// capPinToOrgQuota caps a pin into col, whose size is only known once it
+// is fetched, to what is left of the quota of the organization of col. The
+// cap goes in the meta of the pin, like the cap of a UCAN, and is checked
+// once the pin is done.
+func (s *Server) capPinToOrgQuota(ctx context.Context, col *Collection, meta map[string]interface{}) (map[string]interface{}, error) {
+	left, limited, err := s.orgQuotaLeft(ctx, col)
+	if err != nil || !limited {
+		return meta, err
+	}
+	if meta == nil {
+		meta = make(map[string]interface{})
+	}
+	if max := metaMaxSize(meta); max <= 0 || left < max {
+		meta[pinMetaMaxSize] = left
+	}
+	return meta, nil
+}
+
+// orgUsage is how many bytes the content in the collections of an
+// organization takes up, content in several of them counts once
+func (s *Server) orgUsage(ctx context.Context, orgID uint) (int64, error) {
+	var usage int64
+	err := s.DB.WithContext(ctx).Model(util.Content{}).
+		Where("(active OR pinning) AND id IN (?)", s.orgContents(orgID)).
+		Select("COALESCE(SUM(size), 0)").
+		Scan(&usage).Error
+	return usage, err
+}
+
+// orgContents selects the ids of the content in the collections of an
+// organization, as a subquery
+func (s *Server) orgContents(orgID uint) *gorm.DB {
+	return s.DB.Model(CollectionRef{}).
+		Select("collection_refs.content").
+		Joins("JOIN collections ON collections.id = collection_refs.collection").
+		Where("collections.org_id = ?", orgID)
+}
+
+// allOrgContents selects the ids of the content in the collections of any
+// organization, which is billed to them rather than to its owner
+func (s *Server) allOrgContents() *gorm.DB {
+	return s.DB.Model(CollectionRef{}).
+		Select("collection_refs.content").
+		Joins("JOIN collections ON collections.id = collection_refs.collection").
+		Where("collections.org_id > 0")
+}
+
+// contentOrg returns the organization a content is billed to, 0 if it is
+// in no organization's collection
+func (s *Server) contentOrg(ctx context.Context, contID uint) (uint, error) {
+	var orgs []uint
+	if err := s.DB.WithContext(ctx).Model(CollectionRef{}).
+		Joins("JOIN collections ON collections.id = collection_refs.collection").
+		Where("collection_refs.content = ? AND collections.org_id > 0", contID).
+		Order("collections.id").Limit(1).
+		Pluck("collections.org_id", &orgs).Error; err != nil {
+		return 0, err
+	}
+	if len(orgs) == 0 {
+		return 0, nil
+	}
+	return orgs[0], nil
+}
+
+type orgResponse struct {
+	Organization
+	Role  string `json:"role"`
+	Usage int64  `json:"usage"`
+}
+
+type createOrgBody struct {
+	Name string `json:"name"`
+}
+
+// handleCreateOrg godoc
+// @Summary      Create an organization
+// @Description  This endpoint creates an organization with the user as its owner.
+// @Tags         orgs
+// @Accept       json
+// @Produce      json
+// @Param        body  body      createOrgBody  true  "Organization"
+// @Success      200   {object}  orgResponse
+// @Router       /orgs [post]
+func (s *Server) handleCreateOrg(c echo.Context, u *User) error {
+	var body createOrgBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "organizations need a name",
+		}
+	}
+
+	org := &Organization{
+		UUID:  uuid.New().String(),
+		Name:  body.Name,
+		Quota: s.estuaryCfg.Orgs.DefaultQuota,
+	}
+	if err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(org).Error; err != nil {
+			return err
+		}
+		return tx.Create(&orgMember{OrgID: org.ID, UserID: u.ID, Role: orgRoleOwner}).Error
+	}); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, &orgResponse{Organization: *org, Role: orgRoleOwner})
+}
+
+// handleListOrgs godoc
+// @Summary      List organizations
+// @Description  This endpoint lists the organizations the user is a member of, with their role in each.
+// @Tags         orgs
+// @Produce      json
+// @Success      200  {object}  []orgResponse
+// @Router       /orgs [get]
+func (s *Server) handleListOrgs(c echo.Context, u *User) error {
+	var members []orgMember
+	if err := s.DB.Find(&members, "user_id = ?", u.ID).Error; err != nil {
+		return err
+	}
+	roles := make(map[uint]string)
+	ids := make([]uint, 0, len(members))
+	for _, m := range members {
+		roles[m.OrgID] = m.Role
+		ids = append(ids, m.OrgID)
+	}
+
+	var orgs []Organization
+	if err := s.DB.Order("name").Find(&orgs, "id IN ?", ids).Error; err != nil {
+		return err
+	}
+	out := []orgResponse{}
+	for _, o := range orgs {
+		out = append(out, orgResponse{Organization: o, Role: roles[o.ID]})
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+// handleGetOrg godoc
+// @Summary      Get an organization
+// @Description  This endpoint returns an organization, with the user's role in it and how much of its quota is used.
+// @Tags         orgs
+// @Produce      json
+// @Param        org  path      string  true  "Organization UUID"
+// @Success      200  {object}  orgResponse
+// @Router       /orgs/{org} [get]
+func (s *Server) handleGetOrg(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+	org, m, err := s.getOrg(ctx, u, c.Param("org"), orgRoleViewer)
+	if err != nil {
+		return err
+	}
+	usage, err := s.orgUsage(ctx, org.ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, &orgResponse{Organization: *org, Role: m.Role, Usage: usage})
+}
+
+// handleDeleteOrg godoc
+// @Summary      Delete an organization
+// @Description  This endpoint deletes an organization. Its collections are kept and go to the owner deleting it.
+// @Tags         orgs
+// @Param        org  path  string  true  "Organization UUID"
+// @Router       /orgs/{org} [delete]
+func (s *Server) handleDeleteOrg(c echo.Context, u *User) error {
+	org, _, err := s.getOrg(c.Request().Context(), u, c.Param("org"), orgRoleOwner)
+	if err != nil {
+		return err
+	}
+
+	if err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Collection{}).Where("org_id = ?", org.ID).
+			Updates(map[string]interface{}{"org_id": 0, "user_id": u.ID}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("org_id = ?", org.ID).Delete(&orgMember{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(org).Error
+	}); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+type orgMemberResponse struct {
+	Username string    `json:"username"`
+	Role     string    `json:"role"`
+	Since    time.Time `json:"since"`
+}
+
+// handleGetOrgMembers godoc
+// @Summary      List organization members
+// @Description  This endpoint lists the members of an organization and their roles.
+// @Tags         orgs
+// @Produce      json
+// @Param        org  path      string  true  "Organization UUID"
+// @Success      200  {object}  []orgMemberResponse
+// @Router       /orgs/{org}/members [get]
+func (s *Server) handleGetOrgMembers(c echo.Context, u *User) error {
+	org, _, err := s.getOrg(c.Request().Context(), u, c.Param("org"), orgRoleViewer)
+	if err != nil {
+		return err
+	}
+
+	out := []orgMemberResponse{}
+	if err := s.DB.Model(&orgMember{}).
+		Joins("JOIN users ON users.id = org_members.user_id").
+		Where("org_members.org_id = ?", org.ID).
+		Order("users.username").
+		Select("users.username, org_members.role, org_members.created_at as since").
+		Scan(&out).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+type orgMemberBody struct {
+	Role string `json:"role"`
+}
+
+// handleSetOrgMember godoc
+// @Summary      Add or change an organization member
+// @Description  This endpoint adds a user to an organization, or changes their role: owner, admin, uploader or viewer. Admins manage members up to admin, only owners can make or unmake owners.
+// @Tags         orgs
+// @Accept       json
+// @Param        org       path  string         true  "Organization UUID"
+// @Param        username  path  string         true  "Username"
+// @Param        body      body  orgMemberBody  true  "Role"
+// @Router       /orgs/{org}/members/{username} [put]
+func (s *Server) handleSetOrgMember(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+	org, me, err := s.getOrg(ctx, u, c.Param("org"), orgRoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	var body orgMemberBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if _, ok := orgRoleRanks[body.Role]; !ok {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid role %q, must be owner, admin, uploader or viewer", body.Role),
+		}
+	}
+
+	member, err := s.getUserByName(c.Param("username"))
+	if err != nil {
+		return err
+	}
+
+	if err := s.DB.Transaction(func(tx *gorm.DB) error {
+		var m orgMember
+		err := tx.First(&m, "org_id = ? AND user_id = ?", org.ID, member.ID).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			var count int64
+			if err := tx.Model(&orgMember{}).Where("org_id = ?", org.ID).Count(&count).Error; err != nil {
+				return err
+			}
+			if max := s.estuaryCfg.Orgs.MaxMembers; max > 0 && count >= int64(max) {
+				return &util.HttpError{
+					Code:    http.StatusBadRequest,
+					Reason:  util.ERR_INVALID_INPUT,
+					Details: fmt.Sprintf("organizations can have at most %d members", max),
+				}
+			}
+		case err != nil:
+			return err
+		}
+
+		if (body.Role == orgRoleOwner || m.Role == orgRoleOwner) && me.Role != orgRoleOwner {
+			return &util.HttpError{
+				Code:    http.StatusForbidden,
+				Reason:  util.ERR_NOT_AUTHORIZED,
+				Details: "only owners can make or unmake owners",
+			}
+		}
+		if m.Role == orgRoleOwner && body.Role != orgRoleOwner {
+			if err := checkOtherOwner(tx, org.ID, member.ID); err != nil {
+				return err
+			}
+		}
+
+		m.OrgID = org.ID
+		m.UserID = member.ID
+		m.Role = body.Role
+		return tx.Save(&m).Error
+	}); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// handleRemoveOrgMember godoc
+// @Summary      Remove an organization member
+// @Description  This endpoint removes a user from an organization. Admins can remove members up to admin, and every member can leave.
+// @Tags         orgs
+// @Param        org       path  string  true  "Organization UUID"
+// @Param        username  path  string  true  "Username"
+// @Router       /orgs/{org}/members/{username} [delete]
+func (s *Server) handleRemoveOrgMember(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+	leaving := strings.ToLower(c.Param("username")) == u.Username
+
+	role := orgRoleAdmin
+	if leaving {
+		role = orgRoleViewer
+	}
+	org, me, err := s.getOrg(ctx, u, c.Param("org"), role)
+	if err != nil {
+		return err
+	}
+
+	member, err := s.getUserByName(c.Param("username"))
+	if err != nil {
+		return err
+	}
+
+	if err := s.DB.Transaction(func(tx *gorm.DB) error {
+		var m orgMember
+		if err := tx.First(&m, "org_id = ? AND user_id = ?", org.ID, member.ID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return &util.HttpError{
+					Code:    http.StatusNotFound,
+					Reason:  util.ERR_USER_NOT_FOUND,
+					Details: fmt.Sprintf("%s is not a member of the organization", member.Username),
+				}
+			}
+			return err
+		}
+		if m.Role == orgRoleOwner {
+			if !leaving && me.Role != orgRoleOwner {
+				return &util.HttpError{
+					Code:    http.StatusForbidden,
+					Reason:  util.ERR_NOT_AUTHORIZED,
+					Details: "only owners can remove owners",
+				}
+			}
+			if err := checkOtherOwner(tx, org.ID, member.ID); err != nil {
+				return err
+			}
+		}
+
+		return tx.Delete(&m).Error
+	}); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func (s *Server) getUserByName(username string) (*User, error) {
+	var u User
+	if err := s.DB.First(&u, "username = ?", strings.ToLower(username)).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_USER_NOT_FOUND,
+				Details: fmt.Sprintf("user %s does not exist", username),
+			}
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
+// checkOtherOwner makes sure an organization keeps an owner when userID
+// stops being one
+func checkOtherOwner(tx *gorm.DB, orgID, userID uint) error {
+	var owners int64
+	if err := tx.Model(&orgMember{}).Where("org_id = ? AND role = ? AND user_id != ?", orgID, orgRoleOwner, userID).Count(&owners).Error; err != nil {
+		return err
+	}
+	if owners == 0 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "organizations need at least one owner",
+		}
+	}
+	return nil
+}
+
+// handleCreateOrgCollection godoc
+// @Summary      Create an organization collection
+// @Description  This endpoint creates a collection shared by the members of an organization. Uploaders can add content to it and viewers can list it, its content counts towards the quota of the organization.
+// @Tags         orgs
+// @Accept       json
+// @Produce      json
+// @Param        org   path      string                true  "Organization UUID"
+// @Param        body  body      createCollectionBody  true  "Collection name and description"
+// @Success      200   {object}  Collection
+// @Router       /orgs/{org}/collections [post]
+func (s *Server) handleCreateOrgCollection(c echo.Context, u *User) error {
+	org, _, err := s.getOrg(c.Request().Context(), u, c.Param("org"), orgRoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	var body createCollectionBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	col := &Collection{
+		UUID:        uuid.New().String(),
+		Name:        body.Name,
+		Description: body.Description,
+		UserID:      u.ID,
+		OrgID:       org.ID,
+		Namespace:   u.namespace(),
+	}
+	if err := s.DB.Create(col).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, col)
+}
+
+// handleListOrgCollections godoc
+// @Summary      List organization collections
+// @Description  This endpoint lists the collections of an organization, keys bound to a namespace only see the ones in it.
+// @Tags         orgs
+// @Produce      json
+// @Param        org  path      string  true  "Organization UUID"
+// @Success      200  {object}  []Collection
+// @Router       /orgs/{org}/collections [get]
+func (s *Server) handleListOrgCollections(c echo.Context, u *User) error {
+	org, _, err := s.getOrg(c.Request().Context(), u, c.Param("org"), orgRoleViewer)
+	if err != nil {
+		return err
+	}
+
+	cols := []Collection{}
+	if err := s.DB.Order("id").Scopes(inNamespace(u)).Find(&cols, "org_id = ?", org.ID).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, cols)
+}
+
+type orgQuotaBody struct {
+	Quota int64 `json:"quota"`
+}
+
+// handleAdminSetOrgQuota godoc
+// @Summary      Set the quota of an organization
+// @Description  This endpoint sets how many bytes the collections of an organization can hold, 0 for no quota.
+// @Tags         admin
+// @Accept       json
+// @Param        org   path  string        true  "Organization UUID"
+// @Param        body  body  orgQuotaBody  true  "Quota"
+// @Router       /admin/orgs/{org}/quota [put]
+func (s *Server) handleAdminSetOrgQuota(c echo.Context) error {
+	var body orgQuotaBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if body.Quota < 0 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "quota can not be negative",
+		}
+	}
+
+	res := s.DB.Model(&Organization{}).Where("uuid = ?", c.Param("org")).Update("quota", body.Quota)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return orgNotFound(c.Param("org"))
+	}
+	return c.NoContent(http.StatusOK)
+}
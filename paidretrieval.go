@@ -0,0 +1,738 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/alerts"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/dagsize"
+	"github.com/application-research/estuary/util/gateway"
+	"github.com/application-research/filclient"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/big"
+	lbstore "github.com/filecoin-project/lotus/blockstore"
+	"github.com/filecoin-project/lotus/chain/actors/adt"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/paych"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/lib/sigs"
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// payment channel vouchers are sent in this header or query parameter
+const (
+	paychVoucherHeader = "X-Estuary-Paych-Voucher"
+	paychVoucherParam  = "paych-voucher"
+)
+
+const gib = 1 << 30
+
+// retrievals served by shuttles are kept this many at most to be metered
+// and refunded
+const retrievalTicketsTracked = 10000
+
+// retrievalAllowance is how many bytes a client address retrieved for free
+// on a day
+type retrievalAllowance struct {
+	ID     uint   `gorm:"primarykey"`
+	Day    string `gorm:"uniqueIndex:idx_allowance_day"`
+	Remote string `gorm:"uniqueIndex:idx_allowance_day"`
+	Bytes  int64
+}
+
+// paychChannel is what a payment channel to the primary paid in vouchers,
+// and what of it retrievals spent, in attoFIL
+type paychChannel struct {
+	ID        uint `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	Channel string `gorm:"uniqueIndex" json:"channel"`
+	From    string `json:"from"`
+	Paid    string `json:"paid"`
+	Spent   string `json:"spent"`
+	// SettlingAt is the epoch the channel settles at once its payer started
+	// settling it, and Closed is set once it was collected
+	SettlingAt int64 `json:"settlingAt,omitempty"`
+	Closed     bool  `json:"closed"`
+}
+
+// paychVoucher is the best voucher received on a lane, submitted once the
+// channel starts settling
+type paychVoucher struct {
+	ID        uint `gorm:"primarykey" json:"-"`
+	UpdatedAt time.Time
+
+	Channel string `gorm:"uniqueIndex:idx_voucher_lane" json:"channel"`
+	Lane    uint64 `gorm:"uniqueIndex:idx_voucher_lane" json:"lane"`
+	Nonce   uint64 `json:"nonce"`
+	Amount  string `json:"amount"`
+	Voucher string `json:"voucher"`
+	// SubmittedAt is when the voucher was last submitted, in SubmitMsg
+	SubmittedAt *time.Time `json:"submittedAt,omitempty"`
+	SubmitMsg   string     `json:"submitMsg,omitempty"`
+}
+
+// retrievalCharge is what a retrieval was charged, to be given back if it
+// isn't served after all
+type retrievalCharge struct {
+	remote string
+	day    string
+	// bytes were taken from the free allowance of remote
+	bytes int64
+	// price was spent from the credit of channel
+	channel string
+	price   types.BigInt
+}
+
+func paychVoucherParamOrHeader(c echo.Context) string {
+	if v := c.QueryParam(paychVoucherParam); v != "" {
+		return v
+	}
+	return c.Request().Header.Get(paychVoucherHeader)
+}
+
+// retrievalSize returns the size of the DAG of cc: the size of the content
+// it is the root of, its estimate from the blocks here, or failing those the
+// size of the smallest content it is part of. Cids that aren't pinned here
+// have no size.
+func (s *Server) retrievalSize(ctx context.Context, cc cid.Cid) (int64, error) {
+	var size int64
+	if err := s.DB.WithContext(ctx).Model(&util.Content{}).Where("cid = ? AND active", util.DbCID{CID: cc}).
+		Select("COALESCE(MAX(size), 0)").Scan(&size).Error; err != nil {
+		return 0, err
+	}
+	if size > 0 {
+		return size, nil
+	}
+
+	// a root block alone is only a lower bound for codecs that don't record
+	// the sizes of their links
+	est, ok, err := s.CM.dagSizes.Peek(ctx, cc)
+	if err == nil && ok && (est.Exact || est.Source != dagsize.SourceRoot) {
+		return est.Size, nil
+	}
+
+	if err := s.DB.WithContext(ctx).Model(&util.Object{}).
+		Joins("JOIN obj_refs ON obj_refs.object = objects.id").
+		Joins("JOIN contents ON contents.id = obj_refs.content").
+		Where("objects.cid = ? AND contents.active", util.DbCID{CID: cc}).
+		Select("COALESCE(MIN(contents.size), 0)").Scan(&size).Error; err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// retrievalTarget returns the cid the gateway path p into the DAG of root
+// resolves to, for a retrieval to be priced by what it gets. Paths that
+// can't be resolved here are priced as the whole DAG.
+func (s *Server) retrievalTarget(ctx context.Context, root cid.Cid, p string) cid.Cid {
+	_, _, segs, err := gateway.ParsePath(p)
+	if err != nil || len(segs) == 0 {
+		return root
+	}
+	target, err := s.gwayHandler.Resolve(ctx, p)
+	if err != nil {
+		return root
+	}
+	return target
+}
+
+// selectedSize returns the size of what the selector of the gateway request
+// req picks
+func (s *Server) selectedSize(ctx context.Context, req *http.Request) (int64, error) {
+	size, err := s.gwayHandler.SelectedSize(ctx, req)
+	if err != nil {
+		code := gateway.ErrorCode(err)
+		return 0, &util.HttpError{
+			Code:    code,
+			Reason:  http.StatusText(code),
+			Details: err.Error(),
+		}
+	}
+	return size, nil
+}
+
+// retrievalPrice returns what retrieving cc costs, and its size. Content
+// that isn't pinned here is free. selected is the size of what a selector
+// picks out of the DAG of cc, zero when all of it is retrieved.
+func (s *Server) retrievalPrice(ctx context.Context, cc cid.Cid, selected int64) (types.BigInt, int64, error) {
+	size, err := s.retrievalSize(ctx, cc)
+	if err != nil {
+		return types.EmptyInt, 0, err
+	}
+	if selected > 0 && selected < size {
+		size = selected
+	}
+
+	perGiB, err := types.ParseFIL(s.estuaryCfg.PaidRetrieval.PricePerGiB)
+	if err != nil {
+		return types.EmptyInt, 0, fmt.Errorf("invalid retrieval price: %w", err)
+	}
+	price := big.Div(big.Mul(big.Int(perGiB), big.NewInt(size)), big.NewInt(gib))
+	return price, size, nil
+}
+
+// useAllowance takes size from the free bytes of remote for day, if enough
+// are left
+func (s *Server) useAllowance(ctx context.Context, day, remote string, size int64) (bool, error) {
+	free := s.estuaryCfg.PaidRetrieval.FreeBytesPerDay
+	if size > free {
+		return false, nil
+	}
+
+	a := retrievalAllowance{Day: day, Remote: remote}
+	if err := s.DB.WithContext(ctx).Where(&a).FirstOrCreate(&a).Error; err != nil {
+		return false, err
+	}
+	res := s.DB.WithContext(ctx).Model(&retrievalAllowance{}).
+		Where("id = ? AND bytes + ? <= ?", a.ID, size, free).
+		Update("bytes", gorm.Expr("bytes + ?", size))
+	return res.RowsAffected > 0, res.Error
+}
+
+// chargeRetrieval lets a retrieval of cc by remote through if it is free,
+// fits in the allowance of remote, or is paid for by the voucher. It returns
+// the charge to refund if the retrieval isn't served, nil if there was none.
+// Retrievals with a selector are charged the selected size.
+func (s *Server) chargeRetrieval(ctx context.Context, cc cid.Cid, selected int64, remote, voucher string) (*retrievalCharge, error) {
+	if !s.estuaryCfg.PaidRetrieval.Enabled {
+		return nil, nil
+	}
+
+	price, size, err := s.retrievalPrice(ctx, cc, selected)
+	if err != nil {
+		return nil, err
+	}
+	if price.IsZero() {
+		return nil, nil
+	}
+	charge := &retrievalCharge{remote: remote, day: time.Now().UTC().Format("2006-01-02")}
+	ok, err := s.useAllowance(ctx, charge.day, remote, size)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		charge.bytes = size
+		return charge, nil
+	}
+
+	if voucher == "" {
+		return nil, &util.HttpError{
+			Code:   http.StatusPaymentRequired,
+			Reason: util.ERR_PAYMENT_REQUIRED,
+			Details: fmt.Sprintf("retrieving %s costs %s, send a payment channel voucher to %s in the %s header",
+				cc, types.FIL(price), s.FilClient.ClientAddr, paychVoucherHeader),
+		}
+	}
+	channel, err := s.redeemVoucher(ctx, voucher, price)
+	if err != nil {
+		return nil, err
+	}
+	charge.channel = channel
+	charge.price = price
+	return charge, nil
+}
+
+// paid tells whether the retrieval was paid for with a voucher, rather than
+// let through by the free allowance
+func (rc *retrievalCharge) paid() bool {
+	return rc != nil && rc.channel != ""
+}
+
+// refundRetrieval gives back what a retrieval that wasn't served was
+// charged
+func (s *Server) refundRetrieval(ctx context.Context, charge *retrievalCharge) {
+	if charge == nil {
+		return
+	}
+	if charge.bytes > 0 {
+		if err := s.DB.WithContext(ctx).Model(&retrievalAllowance{}).
+			Where("day = ? AND remote = ? AND bytes >= ?", charge.day, charge.remote, charge.bytes).
+			Update("bytes", gorm.Expr("bytes - ?", charge.bytes)).Error; err != nil {
+			log.Errorf("failed to refund %d free bytes to %s: %s", charge.bytes, charge.remote, err)
+		}
+	}
+	if charge.channel == "" {
+		return
+	}
+
+	paychLk.Lock()
+	defer paychLk.Unlock()
+
+	if err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var ch paychChannel
+		if err := tx.First(&ch, "channel = ?", charge.channel).Error; err != nil {
+			return err
+		}
+		spent, err := big.FromString(ch.Spent)
+		if err != nil {
+			return err
+		}
+		spent = big.Sub(spent, charge.price)
+		if spent.LessThan(big.Zero()) {
+			spent = big.Zero()
+		}
+		return tx.Model(&ch).Update("spent", spent.String()).Error
+	}); err != nil {
+		log.Errorf("failed to refund %s to channel %s: %s", types.FIL(charge.price), charge.channel, err)
+	}
+}
+
+var errInvalidVoucher = errors.New("invalid voucher")
+
+// voucherChannel is what the chain says about the channel of a voucher
+type voucherChannel struct {
+	from address.Address
+	// balance is what the vouchers of all lanes together can pay
+	balance types.BigInt
+}
+
+// checkVoucher checks that sv is signed by the sender of a channel to the
+// primary that can still pay it, and that it can be submitted now
+func (s *Server) checkVoucher(ctx context.Context, sv *paych.SignedVoucher) (*voucherChannel, error) {
+	// merges would redeem other lanes, and a minimum settle height or a
+	// time lock is no use to a payment for a retrieval made now
+	if sv.Signature == nil || len(sv.SecretPreimage) > 0 || sv.Extra != nil || sv.TimeLockMax != 0 ||
+		len(sv.Merges) > 0 || sv.MinSettleHeight != 0 {
+		return nil, fmt.Errorf("%w: only plain signed vouchers are accepted", errInvalidVoucher)
+	}
+
+	head, err := s.Api.ChainHead(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if sv.TimeLockMin > head.Height() {
+		return nil, fmt.Errorf("%w: voucher can't be submitted before epoch %d", errInvalidVoucher, sv.TimeLockMin)
+	}
+
+	act, err := s.Api.StateGetActor(ctx, sv.ChannelAddr, head.Key())
+	if err != nil {
+		return nil, fmt.Errorf("%w: channel %s: %s", errInvalidVoucher, sv.ChannelAddr, err)
+	}
+	store := adt.WrapStore(ctx, cbor.NewCborStore(lbstore.NewAPIBlockstore(s.Api)))
+	st, err := paych.Load(store, act)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s is not a payment channel: %s", errInvalidVoucher, sv.ChannelAddr, err)
+	}
+
+	settling, err := st.SettlingAt()
+	if err != nil {
+		return nil, err
+	}
+	if settling != 0 {
+		return nil, fmt.Errorf("%w: channel %s is settling", errInvalidVoucher, sv.ChannelAddr)
+	}
+
+	to, err := st.To()
+	if err != nil {
+		return nil, err
+	}
+	self, err := s.Api.StateLookupID(ctx, s.FilClient.ClientAddr, types.EmptyTSK)
+	if err != nil {
+		return nil, err
+	}
+	if to != self {
+		return nil, fmt.Errorf("%w: channel %s does not pay %s", errInvalidVoucher, sv.ChannelAddr, s.FilClient.ClientAddr)
+	}
+
+	from, err := st.From()
+	if err != nil {
+		return nil, err
+	}
+	key, err := s.Api.StateAccountKey(ctx, from, types.EmptyTSK)
+	if err != nil {
+		return nil, err
+	}
+	vb, err := sv.SigningBytes()
+	if err != nil {
+		return nil, err
+	}
+	if err := sigs.Verify(sv.Signature, key, vb); err != nil {
+		return nil, fmt.Errorf("%w: bad signature: %s", errInvalidVoucher, err)
+	}
+
+	if sv.Amount.GreaterThan(act.Balance) {
+		return nil, fmt.Errorf("%w: channel %s holds less than %s", errInvalidVoucher, sv.ChannelAddr, types.FIL(sv.Amount))
+	}
+
+	// a voucher the lane is past on chain can't be submitted anymore
+	if err := st.ForEachLaneState(func(idx uint64, ls paych.LaneState) error {
+		if idx != sv.Lane {
+			return nil
+		}
+		nonce, err := ls.Nonce()
+		if err != nil {
+			return err
+		}
+		if nonce >= sv.Nonce {
+			return fmt.Errorf("%w: lane %d is at nonce %d on chain", errInvalidVoucher, sv.Lane, nonce)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return &voucherChannel{from: from, balance: act.Balance}, nil
+}
+
+// vouchers of a channel are redeemed one at a time
+var paychLk sync.Mutex
+
+// redeemVoucher credits a channel with what its voucher adds and spends
+// price of the credit, it returns the channel charged
+func (s *Server) redeemVoucher(ctx context.Context, voucher string, price types.BigInt) (string, error) {
+	sv, err := paych.DecodeSignedVoucher(voucher)
+	if err != nil {
+		return "", &util.HttpError{
+			Code:    http.StatusPaymentRequired,
+			Reason:  util.ERR_INVALID_PAYMENT,
+			Details: fmt.Sprintf("failed to decode voucher: %s", err),
+		}
+	}
+	vc, err := s.checkVoucher(ctx, sv)
+	if err != nil {
+		if errors.Is(err, errInvalidVoucher) {
+			return "", &util.HttpError{
+				Code:    http.StatusPaymentRequired,
+				Reason:  util.ERR_INVALID_PAYMENT,
+				Details: err.Error(),
+			}
+		}
+		return "", err
+	}
+
+	paychLk.Lock()
+	defer paychLk.Unlock()
+
+	ch := paychChannel{Channel: sv.ChannelAddr.String()}
+	err = s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where(&ch).Attrs(paychChannel{From: vc.from.String(), Paid: "0", Spent: "0"}).FirstOrCreate(&ch).Error; err != nil {
+			return err
+		}
+		spent, err := big.FromString(ch.Spent)
+		if err != nil {
+			return err
+		}
+
+		// a lane's vouchers are cumulative, the best one is what it paid,
+		// and the channel paid what the best vouchers of its lanes add up to
+		var lanes []paychVoucher
+		if err := tx.Find(&lanes, "channel = ?", ch.Channel).Error; err != nil {
+			return err
+		}
+		paid := big.Zero()
+		var lane *paychVoucher
+		for i := range lanes {
+			if lanes[i].Lane == sv.Lane {
+				lane = &lanes[i]
+				continue
+			}
+			amt, err := big.FromString(lanes[i].Amount)
+			if err != nil {
+				return err
+			}
+			paid = big.Add(paid, amt)
+		}
+		if lane == nil {
+			lane = &paychVoucher{Channel: ch.Channel, Lane: sv.Lane, Amount: "0"}
+		}
+		best, err := big.FromString(lane.Amount)
+		if err != nil {
+			return err
+		}
+		better := sv.Amount.GreaterThan(best) && (sv.Nonce > lane.Nonce || lane.Voucher == "")
+		if better {
+			best = sv.Amount
+		}
+		paid = big.Add(paid, best)
+
+		// the chain only pays out what the channel holds, over all lanes
+		if paid.GreaterThan(vc.balance) {
+			return &util.HttpError{
+				Code:   http.StatusPaymentRequired,
+				Reason: util.ERR_INVALID_PAYMENT,
+				Details: fmt.Sprintf("vouchers of channel %s add up to more than the %s it holds",
+					ch.Channel, types.FIL(vc.balance)),
+			}
+		}
+
+		// turning the retrieval away rolls back what the voucher added, it
+		// is counted again when it, or a later one, comes back
+		credit := big.Sub(paid, spent)
+		if credit.LessThan(price) {
+			return &util.HttpError{
+				Code:   http.StatusPaymentRequired,
+				Reason: util.ERR_PAYMENT_REQUIRED,
+				Details: fmt.Sprintf("channel %s has %s of credit left, %s is needed",
+					ch.Channel, types.FIL(credit), types.FIL(price)),
+			}
+		}
+
+		if better {
+			lane.Nonce = sv.Nonce
+			lane.Amount = sv.Amount.String()
+			lane.Voucher = voucher
+			if err := tx.Save(lane).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&ch).Updates(map[string]interface{}{
+			"paid":  paid.String(),
+			"spent": big.Add(spent, price).String(),
+		}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	return ch.Channel, nil
+}
+
+type retrievalPriceResponse struct {
+	Cid            string `json:"cid"`
+	Size           int64  `json:"size"`
+	Price          string `json:"price"`
+	PaymentAddress string `json:"paymentAddress"`
+	FreeBytesLeft  int64  `json:"freeBytesLeft"`
+}
+
+// handleGetRetrievalPrice godoc
+// @Summary      Get the price of a retrieval
+// @Description  This endpoint returns what retrieving a cid from the gateways costs, where vouchers pay to, and how many free bytes the caller has left today.
+// @Tags         public
+// @Produce      json
+// @Param        cid  path      string  true  "Cid"
+// @Success      200  {object}  retrievalPriceResponse
+// @Router       /public/retrieval/price/{cid} [get]
+func (s *Server) handleGetRetrievalPrice(c echo.Context) error {
+	cc, err := cid.Decode(c.Param("cid"))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid cid: %s", err),
+		}
+	}
+
+	resp := retrievalPriceResponse{Cid: cc.String(), Price: "0", PaymentAddress: s.FilClient.ClientAddr.String()}
+	if !s.estuaryCfg.PaidRetrieval.Enabled {
+		return c.JSON(http.StatusOK, resp)
+	}
+
+	price, size, err := s.retrievalPrice(c.Request().Context(), cc, 0)
+	if err != nil {
+		return err
+	}
+	resp.Size = size
+	resp.Price = types.FIL(price).String()
+
+	var used int64
+	if err := s.DB.Model(&retrievalAllowance{}).
+		Where("day = ? AND remote = ?", time.Now().UTC().Format("2006-01-02"), c.RealIP()).
+		Select("COALESCE(SUM(bytes), 0)").Scan(&used).Error; err != nil {
+		return err
+	}
+	if left := s.estuaryCfg.PaidRetrieval.FreeBytesPerDay - used; left > 0 {
+		resp.FreeBytesLeft = left
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+type paychChannelResponse struct {
+	paychChannel
+	Vouchers []paychVoucher `json:"vouchers"`
+}
+
+// handleAdminListPaychs godoc
+// @Summary      List retrieval payment channels
+// @Description  This endpoint lists the payment channels retrievals were paid through, with the best voucher of each lane and when it was submitted.
+// @Tags         admin
+// @Produce      json
+// @Success      200  {array}  paychChannelResponse
+// @Router       /admin/retrieval/channels [get]
+func (s *Server) handleAdminListPaychs(c echo.Context) error {
+	var chans []paychChannel
+	if err := s.DB.Order("id").Find(&chans).Error; err != nil {
+		return err
+	}
+	var vouchers []paychVoucher
+	if err := s.DB.Where("voucher != ''").Order("channel, lane").Find(&vouchers).Error; err != nil {
+		return err
+	}
+
+	byChan := make(map[string][]paychVoucher)
+	for _, v := range vouchers {
+		byChan[v.Channel] = append(byChan[v.Channel], v)
+	}
+	out := make([]paychChannelResponse, 0, len(chans))
+	for _, ch := range chans {
+		out = append(out, paychChannelResponse{paychChannel: ch, Vouchers: byChan[ch.Channel]})
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+// paychSubmitRetry is how long a submitted voucher is given to land on chain
+// before it is submitted again
+const paychSubmitRetry = time.Hour
+
+type paychSettleState int
+
+const (
+	// paychIdle channels aren't settling, or the chain redeemed all their
+	// vouchers
+	paychIdle paychSettleState = iota
+	// paychSettling channels are settling with vouchers submitted that the
+	// chain hasn't redeemed yet
+	paychSettling
+	// paychMissed channels settled before the chain redeemed all their
+	// vouchers, what those pay is lost
+	paychMissed
+)
+
+// submitSettlingVouchers watches the channels retrievals were paid through.
+// Once the payer of a channel starts settling it, the best voucher of each
+// lane the chain hasn't redeemed yet is submitted, it pays nothing once the
+// channel settled. Vouchers don't expire otherwise, those with a time lock
+// are refused. Channels that are settling, or settled with vouchers unpaid,
+// raise the paych_settling alert.
+func (s *Server) submitSettlingVouchers(ctx context.Context) error {
+	head, err := s.Api.ChainHead(ctx)
+	if err != nil {
+		return err
+	}
+	var chans []paychChannel
+	if err := s.DB.WithContext(ctx).Find(&chans, "NOT closed").Error; err != nil {
+		return err
+	}
+
+	// the nonce of the wallet is read from the chain on every run, messages
+	// of the run are numbered from there
+	pusher := filclient.NewMsgPusher(s.Api, s.Node.Wallet)
+	firing := make(map[string]bool)
+	for i := range chans {
+		ch := &chans[i]
+		key := alertPaychSettling + ":" + ch.Channel
+		state, err := s.settlePaych(ctx, pusher, head, ch)
+		switch {
+		case err != nil:
+			log.Errorf("failed to submit vouchers of settling channel %s: %s", ch.Channel, err)
+			if ch.SettlingAt == 0 {
+				continue
+			}
+			firing[key] = true
+			s.alerts.Fire(ctx, key, alertPaychSettling, alerts.SeverityCritical,
+				fmt.Sprintf("payment channel %s settles at epoch %d and its vouchers failed to be submitted: %s", ch.Channel, ch.SettlingAt, err))
+		case state == paychSettling:
+			firing[key] = true
+			s.alerts.Fire(ctx, key, alertPaychSettling, alerts.SeverityWarning,
+				fmt.Sprintf("payment channel %s settles at epoch %d, its vouchers were submitted", ch.Channel, ch.SettlingAt))
+		case state == paychMissed:
+			firing[key] = true
+			s.alerts.Fire(ctx, key, alertPaychSettling, alerts.SeverityCritical,
+				fmt.Sprintf("payment channel %s settled at epoch %d before all its vouchers were redeemed", ch.Channel, ch.SettlingAt))
+		}
+	}
+	s.alerts.ResolveMissing(ctx, alertPaychSettling, firing)
+	return nil
+}
+
+// settlePaych submits the vouchers of ch the chain hasn't redeemed if it is
+// settling
+func (s *Server) settlePaych(ctx context.Context, pusher *filclient.MsgPusher, head *types.TipSet, ch *paychChannel) (paychSettleState, error) {
+	addr, err := address.NewFromString(ch.Channel)
+	if err != nil {
+		return paychIdle, err
+	}
+	act, err := s.Api.StateGetActor(ctx, addr, head.Key())
+	if err != nil {
+		if strings.Contains(err.Error(), types.ErrActorNotFound.Error()) {
+			// collected, what the chain redeemed was paid out
+			return paychIdle, s.DB.WithContext(ctx).Model(ch).Update("closed", true).Error
+		}
+		return paychIdle, err
+	}
+	store := adt.WrapStore(ctx, cbor.NewCborStore(lbstore.NewAPIBlockstore(s.Api)))
+	st, err := paych.Load(store, act)
+	if err != nil {
+		return paychIdle, err
+	}
+	settling, err := st.SettlingAt()
+	if err != nil {
+		return paychIdle, err
+	}
+	if settling == 0 {
+		return paychIdle, nil
+	}
+	if int64(settling) != ch.SettlingAt {
+		ch.SettlingAt = int64(settling)
+		if err := s.DB.WithContext(ctx).Model(ch).Update("settling_at", ch.SettlingAt).Error; err != nil {
+			return paychIdle, err
+		}
+	}
+
+	redeemed := make(map[uint64]uint64)
+	if err := st.ForEachLaneState(func(idx uint64, ls paych.LaneState) error {
+		nonce, err := ls.Nonce()
+		redeemed[idx] = nonce
+		return err
+	}); err != nil {
+		return paychIdle, err
+	}
+	var vouchers []paychVoucher
+	if err := s.DB.WithContext(ctx).Find(&vouchers, "channel = ? AND voucher != ''", ch.Channel).Error; err != nil {
+		return paychIdle, err
+	}
+	var pending []paychVoucher
+	for _, v := range vouchers {
+		if v.Nonce > redeemed[v.Lane] {
+			pending = append(pending, v)
+		}
+	}
+	if len(pending) == 0 {
+		return paychIdle, nil
+	}
+	if head.Height() >= settling {
+		return paychMissed, nil
+	}
+
+	_, av, err := actorsVersion(ctx, s.Api)
+	if err != nil {
+		return paychIdle, err
+	}
+	if av < 0 {
+		return paychIdle, fmt.Errorf("the network runs actors this build doesn't know")
+	}
+	mb := paych.Message(av, s.FilClient.ClientAddr)
+	for _, v := range pending {
+		if v.SubmittedAt != nil && time.Since(*v.SubmittedAt) < paychSubmitRetry {
+			continue
+		}
+		sv, err := paych.DecodeSignedVoucher(v.Voucher)
+		if err != nil {
+			return paychIdle, err
+		}
+		msg, err := mb.Update(addr, sv, nil)
+		if err != nil {
+			return paychIdle, err
+		}
+		smsg, err := pusher.MpoolPushMessage(ctx, msg, nil)
+		if err != nil {
+			return paychIdle, fmt.Errorf("submitting voucher of lane %d: %w", v.Lane, err)
+		}
+		log.Infof("submitted voucher of lane %d of settling channel %s in %s", v.Lane, ch.Channel, smsg.Cid())
+		if err := s.DB.WithContext(ctx).Model(&paychVoucher{}).Where("id = ?", v.ID).Updates(map[string]interface{}{
+			"submitted_at": time.Now(),
+			"submit_msg":   smsg.Cid().String(),
+		}).Error; err != nil {
+			return paychIdle, err
+		}
+	}
+	return paychSettling, nil
+}
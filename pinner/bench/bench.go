@@ -0,0 +1,404 @@
+// Package bench generates load for the pin manager. It queues synthetic pin
+// operations for a number of users at a given rate, runs them through a pin
+// manager with either a real pin func or a simulated one, and reports the
+// throughput, latencies and queue length seen, so that changes to the
+// scheduler or the queue can be measured before they are deployed.
+package bench
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/pinner"
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+type Config struct {
+	// Ops is the number of operations to queue
+	Ops int
+	// Users is the number of users the operations are spread over
+	Users int
+	// Rate is how many operations are queued per second, zero queues them
+	// all at once
+	Rate float64
+	// MinSize and MaxSize bound the size of the synthetic content
+	MinSize int64
+	MaxSize int64
+	// HighPriority is the fraction of operations that skip the per user
+	// limiter
+	HighPriority float64
+	// Workers is the number of pin workers the manager runs
+	Workers int
+	// SampleInterval is how often the queue length is sampled
+	SampleInterval time.Duration
+	// Seed makes the generated operations and simulated failures repeatable
+	Seed int64
+}
+
+// Sim describes the simulated pin func. Each operation waits Latency before
+// its first block, then fetches its size at Bandwidth bytes per second in
+// BlockSize chunks, and fails with probability FailureRate.
+type Sim struct {
+	Latency     time.Duration
+	Bandwidth   int64
+	BlockSize   int64
+	FailureRate float64
+}
+
+type Percentiles struct {
+	P50 time.Duration `json:"p50"`
+	P90 time.Duration `json:"p90"`
+	P99 time.Duration `json:"p99"`
+	Max time.Duration `json:"max"`
+}
+
+type Report struct {
+	Ops         int           `json:"ops"`
+	Pinned      int           `json:"pinned"`
+	Failed      int           `json:"failed"`
+	Duration    time.Duration `json:"duration"`
+	OpsPerSec   float64       `json:"opsPerSec"`
+	Bytes       int64         `json:"bytes"`
+	BytesPerSec float64       `json:"bytesPerSec"`
+
+	// QueueWait is the time from being queued to being started
+	QueueWait Percentiles `json:"queueWait"`
+	// PinTime is the time from being started to finishing
+	PinTime Percentiles `json:"pinTime"`
+	// Total is the time from being queued to finishing
+	Total Percentiles `json:"total"`
+
+	MaxQueueLength  int     `json:"maxQueueLength"`
+	MeanQueueLength float64 `json:"meanQueueLength"`
+	// UserTotalP50 is the median time to pin for each user, an even spread
+	// means the per user limiter is keeping things fair
+	UserTotalP50 map[uint]time.Duration `json:"userTotalP50"`
+}
+
+type opTimes struct {
+	user    uint
+	size    int64
+	queued  time.Time
+	started time.Time
+	ended   time.Time
+	failed  bool
+}
+
+type Bench struct {
+	cfg Config
+	ops []*opTimes
+
+	lk      sync.Mutex
+	rnd     *rand.Rand
+	pending int
+	done    chan struct{}
+}
+
+func New(cfg Config) *Bench {
+	if cfg.Users <= 0 {
+		cfg.Users = 1
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 1
+	}
+	if cfg.MaxSize < cfg.MinSize {
+		cfg.MaxSize = cfg.MinSize
+	}
+	if cfg.SampleInterval <= 0 {
+		cfg.SampleInterval = 100 * time.Millisecond
+	}
+
+	rnd := rand.New(rand.NewSource(cfg.Seed))
+	ops := make([]*opTimes, cfg.Ops)
+	for i := range ops {
+		size := cfg.MinSize
+		if cfg.MaxSize > cfg.MinSize {
+			size += rnd.Int63n(cfg.MaxSize - cfg.MinSize + 1)
+		}
+		ops[i] = &opTimes{
+			user: uint(i%cfg.Users) + 1,
+			size: size,
+		}
+	}
+
+	return &Bench{
+		cfg:     cfg,
+		ops:     ops,
+		rnd:     rnd,
+		pending: cfg.Ops,
+		done:    make(chan struct{}),
+	}
+}
+
+// contID numbers operations from one, content ids of zero are not valid
+func contID(i int) uint {
+	return uint(i + 1)
+}
+
+func (b *Bench) op(contID uint) *opTimes {
+	if contID == 0 || int(contID) > len(b.ops) {
+		return nil
+	}
+	return b.ops[contID-1]
+}
+
+func fakeCid(i int) cid.Cid {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(i))
+	sum := sha256.Sum256(buf[:])
+	mh, err := multihash.Encode(sum[:], multihash.SHA2_256)
+	if err != nil {
+		panic(err)
+	}
+	return cid.NewCidV1(cid.Raw, mh)
+}
+
+// SimulatedPinFunc returns a pin func that fetches nothing, it only takes
+// as long as fetching the operation's content would
+func (b *Bench) SimulatedPinFunc(sim Sim) pinner.PinFunc {
+	if sim.BlockSize <= 0 {
+		sim.BlockSize = 256 << 10
+	}
+
+	return func(ctx context.Context, op *pinner.PinningOperation, cb pinner.PinProgressCB) error {
+		ot := b.op(op.ContId)
+		if ot == nil {
+			return fmt.Errorf("unknown benchmark operation %d", op.ContId)
+		}
+
+		b.lk.Lock()
+		fail := b.rnd.Float64() < sim.FailureRate
+		b.lk.Unlock()
+
+		if err := sleep(ctx, sim.Latency); err != nil {
+			return err
+		}
+
+		for left := ot.size; left > 0; {
+			n := sim.BlockSize
+			if n > left {
+				n = left
+			}
+			if sim.Bandwidth > 0 {
+				if err := sleep(ctx, time.Duration(n)*time.Second/time.Duration(sim.Bandwidth)); err != nil {
+					return err
+				}
+			}
+			cb(n)
+			left -= n
+		}
+
+		if fail {
+			return fmt.Errorf("simulated failure")
+		}
+		return nil
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *Bench) statusChanged(contID uint, location string, status types.PinningStatus) error {
+	ot := b.op(contID)
+	if ot == nil {
+		return nil
+	}
+
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	now := time.Now()
+	switch status {
+	case types.PinningStatusPinning:
+		if ot.started.IsZero() {
+			ot.started = now
+		}
+	case types.PinningStatusPinned, types.PinningStatusFailed:
+		if !ot.ended.IsZero() {
+			return nil
+		}
+		ot.ended = now
+		ot.failed = status == types.PinningStatusFailed
+		b.pending--
+		if b.pending == 0 {
+			close(b.done)
+		}
+	}
+	return nil
+}
+
+// Run queues the operations into a new pin manager running pinfunc, waits
+// for all of them to finish and reports on how it went. opts may be nil.
+// The pin manager is closed when Run returns.
+func (b *Bench) Run(ctx context.Context, pinfunc pinner.PinFunc, opts *pinner.PinManagerOpts) (_ *Report, err error) {
+	pm := pinner.NewPinManager(pinfunc, b.statusChanged, opts)
+	defer func() {
+		if cerr := pm.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+	go pm.Run(b.cfg.Workers)
+
+	start := time.Now()
+	if b.cfg.Ops == 0 {
+		return b.report(start, nil), nil
+	}
+
+	var samples []int
+	var samplesLk sync.Mutex
+	sampleCtx, stopSampling := context.WithCancel(ctx)
+	defer stopSampling()
+	go func() {
+		t := time.NewTicker(b.cfg.SampleInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				n := pm.PinQueueSize()
+				samplesLk.Lock()
+				samples = append(samples, n)
+				samplesLk.Unlock()
+			case <-sampleCtx.Done():
+				return
+			}
+		}
+	}()
+
+	var interval time.Duration
+	if b.cfg.Rate > 0 {
+		interval = time.Duration(float64(time.Second) / b.cfg.Rate)
+	}
+
+	for i, ot := range b.ops {
+		if interval > 0 && i > 0 {
+			if err := sleep(ctx, interval); err != nil {
+				return nil, err
+			}
+		}
+
+		b.lk.Lock()
+		high := b.rnd.Float64() < b.cfg.HighPriority
+		ot.queued = time.Now()
+		b.lk.Unlock()
+
+		pm.Add(&pinner.PinningOperation{
+			Obj:         fakeCid(i),
+			Name:        fmt.Sprintf("bench-%d", i),
+			UserId:      ot.user,
+			ContId:      contID(i),
+			Status:      types.PinningStatusQueued,
+			SkipLimiter: high,
+			Location:    constants.ContentLocationLocal,
+		})
+	}
+
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	stopSampling()
+
+	samplesLk.Lock()
+	defer samplesLk.Unlock()
+	return b.report(start, samples), nil
+}
+
+func percentiles(ds []time.Duration) Percentiles {
+	if len(ds) == 0 {
+		return Percentiles{}
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	at := func(q float64) time.Duration {
+		return ds[int(q*float64(len(ds)-1))]
+	}
+	return Percentiles{
+		P50: at(0.5),
+		P90: at(0.9),
+		P99: at(0.99),
+		Max: ds[len(ds)-1],
+	}
+}
+
+func (b *Bench) report(start time.Time, samples []int) *Report {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	r := &Report{
+		Ops:          len(b.ops),
+		UserTotalP50: make(map[uint]time.Duration),
+	}
+
+	var end time.Time
+	var wait, pin, total []time.Duration
+	perUser := make(map[uint][]time.Duration)
+	for _, ot := range b.ops {
+		if ot.ended.IsZero() {
+			continue
+		}
+		if ot.failed {
+			r.Failed++
+		} else {
+			r.Pinned++
+			r.Bytes += ot.size
+		}
+		if ot.ended.After(end) {
+			end = ot.ended
+		}
+
+		if !ot.started.IsZero() {
+			wait = append(wait, ot.started.Sub(ot.queued))
+			pin = append(pin, ot.ended.Sub(ot.started))
+		}
+		t := ot.ended.Sub(ot.queued)
+		total = append(total, t)
+		perUser[ot.user] = append(perUser[ot.user], t)
+	}
+
+	if !end.IsZero() {
+		r.Duration = end.Sub(start)
+	}
+	if secs := r.Duration.Seconds(); secs > 0 {
+		r.OpsPerSec = float64(r.Pinned+r.Failed) / secs
+		r.BytesPerSec = float64(r.Bytes) / secs
+	}
+
+	r.QueueWait = percentiles(wait)
+	r.PinTime = percentiles(pin)
+	r.Total = percentiles(total)
+	for u, ds := range perUser {
+		r.UserTotalP50[u] = percentiles(ds).P50
+	}
+
+	var sum int
+	for _, n := range samples {
+		sum += n
+		if n > r.MaxQueueLength {
+			r.MaxQueueLength = n
+		}
+	}
+	if len(samples) > 0 {
+		r.MeanQueueLength = float64(sum) / float64(len(samples))
+	}
+	return r
+}
@@ -0,0 +1,62 @@
+package bench
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/pinner"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimulatedRun(t *testing.T) {
+	b := New(Config{
+		Ops:            40,
+		Users:          4,
+		MinSize:        1 << 20,
+		MaxSize:        4 << 20,
+		Workers:        8,
+		SampleInterval: time.Millisecond,
+		Seed:           1,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	r, err := b.Run(ctx, b.SimulatedPinFunc(Sim{
+		Latency:     time.Millisecond,
+		Bandwidth:   1 << 30,
+		FailureRate: 0.25,
+	}), &pinner.PinManagerOpts{MaxActivePerUser: 2})
+	assert.NoError(t, err)
+
+	assert.Equal(t, 40, r.Ops)
+	assert.Equal(t, 40, r.Pinned+r.Failed)
+	assert.True(t, r.Failed > 0 && r.Failed < 40, "failed %d", r.Failed)
+	assert.True(t, r.Bytes >= int64(r.Pinned)<<20)
+	assert.True(t, r.OpsPerSec > 0)
+	assert.Len(t, r.UserTotalP50, 4)
+	assert.True(t, r.Total.P50 <= r.Total.P99 && r.Total.P99 <= r.Total.Max)
+	assert.True(t, r.MaxQueueLength > 0)
+}
+
+func TestSizesAreRepeatable(t *testing.T) {
+	cfg := Config{Ops: 10, MinSize: 10, MaxSize: 1000, Seed: 7}
+	a, b := New(cfg), New(cfg)
+	for i := range a.ops {
+		assert.Equal(t, a.ops[i].size, b.ops[i].size)
+		assert.True(t, a.ops[i].size >= 10 && a.ops[i].size <= 1000)
+	}
+}
+
+func TestPercentiles(t *testing.T) {
+	var ds []time.Duration
+	for i := 100; i > 0; i-- {
+		ds = append(ds, time.Duration(i))
+	}
+	p := percentiles(ds)
+	assert.Equal(t, time.Duration(50), p.P50)
+	assert.Equal(t, time.Duration(90), p.P90)
+	assert.Equal(t, time.Duration(99), p.P99)
+	assert.Equal(t, time.Duration(100), p.Max)
+}
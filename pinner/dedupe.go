@@ -0,0 +1,418 @@
+package pinner
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/ipfs/bbloom"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	levelds "github.com/ipfs/go-ds-leveldb"
+)
+
+// dedupeKeyVersion is mixed into every dedupe key and names the keys in the
+// index on disk. It is bumped whenever the fields that go into the key or
+// the way they are written change, so keys of different definitions never
+// match, and the ones left on disk are dropped as stale.
+const dedupeKeyVersion = 2
+
+// dedupeKey identifies an operation for the duplicate guard. It is a hash
+// of the fields that make two operations the same pin rather than the
+// fields themselves, so the guard neither copies nor compares them on every
+// lookup.
+type dedupeKey [sha256.Size]byte
+
+// dedupeKey is the key of the operation. The key is made of, in order: the
+// version, content, user, replaced content and object. Every pin is its own
+// content, so origins, name, meta, location, deal making, status, progress
+// and tracing fields are not part of it: another request for the same
+// content is a duplicate whatever it carried, and the key stays the same
+// when the operation drops its origins after a stall.
+func (po *PinningOperation) dedupeKey() dedupeKey {
+	buf := appendUvarint(nil, dedupeKeyVersion)
+	buf = appendUvarint(buf, uint64(po.ContId))
+	buf = appendUvarint(buf, uint64(po.UserId))
+	buf = appendUvarint(buf, uint64(po.Replace))
+	buf = appendBytes(buf, po.Obj.Bytes())
+	return sha256.Sum256(buf)
+}
+
+// dedupeIndex is the exact record of the keys held in the duplicate guard
+type dedupeIndex interface {
+	has(key dedupeKey) (bool, error)
+	put(key dedupeKey) error
+	delete(key dedupeKey) error
+	forEach(func(dedupeKey) error) error
+	// dropStale removes the keys a previous run left behind that were not
+	// taken back, and those of earlier key definitions, returning how many
+	// there were
+	dropStale() (int, error)
+	close() error
+}
+
+type memIndex map[dedupeKey]struct{}
+
+func (m memIndex) has(key dedupeKey) (bool, error) {
+	_, ok := m[key]
+	return ok, nil
+}
+
+func (m memIndex) put(key dedupeKey) error {
+	m[key] = struct{}{}
+	return nil
+}
+
+func (m memIndex) delete(key dedupeKey) error {
+	delete(m, key)
+	return nil
+}
+
+func (m memIndex) forEach(f func(dedupeKey) error) error {
+	for key := range m {
+		if err := f(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m memIndex) dropStale() (int, error) {
+	return 0, nil
+}
+
+func (m memIndex) close() error {
+	return nil
+}
+
+// DedupeIndex keeps the keys of the duplicate guard in a leveldb on disk
+// rather than in memory, for queues of millions of operations. The index
+// outlives the node: every key is written with the generation of the run
+// that holds it, and each open starts a new generation. Keys of earlier
+// generations don't count as held, the operations reloaded on start take
+// them back as they are queued again, and whatever is left once the queue
+// has been reloaded is dropped.
+type DedupeIndex struct {
+	ds  *levelds.Datastore
+	gen uint64
+}
+
+var dedupeGenKey = datastore.NewKey("generation")
+
+// OpenDedupeIndex opens the index kept in dir, or creates it, and starts a
+// new generation in it
+func OpenDedupeIndex(dir string) (*DedupeIndex, error) {
+	ds, err := levelds.NewDatastore(dir, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var gen uint64
+	v, err := ds.Get(context.TODO(), dedupeGenKey)
+	switch {
+	case err == nil:
+		gen, _ = binary.Uvarint(v)
+	case !errors.Is(err, datastore.ErrNotFound):
+		ds.Close() //nolint:errcheck
+		return nil, err
+	}
+	gen++
+	if err := ds.Put(context.TODO(), dedupeGenKey, appendUvarint(nil, gen)); err != nil {
+		ds.Close() //nolint:errcheck
+		return nil, err
+	}
+	return &DedupeIndex{ds: ds, gen: gen}, nil
+}
+
+// Close closes the index, the pin manager using it closes it itself
+func (di *DedupeIndex) Close() error {
+	return di.ds.Close()
+}
+
+func (di *DedupeIndex) close() error {
+	return di.Close()
+}
+
+// indexKeyPrefix holds the keys of the current key definition in the index,
+// keys under any other prefix were written by an earlier one
+var indexKeyPrefix = datastore.NewKey("v" + strconv.Itoa(dedupeKeyVersion))
+
+func indexKey(key dedupeKey) datastore.Key {
+	return indexKeyPrefix.ChildString(hex.EncodeToString(key[:]))
+}
+
+// parseIndexKey returns the dedupe key of an index entry, false if it is not
+// a key of the current definition
+func parseIndexKey(k string) (dedupeKey, bool) {
+	var key dedupeKey
+	dk := datastore.RawKey(k)
+	if !dk.Parent().Equal(indexKeyPrefix) {
+		return key, false
+	}
+	b, err := hex.DecodeString(dk.Name())
+	if err != nil || len(b) != sha256.Size {
+		return key, false
+	}
+	copy(key[:], b)
+	return key, true
+}
+
+func (di *DedupeIndex) has(key dedupeKey) (bool, error) {
+	v, err := di.ds.Get(context.TODO(), indexKey(key))
+	if err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	gen, _ := binary.Uvarint(v)
+	return gen == di.gen, nil
+}
+
+func (di *DedupeIndex) put(key dedupeKey) error {
+	return di.ds.Put(context.TODO(), indexKey(key), appendUvarint(nil, di.gen))
+}
+
+func (di *DedupeIndex) delete(key dedupeKey) error {
+	return di.ds.Delete(context.TODO(), indexKey(key))
+}
+
+// each calls f with every key of the current definition in the index and
+// whether it belongs to this generation
+func (di *DedupeIndex) each(f func(key dedupeKey, current bool) error) error {
+	res, err := di.ds.Query(context.TODO(), query.Query{Prefix: indexKeyPrefix.String()})
+	if err != nil {
+		return err
+	}
+	defer res.Close() //nolint:errcheck
+
+	for r := range res.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		key, ok := parseIndexKey(r.Key)
+		if !ok {
+			continue
+		}
+		gen, _ := binary.Uvarint(r.Value)
+		if err := f(key, gen == di.gen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// outdated returns the entries of the index written with an earlier key
+// definition
+func (di *DedupeIndex) outdated() ([]datastore.Key, error) {
+	res, err := di.ds.Query(context.TODO(), query.Query{KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close() //nolint:errcheck
+
+	var keys []datastore.Key
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		k := datastore.RawKey(r.Key)
+		if k.Equal(dedupeGenKey) {
+			continue
+		}
+		if _, ok := parseIndexKey(r.Key); !ok {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+func (di *DedupeIndex) forEach(f func(dedupeKey) error) error {
+	return di.each(func(key dedupeKey, current bool) error {
+		if !current {
+			return nil
+		}
+		return f(key)
+	})
+}
+
+func (di *DedupeIndex) dropStale() (int, error) {
+	stale, err := di.outdated()
+	if err != nil {
+		return 0, err
+	}
+	if err := di.each(func(key dedupeKey, current bool) error {
+		if !current {
+			stale = append(stale, indexKey(key))
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	for _, k := range stale {
+		if err := di.ds.Delete(context.TODO(), k); err != nil {
+			return 0, err
+		}
+	}
+	return len(stale), nil
+}
+
+// defaultBloomSize is how many keys the bloom filter in front of a disk
+// index is sized for when no size is given
+const defaultBloomSize = 1000000
+
+// duplicateGuard keeps the same operation from being queued again while it
+// is still queued or running. With the keys in memory it is just the index.
+// With them on disk a bloom filter answers for the keys that were never
+// added without going to disk. Released keys can't be taken out of the
+// filter, so it is rebuilt from the index every time it has taken as many
+// new keys as it was sized for. A filter sized for fewer keys than are
+// queued at once still works, it just sends more lookups to disk.
+type duplicateGuard struct {
+	lk    sync.Mutex
+	index dedupeIndex
+	bloom *bbloom.Bloom
+	size  int
+	// added is the number of keys added since the filter was last rebuilt
+	added int
+	live  int
+	// closed is set once the index is closed, the guard lets everything
+	// through after that
+	closed bool
+}
+
+func newDuplicateGuard(di *DedupeIndex, bloomSize int) *duplicateGuard {
+	if di == nil {
+		return &duplicateGuard{index: make(memIndex)}
+	}
+
+	if bloomSize <= 0 {
+		bloomSize = defaultBloomSize
+	}
+	// only fails for sizes below zero
+	bloom, _ := bbloom.New(float64(bloomSize), 0.01)
+	return &duplicateGuard{index: di, bloom: bloom, size: bloomSize}
+}
+
+// add takes the key of the operation, it returns false if an operation with
+// the same key is already queued. If the index fails the operation is let
+// through, a duplicate pin is cheaper than a lost one.
+func (g *duplicateGuard) add(op *PinningOperation) bool {
+	key := op.dedupeKey()
+
+	g.lk.Lock()
+	defer g.lk.Unlock()
+	if g.closed {
+		return true
+	}
+
+	if g.bloom == nil || g.bloom.Has(key[:]) {
+		dup, err := g.index.has(key)
+		if err != nil {
+			log.Warnw("failed to check pin dedupe index", "content", op.ContId, "err", err)
+			return true
+		}
+		if dup {
+			return false
+		}
+	}
+
+	if err := g.index.put(key); err != nil {
+		log.Warnw("failed to write pin dedupe index", "content", op.ContId, "err", err)
+		return true
+	}
+	g.live++
+	if g.bloom != nil {
+		g.bloom.Add(key[:])
+		g.added++
+		if g.added >= g.size {
+			g.rebuildBloom()
+		}
+	}
+
+	op.lk.Lock()
+	op.guarded = true
+	op.lk.Unlock()
+	return true
+}
+
+// rebuildBloom starts the filter over with the keys still held, must be
+// called with lk held
+func (g *duplicateGuard) rebuildBloom() {
+	g.added = 0
+	g.bloom.Clear()
+	if err := g.index.forEach(func(key dedupeKey) error {
+		g.bloom.Add(key[:])
+		return nil
+	}); err != nil {
+		// a filter missing keys would let duplicates through unchecked, go
+		// to the index for every key from now on instead
+		log.Errorw("failed to rebuild pin dedupe filter, checking every key on disk", "err", err)
+		g.bloom = nil
+	}
+}
+
+// release gives up the key the operation was added with
+func (g *duplicateGuard) release(op *PinningOperation) {
+	op.lk.Lock()
+	guarded := op.guarded
+	op.guarded = false
+	op.lk.Unlock()
+	if !guarded {
+		return
+	}
+	key := op.dedupeKey()
+
+	g.lk.Lock()
+	defer g.lk.Unlock()
+	if g.closed {
+		return
+	}
+	if err := g.index.delete(key); err != nil {
+		log.Warnw("failed to release pin dedupe key", "content", op.ContId, "err", err)
+		return
+	}
+	g.live--
+}
+
+// dropStale drops the keys the previous run left that no reloaded operation
+// took back
+func (g *duplicateGuard) dropStale() {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+	if g.closed {
+		return
+	}
+	n, err := g.index.dropStale()
+	if err != nil {
+		log.Errorw("failed to drop stale pin dedupe keys", "err", err)
+		return
+	}
+	if n > 0 {
+		log.Infof("dropped %d pin dedupe keys left from the previous run", n)
+	}
+}
+
+// close closes the index once nothing can be using it any more, keys still
+// held stay in it and are taken back by the operations reloaded on the next
+// start
+func (g *duplicateGuard) close() error {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+	if g.closed {
+		return nil
+	}
+	g.closed = true
+	return g.index.close()
+}
+
+func (g *duplicateGuard) len() int {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+	return g.live
+}
@@ -0,0 +1,181 @@
+package pinner
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupeKey(t *testing.T) {
+	assert := assert.New(t)
+
+	a1 := multiaddr.StringCast("/ip4/1.2.3.4/tcp/4001")
+	a2 := multiaddr.StringCast("/ip4/5.6.7.8/tcp/4001")
+	op := testOp(1, 1)
+	op.Peers = []*peer.AddrInfo{{ID: peer.ID("peer one"), Addrs: []multiaddr.Multiaddr{a1, a2}}}
+
+	// another request for the same content is the same pin, whatever else it
+	// carried, and the key survives dropping origins after a stall
+	for name, change := range map[string]func(*PinningOperation){
+		"origins":  func(o *PinningOperation) { o.Peers = nil },
+		"urls":     func(o *PinningOperation) { o.SourceURLs = []string{"https://example.com"} },
+		"meta":     func(o *PinningOperation) { o.Meta = `{"a":1}` },
+		"name":     func(o *PinningOperation) { o.Name = "other" },
+		"location": func(o *PinningOperation) { o.Location = "shuttle" },
+		"deal":     func(o *PinningOperation) { o.MakeDeal = true },
+		"progress": func(o *PinningOperation) { o.Status = types.PinningStatusPinning; o.SizeFetched = 100 },
+	} {
+		same := testOp(1, 1)
+		change(same)
+		assert.Equal(op.dedupeKey(), same.dedupeKey(), name)
+	}
+
+	for name, change := range map[string]func(*PinningOperation){
+		"content": func(o *PinningOperation) { o.ContId = 2 },
+		"user":    func(o *PinningOperation) { o.UserId = 2 },
+		"replace": func(o *PinningOperation) { o.Replace = 3 },
+		"object":  func(o *PinningOperation) { o.Obj, _ = cid.Decode("bafkqabtimvwgy3yk") },
+	} {
+		other := testOp(1, 1)
+		change(other)
+		assert.NotEqual(op.dedupeKey(), other.dedupeKey(), name)
+	}
+
+	// keys are written under the version of their definition and read back
+	key := op.dedupeKey()
+	assert.Equal(fmt.Sprintf("/v%d", dedupeKeyVersion), indexKey(key).Parent().String())
+	parsed, ok := parseIndexKey(indexKey(key).String())
+	assert.True(ok)
+	assert.Equal(key, parsed)
+	_, ok = parseIndexKey(fmt.Sprintf("/v%d/%x", dedupeKeyVersion-1, key))
+	assert.False(ok, "keys of another definition are not the current one's")
+}
+
+func TestDuplicateGuard(t *testing.T) {
+	assert := assert.New(t)
+
+	release := make(chan struct{})
+	pinfunc := func(ctx context.Context, op *PinningOperation, cb PinProgressCB) error {
+		<-release
+		return nil
+	}
+	done := make(chan uint, 10)
+	statusfunc := func(contID uint, location string, status types.PinningStatus) error {
+		if status == types.PinningStatusPinned {
+			done <- contID
+		}
+		return nil
+	}
+
+	pm := NewPinManager(pinfunc, statusfunc, &PinManagerOpts{MaxActivePerUser: 5})
+	go pm.Run(2)
+
+	pm.Add(testOp(1, 1))
+	pm.Add(testOp(1, 1))
+	pm.Add(testOp(2, 1))
+	assert.Equal(2, pm.guard.len())
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second * 10):
+			t.Fatal("pin never finished")
+		}
+	}
+	select {
+	case id := <-done:
+		t.Fatalf("duplicate of %d was pinned", id)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// once done the same pin can be queued again
+	assert.Eventually(func() bool { return pm.guard.len() == 0 }, time.Second, time.Millisecond*10)
+	pm.Add(testOp(1, 1))
+	select {
+	case <-done:
+	case <-time.After(time.Second * 10):
+		t.Fatal("pin never finished")
+	}
+}
+
+func TestDuplicateGuardOnDisk(t *testing.T) {
+	assert := assert.New(t)
+	dir := filepath.Join(t.TempDir(), "dedupe")
+
+	di, err := OpenDedupeIndex(dir)
+	assert.NoError(err)
+
+	// a small filter is rebuilt a few times along the way
+	g := newDuplicateGuard(di, 4)
+	var ops []*PinningOperation
+	for i := uint(1); i <= 20; i++ {
+		op := testOp(i, 1)
+		assert.True(g.add(op))
+		assert.False(g.add(testOp(i, 1)), "duplicate of %d", i)
+		ops = append(ops, op)
+	}
+	assert.Equal(20, g.len())
+
+	for _, op := range ops[:10] {
+		g.release(op)
+		g.release(op)
+	}
+	assert.Equal(10, g.len())
+	for i := uint(1); i <= 20; i++ {
+		assert.Equal(i <= 10, g.add(testOp(i, 1)), "content %d", i)
+	}
+	assert.NoError(g.close())
+	// the guard lets everything through once the index is closed
+	assert.True(g.add(testOp(1, 1)))
+	g.release(ops[0])
+
+	// the keys of the last run are kept, but only count once they are taken
+	// back by the operations queued again
+	di, err = OpenDedupeIndex(dir)
+	assert.NoError(err)
+	g = newDuplicateGuard(di, 4)
+	defer g.close() //nolint:errcheck
+
+	var kept int
+	assert.NoError(di.each(func(key dedupeKey, current bool) error {
+		assert.False(current)
+		kept++
+		return nil
+	}))
+	assert.Equal(20, kept)
+
+	assert.True(g.add(testOp(1, 1)))
+	assert.False(g.add(testOp(1, 1)))
+
+	// keys of earlier definitions never match and are dropped with the rest
+	old := datastore.NewKey("1")
+	assert.NoError(di.ds.Put(context.Background(), old, appendUvarint(nil, di.gen)))
+	assert.NoError(di.ds.Put(context.Background(), datastore.NewKey("v1").ChildString("00"), appendUvarint(nil, di.gen)))
+
+	// the rest were not reloaded and are dropped
+	g.dropStale()
+	var left int
+	assert.NoError(di.each(func(key dedupeKey, current bool) error {
+		assert.True(current)
+		left++
+		return nil
+	}))
+	assert.Equal(1, left)
+	assert.Equal(1, g.len())
+	stale, err := di.outdated()
+	assert.NoError(err)
+	assert.Empty(stale)
+	has, err := di.ds.Has(context.Background(), dedupeGenKey)
+	assert.NoError(err)
+	assert.True(has, "the generation is kept")
+}
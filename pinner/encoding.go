@@ -0,0 +1,185 @@
+package pinner
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// Encodings of the origins and metadata of shared queue entries. JSON keeps
+// them readable in their own columns, the others pack them into one binary
+// column: peer ids and addresses in their binary form, and optionally
+// compressed. Entries in any encoding can be read whatever the queue writes.
+const (
+	EncodingJSON    = "json"
+	EncodingCompact = "compact"
+	EncodingSnappy  = "snappy"
+	EncodingZstd    = "zstd"
+)
+
+// the first byte of a packed entry says how the rest is compressed
+const (
+	packedPlain  byte = 1
+	packedSnappy byte = 2
+	packedZstd   byte = 3
+)
+
+// maxPackedSize bounds what a packed entry may decompress to
+const maxPackedSize = 16 << 20
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxPackedSize))
+)
+
+// ValidEncoding reports whether enc is one of the queue encodings
+func ValidEncoding(enc string) bool {
+	switch enc {
+	case EncodingJSON, EncodingCompact, EncodingSnappy, EncodingZstd:
+		return true
+	default:
+		return false
+	}
+}
+
+// packedFields are the parts of an operation that grow with its origins
+type packedFields struct {
+	Peers      []*peer.AddrInfo
+	SourceURLs []string
+	Meta       string
+}
+
+func packFields(enc string, f packedFields) ([]byte, error) {
+	buf := []byte{packedPlain}
+	buf = appendUvarint(buf, uint64(len(f.Peers)))
+	for _, p := range f.Peers {
+		buf = appendBytes(buf, []byte(p.ID))
+		buf = appendUvarint(buf, uint64(len(p.Addrs)))
+		for _, a := range p.Addrs {
+			buf = appendBytes(buf, a.Bytes())
+		}
+	}
+	buf = appendUvarint(buf, uint64(len(f.SourceURLs)))
+	for _, u := range f.SourceURLs {
+		buf = appendBytes(buf, []byte(u))
+	}
+	buf = appendBytes(buf, []byte(f.Meta))
+
+	switch enc {
+	case EncodingCompact:
+		return buf, nil
+	case EncodingSnappy:
+		return append([]byte{packedSnappy}, snappy.Encode(nil, buf[1:])...), nil
+	case EncodingZstd:
+		return zstdEncoder.EncodeAll(buf[1:], []byte{packedZstd}), nil
+	default:
+		return nil, fmt.Errorf("unknown queue encoding: %q", enc)
+	}
+}
+
+func unpackFields(data []byte) (packedFields, error) {
+	var f packedFields
+	if len(data) == 0 {
+		return f, errors.New("empty packed entry")
+	}
+
+	body := data[1:]
+	switch data[0] {
+	case packedPlain:
+	case packedSnappy:
+		n, err := snappy.DecodedLen(body)
+		if err != nil {
+			return f, err
+		}
+		if n > maxPackedSize {
+			return f, fmt.Errorf("packed entry too large: %d", n)
+		}
+		if body, err = snappy.Decode(nil, body); err != nil {
+			return f, err
+		}
+	case packedZstd:
+		var err error
+		if body, err = zstdDecoder.DecodeAll(body, nil); err != nil {
+			return f, err
+		}
+	default:
+		return f, fmt.Errorf("unknown packed entry format: %d", data[0])
+	}
+
+	r := &byteReader{buf: body}
+	npeers := r.uvarint()
+	for i := uint64(0); i < npeers && r.err == nil; i++ {
+		ai := &peer.AddrInfo{}
+		ai.ID, r.err = peer.IDFromBytes(r.bytes())
+		naddrs := r.uvarint()
+		for j := uint64(0); j < naddrs && r.err == nil; j++ {
+			var a multiaddr.Multiaddr
+			if a, r.err = multiaddr.NewMultiaddrBytes(r.bytes()); r.err == nil {
+				ai.Addrs = append(ai.Addrs, a)
+			}
+		}
+		f.Peers = append(f.Peers, ai)
+	}
+	nsources := r.uvarint()
+	for i := uint64(0); i < nsources && r.err == nil; i++ {
+		f.SourceURLs = append(f.SourceURLs, string(r.bytes()))
+	}
+	f.Meta = string(r.bytes())
+
+	if r.err != nil {
+		return packedFields{}, r.err
+	}
+	return f, nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendBytes(buf, b []byte) []byte {
+	buf = appendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+var errTruncated = errors.New("packed entry is truncated")
+
+// byteReader reads the fields of a packed entry, remembering the first
+// error so the fields can be read without checking each one
+type byteReader struct {
+	buf []byte
+	err error
+}
+
+func (r *byteReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errTruncated
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *byteReader) bytes() []byte {
+	l := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if l > uint64(len(r.buf)) {
+		r.err = errTruncated
+		return nil
+	}
+	b := r.buf[:l]
+	r.buf = r.buf[l:]
+	return b
+}
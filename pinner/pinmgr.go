@@ -7,11 +7,18 @@ import (
 	"sync"
 	"time"
 
+	"github.com/application-research/estuary/metrics"
 	"github.com/application-research/estuary/pinner/types"
+	"github.com/application-research/estuary/util/dagsize"
+	"github.com/application-research/estuary/util/fetchstats"
+	"github.com/application-research/estuary/util/requestid"
 	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/pkg/errors"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var log = logging.Logger("pinner")
@@ -31,15 +38,45 @@ func NewPinManager(pinfunc PinFunc, scf PinStatusFunc, opts *PinManagerOpts) *Pi
 		opts = DefaultOpts
 	}
 
+	pollInterval := opts.PollInterval
+	if pollInterval == 0 {
+		pollInterval = defaultPollInterval
+	}
+	providerTimeout := opts.ProviderTimeout
+	if providerTimeout == 0 {
+		providerTimeout = defaultProviderTimeout
+	}
+
+	// a shared queue is already kept in the database
+	store := opts.Store
+	if opts.SharedQueue != nil {
+		store = nil
+	}
+
 	return &PinManager{
 		pinQueue:         make(map[uint][]*PinningOperation),
 		activePins:       make(map[uint]int),
+		pending:          make(map[*PinningOperation]struct{}),
 		pinQueueIn:       make(chan *PinningOperation, 64),
 		pinQueueOut:      make(chan *PinningOperation),
 		pinComplete:      make(chan *PinningOperation, 64),
 		RunPinFunc:       pinfunc,
 		StatusChangeFunc: scf,
 		maxActivePerUser: opts.MaxActivePerUser,
+		shared:           opts.SharedQueue,
+		sharedWake:       make(chan struct{}, 1),
+		sharedRunning:    make(map[uint]bool),
+		workersChanged:   make(chan struct{}),
+		pollInterval:     pollInterval,
+		drainCh:          make(chan struct{}),
+		closeCh:          make(chan struct{}),
+		stallTimeout:     opts.StallTimeout,
+		maxStallRestarts: opts.MaxStallRestarts,
+		stallDropOrigins: opts.StallDropOrigins,
+		providerTimeout:  providerTimeout,
+		providerChecks:   make(chan struct{}, maxProviderChecks),
+		store:            store,
+		guard:            newDuplicateGuard(opts.DedupeIndex, opts.DedupeBloomSize),
 	}
 }
 
@@ -49,6 +86,36 @@ var DefaultOpts = &PinManagerOpts{
 
 type PinManagerOpts struct {
 	MaxActivePerUser int
+
+	// SharedQueue, if set, holds queued operations in the database instead
+	// of in memory so that several nodes can work through one queue
+	SharedQueue *SharedQueue
+	// PollInterval is how often idle workers check the shared queue for
+	// operations added by other nodes
+	PollInterval time.Duration
+
+	// StallTimeout cancels an operation that hasn't fetched anything for
+	// that long, it is restarted up to MaxStallRestarts times before it
+	// fails. Zero turns stall detection off.
+	StallTimeout     time.Duration
+	MaxStallRestarts int
+	// StallDropOrigins restarts stalled operations without the origins they
+	// were given, leaving it to content routing to find providers
+	StallDropOrigins bool
+
+	// ProviderTimeout is how long the providers of an operation without
+	// origins are looked for before it is queued, when a ProviderFunc is set
+	ProviderTimeout time.Duration
+
+	// Store, if set, keeps the in memory queue on disk so it can be restored
+	// after a restart, it is not used with a SharedQueue
+	Store *QueueStore
+
+	// DedupeIndex, if set, keeps the keys of the duplicate guard on disk
+	// behind a bloom filter sized for DedupeBloomSize keys, instead of in
+	// memory. The pin manager takes it over and closes it in Close.
+	DedupeIndex     *DedupeIndex
+	DedupeBloomSize int
 }
 
 type PinManager struct {
@@ -61,6 +128,57 @@ type PinManager struct {
 	RunPinFunc       PinFunc
 	StatusChangeFunc PinStatusFunc
 	maxActivePerUser int
+
+	// next is the operation the run loop is about to dispatch, it has been
+	// taken out of pinQueue already. pending are the operations that were
+	// added but haven't made it into the queue yet, while their providers
+	// are looked up or on their way to the run loop. Both are guarded by
+	// pinQueueLk.
+	next    *PinningOperation
+	pending map[*PinningOperation]struct{}
+
+	// workers is how many workers are wanted and running how many there
+	// are, they are only started while started is set. workersChanged is closed and replaced
+	// whenever workers changes, so idle workers notice. All of them are
+	// guarded by pinQueueLk.
+	started        bool
+	workers        int
+	running        int
+	workersChanged chan struct{}
+	workerWg       sync.WaitGroup
+
+	shared       *SharedQueue
+	sharedWake   chan struct{}
+	pollInterval time.Duration
+	// sharedRunning holds the contents of the shared operations this node
+	// is working on, guarded by pinQueueLk
+	sharedRunning map[uint]bool
+
+	drainCh   chan struct{}
+	drainOnce sync.Once
+
+	closeCh   chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+
+	// StallFunc, if set, gets a say in where stalled operations are retried
+	StallFunc        StallFunc
+	stallTimeout     time.Duration
+	maxStallRestarts int
+	stallDropOrigins bool
+
+	// ProviderFunc, if set, is asked for providers of the operations that
+	// come without origins before they are queued, those that have none fail
+	// right away instead of taking up a worker until they time out
+	ProviderFunc    ProviderFunc
+	providerTimeout time.Duration
+	providerChecks  chan struct{}
+
+	store *QueueStore
+
+	// guard drops operations that are already queued or running, the shared
+	// queue dedupes in the database instead
+	guard *duplicateGuard
 }
 
 // TODO: some of these fields are overkill for the generalized pin manager
@@ -71,6 +189,9 @@ type PinningOperation struct {
 	Name  string
 	Peers []*peer.AddrInfo
 	Meta  string
+	// SourceURLs are gateways of other estuary nodes that have the content
+	// and stream it as a car, they are tried before anything else
+	SourceURLs []string
 
 	Status types.PinningStatus
 
@@ -86,6 +207,12 @@ type PinningOperation struct {
 	FetchErr    error
 	EndTime     time.Time
 
+	// estimate is how large the DAG is thought to be, it is set by the pin
+	// func once it knows
+	estimate dagsize.Estimate
+	// fetchStarted is when the current attempt at the operation started
+	fetchStarted time.Time
+
 	Location string
 
 	SkipLimiter bool
@@ -93,6 +220,74 @@ type PinningOperation struct {
 	lk sync.Mutex
 
 	MakeDeal bool
+
+	// SpanContext is the span of the request that queued this operation, the
+	// pin func is run under it so the trace continues through the queue
+	SpanContext trace.SpanContext
+	// RequestID is the id of the api request that queued this operation, it
+	// is passed to the pin func in its context
+	RequestID string
+
+	// fetchStats records how the blocks of the operation are being fetched,
+	// it is set by the pin func
+	fetchStats *fetchstats.Recorder
+
+	// Stalls is the history of the times the operation was cancelled for
+	// not making progress
+	Stalls []Stall
+	// restart is set when the operation stalled and is to be queued again
+	restart bool
+	// failure is why the operation failed, when there is more to say than
+	// the status does
+	failure string
+
+	// when the operation was handed to the pin manager, used for queue metrics
+	queuedAt time.Time
+
+	// the shared queue entry and claim this operation was taken from
+	sharedID   uint
+	claimToken string
+
+	// guarded is set while the operation holds its key in the duplicate
+	// guard
+	guarded bool
+
+	// cancelled is set when the operation is no longer wanted, cancelPin
+	// stops it while it runs
+	cancelled bool
+	cancelPin context.CancelFunc
+}
+
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+)
+
+// Priority is the class the operation is queued under, operations that skip
+// the per user limiter are dispatched ahead of everything else
+func (po *PinningOperation) Priority() string {
+	if po.SkipLimiter {
+		return PriorityHigh
+	}
+	return PriorityNormal
+}
+
+// Cancel stops the operation, it is dropped if it hasn't started yet. A
+// cancelled operation reports no status.
+func (po *PinningOperation) Cancel() {
+	po.lk.Lock()
+	defer po.lk.Unlock()
+
+	po.cancelled = true
+	if po.cancelPin != nil {
+		po.cancelPin()
+	}
+}
+
+func (po *PinningOperation) isCancelled() bool {
+	po.lk.Lock()
+	defer po.lk.Unlock()
+	return po.cancelled
 }
 
 func (po *PinningOperation) fail(err error) {
@@ -119,6 +314,39 @@ func (po *PinningOperation) SetStatus(st types.PinningStatus) {
 
 	po.Status = st
 	po.LastUpdate = time.Now()
+	if st == types.PinningStatusPinning {
+		po.fetchStarted = po.LastUpdate
+	}
+}
+
+// SetEstimate records how large the DAG of the operation is thought to be,
+// it is reported with the progress of the operation
+func (po *PinningOperation) SetEstimate(est dagsize.Estimate) {
+	po.lk.Lock()
+	defer po.lk.Unlock()
+	po.estimate = est
+}
+
+// eta is how long the operation is expected to take still, going by how
+// fast it has fetched so far. It is zero when there is no telling.
+func (po *PinningOperation) eta(now time.Time) time.Duration {
+	if po.Status != types.PinningStatusPinning || po.fetchStarted.IsZero() || po.SizeFetched <= 0 {
+		return 0
+	}
+	left := po.estimate.Size - po.SizeFetched
+	if left <= 0 {
+		return 0
+	}
+	rate := float64(po.SizeFetched) / now.Sub(po.fetchStarted).Seconds()
+	return time.Duration(float64(left) / rate * float64(time.Second))
+}
+
+// SetFetchStats attaches the recorder the operation is being fetched with so
+// the stats can be seen while it is in progress
+func (po *PinningOperation) SetFetchStats(r *fetchstats.Recorder) {
+	po.lk.Lock()
+	defer po.lk.Unlock()
+	po.fetchStats = r
 }
 
 func (po *PinningOperation) PinStatus() *types.IpfsPinStatusResponse {
@@ -142,6 +370,23 @@ func (po *PinningOperation) PinStatus() *types.IpfsPinStatusResponse {
 		}
 	}
 
+	info := make(map[string]interface{}, 0)
+	if po.fetchStats != nil {
+		info["fetch_stats"] = po.fetchStats.Stats()
+	}
+	if len(po.Stalls) > 0 {
+		info["stalls"] = append([]Stall(nil), po.Stalls...)
+	}
+	if po.failure != "" {
+		info["failure"] = po.failure
+	}
+	if po.estimate.Size > 0 {
+		info["estimated_size"] = po.estimate
+		if eta := po.eta(time.Now()); eta > 0 {
+			info["eta_seconds"] = int64(eta.Seconds())
+		}
+	}
+
 	return &types.IpfsPinStatusResponse{
 		RequestID: fmt.Sprint(po.ContId),
 		Status:    po.Status,
@@ -152,7 +397,7 @@ func (po *PinningOperation) PinStatus() *types.IpfsPinStatusResponse {
 			Origins: originStrs,
 			Meta:    meta,
 		},
-		Info: make(map[string]interface{}, 0),
+		Info: info,
 		/* Ref: https://github.com/ipfs/go-pinning-service-http-client/issues/12
 		Info: map[string]interface{}{
 			"obj_fetched":  po.NumFetched,
@@ -162,7 +407,141 @@ func (po *PinningOperation) PinStatus() *types.IpfsPinStatusResponse {
 	}
 }
 
+// SetMaxActivePerUser changes how many pins of a single user may be in
+// progress at once, it applies to operations dispatched from then on
+func (pm *PinManager) SetMaxActivePerUser(n int) {
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+	pm.maxActivePerUser = n
+}
+
+// SetStallOptions changes how stalled operations are detected and retried,
+// it applies to operations started from then on
+func (pm *PinManager) SetStallOptions(timeout time.Duration, maxRestarts int, dropOrigins bool) {
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+	pm.stallTimeout = timeout
+	pm.maxStallRestarts = maxRestarts
+	pm.stallDropOrigins = dropOrigins
+}
+
+func (pm *PinManager) getStallTimeout() time.Duration {
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+	return pm.stallTimeout
+}
+
+func (pm *PinManager) getMaxActivePerUser() int {
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+	return pm.maxActivePerUser
+}
+
+// ActivePins returns the number of operations currently being pinned
+func (pm *PinManager) ActivePins() int {
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+
+	var active int
+	for _, n := range pm.activePins {
+		active += n
+	}
+	return active
+}
+
+// Drain stops any more operations from being started and waits for the
+// ones in progress to finish, and for those still on their way into the
+// queue to get there, or for ctx to be done. Queued operations stay queued,
+// they are persisted by the callers and picked up again on restart.
+// With a shared queue, whatever this node claimed but hasn't started is
+// handed back to the other nodes, operations still running keep their claim
+// so they aren't pinned twice, and are only picked up elsewhere once their
+// lease runs out.
+func (pm *PinManager) Drain(ctx context.Context) error {
+	pm.drainOnce.Do(func() {
+		close(pm.drainCh)
+	})
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var err error
+	for (pm.ActivePins() > 0 || pm.pendingPins() > 0) && err == nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			err = fmt.Errorf("%d pins still in progress and %d not queued yet: %w", pm.ActivePins(), pm.pendingPins(), ctx.Err())
+		}
+	}
+
+	if pm.shared != nil {
+		if rerr := pm.shared.Release(context.Background(), pm.runningShared()); rerr != nil {
+			log.Errorf("failed to release shared pin queue claims: %s", rerr)
+		}
+	}
+	return err
+}
+
+// Close stops the pin manager: no more operations are started and the
+// workers stop once the operation they are on, if any, returns. It then
+// closes the dedupe index, the guard lets everything through from then on
+// so workers still finishing up don't touch the closed index. Call Drain
+// first to wait for the operations in progress.
+func (pm *PinManager) Close() error {
+	pm.closeOnce.Do(func() {
+		close(pm.closeCh)
+		pm.closeErr = pm.guard.close()
+	})
+	return pm.closeErr
+}
+
+// Reloaded tells the pin manager the queue has been restored or refreshed
+// after a start, the dedupe keys of the previous run that no reloaded
+// operation took back are dropped
+func (pm *PinManager) Reloaded() {
+	pm.guard.dropStale()
+}
+
+func (pm *PinManager) runningShared() []uint {
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+
+	running := make([]uint, 0, len(pm.sharedRunning))
+	for id := range pm.sharedRunning {
+		running = append(running, id)
+	}
+	return running
+}
+
+// Checkpoint writes the queue store out so the operations still queued are
+// restored on restart, and returns how many there are. ok is false when
+// there is no store, the queue is then rebuilt from the database instead.
+func (pm *PinManager) Checkpoint() (queued int, ok bool, err error) {
+	if pm.store == nil {
+		return 0, false, nil
+	}
+	if err := pm.store.Snapshot(); err != nil {
+		return 0, false, err
+	}
+	return pm.store.Len(), true, nil
+}
+
+// Shared reports whether the queue is shared with other nodes through the
+// database
+func (pm *PinManager) Shared() bool {
+	return pm.shared != nil
+}
+
 func (pm *PinManager) PinQueueSize() int {
+	if pm.shared != nil {
+		length, _, _, err := pm.shared.Stats(context.TODO())
+		if err != nil {
+			log.Errorf("failed to get shared pin queue size: %s", err)
+			return 0
+		}
+		return int(length[PriorityHigh] + length[PriorityNormal])
+	}
+
 	var count int
 	pm.pinQueueLk.Lock()
 	defer pm.pinQueueLk.Unlock()
@@ -172,29 +551,265 @@ func (pm *PinManager) PinQueueSize() int {
 	return count
 }
 
+type PinQueueSnapshot struct {
+	Shared       bool         `json:"shared"`
+	QueueSize    int          `json:"queueSize"`
+	QueuedByUser map[uint]int `json:"queuedByUser"`
+	ActiveByUser map[uint]int `json:"activeByUser"`
+	// Pending are the operations counted as queued that are still having
+	// their providers looked up or on their way into the queue
+	Pending int `json:"pending"`
+}
+
+// Snapshot returns a point in time copy of the per user queue lengths and
+// active pin counts, for debugging stuck queues
+func (pm *PinManager) Snapshot() *PinQueueSnapshot {
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+
+	snap := &PinQueueSnapshot{
+		QueuedByUser: make(map[uint]int, len(pm.pinQueue)),
+		ActiveByUser: make(map[uint]int, len(pm.activePins)),
+	}
+	for u, pq := range pm.pinQueue {
+		snap.QueuedByUser[u] += len(pq)
+		snap.QueueSize += len(pq)
+	}
+	if pm.next != nil {
+		snap.QueuedByUser[pm.next.UserId]++
+		snap.QueueSize++
+	}
+	for op := range pm.pending {
+		snap.QueuedByUser[op.UserId]++
+		snap.QueueSize++
+		snap.Pending++
+	}
+	for u, n := range pm.activePins {
+		if n > 0 {
+			snap.ActiveByUser[u] = n
+		}
+	}
+
+	// with a shared queue only the active counts are local to this node
+	if pm.shared != nil {
+		snap.Shared = true
+		_, _, users, err := pm.shared.Stats(context.TODO())
+		if err != nil {
+			log.Errorf("failed to get shared pin queue snapshot: %s", err)
+			return snap
+		}
+		for u, n := range users {
+			snap.QueuedByUser[u] += n
+			snap.QueueSize += n
+		}
+	}
+	return snap
+}
+
+// Cancel drops the queued operation of content contID and reports whether
+// it was waiting in the queue. Operations already running have to be
+// stopped with their own Cancel, those claimed by other nodes of a shared
+// queue can't be stopped from here.
+func (pm *PinManager) Cancel(ctx context.Context, contID uint) (bool, error) {
+	if pm.shared != nil {
+		return pm.shared.Remove(ctx, contID)
+	}
+
+	pm.pinQueueLk.Lock()
+	op := pm.removeQueued(contID)
+	pm.pinQueueLk.Unlock()
+	if op == nil {
+		return false, nil
+	}
+
+	op.Cancel()
+	pm.guard.release(op)
+	if pm.store != nil {
+		pm.store.done(op)
+	}
+	return true, nil
+}
+
+// Boost moves the queued operation of content contID ahead of the per user
+// limiter, as if it was queued with SkipLimiter, and to the front of the
+// operations that skip it, and reports whether it was waiting in the queue
+func (pm *PinManager) Boost(ctx context.Context, contID uint) (bool, error) {
+	if pm.shared != nil {
+		return pm.shared.Boost(ctx, contID)
+	}
+
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+	op := pm.removeQueued(contID)
+	if op == nil {
+		return false, nil
+	}
+	op.SkipLimiter = true
+	pm.pinQueue[0] = append([]*PinningOperation{op}, pm.pinQueue[0]...)
+	if pm.store != nil {
+		pm.store.added(op)
+	}
+	return true, nil
+}
+
+// removeQueued takes the operation of content contID out of the queue, the
+// one the run loop is about to dispatch isn't in it anymore. Must be called
+// with pinQueueLk held.
+func (pm *PinManager) removeQueued(contID uint) *PinningOperation {
+	for u, pq := range pm.pinQueue {
+		for i, op := range pq {
+			if op.ContId != contID {
+				continue
+			}
+			if len(pq) == 1 {
+				delete(pm.pinQueue, u)
+			} else {
+				pm.pinQueue[u] = append(pq[:i:i], pq[i+1:]...)
+			}
+			return op
+		}
+	}
+	return nil
+}
+
 func (pm *PinManager) Add(op *PinningOperation) {
+	if pm.shared == nil && !pm.guard.add(op) {
+		log.Debugw("dropping duplicate pin operation", "content", op.ContId, "cid", op.Obj)
+		return
+	}
+
+	op.queuedAt = time.Now()
+	if pm.store != nil {
+		pm.store.added(op)
+	}
+	pm.addPending(op)
+	if pm.ProviderFunc != nil && len(op.Peers) == 0 {
+		go func() {
+			if !pm.checkProviders(op) {
+				pm.failNoProviders(op)
+				return
+			}
+			pm.enqueue(op)
+		}()
+		return
+	}
+	pm.enqueue(op)
+}
+
+// Restore queues the operations that were outstanding when the node last
+// stopped, as kept by the queue store, and returns them. found is false when
+// the store had nothing, and the queue has to be rebuilt from the database
+// instead.
+func (pm *PinManager) Restore() (ops []*PinningOperation, found bool, err error) {
+	if pm.store == nil {
+		return nil, false, nil
+	}
+
+	ops, found, err = pm.store.Load()
+	if err != nil {
+		return nil, false, err
+	}
+	// restored operations take back the keys they held before the restart,
+	// only those already queued again in the meantime are dropped
+	restored := ops[:0]
+	for _, op := range ops {
+		if !pm.guard.add(op) {
+			continue
+		}
+		pm.addPending(op)
+		pm.enqueue(op)
+		restored = append(restored, op)
+	}
+	return restored, found, nil
+}
+
+func (pm *PinManager) enqueue(op *PinningOperation) {
+	if pm.shared != nil {
+		go pm.addShared(op)
+		return
+	}
+
 	go func() {
-		pm.pinQueueIn <- op
+		select {
+		case pm.pinQueueIn <- op:
+		case <-pm.closeCh:
+			pm.donePending(op)
+		}
 	}()
 }
 
+func (pm *PinManager) addPending(op *PinningOperation) {
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+	pm.pending[op] = struct{}{}
+}
+
+// donePending is called once a pending operation made it into the queue or
+// was dropped
+func (pm *PinManager) donePending(op *PinningOperation) {
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+	delete(pm.pending, op)
+}
+
+func (pm *PinManager) pendingPins() int {
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+	return len(pm.pending)
+}
+
 var maxTimeout = 24 * time.Hour
 
+var ErrCancelled = errors.New("pinning operation cancelled")
+
+const queueMetricsInterval = 15 * time.Second
+
+const defaultPollInterval = 5 * time.Second
+
 func (pm *PinManager) doPinning(op *PinningOperation) error {
 	ctx, cancel := context.WithTimeout(context.Background(), maxTimeout)
 	defer cancel()
 
+	if op.SpanContext.IsValid() {
+		ctx = trace.ContextWithSpanContext(ctx, op.SpanContext)
+	}
+	ctx = requestid.WithID(ctx, op.RequestID)
+
+	recordQueueWait(op)
+
+	if op.isCancelled() {
+		return ErrCancelled
+	}
+
 	op.SetStatus(types.PinningStatusPinning)
 	if err := pm.StatusChangeFunc(op.ContId, op.Location, types.PinningStatusPinning); err != nil {
 		return err
 	}
 
-	if err := pm.RunPinFunc(ctx, op, func(size int64) {
+	pinctx, cancelPin := context.WithCancel(ctx)
+	defer cancelPin()
+	op.lk.Lock()
+	op.cancelPin = cancelPin
+	op.lk.Unlock()
+	sw := watchForStall(op, pm.getStallTimeout(), cancelPin)
+
+	err := pm.RunPinFunc(pinctx, op, func(size int64) {
 		op.lk.Lock()
 		defer op.lk.Unlock()
 		op.NumFetched++
 		op.SizeFetched += size
-	}); err != nil {
+	})
+	if sw.stop() && err != nil {
+		if pm.handleStall(ctx, op) {
+			op.SetStatus(types.PinningStatusQueued)
+			return pm.StatusChangeFunc(op.ContId, op.Location, types.PinningStatusQueued)
+		}
+		err = errors.Wrap(ErrStalled, err.Error())
+	}
+	if op.isCancelled() {
+		return ErrCancelled
+	}
+	if err != nil {
 		op.fail(err)
 		if err2 := pm.StatusChangeFunc(op.ContId, op.Location, types.PinningStatusFailed); err2 != nil {
 			return err2
@@ -252,37 +867,123 @@ func (pm *PinManager) enqueuePinOp(po *PinningOperation) {
 	pm.pinQueue[u] = append(q, po)
 }
 
-func (pm *PinManager) Run(workers int) {
-	for i := 0; i < workers; i++ {
-		go pm.pinWorker()
+// SetWorkers changes how many operations are pinned at once, n below one
+// is taken as one. New workers start right away, those over the new count
+// stop once the operation they are on, if any, is done. No workers are
+// started before Run, or once the pin manager is drained or closed.
+func (pm *PinManager) SetWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+
+	pm.workers = n
+	close(pm.workersChanged)
+	pm.workersChanged = make(chan struct{})
+	if !pm.started {
+		return
 	}
+	select {
+	case <-pm.drainCh:
+		return
+	case <-pm.closeCh:
+		return
+	default:
+	}
+
+	for pm.running < pm.workers {
+		pm.running++
+		pm.workerWg.Add(1)
+		go func() {
+			defer pm.workerWg.Done()
+			if pm.shared != nil {
+				pm.sharedPinWorker()
+			} else {
+				pm.pinWorker()
+			}
+		}()
+	}
+}
+
+// retireWorker reports whether there are more workers than wanted, in
+// which case the calling worker is counted out and must stop
+func (pm *PinManager) retireWorker() bool {
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+
+	if pm.running > pm.workers {
+		pm.running--
+		return true
+	}
+	return false
+}
+
+func (pm *PinManager) workersChangedCh() <-chan struct{} {
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+	return pm.workersChanged
+}
+
+func (pm *PinManager) Run(workers int) {
+	pm.pinQueueLk.Lock()
+	pm.started = true
+	pm.pinQueueLk.Unlock()
+	pm.SetWorkers(workers)
 
-	var next *PinningOperation
+	if pm.shared != nil {
+		pm.runShared()
+		return
+	}
 
 	var send chan *PinningOperation
 
-	next = pm.popNextPinOp()
-	if next != nil {
+	pm.pinQueueLk.Lock()
+	pm.next = pm.popNextPinOp()
+	pm.pinQueueLk.Unlock()
+	if pm.next != nil {
 		send = pm.pinQueueOut
 	}
 
+	metricsTicker := time.NewTicker(queueMetricsInterval)
+	defer metricsTicker.Stop()
+
+	drain := pm.drainCh
+	var draining bool
+
 	for {
+		// once draining, operations keep being queued but none are started
+		if draining {
+			send = nil
+		}
+
 		select {
+		case <-pm.closeCh:
+			return
+		case <-drain:
+			drain = nil
+			draining = true
+		case <-metricsTicker.C:
+			pm.pinQueueLk.Lock()
+			pm.recordQueueMetrics(pm.next)
+			pm.pinQueueLk.Unlock()
 		case op := <-pm.pinQueueIn:
-			if next == nil {
-				next = op
+			pm.pinQueueLk.Lock()
+			delete(pm.pending, op)
+			if pm.next == nil {
+				pm.next = op
 				send = pm.pinQueueOut
 			} else {
-				pm.pinQueueLk.Lock()
 				pm.enqueuePinOp(op)
-				pm.pinQueueLk.Unlock()
 			}
-		case send <- next:
+			pm.pinQueueLk.Unlock()
+		case send <- pm.next:
 			pm.pinQueueLk.Lock()
-			pm.activePins[next.UserId]++
+			pm.activePins[pm.next.UserId]++
 
-			next = pm.popNextPinOp()
-			if next == nil {
+			pm.next = pm.popNextPinOp()
+			if pm.next == nil {
 				send = nil
 			}
 			pm.pinQueueLk.Unlock()
@@ -290,9 +991,9 @@ func (pm *PinManager) Run(workers int) {
 			pm.pinQueueLk.Lock()
 			pm.activePins[op.UserId]--
 
-			if next == nil {
-				next = pm.popNextPinOp()
-				if next != nil {
+			if pm.next == nil {
+				pm.next = pm.popNextPinOp()
+				if pm.next != nil {
 					send = pm.pinQueueOut
 				}
 			}
@@ -303,10 +1004,105 @@ func (pm *PinManager) Run(workers int) {
 }
 
 func (pm *PinManager) pinWorker() {
-	for op := range pm.pinQueueOut {
+	for {
+		if pm.retireWorker() {
+			return
+		}
+
+		var op *PinningOperation
+		select {
+		case op = <-pm.pinQueueOut:
+		case <-pm.workersChangedCh():
+			continue
+		case <-pm.closeCh:
+			return
+		}
+
 		if err := pm.doPinning(op); err != nil {
-			log.Errorf("pinning queue error: %+v", err)
+			log.Errorw("pinning queue error", "content", op.ContId, "requestId", op.RequestID, "err", err)
 		}
-		pm.pinComplete <- op
+		recordTimeToPin(op)
+		select {
+		case pm.pinComplete <- op:
+		case <-pm.closeCh:
+		}
+		pm.guard.release(op)
+
+		if op.takeRestart() {
+			pm.Add(op)
+		} else if pm.store != nil {
+			pm.store.done(op)
+		}
+	}
+}
+
+func recordQueueWait(op *PinningOperation) {
+	if op.queuedAt.IsZero() {
+		return
+	}
+
+	ctx, _ := tag.New(context.Background(), tag.Upsert(metrics.Priority, op.Priority()))
+	stats.Record(ctx, metrics.PinQueueWait.M(time.Since(op.queuedAt).Seconds()))
+}
+
+func recordTimeToPin(op *PinningOperation) {
+	if op.queuedAt.IsZero() {
+		return
+	}
+
+	op.lk.Lock()
+	status := op.Status
+	op.lk.Unlock()
+
+	ctx, _ := tag.New(context.Background(),
+		tag.Upsert(metrics.Priority, op.Priority()),
+		tag.Upsert(metrics.PinStatus, string(status)),
+	)
+	stats.Record(ctx, metrics.PinTimeToPin.M(time.Since(op.queuedAt).Seconds()))
+}
+
+// recordQueueMetrics samples the length of the queue and the age of the
+// oldest waiting operation for each priority class. next is the operation
+// the run loop is currently trying to dispatch, which is no longer in
+// pinQueue but is still waiting. Must be called with pinQueueLk held.
+func (pm *PinManager) recordQueueMetrics(next *PinningOperation) {
+	now := time.Now()
+	length := map[string]int64{PriorityHigh: 0, PriorityNormal: 0}
+	oldest := map[string]time.Time{}
+
+	observe := func(op *PinningOperation) {
+		p := op.Priority()
+		length[p]++
+		if op.queuedAt.IsZero() {
+			return
+		}
+		if o, ok := oldest[p]; !ok || op.queuedAt.Before(o) {
+			oldest[p] = op.queuedAt
+		}
+	}
+
+	for _, pq := range pm.pinQueue {
+		for _, op := range pq {
+			observe(op)
+		}
+	}
+	if next != nil {
+		observe(next)
+	}
+
+	var active int64
+	for _, n := range pm.activePins {
+		active += int64(n)
+	}
+	stats.Record(context.Background(), metrics.PinActiveWorker.M(active))
+
+	for p, l := range length {
+		var age float64
+		if o, ok := oldest[p]; ok {
+			age = now.Sub(o).Seconds()
+		}
+
+		ctx, _ := tag.New(context.Background(), tag.Upsert(metrics.Priority, p))
+		stats.Record(ctx, metrics.PinQueueLength.M(l), metrics.PinBacklogAge.M(age))
 	}
 }
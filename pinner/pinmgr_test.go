@@ -0,0 +1,91 @@
+package pinner
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPinManagerCancelBoost(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	pm := NewPinManager(nil, nil, nil)
+	urgent := testOp(4, 3)
+	urgent.SkipLimiter = true
+	ops := []*PinningOperation{testOp(1, 1), testOp(2, 1), testOp(3, 2), urgent}
+	for _, op := range ops {
+		assert.True(pm.guard.add(op))
+		pm.enqueuePinOp(op)
+	}
+
+	ok, err := pm.Cancel(ctx, 2)
+	assert.NoError(err)
+	assert.True(ok)
+	assert.True(ops[1].isCancelled())
+	assert.Equal(3, pm.PinQueueSize())
+	// the cancelled operation can be queued again
+	assert.True(pm.guard.add(testOp(2, 1)))
+
+	ok, err = pm.Boost(ctx, 3)
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(PriorityHigh, ops[2].Priority())
+	assert.Equal(uint(3), pm.popNextPinOp().ContId, "boosted operations go first")
+	assert.Equal(uint(4), pm.popNextPinOp().ContId, "even before those queued to skip the limiter")
+	assert.Equal(uint(1), pm.popNextPinOp().ContId)
+
+	ok, err = pm.Cancel(ctx, 3)
+	assert.NoError(err)
+	assert.False(ok, "operations no longer queued aren't found")
+}
+
+func TestPinManagerSetWorkers(t *testing.T) {
+	assert := assert.New(t)
+
+	var active, most int32
+	release := make(chan struct{})
+	pinfunc := func(ctx context.Context, op *PinningOperation, cb PinProgressCB) error {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&active, -1)
+		return nil
+	}
+	statusfunc := func(contID uint, location string, status types.PinningStatus) error {
+		return nil
+	}
+
+	pm := NewPinManager(pinfunc, statusfunc, &PinManagerOpts{MaxActivePerUser: 10})
+	go pm.Run(1)
+	defer pm.Close() //nolint:errcheck
+
+	for i := uint(1); i <= 4; i++ {
+		pm.Add(testOp(i, 1))
+	}
+	assert.Eventually(func() bool { return atomic.LoadInt32(&active) == 1 }, time.Second, time.Millisecond*10)
+	time.Sleep(time.Millisecond * 50)
+	assert.Equal(int32(1), atomic.LoadInt32(&most))
+
+	pm.SetWorkers(3)
+	assert.Eventually(func() bool { return atomic.LoadInt32(&active) == 3 }, time.Second, time.Millisecond*10)
+
+	// the extra workers stop once they are done, one is left
+	pm.SetWorkers(1)
+	close(release)
+	assert.Eventually(func() bool { return pm.ActivePins() == 0 && pm.PinQueueSize() == 0 }, time.Second*5, time.Millisecond*10)
+	assert.Eventually(func() bool {
+		pm.pinQueueLk.Lock()
+		defer pm.pinQueueLk.Unlock()
+		return pm.running == 1
+	}, time.Second, time.Millisecond*10)
+}
@@ -0,0 +1,53 @@
+package pinner
+
+import "sync"
+
+// PrefetchProgress counts the progress of a pin whose DAG may be fetched
+// ahead of its walk, by a fetch that can stop partway. The walk comes across
+// the blocks the prefetch stored again, so the callback for it leaves out as
+// many bytes as the prefetch counted, to count each block once.
+type PrefetchProgress struct {
+	cb PinProgressCB
+
+	lk         sync.Mutex
+	prefetched int64
+}
+
+func NewPrefetchProgress(cb PinProgressCB) *PrefetchProgress {
+	return &PrefetchProgress{cb: cb}
+}
+
+// Prefetched is the progress callback for the prefetch
+func (p *PrefetchProgress) Prefetched(n int64) {
+	p.lk.Lock()
+	p.prefetched += n
+	p.lk.Unlock()
+	p.cb(n)
+}
+
+// Walk returns the progress callback for the walk that follows the
+// prefetch. complete is whether the prefetch got the whole DAG, the walk
+// then has nothing left to count.
+func (p *PrefetchProgress) Walk(complete bool) PinProgressCB {
+	if complete {
+		return func(int64) {}
+	}
+
+	p.lk.Lock()
+	skip := p.prefetched
+	p.lk.Unlock()
+
+	var lk sync.Mutex
+	return func(n int64) {
+		lk.Lock()
+		if skip >= n {
+			skip -= n
+			lk.Unlock()
+			return
+		}
+		n -= skip
+		skip = 0
+		lk.Unlock()
+		p.cb(n)
+	}
+}
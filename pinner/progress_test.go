@@ -0,0 +1,31 @@
+package pinner
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefetchProgress(t *testing.T) {
+	var total int64
+	p := NewPrefetchProgress(func(n int64) {
+		total += n
+	})
+
+	// the prefetch stops after two of the four blocks of the DAG
+	p.Prefetched(10)
+	p.Prefetched(20)
+	assert.Equal(t, int64(30), total)
+
+	// the walk comes across all four, in any order
+	walk := p.Walk(false)
+	for _, n := range []int64{40, 10, 20, 5} {
+		walk(n)
+	}
+	assert.Equal(t, int64(75), total)
+
+	// nothing is counted twice when the prefetch got everything
+	walk = p.Walk(true)
+	walk(10)
+	assert.Equal(t, int64(75), total)
+}
@@ -0,0 +1,76 @@
+package pinner
+
+import (
+	"context"
+	"time"
+
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/pkg/errors"
+)
+
+// ErrNoProviders is what an operation without origins fails with when
+// nobody could be found to fetch its root from
+var ErrNoProviders = errors.New("no providers found for the content")
+
+// FailureNoProviders is the failure reason shown in the status of
+// operations that failed with ErrNoProviders
+const FailureNoProviders = "no_providers"
+
+// ProviderFunc reports whether providers can be found for the root of an
+// operation. It should give up and return false once ctx is done.
+type ProviderFunc func(ctx context.Context, op *PinningOperation) (bool, error)
+
+const (
+	defaultProviderTimeout = time.Second * 30
+	// maxProviderChecks bounds the lookups running at once, they are cheap
+	// next to a pin but a burst of pins shouldn't flood the dht
+	maxProviderChecks = 16
+)
+
+// checkProviders looks up the providers of an operation that came without
+// origins, it returns false only if the lookup positively found nobody
+func (pm *PinManager) checkProviders(op *PinningOperation) bool {
+	pm.providerChecks <- struct{}{}
+	defer func() {
+		<-pm.providerChecks
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), pm.providerTimeout)
+	defer cancel()
+
+	found, err := pm.ProviderFunc(ctx, op)
+	if err != nil {
+		// a failed lookup says nothing about the content, let the pin try
+		log.Warnw("failed to look up providers", "content", op.ContId, "cid", op.Obj, "err", err)
+		return true
+	}
+	return found
+}
+
+func (pm *PinManager) failNoProviders(op *PinningOperation) {
+	log.Infow("no providers found, failing pin", "content", op.ContId, "cid", op.Obj, "requestId", op.RequestID)
+	op.fail(ErrNoProviders)
+	op.SetFailure(FailureNoProviders)
+	pm.donePending(op)
+	pm.guard.release(op)
+	if pm.store != nil {
+		pm.store.done(op)
+	}
+	if err := pm.StatusChangeFunc(op.ContId, op.Location, types.PinningStatusFailed); err != nil {
+		log.Errorf("failed to update status of pin without providers: %s", err)
+	}
+}
+
+// Failure returns what the operation failed with, and the reason set for it
+func (po *PinningOperation) Failure() (string, error) {
+	po.lk.Lock()
+	defer po.lk.Unlock()
+	return po.failure, po.FetchErr
+}
+
+// SetFailure records why the operation failed, to be shown in its status
+func (po *PinningOperation) SetFailure(reason string) {
+	po.lk.Lock()
+	defer po.lk.Unlock()
+	po.failure = reason
+}
@@ -0,0 +1,117 @@
+package pinner
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProviderCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	pinned := make(chan uint, 10)
+	statuses := make(chan types.PinningStatus, 10)
+	pm := NewPinManager(func(ctx context.Context, op *PinningOperation, cb PinProgressCB) error {
+		pinned <- op.ContId
+		return nil
+	}, func(contID uint, location string, status types.PinningStatus) error {
+		if status == types.PinningStatusFailed {
+			statuses <- status
+		}
+		return nil
+	}, &PinManagerOpts{MaxActivePerUser: 5})
+
+	var checked []uint
+	pm.ProviderFunc = func(ctx context.Context, op *PinningOperation) (bool, error) {
+		checked = append(checked, op.ContId)
+		switch op.ContId {
+		case 1:
+			return true, nil
+		case 2:
+			return false, errors.New("lookup failed")
+		default:
+			return false, nil
+		}
+	}
+	go pm.Run(1)
+
+	wait := func() uint {
+		select {
+		case id := <-pinned:
+			return id
+		case <-time.After(time.Second * 5):
+			t.Fatal("pin was never run")
+			return 0
+		}
+	}
+
+	pm.Add(testOp(1, 1))
+	assert.Equal(uint(1), wait())
+
+	// a failed lookup doesn't fail the pin
+	pm.Add(testOp(2, 1))
+	assert.Equal(uint(2), wait())
+
+	op := testOp(3, 1)
+	pm.Add(op)
+	select {
+	case <-statuses:
+	case <-time.After(time.Second * 5):
+		t.Fatal("pin without providers was not failed")
+	}
+	assert.ErrorIs(op.FetchErr, ErrNoProviders)
+	assert.Equal(FailureNoProviders, op.PinStatus().Info["failure"])
+
+	// operations with origins go straight to the queue
+	op = testOp(4, 1)
+	op.Peers = []*peer.AddrInfo{{ID: peer.ID("origin")}}
+	pm.Add(op)
+	assert.Equal(uint(4), wait())
+	assert.Equal([]uint{1, 2, 3}, checked)
+}
+
+func TestProviderCheckPending(t *testing.T) {
+	assert := assert.New(t)
+
+	pinned := make(chan uint, 10)
+	pm := NewPinManager(func(ctx context.Context, op *PinningOperation, cb PinProgressCB) error {
+		pinned <- op.ContId
+		return nil
+	}, func(contID uint, location string, status types.PinningStatus) error {
+		return nil
+	}, &PinManagerOpts{MaxActivePerUser: 5})
+
+	release := make(chan struct{})
+	pm.ProviderFunc = func(ctx context.Context, op *PinningOperation) (bool, error) {
+		<-release
+		return true, nil
+	}
+	go pm.Run(1)
+
+	pm.Add(testOp(1, 7))
+
+	// the operation counts as queued while its providers are looked up
+	snap := pm.Snapshot()
+	assert.Equal(1, snap.QueueSize)
+	assert.Equal(1, snap.Pending)
+	assert.Equal(1, snap.QueuedByUser[7])
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	assert.Error(pm.Drain(ctx))
+
+	close(release)
+	assert.NoError(pm.Drain(context.Background()))
+	assert.Equal(0, pm.Snapshot().Pending)
+	assert.Equal(1, pm.Snapshot().QueueSize)
+	select {
+	case <-pinned:
+		t.Fatal("pin started while draining")
+	default:
+	}
+}
@@ -0,0 +1,460 @@
+package pinner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/ipfs/go-cid"
+)
+
+// QueueStore keeps the in memory pin queue on disk so a restarted node can
+// pick up where it left off. Operations being queued and finished are
+// appended to a journal, and every so often the operations still
+// outstanding are written out as one snapshot and the journal is started
+// over, so loading the queue back is reading one snapshot and a short
+// journal, however long the node has been running.
+type QueueStore struct {
+	dir string
+
+	lk      sync.Mutex
+	live    map[uint]*PinningOperation
+	journal *os.File
+	jw      *bufio.Writer
+	// records is the number of records in the journal, a snapshot is only
+	// worth writing if there are any
+	records int
+	// stored holds what was on disk when the store was opened, until Load
+	// hands it out
+	stored map[uint]*PinningOperation
+	found  bool
+}
+
+const (
+	snapshotFile = "queue.snapshot"
+	journalFile  = "queue.journal"
+
+	recordAdd  byte = 1
+	recordDone byte = 2
+)
+
+var snapshotMagic = []byte("estuary-pinqueue-1\n")
+
+// OpenQueueStore opens the queue kept in dir, creating it if needed. What was
+// stored is read into memory and the store starts over empty, so operations
+// are journaled from the start and the old queue is only queued again if Load
+// is called. An unreadable snapshot is dropped, the queue is then rebuilt
+// some other way.
+func OpenQueueStore(dir string) (*QueueStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	qs := &QueueStore{
+		dir:    dir,
+		live:   make(map[uint]*PinningOperation),
+		stored: make(map[uint]*PinningOperation),
+	}
+	found, err := qs.read()
+	if err != nil {
+		log.Errorf("dropping unreadable pin queue: %s", err)
+		qs.stored = make(map[uint]*PinningOperation)
+		found = false
+	}
+	qs.found = found
+
+	if err := qs.snapshotLocked(); err != nil {
+		return nil, err
+	}
+	return qs, nil
+}
+
+func (qs *QueueStore) read() (found bool, err error) {
+	snap, err := os.Open(filepath.Join(qs.dir, snapshotFile))
+	switch {
+	case err == nil:
+		found = true
+		err = readSnapshot(snap, qs.stored)
+		snap.Close() //nolint:errcheck
+		if err != nil {
+			return false, fmt.Errorf("reading pin queue snapshot: %w", err)
+		}
+	case !os.IsNotExist(err):
+		return false, err
+	}
+
+	jf, err := os.Open(filepath.Join(qs.dir, journalFile))
+	switch {
+	case err == nil:
+		found = true
+		n, err := replayJournal(jf, qs.stored)
+		jf.Close() //nolint:errcheck
+		if err != nil {
+			// a torn record at the end is what a crash mid write leaves,
+			// everything before it is still good
+			log.Warnf("pin queue journal ends early after %d records: %s", n, err)
+		}
+	case !os.IsNotExist(err):
+		return false, err
+	}
+	return found, nil
+}
+
+// Load returns the operations that were outstanding when the store was
+// opened, oldest first, and keeps them in the store again. found is false if
+// there was nothing stored, eg. on the first start, in which case the queue
+// has to be rebuilt some other way. Only the first call returns anything.
+func (qs *QueueStore) Load() (ops []*PinningOperation, found bool, err error) {
+	qs.lk.Lock()
+	defer qs.lk.Unlock()
+
+	found = qs.found
+	for _, op := range qs.stored {
+		qs.live[op.ContId] = op
+		ops = append(ops, op)
+	}
+	qs.stored = nil
+	qs.found = false
+
+	if len(ops) > 0 {
+		if err := qs.snapshotLocked(); err != nil {
+			return nil, false, err
+		}
+	}
+
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].queuedAt.Before(ops[j].queuedAt)
+	})
+	return ops, found, nil
+}
+
+func (qs *QueueStore) added(op *PinningOperation) {
+	qs.lk.Lock()
+	defer qs.lk.Unlock()
+
+	qs.live[op.ContId] = op
+	rec, err := encodeOp(op)
+	if err != nil {
+		log.Errorf("failed to encode pin %d for the queue journal: %s", op.ContId, err)
+		return
+	}
+	qs.appendLocked(recordAdd, rec)
+}
+
+func (qs *QueueStore) done(op *PinningOperation) {
+	qs.lk.Lock()
+	defer qs.lk.Unlock()
+
+	if _, ok := qs.live[op.ContId]; !ok {
+		return
+	}
+	delete(qs.live, op.ContId)
+	qs.appendLocked(recordDone, appendUvarint(nil, uint64(op.ContId)))
+}
+
+func (qs *QueueStore) appendLocked(kind byte, rec []byte) {
+	if qs.jw == nil {
+		return
+	}
+
+	buf := []byte{kind}
+	buf = appendBytes(buf, rec)
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(buf))
+	buf = append(buf, sum[:]...)
+	if _, err := qs.jw.Write(buf); err != nil {
+		log.Errorf("failed to write pin queue journal: %s", err)
+		return
+	}
+	// flushed to the os on every record so the journal survives the process
+	// dying, it is only synced to disk with the snapshots
+	if err := qs.jw.Flush(); err != nil {
+		log.Errorf("failed to write pin queue journal: %s", err)
+	}
+	qs.records++
+}
+
+// Snapshot writes the outstanding operations out and starts a new journal
+func (qs *QueueStore) Snapshot() error {
+	qs.lk.Lock()
+	defer qs.lk.Unlock()
+
+	if qs.records == 0 && qs.jw != nil {
+		return nil
+	}
+	return qs.snapshotLocked()
+}
+
+func (qs *QueueStore) snapshotLocked() error {
+	tmp := filepath.Join(qs.dir, snapshotFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	if err := writeSnapshot(w, qs.live); err != nil {
+		f.Close() //nolint:errcheck
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close() //nolint:errcheck
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close() //nolint:errcheck
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(qs.dir, snapshotFile)); err != nil {
+		return err
+	}
+
+	// everything in the journal is in the snapshot now
+	if qs.journal != nil {
+		qs.journal.Close() //nolint:errcheck
+	}
+	jf, err := os.Create(filepath.Join(qs.dir, journalFile))
+	if err != nil {
+		qs.journal, qs.jw = nil, nil
+		return err
+	}
+	qs.journal = jf
+	qs.jw = bufio.NewWriter(jf)
+	qs.records = 0
+	return nil
+}
+
+// Run snapshots the queue every interval until ctx is cancelled, and once
+// more on the way out
+func (qs *QueueStore) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := qs.Snapshot(); err != nil {
+				log.Errorf("failed to snapshot pin queue: %s", err)
+			}
+		case <-ctx.Done():
+			if err := qs.Close(); err != nil {
+				log.Errorf("failed to snapshot pin queue: %s", err)
+			}
+			return
+		}
+	}
+}
+
+// Close writes a final snapshot
+func (qs *QueueStore) Close() error {
+	qs.lk.Lock()
+	defer qs.lk.Unlock()
+
+	err := qs.snapshotLocked()
+	if qs.journal != nil {
+		qs.journal.Close() //nolint:errcheck
+		qs.journal, qs.jw = nil, nil
+	}
+	return err
+}
+
+// Len is the number of outstanding operations
+func (qs *QueueStore) Len() int {
+	qs.lk.Lock()
+	defer qs.lk.Unlock()
+	return len(qs.live)
+}
+
+func writeSnapshot(w io.Writer, live map[uint]*PinningOperation) error {
+	buf := append([]byte{}, snapshotMagic...)
+	buf = appendUvarint(buf, uint64(len(live)))
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+
+	for _, op := range live {
+		rec, err := encodeOp(op)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(appendBytes(nil, rec)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSnapshot(f io.Reader, live map[uint]*PinningOperation) error {
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if len(data) < len(snapshotMagic) || string(data[:len(snapshotMagic)]) != string(snapshotMagic) {
+		return errors.New("not a pin queue snapshot")
+	}
+
+	r := &byteReader{buf: data[len(snapshotMagic):]}
+	n := r.uvarint()
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		rec := r.bytes()
+		if r.err != nil {
+			break
+		}
+		op, err := decodeOp(rec)
+		if err != nil {
+			return err
+		}
+		live[op.ContId] = op
+	}
+	return r.err
+}
+
+func replayJournal(f io.Reader, live map[uint]*PinningOperation) (int, error) {
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for len(data) > 0 {
+		r := &byteReader{buf: data[1:]}
+		rec := r.bytes()
+		if r.err != nil || len(r.buf) < 4 {
+			return n, errTruncated
+		}
+		end := len(data) - len(r.buf)
+		if crc32.ChecksumIEEE(data[:end]) != binary.BigEndian.Uint32(r.buf) {
+			return n, errors.New("journal record checksum mismatch")
+		}
+
+		switch data[0] {
+		case recordAdd:
+			op, err := decodeOp(rec)
+			if err != nil {
+				return n, err
+			}
+			live[op.ContId] = op
+		case recordDone:
+			rr := &byteReader{buf: rec}
+			id := rr.uvarint()
+			if rr.err != nil {
+				return n, rr.err
+			}
+			delete(live, uint(id))
+		default:
+			return n, fmt.Errorf("unknown journal record %d", data[0])
+		}
+
+		data = r.buf[4:]
+		n++
+	}
+	return n, nil
+}
+
+const (
+	opSkipLimiter = 1 << iota
+	opMakeDeal
+)
+
+// encodeOp packs the parts of an operation needed to queue it again
+func encodeOp(op *PinningOperation) ([]byte, error) {
+	op.lk.Lock()
+	defer op.lk.Unlock()
+
+	packed, err := packFields(EncodingSnappy, packedFields{
+		Peers:      op.Peers,
+		SourceURLs: op.SourceURLs,
+		Meta:       op.Meta,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var flags uint64
+	if op.SkipLimiter {
+		flags |= opSkipLimiter
+	}
+	if op.MakeDeal {
+		flags |= opMakeDeal
+	}
+
+	buf := appendUvarint(nil, uint64(op.ContId))
+	buf = appendUvarint(buf, uint64(op.UserId))
+	buf = appendUvarint(buf, uint64(op.Replace))
+	buf = appendUvarint(buf, flags)
+	buf = appendBytes(buf, op.Obj.Bytes())
+	buf = appendBytes(buf, []byte(op.Name))
+	buf = appendBytes(buf, []byte(op.Location))
+	buf = appendBytes(buf, []byte(op.RequestID))
+	buf = appendUvarint(buf, unixNano(op.queuedAt))
+	buf = appendUvarint(buf, unixNano(op.Started))
+	buf = appendBytes(buf, packed)
+	return buf, nil
+}
+
+func decodeOp(rec []byte) (*PinningOperation, error) {
+	r := &byteReader{buf: rec}
+	op := &PinningOperation{
+		ContId:  uint(r.uvarint()),
+		UserId:  uint(r.uvarint()),
+		Replace: uint(r.uvarint()),
+	}
+	flags := r.uvarint()
+	obj := r.bytes()
+	op.Name = string(r.bytes())
+	op.Location = string(r.bytes())
+	op.RequestID = string(r.bytes())
+	queuedAt := r.uvarint()
+	started := r.uvarint()
+	packed := r.bytes()
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	c, err := cid.Cast(obj)
+	if err != nil {
+		return nil, fmt.Errorf("pin %d has an invalid cid: %w", op.ContId, err)
+	}
+	f, err := unpackFields(packed)
+	if err != nil {
+		return nil, fmt.Errorf("pin %d has invalid packed fields: %w", op.ContId, err)
+	}
+
+	op.Obj = c
+	op.Peers = f.Peers
+	op.SourceURLs = f.SourceURLs
+	op.Meta = f.Meta
+	op.SkipLimiter = flags&opSkipLimiter != 0
+	op.MakeDeal = flags&opMakeDeal != 0
+	op.queuedAt = fromUnixNano(queuedAt)
+	op.Started = fromUnixNano(started)
+	op.Status = types.PinningStatusQueued
+	return op, nil
+}
+
+// unixNano keeps the zero time as zero, it has no unix time of its own
+func unixNano(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
+
+func fromUnixNano(v uint64) time.Time {
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(v))
+}
@@ -0,0 +1,166 @@
+package pinner
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestStore(t *testing.T, dir string) (*QueueStore, []*PinningOperation, bool) {
+	qs, err := OpenQueueStore(dir)
+	require.NoError(t, err)
+	ops, found, err := qs.Load()
+	require.NoError(t, err)
+	return qs, ops, found
+}
+
+func TestQueueStoreRestore(t *testing.T) {
+	dir := t.TempDir()
+
+	qs, ops, found := openTestStore(t, dir)
+	assert.False(t, found)
+	assert.Empty(t, ops)
+
+	ma, err := multiaddr.NewMultiaddr("/ip4/1.2.3.4/tcp/4001")
+	require.NoError(t, err)
+	pid, err := peer.Decode("12D3KooWGzxzKZYveHXtpG6AsrUJBcWxHBFS2HsEoGTxrMLvKXtf")
+	require.NoError(t, err)
+
+	first := testOp(1, 1)
+	first.Peers = []*peer.AddrInfo{{ID: pid, Addrs: []multiaddr.Multiaddr{ma}}}
+	first.Meta = `{"transport":"bitswap"}`
+	first.MakeDeal = true
+	first.queuedAt = time.Now().Add(-time.Minute)
+	qs.added(first)
+
+	second := testOp(2, 1)
+	second.SkipLimiter = true
+	second.Location = "SHUTTLE1"
+	second.queuedAt = time.Now()
+	qs.added(second)
+
+	qs.added(testOp(3, 2))
+	qs.done(testOp(3, 2))
+
+	// restoring replays the journal on top of the snapshot written by Load
+	_, ops, found = openTestStore(t, dir)
+	assert.True(t, found)
+	require.Len(t, ops, 2)
+
+	assert.Equal(t, uint(1), ops[0].ContId)
+	assert.Equal(t, first.Obj, ops[0].Obj)
+	assert.Equal(t, first.Meta, ops[0].Meta)
+	assert.True(t, ops[0].MakeDeal)
+	require.Len(t, ops[0].Peers, 1)
+	assert.Equal(t, pid, ops[0].Peers[0].ID)
+	assert.True(t, ops[0].Peers[0].Addrs[0].Equal(ma))
+	assert.True(t, first.queuedAt.Equal(ops[0].queuedAt))
+
+	assert.Equal(t, uint(2), ops[1].ContId)
+	assert.True(t, ops[1].SkipLimiter)
+	assert.Equal(t, "SHUTTLE1", ops[1].Location)
+	assert.True(t, ops[1].Started.IsZero())
+}
+
+func TestQueueStoreSnapshotTruncatesJournal(t *testing.T) {
+	dir := t.TempDir()
+	qs, _, _ := openTestStore(t, dir)
+
+	for i := uint(1); i <= 100; i++ {
+		qs.added(testOp(i, 1))
+	}
+	for i := uint(1); i <= 90; i++ {
+		qs.done(testOp(i, 1))
+	}
+
+	st, err := os.Stat(filepath.Join(dir, journalFile))
+	require.NoError(t, err)
+	assert.True(t, st.Size() > 0)
+
+	require.NoError(t, qs.Snapshot())
+	st, err = os.Stat(filepath.Join(dir, journalFile))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), st.Size())
+
+	qs.added(testOp(101, 1))
+
+	_, ops, _ := openTestStore(t, dir)
+	assert.Len(t, ops, 11)
+}
+
+func TestQueueStoreTornJournal(t *testing.T) {
+	dir := t.TempDir()
+	qs, _, _ := openTestStore(t, dir)
+	qs.added(testOp(1, 1))
+	qs.added(testOp(2, 1))
+
+	// cut the last record short, as a crash in the middle of writing would
+	jp := filepath.Join(dir, journalFile)
+	data, err := os.ReadFile(jp)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(jp, data[:len(data)-3], 0644))
+
+	_, ops, found := openTestStore(t, dir)
+	assert.True(t, found)
+	require.Len(t, ops, 1)
+	assert.Equal(t, uint(1), ops[0].ContId)
+}
+
+func TestQueueStoreNotRestored(t *testing.T) {
+	dir := t.TempDir()
+	qs, _, _ := openTestStore(t, dir)
+	qs.added(testOp(1, 1))
+
+	// the node starts without reloading its queue, what it queues from then
+	// on is still kept, the old queue is not
+	qs, err := OpenQueueStore(dir)
+	require.NoError(t, err)
+	qs.added(testOp(2, 1))
+
+	_, ops, found := openTestStore(t, dir)
+	assert.True(t, found)
+	require.Len(t, ops, 1)
+	assert.Equal(t, uint(2), ops[0].ContId)
+}
+
+func TestPinManagerRestore(t *testing.T) {
+	dir := t.TempDir()
+	qs, _, _ := openTestStore(t, dir)
+	qs.added(testOp(1, 1))
+	qs.added(testOp(2, 2))
+
+	store, err := OpenQueueStore(dir)
+	require.NoError(t, err)
+
+	pinned := make(chan uint, 2)
+	pm := NewPinManager(func(ctx context.Context, op *PinningOperation, cb PinProgressCB) error {
+		pinned <- op.ContId
+		return nil
+	}, nil, &PinManagerOpts{MaxActivePerUser: 5, Store: store})
+
+	ops, found, err := pm.Restore()
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Len(t, ops, 2)
+
+	go pm.Run(2)
+	got := map[uint]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case id := <-pinned:
+			got[id] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("restored operations were not run")
+		}
+	}
+	assert.True(t, got[1] && got[2])
+
+	assert.Eventually(t, func() bool { return store.Len() == 0 }, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,503 @@
+package pinner
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/application-research/estuary/metrics"
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/ipfs/go-cid"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// sharedQueueEntry is a queued pinning operation in the shared queue table.
+// An entry is claimed by setting ClaimedBy and ClaimToken, the claim is held
+// for as long as the owner keeps pushing LeaseUntil forward, and the entry is
+// deleted once the operation finishes. Entries whose lease ran out (because
+// the node that claimed them went away) are claimed again by another node.
+// Peers, SourceURLs and Meta are empty when the entry was packed into Packed.
+type sharedQueueEntry struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	Queue  string `gorm:"uniqueIndex:idx_pin_queue_entries_cont"`
+	ContID uint   `gorm:"uniqueIndex:idx_pin_queue_entries_cont"`
+	UserID uint   `gorm:"index"`
+
+	Cid         string
+	Name        string
+	Peers       string
+	SourceURLs  string
+	Meta        string
+	Packed      []byte
+	Replace     uint
+	Location    string
+	MakeDeal    bool
+	SkipLimiter bool
+	BoostedAt   time.Time
+	Started     time.Time
+	RequestID   string
+
+	ClaimedBy  string `gorm:"index"`
+	ClaimToken string
+	LeaseUntil time.Time
+}
+
+func (sharedQueueEntry) TableName() string {
+	return "pin_queue_entries"
+}
+
+// SharedQueue keeps pinning operations in a database table rather than in
+// memory, so that several nodes pointed at the same database consume from one
+// logical queue. Each operation is handed to exactly one node at a time,
+// claims are made with row locks (SKIP LOCKED on postgres) so concurrent
+// workers never block on or double claim the same entry.
+type SharedQueue struct {
+	db       *gorm.DB
+	name     string
+	owner    string
+	lease    time.Duration
+	encoding string
+}
+
+// NewSharedQueue returns a queue reading and writing the entries of the named
+// queue in db. Nodes that should consume the same operations must use the
+// same name. Claims not renewed within lease are given to other nodes.
+// Entries are written in encoding, one of the Encoding constants, an empty
+// one meaning json.
+func NewSharedQueue(db *gorm.DB, name string, lease time.Duration, encoding string) (*SharedQueue, error) {
+	if encoding == "" {
+		encoding = EncodingJSON
+	}
+	if !ValidEncoding(encoding) {
+		return nil, fmt.Errorf("unknown pin queue encoding: %q", encoding)
+	}
+
+	if err := db.AutoMigrate(&sharedQueueEntry{}); err != nil {
+		return nil, fmt.Errorf("failed to migrate shared pin queue: %w", err)
+	}
+
+	return &SharedQueue{
+		db:       db,
+		name:     name,
+		owner:    queueOwnerID(),
+		lease:    lease,
+		encoding: encoding,
+	}, nil
+}
+
+// queueOwnerID identifies this process as the holder of a claim, it has to
+// be unique across restarts so a restarted node doesn't renew the claims of
+// its previous run
+func queueOwnerID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), randomToken())
+}
+
+func randomToken() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Push adds op to the queue. Pushing an operation for content that is
+// already queued is a no-op, so refreshing the queue on startup from several
+// nodes does not duplicate work.
+func (q *SharedQueue) Push(ctx context.Context, op *PinningOperation) error {
+	ent := &sharedQueueEntry{
+		Queue:       q.name,
+		ContID:      op.ContId,
+		UserID:      op.UserId,
+		Cid:         op.Obj.String(),
+		Name:        op.Name,
+		Replace:     op.Replace,
+		Location:    op.Location,
+		MakeDeal:    op.MakeDeal,
+		SkipLimiter: op.SkipLimiter,
+		Started:     op.Started,
+		RequestID:   op.RequestID,
+	}
+
+	if q.encoding == EncodingJSON {
+		peers, err := json.Marshal(op.Peers)
+		if err != nil {
+			return err
+		}
+		ent.Peers = string(peers)
+
+		if len(op.SourceURLs) > 0 {
+			sources, err := json.Marshal(op.SourceURLs)
+			if err != nil {
+				return err
+			}
+			ent.SourceURLs = string(sources)
+		}
+		ent.Meta = op.Meta
+	} else {
+		packed, err := packFields(q.encoding, packedFields{
+			Peers:      op.Peers,
+			SourceURLs: op.SourceURLs,
+			Meta:       op.Meta,
+		})
+		if err != nil {
+			return err
+		}
+		ent.Packed = packed
+	}
+
+	return q.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(ent).Error
+}
+
+// Claim takes the next operation off the queue for this node, or returns nil
+// if there is nothing to do. Operations that skip the limiter are handed out
+// first, the most recently boosted of them before the rest, and users with maxActivePerUser operations already in progress
+// across all nodes are skipped over.
+func (q *SharedQueue) Claim(ctx context.Context, maxActivePerUser int) (*PinningOperation, error) {
+	db := q.db.WithContext(ctx)
+	now := time.Now()
+	token := randomToken()
+
+	busy := db.Model(&sharedQueueEntry{}).Select("user_id").
+		Where("queue = ? AND claimed_by != '' AND lease_until >= ?", q.name, now).
+		Group("user_id").
+		Having("COUNT(1) >= ?", maxActivePerUser)
+
+	next := db.Model(&sharedQueueEntry{}).Select("id").
+		Where("queue = ? AND (claimed_by = '' OR lease_until < ?)", q.name, now).
+		Where("skip_limiter OR user_id NOT IN (?)", busy).
+		Order("skip_limiter desc, boosted_at desc, id asc").
+		Limit(1)
+	if db.Dialector.Name() == "postgres" {
+		next = next.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"})
+	}
+
+	res := db.Model(&sharedQueueEntry{}).Where("id = (?)", next).UpdateColumns(map[string]interface{}{
+		"claimed_by":  q.owner,
+		"claim_token": token,
+		"lease_until": now.Add(q.lease),
+	})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	var ent sharedQueueEntry
+	if err := db.First(&ent, "claim_token = ?", token).Error; err != nil {
+		return nil, err
+	}
+	return ent.operation()
+}
+
+func (ent *sharedQueueEntry) operation() (*PinningOperation, error) {
+	obj, err := cid.Decode(ent.Cid)
+	if err != nil {
+		return nil, fmt.Errorf("queue entry %d has invalid cid: %w", ent.ID, err)
+	}
+
+	var f packedFields
+	if len(ent.Packed) > 0 {
+		if f, err = unpackFields(ent.Packed); err != nil {
+			return nil, fmt.Errorf("queue entry %d has invalid packed fields: %w", ent.ID, err)
+		}
+	} else {
+		if ent.Peers != "" {
+			if err := json.Unmarshal([]byte(ent.Peers), &f.Peers); err != nil {
+				return nil, fmt.Errorf("queue entry %d has invalid peers: %w", ent.ID, err)
+			}
+		}
+		if ent.SourceURLs != "" {
+			if err := json.Unmarshal([]byte(ent.SourceURLs), &f.SourceURLs); err != nil {
+				return nil, fmt.Errorf("queue entry %d has invalid source urls: %w", ent.ID, err)
+			}
+		}
+		f.Meta = ent.Meta
+	}
+
+	return &PinningOperation{
+		Obj:         obj,
+		Name:        ent.Name,
+		Peers:       f.Peers,
+		SourceURLs:  f.SourceURLs,
+		Meta:        f.Meta,
+		UserId:      ent.UserID,
+		ContId:      ent.ContID,
+		Replace:     ent.Replace,
+		Location:    ent.Location,
+		MakeDeal:    ent.MakeDeal,
+		SkipLimiter: ent.SkipLimiter,
+		Started:     ent.Started,
+		RequestID:   ent.RequestID,
+		queuedAt:    ent.CreatedAt,
+		sharedID:    ent.ID,
+		claimToken:  ent.ClaimToken,
+	}, nil
+}
+
+// Complete removes a claimed operation from the queue. If the claim was lost
+// in the meantime the entry belongs to another node and is left alone.
+func (q *SharedQueue) Complete(ctx context.Context, op *PinningOperation) error {
+	return q.db.WithContext(ctx).
+		Where("id = ? AND claim_token = ?", op.sharedID, op.claimToken).
+		Delete(&sharedQueueEntry{}).Error
+}
+
+// Renew extends the lease on every operation this node currently holds
+func (q *SharedQueue) Renew(ctx context.Context) error {
+	return q.db.WithContext(ctx).Model(&sharedQueueEntry{}).
+		Where("queue = ? AND claimed_by = ?", q.name, q.owner).
+		UpdateColumn("lease_until", time.Now().Add(q.lease)).Error
+}
+
+// Release hands the operations held by this node back to the queue, except
+// those of the contents in running, it is called when draining the node so
+// the work doesn't wait for the leases to run out
+func (q *SharedQueue) Release(ctx context.Context, running []uint) error {
+	tx := q.db.WithContext(ctx).Model(&sharedQueueEntry{}).
+		Where("queue = ? AND claimed_by = ?", q.name, q.owner)
+	if len(running) > 0 {
+		tx = tx.Where("cont_id NOT IN ?", running)
+	}
+	return tx.UpdateColumns(map[string]interface{}{
+		"claimed_by":  "",
+		"claim_token": "",
+	}).Error
+}
+
+// Remove deletes the operation of content contID if no node holds it, and
+// reports whether it did
+func (q *SharedQueue) Remove(ctx context.Context, contID uint) (bool, error) {
+	res := q.db.WithContext(ctx).
+		Where("queue = ? AND cont_id = ? AND (claimed_by = '' OR lease_until < ?)", q.name, contID, time.Now()).
+		Delete(&sharedQueueEntry{})
+	return res.RowsAffected > 0, res.Error
+}
+
+// Boost has the operation of content contID skip the per user limiter, and
+// be handed out next, if no node holds it yet, and reports whether it did
+func (q *SharedQueue) Boost(ctx context.Context, contID uint) (bool, error) {
+	now := time.Now()
+	res := q.db.WithContext(ctx).Model(&sharedQueueEntry{}).
+		Where("queue = ? AND cont_id = ? AND (claimed_by = '' OR lease_until < ?)", q.name, contID, now).
+		UpdateColumns(map[string]interface{}{
+			"skip_limiter": true,
+			"boosted_at":   now,
+		})
+	return res.RowsAffected > 0, res.Error
+}
+
+// Stats returns the number of unclaimed operations and the age of the oldest
+// of them for each priority class, along with the number of operations
+// waiting for each user
+func (q *SharedQueue) Stats(ctx context.Context) (map[string]int64, map[string]time.Time, map[uint]int, error) {
+	db := q.db.WithContext(ctx)
+	now := time.Now()
+	waiting := db.Model(&sharedQueueEntry{}).
+		Where("queue = ? AND (claimed_by = '' OR lease_until < ?)", q.name, now).
+		Session(&gorm.Session{})
+
+	length := make(map[string]int64)
+	oldest := make(map[string]time.Time)
+	for p, skip := range map[string]bool{PriorityHigh: true, PriorityNormal: false} {
+		var count int64
+		if err := waiting.Where("skip_limiter = ?", skip).Count(&count).Error; err != nil {
+			return nil, nil, nil, err
+		}
+		length[p] = count
+		if count == 0 {
+			continue
+		}
+
+		// ids are handed out in insertion order, the lowest is the oldest
+		var first sharedQueueEntry
+		if err := waiting.Where("skip_limiter = ?", skip).Order("id asc").Limit(1).Find(&first).Error; err != nil {
+			return nil, nil, nil, err
+		}
+		oldest[p] = first.CreatedAt
+	}
+
+	var byUser []struct {
+		UserID uint
+		Count  int
+	}
+	if err := waiting.
+		Select("user_id, COUNT(1) as count").
+		Group("user_id").
+		Scan(&byUser).Error; err != nil {
+		return nil, nil, nil, err
+	}
+
+	users := make(map[uint]int, len(byUser))
+	for _, u := range byUser {
+		users[u.UserID] = u.Count
+	}
+	return length, oldest, users, nil
+}
+
+func (pm *PinManager) addShared(op *PinningOperation) {
+	defer pm.donePending(op)
+	if err := pm.shared.Push(context.TODO(), op); err != nil {
+		log.Errorf("failed to add content %d to shared pin queue: %s", op.ContId, err)
+		op.fail(err)
+		if err := pm.StatusChangeFunc(op.ContId, op.Location, types.PinningStatusFailed); err != nil {
+			log.Errorf("failed to update status of content %d: %s", op.ContId, err)
+		}
+		return
+	}
+	pm.wakeSharedWorker()
+}
+
+// wakeSharedWorker gets one idle worker to check the shared queue now
+// rather than at its next poll
+func (pm *PinManager) wakeSharedWorker() {
+	select {
+	case pm.sharedWake <- struct{}{}:
+	default:
+	}
+}
+
+// runShared returns once the pin manager is drained or closed and all its
+// workers have stopped, which they do once the operations they are on are
+// done. Claims are renewed until then so that nothing still running is
+// claimed by another node.
+func (pm *PinManager) runShared() {
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-pm.drainCh:
+		case <-pm.closeCh:
+		}
+		// no workers are started from then on, once SetWorkers calls that
+		// may be starting some right now are done
+		pm.pinQueueLk.Lock()
+		pm.started = false
+		pm.pinQueueLk.Unlock()
+		pm.workerWg.Wait()
+		close(stopped)
+	}()
+
+	renewTicker := time.NewTicker(pm.shared.lease / 3)
+	defer renewTicker.Stop()
+
+	metricsTicker := time.NewTicker(queueMetricsInterval)
+	defer metricsTicker.Stop()
+
+	for {
+		select {
+		case <-renewTicker.C:
+			if err := pm.shared.Renew(context.TODO()); err != nil {
+				log.Errorf("failed to renew shared pin queue claims: %s", err)
+			}
+		case <-metricsTicker.C:
+			pm.recordSharedQueueMetrics()
+		case <-stopped:
+			return
+		}
+	}
+}
+
+func (pm *PinManager) sharedPinWorker() {
+	for {
+		select {
+		case <-pm.drainCh:
+			return
+		case <-pm.closeCh:
+			return
+		default:
+		}
+		if pm.retireWorker() {
+			return
+		}
+
+		op, err := pm.shared.Claim(context.TODO(), pm.getMaxActivePerUser())
+		if err != nil {
+			log.Errorf("failed to claim from shared pin queue: %s", err)
+		}
+		if op == nil {
+			select {
+			case <-pm.sharedWake:
+			case <-pm.workersChangedCh():
+			case <-time.After(pm.pollInterval):
+			case <-pm.drainCh:
+				return
+			case <-pm.closeCh:
+				return
+			}
+			continue
+		}
+
+		// there may be more work waiting, pass it on to another idle worker
+		pm.wakeSharedWorker()
+
+		pm.pinQueueLk.Lock()
+		pm.activePins[op.UserId]++
+		pm.sharedRunning[op.ContId] = true
+		pm.pinQueueLk.Unlock()
+
+		if err := pm.doPinning(op); err != nil {
+			log.Errorw("pinning queue error", "content", op.ContId, "requestId", op.RequestID, "err", err)
+		}
+		recordTimeToPin(op)
+
+		if err := pm.shared.Complete(context.TODO(), op); err != nil {
+			log.Errorf("failed to remove content %d from shared pin queue: %s", op.ContId, err)
+		}
+
+		pm.pinQueueLk.Lock()
+		pm.activePins[op.UserId]--
+		delete(pm.sharedRunning, op.ContId)
+		pm.pinQueueLk.Unlock()
+
+		// the entry is only pushed again once the old one is gone
+		if op.takeRestart() {
+			pm.Add(op)
+		}
+	}
+}
+
+func (pm *PinManager) recordSharedQueueMetrics() {
+	length, oldest, _, err := pm.shared.Stats(context.TODO())
+	if err != nil {
+		log.Errorf("failed to collect shared pin queue metrics: %s", err)
+		return
+	}
+
+	pm.pinQueueLk.Lock()
+	var active int64
+	for _, n := range pm.activePins {
+		active += int64(n)
+	}
+	pm.pinQueueLk.Unlock()
+	stats.Record(context.Background(), metrics.PinActiveWorker.M(active))
+
+	now := time.Now()
+	for p, l := range length {
+		var age float64
+		if o, ok := oldest[p]; ok {
+			age = now.Sub(o).Seconds()
+		}
+
+		ctx, _ := tag.New(context.Background(), tag.Upsert(metrics.Priority, p))
+		stats.Record(ctx, metrics.PinQueueLength.M(l), metrics.PinBacklogAge.M(age))
+	}
+}
+
+// SharedQueueModel returns the model queue entries are stored as, so node
+// backups can include the queue
+func SharedQueueModel() interface{} {
+	return &sharedQueueEntry{}
+}
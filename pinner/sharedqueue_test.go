@@ -0,0 +1,290 @@
+package pinner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// testDB opens an in memory database for the test, dropped when it ends so
+// repeated runs start empty
+func testDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	require.NoError(t, err)
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	t.Cleanup(func() { sqlDB.Close() })
+	return db
+}
+
+func testQueue(t *testing.T, db *gorm.DB) *SharedQueue {
+	q, err := NewSharedQueue(db, "test", time.Minute, EncodingJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func testOp(contID, userID uint) *PinningOperation {
+	c, _ := cid.Decode("bafkqaaa")
+	return &PinningOperation{Obj: c, ContId: contID, UserId: userID}
+}
+
+func TestSharedQueueClaim(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	db := testDB(t)
+
+	a := testQueue(t, db)
+	b := testQueue(t, db)
+
+	assert.NoError(a.Push(ctx, testOp(1, 1)))
+	assert.NoError(a.Push(ctx, testOp(2, 1)))
+	// queued twice, e.g. by two nodes refreshing the queue on startup
+	assert.NoError(b.Push(ctx, testOp(2, 1)))
+
+	prio := testOp(3, 2)
+	prio.SkipLimiter = true
+	assert.NoError(b.Push(ctx, prio))
+
+	op, err := a.Claim(ctx, 10)
+	require.NoError(t, err)
+	require.NotNil(t, op)
+	assert.Equal(uint(3), op.ContId, "operations skipping the limiter go first")
+
+	op2, err := b.Claim(ctx, 10)
+	require.NoError(t, err)
+	require.NotNil(t, op2)
+	assert.Equal(uint(1), op2.ContId)
+
+	// user 1 is at its limit, so nothing is handed out
+	none, err := a.Claim(ctx, 1)
+	assert.NoError(err)
+	assert.Nil(none)
+
+	op3, err := a.Claim(ctx, 10)
+	require.NoError(t, err)
+	require.NotNil(t, op3)
+	assert.Equal(uint(2), op3.ContId)
+
+	none, err = b.Claim(ctx, 10)
+	assert.NoError(err)
+	assert.Nil(none)
+
+	// completing with a claim that is no longer held leaves the entry alone
+	op.claimToken = "stale"
+	assert.NoError(a.Complete(ctx, op))
+
+	var count int64
+	assert.NoError(db.Model(&sharedQueueEntry{}).Count(&count).Error)
+	assert.Equal(int64(3), count)
+}
+
+func TestSharedQueueExpiredLease(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	db := testDB(t)
+
+	a := testQueue(t, db)
+	b := testQueue(t, db)
+
+	assert.NoError(a.Push(ctx, testOp(1, 1)))
+
+	op, err := a.Claim(ctx, 10)
+	require.NoError(t, err)
+	require.NotNil(t, op)
+
+	// the node holding the claim stops renewing it
+	assert.NoError(db.Model(&sharedQueueEntry{}).Where("id = ?", op.sharedID).
+		UpdateColumn("lease_until", time.Now().Add(-time.Second)).Error)
+
+	again, err := b.Claim(ctx, 10)
+	require.NoError(t, err)
+	require.NotNil(t, again)
+	assert.Equal(op.ContId, again.ContId)
+
+	// the original claim is gone, completing it must not remove the entry
+	assert.NoError(a.Complete(ctx, op))
+	assert.NoError(b.Complete(ctx, again))
+
+	var count int64
+	assert.NoError(db.Model(&sharedQueueEntry{}).Count(&count).Error)
+	assert.Equal(int64(0), count)
+}
+
+func TestSharedQueueRelease(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	db := testDB(t)
+
+	a := testQueue(t, db)
+	b := testQueue(t, db)
+
+	assert.NoError(a.Push(ctx, testOp(1, 1)))
+	assert.NoError(a.Push(ctx, testOp(2, 1)))
+
+	running, err := a.Claim(ctx, 10)
+	require.NoError(t, err)
+	require.NotNil(t, running)
+	claimed, err := a.Claim(ctx, 10)
+	require.NoError(t, err)
+	require.NotNil(t, claimed)
+
+	// the running operation stays with a, only the other one is handed back
+	assert.NoError(a.Release(ctx, []uint{running.ContId}))
+
+	op, err := b.Claim(ctx, 10)
+	require.NoError(t, err)
+	require.NotNil(t, op)
+	assert.Equal(claimed.ContId, op.ContId)
+
+	none, err := b.Claim(ctx, 10)
+	assert.NoError(err)
+	assert.Nil(none)
+}
+
+func TestSharedQueueRemoveBoost(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	db := testDB(t)
+
+	q := testQueue(t, db)
+	assert.NoError(q.Push(ctx, testOp(1, 1)))
+	assert.NoError(q.Push(ctx, testOp(2, 1)))
+	assert.NoError(q.Push(ctx, testOp(3, 1)))
+
+	held, err := q.Claim(ctx, 10)
+	require.NoError(t, err)
+	require.NotNil(t, held)
+	assert.Equal(uint(1), held.ContId)
+	urgent := testOp(4, 1)
+	urgent.SkipLimiter = true
+	assert.NoError(q.Push(ctx, urgent))
+
+	// a claimed operation is left to the node holding it
+	ok, err := q.Remove(ctx, 1)
+	assert.NoError(err)
+	assert.False(ok)
+	ok, err = q.Boost(ctx, 1)
+	assert.NoError(err)
+	assert.False(ok)
+
+	ok, err = q.Boost(ctx, 3)
+	assert.NoError(err)
+	assert.True(ok)
+	ok, err = q.Remove(ctx, 2)
+	assert.NoError(err)
+	assert.True(ok)
+
+	next, err := q.Claim(ctx, 1)
+	require.NoError(t, err)
+	require.NotNil(t, next)
+	assert.Equal(uint(3), next.ContId, "boosted operations skip the limiter, ahead of those queued to skip it")
+	next, err = q.Claim(ctx, 1)
+	require.NoError(t, err)
+	require.NotNil(t, next)
+	assert.Equal(uint(4), next.ContId)
+
+	none, err := q.Claim(ctx, 10)
+	assert.NoError(err)
+	assert.Nil(none)
+}
+
+func TestSharedQueueEncodings(t *testing.T) {
+	ctx := context.Background()
+
+	origin, err := peer.Decode("12D3KooWHdHSKtyWsCGwAJx2aDHKTW5rwNGUZmAGMCnjxEAqGwoR")
+	require.NoError(t, err)
+	op := testOp(1, 1)
+	op.Peers = []*peer.AddrInfo{{
+		ID:    origin,
+		Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/1.2.3.4/tcp/4001"), multiaddr.StringCast("/dns4/example.com/tcp/443/https")},
+	}}
+	op.SourceURLs = []string{"https://shuttle.example.com/gw"}
+	op.Meta = `{"transport":"graphsync"}`
+
+	db := testDB(t)
+
+	for i, enc := range []string{EncodingJSON, EncodingCompact, EncodingSnappy, EncodingZstd} {
+		q, err := NewSharedQueue(db, "test", time.Minute, enc)
+		require.NoError(t, err)
+
+		op.ContId = uint(i + 1)
+		require.NoError(t, q.Push(ctx, op))
+
+		var ent sharedQueueEntry
+		require.NoError(t, db.First(&ent, "cont_id = ?", op.ContId).Error)
+		assert.Equal(t, enc != EncodingJSON, len(ent.Packed) > 0, enc)
+
+		got, err := q.Claim(ctx, 10)
+		require.NoError(t, err)
+		require.NotNil(t, got, enc)
+		assert.Equal(t, op.Peers, got.Peers, enc)
+		assert.Equal(t, op.SourceURLs, got.SourceURLs, enc)
+		assert.Equal(t, op.Meta, got.Meta, enc)
+		require.NoError(t, q.Complete(ctx, got))
+	}
+
+	_, err = NewSharedQueue(db, "test", time.Minute, "gzip")
+	assert.Error(t, err)
+
+	_, err = unpackFields([]byte{packedPlain, 1, 200})
+	assert.Error(t, err, "truncated entries are refused")
+}
+
+func TestSharedRunStops(t *testing.T) {
+	db := testDB(t)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	pinfunc := func(ctx context.Context, op *PinningOperation, cb PinProgressCB) error {
+		close(started)
+		<-release
+		return nil
+	}
+	statusfunc := func(contID uint, location string, status types.PinningStatus) error {
+		return nil
+	}
+
+	pm := NewPinManager(pinfunc, statusfunc, &PinManagerOpts{MaxActivePerUser: 5, SharedQueue: testQueue(t, db)})
+	done := make(chan struct{})
+	go func() {
+		pm.Run(2)
+		close(done)
+	}()
+
+	pm.Add(testOp(1, 1))
+	select {
+	case <-started:
+	case <-time.After(time.Second * 10):
+		t.Fatal("pin never started")
+	}
+
+	// the run keeps going while a worker is still pinning
+	require.NoError(t, pm.Close())
+	select {
+	case <-done:
+		t.Fatal("run returned with a pin still running")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(time.Second * 10):
+		t.Fatal("run never returned")
+	}
+}
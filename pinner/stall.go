@@ -0,0 +1,194 @@
+package pinner
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrStalled is what an operation fails with once it has stalled more times
+// than it is allowed to be restarted
+var ErrStalled = errors.New("no data fetched within the stall timeout")
+
+const (
+	StallActionRestarted    = "restarted"
+	StallActionRedispatched = "redispatched"
+	StallActionFailed       = "failed"
+)
+
+// minStallCheckInterval keeps short stall timeouts from turning the
+// watchdog into a busy loop
+const minStallCheckInterval = time.Millisecond * 100
+
+// Stall is an entry in the history of an operation, recorded every time it
+// was cancelled for not making progress
+type Stall struct {
+	At          time.Time `json:"at"`
+	SizeFetched int64     `json:"sizeFetched"`
+	NumFetched  int       `json:"numFetched"`
+	Action      string    `json:"action"`
+	// Location is where the operation was sent to when it was redispatched
+	Location string `json:"location,omitempty"`
+}
+
+// StallFunc is called when an operation stalls and is going to be retried.
+// It can redispatch the operation elsewhere, eg. to another shuttle, and
+// returns the location it was sent to, or "" to have the operation restarted
+// where it was.
+type StallFunc func(ctx context.Context, op *PinningOperation) (string, error)
+
+// stallWatch cancels an operation that hasn't fetched anything for timeout
+type stallWatch struct {
+	op      *PinningOperation
+	timeout time.Duration
+	cancel  context.CancelFunc
+
+	lk      sync.Mutex
+	stalled bool
+	done    chan struct{}
+}
+
+func watchForStall(op *PinningOperation, timeout time.Duration, cancel context.CancelFunc) *stallWatch {
+	sw := &stallWatch{
+		op:      op,
+		timeout: timeout,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	if timeout > 0 {
+		go sw.run()
+	}
+	return sw
+}
+
+// Progress returns how much the current attempt of the operation has
+// fetched so far
+func (po *PinningOperation) Progress() (int64, int) {
+	po.lk.Lock()
+	defer po.lk.Unlock()
+	return po.SizeFetched, po.NumFetched
+}
+
+func (sw *stallWatch) run() {
+	interval := sw.timeout / 4
+	if interval < minStallCheckInterval {
+		interval = minStallCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastSize, lastNum := sw.op.Progress()
+	lastProgress := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-sw.done:
+			return
+		}
+
+		size, num := sw.op.Progress()
+		if size != lastSize || num != lastNum {
+			lastSize, lastNum = size, num
+			lastProgress = time.Now()
+			continue
+		}
+
+		if time.Since(lastProgress) >= sw.timeout {
+			sw.lk.Lock()
+			sw.stalled = true
+			sw.lk.Unlock()
+			sw.cancel()
+			return
+		}
+	}
+}
+
+// stop ends the watch and reports whether the operation was cancelled for
+// stalling
+func (sw *stallWatch) stop() bool {
+	close(sw.done)
+
+	sw.lk.Lock()
+	defer sw.lk.Unlock()
+	return sw.stalled
+}
+
+// recordStall adds a stall to the history of the operation and resets its
+// progress for the next attempt
+func (po *PinningOperation) recordStall(action, location string) Stall {
+	po.lk.Lock()
+	defer po.lk.Unlock()
+
+	st := Stall{
+		At:          time.Now(),
+		SizeFetched: po.SizeFetched,
+		NumFetched:  po.NumFetched,
+		Action:      action,
+		Location:    location,
+	}
+	po.Stalls = append(po.Stalls, st)
+	po.SizeFetched = 0
+	po.NumFetched = 0
+	po.LastUpdate = st.At
+	return st
+}
+
+// NumStalls is how many times the operation has stalled so far
+func (po *PinningOperation) NumStalls() int {
+	po.lk.Lock()
+	defer po.lk.Unlock()
+	return len(po.Stalls)
+}
+
+// handleStall decides what happens to an operation that stalled, it returns
+// false when the operation is out of restarts and should fail
+func (pm *PinManager) handleStall(ctx context.Context, op *PinningOperation) bool {
+	pm.pinQueueLk.Lock()
+	maxRestarts, dropOrigins := pm.maxStallRestarts, pm.stallDropOrigins
+	pm.pinQueueLk.Unlock()
+
+	if op.NumStalls() >= maxRestarts {
+		op.recordStall(StallActionFailed, "")
+		return false
+	}
+
+	if dropOrigins {
+		// the origins given with the pin are a common cause of stalls, try
+		// whatever providers content routing finds instead
+		op.lk.Lock()
+		op.Peers = nil
+		op.lk.Unlock()
+	}
+
+	if pm.StallFunc != nil {
+		loc, err := pm.StallFunc(ctx, op)
+		if err != nil {
+			log.Warnw("failed to redispatch stalled pin, restarting it here", "content", op.ContId, "requestId", op.RequestID, "err", err)
+		} else if loc != "" {
+			st := op.recordStall(StallActionRedispatched, loc)
+			log.Infow("redispatched stalled pin", "content", op.ContId, "requestId", op.RequestID, "location", loc, "sizeFetched", st.SizeFetched)
+			return true
+		}
+	}
+
+	st := op.recordStall(StallActionRestarted, "")
+	log.Infow("restarting stalled pin", "content", op.ContId, "requestId", op.RequestID, "sizeFetched", st.SizeFetched, "attempt", op.NumStalls())
+
+	op.lk.Lock()
+	op.restart = true
+	op.lk.Unlock()
+	return true
+}
+
+// takeRestart reports whether the operation is to be queued again now that
+// its worker is done with it
+func (po *PinningOperation) takeRestart() bool {
+	po.lk.Lock()
+	defer po.lk.Unlock()
+
+	r := po.restart
+	po.restart = false
+	return r
+}
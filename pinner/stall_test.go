@@ -0,0 +1,100 @@
+package pinner
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStalledPinRestart(t *testing.T) {
+	assert := assert.New(t)
+
+	var lk sync.Mutex
+	var attempts int
+	pinfunc := func(ctx context.Context, op *PinningOperation, cb PinProgressCB) error {
+		lk.Lock()
+		attempts++
+		n := attempts
+		lk.Unlock()
+
+		// the first attempt fetches a little then hangs
+		if n == 1 {
+			cb(100)
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		cb(100)
+		cb(100)
+		return nil
+	}
+
+	done := make(chan types.PinningStatus, 10)
+	statusfunc := func(contID uint, location string, status types.PinningStatus) error {
+		if status == types.PinningStatusPinned || status == types.PinningStatusFailed {
+			done <- status
+		}
+		return nil
+	}
+
+	pm := NewPinManager(pinfunc, statusfunc, &PinManagerOpts{
+		MaxActivePerUser: 5,
+		StallTimeout:     time.Millisecond * 200,
+		MaxStallRestarts: 1,
+	})
+	go pm.Run(1)
+
+	op := testOp(1, 1)
+	pm.Add(op)
+
+	select {
+	case st := <-done:
+		assert.Equal(types.PinningStatusPinned, st)
+	case <-time.After(time.Second * 10):
+		t.Fatal("pin never finished")
+	}
+
+	assert.Equal(2, attempts)
+	assert.Len(op.Stalls, 1)
+	assert.Equal(StallActionRestarted, op.Stalls[0].Action)
+	assert.Equal(int64(100), op.Stalls[0].SizeFetched)
+	assert.Equal(int64(200), op.SizeFetched, "progress starts over on restart")
+}
+
+func TestStalledPinRedispatch(t *testing.T) {
+	assert := assert.New(t)
+
+	hang := func(ctx context.Context, op *PinningOperation, cb PinProgressCB) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	statuses := make(chan types.PinningStatus, 10)
+	pm := NewPinManager(hang, func(contID uint, location string, status types.PinningStatus) error {
+		statuses <- status
+		return nil
+	}, &PinManagerOpts{
+		MaxActivePerUser: 5,
+		StallTimeout:     time.Millisecond * 200,
+		MaxStallRestarts: 1,
+	})
+	pm.StallFunc = func(ctx context.Context, op *PinningOperation) (string, error) {
+		return "shuttle-2", nil
+	}
+
+	op := testOp(1, 1)
+	assert.NoError(pm.doPinning(op))
+	assert.Len(op.Stalls, 1)
+	assert.Equal(StallActionRedispatched, op.Stalls[0].Action)
+	assert.Equal("shuttle-2", op.Stalls[0].Location)
+	assert.False(op.takeRestart())
+
+	// out of restarts, the next stall fails the operation
+	err := pm.doPinning(op)
+	assert.ErrorIs(err, ErrStalled)
+	assert.Equal(types.PinningStatusFailed, op.Status)
+	assert.Equal(StallActionFailed, op.Stalls[1].Action)
+}
@@ -10,13 +10,22 @@ import (
 	"strings"
 	"time"
 
+	"github.com/application-research/estuary/config"
 	"github.com/application-research/estuary/constants"
 	drpc "github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/faults"
 	"github.com/application-research/estuary/pinner"
 	"github.com/application-research/estuary/pinner/types"
 	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/fetchstats"
+	"github.com/application-research/estuary/util/gsfetch"
+	"github.com/application-research/estuary/util/httpfetch"
+	"github.com/application-research/estuary/util/providers"
+	"github.com/application-research/estuary/util/requestid"
+	"github.com/application-research/estuary/util/sessionpool"
 	"github.com/ipfs/go-blockservice"
 	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
 	"github.com/ipfs/go-merkledag"
 	"github.com/labstack/echo/v4"
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -35,6 +44,13 @@ const (
 )
 
 func (cm *ContentManager) pinStatus(cont util.Content, origins []*peer.AddrInfo) (*types.IpfsPinStatusResponse, error) {
+	switch cont.Location {
+	case constants.ContentLocationRemote:
+		return cm.remotePinStatus(cont)
+	case constants.ContentLocationCluster:
+		return cm.clusterPinStatus(cont)
+	}
+
 	delegates := cm.pinDelegatesForContent(cont)
 
 	cm.pinLk.Lock()
@@ -88,6 +104,10 @@ func (cm *ContentManager) pinStatus(cont util.Content, origins []*peer.AddrInfo)
 }
 
 func (cm *ContentManager) pinDelegatesForContent(cont util.Content) []string {
+	if cont.Location == constants.ContentLocationRemote || cont.Location == constants.ContentLocationCluster {
+		return []string{}
+	}
+
 	if cont.Location == constants.ContentLocationLocal {
 		var out []string
 		for _, a := range cm.Host.Addrs() {
@@ -115,6 +135,16 @@ func (cm *ContentManager) pinDelegatesForContent(cont util.Content) []string {
 	}
 }
 
+// pinSessionKey groups the pins that fetch from the same origins, or if they
+// have none that belong to the same user, so they share a bitswap session
+func pinSessionKey(op *pinner.PinningOperation) string {
+	return sessionpool.Key(fmt.Sprintf("user:%d", op.UserId), op.Peers)
+}
+
+func (s *Server) newFetchSession(ctx context.Context) ipld.NodeGetter {
+	return merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, s.Node.Bitswap)).Session(ctx)
+}
+
 func (s *Server) doPinning(ctx context.Context, op *pinner.PinningOperation, cb pinner.PinProgressCB) error {
 	ctx, span := s.tracer.Start(ctx, "doPinning")
 	defer span.End()
@@ -134,11 +164,60 @@ func (s *Server) doPinning(ctx context.Context, op *pinner.PinningOperation, cb
 		}
 	}
 
-	bserv := blockservice.New(s.Node.Blockstore, s.Node.Bitswap)
-	dserv := merkledag.NewDAGService(bserv)
-	dsess := dserv.Session(ctx)
+	dsess, release := s.sessions.Get(pinSessionKey(op), op.Peers)
+	defer release()
+
+	fstats := fetchstats.NewRecorder(fetchstats.DefaultStallThreshold)
+	op.SetFetchStats(fstats)
+	untrack := s.Node.FetchTracer.Track(fstats)
+	defer func() {
+		untrack()
+		// ctx is done by now for pins that were cancelled or timed out,
+		// whose stats are wanted the most
+		s.CM.saveFetchStats(context.Background(), op.ContId, constants.ContentLocationLocal, fstats.Stats())
+	}()
+
+	if err := faults.Check(ctx, faults.SlowFetch); err != nil {
+		return err
+	}
+
+	progress := pinner.NewPrefetchProgress(cb)
+	var getter ipld.NodeGetter
+	var fetched bool
+	if s.gateways != nil && op.NumStalls() > 0 {
+		// fetching peer to peer stalled before, try the gateways instead
+		getter, fetched = s.gateways.Fallback(ctx, op.Obj, s.Node.Blockstore, progress.Prefetched)
+	} else {
+		t := gsfetch.FromMeta(op.Meta, s.CM.pinTransport(op.UserId))
+		if t == gsfetch.TransportAuto {
+			// a single verified car beats both when an origin serves one
+			fetched = httpfetch.FetchFromOrigins(ctx, op.Peers, op.Obj, s.Node.Blockstore, progress.Prefetched)
+		}
+		if !fetched {
+			var err error
+			fetched, err = s.Node.GraphsyncFetcher.FetchWith(ctx, t, op.Peers, op.Obj, progress.Prefetched)
+			if err != nil {
+				if s.gateways == nil {
+					return err
+				}
+				// the walk gets what is missing from the gateways
+				log.Warnf("failed to fetch %s, falling back to the gateways: %s", op.Obj, err)
+			}
+		}
+		getter = fstats.Getter(dsess)
+		if s.gateways != nil {
+			getter = s.gateways.WithFallback(getter, s.Node.Blockstore)
+		}
+	}
+	// the walk finds the blocks fetched so far locally, and they were
+	// counted already
+	cb = progress.Walk(fetched)
+
+	if err := s.CM.estimatePin(ctx, op, getter); err != nil {
+		return err
+	}
 
-	if err := s.CM.addDatabaseTrackingToContent(ctx, op.ContId, dsess, op.Obj, cb); err != nil {
+	if err := s.CM.addDatabaseTrackingToContent(ctx, op.ContId, getter, op.Obj, cb); err != nil {
 		return err
 	}
 
@@ -155,13 +234,52 @@ func (s *Server) doPinning(ctx context.Context, op *pinner.PinningOperation, cb
 	if err := s.Node.Provider.Provide(op.Obj); err != nil {
 		log.Warnf("providing failed: %s", err)
 	}
+	go s.CM.provideDag(context.Background(), op.ContId, op.Obj)
 	return nil
 }
 
+// pinProviderFunc checks that pins without origins have providers before
+// they are queued, content already in the blockstore needs none
+func (s *Server) pinProviderFunc(cfg config.ProviderCheck) pinner.ProviderFunc {
+	finder := &providers.Finder{
+		Routing: s.Node.FullRT,
+		Indexer: s.Node.Indexer,
+	}
+	return func(ctx context.Context, op *pinner.PinningOperation) (bool, error) {
+		if has, err := s.Node.Blockstore.Has(ctx, op.Obj); err == nil && has {
+			return true, nil
+		}
+		return finder.HasProviders(ctx, op.Obj)
+	}
+}
+
 func (s *Server) PinStatusFunc(contID uint, location string, status types.PinningStatus) error {
 	return s.CM.UpdatePinStatus(location, contID, status)
 }
 
+// restorePinQueue queues the local pins kept by the pin queue store from
+// before the restart. It returns false if the store had nothing and the queue
+// has to be refreshed from the database.
+func (cm *ContentManager) restorePinQueue() bool {
+	ops, found, err := cm.pinMgr.Restore()
+	if err != nil {
+		log.Errorf("failed to restore pin queue: %s", err)
+		return false
+	}
+	if !found {
+		return false
+	}
+
+	cm.pinLk.Lock()
+	for _, op := range ops {
+		cm.pinJobs[op.ContId] = op
+	}
+	cm.pinLk.Unlock()
+
+	log.Infof("restored %d pins from the pin queue snapshot", len(ops))
+	return true
+}
+
 func (cm *ContentManager) refreshPinQueue(ctx context.Context, contentLoc string) error {
 	log.Infof("trying to refresh pin queue for %s contents", contentLoc)
 
@@ -184,7 +302,7 @@ func (cm *ContentManager) refreshPinQueue(ctx context.Context, contentLoc string
 			}
 
 			if c.Location == constants.ContentLocationLocal {
-				cm.addPinToQueue(c, origins, 0, makeDeal)
+				cm.addPinToQueue(ctx, c, origins, 0, makeDeal)
 			} else {
 				if err := cm.pinContentOnShuttle(ctx, c, origins, 0, c.Location, makeDeal); err != nil {
 					log.Errorf("failed to send pin message to shuttle: %s", err)
@@ -196,10 +314,17 @@ func (cm *ContentManager) refreshPinQueue(ctx context.Context, contentLoc string
 	return nil
 }
 
-func (cm *ContentManager) pinContent(ctx context.Context, user uint, obj cid.Cid, filename string, cols []*CollectionRef, origins []*peer.AddrInfo, replaceID uint, meta map[string]interface{}, makeDeal bool) (*types.IpfsPinStatusResponse, error) {
+func (cm *ContentManager) pinContent(ctx context.Context, user uint, namespace string, obj cid.Cid, filename string, cols []*CollectionRef, origins []*peer.AddrInfo, replaceID uint, meta map[string]interface{}, makeDeal bool) (*types.IpfsPinStatusResponse, error) {
+	if err := cm.denylist.check(ctx, obj, denyPin, user, ""); err != nil {
+		return nil, err
+	}
+
 	loc, err := cm.selectLocationForContent(ctx, obj, user)
 	if err != nil {
-		return nil, xerrors.Errorf("selecting location for content failed: %w", err)
+		if !xerrors.Is(err, errNoPinCapacity) || !cm.delegateWhenFull() {
+			return nil, xerrors.Errorf("selecting location for content failed: %w", err)
+		}
+		loc = constants.ContentLocationRemote
 	}
 
 	if replaceID > 0 {
@@ -231,8 +356,9 @@ func (cm *ContentManager) pinContent(ctx context.Context, user uint, obj cid.Cid
 		Cid:         util.DbCID{CID: obj},
 		Name:        filename,
 		UserID:      user,
+		Namespace:   namespace,
 		Active:      false,
-		Replication: cm.Replication,
+		Replication: cm.replicationFactor(),
 		Pinning:     true,
 		PinMeta:     metaStr,
 		Location:    loc,
@@ -241,6 +367,7 @@ func (cm *ContentManager) pinContent(ctx context.Context, user uint, obj cid.Cid
 	if err := cm.DB.Create(&cont).Error; err != nil {
 		return nil, err
 	}
+	cm.recordContentEvent(ctx, eventContentAdded, cont.ID, nil)
 
 	if len(cols) > 0 {
 		for _, c := range cols {
@@ -255,8 +382,30 @@ func (cm *ContentManager) pinContent(ctx context.Context, user uint, obj cid.Cid
 		}
 	}
 
-	if loc == constants.ContentLocationLocal {
-		cm.addPinToQueue(cont, origins, replaceID, makeDeal)
+	if loc == constants.ContentLocationRemote {
+		if err := cm.delegatePin(ctx, cont, origins, delegatedNoCapacity); err != nil {
+			if err := cm.DB.Model(util.Content{}).Where("id = ?", cont.ID).UpdateColumns(map[string]interface{}{
+				"pinning":         false,
+				"failed":          true,
+				"pin_finished_at": time.Now(),
+			}).Error; err != nil {
+				log.Errorf("failed to mark content as failed in database: %s", err)
+			}
+			return nil, err
+		}
+	} else if loc == constants.ContentLocationCluster {
+		if err := cm.pinContentOnCluster(ctx, cont, origins); err != nil {
+			if err := cm.DB.Model(util.Content{}).Where("id = ?", cont.ID).UpdateColumns(map[string]interface{}{
+				"pinning":         false,
+				"failed":          true,
+				"pin_finished_at": time.Now(),
+			}).Error; err != nil {
+				log.Errorf("failed to mark content as failed in database: %s", err)
+			}
+			return nil, err
+		}
+	} else if loc == constants.ContentLocationLocal {
+		cm.addPinToQueue(ctx, cont, origins, replaceID, makeDeal)
 	} else {
 		if err := cm.pinContentOnShuttle(ctx, cont, origins, replaceID, loc, makeDeal); err != nil {
 			return nil, err
@@ -265,23 +414,25 @@ func (cm *ContentManager) pinContent(ctx context.Context, user uint, obj cid.Cid
 	return cm.pinStatus(cont, origins)
 }
 
-func (cm *ContentManager) addPinToQueue(cont util.Content, peers []*peer.AddrInfo, replaceID uint, makeDeal bool) {
+func (cm *ContentManager) addPinToQueue(ctx context.Context, cont util.Content, peers []*peer.AddrInfo, replaceID uint, makeDeal bool) {
 	if cont.Location != constants.ContentLocationLocal {
 		log.Errorf("calling addPinToQueue on non-local content")
 	}
 
 	op := &pinner.PinningOperation{
-		ContId:   cont.ID,
-		UserId:   cont.UserID,
-		Obj:      cont.Cid.CID,
-		Name:     cont.Name,
-		Peers:    peers,
-		Started:  cont.CreatedAt,
-		Status:   types.PinningStatusQueued,
-		Replace:  replaceID,
-		Location: cont.Location,
-		MakeDeal: makeDeal,
-		Meta:     cont.PinMeta,
+		ContId:      cont.ID,
+		UserId:      cont.UserID,
+		Obj:         cont.Cid.CID,
+		Name:        cont.Name,
+		Peers:       peers,
+		Started:     cont.CreatedAt,
+		Status:      types.PinningStatusQueued,
+		Replace:     replaceID,
+		Location:    cont.Location,
+		MakeDeal:    makeDeal,
+		Meta:        cont.PinMeta,
+		SpanContext: trace.SpanContextFromContext(ctx),
+		RequestID:   requestid.FromContext(ctx),
 	}
 
 	cm.pinLk.Lock()
@@ -307,6 +458,7 @@ func (cm *ContentManager) pinContentOnShuttle(ctx context.Context, cont util.Con
 				UserId: cont.UserID,
 				Cid:    cont.Cid.CID,
 				Peers:  peers,
+				Meta:   cont.PinMeta,
 			},
 		},
 	}); err != nil {
@@ -335,6 +487,55 @@ func (cm *ContentManager) pinContentOnShuttle(ctx context.Context, cont util.Con
 	return nil
 }
 
+// onPinStalled is called by the pin manager when a local pin stopped making
+// progress. The stall goes into the content's event log, and if stalled pins
+// are to be redispatched the pin is handed to a shuttle instead of being
+// restarted here.
+func (cm *ContentManager) onPinStalled(ctx context.Context, op *pinner.PinningOperation) (string, error) {
+	size, num := op.Progress()
+	data := map[string]interface{}{
+		"sizeFetched": size,
+		"numFetched":  num,
+		"attempt":     op.NumStalls() + 1,
+	}
+
+	var loc string
+	var err error
+	if cm.redispatchStalled() && op.Location == constants.ContentLocationLocal {
+		loc, err = cm.redispatchStalledPin(ctx, op)
+		if loc != "" {
+			data["location"] = loc
+		}
+	}
+	cm.recordContentEvent(ctx, eventPinStalled, op.ContId, data)
+	return loc, err
+}
+
+func (cm *ContentManager) redispatchStalledPin(ctx context.Context, op *pinner.PinningOperation) (string, error) {
+	var cont util.Content
+	if err := cm.DB.First(&cont, "id = ?", op.ContId).Error; err != nil {
+		return "", err
+	}
+
+	loc, err := cm.selectLocationForContent(ctx, cont.Cid.CID, cont.UserID)
+	if err != nil {
+		return "", err
+	}
+	if loc == constants.ContentLocationLocal || loc == constants.ContentLocationCluster {
+		// no shuttle to send it to
+		return "", nil
+	}
+
+	if err := cm.pinContentOnShuttle(ctx, cont, op.Peers, op.Replace, loc, op.MakeDeal); err != nil {
+		return "", err
+	}
+
+	if err := cm.DB.Model(util.Content{}).Where("id = ?", cont.ID).UpdateColumn("location", loc).Error; err != nil {
+		log.Errorf("failed to update location of redispatched content %d: %s", cont.ID, err)
+	}
+	return loc, nil
+}
+
 func (cm *ContentManager) selectLocationForContent(ctx context.Context, obj cid.Cid, uid uint) (string, error) {
 	ctx, span := cm.tracer.Start(ctx, "selectLocation")
 	defer span.End()
@@ -344,13 +545,35 @@ func (cm *ContentManager) selectLocationForContent(ctx context.Context, obj cid.
 		return "", err
 	}
 
+	shared, err := cm.sharedContentLocation(ctx, obj)
+	if err != nil {
+		return "", err
+	}
+	if shared != "" {
+		return shared, nil
+	}
+
+	if cm.cluster != nil && cm.clusterCfg.Preferred {
+		return constants.ContentLocationCluster, nil
+	}
+
+	// shuttles that have reported less free space than the content is
+	// thought to need count as low on space too
+	est, known, err := cm.dagSizes.Peek(ctx, obj)
+	if err != nil {
+		log.Warnf("failed to estimate size of %s: %s", obj, err)
+	}
+
 	allShuttlesLowSpace := true
 	lowSpace := make(map[string]bool)
 	var activeShuttles []string
 	cm.shuttlesLk.Lock()
 	for d, sh := range cm.shuttles {
+		if sh.draining || sh.intakePaused {
+			continue
+		}
 		if !sh.private {
-			lowSpace[d] = sh.spaceLow
+			lowSpace[d] = sh.spaceLow || (known && sh.blockstoreFree > 0 && sh.blockstoreFree < uint64(est.Size))
 			activeShuttles = append(activeShuttles, d)
 		} else {
 			allShuttlesLowSpace = false
@@ -377,12 +600,20 @@ func (cm *ContentManager) selectLocationForContent(ctx context.Context, obj cid.
 
 	if len(shuttles) == 0 {
 		//log.Info("no shuttles available for content to be delegated to")
+		if cm.cluster != nil {
+			return constants.ContentLocationCluster, nil
+		}
 		if cm.localContentAddingDisabled {
-			return "", fmt.Errorf("no shuttles available and local content adding disabled")
+			return "", xerrors.Errorf("no shuttles available and local content adding disabled: %w", errNoPinCapacity)
 		}
 		return constants.ContentLocationLocal, nil
 	}
 
+	// shuttles low on space sort last, so if the first is all of them are
+	if lowSpace[shuttles[0].Handle] && cm.delegateWhenFull() {
+		return "", xerrors.Errorf("all shuttles are low on space: %w", errNoPinCapacity)
+	}
+
 	// TODO: take into account existing staging zones and their primary
 	// locations while choosing
 	ploc, err := cm.primaryStagingLocation(ctx, uid)
@@ -416,6 +647,9 @@ func (cm *ContentManager) selectLocationForRetrieval(ctx context.Context, cont u
 	var activeShuttles []string
 	cm.shuttlesLk.Lock()
 	for d, sh := range cm.shuttles {
+		if sh.draining || sh.intakePaused {
+			continue
+		}
 		if !sh.private {
 			activeShuttles = append(activeShuttles, d)
 		}
@@ -502,7 +736,7 @@ func (s *Server) handleListPins(e echo.Context, u *User) error {
 		}
 	}
 
-	q := s.DB.Model(util.Content{}).Where("user_id = ? AND not aggregate AND not replace", u.ID).Order("created_at desc")
+	q := util.ReadReplica(s.DB).Model(util.Content{}).Scopes(inNamespace(u)).Where("user_id = ? AND not aggregate AND not replace", u.ID).Order("created_at desc")
 
 	if qcids != "" {
 		var cids []util.DbCID
@@ -693,11 +927,13 @@ func (s *Server) handleAddPin(e echo.Context, u *User) error {
 	}
 
 	var cols []*CollectionRef
+	var col *Collection
 	if c, ok := pin.Meta["collection"].(string); ok && c != "" {
-		var srchCol Collection
-		if err := s.DB.First(&srchCol, "uuid = ? and user_id = ?", c, u.ID).Error; err != nil {
+		srchCol, err := s.getCollectionForUpload(ctx, u, c)
+		if err != nil {
 			return err
 		}
+		col = srchCol
 
 		var colpath *string
 		colp, ok := pin.Meta["colpath"].(string)
@@ -732,9 +968,23 @@ func (s *Server) handleAddPin(e echo.Context, u *User) error {
 		return err
 	}
 
+	if err := s.checkPinQuota(e, u); err != nil {
+		return err
+	}
+
+	if err := s.checkPinSize(e, u, obj); err != nil {
+		return err
+	}
+
+	// the size of a pin is only known once it is fetched
+	meta, err := s.capPinToOrgQuota(ctx, col, pin.Meta)
+	if err != nil {
+		return err
+	}
+
 	makeDeal := true
 	// TODO pinning should be async
-	status, err := s.CM.pinContent(ctx, u.ID, obj, pin.Name, cols, origins, 0, pin.Meta, makeDeal)
+	status, err := s.CM.pinContent(ctx, u.ID, u.namespace(), obj, pin.Name, cols, origins, 0, meta, makeDeal)
 	if err != nil {
 		return err
 	}
@@ -766,7 +1016,7 @@ func (s *Server) handleGetPin(e echo.Context, u *User) error {
 		return err
 	}
 
-	if err := util.IsContentOwner(u.ID, content.UserID); err != nil {
+	if err := checkContentOwner(u, &content); err != nil {
 		return err
 	}
 
@@ -774,12 +1024,13 @@ func (s *Server) handleGetPin(e echo.Context, u *User) error {
 	if err != nil {
 		return err
 	}
+	s.CM.addFetchStats(e.Request().Context(), content.ID, st)
 	return e.JSON(http.StatusOK, st)
 }
 
 // handleReplacePin godoc
 // @Summary      Replace a pinned object
-// @Description  This endpoint replaces a pinned object.
+// @Description  This endpoint replaces a pinned object. An object that is a version of a name is kept, and the replacement is added as the next version of the names that point at it.
 // @Tags         pinning
 // @Produce      json
 // @Param        pinid  path  string  true  "Pin ID"
@@ -812,7 +1063,7 @@ func (s *Server) handleReplacePin(e echo.Context, u *User) error {
 		return err
 	}
 
-	if err := util.IsContentOwner(u.ID, content.UserID); err != nil {
+	if err := checkContentOwner(u, &content); err != nil {
 		return err
 	}
 
@@ -830,17 +1081,49 @@ func (s *Server) handleReplacePin(e echo.Context, u *User) error {
 		return err
 	}
 
+	if err := s.checkPinQuota(e, u); err != nil {
+		return err
+	}
+
+	if err := s.checkPinSize(e, u, pinCID); err != nil {
+		return err
+	}
+
+	// a content that is a version of a name stays pinned, the replacement
+	// is added as the next version of the names it is the current one of
+	ctx := e.Request().Context()
+	names, current, err := s.namedContent(ctx, content.ID)
+	if err != nil {
+		return err
+	}
+	replaceID := uint(pinID)
+	if len(names) > 0 {
+		replaceID = 0
+	}
+
 	makeDeal := true
-	status, err := s.CM.pinContent(e.Request().Context(), u.ID, pinCID, pin.Name, nil, origins, uint(pinID), pin.Meta, makeDeal)
+	status, err := s.CM.pinContent(ctx, u.ID, content.Namespace, pinCID, pin.Name, nil, origins, replaceID, pin.Meta, makeDeal)
 	if err != nil {
 		return err
 	}
+	if len(current) > 0 {
+		newID, err := strconv.ParseUint(status.RequestID, 10, 64)
+		if err != nil {
+			return err
+		}
+		for i := range current {
+			v := &contentNameVersion{Content: uint(newID), Note: fmt.Sprintf("replaced pin %d", pinID)}
+			if err := s.appendContentVersion(ctx, &current[i], v); err != nil {
+				return err
+			}
+		}
+	}
 	return e.JSON(http.StatusAccepted, status)
 }
 
 // handleDeletePin godoc
 // @Summary      Delete a pinned object
-// @Description  This endpoint deletes a pinned object.
+// @Description  This endpoint deletes a pinned object. Objects that are a version of a name can't be deleted while the name exists.
 // @Tags         pinning
 // @Produce      json
 // @Param        pinid  path  string  true  "Pin ID"
@@ -863,7 +1146,11 @@ func (s *Server) handleDeletePin(e echo.Context, u *User) error {
 		return err
 	}
 
-	if err := util.IsContentOwner(u.ID, content.UserID); err != nil {
+	if err := checkContentOwner(u, &content); err != nil {
+		return err
+	}
+
+	if err := s.checkNotNamed(e.Request().Context(), content.ID); err != nil {
 		return err
 	}
 
@@ -886,11 +1173,18 @@ func (cm *ContentManager) UpdatePinStatus(location string, contID uint, status t
 	op, ok := cm.pinJobs[contID]
 
 	cm.pinLk.Unlock()
-	if !ok {
+	// with a shared queue the operation may have been queued by another node
+	if !ok && !cm.pinMgr.Shared() {
 		return fmt.Errorf("got pin status update for unknown content: %d, status: %s, location: %s", contID, status, location)
 	}
 
 	if status == types.PinningStatusFailed {
+		// the remote service gets a go at pins that failed here, if they
+		// may succeed there. Pins queued by another node are left to it
+		if cm.delegateFailed() && ok && retryablePinFailure(op) && cm.delegateFailedPin(contID) {
+			return nil
+		}
+
 		var c util.Content
 		if err := cm.DB.First(&c, "id = ?", contID).Error; err != nil {
 			return errors.Wrap(err, "failed to look up content")
@@ -901,17 +1195,41 @@ func (cm *ContentManager) UpdatePinStatus(location string, contID uint, status t
 		}
 
 		if err := cm.DB.Model(util.Content{}).Where("id = ?", contID).UpdateColumns(map[string]interface{}{
-			"active":  false,
-			"pinning": false,
-			"failed":  true,
+			"active":          false,
+			"pinning":         false,
+			"failed":          true,
+			"pin_finished_at": time.Now(),
 		}).Error; err != nil {
 			log.Errorf("failed to mark content as failed in database: %s", err)
+		} else {
+			var reason string
+			if ok {
+				r, err := op.Failure()
+				if r == "" && err != nil {
+					r = err.Error()
+				}
+				reason = r
+			}
+			cm.recordDeadLetter(contID, location, reason)
 		}
 	}
-	op.SetStatus(status)
+	if ok {
+		op.SetStatus(status)
+	}
 	return nil
 }
 
+// setPinFailure records why a pin failed on a shuttle in the status of its
+// operation
+func (cm *ContentManager) setPinFailure(contID uint, reason string) {
+	cm.pinLk.Lock()
+	op, ok := cm.pinJobs[contID]
+	cm.pinLk.Unlock()
+	if ok {
+		op.SetFailure(reason)
+	}
+}
+
 func (cm *ContentManager) handlePinningComplete(ctx context.Context, handle string, pincomp *drpc.PinComplete) error {
 	ctx, span := cm.tracer.Start(ctx, "handlePinningComplete")
 	defer span.End()
@@ -924,10 +1242,18 @@ func (cm *ContentManager) handlePinningComplete(ctx context.Context, handle stri
 	if cont.Active {
 		// content already active, no need to add objects, just update location
 		if err := cm.DB.Model(util.Content{}).Where("id = ?", cont.ID).UpdateColumns(map[string]interface{}{
-			"location": handle,
+			"location":  handle,
+			"offloaded": false,
 		}).Error; err != nil {
 			return err
 		}
+		if cont.Offloaded {
+			// it was retrieved from its deals
+			if err := cm.DB.Model(&util.ObjRef{}).Where("content = ?", cont.ID).Update("offloaded", 0).Error; err != nil {
+				return err
+			}
+			cm.finishRestore(ctx, cont.ID, nil)
+		}
 
 		// TODO: should we recheck the staging zones?
 		return nil
@@ -953,6 +1279,18 @@ func (cm *ContentManager) handlePinningComplete(ctx context.Context, handle stri
 	}
 
 	if err := cm.addObjectsToDatabase(ctx, pincomp.DBID, nil, cid.Cid{}, objects, handle); err != nil {
+		if xerrors.Is(err, errPinOverMaxSize) {
+			// the shuttle has nothing else to keep it for
+			cm.setPinFailure(cont.ID, err.Error())
+			if err := cm.DB.Model(util.Content{}).Where("id = ?", cont.ID).UpdateColumns(map[string]interface{}{
+				"pinning":         false,
+				"failed":          true,
+				"pin_finished_at": time.Now(),
+			}).Error; err != nil {
+				return err
+			}
+			return cm.sendUnpinCmd(ctx, handle, []uint{cont.ID})
+		}
 		return xerrors.Errorf("failed to add objects to database: %w", err)
 	}
 
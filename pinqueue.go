@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/pinner"
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+)
+
+const defaultPinQueueListLimit = 100
+
+type pinQueueEntry struct {
+	Content  uint   `json:"content"`
+	User     uint   `json:"user"`
+	Location string `json:"location"`
+	Priority string `json:"priority"`
+	*types.IpfsPinStatusResponse
+}
+
+type pinQueueStats struct {
+	*pinner.PinQueueSnapshot
+	Active   int  `json:"active"`
+	Draining bool `json:"draining"`
+}
+
+// handleAdminListPinQueue godoc
+// @Summary      List the pin queue
+// @Description  This endpoint lists the pins this node queued that haven't finished, oldest first. They can be narrowed down to a user, and to queued or pinning ones with status.
+// @Tags         admin
+// @Produce      json
+// @Param        user    query  int     false  "User ID"
+// @Param        status  query  string  false  "queued or pinning"
+// @Param        limit   query  int     false  "Most pins listed, 100 by default"
+// @Success      200  {array}  pinQueueEntry
+// @Router       /admin/pin-queue [get]
+func (s *Server) handleAdminListPinQueue(c echo.Context) error {
+	var user uint64
+	if q := c.QueryParam("user"); q != "" {
+		u, err := strconv.ParseUint(q, 10, 64)
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid user: %s", q),
+			}
+		}
+		user = u
+	}
+
+	status := types.PinningStatus(c.QueryParam("status"))
+	switch status {
+	case "", types.PinningStatusQueued, types.PinningStatusPinning:
+	default:
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "status must be queued or pinning",
+		}
+	}
+
+	limit := defaultPinQueueListLimit
+	if q := c.QueryParam("limit"); q != "" {
+		l, err := strconv.Atoi(q)
+		if err != nil || l <= 0 {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid limit: %s", q),
+			}
+		}
+		limit = l
+	}
+
+	s.CM.pinLk.Lock()
+	ops := make([]*pinner.PinningOperation, 0, len(s.CM.pinJobs))
+	for _, op := range s.CM.pinJobs {
+		if user == 0 || op.UserId == uint(user) {
+			ops = append(ops, op)
+		}
+	}
+	s.CM.pinLk.Unlock()
+
+	out := make([]*pinQueueEntry, 0)
+	for _, op := range ops {
+		st := op.PinStatus()
+		if st.Status != types.PinningStatusQueued && st.Status != types.PinningStatusPinning {
+			continue
+		}
+		if status != "" && st.Status != status {
+			continue
+		}
+		out = append(out, &pinQueueEntry{
+			Content:               op.ContId,
+			User:                  op.UserId,
+			Location:              op.Location,
+			Priority:              op.Priority(),
+			IpfsPinStatusResponse: st,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Created.Before(out[j].Created)
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+// handleAdminGetPinQueueStats godoc
+// @Summary      Get pin queue stats
+// @Description  This endpoint returns how many pins are queued, in all and for each user, how many are in progress on this node, and whether the node is draining.
+// @Tags         admin
+// @Produce      json
+// @Success      200  {object}  pinQueueStats
+// @Router       /admin/pin-queue/stats [get]
+func (s *Server) handleAdminGetPinQueueStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, &pinQueueStats{
+		PinQueueSnapshot: s.CM.pinMgr.Snapshot(),
+		Active:           s.CM.pinMgr.ActivePins(),
+		Draining:         s.drain.Status().Draining,
+	})
+}
+
+func pinQueueContentParam(c echo.Context) (uint, error) {
+	id, err := strconv.ParseUint(c.Param("content"), 10, 64)
+	if err != nil {
+		return 0, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid content id: %s", c.Param("content")),
+		}
+	}
+	return uint(id), nil
+}
+
+// handleAdminCancelPin godoc
+// @Summary      Cancel a queued pin
+// @Description  This endpoint stops a pin that is queued or in progress, and marks its content as failed.
+// @Tags         admin
+// @Param        content  path  int  true  "Content ID"
+// @Router       /admin/pin-queue/{content} [delete]
+func (s *Server) handleAdminCancelPin(c echo.Context) error {
+	id, err := pinQueueContentParam(c)
+	if err != nil {
+		return err
+	}
+	if err := s.CM.cancelPin(c.Request().Context(), id); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// handleAdminBoostPin godoc
+// @Summary      Boost a queued pin
+// @Description  This endpoint moves a queued pin ahead of the per user limit on pins in progress, so it is started next.
+// @Tags         admin
+// @Param        content  path  int  true  "Content ID"
+// @Router       /admin/pin-queue/{content}/boost [post]
+func (s *Server) handleAdminBoostPin(c echo.Context) error {
+	id, err := pinQueueContentParam(c)
+	if err != nil {
+		return err
+	}
+
+	s.CM.pinLk.Lock()
+	op, ok := s.CM.pinJobs[id]
+	s.CM.pinLk.Unlock()
+	if ok && op.Location != constants.ContentLocationLocal {
+		return &util.HttpError{
+			Code:    http.StatusConflict,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("content %d is queued on shuttle %s", id, op.Location),
+		}
+	}
+
+	boosted, err := s.CM.pinMgr.Boost(c.Request().Context(), id)
+	if err != nil {
+		return err
+	}
+	if !boosted {
+		return &util.HttpError{
+			Code:    http.StatusConflict,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("content %d is not waiting in the pin queue", id),
+		}
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// cancelPin stops the pin of content contID wherever it is queued or
+// running, and marks the content as failed
+func (cm *ContentManager) cancelPin(ctx context.Context, contID uint) error {
+	cm.pinLk.Lock()
+	op, ok := cm.pinJobs[contID]
+	if ok {
+		op.Cancel()
+		delete(cm.pinJobs, contID)
+	}
+	cm.pinLk.Unlock()
+
+	found := ok
+	if ok && op.Location != constants.ContentLocationLocal {
+		if err := cm.sendUnpinCmd(ctx, op.Location, []uint{contID}); err != nil {
+			return fmt.Errorf("failed to unpin from shuttle %s: %w", op.Location, err)
+		}
+	} else {
+		removed, err := cm.pinMgr.Cancel(ctx, contID)
+		if err != nil {
+			return err
+		}
+		found = found || removed
+	}
+	if !found {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_CONTENT_NOT_FOUND,
+			Details: fmt.Sprintf("content %d is not in the pin queue", contID),
+		}
+	}
+
+	return cm.DB.WithContext(ctx).Model(util.Content{}).Where("id = ? AND NOT active", contID).UpdateColumns(map[string]interface{}{
+		"pinning": false,
+		"failed":  true,
+	}).Error
+}
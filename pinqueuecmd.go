@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util"
+	cli "github.com/urfave/cli/v2"
+)
+
+// adminClient calls the admin api of a running node
+type adminClient struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+func newAdminClient(cctx *cli.Context, cfg *config.Estuary, flags []cli.Flag) (*adminClient, error) {
+	token := cctx.String("token")
+	if token == "" {
+		return nil, errors.New("an admin api key is needed, pass --token or set ESTUARY_TOKEN")
+	}
+
+	base := cctx.String("api")
+	if base == "" {
+		// the node on this host, as configured
+		if err := cfg.Load(cctx.String("config")); err != nil && err != config.ErrNotInitialized {
+			return nil, err
+		}
+		if err := overrideSetOptions(flags, cctx, cfg); err != nil {
+			return nil, err
+		}
+		host, port, err := net.SplitHostPort(cfg.ApiListen)
+		if err != nil {
+			return nil, fmt.Errorf("invalid api listen address %q: %w", cfg.ApiListen, err)
+		}
+		if host == "" || host == "0.0.0.0" || host == "::" {
+			host = "localhost"
+		}
+		base = "http://" + net.JoinHostPort(host, port)
+	}
+
+	return &adminClient{
+		base:  strings.TrimSuffix(base, "/"),
+		token: token,
+		http:  &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+// do sends a request to the api and decodes the response into out, if set
+func (ac *adminClient) do(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, ac.base+path, rd)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+ac.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := ac.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var herr util.HttpErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&herr); err != nil || herr.Error.Reason == "" {
+			return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+		}
+		return fmt.Errorf("%s %s: %s: %s", method, path, herr.Error.Reason, herr.Error.Details)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// pinQueueCommand manages the pin queue of a running node through its admin
+// api
+func pinQueueCommand(cfg *config.Estuary, flags []cli.Flag) *cli.Command {
+	client := func(cctx *cli.Context) (*adminClient, error) {
+		return newAdminClient(cctx, cfg, flags)
+	}
+	jsonFlag := &cli.BoolFlag{
+		Name:  "json",
+		Usage: "print the response of the api as it is",
+	}
+
+	return &cli.Command{
+		Name:  "pin-queue",
+		Usage: "Inspects and manages the pin queue of a running node through its admin api",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "api",
+				Usage: "url of the api of the node, the one configured on this host by default",
+			},
+			&cli.StringFlag{
+				Name:    "token",
+				Usage:   "api key of an admin",
+				EnvVars: []string{"ESTUARY_TOKEN"},
+			},
+		},
+		Subcommands: []*cli.Command{
+			{
+				Name:  "list",
+				Usage: "Lists the pins that are queued or in progress, oldest first",
+				Flags: []cli.Flag{
+					&cli.UintFlag{
+						Name:  "user",
+						Usage: "only list the pins of this user",
+					},
+					&cli.StringFlag{
+						Name:  "status",
+						Usage: "only list queued or pinning pins",
+					},
+					&cli.IntFlag{
+						Name:  "limit",
+						Usage: "most pins listed",
+						Value: defaultPinQueueListLimit,
+					},
+					jsonFlag,
+				},
+				Action: func(cctx *cli.Context) error {
+					ac, err := client(cctx)
+					if err != nil {
+						return err
+					}
+
+					q := url.Values{}
+					if u := cctx.Uint("user"); u != 0 {
+						q.Set("user", strconv.FormatUint(uint64(u), 10))
+					}
+					if st := cctx.String("status"); st != "" {
+						q.Set("status", st)
+					}
+					q.Set("limit", strconv.Itoa(cctx.Int("limit")))
+
+					var entries []*pinQueueEntry
+					if err := ac.do(cctx.Context, http.MethodGet, "/admin/pin-queue?"+q.Encode(), nil, &entries); err != nil {
+						return err
+					}
+					if cctx.Bool("json") {
+						return printJSON(entries)
+					}
+
+					w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+					fmt.Fprintln(w, "CONTENT\tUSER\tSTATUS\tPRIORITY\tLOCATION\tQUEUED\tCID\tNAME")
+					for _, e := range entries {
+						fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+							e.Content, e.User, e.Status, e.Priority, e.Location,
+							time.Since(e.Created).Truncate(time.Second), e.Pin.CID, e.Pin.Name)
+					}
+					return w.Flush()
+				},
+			}, {
+				Name:      "cancel",
+				Usage:     "Stops pins, their contents are marked as failed",
+				ArgsUsage: "<content id>...",
+				Action: func(cctx *cli.Context) error {
+					if cctx.Args().Len() == 0 {
+						return errors.New("must specify the contents to cancel the pins of")
+					}
+					ac, err := client(cctx)
+					if err != nil {
+						return err
+					}
+					for _, id := range cctx.Args().Slice() {
+						if err := ac.do(cctx.Context, http.MethodDelete, "/admin/pin-queue/"+url.PathEscape(id), nil, nil); err != nil {
+							return err
+						}
+						fmt.Printf("cancelled %s\n", id)
+					}
+					return nil
+				},
+			}, {
+				Name:      "boost",
+				Usage:     "Moves queued pins ahead of the per user limit, so they are started next",
+				ArgsUsage: "<content id>...",
+				Action: func(cctx *cli.Context) error {
+					if cctx.Args().Len() == 0 {
+						return errors.New("must specify the contents to boost the pins of")
+					}
+					ac, err := client(cctx)
+					if err != nil {
+						return err
+					}
+					for _, id := range cctx.Args().Slice() {
+						if err := ac.do(cctx.Context, http.MethodPost, "/admin/pin-queue/"+url.PathEscape(id)+"/boost", nil, nil); err != nil {
+							return err
+						}
+						fmt.Printf("boosted %s\n", id)
+					}
+					return nil
+				},
+			}, {
+				Name:  "stats",
+				Usage: "Prints how many pins are queued and in progress, in all and for each user",
+				Flags: []cli.Flag{jsonFlag},
+				Action: func(cctx *cli.Context) error {
+					ac, err := client(cctx)
+					if err != nil {
+						return err
+					}
+					var st pinQueueStats
+					if err := ac.do(cctx.Context, http.MethodGet, "/admin/pin-queue/stats", nil, &st); err != nil {
+						return err
+					}
+					if cctx.Bool("json") {
+						return printJSON(&st)
+					}
+
+					fmt.Printf("queued: %d\n", st.QueueSize)
+					fmt.Printf("in progress: %d\n", st.Active)
+					fmt.Printf("shared: %t\n", st.Shared)
+					fmt.Printf("draining: %t\n", st.Draining)
+
+					users := make(map[uint]bool)
+					for u := range st.QueuedByUser {
+						users[u] = true
+					}
+					for u := range st.ActiveByUser {
+						users[u] = true
+					}
+					if len(users) == 0 {
+						return nil
+					}
+					ids := make([]uint, 0, len(users))
+					for u := range users {
+						ids = append(ids, u)
+					}
+					sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+					fmt.Println()
+					w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+					fmt.Fprintln(w, "USER\tQUEUED\tIN PROGRESS")
+					for _, u := range ids {
+						fmt.Fprintf(w, "%d\t%d\t%d\n", u, st.QueuedByUser[u], st.ActiveByUser[u])
+					}
+					return w.Flush()
+				},
+			}, {
+				Name:  "drain",
+				Usage: "Drains the node: no more pins are started and those in progress are given until the deadline to finish",
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:  "deadline",
+						Usage: "how long pins and transfers in progress are given to finish",
+						Value: defaultDrainDeadline,
+					},
+					&cli.BoolFlag{
+						Name:  "exit",
+						Usage: "shut the node down once it is drained",
+					},
+					&cli.BoolFlag{
+						Name:  "wait",
+						Usage: "wait for the drain to finish, printing its phases",
+					},
+				},
+				Action: func(cctx *cli.Context) error {
+					ac, err := client(cctx)
+					if err != nil {
+						return err
+					}
+
+					body := drainBody{
+						Deadline: cctx.Duration("deadline").String(),
+						Exit:     cctx.Bool("exit"),
+					}
+					var st util.DrainStatus
+					if err := ac.do(cctx.Context, http.MethodPost, "/admin/drain", body, &st); err != nil {
+						return err
+					}
+					fmt.Printf("draining until %s\n", st.Deadline.Format(time.RFC3339))
+					if !cctx.Bool("wait") {
+						return nil
+					}
+
+					phase := ""
+					for {
+						if st.Phase != phase {
+							phase = st.Phase
+							fmt.Println(phase)
+						}
+						if st.Done {
+							break
+						}
+						select {
+						case <-time.After(2 * time.Second):
+						case <-cctx.Context.Done():
+							return cctx.Context.Err()
+						}
+						if err := ac.do(cctx.Context, http.MethodGet, "/admin/drain", nil, &st); err != nil {
+							// the node is gone once it exits
+							if cctx.Bool("exit") && phase == "shutting down" {
+								return nil
+							}
+							return err
+						}
+					}
+					if st.Error != "" {
+						return fmt.Errorf("drain failed: %s", st.Error)
+					}
+					fmt.Println("drained")
+					return nil
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/access"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"gorm.io/gorm"
+)
+
+// Private content is only served by the gateways with an access token,
+// passed in this query parameter or header.
+const (
+	accessTokenParam  = "access-token"
+	accessTokenHeader = "X-Estuary-Access-Token"
+)
+
+// whether blocks are private is looked up once in this long for bitswap,
+// for this many blocks at most
+const (
+	withheldCacheTTL  = time.Minute
+	withheldCacheSize = 100000
+)
+
+// accessSecret returns the secret access tokens are signed with: the
+// configured one, or one derived from the key of the node
+func accessSecret(secret string, key crypto.PrivKey) ([]byte, error) {
+	if secret != "" {
+		return []byte(secret), nil
+	}
+	raw, err := key.Raw()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(append([]byte("estuary-access-secret:"), raw...))
+	return sum[:], nil
+}
+
+func accessToken(c echo.Context) string {
+	if tok := c.QueryParam(accessTokenParam); tok != "" {
+		return tok
+	}
+	return c.Request().Header.Get(accessTokenHeader)
+}
+
+// isPrivateCid reports whether a cid is only pinned as private content, as
+// the root of the content or a block in its dag. Once anyone pins it in
+// public, it is public.
+func (s *Server) isPrivateCid(ctx context.Context, cc cid.Cid) (bool, error) {
+	return isPrivateCid(ctx, s.DB, cc)
+}
+
+func isPrivateCid(ctx context.Context, db *gorm.DB, cc cid.Cid) (bool, error) {
+	var res struct {
+		Total   int64
+		Private int64
+	}
+	// aggregates are made by the node and hold the dags of the contents in
+	// them, they say nothing about who pinned what
+	if err := db.WithContext(ctx).Model(&util.Content{}).
+		Select("COUNT(1) AS total, COALESCE(SUM(CASE WHEN private THEN 1 ELSE 0 END), 0) AS private").
+		Where("active AND NOT aggregate").
+		Where("cid = ? OR id IN (SELECT obj_refs.content FROM obj_refs JOIN objects ON objects.id = obj_refs.object WHERE objects.cid = ?)",
+			util.DbCID{CID: cc}, util.DbCID{CID: cc}).
+		Scan(&res).Error; err != nil {
+		return false, err
+	}
+	return res.Total > 0 && res.Private == res.Total, nil
+}
+
+// tokenCovers reports whether a token for the content with root root
+// gives access to cc, which is the root or a block in its dag
+func (s *Server) tokenCovers(ctx context.Context, root string, cc cid.Cid) (bool, error) {
+	if root == cc.String() {
+		return true, nil
+	}
+	rc, err := cid.Decode(root)
+	if err != nil {
+		return false, nil
+	}
+	var n int64
+	if err := s.DB.WithContext(ctx).Model(&util.ObjRef{}).
+		Joins("JOIN objects ON objects.id = obj_refs.object").
+		Joins("JOIN contents ON contents.id = obj_refs.content").
+		Where("objects.cid = ? AND contents.cid = ? AND contents.active", util.DbCID{CID: cc}, util.DbCID{CID: rc}).
+		Limit(1).Count(&n).Error; err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// checkRetrievalAccess lets the dag under cc be retrieved if it is public,
+// or with a valid access token for it or for content it is part of
+func (s *Server) checkRetrievalAccess(ctx context.Context, cc cid.Cid, token string) (bool, error) {
+	private, err := s.isPrivateCid(ctx, cc)
+	if err != nil || !private {
+		return false, err
+	}
+
+	if token == "" {
+		return true, &util.HttpError{
+			Code:    http.StatusUnauthorized,
+			Reason:  util.ERR_NOT_AUTHORIZED,
+			Details: fmt.Sprintf("%s is private, an access token is required", cc),
+		}
+	}
+	tok, err := access.Verify(s.accessSecret, token, time.Now())
+	if err == nil {
+		covers, cerr := s.tokenCovers(ctx, tok.Cid, cc)
+		if cerr != nil {
+			return true, cerr
+		}
+		if !covers {
+			err = access.ErrInvalid
+		}
+	}
+	if err != nil {
+		return true, &util.HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  util.ERR_NOT_AUTHORIZED,
+			Details: fmt.Sprintf("%s: %s", cc, err),
+		}
+	}
+	return true, nil
+}
+
+type privateContentBody struct {
+	Private bool `json:"private"`
+}
+
+// handleSetContentPrivate godoc
+// @Summary      Make content private or public
+// @Description  This endpoint makes content private, so the gateways only serve it with an access token and its blocks are neither served over bitswap nor announced, or public again. Content that is also pinned in public, by anyone, stays public.
+// @Tags         content
+// @Accept       json
+// @Param        id    path  int                 true  "Content ID"
+// @Param        body  body  privateContentBody  true  "Private"
+// @Router       /content/{id}/private [put]
+func (s *Server) handleSetContentPrivate(c echo.Context, u *User) error {
+	content, err := s.getOwnContent(c, u)
+	if err != nil {
+		return err
+	}
+
+	var body privateContentBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := s.DB.Model(&util.Content{}).Where("id = ?", content.ID).Update("private", body.Private).Error; err != nil {
+		return err
+	}
+	s.withheld.Forget()
+	switch content.Location {
+	case constants.ContentLocationLocal, constants.ContentLocationRemote, constants.ContentLocationCluster:
+	default:
+		// the shuttle keeps the blocks from bitswap itself
+		if err := s.CM.sendShuttleCommand(c.Request().Context(), content.Location, &drpc.Command{
+			Op: drpc.CMD_SetContentPrivate,
+			Params: drpc.CmdParams{
+				SetContentPrivate: &drpc.SetContentPrivate{Contents: []uint{content.ID}, Private: body.Private},
+			},
+		}); err != nil {
+			return err
+		}
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+type accessTokenBody struct {
+	// Expiry is how long the token is valid, eg 24h
+	Expiry string `json:"expiry"`
+}
+
+type accessTokenResponse struct {
+	Token  string    `json:"token"`
+	Expiry time.Time `json:"expiry"`
+	URL    string    `json:"url"`
+}
+
+// handleCreateAccessToken godoc
+// @Summary      Create an access token for private content
+// @Description  This endpoint mints a token that lets anyone holding it retrieve private content through the gateways until it expires.
+// @Tags         content
+// @Accept       json
+// @Produce      json
+// @Param        id    path      int              true  "Content ID"
+// @Param        body  body      accessTokenBody  false "Expiry"
+// @Success      200   {object}  accessTokenResponse
+// @Router       /content/{id}/access-tokens [post]
+func (s *Server) handleCreateAccessToken(c echo.Context, u *User) error {
+	content, err := s.getOwnContent(c, u)
+	if err != nil {
+		return err
+	}
+
+	var body accessTokenBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	cfg := s.estuaryCfg.PrivateRetrieval
+	ttl := cfg.DefaultTokenExpiry
+	if body.Expiry != "" {
+		ttl, err = time.ParseDuration(body.Expiry)
+		if err != nil || ttl <= 0 || ttl > cfg.MaxTokenExpiry {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("expiry must be a duration up to %s", cfg.MaxTokenExpiry),
+			}
+		}
+	}
+
+	expiry := time.Now().Add(ttl).Truncate(time.Second)
+	root := content.Cid.CID.String()
+	tok, err := access.Mint(s.accessSecret, access.Token{Cid: root, Expiry: expiry.Unix()})
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, &accessTokenResponse{
+		Token:  tok,
+		Expiry: expiry,
+		URL:    fmt.Sprintf("%s/gw/ipfs/%s?%s=%s", s.estuaryCfg.Hostname, root, accessTokenParam, tok),
+	})
+}
+
+// handleShuttleCheckAccess lets shuttle gateways check retrievals with the
+// primary node, which holds the content records and the access secret
+func (s *Server) handleShuttleCheckAccess(c echo.Context) error {
+	cc, err := cid.Decode(c.Param("cid"))
+	if err != nil {
+		return err
+	}
+	if err := s.CM.denylist.checkPath(c.Request().Context(), cc, c.QueryParam("path"), denyServe, 0, c.QueryParam("remote")); err != nil {
+		return err
+	}
+	// the shuttle sends the cid the path resolved to
+	target := cc
+	if t, err := cid.Decode(c.QueryParam("target")); err == nil {
+		target = t
+	}
+	if err := s.CM.denylist.check(c.Request().Context(), target, denyServe, 0, c.QueryParam("remote")); err != nil {
+		return err
+	}
+	if err := s.checkQuarantine(c.Request().Context(), cc); err != nil {
+		return err
+	}
+	// retrievals with a selector take an api key, and the shuttle sends the
+	// size of what it selects
+	selective := c.QueryParam("selective") == "true"
+	var selected int64
+	if selective {
+		if _, err := s.checkTokenAuth(c.Request().Header.Get(constants.ClientAuthHeader)); err != nil {
+			return err
+		}
+		c.Response().Header().Set("Cache-Control", "no-store")
+		selected, _ = strconv.ParseInt(c.QueryParam("selected"), 10, 64)
+	}
+	private, err := s.checkRetrievalAccess(c.Request().Context(), cc, accessToken(c))
+	if err != nil {
+		return err
+	}
+	if s.retrievals != nil {
+		// each retrieval is counted, the shuttle can't reuse the answer
+		c.Response().Header().Set("Cache-Control", "no-store")
+		s.retrievals.hit(cc)
+	}
+	// the shuttle reports the requests it served without asking
+	hits, _ := strconv.Atoi(c.QueryParam("hits"))
+	if hits < 0 || hits > maxReportedHits {
+		hits = 0
+	}
+	base, err := s.cdnRedirect(c.Request().Context(), cc, private, 1+hits)
+	if err != nil {
+		return err
+	}
+	if selective {
+		// the cdn serves whole dags
+		base = ""
+	}
+
+	var charge *retrievalCharge
+	if s.estuaryCfg.PaidRetrieval.Enabled {
+		// every retrieval is charged, the shuttle can't reuse the answer.
+		// What the path resolved to is priced instead of the root
+		c.Response().Header().Set("Cache-Control", "no-store")
+		charge, err = s.chargeRetrieval(c.Request().Context(), target, selected, c.QueryParam("remote"), c.QueryParam(paychVoucherParam))
+		if err != nil {
+			return err
+		}
+	}
+
+	if base != "" {
+		// hot content goes to the cdn, requests have to keep counting
+		c.Response().Header().Set("Cache-Control", "no-store")
+		c.Response().Header().Set(constants.CDNHeader, base)
+	} else {
+		r, started, err := s.warmOffloaded(c.Request().Context(), cc, charge.paid(), c.Request().Header.Get(constants.ClientAuthHeader))
+		if err != nil {
+			s.refundRetrieval(c.Request().Context(), charge)
+			return err
+		}
+		if r != nil {
+			if !started {
+				s.refundRetrieval(c.Request().Context(), charge)
+			}
+			return s.serveWarming(c, r)
+		}
+		uid, org, err := s.egressAccount(c.Request().Context(), cc, c.Request().Header.Get(constants.ClientAuthHeader), private)
+		if err != nil {
+			s.refundRetrieval(c.Request().Context(), charge)
+			return err
+		}
+		if uid != 0 {
+			// the bytes served are counted, the shuttle can't reuse the
+			// answer
+			c.Response().Header().Set("Cache-Control", "no-store")
+			if err := s.checkEgress(c, uid); err != nil {
+				s.refundRetrieval(c.Request().Context(), charge)
+				return err
+			}
+		}
+		if charge != nil || uid != 0 {
+			// the shuttle reports how serving went, to meter it and give
+			// the charge back if it failed
+			id := uuid.New().String()
+			s.retrievalTickets.Add(id, &retrievalTicket{charge: charge, user: uid, org: org})
+			c.Response().Header().Set(constants.RetrievalTicketHeader, id)
+		}
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// retrievalTicket is what the primary did for a retrieval it let a shuttle
+// serve, until the shuttle reports how serving it went
+type retrievalTicket struct {
+	charge *retrievalCharge
+	// user and org are who the bytes served are counted against
+	user uint
+	org  uint
+}
+
+type retrievalServedBody struct {
+	Status int   `json:"status"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// handleShuttleRetrievalServed meters the bytes a shuttle served for a
+// retrieval, and gives back its charge if it failed
+func (s *Server) handleShuttleRetrievalServed(c echo.Context) error {
+	var body retrievalServedBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	v, ok := s.retrievalTickets.Get(c.Param("ticket"))
+	if !ok {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_RECORD_NOT_FOUND,
+			Details: "no such retrieval ticket",
+		}
+	}
+	// a ticket is reported once
+	s.retrievalTickets.Remove(c.Param("ticket"))
+
+	t := v.(*retrievalTicket)
+	if body.Status >= http.StatusBadRequest {
+		s.refundRetrieval(c.Request().Context(), t.charge)
+	}
+	if s.egress != nil && t.user != 0 {
+		s.egress.add(t.user, t.org, body.Bytes)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// getOwnContent returns the content in the id path parameter, if it is the
+// user's
+func (s *Server) getOwnContent(c echo.Context, u *User) (*util.Content, error) {
+	contID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return nil, err
+	}
+	return s.getOwnContentByID(u, contID)
+}
+
+// getOwnContentByID returns a content of the user by its id
+func (s *Server) getOwnContentByID(u *User, contID int) (*util.Content, error) {
+	var content util.Content
+	if err := s.DB.First(&content, "id = ?", contID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("content with ID(%d) was not found", contID),
+			}
+		}
+		return nil, err
+	}
+	if err := checkContentOwner(u, &content); err != nil {
+		return nil, err
+	}
+	return &content, nil
+}
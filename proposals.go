@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/dealbatch"
+	"github.com/application-research/filclient"
+	"github.com/filecoin-project/go-address"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/network"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+// dealSessionTag protects the connections to storage providers we are
+// sending a batch of proposals to
+const dealSessionTag = "deal-proposals"
+
+// pendingProposal is a deal proposal that has its database records in place
+// and still has to be sent to the storage provider
+type pendingProposal struct {
+	content  util.Content
+	miner    miner
+	prop     *network.Proposal
+	propCid  cid.Cid
+	dealUUID uuid.UUID
+	record   *proposalRecord
+	deal     *contentDeal
+
+	// set by sendProposal
+	cleanup   func() error
+	propPhase bool
+}
+
+func (pp *pendingProposal) isPushTransfer() bool {
+	return pp.miner.dealProtocolVersion == filclient.DealProtocolv110
+}
+
+func (cm *ContentManager) prepareProposal(ctx context.Context, content util.Content, m miner, verified bool) (*pendingProposal, error) {
+	price := m.ask.GetPrice(verified)
+	prop, err := cm.FilClient.MakeDeal(ctx, m.address, content.Cid.CID, price, m.ask.MinPieceSize, constants.DealDuration, verified)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to construct a deal proposal: %w", err)
+	}
+
+	var transfer string
+	if m.dealProtocolVersion == filclient.DealProtocolv120 {
+		transfer = cm.dealTransferFor(ctx, m, content)
+	}
+
+	snap := m.snap && cm.snapDealsFor(content)
+	if snap {
+		if err := cm.startSnapDeal(ctx, prop); err != nil {
+			return nil, xerrors.Errorf("failed to make snap deal proposal: %w", err)
+		}
+	}
+
+	dp, err := cm.putProposalRecord(prop.DealProposal)
+	if err != nil {
+		return nil, err
+	}
+
+	propnd, err := cborutil.AsIpld(prop.DealProposal)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to compute deal proposal ipld node: %w", err)
+	}
+
+	dealUUID := uuid.New()
+	cd := &contentDeal{
+		Content:             content.ID,
+		PropCid:             util.DbCID{CID: propnd.Cid()},
+		DealUUID:            dealUUID.String(),
+		Miner:               m.address.String(),
+		Verified:            verified,
+		UserID:              content.UserID,
+		DealProtocolVersion: m.dealProtocolVersion,
+		MinerVersion:        m.ask.MinerVersion,
+		Snap:                snap,
+		EndEpoch:            int64(prop.DealProposal.Proposal.EndEpoch),
+		Transfer:            transfer,
+	}
+
+	if err := cm.DB.Create(cd).Error; err != nil {
+		return nil, xerrors.Errorf("failed to create database entry for deal: %w", err)
+	}
+
+	return &pendingProposal{
+		content:  content,
+		miner:    m,
+		prop:     prop,
+		propCid:  propnd.Cid(),
+		dealUUID: dealUUID,
+		record:   dp,
+		deal:     cd,
+	}, nil
+}
+
+// sendProposal sends the deal proposal to the storage provider
+func (cm *ContentManager) sendProposal(ctx context.Context, pp *pendingProposal) error {
+	if err := cm.connectProvider(ctx, pp.miner.address); err != nil {
+		return err
+	}
+
+	var err error
+	switch pp.miner.dealProtocolVersion {
+	case filclient.DealProtocolv110:
+		pp.propPhase, err = cm.FilClient.SendProposalV110(ctx, *pp.prop, pp.propCid)
+	case filclient.DealProtocolv120:
+		if pp.deal.Transfer == dealTransferLibp2p {
+			pp.cleanup, pp.propPhase, err = cm.sendProposalV120(ctx, pp.content.Location, *pp.prop, pp.propCid, pp.dealUUID, pp.deal.ID)
+		} else {
+			pp.cleanup, pp.propPhase, err = cm.sendBoostProposal(ctx, pp)
+		}
+	default:
+		err = fmt.Errorf("unrecognized deal protocol %s", pp.miner.dealProtocolVersion)
+	}
+	return err
+}
+
+// abandonProposal removes the records of a proposal that could not be sent
+// and records the deal failure
+func (cm *ContentManager) abandonProposal(pp *pendingProposal, sendErr error) error {
+	// Clean up the contentDeal database entry
+	if err := cm.DB.Delete(&contentDeal{}, pp.deal).Error; err != nil {
+		return fmt.Errorf("failed to delete content deal from db: %w", err)
+	}
+
+	// Clean up the proposal database entry
+	if err := cm.DB.Delete(&proposalRecord{}, pp.record).Error; err != nil {
+		return fmt.Errorf("failed to delete deal proposal from db: %w", err)
+	}
+
+	// Clean up the preparation for deal request - deal protocol v120
+	if pp.cleanup != nil {
+		if err := pp.cleanup(); err != nil {
+			log.Errorw("cleaning up deal prepared request", "error", err)
+		}
+	}
+
+	// Record a deal failure
+	phase := "send-proposal"
+	if pp.propPhase {
+		phase = "propose"
+	}
+
+	if err := cm.recordDealFailure(&DealFailureError{
+		Miner:               pp.miner.address,
+		Phase:               phase,
+		Message:             sendErr.Error(),
+		Content:             pp.content.ID,
+		UserID:              pp.content.UserID,
+		DealProtocolVersion: pp.miner.dealProtocolVersion,
+		MinerVersion:        pp.miner.ask.MinerVersion,
+	}); err != nil {
+		log.Errorw("failed to record deail failure", "error", err)
+	}
+	return nil
+}
+
+// queueProposal hands the proposal to the batcher for its storage provider.
+// If it fails to go out the content is checked again shortly, so its deal
+// gets made with another provider.
+func (cm *ContentManager) queueProposal(pp *pendingProposal) error {
+	err := cm.proposals.Submit(pp.miner.address.String(), dealbatch.Job{
+		Send: func(ctx context.Context) error {
+			return cm.sendProposal(ctx, pp)
+		},
+		Done: func(err error) {
+			if err != nil {
+				if err := cm.abandonProposal(pp, err); err != nil {
+					log.Errorw("failed to abandon deal proposal", "content", pp.content.ID, "miner", pp.miner.address, "error", err)
+				}
+				cm.queueMgr.add(pp.content.ID, time.Minute)
+				return
+			}
+
+			// pull transfers are started by the storage provider once it
+			// accepts the proposal
+			if !pp.isPushTransfer() {
+				return
+			}
+
+			if err := cm.StartDataTransfer(context.Background(), pp.deal); err != nil {
+				log.Errorw("failed to start data transfer", "err", err, "miner", pp.miner.address)
+			}
+		},
+	})
+	if err != nil {
+		if aerr := cm.abandonProposal(pp, err); aerr != nil {
+			return aerr
+		}
+		return err
+	}
+	return nil
+}
+
+// openProviderSession connects to a storage provider and keeps the
+// connection from being trimmed while proposals are being sent over it
+func (cm *ContentManager) openProviderSession(ctx context.Context, key string) (func(), error) {
+	maddr, err := address.NewFromString(key)
+	if err != nil {
+		return nil, err
+	}
+
+	_, release, err := cm.spConns.Acquire(ctx, maddr, dealSessionTag)
+	return release, err
+}
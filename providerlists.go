@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/filecoin-project/go-address"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// userProviderRule allows or denies a storage provider for the deals of the
+// content of a user. Users with allowed providers only get deals with them.
+type userProviderRule struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	UserID uint   `gorm:"index;uniqueIndex:idx_user_provider"`
+	Miner  string `gorm:"uniqueIndex:idx_user_provider"`
+	Allow  bool
+}
+
+// dealConstraint records that the providers a content may be dealt to were
+// too few to make the deals it needed
+type dealConstraint struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	Content   uint   `gorm:"uniqueIndex" json:"-"`
+	Needed    int    `json:"needed"`
+	Available int    `json:"available"`
+	Message   string `json:"message"`
+}
+
+// providerExclusions returns the providers the content of a user can't be
+// dealt to, from the lists of the user and of their plan, and whether there
+// are any such lists at all
+func (cm *ContentManager) providerExclusions(ctx context.Context, uid uint) (map[address.Address]bool, bool, error) {
+	var u User
+	if err := cm.DB.WithContext(ctx).Select("id, plan").First(&u, "id = ?", uid).Error; err != nil {
+		return nil, false, err
+	}
+	name := u.Plan
+	if name == "" {
+		name = cm.defaultPlan
+	}
+	plan := cm.providerLists.Plan(name)
+
+	var rules []userProviderRule
+	if err := cm.DB.WithContext(ctx).Find(&rules, "user_id = ?", uid).Error; err != nil {
+		return nil, false, err
+	}
+	if len(rules) == 0 && len(plan.Allow) == 0 && len(plan.Deny) == 0 {
+		return nil, false, nil
+	}
+
+	exclude := make(map[address.Address]bool)
+	var allows []map[string]bool
+	if len(plan.Allow) > 0 {
+		allow := make(map[string]bool, len(plan.Allow))
+		for _, m := range plan.Allow {
+			a, err := address.NewFromString(m)
+			if err != nil {
+				return nil, false, err
+			}
+			allow[a.String()] = true
+		}
+		allows = append(allows, allow)
+	}
+	for _, m := range plan.Deny {
+		a, err := address.NewFromString(m)
+		if err != nil {
+			return nil, false, err
+		}
+		exclude[a] = true
+	}
+
+	userAllow := make(map[string]bool)
+	for _, r := range rules {
+		if r.Allow {
+			userAllow[r.Miner] = true
+			continue
+		}
+		if a, err := address.NewFromString(r.Miner); err == nil {
+			exclude[a] = true
+		}
+	}
+	if len(userAllow) > 0 {
+		allows = append(allows, userAllow)
+	}
+
+	if len(allows) > 0 {
+		var miners []storageMiner
+		if err := cm.DB.WithContext(ctx).Select("address").Find(&miners).Error; err != nil {
+			return nil, false, err
+		}
+		for _, m := range miners {
+			for _, allow := range allows {
+				if !allow[m.Address.Addr.String()] {
+					exclude[m.Address.Addr] = true
+					break
+				}
+			}
+		}
+	}
+	return exclude, true, nil
+}
+
+// dealsAllowed returns whether every deal of the content owner is with a
+// provider the content of the user uid may be dealt to
+func (cm *ContentManager) dealsAllowed(ctx context.Context, owner uint, uid uint) (bool, error) {
+	exclude, has, err := cm.providerExclusions(ctx, uid)
+	if err != nil {
+		return false, err
+	}
+	if !has {
+		return true, nil
+	}
+
+	var miners []string
+	if err := cm.DB.WithContext(ctx).Model(&contentDeal{}).Distinct().
+		Where("content = ? AND NOT failed AND NOT slashed", owner).
+		Pluck("miner", &miners).Error; err != nil {
+		return false, err
+	}
+	for _, m := range miners {
+		a, err := address.NewFromString(m)
+		if err != nil || exclude[a] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// recordDealConstraint keeps track of content that can't get all of its
+// deals because of the providers it may be dealt to, and forgets it once
+// enough of them are found
+func (cm *ContentManager) recordDealConstraint(ctx context.Context, content uint, needed, available int) {
+	db := cm.DB.WithContext(ctx)
+	if available >= needed {
+		if err := db.Where("content = ?", content).Delete(&dealConstraint{}).Error; err != nil {
+			log.Errorf("failed to clear deal constraint of content %d: %s", content, err)
+		}
+		return
+	}
+
+	row := dealConstraint{
+		Content:   content,
+		Needed:    needed,
+		Available: available,
+		Message:   fmt.Sprintf("only %d of the %d providers needed are allowed by the provider lists", available, needed),
+	}
+	if err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "content"}},
+		DoUpdates: clause.AssignmentColumns([]string{"needed", "available", "message", "updated_at"}),
+	}).Create(&row).Error; err != nil {
+		log.Errorf("failed to record deal constraint of content %d: %s", content, err)
+	}
+}
+
+type userProvidersBody struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// handleGetUserProviders godoc
+// @Summary      Get allowed and denied storage providers
+// @Description  This endpoint returns the storage providers the user's content may and may not be dealt to. Content is dealt to every provider while none are allowed.
+// @Tags         User
+// @Produce      json
+// @Success      200  {object}  userProvidersBody
+// @Router       /user/providers [get]
+func (s *Server) handleGetUserProviders(c echo.Context, u *User) error {
+	var rules []userProviderRule
+	if err := s.DB.Order("miner").Find(&rules, "user_id = ?", u.ID).Error; err != nil {
+		return err
+	}
+
+	out := userProvidersBody{Allow: []string{}, Deny: []string{}}
+	for _, r := range rules {
+		if r.Allow {
+			out.Allow = append(out.Allow, r.Miner)
+		} else {
+			out.Deny = append(out.Deny, r.Miner)
+		}
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+// handleSetUserProviders godoc
+// @Summary      Set allowed and denied storage providers
+// @Description  This endpoint replaces the storage providers the user's content may and may not be dealt to, for example to keep it within a jurisdiction. Deals already made are kept. The lists of the user's plan apply as well.
+// @Tags         User
+// @Accept       json
+// @Produce      json
+// @Param        body  body      userProvidersBody  true  "Providers"
+// @Success      200   {object}  userProvidersBody
+// @Router       /user/providers [put]
+func (s *Server) handleSetUserProviders(c echo.Context, u *User) error {
+	var body userProvidersBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	rules := []userProviderRule{}
+	add := func(miners []string, allow bool) error {
+		for _, m := range miners {
+			a, err := address.NewFromString(m)
+			if err != nil || a.Protocol() != address.ID {
+				return &util.HttpError{
+					Code:    http.StatusBadRequest,
+					Reason:  util.ERR_INVALID_INPUT,
+					Details: fmt.Sprintf("%q is not a storage provider id address", m),
+				}
+			}
+			if seen[a.String()] {
+				return &util.HttpError{
+					Code:    http.StatusBadRequest,
+					Reason:  util.ERR_INVALID_INPUT,
+					Details: fmt.Sprintf("%s is listed more than once", a),
+				}
+			}
+			seen[a.String()] = true
+			rules = append(rules, userProviderRule{UserID: u.ID, Miner: a.String(), Allow: allow})
+		}
+		return nil
+	}
+	if err := add(body.Allow, true); err != nil {
+		return err
+	}
+	if err := add(body.Deny, false); err != nil {
+		return err
+	}
+
+	if err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", u.ID).Delete(&userProviderRule{}).Error; err != nil {
+			return err
+		}
+		if len(rules) == 0 {
+			return nil
+		}
+		return tx.Create(&rules).Error
+	}); err != nil {
+		return err
+	}
+	return s.handleGetUserProviders(c, u)
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/receipt"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	purgePending = "pending"
+	purgeRunning = "running"
+	purgeDone    = "done"
+	purgeFailed  = "failed"
+)
+
+// a purge still running after this long was cut short, by a restart, and
+// is picked up again. All of its steps can be run again.
+const purgeStaleAfter = 15 * time.Minute
+
+// a failed purge is tried again after purgeRetryAfter, up to
+// maxPurgeAttempts times, after that only when the user asks again
+const (
+	purgeRetryAfter  = time.Hour
+	maxPurgeAttempts = 5
+)
+
+// purgeRequest is a request to delete a content and everything kept of it,
+// with when each step was done. Receipt holds the receipt.SignedPurge as
+// json once the purge is done.
+type purgeRequest struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	UserID uint `gorm:"index"`
+	// Namespace is the namespace of the content, kept to scope the purge to
+	// it once the content is gone
+	Namespace string `gorm:"index"`
+	Content   uint   `gorm:"index"`
+	Cid       util.DbCID
+	Size      int64
+	Status    string `gorm:"index"`
+	Error     string
+	// Attempts is how many times the purge was run
+	Attempts int
+
+	// BlocksReclaimed are the blocks deleted from this node, BlocksKept
+	// the ones other content still references
+	BlocksReclaimed int
+	BlocksKept      int
+
+	PinsCancelledAt   time.Time
+	UnpinnedAt        time.Time
+	BlocksReclaimedAt time.Time
+	DealsStoppedAt    time.Time
+	CompletedAt       time.Time
+
+	Receipt string
+}
+
+// purgeContent runs the steps of a purge it could claim, recording each as
+// it is done
+func (cm *ContentManager) purgeContent(ctx context.Context, id uint) error {
+	res := cm.DB.WithContext(ctx).Model(&purgeRequest{}).
+		Where("id = ? AND (status = ? OR (status = ? AND updated_at < ?))", id, purgePending, purgeRunning, time.Now().Add(-purgeStaleAfter)).
+		UpdateColumns(map[string]interface{}{"status": purgeRunning, "updated_at": time.Now(), "attempts": gorm.Expr("attempts + 1")})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		// someone else has it
+		return nil
+	}
+
+	var pr purgeRequest
+	if err := cm.DB.First(&pr, "id = ?", id).Error; err != nil {
+		return err
+	}
+
+	if err := cm.runPurge(ctx, &pr); err != nil {
+		log.Errorf("failed to purge content %d: %s", pr.Content, err)
+		return cm.DB.Model(&purgeRequest{}).Where("id = ?", pr.ID).UpdateColumns(map[string]interface{}{
+			"status":     purgeFailed,
+			"error":      err.Error(),
+			"updated_at": time.Now(),
+		}).Error
+	}
+	return nil
+}
+
+func (cm *ContentManager) purgeStep(pr *purgeRequest, column string, at *time.Time) error {
+	if !at.IsZero() {
+		return nil
+	}
+	*at = time.Now()
+	return cm.DB.Model(&purgeRequest{}).Where("id = ?", pr.ID).UpdateColumn(column, *at).Error
+}
+
+func (cm *ContentManager) runPurge(ctx context.Context, pr *purgeRequest) error {
+	// the children of a split dag go with it
+	var conts []util.Content
+	if err := cm.DB.Unscoped().Find(&conts, "id = ? OR (split_from = ? AND split_from > 0)", pr.Content, pr.Content).Error; err != nil {
+		return err
+	}
+	ids := make([]uint, 0, len(conts))
+	for _, c := range conts {
+		ids = append(ids, c.ID)
+	}
+
+	// nothing is fetched for the content from here on
+	if err := cm.DB.Model(&util.Content{}).Where("id IN ?", ids).Update("replace", true).Error; err != nil {
+		return err
+	}
+	cm.pinLk.Lock()
+	for _, id := range ids {
+		if op, ok := cm.pinJobs[id]; ok {
+			op.Cancel()
+			delete(cm.pinJobs, id)
+		}
+	}
+	cm.pinLk.Unlock()
+
+	// content waiting in a staging zone is taken out before it is
+	// aggregated, content already aggregated stays in the deals of the
+	// aggregate
+	for i, c := range conts {
+		if c.AggregatedIn == 0 || !cm.removeFromStagingZone(c) {
+			continue
+		}
+		if err := cm.DB.Model(&util.Content{}).Unscoped().Where("id = ?", c.ID).UpdateColumn("aggregated_in", 0).Error; err != nil {
+			return err
+		}
+		conts[i].AggregatedIn = 0
+	}
+	if err := cm.purgeStep(pr, "pins_cancelled_at", &pr.PinsCancelledAt); err != nil {
+		return err
+	}
+
+	locations := make(map[string][]uint)
+	for _, c := range conts {
+		switch c.Location {
+		case constants.ContentLocationLocal, constants.ContentLocationRemote, constants.ContentLocationCluster, "":
+		default:
+			locations[c.Location] = append(locations[c.Location], c.ID)
+		}
+	}
+	for loc, ids := range locations {
+		if err := cm.sendUnpinCmd(ctx, loc, ids); err != nil {
+			return fmt.Errorf("failed to unpin from shuttle %s: %w", loc, err)
+		}
+	}
+	if err := cm.purgeStep(pr, "unpinned_at", &pr.UnpinnedAt); err != nil {
+		return err
+	}
+
+	// reclaimContent removes what is pinned remotely or on cluster, and the
+	// blocks here that nothing else references. The counts are kept as
+	// they go, content unpinned by an earlier attempt isn't counted again
+	for _, c := range conts {
+		if c.DeletedAt.Valid {
+			continue
+		}
+		reclaimed, kept, err := cm.reclaimContent(ctx, c.ID)
+		pr.BlocksReclaimed += reclaimed
+		pr.BlocksKept += kept
+		if uerr := cm.DB.Model(&purgeRequest{}).Where("id = ?", pr.ID).UpdateColumns(map[string]interface{}{
+			"blocks_reclaimed": pr.BlocksReclaimed,
+			"blocks_kept":      pr.BlocksKept,
+		}).Error; uerr != nil {
+			return uerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := cm.purgeStep(pr, "blocks_reclaimed_at", &pr.BlocksReclaimedAt); err != nil {
+		return err
+	}
+
+	// the deals of the content are deleted, so they are no longer checked,
+	// renewed or made again, and unlike with a plain removal they aren't
+	// handed over. Deals deleted by an earlier attempt still go in the
+	// receipt
+	var deals []contentDeal
+	if err := cm.DB.Unscoped().Find(&deals, "content IN ? AND deal_id > 0 AND NOT failed", ids).Error; err != nil {
+		return err
+	}
+	if err := cm.DB.Where("content IN ?", ids).Delete(&contentDeal{}).Error; err != nil {
+		return err
+	}
+	if err := cm.purgeStep(pr, "deals_stopped_at", &pr.DealsStoppedAt); err != nil {
+		return err
+	}
+
+	// the deals of an aggregate hold the other content in it too, so they
+	// run on, and the receipt says so
+	var aggregate string
+	var aggDeals []receipt.Deal
+	for _, c := range conts {
+		if c.AggregatedIn == 0 {
+			continue
+		}
+		var agg util.Content
+		if err := cm.DB.Unscoped().First(&agg, "id = ?", c.AggregatedIn).Error; err != nil {
+			return err
+		}
+		var adeals []contentDeal
+		if err := cm.DB.Find(&adeals, "content = ? AND deal_id > 0 AND NOT failed", agg.ID).Error; err != nil {
+			return err
+		}
+		aggregate = agg.Cid.CID.String()
+		aggDeals = toReceiptDeals(adeals)
+		break
+	}
+
+	rdeals := toReceiptDeals(deals)
+	locs := []string{cm.Node.Host.ID().String()}
+	for loc := range locations {
+		var sh Shuttle
+		if err := cm.DB.First(&sh, "handle = ?", loc).Error; err == nil {
+			locs = append(locs, sh.PeerID)
+		}
+	}
+
+	pr.CompletedAt = time.Now()
+	key := cm.Node.Host.Peerstore().PrivKey(cm.Node.Host.ID())
+	signed, err := receipt.SignPurge(receipt.Purge{
+		Cid:               pr.Cid.CID.String(),
+		Size:              pr.Size,
+		RequestedAt:       pr.CreatedAt,
+		PinsCancelledAt:   pr.PinsCancelledAt,
+		UnpinnedAt:        pr.UnpinnedAt,
+		BlocksReclaimedAt: pr.BlocksReclaimedAt,
+		DealsStoppedAt:    pr.DealsStoppedAt,
+		CompletedAt:       pr.CompletedAt,
+		Locations:         locs,
+		Deals:             rdeals,
+		BlocksReclaimed:   pr.BlocksReclaimed,
+		BlocksKept:        pr.BlocksKept,
+		Aggregate:         aggregate,
+		AggregateDeals:    aggDeals,
+	}, key)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(signed)
+	if err != nil {
+		return err
+	}
+
+	// nothing of the content is kept once the purge is done: its rows go
+	// for good, and with them the collections and share links it was in
+	return cm.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("content IN ?", ids).Delete(&CollectionRef{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("content IN ?", ids).Delete(&shareLink{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("id IN ?", ids).Delete(&util.Content{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&purgeRequest{}).Where("id = ?", pr.ID).UpdateColumns(map[string]interface{}{
+			"status":       purgeDone,
+			"completed_at": pr.CompletedAt,
+			"receipt":      string(b),
+			"error":        "",
+		}).Error
+	})
+}
+
+func toReceiptDeals(deals []contentDeal) []receipt.Deal {
+	rdeals := make([]receipt.Deal, 0, len(deals))
+	for _, d := range deals {
+		rdeals = append(rdeals, receipt.Deal{Miner: d.Miner, DealID: d.DealID})
+	}
+	return rdeals
+}
+
+// runPurges picks up purges that were not started, cut short, or failed a
+// while ago and have attempts left
+func (s *Server) runPurges(ctx context.Context) error {
+	if err := s.DB.WithContext(ctx).Model(&purgeRequest{}).
+		Where("status = ? AND attempts < ? AND updated_at < ?", purgeFailed, maxPurgeAttempts, time.Now().Add(-purgeRetryAfter)).
+		UpdateColumn("status", purgePending).Error; err != nil {
+		return err
+	}
+
+	var ids []uint
+	if err := s.DB.WithContext(ctx).Model(&purgeRequest{}).
+		Where("status = ? OR (status = ? AND updated_at < ?)", purgePending, purgeRunning, time.Now().Add(-purgeStaleAfter)).
+		Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := s.CM.purgeContent(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type purgeResponse struct {
+	ID                uint                 `json:"id"`
+	Content           uint                 `json:"content"`
+	Cid               string               `json:"cid"`
+	Status            string               `json:"status"`
+	Error             string               `json:"error,omitempty"`
+	Attempts          int                  `json:"attempts"`
+	BlocksReclaimed   int                  `json:"blocksReclaimed"`
+	BlocksKept        int                  `json:"blocksKept"`
+	RequestedAt       time.Time            `json:"requestedAt"`
+	PinsCancelledAt   *time.Time           `json:"pinsCancelledAt,omitempty"`
+	UnpinnedAt        *time.Time           `json:"unpinnedAt,omitempty"`
+	BlocksReclaimedAt *time.Time           `json:"blocksReclaimedAt,omitempty"`
+	DealsStoppedAt    *time.Time           `json:"dealsStoppedAt,omitempty"`
+	CompletedAt       *time.Time           `json:"completedAt,omitempty"`
+	Receipt           *receipt.SignedPurge `json:"receipt,omitempty"`
+}
+
+func optTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func newPurgeResponse(pr *purgeRequest) (*purgeResponse, error) {
+	resp := &purgeResponse{
+		ID:                pr.ID,
+		Content:           pr.Content,
+		Cid:               pr.Cid.CID.String(),
+		Status:            pr.Status,
+		Error:             pr.Error,
+		Attempts:          pr.Attempts,
+		BlocksReclaimed:   pr.BlocksReclaimed,
+		BlocksKept:        pr.BlocksKept,
+		RequestedAt:       pr.CreatedAt,
+		PinsCancelledAt:   optTime(pr.PinsCancelledAt),
+		UnpinnedAt:        optTime(pr.UnpinnedAt),
+		BlocksReclaimedAt: optTime(pr.BlocksReclaimedAt),
+		DealsStoppedAt:    optTime(pr.DealsStoppedAt),
+		CompletedAt:       optTime(pr.CompletedAt),
+	}
+	if pr.Receipt != "" {
+		resp.Receipt = new(receipt.SignedPurge)
+		if err := json.Unmarshal([]byte(pr.Receipt), resp.Receipt); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// handlePurgeContent godoc
+// @Summary      Purge content
+// @Description  This endpoint deletes a content for good: pins of it are cancelled, it is unpinned everywhere it is stored, its blocks are reclaimed and its deals are no longer renewed. Once done, nothing of it is kept, it is taken out of collections and its share links go. The purge runs in the background, its status and, once done, a signed receipt of when each step was done are returned by /content/purges/{id}. A failed purge is tried again by asking again, even once the content is gone.
+// @Tags         content
+// @Produce      json
+// @Param        id   path      int  true  "Content ID"
+// @Success      202  {object}  purgeResponse
+// @Router       /content/{id}/purge [post]
+func (s *Server) handlePurgeContent(c echo.Context, u *User) error {
+	contID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "content id must be a number",
+		}
+	}
+
+	// a purge that failed part way may have deleted the content already,
+	// so it is looked up before the content
+	var pr purgeRequest
+	err = s.DB.Scopes(inNamespace(u)).Where("content = ? AND user_id = ? AND status IN ?", contID, u.ID, []string{purgePending, purgeRunning, purgeFailed}).
+		Order("id desc").First(&pr).Error
+	if err == nil {
+		if pr.Status == purgeFailed {
+			if err := s.DB.Model(&purgeRequest{}).Where("id = ? AND status = ?", pr.ID, purgeFailed).UpdateColumns(map[string]interface{}{
+				"status":   purgePending,
+				"attempts": 0,
+			}).Error; err != nil {
+				return err
+			}
+			pr.Status = purgePending
+			pr.Attempts = 0
+			s.startPurge(pr)
+		}
+		resp, err := newPurgeResponse(&pr)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusAccepted, resp)
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	content, err := s.getOwnContentByID(u, contID)
+	if err != nil {
+		return err
+	}
+
+	err = s.DB.First(&pr, "content = ? AND status IN ?", content.ID, []string{purgePending, purgeRunning}).Error
+	switch {
+	case err == nil:
+		// already being purged
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		pr = purgeRequest{
+			UserID:    u.ID,
+			Namespace: content.Namespace,
+			Content:   content.ID,
+			Cid:       content.Cid,
+			Size:      content.Size,
+			Status:    purgePending,
+		}
+		if err := s.DB.Create(&pr).Error; err != nil {
+			return err
+		}
+		s.startPurge(pr)
+	default:
+		return err
+	}
+
+	resp, err := newPurgeResponse(&pr)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusAccepted, resp)
+}
+
+func (s *Server) startPurge(pr purgeRequest) {
+	go func() {
+		if err := s.CM.purgeContent(context.Background(), pr.ID); err != nil {
+			log.Errorf("failed to purge content %d: %s", pr.Content, err)
+		}
+	}()
+}
+
+// handleGetPurge godoc
+// @Summary      Get the status of a purge
+// @Description  This endpoint returns how far a purge has got, and the signed receipt of it once it is done. The receipt can be checked by anyone against the peer id of the node.
+// @Tags         content
+// @Produce      json
+// @Param        id   path      int  true  "Purge ID"
+// @Success      200  {object}  purgeResponse
+// @Router       /content/purges/{id} [get]
+func (s *Server) handleGetPurge(c echo.Context, u *User) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	var pr purgeRequest
+	if err := s.DB.Scopes(inNamespace(u)).First(&pr, "id = ? AND user_id = ?", id, u.ID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("purge %d was not found", id),
+			}
+		}
+		return err
+	}
+
+	resp, err := newPurgeResponse(&pr)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, resp)
+}
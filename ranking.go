@@ -1,10 +1,14 @@
 package main
 
 import (
+	"net/http"
 	"sort"
 	"time"
 
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/reputation"
 	"github.com/filecoin-project/go-address"
+	"github.com/labstack/echo/v4"
 )
 
 const minerListTTL = time.Minute
@@ -28,7 +32,7 @@ func (cm *ContentManager) sortedMinerList() ([]address.Address, []*minerDealStat
 			return nil, nil, err
 		}
 
-		if !sus {
+		if !sus && !m.Excluded {
 			sortedAddrs = append(sortedAddrs, m.Miner)
 		}
 	}
@@ -55,18 +59,68 @@ type minerDealStats struct {
 	ConfirmedDeals int `json:"confirmedDeals"`
 	FailedDeals    int `json:"failedDeals"`
 	DealFaults     int `json:"dealFaults"`
+
+	SealedDeals       int     `json:"sealedDeals"`
+	AvgSealHours      float64 `json:"avgSealHours"`
+	Retrievals        int     `json:"retrievals"`
+	RetrievalFailures int     `json:"retrievalFailures"`
+	AvgRetrievalMs    int64   `json:"avgRetrievalMs"`
+
+	Reputation reputation.Score `json:"reputation"`
+	// Excluded is set when the reputation is too low to get deals
+	Excluded bool `json:"excluded"`
 }
 
 func (mds *minerDealStats) SuccessRatio() float64 {
+	if mds.TotalDeals == 0 {
+		return 0
+	}
 	return float64(mds.ConfirmedDeals) / float64(mds.TotalDeals)
 }
 
-// The comparison function that decides 'miner X is better than miner Y'
+// The comparison function that decides 'miner X is better than miner Y',
+// miners scored the same, like those not seen yet, go by their deals
 func (mds *minerDealStats) Better(o *minerDealStats) bool {
+	if mds.Reputation.Total != o.Reputation.Total {
+		return mds.Reputation.Total > o.Reputation.Total
+	}
 	return mds.SuccessRatio() > o.SuccessRatio()
 }
 
+// observations is how many deals and retrievals the reputation of a miner
+// is built on
+func (mds *minerDealStats) observations() int {
+	return mds.ConfirmedDeals + mds.FailedDeals + mds.Retrievals + mds.RetrievalFailures
+}
+
+// lowReputation tells whether a miner was seen enough to know it shouldn't
+// get deals
+func (cm *ContentManager) lowReputation(mds *minerDealStats) bool {
+	return mds.observations() >= cm.reputationCfg.MinObservations && mds.Reputation.Total < cm.reputationCfg.MinScore
+}
+
+// minerReputations returns the stats of the miners with deals, by address
+func (cm *ContentManager) minerReputations() (map[address.Address]*minerDealStats, error) {
+	_, sml, err := cm.sortedMinerList()
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[address.Address]*minerDealStats, len(sml))
+	for _, st := range sml {
+		out[st.Miner] = st
+	}
+	return out, nil
+}
+
+// computeSortedMinerList ranks the miners with deals by what was seen of
+// them within the reputation window, so a miner that got no deals for
+// scoring low is scored again once its old deals fall out of it
 func (cm *ContentManager) computeSortedMinerList() ([]*minerDealStats, error) {
+	var since time.Time
+	if cm.reputationCfg.Window > 0 {
+		since = time.Now().Add(-cm.reputationCfg.Window)
+	}
+
 	var deals []contentDeal
 	if err := cm.DB.Find(&deals).Error; err != nil {
 		return nil, err
@@ -86,21 +140,80 @@ func (cm *ContentManager) computeSortedMinerList() ([]*minerDealStats, error) {
 			}
 			stats[maddr] = st
 		}
+		if d.CreatedAt.Before(since) {
+			continue
+		}
 
 		st.TotalDeals++
 		if d.DealID > 0 {
-			if d.Failed {
+			if d.Failed || d.Slashed {
 				st.DealFaults++
 			} else {
 				st.ConfirmedDeals++
 			}
+			if d.SealedAt.After(d.OnChainAt) {
+				st.SealedDeals++
+				st.AvgSealHours += d.SealedAt.Sub(d.CreatedAt).Hours()
+			}
 		} else if d.Failed {
 			st.FailedDeals++
 		}
 	}
 
+	var retrievals []struct {
+		Miner      string
+		Count      int
+		DurationMs float64
+	}
+	if err := cm.DB.Model(&retrievalSuccessRecord{}).
+		Select("miner, COUNT(*) AS count, AVG(duration_ms) AS duration_ms").
+		Where("created_at > ?", since).
+		Group("miner").Scan(&retrievals).Error; err != nil {
+		return nil, err
+	}
+	var failures []struct {
+		Miner string
+		Count int
+	}
+	if err := cm.DB.Model(&util.RetrievalFailureRecord{}).
+		Select("miner, COUNT(*) AS count").
+		Where("created_at > ?", since).
+		Group("miner").Scan(&failures).Error; err != nil {
+		return nil, err
+	}
+	// only miners deals were made with are ranked
+	for _, r := range retrievals {
+		if maddr, err := address.NewFromString(r.Miner); err == nil && stats[maddr] != nil {
+			stats[maddr].Retrievals = r.Count
+			stats[maddr].AvgRetrievalMs = int64(r.DurationMs)
+		}
+	}
+	for _, f := range failures {
+		if maddr, err := address.NewFromString(f.Miner); err == nil && stats[maddr] != nil {
+			stats[maddr].RetrievalFailures = f.Count
+		}
+	}
+
+	params := reputation.Params{
+		SealTarget:    cm.reputationCfg.SealTarget,
+		LatencyTarget: cm.reputationCfg.LatencyTarget,
+	}
 	minerStatsArr := make([]*minerDealStats, 0, len(stats))
 	for _, st := range stats {
+		if st.SealedDeals > 0 {
+			st.AvgSealHours /= float64(st.SealedDeals)
+		}
+		st.Reputation = params.Score(reputation.Observations{
+			Proposed:          st.ConfirmedDeals + st.DealFaults + st.FailedDeals,
+			Accepted:          st.ConfirmedDeals + st.DealFaults,
+			Faults:            st.DealFaults,
+			Sealed:            st.SealedDeals,
+			SealTime:          time.Duration(st.AvgSealHours * float64(time.Hour)),
+			Retrievals:        st.Retrievals,
+			RetrievalFailures: st.RetrievalFailures,
+			RetrievalLatency:  time.Duration(st.AvgRetrievalMs) * time.Millisecond,
+		})
+		st.Excluded = cm.lowReputation(st)
 		minerStatsArr = append(minerStatsArr, st)
 	}
 
@@ -110,3 +223,27 @@ func (cm *ContentManager) computeSortedMinerList() ([]*minerDealStats, error) {
 
 	return minerStatsArr, nil
 }
+
+// handleAdminGetMinerReputations godoc
+// @Summary      List the reputation of miners
+// @Description  This endpoint lists the miners with deals by reputation, best first, with whether their reputation is too low for them to get deals. With excluded=true only those are listed.
+// @Tags         admin
+// @Produce      json
+// @Param        excluded  query     bool  false  "Only list the miners excluded from deals"
+// @Success      200       {array}   minerDealStats
+// @Router       /admin/miners/reputation [get]
+func (s *Server) handleAdminGetMinerReputations(c echo.Context) error {
+	_, sml, err := s.CM.sortedMinerList()
+	if err != nil {
+		return err
+	}
+
+	out := make([]*minerDealStats, 0, len(sml))
+	for _, st := range sml {
+		if c.QueryParam("excluded") == "true" && !st.Excluded {
+			continue
+		}
+		out = append(out, st)
+	}
+	return c.JSON(http.StatusOK, out)
+}
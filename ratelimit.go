@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util"
+)
+
+// pinQueueRetryAfter is what users over their queued pin limit are told to
+// wait, there is no telling when their pins will be worked through
+const pinQueueRetryAfter = time.Minute
+
+// apiLimits holds the limits applied to api requests, they are replaced
+// when the config is reloaded
+type apiLimits struct {
+	lk            sync.RWMutex
+	cfg           config.RateLimit
+	requests      *util.RateLimiter
+	maxQueuedPins int64
+}
+
+func (l *apiLimits) set(rl config.RateLimit, pq config.PinQueue) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	// keep the buckets users have already drawn from unless the limit
+	// actually changed
+	if rl != l.cfg || l.requests == nil {
+		l.cfg = rl
+		l.requests = nil
+		if rl.RequestsPerSecond > 0 {
+			l.requests = util.NewRateLimiter(rl.RequestsPerSecond, rl.Burst)
+		}
+	}
+	l.maxQueuedPins = pq.MaxQueuedPerUser
+}
+
+// checkRequest applies the api rate limit of a user to a request
+func (l *apiLimits) checkRequest(c echo.Context, u *User) error {
+	if u.Perm >= util.PermLevelAdmin {
+		return nil
+	}
+
+	l.lk.RLock()
+	rl := l.requests
+	l.lk.RUnlock()
+
+	if rl == nil {
+		return nil
+	}
+	return rl.Check(c, strconv.FormatUint(uint64(u.ID), 10))
+}
+
+// checkPinQuota turns away a new pin with a 429 if the user already has as
+// many pins waiting in the queue as they are allowed
+func (s *Server) checkPinQuota(c echo.Context, u *User) error {
+	s.limits.lk.RLock()
+	max := s.limits.maxQueuedPins
+	s.limits.lk.RUnlock()
+
+	if max <= 0 {
+		return nil
+	}
+
+	var queued int64
+	if err := s.DB.Model(util.Content{}).
+		Where("user_id = ? and pinning and not active and not failed", u.ID).
+		Count(&queued).Error; err != nil {
+		return err
+	}
+
+	info := util.LimitInfo{Limit: max, Remaining: max - queued}
+	if queued >= max {
+		info.Remaining = 0
+		info.Reset = pinQueueRetryAfter
+		return util.TooManyRequests(c, util.ERR_PIN_QUEUE_FULL, info,
+			fmt.Sprintf("you have %d pins waiting to be processed, the limit is %d", queued, max))
+	}
+	info.SetHeaders(c)
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/receipt"
+	"github.com/labstack/echo/v4"
+)
+
+// what a receipt was issued after
+const (
+	receiptPinned = "pinned"
+	receiptDeal   = "deal"
+)
+
+// storageReceipt is a signed receipt issued for a content, Signed holds the
+// receipt.Signed as json
+type storageReceipt struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	Content uint `gorm:"index"`
+	Kind    string
+	Signed  string
+}
+
+// issueReceipt signs a receipt of where the content is stored and the
+// active deals it is in
+func (cm *ContentManager) issueReceipt(ctx context.Context, contID uint, kind string) {
+	if !cm.receiptsCfg.Enabled || (kind == receiptDeal && !cm.receiptsCfg.AfterDeals) {
+		return
+	}
+
+	var content util.Content
+	if err := cm.DB.First(&content, "id = ?", contID).Error; err != nil {
+		log.Errorf("failed to get content %d to issue a receipt: %s", contID, err)
+		return
+	}
+
+	loc := cm.Node.Host.ID().String()
+	if content.Location != constants.ContentLocationLocal {
+		var sh Shuttle
+		if err := cm.DB.First(&sh, "handle = ?", content.Location).Error; err != nil {
+			log.Errorf("failed to get shuttle %s to issue a receipt: %s", content.Location, err)
+			return
+		}
+		loc = sh.PeerID
+	}
+
+	var deals []contentDeal
+	if err := cm.DB.Find(&deals, "content = ? AND deal_id > 0 AND NOT failed AND NOT slashed AND sealed_at > on_chain_at", contID).Error; err != nil {
+		log.Errorf("failed to get deals of content %d to issue a receipt: %s", contID, err)
+		return
+	}
+	rdeals := make([]receipt.Deal, 0, len(deals))
+	for _, d := range deals {
+		rdeals = append(rdeals, receipt.Deal{Miner: d.Miner, DealID: d.DealID})
+	}
+
+	key := cm.Node.Host.Peerstore().PrivKey(cm.Node.Host.ID())
+	signed, err := receipt.Sign(receipt.Receipt{
+		Cid:       content.Cid.CID.String(),
+		Size:      content.Size,
+		IssuedAt:  time.Now(),
+		Locations: []string{loc},
+		Deals:     rdeals,
+	}, key)
+	if err != nil {
+		log.Errorf("failed to sign receipt for content %d: %s", contID, err)
+		return
+	}
+
+	b, err := json.Marshal(signed)
+	if err != nil {
+		log.Errorf("failed to encode receipt for content %d: %s", contID, err)
+		return
+	}
+	if err := cm.DB.WithContext(ctx).Create(&storageReceipt{
+		Content: contID,
+		Kind:    kind,
+		Signed:  string(b),
+	}).Error; err != nil {
+		log.Errorf("failed to save receipt for content %d: %s", contID, err)
+	}
+}
+
+type receiptResponse struct {
+	ID        uint            `json:"id"`
+	Kind      string          `json:"kind"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Receipt   *receipt.Signed `json:"receipt"`
+}
+
+// handleGetContentReceipts godoc
+// @Summary      Get storage receipts
+// @Description  This endpoint returns the signed storage receipts of a content, newest first. A receipt is issued once the content is pinned and each time one of its deals goes active, and can be checked by anyone against the peer id of the node.
+// @Tags         content
+// @Produce      json
+// @Param        content  path  int  true  "Content ID"
+// @Success      200  {array}  receiptResponse
+// @Router       /content/receipts/{content} [get]
+func (s *Server) handleGetContentReceipts(c echo.Context, u *User) error {
+	contID, err := strconv.Atoi(c.Param("content"))
+	if err != nil {
+		return err
+	}
+
+	var content util.Content
+	if err := s.DB.First(&content, contID).Error; err != nil {
+		return err
+	}
+
+	if err := checkContentOwner(u, &content); err != nil {
+		return err
+	}
+
+	var receipts []storageReceipt
+	if err := s.DB.Order("id desc").Find(&receipts, "content = ?", content.ID).Error; err != nil {
+		return err
+	}
+
+	out := make([]receiptResponse, 0, len(receipts))
+	for _, r := range receipts {
+		var signed receipt.Signed
+		if err := json.Unmarshal([]byte(r.Signed), &signed); err != nil {
+			return err
+		}
+		out = append(out, receiptResponse{
+			ID:        r.ID,
+			Kind:      r.Kind,
+			CreatedAt: r.CreatedAt,
+			Receipt:   &signed,
+		})
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+type verifyReceiptResponse struct {
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+	// IssuedHere is set for receipts signed by this node
+	IssuedHere bool `json:"issuedHere"`
+}
+
+// handleVerifyReceipt godoc
+// @Summary      Verify a storage receipt
+// @Description  This endpoint checks the signature of a storage receipt against the peer id of its issuer.
+// @Tags         public
+// @Accept       json
+// @Produce      json
+// @Param        body  body      receipt.Signed  true  "Signed receipt"
+// @Success      200   {object}  verifyReceiptResponse
+// @Router       /public/receipts/verify [post]
+func (s *Server) handleVerifyReceipt(c echo.Context) error {
+	var signed receipt.Signed
+	if err := c.Bind(&signed); err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "body must be a signed receipt",
+		}
+	}
+
+	resp := verifyReceiptResponse{Valid: true}
+	if err := signed.Verify(); err != nil {
+		resp.Valid = false
+		resp.Error = err.Error()
+	}
+	resp.IssuedHere = signed.Receipt.Issuer == s.Node.Host.ID().String()
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const eventRedealing = "content.redealing"
+
+const (
+	redealQueued    = "queued"
+	redealRestoring = "restoring"
+	redealFailed    = "failed"
+)
+
+// contentRetention is how long a user wants a content kept on deals, Until
+// is nil to keep it forever
+type contentRetention struct {
+	ID        uint `gorm:"primarykey"`
+	UpdatedAt time.Time
+
+	Content uint `gorm:"uniqueIndex"`
+	Until   *time.Time
+}
+
+// contentRedeal is the last time a content that ran out of deals was put
+// back into the deal pipeline
+type contentRedeal struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	Content     uint      `gorm:"uniqueIndex" json:"-"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	Attempts    int       `json:"attempts"`
+	LastAttempt time.Time `json:"lastAttempt"`
+}
+
+// retainedUntil returns until when a content is kept on deals, nil for
+// forever
+func (cm *ContentManager) retainedUntil(ctx context.Context, content util.Content) (*time.Time, error) {
+	var r contentRetention
+	if err := cm.DB.WithContext(ctx).First(&r, "content = ?", content.ID).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		if cm.redealCfg.Retention <= 0 {
+			return nil, nil
+		}
+		until := content.CreatedAt.Add(cm.redealCfg.Retention)
+		return &until, nil
+	}
+	return r.Until, nil
+}
+
+// retained reports whether deals should still be made for a content
+func (cm *ContentManager) retained(ctx context.Context, content util.Content) bool {
+	until, err := cm.retainedUntil(ctx, content)
+	if err != nil {
+		log.Warnf("failed to get retention of content %d: %s", content.ID, err)
+		return true
+	}
+	return until == nil || time.Now().Before(*until)
+}
+
+// redealContents puts content whose deals all ran out or failed back into
+// the deal pipeline. Content that was offloaded is restored from its deals
+// first, which providers often can still serve after the deals ended.
+func (s *Server) redealContents(ctx context.Context) error {
+	cfg := s.estuaryCfg.Redeal
+	head, err := s.Api.ChainHead(ctx)
+	if err != nil {
+		return err
+	}
+	epoch := int64(head.Height())
+
+	// content past its retention is left out here, so it doesn't hold up
+	// the batch
+	now := time.Now()
+	q := s.DB.WithContext(ctx).
+		Where("id NOT IN (?)", s.DB.Model(&contentRetention{}).Select("content").Where("until IS NOT NULL AND until <= ?", now))
+	if cfg.Retention > 0 {
+		q = q.Where("(created_at > ? OR id IN (?))", now.Add(-cfg.Retention),
+			s.DB.Model(&contentRetention{}).Select("content").Where("until IS NULL OR until > ?", now))
+	}
+
+	var conts []util.Content
+	if err := q.
+		Where("active AND NOT quarantined AND aggregated_in = 0 AND NOT (dag_split AND split_from = 0)").
+		Where("EXISTS (SELECT 1 FROM content_deals WHERE content_deals.content = contents.id)").
+		Where("NOT EXISTS (SELECT 1 FROM content_deals WHERE content_deals.content = contents.id AND NOT content_deals.failed AND NOT content_deals.slashed AND (content_deals.deal_id = 0 OR content_deals.end_epoch = 0 OR content_deals.end_epoch > ?))", epoch).
+		Where("id NOT IN (?)", s.DB.Model(&contentRedeal{}).Select("content").Where("last_attempt > ?", time.Now().Add(-cfg.RetryAfter))).
+		Order("id").
+		Limit(cfg.BatchSize).
+		Find(&conts).Error; err != nil {
+		return err
+	}
+
+	for _, cont := range conts {
+		// deals that ran out no longer count towards the replication
+		if err := s.DB.WithContext(ctx).Model(&contentDeal{}).
+			Where("content = ? AND NOT failed AND end_epoch > 0 AND end_epoch <= ?", cont.ID, epoch).
+			UpdateColumns(map[string]interface{}{"failed": true, "failed_at": time.Now()}).Error; err != nil {
+			return err
+		}
+
+		status, rerr := redealQueued, error(nil)
+		if cont.Offloaded {
+			status = redealRestoring
+			if _, _, err := s.restoreContent(ctx, cont); err != nil {
+				status, rerr = redealFailed, err
+			}
+		} else {
+			s.CM.queueMgr.add(cont.ID, 0)
+		}
+		s.recordRedeal(ctx, cont.ID, status, rerr)
+	}
+	return nil
+}
+
+func (s *Server) recordRedeal(ctx context.Context, contID uint, status string, rerr error) {
+	row := contentRedeal{
+		Content:     contID,
+		Status:      status,
+		Attempts:    1,
+		LastAttempt: time.Now(),
+	}
+	if rerr != nil {
+		row.Error = rerr.Error()
+	}
+	if err := s.DB.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "content"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"status":       row.Status,
+			"error":        row.Error,
+			"attempts":     gorm.Expr("content_redeals.attempts + 1"),
+			"last_attempt": row.LastAttempt,
+			"updated_at":   row.LastAttempt,
+		}),
+	}).Create(&row).Error; err != nil {
+		log.Errorf("failed to record redeal of content %d: %s", contID, err)
+		return
+	}
+	if rerr != nil {
+		log.Warnf("failed to redeal content %d: %s", contID, rerr)
+		return
+	}
+	s.CM.recordContentEvent(ctx, eventRedealing, contID, map[string]interface{}{"status": status})
+}
+
+type retentionBody struct {
+	// Until is when the content stops being kept on deals, null to keep
+	// it forever
+	Until *time.Time `json:"until"`
+}
+
+type retentionResponse struct {
+	Until *time.Time `json:"until"`
+	// Default is set while the content has no retention of its own
+	Default bool           `json:"default"`
+	Redeal  *contentRedeal `json:"redeal,omitempty"`
+}
+
+func (s *Server) getRetention(ctx context.Context, content util.Content) (*retentionResponse, error) {
+	until, err := s.CM.retainedUntil(ctx, content)
+	if err != nil {
+		return nil, err
+	}
+
+	var own int64
+	if err := s.DB.WithContext(ctx).Model(&contentRetention{}).Where("content = ?", content.ID).Count(&own).Error; err != nil {
+		return nil, err
+	}
+	resp := &retentionResponse{Until: until, Default: own == 0}
+
+	var rd contentRedeal
+	if err := s.DB.WithContext(ctx).Where("content = ?", content.ID).Find(&rd).Error; err != nil {
+		return nil, err
+	}
+	if rd.ID != 0 {
+		resp.Redeal = &rd
+	}
+	return resp, nil
+}
+
+// handleGetContentRetention godoc
+// @Summary      Get the retention of a content
+// @Description  This endpoint returns until when a content is kept on deals, and how putting it back on deals went once they all ran out.
+// @Tags         content
+// @Produce      json
+// @Param        id   path      int  true  "Content ID"
+// @Success      200  {object}  retentionResponse
+// @Router       /content/{id}/retention [get]
+func (s *Server) handleGetContentRetention(c echo.Context, u *User) error {
+	content, err := s.getOwnContent(c, u)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.getRetention(c.Request().Context(), *content)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// handleSetContentRetention godoc
+// @Summary      Set the retention of a content
+// @Description  This endpoint sets until when a content is kept on deals. Until then new deals are made for it when its deals run out, after that they are left to run out. Deals already made are kept.
+// @Tags         content
+// @Accept       json
+// @Produce      json
+// @Param        id    path      int            true  "Content ID"
+// @Param        body  body      retentionBody  true  "Retention"
+// @Success      200   {object}  retentionResponse
+// @Router       /content/{id}/retention [put]
+func (s *Server) handleSetContentRetention(c echo.Context, u *User) error {
+	content, err := s.getOwnContent(c, u)
+	if err != nil {
+		return err
+	}
+
+	var body retentionBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if body.Until != nil && body.Until.Before(content.CreatedAt) {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("until must be after the content was added at %s", content.CreatedAt.Format(time.RFC3339)),
+		}
+	}
+
+	ctx := c.Request().Context()
+	if err := s.DB.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "content"}},
+		DoUpdates: clause.AssignmentColumns([]string{"until", "updated_at"}),
+	}).Create(&contentRetention{Content: content.ID, Until: body.Until}).Error; err != nil {
+		return err
+	}
+
+	resp, err := s.getRetention(ctx, *content)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// dealEnded reports whether a deal is past its end epoch
+func (cm *ContentManager) dealEnded(d *contentDeal) bool {
+	if d.EndEpoch == 0 {
+		return false
+	}
+	head, err := cm.Api.ChainHead(context.TODO())
+	if err != nil {
+		log.Warnf("failed to get chain head: %s", err)
+		return false
+	}
+	return d.EndEpoch <= int64(head.Height())
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/dealbatch"
+)
+
+const configPollInterval = time.Second * 10
+
+// reloadableSettings are the top level config sections that applyConfig
+// picks up on a running node. Changes to anything else are ignored until the
+// node is restarted, as are the parts of these sections that size or wire up
+// components at startup (the pin queue mode, alert notifiers, enabling or
+// disabling disk pressure checks or deal batching).
+var reloadableSettings = map[string]bool{
+	"logging":       true,
+	"replication":   true,
+	"deal":          true,
+	"pin_queue":     true,
+	"disk_pressure": true,
+	"alerts":        true,
+	"rate_limit":    true,
+}
+
+// reloadConfig reads the config file again, applies any flags given on the
+// command line over it just like on startup, and applies the result
+func (s *Server) reloadConfig(cctx *cli.Context, flags []cli.Flag) error {
+	cfg := config.NewEstuary(s.estuaryCfg.AppVersion)
+	if err := cfg.Load(cctx.String("config")); err != nil && err != config.ErrNotInitialized {
+		return err
+	}
+
+	if err := overrideSetOptions(flags, cctx, cfg); err != nil {
+		return err
+	}
+	return s.applyConfig(cfg)
+}
+
+// applyConfig changes the reloadable settings of the running node to those
+// of cfg: log levels, replication and deal parameters, the pin workers and
+// per user pin limits, the api rate limit, disk pressure thresholds and alert thresholds and intervals
+func (s *Server) applyConfig(cfg *config.Estuary) error {
+	s.reloadLk.Lock()
+	defer s.reloadLk.Unlock()
+	prev := s.reloadedCfg
+
+	if err := util.ApplyLogLevels(cfg.Logging.Levels); err != nil {
+		return err
+	}
+
+	s.CM.setDealSettings(cfg.Replication, cfg.Deal.Verified, cfg.Deal.FailOnTransferFailure)
+	s.CM.setStuckDealSettings(cfg.Deal.Stuck)
+	if s.CM.proposals != nil {
+		s.CM.proposals.SetOptions(dealbatch.Options{Pace: cfg.Deal.Batch.Pace, Idle: cfg.Deal.Batch.Idle})
+	}
+	// deal making can also be toggled from the admin api, only touch it if
+	// the config actually changed
+	if cfg.Deal.Disable != prev.Deal.Disable {
+		s.CM.setDealMakingEnabled(!cfg.Deal.Disable)
+	}
+
+	s.CM.pinMgr.SetWorkers(cfg.PinQueue.Workers)
+	s.CM.pinMgr.SetMaxActivePerUser(cfg.PinQueue.MaxActivePerUser)
+	s.CM.pinMgr.SetStallOptions(cfg.PinQueue.StallTimeout, cfg.PinQueue.MaxStallRestarts, cfg.PinQueue.StallDropOrigins)
+	s.CM.setRedispatchStalledPins(cfg.PinQueue.RedispatchStalled)
+	s.CM.setDagFetch(cfg.PinQueue.Fetch)
+	s.sessions.SetIdleTimeout(cfg.PinQueue.SessionIdleTimeout)
+	s.limits.set(cfg.RateLimit, cfg.PinQueue)
+
+	s.diskMon.SetConfig(util.DiskPressureOptions(cfg.DiskPressure))
+	if prev.DiskPressure.Enabled {
+		if err := s.jobs.SetInterval("disk-pressure", cfg.DiskPressure.CheckInterval); err != nil {
+			return err
+		}
+	}
+
+	if s.alertChecker != nil {
+		s.alertChecker.setConfig(cfg.Alerts)
+		if err := s.jobs.SetInterval("alert-checks", cfg.Alerts.CheckInterval); err != nil {
+			return err
+		}
+	}
+
+	changed, err := config.ChangedSections(prev, cfg, reloadableSettings)
+	if err != nil {
+		log.Errorf("failed to compare configs: %s", err)
+	} else if len(changed) > 0 {
+		log.Warnf("config changes to %v are not applied until the node is restarted", changed)
+	}
+
+	s.reloadedCfg = cfg
+	log.Infof("applied reloaded config")
+	return nil
+}
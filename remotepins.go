@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/pinner"
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/pinsvc"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"gorm.io/gorm"
+)
+
+// errNoPinCapacity is returned when there is nowhere to pin content
+var errNoPinCapacity = errors.New("no pinning capacity available")
+
+// why pins were delegated
+const (
+	delegatedNoCapacity = "no_capacity"
+	delegatedFailed     = "failed"
+)
+
+const eventPinDelegated = "pin.delegated"
+
+// RemotePin is content that was delegated to a remote pinning service,
+// RequestID is what the service knows the pin by
+type RemotePin struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	Content   uint                `gorm:"uniqueIndex"`
+	Service   string              `json:"service"`
+	RequestID string              `json:"requestId"`
+	Status    types.PinningStatus `gorm:"index" json:"status"`
+	Reason    string              `json:"reason"`
+}
+
+func (cm *ContentManager) delegateWhenFull() bool {
+	return cm.remotePins != nil && cm.remotePinCfg.DelegateWhenFull
+}
+
+func (cm *ContentManager) delegateFailed() bool {
+	return cm.remotePins != nil && cm.remotePinCfg.DelegateFailed
+}
+
+// delegatePin hands content to the remote pinning service and moves it to
+// the remote location
+func (cm *ContentManager) delegatePin(ctx context.Context, cont util.Content, origins []*peer.AddrInfo, reason string) error {
+	pin := types.IpfsPin{
+		CID:  cont.Cid.CID.String(),
+		Name: cont.Name,
+	}
+	for _, o := range origins {
+		addrs, err := peer.AddrInfoToP2pAddrs(o)
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			pin.Origins = append(pin.Origins, a.String())
+		}
+	}
+	if cont.PinMeta != "" {
+		if err := json.Unmarshal([]byte(cont.PinMeta), &pin.Meta); err != nil {
+			log.Warnf("content %d has invalid pinmeta: %s", cont.ID, err)
+		}
+	}
+
+	st, err := cm.remotePins.Add(ctx, pin)
+	if err != nil {
+		return fmt.Errorf("delegating pin to %s: %w", cm.remotePins.Endpoint(), err)
+	}
+
+	rp := &RemotePin{
+		Content:   cont.ID,
+		Service:   cm.remotePins.Endpoint(),
+		RequestID: st.RequestID,
+		Status:    st.Status,
+		Reason:    reason,
+	}
+	if err := cm.DB.Create(rp).Error; err != nil {
+		return err
+	}
+	if err := cm.DB.Model(util.Content{}).Where("id = ?", cont.ID).UpdateColumns(map[string]interface{}{
+		"location": constants.ContentLocationRemote,
+		"pinning":  true,
+		"failed":   false,
+	}).Error; err != nil {
+		return err
+	}
+
+	cm.pinLk.Lock()
+	delete(cm.pinJobs, cont.ID)
+	cm.pinLk.Unlock()
+
+	cm.recordContentEvent(ctx, eventPinDelegated, cont.ID, map[string]interface{}{
+		"service":   rp.Service,
+		"requestId": rp.RequestID,
+		"reason":    reason,
+	})
+	return cm.applyRemotePinStatus(rp, st.Status)
+}
+
+// retryablePinFailure reports whether a pin failed in a way another node
+// may get past: content nobody provides, or that is too large, fails
+// everywhere
+func retryablePinFailure(op *pinner.PinningOperation) bool {
+	reason, err := op.Failure()
+	switch {
+	case reason == pinner.FailureNoProviders, errors.Is(err, pinner.ErrNoProviders):
+		return false
+	case errors.Is(err, errPinOverSizeLimit), errors.Is(err, errPinOverMaxSize):
+		return false
+	default:
+		return true
+	}
+}
+
+// delegateFailedPin hands a pin that failed here to the remote service in
+// the background, it returns false if the pin is not to be delegated and
+// should fail as usual
+func (cm *ContentManager) delegateFailedPin(contID uint) bool {
+	var cont util.Content
+	if err := cm.DB.First(&cont, "id = ? AND NOT active AND NOT replace", contID).Error; err != nil {
+		return false
+	}
+	if cont.Location == constants.ContentLocationRemote {
+		return false
+	}
+	// listed since it was pinned
+	if _, ok := cm.denylist.lookup(cont.Cid.CID); ok {
+		return false
+	}
+
+	var origins []*peer.AddrInfo
+	if cont.Origins != "" {
+		_ = json.Unmarshal([]byte(cont.Origins), &origins) // origins are only a hint
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cm.remotePinCfg.Timeout)
+		defer cancel()
+
+		if err := cm.delegatePin(ctx, cont, origins, delegatedFailed); err != nil {
+			log.Errorf("failed to delegate failed pin of content %d: %s", cont.ID, err)
+			if err := cm.DB.Model(util.Content{}).Where("id = ? AND NOT active", cont.ID).UpdateColumns(map[string]interface{}{
+				"pinning":         false,
+				"failed":          true,
+				"pin_finished_at": time.Now(),
+			}).Error; err != nil {
+				log.Errorf("failed to mark content as failed in database: %s", err)
+			}
+		}
+	}()
+	return true
+}
+
+// applyRemotePinStatus records the status the service reported for a pin
+func (cm *ContentManager) applyRemotePinStatus(rp *RemotePin, status types.PinningStatus) error {
+	if status != rp.Status {
+		if err := cm.DB.Model(RemotePin{}).Where("id = ?", rp.ID).UpdateColumn("status", status).Error; err != nil {
+			return err
+		}
+		rp.Status = status
+	}
+
+	// content delegated away is never active here, it stops pinning once the
+	// service is done with it one way or the other
+	switch status {
+	case types.PinningStatusPinned:
+		return cm.DB.Model(util.Content{}).Where("id = ?", rp.Content).UpdateColumns(map[string]interface{}{
+			"pinning":         false,
+			"pin_finished_at": time.Now(),
+		}).Error
+	case types.PinningStatusFailed:
+		return cm.DB.Model(util.Content{}).Where("id = ?", rp.Content).UpdateColumns(map[string]interface{}{
+			"pinning":         false,
+			"failed":          true,
+			"pin_finished_at": time.Now(),
+		}).Error
+	}
+	return nil
+}
+
+// pollRemotePins checks on the pins the remote service hasn't finished yet
+func (cm *ContentManager) pollRemotePins(ctx context.Context) error {
+	var pending []*RemotePin
+	if err := cm.DB.Find(&pending, "status in ?", []types.PinningStatus{types.PinningStatusQueued, types.PinningStatusPinning}).Error; err != nil {
+		return err
+	}
+
+	for _, rp := range pending {
+		st, err := cm.remotePins.Get(ctx, rp.RequestID)
+		switch {
+		case errors.Is(err, pinsvc.ErrNotFound):
+			// the service dropped it
+			st = &types.IpfsPinStatusResponse{Status: types.PinningStatusFailed}
+		case err != nil:
+			log.Warnf("failed to get status of remote pin %s of content %d: %s", rp.RequestID, rp.Content, err)
+			continue
+		}
+
+		if err := cm.applyRemotePinStatus(rp, st.Status); err != nil {
+			log.Errorf("failed to update remote pin of content %d: %s", rp.Content, err)
+		}
+	}
+	return nil
+}
+
+// remotePinStatus is the status of content delegated to a remote service
+func (cm *ContentManager) remotePinStatus(cont util.Content) (*types.IpfsPinStatusResponse, error) {
+	var rp RemotePin
+	if err := cm.DB.First(&rp, "content = ?", cont.ID).Error; err != nil {
+		return nil, err
+	}
+
+	meta := make(map[string]interface{})
+	if cont.PinMeta != "" {
+		if err := json.Unmarshal([]byte(cont.PinMeta), &meta); err != nil {
+			log.Warnf("content %d has invalid pinmeta: %s", cont.ID, err)
+		}
+	}
+
+	return &types.IpfsPinStatusResponse{
+		RequestID: fmt.Sprintf("%d", cont.ID),
+		Status:    rp.Status,
+		Created:   cont.CreatedAt,
+		Pin: types.IpfsPin{
+			CID:  cont.Cid.CID.String(),
+			Name: cont.Name,
+			Meta: meta,
+		},
+		Delegates: []string{},
+		Info: map[string]interface{}{
+			"remote_service":   rp.Service,
+			"remote_requestid": rp.RequestID,
+			"delegated":        rp.Reason,
+		},
+	}, nil
+}
+
+// removeRemotePin drops the pin of content from the remote service
+func (cm *ContentManager) removeRemotePin(ctx context.Context, contID uint) error {
+	var rp RemotePin
+	if err := cm.DB.First(&rp, "content = ?", contID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	if cm.remotePins == nil || rp.Service != cm.remotePins.Endpoint() {
+		log.Warnf("remote pin %s of content %d is on %s, which is no longer configured, leaving it", rp.RequestID, contID, rp.Service)
+	} else if err := cm.remotePins.Remove(ctx, rp.RequestID); err != nil {
+		return err
+	}
+	return cm.DB.Delete(&RemotePin{}, rp.ID).Error
+}
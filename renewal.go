@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const eventDealRenewing = "deal.renewing"
+
+const defaultExpiringDays = 60
+
+// renewalPolicy is a users choice of when deals for their content are
+// renewed, users without one get the configured default
+type renewalPolicy struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	UserID     uint `gorm:"uniqueIndex"`
+	Disabled   bool
+	DaysBefore int
+}
+
+type renewalSetting struct {
+	before time.Duration
+	ok     bool
+}
+
+// renewalBefore is how long before its end a deal of the user is renewed,
+// false if the users deals aren't renewed
+func (cm *ContentManager) renewalBefore(userID uint) (time.Duration, bool) {
+	cfg := cm.dealRenewal
+	if !cfg.Enabled {
+		return 0, false
+	}
+
+	if v, ok := cm.renewalPolicies.Get(userID); ok {
+		r := v.(renewalSetting)
+		return r.before, r.ok
+	}
+
+	r := renewalSetting{before: cfg.Before, ok: true}
+	var p renewalPolicy
+	if err := cm.DB.First(&p, "user_id = ?", userID).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			// not cached, so the policy is looked up again next time
+			log.Warnf("failed to get renewal policy of user %d: %s", userID, err)
+			return r.before, r.ok
+		}
+	} else if p.Disabled {
+		r = renewalSetting{}
+	} else {
+		r.before = time.Duration(p.DaysBefore) * time.Hour * 24
+	}
+	cm.renewalPolicies.Add(userID, r)
+	return r.before, r.ok
+}
+
+// renewalWindow is renewalBefore in epochs
+func (cm *ContentManager) renewalWindow(userID uint) (abi.ChainEpoch, bool) {
+	before, ok := cm.renewalBefore(userID)
+	return abi.ChainEpoch(before / epochDuration), ok
+}
+
+// renewDeal marks a deal as being renewed, the deal keeps running until it
+// ends but no longer counts towards the replication of its content
+func (cm *ContentManager) renewDeal(ctx context.Context, d *contentDeal) error {
+	if !d.RenewedAt.IsZero() {
+		return nil
+	}
+
+	if err := cm.DB.Model(contentDeal{}).Where("id = ?", d.ID).UpdateColumn("renewed_at", time.Now()).Error; err != nil {
+		return err
+	}
+	cm.recordContentEvent(ctx, eventDealRenewing, d.Content, map[string]interface{}{
+		"miner":    d.Miner,
+		"dealId":   d.DealID,
+		"endEpoch": d.EndEpoch,
+	})
+	return nil
+}
+
+type renewalPolicyResponse struct {
+	Enabled    bool `json:"enabled"`
+	DaysBefore int  `json:"daysBefore"`
+	// Default is set while the user hasn't picked a policy
+	Default bool `json:"default"`
+}
+
+func (s *Server) getRenewalPolicy(uid uint) (*renewalPolicyResponse, error) {
+	cfg := s.CM.dealRenewal
+	resp := &renewalPolicyResponse{
+		Enabled:    cfg.Enabled,
+		DaysBefore: int(cfg.Before / (time.Hour * 24)),
+		Default:    true,
+	}
+
+	var p renewalPolicy
+	if err := s.DB.First(&p, "user_id = ?", uid).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return resp, nil
+		}
+		return nil, err
+	}
+	resp.Enabled = cfg.Enabled && !p.Disabled
+	resp.DaysBefore = p.DaysBefore
+	resp.Default = false
+	return resp, nil
+}
+
+// handleGetRenewalPolicy godoc
+// @Summary      Get deal renewal policy
+// @Description  This endpoint returns how long before they end the deals for the user's content are renewed.
+// @Tags         User
+// @Produce      json
+// @Success      200  {object}  renewalPolicyResponse
+// @Router       /user/renewal-policy [get]
+func (s *Server) handleGetRenewalPolicy(c echo.Context, u *User) error {
+	resp, err := s.getRenewalPolicy(u.ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+type renewalPolicyParams struct {
+	Enabled    bool `json:"enabled"`
+	DaysBefore int  `json:"daysBefore"`
+}
+
+// handleSetRenewalPolicy godoc
+// @Summary      Set deal renewal policy
+// @Description  This endpoint sets how many days before they end the deals for the user's content are renewed. With renewal disabled deals are only replaced once they have run out.
+// @Tags         User
+// @Accept       json
+// @Produce      json
+// @Param        body  body      renewalPolicyParams  true  "Renewal policy"
+// @Success      200   {object}  renewalPolicyResponse
+// @Router       /user/renewal-policy [put]
+func (s *Server) handleSetRenewalPolicy(c echo.Context, u *User) error {
+	var params renewalPolicyParams
+	if err := c.Bind(&params); err != nil {
+		return err
+	}
+
+	cfg := s.CM.dealRenewal
+	if !cfg.Enabled {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "deal renewal is disabled on this node",
+		}
+	}
+
+	before := time.Duration(params.DaysBefore) * time.Hour * 24
+	if params.Enabled && (before < cfg.MinBefore || before > cfg.MaxBefore) {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("daysBefore must be between %d and %d", cfg.MinBefore/(time.Hour*24), cfg.MaxBefore/(time.Hour*24)),
+		}
+	}
+
+	p := renewalPolicy{
+		UserID:     u.ID,
+		Disabled:   !params.Enabled,
+		DaysBefore: params.DaysBefore,
+	}
+	if err := s.DB.Where(renewalPolicy{UserID: u.ID}).
+		Assign(map[string]interface{}{"disabled": p.Disabled, "days_before": p.DaysBefore}).
+		FirstOrCreate(&p).Error; err != nil {
+		return err
+	}
+	s.CM.renewalPolicies.Remove(u.ID)
+
+	resp, err := s.getRenewalPolicy(u.ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+type expiringDeal struct {
+	Deal     uint      `json:"deal"`
+	Content  uint      `json:"content"`
+	Cid      string    `json:"cid"`
+	UserID   uint      `json:"userId"`
+	Miner    string    `json:"miner"`
+	DealID   int64     `json:"dealId"`
+	EndEpoch int64     `json:"endEpoch"`
+	EndsAt   time.Time `json:"endsAt"`
+	// RenewAt is when a replacement is asked for, zero if the deal isn't
+	// renewed
+	RenewAt   time.Time `json:"renewAt,omitempty"`
+	RenewedAt time.Time `json:"renewedAt,omitempty"`
+}
+
+// listExpiringDeals returns the active deals that end within the number of
+// days given in the days query param, for all users if uid is zero
+func (s *Server) listExpiringDeals(c echo.Context, uid uint) error {
+	days := defaultExpiringDays
+	if dstr := c.QueryParam("days"); dstr != "" {
+		d, err := strconv.Atoi(dstr)
+		if err != nil || d <= 0 {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_QUERY_PARAM_VALUE,
+				Details: "days must be a positive number",
+			}
+		}
+		days = d
+	}
+
+	ctx := c.Request().Context()
+	head, err := s.CM.Api.ChainHead(ctx)
+	if err != nil {
+		return err
+	}
+	until := head.Height() + abi.ChainEpoch(time.Duration(days)*time.Hour*24/epochDuration)
+
+	var deals []contentDeal
+	q := s.DB.WithContext(ctx).Where("deal_id > 0 AND NOT failed AND NOT slashed AND end_epoch > 0 AND end_epoch <= ?", until)
+	if uid != 0 {
+		q = q.Where("user_id = ?", uid)
+	}
+	if err := q.Order("end_epoch asc").Find(&deals).Error; err != nil {
+		return err
+	}
+
+	ids := make([]uint, 0, len(deals))
+	for _, d := range deals {
+		ids = append(ids, d.Content)
+	}
+	var conts []util.Content
+	if err := s.DB.WithContext(ctx).Select("id", "cid").Find(&conts, "id in ?", ids).Error; err != nil {
+		return err
+	}
+	cids := make(map[uint]string, len(conts))
+	for _, cont := range conts {
+		cids[cont.ID] = cont.Cid.CID.String()
+	}
+
+	epochTime := func(e int64) time.Time {
+		return time.Now().Add(time.Duration(e-int64(head.Height())) * epochDuration).Truncate(time.Minute)
+	}
+
+	out := make([]expiringDeal, 0, len(deals))
+	for _, d := range deals {
+		ed := expiringDeal{
+			Deal:      d.ID,
+			Content:   d.Content,
+			Cid:       cids[d.Content],
+			UserID:    d.UserID,
+			Miner:     d.Miner,
+			DealID:    d.DealID,
+			EndEpoch:  d.EndEpoch,
+			EndsAt:    epochTime(d.EndEpoch),
+			RenewedAt: d.RenewedAt,
+		}
+		if before, ok := s.CM.renewalBefore(d.UserID); ok {
+			ed.RenewAt = ed.EndsAt.Add(-before)
+		}
+		out = append(out, ed)
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+// handleGetExpiringDeals godoc
+// @Summary      Get upcoming deal expirations
+// @Description  This endpoint returns the user's active deals that end within the given number of days, with when they are renewed.
+// @Tags         deals
+// @Produce      json
+// @Param        days  query  int  false  "Number of days to look ahead, defaults to 60"
+// @Success      200  {array}  expiringDeal
+// @Router       /deals/expiring [get]
+func (s *Server) handleGetExpiringDeals(c echo.Context, u *User) error {
+	return s.listExpiringDeals(c, u.ID)
+}
+
+// handleAdminGetExpiringDeals godoc
+// @Summary      Get upcoming deal expirations for all users
+// @Description  This endpoint returns all active deals that end within the given number of days, with when they are renewed.
+// @Tags         admin
+// @Produce      json
+// @Param        days  query  int  false  "Number of days to look ahead, defaults to 60"
+// @Success      200  {array}  expiringDeal
+// @Router       /admin/deals/expiring [get]
+func (s *Server) handleAdminGetExpiringDeals(c echo.Context) error {
+	return s.listExpiringDeals(c, 0)
+}
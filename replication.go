@@ -6,6 +6,9 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
 	"sort"
 	"sync"
 	"time"
@@ -13,10 +16,24 @@ import (
 	"github.com/application-research/estuary/config"
 	"github.com/application-research/estuary/constants"
 	drpc "github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/eventstream"
+	"github.com/application-research/estuary/featureflags"
 	"github.com/application-research/estuary/node"
 	"github.com/application-research/estuary/pinner"
 	util "github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/carindex"
+	"github.com/application-research/estuary/util/cluster"
+	"github.com/application-research/estuary/util/dagsize"
 	dagsplit "github.com/application-research/estuary/util/dagsplit"
+	"github.com/application-research/estuary/util/dagwalk"
+	"github.com/application-research/estuary/util/dealbatch"
+	"github.com/application-research/estuary/util/dealfailure"
+	"github.com/application-research/estuary/util/fvm"
+	"github.com/application-research/estuary/util/gsfetch"
+	"github.com/application-research/estuary/util/piece"
+	"github.com/application-research/estuary/util/pinsvc"
+	"github.com/application-research/estuary/util/scan"
+	"github.com/application-research/estuary/util/spconn"
 	"github.com/application-research/filclient"
 	"github.com/filecoin-project/boost/transport/httptransport"
 	"github.com/filecoin-project/go-address"
@@ -59,6 +76,7 @@ type miner struct {
 	address             address.Address
 	dealProtocolVersion protocol.ID
 	ask                 *minerStorageAsk
+	snap                bool
 }
 
 type deal struct {
@@ -74,6 +92,10 @@ type ContentManager struct {
 	Provider  *batched.BatchProvidingSystem
 	Node      *node.Node
 
+	// msgLookback is how many epochs back publish messages are searched,
+	// lotus gateways refuse to search further than liteLookback
+	msgLookback abi.ChainEpoch
+
 	Host host.Host
 
 	tracer trace.Tracer
@@ -84,6 +106,9 @@ type ContentManager struct {
 
 	ToCheck  chan uint
 	queueMgr *queueManager
+	// checksStarted rebuilds the staging zones and queues all content for a
+	// check before the first content check or aggregation
+	checksStarted sync.Once
 
 	retrLk               sync.Mutex
 	retrievalsInProgress map[uint]*util.RetrievalProgress
@@ -102,14 +127,69 @@ type ContentManager struct {
 	bucketLk sync.Mutex
 	buckets  map[uint][]*contentStagingZone
 
-	// some behavior flags
+	// some behavior flags, settingsLk guards the ones that can be changed by
+	// reloading the config
+	settingsLk                sync.Mutex
 	FailDealOnTransferFailure bool
+	redispatchStalledPins     bool
+	stuckDeals                config.StuckDeals
+	snapDeals                 config.SnapDeals
+	dealRenewal               config.DealRenewal
+	datacapCfg                config.Datacap
+	boostCfg                  config.Boost
+	datacap                   datacapStatus
+	dagFetch                  config.DagFetch
+
+	// dealProgressCfg is whether the state providers return for deals is
+	// kept
+	dealProgressCfg config.DealProgress
 
 	dealDisabledLk       sync.Mutex
 	isDealMakingDisabled bool
 
 	globalContentAddingDisabled bool
 	localContentAddingDisabled  bool
+	dedupeAcrossUsers           bool
+
+	// proposals queues deal proposals per storage provider, it is nil when
+	// deal batching is disabled
+	proposals *dealbatch.Batcher
+	spConns   *spconn.Pool
+
+	// dagSizes estimates the size of content before it is fetched
+	dagSizes *dagsize.Estimator
+
+	// remotePins is the service pins are delegated to, nil unless remote
+	// pinning is enabled
+	remotePins   *pinsvc.Client
+	remotePinCfg config.RemotePinning
+
+	// cluster is the ipfs-cluster pins can go to, nil unless enabled
+	cluster    *cluster.Client
+	clusterCfg config.Cluster
+
+	// fvm is where deal attestations are sent, nil unless enabled
+	fvm    *fvm.Client
+	fvmCfg config.FVM
+
+	receiptsCfg config.Receipts
+
+	denylist *contentDenylist
+
+	// scanner is run on content before it is pinned, nil unless enabled
+	scanner scan.Scanner
+	scanCfg config.Scanning
+
+	reprovideCfg config.Reprovide
+
+	reputationCfg config.Reputation
+	providerLists config.ProviderLists
+	defaultPlan   string
+	redealCfg     config.Redeal
+
+	// carIndexes keeps where the blocks are in the CARs of the pieces
+	// computed here
+	carIndexes *carindex.Store
 
 	Replication int
 
@@ -120,18 +200,27 @@ type ContentManager struct {
 
 	pinMgr *pinner.PinManager
 
+	flags *featureflags.Manager
+
+	// events publishes content events to a broker, nil when none is configured
+	events *eventstream.Stream
+
 	shuttlesLk sync.Mutex
 	shuttles   map[string]*ShuttleConnection
+	// shuttleBandwidth is guarded by shuttlesLk
+	shuttleBandwidth map[string]bandwidthMark
 
 	remoteTransferStatus *lru.ARCCache
 
+	// renewalPolicies caches renewalBefore by user, entries are dropped when
+	// a user sets their policy
+	renewalPolicies *lru.ARCCache
+
 	inflightCids   map[cid.Cid]uint
 	inflightCidsLk sync.Mutex
 
 	VerifiedDeal bool
 
-	DisableFilecoinStorage bool
-
 	IncomingRPCMessages chan *drpc.Message
 
 	EnabledDealProtocolsVersions map[protocol.ID]bool
@@ -195,7 +284,7 @@ func (cm *ContentManager) newContentStagingZone(user uint, loc string) (*content
 		Active:      false,
 		Pinning:     true,
 		UserID:      user,
-		Replication: cm.Replication,
+		Replication: cm.replicationFactor(),
 		Aggregate:   true,
 		Location:    loc,
 	}
@@ -290,10 +379,16 @@ func NewContentManager(db *gorm.DB, api api.Gateway, fc *filclient.FilClient, tb
 		return nil, err
 	}
 
+	renewalPolicies, err := lru.NewARC(10000)
+	if err != nil {
+		return nil, err
+	}
+
 	cm := &ContentManager{
 		Provider:                     prov,
 		DB:                           db,
 		Api:                          api,
+		msgLookback:                  1000,
 		FilClient:                    fc,
 		Blockstore:                   tbs.Under().(node.EstuaryBlockstore),
 		Host:                         nd.Host,
@@ -306,21 +401,101 @@ func NewContentManager(db *gorm.DB, api api.Gateway, fc *filclient.FilClient, tb
 		pinJobs:                      make(map[uint]*pinner.PinningOperation),
 		pinMgr:                       pinmgr,
 		remoteTransferStatus:         cache,
+		renewalPolicies:              renewalPolicies,
 		shuttles:                     make(map[string]*ShuttleConnection),
+		shuttleBandwidth:             make(map[string]bandwidthMark),
 		contentSizeLimit:             constants.DefaultContentSizeLimit,
 		hostname:                     cfg.Hostname,
 		inflightCids:                 make(map[cid.Cid]uint),
 		FailDealOnTransferFailure:    cfg.Deal.FailOnTransferFailure,
+		redispatchStalledPins:        cfg.PinQueue.RedispatchStalled,
+		stuckDeals:                   cfg.Deal.Stuck,
+		snapDeals:                    cfg.Deal.Snap,
+		dealRenewal:                  cfg.Deal.Renewal,
+		datacapCfg:                   cfg.Deal.Datacap,
+		boostCfg:                     cfg.Deal.Boost,
+		dealProgressCfg:              cfg.DealProgress,
+		receiptsCfg:                  cfg.Receipts,
+		scanner:                      newScanner(cfg.Scanning),
+		scanCfg:                      cfg.Scanning,
+		reprovideCfg:                 cfg.Reprovide,
+		reputationCfg:                cfg.Reputation,
+		providerLists:                cfg.ProviderLists,
+		defaultPlan:                  cfg.Egress.DefaultPlan,
+		redealCfg:                    cfg.Redeal,
+		dagFetch:                     cfg.PinQueue.Fetch,
 		isDealMakingDisabled:         cfg.Deal.Disable,
 		globalContentAddingDisabled:  cfg.Content.DisableGlobalAdding,
 		localContentAddingDisabled:   cfg.Content.DisableLocalAdding,
+		dedupeAcrossUsers:            cfg.Content.DedupeAcrossUsers,
 		VerifiedDeal:                 cfg.Deal.Verified,
 		Replication:                  cfg.Replication,
 		tracer:                       otel.Tracer("replicator"),
-		DisableFilecoinStorage:       cfg.DisableFilecoinStorage,
 		IncomingRPCMessages:          make(chan *drpc.Message),
 		EnabledDealProtocolsVersions: cfg.Deal.EnabledDealProtocolsVersions,
 	}
+	cm.carIndexes, err = carindex.NewStore(filepath.Join(cfg.DataDir, "car-indexes"))
+	if err != nil {
+		return nil, err
+	}
+	cm.dagSizes, err = dagsize.New(dagsize.Options{
+		CacheSize: dagSizeCacheSize,
+		Local:     cm.Blockstore.Get,
+		Lookup:    cm.lookupDagSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	cm.spConns = spconn.New(spconn.HostDialer(nd.Host), fc.MinerPeer, spconn.Options{
+		MaxDials:    cfg.FilClient.ProviderConns.MaxDials,
+		BackoffBase: cfg.FilClient.ProviderConns.BackoffBase,
+		BackoffMax:  cfg.FilClient.ProviderConns.BackoffMax,
+		AddrTTL:     cfg.FilClient.ProviderConns.AddrTTL,
+	})
+
+	if rp := cfg.RemotePinning; rp.Enabled {
+		if rp.Endpoint == "" {
+			return nil, fmt.Errorf("remote pinning is enabled but no endpoint is set")
+		}
+		cm.remotePins = pinsvc.New(rp.Endpoint, rp.Token, rp.Timeout)
+		cm.remotePinCfg = rp
+	}
+
+	if cc := cfg.Cluster; cc.Enabled {
+		if cc.Endpoint == "" {
+			return nil, fmt.Errorf("cluster is enabled but no endpoint is set")
+		}
+		cm.cluster = cluster.New(cc.Endpoint, cc.Username, cc.Password, cc.Token, cc.Timeout)
+		cm.clusterCfg = cc
+	}
+
+	if fc := cfg.FVM; fc.Enabled {
+		if fc.Contract == "" || fc.KeyFile == "" {
+			return nil, fmt.Errorf("fvm is enabled but no contract or key file is set")
+		}
+		kb, err := os.ReadFile(fc.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read fvm key file: %w", err)
+		}
+		key, err := fvm.ParseKey(string(kb))
+		if err != nil {
+			return nil, fmt.Errorf("invalid fvm key: %w", err)
+		}
+		cm.fvm, err = fvm.New(fc.Endpoint, fc.Contract, key, fc.ChainID, fc.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		cm.fvmCfg = fc
+		log.Infof("sending deal attestations to %s from %s", fc.Contract, cm.fvm.From())
+	}
+
+	if cfg.Deal.Batch.Enabled {
+		cm.proposals = dealbatch.New(cm.openProviderSession, dealbatch.Options{
+			Pace: cfg.Deal.Batch.Pace,
+			Idle: cfg.Deal.Batch.Idle,
+		})
+	}
+
 	qm := newQueueManager(func(c uint) {
 		cm.ToCheck <- c
 	})
@@ -329,61 +504,67 @@ func NewContentManager(db *gorm.DB, api api.Gateway, fc *filclient.FilClient, tb
 	return cm, nil
 }
 
-func (cm *ContentManager) ContentWatcher() {
-	if err := cm.reBuildStagingZones(); err != nil {
-		log.Fatalf("failed to rebuild staging zones: %s", err)
-	}
+// contentCheckInterval is how often the deal-checks job picks up the
+// contents queued for a check
+const contentCheckInterval = time.Second * 10
 
-	// do not process content for storage if DisableFilecoinStorage is enabled
-	if cm.DisableFilecoinStorage {
-		return
-	}
+func (cm *ContentManager) startContentChecks() {
+	cm.checksStarted.Do(func() {
+		if err := cm.reBuildStagingZones(); err != nil {
+			log.Fatalf("failed to rebuild staging zones: %s", err)
+		}
 
-	if err := cm.startup(); err != nil {
-		log.Errorf("failed to recheck existing content: %s", err)
-	}
+		if err := cm.startup(); err != nil {
+			log.Errorf("failed to recheck existing content: %s", err)
+		}
+	})
+}
 
-	timer := time.NewTimer(time.Minute * 5)
+// checkContents makes sure the contents queued for a check by the time it
+// starts are stored as they should be, it runs as the deal-checks job
+func (cm *ContentManager) checkContents(ctx context.Context) error {
+	cm.startContentChecks()
 
-	for {
+	for n := len(cm.ToCheck); n > 0; n-- {
+		var c uint
 		select {
-		case c := <-cm.ToCheck:
-			var content util.Content
-			if err := cm.DB.First(&content, "id = ?", c).Error; err != nil {
-				log.Errorf("finding content %d in database: %s", c, err)
-				continue
-			}
-
-			log.Debugf("checking content: %d", content.ID)
-			err := cm.ensureStorage(context.TODO(), content, func(dur time.Duration) {
-				cm.queueMgr.add(content.ID, dur)
-			})
-			if err != nil {
-				log.Errorf("failed to ensure replication of content %d: %s", content.ID, err)
-				cm.queueMgr.add(content.ID, time.Minute*5)
-			}
+		case c = <-cm.ToCheck:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 
-		case <-timer.C:
-			log.Infow("content check queue", "length", len(cm.queueMgr.queue.elems), "nextEvent", cm.queueMgr.nextEvent)
+		var content util.Content
+		if err := cm.DB.First(&content, "id = ?", c).Error; err != nil {
+			log.Errorf("finding content %d in database: %s", c, err)
+			continue
+		}
 
-			/*
-				if err := cm.queueAllContent(); err != nil {
-					log.Errorf("rechecking content: %s", err)
-					continue
-				}
-			*/
+		log.Debugf("checking content: %d", content.ID)
+		err := cm.ensureStorage(ctx, content, func(dur time.Duration) {
+			cm.queueMgr.add(content.ID, dur)
+		})
+		if err != nil {
+			log.Errorf("failed to ensure replication of content %d: %s", content.ID, err)
+			cm.queueMgr.add(content.ID, time.Minute*5)
+		}
+	}
+	return nil
+}
 
-			buckets := cm.popReadyStagingZone()
-			for _, b := range buckets {
-				if err := cm.aggregateContent(context.TODO(), b); err != nil {
-					log.Errorf("content aggregation failed (bucket %d): %s", b.ContID, err)
-					continue
-				}
-			}
+// aggregateReadyStagingZones aggregates every staging zone that is ready to
+// be made into a deal, it runs as the staging-aggregation job
+func (cm *ContentManager) aggregateReadyStagingZones(ctx context.Context) error {
+	cm.startContentChecks()
+	log.Infow("content check queue", "length", len(cm.queueMgr.queue.elems), "nextEvent", cm.queueMgr.nextEvent)
 
-			timer.Reset(time.Minute * 5)
+	buckets := cm.popReadyStagingZone()
+	for _, b := range buckets {
+		if err := cm.aggregateContent(ctx, b); err != nil {
+			log.Errorf("content aggregation failed (bucket %d): %s", b.ContID, err)
+			continue
 		}
 	}
+	return nil
 }
 
 type queueEntry struct {
@@ -890,8 +1071,8 @@ func (cm *ContentManager) sortedMinersForDeal(ctx context.Context, out []miner,
 		}
 
 		if filterByPrice {
-			price := ask.GetPrice(cm.VerifiedDeal)
-			if cm.priceIsTooHigh(price, cm.VerifiedDeal) {
+			price := ask.GetPrice(cm.verifiedDeals())
+			if cm.priceIsTooHigh(price, cm.verifiedDeals()) {
 				continue
 			}
 		}
@@ -915,6 +1096,11 @@ func (cm *ContentManager) randomMinerListForDeal(ctx context.Context, n int, pie
 		return out, nil
 	}
 
+	reps, err := cm.minerReputations()
+	if err != nil {
+		return nil, err
+	}
+
 	rand.Shuffle(len(dbminers), func(i, j int) {
 		dbminers[i], dbminers[j] = dbminers[j], dbminers[i]
 	})
@@ -928,6 +1114,10 @@ func (cm *ContentManager) randomMinerListForDeal(ctx context.Context, n int, pie
 			continue
 		}
 
+		if st, ok := reps[dbm.Address.Addr]; ok && cm.lowReputation(st) {
+			continue
+		}
+
 		proto, err := cm.FilClient.DealProtocolForMiner(ctx, dbm.Address.Addr)
 		if err != nil {
 			log.Errorf("getting deal protocol for %s failed: %s", dbm.Address.Addr, err)
@@ -946,8 +1136,8 @@ func (cm *ContentManager) randomMinerListForDeal(ctx context.Context, n int, pie
 		}
 
 		if filterByPrice {
-			price := ask.GetPrice(cm.VerifiedDeal)
-			if cm.priceIsTooHigh(price, cm.VerifiedDeal) {
+			price := ask.GetPrice(cm.verifiedDeals())
+			if cm.priceIsTooHigh(price, cm.verifiedDeals()) {
 				continue
 			}
 		}
@@ -996,6 +1186,11 @@ func (cm *ContentManager) getAsk(ctx context.Context, m address.Address, maxCach
 		return &ask, nil
 	}
 
+	if err := cm.connectProvider(ctx, m); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
 	netask, err := cm.FilClient.GetAsk(ctx, m)
 	if err != nil {
 		span.RecordError(err)
@@ -1071,6 +1266,22 @@ type contentDeal struct {
 	SealedAt            time.Time   `json:"sealedAt"`
 	DealProtocolVersion protocol.ID `json:"deal_protocol_version"`
 	MinerVersion        string      `json:"miner_version"`
+	Snap                bool        `json:"snap"`
+
+	// EndEpoch is when the deal runs out, RenewedAt is set once a deal to
+	// replace it was asked for
+	EndEpoch  int64     `json:"endEpoch"`
+	RenewedAt time.Time `json:"renewedAt,omitempty"`
+
+	// Transfer is how a Boost provider gets the data, empty for the legacy
+	// market
+	Transfer string `json:"transfer,omitempty"`
+
+	// StuckPhase is set once the deal was found stuck, StuckRetries is how
+	// many times it was retried since
+	StuckPhase   string    `json:"stuckPhase,omitempty"`
+	StuckAt      time.Time `json:"stuckAt,omitempty"`
+	StuckRetries int       `json:"stuckRetries,omitempty"`
 }
 
 func (cd contentDeal) MinerAddr() (address.Address, error) {
@@ -1111,6 +1322,27 @@ func (cm *ContentManager) contentInStagingZone(ctx context.Context, content util
 	return false
 }
 
+// removeFromStagingZone takes a content out of the staging zone it waits in
+// to be aggregated, and returns whether it was in one
+func (cm *ContentManager) removeFromStagingZone(content util.Content) bool {
+	cm.bucketLk.Lock()
+	defer cm.bucketLk.Unlock()
+
+	for _, b := range cm.buckets[content.UserID] {
+		b.lk.Lock()
+		for i, c := range b.Contents {
+			if c.ID == content.ID {
+				b.Contents = append(b.Contents[:i], b.Contents[i+1:]...)
+				b.CurSize -= c.Size
+				b.lk.Unlock()
+				return true
+			}
+		}
+		b.lk.Unlock()
+	}
+	return false
+}
+
 func (cm *ContentManager) getStagingZonesForUser(ctx context.Context, user uint) []*contentStagingZone {
 	cm.bucketLk.Lock()
 	defer cm.bucketLk.Unlock()
@@ -1224,7 +1456,7 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content util.Conten
 	))
 	defer span.End()
 
-	verified := cm.VerifiedDeal
+	verified := cm.verifiedDeals()
 
 	if content.AggregatedIn > 0 {
 		// This content is aggregated inside another piece of content, nothing to do here
@@ -1236,6 +1468,37 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content util.Conten
 		return nil
 	}
 
+	if content.Quarantined || (cm.scanner != nil && content.Pinning && !content.Active && !content.Aggregate) {
+		// quarantined, or not scanned yet
+		return nil
+	}
+
+	if src, ok := cm.denylist.lookup(content.Cid.CID); ok {
+		log.Debugw("not making deals for denylisted content", "content", content.ID, "source", src)
+		return nil
+	}
+
+	owner, err := cm.dealOwner(ctx, content)
+	if err != nil {
+		return err
+	}
+	shared := owner.ID != content.ID
+	if shared {
+		// the same data is stored and dealt for as older content already,
+		// only deals made before it was shared are still checked
+		var own int64
+		if err := cm.DB.Model(&contentDeal{}).Where("content = ? AND NOT failed", content.ID).Count(&own).Error; err != nil {
+			return err
+		}
+		if own == 0 {
+			return nil
+		}
+	}
+
+	// content past its retention keeps its deals checked until they run
+	// out, but gets no new ones
+	retained := cm.retained(ctx, content)
+
 	// if it's a shuttle content and the shuttle is not online, do not proceed
 	if content.Location != constants.ContentLocationLocal && !cm.shuttleIsOnline(content.Location) {
 		log.Debugf("content shuttle: %s, is not online", content.Location)
@@ -1249,7 +1512,7 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content util.Conten
 	}
 
 	// its too big, need to split it up into chunks
-	if content.Size > cm.contentSizeLimit {
+	if content.Size > cm.contentSizeLimit && retained {
 		if err := cm.splitContent(ctx, content, cm.contentSizeLimit); err != nil {
 			return err
 		}
@@ -1275,6 +1538,7 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content util.Conten
 	}
 
 	if len(deals) == 0 &&
+		retained &&
 		content.Size < int64(constants.IndividualDealThreshold) &&
 		!content.Aggregate &&
 		constants.BucketingEnabled {
@@ -1285,10 +1549,19 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content util.Conten
 		return nil
 	}
 
-	replicationFactor := cm.Replication
+	replicationFactor := cm.replicationFactor()
 	if content.Replication > 0 {
 		replicationFactor = content.Replication
 	}
+	if cm.dedupeAcrossUsers {
+		shared, err := cm.sharedReplication(ctx, content)
+		if err != nil {
+			return err
+		}
+		if shared > replicationFactor {
+			replicationFactor = shared
+		}
+	}
 
 	minersAlready := make(map[address.Address]bool)
 	for _, d := range deals {
@@ -1303,6 +1576,15 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content util.Conten
 		}
 		minersAlready[maddr] = true
 	}
+	// miners that failed for reasons trying again won't fix get no more
+	// deals for this content
+	unretryable, err := cm.unretryableMiners(ctx, content.ID)
+	if err != nil {
+		return err
+	}
+	for _, m := range unretryable {
+		minersAlready[m] = true
+	}
 
 	// check on each of the existing deals, see if they need fixing
 	var countLk sync.Mutex
@@ -1328,11 +1610,22 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content util.Conten
 			countLk.Lock()
 			defer countLk.Unlock()
 			switch status {
-			case DEAL_CHECK_UNKNOWN, DEAL_NEARLY_EXPIRED:
+			case DEAL_CHECK_UNKNOWN:
 				if err := cm.repairDeal(&d); err != nil {
 					errs[i] = xerrors.Errorf("repairing deal failed: %w", err)
 					return
 				}
+			case DEAL_NEARLY_EXPIRED:
+				if !retained {
+					numSealed++
+					return
+				}
+				// the deal is still good but no longer counts, so that a
+				// deal to replace it is made
+				if err := cm.renewDeal(ctx, &d); err != nil {
+					errs[i] = xerrors.Errorf("renewing deal failed: %w", err)
+					return
+				}
 			case DEAL_CHECK_SECTOR_ON_CHAIN:
 				numSealed++
 			case DEAL_CHECK_DEALID_ON_CHAIN:
@@ -1360,7 +1653,7 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content util.Conten
 	}
 
 	goodDeals := numSealed + numPublished + numProgress
-	if goodDeals < replicationFactor {
+	if goodDeals < replicationFactor && !shared && retained {
 		pc, err := cm.lookupPieceCommRecord(content.Cid.CID)
 		if err != nil {
 			return err
@@ -1526,7 +1819,14 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 			return DEAL_CHECK_UNKNOWN, fmt.Errorf("failed to check chain head: %w", err)
 		}
 
-		if deal.Proposal.EndEpoch-head.Height() < constants.MinSafeDealLifetime {
+		if d.EndEpoch != int64(deal.Proposal.EndEpoch) {
+			if err := cm.DB.Model(contentDeal{}).Where("id = ?", d.ID).UpdateColumn("end_epoch", deal.Proposal.EndEpoch).Error; err != nil {
+				return DEAL_CHECK_UNKNOWN, err
+			}
+			d.EndEpoch = int64(deal.Proposal.EndEpoch)
+		}
+
+		if before, ok := cm.renewalWindow(d.UserID); ok && deal.Proposal.EndEpoch-head.Height() < before {
 			return DEAL_NEARLY_EXPIRED, nil
 		}
 
@@ -1534,6 +1834,10 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 			if err := cm.DB.Model(contentDeal{}).Where("id = ?", d.ID).UpdateColumn("sealed_at", time.Now()).Error; err != nil {
 				return DEAL_CHECK_UNKNOWN, err
 			}
+			cm.queueDealAttestation(d, fvm.DealActive)
+			cm.issueReceipt(ctx, d.Content, receiptDeal)
+			// the content can now also be retrieved from the provider
+			cm.advertise(ctx, d.Content)
 			return DEAL_CHECK_SECTOR_ON_CHAIN, nil
 		}
 		return DEAL_CHECK_DEALID_ON_CHAIN, nil
@@ -1560,6 +1864,9 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 	}
 
 	var provds *storagemarket.ProviderDealState
+	if err == nil {
+		err = cm.connectProvider(subctx, maddr)
+	}
 	if err == nil {
 		provds, err = cm.FilClient.DealStatus(subctx, maddr, d.PropCid.CID, dealUUID)
 	}
@@ -1594,6 +1901,7 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 	if provds == nil {
 		return DEAL_CHECK_UNKNOWN, fmt.Errorf("failed to lookup provider deal state")
 	}
+	cm.recordDealState(ctx, *d, provds)
 
 	if provds.State == storagemarket.StorageDealError {
 		log.Errorf("deal state for deal %s from miner %s is error: %s",
@@ -1605,6 +1913,18 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 		return DEAL_CHECK_UNKNOWN, err
 	}
 
+	// a deal that is still under way gets failed over once it is stuck
+	inProgress := func(phase string, since time.Time) (int, error) {
+		failover, err := cm.checkStuckDeal(ctx, d, maddr, content, phase, since)
+		if err != nil {
+			return DEAL_CHECK_UNKNOWN, err
+		}
+		if failover {
+			return DEAL_CHECK_UNKNOWN, nil
+		}
+		return DEAL_CHECK_PROGRESS, nil
+	}
+
 	head, err := cm.Api.ChainHead(ctx)
 	if err != nil {
 		return DEAL_CHECK_UNKNOWN, fmt.Errorf("failed to check chain head: %w", err)
@@ -1654,7 +1974,11 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 				}
 				return DEAL_CHECK_UNKNOWN, nil
 			}
-			return DEAL_CHECK_PROGRESS, nil
+			since := d.TransferFinished
+			if since.IsZero() {
+				since = d.CreatedAt
+			}
+			return inProgress(stuckPhasePublish, since)
 		}
 
 		log.Infof("Found deal ID, updating in database: %d %d %d", d.Content, d.ID, id)
@@ -1701,6 +2025,16 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 	}
 	// miner still has time...
 
+	// the provider fetches or imports the data on its own, all that is left
+	// to check is that the deal makes it on chain in time. Shipping the data
+	// offline takes as long as it takes.
+	if d.Transfer == dealTransferOffline {
+		return DEAL_CHECK_PROGRESS, nil
+	}
+	if d.Transfer == dealTransferHTTP {
+		return inProgress(stuckDealPhase(d, nil))
+	}
+
 	if d.DTChan == "" {
 		if content.Location != constants.ContentLocationLocal {
 			log.Warnw("have not yet received confirmation of transfer start from remote", "loc", content.Location, "content", content.ID, "deal", d.ID)
@@ -1708,7 +2042,7 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 				return DEAL_CHECK_UNKNOWN, nil
 			}
 
-			return DEAL_CHECK_PROGRESS, nil
+			return inProgress(stuckDealPhase(d, nil))
 		} else {
 			// Weird case where we somehow dont have the data transfer started for this deal
 			log.Warnf("creating new data transfer for local deal that is missing it: %d", d.ID)
@@ -1739,7 +2073,7 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 			if err := cm.sendRequestTransferStatusCmd(ctx, content.Location, d.ID, d.DTChan); err != nil {
 				return DEAL_CHECK_UNKNOWN, err
 			}
-			return DEAL_CHECK_PROGRESS, nil
+			return inProgress(stuckDealPhase(d, nil))
 		}
 	}
 
@@ -1759,7 +2093,7 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 
 		// TODO: returning unknown==error here feels excessive
 		// but since 'Failed' is a terminal state, we kinda just have to make a new deal altogether
-		if cm.FailDealOnTransferFailure {
+		if cm.failDealOnTransferFailure() {
 			return DEAL_CHECK_UNKNOWN, nil
 		}
 	case datatransfer.Cancelled:
@@ -1809,7 +2143,8 @@ func (cm *ContentManager) checkDeal(ctx context.Context, d *contentDeal) (int, e
 	default:
 		fmt.Printf("Unexpected data transfer state: %d (msg = %s)\n", status.Status, status.Message)
 	}
-	return DEAL_CHECK_PROGRESS, nil
+
+	return inProgress(stuckDealPhase(d, status))
 }
 
 func (cm *ContentManager) updateDealID(d *contentDeal, id int64) error {
@@ -1819,6 +2154,14 @@ func (cm *ContentManager) updateDealID(d *contentDeal, id int64) error {
 	}).Error; err != nil {
 		return err
 	}
+	cm.recordContentEvent(context.TODO(), eventDealMade, d.Content, map[string]interface{}{
+		"miner":  d.Miner,
+		"dealId": id,
+	})
+	cm.queueDealAttestation(d, fvm.DealPublished)
+	if d.Verified {
+		cm.recordDatacapAllocation(d, id)
+	}
 	return nil
 }
 
@@ -1909,7 +2252,7 @@ func (cm *ContentManager) getLocalTransferStatus(ctx context.Context, d *content
 var ErrNotOnChainYet = fmt.Errorf("message not found on chain")
 
 func (cm *ContentManager) getDealID(ctx context.Context, pubcid cid.Cid, d *contentDeal) (abi.DealID, error) {
-	mlookup, err := cm.Api.StateSearchMsg(ctx, types.EmptyTSK, pubcid, 1000, false)
+	mlookup, err := cm.Api.StateSearchMsg(ctx, types.EmptyTSK, pubcid, cm.msgLookback, false)
 	if err != nil {
 		return 0, xerrors.Errorf("could not find published deal on chain: %w", err)
 	}
@@ -1967,7 +2310,9 @@ func (cm *ContentManager) getDealID(ctx context.Context, pubcid cid.Cid, d *cont
 }
 
 func (cm *ContentManager) repairDeal(d *contentDeal) error {
-	if d.DealID != 0 {
+	// a renewed deal that is gone from chain simply ran out, as did one
+	// past its end
+	if d.DealID != 0 && d.RenewedAt.IsZero() && !cm.dealEnded(d) {
 		log.Debugw("miner faulted on deal", "deal", d.DealID, "content", d.Content, "miner", d.Miner)
 		maddr, err := d.MinerAddr()
 		if err != nil {
@@ -2038,103 +2383,73 @@ func (cm *ContentManager) makeDealsForContent(ctx context.Context, content util.
 		return fmt.Errorf("cannot make more deals for offloaded content, must retrieve first")
 	}
 
+	if err := cm.denylist.check(ctx, content.Cid.CID, denyDeal, content.UserID, ""); err != nil {
+		return err
+	}
+
 	_, _, pieceSize, err := cm.getPieceCommitment(ctx, content.Cid.CID, cm.Blockstore)
 	if err != nil {
 		return xerrors.Errorf("failed to compute piece commitment while making deals %d: %w", content.ID, err)
 	}
 
-	miners, err := cm.pickMiners(ctx, count*2, pieceSize.Padded(), exclude, true)
+	listed, constrained, err := cm.providerExclusions(ctx, content.UserID)
 	if err != nil {
 		return err
 	}
-
-	var readyDeals []deal
-	for _, m := range miners {
-		price := m.ask.GetPrice(verified)
-		prop, err := cm.FilClient.MakeDeal(ctx, m.address, content.Cid.CID, price, m.ask.MinPieceSize, constants.DealDuration, verified)
-		if err != nil {
-			return xerrors.Errorf("failed to construct a deal proposal: %w", err)
+	if constrained {
+		merged := make(map[address.Address]bool, len(exclude)+len(listed))
+		for a := range exclude {
+			merged[a] = true
 		}
+		for a := range listed {
+			merged[a] = true
+		}
+		exclude = merged
+	}
 
-		dp, err := cm.putProposalRecord(prop.DealProposal)
-		if err != nil {
+	miners, err := cm.pickMiners(ctx, count*2, pieceSize.Padded(), exclude, true)
+	if err != nil {
+		return err
+	}
+	// only the shortfalls the provider lists can cause are reported
+	available := len(miners)
+	if !constrained {
+		available = count
+	}
+	cm.recordDealConstraint(ctx, content.ID, count, available)
+	if cm.snapDealsFor(content) {
+		if miners, err = cm.preferSnapMiners(miners); err != nil {
 			return err
 		}
+	}
 
-		propnd, err := cborutil.AsIpld(prop.DealProposal)
+	var readyDeals []deal
+	var queued int
+	for _, m := range miners {
+		pp, err := cm.prepareProposal(ctx, content, m, verified)
 		if err != nil {
-			return xerrors.Errorf("failed to compute deal proposal ipld node: %w", err)
-		}
-
-		dealUUID := uuid.New()
-		cd := &contentDeal{
-			Content:             content.ID,
-			PropCid:             util.DbCID{CID: propnd.Cid()},
-			DealUUID:            dealUUID.String(),
-			Miner:               m.address.String(),
-			Verified:            verified,
-			UserID:              content.UserID,
-			DealProtocolVersion: m.dealProtocolVersion,
-			MinerVersion:        m.ask.MinerVersion,
-		}
-
-		if err := cm.DB.Create(cd).Error; err != nil {
-			return xerrors.Errorf("failed to create database entry for deal: %w", err)
-		}
-
-		// Send the deal proposal to the storage provider
-		var cleanupDealPrep func() error
-		var propPhase bool
-		isPushTransfer := m.dealProtocolVersion == filclient.DealProtocolv110
-
-		switch m.dealProtocolVersion {
-		case filclient.DealProtocolv110:
-			propPhase, err = cm.FilClient.SendProposalV110(ctx, *prop, propnd.Cid())
-		case filclient.DealProtocolv120:
-			cleanupDealPrep, propPhase, err = cm.sendProposalV120(ctx, content.Location, *prop, propnd.Cid(), dealUUID, cd.ID)
-		default:
-			err = fmt.Errorf("unrecognized deal protocol %s", m.dealProtocolVersion)
+			return err
 		}
 
-		if err != nil {
-			// Clean up the contentDeal database entry
-			if err := cm.DB.Delete(&contentDeal{}, cd).Error; err != nil {
-				return fmt.Errorf("failed to delete content deal from db: %w", err)
+		if cm.proposals != nil && cm.flags.Enabled(flagDealBatching, content.UserID) {
+			if err := cm.queueProposal(pp); err != nil {
+				return err
 			}
-
-			// Clean up the proposal database entry
-			if err := cm.DB.Delete(&proposalRecord{}, dp).Error; err != nil {
-				return fmt.Errorf("failed to delete deal proposal from db: %w", err)
-			}
-
-			// Clean up the preparation for deal request - deal protocol v120
-			if cleanupDealPrep != nil {
-				if err := cleanupDealPrep(); err != nil {
-					log.Errorw("cleaning up deal prepared request", "error", err)
-				}
-			}
-
-			// Record a deal failure
-			phase := "send-proposal"
-			if propPhase {
-				phase = "propose"
+			queued++
+			if queued >= count {
+				break
 			}
+			continue
+		}
 
-			if err = cm.recordDealFailure(&DealFailureError{
-				Miner:               m.address,
-				Phase:               phase,
-				Message:             err.Error(),
-				Content:             content.ID,
-				UserID:              content.UserID,
-				DealProtocolVersion: m.dealProtocolVersion,
-				MinerVersion:        m.ask.MinerVersion,
-			}); err != nil {
-				log.Errorw("failed to record deail failure", "error", err)
+		if err := cm.sendProposal(ctx, pp); err != nil {
+			if err := cm.abandonProposal(pp, err); err != nil {
+				return err
 			}
 			continue
 		}
 
-		readyDeals = append(readyDeals, deal{minerAddr: m.address, isPushTransfer: isPushTransfer, contentDeal: cd})
+		readyDeals = append(readyDeals, deal{minerAddr: m.address, isPushTransfer: pp.isPushTransfer(), contentDeal: pp.deal})
 		if len(readyDeals) >= count {
 			break
 		}
@@ -2321,6 +2636,7 @@ func (cm *ContentManager) makeDealWithMiner(ctx context.Context, content util.Co
 		UserID:              content.UserID,
 		DealProtocolVersion: proto,
 		MinerVersion:        ask.MinerVersion,
+		EndEpoch:            int64(prop.DealProposal.Proposal.EndEpoch),
 	}
 
 	if err := cm.DB.Create(deal).Error; err != nil {
@@ -2407,6 +2723,10 @@ func (cm *ContentManager) StartDataTransfer(ctx context.Context, cd *contentDeal
 		return err
 	}
 
+	if err := cm.connectProvider(ctx, miner); err != nil {
+		return err
+	}
+
 	chanid, err := cm.FilClient.StartDataTransfer(ctx, miner, cd.PropCid.CID, cont.Cid.CID)
 	if err != nil {
 		if oerr := cm.recordDealFailure(&DealFailureError{
@@ -2469,9 +2789,18 @@ func (cm *ContentManager) getProposalRecord(propCid cid.Cid) (*market.ClientDeal
 }
 
 func (cm *ContentManager) recordDealFailure(dfe *DealFailureError) error {
-	log.Debugw("deal failure error", "miner", dfe.Miner, "phase", dfe.Phase, "msg", dfe.Message, "content", dfe.Content)
 	rec := dfe.Record()
-	return cm.DB.Create(rec).Error
+	log.Debugw("deal failure error", "miner", dfe.Miner, "phase", dfe.Phase, "reason", rec.Reason, "msg", dfe.Message, "content", dfe.Content)
+	if err := cm.DB.Create(rec).Error; err != nil {
+		return err
+	}
+	cm.recordContentEvent(context.TODO(), eventDealFailed, dfe.Content, map[string]interface{}{
+		"miner":   dfe.Miner.String(),
+		"phase":   dfe.Phase,
+		"reason":  rec.Reason,
+		"message": dfe.Message,
+	})
+	return nil
 }
 
 type DealFailureError struct {
@@ -2490,6 +2819,7 @@ type dfeRecord struct {
 	Miner               string      `json:"miner"`
 	Phase               string      `json:"phase"`
 	Message             string      `json:"message"`
+	Reason              string      `json:"reason" gorm:"index"`
 	Content             uint        `json:"content" gorm:"index"`
 	MinerVersion        string      `json:"minerVersion"`
 	UserID              uint        `json:"user_id" gorm:"index"`
@@ -2501,6 +2831,7 @@ func (dfe *DealFailureError) Record() *dfeRecord {
 		Miner:               dfe.Miner.String(),
 		Phase:               dfe.Phase,
 		Message:             dfe.Message,
+		Reason:              dealfailure.Classify(dfe.Phase, dfe.Message),
 		Content:             dfe.Content,
 		UserID:              dfe.UserID,
 		MinerVersion:        dfe.MinerVersion,
@@ -2585,7 +2916,21 @@ func (cm *ContentManager) runPieceCommCompute(ctx context.Context, data cid.Cid,
 	}
 
 	log.Debugw("computing piece commitment", "data", cont.Cid.CID)
-	return filclient.GeneratePieceCommitmentFFI(ctx, data, bs)
+	var pc *piece.Piece
+	var err error
+	if cont.Aggregate {
+		// the contents in it that had their own pieces computed aren't walked
+		pc, err = piece.GenerateAggregate(ctx, data, bs, cm.carIndexes.Lookup)
+	} else {
+		pc, err = piece.Generate(ctx, data, bs)
+	}
+	if err != nil {
+		return cid.Undef, 0, 0, err
+	}
+	if err := cm.carIndexes.Put(pc.Layout); err != nil {
+		log.Warnf("failed to store car index of %s: %s", data, err)
+	}
+	return pc.PieceCID, pc.CarSize, pc.PieceSize, nil
 }
 
 func (cm *ContentManager) getPieceCommitment(ctx context.Context, data cid.Cid, bs blockstore.Blockstore) (cid.Cid, uint64, abi.UnpaddedPieceSize, error) {
@@ -2639,6 +2984,14 @@ func (cm *ContentManager) getPieceCommitment(ctx context.Context, data cid.Cid,
 	return pc, carSize, size, nil
 }
 
+// connectProvider goes through the connection pool before any request to a
+// storage provider, so providers that can't be reached are backed off from
+// instead of being dialed by every worker that needs them
+func (cm *ContentManager) connectProvider(ctx context.Context, sp address.Address) error {
+	_, err := cm.spConns.Connect(ctx, sp)
+	return err
+}
+
 func (cm *ContentManager) RefreshContentForCid(ctx context.Context, c cid.Cid) (blocks.Block, error) {
 	ctx, span := cm.tracer.Start(ctx, "refreshForCid", trace.WithAttributes(
 		attribute.Stringer("cid", c),
@@ -2735,43 +3088,51 @@ func (cm *ContentManager) RefreshContent(ctx context.Context, cont uint) error {
 }
 
 func (cm *ContentManager) sendRetrieveContentMessage(ctx context.Context, loc string, cont util.Content) error {
-	return fmt.Errorf("not retrieving content yet until implementation is finished")
-	/*
-		var activeDeals []contentDeal
-		if err := cm.DB.Find(&activeDeals, "content = ? and not failed and deal_id > 0", cont.ID).Error; err != nil {
-			return err
-		}
+	deals, err := cm.activeStorageDeals(ctx, cont.ID)
+	if err != nil {
+		return err
+	}
 
-		if len(activeDeals) == 0 {
-			log.Errorf("attempted to retrieve content %d but have no active deals", cont.ID)
-			return fmt.Errorf("no active deals for content %d, cannot retrieve", cont.ID)
-		}
+	if len(deals) == 0 {
+		log.Errorf("attempted to retrieve content %d but have no active deals", cont.ID)
+		return fmt.Errorf("no active deals for content %d, cannot retrieve", cont.ID)
+	}
 
-		var deals []drpc.StorageDeal
-		for _, d := range activeDeals {
-			ma, err := d.MinerAddr()
-			if err != nil {
-				log.Errorf("failed to parse miner addres for deal %d: %s", d.ID, err)
-				continue
-			}
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_RetrieveContent,
+		Params: drpc.CmdParams{
+			RetrieveContent: &drpc.RetrieveContent{
+				Content: cont.ID,
+				UserID:  cont.UserID,
+				Cid:     cont.Cid.CID,
+				Deals:   deals,
+			},
+		},
+	})
+}
 
-			deals = append(deals, drpc.StorageDeal{
-				Miner:  ma,
-				DealID: d.DealID,
-			})
+// activeStorageDeals returns the deals of a content that are on chain and
+// not slashed, for a shuttle to retrieve it from
+func (cm *ContentManager) activeStorageDeals(ctx context.Context, contID uint) ([]drpc.StorageDeal, error) {
+	var activeDeals []contentDeal
+	if err := cm.DB.WithContext(ctx).Find(&activeDeals, "content = ? and not failed and not slashed and deal_id > 0", contID).Error; err != nil {
+		return nil, err
+	}
+
+	var deals []drpc.StorageDeal
+	for _, d := range activeDeals {
+		ma, err := d.MinerAddr()
+		if err != nil {
+			log.Errorf("failed to parse miner addres for deal %d: %s", d.ID, err)
+			continue
 		}
 
-		return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
-			Op: drpc.CMD_RetrieveContent,
-			Params: drpc.CmdParams{
-				RetrieveContent: &drpc.RetrieveContent{
-					Content: cont.ID,
-					Cid:     cont.Cid.CID,
-					Deals:   deals,
-				},
-			},
+		deals = append(deals, drpc.StorageDeal{
+			Miner:  ma,
+			DealID: d.DealID,
 		})
-	*/
+	}
+	return deals, nil
 }
 
 func (cm *ContentManager) retrieveContent(ctx context.Context, contentToFetch uint) error {
@@ -2861,6 +3222,11 @@ func (cm *ContentManager) runRetrieval(ctx context.Context, contentToFetch uint)
 
 		log.Infow("attempting retrieval deal", "content", contentToFetch, "miner", maddr)
 
+		if err := cm.connectProvider(ctx, maddr); err != nil {
+			log.Errorw("failed to connect to miner for retrieval", "miner", maddr, "err", err)
+			continue
+		}
+
 		ask, err := cm.FilClient.RetrievalQuery(ctx, maddr, content.Cid.CID)
 		if err != nil {
 			span.RecordError(err)
@@ -2902,6 +3268,10 @@ func (cm *ContentManager) runRetrieval(ctx context.Context, contentToFetch uint)
 }
 
 func (s *Server) handleFixupDeals(c echo.Context) error {
+	if err := s.requireFullNode(); err != nil {
+		return err
+	}
+
 	ctx := context.Background()
 	var deals []contentDeal
 	if err := s.DB.Order("deal_id desc").Find(&deals, "deal_id > 0 AND on_chain_at < ?", time.Now().Add(time.Hour*24*-100)).Error; err != nil {
@@ -2946,6 +3316,11 @@ func (s *Server) handleFixupDeals(c echo.Context) error {
 				}
 				dealUUID = &parsed
 			}
+			if err := s.CM.connectProvider(subctx, miner); err != nil {
+				log.Errorf("failed to get deal status: %d %s: %s", d.ID, miner, err)
+				return
+			}
+
 			provds, err := s.CM.FilClient.DealStatus(subctx, miner, d.PropCid.CID, dealUUID)
 			if err != nil {
 				log.Errorf("failed to get deal status: %d %s: %s", d.ID, miner, err)
@@ -2989,17 +3364,8 @@ func (cm *ContentManager) addObjectsToDatabase(ctx context.Context, content uint
 	_, span := cm.tracer.Start(ctx, "addObjectsToDatabase")
 	defer span.End()
 
-	if err := cm.DB.CreateInBatches(objects, 300).Error; err != nil {
-		return xerrors.Errorf("failed to create objects in db: %w", err)
-	}
-
-	refs := make([]util.ObjRef, 0, len(objects))
 	var totalSize int64
 	for _, o := range objects {
-		refs = append(refs, util.ObjRef{
-			Content: content,
-			Object:  o.ID,
-		})
 		totalSize += int64(o.Size)
 	}
 
@@ -3008,22 +3374,132 @@ func (cm *ContentManager) addObjectsToDatabase(ctx context.Context, content uint
 		attribute.Int("numObjects", len(objects)),
 	)
 
-	if err := cm.DB.Model(util.Content{}).Where("id = ?", content).UpdateColumns(map[string]interface{}{
-		"active":   true,
-		"size":     totalSize,
-		"pinning":  false,
-		"location": loc,
-	}).Error; err != nil {
-		return xerrors.Errorf("failed to update content in database: %w", err)
+	if loc == constants.ContentLocationLocal {
+		if err := cm.Node.FlushWrites(ctx); err != nil {
+			return xerrors.Errorf("failed to flush blocks: %w", err)
+		}
+	}
+
+	if err := cm.checkPinMaxSize(ctx, content, totalSize); err != nil {
+		return err
 	}
 
-	if err := cm.DB.CreateInBatches(refs, 500).Error; err != nil {
-		return xerrors.Errorf("failed to create refs: %w", err)
+	if err := cm.insertObjects(ctx, content, objects); err != nil {
+		return err
 	}
 
+	// scanned content is pinned once the scanner has cleared it
+	if cm.scanner != nil {
+		if err := cm.queueScan(ctx, content, totalSize, loc); err != nil {
+			return err
+		}
+	} else if err := cm.markPinned(ctx, content, totalSize, loc); err != nil {
+		return err
+	}
+
+	// a shuttle's count is taken on its word
+	src := dagsize.SourceMeasured
+	if loc != constants.ContentLocationLocal {
+		src = dagsize.SourceProvider
+	}
+	cm.dagSizes.Hint(root, totalSize, src)
+
 	return nil
 }
 
+// advertise queues content, and what is aggregated in it, to be announced
+// to the autoretrieve servers
+func (cm *ContentManager) advertise(ctx context.Context, contID uint) {
+	if cm.Node.ArEngine == nil {
+		return
+	}
+
+	ids := []uint{contID}
+	var children []uint
+	if err := cm.DB.Model(&util.Content{}).Where("aggregated_in = ?", contID).Pluck("id", &children).Error; err != nil {
+		log.Errorf("failed to get the contents aggregated in %d: %s", contID, err)
+	}
+	ids = append(ids, children...)
+
+	if err := cm.Node.ArEngine.Enqueue(ctx, ids...); err != nil {
+		log.Errorf("failed to queue content %d for advertisement: %s", contID, err)
+	}
+}
+
+// retract removes the advertisements of a removed content to the
+// autoretrieve servers and the indexers
+func (cm *ContentManager) retract(ctx context.Context, contID uint) {
+	if cm.Node.ArEngine == nil {
+		return
+	}
+	if err := cm.Node.ArEngine.Retract(ctx, contID); err != nil {
+		log.Errorf("failed to remove the advertisements of content %d: %s", contID, err)
+	}
+}
+
+// provideDag queues the blocks below a content's root that the provide policy
+// asks for, once they are in the blockstore
+func (cm *ContentManager) provideDag(ctx context.Context, contID uint, root cid.Cid) {
+	if cm.Node.ProvidePolicy.RootsOnly() {
+		return
+	}
+
+	var size int64
+	if err := cm.DB.Model(&util.Content{}).Where("id = ?", contID).Pluck("size", &size).Error; err != nil {
+		log.Errorf("failed to get the size of content %d: %s", contID, err)
+		return
+	}
+	cm.Node.ProvideDag(ctx, root, size)
+}
+
+// insertObjects writes the objects of a content and the refs linking them to
+// it. On postgres both are bulk loaded with COPY, elsewhere the batched
+// inserts share a single transaction rather than committing every batch.
+func (cm *ContentManager) insertObjects(ctx context.Context, content uint, objects []*util.Object) error {
+	if util.SupportsCopy(cm.DB) && cm.flags.Enabled(flagCopyObjects, 0) {
+		cids := make([]util.DbCID, len(objects))
+		sizes := make([]int, len(objects))
+		for i, o := range objects {
+			cids[i] = o.Cid
+			sizes[i] = o.Size
+		}
+
+		ids, err := util.CopyObjects(ctx, cm.DB, cids, sizes, util.CopyObjectsOpts{
+			RefColumn:      "content",
+			Owner:          content,
+			ObjectDefaults: map[string]interface{}{"reads": 0},
+			RefDefaults:    map[string]interface{}{"offloaded": 0},
+		})
+		if err != nil {
+			return xerrors.Errorf("failed to copy objects into db: %w", err)
+		}
+
+		for i, id := range ids {
+			objects[i].ID = id
+		}
+		return nil
+	}
+
+	return cm.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.CreateInBatches(objects, 300).Error; err != nil {
+			return xerrors.Errorf("failed to create objects in db: %w", err)
+		}
+
+		refs := make([]util.ObjRef, 0, len(objects))
+		for _, o := range objects {
+			refs = append(refs, util.ObjRef{
+				Content: content,
+				Object:  o.ID,
+			})
+		}
+
+		if err := tx.CreateInBatches(refs, 500).Error; err != nil {
+			return xerrors.Errorf("failed to create refs: %w", err)
+		}
+		return nil
+	})
+}
+
 func (cm *ContentManager) migrateContentsToLocalNode(ctx context.Context, toMove []util.Content) error {
 	for _, c := range toMove {
 		if err := cm.migrateContentToLocalNode(ctx, c); err != nil {
@@ -3109,6 +3585,27 @@ func (cm *ContentManager) addrInfoForShuttle(handle string) (*peer.AddrInfo, err
 	return &conn.addrInfo, nil
 }
 
+// gatewayURLForShuttle returns the url of the gateway of the node behind
+// handle, empty if the hostname of the node isn't known
+func (cm *ContentManager) gatewayURLForShuttle(handle string) string {
+	hostname := cm.hostname
+	if handle != constants.ContentLocationLocal {
+		cm.shuttlesLk.Lock()
+		conn, ok := cm.shuttles[handle]
+		cm.shuttlesLk.Unlock()
+		if !ok {
+			return ""
+		}
+		hostname = conn.hostname
+	}
+
+	u, err := url.Parse(hostname)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s://%s/gw", u.Scheme, u.Host)
+}
+
 func (cm *ContentManager) sendPrepareForDataRequestCommand(ctx context.Context, loc string, dbid uint, authToken string, propCid cid.Cid, payloadCid cid.Cid, size uint64) error {
 	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
 		Op: drpc.CMD_PrepareForDataRequest,
@@ -3202,9 +3699,10 @@ func (cm *ContentManager) sendConsolidateContentCmd(ctx context.Context, loc str
 		fromLocs[c.Location] = struct{}{}
 
 		tc.Contents = append(tc.Contents, drpc.ContentFetch{
-			ID:     c.ID,
-			Cid:    c.Cid.CID,
-			UserID: c.UserID,
+			ID:      c.ID,
+			Cid:     c.Cid.CID,
+			UserID:  c.UserID,
+			Private: c.Private,
 		})
 	}
 
@@ -3220,6 +3718,9 @@ func (cm *ContentManager) sendConsolidateContentCmd(ctx context.Context, loc str
 		}
 
 		tc.Sources = append(tc.Sources, *ai)
+		if u := cm.gatewayURLForShuttle(handle); u != "" {
+			tc.SourceURLs = append(tc.SourceURLs, u)
+		}
 	}
 
 	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
@@ -3253,6 +3754,79 @@ func (cm *ContentManager) setDealMakingEnabled(enable bool) {
 	cm.isDealMakingDisabled = !enable
 }
 
+func (cm *ContentManager) replicationFactor() int {
+	cm.settingsLk.Lock()
+	defer cm.settingsLk.Unlock()
+	return cm.Replication
+}
+
+func (cm *ContentManager) verifiedDeals() bool {
+	cm.settingsLk.Lock()
+	verified := cm.VerifiedDeal
+	cm.settingsLk.Unlock()
+	return verified && !cm.datacapExhausted()
+}
+
+func (cm *ContentManager) failDealOnTransferFailure() bool {
+	cm.settingsLk.Lock()
+	defer cm.settingsLk.Unlock()
+	return cm.FailDealOnTransferFailure
+}
+
+func (cm *ContentManager) redispatchStalled() bool {
+	cm.settingsLk.Lock()
+	defer cm.settingsLk.Unlock()
+	return cm.redispatchStalledPins
+}
+
+func (cm *ContentManager) setRedispatchStalledPins(v bool) {
+	cm.settingsLk.Lock()
+	defer cm.settingsLk.Unlock()
+	cm.redispatchStalledPins = v
+}
+
+func (cm *ContentManager) dagFetchOptions() dagwalk.Options {
+	cm.settingsLk.Lock()
+	defer cm.settingsLk.Unlock()
+	return dagwalk.Options{
+		Workers:       cm.dagFetch.Workers,
+		MaxWorkers:    cm.dagFetch.MaxWorkers,
+		ScaleEvery:    cm.dagFetch.ScaleEvery,
+		WantBatchSize: cm.dagFetch.WantBatchSize,
+	}
+}
+
+// pinTransport is the transport of the pins of user uid that don't ask for
+// one, users the origin-fetch flag is off for only get bitswap
+func (cm *ContentManager) pinTransport(uid uint) gsfetch.Transport {
+	if !cm.flags.Enabled(flagOriginFetch, uid) {
+		return gsfetch.TransportBitswap
+	}
+
+	cm.settingsLk.Lock()
+	defer cm.settingsLk.Unlock()
+	t, err := gsfetch.ParseTransport(cm.dagFetch.Transport)
+	if err != nil {
+		return gsfetch.TransportAuto
+	}
+	return t
+}
+
+func (cm *ContentManager) setDagFetch(cfg config.DagFetch) {
+	cm.settingsLk.Lock()
+	defer cm.settingsLk.Unlock()
+	cm.dagFetch = cfg
+}
+
+// setDealSettings applies the deal settings of a reloaded config
+func (cm *ContentManager) setDealSettings(replication int, verified, failOnTransferFailure bool) {
+	cm.settingsLk.Lock()
+	defer cm.settingsLk.Unlock()
+	cm.Replication = replication
+	cm.VerifiedDeal = verified
+	cm.FailDealOnTransferFailure = failOnTransferFailure
+}
+
 func (cm *ContentManager) splitContentLocal(ctx context.Context, cont util.Content, size int64) error {
 	dserv := merkledag.NewDAGService(blockservice.New(cm.Node.Blockstore, nil))
 	b := dagsplit.NewBuilder(dserv, uint64(size), 0)
@@ -3279,6 +3853,7 @@ func (cm *ContentManager) splitContentLocal(ctx context.Context, cont util.Conte
 			Active:      true,
 			Pinning:     true,
 			UserID:      cont.UserID,
+			Namespace:   cont.Namespace,
 			Replication: cont.Replication,
 			Location:    constants.ContentLocationLocal,
 			DagSplit:    true,
@@ -3288,6 +3863,7 @@ func (cm *ContentManager) splitContentLocal(ctx context.Context, cont util.Conte
 		if err := cm.DB.Create(content).Error; err != nil {
 			return xerrors.Errorf("failed to track new content in database: %w", err)
 		}
+		cm.recordContentEvent(ctx, eventContentAdded, content.ID, nil)
 
 		if err := cm.addDatabaseTrackingToContent(ctx, content.ID, dserv, c, func(int64) {}); err != nil {
 			return err
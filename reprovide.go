@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/metrics"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/provide"
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+	"github.com/multiformats/go-multihash"
+	"go.opencensus.io/stats"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// contentProvide is when the reprovide scheduler last provided a content
+type contentProvide struct {
+	ID        uint `gorm:"primarykey"`
+	UpdatedAt time.Time
+
+	Content      uint       `gorm:"uniqueIndex"`
+	LastProvided *time.Time `gorm:"index"`
+	// Lag is how long past due the content was when it was last provided
+	Lag time.Duration
+	// Reads is how often the root was requested when the content was last
+	// provided, so due contents are ordered without counting reads for each
+	Reads     int
+	Failures  int
+	LastError string
+}
+
+type reprovideCandidate struct {
+	ID           uint
+	Cid          util.DbCID
+	Size         int64
+	CreatedAt    time.Time
+	LastProvided *time.Time
+}
+
+// dueReprovides returns the local contents that are due, recently added
+// ones first, then the most requested, then the longest unprovided
+func (cm *ContentManager) dueReprovides(ctx context.Context, now time.Time, limit int) ([]reprovideCandidate, error) {
+	var out []reprovideCandidate
+	err := cm.DB.WithContext(ctx).Model(&util.Content{}).
+		Select(`contents.id, contents.cid, contents.size, contents.created_at, content_provides.last_provided,
+			CASE WHEN contents.created_at > ? THEN 0 ELSE 1 END AS tier,
+			COALESCE(content_provides.reads, 0) AS reads`, now.Add(-cm.reprovideCfg.RecentWindow)).
+		Joins("LEFT JOIN content_provides ON content_provides.content = contents.id").
+		Where("contents.active AND NOT contents.quarantined AND NOT contents.private AND contents.location = ?", constants.ContentLocationLocal).
+		Where("content_provides.last_provided IS NULL OR content_provides.last_provided < ?", now.Add(-cm.reprovideCfg.Interval)).
+		Order("tier, reads DESC, content_provides.last_provided IS NOT NULL, content_provides.last_provided").
+		Limit(limit).
+		Scan(&out).Error
+	return out, err
+}
+
+// reprovide runs one round of the scheduler
+func (cm *ContentManager) reprovide(ctx context.Context) error {
+	if !cm.Node.FullRT.Ready() {
+		log.Debugf("skipping reprovide round, the routing table is not ready")
+		return nil
+	}
+
+	now := time.Now()
+	conts, err := cm.dueReprovides(ctx, now, cm.reprovideCfg.BatchSize)
+	if err != nil {
+		return err
+	}
+	if len(conts) > 0 {
+		if err := cm.reprovideBatch(ctx, now, conts); err != nil {
+			return err
+		}
+	}
+
+	if _, err := cm.reprovideHealth(ctx); err != nil {
+		log.Errorf("failed to collect reprovide metrics: %s", err)
+	}
+	return nil
+}
+
+func (cm *ContentManager) reprovideBatch(ctx context.Context, now time.Time, conts []reprovideCandidate) error {
+	var keys []multihash.Multihash
+	seen := cid.NewSet()
+	for _, c := range conts {
+		s := cm.Node.ProvidePolicy.For(c.Size)
+		if err := provide.Keys(ctx, cm.Blockstore, s, c.Cid.CID, func(k cid.Cid) error {
+			if seen.Visit(k) {
+				keys = append(keys, k.Hash())
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	perr := cm.Node.FullRT.ProvideMany(ctx, keys)
+
+	reads, err := cm.rootReads(ctx, conts)
+	if err != nil {
+		return err
+	}
+
+	rows := make([]contentProvide, 0, len(conts))
+	for _, c := range conts {
+		row := contentProvide{Content: c.ID, Reads: reads[c.Cid.CID.KeyString()]}
+		if perr != nil {
+			row.Failures = 1
+			row.LastError = perr.Error()
+			rows = append(rows, row)
+			continue
+		}
+
+		due := c.CreatedAt
+		if c.LastProvided != nil {
+			due = c.LastProvided.Add(cm.reprovideCfg.Interval)
+		}
+		row.LastProvided = &now
+		if now.After(due) {
+			row.Lag = now.Sub(due)
+		}
+		rows = append(rows, row)
+		stats.Record(ctx, metrics.ReprovideLag.M(row.Lag.Seconds()))
+	}
+
+	// a failed round keeps when the content was last provided
+	upsert := clause.OnConflict{
+		Columns:   []clause.Column{{Name: "content"}},
+		DoUpdates: clause.AssignmentColumns([]string{"last_provided", "lag", "reads", "failures", "last_error", "updated_at"}),
+	}
+	if perr != nil {
+		upsert.DoUpdates = clause.Assignments(map[string]interface{}{
+			"failures":   gorm.Expr("content_provides.failures + 1"),
+			"last_error": perr.Error(),
+			"updated_at": now,
+		})
+	}
+	if err := cm.DB.WithContext(ctx).Clauses(upsert).Create(&rows).Error; err != nil {
+		return err
+	}
+
+	if perr != nil {
+		stats.Record(ctx, metrics.ReprovideFailed.M(int64(len(conts))))
+		return perr
+	}
+	stats.Record(ctx, metrics.ReprovideProvided.M(int64(len(conts))))
+	return nil
+}
+
+// rootReads returns how often the roots of conts were requested, by key
+func (cm *ContentManager) rootReads(ctx context.Context, conts []reprovideCandidate) (map[string]int, error) {
+	roots := make([][]byte, 0, len(conts))
+	for _, c := range conts {
+		roots = append(roots, c.Cid.CID.Bytes())
+	}
+
+	var rows []struct {
+		Cid   util.DbCID
+		Reads int
+	}
+	if err := cm.DB.WithContext(ctx).Model(&util.Object{}).Select("cid, MAX(reads) AS reads").
+		Where("cid IN ?", roots).Group("cid").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	reads := make(map[string]int, len(rows))
+	for _, r := range rows {
+		reads[r.Cid.CID.KeyString()] = r.Reads
+	}
+	return reads, nil
+}
+
+type reprovideHealth struct {
+	Due           int64         `json:"due"`
+	NeverProvided int64         `json:"neverProvided"`
+	Failing       int64         `json:"failing"`
+	OldestAge     time.Duration `json:"oldestAge"`
+	Interval      time.Duration `json:"interval"`
+}
+
+// reprovideHealth counts what is due and records it in the metrics
+func (cm *ContentManager) reprovideHealth(ctx context.Context) (*reprovideHealth, error) {
+	now := time.Now()
+	local := cm.DB.WithContext(ctx).Model(&util.Content{}).
+		Joins("LEFT JOIN content_provides ON content_provides.content = contents.id").
+		Where("contents.active AND NOT contents.quarantined AND contents.location = ?", constants.ContentLocationLocal)
+
+	h := &reprovideHealth{Interval: cm.reprovideCfg.Interval}
+	if err := local.Session(&gorm.Session{}).
+		Where("content_provides.last_provided IS NULL OR content_provides.last_provided < ?", now.Add(-cm.reprovideCfg.Interval)).
+		Count(&h.Due).Error; err != nil {
+		return nil, err
+	}
+	if err := local.Session(&gorm.Session{}).Where("content_provides.last_provided IS NULL").Count(&h.NeverProvided).Error; err != nil {
+		return nil, err
+	}
+	if err := local.Session(&gorm.Session{}).Where("content_provides.failures > 0").Count(&h.Failing).Error; err != nil {
+		return nil, err
+	}
+
+	var oldest []time.Time
+	if err := local.Session(&gorm.Session{}).Where("content_provides.last_provided IS NOT NULL").
+		Order("content_provides.last_provided").Limit(1).Pluck("content_provides.last_provided", &oldest).Error; err != nil {
+		return nil, err
+	}
+	if len(oldest) > 0 {
+		h.OldestAge = now.Sub(oldest[0])
+	}
+
+	stats.Record(ctx,
+		metrics.ReprovideBacklog.M(h.Due),
+		metrics.ReprovideOldestAge.M(h.OldestAge.Seconds()),
+	)
+	return h, nil
+}
+
+// handleAdminReprovideHealth godoc
+// @Summary      Reprovide health
+// @Description  This endpoint returns how many contents are due to be reprovided, how many never were or are failing, and how long ago the least recently provided content was provided.
+// @Tags         admin
+// @Produce      json
+// @Success      200  {object}  reprovideHealth
+// @Router       /admin/reprovide [get]
+func (s *Server) handleAdminReprovideHealth(c echo.Context) error {
+	h, err := s.CM.reprovideHealth(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, h)
+}
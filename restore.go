@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	restoreWarming  = "warming"
+	restoreRestored = "restored"
+	restoreFailed   = "failed"
+)
+
+const eventRestored = "content.restored"
+
+// contentRestore is the last time an offloaded content was brought back
+// from its deals
+type contentRestore struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	UpdatedAt time.Time `json:"-"`
+
+	Content    uint       `gorm:"uniqueIndex" json:"content"`
+	Cid        util.DbCID `gorm:"index" json:"cid"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+var restoreLk sync.Mutex
+
+// restoreContent starts bringing back an offloaded content, unless that is
+// already under way, started tells which. Content restored on the primary is
+// done when RefreshContent returns, shuttles report it when they pinned it
+// again.
+func (s *Server) restoreContent(ctx context.Context, cont util.Content) (*contentRestore, bool, error) {
+	restoreLk.Lock()
+	defer restoreLk.Unlock()
+
+	var r contentRestore
+	if err := s.DB.WithContext(ctx).Where("content = ?", cont.ID).Find(&r).Error; err != nil {
+		return nil, false, err
+	}
+	if r.ID != 0 && r.Status == restoreWarming && time.Since(r.StartedAt) < s.estuaryCfg.Restore.Timeout {
+		return &r, false, nil
+	}
+
+	r = contentRestore{
+		ID:        r.ID,
+		Content:   cont.ID,
+		Cid:       cont.Cid,
+		Status:    restoreWarming,
+		StartedAt: time.Now(),
+	}
+	if err := s.DB.WithContext(ctx).Save(&r).Error; err != nil {
+		return nil, false, err
+	}
+
+	go func() {
+		// a restore that outlives its timeout is started again anyway
+		ctx, cancel := context.WithTimeout(context.Background(), s.estuaryCfg.Restore.Timeout)
+		defer cancel()
+		if err := s.CM.RefreshContent(ctx, cont.ID); err != nil {
+			log.Warnf("failed to restore content %d: %s", cont.ID, err)
+			s.CM.finishRestore(ctx, cont.ID, err)
+			return
+		}
+
+		var c util.Content
+		if err := s.DB.Select("id, offloaded").First(&c, "id = ?", cont.ID).Error; err != nil {
+			log.Errorf("failed to check restore of content %d: %s", cont.ID, err)
+			return
+		}
+		if !c.Offloaded {
+			s.CM.finishRestore(ctx, cont.ID, nil)
+		}
+	}()
+	return &r, true, nil
+}
+
+// finishRestore records how the restore of a content ended
+func (cm *ContentManager) finishRestore(ctx context.Context, contID uint, rerr error) {
+	upd := map[string]interface{}{
+		"status":      restoreRestored,
+		"error":       "",
+		"finished_at": time.Now(),
+	}
+	if rerr != nil {
+		upd["status"] = restoreFailed
+		upd["error"] = rerr.Error()
+	}
+	res := cm.DB.WithContext(ctx).Model(&contentRestore{}).Where("content = ? AND status = ?", contID, restoreWarming).Updates(upd)
+	if res.Error != nil {
+		log.Errorf("failed to record restore of content %d: %s", contID, res.Error)
+		return
+	}
+	if res.RowsAffected > 0 && rerr == nil {
+		cm.recordContentEvent(ctx, eventRestored, contID, nil)
+		// it may have been restored to make new deals for
+		cm.queueMgr.add(contID, 0)
+	}
+}
+
+// warmOffloaded starts restoring cc if all the content with it was
+// offloaded, and returns the restore to report and whether this call started
+// it. It returns nil when cc can be served as it is. Restores are retrievals
+// from Filecoin, so only a paid retrieval or the owner of the content, by
+// the api key auth, can start one; anyone else is told about a restore under
+// way or refused.
+func (s *Server) warmOffloaded(ctx context.Context, cc cid.Cid, paid bool, auth string) (*contentRestore, bool, error) {
+	if !s.estuaryCfg.Restore.Enabled {
+		return nil, false, nil
+	}
+
+	var conts []util.Content
+	if err := s.DB.WithContext(ctx).Select("id, cid, offloaded, user_id").Order("id").
+		Find(&conts, "cid = ? AND active", util.DbCID{CID: cc}).Error; err != nil {
+		return nil, false, err
+	}
+	if len(conts) == 0 {
+		return nil, false, nil
+	}
+	for _, cont := range conts {
+		if !cont.Offloaded {
+			return nil, false, nil
+		}
+	}
+	if paid {
+		return s.restoreContent(ctx, conts[0])
+	}
+
+	if auth != "" {
+		if u, err := s.checkTokenAuth(auth); err == nil {
+			for _, cont := range conts {
+				if cont.UserID == u.ID {
+					return s.restoreContent(ctx, cont)
+				}
+			}
+		}
+	}
+
+	var r contentRestore
+	if err := s.DB.WithContext(ctx).Where("cid = ? AND status = ? AND started_at > ?",
+		util.DbCID{CID: cc}, restoreWarming, time.Now().Add(-s.estuaryCfg.Restore.Timeout)).
+		Order("started_at desc").Limit(1).Find(&r).Error; err != nil {
+		return nil, false, err
+	}
+	if r.ID != 0 {
+		return &r, false, nil
+	}
+	return nil, false, &util.HttpError{
+		Code:    http.StatusPaymentRequired,
+		Reason:  util.ERR_PAYMENT_REQUIRED,
+		Details: fmt.Sprintf("%s is offloaded, it is restored from its deals for a paid retrieval or for its owner", cc),
+	}
+}
+
+// handleRpcRetrieveFailed records that a shuttle failed to restore a content
+// from its deals
+func (cm *ContentManager) handleRpcRetrieveFailed(ctx context.Context, handle string, param *drpc.RetrieveFailed) error {
+	log.Warnf("shuttle %s failed to retrieve content %d: %s", handle, param.Content, param.Reason)
+	cm.finishRestore(ctx, param.Content, errors.New(param.Reason))
+	return nil
+}
+
+// serveWarming answers a retrieval of content that is being restored
+func (s *Server) serveWarming(c echo.Context, r *contentRestore) error {
+	c.Response().Header().Set("Cache-Control", "no-store")
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(s.estuaryCfg.Restore.RetryAfter.Seconds())))
+	return c.JSON(http.StatusAccepted, r)
+}
+
+// handleGetRestoreStatus godoc
+// @Summary      Get the restore status of a cid
+// @Description  This endpoint returns whether offloaded content with a cid is being brought back from its deals, or how the last restore of it ended.
+// @Tags         public
+// @Produce      json
+// @Param        cid  path      string  true  "Cid"
+// @Success      200  {object}  contentRestore
+// @Router       /public/retrieval/restore/{cid} [get]
+func (s *Server) handleGetRestoreStatus(c echo.Context) error {
+	cc, err := cid.Decode(c.Param("cid"))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid cid: %s", err),
+		}
+	}
+	if _, err := s.checkRetrievalAccess(c.Request().Context(), cc, accessToken(c)); err != nil {
+		return err
+	}
+
+	var r contentRestore
+	if err := s.DB.Order("updated_at desc").First(&r, "cid = ?", util.DbCID{CID: cc}).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("%s was never restored", cc),
+			}
+		}
+		return err
+	}
+	return c.JSON(http.StatusOK, r)
+}
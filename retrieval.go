@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/application-research/estuary/drpc"
 	"github.com/application-research/estuary/util"
 	"github.com/application-research/filclient"
 	"github.com/application-research/filclient/retrievehelper"
@@ -39,6 +40,11 @@ func (s *Server) retrievalAsksForContent(ctx context.Context, contid uint) (map[
 			return nil, err
 		}
 
+		if err := s.CM.connectProvider(ctx, maddr); err != nil {
+			log.Errorf("failed to connect to miner %s for retrieval query: %s", maddr, err)
+			continue
+		}
+
 		resp, err := s.FilClient.RetrievalQuery(ctx, maddr, content.Cid.CID)
 		if err != nil {
 			if err := s.CM.recordRetrievalFailure(&util.RetrievalFailureRecord{
@@ -112,6 +118,10 @@ func (cm *ContentManager) tryRetrieve(ctx context.Context, maddr address.Address
 		return err
 	}
 
+	if err := cm.connectProvider(ctx, maddr); err != nil {
+		return err
+	}
+
 	stats, err := cm.FilClient.RetrieveContent(ctx, maddr, proposal)
 	if err != nil {
 		return err
@@ -137,6 +147,31 @@ type retrievalSuccessRecord struct {
 	AskPrice     string `json:"askPrice"`
 }
 
+// handleRpcRetrievalResult records a retrieval a shuttle made, like the
+// ones made here
+func (cm *ContentManager) handleRpcRetrievalResult(ctx context.Context, handle string, param *drpc.RetrievalResult) error {
+	if param.Error != "" {
+		return cm.recordRetrievalFailure(&util.RetrievalFailureRecord{
+			Miner:   param.Miner,
+			Phase:   param.Phase,
+			Message: fmt.Sprintf("shuttle %s: %s", handle, param.Error),
+			Content: param.Content,
+			Cid:     util.DbCID{CID: param.Cid},
+		})
+	}
+	return cm.DB.WithContext(ctx).Create(&retrievalSuccessRecord{
+		Cid:          util.DbCID{CID: param.Cid},
+		Miner:        param.Miner,
+		Peer:         param.Peer,
+		Size:         param.Size,
+		DurationMs:   param.DurationMs,
+		AverageSpeed: param.AverageSpeed,
+		TotalPayment: param.TotalPayment,
+		NumPayments:  param.NumPayments,
+		AskPrice:     param.AskPrice,
+	}).Error
+}
+
 func (cm *ContentManager) recordRetrievalSuccess(cc cid.Cid, m address.Address, rstats *filclient.RetrievalStats) {
 	if err := cm.DB.Create(&retrievalSuccessRecord{
 		Cid:          util.DbCID{CID: cc},
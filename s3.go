@@ -0,0 +1,1028 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/requestid"
+	"github.com/application-research/estuary/util/s3"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-merkledag"
+	uio "github.com/ipfs/go-unixfs/io"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// S3Object is what the s3 api knows about content uploaded through it
+type S3Object struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	Content     uint   `gorm:"uniqueIndex"`
+	ETag        string `json:"etag"`
+	ContentType string `json:"contentType"`
+}
+
+// S3Upload is a multipart upload in progress, its parts are kept on disk
+// until it is completed
+type S3Upload struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	UploadID    string `gorm:"uniqueIndex"`
+	UserID      uint
+	Collection  uint
+	Key         string
+	ContentType string
+}
+
+type S3UploadPart struct {
+	ID     uint  `gorm:"primarykey"`
+	Upload uint  `gorm:"uniqueIndex:idx_s3_upload_part"`
+	Number int   `gorm:"uniqueIndex:idx_s3_upload_part"`
+	Size   int64 `json:"size"`
+	ETag   string
+}
+
+const (
+	s3MaxKeyLength = 1024
+	s3MaxParts     = 10000
+	s3MaxXMLBody   = 1 << 20
+	s3MaxPartSize  = 5 << 30
+)
+
+var s3BucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+func (s *Server) registerS3Routes(e *echo.Echo) {
+	g := e.Group("/s3", s.s3Auth)
+	g.GET("", s.s3Handler(s.handleS3ListBuckets))
+	g.GET("/", s.s3Handler(s.handleS3ListBuckets))
+
+	g.GET("/:bucket", s.s3Handler(s.handleS3GetBucket))
+	g.HEAD("/:bucket", s.s3Handler(s.handleS3HeadBucket))
+	g.PUT("/:bucket", s.s3Handler(s.handleS3PutBucket))
+	g.DELETE("/:bucket", s.s3Handler(s.handleS3DeleteBucket))
+	g.POST("/:bucket", s.s3Handler(s.handleS3PostBucket))
+
+	g.GET("/:bucket/*", s.s3Handler(s.handleS3GetObject))
+	g.HEAD("/:bucket/*", s.s3Handler(s.handleS3GetObject))
+	g.PUT("/:bucket/*", s.s3Handler(s.handleS3PutObject), s.diskMon.Middleware, s.drain.Middleware)
+	g.POST("/:bucket/*", s.s3Handler(s.handleS3PostObject), s.diskMon.Middleware, s.drain.Middleware)
+	g.DELETE("/:bucket/*", s.s3Handler(s.handleS3DeleteObject))
+}
+
+// s3Auth authenticates signature version 4 signed requests, the access key
+// is the username and the secret key any api key of the user
+func (s *Server) s3Auth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		u, auth, err := s.checkS3Auth(c.Request())
+		if err != nil {
+			return s.writeS3Error(c, err)
+		}
+
+		if err := s.limits.checkRequest(c, u); err != nil {
+			return err
+		}
+		c.Set("user", u)
+		c.Set("s3auth", auth)
+		return next(c)
+	}
+}
+
+func (s *Server) checkS3Auth(r *http.Request) (*User, *s3.Auth, error) {
+	auth, err := s3.ParseAuth(r, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	if auth.Service != "s3" || auth.Region != s.estuaryCfg.S3.Region {
+		return nil, nil, s3.ErrAuthorizationHeaderMalformed
+	}
+
+	var user User
+	if err := s.DB.First(&user, "username = ?", auth.AccessKey).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, s3.ErrInvalidAccessKeyID
+		}
+		return nil, nil, err
+	}
+
+	var keys []AuthToken
+	if err := s.DB.Find(&keys, "auth_tokens.user = ? AND expiry > ?", user.ID, time.Now()).Error; err != nil {
+		return nil, nil, err
+	}
+	for _, k := range keys {
+		if auth.Verify(r, k.Token) {
+			user.authToken = k
+			return &user, auth, nil
+		}
+	}
+	return nil, nil, s3.ErrSignatureDoesNotMatch
+}
+
+// s3Payload returns the body of a request, streamed chunks are checked
+// against the signature the request was authenticated with
+func s3Payload(c echo.Context) (io.Reader, error) {
+	auth, ok := c.Get("s3auth").(*s3.Auth)
+	if !ok {
+		return nil, s3.ErrAccessDenied
+	}
+	return auth.Payload(c.Request())
+}
+
+// s3Handler turns the errors of an s3 handler into s3 error responses
+func (s *Server) s3Handler(f func(echo.Context, *User) error) echo.HandlerFunc {
+	return withUser(func(c echo.Context, u *User) error {
+		if err := f(c, u); err != nil {
+			return s.writeS3Error(c, err)
+		}
+		return nil
+	})
+}
+
+func (s *Server) writeS3Error(c echo.Context, err error) error {
+	var serr *s3.Error
+	if !errors.As(err, &serr) {
+		log.Errorf("s3 request %s %s failed: %s", c.Request().Method, c.Request().URL.Path, err)
+		serr = s3.ErrInternal
+	}
+	return s3.WriteError(c.Response(), serr, c.Request().URL.Path, requestid.Get(c))
+}
+
+// s3Key returns the key of an object request, or an empty key for requests
+// on the bucket that have a trailing slash
+func s3Key(c echo.Context) (string, error) {
+	key := strings.TrimPrefix(c.Request().URL.Path, "/s3/"+c.Param("bucket"))
+	key = strings.TrimPrefix(key, "/")
+	if key == "" {
+		return "", nil
+	}
+
+	// keys are collection paths, so they have to be clean ones
+	if len(key) > s3MaxKeyLength || path.Clean("/"+key) != "/"+key {
+		return "", s3.ErrInvalidKey
+	}
+	return key, nil
+}
+
+func (s *Server) s3Writable(u *User) error {
+	if s.isContentAddingDisabled(u) {
+		return s3.ErrAccessDenied
+	}
+	return nil
+}
+
+func s3Readable(u *User) error {
+	if u.authToken.UploadOnly {
+		return s3.ErrAccessDenied
+	}
+	return nil
+}
+
+func (s *Server) s3Bucket(u *User, name string) (*Collection, error) {
+	var col Collection
+	if err := s.DB.Order("id").Scopes(inNamespace(u)).First(&col, "user_id = ? AND name = ?", u.ID, name).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, s3.ErrNoSuchBucket
+		}
+		return nil, err
+	}
+	return &col, nil
+}
+
+func (s *Server) handleS3ListBuckets(c echo.Context, u *User) error {
+	if err := s3Readable(u); err != nil {
+		return err
+	}
+
+	var cols []Collection
+	if err := s.DB.Order("id").Scopes(inNamespace(u)).Find(&cols, "user_id = ?", u.ID).Error; err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	var buckets []s3.Bucket
+	for _, col := range cols {
+		if seen[col.Name] {
+			continue
+		}
+		seen[col.Name] = true
+		buckets = append(buckets, s3.Bucket{Name: col.Name, CreationDate: s3.FormatTime(col.CreatedAt)})
+	}
+
+	owner := s3.Owner{ID: strconv.Itoa(int(u.ID)), DisplayName: u.Username}
+	return s3.WriteXML(c.Response(), http.StatusOK, s3.NewListAllMyBucketsResult(owner, buckets))
+}
+
+func (s *Server) handleS3HeadBucket(c echo.Context, u *User) error {
+	if err := s3Readable(u); err != nil {
+		return err
+	}
+
+	if _, err := s.s3Bucket(u, c.Param("bucket")); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func (s *Server) handleS3PutBucket(c echo.Context, u *User) error {
+	if err := s.s3Writable(u); err != nil {
+		return err
+	}
+
+	name := c.Param("bucket")
+	if !s3BucketName.MatchString(name) {
+		return s3.ErrInvalidBucketName
+	}
+
+	if _, err := s.s3Bucket(u, name); err == nil {
+		return s3.ErrBucketAlreadyOwnedByYou
+	} else if err != s3.ErrNoSuchBucket {
+		return err
+	}
+
+	if err := s.DB.Create(&Collection{
+		UUID:      uuid.New().String(),
+		Name:      name,
+		UserID:    u.ID,
+		Namespace: u.namespace(),
+	}).Error; err != nil {
+		return err
+	}
+
+	c.Response().Header().Set("Location", "/"+name)
+	return c.NoContent(http.StatusOK)
+}
+
+func (s *Server) handleS3DeleteBucket(c echo.Context, u *User) error {
+	if err := s3Readable(u); err != nil {
+		return err
+	}
+
+	col, err := s.s3Bucket(u, c.Param("bucket"))
+	if err != nil {
+		return err
+	}
+
+	var refs int64
+	if err := s.DB.Model(CollectionRef{}).Where("collection = ?", col.ID).Count(&refs).Error; err != nil {
+		return err
+	}
+	if refs > 0 {
+		return s3.ErrBucketNotEmpty
+	}
+
+	if err := s.DB.Delete(col).Error; err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (s *Server) handleS3GetBucket(c echo.Context, u *User) error {
+	if err := s3Readable(u); err != nil {
+		return err
+	}
+
+	col, err := s.s3Bucket(u, c.Param("bucket"))
+	if err != nil {
+		return err
+	}
+
+	q := c.Request().URL.Query()
+	switch {
+	case q.Has("location"):
+		return s3.WriteXML(c.Response(), http.StatusOK, s3.NewLocationConstraint(s.estuaryCfg.S3.Region))
+	case q.Has("uploads"), q.Has("versioning"), q.Has("acl"), q.Has("policy"), q.Has("cors"), q.Has("lifecycle"), q.Has("tagging"):
+		return s3.ErrNotImplemented
+	}
+	return s.s3ListObjects(c, col, q)
+}
+
+// s3Entry is an object as listed
+type s3Entry struct {
+	Path      string
+	CreatedAt time.Time
+	Size      int64
+	Cid       util.DbCID
+	ETag      string
+}
+
+func (e s3Entry) etag() string {
+	if e.ETag != "" {
+		return e.ETag
+	}
+	// content that wasn't uploaded through the s3 api has no md5
+	return `"` + e.Cid.CID.String() + `"`
+}
+
+func (s *Server) s3ListObjects(c echo.Context, col *Collection, q url.Values) error {
+	var entries []s3Entry
+	if err := s.DB.Table("collection_refs").
+		Select("collection_refs.path, collection_refs.created_at, contents.size, contents.cid, s3_objects.e_tag").
+		Joins("INNER JOIN contents ON contents.id = collection_refs.content").
+		Joins("LEFT JOIN s3_objects ON s3_objects.content = contents.id").
+		Where("collection_refs.collection = ? AND contents.deleted_at IS NULL", col.ID).
+		Scan(&entries).Error; err != nil {
+		return err
+	}
+
+	byKey := make(map[string]s3Entry, len(entries))
+	keys := make([]string, 0, len(entries))
+	for _, e := range entries {
+		k := strings.TrimPrefix(e.Path, "/")
+		byKey[k] = e
+		keys = append(keys, k)
+	}
+
+	maxKeys := s3.DefaultMaxKeys
+	if mk := q.Get("max-keys"); mk != "" {
+		n, err := strconv.Atoi(mk)
+		if err != nil || n < 0 {
+			return s3.ErrInvalidArgument
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	res := s3.NewListBucketResult(col.Name)
+	res.Prefix = q.Get("prefix")
+	res.Delimiter = q.Get("delimiter")
+	res.MaxKeys = maxKeys
+
+	var after string
+	v2 := q.Get("list-type") == "2"
+	if v2 {
+		res.StartAfter = q.Get("start-after")
+		after = res.StartAfter
+		if tok := q.Get("continuation-token"); tok != "" {
+			b, err := base64.URLEncoding.DecodeString(tok)
+			if err != nil {
+				return s3.ErrInvalidArgument
+			}
+			res.ContinuationToken = tok
+			after = string(b)
+		}
+	} else {
+		res.Marker = q.Get("marker")
+		after = res.Marker
+	}
+
+	page := s3.List(keys, res.Prefix, res.Delimiter, after, maxKeys)
+	res.IsTruncated = page.IsTruncated
+
+	encode := func(s string) string { return s }
+	if q.Get("encoding-type") == "url" {
+		res.EncodingType = "url"
+		encode = url.QueryEscape
+	}
+
+	for _, k := range page.Keys {
+		e := byKey[k]
+		res.Contents = append(res.Contents, s3.Object{
+			Key:          encode(k),
+			LastModified: s3.FormatTime(e.CreatedAt),
+			ETag:         e.etag(),
+			Size:         e.Size,
+			StorageClass: "STANDARD",
+		})
+	}
+	for _, p := range page.Prefixes {
+		res.CommonPrefixes = append(res.CommonPrefixes, s3.CommonPrefix{Prefix: encode(p)})
+	}
+
+	if v2 {
+		res.KeyCount = len(page.Keys) + len(page.Prefixes)
+		if page.IsTruncated {
+			res.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(page.Next))
+		}
+	} else if page.IsTruncated && res.Delimiter != "" {
+		res.NextMarker = encode(page.Next)
+	}
+	return s3.WriteXML(c.Response(), http.StatusOK, res)
+}
+
+// handleS3PostBucket deletes objects in bulk
+func (s *Server) handleS3PostBucket(c echo.Context, u *User) error {
+	if !c.Request().URL.Query().Has("delete") {
+		return s3.ErrNotImplemented
+	}
+	if err := s3Readable(u); err != nil {
+		return err
+	}
+
+	col, err := s.s3Bucket(u, c.Param("bucket"))
+	if err != nil {
+		return err
+	}
+
+	var del s3.Delete
+	if err := s.readS3XML(c, &del); err != nil {
+		return err
+	}
+
+	res := s3.NewDeleteResult()
+	for _, o := range del.Objects {
+		if err := s.deleteS3Object(c.Request().Context(), u, col, o.Key); err != nil {
+			var serr *s3.Error
+			if !errors.As(err, &serr) {
+				log.Errorf("failed to delete s3 object %q: %s", o.Key, err)
+				serr = s3.ErrInternal
+			}
+			res.Errors = append(res.Errors, s3.DeleteError{Key: o.Key, Code: serr.Code, Message: serr.Message})
+			continue
+		}
+		if !del.Quiet {
+			res.Deleted = append(res.Deleted, s3.DeletedObject{Key: o.Key})
+		}
+	}
+	return s3.WriteXML(c.Response(), http.StatusOK, res)
+}
+
+func (s *Server) readS3XML(c echo.Context, v interface{}) error {
+	body, err := s3Payload(c)
+	if err != nil {
+		return err
+	}
+	b, err := io.ReadAll(io.LimitReader(body, s3MaxXMLBody))
+	if err != nil {
+		return err
+	}
+	if err := xml.Unmarshal(b, v); err != nil {
+		return s3.ErrMalformedXML
+	}
+	return nil
+}
+
+func (s *Server) handleS3GetObject(c echo.Context, u *User) error {
+	key, err := s3Key(c)
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		if c.Request().Method == http.MethodHead {
+			return s.handleS3HeadBucket(c, u)
+		}
+		return s.handleS3GetBucket(c, u)
+	}
+	if err := s3Readable(u); err != nil {
+		return err
+	}
+
+	col, err := s.s3Bucket(u, c.Param("bucket"))
+	if err != nil {
+		return err
+	}
+
+	var ref CollectionRef
+	if err := s.DB.First(&ref, "collection = ? AND path = ?", col.ID, "/"+key).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return s3.ErrNoSuchKey
+		}
+		return err
+	}
+
+	var cont util.Content
+	if err := s.DB.First(&cont, "id = ?", ref.Content).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return s3.ErrNoSuchKey
+		}
+		return err
+	}
+
+	var obj S3Object
+	if err := s.DB.Limit(1).Find(&obj, "content = ?", cont.ID).Error; err != nil {
+		return err
+	}
+
+	if err := s.CM.denylist.check(c.Request().Context(), cont.Cid.CID, denyServe, u.ID, c.RealIP()); err != nil {
+		return err
+	}
+	// content waiting to be scanned isn't served either
+	if cont.Quarantined || (s.CM.scanner != nil && !cont.Active) {
+		return s3.ErrNoSuchKey
+	}
+
+	entry := s3Entry{Cid: cont.Cid, ETag: obj.ETag}
+	h := c.Response().Header()
+	h.Set("ETag", entry.etag())
+	h.Set("X-Amz-Meta-Cid", cont.Cid.CID.String())
+	if obj.ContentType != "" {
+		h.Set("Content-Type", obj.ContentType)
+	} else {
+		h.Set("Content-Type", "application/octet-stream")
+	}
+
+	// content that moved to a shuttle is served by the gateway
+	if cont.Location != constants.ContentLocationLocal {
+		return c.Redirect(http.StatusTemporaryRedirect, util.CreateRetrievalURL(cont.Cid.CID.String()))
+	}
+
+	ctx := c.Request().Context()
+	dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, nil))
+	nd, err := dserv.Get(ctx, cont.Cid.CID)
+	if err != nil {
+		return err
+	}
+	dr, err := uio.NewDagReader(ctx, nd, dserv)
+	if err != nil {
+		if err == uio.ErrIsDir {
+			return s3.ErrNoSuchKey
+		}
+		return err
+	}
+
+	org, err := s.contentOrg(ctx, cont.ID)
+	if err != nil {
+		return err
+	}
+	return s.meterEgress(c, u.ID, org, func() error {
+		http.ServeContent(c.Response(), c.Request(), key, ref.CreatedAt, dr)
+		return nil
+	})
+}
+
+func (s *Server) handleS3PutObject(c echo.Context, u *User) error {
+	key, err := s3Key(c)
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return s.handleS3PutBucket(c, u)
+	}
+	if err := s.s3Writable(u); err != nil {
+		return err
+	}
+
+	r := c.Request()
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		return s3.ErrNotImplemented
+	}
+
+	col, err := s.s3Bucket(u, c.Param("bucket"))
+	if err != nil {
+		return err
+	}
+
+	q := r.URL.Query()
+	if q.Has("uploadId") {
+		return s.handleS3UploadPart(c, u, col, key, q.Get("uploadId"), q.Get("partNumber"))
+	}
+
+	if n := s3.DecodedLength(r); !u.FlagSplitContent() && n > s.CM.contentSizeLimit {
+		return s3.ErrEntityTooLarge
+	}
+
+	body, err := s3Payload(c)
+	if err != nil {
+		return err
+	}
+	if !u.FlagSplitContent() {
+		// the decoded length is only a claim, and unknown for some uploads
+		body = s3.LimitReader(body, s.CM.contentSizeLimit)
+	}
+
+	sum := md5.New()
+	etag, err := s.putS3Object(r.Context(), u, col, key, io.TeeReader(body, sum), r.Header.Get("Content-Type"), func() string {
+		return `"` + hex.EncodeToString(sum.Sum(nil)) + `"`
+	})
+	if err != nil {
+		return err
+	}
+
+	c.Response().Header().Set("ETag", etag)
+	return c.NoContent(http.StatusOK)
+}
+
+// s3BodyReader keeps the error reading the body failed with, the importer
+// doesn't pass it on as is
+type s3BodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (br *s3BodyReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	if err != nil && err != io.EOF && br.err == nil {
+		br.err = err
+	}
+	return n, err
+}
+
+// putS3Object imports body as the object at key of col, replacing the
+// object that was there. etag is called once all of body has been read.
+func (s *Server) putS3Object(ctx context.Context, u *User, col *Collection, key string, body io.Reader, contentType string, etag func() string) (string, error) {
+	fullPath := "/" + key
+	var old CollectionRef
+	if err := s.DB.Limit(1).Find(&old, "collection = ? AND path = ?", col.ID, fullPath).Error; err != nil {
+		return "", err
+	}
+	// replacing an object drops the old one, which upload only keys may not do
+	if old.ID != 0 {
+		if err := s3Readable(u); err != nil {
+			return "", err
+		}
+	}
+
+	bsid, bs, err := s.StagingMgr.AllocNew()
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		go func() {
+			if err := s.StagingMgr.CleanUp(bsid); err != nil {
+				log.Errorf("failed to clean up staging blockstore: %s", err)
+			}
+		}()
+	}()
+
+	dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+	br := &s3BodyReader{r: body}
+	nd, err := s.importFile(ctx, dserv, br, s.importDefaults)
+	if err != nil {
+		if br.err != nil {
+			return "", br.err
+		}
+		return "", err
+	}
+
+	content, err := s.CM.addDatabaseTracking(ctx, u, dserv, nd.Cid(), path.Base(key), s.CM.replicationFactor(), s.importDefaults.Chunker, nil)
+	if err != nil {
+		return "", xerrors.Errorf("encountered problem computing object references: %w", err)
+	}
+
+	if err := s.dumpBlockstoreTo(ctx, bs, s.Node.Blockstore); err != nil {
+		return "", xerrors.Errorf("failed to move data from staging to main blockstore: %w", err)
+	}
+
+	tag := etag()
+	if err := s.DB.Create(&S3Object{
+		Content:     content.ID,
+		ETag:        tag,
+		ContentType: contentType,
+	}).Error; err != nil {
+		return "", err
+	}
+
+	if err := s.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "path"}, {Name: "collection"}},
+		DoUpdates: clause.AssignmentColumns([]string{"created_at", "content"}),
+	}).Create(&CollectionRef{
+		Collection: col.ID,
+		Content:    content.ID,
+		Path:       &fullPath,
+	}).Error; err != nil {
+		return "", err
+	}
+
+	if old.ID != 0 && old.Content != content.ID {
+		s.dropS3Content(ctx, u, old.Content)
+	}
+
+	go func() {
+		s.CM.ToCheck <- content.ID
+	}()
+
+	go func() {
+		if err := s.Node.Provider.Provide(nd.Cid()); err != nil {
+			log.Warnf("failed to announce providers: %s", err)
+		}
+		s.CM.provideDag(context.Background(), content.ID, nd.Cid())
+	}()
+	return tag, nil
+}
+
+// dropS3Content unpins content that was replaced or deleted through the s3
+// api, unless it is still in a collection or a version of a name. Content
+// that wasn't put through the s3 api is left alone.
+func (s *Server) dropS3Content(ctx context.Context, u *User, contID uint) {
+	var obj S3Object
+	if err := s.DB.Limit(1).Find(&obj, "content = ?", contID).Error; err != nil {
+		log.Errorf("failed to look up s3 object of content %d: %s", contID, err)
+		return
+	}
+	if obj.ID == 0 {
+		return
+	}
+
+	var refs int64
+	if err := s.DB.Model(CollectionRef{}).Where("content = ?", contID).Count(&refs).Error; err != nil {
+		log.Errorf("failed to check references of content %d: %s", contID, err)
+		return
+	}
+	if refs > 0 {
+		return
+	}
+	if err := s.checkNotNamed(ctx, contID); err != nil {
+		return
+	}
+
+	var cont util.Content
+	if err := s.DB.First(&cont, "id = ? AND user_id = ?", contID, u.ID).Error; err != nil {
+		if !xerrors.Is(err, gorm.ErrRecordNotFound) {
+			log.Errorf("failed to look up content %d: %s", contID, err)
+		}
+		return
+	}
+
+	if err := s.DB.Delete(&obj).Error; err != nil {
+		log.Errorf("failed to delete s3 object of content %d: %s", contID, err)
+	}
+
+	go func() {
+		if err := s.CM.unpinContent(context.Background(), contID); err != nil {
+			log.Errorf("could not unpinContent(%d): %s", contID, err)
+		}
+	}()
+}
+
+func (s *Server) handleS3DeleteObject(c echo.Context, u *User) error {
+	key, err := s3Key(c)
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return s.handleS3DeleteBucket(c, u)
+	}
+
+	col, err := s.s3Bucket(u, c.Param("bucket"))
+	if err != nil {
+		return err
+	}
+
+	if uploadID := c.QueryParam("uploadId"); uploadID != "" {
+		upload, err := s.s3Upload(u, col, key, uploadID)
+		if err != nil {
+			return err
+		}
+		if err := s.removeS3Upload(upload); err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	if err := s3Readable(u); err != nil {
+		return err
+	}
+	if err := s.deleteS3Object(c.Request().Context(), u, col, key); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// deleteS3Object removes the object at key from col, deleting an object
+// that isn't there is fine
+func (s *Server) deleteS3Object(ctx context.Context, u *User, col *Collection, key string) error {
+	var ref CollectionRef
+	if err := s.DB.Limit(1).Find(&ref, "collection = ? AND path = ?", col.ID, "/"+key).Error; err != nil {
+		return err
+	}
+	if ref.ID == 0 {
+		return nil
+	}
+
+	if err := s.DB.Delete(&ref).Error; err != nil {
+		return err
+	}
+	s.dropS3Content(ctx, u, ref.Content)
+	return nil
+}
+
+func (s *Server) handleS3PostObject(c echo.Context, u *User) error {
+	key, err := s3Key(c)
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return s.handleS3PostBucket(c, u)
+	}
+	if err := s.s3Writable(u); err != nil {
+		return err
+	}
+
+	col, err := s.s3Bucket(u, c.Param("bucket"))
+	if err != nil {
+		return err
+	}
+
+	q := c.Request().URL.Query()
+	switch {
+	case q.Has("uploads"):
+		return s.handleS3CreateUpload(c, u, col, key)
+	case q.Has("uploadId"):
+		return s.handleS3CompleteUpload(c, u, col, key, q.Get("uploadId"))
+	default:
+		return s3.ErrNotImplemented
+	}
+}
+
+func (s *Server) s3UploadDir(uploadID string) string {
+	return filepath.Join(s.estuaryCfg.DataDir, "s3-uploads", uploadID)
+}
+
+func (s *Server) s3Upload(u *User, col *Collection, key, uploadID string) (*S3Upload, error) {
+	var upload S3Upload
+	if err := s.DB.First(&upload, "upload_id = ? AND user_id = ? AND collection = ? AND key = ?", uploadID, u.ID, col.ID, key).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, s3.ErrNoSuchUpload
+		}
+		return nil, err
+	}
+	return &upload, nil
+}
+
+func (s *Server) handleS3CreateUpload(c echo.Context, u *User, col *Collection, key string) error {
+	upload := &S3Upload{
+		UploadID:    uuid.New().String(),
+		UserID:      u.ID,
+		Collection:  col.ID,
+		Key:         key,
+		ContentType: c.Request().Header.Get("Content-Type"),
+	}
+	if err := os.MkdirAll(s.s3UploadDir(upload.UploadID), 0755); err != nil {
+		return err
+	}
+	if err := s.DB.Create(upload).Error; err != nil {
+		return err
+	}
+	return s3.WriteXML(c.Response(), http.StatusOK, s3.NewInitiateMultipartUploadResult(col.Name, key, upload.UploadID))
+}
+
+func (s *Server) handleS3UploadPart(c echo.Context, u *User, col *Collection, key, uploadID, partNumber string) error {
+	num, err := strconv.Atoi(partNumber)
+	if err != nil || num < 1 || num > s3MaxParts {
+		return s3.ErrInvalidArgument
+	}
+
+	upload, err := s.s3Upload(u, col, key, uploadID)
+	if err != nil {
+		return err
+	}
+
+	if s3.DecodedLength(c.Request()) > s3MaxPartSize {
+		return s3.ErrEntityTooLarge
+	}
+
+	body, err := s3Payload(c)
+	if err != nil {
+		return err
+	}
+	body = s3.LimitReader(body, s3MaxPartSize)
+
+	dir := s.s3UploadDir(upload.UploadID)
+	f, err := os.CreateTemp(dir, "part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) //nolint:errcheck
+
+	sum := md5.New()
+	size, err := io.Copy(io.MultiWriter(f, sum), body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), filepath.Join(dir, strconv.Itoa(num))); err != nil {
+		return err
+	}
+
+	part := &S3UploadPart{
+		Upload: upload.ID,
+		Number: num,
+		Size:   size,
+		ETag:   `"` + hex.EncodeToString(sum.Sum(nil)) + `"`,
+	}
+	if err := s.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "upload"}, {Name: "number"}},
+		DoUpdates: clause.AssignmentColumns([]string{"size", "e_tag"}),
+	}).Create(part).Error; err != nil {
+		return err
+	}
+
+	c.Response().Header().Set("ETag", part.ETag)
+	return c.NoContent(http.StatusOK)
+}
+
+func (s *Server) handleS3CompleteUpload(c echo.Context, u *User, col *Collection, key, uploadID string) error {
+	upload, err := s.s3Upload(u, col, key, uploadID)
+	if err != nil {
+		return err
+	}
+
+	var req s3.CompleteMultipartUpload
+	if err := s.readS3XML(c, &req); err != nil {
+		return err
+	}
+	if len(req.Parts) == 0 {
+		return s3.ErrMalformedXML
+	}
+
+	var stored []S3UploadPart
+	if err := s.DB.Find(&stored, "upload = ?", upload.ID).Error; err != nil {
+		return err
+	}
+	byNumber := make(map[int]S3UploadPart, len(stored))
+	for _, p := range stored {
+		byNumber[p.Number] = p
+	}
+
+	// the etag of a multipart object is the md5 of the md5s of its parts
+	// with the number of parts appended
+	var total int64
+	var files []io.Reader
+	sums := md5.New()
+	for i, p := range req.Parts {
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			return s3.ErrInvalidPartOrder
+		}
+		sp, ok := byNumber[p.PartNumber]
+		if !ok || strings.Trim(p.ETag, `"`) != strings.Trim(sp.ETag, `"`) {
+			return s3.ErrInvalidPart
+		}
+		if err := writeETagSum(sums, sp.ETag); err != nil {
+			return err
+		}
+		total += sp.Size
+
+		f, err := os.Open(filepath.Join(s.s3UploadDir(upload.UploadID), strconv.Itoa(p.PartNumber)))
+		if err != nil {
+			return s3.ErrInvalidPart
+		}
+		defer f.Close() //nolint:errcheck
+		files = append(files, f)
+	}
+
+	if !u.FlagSplitContent() && total > s.CM.contentSizeLimit {
+		return s3.ErrEntityTooLarge
+	}
+
+	etag, err := s.putS3Object(c.Request().Context(), u, col, key, io.MultiReader(files...), upload.ContentType, func() string {
+		return fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sums.Sum(nil)), len(req.Parts))
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := s.removeS3Upload(upload); err != nil {
+		log.Errorf("failed to remove completed s3 upload %s: %s", upload.UploadID, err)
+	}
+
+	location := s.estuaryCfg.Hostname + "/s3/" + col.Name + "/" + key
+	return s3.WriteXML(c.Response(), http.StatusOK, s3.NewCompleteMultipartUploadResult(location, col.Name, key, etag))
+}
+
+func writeETagSum(h hash.Hash, etag string) error {
+	b, err := hex.DecodeString(strings.Trim(etag, `"`))
+	if err != nil {
+		return err
+	}
+	_, err = h.Write(b)
+	return err
+}
+
+func (s *Server) removeS3Upload(upload *S3Upload) error {
+	if err := s.DB.Delete(&S3UploadPart{}, "upload = ?", upload.ID).Error; err != nil {
+		return err
+	}
+	if err := s.DB.Delete(upload).Error; err != nil {
+		return err
+	}
+	return os.RemoveAll(s.s3UploadDir(upload.UploadID))
+}
+
+// expireS3Uploads drops the multipart uploads that were never completed
+func (s *Server) expireS3Uploads(ctx context.Context) error {
+	var uploads []*S3Upload
+	if err := s.DB.Find(&uploads, "created_at < ?", time.Now().Add(-s.estuaryCfg.S3.UploadExpiry)).Error; err != nil {
+		return err
+	}
+
+	for _, upload := range uploads {
+		if err := s.removeS3Upload(upload); err != nil {
+			log.Errorf("failed to remove expired s3 upload %s: %s", upload.UploadID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/scan"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+const eventContentQuarantined = "content.quarantined"
+
+const (
+	scanPending = "pending"
+	scanRunning = "running"
+	scanClean   = "clean"
+	scanFlagged = "flagged"
+	scanFailed  = "failed"
+)
+
+// what an admin decided about flagged content
+const (
+	reviewRelease = "release"
+	reviewUphold  = "uphold"
+)
+
+// contentScan is a scan of a content, and the appeal and review of it
+// when it was flagged
+type contentScan struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	Content  uint   `gorm:"index"`
+	UserID   uint   `gorm:"index"`
+	Status   string `gorm:"index"`
+	Attempts int
+	Reason   string
+	Error    string
+
+	AppealedAt time.Time
+	Appeal     string
+	ReviewedAt time.Time
+	ReviewedBy uint
+	Decision   string
+	Note       string
+}
+
+func newScanner(cfg config.Scanning) scan.Scanner {
+	if !cfg.Enabled {
+		return nil
+	}
+	s := scan.New(cfg.URL, cfg.Command)
+	if s == nil {
+		log.Warn("content scanning is enabled without a scanner url or command, nothing is scanned")
+	}
+	return s
+}
+
+// queueScan holds a content back from being pinned until it is scanned
+func (cm *ContentManager) queueScan(ctx context.Context, contID uint, size int64, loc string) error {
+	var content util.Content
+	if err := cm.DB.First(&content, "id = ?", contID).Error; err != nil {
+		return err
+	}
+	if err := cm.DB.Model(util.Content{}).Where("id = ?", contID).UpdateColumns(map[string]interface{}{
+		"size":     size,
+		"location": loc,
+	}).Error; err != nil {
+		return xerrors.Errorf("failed to update content in database: %w", err)
+	}
+
+	sc := &contentScan{
+		Content: contID,
+		UserID:  content.UserID,
+		Status:  scanPending,
+	}
+	if err := cm.DB.WithContext(ctx).Create(sc).Error; err != nil {
+		return err
+	}
+
+	go func() {
+		if err := cm.runScan(context.Background(), sc.ID); err != nil {
+			log.Errorf("failed to scan content %d: %s", contID, err)
+		}
+	}()
+	return nil
+}
+
+// markPinned makes a content active, once all of it is stored
+func (cm *ContentManager) markPinned(ctx context.Context, contID uint, size int64, loc string) error {
+	if err := cm.DB.Model(util.Content{}).Where("id = ?", contID).UpdateColumns(map[string]interface{}{
+		"active":          true,
+		"size":            size,
+		"pinning":         false,
+		"location":        loc,
+		"pin_finished_at": time.Now(),
+	}).Error; err != nil {
+		return xerrors.Errorf("failed to update content in database: %w", err)
+	}
+	cm.recordContentEvent(ctx, eventContentPinned, contID, map[string]interface{}{
+		"size":     size,
+		"location": loc,
+	})
+	cm.issueReceipt(ctx, contID, receiptPinned)
+	cm.advertise(ctx, contID)
+	return nil
+}
+
+// runScan runs a scan it could claim. Content on a shuttle is scanned
+// there, which sends the verdict back.
+func (cm *ContentManager) runScan(ctx context.Context, id uint) error {
+	res := cm.DB.WithContext(ctx).Model(&contentScan{}).
+		Where("id = ? AND (status = ? OR (status = ? AND updated_at < ?))", id, scanPending, scanRunning, time.Now().Add(-2*cm.scanCfg.Timeout)).
+		UpdateColumns(map[string]interface{}{"status": scanRunning, "updated_at": time.Now()})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil
+	}
+
+	var sc contentScan
+	if err := cm.DB.First(&sc, "id = ?", id).Error; err != nil {
+		return err
+	}
+	var content util.Content
+	if err := cm.DB.First(&content, "id = ?", sc.Content).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return cm.DB.Model(&contentScan{}).Where("id = ?", id).UpdateColumns(map[string]interface{}{
+				"status": scanFailed,
+				"error":  "content was removed",
+			}).Error
+		}
+		return err
+	}
+
+	switch content.Location {
+	case constants.ContentLocationLocal, constants.ContentLocationRemote, constants.ContentLocationCluster, "":
+	default:
+		if err := cm.sendShuttleCommand(ctx, content.Location, &drpc.Command{
+			Op: drpc.CMD_ScanContent,
+			Params: drpc.CmdParams{
+				ScanContent: &drpc.ScanContent{Content: content.ID, Cid: content.Cid.CID},
+			},
+		}); err != nil {
+			return cm.applyScan(ctx, &sc, content, nil, err)
+		}
+		// stays running until the shuttle answers, or is run again once
+		// stale
+		return nil
+	}
+
+	result, err := cm.scanContent(ctx, content.Cid.CID)
+	return cm.applyScan(ctx, &sc, content, result, err)
+}
+
+// applyScan records the verdict of a scan: content that is not flagged is
+// pinned and content that is is quarantined. A failed scan is run again
+// until it runs out of attempts.
+func (cm *ContentManager) applyScan(ctx context.Context, sc *contentScan, content util.Content, result *scan.Result, err error) error {
+	id := sc.ID
+	if err != nil {
+		attempts := sc.Attempts + 1
+		status := scanPending
+		if attempts >= cm.scanCfg.MaxAttempts {
+			status = scanFailed
+			if err := cm.DB.Model(util.Content{}).Where("id = ?", content.ID).UpdateColumns(map[string]interface{}{
+				"pinning":         false,
+				"failed":          true,
+				"pin_finished_at": time.Now(),
+			}).Error; err != nil {
+				return err
+			}
+		}
+		log.Warnf("scanning content %d failed (attempt %d): %s", content.ID, attempts, err)
+		return cm.DB.Model(&contentScan{}).Where("id = ?", id).UpdateColumns(map[string]interface{}{
+			"status":   status,
+			"attempts": attempts,
+			"error":    err.Error(),
+		}).Error
+	}
+
+	if !result.Flagged {
+		if err := cm.DB.Model(&contentScan{}).Where("id = ?", id).UpdateColumns(map[string]interface{}{
+			"status": scanClean,
+			"error":  "",
+		}).Error; err != nil {
+			return err
+		}
+		if err := cm.markPinned(ctx, content.ID, content.Size, content.Location); err != nil {
+			return err
+		}
+		cm.ToCheck <- content.ID
+		return nil
+	}
+
+	log.Warnw("content flagged by the scanner, quarantining it", "content", content.ID, "reason", result.Reason)
+	if err := cm.DB.Model(&contentScan{}).Where("id = ?", id).UpdateColumns(map[string]interface{}{
+		"status": scanFlagged,
+		"reason": result.Reason,
+		"error":  "",
+	}).Error; err != nil {
+		return err
+	}
+	if err := cm.DB.Model(util.Content{}).Where("id = ?", content.ID).UpdateColumns(map[string]interface{}{
+		"quarantined": true,
+		"pinning":     false,
+	}).Error; err != nil {
+		return err
+	}
+	cm.recordContentEvent(ctx, eventContentQuarantined, content.ID, map[string]interface{}{
+		"reason": result.Reason,
+	})
+	return nil
+}
+
+// scanContent scans the dag under root stored here, nothing is fetched
+func (cm *ContentManager) scanContent(ctx context.Context, root cid.Cid) (*scan.Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, cm.scanCfg.Timeout)
+	defer cancel()
+
+	dserv := merkledag.NewDAGService(blockservice.New(cm.Node.Blockstore, offline.Exchange(cm.Node.Blockstore)))
+	return scan.Dag(ctx, cm.scanner, dserv, root)
+}
+
+// handleRpcScanResult applies the verdict of a shuttle on a content stored
+// on it
+func (cm *ContentManager) handleRpcScanResult(ctx context.Context, handle string, res *drpc.ScanResult) error {
+	var content util.Content
+	if err := cm.DB.First(&content, "id = ?", res.Content).Error; err != nil {
+		return err
+	}
+	if content.Location != handle {
+		return fmt.Errorf("shuttle %s sent the scan result of content %d, which is on %s", handle, content.ID, content.Location)
+	}
+
+	var sc contentScan
+	if err := cm.DB.Order("id desc").First(&sc, "content = ? AND status = ?", content.ID, scanRunning).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// a stale scan that was run again, or one of removed content
+			return nil
+		}
+		return err
+	}
+
+	if res.Error != "" {
+		return cm.applyScan(ctx, &sc, content, nil, errors.New(res.Error))
+	}
+	return cm.applyScan(ctx, &sc, content, &scan.Result{Flagged: res.Flagged, Reason: res.Reason}, nil)
+}
+
+// runScans picks up scans that were not run, failed or were cut short
+func (s *Server) runScans(ctx context.Context) error {
+	var ids []uint
+	if err := s.DB.WithContext(ctx).Model(&contentScan{}).
+		Where("status = ? OR (status = ? AND updated_at < ?)", scanPending, scanRunning, time.Now().Add(-2*s.CM.scanCfg.Timeout)).
+		Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := s.CM.runScan(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkQuarantine fails with 451 for a cid that was quarantined, or that
+// is waiting to be scanned and isn't pinned by anyone yet
+func (s *Server) checkQuarantine(ctx context.Context, cc cid.Cid) error {
+	var res struct {
+		Quarantined int64
+		Active      int64
+		Scanning    int64
+	}
+	if err := s.DB.WithContext(ctx).Model(&util.Content{}).
+		Select("COALESCE(SUM(CASE WHEN quarantined THEN 1 ELSE 0 END), 0) AS quarantined, "+
+			"COALESCE(SUM(CASE WHEN active THEN 1 ELSE 0 END), 0) AS active, "+
+			"COALESCE(SUM(CASE WHEN id IN (SELECT content FROM content_scans WHERE status IN ?) THEN 1 ELSE 0 END), 0) AS scanning",
+			[]string{scanPending, scanRunning}).
+		Where("cid = ?", util.DbCID{CID: cc}).
+		Scan(&res).Error; err != nil {
+		return err
+	}
+	if res.Quarantined > 0 {
+		return &util.HttpError{
+			Code:    http.StatusUnavailableForLegalReasons,
+			Reason:  util.ERR_CONTENT_QUARANTINED,
+			Details: fmt.Sprintf("%s is quarantined", cc),
+		}
+	}
+	if res.Scanning > 0 && res.Active == 0 {
+		return &util.HttpError{
+			Code:    http.StatusUnavailableForLegalReasons,
+			Reason:  util.ERR_CONTENT_QUARANTINED,
+			Details: fmt.Sprintf("%s is waiting to be scanned", cc),
+		}
+	}
+	return nil
+}
+
+// handleGetContentScans godoc
+// @Summary      Get the scans of a content
+// @Description  This endpoint returns the scans of a content, newest first, with the appeal and review of flagged ones.
+// @Tags         content
+// @Produce      json
+// @Param        id   path      int  true  "Content ID"
+// @Success      200  {array}   contentScan
+// @Router       /content/{id}/scans [get]
+func (s *Server) handleGetContentScans(c echo.Context, u *User) error {
+	content, err := s.getOwnContent(c, u)
+	if err != nil {
+		return err
+	}
+
+	var scans []contentScan
+	if err := s.DB.Order("id desc").Find(&scans, "content = ?", content.ID).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, scans)
+}
+
+type scanAppealBody struct {
+	Appeal string `json:"appeal"`
+}
+
+// handleAppealScan godoc
+// @Summary      Appeal a quarantine
+// @Description  This endpoint asks for the review of a content the scanner flagged. Admins release it, or uphold the quarantine.
+// @Tags         content
+// @Accept       json
+// @Param        id    path  int             true  "Content ID"
+// @Param        body  body  scanAppealBody  true  "Appeal"
+// @Router       /content/{id}/appeal [post]
+func (s *Server) handleAppealScan(c echo.Context, u *User) error {
+	content, err := s.getOwnContent(c, u)
+	if err != nil {
+		return err
+	}
+
+	var body scanAppealBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	var scans []contentScan
+	if err := s.DB.Order("id desc").Limit(1).Find(&scans, "content = ? AND status = ?", content.ID, scanFlagged).Error; err != nil {
+		return err
+	}
+	if !content.Quarantined || len(scans) == 0 || !scans[0].AppealedAt.IsZero() {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("content %d is not quarantined, or was appealed already", content.ID),
+		}
+	}
+
+	if err := s.DB.Model(&contentScan{}).Where("id = ?", scans[0].ID).UpdateColumns(map[string]interface{}{
+		"appealed_at": time.Now(),
+		"appeal":      body.Appeal,
+	}).Error; err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// handleAdminListScans godoc
+// @Summary      List flagged content
+// @Description  This endpoint lists the scans that flagged content, appealed ones first, for review.
+// @Tags         admin
+// @Produce      json
+// @Param        reviewed  query     bool  false  "Include reviewed scans"
+// @Success      200       {array}   contentScan
+// @Router       /admin/scans [get]
+func (s *Server) handleAdminListScans(c echo.Context) error {
+	q := s.DB.Where("status = ?", scanFlagged)
+	if c.QueryParam("reviewed") != "true" {
+		q = q.Where("decision = ''")
+	}
+
+	var scans []contentScan
+	if err := q.Order("appealed_at desc, id asc").Limit(500).Find(&scans).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, scans)
+}
+
+type scanReviewBody struct {
+	// Decision is release or uphold
+	Decision string `json:"decision"`
+	Note     string `json:"note"`
+}
+
+// handleAdminReviewScan godoc
+// @Summary      Review flagged content
+// @Description  This endpoint releases content the scanner flagged, which is then pinned, or upholds its quarantine.
+// @Tags         admin
+// @Accept       json
+// @Param        id    path  int             true  "Scan ID"
+// @Param        body  body  scanReviewBody  true  "Review"
+// @Router       /admin/scans/{id}/review [post]
+func (s *Server) handleAdminReviewScan(c echo.Context, u *User) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	var body scanReviewBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if body.Decision != reviewRelease && body.Decision != reviewUphold {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("decision must be %s or %s", reviewRelease, reviewUphold),
+		}
+	}
+
+	var sc contentScan
+	if err := s.DB.First(&sc, "id = ? AND status = ?", id, scanFlagged).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_RECORD_NOT_FOUND,
+				Details: fmt.Sprintf("flagged scan %d was not found", id),
+			}
+		}
+		return err
+	}
+
+	if err := s.DB.Model(&contentScan{}).Where("id = ?", sc.ID).UpdateColumns(map[string]interface{}{
+		"reviewed_at": time.Now(),
+		"reviewed_by": u.ID,
+		"decision":    body.Decision,
+		"note":        body.Note,
+	}).Error; err != nil {
+		return err
+	}
+
+	if body.Decision == reviewRelease {
+		var content util.Content
+		if err := s.DB.First(&content, "id = ?", sc.Content).Error; err != nil {
+			return err
+		}
+		if err := s.DB.Model(util.Content{}).Where("id = ?", content.ID).Update("quarantined", false).Error; err != nil {
+			return err
+		}
+		if err := s.CM.markPinned(c.Request().Context(), content.ID, content.Size, content.Location); err != nil {
+			return err
+		}
+		s.CM.ToCheck <- content.ID
+	}
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/access"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/time/rate"
+	"gorm.io/gorm"
+)
+
+// shareLinkPasswordHeader carries the password of a share link, it can be
+// passed in the password query parameter too
+const shareLinkPasswordHeader = "X-Estuary-Share-Password"
+
+// password attempts on a share link are limited to shareLinkAttempts a
+// minute, tracked for up to shareLinkAttemptsTracked links
+const (
+	shareLinkAttempts        = 10
+	shareLinkAttemptsTracked = 10000
+)
+
+// shareTokenExpiry is how long the access tokens minted to serve private
+// content through a share link, or a name, are valid
+const shareTokenExpiry = time.Hour
+
+// shareLink lets anyone with its token retrieve a content, or the contents
+// of a collection, through the gateway
+type shareLink struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	Token      string     `gorm:"uniqueIndex" json:"token"`
+	UserID     uint       `gorm:"index" json:"-"`
+	Namespace  string     `gorm:"index" json:"namespace,omitempty"`
+	Content    uint       `json:"content,omitempty"`
+	Collection uint       `json:"-"`
+	Expiry     *time.Time `json:"expiry,omitempty"`
+	PassHash   string     `json:"-"`
+	Views      int64      `json:"views"`
+}
+
+type createShareLinkBody struct {
+	Content uint   `json:"content"`
+	ColUuid string `json:"coluuid"`
+	// Expiry is how long the link works, eg 168h, it works until it is
+	// deleted if empty
+	Expiry   string `json:"expiry"`
+	Password string `json:"password"`
+}
+
+type shareLinkResponse struct {
+	shareLink
+	ColUuid   string `json:"coluuid,omitempty"`
+	Protected bool   `json:"protected"`
+	URL       string `json:"url"`
+}
+
+func (s *Server) shareLinkResponse(ctx context.Context, l shareLink) (*shareLinkResponse, error) {
+	resp := &shareLinkResponse{
+		shareLink: l,
+		Protected: l.PassHash != "",
+		URL:       fmt.Sprintf("%s/share/%s", s.estuaryCfg.Hostname, l.Token),
+	}
+	if l.Collection != 0 {
+		var col Collection
+		if err := s.DB.WithContext(ctx).First(&col, "id = ?", l.Collection).Error; err != nil {
+			return nil, err
+		}
+		resp.ColUuid = col.UUID
+	}
+	return resp, nil
+}
+
+// handleCreateShareLink godoc
+// @Summary      Create a share link
+// @Description  This endpoint creates a link that lets anyone holding it retrieve a content, or the contents of a collection, through the gateway, private ones included. Links can expire and be protected with a password, which is then passed in the password query parameter or the X-Estuary-Share-Password header.
+// @Tags         User
+// @Accept       json
+// @Produce      json
+// @Param        body  body      createShareLinkBody  true  "Content or collection to share"
+// @Success      200   {object}  shareLinkResponse
+// @Router       /user/share-links [post]
+func (s *Server) handleCreateShareLink(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+	var body createShareLinkBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if (body.Content == 0) == (body.ColUuid == "") {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "either a content or a collection has to be shared",
+		}
+	}
+
+	link := shareLink{
+		Token:   uuid.New().String(),
+		UserID:  u.ID,
+		Content: body.Content,
+	}
+	if body.Content != 0 {
+		cont, err := s.getOwnContentByID(u, int(body.Content))
+		if err != nil {
+			return err
+		}
+		link.Namespace = cont.Namespace
+	} else {
+		col, err := s.getCollection(ctx, u, body.ColUuid, orgRoleAdmin)
+		if err != nil {
+			return err
+		}
+		link.Collection = col.ID
+		link.Namespace = col.Namespace
+	}
+
+	if body.Expiry != "" {
+		ttl, err := time.ParseDuration(body.Expiry)
+		if err != nil || ttl <= 0 {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: "expiry must be a positive duration",
+			}
+		}
+		exp := time.Now().Add(ttl).Truncate(time.Second)
+		link.Expiry = &exp
+	}
+	if body.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(body.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: err.Error(),
+			}
+		}
+		link.PassHash = string(hash)
+	}
+
+	if err := s.DB.WithContext(ctx).Create(&link).Error; err != nil {
+		return err
+	}
+	resp, err := s.shareLinkResponse(ctx, link)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// handleListShareLinks godoc
+// @Summary      List share links
+// @Description  This endpoint lists the share links of the user, with how many times they were used. Keys bound to a namespace only see the links of content and collections in it.
+// @Tags         User
+// @Produce      json
+// @Success      200  {array}  shareLinkResponse
+// @Router       /user/share-links [get]
+func (s *Server) handleListShareLinks(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+	var links []shareLink
+	if err := s.DB.WithContext(ctx).Order("id").Scopes(inNamespace(u)).Find(&links, "user_id = ?", u.ID).Error; err != nil {
+		return err
+	}
+
+	out := make([]*shareLinkResponse, 0, len(links))
+	for _, l := range links {
+		resp, err := s.shareLinkResponse(ctx, l)
+		if err != nil {
+			return err
+		}
+		out = append(out, resp)
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+// handleDeleteShareLink godoc
+// @Summary      Delete a share link
+// @Description  This endpoint deletes a share link, it stops working right away.
+// @Tags         User
+// @Param        token  path  string  true  "Token of the link"
+// @Router       /user/share-links/{token} [delete]
+func (s *Server) handleDeleteShareLink(c echo.Context, u *User) error {
+	res := s.DB.WithContext(c.Request().Context()).Scopes(inNamespace(u)).Where("token = ? AND user_id = ?", c.Param("token"), u.ID).Delete(&shareLink{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_RECORD_NOT_FOUND,
+			Details: "share link was not found",
+		}
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// openShareLink finds the link of a token and checks it can be used
+func (s *Server) openShareLink(c echo.Context) (*shareLink, error) {
+	var link shareLink
+	if err := s.DB.WithContext(c.Request().Context()).First(&link, "token = ?", c.Param("token")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_RECORD_NOT_FOUND,
+				Details: "share link was not found",
+			}
+		}
+		return nil, err
+	}
+	if link.Expiry != nil && time.Now().After(*link.Expiry) {
+		return nil, &util.HttpError{
+			Code:    http.StatusGone,
+			Reason:  util.ERR_NOT_AUTHORIZED,
+			Details: "share link expired",
+		}
+	}
+
+	if link.PassHash != "" {
+		pw := c.QueryParam("password")
+		if pw == "" {
+			pw = c.Request().Header.Get(shareLinkPasswordHeader)
+		}
+		if pw == "" {
+			return nil, &util.HttpError{
+				Code:    http.StatusUnauthorized,
+				Reason:  util.ERR_NOT_AUTHORIZED,
+				Details: "share link needs a password",
+			}
+		}
+		if !s.shareLinkAttempt(link.ID) {
+			return nil, &util.HttpError{
+				Code:    http.StatusTooManyRequests,
+				Reason:  util.ERR_RATE_LIMITED,
+				Details: "too many password attempts on this share link, try again later",
+			}
+		}
+		if !link.checkPassword(pw) {
+			return nil, &util.HttpError{
+				Code:    http.StatusUnauthorized,
+				Reason:  util.ERR_NOT_AUTHORIZED,
+				Details: "share link needs a password",
+			}
+		}
+	}
+
+	// the password goes no further, the gateway forwards the query to
+	// shuttles, other gateways and the cdn
+	q := c.Request().URL.Query()
+	if q.Has("password") {
+		q.Del("password")
+		c.Request().URL.RawQuery = q.Encode()
+	}
+	c.Request().Header.Del(shareLinkPasswordHeader)
+	return &link, nil
+}
+
+// checkPassword checks a password against the bcrypt hash of the link
+func (l *shareLink) checkPassword(pw string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(l.PassHash), []byte(pw)) == nil
+}
+
+// shareLinkAttempt takes a password attempt on a link, false when the link
+// had too many lately
+func (s *Server) shareLinkAttempt(id uint) bool {
+	v, ok := s.shareAttempts.Get(id)
+	if !ok {
+		v = rate.NewLimiter(rate.Every(time.Minute/shareLinkAttempts), shareLinkAttempts)
+		if prev, found, _ := s.shareAttempts.PeekOrAdd(id, v); found {
+			v = prev
+		}
+	}
+	return v.(*rate.Limiter).Allow()
+}
+
+type sharedFile struct {
+	Path string           `json:"path"`
+	Cid  util.DbCID       `json:"cid"`
+	Size int64            `json:"size"`
+	Type util.ContentType `json:"type"`
+}
+
+// handleServeShareLink godoc
+// @Summary      Retrieve shared content
+// @Description  This endpoint serves what a share link was made for through the gateway. A content is served at the link and paths below it go into its DAG. For a collection the link lists its contents and their paths in the collection serve them.
+// @Tags         public
+// @Param        token     path   string  true   "Token of the link"
+// @Param        password  query  string  false  "Password of the link"
+// @Router       /share/{token} [get]
+func (s *Server) handleServeShareLink(c echo.Context) error {
+	ctx := c.Request().Context()
+	link, err := s.openShareLink(c)
+	if err != nil {
+		return err
+	}
+	rest := strings.Trim(c.Param("*"), "/")
+
+	var content util.Content
+	if link.Content != 0 {
+		if err := s.DB.WithContext(ctx).First(&content, "id = ? AND active", link.Content).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return &util.HttpError{
+					Code:    http.StatusNotFound,
+					Reason:  util.ERR_CONTENT_NOT_FOUND,
+					Details: "the shared content was removed",
+				}
+			}
+			return err
+		}
+	} else {
+		var refs []util.ContentWithPath
+		if err := s.DB.WithContext(ctx).Model(CollectionRef{}).
+			Where("collection = ? AND contents.active", link.Collection).
+			Joins("JOIN contents ON contents.id = collection_refs.content").
+			Select("contents.*, collection_refs.path AS path").
+			Order("collection_refs.path").
+			Scan(&refs).Error; err != nil {
+			return err
+		}
+
+		if rest == "" {
+			out := make([]sharedFile, 0, len(refs))
+			for _, r := range refs {
+				out = append(out, sharedFile{Path: r.Path, Cid: r.Cid, Size: r.Size, Type: r.Type})
+			}
+			return c.JSON(http.StatusOK, out)
+		}
+
+		// the content at the path, or a directory the path goes into
+		found := false
+		for _, r := range refs {
+			p := strings.Trim(r.Path, "/")
+			if rest == p || strings.HasPrefix(rest, p+"/") {
+				content = r.Content
+				rest = strings.TrimPrefix(strings.TrimPrefix(rest, p), "/")
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("nothing is shared at %s", rest),
+			}
+		}
+	}
+
+	// the link stands in for the access token of private content
+	if err := s.serveThroughGateway(c, &content, rest); err != nil {
+		return err
+	}
+
+	// only views that got the content count
+	if c.Response().Status < http.StatusBadRequest {
+		if err := s.DB.WithContext(ctx).Model(&shareLink{}).Where("id = ?", link.ID).
+			UpdateColumn("views", gorm.Expr("views + 1")).Error; err != nil {
+			log.Warnf("failed to count view of share link %d: %s", link.ID, err)
+		}
+	}
+	return nil
+}
+
+// serveThroughGateway serves the DAG of content, or the path p in it, as
+// the gateway does. Access to it must have been checked already.
+func (s *Server) serveThroughGateway(c echo.Context, content *util.Content, p string) error {
+	root := content.Cid.CID.String()
+	if content.Private {
+		tok, err := access.Mint(s.accessSecret, access.Token{Cid: root, Expiry: time.Now().Add(shareTokenExpiry).Unix()})
+		if err != nil {
+			return err
+		}
+		c.Request().Header.Set(accessTokenHeader, tok)
+	}
+	c.SetParamNames("*")
+	c.SetParamValues(path.Join("ipfs", root, p))
+	return s.handleGateway(c)
+}
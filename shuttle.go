@@ -13,6 +13,7 @@ import (
 
 	drpc "github.com/application-research/estuary/drpc"
 	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/requestid"
 	"github.com/application-research/filclient"
 	"github.com/filecoin-project/go-address"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
@@ -48,12 +49,23 @@ type ShuttleConnection struct {
 	private bool
 
 	spaceLow       bool
+	draining       bool
+	intakePaused   bool
 	blockstoreSize uint64
 	blockstoreFree uint64
 	pinCount       int64
 	pinQueueLength int64
 }
 
+// bandwidthMark is where the bandwidth totals of a shuttle were at its last
+// update, the next one is recorded as the difference. It outlives the
+// connection so traffic while the shuttle was away is counted.
+type bandwidthMark struct {
+	started time.Time
+	ingest  uint64
+	egress  uint64
+}
+
 func (sc *ShuttleConnection) sendMessage(ctx context.Context, cmd *drpc.Command) error {
 	select {
 	case sc.cmds <- cmd:
@@ -112,6 +124,12 @@ func (cm *ContentManager) registerShuttleConnection(handle string, hello *drpc.H
 
 	cm.shuttles[handle] = sc
 
+	go func() {
+		if err := cm.sendBandwidthLimits(ctx, handle); err != nil {
+			log.Errorf("failed to send bandwidth limits to shuttle %s: %s", handle, err)
+		}
+	}()
+
 	return sc.cmds, func() {
 		cancel()
 		cm.shuttlesLk.Lock()
@@ -136,7 +154,7 @@ func (cm *ContentManager) handleShuttleMessages(ctx context.Context, numHandlers
 					return
 				case msg := <-cm.IncomingRPCMessages:
 					if err := cm.processShuttleMessage(msg.Handle, msg); err != nil {
-						log.Errorf("failed to process message from shuttle: %s", err)
+						log.Errorw("failed to process message from shuttle", "shuttle", msg.Handle, "op", msg.Op, "requestId", msg.RequestID, "err", err)
 					}
 				}
 			}
@@ -145,7 +163,7 @@ func (cm *ContentManager) handleShuttleMessages(ctx context.Context, numHandlers
 }
 
 func (cm *ContentManager) processShuttleMessage(handle string, msg *drpc.Message) error {
-	ctx := context.TODO()
+	ctx := requestid.WithID(context.TODO(), msg.RequestID)
 
 	// if the message contains a trace continue it here.
 	if msg.HasTraceCarrier() {
@@ -163,6 +181,9 @@ func (cm *ContentManager) processShuttleMessage(handle string, msg *drpc.Message
 		if ups == nil {
 			return ErrNilParams
 		}
+		if ups.Reason != "" {
+			cm.setPinFailure(ups.DBID, ups.Reason)
+		}
 		return cm.UpdatePinStatus(handle, ups.DBID, ups.Status)
 	case drpc.OP_PinComplete:
 		param := msg.Params.PinComplete
@@ -234,6 +255,78 @@ func (cm *ContentManager) processShuttleMessage(handle string, msg *drpc.Message
 			log.Errorf("handling split complete message from shuttle %s: %s", handle, err)
 		}
 		return nil
+	case drpc.OP_PinFetchStats:
+		param := msg.Params.PinFetchStats
+		if param == nil {
+			return ErrNilParams
+		}
+
+		if err := cm.handleRpcPinFetchStats(ctx, handle, param); err != nil {
+			log.Errorf("handling pin fetch stats message from shuttle %s: %s", handle, err)
+		}
+		return nil
+	case drpc.OP_AuditResult:
+		param := msg.Params.AuditResult
+		if param == nil {
+			return ErrNilParams
+		}
+
+		go func() {
+			if err := cm.handleRpcAuditResult(context.Background(), handle, param); err != nil {
+				log.Errorf("handling audit result message from shuttle %s: %s", handle, err)
+			}
+		}()
+		return nil
+	case drpc.OP_RetrieveFailed:
+		param := msg.Params.RetrieveFailed
+		if param == nil {
+			return ErrNilParams
+		}
+
+		if err := cm.handleRpcRetrieveFailed(ctx, handle, param); err != nil {
+			log.Errorf("handling retrieve failed message from shuttle %s: %s", handle, err)
+		}
+		return nil
+	case drpc.OP_RepairFailed:
+		param := msg.Params.RepairFailed
+		if param == nil {
+			return ErrNilParams
+		}
+
+		if err := cm.handleRpcRepairFailed(ctx, handle, param); err != nil {
+			log.Errorf("handling repair failed message from shuttle %s: %s", handle, err)
+		}
+		return nil
+	case drpc.OP_RetrievalResult:
+		param := msg.Params.RetrievalResult
+		if param == nil {
+			return ErrNilParams
+		}
+
+		if err := cm.handleRpcRetrievalResult(ctx, handle, param); err != nil {
+			log.Errorf("handling retrieval result message from shuttle %s: %s", handle, err)
+		}
+		return nil
+	case drpc.OP_ScanResult:
+		param := msg.Params.ScanResult
+		if param == nil {
+			return ErrNilParams
+		}
+
+		if err := cm.handleRpcScanResult(ctx, handle, param); err != nil {
+			log.Errorf("handling scan result message from shuttle %s: %s", handle, err)
+		}
+		return nil
+	case drpc.OP_DagStat:
+		param := msg.Params.DagStat
+		if param == nil {
+			return ErrNilParams
+		}
+
+		if err := cm.handleRpcDagStat(ctx, handle, param); err != nil {
+			log.Errorf("handling dag stat message from shuttle %s: %s", handle, err)
+		}
+		return nil
 	default:
 		return fmt.Errorf("unrecognized message op: %q", msg.Op)
 	}
@@ -250,6 +343,9 @@ func (cm *ContentManager) sendShuttleCommand(ctx context.Context, handle string,
 	d, ok := cm.shuttles[handle]
 	cm.shuttlesLk.Unlock()
 	if ok {
+		// if a span is contained in `ctx` the shuttle will continue it when handling the command
+		cmd.TraceCarrier = drpc.NewTraceCarrier(trace.SpanFromContext(ctx).SpanContext())
+		cmd.RequestID = requestid.FromContext(ctx)
 		return d.sendMessage(ctx, cmd)
 	}
 
@@ -398,7 +494,28 @@ func (cm *ContentManager) handleRpcShuttleUpdate(ctx context.Context, handle str
 	d.blockstoreSize = param.BlockstoreSize
 	d.pinCount = param.NumPins
 	d.pinQueueLength = int64(param.PinQueueSize)
+	d.draining = param.Draining
+	d.intakePaused = param.IntakePaused
+
+	// the first update since the primary started only sets where to count
+	// from. After a restart of the shuttle, seen by when it started or by
+	// totals that went down, all it counted is new.
+	var ingest, egress uint64
+	mark, ok := cm.shuttleBandwidth[handle]
+	switch {
+	case !ok:
+	case !param.StartedAt.Equal(mark.started) || param.IngestBytes < mark.ingest || param.EgressBytes < mark.egress:
+		ingest, egress = param.IngestBytes, param.EgressBytes
+	default:
+		ingest, egress = param.IngestBytes-mark.ingest, param.EgressBytes-mark.egress
+	}
+	cm.shuttleBandwidth[handle] = bandwidthMark{started: param.StartedAt, ingest: param.IngestBytes, egress: param.EgressBytes}
 
+	go func() {
+		if err := cm.recordShuttleBandwidth(context.Background(), handle, int64(ingest), int64(egress)); err != nil {
+			log.Errorf("failed to record the bandwidth of shuttle %s: %s", handle, err)
+		}
+	}()
 	return nil
 }
 
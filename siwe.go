@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/oidc"
+	"github.com/application-research/estuary/util/siwe"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// identities of wallets are kept with provider siwe and their lower case
+// address as subject
+const siweProvider = "siwe"
+
+// siweNonce is a nonce that was used to sign in. Nonces are handed out
+// without being stored, they are only recorded once used, until they expire,
+// so they can't be used again.
+type siweNonce struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	Nonce  string `gorm:"uniqueIndex"`
+	Expiry time.Time
+}
+
+// a nonce is a random value and its expiry, followed by their mac, hex
+// encoded as nonces have to be alphanumeric
+const (
+	siweNonceRandLen = 16
+	siweNonceMACLen  = 16
+	siweNonceLen     = siweNonceRandLen + 8 + siweNonceMACLen
+)
+
+func (s *Server) siweNonceMAC(b []byte) []byte {
+	mac := hmac.New(sha256.New, s.accessSecret)
+	mac.Write([]byte("estuary-siwe-nonce:")) //nolint:errcheck
+	mac.Write(b)                             //nolint:errcheck
+	return mac.Sum(nil)[:siweNonceMACLen]
+}
+
+// newSIWENonce returns a nonce that is valid until expiry
+func (s *Server) newSIWENonce(expiry time.Time) (string, error) {
+	b := make([]byte, siweNonceRandLen+8, siweNonceLen)
+	if _, err := rand.Read(b[:siweNonceRandLen]); err != nil {
+		return "", err
+	}
+	binary.BigEndian.PutUint64(b[siweNonceRandLen:], uint64(expiry.Unix()))
+	return hex.EncodeToString(append(b, s.siweNonceMAC(b)...)), nil
+}
+
+// checkSIWENonce checks that nonce was handed out by a node of this
+// estuary, and returns when it expires
+func (s *Server) checkSIWENonce(nonce string) (time.Time, bool) {
+	b, err := hex.DecodeString(nonce)
+	if err != nil || len(b) != siweNonceLen {
+		return time.Time{}, false
+	}
+	data, mac := b[:siweNonceRandLen+8], b[siweNonceRandLen+8:]
+	if !hmac.Equal(mac, s.siweNonceMAC(data)) {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(binary.BigEndian.Uint64(data[siweNonceRandLen:])), 0), true
+}
+
+func (s *Server) siweDomain() string {
+	if d := s.estuaryCfg.SIWE.Domain; d != "" {
+		return d
+	}
+	u, err := url.Parse(s.estuaryCfg.Hostname)
+	if err != nil {
+		return s.estuaryCfg.Hostname
+	}
+	return u.Host
+}
+
+func (s *Server) checkSIWEEnabled() error {
+	if !s.estuaryCfg.SIWE.Enabled {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "sign in with ethereum is disabled on this node",
+		}
+	}
+	return nil
+}
+
+type siweNonceResponse struct {
+	Nonce    string    `json:"nonce"`
+	Domain   string    `json:"domain"`
+	ChainIDs []int64   `json:"chainIds"`
+	Expiry   time.Time `json:"expiry"`
+}
+
+// handleGetSIWENonce godoc
+// @Summary      Get a sign in nonce
+// @Description  This endpoint returns a nonce to put in a Sign-In With Ethereum message, along with the domain and chains the message has to be for.
+// @Tags         User
+// @Produce      json
+// @Success      200  {object}  siweNonceResponse
+// @Router       /auth/siwe/nonce [get]
+func (s *Server) handleGetSIWENonce(c echo.Context) error {
+	if err := s.checkSIWEEnabled(); err != nil {
+		return err
+	}
+
+	expiry := time.Now().Add(s.estuaryCfg.SIWE.NonceExpiry).Truncate(time.Second)
+	nonce, err := s.newSIWENonce(expiry)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, &siweNonceResponse{
+		Nonce:    nonce,
+		Domain:   s.siweDomain(),
+		ChainIDs: s.estuaryCfg.SIWE.ChainIDs,
+		Expiry:   expiry,
+	})
+}
+
+type siweBody struct {
+	Message   string `json:"message"`
+	Signature string `json:"signature"`
+}
+
+// verifySIWE checks a signed sign in message and uses up its nonce, it
+// returns the address that signed it
+func (s *Server) verifySIWE(ctx context.Context, body siweBody) (string, error) {
+	invalid := func(details string) error {
+		return &util.HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  util.ERR_INVALID_AUTH,
+			Details: details,
+		}
+	}
+
+	msg, err := siwe.Parse(body.Message)
+	if err != nil {
+		return "", invalid(err.Error())
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(body.Signature, "0x"))
+	if err != nil {
+		return "", invalid("signature must be hex encoded")
+	}
+	exp := siwe.Expect{
+		Domain:   s.siweDomain(),
+		ChainIDs: s.estuaryCfg.SIWE.ChainIDs,
+	}
+	if err := msg.Verify(body.Message, sig, exp, time.Now()); err != nil {
+		return "", invalid(err.Error())
+	}
+
+	expiry, ok := s.checkSIWENonce(msg.Nonce)
+	if !ok || !time.Now().Before(expiry) {
+		return "", invalid("unknown or expired nonce")
+	}
+	// hex decodes either case, the nonce is recorded in the case it was
+	// handed out in so it can't be used again in the other
+	used := &siweNonce{Nonce: strings.ToLower(msg.Nonce), Expiry: expiry}
+	res := s.DB.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(used)
+	if res.Error != nil {
+		return "", res.Error
+	}
+	if res.RowsAffected == 0 {
+		return "", invalid("nonce was already used")
+	}
+	return strings.ToLower(msg.Address), nil
+}
+
+// handleSIWELogin godoc
+// @Summary      Sign in with ethereum
+// @Description  This endpoint logs in the user of the wallet that signed the message, signing them up on their first login. The message has to use a nonce from /auth/siwe/nonce.
+// @Tags         User
+// @Accept       json
+// @Produce      json
+// @Param        body  body      siweBody  true  "Signed message"
+// @Success      200   {object}  loginResponse
+// @Router       /auth/siwe/login [post]
+func (s *Server) handleSIWELogin(c echo.Context) error {
+	if err := s.checkSIWEEnabled(); err != nil {
+		return err
+	}
+
+	var body siweBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	addr, err := s.verifySIWE(ctx, body)
+	if err != nil {
+		return err
+	}
+
+	var user User
+	var ident userIdentity
+	err = s.DB.WithContext(ctx).First(&ident, "provider = ? AND subject = ?", siweProvider, addr).Error
+	switch {
+	case err == nil:
+		if err := s.DB.WithContext(ctx).First(&user, ident.UserID).Error; err != nil {
+			return err
+		}
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return err
+	case !s.estuaryCfg.SIWE.AllowSignup:
+		return &util.HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  util.ERR_USER_NOT_FOUND,
+			Details: "no user is linked to this wallet",
+		}
+	default:
+		u, err := s.oidcSignup(ctx, &oidc.Identity{Name: addr})
+		if err != nil {
+			return err
+		}
+		if err := s.DB.WithContext(ctx).Create(&userIdentity{
+			UserID:   u.ID,
+			Provider: siweProvider,
+			Subject:  addr,
+		}).Error; err != nil {
+			return err
+		}
+		user = *u
+	}
+
+	authToken, err := s.newAuthTokenForUser(&user, time.Now().Add(s.estuaryCfg.SIWE.SessionExpiry), nil, "", true)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, &loginResponse{
+		Token:  authToken.Token,
+		Expiry: authToken.Expiry,
+	})
+}
+
+// handleLinkWallet godoc
+// @Summary      Link a wallet
+// @Description  This endpoint links the wallet that signed the message to the user, after which the user can sign in with it.
+// @Tags         User
+// @Accept       json
+// @Param        body  body  siweBody  true  "Signed message"
+// @Router       /user/identities/wallet [post]
+func (s *Server) handleLinkWallet(c echo.Context, u *User) error {
+	if err := s.checkSIWEEnabled(); err != nil {
+		return err
+	}
+
+	var body siweBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	addr, err := s.verifySIWE(ctx, body)
+	if err != nil {
+		return err
+	}
+
+	var ident userIdentity
+	err = s.DB.WithContext(ctx).First(&ident, "provider = ? AND subject = ?", siweProvider, addr).Error
+	switch {
+	case err == nil:
+		if ident.UserID != u.ID {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: "this wallet is linked to another user",
+			}
+		}
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		if err := s.DB.WithContext(ctx).Create(&userIdentity{
+			UserID:   u.ID,
+			Provider: siweProvider,
+			Subject:  addr,
+		}).Error; err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]string{})
+}
+
+// expireSIWENonces drops the used nonces once they expired, they can't be
+// used anymore anyway
+func (s *Server) expireSIWENonces(ctx context.Context) error {
+	return s.DB.WithContext(ctx).Where("expiry < ?", time.Now()).Delete(&siweNonce{}).Error
+}
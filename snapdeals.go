@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/network"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+)
+
+const epochDuration = time.Second * 30
+
+// snapDealsFor reports whether deals for content go to providers that take
+// snap deals
+func (cm *ContentManager) snapDealsFor(content util.Content) bool {
+	cfg := cm.snapDeals
+	return cfg.Enabled && (content.Aggregate || !cfg.AggregatesOnly)
+}
+
+// preferSnapMiners marks the miners that take snap deals and moves them to
+// the front, keeping the order otherwise
+func (cm *ContentManager) preferSnapMiners(miners []miner) ([]miner, error) {
+	addrs := make([]string, len(miners))
+	for i, m := range miners {
+		addrs[i] = m.address.String()
+	}
+
+	var snap []util.DbAddr
+	if err := cm.DB.Model(storageMiner{}).Where("address in ? AND snap_deals", addrs).Pluck("address", &snap).Error; err != nil {
+		return nil, err
+	}
+	takesSnap := make(map[string]bool, len(snap))
+	for _, a := range snap {
+		takesSnap[a.Addr.String()] = true
+	}
+
+	for i := range miners {
+		miners[i].snap = takesSnap[miners[i].address.String()]
+	}
+	sort.SliceStable(miners, func(i, j int) bool {
+		return miners[i].snap && !miners[j].snap
+	})
+	return miners, nil
+}
+
+// startSnapDeal moves the start of a proposal up to the snap deal start
+// delay, keeping its duration, and signs it again
+func (cm *ContentManager) startSnapDeal(ctx context.Context, prop *network.Proposal) error {
+	head, err := cm.Api.ChainHead(ctx)
+	if err != nil {
+		return err
+	}
+
+	p := prop.DealProposal.Proposal
+	start := head.Height() + abi.ChainEpoch(cm.snapDeals.StartDelay/epochDuration)
+	if start >= p.StartEpoch {
+		return nil
+	}
+	// the end moves up with the start, so the deal runs for as long as it
+	// was proposed for, which can differ from the default duration
+	duration := p.EndEpoch - p.StartEpoch
+	p.StartEpoch = start
+	p.EndEpoch = start + duration
+
+	raw, err := cborutil.Dump(&p)
+	if err != nil {
+		return err
+	}
+	sig, err := cm.Node.Wallet.WalletSign(ctx, cm.FilClient.ClientAddr, raw, api.MsgMeta{Type: api.MTDealProposal})
+	if err != nil {
+		return err
+	}
+
+	prop.DealProposal.Proposal = p
+	prop.DealProposal.ClientSignature = *sig
+	return nil
+}
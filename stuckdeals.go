@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/filclient"
+	"github.com/filecoin-project/go-address"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	stuckPhaseTransfer = "transfer"
+	stuckPhasePublish  = "publish"
+)
+
+func (cm *ContentManager) stuckDealSettings() config.StuckDeals {
+	cm.settingsLk.Lock()
+	defer cm.settingsLk.Unlock()
+	return cm.stuckDeals
+}
+
+func (cm *ContentManager) setStuckDealSettings(cfg config.StuckDeals) {
+	cm.settingsLk.Lock()
+	defer cm.settingsLk.Unlock()
+	cm.stuckDeals = cfg
+}
+
+// stuckDealPhase returns what a deal that isn't on chain yet is waiting on,
+// and since when. status is nil when there is no data transfer to look at.
+func stuckDealPhase(d *contentDeal, status *filclient.ChannelState) (string, time.Time) {
+	if status != nil {
+		switch status.Status {
+		case datatransfer.TransferFinished, datatransfer.Finalizing, datatransfer.Completing, datatransfer.Completed:
+			if d.TransferFinished.IsZero() {
+				// the transfer was only just seen finishing
+				return stuckPhasePublish, time.Now()
+			}
+		}
+	}
+	if !d.TransferFinished.IsZero() {
+		return stuckPhasePublish, d.TransferFinished
+	}
+	if d.TransferStarted.IsZero() {
+		return stuckPhaseTransfer, d.CreatedAt
+	}
+	return stuckPhaseTransfer, d.TransferStarted
+}
+
+// checkStuckDeal retries a deal that has been in phase since a time for too
+// long, and returns true once it is out of retries and should be failed so
+// that it gets made again with another provider
+func (cm *ContentManager) checkStuckDeal(ctx context.Context, d *contentDeal, maddr address.Address, content *util.Content, phase string, since time.Time) (bool, error) {
+	cfg := cm.stuckDealSettings()
+	if !cfg.Enabled {
+		return false, nil
+	}
+
+	timeout := cfg.TransferTimeout
+	if phase == stuckPhasePublish {
+		timeout = cfg.PublishTimeout
+	}
+	if timeout <= 0 {
+		return false, nil
+	}
+
+	retries := 0
+	if d.StuckPhase == phase {
+		retries = d.StuckRetries
+		// every retry gets a full timeout of its own
+		if d.StuckAt.After(since) {
+			since = d.StuckAt
+		}
+	}
+	if time.Since(since) < timeout {
+		return false, nil
+	}
+
+	if retries >= cfg.MaxRetries {
+		log.Warnw("failing over stuck deal", "deal", d.ID, "content", d.Content, "miner", d.Miner, "phase", phase, "retries", retries)
+		if err := cm.recordDealFailure(&DealFailureError{
+			Miner:               maddr,
+			Phase:               "stuck-" + phase,
+			Message:             fmt.Sprintf("deal made no progress in %s phase after %d retries", phase, retries),
+			Content:             d.Content,
+			UserID:              d.UserID,
+			DealProtocolVersion: d.DealProtocolVersion,
+			MinerVersion:        d.MinerVersion,
+		}); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	log.Warnw("deal is stuck, retrying", "deal", d.ID, "content", d.Content, "miner", d.Miner, "phase", phase, "since", since, "retry", retries+1)
+	// transfers the provider makes itself can't be restarted from here
+	if phase == stuckPhaseTransfer && d.DTChan != "" {
+		chanid, err := d.ChannelID()
+		if err == nil {
+			err = cm.RestartTransfer(ctx, content.Location, chanid, d.ID)
+		}
+		if err != nil {
+			log.Warnw("failed to restart stuck transfer", "deal", d.ID, "err", err)
+		}
+	}
+	// there is nothing to retry for a publish, the provider may simply be
+	// batching its publish messages, so it gets another timeout
+
+	if err := cm.DB.Model(contentDeal{}).Where("id = ?", d.ID).UpdateColumns(map[string]interface{}{
+		"stuck_phase":   phase,
+		"stuck_at":      time.Now(),
+		"stuck_retries": retries + 1,
+	}).Error; err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+type stuckDealResponse struct {
+	ID          uint      `json:"id"`
+	Content     uint      `json:"content"`
+	Cid         string    `json:"cid"`
+	Location    string    `json:"location"`
+	Miner       string    `json:"miner"`
+	Phase       string    `json:"phase"`
+	StuckAt     time.Time `json:"stuckAt"`
+	Retries     int       `json:"retries"`
+	CreatedAt   time.Time `json:"createdAt"`
+	TransferEnd time.Time `json:"transferFinished"`
+}
+
+// handleAdminGetStuckDeals godoc
+// @Summary      List stuck deals
+// @Description  This endpoint returns the deals that are not on chain yet and were found stuck in transfer or publishing, with how often they have been retried so far.
+// @Tags         admin
+// @Produce      json
+// @Success      200  {array}  stuckDealResponse
+// @Router       /admin/deals/stuck [get]
+func (s *Server) handleAdminGetStuckDeals(c echo.Context) error {
+	var deals []contentDeal
+	if err := s.DB.Where("stuck_phase != '' AND deal_id = 0 AND NOT failed").
+		Order("stuck_at asc").
+		Find(&deals).Error; err != nil {
+		return err
+	}
+
+	ids := make([]uint, 0, len(deals))
+	for _, d := range deals {
+		ids = append(ids, d.Content)
+	}
+	var conts []util.Content
+	if err := s.DB.Select("id, cid, location").Find(&conts, "id IN ?", ids).Error; err != nil {
+		return err
+	}
+	byID := make(map[uint]util.Content, len(conts))
+	for _, cont := range conts {
+		byID[cont.ID] = cont
+	}
+
+	out := make([]stuckDealResponse, 0, len(deals))
+	for _, d := range deals {
+		sd := stuckDealResponse{
+			ID:          d.ID,
+			Content:     d.Content,
+			Miner:       d.Miner,
+			Phase:       d.StuckPhase,
+			StuckAt:     d.StuckAt,
+			Retries:     d.StuckRetries,
+			CreatedAt:   d.CreatedAt,
+			TransferEnd: d.TransferFinished,
+		}
+		if cont, ok := byID[d.Content]; ok {
+			sd.Cid = cont.Cid.CID.String()
+			sd.Location = cont.Location
+		}
+		out = append(out, sd)
+	}
+	return c.JSON(http.StatusOK, out)
+}
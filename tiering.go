@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	tierHot  = "hot"
+	tierCold = "cold"
+)
+
+// contentRetrieval is how many times a cid was retrieved through the
+// gateways in an hour
+type contentRetrieval struct {
+	ID    uint       `gorm:"primarykey"`
+	Cid   util.DbCID `gorm:"uniqueIndex:idx_content_retrieval_hour"`
+	Hour  time.Time  `gorm:"uniqueIndex:idx_content_retrieval_hour"`
+	Count int64
+}
+
+// contentTier is the tier a content was put in, and the tier an admin put
+// it in instead, if any. Content without one is cold.
+type contentTier struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	Content    uint   `gorm:"uniqueIndex" json:"content"`
+	Tier       string `json:"tier"`
+	Override   string `json:"override,omitempty"`
+	Retrievals int64  `json:"retrievals"`
+
+	Effective string `gorm:"-" json:"effective"`
+}
+
+func (t *contentTier) effective() string {
+	if t.Override != "" {
+		return t.Override
+	}
+	if t.Tier != "" {
+		return t.Tier
+	}
+	return tierCold
+}
+
+// hotTiers selects the tiers of hot content
+func hotTiers(db *gorm.DB) *gorm.DB {
+	return db.Where("override = ? OR (override = '' AND tier = ?)", tierHot, tierHot)
+}
+
+// retrievals of at most this many cids are counted between flushes, so
+// retrieving made up cids can't grow the meter without bound
+const maxPendingRetrievals = 100000
+
+// at most this many blocks of hot content are read into the block cache
+// per run
+const maxWarmBlocks = 100000
+
+type retrievalKey struct {
+	cid  cid.Cid
+	hour time.Time
+}
+
+// retrievalMeter counts retrievals in memory, and adds them to the hourly
+// records when flushed
+type retrievalMeter struct {
+	db *gorm.DB
+
+	lk      sync.Mutex
+	pending map[retrievalKey]int64
+}
+
+func newRetrievalMeter(db *gorm.DB) *retrievalMeter {
+	return &retrievalMeter{
+		db:      db,
+		pending: make(map[retrievalKey]int64),
+	}
+}
+
+func (m *retrievalMeter) hit(c cid.Cid) {
+	if m == nil {
+		return
+	}
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	k := retrievalKey{cid: c, hour: time.Now().UTC().Truncate(time.Hour)}
+	if _, ok := m.pending[k]; !ok && len(m.pending) >= maxPendingRetrievals {
+		return
+	}
+	m.pending[k]++
+}
+
+func (m *retrievalMeter) flush(ctx context.Context) error {
+	m.lk.Lock()
+	pending := m.pending
+	m.pending = make(map[retrievalKey]int64)
+	m.lk.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	recs, err := m.known(ctx, pending)
+	if err == nil && len(recs) > 0 {
+		err = m.db.WithContext(ctx).Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "cid"}, {Name: "hour"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{"count": gorm.Expr("content_retrievals.count + excluded.count")}),
+		}).CreateInBatches(recs, 500).Error
+	}
+	if err != nil {
+		// keep the counts for the next flush
+		m.lk.Lock()
+		for k, n := range pending {
+			m.pending[k] += n
+		}
+		m.lk.Unlock()
+	}
+	return err
+}
+
+// known returns the records of the pending retrievals of cids that are
+// content, the others aren't counted
+func (m *retrievalMeter) known(ctx context.Context, pending map[retrievalKey]int64) ([]contentRetrieval, error) {
+	cids := make([]util.DbCID, 0, len(pending))
+	seen := make(map[cid.Cid]bool, len(pending))
+	for k := range pending {
+		if !seen[k.cid] {
+			seen[k.cid] = true
+			cids = append(cids, util.DbCID{CID: k.cid})
+		}
+	}
+
+	content := make(map[string]bool, len(cids))
+	for i := 0; i < len(cids); i += 500 {
+		batch := cids[i:]
+		if len(batch) > 500 {
+			batch = batch[:500]
+		}
+		var found []util.DbCID
+		if err := m.db.WithContext(ctx).Model(&util.Content{}).Where("cid IN ?", batch).Distinct().Pluck("cid", &found).Error; err != nil {
+			return nil, err
+		}
+		for _, c := range found {
+			content[c.CID.KeyString()] = true
+		}
+	}
+
+	recs := make([]contentRetrieval, 0, len(pending))
+	for k, n := range pending {
+		if content[k.cid.KeyString()] {
+			recs = append(recs, contentRetrieval{Cid: util.DbCID{CID: k.cid}, Hour: k.hour, Count: n})
+		}
+	}
+	return recs, nil
+}
+
+// tierContents marks the content retrieved often enough within the window
+// as hot and the rest as cold, brings back hot content that was offloaded
+// and warms the block caches with the rest of it
+func (s *Server) tierContents(ctx context.Context) error {
+	cfg := s.estuaryCfg.Tiering
+	start := time.Now()
+	since := start.UTC().Add(-cfg.HotWindow).Truncate(time.Hour)
+
+	var hot []struct {
+		Cid        util.DbCID
+		Retrievals int64
+	}
+	if err := s.DB.WithContext(ctx).Model(&contentRetrieval{}).
+		Select("cid, SUM(count) AS retrievals").
+		Where("hour >= ?", since).
+		Group("cid").
+		Having("SUM(count) >= ?", cfg.HotRetrievals).
+		Scan(&hot).Error; err != nil {
+		return err
+	}
+
+	for i := 0; i < len(hot); i += 500 {
+		batch := hot[i:]
+		if len(batch) > 500 {
+			batch = batch[:500]
+		}
+		counts := make(map[string]int64, len(batch))
+		cids := make([]util.DbCID, 0, len(batch))
+		for _, h := range batch {
+			counts[h.Cid.CID.KeyString()] = h.Retrievals
+			cids = append(cids, h.Cid)
+		}
+
+		var conts []util.Content
+		if err := s.DB.WithContext(ctx).Select("id, cid").Where("cid IN ? AND active", cids).Find(&conts).Error; err != nil {
+			return err
+		}
+		if len(conts) == 0 {
+			continue
+		}
+		rows := make([]contentTier, 0, len(conts))
+		for _, c := range conts {
+			rows = append(rows, contentTier{Content: c.ID, Tier: tierHot, Retrievals: counts[c.Cid.CID.KeyString()]})
+		}
+		if err := s.DB.WithContext(ctx).Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "content"}},
+			DoUpdates: clause.AssignmentColumns([]string{"tier", "retrievals", "updated_at"}),
+		}).Create(&rows).Error; err != nil {
+			return err
+		}
+	}
+
+	// whatever wasn't marked hot in this run cooled down
+	if err := s.DB.WithContext(ctx).Model(&contentTier{}).
+		Where("tier = ? AND updated_at < ?", tierHot, start).
+		Updates(map[string]interface{}{"tier": tierCold, "retrievals": 0}).Error; err != nil {
+		return err
+	}
+
+	if err := s.pruneRetrievals(ctx); err != nil {
+		return err
+	}
+
+	// restores in flight or that failed recently aren't started again
+	restoring := s.DB.Model(&contentRestore{}).Select("content").
+		Where("status IN ? AND started_at > ?", []string{restoreWarming, restoreFailed}, time.Now().Add(-s.estuaryCfg.Restore.Timeout))
+
+	var offloaded []util.Content
+	if err := s.DB.WithContext(ctx).Select("id, cid").
+		Where("active AND offloaded AND id IN (?)", hotTiers(s.DB.Model(&contentTier{}).Select("content"))).
+		Where("id NOT IN (?)", restoring).
+		Limit(cfg.MaxRefreshes).
+		Find(&offloaded).Error; err != nil {
+		return err
+	}
+	for _, cont := range offloaded {
+		if _, _, err := s.restoreContent(ctx, cont); err != nil {
+			log.Warnf("failed to bring back hot content %d: %s", cont.ID, err)
+		}
+	}
+	return s.warmHotContents(ctx)
+}
+
+// warmHotContents reads the blocks of the hottest content into the block
+// cache of the primary or of the shuttle it is on, so the gateways serve
+// it from memory
+func (s *Server) warmHotContents(ctx context.Context) error {
+	var hot []util.Content
+	if err := s.DB.WithContext(ctx).Model(&util.Content{}).
+		Select("contents.id, contents.location").
+		Joins("JOIN content_tiers ON content_tiers.content = contents.id").
+		Where("contents.active AND NOT contents.offloaded").
+		Where("content_tiers.override = ? OR (content_tiers.override = '' AND content_tiers.tier = ?)", tierHot, tierHot).
+		Order("content_tiers.retrievals desc").
+		Limit(s.estuaryCfg.Tiering.MaxWarm).
+		Find(&hot).Error; err != nil {
+		return err
+	}
+
+	byLoc := make(map[string][]uint)
+	for _, c := range hot {
+		byLoc[c.Location] = append(byLoc[c.Location], c.ID)
+	}
+	for loc, ids := range byLoc {
+		switch loc {
+		case constants.ContentLocationLocal:
+			if err := s.warmLocalContents(ctx, ids); err != nil {
+				log.Warnf("failed to warm hot content: %s", err)
+			}
+		case constants.ContentLocationRemote, constants.ContentLocationCluster:
+		default:
+			if err := s.CM.sendShuttleCommand(ctx, loc, &drpc.Command{
+				Op: drpc.CMD_WarmContent,
+				Params: drpc.CmdParams{
+					WarmContent: &drpc.WarmContent{Contents: ids},
+				},
+			}); err != nil {
+				log.Warnf("failed to ask shuttle %s to warm hot content: %s", loc, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) warmLocalContents(ctx context.Context, ids []uint) error {
+	if s.Node.BlockCache == nil {
+		return nil
+	}
+
+	// hottest first, as the cache may not fit them all
+	cids := make([]cid.Cid, 0, maxWarmBlocks)
+	for _, id := range ids {
+		var objs []util.DbCID
+		if err := s.DB.WithContext(ctx).Table("obj_refs").
+			Joins("JOIN objects ON objects.id = obj_refs.object").
+			Where("obj_refs.content = ?", id).
+			Order("obj_refs.id").
+			Limit(maxWarmBlocks-len(cids)).
+			Pluck("objects.cid", &objs).Error; err != nil {
+			return err
+		}
+		for _, o := range objs {
+			cids = append(cids, o.CID)
+		}
+		if len(cids) >= maxWarmBlocks {
+			break
+		}
+	}
+
+	_, err := s.Node.BlockCache.Warm(ctx, cids)
+	return err
+}
+
+func (s *Server) getContentTier(ctx context.Context, id uint) (*contentTier, error) {
+	var cont util.Content
+	if err := s.DB.WithContext(ctx).Select("id").First(&cont, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("content with ID(%d) was not found", id),
+			}
+		}
+		return nil, err
+	}
+
+	t := contentTier{Content: id}
+	if err := s.DB.WithContext(ctx).Where("content = ?", id).Find(&t).Error; err != nil {
+		return nil, err
+	}
+	t.Effective = t.effective()
+	return &t, nil
+}
+
+// handleAdminListTiers godoc
+// @Summary      List content tiers
+// @Description  This endpoint lists the content put in a tier, by retrievals within the hot window, most first.
+// @Tags         admin
+// @Produce      json
+// @Param        tier   query     string  false  "hot or cold"
+// @Param        limit  query     int     false  "Limit (default 100)"
+// @Success      200    {array}   contentTier
+// @Router       /admin/cm/tiers [get]
+func (s *Server) handleAdminListTiers(c echo.Context) error {
+	limit := 100
+	if l := c.QueryParam("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_QUERY_PARAM_VALUE,
+				Details: "limit must be a positive number",
+			}
+		}
+		limit = n
+	}
+
+	q := s.DB.Model(&contentTier{})
+	switch c.QueryParam("tier") {
+	case "":
+	case tierHot:
+		q = hotTiers(q)
+	case tierCold:
+		q = q.Where("override = ? OR (override = '' AND tier <> ?)", tierCold, tierHot)
+	default:
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_QUERY_PARAM_VALUE,
+			Details: "tier must be hot or cold",
+		}
+	}
+
+	var tiers []contentTier
+	if err := q.Order("retrievals desc, content").Limit(limit).Find(&tiers).Error; err != nil {
+		return err
+	}
+	for i := range tiers {
+		tiers[i].Effective = tiers[i].effective()
+	}
+	return c.JSON(http.StatusOK, tiers)
+}
+
+// handleAdminGetContentTier godoc
+// @Summary      Get the tier of a content
+// @Description  This endpoint returns the tier a content is in, from its retrievals and from the override an admin set.
+// @Tags         admin
+// @Produce      json
+// @Param        content  path      int  true  "Content ID"
+// @Success      200      {object}  contentTier
+// @Router       /admin/cm/tier/{content} [get]
+func (s *Server) handleAdminGetContentTier(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("content"), 10, 64)
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "content id must be a number",
+		}
+	}
+
+	t, err := s.getContentTier(c.Request().Context(), uint(id))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, t)
+}
+
+type contentTierBody struct {
+	// Override is hot, cold, or empty to go back to the tier from
+	// retrievals
+	Override string `json:"override"`
+}
+
+// handleAdminSetContentTier godoc
+// @Summary      Override the tier of a content
+// @Description  This endpoint keeps a content hot or cold whatever its retrievals, or lets its retrievals decide again with an empty override.
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        content  path      int              true  "Content ID"
+// @Param        body     body      contentTierBody  true  "Override"
+// @Success      200      {object}  contentTier
+// @Router       /admin/cm/tier/{content} [put]
+func (s *Server) handleAdminSetContentTier(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("content"), 10, 64)
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "content id must be a number",
+		}
+	}
+
+	var body contentTierBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if body.Override != "" && body.Override != tierHot && body.Override != tierCold {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "override must be hot, cold or empty",
+		}
+	}
+
+	t, err := s.getContentTier(c.Request().Context(), uint(id))
+	if err != nil {
+		return err
+	}
+	t.Override = body.Override
+	if t.ID == 0 {
+		t.Tier = tierCold
+		err = s.DB.Create(t).Error
+	} else {
+		err = s.DB.Model(t).Update("override", t.Override).Error
+	}
+	if err != nil {
+		return err
+	}
+	t.Effective = t.effective()
+	return c.JSON(http.StatusOK, t)
+}
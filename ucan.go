@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/ucan"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// ucanResourcePrefix is followed by the id of the user whose account a
+	// capability is on
+	ucanResourcePrefix = "estuary:user/"
+	// ucanPinAbility is the ability to upload and pin content
+	ucanPinAbility = "pin/add"
+	// ucanRemoveAbility is the ability to remove content from collections
+	ucanRemoveAbility = "pin/remove"
+
+	// pinMetaMaxSize in the meta of a pin caps its size, for pins made with
+	// a UCAN that caps uploads or into a collection with a quota
+	pinMetaMaxSize = "maxSize"
+
+	// users of UCANs are cached so that checking a UCAN needs no database
+	// lookup, for at most this long
+	ucanUserRefresh = time.Minute
+)
+
+// ucanRouteAbilities is the ability a UCAN has to delegate for each route it
+// can be used with, by method and route path. UCANs are refused everywhere
+// else.
+var ucanRouteAbilities = map[string]string{
+	"GET /viewer":             ucanPinAbility,
+	"POST /content/add":       ucanPinAbility,
+	"POST /content/add-ipfs":  ucanPinAbility,
+	"POST /content/add-car":   ucanPinAbility,
+	"POST /content/create":    ucanPinAbility,
+	"POST /content/:id/clone": ucanPinAbility,
+	"DELETE /content/remove":  ucanRemoveAbility,
+}
+
+type cachedUCANUser struct {
+	user   User
+	loaded time.Time
+}
+
+func (s *Server) nodeDID() (string, error) {
+	return ucan.DID(s.Node.Host.Peerstore().PubKey(s.Node.Host.ID()))
+}
+
+func (s *Server) checkUCANEnabled() error {
+	if !s.estuaryCfg.UCAN.Enabled {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "ucan authorization is disabled on this node",
+		}
+	}
+	return nil
+}
+
+// isUCAN tells UCANs apart from api keys, which never have dots
+func (s *Server) isUCAN(auth string) bool {
+	return s.estuaryCfg.UCAN.Enabled && strings.Count(auth, ".") == 2
+}
+
+func (s *Server) ucanUser(ctx context.Context, id uint) (*User, error) {
+	if v, ok := s.ucanUsers.Get(id); ok {
+		cu := v.(*cachedUCANUser)
+		if time.Since(cu.loaded) < ucanUserRefresh {
+			u := cu.user
+			return &u, nil
+		}
+	}
+
+	var u User
+	if err := s.DB.WithContext(ctx).First(&u, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	s.ucanUsers.Add(id, &cachedUCANUser{user: u, loaded: time.Now()})
+	return &u, nil
+}
+
+// checkUCANAuth checks a UCAN that delegates the ability the route needs on
+// a user account, from the account UCAN the node issued to that user.
+// Uploads are capped to the size the capability allows.
+func (s *Server) checkUCANAuth(c echo.Context, raw string) (*User, error) {
+	invalid := func(details string) error {
+		return &util.HttpError{
+			Code:    http.StatusUnauthorized,
+			Reason:  util.ERR_INVALID_TOKEN,
+			Details: details,
+		}
+	}
+
+	ability, ok := ucanRouteAbilities[c.Request().Method+" "+c.Path()]
+	if !ok {
+		return nil, &util.HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  util.ERR_NOT_AUTHORIZED,
+			Details: "ucans can't be used with this endpoint",
+		}
+	}
+
+	did, err := s.nodeDID()
+	if err != nil {
+		return nil, err
+	}
+	tok, root, err := ucan.Verify(raw, did, time.Now())
+	if err != nil {
+		return nil, invalid(err.Error())
+	}
+	if root.Issuer != did {
+		return nil, invalid("ucan was not delegated from an account ucan of this node")
+	}
+
+	var capability *ucan.Capability
+	for i, cp := range tok.Capabilities {
+		need := ucan.Capability{With: cp.With, Can: ability, MaxSize: cp.MaxSize}
+		if strings.HasPrefix(cp.With, ucanResourcePrefix) && cp.Covers(need) {
+			capability = &tok.Capabilities[i]
+			break
+		}
+	}
+	if capability == nil {
+		return nil, &util.HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  util.ERR_NOT_AUTHORIZED,
+			Details: fmt.Sprintf("ucan does not delegate %s", ability),
+		}
+	}
+	uid, err := strconv.ParseUint(strings.TrimPrefix(capability.With, ucanResourcePrefix), 10, 64)
+	if err != nil {
+		return nil, invalid(fmt.Sprintf("invalid resource %q", capability.With))
+	}
+
+	u, err := s.ucanUser(c.Request().Context(), uint(uid))
+	if err != nil {
+		return nil, invalid("no user exists for the ucan")
+	}
+	// the account ucan has to be for the current account key, replacing
+	// the key revokes everything delegated from the old one
+	if u.DID == "" || root.Audience != u.DID {
+		return nil, invalid("account key of the ucan was revoked")
+	}
+
+	if max := capability.MaxSize; max > 0 {
+		if c.Request().ContentLength > max {
+			return nil, &util.HttpError{
+				Code:    http.StatusRequestEntityTooLarge,
+				Reason:  util.ERR_CONTENT_SIZE_OVER_LIMIT,
+				Details: fmt.Sprintf("ucan allows uploads of up to %d bytes", max),
+			}
+		}
+		c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, max)
+		u.ucanMaxSize = max
+	}
+
+	u.authToken = AuthToken{
+		Token:      raw,
+		User:       u.ID,
+		UploadOnly: true,
+		Expiry:     time.Unix(tok.Expiry, 0),
+	}
+	return u, nil
+}
+
+type ucanNodeResponse struct {
+	DID string `json:"did"`
+}
+
+// handleGetUCANNode godoc
+// @Summary      Get the did of the node
+// @Description  This endpoint returns the did of the node, which UCANs used with it have to be addressed to.
+// @Tags         public
+// @Produce      json
+// @Success      200  {object}  ucanNodeResponse
+// @Router       /public/ucan [get]
+func (s *Server) handleGetUCANNode(c echo.Context) error {
+	if err := s.checkUCANEnabled(); err != nil {
+		return err
+	}
+	did, err := s.nodeDID()
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, &ucanNodeResponse{DID: did})
+}
+
+type ucanAccountBody struct {
+	DID string `json:"did"`
+}
+
+type ucanAccountResponse struct {
+	Token    string    `json:"token"`
+	Node     string    `json:"node"`
+	Resource string    `json:"resource"`
+	Expiry   time.Time `json:"expiry"`
+}
+
+// handleSetUCANAccountKey godoc
+// @Summary      Register an account key
+// @Description  This endpoint registers the did:key of the user's account key and returns an account UCAN, delegating the pin ability on the account to that key. UCANs delegated from an account UCAN of an earlier key stop working.
+// @Tags         User
+// @Accept       json
+// @Produce      json
+// @Param        body  body      ucanAccountBody  true  "Account key"
+// @Success      200   {object}  ucanAccountResponse
+// @Router       /user/ucan [post]
+func (s *Server) handleSetUCANAccountKey(c echo.Context, u *User) error {
+	if err := s.checkUCANEnabled(); err != nil {
+		return err
+	}
+
+	var body ucanAccountBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if _, err := ucan.ParseDID(body.DID); err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+
+	node, err := s.nodeDID()
+	if err != nil {
+		return err
+	}
+	resource := fmt.Sprintf("%s%d", ucanResourcePrefix, u.ID)
+	expiry := time.Now().Add(s.estuaryCfg.UCAN.AccountExpiry)
+	tok, err := ucan.Issue(s.Node.Host.Peerstore().PrivKey(s.Node.Host.ID()), ucan.Token{
+		Audience:     body.DID,
+		Expiry:       expiry.Unix(),
+		Capabilities: []ucan.Capability{{With: resource, Can: "pin/*"}},
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := s.DB.Model(&User{}).Where("id = ?", u.ID).Update("did", body.DID).Error; err != nil {
+		return err
+	}
+	s.ucanUsers.Remove(u.ID)
+
+	return c.JSON(http.StatusOK, &ucanAccountResponse{
+		Token:    tok,
+		Node:     node,
+		Resource: resource,
+		Expiry:   time.Unix(expiry.Unix(), 0),
+	})
+}
+
+// handleRevokeUCANAccountKey godoc
+// @Summary      Revoke the account key
+// @Description  This endpoint removes the user's account key, revoking every UCAN delegated from it.
+// @Tags         User
+// @Router       /user/ucan [delete]
+func (s *Server) handleRevokeUCANAccountKey(c echo.Context, u *User) error {
+	if err := s.checkUCANEnabled(); err != nil {
+		return err
+	}
+	if err := s.DB.Model(&User{}).Where("id = ?", u.ID).Update("did", "").Error; err != nil {
+		return err
+	}
+	s.ucanUsers.Remove(u.ID)
+	return c.NoContent(http.StatusOK)
+}
+
+// checkUCANMaxSize turns away content over the size the UCAN of the request
+// caps uploads to
+func checkUCANMaxSize(u *User, size int64) error {
+	if u.ucanMaxSize > 0 && size > u.ucanMaxSize {
+		return &util.HttpError{
+			Code:    http.StatusRequestEntityTooLarge,
+			Reason:  util.ERR_CONTENT_SIZE_OVER_LIMIT,
+			Details: fmt.Sprintf("ucan allows uploads of up to %d bytes, the content is %d bytes", u.ucanMaxSize, size),
+		}
+	}
+	return nil
+}
+
+// errPinOverMaxSize fails pins that turned out larger than the meta of the
+// pin allows
+var errPinOverMaxSize = errors.New("pin is over the size it was allowed")
+
+// pinMaxSize returns the size the meta of a pin caps it to, 0 for no cap
+func pinMaxSize(meta string) int64 {
+	if meta == "" {
+		return 0
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(meta), &m); err != nil {
+		return 0
+	}
+	return metaMaxSize(m)
+}
+
+// metaMaxSize is pinMaxSize for a meta that wasn't encoded yet
+func metaMaxSize(m map[string]interface{}) int64 {
+	switch max := m[pinMetaMaxSize].(type) {
+	case float64:
+		return int64(max)
+	case int64:
+		return max
+	default:
+		return 0
+	}
+}
+
+// checkPinMaxSize checks the size of a pin that finished against the cap in
+// its meta
+func (cm *ContentManager) checkPinMaxSize(ctx context.Context, contID uint, size int64) error {
+	var metas []string
+	if err := cm.DB.WithContext(ctx).Model(&util.Content{}).Where("id = ?", contID).Pluck("pin_meta", &metas).Error; err != nil {
+		return err
+	}
+	if len(metas) == 0 {
+		return nil
+	}
+	if max := pinMaxSize(metas[0]); max > 0 && size > max {
+		return fmt.Errorf("%w: content is %d bytes, it was pinned with a cap of %d", errPinOverMaxSize, size, max)
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const usageSampleInterval = time.Hour
+
+// userUsageRecord is a point in time sample of a users usage, taken every
+// usageSampleInterval so that usage can be graphed over time. Samples of
+// organizations have an OrgID and no UserID. OrgBytesPinned is the part of
+// the bytes of a user that is in the collections of organizations, and is
+// billed to them. BandwidthServed is a running total of everything ever
+// served of the content the user has now.
+type userUsageRecord struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"time"`
+	UserID    uint      `gorm:"index:,option:CONCURRENTLY" json:"-"`
+	OrgID     uint      `gorm:"index" json:"-"`
+
+	BytesPinned     int64 `json:"bytesPinned"`
+	NumPins         int64 `json:"numPins"`
+	ActiveDeals     int64 `json:"activeDeals"`
+	BandwidthServed int64 `json:"bandwidthServed"`
+	PinsSucceeded   int64 `json:"pinsSucceeded"`
+	PinsFailed      int64 `json:"pinsFailed"`
+	OrgBytesPinned  int64 `json:"-"`
+}
+
+func (r *userUsageRecord) PinSuccessRate() float64 {
+	if r.PinsSucceeded+r.PinsFailed == 0 {
+		return 0
+	}
+	return float64(r.PinsSucceeded) / float64(r.PinsSucceeded+r.PinsFailed)
+}
+
+type usageQuery struct {
+	UserID uint
+	OrgID  uint
+	Value  int64
+	Value2 int64
+}
+
+func usageByUser(db *gorm.DB, uid uint) *gorm.DB {
+	if uid > 0 {
+		return db.Where("user_id = ?", uid)
+	}
+	return db
+}
+
+// collectUsage computes the current usage for a single user, or every user
+// with content on the node if uid is zero
+func (s *Server) collectUsage(ctx context.Context, uid uint) (map[uint]*userUsageRecord, error) {
+	db := s.DB.WithContext(ctx)
+	out := make(map[uint]*userUsageRecord)
+	get := func(u uint) *userUsageRecord {
+		r, ok := out[u]
+		if !ok {
+			r = &userUsageRecord{UserID: u}
+			out[u] = r
+		}
+		return r
+	}
+
+	var pinned []usageQuery
+	if err := usageByUser(db.Table("contents"), uid).
+		Select("user_id, SUM(size) as value, COUNT(1) as value2").
+		Where("active AND aggregated_in = 0 AND deleted_at IS NULL").
+		Group("user_id").Scan(&pinned).Error; err != nil {
+		return nil, err
+	}
+	for _, q := range pinned {
+		r := get(q.UserID)
+		r.BytesPinned = q.Value
+		r.NumPins = q.Value2
+	}
+
+	var orgPinned []usageQuery
+	if err := usageByUser(db.Table("contents"), uid).
+		Select("user_id, SUM(size) as value").
+		Where("active AND aggregated_in = 0 AND deleted_at IS NULL AND id IN (?)", s.allOrgContents()).
+		Group("user_id").Scan(&orgPinned).Error; err != nil {
+		return nil, err
+	}
+	for _, q := range orgPinned {
+		get(q.UserID).OrgBytesPinned = q.Value
+	}
+
+	var deals []usageQuery
+	if err := usageByUser(db.Model(&contentDeal{}), uid).
+		Select("user_id, COUNT(1) as value").
+		Where("deal_id > 0 AND NOT failed AND NOT slashed").
+		Group("user_id").Scan(&deals).Error; err != nil {
+		return nil, err
+	}
+	for _, q := range deals {
+		get(q.UserID).ActiveDeals = q.Value
+	}
+
+	var pins []usageQuery
+	if err := usageByUser(db.Table("contents"), uid).
+		Select("user_id, SUM(CASE WHEN active THEN 1 ELSE 0 END) as value, SUM(CASE WHEN failed THEN 1 ELSE 0 END) as value2").
+		Where("aggregated_in = 0 AND NOT aggregate AND deleted_at IS NULL").
+		Group("user_id").Scan(&pins).Error; err != nil {
+		return nil, err
+	}
+	for _, q := range pins {
+		r := get(q.UserID)
+		r.PinsSucceeded = q.Value
+		r.PinsFailed = q.Value2
+	}
+
+	bwq := db.Table("obj_refs").
+		Joins("inner join contents on obj_refs.content = contents.id").
+		Joins("inner join objects on obj_refs.object = objects.id").
+		Select("contents.user_id as user_id, SUM(objects.size * objects.reads) as value").
+		Group("contents.user_id")
+	if uid > 0 {
+		bwq = bwq.Where("contents.user_id = ?", uid)
+	}
+
+	var bw []usageQuery
+	if err := bwq.Scan(&bw).Error; err != nil {
+		return nil, err
+	}
+	for _, q := range bw {
+		get(q.UserID).BandwidthServed = q.Value
+	}
+
+	return out, nil
+}
+
+// collectOrgUsage computes the current usage of every organization, from
+// the content in its collections
+func (s *Server) collectOrgUsage(ctx context.Context) ([]*userUsageRecord, error) {
+	db := s.DB.WithContext(ctx)
+
+	var orgs []Organization
+	if err := db.Find(&orgs).Error; err != nil {
+		return nil, err
+	}
+
+	out := make([]*userUsageRecord, 0, len(orgs))
+	for _, o := range orgs {
+		r := &userUsageRecord{OrgID: o.ID}
+		if err := db.Table("contents").
+			Select("COALESCE(SUM(size), 0), COUNT(1)").
+			Where("active AND id IN (?)", s.orgContents(o.ID)).
+			Row().Scan(&r.BytesPinned, &r.NumPins); err != nil {
+			return nil, err
+		}
+		if err := db.Model(&contentDeal{}).
+			Where("deal_id > 0 AND NOT failed AND NOT slashed AND content IN (?)", s.orgContents(o.ID)).
+			Count(&r.ActiveDeals).Error; err != nil {
+			return nil, err
+		}
+		if err := db.Table("obj_refs").
+			Joins("inner join objects on obj_refs.object = objects.id").
+			Where("obj_refs.content IN (?)", s.orgContents(o.ID)).
+			Select("COALESCE(SUM(objects.size * objects.reads), 0)").
+			Row().Scan(&r.BandwidthServed); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+func (s *Server) recordUsage(ctx context.Context) error {
+	usage, err := s.collectUsage(ctx, 0)
+	if err != nil {
+		return err
+	}
+
+	recs := make([]*userUsageRecord, 0, len(usage))
+	for _, r := range usage {
+		recs = append(recs, r)
+	}
+
+	orgs, err := s.collectOrgUsage(ctx)
+	if err != nil {
+		return err
+	}
+	recs = append(recs, orgs...)
+
+	if len(recs) == 0 {
+		return nil
+	}
+	return s.DB.WithContext(ctx).CreateInBatches(recs, 500).Error
+}
+
+type usagePoint struct {
+	*userUsageRecord
+	PinSuccessRate float64 `json:"pinSuccessRate"`
+	// BandwidthServedInPeriod is what was served since the sample before,
+	// zero for the first sample of a user
+	BandwidthServedInPeriod int64 `json:"bandwidthServedInPeriod"`
+}
+
+// newUsagePoint is the sample r, following the sample prev if there is one
+func newUsagePoint(r, prev *userUsageRecord) *usagePoint {
+	p := &usagePoint{userUsageRecord: r, PinSuccessRate: r.PinSuccessRate()}
+	// the total drops when content is removed, what was served of the rest
+	// in the meantime is lost with it
+	if prev != nil && r.BandwidthServed > prev.BandwidthServed {
+		p.BandwidthServedInPeriod = r.BandwidthServed - prev.BandwidthServed
+	}
+	return p
+}
+
+type userUsageResponse struct {
+	Current *usagePoint   `json:"current"`
+	History []*usagePoint `json:"history"`
+}
+
+// lastUsageSample is the last usage sample of user uid taken before t, if
+// there is one
+func (s *Server) lastUsageSample(uid uint, t time.Time) (*userUsageRecord, error) {
+	var recs []*userUsageRecord
+	if err := util.ReadReplica(s.DB).Order("created_at desc").Limit(1).
+		Find(&recs, "user_id = ? AND created_at < ?", uid, t).Error; err != nil {
+		return nil, err
+	}
+	if len(recs) == 0 {
+		return nil, nil
+	}
+	return recs[0], nil
+}
+
+// handleGetUserUsage godoc
+// @Summary      Get usage over time for the user
+// @Description  This endpoint returns the current usage for the user along with hourly samples of bytes pinned, active deals, bandwidth served and pin success rate. Bandwidth served is a running total, bandwidthServedInPeriod is what was served since the sample before.
+// @Tags         User
+// @Produce      json
+// @Param        begin query string false "Start of the range (2006-01-02T15:04), defaults to 30 days ago"
+// @Param        duration query string false "Length of the range, eg 168h"
+// @Success      200  {object}  userUsageResponse
+// @Router       /user/usage [get]
+func (s *Server) handleGetUserUsage(c echo.Context, u *User) error {
+	begin := time.Now().Add(-time.Hour * 24 * 30)
+	end := time.Now()
+
+	if beg := c.QueryParam("begin"); beg != "" {
+		ts, err := time.Parse("2006-01-02T15:04", beg)
+		if err != nil {
+			return err
+		}
+		begin = ts
+	}
+
+	if dur := c.QueryParam("duration"); dur != "" {
+		d, err := time.ParseDuration(dur)
+		if err != nil {
+			return err
+		}
+		end = begin.Add(d)
+	}
+
+	var history []*userUsageRecord
+	if err := util.ReadReplica(s.DB).Order("created_at asc").
+		Find(&history, "user_id = ? AND created_at >= ? AND created_at <= ?", u.ID, begin, end).Error; err != nil {
+		return err
+	}
+
+	// the first sample in the range follows the one before it, and the
+	// current usage follows the latest
+	prev, err := s.lastUsageSample(u.ID, begin)
+	if err != nil {
+		return err
+	}
+	latest, err := s.lastUsageSample(u.ID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	current, err := s.collectUsage(c.Request().Context(), u.ID)
+	if err != nil {
+		return err
+	}
+
+	cur, ok := current[u.ID]
+	if !ok {
+		cur = &userUsageRecord{UserID: u.ID}
+	}
+	cur.CreatedAt = time.Now()
+
+	resp := &userUsageResponse{
+		History: make([]*usagePoint, 0, len(history)),
+	}
+	for _, r := range history {
+		resp.History = append(resp.History, newUsagePoint(r, prev))
+		prev = r
+	}
+	resp.Current = newUsagePoint(cur, latest)
+
+	return c.JSON(http.StatusOK, resp)
+}
@@ -21,8 +21,13 @@ type User struct {
 	authToken AuthToken
 	Perm      int
 	Flags     int
+	// Plan is the egress plan of the user, the default plan when empty
+	Plan string
 
 	StorageDisabled bool
+
+	// ucanMaxSize caps uploads of a request authorized with a UCAN
+	ucanMaxSize int64
 }
 
 func (u *User) FlagSplitContent() bool {
@@ -35,6 +40,10 @@ type AuthToken struct {
 	User       uint
 	UploadOnly bool
 	Expiry     time.Time
+	// Namespace confines the key to the content and collections in it
+	Namespace string
+	// Session tokens are handed out at login rather than created as keys
+	Session bool
 }
 
 type InviteCode struct {
@@ -0,0 +1,38 @@
+package access
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMintVerify(t *testing.T) {
+	secret := []byte("s3cret")
+	now := time.Unix(1660000000, 0)
+
+	raw, err := Mint(secret, Token{Cid: "bafyroot", Expiry: now.Add(time.Hour).Unix()})
+	require.NoError(t, err)
+
+	tok, err := Verify(secret, raw, now)
+	require.NoError(t, err)
+	assert.Equal(t, "bafyroot", tok.Cid)
+
+	_, err = Verify(secret, raw, now.Add(time.Hour))
+	assert.Equal(t, ErrExpired, err)
+
+	_, err = Verify([]byte("other"), raw, now)
+	assert.Equal(t, ErrInvalid, err)
+
+	// a payload swapped under the signature
+	other, err := Mint(secret, Token{Cid: "bafyother", Expiry: now.Add(time.Hour).Unix()})
+	require.NoError(t, err)
+	_, err = Verify(secret, other[:len(other)/2]+raw[len(raw)/2:], now)
+	assert.Equal(t, ErrInvalid, err)
+
+	for _, bad := range []string{"", "abc", "a.b.c", "!!.!!"} {
+		_, err = Verify(secret, bad, now)
+		assert.Equal(t, ErrInvalid, err)
+	}
+}
@@ -0,0 +1,203 @@
+// Package audit checks that the blocks of stored content are still there
+// and still hash to their cids.
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/application-research/estuary/util/carindex"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/multiformats/go-varint"
+)
+
+const (
+	// Missing blocks are gone from the blockstore
+	Missing = "missing"
+	// Corrupt blocks don't hash to their cid any more
+	Corrupt = "corrupt"
+	// SizeMismatch blocks hash fine but aren't the size they were
+	// recorded with
+	SizeMismatch = "size-mismatch"
+	// IndexMismatch blocks aren't where the CAR index of their content
+	// has them, or aren't in it at all
+	IndexMismatch = "index-mismatch"
+)
+
+// Block is a block to check and the size it was recorded with, 0 when
+// unknown
+type Block struct {
+	Cid  cid.Cid
+	Size int
+}
+
+type Problem struct {
+	Cid    cid.Cid
+	Kind   string
+	Detail string `json:",omitempty"`
+}
+
+// Result is how the blocks sampled from a content held up
+type Result struct {
+	Content  uint
+	Checked  int
+	Problems []Problem `json:",omitempty"`
+}
+
+// Getter reads a block, like a blockstore does
+type Getter func(context.Context, cid.Cid) (blocks.Block, error)
+
+// Verify checks that data hashes to c
+func Verify(c cid.Cid, data []byte) error {
+	sum, err := c.Prefix().Sum(data)
+	if err != nil {
+		return err
+	}
+	if !sum.Equals(c) {
+		return fmt.Errorf("data hashes to %s", sum)
+	}
+	return nil
+}
+
+// Check reads the blocks with get and returns the ones that are missing,
+// corrupt or not the size they were recorded with. Errors other than a
+// block not being found stop the check.
+func Check(ctx context.Context, get Getter, content uint, blks []Block) (*Result, error) {
+	res := &Result{Content: content}
+	for _, b := range blks {
+		blk, err := get(ctx, b.Cid)
+		if err != nil {
+			if errors.Is(err, ipld.ErrNotFound) || errors.Is(err, blockstore.ErrNotFound) {
+				res.Checked++
+				res.Problems = append(res.Problems, Problem{Cid: b.Cid, Kind: Missing})
+				continue
+			}
+			return nil, err
+		}
+		res.Checked++
+
+		data := blk.RawData()
+		if err := Verify(b.Cid, data); err != nil {
+			res.Problems = append(res.Problems, Problem{Cid: b.Cid, Kind: Corrupt, Detail: err.Error()})
+			continue
+		}
+		if b.Size > 0 && len(data) != b.Size {
+			res.Problems = append(res.Problems, Problem{Cid: b.Cid, Kind: SizeMismatch, Detail: fmt.Sprintf("%d bytes, recorded as %d", len(data), b.Size)})
+		}
+	}
+	return res, nil
+}
+
+// CheckIndex adds to res the blocks that are not in the CAR layout l of
+// their content, or whose section there isn't the size of the block
+func CheckIndex(res *Result, l *carindex.Layout, blks []Block) {
+	sections := make(map[cid.Cid]carindex.Section, len(blks))
+	for _, b := range blks {
+		sections[b.Cid] = carindex.Section{}
+	}
+	found := make(map[cid.Cid]bool, len(blks))
+	for _, sec := range l.Sections {
+		if _, ok := sections[sec.Cid]; ok && !found[sec.Cid] {
+			sections[sec.Cid] = sec
+			found[sec.Cid] = true
+		}
+	}
+
+	for _, b := range blks {
+		if !found[b.Cid] {
+			res.Problems = append(res.Problems, Problem{Cid: b.Cid, Kind: IndexMismatch, Detail: fmt.Sprintf("not in the car index of %s", l.Root)})
+			continue
+		}
+		if b.Size <= 0 {
+			continue
+		}
+		n := uint64(len(b.Cid.Bytes()) + b.Size)
+		if want := uint64(varint.UvarintSize(n)) + n; sections[b.Cid].Size != want {
+			res.Problems = append(res.Problems, Problem{Cid: b.Cid, Kind: IndexMismatch, Detail: fmt.Sprintf("section at %d is %d bytes, expected %d", sections[b.Cid].Offset, sections[b.Cid].Size, want)})
+		}
+	}
+}
+
+// CheckStoredIndex adds to res the blocks that aren't where the CAR index of
+// root kept in store has them, if one is kept. A stale index is dropped, it
+// is built again from the blocks the next time it is asked for.
+func CheckStoredIndex(res *Result, store *carindex.Store, root cid.Cid, blks []Block) error {
+	l, err := store.Get(root)
+	if err != nil {
+		if errors.Is(err, carindex.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("reading car index of %s: %w", root, err)
+	}
+
+	n := len(res.Problems)
+	CheckIndex(res, l, blks)
+	if len(res.Problems) > n {
+		if err := store.Delete(root); err != nil {
+			return fmt.Errorf("dropping stale car index of %s: %w", root, err)
+		}
+	}
+	return nil
+}
+
+// Damaged returns the problems that leave a block unreadable, the ones a
+// repair has to fetch again
+func Damaged(problems []Problem) []Problem {
+	var out []Problem
+	for _, p := range problems {
+		if p.Kind == Missing || p.Kind == Corrupt {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// Repair fetches the missing and corrupt blocks again with fetch and puts
+// them in bs. A corrupt block is only deleted once a copy of it that hashes
+// to its cid is in hand, blocks that can't be fetched are left as they are.
+func Repair(ctx context.Context, bs blockstore.Blockstore, fetch Getter, problems []Problem) error {
+	var failed int
+	var lastErr error
+	for _, p := range Damaged(problems) {
+		blk, err := fetch(ctx, p.Cid)
+		if err == nil {
+			err = Verify(p.Cid, blk.RawData())
+		}
+		if err != nil {
+			failed++
+			lastErr = fmt.Errorf("fetching %s: %w", p.Cid, err)
+			continue
+		}
+
+		if p.Kind == Corrupt {
+			if err := bs.DeleteBlock(ctx, p.Cid); err != nil {
+				return err
+			}
+		}
+		if err := bs.Put(ctx, blk); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d blocks could not be fetched again, last: %w", failed, lastErr)
+	}
+	return nil
+}
+
+// DropCorrupt deletes the corrupt blocks, for them to be written again by
+// something that skips blocks it already has, like a retrieval
+func DropCorrupt(ctx context.Context, bs blockstore.Blockstore, problems []Problem) error {
+	for _, p := range problems {
+		if p.Kind != Corrupt {
+			continue
+		}
+		if err := bs.DeleteBlock(ctx, p.Cid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
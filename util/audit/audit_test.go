@@ -0,0 +1,146 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/application-research/estuary/util/carindex"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	car "github.com/ipld/go-car"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	good := blocks.NewBlock([]byte("good block"))
+	bad := blocks.NewBlock([]byte("bad block"))
+	gone := blocks.NewBlock([]byte("gone block"))
+
+	stored := map[cid.Cid]blocks.Block{
+		good.Cid(): good,
+		// what is stored under the cid of bad no longer matches it
+		bad.Cid(): blocks.NewBlock([]byte("flipped bits")),
+	}
+	get := func(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+		if b, ok := stored[c]; ok {
+			return b, nil
+		}
+		return nil, ipld.ErrNotFound
+	}
+
+	res, err := Check(context.Background(), get, 7, []Block{
+		{Cid: good.Cid(), Size: len(good.RawData())},
+		{Cid: bad.Cid()},
+		{Cid: gone.Cid()},
+		{Cid: good.Cid(), Size: 3},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, uint(7), res.Content)
+	assert.Equal(t, 4, res.Checked)
+	require.Len(t, res.Problems, 3)
+	assert.Equal(t, Corrupt, res.Problems[0].Kind)
+	assert.Equal(t, Missing, res.Problems[1].Kind)
+	assert.Equal(t, SizeMismatch, res.Problems[2].Kind)
+}
+
+func TestCheckIndex(t *testing.T) {
+	in := blocks.NewBlock([]byte("indexed block"))
+	out := blocks.NewBlock([]byte("block not in the index"))
+
+	l, err := carindex.New(in.Cid())
+	require.NoError(t, err)
+	n := uint64(len(in.Cid().Bytes()) + len(in.RawData()))
+	require.NoError(t, l.Add(car.Block{BlockCID: in.Cid(), Offset: l.Size(), Size: 1 + n}))
+
+	res := &Result{}
+	CheckIndex(res, l, []Block{
+		{Cid: in.Cid(), Size: len(in.RawData())},
+		{Cid: in.Cid(), Size: len(in.RawData()) + 1},
+		{Cid: out.Cid(), Size: len(out.RawData())},
+	})
+	require.Len(t, res.Problems, 2)
+	assert.Equal(t, IndexMismatch, res.Problems[0].Kind)
+	assert.Equal(t, IndexMismatch, res.Problems[1].Kind)
+	assert.Equal(t, out.Cid(), res.Problems[1].Cid)
+}
+
+func TestCheckStoredIndex(t *testing.T) {
+	store, err := carindex.NewStore(t.TempDir())
+	require.NoError(t, err)
+	in := blocks.NewBlock([]byte("indexed block"))
+	out := blocks.NewBlock([]byte("block not in the index"))
+
+	// without an index there is nothing to check
+	res := &Result{}
+	require.NoError(t, CheckStoredIndex(res, store, in.Cid(), []Block{{Cid: out.Cid()}}))
+	assert.Empty(t, res.Problems)
+
+	l, err := carindex.New(in.Cid())
+	require.NoError(t, err)
+	n := uint64(len(in.Cid().Bytes()) + len(in.RawData()))
+	require.NoError(t, l.Add(car.Block{BlockCID: in.Cid(), Offset: l.Size(), Size: 1 + n}))
+	require.NoError(t, store.Put(l))
+
+	require.NoError(t, CheckStoredIndex(res, store, in.Cid(), []Block{{Cid: in.Cid(), Size: len(in.RawData())}}))
+	assert.Empty(t, res.Problems)
+	_, err = store.Get(in.Cid())
+	require.NoError(t, err, "a good index is kept")
+
+	require.NoError(t, CheckStoredIndex(res, store, in.Cid(), []Block{{Cid: out.Cid()}}))
+	require.Len(t, res.Problems, 1)
+	_, err = store.Get(in.Cid())
+	assert.ErrorIs(t, err, carindex.ErrNotFound, "a stale index is dropped")
+}
+
+func TestRepair(t *testing.T) {
+	ctx := context.Background()
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	// the blockstore doesn't check hashes, it keeps whatever it is given
+	bs.HashOnRead(false)
+
+	bad := blocks.NewBlock([]byte("bad block"))
+	gone := blocks.NewBlock([]byte("gone block"))
+	lost := blocks.NewBlock([]byte("lost block"))
+	flipped, err := blocks.NewBlockWithCid([]byte("flipped bits"), bad.Cid())
+	require.NoError(t, err)
+	require.NoError(t, bs.Put(ctx, flipped))
+	require.NoError(t, bs.Put(ctx, blocks.NewBlock([]byte("stays"))))
+
+	peers := map[cid.Cid]blocks.Block{bad.Cid(): bad, gone.Cid(): gone}
+	fetch := func(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+		if b, ok := peers[c]; ok {
+			return b, nil
+		}
+		return nil, errors.New("no peer has it")
+	}
+
+	err = Repair(ctx, bs, fetch, []Problem{
+		{Cid: bad.Cid(), Kind: Corrupt},
+		{Cid: gone.Cid(), Kind: Missing},
+		{Cid: lost.Cid(), Kind: Missing},
+	})
+	assert.Error(t, err)
+
+	blk, err := bs.Get(ctx, bad.Cid())
+	require.NoError(t, err)
+	assert.Equal(t, bad.RawData(), blk.RawData())
+	has, err := bs.Has(ctx, gone.Cid())
+	require.NoError(t, err)
+	assert.True(t, has)
+
+	// a corrupt block no peer has is kept until something can replace it
+	other := blocks.NewBlock([]byte("other block"))
+	flipped, err = blocks.NewBlockWithCid([]byte("more flipped bits"), other.Cid())
+	require.NoError(t, err)
+	require.NoError(t, bs.Put(ctx, flipped))
+	assert.Error(t, Repair(ctx, bs, fetch, []Problem{{Cid: other.Cid(), Kind: Corrupt}}))
+	has, err = bs.Has(ctx, other.Cid())
+	require.NoError(t, err)
+	assert.True(t, has)
+}
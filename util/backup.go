@@ -0,0 +1,292 @@
+package util
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+const backupFormatVersion = 1
+
+const restoreBatchSize = 500
+
+// BackupTable is a table included in node backups, Model is a pointer to
+// the struct the table is stored as
+type BackupTable struct {
+	Name  string
+	Model interface{}
+}
+
+type BackupManifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Node    string    `json:"node"`
+	Tables  []string  `json:"tables"`
+	// Rows is only known once the whole backup has been written, it is
+	// filled in from the end of the archive
+	Rows map[string]int64 `json:"rows,omitempty"`
+}
+
+// backupRecord is a line of a backup archive. An archive is a gzipped
+// stream of json lines, a manifest, then the rows of each table, then an
+// end record with the row counts so truncated archives can be detected.
+// Rows are keyed by column name rather than by the json tags of the model,
+// which leave out columns like timestamps and ids.
+type backupRecord struct {
+	Manifest *BackupManifest            `json:"manifest,omitempty"`
+	Table    string                     `json:"table,omitempty"`
+	Row      map[string]json.RawMessage `json:"row,omitempty"`
+	End      map[string]int64           `json:"end,omitempty"`
+}
+
+func parseModel(db *gorm.DB, model interface{}) (*schema.Schema, error) {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(model); err != nil {
+		return nil, err
+	}
+	return stmt.Schema, nil
+}
+
+// WriteBackup writes every row of the given tables, including soft deleted
+// ones, to w as a portable archive that RestoreBackup can load into a
+// database of either supported dialect
+func WriteBackup(ctx context.Context, db *gorm.DB, w io.Writer, node string, tables []BackupTable) (*BackupManifest, error) {
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+
+	man := &BackupManifest{
+		Version: backupFormatVersion,
+		Created: time.Now(),
+		Node:    node,
+		Rows:    make(map[string]int64, len(tables)),
+	}
+	for _, t := range tables {
+		man.Tables = append(man.Tables, t.Name)
+	}
+
+	if err := enc.Encode(&backupRecord{Manifest: &BackupManifest{
+		Version: man.Version,
+		Created: man.Created,
+		Node:    man.Node,
+		Tables:  man.Tables,
+	}}); err != nil {
+		return nil, err
+	}
+
+	for _, t := range tables {
+		n, err := writeBackupTable(ctx, db, enc, t)
+		if err != nil {
+			return nil, fmt.Errorf("failed to back up %s: %w", t.Name, err)
+		}
+		man.Rows[t.Name] = n
+	}
+
+	if err := enc.Encode(&backupRecord{End: man.Rows}); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return man, nil
+}
+
+func writeBackupTable(ctx context.Context, db *gorm.DB, enc *json.Encoder, t BackupTable) (int64, error) {
+	sch, err := parseModel(db, t.Model)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := db.WithContext(ctx).Unscoped().Model(t.Model).Rows()
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	mtype := reflect.TypeOf(t.Model).Elem()
+
+	var count int64
+	for rows.Next() {
+		rv := reflect.New(mtype)
+		if err := db.ScanRows(rows, rv.Interface()); err != nil {
+			return count, err
+		}
+
+		row := make(map[string]json.RawMessage, len(sch.Fields))
+		for _, f := range sch.Fields {
+			if f.DBName == "" {
+				continue
+			}
+
+			b, err := json.Marshal(f.ReflectValueOf(rv.Elem()).Interface())
+			if err != nil {
+				return count, fmt.Errorf("column %s: %w", f.DBName, err)
+			}
+			row[f.DBName] = b
+		}
+
+		if err := enc.Encode(&backupRecord{Table: t.Name, Row: row}); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, rows.Err()
+}
+
+// RestoreBackup loads an archive written by WriteBackup. Tables in the
+// archive that aren't in the given list are rejected, rows whose key
+// already exists are left alone so an interrupted restore can be run again.
+func RestoreBackup(ctx context.Context, db *gorm.DB, r io.Reader, tables []BackupTable) (*BackupManifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a backup archive: %w", err)
+	}
+	defer gz.Close()
+
+	dec := json.NewDecoder(gz)
+
+	var first backupRecord
+	if err := dec.Decode(&first); err != nil {
+		return nil, fmt.Errorf("failed to read backup manifest: %w", err)
+	}
+	man := first.Manifest
+	if man == nil {
+		return nil, fmt.Errorf("backup archive is missing its manifest")
+	}
+	if man.Version != backupFormatVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", man.Version)
+	}
+
+	byName := make(map[string]BackupTable, len(tables))
+	for _, t := range tables {
+		byName[t.Name] = t
+	}
+
+	restorers := make(map[string]*tableRestorer, len(man.Tables))
+	for _, name := range man.Tables {
+		t, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("backup contains unknown table %q", name)
+		}
+
+		// the table may belong to a subsystem that hasn't been started on
+		// this host yet
+		if err := db.AutoMigrate(t.Model); err != nil {
+			return nil, err
+		}
+
+		sch, err := parseModel(db, t.Model)
+		if err != nil {
+			return nil, err
+		}
+		restorers[name] = &tableRestorer{
+			db:     db.WithContext(ctx).Session(&gorm.Session{SkipHooks: true}),
+			schema: sch,
+			batch:  reflect.New(reflect.SliceOf(reflect.TypeOf(t.Model).Elem())).Elem(),
+		}
+	}
+
+	rows := make(map[string]int64, len(restorers))
+	for {
+		var rec backupRecord
+		if err := dec.Decode(&rec); err != nil {
+			if err == io.EOF {
+				return nil, fmt.Errorf("backup archive is truncated")
+			}
+			return nil, err
+		}
+
+		if rec.End != nil {
+			for name, n := range rec.End {
+				if rows[name] != n {
+					return nil, fmt.Errorf("backup archive has %d rows for %s, expected %d", rows[name], name, n)
+				}
+			}
+			break
+		}
+
+		tr, ok := restorers[rec.Table]
+		if !ok {
+			return nil, fmt.Errorf("backup row for unknown table %q", rec.Table)
+		}
+		if err := tr.add(rec.Row); err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %w", rec.Table, err)
+		}
+		rows[rec.Table]++
+	}
+
+	for _, name := range man.Tables {
+		tr := restorers[name]
+		if err := tr.flush(); err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %w", name, err)
+		}
+		if err := tr.resetSequence(); err != nil {
+			return nil, fmt.Errorf("failed to reset id sequence of %s: %w", name, err)
+		}
+	}
+
+	man.Rows = rows
+	return man, nil
+}
+
+type tableRestorer struct {
+	db     *gorm.DB
+	schema *schema.Schema
+	batch  reflect.Value
+}
+
+func (tr *tableRestorer) add(row map[string]json.RawMessage) error {
+	rv := reflect.New(tr.schema.ModelType).Elem()
+	for col, raw := range row {
+		f, ok := tr.schema.FieldsByDBName[col]
+		if !ok {
+			// the column has since been dropped from the model
+			continue
+		}
+		if err := json.Unmarshal(raw, f.ReflectValueOf(rv).Addr().Interface()); err != nil {
+			return fmt.Errorf("column %s: %w", col, err)
+		}
+	}
+
+	tr.batch = reflect.Append(tr.batch, rv)
+	if tr.batch.Len() >= restoreBatchSize {
+		return tr.flush()
+	}
+	return nil
+}
+
+func (tr *tableRestorer) flush() error {
+	if tr.batch.Len() == 0 {
+		return nil
+	}
+
+	batch := reflect.New(tr.batch.Type())
+	batch.Elem().Set(tr.batch)
+	if err := tr.db.Omit(clause.Associations).Clauses(clause.OnConflict{DoNothing: true}).Create(batch.Interface()).Error; err != nil {
+		return err
+	}
+
+	tr.batch = tr.batch.Slice(0, 0)
+	return nil
+}
+
+// resetSequence moves the id sequence of a restored postgres table past
+// the restored ids, sqlite works it out from the rows
+func (tr *tableRestorer) resetSequence() error {
+	pf := tr.schema.PrioritizedPrimaryField
+	if tr.db.Dialector.Name() != "postgres" || pf == nil || !pf.AutoIncrement {
+		return nil
+	}
+
+	return tr.db.Exec(fmt.Sprintf(
+		"SELECT setval(pg_get_serial_sequence('%s', '%s'), COALESCE((SELECT MAX(%s) FROM %s), 0) + 1, false)",
+		tr.schema.Table, pf.DBName, pf.DBName, tr.schema.Table,
+	)).Error
+}
@@ -0,0 +1,84 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestBackupRestore(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	src, err := gorm.Open(sqlite.Open("file:"+t.Name()+"-src?mode=memory&cache=shared"), &gorm.Config{})
+	assert.NoError(err)
+	assert.NoError(src.AutoMigrate(&Content{}, &ObjRef{}))
+
+	c, _ := cid.Decode("bafkqaaa")
+	live := &Content{Cid: DbCID{c}, Name: "live", UserID: 1, Active: true}
+	gone := &Content{Cid: DbCID{c}, Name: "gone", UserID: 1}
+	assert.NoError(src.Create(live).Error)
+	assert.NoError(src.Create(gone).Error)
+	assert.NoError(src.Delete(gone).Error)
+	assert.NoError(src.Create(&ObjRef{Content: live.ID, Object: 7}).Error)
+
+	tables := []BackupTable{
+		{Name: "contents", Model: &Content{}},
+		{Name: "obj_refs", Model: &ObjRef{}},
+	}
+
+	buf := new(bytes.Buffer)
+	man, err := WriteBackup(ctx, src, buf, "test", tables)
+	assert.NoError(err)
+	assert.Equal(int64(2), man.Rows["contents"])
+	archive := buf.Bytes()
+
+	dst, err := gorm.Open(sqlite.Open("file:"+t.Name()+"-dst?mode=memory&cache=shared"), &gorm.Config{})
+	assert.NoError(err)
+
+	man, err = RestoreBackup(ctx, dst, bytes.NewReader(archive), tables)
+	assert.NoError(err)
+	assert.Equal(int64(1), man.Rows["obj_refs"])
+
+	var restored Content
+	assert.NoError(dst.First(&restored, "id = ?", live.ID).Error)
+	assert.Equal(c, restored.Cid.CID)
+	assert.Equal("live", restored.Name)
+	assert.True(restored.Active)
+	assert.Equal(live.CreatedAt.Unix(), restored.CreatedAt.Unix())
+
+	var deleted Content
+	assert.NoError(dst.Unscoped().First(&deleted, "id = ?", gone.ID).Error)
+	assert.True(deleted.DeletedAt.Valid, "soft deleted rows stay deleted")
+
+	// running the restore again doesn't duplicate anything
+	_, err = RestoreBackup(ctx, dst, bytes.NewReader(archive), tables)
+	assert.NoError(err)
+
+	var count int64
+	assert.NoError(dst.Unscoped().Model(&Content{}).Count(&count).Error)
+	assert.Equal(int64(2), count)
+
+	_, err = RestoreBackup(ctx, dst, bytes.NewReader(archive[:len(archive)/2]), tables)
+	assert.Error(err)
+}
+
+func TestDbCIDUndefinedJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	b, err := json.Marshal(DbCID{})
+	assert.NoError(err)
+	assert.Equal(`"b"`, string(b))
+
+	for _, in := range []string{`"b"`, `""`} {
+		var dc DbCID
+		assert.NoError(json.Unmarshal([]byte(in), &dc), in)
+		assert.False(dc.CID.Defined(), in)
+	}
+}
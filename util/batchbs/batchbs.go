@@ -0,0 +1,252 @@
+// Package batchbs buffers block writes in memory and writes them to the
+// underlying blockstore with PutMany, so ingesting a DAG doesn't pay for a
+// write (and on flatfs a file sync) per block.
+package batchbs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("batchbs")
+
+type deleteManyer interface {
+	DeleteMany(context.Context, []cid.Cid) error
+}
+
+// Options controls when buffered blocks are written out
+type Options struct {
+	// MaxBlocks and MaxBytes flush the buffer once either is reached
+	MaxBlocks int
+	MaxBytes  int64
+	// FlushInterval flushes whatever is buffered periodically, 0 to only
+	// flush when the buffer is full or Flush is called
+	FlushInterval time.Duration
+}
+
+// Blockstore buffers Put and PutMany calls. Buffered blocks are served by
+// reads like any other, but they are only durable after the next flush, so
+// callers must Flush before recording that content is stored.
+type Blockstore struct {
+	blockstore.Blockstore
+
+	opts Options
+
+	// flushLk serializes flushes and deletes, so a block deleted while it is
+	// being flushed can't be written back after the delete
+	flushLk sync.Mutex
+
+	lk       sync.Mutex
+	pending  map[string]blocks.Block
+	flushing map[string]blocks.Block
+	size     int64
+
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+// New buffers writes to bs according to opts, flushing in the background
+// if opts has a FlushInterval
+func New(bs blockstore.Blockstore, opts Options) *Blockstore {
+	b := &Blockstore{
+		Blockstore: bs,
+		opts:       opts,
+		pending:    make(map[string]blocks.Block),
+		closing:    make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+
+	if opts.FlushInterval > 0 {
+		go b.run()
+	} else {
+		close(b.closed)
+	}
+	return b
+}
+
+func (b *Blockstore) run() {
+	defer close(b.closed)
+
+	tick := time.NewTicker(b.opts.FlushInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			if err := b.Flush(context.Background()); err != nil {
+				log.Errorf("failed to flush buffered blocks: %s", err)
+			}
+		case <-b.closing:
+			return
+		}
+	}
+}
+
+// Close stops the background flushes and flushes what is left
+func (b *Blockstore) Close() error {
+	select {
+	case <-b.closing:
+	default:
+		close(b.closing)
+	}
+	<-b.closed
+	return b.Flush(context.Background())
+}
+
+// Flush writes all buffered blocks to the underlying blockstore. On failure
+// the blocks stay buffered and the next flush tries them again.
+func (b *Blockstore) Flush(ctx context.Context) error {
+	b.flushLk.Lock()
+	defer b.flushLk.Unlock()
+
+	b.lk.Lock()
+	if len(b.pending) == 0 {
+		b.lk.Unlock()
+		return nil
+	}
+	batch := b.pending
+	b.flushing = batch
+	b.pending = make(map[string]blocks.Block)
+	b.size = 0
+	b.lk.Unlock()
+
+	blks := make([]blocks.Block, 0, len(batch))
+	for _, blk := range batch {
+		blks = append(blks, blk)
+	}
+	err := b.Blockstore.PutMany(ctx, blks)
+
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.flushing = nil
+	if err != nil {
+		for k, blk := range batch {
+			if _, ok := b.pending[k]; !ok {
+				b.pending[k] = blk
+				b.size += int64(len(blk.RawData()))
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+func (b *Blockstore) lookup(c cid.Cid) (blocks.Block, bool) {
+	k := string(c.Hash())
+
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	blk, ok := b.pending[k]
+	if !ok {
+		blk, ok = b.flushing[k]
+	}
+	if !ok {
+		return nil, false
+	}
+
+	if !blk.Cid().Equals(c) {
+		if nblk, err := blocks.NewBlockWithCid(blk.RawData(), c); err == nil {
+			return nblk, true
+		}
+	}
+	return blk, true
+}
+
+// add buffers blks and reports whether the buffer should be flushed
+func (b *Blockstore) add(blks []blocks.Block) bool {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	for _, blk := range blks {
+		k := string(blk.Cid().Hash())
+		if _, ok := b.pending[k]; ok {
+			continue
+		}
+		b.pending[k] = blk
+		b.size += int64(len(blk.RawData()))
+	}
+
+	return (b.opts.MaxBlocks > 0 && len(b.pending) >= b.opts.MaxBlocks) ||
+		(b.opts.MaxBytes > 0 && b.size >= b.opts.MaxBytes)
+}
+
+func (b *Blockstore) Put(ctx context.Context, blk blocks.Block) error {
+	return b.PutMany(ctx, []blocks.Block{blk})
+}
+
+func (b *Blockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	if b.add(blks) {
+		return b.Flush(ctx)
+	}
+	return nil
+}
+
+func (b *Blockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if blk, ok := b.lookup(c); ok {
+		return blk, nil
+	}
+	return b.Blockstore.Get(ctx, c)
+}
+
+func (b *Blockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	if blk, ok := b.lookup(c); ok {
+		return len(blk.RawData()), nil
+	}
+	return b.Blockstore.GetSize(ctx, c)
+}
+
+func (b *Blockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	if _, ok := b.lookup(c); ok {
+		return true, nil
+	}
+	return b.Blockstore.Has(ctx, c)
+}
+
+func (b *Blockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	if err := b.Flush(ctx); err != nil {
+		return nil, err
+	}
+	return b.Blockstore.AllKeysChan(ctx)
+}
+
+func (b *Blockstore) remove(c cid.Cid) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if blk, ok := b.pending[string(c.Hash())]; ok {
+		delete(b.pending, string(c.Hash()))
+		b.size -= int64(len(blk.RawData()))
+	}
+}
+
+func (b *Blockstore) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	b.flushLk.Lock()
+	defer b.flushLk.Unlock()
+
+	b.remove(c)
+	return b.Blockstore.DeleteBlock(ctx, c)
+}
+
+func (b *Blockstore) DeleteMany(ctx context.Context, cids []cid.Cid) error {
+	b.flushLk.Lock()
+	defer b.flushLk.Unlock()
+
+	for _, c := range cids {
+		b.remove(c)
+	}
+
+	if dm, ok := b.Blockstore.(deleteManyer); ok {
+		return dm.DeleteMany(ctx, cids)
+	}
+	for _, c := range cids {
+		if err := b.Blockstore.DeleteBlock(ctx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
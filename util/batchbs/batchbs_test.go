@@ -0,0 +1,75 @@
+package batchbs
+
+import (
+	"context"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countingBlockstore struct {
+	blockstore.Blockstore
+	putManys int
+}
+
+func (cb *countingBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	cb.putManys++
+	return cb.Blockstore.PutMany(ctx, blks)
+}
+
+func TestBlockstore(t *testing.T) {
+	ctx := context.Background()
+	base := &countingBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))}
+	bs := New(base, Options{MaxBlocks: 4, MaxBytes: 1 << 20})
+
+	var blks []blocks.Block
+	for i := 0; i < 6; i++ {
+		blks = append(blks, blocks.NewBlock([]byte{byte(i)}))
+	}
+
+	for _, blk := range blks[:3] {
+		require.NoError(t, bs.Put(ctx, blk))
+	}
+	assert.Equal(t, 0, base.putManys)
+
+	// buffered blocks are readable before they are written
+	has, err := bs.Has(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	assert.True(t, has)
+	has, err = base.Has(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	assert.False(t, has)
+	blk, err := bs.Get(ctx, cid.NewCidV1(cid.Raw, blks[1].Cid().Hash()))
+	require.NoError(t, err)
+	assert.Equal(t, blks[1].RawData(), blk.RawData())
+
+	// a full buffer is written out in one go
+	require.NoError(t, bs.Put(ctx, blks[3]))
+	assert.Equal(t, 1, base.putManys)
+	for _, blk := range blks[:4] {
+		has, err := base.Has(ctx, blk.Cid())
+		require.NoError(t, err)
+		assert.True(t, has)
+	}
+
+	// deleting a buffered block keeps it from being written
+	require.NoError(t, bs.PutMany(ctx, blks[4:]))
+	require.NoError(t, bs.DeleteBlock(ctx, blks[4].Cid()))
+	require.NoError(t, bs.Close())
+	assert.Equal(t, 2, base.putManys)
+	has, err = base.Has(ctx, blks[4].Cid())
+	require.NoError(t, err)
+	assert.False(t, has)
+	has, err = base.Has(ctx, blks[5].Cid())
+	require.NoError(t, err)
+	assert.True(t, has)
+
+	require.NoError(t, bs.Flush(ctx))
+	assert.Equal(t, 2, base.putManys, "nothing to flush")
+}
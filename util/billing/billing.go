@@ -0,0 +1,198 @@
+// Package billing reports the monthly usage of accounts on a node to the
+// systems operators bill their customers with: a webhook of their own, or
+// the metered billing of Stripe.
+package billing
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	gib = 1 << 30
+
+	// SignatureHeader carries the hex hmac-sha256 of webhook bodies
+	SignatureHeader = "X-Estuary-Signature"
+
+	DefaultStripeURL = "https://api.stripe.com"
+)
+
+// StripeItems are the ids of the metered subscription items an account is
+// billed with, usage without an item is not reported
+type StripeItems struct {
+	Storage string `json:"storage,omitempty"`
+	Egress  string `json:"egress,omitempty"`
+	Deals   string `json:"deals,omitempty"`
+}
+
+// Usage is what an account, a user or an organization, used in a month
+type Usage struct {
+	// Period is the month, like 2022-09
+	Period string `json:"period"`
+	// Account is user:<id> or org:<uuid>
+	Account   string `json:"account"`
+	Name      string `json:"name"`
+	ByteHours int64  `json:"byteHours"`
+	Deals     int64  `json:"deals"`
+	Egress    int64  `json:"egress"`
+
+	Stripe *StripeItems `json:"-"`
+}
+
+// End is the first moment after the period
+func (u *Usage) End() (time.Time, error) {
+	start, err := time.Parse("2006-01", u.Period)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return start.AddDate(0, 1, 0), nil
+}
+
+// Reporter sends usage off to be billed. Reports of the same usage are
+// repeated until they succeed, so reporters have to be idempotent.
+type Reporter interface {
+	Name() string
+	Report(ctx context.Context, usage []Usage) error
+}
+
+// WebhookReporter posts the usage of a month as a json array. With a
+// Secret, the body is signed in the SignatureHeader.
+type WebhookReporter struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+func (r *WebhookReporter) Name() string {
+	return "webhook"
+}
+
+func (r *WebhookReporter) Report(ctx context.Context, usage []Usage) error {
+	b, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(r.Secret, b))
+	}
+	return do(r.Client, req)
+}
+
+// Sign returns the signature of a webhook body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body) //nolint:errcheck
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// StripeReporter creates usage records on the subscription items of the
+// accounts: storage in GiB hours, egress in GiB, both rounded up, and the
+// number of deals. Records set the quantity at the end of the period, and
+// use idempotency keys, so reporting a month again changes nothing.
+type StripeReporter struct {
+	APIKey string
+	URL    string
+	Client *http.Client
+}
+
+func (r *StripeReporter) Name() string {
+	return "stripe"
+}
+
+func (r *StripeReporter) Report(ctx context.Context, usage []Usage) error {
+	for _, u := range usage {
+		if u.Stripe == nil {
+			continue
+		}
+		end, err := u.End()
+		if err != nil {
+			return err
+		}
+		// usage records can't be in the future, the last second of the
+		// period is in it
+		ts := end.Add(-time.Second).Unix()
+
+		for _, rec := range []struct {
+			item     string
+			metric   string
+			quantity int64
+		}{
+			{u.Stripe.Storage, "storage", ceilDiv(u.ByteHours, gib)},
+			{u.Stripe.Egress, "egress", ceilDiv(u.Egress, gib)},
+			{u.Stripe.Deals, "deals", u.Deals},
+		} {
+			if rec.item == "" {
+				continue
+			}
+			key := strings.Join([]string{u.Period, u.Account, rec.metric}, ":")
+			if err := r.createUsageRecord(ctx, rec.item, rec.quantity, ts, key); err != nil {
+				return fmt.Errorf("reporting %s of %s: %w", rec.metric, u.Account, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *StripeReporter) createUsageRecord(ctx context.Context, item string, quantity, ts int64, key string) error {
+	base := r.URL
+	if base == "" {
+		base = DefaultStripeURL
+	}
+	form := url.Values{
+		"quantity":  {strconv.FormatInt(quantity, 10)},
+		"timestamp": {strconv.FormatInt(ts, 10)},
+		"action":    {"set"},
+	}
+
+	u := fmt.Sprintf("%s/v1/subscription_items/%s/usage_records", strings.TrimSuffix(base, "/"), url.PathEscape(item))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+r.APIKey)
+	req.Header.Set("Idempotency-Key", key)
+	return do(r.Client, req)
+}
+
+func do(c *http.Client, req *http.Request) error {
+	if c == nil {
+		c = http.DefaultClient
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected response status %d: %s", resp.StatusCode, string(msg))
+	}
+	return nil
+}
+
+func ceilDiv(a, b int64) int64 {
+	if a <= 0 {
+		return 0
+	}
+	return (a + b - 1) / b
+}
@@ -0,0 +1,65 @@
+package billing
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookReporter(t *testing.T) {
+	var got []Usage
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, Sign("s3cret", b), r.Header.Get(SignatureHeader))
+		require.NoError(t, json.Unmarshal(b, &got))
+	}))
+	defer srv.Close()
+
+	usage := []Usage{{Period: "2022-09", Account: "user:1", Name: "alice", ByteHours: 42, Deals: 3, Egress: 7}}
+	r := &WebhookReporter{URL: srv.URL, Secret: "s3cret"}
+	require.NoError(t, r.Report(context.Background(), usage))
+	assert.Equal(t, usage, got)
+}
+
+func TestStripeReporter(t *testing.T) {
+	var lk sync.Mutex
+	records := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "Bearer sk_test", r.Header.Get("Authorization"))
+		assert.Equal(t, "set", r.Form.Get("action"))
+		// the last second of september 2022
+		assert.Equal(t, "1664582399", r.Form.Get("timestamp"))
+
+		lk.Lock()
+		defer lk.Unlock()
+		records[r.URL.Path] = r.Form.Get("quantity") + " " + r.Header.Get("Idempotency-Key")
+	}))
+	defer srv.Close()
+
+	r := &StripeReporter{APIKey: "sk_test", URL: srv.URL}
+	require.NoError(t, r.Report(context.Background(), []Usage{
+		{
+			Period:    "2022-09",
+			Account:   "org:abc",
+			ByteHours: 3*gib + 1,
+			Deals:     5,
+			Egress:    gib,
+			Stripe:    &StripeItems{Storage: "si_storage", Deals: "si_deals"},
+		},
+		{Period: "2022-09", Account: "user:2", ByteHours: gib},
+	}))
+
+	assert.Equal(t, map[string]string{
+		"/v1/subscription_items/si_storage/usage_records": "4 2022-09:org:abc:storage",
+		"/v1/subscription_items/si_deals/usage_records":   "5 2022-09:org:abc:deals",
+	}, records)
+}
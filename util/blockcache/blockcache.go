@@ -0,0 +1,249 @@
+// Package blockcache keeps recently read blocks in memory in front of a
+// blockstore. The cache is bounded by the bytes of the blocks in it rather
+// than by their number, so a few large blocks can't take more memory than
+// configured.
+package blockcache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+type deleteManyer interface {
+	DeleteMany(context.Context, []cid.Cid) error
+}
+
+// Blockstore is a blockstore that serves reads from a least recently used
+// cache of blocks. Blocks only enter the cache when they are read, writes go
+// straight through, so pinning a lot of content doesn't evict what is hot.
+type Blockstore struct {
+	blockstore.Blockstore
+
+	maxBlockSize int
+
+	lk      sync.Mutex
+	maxSize int64
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+	// removals counts the blocks deleted, a block read from the blockstore
+	// is only cached if none was deleted since, or it could be one deleted
+	// while it was read
+	removals uint64
+
+	hits   int64
+	misses int64
+}
+
+// Stats reports how well the cache is doing
+type Stats struct {
+	Blocks int   `json:"blocks"`
+	Size   int64 `json:"size"`
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+// New caches up to size bytes of the blocks read from bs, leaving out
+// blocks larger than maxBlockSize
+func New(bs blockstore.Blockstore, size int64, maxBlockSize int) *Blockstore {
+	return &Blockstore{
+		Blockstore:   bs,
+		maxBlockSize: maxBlockSize,
+		maxSize:      size,
+		lru:          list.New(),
+		entries:      make(map[string]*list.Element),
+	}
+}
+
+func (b *Blockstore) lookup(c cid.Cid) (blocks.Block, bool) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	el, ok := b.entries[string(c.Hash())]
+	if !ok {
+		b.misses++
+		return nil, false
+	}
+	b.hits++
+	b.lru.MoveToFront(el)
+
+	// blocks are stored by their multihash, like in the blockstore, so the
+	// same data is found under any cid version and codec
+	blk := el.Value.(blocks.Block)
+	if !blk.Cid().Equals(c) {
+		if nblk, err := blocks.NewBlockWithCid(blk.RawData(), c); err == nil {
+			return nblk, true
+		}
+	}
+	return blk, true
+}
+
+func (b *Blockstore) removalCount() uint64 {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return b.removals
+}
+
+// add caches blk, read from the blockstore when the removal count was
+// removals
+func (b *Blockstore) add(blk blocks.Block, removals uint64) {
+	size := int64(len(blk.RawData()))
+	if size > int64(b.maxBlockSize) {
+		return
+	}
+
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	if size > b.maxSize || b.removals != removals {
+		return
+	}
+	key := string(blk.Cid().Hash())
+	if el, ok := b.entries[key]; ok {
+		b.lru.MoveToFront(el)
+		return
+	}
+
+	b.entries[key] = b.lru.PushFront(blk)
+	b.size += size
+	for b.size > b.maxSize {
+		b.removeElement(b.lru.Back())
+	}
+}
+
+func (b *Blockstore) remove(c cid.Cid) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.removals++
+	if el, ok := b.entries[string(c.Hash())]; ok {
+		b.removeElement(el)
+	}
+}
+
+func (b *Blockstore) removeElement(el *list.Element) {
+	blk := b.lru.Remove(el).(blocks.Block)
+	delete(b.entries, string(blk.Cid().Hash()))
+	b.size -= int64(len(blk.RawData()))
+}
+
+// Stats returns the current contents and hit rate of the cache
+func (b *Blockstore) Stats() Stats {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return Stats{
+		Blocks: len(b.entries),
+		Size:   b.size,
+		Hits:   b.hits,
+		Misses: b.misses,
+	}
+}
+
+func (b *Blockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if blk, ok := b.lookup(c); ok {
+		return blk, nil
+	}
+
+	removals := b.removalCount()
+	blk, err := b.Blockstore.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	b.add(blk, removals)
+	return blk, nil
+}
+
+// Warm reads the blocks of cids into the cache ahead of their retrievals,
+// in order, until they fill it. Blocks that aren't stored are skipped. It
+// returns how many blocks are in the cache now.
+func (b *Blockstore) Warm(ctx context.Context, cids []cid.Cid) (int, error) {
+	var n int
+	var warmed int64
+	for _, c := range cids {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+
+		b.lk.Lock()
+		el, ok := b.entries[string(c.Hash())]
+		if ok {
+			b.lru.MoveToFront(el)
+			warmed += int64(len(el.Value.(blocks.Block).RawData()))
+			n++
+		}
+		removals := b.removals
+		b.lk.Unlock()
+
+		if !ok {
+			blk, err := b.Blockstore.Get(ctx, c)
+			if err != nil {
+				if errors.Is(err, blockstore.ErrNotFound) {
+					continue
+				}
+				return n, err
+			}
+			size := int64(len(blk.RawData()))
+			if size > int64(b.maxBlockSize) {
+				continue
+			}
+			// stop before the blocks warmed first are evicted
+			if warmed+size > b.maxSize {
+				break
+			}
+			b.add(blk, removals)
+			warmed += size
+			n++
+		}
+		if warmed >= b.maxSize {
+			break
+		}
+	}
+	return n, nil
+}
+
+func (b *Blockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	if blk, ok := b.lookup(c); ok {
+		return len(blk.RawData()), nil
+	}
+	return b.Blockstore.GetSize(ctx, c)
+}
+
+func (b *Blockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	b.lk.Lock()
+	_, ok := b.entries[string(c.Hash())]
+	b.lk.Unlock()
+	if ok {
+		return true, nil
+	}
+	return b.Blockstore.Has(ctx, c)
+}
+
+// DeleteBlock drops the block from the cache once it is deleted from the
+// blockstore, so a read racing the delete can't cache it again
+func (b *Blockstore) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	defer b.remove(c)
+	return b.Blockstore.DeleteBlock(ctx, c)
+}
+
+func (b *Blockstore) DeleteMany(ctx context.Context, cids []cid.Cid) error {
+	defer func() {
+		for _, c := range cids {
+			b.remove(c)
+		}
+	}()
+
+	if dm, ok := b.Blockstore.(deleteManyer); ok {
+		return dm.DeleteMany(ctx, cids)
+	}
+	for _, c := range cids {
+		if err := b.Blockstore.DeleteBlock(ctx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
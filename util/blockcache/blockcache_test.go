@@ -0,0 +1,134 @@
+package blockcache
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func block(b byte, size int) blocks.Block {
+	return blocks.NewBlock(bytes.Repeat([]byte{b}, size))
+}
+
+func TestBlockstore(t *testing.T) {
+	ctx := context.Background()
+	base := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	bs := New(base, 300, 150)
+
+	small := []blocks.Block{block(1, 100), block(2, 100), block(3, 100), block(4, 100)}
+	big := block(5, 200)
+	for _, blk := range append(small, big) {
+		require.NoError(t, bs.Put(ctx, blk))
+	}
+	assert.Equal(t, Stats{}, bs.Stats(), "writes don't fill the cache")
+
+	for _, blk := range small[:3] {
+		_, err := bs.Get(ctx, blk.Cid())
+		require.NoError(t, err)
+	}
+	_, err := bs.Get(ctx, big.Cid())
+	require.NoError(t, err)
+	assert.Equal(t, Stats{Blocks: 3, Size: 300, Misses: 4}, bs.Stats(), "blocks over the max size aren't cached")
+
+	// reading the first block again makes the second the least recently used
+	_, err = bs.Get(ctx, small[0].Cid())
+	require.NoError(t, err)
+	_, err = bs.Get(ctx, small[3].Cid())
+	require.NoError(t, err)
+	st := bs.Stats()
+	assert.Equal(t, int64(300), st.Size)
+	assert.Equal(t, int64(1), st.Hits)
+
+	size, err := bs.GetSize(ctx, small[0].Cid())
+	require.NoError(t, err)
+	assert.Equal(t, 100, size)
+	_, err = bs.GetSize(ctx, small[1].Cid())
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), bs.Stats().Hits, "the second block was evicted")
+
+	// the same data under another cid version comes back with the cid asked for
+	v1 := cid.NewCidV1(cid.Raw, small[0].Cid().Hash())
+	blk, err := bs.Get(ctx, v1)
+	require.NoError(t, err)
+	assert.Equal(t, v1, blk.Cid())
+	assert.Equal(t, int64(3), bs.Stats().Hits)
+
+	require.NoError(t, bs.DeleteBlock(ctx, small[0].Cid()))
+	has, err := bs.Has(ctx, small[0].Cid())
+	require.NoError(t, err)
+	assert.False(t, has)
+	_, err = bs.Get(ctx, small[0].Cid())
+	assert.ErrorIs(t, err, blockstore.ErrNotFound)
+
+	require.NoError(t, bs.DeleteMany(ctx, []cid.Cid{small[2].Cid(), small[3].Cid()}))
+	assert.Equal(t, 0, bs.Stats().Blocks)
+}
+
+func TestWarm(t *testing.T) {
+	ctx := context.Background()
+	base := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	bs := New(base, 300, 150)
+
+	small := []blocks.Block{block(1, 100), block(2, 100), block(3, 100), block(4, 100)}
+	big := block(5, 200)
+	for _, blk := range append(small, big) {
+		require.NoError(t, bs.Put(ctx, blk))
+	}
+
+	cids := []cid.Cid{block(6, 10).Cid(), big.Cid()}
+	for _, blk := range small {
+		cids = append(cids, blk.Cid())
+	}
+	n, err := bs.Warm(ctx, cids)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n, "missing and oversized blocks are skipped, and warming stops once the cache is full")
+	assert.Equal(t, Stats{Blocks: 3, Size: 300}, bs.Stats(), "warming isn't counted as hits or misses")
+
+	for _, blk := range small[:3] {
+		_, err := bs.Get(ctx, blk.Cid())
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int64(3), bs.Stats().Hits)
+}
+
+// racingBlockstore runs onGet after reading a block, before handing it back
+type racingBlockstore struct {
+	blockstore.Blockstore
+	onGet func()
+}
+
+func (r *racingBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	blk, err := r.Blockstore.Get(ctx, c)
+	if r.onGet != nil {
+		r.onGet()
+	}
+	return blk, err
+}
+
+func TestDeleteDuringGet(t *testing.T) {
+	ctx := context.Background()
+	base := &racingBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))}
+	bs := New(base, 300, 150)
+
+	blk := block(1, 100)
+	require.NoError(t, bs.Put(ctx, blk))
+
+	base.onGet = func() {
+		base.onGet = nil
+		require.NoError(t, bs.DeleteBlock(ctx, blk.Cid()))
+	}
+	_, err := bs.Get(ctx, blk.Cid())
+	require.NoError(t, err)
+	assert.Equal(t, 0, bs.Stats().Blocks, "a block deleted while it was read isn't cached")
+
+	_, err = bs.Get(ctx, blk.Cid())
+	assert.ErrorIs(t, err, blockstore.ErrNotFound)
+}
@@ -0,0 +1,130 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
+	"gorm.io/gorm"
+)
+
+// SupportsCopy reports whether db can bulk load rows with CopyObjects
+func SupportsCopy(db *gorm.DB) bool {
+	return db.Dialector.Name() == "postgres"
+}
+
+// CopyObjectsOpts describes how the obj_refs rows written by CopyObjects
+// link the new objects to their owner
+type CopyObjectsOpts struct {
+	// RefColumn is the obj_refs column holding the owner, 'content' on the
+	// primary node and 'pin' on shuttles
+	RefColumn string
+	Owner     uint
+
+	// ObjectDefaults and RefDefaults are constant values for any other non
+	// nullable columns of the objects and obj_refs tables
+	ObjectDefaults map[string]interface{}
+	RefDefaults    map[string]interface{}
+}
+
+// CopyObjects inserts a row into objects for each of cids and sizes, and a
+// row into obj_refs linking each of them to the owner, in one transaction
+// using COPY. Large DAGs otherwise generate thousands of insert round trips.
+// Object ids are reserved from the sequence up front so both tables can be
+// loaded in a single pass, and are returned in the same order as cids.
+func CopyObjects(ctx context.Context, db *gorm.DB, cids []DbCID, sizes []int, opts CopyObjectsOpts) ([]uint, error) {
+	if len(cids) != len(sizes) {
+		return nil, fmt.Errorf("got %d cids but %d sizes", len(cids), len(sizes))
+	}
+	if len(cids) == 0 {
+		return nil, nil
+	}
+
+	sqldb, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := sqldb.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var ids []uint
+	if err := conn.Raw(func(dc interface{}) error {
+		sc, ok := dc.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("bulk copy is not supported by driver connection %T", dc)
+		}
+
+		ids, err = copyObjects(ctx, sc.Conn(), cids, sizes, opts)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func copyObjects(ctx context.Context, pc *pgx.Conn, cids []DbCID, sizes []int, opts CopyObjectsOpts) ([]uint, error) {
+	tx, err := pc.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx) //nolint:errcheck
+
+	rows, err := tx.Query(ctx, "SELECT nextval(pg_get_serial_sequence('objects', 'id')) FROM generate_series(1, $1)", len(cids))
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve object ids: %w", err)
+	}
+
+	ids := make([]uint, 0, len(cids))
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, uint(id))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	objCols, objDefaults := copyColumns([]string{"id", "cid", "size", "last_access"}, opts.ObjectDefaults)
+	objRows := make([][]interface{}, len(cids))
+	for i := range cids {
+		objRows[i] = append([]interface{}{ids[i], cids[i].CID.Bytes(), sizes[i], time.Time{}}, objDefaults...)
+	}
+
+	if _, err := tx.CopyFrom(ctx, pgx.Identifier{"objects"}, objCols, pgx.CopyFromRows(objRows)); err != nil {
+		return nil, fmt.Errorf("failed to copy objects: %w", err)
+	}
+
+	refCols, refDefaults := copyColumns([]string{opts.RefColumn, "object"}, opts.RefDefaults)
+	refRows := make([][]interface{}, len(ids))
+	for i, id := range ids {
+		refRows[i] = append([]interface{}{opts.Owner, id}, refDefaults...)
+	}
+
+	if _, err := tx.CopyFrom(ctx, pgx.Identifier{"obj_refs"}, refCols, pgx.CopyFromRows(refRows)); err != nil {
+		return nil, fmt.Errorf("failed to copy refs: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func copyColumns(cols []string, defaults map[string]interface{}) ([]string, []interface{}) {
+	vals := make([]interface{}, 0, len(defaults))
+	for k, v := range defaults {
+		cols = append(cols, k)
+		vals = append(vals, v)
+	}
+	return cols, vals
+}
@@ -0,0 +1,206 @@
+// Package bwlimit meters and throttles bandwidth, with caps that can change
+// on a weekly schedule.
+package bwlimit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Window applies its caps on Days, every day if none are set, from Start to
+// End, as "15:04" in the timezone of the limits. A window that ends before it
+// starts runs past midnight.
+type Window struct {
+	Days   []time.Weekday `json:"days"`
+	Start  string         `json:"start"`
+	End    string         `json:"end"`
+	Ingest int64          `json:"ingest"`
+	Egress int64          `json:"egress"`
+}
+
+// Limits caps ingest and egress in bytes per second, 0 for no cap. The first
+// window that is open overrides them.
+type Limits struct {
+	Ingest   int64    `json:"ingest"`
+	Egress   int64    `json:"egress"`
+	Timezone string   `json:"timezone"`
+	Windows  []Window `json:"windows"`
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (l Limits) location() (*time.Location, error) {
+	if l.Timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(l.Timezone)
+}
+
+func (l Limits) Validate() error {
+	if l.Ingest < 0 || l.Egress < 0 {
+		return fmt.Errorf("caps can't be negative")
+	}
+	if _, err := l.location(); err != nil {
+		return fmt.Errorf("invalid timezone: %w", err)
+	}
+	for i, w := range l.Windows {
+		if w.Ingest < 0 || w.Egress < 0 {
+			return fmt.Errorf("window %d: caps can't be negative", i)
+		}
+		if _, err := parseClock(w.Start); err != nil {
+			return fmt.Errorf("window %d: %w", i, err)
+		}
+		if _, err := parseClock(w.End); err != nil {
+			return fmt.Errorf("window %d: %w", i, err)
+		}
+		for _, d := range w.Days {
+			if d < time.Sunday || d > time.Saturday {
+				return fmt.Errorf("window %d: invalid day %d", i, d)
+			}
+		}
+	}
+	return nil
+}
+
+func (w Window) open(t time.Time) bool {
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(w.End)
+	if err != nil {
+		return false
+	}
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+
+	day := t.Weekday()
+	if end <= start && clock < end {
+		// the part past midnight belongs to the day before
+		day = (day + 6) % 7
+	}
+	if len(w.Days) > 0 {
+		found := false
+		for _, d := range w.Days {
+			if d == day {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if end > start {
+		return clock >= start && clock < end
+	}
+	return clock >= start || clock < end
+}
+
+// At returns the caps at t
+func (l Limits) At(t time.Time) (ingest, egress int64) {
+	loc, err := l.location()
+	if err != nil {
+		loc = time.UTC
+	}
+	t = t.In(loc)
+	for _, w := range l.Windows {
+		if w.open(t) {
+			return w.Ingest, w.Egress
+		}
+	}
+	return l.Ingest, l.Egress
+}
+
+// Limiter counts the bytes that pass through it and holds them to the caps
+// it is set to
+type Limiter struct {
+	ingest *rate.Limiter
+	egress *rate.Limiter
+
+	in  uint64
+	out uint64
+}
+
+// New returns a limiter without caps
+func New() *Limiter {
+	return &Limiter{
+		ingest: rate.NewLimiter(rate.Inf, 0),
+		egress: rate.NewLimiter(rate.Inf, 0),
+	}
+}
+
+func setLimit(rl *rate.Limiter, bps int64) {
+	if bps <= 0 {
+		rl.SetLimit(rate.Inf)
+		return
+	}
+	rl.SetLimit(rate.Limit(bps))
+	// a second's worth can go at once
+	rl.SetBurst(int(bps))
+}
+
+// Set caps ingest and egress in bytes per second, 0 for no cap
+func (l *Limiter) Set(ingest, egress int64) {
+	setLimit(l.ingest, ingest)
+	setLimit(l.egress, egress)
+}
+
+// Totals returns the bytes that came in and went out
+func (l *Limiter) Totals() (in, out uint64) {
+	return atomic.LoadUint64(&l.in), atomic.LoadUint64(&l.out)
+}
+
+func wait(ctx context.Context, rl *rate.Limiter, n int) error {
+	if rl.Limit() == rate.Inf {
+		return nil
+	}
+	for n > 0 {
+		m := n
+		if b := rl.Burst(); m > b {
+			m = b
+		}
+		if err := rl.WaitN(ctx, m); err != nil {
+			return err
+		}
+		n -= m
+	}
+	return nil
+}
+
+type reader struct {
+	ctx context.Context
+	l   *Limiter
+	r   io.Reader
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddUint64(&r.l.in, uint64(n))
+	if werr := wait(r.ctx, r.l.ingest, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+// Reader counts what is read from r as ingest
+func (l *Limiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	return &reader{ctx: ctx, l: l, r: r}
+}
+
+// Egress waits until n bytes may go out, and counts them
+func (l *Limiter) Egress(ctx context.Context, n int) error {
+	atomic.AddUint64(&l.out, uint64(n))
+	return wait(ctx, l.egress, n)
+}
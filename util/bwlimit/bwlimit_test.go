@@ -0,0 +1,100 @@
+package bwlimit
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitsAt(t *testing.T) {
+	l := Limits{
+		Ingest: 100,
+		Egress: 200,
+		Windows: []Window{
+			{Days: []time.Weekday{time.Monday, time.Tuesday}, Start: "09:00", End: "17:00", Ingest: 10, Egress: 20},
+			{Start: "22:00", End: "02:00", Ingest: 0, Egress: 0},
+		},
+	}
+	require.NoError(t, l.Validate())
+
+	mon := time.Date(2022, 10, 3, 0, 0, 0, 0, time.UTC)
+	at := func(t time.Time) [2]int64 {
+		i, e := l.At(t)
+		return [2]int64{i, e}
+	}
+	assert.Equal(t, [2]int64{10, 20}, at(mon.Add(10*time.Hour)))
+	assert.Equal(t, [2]int64{100, 200}, at(mon.Add(17*time.Hour)))
+	assert.Equal(t, [2]int64{100, 200}, at(mon.Add(3*24*time.Hour+10*time.Hour)))
+	assert.Equal(t, [2]int64{0, 0}, at(mon.Add(23*time.Hour)))
+	assert.Equal(t, [2]int64{0, 0}, at(mon.Add(25*time.Hour)))
+
+	assert.Error(t, Limits{Windows: []Window{{Start: "9am", End: "17:00"}}}.Validate())
+	assert.Error(t, Limits{Timezone: "Nowhere/Else"}.Validate())
+	assert.Error(t, Limits{Egress: -1}.Validate())
+}
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	l := New()
+
+	data := bytes.Repeat([]byte("x"), 1000)
+	b, err := ioutil.ReadAll(l.Reader(ctx, bytes.NewReader(data)))
+	require.NoError(t, err)
+	assert.Len(t, b, 1000)
+	require.NoError(t, l.Egress(ctx, 500))
+
+	in, out := l.Totals()
+	assert.Equal(t, uint64(1000), in)
+	assert.Equal(t, uint64(500), out)
+
+	// at 1000 bytes per second the first 1000 go at once, the rest take 1.5s
+	l.Set(0, 1000)
+	start := time.Now()
+	require.NoError(t, l.Egress(ctx, 2500))
+	assert.True(t, time.Since(start) > time.Second)
+
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.Error(t, l.Egress(cctx, 5000))
+}
+
+func TestHost(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mn := mocknet.New()
+	a, err := mn.GenPeer()
+	require.NoError(t, err)
+	b, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+
+	received := make(chan []byte, 1)
+	b.SetStreamHandler("/test", func(s network.Stream) {
+		data, _ := ioutil.ReadAll(s)
+		received <- data
+	})
+
+	// at 1000 bytes per second the first 1000 go at once, the rest take 1.5s
+	l := New()
+	l.Set(0, 1000)
+	h := Host(a, l)
+	require.NoError(t, h.Connect(ctx, peer.AddrInfo{ID: b.ID(), Addrs: b.Addrs()}))
+	s, err := h.NewStream(ctx, b.ID(), "/test")
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = s.Write(bytes.Repeat([]byte("x"), 2500))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	assert.True(t, time.Since(start) > time.Second)
+	assert.Len(t, <-received, 2500)
+}
@@ -0,0 +1,67 @@
+package bwlimit
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// limitedHost holds the streams of a libp2p host to the caps of a limiter,
+// which covers bitswap, graphsync and data transfers over it. What goes
+// through is counted by the bandwidth counter of the host, not the limiter.
+type limitedHost struct {
+	host.Host
+	l *Limiter
+}
+
+// Host returns h with its streams held to the caps of l
+func Host(h host.Host, l *Limiter) host.Host {
+	return &limitedHost{Host: h, l: l}
+}
+
+func (h *limitedHost) wrap(s network.Stream) network.Stream {
+	return &limitedStream{Stream: s, l: h.l}
+}
+
+func (h *limitedHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	s, err := h.Host.NewStream(ctx, p, pids...)
+	if err != nil {
+		return nil, err
+	}
+	return h.wrap(s), nil
+}
+
+func (h *limitedHost) SetStreamHandler(pid protocol.ID, handler network.StreamHandler) {
+	h.Host.SetStreamHandler(pid, func(s network.Stream) {
+		handler(h.wrap(s))
+	})
+}
+
+func (h *limitedHost) SetStreamHandlerMatch(pid protocol.ID, m func(string) bool, handler network.StreamHandler) {
+	h.Host.SetStreamHandlerMatch(pid, m, func(s network.Stream) {
+		handler(h.wrap(s))
+	})
+}
+
+type limitedStream struct {
+	network.Stream
+	l *Limiter
+}
+
+func (s *limitedStream) Read(p []byte) (int, error) {
+	n, err := s.Stream.Read(p)
+	if werr := wait(context.Background(), s.l.ingest, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+func (s *limitedStream) Write(p []byte) (int, error) {
+	if err := wait(context.Background(), s.l.egress, len(p)); err != nil {
+		return 0, err
+	}
+	return s.Stream.Write(p)
+}
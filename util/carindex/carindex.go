@@ -0,0 +1,416 @@
+// Package carindex records where each block is in the CAR a piece is
+// computed over. With it a CAR can be written from any offset without
+// walking the DAG up to there, and a CARv2 index can be handed out for it.
+package carindex
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-varint"
+)
+
+// version is the version of the encoding of layouts
+const version = 1
+
+// Section is a block in the CAR. Offset is where its length prefix starts
+// and Size includes the prefix.
+type Section struct {
+	Cid    cid.Cid
+	Offset uint64
+	Size   uint64
+}
+
+// Layout is where the header and the blocks are in the CARv1 of root
+type Layout struct {
+	Root       cid.Cid
+	HeaderSize uint64
+	Sections   []Section
+}
+
+// New starts the layout of the CAR of root, which has only the header yet
+func New(root cid.Cid) (*Layout, error) {
+	hs, err := car.HeaderSize(header(root))
+	if err != nil {
+		return nil, err
+	}
+	return &Layout{Root: root, HeaderSize: hs}, nil
+}
+
+func header(root cid.Cid) *car.CarHeader {
+	return &car.CarHeader{Roots: []cid.Cid{root}, Version: 1}
+}
+
+// Add records the next block written to the CAR
+func (l *Layout) Add(b car.Block) error {
+	if b.Offset != l.Size() {
+		return fmt.Errorf("block %s is at %d, expected it at %d", b.BlockCID, b.Offset, l.Size())
+	}
+	l.Sections = append(l.Sections, Section{Cid: b.BlockCID, Offset: b.Offset, Size: b.Size})
+	return nil
+}
+
+// Size is the size of the CAR
+func (l *Layout) Size() uint64 {
+	if len(l.Sections) == 0 {
+		return l.HeaderSize
+	}
+	last := l.Sections[len(l.Sections)-1]
+	return last.Offset + last.Size
+}
+
+// find returns the index of the section offset is in
+func (l *Layout) find(offset uint64) int {
+	return sort.Search(len(l.Sections), func(i int) bool {
+		return l.Sections[i].Offset+l.Sections[i].Size > offset
+	})
+}
+
+// Index returns the CARv2 index of the CAR, a multihash sorted index of
+// the offsets of the blocks
+func (l *Layout) Index() (index.Index, error) {
+	idx, err := index.New(multicodec.CarMultihashIndexSorted)
+	if err != nil {
+		return nil, err
+	}
+	recs := make([]index.Record, 0, len(l.Sections))
+	for _, s := range l.Sections {
+		recs = append(recs, index.Record{Cid: s.Cid, Offset: s.Offset})
+	}
+	if err := idx.Load(recs); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// WriteIndex writes the CARv2 index of the CAR, as index.ReadFrom reads it
+func (l *Layout) WriteIndex(w io.Writer) error {
+	idx, err := l.Index()
+	if err != nil {
+		return err
+	}
+	_, err = index.WriteTo(idx, w)
+	return err
+}
+
+// Getter reads a block, like a blockstore does
+type Getter func(context.Context, cid.Cid) (blocks.Block, error)
+
+// WriteFrom writes the CAR from offset on, reading only the blocks at or
+// after it
+func (l *Layout) WriteFrom(ctx context.Context, get Getter, offset uint64, w io.Writer) error {
+	if offset > l.Size() {
+		return fmt.Errorf("offset %d is past the end of the car at %d", offset, l.Size())
+	}
+
+	if offset < l.HeaderSize {
+		var buf bytes.Buffer
+		if err := car.WriteHeader(header(l.Root), &buf); err != nil {
+			return err
+		}
+		if _, err := w.Write(buf.Bytes()[offset:]); err != nil {
+			return err
+		}
+		offset = l.HeaderSize
+	}
+
+	for i := l.find(offset); i < len(l.Sections); i++ {
+		s := l.Sections[i]
+		blk, err := get(ctx, s.Cid)
+		if err != nil {
+			return fmt.Errorf("reading block %s: %w", s.Cid, err)
+		}
+		if sz := carutil.LdSize(s.Cid.Bytes(), blk.RawData()); sz != s.Size {
+			return fmt.Errorf("block %s is %d bytes in the car, expected %d", s.Cid, sz, s.Size)
+		}
+
+		if offset > s.Offset {
+			var buf bytes.Buffer
+			if err := carutil.LdWrite(&buf, s.Cid.Bytes(), blk.RawData()); err != nil {
+				return err
+			}
+			if _, err := w.Write(buf.Bytes()[offset-s.Offset:]); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := carutil.LdWrite(w, s.Cid.Bytes(), blk.RawData()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarshalBinary encodes the layout. Offsets follow from the sizes, so only
+// the cids and sizes of the blocks are kept.
+func (l *Layout) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(varint.ToUvarint(version))
+	writeBytes(&buf, l.Root.Bytes())
+	buf.Write(varint.ToUvarint(l.HeaderSize))
+	buf.Write(varint.ToUvarint(uint64(len(l.Sections))))
+	for _, s := range l.Sections {
+		writeBytes(&buf, s.Cid.Bytes())
+		buf.Write(varint.ToUvarint(s.Size))
+	}
+	return buf.Bytes(), nil
+}
+
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	buf.Write(varint.ToUvarint(uint64(len(b))))
+	buf.Write(b)
+}
+
+// UnmarshalBinary decodes a layout encoded with MarshalBinary
+func (l *Layout) UnmarshalBinary(data []byte) error {
+	r := bufio.NewReader(bytes.NewReader(data))
+	v, err := varint.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	if v != version {
+		return fmt.Errorf("unknown layout version %d", v)
+	}
+
+	readCid := func() (cid.Cid, error) {
+		n, err := varint.ReadUvarint(r)
+		if err != nil {
+			return cid.Undef, err
+		}
+		if n > uint64(len(data)) {
+			return cid.Undef, fmt.Errorf("cid length %d is longer than the layout", n)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return cid.Undef, err
+		}
+		return cid.Cast(b)
+	}
+
+	if l.Root, err = readCid(); err != nil {
+		return err
+	}
+	if l.HeaderSize, err = varint.ReadUvarint(r); err != nil {
+		return err
+	}
+	count, err := varint.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	if count > uint64(len(data)) {
+		return fmt.Errorf("layout claims %d blocks, more than it could hold", count)
+	}
+
+	l.Sections = make([]Section, 0, count)
+	offset := l.HeaderSize
+	for i := uint64(0); i < count; i++ {
+		c, err := readCid()
+		if err != nil {
+			return err
+		}
+		size, err := varint.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		l.Sections = append(l.Sections, Section{Cid: c, Offset: offset, Size: size})
+		offset += size
+	}
+	return nil
+}
+
+// Store keeps layouts as files in a directory, by the root of their CAR
+type Store struct {
+	dir string
+}
+
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+func (s *Store) path(root cid.Cid) string {
+	return filepath.Join(s.dir, root.String()+".layout")
+}
+
+// Put stores the layout of a CAR, replacing what was stored for its root
+func (s *Store) Put(l *Layout) error {
+	data, err := l.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	tmp := s.path(l.Root) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(l.Root))
+}
+
+// ErrNotFound is returned for roots there is no layout of
+var ErrNotFound = errors.New("car layout not found")
+
+// Get returns the layout of the CAR of root
+func (s *Store) Get(root cid.Cid) (*Layout, error) {
+	data, err := os.ReadFile(s.path(root))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	var l Layout
+	if err := l.UnmarshalBinary(data); err != nil {
+		return nil, fmt.Errorf("decoding layout of %s: %w", root, err)
+	}
+	return &l, nil
+}
+
+// Lookup returns the layout of the CAR of root if it is stored, for reads
+// that can do without it
+func (s *Store) Lookup(root cid.Cid) (*Layout, bool) {
+	l, err := s.Get(root)
+	return l, err == nil
+}
+
+// Delete removes the layout of the CAR of root, if there is one
+func (s *Store) Delete(root cid.Cid) error {
+	if err := os.Remove(s.path(root)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Roots returns the roots there are layouts of
+func (s *Store) Roots() ([]cid.Cid, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var roots []cid.Cid
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".layout") {
+			continue
+		}
+		c, err := cid.Decode(strings.TrimSuffix(name, ".layout"))
+		if err != nil {
+			continue
+		}
+		roots = append(roots, c)
+	}
+	return roots, nil
+}
+
+// Serve writes the CAR as the response to r, or the range of it r asks
+// for. Only single ranges are served, a request for several gets all of it.
+func Serve(w http.ResponseWriter, r *http.Request, l *Layout, get Getter) error {
+	size := l.Size()
+	start, end := uint64(0), size
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" && !strings.Contains(rng, ",") {
+		s, e, ok := ParseRange(rng, size)
+		if !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return nil
+		}
+		start, end = s, e
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, size))
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.ipld.car")
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatUint(end-start, 10))
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	lw := &limitWriter{w: w, n: end - start}
+	if err := l.WriteFrom(r.Context(), get, start, lw); err != nil && !errors.Is(err, errRangeWritten) {
+		return err
+	}
+	return nil
+}
+
+// ParseRange parses a single bytes range of a body of size bytes into the
+// offsets it starts at and ends before
+func ParseRange(rng string, size uint64) (uint64, uint64, bool) {
+	spec := strings.TrimPrefix(rng, "bytes=")
+	if spec == rng {
+		return 0, 0, false
+	}
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return 0, 0, false
+	}
+	first, last := spec[:i], spec[i+1:]
+
+	if first == "" {
+		// the last bytes of the car
+		n, err := strconv.ParseUint(last, 10, 64)
+		if err != nil || n == 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size, true
+	}
+
+	start, err := strconv.ParseUint(first, 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end := size
+	if last != "" {
+		e, err := strconv.ParseUint(last, 10, 64)
+		if err != nil || e < start {
+			return 0, 0, false
+		}
+		if e+1 < size {
+			end = e + 1
+		}
+	}
+	return start, end, true
+}
+
+var errRangeWritten = errors.New("range written")
+
+// limitWriter takes n bytes and then stops the write
+type limitWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	if uint64(len(p)) <= lw.n {
+		n, err := lw.w.Write(p)
+		lw.n -= uint64(n)
+		return n, err
+	}
+	n, err := lw.w.Write(p[:lw.n])
+	lw.n -= uint64(n)
+	if err != nil {
+		return n, err
+	}
+	return n, errRangeWritten
+}
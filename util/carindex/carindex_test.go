@@ -0,0 +1,149 @@
+package carindex
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/filecoin-project/go-fil-markets/shared"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-merkledag"
+	car "github.com/ipld/go-car"
+	"github.com/ipld/go-car/v2/index"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCar writes the CAR of a small DAG and returns it with its layout
+func writeCar(t *testing.T) (blockstore.Blockstore, *Layout, []byte) {
+	ctx := context.Background()
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	root := merkledag.NodeWithData([]byte("root"))
+	for i := 0; i < 10; i++ {
+		leaf := merkledag.NewRawNode(bytes.Repeat([]byte(fmt.Sprint(i)), 100*(i+1)))
+		assert.NoError(t, bs.Put(ctx, leaf))
+		assert.NoError(t, root.AddNodeLink(fmt.Sprint(i), leaf))
+	}
+	assert.NoError(t, bs.Put(ctx, root))
+
+	l, err := New(root.Cid())
+	assert.NoError(t, err)
+	var buf bytes.Buffer
+	assert.NoError(t, car.NewSelectiveCar(ctx, bs,
+		[]car.Dag{{Root: root.Cid(), Selector: shared.AllSelector()}},
+		car.TraverseLinksOnlyOnce(),
+	).Write(&buf, l.Add))
+	return bs, l, buf.Bytes()
+}
+
+func TestLayout(t *testing.T) {
+	_, l, data := writeCar(t)
+	assert.Len(t, l.Sections, 11)
+	assert.Equal(t, uint64(len(data)), l.Size())
+
+	idx, err := l.Index()
+	assert.NoError(t, err)
+	for _, s := range l.Sections {
+		err := idx.GetAll(s.Cid, func(off uint64) bool {
+			assert.Equal(t, s.Offset, off)
+			return false
+		})
+		assert.NoError(t, err)
+	}
+
+	var ib bytes.Buffer
+	assert.NoError(t, l.WriteIndex(&ib))
+	read, err := index.ReadFrom(&ib)
+	assert.NoError(t, err)
+	assert.NoError(t, read.GetAll(l.Sections[3].Cid, func(off uint64) bool {
+		assert.Equal(t, l.Sections[3].Offset, off)
+		return false
+	}))
+}
+
+func TestWriteFrom(t *testing.T) {
+	bs, l, data := writeCar(t)
+	offsets := []uint64{0, 1, l.HeaderSize, l.HeaderSize + 1, l.Sections[5].Offset, l.Sections[5].Offset + 3, uint64(len(data)) - 1, uint64(len(data))}
+	for _, off := range offsets {
+		var buf bytes.Buffer
+		assert.NoError(t, l.WriteFrom(context.Background(), bs.Get, off, &buf))
+		assert.Equal(t, string(data[off:]), buf.String(), "offset %d", off)
+	}
+
+	assert.Error(t, l.WriteFrom(context.Background(), bs.Get, uint64(len(data))+1, &bytes.Buffer{}))
+}
+
+func TestMarshal(t *testing.T) {
+	_, l, _ := writeCar(t)
+	b, err := l.MarshalBinary()
+	assert.NoError(t, err)
+
+	var got Layout
+	assert.NoError(t, got.UnmarshalBinary(b))
+	assert.Equal(t, l, &got)
+
+	assert.Error(t, got.UnmarshalBinary(b[:len(b)-1]))
+}
+
+func TestStore(t *testing.T) {
+	_, l, _ := writeCar(t)
+	s, err := NewStore(t.TempDir())
+	assert.NoError(t, err)
+
+	_, err = s.Get(l.Root)
+	assert.Equal(t, ErrNotFound, err)
+	_, ok := s.Lookup(l.Root)
+	assert.False(t, ok)
+
+	assert.NoError(t, s.Put(l))
+	got, err := s.Get(l.Root)
+	assert.NoError(t, err)
+	assert.Equal(t, l, got)
+	got, ok = s.Lookup(l.Root)
+	assert.True(t, ok)
+	assert.Equal(t, l, got)
+
+	roots, err := s.Roots()
+	assert.NoError(t, err)
+	assert.Equal(t, []cid.Cid{l.Root}, roots)
+
+	assert.NoError(t, s.Delete(l.Root))
+	assert.NoError(t, s.Delete(l.Root))
+	_, err = s.Get(l.Root)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestServe(t *testing.T) {
+	bs, l, data := writeCar(t)
+	size := len(data)
+
+	cases := []struct {
+		rng    string
+		status int
+		body   string
+	}{
+		{"", http.StatusOK, string(data)},
+		{"bytes=0-", http.StatusPartialContent, string(data)},
+		{"bytes=10-", http.StatusPartialContent, string(data[10:])},
+		{fmt.Sprintf("bytes=%d-%d", l.Sections[2].Offset, l.Sections[4].Offset), http.StatusPartialContent, string(data[l.Sections[2].Offset : l.Sections[4].Offset+1])},
+		{"bytes=-5", http.StatusPartialContent, string(data[size-5:])},
+		{fmt.Sprintf("bytes=5-%d", size+100), http.StatusPartialContent, string(data[5:])},
+		{fmt.Sprintf("bytes=%d-", size), http.StatusRequestedRangeNotSatisfiable, ""},
+		{"bytes=0-1,4-5", http.StatusOK, string(data)},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if c.rng != "" {
+			req.Header.Set("Range", c.rng)
+		}
+		rec := httptest.NewRecorder()
+		assert.NoError(t, Serve(rec, req, l, bs.Get), c.rng)
+		assert.Equal(t, c.status, rec.Code, c.rng)
+		assert.Equal(t, c.body, rec.Body.String(), c.rng)
+	}
+}
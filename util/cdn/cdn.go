@@ -0,0 +1,183 @@
+// Package cdn registers content with an external retrieval CDN and keeps
+// track of which content is requested often enough to be sent there.
+package cdn
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+// Client registers cids with the CDN, and deregisters them
+type Client struct {
+	url           string
+	deregisterURL string
+	apiKey        string
+	hc            *http.Client
+}
+
+func NewClient(registerURL, deregisterURL, apiKey string, timeout time.Duration) *Client {
+	return &Client{
+		url:           registerURL,
+		deregisterURL: deregisterURL,
+		apiKey:        apiKey,
+		hc:            &http.Client{Timeout: timeout},
+	}
+}
+
+type registerBody struct {
+	Cids []string `json:"cids"`
+}
+
+// Register posts cids to the register url as {"cids": [...]}
+func (c *Client) Register(ctx context.Context, cids []cid.Cid) error {
+	return c.post(ctx, c.url, "registering with", cids)
+}
+
+// Deregister posts cids to the deregister url the same way, for the cdn to
+// stop serving them. Without a deregister url there is nothing to tell it.
+func (c *Client) Deregister(ctx context.Context, cids []cid.Cid) error {
+	if c.deregisterURL == "" {
+		return nil
+	}
+	return c.post(ctx, c.deregisterURL, "deregistering from", cids)
+}
+
+func (c *Client) post(ctx context.Context, u, what string, cids []cid.Cid) error {
+	body := registerBody{Cids: make([]string, 0, len(cids))}
+	for _, cc := range cids {
+		body.Cids = append(body.Cids, cc.String())
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s the cdn failed with status %d: %s", what, resp.StatusCode, msg)
+	}
+	return nil
+}
+
+// Heat counts requests per cid over a sliding window
+type Heat struct {
+	window time.Duration
+
+	lk      sync.Mutex
+	start   time.Time
+	cur     map[cid.Cid]int
+	prev    map[cid.Cid]int
+	maxKeys int
+}
+
+// NewHeat counts over window, forgetting the quietest cids once more than
+// maxKeys are tracked
+func NewHeat(window time.Duration, maxKeys int) *Heat {
+	return &Heat{
+		window:  window,
+		cur:     make(map[cid.Cid]int),
+		prev:    make(map[cid.Cid]int),
+		maxKeys: maxKeys,
+	}
+}
+
+// Hit counts a request for c and returns about how many there were within
+// the window, this one included
+func (h *Heat) Hit(c cid.Cid, now time.Time) int {
+	return h.Add(c, 1, now)
+}
+
+// Add counts n requests for c, such as those a shuttle served without
+// asking, and returns about how many there were within the window
+func (h *Heat) Add(c cid.Cid, n int, now time.Time) int {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	switch elapsed := now.Sub(h.start); {
+	case elapsed >= 2*h.window:
+		h.prev = make(map[cid.Cid]int)
+		h.cur = make(map[cid.Cid]int)
+		h.start = now
+	case elapsed >= h.window:
+		h.prev = h.cur
+		h.cur = make(map[cid.Cid]int)
+		h.start = h.start.Add(h.window)
+	}
+
+	if _, ok := h.cur[c]; !ok && len(h.cur) >= h.maxKeys {
+		h.evict()
+	}
+	h.cur[c] += n
+
+	// the previous window counts for the part of it still in range
+	frac := 1 - float64(now.Sub(h.start))/float64(h.window)
+	return h.cur[c] + int(float64(h.prev[c])*frac)
+}
+
+// evict forgets the quietest cids, down to a tenth under maxKeys so it
+// doesn't run on every new cid
+func (h *Heat) evict() {
+	keep := h.maxKeys - h.maxKeys/10
+	if keep < 1 {
+		keep = h.maxKeys - 1
+	}
+
+	type count struct {
+		c cid.Cid
+		n int
+	}
+	counts := make([]count, 0, len(h.cur))
+	for k, n := range h.cur {
+		counts = append(counts, count{c: k, n: n})
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].n < counts[j].n })
+	for _, ct := range counts[:len(counts)-keep] {
+		delete(h.cur, ct.c)
+	}
+}
+
+// forwardedParams are the query parameters that go along to the cdn. The
+// rest, such as access tokens, passwords and vouchers, are for estuary only
+var forwardedParams = []string{"format", "filename", "download"}
+
+// RedirectURL is where a gateway path, /ipfs/<cid>/..., is served from by
+// the cdn at base
+func RedirectURL(base, path string, query url.Values) string {
+	u := strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+	fwd := url.Values{}
+	for _, k := range forwardedParams {
+		if v, ok := query[k]; ok {
+			fwd[k] = v
+		}
+	}
+	if len(fwd) > 0 {
+		u += "?" + fwd.Encode()
+	}
+	return u
+}
@@ -0,0 +1,96 @@
+package cdn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testCid(t *testing.T, s string) cid.Cid {
+	mh, err := multihash.Sum([]byte(s), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	return cid.NewCidV1(cid.Raw, mh)
+}
+
+func TestRegister(t *testing.T) {
+	c1 := testCid(t, "a")
+	var got registerBody
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer key", r.Header.Get("Authorization"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+	}))
+	defer srv.Close()
+
+	require.NoError(t, NewClient(srv.URL, "", "key", time.Second).Register(context.Background(), []cid.Cid{c1}))
+	assert.Equal(t, []string{c1.String()}, got.Cids)
+
+	got = registerBody{}
+	require.NoError(t, NewClient("", srv.URL, "key", time.Second).Deregister(context.Background(), []cid.Cid{c1}))
+	assert.Equal(t, []string{c1.String()}, got.Cids)
+	// without a deregister url there is nothing to do
+	require.NoError(t, NewClient(srv.URL, "", "key", time.Second).Deregister(context.Background(), []cid.Cid{c1}))
+
+	fail := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer fail.Close()
+	assert.Error(t, NewClient(fail.URL, "", "", time.Second).Register(context.Background(), []cid.Cid{c1}))
+}
+
+func TestHeat(t *testing.T) {
+	a, b := testCid(t, "a"), testCid(t, "b")
+	h := NewHeat(time.Minute, 10)
+	now := time.Unix(1000, 0)
+
+	assert.Equal(t, 1, h.Hit(a, now))
+	assert.Equal(t, 2, h.Hit(a, now.Add(time.Second)))
+	assert.Equal(t, 1, h.Hit(b, now.Add(time.Second)))
+
+	// halfway through the next window half of the last one counts
+	assert.Equal(t, 2, h.Hit(a, now.Add(90*time.Second)))
+
+	// long after, it starts over
+	assert.Equal(t, 1, h.Hit(a, now.Add(time.Hour)))
+
+	// requests a shuttle served on its own count too
+	assert.Equal(t, 5, h.Add(a, 4, now.Add(time.Hour)))
+}
+
+func TestHeatEviction(t *testing.T) {
+	h := NewHeat(time.Hour, 10)
+	now := time.Unix(1000, 0)
+
+	hot := testCid(t, "hot")
+	h.Add(hot, 100, now)
+	for i := 0; i < 50; i++ {
+		c := testCid(t, fmt.Sprint(i))
+		// none are seen just once, they all survive the first pass
+		h.Add(c, 2, now)
+		assert.LessOrEqual(t, len(h.cur), 10)
+	}
+	assert.Equal(t, 101, h.Hit(hot, now))
+}
+
+func TestRedirectURL(t *testing.T) {
+	assert.Equal(t, "https://cdn.example/ipfs/x/a.txt", RedirectURL("https://cdn.example/", "/ipfs/x/a.txt", nil))
+	assert.Equal(t, "https://cdn.example/ipfs/x?format=car", RedirectURL("https://cdn.example", "/ipfs/x", url.Values{"format": {"car"}}))
+
+	// credentials stay with estuary
+	q := url.Values{
+		"format":        {"car"},
+		"access-token":  {"secret"},
+		"password":      {"hunter2"},
+		"paych-voucher": {"voucher"},
+	}
+	assert.Equal(t, "https://cdn.example/ipfs/x?format=car", RedirectURL("https://cdn.example", "/ipfs/x", q))
+}
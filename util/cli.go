@@ -10,3 +10,12 @@ var FlagLogLevel = &cli.StringFlag{
 	Value:       "INFO",
 	Destination: &LogLevel,
 }
+
+var LogFormat string
+
+var FlagLogFormat = &cli.StringFlag{
+	Name:        "log-format",
+	Usage:       "sets the log output format: color, nocolor or json",
+	Value:       "color",
+	Destination: &LogFormat,
+}
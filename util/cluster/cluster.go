@@ -0,0 +1,218 @@
+// Package cluster is a client for the REST API of ipfs-cluster, so that an
+// existing cluster can be used as a place to pin content.
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+// ErrNotFound is returned for cids the cluster doesn't track
+var ErrNotFound = xerrors.New("cid not tracked by the cluster")
+
+// peer statuses reported by the cluster
+const (
+	StatusPinned       = "pinned"
+	StatusPinning      = "pinning"
+	StatusPinQueued    = "pin_queued"
+	StatusPinError     = "pin_error"
+	StatusClusterError = "cluster_error"
+	StatusUnpinned     = "unpinned"
+	StatusRemote       = "remote"
+)
+
+// PinInfo is the status of a cid on one cluster peer
+type PinInfo struct {
+	PeerName string `json:"peername"`
+	Status   string `json:"status"`
+	Error    string `json:"error"`
+}
+
+// GlobalPinInfo is the status of a cid on every cluster peer, by peer id
+type GlobalPinInfo struct {
+	Cid     json.RawMessage    `json:"cid"`
+	Name    string             `json:"name"`
+	PeerMap map[string]PinInfo `json:"peer_map"`
+}
+
+// PinOptions are the options a pin is submitted with, zero replication
+// factors leave them to the cluster
+type PinOptions struct {
+	Name           string
+	ReplicationMin int
+	ReplicationMax int
+	Origins        []string
+}
+
+// Client talks to the cluster REST API at endpoint
+type Client struct {
+	endpoint string
+	username string
+	password string
+	token    string
+	client   *http.Client
+}
+
+// New returns a client that authenticates with basic auth if username is
+// set, with token as bearer token otherwise
+func New(endpoint, username, password, token string, timeout time.Duration) *Client {
+	return &Client{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		username: username,
+		password: password,
+		token:    token,
+		client:   &http.Client{Timeout: timeout},
+	}
+}
+
+// Pin submits obj to the cluster, pinning a cid that is already pinned updates
+// its options
+func (c *Client) Pin(ctx context.Context, obj cid.Cid, opts PinOptions) error {
+	q := url.Values{}
+	if opts.Name != "" {
+		q.Set("name", opts.Name)
+	}
+	if opts.ReplicationMin != 0 {
+		q.Set("replication-min", strconv.Itoa(opts.ReplicationMin))
+	}
+	if opts.ReplicationMax != 0 {
+		q.Set("replication-max", strconv.Itoa(opts.ReplicationMax))
+	}
+	if len(opts.Origins) > 0 {
+		q.Set("origins", strings.Join(opts.Origins, ","))
+	}
+
+	path := "/pins/" + obj.String()
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	return c.do(ctx, http.MethodPost, path, nil)
+}
+
+// Status returns the status of obj on every cluster peer
+func (c *Client) Status(ctx context.Context, obj cid.Cid) (*GlobalPinInfo, error) {
+	var gpi GlobalPinInfo
+	if err := c.do(ctx, http.MethodGet, "/pins/"+obj.String(), &gpi); err != nil {
+		return nil, err
+	}
+	return &gpi, nil
+}
+
+// Unpin removes obj from the cluster, a cid the cluster doesn't track is
+// already gone
+func (c *Client) Unpin(ctx context.Context, obj cid.Cid) error {
+	err := c.do(ctx, http.MethodDelete, "/pins/"+obj.String(), nil)
+	if xerrors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// failure is the error body of the api
+type failure struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (c *Client) do(ctx context.Context, method, path string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	switch {
+	case c.username != "":
+		req.SetBasicAuth(c.username, c.password)
+	case c.token != "":
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		var f failure
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&f); err == nil && f.Message != "" {
+			return fmt.Errorf("cluster returned %d: %s", resp.StatusCode, f.Message)
+		}
+		return fmt.Errorf("cluster returned %d", resp.StatusCode)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// PinningStatus maps the status of a cid on the cluster peers to a pinning
+// service status. It counts as pinned once min peers have pinned it, or one
+// peer if min is not positive, and as failed once too few peers are left
+// that could still pin it or no peer is allocated to it at all. It also
+// returns the number of peers that pinned it.
+func (gpi *GlobalPinInfo) PinningStatus(min int) (types.PinningStatus, int) {
+	if min <= 0 {
+		min = 1
+	}
+
+	var pinned, pinning, queued, failed, remote int
+	for _, pi := range gpi.PeerMap {
+		switch pi.Status {
+		case StatusPinned:
+			pinned++
+		case StatusPinning:
+			pinning++
+		case StatusPinQueued:
+			queued++
+		case StatusPinError, StatusClusterError:
+			failed++
+		case StatusRemote:
+			remote++
+		}
+	}
+
+	switch {
+	case pinned >= min:
+		return types.PinningStatusPinned, pinned
+	case failed > 0 && pinned+pinning+queued < min:
+		return types.PinningStatusFailed, pinned
+	case pinned+pinning+queued+remote == 0:
+		return types.PinningStatusFailed, pinned
+	case pinning > 0 || pinned > 0:
+		return types.PinningStatusPinning, pinned
+	default:
+		return types.PinningStatusQueued, pinned
+	}
+}
+
+// Errors returns the errors peers reported for the cid, by peer name
+func (gpi *GlobalPinInfo) Errors() map[string]string {
+	out := make(map[string]string)
+	for id, pi := range gpi.PeerMap {
+		if pi.Error == "" {
+			continue
+		}
+		name := pi.PeerName
+		if name == "" {
+			name = id
+		}
+		out[name] = pi.Error
+	}
+	return out
+}
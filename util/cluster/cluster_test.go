@@ -0,0 +1,103 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	obj, err := cid.Decode("bafkqaaa")
+	require.NoError(t, err)
+
+	pins := map[string]*GlobalPinInfo{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "estuary" || p != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"code":401,"message":"Unauthorized"}`)) //nolint:errcheck
+			return
+		}
+
+		c := strings.TrimPrefix(r.URL.Path, "/pins/")
+		switch {
+		case r.Method == http.MethodPost:
+			assert.Equal(t, "2", r.URL.Query().Get("replication-min"))
+			assert.Equal(t, "docs", r.URL.Query().Get("name"))
+			pins[c] = &GlobalPinInfo{Name: "docs", PeerMap: map[string]PinInfo{
+				"p1": {PeerName: "one", Status: StatusPinQueued},
+				"p2": {PeerName: "two", Status: StatusPinQueued},
+				"p3": {PeerName: "three", Status: StatusRemote},
+			}}
+			w.Write([]byte(`{}`)) //nolint:errcheck
+		case r.Method == http.MethodGet && pins[c] != nil:
+			json.NewEncoder(w).Encode(pins[c]) //nolint:errcheck
+		case r.Method == http.MethodDelete && pins[c] != nil:
+			delete(pins, c)
+			w.Write([]byte(`{}`)) //nolint:errcheck
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code":404,"message":"not found"}`)) //nolint:errcheck
+		}
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL, "estuary", "secret", "", time.Second*5)
+	require.NoError(t, c.Pin(ctx, obj, PinOptions{Name: "docs", ReplicationMin: 2}))
+
+	gpi, err := c.Status(ctx, obj)
+	require.NoError(t, err)
+	st, n := gpi.PinningStatus(2)
+	assert.Equal(t, types.PinningStatusQueued, st)
+	assert.Equal(t, 0, n)
+
+	assert.NoError(t, c.Unpin(ctx, obj))
+	assert.NoError(t, c.Unpin(ctx, obj), "unpinning what is gone is fine")
+	_, err = c.Status(ctx, obj)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	err = New(srv.URL, "estuary", "wrong", "", time.Second*5).Pin(ctx, obj, PinOptions{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Unauthorized")
+	}
+}
+
+func TestPinningStatus(t *testing.T) {
+	peers := func(statuses ...string) *GlobalPinInfo {
+		gpi := &GlobalPinInfo{PeerMap: map[string]PinInfo{}}
+		for i, s := range statuses {
+			gpi.PeerMap[string(rune('a'+i))] = PinInfo{Status: s}
+		}
+		return gpi
+	}
+
+	for _, tc := range []struct {
+		name   string
+		gpi    *GlobalPinInfo
+		min    int
+		status types.PinningStatus
+		pinned int
+	}{
+		{"queued", peers(StatusPinQueued, StatusRemote), 0, types.PinningStatusQueued, 0},
+		{"pinning", peers(StatusPinning, StatusPinQueued), 0, types.PinningStatusPinning, 0},
+		{"pinned by one", peers(StatusPinned, StatusPinning), 0, types.PinningStatusPinned, 1},
+		{"short of min", peers(StatusPinned, StatusPinning), 2, types.PinningStatusPinning, 1},
+		{"min reached", peers(StatusPinned, StatusPinned, StatusRemote), 2, types.PinningStatusPinned, 2},
+		{"error with others left", peers(StatusPinError, StatusPinning), 0, types.PinningStatusPinning, 0},
+		{"too many errors", peers(StatusPinError, StatusPinned), 2, types.PinningStatusFailed, 1},
+		{"not allocated", peers(StatusUnpinned, StatusUnpinned), 0, types.PinningStatusFailed, 0},
+	} {
+		st, n := tc.gpi.PinningStatus(tc.min)
+		assert.Equal(t, tc.status, st, tc.name)
+		assert.Equal(t, tc.pinned, n, tc.name)
+	}
+}
@@ -8,10 +8,7 @@ import (
 	"time"
 
 	"github.com/ipfs/go-cid"
-	format "github.com/ipfs/go-ipld-format"
 	ipld "github.com/ipfs/go-ipld-format"
-	"github.com/ipfs/go-merkledag"
-	unixfs "github.com/ipfs/go-unixfs"
 	"gorm.io/gorm"
 )
 
@@ -53,6 +50,17 @@ type ContentCreateBody struct {
 	Name     string      `json:"name"`
 	Location string      `json:"location"`
 	Type     ContentType `json:"type"`
+	Chunker  string      `json:"chunker"`
+
+	// Encryption is set for content encrypted at upload
+	Encryption *ContentEncryption `json:"encryption,omitempty"`
+}
+
+// ContentEncryption is the key content was encrypted with, wrapped with the
+// key of the user, and the size of its plaintext
+type ContentEncryption struct {
+	WrappedKey []byte `json:"wrappedKey"`
+	Size       int64  `json:"size"`
 }
 
 type ContentCreateResponse struct {
@@ -68,11 +76,14 @@ type Content struct {
 	Cid         DbCID       `json:"cid"`
 	Name        string      `json:"name"`
 	UserID      uint        `json:"userId" gorm:"index"`
+	Namespace   string      `json:"namespace,omitempty" gorm:"index"`
 	Description string      `json:"description"`
 	Size        int64       `json:"size"`
 	Type        ContentType `json:"type"`
 	Active      bool        `json:"active"`
 	Offloaded   bool        `json:"offloaded"`
+	Private     bool        `json:"private"`
+	Quarantined bool        `json:"quarantined"`
 	Replication int         `json:"replication"`
 
 	// TODO: shift most of the 'state' booleans in here into a single state
@@ -86,6 +97,8 @@ type Content struct {
 	Origins string `json:"origins"`
 
 	Failed bool `json:"failed"`
+	// PinFinishedAt is when the content last finished pinning, or failed to
+	PinFinishedAt time.Time `json:"-" gorm:"index"`
 
 	Location string `json:"location"`
 	// TODO: shift location tracking to just use the ID of the shuttle
@@ -100,6 +113,10 @@ type Content struct {
 	// them (unlike with aggregates)
 	DagSplit  bool `json:"dagSplit"`
 	SplitFrom uint `json:"splitFrom"`
+
+	// Chunker is how an upload was split into blocks, see
+	// ChunkerFromParams. It is empty for content that was not chunked here.
+	Chunker string `json:"chunker,omitempty"`
 }
 
 type ContentWithPath struct {
@@ -170,26 +187,6 @@ func DirsFromPath(collectionPath string, filename string) ([]string, error) {
 	return dirs, nil
 }
 
-func EnsurePathIsLinked(dirs []string, rootNode *merkledag.ProtoNode, ds format.DAGService) (*merkledag.ProtoNode, error) {
-	lookupNode := rootNode
-	for _, dir := range dirs {
-		// see if dir already created on DAG
-		_, err := lookupNode.GetNodeLink(dir)
-		if err == merkledag.ErrLinkNotFound { // if not create and link it
-			dirNode := unixfs.EmptyDirNode()
-			if err = lookupNode.AddNodeLink(dir, dirNode); err != nil {
-				return nil, err
-			}
-		}
-		ctx := context.Background()
-		lookupNode, err = lookupNode.GetLinkedProtoNode(ctx, ds, dir)
-		if err != nil {
-			return nil, err
-		}
-	}
-	return lookupNode, nil
-}
-
 func CreateRetrievalURL(cid string) string {
 	return fmt.Sprintf("https://dweb.link/ipfs/%s", cid)
 }
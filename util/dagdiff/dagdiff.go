@@ -0,0 +1,325 @@
+// Package dagdiff compares two DAGs, eg. two versions of a dataset. UnixFS
+// directories are compared entry by entry, down to the files that were
+// added, removed or changed, and subtrees with the same cid on both sides
+// are skipped without being read. Only directories and the roots of files
+// are read, the blocks of the files themselves are not, and how many blocks
+// are read at most is bounded.
+package dagdiff
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
+)
+
+const (
+	// DefaultMaxChanges is how many changes are listed when the options
+	// don't say
+	DefaultMaxChanges = 1000
+	// DefaultMaxBlocks is how many blocks are read when the options don't
+	// say
+	DefaultMaxBlocks = 100000
+)
+
+const (
+	Added    = "added"
+	Removed  = "removed"
+	Modified = "modified"
+)
+
+// Change is a file, or a DAG that isn't UnixFS, that differs between the
+// two roots. Path is relative to the roots.
+type Change struct {
+	Path       string `json:"path"`
+	Kind       string `json:"kind"`
+	Before     string `json:"before,omitempty"`
+	After      string `json:"after,omitempty"`
+	BeforeSize uint64 `json:"beforeSize"`
+	AfterSize  uint64 `json:"afterSize"`
+	// Delta is how many bytes the file grew by
+	Delta int64 `json:"delta"`
+}
+
+type Diff struct {
+	Changes []Change `json:"changes"`
+	// Truncated is set when there were more changes than were asked for,
+	// or more blocks to read than allowed. Delta then only counts the
+	// changes listed
+	Truncated bool `json:"truncated"`
+	// Delta is how many bytes the files grew by in all
+	Delta int64 `json:"delta"`
+	// BlocksAdded and BytesAdded are the blocks only the new root has, and
+	// BlocksRemoved and BytesRemoved the ones only the old root has. They
+	// are counted from what is stored of both rather than by Compare, which
+	// leaves them out.
+	BlocksAdded   int   `json:"blocksAdded"`
+	BytesAdded    int64 `json:"bytesAdded"`
+	BlocksRemoved int   `json:"blocksRemoved"`
+	BytesRemoved  int64 `json:"bytesRemoved"`
+}
+
+type Options struct {
+	// MaxChanges is how many changes are listed at most
+	MaxChanges int
+	// MaxBlocks is how many blocks are read at most, of both roots
+	MaxBlocks int
+}
+
+var errTruncated = errors.New("too many changes")
+
+// Compare returns what changed from the DAG under from to the one under to.
+// Every block that is compared must be readable through the node getter.
+func Compare(ctx context.Context, ng ipld.NodeGetter, from, to cid.Cid, opts Options) (*Diff, error) {
+	if opts.MaxChanges <= 0 {
+		opts.MaxChanges = DefaultMaxChanges
+	}
+	if opts.MaxBlocks <= 0 {
+		opts.MaxBlocks = DefaultMaxBlocks
+	}
+	b := &budget{left: opts.MaxBlocks}
+	d := &differ{
+		opts:   opts,
+		before: &side{ng: ng, budget: b},
+		after:  &side{ng: ng, budget: b},
+		diff:   &Diff{Changes: []Change{}},
+	}
+
+	if err := d.compare(ctx, "", from, to); err != nil {
+		// running out of reads may come back wrapped, or not at all, from
+		// listing a sharded directory
+		if !errors.Is(err, errTruncated) && !b.spent() {
+			return nil, err
+		}
+		d.diff.Truncated = true
+	}
+	return d.diff, nil
+}
+
+// budget is how many more blocks may be read, of both roots
+type budget struct {
+	lk   sync.Mutex
+	left int
+}
+
+func (b *budget) take() error {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if b.left <= 0 {
+		return errTruncated
+	}
+	b.left--
+	return nil
+}
+
+func (b *budget) spent() bool {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return b.left <= 0
+}
+
+// side reads the blocks of one of the roots, within the budget
+type side struct {
+	ng     ipld.NodeGetter
+	budget *budget
+}
+
+func (s *side) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	if err := s.budget.take(); err != nil {
+		return nil, err
+	}
+	return s.ng.Get(ctx, c)
+}
+
+func (s *side) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(cids))
+	go func() {
+		defer close(out)
+		for _, c := range cids {
+			nd, err := s.Get(ctx, c)
+			select {
+			case out <- &ipld.NodeOption{Node: nd, Err: err}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// entries lists a directory, sharded or not, by name
+func (s *side) entries(ctx context.Context, nd ipld.Node) (map[string]cid.Cid, error) {
+	dir, err := uio.NewDirectoryFromNode(merkledag.NewReadOnlyDagService(s), nd)
+	if err != nil {
+		return nil, err
+	}
+	links, err := dir.Links(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]cid.Cid, len(links))
+	for _, lnk := range links {
+		out[lnk.Name] = lnk.Cid
+	}
+	return out, nil
+}
+
+type differ struct {
+	opts   Options
+	before *side
+	after  *side
+	diff   *Diff
+}
+
+func (d *differ) add(ch Change) error {
+	if len(d.diff.Changes) >= d.opts.MaxChanges {
+		return errTruncated
+	}
+	d.diff.Changes = append(d.diff.Changes, ch)
+	d.diff.Delta += ch.Delta
+	return nil
+}
+
+func (d *differ) compare(ctx context.Context, p string, from, to cid.Cid) error {
+	if from.Equals(to) {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	a, err := d.before.Get(ctx, from)
+	if err != nil {
+		return err
+	}
+	b, err := d.after.Get(ctx, to)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case isDir(a) && isDir(b):
+		ea, err := d.before.entries(ctx, a)
+		if err != nil {
+			return err
+		}
+		eb, err := d.after.entries(ctx, b)
+		if err != nil {
+			return err
+		}
+		for _, name := range names(ea, eb) {
+			ca, inA := ea[name]
+			cb, inB := eb[name]
+			sub := path.Join(p, name)
+			switch {
+			case !inB:
+				err = d.gone(ctx, d.before, Removed, sub, ca)
+			case !inA:
+				err = d.gone(ctx, d.after, Added, sub, cb)
+			default:
+				err = d.compare(ctx, sub, ca, cb)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case isDir(a) || isDir(b):
+		// a file became a directory or the other way round
+		if err := d.gone(ctx, d.before, Removed, p, from); err != nil {
+			return err
+		}
+		return d.gone(ctx, d.after, Added, p, to)
+	}
+
+	sa, sb := fileSize(a), fileSize(b)
+	return d.add(Change{
+		Path:       p,
+		Kind:       Modified,
+		Before:     from.String(),
+		After:      to.String(),
+		BeforeSize: sa,
+		AfterSize:  sb,
+		Delta:      int64(sb) - int64(sa),
+	})
+}
+
+// gone lists every file under c as added or removed
+func (d *differ) gone(ctx context.Context, s *side, kind string, p string, c cid.Cid) error {
+	nd, err := s.Get(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	if isDir(nd) {
+		entries, err := s.entries(ctx, nd)
+		if err != nil {
+			return err
+		}
+		for _, name := range names(entries) {
+			if err := d.gone(ctx, s, kind, path.Join(p, name), entries[name]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	size := fileSize(nd)
+	ch := Change{Path: p, Kind: kind}
+	if kind == Added {
+		ch.After, ch.AfterSize, ch.Delta = c.String(), size, int64(size)
+	} else {
+		ch.Before, ch.BeforeSize, ch.Delta = c.String(), size, -int64(size)
+	}
+	return d.add(ch)
+}
+
+func names(ms ...map[string]cid.Cid) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, m := range ms {
+		for n := range m {
+			if !seen[n] {
+				seen[n] = true
+				out = append(out, n)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func isDir(nd ipld.Node) bool {
+	pn, ok := nd.(*merkledag.ProtoNode)
+	if !ok {
+		return false
+	}
+	fsn, err := unixfs.FSNodeFromBytes(pn.Data())
+	if err != nil {
+		return false
+	}
+	return fsn.IsDir()
+}
+
+// fileSize is the size of a UnixFS file, of a raw block its size, and 0
+// for anything else
+func fileSize(nd ipld.Node) uint64 {
+	switch nd := nd.(type) {
+	case *merkledag.RawNode:
+		return uint64(len(nd.RawData()))
+	case *merkledag.ProtoNode:
+		fsn, err := unixfs.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return 0
+		}
+		return fsn.FileSize()
+	}
+	return 0
+}
@@ -0,0 +1,88 @@
+package dagdiff
+
+import (
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/util/dirtree"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type file struct {
+	dirs []string
+	name string
+	data string
+}
+
+func build(t *testing.T, bs blockstore.Blockstore, fanout int, files []file) cid.Cid {
+	ctx := context.Background()
+	tree := dirtree.New(fanout)
+	for _, f := range files {
+		leaf := merkledag.NewRawNode([]byte(f.data))
+		require.NoError(t, bs.Put(ctx, leaf))
+		require.NoError(t, tree.Add(f.dirs, f.name, leaf.Cid(), uint64(len(f.data))))
+	}
+	root, err := tree.Build(ctx, bs)
+	require.NoError(t, err)
+	return root
+}
+
+func TestCompare(t *testing.T) {
+	for _, fanout := range []int{100, 2} {
+		bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+		dserv := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+
+		v1 := build(t, bs, fanout, []file{
+			{[]string{"a"}, "x", "first x"},
+			{[]string{"a"}, "y", "same y"},
+			{nil, "b", "bbbb"},
+			{nil, "c", "same c"},
+		})
+		v2 := build(t, bs, fanout, []file{
+			{[]string{"a"}, "x", "second version of x"},
+			{[]string{"a"}, "y", "same y"},
+			{nil, "c", "same c"},
+			{nil, "d", "dd"},
+			{[]string{"e"}, "1", "e1"},
+			{[]string{"e"}, "2", "e22"},
+		})
+
+		diff, err := Compare(context.Background(), dserv, v1, v2, Options{})
+		require.NoError(t, err)
+		require.Len(t, diff.Changes, 5, "fanout %d", fanout)
+
+		var paths, kinds []string
+		for _, ch := range diff.Changes {
+			paths = append(paths, ch.Path)
+			kinds = append(kinds, ch.Kind)
+		}
+		assert.Equal(t, []string{"a/x", "b", "d", "e/1", "e/2"}, paths)
+		assert.Equal(t, []string{Modified, Removed, Added, Added, Added}, kinds)
+		assert.Equal(t, int64(12), diff.Changes[0].Delta)
+		assert.Equal(t, int64(-4), diff.Changes[1].Delta)
+		assert.Equal(t, int64(12-4+2+2+3), diff.Delta)
+		assert.False(t, diff.Truncated)
+
+		none, err := Compare(context.Background(), dserv, v1, v1, Options{})
+		require.NoError(t, err)
+		assert.Empty(t, none.Changes)
+
+		cut, err := Compare(context.Background(), dserv, v1, v2, Options{MaxChanges: 2})
+		require.NoError(t, err)
+		assert.Len(t, cut.Changes, 2)
+		assert.True(t, cut.Truncated)
+
+		short, err := Compare(context.Background(), dserv, v1, v2, Options{MaxBlocks: 3})
+		require.NoError(t, err)
+		assert.True(t, short.Truncated, "fanout %d", fanout)
+		assert.Less(t, len(short.Changes), 5)
+	}
+}
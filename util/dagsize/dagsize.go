@@ -0,0 +1,243 @@
+// Package dagsize estimates how large a DAG is without walking it. The
+// estimate is taken from whatever is cheapest to hand: the size a node
+// measured when it last pinned the DAG, a size reported by a provider or a
+// shuttle, or the root block alone, whose links carry the cumulative sizes
+// of the subtrees below them in dag-pb and whose UnixFS data carries the
+// file size. Estimates are cached, so quota checks, shuttle selection and
+// progress reporting can all ask without fetching anything twice.
+package dagsize
+
+import (
+	"context"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/multiformats/go-multihash"
+)
+
+// Source is where an estimate came from
+type Source string
+
+const (
+	// SourceRoot is the size of the root block alone, for codecs that don't
+	// record the size of what they link to, it is only a lower bound
+	SourceRoot Source = "root"
+	// SourceProvider is a size reported by someone else, a shuttle or a
+	// provider, that we have no way to check
+	SourceProvider Source = "provider"
+	// SourceLinks is the root block plus the sizes recorded in its dag-pb
+	// links
+	SourceLinks Source = "links"
+	// SourceMeasured is the size counted when the DAG was last pinned
+	SourceMeasured Source = "measured"
+)
+
+// rank orders the sources by how far they can be trusted, a hint never
+// replaces an estimate from a better source
+func (s Source) rank() int {
+	switch s {
+	case SourceRoot:
+		return 1
+	case SourceProvider:
+		return 2
+	case SourceLinks:
+		return 3
+	case SourceMeasured:
+		return 4
+	default:
+		return 0
+	}
+}
+
+type Estimate struct {
+	// Size is the total size of the blocks of the DAG in bytes
+	Size   int64  `json:"size"`
+	Source Source `json:"source"`
+	// Exact is set when Size is known to be the real size, eg. for a DAG of
+	// a single raw block
+	Exact bool `json:"exact"`
+}
+
+// GetFunc returns a block, the local one must not go to the network
+type GetFunc func(ctx context.Context, c cid.Cid) (blocks.Block, error)
+
+// NodeGetter reads blocks through a node getter, eg. a dag service
+func NodeGetter(ng ipld.NodeGetter) GetFunc {
+	return func(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+		return ng.Get(ctx, c)
+	}
+}
+
+// LookupFunc returns a size recorded elsewhere for the DAG, eg. by another
+// pin of the same content, found is false if there is none
+type LookupFunc func(ctx context.Context, c cid.Cid) (size int64, found bool, err error)
+
+type Options struct {
+	// CacheSize is how many estimates are kept
+	CacheSize int
+	// Local reads blocks that are already on the node
+	Local GetFunc
+	// Lookup, if set, is asked before any block is read
+	Lookup LookupFunc
+}
+
+type Estimator struct {
+	opts  Options
+	cache *lru.Cache
+
+	// lk makes a hint and the estimate it replaces one step
+	lk sync.Mutex
+}
+
+func New(opts Options) (*Estimator, error) {
+	if opts.CacheSize <= 0 {
+		opts.CacheSize = 1
+	}
+	cache, err := lru.New(opts.CacheSize)
+	if err != nil {
+		return nil, err
+	}
+	return &Estimator{opts: opts, cache: cache}, nil
+}
+
+func (e *Estimator) cached(c cid.Cid) (Estimate, bool) {
+	v, ok := e.cache.Get(c)
+	if !ok {
+		return Estimate{}, false
+	}
+	return v.(Estimate), true
+}
+
+// Hint records a size for the DAG, unless there is already an estimate
+// from a more trusted source
+func (e *Estimator) Hint(c cid.Cid, size int64, src Source) {
+	if size <= 0 {
+		return
+	}
+
+	e.lk.Lock()
+	defer e.lk.Unlock()
+
+	if cur, ok := e.cached(c); ok && (cur.Exact || cur.Source.rank() > src.rank()) {
+		return
+	}
+	e.cache.Add(c, Estimate{Size: size, Source: src, Exact: src == SourceMeasured})
+}
+
+// Peek estimates the size from what the node already has, it never goes to
+// the network. ok is false when nothing is known about the DAG.
+func (e *Estimator) Peek(ctx context.Context, c cid.Cid) (Estimate, bool, error) {
+	return e.estimate(ctx, c, nil)
+}
+
+// Estimate estimates the size from what the node already has, and failing
+// that fetches the root block with get
+func (e *Estimator) Estimate(ctx context.Context, c cid.Cid, get GetFunc) (Estimate, error) {
+	est, _, err := e.estimate(ctx, c, get)
+	return est, err
+}
+
+func (e *Estimator) estimate(ctx context.Context, c cid.Cid, get GetFunc) (Estimate, bool, error) {
+	if est, ok := e.cached(c); ok {
+		return est, true, nil
+	}
+
+	if c.Prefix().MhType == multihash.IDENTITY {
+		dmh, err := multihash.Decode(c.Hash())
+		if err != nil {
+			return Estimate{}, false, err
+		}
+		est := Estimate{Size: int64(len(dmh.Digest)), Source: SourceLinks, Exact: true}
+		e.remember(c, est)
+		return est, true, nil
+	}
+
+	if e.opts.Lookup != nil {
+		size, found, err := e.opts.Lookup(ctx, c)
+		if err != nil {
+			return Estimate{}, false, err
+		}
+		if found {
+			est := Estimate{Size: size, Source: SourceMeasured, Exact: true}
+			e.remember(c, est)
+			return est, true, nil
+		}
+	}
+
+	var blk blocks.Block
+	if e.opts.Local != nil {
+		if b, err := e.opts.Local(ctx, c); err == nil {
+			blk = b
+		}
+	}
+	if blk == nil {
+		if get == nil {
+			return Estimate{}, false, nil
+		}
+		b, err := get(ctx, c)
+		if err != nil {
+			return Estimate{}, false, err
+		}
+		blk = b
+	}
+
+	est := FromBlock(blk)
+	e.remember(c, est)
+	return est, true, nil
+}
+
+func (e *Estimator) remember(c cid.Cid, est Estimate) {
+	e.lk.Lock()
+	defer e.lk.Unlock()
+
+	if cur, ok := e.cached(c); ok && cur.Source.rank() > est.Source.rank() {
+		return
+	}
+	e.cache.Add(c, est)
+}
+
+// FromBlock estimates the size of the DAG rooted at blk from blk alone
+func FromBlock(blk blocks.Block) Estimate {
+	raw := blk.RawData()
+	size := int64(len(raw))
+
+	switch blk.Cid().Prefix().Codec {
+	case cid.Raw:
+		return Estimate{Size: size, Source: SourceLinks, Exact: true}
+	case cid.DagProtobuf:
+	default:
+		return Estimate{Size: size, Source: SourceRoot}
+	}
+
+	nd, err := merkledag.DecodeProtobuf(raw)
+	if err != nil {
+		return Estimate{Size: size, Source: SourceRoot}
+	}
+
+	// some encoders leave the sizes out of the links, the file size of the
+	// UnixFS data is the next best thing then
+	var missing bool
+	total := size
+	for _, l := range nd.Links() {
+		if l.Size == 0 {
+			missing = true
+		}
+		total += int64(l.Size)
+	}
+	if missing {
+		if fsn, err := unixfs.FSNodeFromBytes(nd.Data()); err == nil && int64(fsn.FileSize()) > total {
+			total = int64(fsn.FileSize())
+		}
+	}
+
+	return Estimate{
+		Size:   total,
+		Source: SourceLinks,
+		Exact:  len(nd.Links()) == 0,
+	}
+}
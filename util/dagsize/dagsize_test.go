@@ -0,0 +1,118 @@
+package dagsize
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromBlock(t *testing.T) {
+	assert := assert.New(t)
+
+	raw := merkledag.NewRawNode([]byte("hello"))
+	assert.Equal(Estimate{Size: 5, Source: SourceLinks, Exact: true}, FromBlock(raw))
+
+	a := merkledag.NewRawNode(make([]byte, 100))
+	b := merkledag.NewRawNode(make([]byte, 200))
+	fsn := unixfs.NewFSNode(unixfs.TFile)
+	fsn.AddBlockSize(100)
+	fsn.AddBlockSize(200)
+	data, err := fsn.GetBytes()
+	require.NoError(t, err)
+
+	root := merkledag.NodeWithData(data)
+	require.NoError(t, root.AddNodeLink("", a))
+	require.NoError(t, root.AddNodeLink("", b))
+
+	est := FromBlock(root)
+	assert.Equal(SourceLinks, est.Source)
+	assert.False(est.Exact)
+	assert.Equal(int64(len(root.RawData())+300), est.Size)
+
+	// without link sizes the file size is used
+	bare := merkledag.NodeWithData(data)
+	bare.SetLinks([]*ipld.Link{{Cid: a.Cid()}, {Cid: b.Cid()}})
+	assert.Equal(int64(300), FromBlock(bare).Size)
+
+	cbor := blocks.NewBlock([]byte{0xa0})
+	cbc, err := cid.Prefix{Version: 1, Codec: cid.DagCBOR, MhType: multihash.SHA2_256, MhLength: -1}.Sum(cbor.RawData())
+	require.NoError(t, err)
+	cb, err := blocks.NewBlockWithCid(cbor.RawData(), cbc)
+	require.NoError(t, err)
+	assert.Equal(Estimate{Size: 1, Source: SourceRoot}, FromBlock(cb))
+}
+
+func TestEstimator(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	local := merkledag.NewRawNode([]byte("local"))
+	remote := merkledag.NewRawNode([]byte("remote block"))
+	known := merkledag.NewRawNode([]byte("known"))
+
+	var fetched int
+	get := func(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+		fetched++
+		if c.Equals(remote.Cid()) {
+			return remote, nil
+		}
+		return nil, errors.New("not found")
+	}
+
+	e, err := New(Options{
+		CacheSize: 10,
+		Local: func(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+			if c.Equals(local.Cid()) {
+				return local, nil
+			}
+			return nil, errors.New("not found")
+		},
+		Lookup: func(ctx context.Context, c cid.Cid) (int64, bool, error) {
+			return 12345, c.Equals(known.Cid()), nil
+		},
+	})
+	require.NoError(t, err)
+
+	est, ok, err := e.Peek(ctx, local.Cid())
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(int64(5), est.Size)
+
+	est, ok, err = e.Peek(ctx, known.Cid())
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(Estimate{Size: 12345, Source: SourceMeasured, Exact: true}, est)
+
+	_, ok, err = e.Peek(ctx, remote.Cid())
+	assert.NoError(err)
+	assert.False(ok)
+
+	est, err = e.Estimate(ctx, remote.Cid(), get)
+	assert.NoError(err)
+	assert.Equal(int64(12), est.Size)
+	_, err = e.Estimate(ctx, remote.Cid(), get)
+	assert.NoError(err)
+	assert.Equal(1, fetched, "the estimate should have been cached")
+
+	// hints only replace estimates they are more trusted than
+	other := merkledag.NewRawNode([]byte("other")).Cid()
+	e.Hint(other, 1000, SourceProvider)
+	e.Hint(other, 10, SourceRoot)
+	est, _, _ = e.Peek(ctx, other)
+	assert.Equal(int64(1000), est.Size)
+	e.Hint(other, 2000, SourceMeasured)
+	est, _, _ = e.Peek(ctx, other)
+	assert.Equal(Estimate{Size: 2000, Source: SourceMeasured, Exact: true}, est)
+	e.Hint(other, 3000, SourceProvider)
+	est, _, _ = e.Peek(ctx, other)
+	assert.Equal(int64(2000), est.Size)
+}
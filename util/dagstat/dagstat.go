@@ -0,0 +1,238 @@
+// Package dagstat describes a DAG: how large it is, how many blocks and how
+// deep it goes, and which of the UnixFS files in it are the largest. The
+// stats of every subtree are kept, so DAGs sharing subtrees with ones seen
+// before only have their new parts walked.
+package dagstat
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+)
+
+// File is a UnixFS file in the DAG, Path is relative to the root
+type File struct {
+	Path string  `json:"path"`
+	Cid  cid.Cid `json:"cid"`
+	Size uint64  `json:"size"`
+}
+
+type Stat struct {
+	// Size is the total size of the blocks
+	Size int64 `json:"size"`
+	// Blocks counts the blocks, a block linked from more than one place is
+	// counted every time
+	Blocks int `json:"blocks"`
+	// MaxDepth is the most links from the root to a block, 0 for a DAG of
+	// a single block
+	MaxDepth int `json:"maxDepth"`
+	// Largest are the largest files, largest first
+	Largest []File `json:"largest"`
+}
+
+const (
+	// DefaultCacheSize is how many subtree stats are kept when the options
+	// don't say
+	DefaultCacheSize = 100000
+	// DefaultLargest is how many of the largest files are listed when the
+	// options don't say
+	DefaultLargest = 20
+
+	// JobTimeout is how long the stat of a DAG is computed for at most
+	JobTimeout = time.Minute * 30
+	// JobWait is how long a request waits for the stat before it is told to
+	// come back
+	JobWait = time.Second * 20
+)
+
+type Options struct {
+	// CacheSize is how many subtree stats are kept
+	CacheSize int
+	// Largest is how many of the largest files are listed
+	Largest int
+}
+
+type Calculator struct {
+	ng    ipld.NodeGetter
+	opts  Options
+	cache *lru.Cache
+
+	lk   sync.Mutex
+	jobs map[cid.Cid]*Job
+}
+
+func New(ng ipld.NodeGetter, opts Options) (*Calculator, error) {
+	if opts.CacheSize <= 0 {
+		opts.CacheSize = DefaultCacheSize
+	}
+	if opts.Largest <= 0 {
+		opts.Largest = DefaultLargest
+	}
+	cache, err := lru.New(opts.CacheSize)
+	if err != nil {
+		return nil, err
+	}
+	return &Calculator{ng: ng, opts: opts, cache: cache, jobs: make(map[cid.Cid]*Job)}, nil
+}
+
+// Job is the stat of a DAG being computed in the background. Stat and Err
+// are set once Done is closed.
+type Job struct {
+	Done chan struct{}
+	Stat *Stat
+	Err  error
+}
+
+// Start computes the stat of root in the background, giving up after
+// timeout, and calls done with it before the job is done. A DAG already
+// being computed isn't computed twice, the job under way is returned and
+// done isn't called for it again.
+func (c *Calculator) Start(root cid.Cid, timeout time.Duration, done func(*Stat, error)) *Job {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if j, ok := c.jobs[root]; ok {
+		return j
+	}
+
+	j := &Job{Done: make(chan struct{})}
+	c.jobs[root] = j
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		j.Stat, j.Err = c.Stat(ctx, root)
+		if done != nil {
+			done(j.Stat, j.Err)
+		}
+
+		c.lk.Lock()
+		delete(c.jobs, root)
+		c.lk.Unlock()
+		close(j.Done)
+	}()
+	return j
+}
+
+// Stat describes the DAG under root. Every block of it must be readable
+// through the node getter.
+func (c *Calculator) Stat(ctx context.Context, root cid.Cid) (*Stat, error) {
+	st, err := c.stat(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+	out := *st
+	out.Largest = append([]File{}, st.Largest...)
+	return &out, nil
+}
+
+func (c *Calculator) stat(ctx context.Context, cc cid.Cid) (*Stat, error) {
+	if v, ok := c.cache.Get(cc); ok {
+		return v.(*Stat), nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	nd, err := c.ng.Get(ctx, cc)
+	if err != nil {
+		return nil, fmt.Errorf("reading block %s: %w", cc, err)
+	}
+
+	st := &Stat{Size: int64(len(nd.RawData())), Blocks: 1}
+	kind, fsn := unixfsKind(nd)
+	if kind == kindFile {
+		// only the file is listed, not the blocks it is made of
+		size := uint64(len(nd.RawData()))
+		if fsn != nil {
+			size = fsn.FileSize()
+		}
+		st.Largest = []File{{Cid: cc, Size: size}}
+	}
+
+	var padLen int
+	if kind == kindShard {
+		padLen = len(fmt.Sprintf("%X", fsn.Fanout()-1))
+	}
+
+	for _, lnk := range nd.Links() {
+		sub, err := c.stat(ctx, lnk.Cid)
+		if err != nil {
+			return nil, err
+		}
+		st.Size += sub.Size
+		st.Blocks += sub.Blocks
+		if sub.MaxDepth+1 > st.MaxDepth {
+			st.MaxDepth = sub.MaxDepth + 1
+		}
+		if kind == kindFile {
+			continue
+		}
+
+		name := lnk.Name
+		switch kind {
+		case kindShard:
+			// entries are prefixed with their bucket, links to the shards
+			// below are only the bucket
+			if len(name) >= padLen {
+				name = name[padLen:]
+			}
+		case kindDir:
+		default:
+			// the links of other nodes aren't file names, but files can
+			// still be found below them
+			name = ""
+		}
+		for _, f := range sub.Largest {
+			f.Path = path.Join(name, f.Path)
+			st.Largest = append(st.Largest, f)
+		}
+	}
+
+	sort.SliceStable(st.Largest, func(i, j int) bool {
+		return st.Largest[i].Size > st.Largest[j].Size
+	})
+	if len(st.Largest) > c.opts.Largest {
+		st.Largest = st.Largest[:c.opts.Largest]
+	}
+
+	c.cache.Add(cc, st)
+	return st, nil
+}
+
+type kind int
+
+const (
+	kindOther kind = iota
+	kindFile
+	kindDir
+	kindShard
+)
+
+func unixfsKind(nd ipld.Node) (kind, *unixfs.FSNode) {
+	switch nd := nd.(type) {
+	case *merkledag.RawNode:
+		return kindFile, nil
+	case *merkledag.ProtoNode:
+		fsn, err := unixfs.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return kindOther, nil
+		}
+		switch fsn.Type() {
+		case unixfs.TFile, unixfs.TRaw:
+			return kindFile, fsn
+		case unixfs.TDirectory:
+			return kindDir, fsn
+		case unixfs.THAMTShard:
+			return kindShard, fsn
+		}
+	}
+	return kindOther, nil
+}
@@ -0,0 +1,147 @@
+package dagstat
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/util/dirtree"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStat(t *testing.T) {
+	ctx := context.Background()
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+
+	// a file of three blocks
+	fsn := unixfs.NewFSNode(unixfs.TFile)
+	file := new(merkledag.ProtoNode)
+	var size int64
+	for i := 0; i < 3; i++ {
+		leaf := merkledag.NewRawNode(bytes.Repeat([]byte{byte(i)}, 1000))
+		require.NoError(t, dserv.Add(ctx, leaf))
+		require.NoError(t, file.AddNodeLink("", leaf))
+		fsn.AddBlockSize(1000)
+		size += 1000
+	}
+	data, err := fsn.GetBytes()
+	require.NoError(t, err)
+	file.SetData(data)
+	require.NoError(t, dserv.Add(ctx, file))
+	size += int64(len(file.RawData()))
+
+	tree := dirtree.New(100)
+	require.NoError(t, tree.Add([]string{"d"}, "big", file.Cid(), fsn.FileSize()))
+	for i := 0; i < 5; i++ {
+		leaf := merkledag.NewRawNode(bytes.Repeat([]byte("x"), 10*(i+1)))
+		require.NoError(t, dserv.Add(ctx, leaf))
+		require.NoError(t, tree.Add(nil, fmt.Sprintf("f%d", i), leaf.Cid(), uint64(len(leaf.RawData()))))
+		size += int64(len(leaf.RawData()))
+	}
+	root, err := tree.Build(ctx, bs)
+	require.NoError(t, err)
+
+	c, err := New(dserv, Options{CacheSize: 100, Largest: 3})
+	require.NoError(t, err)
+	st, err := c.Stat(ctx, root)
+	require.NoError(t, err)
+
+	// the root, d, the file and its three blocks, and five small files
+	assert.Equal(t, 11, st.Blocks)
+	assert.Equal(t, 3, st.MaxDepth)
+	rootNd, err := dserv.Get(ctx, root)
+	require.NoError(t, err)
+	d, err := dserv.Get(ctx, rootNd.Links()[0].Cid)
+	require.NoError(t, err)
+	assert.Equal(t, size+int64(len(rootNd.RawData()))+int64(len(d.RawData())), st.Size)
+
+	require.Len(t, st.Largest, 3)
+	assert.Equal(t, "d/big", st.Largest[0].Path)
+	assert.Equal(t, uint64(3000), st.Largest[0].Size)
+	assert.Equal(t, "f4", st.Largest[1].Path)
+	assert.Equal(t, "f3", st.Largest[2].Path)
+
+	// stats of subtrees are kept
+	sub, err := c.Stat(ctx, d.Cid())
+	require.NoError(t, err)
+	assert.Equal(t, "big", sub.Largest[0].Path)
+}
+
+func TestStatSharded(t *testing.T) {
+	ctx := context.Background()
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+
+	tree := dirtree.New(2)
+	for i := 0; i < 5; i++ {
+		leaf := merkledag.NewRawNode(bytes.Repeat([]byte("x"), 10*(i+1)))
+		require.NoError(t, dserv.Add(ctx, leaf))
+		require.NoError(t, tree.Add(nil, fmt.Sprintf("f%d", i), leaf.Cid(), uint64(len(leaf.RawData()))))
+	}
+	root, err := tree.Build(ctx, bs)
+	require.NoError(t, err)
+
+	c, err := New(dserv, Options{CacheSize: 100})
+	require.NoError(t, err)
+	st, err := c.Stat(ctx, root)
+	require.NoError(t, err)
+	require.Len(t, st.Largest, 5)
+	for i, f := range st.Largest {
+		assert.Equal(t, fmt.Sprintf("f%d", 4-i), f.Path)
+	}
+}
+
+func TestStatMissingBlock(t *testing.T) {
+	ctx := context.Background()
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+
+	root := unixfs.EmptyDirNode()
+	require.NoError(t, root.AddNodeLink("gone", merkledag.NewRawNode([]byte("gone"))))
+	require.NoError(t, dserv.Add(ctx, root))
+
+	c, err := New(dserv, Options{})
+	require.NoError(t, err)
+	_, err = c.Stat(ctx, root.Cid())
+	assert.Error(t, err)
+}
+
+func TestStart(t *testing.T) {
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+
+	root := unixfs.EmptyDirNode()
+	require.NoError(t, root.AddNodeLink("a", merkledag.NewRawNode([]byte("aaaa"))))
+	require.NoError(t, dserv.Add(context.Background(), merkledag.NewRawNode([]byte("aaaa"))))
+	require.NoError(t, dserv.Add(context.Background(), root))
+
+	c, err := New(dserv, Options{})
+	require.NoError(t, err)
+
+	var calls int
+	j := c.Start(root.Cid(), time.Minute, func(st *Stat, err error) {
+		calls++
+	})
+	<-j.Done
+	require.NoError(t, j.Err)
+	assert.Equal(t, 2, j.Stat.Blocks)
+	assert.Equal(t, 1, calls)
+
+	missing := unixfs.EmptyDirNode()
+	require.NoError(t, missing.AddNodeLink("gone", merkledag.NewRawNode([]byte("gone"))))
+	require.NoError(t, dserv.Add(context.Background(), missing))
+	j = c.Start(missing.Cid(), time.Minute, nil)
+	<-j.Done
+	assert.Error(t, j.Err)
+}
@@ -0,0 +1,198 @@
+// Package dagwalk fetches and walks a DAG in parallel like merkledag.Walk
+// does, but with the fan-out of the walk set per call instead of left to the
+// library default. The worker count can grow as the DAG turns out to be
+// large, so one setting serves both small files and huge datasets, and the
+// children of a node can be requested in batches so their wants go out to
+// the network together.
+package dagwalk
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+const (
+	DefaultWorkers       = 32
+	DefaultWantBatchSize = 1
+	DefaultScaleEvery    = 10000
+)
+
+type Options struct {
+	// Workers is how many fetches a walk starts out with
+	Workers int
+	// MaxWorkers, if above Workers, lets the walk double its workers every
+	// ScaleEvery nodes until it reaches MaxWorkers
+	MaxWorkers int
+	ScaleEvery int
+	// WantBatchSize is how many queued nodes a worker requests in a single
+	// GetMany call, 1 fetches them one at a time
+	WantBatchSize int
+}
+
+func (o Options) withDefaults() Options {
+	if o.Workers <= 0 {
+		o.Workers = DefaultWorkers
+	}
+	if o.MaxWorkers < o.Workers {
+		o.MaxWorkers = o.Workers
+	}
+	if o.ScaleEvery <= 0 {
+		o.ScaleEvery = DefaultScaleEvery
+	}
+	if o.WantBatchSize <= 0 {
+		o.WantBatchSize = DefaultWantBatchSize
+	}
+	return o
+}
+
+// VisitFunc is called for every cid found in the DAG and returns whether it
+// should be fetched, like cid.Set.Visit. It is never called concurrently.
+type VisitFunc func(c cid.Cid) bool
+
+// NodeFunc is called with every node fetched and returns the links of it to
+// follow. It is called from several workers at once.
+type NodeFunc func(ctx context.Context, nd ipld.Node) ([]*ipld.Link, error)
+
+type walker struct {
+	ng      ipld.NodeGetter
+	visit   VisitFunc
+	handle  NodeFunc
+	opts    Options
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	lk      sync.Mutex
+	cond    *sync.Cond
+	queue   []cid.Cid
+	busy    int
+	workers int
+	fetched int
+	err     error
+}
+
+// Walk fetches root and everything below it through ng
+func Walk(ctx context.Context, ng ipld.NodeGetter, root cid.Cid, visit VisitFunc, handle NodeFunc, opts Options) error {
+	if !visit(root) {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := &walker{
+		ng:     ng,
+		visit:  visit,
+		handle: handle,
+		opts:   opts.withDefaults(),
+		cancel: cancel,
+		queue:  []cid.Cid{root},
+	}
+	w.cond = sync.NewCond(&w.lk)
+
+	w.lk.Lock()
+	w.grow(ctx, w.opts.Workers)
+	w.lk.Unlock()
+
+	w.wg.Wait()
+	return w.err
+}
+
+// grow starts workers until there are n, w.lk must be held
+func (w *walker) grow(ctx context.Context, n int) {
+	for ; w.workers < n; w.workers++ {
+		w.wg.Add(1)
+		go w.work(ctx)
+	}
+}
+
+func (w *walker) work(ctx context.Context) {
+	defer w.wg.Done()
+
+	for {
+		w.lk.Lock()
+		for len(w.queue) == 0 && w.busy > 0 && w.err == nil {
+			w.cond.Wait()
+		}
+		if w.err != nil || len(w.queue) == 0 {
+			w.lk.Unlock()
+			return
+		}
+
+		// take from the end of the queue so the walk goes depth first and
+		// the queue doesn't grow with the width of the DAG
+		n := w.opts.WantBatchSize
+		if n > len(w.queue) {
+			n = len(w.queue)
+		}
+		batch := make([]cid.Cid, n)
+		copy(batch, w.queue[len(w.queue)-n:])
+		w.queue = w.queue[:len(w.queue)-n]
+		w.busy++
+		w.lk.Unlock()
+
+		links, err := w.fetch(ctx, batch)
+
+		w.lk.Lock()
+		w.busy--
+		if err != nil {
+			if w.err == nil {
+				w.err = err
+				w.cancel()
+			}
+		} else {
+			for _, l := range links {
+				if w.visit(l.Cid) {
+					w.queue = append(w.queue, l.Cid)
+				}
+			}
+
+			prev := w.fetched
+			w.fetched += len(batch)
+			if w.workers < w.opts.MaxWorkers && w.fetched/w.opts.ScaleEvery > prev/w.opts.ScaleEvery {
+				next := w.workers * 2
+				if next > w.opts.MaxWorkers {
+					next = w.opts.MaxWorkers
+				}
+				w.grow(ctx, next)
+			}
+		}
+		w.cond.Broadcast()
+		w.lk.Unlock()
+	}
+}
+
+func (w *walker) fetch(ctx context.Context, batch []cid.Cid) ([]*ipld.Link, error) {
+	if len(batch) == 1 {
+		nd, err := w.ng.Get(ctx, batch[0])
+		if err != nil {
+			return nil, err
+		}
+		return w.handle(ctx, nd)
+	}
+
+	var links []*ipld.Link
+	var got int
+	for no := range w.ng.GetMany(ctx, batch) {
+		if no.Err != nil {
+			return nil, no.Err
+		}
+		got++
+
+		lnks, err := w.handle(ctx, no.Node)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, lnks...)
+	}
+
+	if got != len(batch) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("only got %d of %d requested nodes", got, len(batch))
+	}
+	return links, nil
+}
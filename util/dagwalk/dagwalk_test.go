@@ -0,0 +1,119 @@
+package dagwalk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	mdtest "github.com/ipfs/go-merkledag/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// buildDag adds a tree of the given depth and fanout and returns its root
+// and the number of nodes in it
+func buildDag(t *testing.T, ds ipld.DAGService, depth, fanout int) (cid.Cid, int) {
+	var build func(d int, name string) (ipld.Node, int)
+	build = func(d int, name string) (ipld.Node, int) {
+		if d == 0 {
+			nd := merkledag.NewRawNode([]byte(name))
+			assert.NoError(t, ds.Add(context.Background(), nd))
+			return nd, 1
+		}
+
+		pn := merkledag.NodeWithData([]byte(name))
+		total := 1
+		for i := 0; i < fanout; i++ {
+			child, n := build(d-1, fmt.Sprintf("%s/%d", name, i))
+			assert.NoError(t, pn.AddNodeLink(fmt.Sprint(i), child))
+			total += n
+		}
+		assert.NoError(t, ds.Add(context.Background(), pn))
+		return pn, total
+	}
+
+	root, n := build(depth, "root")
+	return root.Cid(), n
+}
+
+// countingGetter counts the calls made to the getter it wraps
+type countingGetter struct {
+	ipld.NodeGetter
+
+	lk      sync.Mutex
+	gets    int
+	getMany int
+}
+
+func (g *countingGetter) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	g.lk.Lock()
+	g.gets++
+	g.lk.Unlock()
+	return g.NodeGetter.Get(ctx, c)
+}
+
+func (g *countingGetter) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	g.lk.Lock()
+	g.getMany++
+	g.lk.Unlock()
+	return g.NodeGetter.GetMany(ctx, cids)
+}
+
+func TestWalk(t *testing.T) {
+	ds := mdtest.Mock()
+	root, total := buildDag(t, ds, 3, 5)
+
+	for _, opts := range []Options{
+		{},
+		{Workers: 1},
+		{Workers: 2, MaxWorkers: 16, ScaleEvery: 10},
+		{Workers: 4, WantBatchSize: 8},
+	} {
+		t.Run(fmt.Sprintf("%+v", opts), func(t *testing.T) {
+			assert := assert.New(t)
+
+			ng := &countingGetter{NodeGetter: ds}
+			cset := cid.NewSet()
+			var lk sync.Mutex
+			var seen int
+			err := Walk(context.Background(), ng, root, cset.Visit, func(ctx context.Context, nd ipld.Node) ([]*ipld.Link, error) {
+				lk.Lock()
+				seen++
+				lk.Unlock()
+				return nd.Links(), nil
+			}, opts)
+			assert.NoError(err)
+			assert.Equal(total, seen)
+			assert.Equal(total, cset.Len())
+
+			if opts.WantBatchSize > 1 {
+				assert.NotZero(ng.getMany)
+			} else {
+				assert.Equal(total, ng.gets)
+			}
+		})
+	}
+}
+
+func TestWalkError(t *testing.T) {
+	ds := mdtest.Mock()
+	root, _ := buildDag(t, ds, 3, 4)
+
+	errBad := errors.New("bad node")
+	var calls int
+	var lk sync.Mutex
+	err := Walk(context.Background(), ds, root, cid.NewSet().Visit, func(ctx context.Context, nd ipld.Node) ([]*ipld.Link, error) {
+		lk.Lock()
+		defer lk.Unlock()
+		calls++
+		if calls == 3 {
+			return nil, errBad
+		}
+		return nd.Links(), nil
+	}, Options{Workers: 4, WantBatchSize: 2})
+	assert.ErrorIs(t, err, errBad)
+}
@@ -69,6 +69,13 @@ func (dbc *DbCID) UnmarshalJSON(b []byte) error {
 		return err
 	}
 
+	// an undefined cid is marshaled as "b", the multibase prefix with
+	// nothing after it, which doesn't decode. Some archives have it as "".
+	if s == "" || s == "b" {
+		dbc.CID = cid.Undef
+		return nil
+	}
+
 	c, err := cid.Decode(s)
 	if err != nil {
 		return err
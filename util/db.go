@@ -2,28 +2,36 @@ package util
 
 import (
 	"fmt"
+	"net/url"
 	"strings"
 	"time"
 
+	"github.com/application-research/estuary/faults"
+	"github.com/application-research/estuary/metrics"
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
-func SetupDatabase(dbval string) (*gorm.DB, error) {
-	parts := strings.SplitN(dbval, "=", 2)
-	if len(parts) == 1 {
-		return nil, fmt.Errorf("format for database string is 'DBTYPE=PARAMS'")
-	}
+// DatabaseOptions tune the connection pool of a database and what queries
+// are sent where, config.Database converts to it
+type DatabaseOptions struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxIdleTime time.Duration
+	ConnMaxLifetime time.Duration
+	// StatementTimeout aborts any single query that runs longer than this,
+	// only supported on postgres. Zero disables it.
+	StatementTimeout time.Duration
+	// ReadReplicaConnString is an optional 'DBTYPE=PARAMS' connection string
+	// of a read replica that read only listing and status queries are sent to
+	ReadReplicaConnString string
+}
 
-	var dial gorm.Dialector
-	switch parts[0] {
-	case "sqlite":
-		dial = sqlite.Open(parts[1])
-	case "postgres":
-		dial = postgres.Open(parts[1])
-	default:
-		return nil, fmt.Errorf("unsupported or unrecognized db type: %s", parts[0])
+func SetupDatabase(dbval string, cfg DatabaseOptions) (*gorm.DB, error) {
+	dial, err := openDialector(dbval, cfg)
+	if err != nil {
+		return nil, err
 	}
 
 	db, err := gorm.Open(dial, &gorm.Config{
@@ -33,14 +41,131 @@ func SetupDatabase(dbval string) (*gorm.DB, error) {
 		return nil, err
 	}
 
+	if err := db.Use(metrics.GormPlugin{}); err != nil {
+		return nil, err
+	}
+
+	if err := db.Use(faults.GormPlugin{}); err != nil {
+		return nil, err
+	}
+
 	sqldb, err := db.DB()
 	if err != nil {
 		return nil, err
 	}
+	configurePool(sqldb, cfg)
+
+	if cfg.ReadReplicaConnString != "" {
+		rdial, err := openDialector(cfg.ReadReplicaConnString, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse read replica connection string: %w", err)
+		}
 
-	sqldb.SetMaxIdleConns(80)
-	sqldb.SetMaxOpenConns(99)
-	sqldb.SetConnMaxIdleTime(time.Hour)
+		rdb, err := gorm.Open(rdial, &gorm.Config{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to open read replica: %w", err)
+		}
+
+		rsqldb, err := rdb.DB()
+		if err != nil {
+			return nil, err
+		}
+		configurePool(rsqldb, cfg)
+
+		if err := db.Use(&readReplicaPlugin{replica: rsqldb}); err != nil {
+			return nil, err
+		}
+	}
 
 	return db, nil
 }
+
+func openDialector(dbval string, cfg DatabaseOptions) (gorm.Dialector, error) {
+	parts := strings.SplitN(dbval, "=", 2)
+	if len(parts) == 1 {
+		return nil, fmt.Errorf("format for database string is 'DBTYPE=PARAMS'")
+	}
+
+	switch parts[0] {
+	case "sqlite":
+		if cfg.StatementTimeout > 0 {
+			log.Warnf("statement timeout is not supported on sqlite, ignoring")
+		}
+		return sqlite.Open(parts[1]), nil
+	case "postgres":
+		return postgres.Open(withStatementTimeout(parts[1], cfg.StatementTimeout)), nil
+	default:
+		return nil, fmt.Errorf("unsupported or unrecognized db type: %s", parts[0])
+	}
+}
+
+// withStatementTimeout adds the statement_timeout runtime parameter to a
+// postgres dsn, which may be either a url or a list of key=value pairs
+func withStatementTimeout(dsn string, timeout time.Duration) string {
+	if timeout <= 0 {
+		return dsn
+	}
+	ms := fmt.Sprint(timeout.Milliseconds())
+
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err == nil {
+			q := u.Query()
+			q.Set("statement_timeout", ms)
+			u.RawQuery = q.Encode()
+			return u.String()
+		}
+	}
+	return dsn + " statement_timeout=" + ms
+}
+
+type connPool interface {
+	SetMaxIdleConns(int)
+	SetMaxOpenConns(int)
+	SetConnMaxIdleTime(time.Duration)
+	SetConnMaxLifetime(time.Duration)
+}
+
+func configurePool(sqldb connPool, cfg DatabaseOptions) {
+	sqldb.SetMaxIdleConns(cfg.MaxIdleConns)
+	sqldb.SetMaxOpenConns(cfg.MaxOpenConns)
+	sqldb.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+	sqldb.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+}
+
+const readReplicaKey = "estuary:read_replica"
+
+// ReadReplica marks queries made with the returned db as safe to serve from
+// the read replica, if one is configured. Only use it for read only queries
+// that can tolerate replication lag, like listings and status pages, so that
+// heavy dashboard traffic doesn't compete with pin and deal writes.
+func ReadReplica(db *gorm.DB) *gorm.DB {
+	return db.Set(readReplicaKey, true).Session(&gorm.Session{})
+}
+
+type readReplicaPlugin struct {
+	replica gorm.ConnPool
+}
+
+func (p *readReplicaPlugin) Name() string {
+	return "estuary:read_replica"
+}
+
+func (p *readReplicaPlugin) Initialize(db *gorm.DB) error {
+	if err := db.Callback().Query().Before("gorm:query").Register(p.Name(), p.route); err != nil {
+		return err
+	}
+	return db.Callback().Row().Before("gorm:row").Register(p.Name(), p.route)
+}
+
+func (p *readReplicaPlugin) route(db *gorm.DB) {
+	if v, ok := db.Get(readReplicaKey); !ok || v != true {
+		return
+	}
+
+	// never move queries that are part of a transaction off the primary
+	if _, ok := db.Statement.ConnPool.(gorm.TxCommitter); ok {
+		return
+	}
+	db.Statement.ConnPool = p.replica
+}
@@ -0,0 +1,259 @@
+// Package dealbatch groups deal proposals by storage provider. Proposals
+// for the same provider are queued and sent one after another by a single
+// worker, over one session that is opened when the first proposal comes in
+// and kept for an idle timeout after the last, with a pause between sends so
+// providers that rate limit clients don't start turning proposals away.
+package dealbatch
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrClosed = errors.New("deal batcher closed")
+
+// OpenFunc opens a session to the provider with the given key. The returned
+// release func is called once the worker for that provider goes idle.
+type OpenFunc func(ctx context.Context, key string) (release func(), err error)
+
+// Job is a single proposal. Send does the work, Done is then called with its
+// result, or with the error from opening the session if that failed.
+type Job struct {
+	Send func(ctx context.Context) error
+	Done func(err error)
+}
+
+type Options struct {
+	// Pace is the wait between two proposals to the same provider
+	Pace time.Duration
+	// Idle is how long a session is kept open with nothing to send
+	Idle time.Duration
+}
+
+type Stats struct {
+	Providers int   `json:"providers"`
+	Queued    int   `json:"queued"`
+	Sending   int   `json:"sending"`
+	Sessions  int64 `json:"sessions"`
+	Sent      int64 `json:"sent"`
+	Failed    int64 `json:"failed"`
+}
+
+type worker struct {
+	queue []Job
+	wake  chan struct{}
+}
+
+type Batcher struct {
+	open OpenFunc
+	opts Options
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	lk      sync.Mutex
+	workers map[string]*worker
+	stats   Stats
+	closed  bool
+}
+
+func New(open OpenFunc, opts Options) *Batcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Batcher{
+		open:    open,
+		opts:    opts,
+		ctx:     ctx,
+		cancel:  cancel,
+		workers: make(map[string]*worker),
+	}
+}
+
+// Submit queues a job for the provider with the given key, starting a worker
+// for it if there isn't one running
+func (b *Batcher) Submit(key string, j Job) error {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+
+	w, ok := b.workers[key]
+	if !ok {
+		w = &worker{wake: make(chan struct{}, 1)}
+		b.workers[key] = w
+		b.wg.Add(1)
+		go b.run(key, w)
+	}
+
+	w.queue = append(w.queue, j)
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SetOptions changes the pacing and idle timeout, running workers pick them
+// up from their next proposal on
+func (b *Batcher) SetOptions(opts Options) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.opts = opts
+}
+
+func (b *Batcher) options() Options {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return b.opts
+}
+
+func (b *Batcher) next(key string, w *worker) (Job, bool) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	if len(w.queue) == 0 {
+		return Job{}, false
+	}
+	j := w.queue[0]
+	w.queue[0] = Job{}
+	w.queue = w.queue[1:]
+	b.stats.Sending++
+	return j, true
+}
+
+// retire removes the worker if nothing was queued for it in the meantime
+func (b *Batcher) retire(key string, w *worker) bool {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	if len(w.queue) > 0 && !b.closed {
+		return false
+	}
+	delete(b.workers, key)
+	return true
+}
+
+func (b *Batcher) fail(key string, w *worker, err error) {
+	for {
+		j, ok := b.next(key, w)
+		if !ok {
+			return
+		}
+		b.finish(j, err)
+	}
+}
+
+func (b *Batcher) finish(j Job, err error) {
+	b.lk.Lock()
+	if err != nil {
+		b.stats.Failed++
+	} else {
+		b.stats.Sent++
+	}
+	b.lk.Unlock()
+
+	if j.Done != nil {
+		j.Done(err)
+	}
+
+	// a job is pending until what Done starts is under way
+	b.lk.Lock()
+	b.stats.Sending--
+	b.lk.Unlock()
+}
+
+func (b *Batcher) run(key string, w *worker) {
+	defer b.wg.Done()
+
+	release, err := b.open(b.ctx, key)
+	if err != nil {
+		b.fail(key, w, err)
+		b.retire(key, w)
+		return
+	}
+	defer release()
+
+	b.lk.Lock()
+	b.stats.Sessions++
+	b.lk.Unlock()
+
+	idle := time.NewTimer(b.options().Idle)
+	defer idle.Stop()
+
+	var sent bool
+	for {
+		j, ok := b.next(key, w)
+		if !ok {
+			if !idle.Stop() {
+				select {
+				case <-idle.C:
+				default:
+				}
+			}
+			idle.Reset(b.options().Idle)
+
+			select {
+			case <-w.wake:
+				continue
+			case <-idle.C:
+				if b.retire(key, w) {
+					return
+				}
+				continue
+			case <-b.ctx.Done():
+				b.fail(key, w, ErrClosed)
+				b.retire(key, w)
+				return
+			}
+		}
+
+		if pace := b.options().Pace; sent && pace > 0 {
+			select {
+			case <-time.After(pace):
+			case <-b.ctx.Done():
+				b.finish(j, ErrClosed)
+				continue
+			}
+		}
+
+		if b.ctx.Err() != nil {
+			b.finish(j, ErrClosed)
+			continue
+		}
+
+		b.finish(j, j.Send(b.ctx))
+		sent = true
+	}
+}
+
+// Pending is how many jobs are queued or being sent, for drains to wait on
+func (b *Batcher) Pending() int {
+	st := b.Stats()
+	return st.Queued + st.Sending
+}
+
+func (b *Batcher) Stats() Stats {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	st := b.stats
+	st.Providers = len(b.workers)
+	for _, w := range b.workers {
+		st.Queued += len(w.queue)
+	}
+	return st
+}
+
+// Close stops all workers, jobs still queued are finished with ErrClosed
+func (b *Batcher) Close() {
+	b.lk.Lock()
+	b.closed = true
+	b.lk.Unlock()
+
+	b.cancel()
+	b.wg.Wait()
+}
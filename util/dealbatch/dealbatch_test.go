@@ -0,0 +1,157 @@
+package dealbatch
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type opener struct {
+	lk       sync.Mutex
+	opened   map[string]int
+	released map[string]int
+	err      error
+}
+
+func newOpener() *opener {
+	return &opener{opened: make(map[string]int), released: make(map[string]int)}
+}
+
+func (o *opener) open(ctx context.Context, key string) (func(), error) {
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	if o.err != nil {
+		return nil, o.err
+	}
+	o.opened[key]++
+	return func() {
+		o.lk.Lock()
+		defer o.lk.Unlock()
+		o.released[key]++
+	}, nil
+}
+
+func (o *opener) counts(key string) (int, int) {
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	return o.opened[key], o.released[key]
+}
+
+func TestOneSessionPerProvider(t *testing.T) {
+	o := newOpener()
+	b := New(o.open, Options{Pace: 5 * time.Millisecond, Idle: 100 * time.Millisecond})
+	defer b.Close()
+
+	var wg sync.WaitGroup
+	var lk sync.Mutex
+	sent := make(map[string][]time.Time)
+	for i := 0; i < 4; i++ {
+		for _, key := range []string{"f01", "f02"} {
+			key := key
+			wg.Add(1)
+			assert.NoError(t, b.Submit(key, Job{
+				Send: func(ctx context.Context) error {
+					lk.Lock()
+					sent[key] = append(sent[key], time.Now())
+					lk.Unlock()
+					return nil
+				},
+				Done: func(err error) {
+					assert.NoError(t, err)
+					wg.Done()
+				},
+			}))
+		}
+	}
+	wg.Wait()
+
+	for _, key := range []string{"f01", "f02"} {
+		opened, _ := o.counts(key)
+		assert.Equal(t, 1, opened)
+		assert.Len(t, sent[key], 4)
+		for i := 1; i < len(sent[key]); i++ {
+			assert.True(t, sent[key][i].Sub(sent[key][i-1]) >= 5*time.Millisecond)
+		}
+	}
+
+	st := b.Stats()
+	assert.Equal(t, int64(8), st.Sent)
+	assert.Equal(t, int64(2), st.Sessions)
+
+	// sessions are released once the providers go idle
+	assert.Eventually(t, func() bool {
+		_, r1 := o.counts("f01")
+		_, r2 := o.counts("f02")
+		return r1 == 1 && r2 == 1 && b.Stats().Providers == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestOpenFailureFailsJobs(t *testing.T) {
+	o := newOpener()
+	o.err = errors.New("unreachable")
+	b := New(o.open, Options{Idle: time.Second})
+	defer b.Close()
+
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, b.Submit("f01", Job{
+			Send: func(ctx context.Context) error {
+				t.Fatal("should not send without a session")
+				return nil
+			},
+			Done: func(err error) { errs <- err },
+		}))
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-errs:
+			assert.EqualError(t, err, "unreachable")
+		case <-time.After(time.Second):
+			t.Fatal("job was never finished")
+		}
+	}
+}
+
+func TestCloseFinishesQueued(t *testing.T) {
+	o := newOpener()
+	b := New(o.open, Options{Pace: time.Hour, Idle: time.Hour})
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, b.Submit("f01", Job{
+			Send: func(ctx context.Context) error { return nil },
+			Done: func(err error) { errs <- err },
+		}))
+	}
+
+	assert.NoError(t, <-errs)
+	b.Close()
+	assert.ErrorIs(t, <-errs, ErrClosed)
+	assert.ErrorIs(t, b.Submit("f01", Job{}), ErrClosed)
+}
+
+func TestPending(t *testing.T) {
+	o := newOpener()
+	b := New(o.open, Options{Idle: time.Hour})
+	defer b.Close()
+
+	release := make(chan struct{})
+	done := make(chan struct{})
+	assert.NoError(t, b.Submit("f01", Job{
+		Send: func(ctx context.Context) error {
+			<-release
+			return nil
+		},
+		Done: func(err error) { close(done) },
+	}))
+	assert.Equal(t, 1, b.Pending())
+
+	close(release)
+	<-done
+	assert.Eventually(t, func() bool { return b.Pending() == 0 }, time.Second, time.Millisecond*10)
+}
@@ -0,0 +1,80 @@
+// Package dealfailure sorts the errors deals fail with, which come from
+// many places and are mostly free text, into a few causes.
+package dealfailure
+
+import "strings"
+
+const (
+	PriceRejected          = "price-rejected"
+	InsufficientCollateral = "insufficient-collateral"
+	ClientFunds            = "client-funds"
+	Unreachable            = "provider-unreachable"
+	TransferStalled        = "transfer-stalled"
+	SealingFault           = "sealing-fault"
+	ProposalExpired        = "proposal-expired"
+	Rejected               = "rejected"
+	Unknown                = "unknown"
+)
+
+// Reasons are all the causes Classify returns
+var Reasons = []string{
+	PriceRejected,
+	InsufficientCollateral,
+	ClientFunds,
+	Unreachable,
+	TransferStalled,
+	SealingFault,
+	ProposalExpired,
+	Rejected,
+	Unknown,
+}
+
+// Classify returns the cause of a deal failure from the phase it failed in
+// and its message
+func Classify(phase, message string) string {
+	msg := strings.ToLower(message)
+	has := func(subs ...string) bool {
+		for _, s := range subs {
+			if strings.Contains(msg, s) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case phase == "fault" || has("slashed", "faulted", "sector fault", "failed to seal", "sealing failed"):
+		return SealingFault
+	case has("collateral"):
+		return InsufficientCollateral
+	// what we couldn't pay with, rather than the provider
+	case has("insufficient funds", "not enough funds", "escrow", "available balance", "payment channel"):
+		return ClientFunds
+	case has("price", "less than asking", "ask "):
+		return PriceRejected
+	case has("expired", "in time", "start epoch", "deal start"):
+		return ProposalExpired
+	case phase == "data-transfer" || strings.HasPrefix(phase, "start-data-transfer") || phase == "stuck-transfer" || has("transfer"):
+		return TransferStalled
+	case has("dial", "connect", "i/o timeout", "no route", "open stream", "protocol not supported", "context deadline exceeded"):
+		return Unreachable
+	case phase == "query-ask" || phase == "deal-protocol-version":
+		return Unreachable
+	case has("reject", "declin", "not accepting", "refus"):
+		return Rejected
+	default:
+		return Unknown
+	}
+}
+
+// Retryable reports whether a deal that failed for reason could go through
+// with the same provider if it was tried again. Our own lack of funds is
+// fixed by topping them up, not by going to another provider.
+func Retryable(reason string) bool {
+	switch reason {
+	case PriceRejected, InsufficientCollateral, SealingFault, Rejected:
+		return false
+	default:
+		return true
+	}
+}
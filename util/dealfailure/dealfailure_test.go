@@ -0,0 +1,32 @@
+package dealfailure
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassify(t *testing.T) {
+	assert.Equal(t, PriceRejected, Classify("send-proposal", "deal rejected: storage price per epoch less than asking price"))
+	assert.Equal(t, InsufficientCollateral, Classify("propose", "not enough funds to cover provider collateral"))
+	assert.Equal(t, ClientFunds, Classify("send-proposal", "failed to ensure market funds: not enough funds to add: 1 FIL < 2 FIL"))
+	assert.Equal(t, ClientFunds, Classify("propose", "insufficient funds in escrow"))
+	assert.Equal(t, Unknown, Classify("propose", "sector size 32GiB too small for piece"), "only sector faults are sealing faults")
+	assert.Equal(t, SealingFault, Classify("check-chain-deal", "sealing failed: precommit"))
+	assert.Equal(t, Unreachable, Classify("query-ask", "failed to dial 12D3KooW: all dials failed"))
+	assert.Equal(t, TransferStalled, Classify("data-transfer", "transfer failed: graphsync request timed out"))
+	assert.Equal(t, TransferStalled, Classify("stuck-transfer", "deal made no progress in transfer phase after 3 retries"))
+	assert.Equal(t, SealingFault, Classify("fault", "miner faulted on deal: 12"))
+	assert.Equal(t, SealingFault, Classify("check-chain-deal", "deal 12 was slashed at epoch 100"))
+	assert.Equal(t, ProposalExpired, Classify("check-status", "deal did not make it on chain in time"))
+	assert.Equal(t, Rejected, Classify("propose", "deal rejected: provider is not accepting online deals"))
+	assert.Equal(t, Unknown, Classify("propose", "something else"))
+}
+
+func TestRetryable(t *testing.T) {
+	assert.True(t, Retryable(TransferStalled))
+	assert.True(t, Retryable(Unknown))
+	assert.True(t, Retryable(ClientFunds))
+	assert.False(t, Retryable(PriceRejected))
+	assert.False(t, Retryable(SealingFault))
+}
@@ -0,0 +1,58 @@
+// Package dealphase turns the states storage providers report for a deal,
+// of which there are many, into the few phases a deal goes through.
+package dealphase
+
+import "github.com/filecoin-project/go-fil-markets/storagemarket"
+
+const (
+	Proposed     = "proposed"
+	Transferring = "transferring"
+	Publishing   = "publishing"
+	Sealing      = "sealing"
+	Active       = "active"
+	Failed       = "failed"
+)
+
+// Of returns the phase of a deal the provider reports st for
+func Of(st storagemarket.StorageDealStatus) string {
+	switch st {
+	case storagemarket.StorageDealStartDataTransfer,
+		storagemarket.StorageDealTransferQueued,
+		storagemarket.StorageDealTransferring,
+		storagemarket.StorageDealWaitingForData,
+		storagemarket.StorageDealProviderTransferAwaitRestart,
+		storagemarket.StorageDealClientTransferRestart:
+		return Transferring
+	case storagemarket.StorageDealVerifyData,
+		storagemarket.StorageDealReserveProviderFunds,
+		storagemarket.StorageDealProviderFunding,
+		storagemarket.StorageDealPublish,
+		storagemarket.StorageDealPublishing:
+		return Publishing
+	case storagemarket.StorageDealStaged,
+		storagemarket.StorageDealAwaitingPreCommit,
+		storagemarket.StorageDealSealing,
+		storagemarket.StorageDealFinalizing:
+		return Sealing
+	case storagemarket.StorageDealActive:
+		return Active
+	case storagemarket.StorageDealProposalNotFound,
+		storagemarket.StorageDealProposalRejected,
+		storagemarket.StorageDealExpired,
+		storagemarket.StorageDealSlashed,
+		storagemarket.StorageDealRejecting,
+		storagemarket.StorageDealFailing,
+		storagemarket.StorageDealError:
+		return Failed
+	default:
+		return Proposed
+	}
+}
+
+// Name is the name the markets give to st
+func Name(st storagemarket.StorageDealStatus) string {
+	if n, ok := storagemarket.DealStates[st]; ok {
+		return n
+	}
+	return "StorageDealUnknown"
+}
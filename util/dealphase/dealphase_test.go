@@ -0,0 +1,24 @@
+package dealphase
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOf(t *testing.T) {
+	assert.Equal(t, Proposed, Of(storagemarket.StorageDealUnknown))
+	assert.Equal(t, Proposed, Of(storagemarket.StorageDealValidating))
+	assert.Equal(t, Transferring, Of(storagemarket.StorageDealTransferring))
+	assert.Equal(t, Publishing, Of(storagemarket.StorageDealPublishing))
+	assert.Equal(t, Sealing, Of(storagemarket.StorageDealAwaitingPreCommit))
+	assert.Equal(t, Sealing, Of(storagemarket.StorageDealFinalizing))
+	assert.Equal(t, Active, Of(storagemarket.StorageDealActive))
+	assert.Equal(t, Failed, Of(storagemarket.StorageDealError))
+}
+
+func TestName(t *testing.T) {
+	assert.Equal(t, "StorageDealSealing", Name(storagemarket.StorageDealSealing))
+	assert.Equal(t, "StorageDealUnknown", Name(9999))
+}
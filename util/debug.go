@@ -0,0 +1,57 @@
+package util
+
+import (
+	"io"
+	httpprof "net/http/pprof"
+	"runtime"
+	"runtime/pprof"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func ServeCpuProfile(c echo.Context) error {
+	if err := pprof.StartCPUProfile(c.Response()); err != nil {
+		return err
+	}
+
+	defer pprof.StopCPUProfile()
+
+	select {
+	case <-c.Request().Context().Done():
+		return c.Request().Context().Err()
+	case <-time.After(time.Second * 30):
+	}
+
+	return nil
+}
+
+func ServeProfile(c echo.Context) error {
+	httpprof.Handler(c.Param("prof")).ServeHTTP(c.Response().Writer, c.Request())
+	return nil
+}
+
+// ServeGoroutineStacks writes the full stack of every goroutine, which is
+// usually the quickest way to find out what a hung node is waiting on
+func ServeGoroutineStacks(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextPlainCharsetUTF8)
+	return WriteAllGoroutineStacks(c.Response())
+}
+
+func WriteAllGoroutineStacks(w io.Writer) error {
+	buf := make([]byte, 64<<20)
+	for i := 0; ; i++ {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		if len(buf) >= 1<<30 {
+			// Filled 1 GB - stop there.
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,43 @@
+package denylist
+
+import (
+	"context"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+// listedBlockstore hides the blocks listed from its readers
+type listedBlockstore struct {
+	blockstore.Blockstore
+	listed func(cid.Cid) bool
+}
+
+// Blockstore returns bs without the blocks listed says are, so that nothing
+// read through it, e.g. the children of a DAG that is not listed, serves
+// them
+func Blockstore(bs blockstore.Blockstore, listed func(cid.Cid) bool) blockstore.Blockstore {
+	return &listedBlockstore{Blockstore: bs, listed: listed}
+}
+
+func (lb *listedBlockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	if lb.listed(c) {
+		return false, nil
+	}
+	return lb.Blockstore.Has(ctx, c)
+}
+
+func (lb *listedBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if lb.listed(c) {
+		return nil, blockstore.ErrNotFound
+	}
+	return lb.Blockstore.Get(ctx, c)
+}
+
+func (lb *listedBlockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	if lb.listed(c) {
+		return -1, blockstore.ErrNotFound
+	}
+	return lb.Blockstore.GetSize(ctx, c)
+}
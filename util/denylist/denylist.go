@@ -0,0 +1,144 @@
+// Package denylist holds lists of content that must not be pinned, served
+// or dealt, in the format of the badbits list: entries are anchors, the
+// hex sha256 of the base32 CIDv1 of a content followed by a slash, so a
+// list can be published without naming what it blocks. Paths in a content
+// are listed by the anchor of the CIDv1, a slash and the path.
+//
+// Lists are read either as the json array of {"anchor": ...} objects of
+// https://badbits.dwebops.pub/denylist.json, or as text with one entry per
+// line: "//<anchor>", "/ipfs/<cid>" or a bare cid. Blank lines and lines
+// starting with # are skipped.
+package denylist
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+)
+
+// Anchor is the anchor of the content c, the same for the CIDv0 and the
+// CIDv1 of it
+func Anchor(c cid.Cid) string {
+	return PathAnchor(c, "")
+}
+
+// PathAnchor is the anchor of the path p, without a leading slash, in the
+// content c
+func PathAnchor(c cid.Cid, p string) string {
+	v1 := cid.NewCidV1(c.Type(), c.Hash())
+	sum := sha256.Sum256([]byte(v1.String() + "/" + p))
+	return hex.EncodeToString(sum[:])
+}
+
+// List is a set of anchors, each with the source it came from. It is not
+// safe for concurrent writes.
+type List struct {
+	anchors map[string]string
+}
+
+func New() *List {
+	return &List{anchors: make(map[string]string)}
+}
+
+// Add adds c, from source
+func (l *List) Add(c cid.Cid, source string) {
+	l.anchors[Anchor(c)] = source
+}
+
+// AddAnchor adds an anchor, from source
+func (l *List) AddAnchor(anchor, source string) error {
+	anchor = strings.ToLower(strings.TrimSpace(anchor))
+	if b, err := hex.DecodeString(anchor); err != nil || len(b) != sha256.Size {
+		return fmt.Errorf("invalid anchor %q", anchor)
+	}
+	l.anchors[anchor] = source
+	return nil
+}
+
+// Lookup returns the source c is listed by, if it is
+func (l *List) Lookup(c cid.Cid) (string, bool) {
+	src, ok := l.anchors[Anchor(c)]
+	return src, ok
+}
+
+// LookupPath returns the source the path p in c is listed by, if it is:
+// when c, or p or any path above it in c, is listed
+func (l *List) LookupPath(c cid.Cid, p string) (string, bool) {
+	if src, ok := l.Lookup(c); ok {
+		return src, true
+	}
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return "", false
+	}
+	segs := strings.Split(p, "/")
+	for i := range segs {
+		if src, ok := l.anchors[PathAnchor(c, strings.Join(segs[:i+1], "/"))]; ok {
+			return src, true
+		}
+	}
+	return "", false
+}
+
+// Anchors returns the anchors of l
+func (l *List) Anchors() []string {
+	out := make([]string, 0, len(l.anchors))
+	for a := range l.anchors {
+		out = append(out, a)
+	}
+	return out
+}
+
+func (l *List) Len() int {
+	return len(l.anchors)
+}
+
+// Parse adds the entries of a list in either format to l, all from source
+func (l *List) Parse(r io.Reader, source string) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+		var entries []struct {
+			Anchor string `json:"anchor"`
+		}
+		if err := json.Unmarshal(b, &entries); err != nil {
+			return fmt.Errorf("invalid json denylist: %w", err)
+		}
+		for _, e := range entries {
+			if err := l.AddAnchor(e.Anchor, source); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "//"):
+			if err := l.AddAnchor(line[2:], source); err != nil {
+				return fmt.Errorf("line %d: %w", n, err)
+			}
+		default:
+			c, err := cid.Decode(strings.TrimPrefix(line, "/ipfs/"))
+			if err != nil {
+				return fmt.Errorf("line %d: invalid cid: %w", n, err)
+			}
+			l.Add(c, source)
+		}
+	}
+	return sc.Err()
+}
@@ -0,0 +1,98 @@
+package denylist
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnchor(t *testing.T) {
+	v0, err := cid.Decode("QmdfTbBqBPQ7VNxZEYEj14VmRuZBkqFbiwReogJgS1zR1n")
+	require.NoError(t, err)
+	v1 := cid.NewCidV1(cid.DagProtobuf, v0.Hash())
+	assert.Equal(t, Anchor(v0), Anchor(v1))
+	assert.Len(t, Anchor(v0), 64)
+}
+
+func TestParse(t *testing.T) {
+	bad, err := cid.Decode("QmdfTbBqBPQ7VNxZEYEj14VmRuZBkqFbiwReogJgS1zR1n")
+	require.NoError(t, err)
+	good, err := cid.Decode("bafkqaaa")
+	require.NoError(t, err)
+
+	l := New()
+	require.NoError(t, l.Parse(strings.NewReader(fmt.Sprintf(`[{"anchor": %q}]`, Anchor(bad))), "badbits"))
+	src, ok := l.Lookup(bad)
+	assert.True(t, ok)
+	assert.Equal(t, "badbits", src)
+	_, ok = l.Lookup(good)
+	assert.False(t, ok)
+
+	l = New()
+	text := fmt.Sprintf("# comment\n\n//%s\n/ipfs/%s\n", Anchor(bad), good)
+	require.NoError(t, l.Parse(strings.NewReader(text), "local"))
+	assert.Equal(t, 2, l.Len())
+	_, ok = l.Lookup(good)
+	assert.True(t, ok)
+
+	assert.Error(t, New().Parse(strings.NewReader("//nothex\n"), "x"))
+	assert.Error(t, New().Parse(strings.NewReader("notacid\n"), "x"))
+}
+
+func TestLookupPath(t *testing.T) {
+	root, err := cid.Decode("QmdfTbBqBPQ7VNxZEYEj14VmRuZBkqFbiwReogJgS1zR1n")
+	require.NoError(t, err)
+
+	l := New()
+	require.NoError(t, l.Parse(strings.NewReader(fmt.Sprintf("//%s\n", PathAnchor(root, "a/b"))), "badbits"))
+
+	_, ok := l.LookupPath(root, "")
+	assert.False(t, ok)
+	_, ok = l.LookupPath(root, "a")
+	assert.False(t, ok)
+	src, ok := l.LookupPath(root, "/a/b")
+	assert.True(t, ok)
+	assert.Equal(t, "badbits", src)
+	_, ok = l.LookupPath(root, "a/b/c.txt")
+	assert.True(t, ok)
+	_, ok = l.LookupPath(root, "a/bc")
+	assert.False(t, ok)
+
+	l.Add(root, "local")
+	_, ok = l.LookupPath(root, "x")
+	assert.True(t, ok)
+}
+
+func TestBlockstore(t *testing.T) {
+	ctx := context.Background()
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	bad := blocks.NewBlock([]byte("bad"))
+	good := blocks.NewBlock([]byte("good"))
+	require.NoError(t, bs.PutMany(ctx, []blocks.Block{bad, good}))
+
+	l := New()
+	l.Add(bad.Cid(), "local")
+	lbs := Blockstore(bs, func(c cid.Cid) bool {
+		_, ok := l.Lookup(c)
+		return ok
+	})
+
+	_, err := lbs.Get(ctx, bad.Cid())
+	assert.ErrorIs(t, err, blockstore.ErrNotFound)
+	has, err := lbs.Has(ctx, bad.Cid())
+	require.NoError(t, err)
+	assert.False(t, has)
+
+	blk, err := lbs.Get(ctx, good.Cid())
+	require.NoError(t, err)
+	assert.Equal(t, good.RawData(), blk.RawData())
+}
@@ -0,0 +1,176 @@
+// Package dirtree builds UnixFS directory trees over DAGs that already
+// exist, such as the contents of a collection, without fetching any of them.
+// Directories with more entries than the fanout, or with too many to fit in
+// a block, are sharded as HAMTs the way go-ipfs shards them, so a directory
+// can hold millions of entries.
+package dirtree
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync/storeutil"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	"github.com/ipfs/go-unixfsnode/hamt"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	ipldprime "github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+)
+
+const (
+	// DefaultFanout is how many entries a directory holds before it is
+	// sharded
+	DefaultFanout = 1000
+
+	// maxDirSize is the estimated size of a directory block over which it is
+	// sharded whatever the fanout, the same limit as go-ipfs
+	maxDirSize = 256 << 10
+
+	// shardWidth is the number of buckets in each HAMT shard
+	shardWidth = 256
+)
+
+type dir struct {
+	dirs  map[string]*dir
+	links map[string]*ipld.Link
+}
+
+func newDir() *dir {
+	return &dir{
+		dirs:  make(map[string]*dir),
+		links: make(map[string]*ipld.Link),
+	}
+}
+
+// Tree is a directory tree being put together
+type Tree struct {
+	fanout int
+	root   *dir
+}
+
+// New starts an empty tree whose directories are sharded above fanout
+// entries
+func New(fanout int) *Tree {
+	if fanout <= 0 {
+		fanout = DefaultFanout
+	}
+	return &Tree{fanout: fanout, root: newDir()}
+}
+
+// Add links the DAG c of the given size under name in the directory at
+// path dirs, creating the directories along the way. An entry added under
+// a name that is already taken replaces the earlier one.
+func (t *Tree) Add(dirs []string, name string, c cid.Cid, size uint64) error {
+	d := t.root
+	for _, dn := range dirs {
+		if _, ok := d.links[dn]; ok {
+			return fmt.Errorf("%q is both a file and a directory", dn)
+		}
+		sub, ok := d.dirs[dn]
+		if !ok {
+			sub = newDir()
+			d.dirs[dn] = sub
+		}
+		d = sub
+	}
+	if _, ok := d.dirs[name]; ok {
+		return fmt.Errorf("%q is both a file and a directory", name)
+	}
+
+	d.links[name] = &ipld.Link{Name: name, Cid: c, Size: size}
+	return nil
+}
+
+// Build writes the directories of the tree to bs and returns the root
+func (t *Tree) Build(ctx context.Context, bs blockstore.Blockstore) (cid.Cid, error) {
+	ls := storeutil.LinkSystemForBlockstore(bs)
+	b := &treeBuilder{
+		fanout: t.fanout,
+		dserv:  merkledag.NewDAGService(blockservice.New(bs, nil)),
+		ls:     &ls,
+	}
+
+	lnk, err := b.build(ctx, t.root)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return lnk.Cid, nil
+}
+
+type treeBuilder struct {
+	fanout int
+	dserv  ipld.DAGService
+	ls     *ipldprime.LinkSystem
+}
+
+func (b *treeBuilder) build(ctx context.Context, d *dir) (*ipld.Link, error) {
+	links := make([]*ipld.Link, 0, len(d.dirs)+len(d.links))
+	for name, sub := range d.dirs {
+		lnk, err := b.build(ctx, sub)
+		if err != nil {
+			return nil, fmt.Errorf("building %q: %w", name, err)
+		}
+		lnk.Name = name
+		links = append(links, lnk)
+	}
+	for _, lnk := range d.links {
+		links = append(links, lnk)
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].Name < links[j].Name
+	})
+
+	if len(links) > b.fanout || estimateDirSize(links) > maxDirSize {
+		return b.shard(links)
+	}
+
+	nd := unixfs.EmptyDirNode()
+	for _, lnk := range links {
+		if err := nd.AddRawLink(lnk.Name, lnk); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.dserv.Add(ctx, nd); err != nil {
+		return nil, err
+	}
+
+	size, err := nd.Size()
+	if err != nil {
+		return nil, err
+	}
+	return &ipld.Link{Cid: nd.Cid(), Size: size}, nil
+}
+
+func (b *treeBuilder) shard(links []*ipld.Link) (*ipld.Link, error) {
+	entries := make([]dagpb.PBLink, 0, len(links))
+	for _, lnk := range links {
+		e, err := builder.BuildUnixFSDirectoryEntry(lnk.Name, int64(lnk.Size), cidlink.Link{Cid: lnk.Cid})
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	root, size, err := builder.BuildUnixFSShardedDirectory(shardWidth, hamt.HashMurmur3, entries, b.ls)
+	if err != nil {
+		return nil, err
+	}
+	return &ipld.Link{Cid: root.(cidlink.Link).Cid, Size: size}, nil
+}
+
+// estimateDirSize estimates the size of a directory block the way go-ipfs
+// does, by the names and cids of its links
+func estimateDirSize(links []*ipld.Link) int {
+	var size int
+	for _, lnk := range links {
+		size += len(lnk.Name) + lnk.Cid.ByteLen()
+	}
+	return size
+}
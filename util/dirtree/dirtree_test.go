@@ -0,0 +1,69 @@
+package dirtree
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuild(t *testing.T) {
+	ctx := context.Background()
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+
+	tree := New(4)
+	for i := 0; i < 10; i++ {
+		nd := merkledag.NewRawNode([]byte(fmt.Sprintf("file %d", i)))
+		require.NoError(t, dserv.Add(ctx, nd))
+		require.NoError(t, tree.Add(nil, fmt.Sprintf("f%d", i), nd.Cid(), uint64(len(nd.RawData()))))
+	}
+	small := merkledag.NewRawNode([]byte("small"))
+	require.NoError(t, dserv.Add(ctx, small))
+	require.NoError(t, tree.Add([]string{"a", "b"}, "small", small.Cid(), 5))
+	assert.Error(t, tree.Add([]string{"f1"}, "x", small.Cid(), 5))
+	assert.Error(t, tree.Add(nil, "a", small.Cid(), 5))
+
+	root, err := tree.Build(ctx, bs)
+	require.NoError(t, err)
+
+	// the root is over the fanout and sharded, the others aren't
+	rnd, err := dserv.Get(ctx, root)
+	require.NoError(t, err)
+	fsn, err := unixfs.ExtractFSNode(rnd)
+	require.NoError(t, err)
+	assert.Equal(t, unixfs.THAMTShard, fsn.Type())
+
+	dir, err := uio.NewDirectoryFromNode(dserv, rnd)
+	require.NoError(t, err)
+	links, err := dir.Links(ctx)
+	require.NoError(t, err)
+	assert.Len(t, links, 11)
+	for i := 0; i < 10; i++ {
+		_, err := dir.Find(ctx, fmt.Sprintf("f%d", i))
+		assert.NoError(t, err)
+	}
+
+	a, err := dir.Find(ctx, "a")
+	require.NoError(t, err)
+	fsn, err = unixfs.ExtractFSNode(a)
+	require.NoError(t, err)
+	assert.Equal(t, unixfs.TDirectory, fsn.Type())
+
+	adir, err := uio.NewDirectoryFromNode(dserv, a)
+	require.NoError(t, err)
+	b, err := adir.Find(ctx, "b")
+	require.NoError(t, err)
+	got, err := b.(*merkledag.ProtoNode).GetNodeLink("small")
+	require.NoError(t, err)
+	assert.Equal(t, small.Cid(), got.Cid)
+}
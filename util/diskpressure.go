@@ -0,0 +1,183 @@
+package util
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/sys/unix"
+	"golang.org/x/time/rate"
+)
+
+type DiskPressureLevel int
+
+const (
+	DiskPressureNone DiskPressureLevel = iota
+	DiskPressureThrottle
+	DiskPressurePause
+)
+
+func (l DiskPressureLevel) String() string {
+	switch l {
+	case DiskPressureThrottle:
+		return "throttle"
+	case DiskPressurePause:
+		return "pause"
+	default:
+		return "none"
+	}
+}
+
+// DiskPressureOptions are the thresholds and rates of a DiskMonitor,
+// config.DiskPressure converts to it
+type DiskPressureOptions struct {
+	Enabled             bool
+	ThrottleFreePercent float64
+	PauseFreePercent    float64
+	ThrottleRate        float64
+	CheckInterval       time.Duration
+	RetryAfter          time.Duration
+}
+
+type DirUsage struct {
+	Path        string  `json:"path"`
+	Size        uint64  `json:"size"`
+	Free        uint64  `json:"free"`
+	FreePercent float64 `json:"freePercent"`
+}
+
+// DiskMonitor watches the free space of a set of directories and gates
+// content intake when any of them runs low, so that a full disk results in
+// uploads being refused rather than writes failing deep inside the node
+type DiskMonitor struct {
+	cfg  DiskPressureOptions
+	dirs []string
+
+	limiter *rate.Limiter
+
+	// OnChange is called whenever the pressure level changes
+	OnChange func(level DiskPressureLevel, usage []DirUsage)
+
+	lk    sync.Mutex
+	level DiskPressureLevel
+	usage []DirUsage
+}
+
+func NewDiskMonitor(cfg DiskPressureOptions, dirs ...string) *DiskMonitor {
+	return &DiskMonitor{
+		cfg:     cfg,
+		dirs:    dirs,
+		limiter: rate.NewLimiter(rate.Limit(cfg.ThrottleRate), 1),
+	}
+}
+
+// SetConfig changes the thresholds, throttle rate and retry interval of a
+// running monitor, the check interval only applies to monitors started after
+func (dm *DiskMonitor) SetConfig(cfg DiskPressureOptions) {
+	dm.lk.Lock()
+	dm.cfg = cfg
+	dm.lk.Unlock()
+	dm.limiter.SetLimit(rate.Limit(cfg.ThrottleRate))
+}
+
+func (dm *DiskMonitor) config() DiskPressureOptions {
+	dm.lk.Lock()
+	defer dm.lk.Unlock()
+	return dm.cfg
+}
+
+func (dm *DiskMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(dm.config().CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		dm.Check()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Check samples the free space of the monitored directories and updates the
+// pressure level, Run calls it every CheckInterval
+func (dm *DiskMonitor) Check() {
+	cfg := dm.config()
+	usage := make([]DirUsage, 0, len(dm.dirs))
+	level := DiskPressureNone
+	for _, d := range dm.dirs {
+		var st unix.Statfs_t
+		if err := unix.Statfs(d, &st); err != nil {
+			log.Errorf("failed to check free space of %s: %s", d, err)
+			continue
+		}
+
+		du := DirUsage{
+			Path: d,
+			Size: st.Blocks * uint64(st.Bsize),
+			Free: st.Bavail * uint64(st.Bsize),
+		}
+		if du.Size > 0 {
+			du.FreePercent = float64(du.Free) / float64(du.Size) * 100
+		}
+		usage = append(usage, du)
+
+		switch {
+		case du.FreePercent < cfg.PauseFreePercent:
+			level = DiskPressurePause
+		case du.FreePercent < cfg.ThrottleFreePercent && level < DiskPressureThrottle:
+			level = DiskPressureThrottle
+		}
+	}
+
+	dm.lk.Lock()
+	prev := dm.level
+	dm.level = level
+	dm.usage = usage
+	dm.lk.Unlock()
+
+	if level != prev {
+		log.Warnf("disk pressure changed from %s to %s", prev, level)
+		if dm.OnChange != nil {
+			dm.OnChange(level, usage)
+		}
+	}
+}
+
+func (dm *DiskMonitor) Level() DiskPressureLevel {
+	dm.lk.Lock()
+	defer dm.lk.Unlock()
+	return dm.level
+}
+
+func (dm *DiskMonitor) Usage() []DirUsage {
+	dm.lk.Lock()
+	defer dm.lk.Unlock()
+	return append([]DirUsage(nil), dm.usage...)
+}
+
+// Middleware rejects requests with a 507 while intake is paused, and rate
+// limits them with 429s while it is throttled
+func (dm *DiskMonitor) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := dm.config()
+		switch dm.Level() {
+		case DiskPressurePause:
+			return InsufficientStorage(c, ERR_DISK_PRESSURE, LimitInfo{Reset: cfg.RetryAfter},
+				"node is low on disk space, content intake is paused")
+		case DiskPressureThrottle:
+			if !dm.limiter.Allow() {
+				var reset time.Duration
+				if cfg.ThrottleRate > 0 {
+					reset = time.Duration(float64(time.Second) / cfg.ThrottleRate)
+				}
+				return TooManyRequests(c, ERR_DISK_PRESSURE, LimitInfo{Limit: 1, Reset: reset},
+					"node is low on disk space, content intake is throttled")
+			}
+		}
+		return next(c)
+	}
+}
@@ -0,0 +1,133 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// drainRetryAfter is the Retry-After given to clients turned away by a
+// draining node, by then it should be back or replaced
+const drainRetryAfter = time.Minute * 10
+
+const drainPollInterval = time.Second
+
+type DrainStatus struct {
+	Draining bool      `json:"draining"`
+	Started  time.Time `json:"started,omitempty"`
+	Deadline time.Time `json:"deadline,omitempty"`
+	Phase    string    `json:"phase,omitempty"`
+	Done     bool      `json:"done"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Drain tracks a node being drained ahead of maintenance. Once a drain has
+// begun content intake is refused, the node works through the phases of
+// letting in flight work finish, and it can't be undone short of a restart.
+type Drain struct {
+	lk     sync.Mutex
+	status DrainStatus
+}
+
+// Begin starts draining, the returned context is cancelled once the
+// deadline passes so phases waiting on in flight work give up
+func (d *Drain) Begin(deadline time.Duration) (context.Context, context.CancelFunc, error) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+
+	if d.status.Draining {
+		return nil, nil, fmt.Errorf("node is already draining since %s", d.status.Started)
+	}
+
+	now := time.Now()
+	d.status = DrainStatus{
+		Draining: true,
+		Started:  now,
+		Deadline: now.Add(deadline),
+		Phase:    "starting",
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), d.status.Deadline)
+	return ctx, cancel, nil
+}
+
+func (d *Drain) Draining() bool {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	return d.status.Draining
+}
+
+func (d *Drain) Status() DrainStatus {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	return d.status
+}
+
+func (d *Drain) SetPhase(phase string) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	d.status.Phase = phase
+	log.Infof("drain: %s", phase)
+}
+
+// Wait sets the current phase and polls done until it reports true, or
+// until ctx is done
+func (d *Drain) Wait(ctx context.Context, phase string, done func() (bool, error)) error {
+	d.SetPhase(phase)
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for {
+		ok, err := done()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("gave up %s: %w", phase, ctx.Err())
+		}
+	}
+}
+
+// Finish records the end of the drain, err is the reason it stopped short
+// of letting everything finish, if any
+func (d *Drain) Finish(err error) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+
+	d.status.Done = true
+	d.status.Phase = "drained"
+	if err != nil {
+		d.status.Error = err.Error()
+		log.Warnf("drain finished early: %s", err)
+		return
+	}
+	log.Infof("drain finished")
+}
+
+// Middleware rejects requests with a 503 once the node is draining, it
+// goes on the routes that take in new content
+func (d *Drain) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if d.Draining() {
+			c.Response().Header().Set("Retry-After", strconv.Itoa(int(drainRetryAfter.Seconds())))
+			return &HttpError{
+				Code:    http.StatusServiceUnavailable,
+				Reason:  ERR_NODE_DRAINING,
+				Details: "node is draining for maintenance and not accepting new content",
+			}
+		}
+		return next(c)
+	}
+}
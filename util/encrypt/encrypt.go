@@ -0,0 +1,258 @@
+// Package encrypt encrypts content with AES-256-GCM as a stream of
+// authenticated chunks, so it can be encrypted while it is imported and
+// decrypted while it is served, without holding it in memory.
+//
+// Encrypted data starts with a header of the magic "EST1" and a random
+// 8 byte nonce prefix. Each chunk of up to ChunkSize bytes of plaintext is
+// sealed with a nonce of the prefix and the big endian index of the chunk,
+// and the last chunk has an additional data of 1, so a stream that was cut
+// short does not decrypt.
+package encrypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Header is the request header uploads to encrypt and downloads to decrypt
+// carry the key of the user in. The key is never stored.
+const Header = "X-Estuary-Encryption-Key"
+
+const (
+	// KeySize is the size of keys, for AES-256
+	KeySize = 32
+	// ChunkSize is how much plaintext is sealed at a time
+	ChunkSize = 64 << 10
+
+	magic      = "EST1"
+	prefixSize = 8
+	headerSize = len(magic) + prefixSize
+	overhead   = 16
+)
+
+var (
+	ErrWrongKey     = errors.New("wrong key or corrupted data")
+	ErrNotEncrypted = errors.New("data is not encrypted by estuary")
+)
+
+// NewKey returns a random key
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ParseKey decodes a base64 key, padded or not, url safe or not
+func ParseKey(s string) ([]byte, error) {
+	s = strings.TrimRight(strings.TrimSpace(s), "=")
+	s = strings.NewReplacer("-", "+", "_", "/").Replace(s)
+	key, err := base64.RawStdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("keys must be base64 encoded: %w", err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("keys must be %d bytes, not %d", KeySize, len(key))
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("keys must be %d bytes, not %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// WrapKey encrypts key with kek, the key encryption key
+func WrapKey(kek, key []byte) ([]byte, error) {
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, key, nil), nil
+}
+
+// UnwrapKey decrypts a key wrapped with kek, failing with ErrWrongKey for
+// another kek
+func UnwrapKey(kek, wrapped []byte) ([]byte, error) {
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrWrongKey
+	}
+	key, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+	return key, nil
+}
+
+// EncryptedSize is the size of size bytes of plaintext once encrypted
+func EncryptedSize(size int64) int64 {
+	chunks := size/ChunkSize + 1
+	if size > 0 && size%ChunkSize == 0 {
+		chunks--
+	}
+	return int64(headerSize) + size + chunks*overhead
+}
+
+func nonce(prefix []byte, i uint32) []byte {
+	n := make([]byte, prefixSize+4)
+	copy(n, prefix)
+	binary.BigEndian.PutUint32(n[prefixSize:], i)
+	return n
+}
+
+func additionalData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+type streamReader struct {
+	src    *bufio.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	open   bool
+
+	index uint32
+	buf   []byte
+	out   bytes.Reader
+	done  bool
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	return r.out.Read(p)
+}
+
+// next seals or opens the next chunk into out
+func (r *streamReader) next() error {
+	n, err := io.ReadFull(r.src, r.buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	// the last chunk is the one nothing follows
+	_, perr := r.src.Peek(1)
+	last := perr == io.EOF
+	if perr != nil && perr != io.EOF {
+		return perr
+	}
+	if r.index == ^uint32(0) {
+		return errors.New("too many chunks")
+	}
+
+	nc := nonce(r.prefix, r.index)
+	var out []byte
+	if r.open {
+		if n < overhead {
+			return ErrWrongKey
+		}
+		out, err = r.aead.Open(nil, nc, r.buf[:n], additionalData(last))
+		if err != nil {
+			return ErrWrongKey
+		}
+	} else {
+		out = r.aead.Seal(nil, nc, r.buf[:n], additionalData(last))
+	}
+
+	r.index++
+	r.done = last
+	r.out.Reset(out)
+	return nil
+}
+
+// Encrypt returns a reader of src encrypted with key
+func Encrypt(src io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, prefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+
+	header := append([]byte(magic), prefix...)
+	return io.MultiReader(bytes.NewReader(header), &streamReader{
+		src:    bufio.NewReaderSize(src, ChunkSize),
+		aead:   aead,
+		prefix: prefix,
+		buf:    make([]byte, ChunkSize),
+	}), nil
+}
+
+// EncryptNewKey encrypts src with a new key, which it returns wrapped with
+// kek
+func EncryptNewKey(src io.Reader, kek []byte) (io.Reader, []byte, error) {
+	key, err := NewKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := WrapKey(kek, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := Encrypt(src, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r, wrapped, nil
+}
+
+// Decrypt returns a reader of src decrypted with key. Reads fail with
+// ErrWrongKey when the key is wrong or the data was tampered with.
+func Decrypt(src io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNotEncrypted
+		}
+		return nil, err
+	}
+	if string(header[:len(magic)]) != magic {
+		return nil, ErrNotEncrypted
+	}
+
+	return &streamReader{
+		src:    bufio.NewReaderSize(src, ChunkSize+overhead),
+		aead:   aead,
+		prefix: header[len(magic):],
+		open:   true,
+		buf:    make([]byte, ChunkSize+overhead),
+	}, nil
+}
@@ -0,0 +1,121 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTrip(t *testing.T) {
+	key, err := NewKey()
+	require.NoError(t, err)
+
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 100} {
+		plain := make([]byte, size)
+		_, err := rand.Read(plain)
+		require.NoError(t, err)
+
+		r, err := Encrypt(bytes.NewReader(plain), key)
+		require.NoError(t, err)
+		enc, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, EncryptedSize(int64(size)), int64(len(enc)), "size %d", size)
+
+		r, err = Decrypt(bytes.NewReader(enc), key)
+		require.NoError(t, err)
+		dec, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, plain, dec, "size %d", size)
+	}
+}
+
+func TestTampering(t *testing.T) {
+	key, err := NewKey()
+	require.NoError(t, err)
+	other, err := NewKey()
+	require.NoError(t, err)
+
+	plain := bytes.Repeat([]byte("estuary"), ChunkSize)
+	r, err := Encrypt(bytes.NewReader(plain), key)
+	require.NoError(t, err)
+	enc, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+
+	decrypt := func(data, key []byte) error {
+		r, err := Decrypt(bytes.NewReader(data), key)
+		if err != nil {
+			return err
+		}
+		_, err = ioutil.ReadAll(r)
+		return err
+	}
+
+	assert.Equal(t, ErrWrongKey, decrypt(enc, other))
+
+	flipped := append([]byte{}, enc...)
+	flipped[len(flipped)/2] ^= 1
+	assert.Equal(t, ErrWrongKey, decrypt(flipped, key))
+
+	// cut at a chunk boundary
+	assert.Equal(t, ErrWrongKey, decrypt(enc[:headerSize+ChunkSize+overhead], key))
+
+	assert.Equal(t, ErrNotEncrypted, decrypt(plain, key))
+}
+
+func TestWrapKey(t *testing.T) {
+	kek, err := NewKey()
+	require.NoError(t, err)
+	key, err := NewKey()
+	require.NoError(t, err)
+
+	wrapped, err := WrapKey(kek, key)
+	require.NoError(t, err)
+	unwrapped, err := UnwrapKey(kek, wrapped)
+	require.NoError(t, err)
+	assert.Equal(t, key, unwrapped)
+
+	other, err := NewKey()
+	require.NoError(t, err)
+	_, err = UnwrapKey(other, wrapped)
+	assert.Equal(t, ErrWrongKey, err)
+}
+
+func TestEncryptNewKey(t *testing.T) {
+	kek, err := NewKey()
+	require.NoError(t, err)
+
+	plain := bytes.Repeat([]byte("estuary"), 100)
+	r, wrapped, err := EncryptNewKey(bytes.NewReader(plain), kek)
+	require.NoError(t, err)
+	enc, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+
+	key, err := UnwrapKey(kek, wrapped)
+	require.NoError(t, err)
+	r, err = Decrypt(bytes.NewReader(enc), key)
+	require.NoError(t, err)
+	dec, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, plain, dec)
+}
+
+func TestParseKey(t *testing.T) {
+	key, err := NewKey()
+	require.NoError(t, err)
+
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		parsed, err := ParseKey(enc.EncodeToString(key))
+		require.NoError(t, err)
+		assert.Equal(t, key, parsed)
+	}
+
+	_, err = ParseKey(base64.StdEncoding.EncodeToString(key[:16]))
+	assert.Error(t, err)
+	_, err = ParseKey("not base64!")
+	assert.Error(t, err)
+}
@@ -0,0 +1,280 @@
+// Package fetchstats records how the blocks of a pin were fetched, which
+// providers sent them, how many were sent more than once and how often the
+// fetch sat waiting on a block, so that a slow pin can be put down to bad
+// providers rather than to the node itself.
+package fetchstats
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// DefaultStallThreshold is how long a block request may wait before it
+// counts as a stall
+const DefaultStallThreshold = time.Second * 10
+
+// recentBlocks is how many of the blocks a pin is done with are remembered,
+// to tell duplicates that arrive after a block was already handed over
+const recentBlocks = 4096
+
+type ProviderStats struct {
+	Blocks     int64 `json:"blocks"`
+	Bytes      int64 `json:"bytes"`
+	Duplicates int64 `json:"duplicates"`
+}
+
+type Stats struct {
+	// Blocks is how many blocks the pin walked, LocalBlocks of them were
+	// already in the blockstore and NetworkBlocks were fetched over bitswap
+	Blocks        int64 `json:"blocks"`
+	LocalBlocks   int64 `json:"localBlocks"`
+	NetworkBlocks int64 `json:"networkBlocks"`
+	NetworkBytes  int64 `json:"networkBytes"`
+	// DuplicateBlocks were received again after another provider had
+	// already sent them
+	DuplicateBlocks int64 `json:"duplicateBlocks"`
+	DuplicateBytes  int64 `json:"duplicateBytes"`
+	// Stalls is how many block requests waited longer than the stall
+	// threshold, StallMillis is the total time they waited
+	Stalls        int64 `json:"stalls"`
+	StallMillis   int64 `json:"stallMs"`
+	SlowestMillis int64 `json:"slowestMs"`
+	// Providers is keyed by peer id
+	Providers map[string]*ProviderStats `json:"providers"`
+}
+
+// Recorder collects the stats of a single pin. Block requests are seen
+// through the node getter returned by Getter, blocks arriving over bitswap
+// are handed to it by a Tracer it is tracked by.
+type Recorder struct {
+	stallThreshold time.Duration
+
+	lk sync.Mutex
+	// wanted are the cids requested by the pin that it is still waiting
+	// on, and whether they have arrived over bitswap yet. Once a request is
+	// done its cid moves to recent, which only keeps the last recentBlocks
+	// of them in the order they were done, so a pin of any size is tracked
+	// in bounded memory.
+	wanted      map[cid.Cid]bool
+	recent      map[cid.Cid]bool
+	recentOrder []cid.Cid
+	stats       Stats
+}
+
+func NewRecorder(stallThreshold time.Duration) *Recorder {
+	return &Recorder{
+		stallThreshold: stallThreshold,
+		wanted:         make(map[cid.Cid]bool),
+		recent:         make(map[cid.Cid]bool),
+		stats: Stats{
+			Providers: make(map[string]*ProviderStats),
+		},
+	}
+}
+
+func (r *Recorder) want(c cid.Cid) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	if _, ok := r.wanted[c]; !ok {
+		r.wanted[c] = r.recent[c]
+	}
+}
+
+// done is called once the request for c returned
+func (r *Recorder) done(c cid.Cid) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	got, ok := r.wanted[c]
+	if !ok {
+		return
+	}
+	delete(r.wanted, c)
+	r.remember(c, got)
+}
+
+func (r *Recorder) remember(c cid.Cid, got bool) {
+	if _, ok := r.recent[c]; !ok {
+		if len(r.recentOrder) >= recentBlocks {
+			delete(r.recent, r.recentOrder[0])
+			r.recentOrder = r.recentOrder[1:]
+		}
+		r.recentOrder = append(r.recentOrder, c)
+	}
+	r.recent[c] = got
+}
+
+func (r *Recorder) fetched(took time.Duration, ok bool) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	if ok {
+		r.stats.Blocks++
+	}
+	if ms := took.Milliseconds(); ms > r.stats.SlowestMillis {
+		r.stats.SlowestMillis = ms
+	}
+	if took >= r.stallThreshold {
+		r.stats.Stalls++
+		r.stats.StallMillis += took.Milliseconds()
+	}
+}
+
+func (r *Recorder) received(p peer.ID, b blocks.Block) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	set := r.wanted
+	got, ok := r.wanted[b.Cid()]
+	if !ok {
+		set = r.recent
+		if got, ok = r.recent[b.Cid()]; !ok {
+			return
+		}
+	}
+
+	ps, ok := r.stats.Providers[p.Pretty()]
+	if !ok {
+		ps = &ProviderStats{}
+		r.stats.Providers[p.Pretty()] = ps
+	}
+
+	size := int64(len(b.RawData()))
+	if got {
+		ps.Duplicates++
+		r.stats.DuplicateBlocks++
+		r.stats.DuplicateBytes += size
+		return
+	}
+
+	set[b.Cid()] = true
+	ps.Blocks++
+	ps.Bytes += size
+	r.stats.NetworkBlocks++
+	r.stats.NetworkBytes += size
+}
+
+// Stats returns a copy of the stats collected so far
+func (r *Recorder) Stats() *Stats {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	st := r.stats
+	st.Providers = make(map[string]*ProviderStats, len(r.stats.Providers))
+	for p, ps := range r.stats.Providers {
+		cp := *ps
+		st.Providers[p] = &cp
+	}
+	if st.Blocks > st.NetworkBlocks {
+		st.LocalBlocks = st.Blocks - st.NetworkBlocks
+	}
+	return &st
+}
+
+// Getter wraps the node getter a pin is fetched through so its requests are
+// recorded
+func (r *Recorder) Getter(ng ipld.NodeGetter) ipld.NodeGetter {
+	return &getter{NodeGetter: ng, r: r}
+}
+
+type getter struct {
+	ipld.NodeGetter
+	r *Recorder
+}
+
+func (g *getter) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	g.r.want(c)
+	defer g.r.done(c)
+
+	start := time.Now()
+	nd, err := g.NodeGetter.Get(ctx, c)
+	g.r.fetched(time.Since(start), err == nil)
+	return nd, err
+}
+
+func (g *getter) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	for _, c := range cids {
+		g.r.want(c)
+	}
+
+	in := g.NodeGetter.GetMany(ctx, cids)
+	out := make(chan *ipld.NodeOption, len(cids))
+	go func() {
+		defer close(out)
+		defer func() {
+			// failed requests don't say which cid they were for
+			for _, c := range cids {
+				g.r.done(c)
+			}
+		}()
+
+		// the wait between results is what a stall looks like here
+		last := time.Now()
+		for no := range in {
+			g.r.fetched(time.Since(last), no.Err == nil)
+			last = time.Now()
+			if no.Err == nil {
+				g.r.done(no.Node.Cid())
+			}
+			out <- no
+		}
+	}()
+	return out
+}
+
+// Tracer is a bitswap tracer that hands the blocks bitswap receives to the
+// recorders of the pins in progress
+type Tracer struct {
+	lk        sync.RWMutex
+	recorders map[*Recorder]struct{}
+}
+
+func NewTracer() *Tracer {
+	return &Tracer{
+		recorders: make(map[*Recorder]struct{}),
+	}
+}
+
+// Track starts handing blocks to r until the returned func is called. It
+// is safe to call on a nil tracer, which tracks nothing.
+func (t *Tracer) Track(r *Recorder) func() {
+	if t == nil {
+		return func() {}
+	}
+
+	t.lk.Lock()
+	t.recorders[r] = struct{}{}
+	t.lk.Unlock()
+
+	return func() {
+		t.lk.Lock()
+		delete(t.recorders, r)
+		t.lk.Unlock()
+	}
+}
+
+func (t *Tracer) MessageReceived(p peer.ID, msg bsmsg.BitSwapMessage) {
+	blks := msg.Blocks()
+	if len(blks) == 0 {
+		return
+	}
+
+	t.lk.RLock()
+	defer t.lk.RUnlock()
+
+	for r := range t.recorders {
+		for _, b := range blks {
+			r.received(p, b)
+		}
+	}
+}
+
+func (t *Tracer) MessageSent(peer.ID, bsmsg.BitSwapMessage) {}
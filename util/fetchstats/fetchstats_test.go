@@ -0,0 +1,118 @@
+package fetchstats
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	mdtest "github.com/ipfs/go-merkledag/test"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecorder(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	ds := mdtest.Mock()
+	a := merkledag.NewRawNode([]byte("a"))
+	b := merkledag.NewRawNode([]byte("bb"))
+	c := merkledag.NewRawNode([]byte("ccc"))
+	for _, nd := range []*merkledag.RawNode{a, b, c} {
+		assert.NoError(ds.Add(ctx, nd))
+	}
+
+	tr := NewTracer()
+	r := NewRecorder(time.Hour)
+	untrack := tr.Track(r)
+
+	ng := r.Getter(ds)
+	_, err := ng.Get(ctx, a.Cid())
+	assert.NoError(err)
+	for no := range ng.GetMany(ctx, []cid.Cid{b.Cid(), c.Cid()}) {
+		assert.NoError(no.Err)
+	}
+
+	p1 := peer.ID("provider-1")
+	p2 := peer.ID("provider-2")
+
+	m := bsmsg.New(false)
+	m.AddBlock(a)
+	m.AddBlock(b)
+	tr.MessageReceived(p1, m)
+
+	// b arrives a second time from another provider, and a block nobody
+	// asked for is ignored
+	m = bsmsg.New(false)
+	m.AddBlock(b)
+	m.AddBlock(merkledag.NewRawNode([]byte("other")))
+	tr.MessageReceived(p2, m)
+
+	untrack()
+	m = bsmsg.New(false)
+	m.AddBlock(c)
+	tr.MessageReceived(p2, m)
+
+	st := r.Stats()
+	assert.Equal(int64(3), st.Blocks)
+	assert.Equal(int64(2), st.NetworkBlocks)
+	assert.Equal(int64(1), st.LocalBlocks)
+	assert.Equal(int64(3), st.NetworkBytes)
+	assert.Equal(int64(1), st.DuplicateBlocks)
+	assert.Equal(int64(0), st.Stalls)
+
+	assert.Equal(&ProviderStats{Blocks: 2, Bytes: 3}, st.Providers[p1.Pretty()])
+	assert.Equal(&ProviderStats{Duplicates: 1}, st.Providers[p2.Pretty()])
+
+	r = NewRecorder(0)
+	_, err = r.Getter(ds).Get(ctx, a.Cid())
+	assert.NoError(err)
+	assert.Equal(int64(1), r.Stats().Stalls)
+
+	var nilTracer *Tracer
+	nilTracer.Track(r)()
+}
+
+func TestRecorderBounded(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	ds := mdtest.Mock()
+
+	tr := NewTracer()
+	r := NewRecorder(time.Hour)
+	defer tr.Track(r)()
+	ng := r.Getter(ds)
+
+	p := peer.ID("provider")
+	var first *merkledag.RawNode
+	for i := 0; i < recentBlocks*2; i++ {
+		nd := merkledag.NewRawNode([]byte(fmt.Sprintf("block %d", i)))
+		if first == nil {
+			first = nd
+		}
+		assert.NoError(ds.Add(ctx, nd))
+		_, err := ng.Get(ctx, nd.Cid())
+		assert.NoError(err)
+
+		m := bsmsg.New(false)
+		m.AddBlock(nd)
+		tr.MessageReceived(p, m)
+	}
+
+	r.lk.Lock()
+	assert.Len(r.wanted, 0)
+	assert.Len(r.recent, recentBlocks)
+	r.lk.Unlock()
+
+	// a block done with long ago is no longer told apart as a duplicate
+	m := bsmsg.New(false)
+	m.AddBlock(first)
+	tr.MessageReceived(p, m)
+	st := r.Stats()
+	assert.Equal(int64(recentBlocks*2), st.NetworkBlocks)
+	assert.Equal(int64(0), st.DuplicateBlocks)
+}
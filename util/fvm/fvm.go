@@ -0,0 +1,245 @@
+// Package fvm sends deal lifecycle attestations to a smart contract on the
+// Filecoin EVM, through the ethereum JSON-RPC API of a Filecoin node. The
+// contract is called with
+//
+//	attestDeal(bytes cid, uint64 dealId, uint64 provider, uint8 status)
+//
+// where provider is the actor id of the storage provider and status is one
+// of the Deal* constants, so that contracts like DataDAOs can act once
+// content is stored.
+package fvm
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// AttestSignature is the contract function attestations are sent to
+const AttestSignature = "attestDeal(bytes,uint64,uint64,uint8)"
+
+// deal statuses attested to
+const (
+	DealPublished uint8 = 1
+	DealActive    uint8 = 2
+)
+
+// ErrPending is returned for transactions that are not in a block yet
+var ErrPending = xerrors.New("transaction is pending")
+
+// Attestation is the state of a deal attested to
+type Attestation struct {
+	Cid      []byte
+	DealID   uint64
+	Provider uint64
+	Status   uint8
+}
+
+// Client sends attestations to the contract at contract, from the account
+// of key
+type Client struct {
+	endpoint string
+	contract [20]byte
+	key      []byte
+	from     [20]byte
+	client   *http.Client
+
+	lk      sync.Mutex
+	chainID *big.Int
+}
+
+// New sets up a client, chainID 0 asks the node for it
+func New(endpoint, contract string, key []byte, chainID int64, timeout time.Duration) (*Client, error) {
+	to, err := ParseAddress(contract)
+	if err != nil {
+		return nil, fmt.Errorf("invalid contract address: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("private key must be 32 bytes, got %d", len(key))
+	}
+
+	c := &Client{
+		endpoint: endpoint,
+		contract: to,
+		key:      key,
+		from:     AddressOf(key),
+		client:   &http.Client{Timeout: timeout},
+	}
+	if chainID != 0 {
+		c.chainID = big.NewInt(chainID)
+	}
+	return c, nil
+}
+
+// ParseAddress parses a 0x prefixed hex ethereum address
+func ParseAddress(s string) ([20]byte, error) {
+	var addr [20]byte
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		return addr, err
+	}
+	if len(b) != len(addr) {
+		return addr, fmt.Errorf("address must be 20 bytes, got %d", len(b))
+	}
+	copy(addr[:], b)
+	return addr, nil
+}
+
+// ParseKey parses a hex encoded private key, as kept in a key file
+func ParseKey(s string) ([]byte, error) {
+	return hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(s), "0x"))
+}
+
+// From is the address attestations are sent from, it has to hold funds for
+// gas
+func (c *Client) From() string {
+	return "0x" + hex.EncodeToString(c.from[:])
+}
+
+// Attest sends an attestation and returns the hash of its transaction.
+// Attestations are sent one at a time so that nonces don't collide.
+func (c *Client) Attest(ctx context.Context, a Attestation) (string, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if c.chainID == nil {
+		id, err := c.quantity(ctx, "eth_chainId")
+		if err != nil {
+			return "", fmt.Errorf("getting chain id: %w", err)
+		}
+		c.chainID = id
+	}
+
+	data := encodeCall(Selector(AttestSignature), a.Cid, a.DealID, a.Provider, uint64(a.Status))
+	from, to := c.From(), "0x"+hex.EncodeToString(c.contract[:])
+
+	nonce, err := c.quantity(ctx, "eth_getTransactionCount", from, "pending")
+	if err != nil {
+		return "", fmt.Errorf("getting nonce: %w", err)
+	}
+	tip, err := c.quantity(ctx, "eth_maxPriorityFeePerGas")
+	if err != nil {
+		return "", fmt.Errorf("getting priority fee: %w", err)
+	}
+	price, err := c.quantity(ctx, "eth_gasPrice")
+	if err != nil {
+		return "", fmt.Errorf("getting gas price: %w", err)
+	}
+	gas, err := c.quantity(ctx, "eth_estimateGas", map[string]string{
+		"from": from,
+		"to":   to,
+		"data": "0x" + hex.EncodeToString(data),
+	})
+	if err != nil {
+		return "", fmt.Errorf("estimating gas: %w", err)
+	}
+
+	t := &tx{
+		ChainID:              c.chainID,
+		Nonce:                nonce.Uint64(),
+		MaxPriorityFeePerGas: tip,
+		// leave room for the base fee to go up before the tx lands
+		MaxFeePerGas: new(big.Int).Mul(price, big.NewInt(2)),
+		Gas:          gas.Uint64(),
+		To:           c.contract,
+		Value:        new(big.Int),
+		Data:         data,
+	}
+	raw, err := t.sign(c.key)
+	if err != nil {
+		return "", err
+	}
+
+	var hash string
+	if err := c.call(ctx, &hash, "eth_sendRawTransaction", "0x"+hex.EncodeToString(raw)); err != nil {
+		return "", fmt.Errorf("sending transaction: %w", err)
+	}
+	return hash, nil
+}
+
+// Confirmed reports whether the transaction with the given hash succeeded,
+// ErrPending is returned until it is in a block
+func (c *Client) Confirmed(ctx context.Context, hash string) (bool, error) {
+	var receipt *struct {
+		Status string `json:"status"`
+	}
+	if err := c.call(ctx, &receipt, "eth_getTransactionReceipt", hash); err != nil {
+		return false, err
+	}
+	if receipt == nil {
+		return false, ErrPending
+	}
+	return receipt.Status == "0x1", nil
+}
+
+type rpcRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      int           `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (c *Client) call(ctx context.Context, out interface{}, method string, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	body, err := json.Marshal(&rpcRequest{JSONRPC: "2.0", ID: 1, Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", method, resp.StatusCode)
+	}
+
+	var rr rpcResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rr); err != nil {
+		return err
+	}
+	if rr.Error != nil {
+		return fmt.Errorf("%s failed: %s (%d)", method, rr.Error.Message, rr.Error.Code)
+	}
+	return json.Unmarshal(rr.Result, out)
+}
+
+// quantity calls a method that returns a hex encoded number
+func (c *Client) quantity(ctx context.Context, method string, params ...interface{}) (*big.Int, error) {
+	var s string
+	if err := c.call(ctx, &s, method, params...); err != nil {
+		return nil, err
+	}
+	v, ok := new(big.Int).SetString(strings.TrimPrefix(s, "0x"), 16)
+	if !ok {
+		return nil, fmt.Errorf("%s returned invalid quantity %q", method, s)
+	}
+	return v, nil
+}
@@ -0,0 +1,123 @@
+package fvm
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	crypto "github.com/filecoin-project/go-crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the private key of the EIP-155 example
+const testKey = "4646464646464646464646464646464646464646464646464646464646464646"
+
+func TestEncoding(t *testing.T) {
+	assert.Equal(t, "a9059cbb", hex.EncodeToString(Selector("transfer(address,uint256)")))
+
+	assert.Equal(t, "83646f67", hex.EncodeToString(rlpEncode([]byte("dog"))))
+	assert.Equal(t, "c88363617483646f67", hex.EncodeToString(rlpEncode(rlpList{[]byte("cat"), []byte("dog")})))
+	assert.Equal(t, "80", hex.EncodeToString(rlpEncode(uint64(0))))
+	assert.Equal(t, "820400", hex.EncodeToString(rlpEncode(uint64(1024))))
+	long := rlpEncode([]byte(strings.Repeat("a", 56)))
+	assert.Equal(t, "b838", hex.EncodeToString(long[:2]))
+
+	call := encodeCall(Selector(AttestSignature), []byte{1, 2, 3}, 7, 1000, 2)
+	require.Len(t, call, 4+32*6)
+	assert.Equal(t, abiWord(128), call[4:36], "bytes are after the four head words")
+	assert.Equal(t, abiWord(7), call[36:68])
+	assert.Equal(t, abiWord(3), call[132:164])
+	assert.Equal(t, []byte{1, 2, 3}, call[164:167])
+}
+
+func TestSign(t *testing.T) {
+	key, err := ParseKey("0x" + testKey + "\n")
+	require.NoError(t, err)
+	addr := AddressOf(key)
+	assert.Equal(t, "9d8a62f656a8d1615c1294fd71e9cfb3e4855a4f", hex.EncodeToString(addr[:]))
+
+	tx := &tx{
+		ChainID:              big.NewInt(314),
+		Nonce:                9,
+		MaxPriorityFeePerGas: big.NewInt(100),
+		MaxFeePerGas:         big.NewInt(2000),
+		Gas:                  21000,
+		Value:                big.NewInt(0),
+	}
+	raw, err := tx.sign(key)
+	require.NoError(t, err)
+	assert.Equal(t, byte(0x02), raw[0])
+
+	sig, err := crypto.Sign(key, tx.sigHash())
+	require.NoError(t, err)
+	pub, err := crypto.EcRecover(tx.sigHash(), sig)
+	require.NoError(t, err)
+	assert.Equal(t, crypto.PublicKey(key), pub)
+}
+
+func TestAttest(t *testing.T) {
+	ctx := context.Background()
+
+	var sent []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req rpcRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+
+		var result interface{}
+		switch req.Method {
+		case "eth_chainId":
+			result = "0x13a"
+		case "eth_getTransactionCount":
+			assert.Equal(t, "0x9d8a62f656a8d1615c1294fd71e9cfb3e4855a4f", req.Params[0])
+			result = "0x3"
+		case "eth_maxPriorityFeePerGas":
+			result = "0x64"
+		case "eth_gasPrice":
+			result = "0x3e8"
+		case "eth_estimateGas":
+			result = "0x5208"
+		case "eth_sendRawTransaction":
+			sent = append(sent, req.Params[0].(string))
+			result = "0xabcd"
+		case "eth_getTransactionReceipt":
+			if req.Params[0] == "0xabcd" {
+				result = map[string]string{"status": "0x1"}
+			}
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{ //nolint:errcheck
+				"error": map[string]interface{}{"code": -32601, "message": "method not found"},
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": result}) //nolint:errcheck
+	}))
+	defer srv.Close()
+
+	key, err := ParseKey(testKey)
+	require.NoError(t, err)
+	c, err := New(srv.URL, "0x00000000000000000000000000000000000000ff", key, 0, time.Second*5)
+	require.NoError(t, err)
+
+	hash, err := c.Attest(ctx, Attestation{Cid: []byte{1, 2, 3}, DealID: 7, Provider: 1000, Status: DealActive})
+	require.NoError(t, err)
+	assert.Equal(t, "0xabcd", hash)
+	require.Len(t, sent, 1)
+	assert.True(t, strings.HasPrefix(sent[0], "0x02"))
+
+	ok, err := c.Confirmed(ctx, hash)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	_, err = c.Confirmed(ctx, "0xffff")
+	assert.ErrorIs(t, err, ErrPending)
+
+	_, err = New(srv.URL, "0x1234", key, 0, time.Second)
+	assert.Error(t, err)
+}
@@ -0,0 +1,140 @@
+package fvm
+
+import (
+	"encoding/binary"
+	"math/big"
+
+	crypto "github.com/filecoin-project/go-crypto"
+	"golang.org/x/crypto/sha3"
+)
+
+func keccak256(data ...[]byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	for _, d := range data {
+		h.Write(d) //nolint:errcheck
+	}
+	return h.Sum(nil)
+}
+
+// Selector is the 4 byte selector of a contract function signature like
+// "transfer(address,uint256)"
+func Selector(sig string) []byte {
+	return keccak256([]byte(sig))[:4]
+}
+
+// AddressOf is the ethereum address of a secp256k1 private key
+func AddressOf(key []byte) [20]byte {
+	var addr [20]byte
+	// the public key is uncompressed, 0x04 followed by x and y
+	copy(addr[:], keccak256(crypto.PublicKey(key)[1:])[12:])
+	return addr
+}
+
+// rlp values are either byte strings or lists of rlp values
+type rlpList []interface{}
+
+func rlpEncode(v interface{}) []byte {
+	switch v := v.(type) {
+	case []byte:
+		if len(v) == 1 && v[0] < 0x80 {
+			return v
+		}
+		return append(rlpHeader(0x80, len(v)), v...)
+	case *big.Int:
+		return rlpEncode(v.Bytes())
+	case uint64:
+		return rlpEncode(new(big.Int).SetUint64(v).Bytes())
+	case rlpList:
+		var body []byte
+		for _, e := range v {
+			body = append(body, rlpEncode(e)...)
+		}
+		return append(rlpHeader(0xc0, len(body)), body...)
+	default:
+		panic("unsupported rlp value")
+	}
+}
+
+func rlpHeader(base byte, n int) []byte {
+	if n < 56 {
+		return []byte{base + byte(n)}
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(n))
+	l := b[:]
+	for len(l) > 1 && l[0] == 0 {
+		l = l[1:]
+	}
+	return append([]byte{base + 55 + byte(len(l))}, l...)
+}
+
+// abiWord pads an unsigned integer to a 32 byte abi word
+func abiWord(v uint64) []byte {
+	w := make([]byte, 32)
+	binary.BigEndian.PutUint64(w[24:], v)
+	return w
+}
+
+// encodeCall abi encodes a call of a function taking a bytes argument
+// followed by static unsigned integers
+func encodeCall(selector []byte, b []byte, uints ...uint64) []byte {
+	out := append([]byte{}, selector...)
+	// the bytes argument lives after the head, its slot holds the offset
+	out = append(out, abiWord(uint64(32*(1+len(uints))))...)
+	for _, u := range uints {
+		out = append(out, abiWord(u)...)
+	}
+	out = append(out, abiWord(uint64(len(b)))...)
+	out = append(out, b...)
+	if pad := len(b) % 32; pad != 0 {
+		out = append(out, make([]byte, 32-pad)...)
+	}
+	return out
+}
+
+// tx is an EIP-1559 transaction
+type tx struct {
+	ChainID              *big.Int
+	Nonce                uint64
+	MaxPriorityFeePerGas *big.Int
+	MaxFeePerGas         *big.Int
+	Gas                  uint64
+	To                   [20]byte
+	Value                *big.Int
+	Data                 []byte
+}
+
+func (t *tx) fields() rlpList {
+	return rlpList{
+		t.ChainID,
+		t.Nonce,
+		t.MaxPriorityFeePerGas,
+		t.MaxFeePerGas,
+		t.Gas,
+		t.To[:],
+		t.Value,
+		t.Data,
+		rlpList{}, // access list
+	}
+}
+
+// sigHash is the hash the sender signs
+func (t *tx) sigHash() []byte {
+	return keccak256([]byte{0x02}, rlpEncode(t.fields()))
+}
+
+// sign returns the raw signed transaction as sent to eth_sendRawTransaction
+func (t *tx) sign(key []byte) ([]byte, error) {
+	sig, err := crypto.Sign(key, t.sigHash())
+	if err != nil {
+		return nil, err
+	}
+
+	// the signature is r, s and the recovery id
+	fields := append(t.fields(),
+		uint64(sig[64]),
+		new(big.Int).SetBytes(sig[:32]),
+		new(big.Int).SetBytes(sig[32:64]),
+	)
+	return append([]byte{0x02}, rlpEncode(fields)...), nil
+}
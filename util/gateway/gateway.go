@@ -9,17 +9,20 @@ import (
 	"strings"
 	"time"
 
+	"github.com/application-research/estuary/util/carindex"
 	"github.com/ipfs/go-blockservice"
 	"github.com/ipfs/go-cid"
 	bsfetcher "github.com/ipfs/go-fetcher/impl/blockservice"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	mdagipld "github.com/ipfs/go-ipld-format"
+	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipfs/go-merkledag"
 	"github.com/ipfs/go-path"
 	resolver "github.com/ipfs/go-path/resolver"
 	unixfs "github.com/ipfs/go-unixfs"
 	uio "github.com/ipfs/go-unixfs/io"
 	"github.com/ipfs/go-unixfsnode"
+	car "github.com/ipld/go-car"
 	dagpb "github.com/ipld/go-codec-dagpb"
 	"github.com/ipld/go-ipld-prime"
 	ipldbasicnode "github.com/ipld/go-ipld-prime/node/basic"
@@ -27,10 +30,22 @@ import (
 	"golang.org/x/xerrors"
 )
 
+var log = logging.Logger("gateway")
+
+const (
+	acceptRaw = "application/vnd.ipld.raw"
+	acceptCar = "application/vnd.ipld.car"
+)
+
 type GatewayHandler struct {
 	bs       blockstore.Blockstore
 	dserv    mdagipld.DAGService
 	resolver *resolver.Resolver
+	// layouts has the CAR layouts of the pieces computed here, cars of their
+	// roots are served from them
+	layouts *carindex.Store
+
+	selective chan struct{}
 }
 
 type httpError struct {
@@ -38,10 +53,28 @@ type httpError struct {
 	Message string
 }
 
+func (e *httpError) Error() string {
+	return e.Message
+}
+
 func NewGatewayHandler(bs blockstore.Blockstore) *GatewayHandler {
+	return &GatewayHandler{
+		bs:       bs,
+		dserv:    merkledag.NewDAGService(blockservice.New(bs, nil)),
+		resolver: newResolver(bs),
 
-	bsvc := blockservice.New(bs, nil)
-	ipldFetcher := bsfetcher.NewFetcherConfig(bsvc)
+		selective: make(chan struct{}, maxSelectiveRequests),
+	}
+}
+
+// UseCarIndexes serves cars of roots with a stored layout from it, ranges
+// of them included, rather than walking their DAG
+func (gw *GatewayHandler) UseCarIndexes(st *carindex.Store) {
+	gw.layouts = st
+}
+
+func newResolver(bs blockstore.Blockstore) *resolver.Resolver {
+	ipldFetcher := bsfetcher.NewFetcherConfig(blockservice.New(bs, nil))
 
 	ipldFetcher.PrototypeChooser = dagpb.AddSupportToChooser(func(lnk ipld.Link, lnkCtx ipld.LinkContext) (ipld.NodePrototype, error) {
 		if tlnkNd, ok := lnkCtx.LinkNode.(schema.TypedLinkNode); ok {
@@ -49,37 +82,114 @@ func NewGatewayHandler(bs blockstore.Blockstore) *GatewayHandler {
 		}
 		return ipldbasicnode.Prototype.Any, nil
 	})
-
-	return &GatewayHandler{
-		bs:       bs,
-		dserv:    merkledag.NewDAGService(bsvc),
-		resolver: resolver.NewBasicResolver(ipldFetcher.WithReifier(unixfsnode.Reify)),
-	}
+	return resolver.NewBasicResolver(ipldFetcher.WithReifier(unixfsnode.Reify))
 }
 
 func (gw *GatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err := gw.handleRequest(r.Context(), w, r); err != nil {
-		http.Error(w, "error: "+err.Error(), 500)
+		http.Error(w, "error: "+err.Error(), ErrorCode(err))
 		return
 	}
 }
 
+// ErrorCode returns the status an error of the handler is served with
+func ErrorCode(err error) int {
+	var herr *httpError
+	if errors.As(err, &herr) {
+		return herr.Code
+	}
+	return http.StatusInternalServerError
+}
+
 func (gw *GatewayHandler) handleRequest(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if sel := r.URL.Query().Get("selector"); sel != "" {
+		return gw.serveSelective(ctx, w, r, sel)
+	}
+
 	cc, err := gw.resolvePath(ctx, r.URL.Path)
 	if err != nil {
 		return fmt.Errorf("path resolution failed: %w", err)
 	}
 
-	output := "unixfs"
-
-	switch output {
+	switch outputFormat(r) {
 	case "unixfs":
 		return gw.serveUnixfs(ctx, cc, w, r)
+	case "car":
+		return gw.serveCar(ctx, cc, w, r)
+	case "raw":
+		return gw.serveRawBlock(ctx, cc, w)
 	default:
 		return fmt.Errorf("requested output type unsupported")
 	}
 }
 
+// outputFormat picks the response format from the format query parameter
+// or the Accept header, like the trustless gateway api does
+func outputFormat(r *http.Request) string {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f
+	}
+
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, acceptCar):
+		return "car"
+	case strings.Contains(accept, acceptRaw):
+		return "raw"
+	default:
+		return "unixfs"
+	}
+}
+
+func (gw *GatewayHandler) serveRawBlock(ctx context.Context, cc cid.Cid, w http.ResponseWriter) error {
+	blk, err := gw.bs.Get(ctx, cc)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", acceptRaw)
+	_, err = w.Write(blk.RawData())
+	return err
+}
+
+// serveCar streams the DAG under cc as a car, written block by block as it
+// is read from the blockstore so nothing is buffered beyond what the client
+// takes. A DAG that isn't all here is cut off at the first missing block,
+// clients fetching with resumption pick up the rest elsewhere. Roots with a
+// stored layout are served from it, with ranges.
+func (gw *GatewayHandler) serveCar(ctx context.Context, cc cid.Cid, w http.ResponseWriter, r *http.Request) error {
+	has, err := gw.bs.Has(ctx, cc)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return fmt.Errorf("root %s not found", cc)
+	}
+
+	if gw.layouts != nil {
+		l, err := gw.layouts.Get(cc)
+		if err == nil {
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			if err := carindex.Serve(w, r, l, gw.bs.Get); err != nil {
+				log.Warnw("car stream ended early", "root", cc, "err", err)
+			}
+			return nil
+		}
+		if !errors.Is(err, carindex.ErrNotFound) {
+			log.Warnw("failed to read car index", "root", cc, "err", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", acceptCar)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if err := car.WriteCar(ctx, gw.dserv, []cid.Cid{cc}, w); err != nil {
+		// the headers are out already, all that is left is to end the car
+		// early
+		log.Warnw("car stream ended early", "root", cc, "err", err)
+	}
+	return nil
+}
+
 func (gw *GatewayHandler) serveUnixfs(ctx context.Context, cc cid.Cid, w http.ResponseWriter, req *http.Request) error {
 	nd, err := gw.dserv.Get(ctx, cc)
 	if err != nil {
@@ -148,7 +258,17 @@ func (gw *GatewayHandler) serveUnixfsDir(ctx context.Context, n mdagipld.Node, w
 	return nil
 }
 
+// Resolve returns the cid a gateway path resolves to, going by the blocks
+// the handler has
+func (gw *GatewayHandler) Resolve(ctx context.Context, p string) (cid.Cid, error) {
+	return gw.resolvePath(ctx, p)
+}
+
 func (gw *GatewayHandler) resolvePath(ctx context.Context, p string) (cid.Cid, error) {
+	return resolvePathWith(ctx, gw.resolver, p)
+}
+
+func resolvePathWith(ctx context.Context, r *resolver.Resolver, p string) (cid.Cid, error) {
 	proto, _, _, err := ParsePath(p) // a sanity check
 	if err != nil {
 		return cid.Undef, fmt.Errorf("failed to parse request path: %w", err)
@@ -159,7 +279,7 @@ func (gw *GatewayHandler) resolvePath(ctx context.Context, p string) (cid.Cid, e
 		return cid.Undef, fmt.Errorf("failed to parse request path: %w", err)
 	}
 
-	cc, segs, err := gw.resolver.ResolveToLastNode(ctx, pp)
+	cc, segs, err := r.ResolveToLastNode(ctx, pp)
 	if err != nil {
 		return cid.Undef, err
 	}
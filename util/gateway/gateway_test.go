@@ -0,0 +1,208 @@
+package gateway
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/util/dirtree"
+	"github.com/application-research/estuary/util/httpfetch"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-merkledag"
+	car "github.com/ipld/go-car"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newBlockstore() blockstore.Blockstore {
+	return blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+}
+
+func TestServeCar(t *testing.T) {
+	ctx := context.Background()
+
+	full := newBlockstore()
+	partial := newBlockstore()
+	root := merkledag.NodeWithData([]byte{0x08, 0x01})
+	var all []cid.Cid
+	for i := 0; i < 8; i++ {
+		leaf := merkledag.NewRawNode(bytes.Repeat([]byte{byte(i)}, 100))
+		require.NoError(t, full.Put(ctx, leaf))
+		if i < 4 {
+			require.NoError(t, partial.Put(ctx, leaf))
+		}
+		require.NoError(t, root.AddNodeLink("", leaf))
+		all = append(all, leaf.Cid())
+	}
+	require.NoError(t, full.Put(ctx, root))
+	require.NoError(t, partial.Put(ctx, root))
+	all = append(all, root.Cid())
+
+	fullSrv := httptest.NewServer(NewGatewayHandler(full))
+	defer fullSrv.Close()
+	partialSrv := httptest.NewServer(NewGatewayHandler(partial))
+	defer partialSrv.Close()
+
+	// the partial node cuts its car off at the first missing block, the
+	// rest comes from the one that has it all
+	bs := newBlockstore()
+	err := httpfetch.New([]string{partialSrv.URL, fullSrv.URL}, time.Second*10).FetchCAR(ctx, root.Cid(), bs, func(int64) {})
+	require.NoError(t, err)
+	for _, c := range all {
+		has, err := bs.Has(ctx, c)
+		require.NoError(t, err)
+		assert.True(t, has)
+	}
+
+	blk, err := httpfetch.New([]string{fullSrv.URL}, time.Second*10).GetBlock(ctx, all[0])
+	require.NoError(t, err)
+	assert.Equal(t, all[0], blk.Cid())
+
+	missing := merkledag.NewRawNode([]byte("nowhere"))
+	err = httpfetch.New([]string{fullSrv.URL}, time.Second*10).FetchCAR(ctx, missing.Cid(), newBlockstore(), func(int64) {})
+	assert.Error(t, err)
+}
+
+func TestServeShardedDir(t *testing.T) {
+	ctx := context.Background()
+	bs := newBlockstore()
+
+	tree := dirtree.New(2)
+	for i := 0; i < 5; i++ {
+		leaf := merkledag.NewRawNode([]byte(fmt.Sprintf("file %d", i)))
+		require.NoError(t, bs.Put(ctx, leaf))
+		require.NoError(t, tree.Add(nil, fmt.Sprintf("f%d", i), leaf.Cid(), uint64(len(leaf.RawData()))))
+	}
+	root, err := tree.Build(ctx, bs)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(NewGatewayHandler(bs))
+	defer srv.Close()
+
+	get := func(p string) string {
+		resp, err := http.Get(srv.URL + p)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	assert.Equal(t, "file 3", get("/ipfs/"+root.String()+"/f3"))
+
+	listing := get("/ipfs/" + root.String())
+	for i := 0; i < 5; i++ {
+		assert.Contains(t, listing, fmt.Sprintf(">f%d<", i))
+	}
+
+	leaf := merkledag.NewRawNode([]byte("file 3"))
+	resolved, err := NewGatewayHandler(bs).Resolve(ctx, "/ipfs/"+root.String()+"/f3")
+	require.NoError(t, err)
+	assert.Equal(t, leaf.Cid(), resolved)
+}
+
+func TestServeSelective(t *testing.T) {
+	ctx := context.Background()
+	bs := newBlockstore()
+
+	tree := dirtree.New(100)
+	leaves := make(map[string]cid.Cid)
+	for _, p := range [][]string{{"a", "x"}, {"a", "y"}, {"b"}} {
+		leaf := merkledag.NewRawNode([]byte(strings.Join(p, "/")))
+		require.NoError(t, bs.Put(ctx, leaf))
+		require.NoError(t, tree.Add(p[:len(p)-1], p[len(p)-1], leaf.Cid(), uint64(len(leaf.RawData()))))
+		leaves[strings.Join(p, "/")] = leaf.Cid()
+	}
+	root, err := tree.Build(ctx, bs)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(NewGatewayHandler(bs))
+	defer srv.Close()
+
+	get := func(p, sel string) (int, []cid.Cid) {
+		resp, err := http.Get(srv.URL + p + "&selector=" + url.QueryEscape(sel))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return resp.StatusCode, nil
+		}
+		cr, err := car.NewCarReader(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, []cid.Cid{root}, cr.Header.Roots)
+		var out []cid.Cid
+		for {
+			blk, err := cr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			out = append(out, blk.Cid())
+		}
+		return resp.StatusCode, out
+	}
+
+	// only the directory the path leads to, after the root it is reached
+	// through
+	code, got := get("/ipfs/"+root.String()+"/a?format=car", `{".":{}}`)
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, got, 2)
+	assert.Equal(t, root, got[0])
+
+	code, got = get("/ipfs/"+root.String()+"/a?format=car", `{"R":{"l":{"none":{}},":>":{"a":{">":{"@":{}}}}}}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.Len(t, got, 4)
+	assert.Contains(t, got, leaves["a/x"])
+	assert.Contains(t, got, leaves["a/y"])
+	assert.NotContains(t, got, leaves["b"])
+
+	code, _ = get("/ipfs/"+root.String()+"/a?format=raw", `{".":{}}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = get("/ipfs/"+root.String()+"?format=car", `{"nope":{}}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// as files, the selector goes over directories by name
+	resp, err := http.Get(srv.URL + "/ipfs/" + root.String() + "?format=tar&selector=" +
+		url.QueryEscape(`{"f":{"f>":{"a":{"a":{">":{".":{}}}}}}}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	files := make(map[string]string)
+	tr := tar.NewReader(resp.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		files[hdr.Name] = string(data)
+	}
+	assert.Equal(t, map[string]string{
+		root.String() + "/a/x": "a/x",
+		root.String() + "/a/y": "a/y",
+	}, files)
+
+	// a block missing half way cuts the response off rather than ending it
+	// cleanly, a short one may not even have its headers out
+	require.NoError(t, bs.DeleteBlock(ctx, leaves["a/y"]))
+	resp, err = http.Get(srv.URL + "/ipfs/" + root.String() + "/a?format=car&selector=" +
+		url.QueryEscape(`{"R":{"l":{"none":{}},":>":{"a":{">":{"@":{}}}}}}`))
+	if err == nil {
+		defer resp.Body.Close()
+		_, err = io.ReadAll(resp.Body)
+	}
+	assert.Error(t, err)
+}
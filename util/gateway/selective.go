@@ -0,0 +1,326 @@
+package gateway
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync/storeutil"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-unixfsnode"
+	car "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+)
+
+const (
+	// maxSelectiveLinks bounds the links a selector is allowed to traverse,
+	// which also bounds the links remembered to visit each only once
+	maxSelectiveLinks = 1 << 16
+	// maxSelectiveRequests bounds the selective retrievals walked at once,
+	// more are turned away until one is done
+	maxSelectiveRequests = 8
+)
+
+// ParseSelector parses a dag-json encoded IPLD selector, like
+// {"R":{"l":{"depth":1},":>":{"a":{">":{"@":{}}}}}}
+func ParseSelector(s string) (ipld.Node, error) {
+	nd, err := selectorparse.ParseJSONSelector(s)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := selector.ParseSelector(nd); err != nil {
+		return nil, err
+	}
+	return nd, nil
+}
+
+// recordingStore keeps the cids of the blocks read through it, in the order
+// they were first read
+type recordingStore struct {
+	blockstore.Blockstore
+
+	lk   sync.Mutex
+	seen map[cid.Cid]bool
+	read []cid.Cid
+}
+
+func (rs *recordingStore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	blk, err := rs.Blockstore.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	rs.lk.Lock()
+	if !rs.seen[c] {
+		rs.seen[c] = true
+		rs.read = append(rs.read, c)
+	}
+	rs.lk.Unlock()
+	return blk, nil
+}
+
+// selectiveRequest is a gateway request with a selector, resolved
+type selectiveRequest struct {
+	format string
+	spec   ipld.Node
+	root   cid.Cid
+	target cid.Cid
+	// through are the blocks the path was resolved through, the target
+	// excluded
+	through []cid.Cid
+}
+
+// countingWriter counts what is written through it, so a response can tell
+// whether its headers are out yet
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// acquireSelective takes one of the slots for selective retrievals
+func (gw *GatewayHandler) acquireSelective() (func(), error) {
+	select {
+	case gw.selective <- struct{}{}:
+		return func() { <-gw.selective }, nil
+	default:
+		return nil, &httpError{Code: http.StatusServiceUnavailable, Message: "too many selective retrievals in progress, try again later"}
+	}
+}
+
+func (gw *GatewayHandler) parseSelective(ctx context.Context, r *http.Request, sel string) (*selectiveRequest, error) {
+	format := outputFormat(r)
+	switch format {
+	case "car", "tar", "unixfs":
+	default:
+		return nil, &httpError{Code: http.StatusBadRequest, Message: fmt.Sprintf("selectors are not supported for %s output", format)}
+	}
+	spec, err := ParseSelector(sel)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusBadRequest, Message: fmt.Sprintf("invalid selector: %s", err)}
+	}
+
+	proto, root, _, err := ParsePath(r.URL.Path)
+	if err != nil {
+		return nil, &httpError{Code: http.StatusBadRequest, Message: err.Error()}
+	}
+	if proto != "ipfs" {
+		return nil, fmt.Errorf("unsupported protocol: %s", proto)
+	}
+	has, err := gw.bs.Has(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, fmt.Errorf("root %s not found", root)
+	}
+
+	rs := &recordingStore{Blockstore: gw.bs, seen: make(map[cid.Cid]bool)}
+	target, err := resolvePathWith(ctx, newResolver(rs), r.URL.Path)
+	if err != nil {
+		return nil, fmt.Errorf("path resolution failed: %w", err)
+	}
+
+	sr := &selectiveRequest{format: format, spec: spec, root: root, target: target}
+	for _, c := range rs.read {
+		if !c.Equals(target) {
+			sr.through = append(sr.through, c)
+		}
+	}
+	return sr, nil
+}
+
+// serveSelective serves what the selector matches under the path. As a
+// car, it holds the blocks the selector matches, rooted at the cid the path
+// starts from, after the blocks the path was resolved through so clients
+// can check the path themselves. As files, it is a tar of the UnixFS files
+// and directories the selector matches, the selector going over directories
+// by name.
+func (gw *GatewayHandler) serveSelective(ctx context.Context, w http.ResponseWriter, r *http.Request, sel string) error {
+	release, err := gw.acquireSelective()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	sr, err := gw.parseSelective(ctx, r, sel)
+	if err != nil {
+		return err
+	}
+
+	if sr.format == "car" {
+		w.Header().Set("Content-Type", acceptCar)
+	} else {
+		w.Header().Set("Content-Type", "application/x-tar")
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	cw := &countingWriter{w: w}
+	if err := gw.writeSelective(ctx, cw, sr); err != nil {
+		if cw.n == 0 {
+			return err
+		}
+		// the headers are out already, the connection is cut so the client
+		// doesn't take what it got for all of it
+		log.Warnw("selective retrieval ended early", "root", sr.root, "target", sr.target, "err", err)
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
+
+// SelectedSize returns the size of what a request with a selector gets,
+// for it to be priced by that rather than by the whole DAG. It walks the
+// selection the same way serving it does.
+func (gw *GatewayHandler) SelectedSize(ctx context.Context, r *http.Request) (int64, error) {
+	release, err := gw.acquireSelective()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	sr, err := gw.parseSelective(ctx, r, r.URL.Query().Get("selector"))
+	if err != nil {
+		return 0, err
+	}
+	cw := &countingWriter{w: io.Discard}
+	if err := gw.writeSelective(ctx, cw, sr); err != nil {
+		return 0, err
+	}
+	return cw.n, nil
+}
+
+func (gw *GatewayHandler) writeSelective(ctx context.Context, w io.Writer, sr *selectiveRequest) error {
+	if sr.format == "car" {
+		return gw.writeSelectiveCar(ctx, w, sr)
+	}
+	return gw.writeSelectiveTar(ctx, w, sr)
+}
+
+func (gw *GatewayHandler) writeSelectiveCar(ctx context.Context, w io.Writer, sr *selectiveRequest) error {
+	if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{sr.root}, Version: 1}, w); err != nil {
+		return err
+	}
+
+	// the traversal visits each link once, only the blocks of the path are
+	// left to skip
+	through := make(map[cid.Cid]bool, len(sr.through))
+	for _, c := range sr.through {
+		blk, err := gw.bs.Get(ctx, c)
+		if err != nil {
+			return err
+		}
+		if err := carutil.LdWrite(w, c.Bytes(), blk.RawData()); err != nil {
+			return err
+		}
+		through[c] = true
+	}
+
+	sc := car.NewSelectiveCar(ctx, gw.bs,
+		[]car.Dag{{Root: sr.target, Selector: sr.spec}},
+		car.MaxTraversalLinks(maxSelectiveLinks),
+		car.TraverseLinksOnlyOnce(),
+	)
+	return sc.Write(io.Discard, func(b car.Block) error {
+		if through[b.BlockCID] {
+			return nil
+		}
+		return carutil.LdWrite(w, b.BlockCID.Bytes(), b.Data)
+	})
+}
+
+func (gw *GatewayHandler) writeSelectiveTar(ctx context.Context, w io.Writer, sr *selectiveRequest) error {
+	ls := storeutil.LinkSystemForBlockstore(gw.bs)
+	ls.NodeReifier = unixfsnode.Reify
+
+	sel, err := selector.CompileSelector(sr.spec)
+	if err != nil {
+		return err
+	}
+	var proto ipld.NodePrototype = basicnode.Prototype.Any
+	if sr.target.Prefix().Codec == cid.DagProtobuf {
+		proto = dagpb.Type.PBNode
+	}
+	root, err := ls.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: sr.target}, proto)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	prog := traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            ctx,
+			LinkSystem:                     ls,
+			LinkTargetNodePrototypeChooser: dagpb.AddSupportToChooser(basicnode.Chooser),
+			LinkVisitOnlyOnce:              true,
+		},
+		Budget: &traversal.Budget{
+			NodeBudget: math.MaxInt64,
+			LinkBudget: maxSelectiveLinks,
+		},
+	}
+	if err := prog.WalkMatching(root, sel, func(p traversal.Progress, n ipld.Node) error {
+		name := path.Join(sr.target.String(), p.Path.String())
+		switch n.Kind() {
+		case ipld.Kind_Map:
+			return tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: 0755})
+		case ipld.Kind_Bytes:
+			return writeTarFile(tw, name, n)
+		default:
+			// parts of nodes that aren't UnixFS have no file of their own
+			return nil
+		}
+	}); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, n ipld.Node) error {
+	var r io.ReadSeeker
+	if lb, ok := n.(datamodel.LargeBytesNode); ok {
+		lr, err := lb.AsLargeBytes()
+		if err != nil {
+			return err
+		}
+		r = lr
+	} else {
+		b, err := n.AsBytes()
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: size, Mode: 0644}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, r)
+	return err
+}
@@ -0,0 +1,209 @@
+// Package gsfetch fetches DAGs over graphsync. Graphsync moves a whole DAG
+// from a single peer in one request instead of asking for it a block at a
+// time, which makes it much faster than bitswap for large, deep DAGs that
+// one origin holds.
+package gsfetch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync"
+	gsimpl "github.com/ipfs/go-graphsync/impl"
+	gsnet "github.com/ipfs/go-graphsync/network"
+	"github.com/ipfs/go-graphsync/storeutil"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	logging "github.com/ipfs/go-log/v2"
+	_ "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	_ "github.com/ipld/go-ipld-prime/codec/raw"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
+)
+
+var log = logging.Logger("gsfetch")
+
+// Transport is how the DAG of a pin is fetched
+type Transport string
+
+const (
+	// TransportAuto fetches from the origins of a pin over graphsync, when
+	// none of them served a trustless car already, and leaves it to bitswap
+	// if there are none or none of them serve it
+	TransportAuto Transport = "auto"
+	// TransportBitswap only ever uses bitswap
+	TransportBitswap Transport = "bitswap"
+	// TransportGraphsync fetches from the origins over graphsync, and fails
+	// the pin when that doesn't work
+	TransportGraphsync Transport = "graphsync"
+)
+
+// MetaKey is the key in the meta of a pin that picks its transport
+const MetaKey = "transport"
+
+var (
+	ErrNoOrigins    = xerrors.New("fetching over graphsync needs the origins of the content")
+	ErrNotSupported = xerrors.New("peer does not speak graphsync")
+)
+
+func ParseTransport(s string) (Transport, error) {
+	switch t := Transport(strings.ToLower(s)); t {
+	case TransportAuto, TransportBitswap, TransportGraphsync:
+		return t, nil
+	default:
+		return "", fmt.Errorf("unknown transport %q, expected auto, bitswap or graphsync", s)
+	}
+}
+
+// FromMeta returns the transport the pin meta asks for, or def if it asks
+// for none or one that doesn't exist
+func FromMeta(meta string, def Transport) Transport {
+	if meta == "" {
+		return def
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(meta), &m); err != nil {
+		return def
+	}
+	s, ok := m[MetaKey].(string)
+	if !ok {
+		return def
+	}
+	t, err := ParseTransport(s)
+	if err != nil {
+		return def
+	}
+	return t
+}
+
+// Fetcher fetches DAGs into a blockstore over graphsync. It needs a libp2p
+// host of its own: filclient already runs graphsync on the node's host for
+// deals, and a host takes a single handler per protocol.
+type Fetcher struct {
+	host host.Host
+	gs   graphsync.GraphExchange
+	bs   blockstore.Blockstore
+}
+
+// New starts a fetcher on h writing the blocks it fetches to bs. The host
+// doesn't need to listen, it only dials the peers it fetches from.
+func New(ctx context.Context, h host.Host, bs blockstore.Blockstore) *Fetcher {
+	return &Fetcher{
+		host: h,
+		gs:   gsimpl.New(ctx, gsnet.NewFromLibp2pHost(h), storeutil.LinkSystemForBlockstore(bs)),
+		bs:   bs,
+	}
+}
+
+// Fetch fetches the whole DAG under root from p, calling cb with the size of
+// every block received
+func (f *Fetcher) Fetch(ctx context.Context, p peer.AddrInfo, root cid.Cid, cb func(int64)) error {
+	return f.FetchSelector(ctx, p, root, selectorparse.CommonSelector_ExploreAllRecursively, cb)
+}
+
+// FetchSelector fetches the part of the DAG under root that sel selects
+func (f *Fetcher) FetchSelector(ctx context.Context, p peer.AddrInfo, root cid.Cid, sel ipld.Node, cb func(int64)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if err := f.host.Connect(ctx, p); err != nil {
+		return xerrors.Errorf("failed to connect to %s: %w", p.ID, err)
+	}
+
+	// connecting waits for identify, so the peerstore knows the protocols of
+	// p by now. Requests to peers without graphsync would only time out.
+	protos, err := f.host.Peerstore().SupportsProtocols(p.ID, string(gsnet.ProtocolGraphsync_2_0_0), string(gsnet.ProtocolGraphsync_1_0_0))
+	if err != nil {
+		return err
+	}
+	if len(protos) == 0 {
+		return xerrors.Errorf("%s: %w", p.ID, ErrNotSupported)
+	}
+
+	progress, errs := f.gs.Request(ctx, p.ID, cidlink.Link{Cid: root}, sel)
+
+	seen := cid.NewSet()
+	for progress != nil || errs != nil {
+		select {
+		case pr, ok := <-progress:
+			if !ok {
+				progress = nil
+				continue
+			}
+			// the nodes of the root block come without a last block
+			c := root
+			if pr.LastBlock.Link != nil {
+				c = pr.LastBlock.Link.(cidlink.Link).Cid
+			}
+			if !seen.Visit(c) {
+				continue
+			}
+			size, err := f.bs.GetSize(ctx, c)
+			if err != nil {
+				log.Warnf("failed to get size of fetched block %s: %s", c, err)
+				continue
+			}
+			cb(int64(size))
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			// anything missing from the response fails the whole fetch
+			return xerrors.Errorf("graphsync request to %s failed: %w", p.ID, err)
+		}
+	}
+	return nil
+}
+
+// FetchFromAny fetches the DAG under root from the first of origins that
+// has it all
+func (f *Fetcher) FetchFromAny(ctx context.Context, origins []*peer.AddrInfo, root cid.Cid, cb func(int64)) error {
+	if len(origins) == 0 {
+		return ErrNoOrigins
+	}
+
+	var errs []string
+	for _, o := range origins {
+		err := f.Fetch(ctx, *o, root, cb)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		errs = append(errs, err.Error())
+	}
+	return xerrors.Errorf("no origin served %s over graphsync: %s", root, strings.Join(errs, "; "))
+}
+
+// FetchWith fetches the DAG under root from origins if t asks for graphsync,
+// and returns whether it did. In auto mode content without origins, or that
+// none of them served, is left to bitswap, with graphsync it is an error.
+func (f *Fetcher) FetchWith(ctx context.Context, t Transport, origins []*peer.AddrInfo, root cid.Cid, cb func(int64)) (bool, error) {
+	if t == TransportBitswap || (t == TransportAuto && len(origins) == 0) {
+		return false, nil
+	}
+
+	err := f.FetchFromAny(ctx, origins, root, cb)
+	if err == nil {
+		return true, nil
+	}
+	if t == TransportGraphsync || ctx.Err() != nil {
+		return false, err
+	}
+	log.Infow("graphsync fetch failed, leaving it to bitswap", "root", root, "err", err)
+	return false, nil
+}
+
+// Close closes the host the fetcher fetches with
+func (f *Fetcher) Close() error {
+	return f.host.Close()
+}
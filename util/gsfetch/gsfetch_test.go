@@ -0,0 +1,119 @@
+package gsfetch
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-graphsync"
+	gsimpl "github.com/ipfs/go-graphsync/impl"
+	gsnet "github.com/ipfs/go-graphsync/network"
+	"github.com/ipfs/go-graphsync/storeutil"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/libp2p/go-libp2p-core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromMeta(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(TransportAuto, FromMeta("", TransportAuto))
+	assert.Equal(TransportGraphsync, FromMeta(`{"transport":"GraphSync"}`, TransportAuto))
+	assert.Equal(TransportBitswap, FromMeta(`{"transport":"bitswap","other":1}`, TransportAuto))
+	assert.Equal(TransportAuto, FromMeta(`{"transport":"carrier-pigeon"}`, TransportAuto))
+	assert.Equal(TransportBitswap, FromMeta(`{"transport":3}`, TransportBitswap))
+	assert.Equal(TransportBitswap, FromMeta(`not json`, TransportBitswap))
+}
+
+func newBlockstore() blockstore.Blockstore {
+	return blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+}
+
+func TestFetch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	// a two level DAG of raw leaves on the origin
+	originBs := newBlockstore()
+	var total int64
+	var all []cid.Cid
+	root := merkledag.NodeWithData([]byte{0x08, 0x01})
+	for i := 0; i < 4; i++ {
+		mid := merkledag.NodeWithData([]byte{0x08, 0x01})
+		for j := 0; j < 8; j++ {
+			leaf := merkledag.NewRawNode([]byte{byte(i), byte(j), 0xff})
+			require.NoError(t, originBs.Put(ctx, leaf))
+			require.NoError(t, mid.AddRawLink("", &format.Link{Cid: leaf.Cid(), Size: 3}))
+			total += 3
+			all = append(all, leaf.Cid())
+		}
+		require.NoError(t, originBs.Put(ctx, mid))
+		require.NoError(t, root.AddNodeLink("", mid))
+		total += int64(len(mid.RawData()))
+		all = append(all, mid.Cid())
+	}
+	require.NoError(t, originBs.Put(ctx, root))
+	total += int64(len(root.RawData()))
+	all = append(all, root.Cid())
+
+	mn := mocknet.New()
+	origin, err := mn.GenPeer()
+	require.NoError(t, err)
+	fetchHost, err := mn.GenPeer()
+	require.NoError(t, err)
+	// a peer that doesn't speak graphsync at all
+	bitswapOnly, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+
+	gs := gsimpl.New(ctx, gsnet.NewFromLibp2pHost(origin), storeutil.LinkSystemForBlockstore(originBs))
+	gs.RegisterIncomingRequestHook(func(p peer.ID, request graphsync.RequestData, hookActions graphsync.IncomingRequestHookActions) {
+		hookActions.ValidateRequest()
+	})
+
+	fetchBs := newBlockstore()
+	f := New(ctx, fetchHost, fetchBs)
+	defer f.Close()
+
+	var fetched int64
+	originInfo := &peer.AddrInfo{ID: origin.ID(), Addrs: origin.Addrs()}
+	other := &peer.AddrInfo{ID: bitswapOnly.ID(), Addrs: bitswapOnly.Addrs()}
+	err = f.FetchFromAny(ctx, []*peer.AddrInfo{other, originInfo}, root.Cid(), func(size int64) {
+		fetched += size
+	})
+	require.NoError(t, err)
+	assert.Equal(t, total, fetched)
+
+	for _, c := range all {
+		has, err := fetchBs.Has(ctx, c)
+		assert.NoError(t, err)
+		assert.True(t, has, c.String())
+	}
+
+	missing := merkledag.NodeWithData([]byte("nowhere"))
+	err = f.Fetch(ctx, *originInfo, missing.Cid(), func(int64) {})
+	assert.Error(t, err)
+
+	assert.ErrorIs(t, f.FetchFromAny(ctx, nil, root.Cid(), func(int64) {}), ErrNoOrigins)
+
+	// only a forced graphsync fetch fails when there is nothing to fetch from
+	done, err := f.FetchWith(ctx, TransportAuto, []*peer.AddrInfo{other}, root.Cid(), func(int64) {})
+	assert.NoError(t, err)
+	assert.False(t, done)
+	done, err = f.FetchWith(ctx, TransportGraphsync, []*peer.AddrInfo{other}, root.Cid(), func(int64) {})
+	assert.Error(t, err)
+	assert.False(t, done)
+	done, err = f.FetchWith(ctx, TransportBitswap, []*peer.AddrInfo{originInfo}, root.Cid(), func(int64) {})
+	assert.NoError(t, err)
+	assert.False(t, done)
+	done, err = f.FetchWith(ctx, TransportAuto, []*peer.AddrInfo{originInfo}, root.Cid(), func(int64) {})
+	assert.NoError(t, err)
+	assert.True(t, done)
+}
@@ -1,6 +1,8 @@
 package util
 
 import (
+	"fmt"
+	"net"
 	"net/http"
 	"regexp"
 	"strings"
@@ -10,6 +12,8 @@ import (
 	"github.com/labstack/echo/v4"
 	"golang.org/x/xerrors"
 
+	"github.com/application-research/estuary/util/requestid"
+
 	logging "github.com/ipfs/go-log/v2"
 )
 
@@ -42,6 +46,19 @@ const (
 	ERR_INVALID_PINNING_STATUS     = "ERR_INVALID_PINNING_STATUS"
 	ERR_INVALID_QUERY_PARAM_VALUE  = "ERR_INVALID_QUERY_PARAM_VALUE"
 	ERR_CONTENT_LENGTH_REQUIRED    = "ERR_CONTENT_LENGTH_REQUIRED"
+	ERR_DISK_PRESSURE              = "ERR_DISK_PRESSURE"
+	ERR_NODE_DRAINING              = "ERR_NODE_DRAINING"
+	ERR_FAULTS_DISABLED            = "ERR_FAULTS_DISABLED"
+	ERR_RATE_LIMITED               = "ERR_RATE_LIMITED"
+	ERR_PIN_QUEUE_FULL             = "ERR_PIN_QUEUE_FULL"
+	ERR_FULL_NODE_REQUIRED         = "ERR_FULL_NODE_REQUIRED"
+	ERR_QUOTA_EXCEEDED             = "ERR_QUOTA_EXCEEDED"
+	ERR_EGRESS_LIMIT               = "ERR_EGRESS_LIMIT"
+	ERR_RECORD_NOT_FOUND           = "ERR_RECORD_NOT_FOUND"
+	ERR_CONTENT_BLOCKED            = "ERR_CONTENT_BLOCKED"
+	ERR_CONTENT_QUARANTINED        = "ERR_CONTENT_QUARANTINED"
+	ERR_PAYMENT_REQUIRED           = "ERR_PAYMENT_REQUIRED"
+	ERR_INVALID_PAYMENT            = "ERR_INVALID_PAYMENT"
 )
 
 type HttpError struct {
@@ -59,6 +76,8 @@ func (he HttpError) Error() string {
 
 type HttpErrorResponse struct {
 	Error HttpError `json:"error"`
+	// RequestID identifies the request in the node's logs and traces
+	RequestID string `json:"requestId,omitempty"`
 }
 
 const (
@@ -70,6 +89,40 @@ const (
 // isValidAuth checks if authStr is a valid
 // returns false if authStr is not in a valid format
 // returns true otherwise
+// IPExtractor returns how the address of clients is taken from requests.
+// Forwarded addresses are only trusted from the proxies in trusted, IPs or
+// CIDR ranges; with none the address of the connection is used.
+func IPExtractor(trusted []string) (echo.IPExtractor, error) {
+	if len(trusted) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+
+	opts := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, t := range trusted {
+		if !strings.Contains(t, "/") {
+			ip := net.ParseIP(t)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", t)
+			}
+			if ip.To4() != nil {
+				t += "/32"
+			} else {
+				t += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", t, err)
+		}
+		opts = append(opts, echo.TrustIPRange(ipnet))
+	}
+	return echo.ExtractIPFromXFFHeader(opts...), nil
+}
+
 func isValidAuth(authStr string) bool {
 	matchEst, _ := regexp.MatchString("^EST(.+)ARY$", authStr)
 	matchSecret, _ := regexp.MatchString("^SECRET(.+)SECRET$", authStr)
@@ -143,11 +196,13 @@ type ViewerResponse struct {
 }
 
 func ErrorHandler(err error, ctx echo.Context) {
+	reqID := requestid.Get(ctx)
+
 	var httpRespErr *HttpError
 	if xerrors.As(err, &httpRespErr) {
-		log.Errorf("handler error: %s", err)
-		if err := ctx.JSON(httpRespErr.Code, HttpErrorResponse{Error: *httpRespErr}); err != nil {
-			log.Errorf("handler error: %s", err)
+		log.Errorw("handler error", "requestId", reqID, "err", err)
+		if err := ctx.JSON(httpRespErr.Code, HttpErrorResponse{Error: *httpRespErr, RequestID: reqID}); err != nil {
+			log.Errorw("handler error", "requestId", reqID, "err", err)
 			return
 		}
 		return
@@ -161,22 +216,24 @@ func ErrorHandler(err error, ctx echo.Context) {
 				Reason:  http.StatusText(echoErr.Code),
 				Details: echoErr.Message.(string),
 			},
+			RequestID: reqID,
 		}); err != nil {
-			log.Errorf("handler error: %s", err)
+			log.Errorw("handler error", "requestId", reqID, "err", err)
 			return
 		}
 		return
 	}
 
-	log.Errorf("handler error: %s", err)
+	log.Errorw("handler error", "requestId", reqID, "err", err)
 	if err := ctx.JSON(http.StatusInternalServerError, HttpErrorResponse{
 		Error: HttpError{
 			Code:    http.StatusInternalServerError,
 			Reason:  http.StatusText(http.StatusInternalServerError),
 			Details: err.Error(),
 		},
+		RequestID: reqID,
 	}); err != nil {
-		log.Errorf("handler error: %s", err)
+		log.Errorw("handler error", "requestId", reqID, "err", err)
 		return
 	}
 }
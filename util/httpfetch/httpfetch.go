@@ -0,0 +1,541 @@
+// Package httpfetch fetches content over the trustless gateway api, from
+// origins that serve it and from the trusted HTTP gateways pins that can't
+// be fetched peer to peer fall back to. No gateway is trusted to serve
+// content right: the hash of every block is checked before it is stored, and
+// so is that it belongs to the DAG being fetched.
+package httpfetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-core/peer"
+	// registers the dag-pb and raw decoders ipld.Decode uses
+	_ "github.com/ipfs/go-merkledag"
+	car "github.com/ipld/go-car"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+var log = logging.Logger("httpfetch")
+
+const (
+	acceptRaw = "application/vnd.ipld.raw"
+	acceptCar = "application/vnd.ipld.car"
+
+	// maxBlockSize is the largest block a gateway is trusted to send, the
+	// same limit bitswap has
+	maxBlockSize = 2 << 20
+
+	// originTimeout is how long a CAR from an origin may take, origins
+	// that stall are given up on long before by the response timeout
+	originTimeout = 4 * time.Hour
+)
+
+var ErrNoGateways = xerrors.New("no gateways to fetch from")
+
+// Fetcher fetches from Gateways, in order, until one of them succeeds. The
+// timeout of the client covers a whole CAR, so it should leave time for
+// large ones.
+type Fetcher struct {
+	gateways []string
+	client   *http.Client
+}
+
+func New(gateways []string, timeout time.Duration) *Fetcher {
+	return &Fetcher{
+		gateways: trimURLs(gateways),
+		client:   &http.Client{Timeout: timeout},
+	}
+}
+
+// newOriginFetcher returns a fetcher for origins users gave, which may
+// point anywhere: it only connects to public addresses, whatever their
+// names resolve to and wherever they redirect to
+func newOriginFetcher(urls []string) *Fetcher {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   publicOnly,
+	}
+	return &Fetcher{
+		gateways: trimURLs(urls),
+		client: &http.Client{
+			Timeout: originTimeout,
+			Transport: &http.Transport{
+				// no proxy, it would be the address checked
+				DialContext:           dialer.DialContext,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ResponseHeaderTimeout: time.Minute,
+				IdleConnTimeout:       90 * time.Second,
+			},
+		},
+	}
+}
+
+func trimURLs(urls []string) []string {
+	out := make([]string, 0, len(urls))
+	for _, u := range urls {
+		out = append(out, strings.TrimSuffix(u, "/"))
+	}
+	return out
+}
+
+// publicOnly refuses connections to addresses that aren't public, it is
+// called with the address dialed, after names were resolved
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("refusing to connect to non public address %s", address)
+	}
+	return nil
+}
+
+// sharedAddrSpace is 100.64.0.0/10, the carrier grade nat range
+var sharedAddrSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPublicIP reports whether ip can be reached over the internet, and not
+// only from the network of this node
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4[0] != 0 && !sharedAddrSpace.Contains(ip4)
+	}
+	return true
+}
+
+// OriginURLs returns the urls of the origins that serve the trustless
+// gateway api, those with an http or https address. Addresses with ips
+// that aren't public are left out.
+func OriginURLs(origins []*peer.AddrInfo) []string {
+	var urls []string
+	for _, o := range origins {
+		for _, a := range o.Addrs {
+			if u, ok := httpURL(a); ok {
+				urls = append(urls, u)
+			}
+		}
+	}
+	return urls
+}
+
+// FetchFromOrigins fetches the DAG under root from the origins that serve
+// the trustless gateway api, and returns whether it got all of it. Origins
+// are given by users, so only public addresses are connected to.
+func FetchFromOrigins(ctx context.Context, origins []*peer.AddrInfo, root cid.Cid, bs blockstore.Blockstore, cb func(int64)) bool {
+	return fetchCAR(ctx, newOriginFetcher(OriginURLs(origins)), root, bs, cb)
+}
+
+// FetchFromURLs fetches the DAG under root from other estuary nodes known by
+// their urls. They are set by this cluster, so they may be private.
+func FetchFromURLs(ctx context.Context, urls []string, root cid.Cid, bs blockstore.Blockstore, cb func(int64)) bool {
+	return fetchCAR(ctx, New(urls, originTimeout), root, bs, cb)
+}
+
+func fetchCAR(ctx context.Context, f *Fetcher, root cid.Cid, bs blockstore.Blockstore, cb func(int64)) bool {
+	if len(f.gateways) == 0 {
+		return false
+	}
+	if err := f.FetchCAR(ctx, root, bs, cb); err != nil {
+		log.Infow("failed to fetch car", "root", root, "urls", f.gateways, "err", err)
+		return false
+	}
+	return true
+}
+
+// httpURL turns addresses like /dns4/example.com/tcp/443/https into urls
+func httpURL(a multiaddr.Multiaddr) (string, bool) {
+	var host, port, scheme string
+	multiaddr.ForEach(a, func(c multiaddr.Component) bool {
+		switch c.Protocol().Code {
+		case multiaddr.P_IP4, multiaddr.P_IP6:
+			if ip := net.ParseIP(c.Value()); ip == nil || !isPublicIP(ip) {
+				return false
+			}
+			host = c.Value()
+			if c.Protocol().Code == multiaddr.P_IP6 {
+				host = "[" + host + "]"
+			}
+		case multiaddr.P_DNS, multiaddr.P_DNS4, multiaddr.P_DNS6:
+			host = c.Value()
+		case multiaddr.P_TCP:
+			port = c.Value()
+		case multiaddr.P_TLS, multiaddr.P_HTTPS:
+			scheme = "https"
+		case multiaddr.P_HTTP:
+			if scheme == "" {
+				scheme = "http"
+			}
+		}
+		return true
+	})
+	if host == "" || scheme == "" {
+		return "", false
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	return scheme + "://" + host, true
+}
+
+// verify checks that data is the block c names
+func verify(c cid.Cid, data []byte) (blocks.Block, error) {
+	chk, err := c.Prefix().Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	if !chk.Equals(c) {
+		return nil, fmt.Errorf("hash of block %s does not match, got %s", c, chk)
+	}
+	return blocks.NewBlockWithCid(data, c)
+}
+
+func (f *Fetcher) get(ctx context.Context, gw string, c cid.Cid, format, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/ipfs/%s?format=%s", gw, c, format), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("gateway %s returned status %d", gw, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// GetBlock fetches the block c and checks its hash
+func (f *Fetcher) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if len(f.gateways) == 0 {
+		return nil, ErrNoGateways
+	}
+
+	var errs []string
+	for _, gw := range f.gateways {
+		blk, err := f.getBlock(ctx, gw, c)
+		if err == nil {
+			return blk, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, xerrors.Errorf("no gateway served block %s: %s", c, strings.Join(errs, "; "))
+}
+
+func (f *Fetcher) getBlock(ctx context.Context, gw string, c cid.Cid) (blocks.Block, error) {
+	resp, err := f.get(ctx, gw, c, "raw", acceptRaw)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBlockSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxBlockSize {
+		return nil, fmt.Errorf("gateway %s sent a block larger than %d bytes", gw, maxBlockSize)
+	}
+	return verify(c, data)
+}
+
+// FetchCAR fetches the whole DAG under root as CARs and puts its blocks in
+// bs, calling cb with the size of every block stored. Blocks are only taken
+// if a block taken before links to them, so nothing outside the DAG gets in.
+// When a CAR breaks off, the parts of the DAG still missing are asked for
+// again, from the same gateway for as long as it makes progress or up to
+// maxAttempts times, and then from the next one.
+func (f *Fetcher) FetchCAR(ctx context.Context, root cid.Cid, bs blockstore.Blockstore, cb func(int64)) error {
+	if len(f.gateways) == 0 {
+		return ErrNoGateways
+	}
+
+	cf := &carFetch{
+		bs:     bs,
+		cb:     cb,
+		wanted: cid.NewSet(),
+		seen:   cid.NewSet(),
+	}
+	cf.wanted.Add(root)
+
+	var errs []string
+	for _, gw := range f.gateways {
+		for failures := 0; failures < maxAttempts; {
+			before := cf.seen.Len()
+			err := f.fetchMissing(ctx, gw, cf)
+			if err == nil {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Infow("failed to fetch car from gateway", "gateway", gw, "root", root, "missing", cf.wanted.Len(), "err", err)
+			if cf.seen.Len() == before {
+				// only a gateway that keeps making progress is worth resuming
+				failures++
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	return xerrors.Errorf("no gateway served a car of %s: %s", root, strings.Join(errs, "; "))
+}
+
+// maxAttempts is how often a gateway is asked for the rest of a DAG after
+// CARs broke off without bringing anything new
+const maxAttempts = 3
+
+// carFetch is the state of the DAG being fetched, kept across CARs
+type carFetch struct {
+	bs blockstore.Blockstore
+	cb func(int64)
+	// wanted is what the blocks taken so far link to and wasn't received yet
+	wanted *cid.Set
+	seen   *cid.Set
+}
+
+// fetchMissing asks gw for a CAR of each part of the DAG that is still
+// missing, until nothing is
+func (f *Fetcher) fetchMissing(ctx context.Context, gw string, cf *carFetch) error {
+	for cf.wanted.Len() > 0 {
+		for _, c := range cf.wanted.Keys() {
+			if !cf.wanted.Has(c) {
+				// came with the car of another part
+				continue
+			}
+			if err := f.fetchCAR(ctx, gw, c, cf); err != nil {
+				return err
+			}
+			if cf.wanted.Has(c) {
+				return fmt.Errorf("gateway %s sent a car of %s without it", gw, c)
+			}
+		}
+	}
+	return nil
+}
+
+func (f *Fetcher) fetchCAR(ctx context.Context, gw string, root cid.Cid, cf *carFetch) error {
+	resp, err := f.get(ctx, gw, root, "car", acceptCar)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	cr, err := car.NewCarReader(resp.Body)
+	if err != nil {
+		return xerrors.Errorf("failed to read car header: %w", err)
+	}
+	if len(cr.Header.Roots) != 1 || !cr.Header.Roots[0].Equals(root) {
+		return fmt.Errorf("gateway %s sent a car with roots %v, expected %s", gw, cr.Header.Roots, root)
+	}
+
+	for {
+		blk, err := cr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return xerrors.Errorf("failed to read car: %w", err)
+		}
+		if err := cf.take(ctx, blk); err != nil {
+			return xerrors.Errorf("gateway %s: %w", gw, err)
+		}
+	}
+}
+
+// take verifies blk and stores it, and adds the blocks it links to to the
+// wanted ones
+func (cf *carFetch) take(ctx context.Context, blk blocks.Block) error {
+	c := blk.Cid()
+	if cf.seen.Has(c) {
+		// cars may repeat blocks the DAG links to more than once
+		return nil
+	}
+	if !cf.wanted.Has(c) {
+		return fmt.Errorf("sent block %s that isn't part of the DAG", c)
+	}
+
+	vblk, err := verify(c, blk.RawData())
+	if err != nil {
+		return err
+	}
+	if err := cf.bs.Put(ctx, vblk); err != nil {
+		return err
+	}
+	cf.wanted.Remove(c)
+	cf.seen.Add(c)
+	cf.cb(int64(len(vblk.RawData())))
+
+	if c.Type() == cid.Raw {
+		return nil
+	}
+	nd, err := ipld.Decode(vblk)
+	if err != nil {
+		// nothing to walk into in a block we can't decode
+		return nil
+	}
+	for _, l := range nd.Links() {
+		if l.Cid.Prefix().MhType == multihash.IDENTITY {
+			// the data is in the cid, there is nothing to fetch
+			continue
+		}
+		if !cf.seen.Has(l.Cid) {
+			cf.wanted.Add(l.Cid)
+		}
+	}
+	return nil
+}
+
+// Fallback fetches the DAG under root into bs for a pin that couldn't be
+// fetched peer to peer, and returns the getter to walk it with and whether
+// the CAR was fetched whole. Blocks the CAR didn't bring are fetched one at a
+// time by the getter.
+func (f *Fetcher) Fallback(ctx context.Context, root cid.Cid, bs blockstore.Blockstore, cb func(int64)) (ipld.NodeGetter, bool) {
+	err := f.FetchCAR(ctx, root, bs, cb)
+	if err != nil {
+		log.Warnw("failed to fetch car from gateways, fetching blocks one at a time", "root", root, "err", err)
+	}
+	return f.NodeGetter(bs), err == nil
+}
+
+// NodeGetter returns a node getter that takes blocks from bs, and fetches
+// the ones bs doesn't have from the gateways into it
+func (f *Fetcher) NodeGetter(bs blockstore.Blockstore) ipld.NodeGetter {
+	return &nodeGetter{f: f, bs: bs}
+}
+
+type nodeGetter struct {
+	f  *Fetcher
+	bs blockstore.Blockstore
+}
+
+func (ng *nodeGetter) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	blk, err := ng.bs.Get(ctx, c)
+	if err == nil {
+		return ipld.Decode(blk)
+	}
+	if !xerrors.Is(err, blockstore.ErrNotFound) {
+		return nil, err
+	}
+
+	blk, err = ng.f.GetBlock(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if err := ng.bs.Put(ctx, blk); err != nil {
+		return nil, err
+	}
+	return ipld.Decode(blk)
+}
+
+func (ng *nodeGetter) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(cids))
+	go func() {
+		defer close(out)
+		for _, c := range cids {
+			nd, err := ng.Get(ctx, c)
+			select {
+			case out <- &ipld.NodeOption{Node: nd, Err: err}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// WithFallback returns a node getter that gets blocks with ng, and fetches
+// the ones ng fails to get from the gateways into bs, so a pin that fails
+// peer to peer is finished from the gateways rather than failed
+func (f *Fetcher) WithFallback(ng ipld.NodeGetter, bs blockstore.Blockstore) ipld.NodeGetter {
+	return &fallbackGetter{ng: ng, gw: &nodeGetter{f: f, bs: bs}}
+}
+
+type fallbackGetter struct {
+	ng ipld.NodeGetter
+	gw *nodeGetter
+}
+
+func (fg *fallbackGetter) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	nd, err := fg.ng.Get(ctx, c)
+	if err == nil || ctx.Err() != nil {
+		return nd, err
+	}
+	return fg.fallback(ctx, c, err)
+}
+
+func (fg *fallbackGetter) fallback(ctx context.Context, c cid.Cid, err error) (ipld.Node, error) {
+	log.Debugw("failed to get block, trying the gateways", "cid", c, "err", err)
+	nd, gerr := fg.gw.Get(ctx, c)
+	if gerr != nil {
+		return nil, xerrors.Errorf("%w (gateways: %s)", err, gerr)
+	}
+	return nd, nil
+}
+
+func (fg *fallbackGetter) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(cids))
+	go func() {
+		defer close(out)
+
+		// failed results don't say which cid they were for, the cids that
+		// got no node are fetched from the gateways once ng is done
+		got := cid.NewSet()
+		var err error
+		for no := range fg.ng.GetMany(ctx, cids) {
+			if no.Err != nil {
+				err = no.Err
+				continue
+			}
+			got.Add(no.Node.Cid())
+			select {
+			case out <- no:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err == nil {
+			err = fmt.Errorf("block was not returned")
+		}
+
+		for _, c := range cids {
+			if !got.Visit(c) {
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			nd, gerr := fg.fallback(ctx, c, err)
+			select {
+			case out <- &ipld.NodeOption{Node: nd, Err: gerr}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
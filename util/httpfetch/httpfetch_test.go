@@ -0,0 +1,279 @@
+package httpfetch
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-merkledag"
+	car "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newBlockstore() blockstore.Blockstore {
+	return blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+}
+
+// gateway serves blocks and cars out of bs, with the blocks in lie served
+// with the wrong data
+func gateway(t *testing.T, bs blockstore.Blockstore, lie map[cid.Cid]bool) *httptest.Server {
+	return flakyGateway(t, bs, lie, nil)
+}
+
+// flakyGateway cuts every car off after the number of bytes cut returns
+func flakyGateway(t *testing.T, bs blockstore.Blockstore, lie map[cid.Cid]bool, cut func() int) *httptest.Server {
+	dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := cid.Decode(strings.TrimPrefix(r.URL.Path, "/ipfs/"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch r.URL.Query().Get("format") {
+		case "raw":
+			blk, err := bs.Get(r.Context(), c)
+			if err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			data := blk.RawData()
+			if lie[c] {
+				data = []byte("not the block you asked for")
+			}
+			_, _ = w.Write(data)
+		case "car":
+			if lie[c] {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			var buf bytes.Buffer
+			if err := car.WriteCar(r.Context(), dserv, []cid.Cid{c}, &buf); err != nil {
+				t.Logf("failed to write car: %s", err)
+			}
+			data := buf.Bytes()
+			if cut != nil && cut() < len(data) {
+				data = data[:cut()]
+			}
+			_, _ = w.Write(data)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+}
+
+func TestFallback(t *testing.T) {
+	ctx := context.Background()
+
+	originBs := newBlockstore()
+	root := merkledag.NodeWithData([]byte{0x08, 0x01})
+	var all []cid.Cid
+	var total int64
+	for i := 0; i < 5; i++ {
+		leaf := merkledag.NewRawNode([]byte{byte(i), 0xaa})
+		require.NoError(t, originBs.Put(ctx, leaf))
+		require.NoError(t, root.AddNodeLink("", leaf))
+		all = append(all, leaf.Cid())
+		total += 2
+	}
+	require.NoError(t, originBs.Put(ctx, root))
+	all = append(all, root.Cid())
+	total += int64(len(root.RawData()))
+
+	liar := gateway(t, originBs, map[cid.Cid]bool{root.Cid(): true, all[0]: true})
+	defer liar.Close()
+	honest := gateway(t, originBs, nil)
+	defer honest.Close()
+
+	t.Run("car", func(t *testing.T) {
+		bs := newBlockstore()
+		f := New([]string{liar.URL, honest.URL + "/"}, time.Second*10)
+
+		var fetched int64
+		ng, whole := f.Fallback(ctx, root.Cid(), bs, func(size int64) { fetched += size })
+		assert.True(t, whole)
+		assert.Equal(t, total, fetched)
+		for _, c := range all {
+			has, err := bs.Has(ctx, c)
+			assert.NoError(t, err)
+			assert.True(t, has)
+		}
+
+		nd, err := ng.Get(ctx, root.Cid())
+		assert.NoError(t, err)
+		assert.Len(t, nd.Links(), 5)
+	})
+
+	t.Run("blocks", func(t *testing.T) {
+		bs := newBlockstore()
+		// the liar is the only one serving cars, so the blocks come one at
+		// a time from whoever sends the right ones
+		f := New([]string{liar.URL}, time.Second*10)
+		_, whole := f.Fallback(ctx, root.Cid(), bs, func(int64) {})
+		assert.False(t, whole)
+
+		ng := New([]string{liar.URL, honest.URL}, time.Second*10).NodeGetter(bs)
+		var got int
+		for opt := range ng.GetMany(ctx, all) {
+			assert.NoError(t, opt.Err)
+			got++
+		}
+		assert.Equal(t, len(all), got)
+
+		_, err := New([]string{liar.URL}, time.Second*10).GetBlock(ctx, all[0])
+		assert.Error(t, err, "a block with the wrong hash must not be accepted")
+
+		_, err = New(nil, time.Second).GetBlock(ctx, all[0])
+		assert.ErrorIs(t, err, ErrNoGateways)
+	})
+
+	t.Run("with fallback", func(t *testing.T) {
+		// peer to peer only one of the leaves can be had, the rest come from
+		// the gateway
+		p2p := newBlockstore()
+		leaf, err := originBs.Get(ctx, all[1])
+		require.NoError(t, err)
+		require.NoError(t, p2p.Put(ctx, leaf))
+		p2pGetter := merkledag.NewDAGService(blockservice.New(p2p, nil))
+
+		bs := newBlockstore()
+		ng := New([]string{honest.URL}, time.Second*10).WithFallback(p2pGetter, bs)
+
+		nd, err := ng.Get(ctx, root.Cid())
+		require.NoError(t, err)
+		assert.Len(t, nd.Links(), 5)
+
+		var got int
+		for opt := range ng.GetMany(ctx, all[:5]) {
+			assert.NoError(t, opt.Err)
+			got++
+		}
+		assert.Equal(t, 5, got)
+
+		// only the blocks that failed peer to peer were fetched into bs
+		has, err := bs.Has(ctx, all[0])
+		assert.NoError(t, err)
+		assert.True(t, has)
+		has, err = bs.Has(ctx, all[1])
+		assert.NoError(t, err)
+		assert.False(t, has)
+
+		// a block no gateway has still fails
+		missing := merkledag.NewRawNode([]byte("missing"))
+		_, err = ng.Get(ctx, missing.Cid())
+		assert.Error(t, err)
+	})
+}
+
+func TestFetchCARResumes(t *testing.T) {
+	ctx := context.Background()
+
+	// a DAG of three levels, so a car that breaks off leaves whole subtrees
+	// missing
+	originBs := newBlockstore()
+	root := merkledag.NodeWithData([]byte{0x08, 0x01})
+	var all []cid.Cid
+	for i := 0; i < 4; i++ {
+		mid := merkledag.NodeWithData([]byte{0x08, 0x01})
+		for j := 0; j < 4; j++ {
+			leaf := merkledag.NewRawNode(bytes.Repeat([]byte{byte(i), byte(j)}, 64))
+			require.NoError(t, originBs.Put(ctx, leaf))
+			require.NoError(t, mid.AddNodeLink("", leaf))
+			all = append(all, leaf.Cid())
+		}
+		require.NoError(t, originBs.Put(ctx, mid))
+		require.NoError(t, root.AddNodeLink("", mid))
+		all = append(all, mid.Cid())
+	}
+	require.NoError(t, originBs.Put(ctx, root))
+	all = append(all, root.Cid())
+
+	var requests int
+	gw := flakyGateway(t, originBs, nil, func() int {
+		// every car breaks off after the header and a few blocks
+		return 700
+	})
+	defer gw.Close()
+	counting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		gw.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer counting.Close()
+
+	bs := newBlockstore()
+	var fetched int
+	err := New([]string{counting.URL}, time.Second*10).FetchCAR(ctx, root.Cid(), bs, func(int64) { fetched++ })
+	require.NoError(t, err)
+	assert.Equal(t, len(all), fetched)
+	assert.Greater(t, requests, 1)
+	for _, c := range all {
+		has, err := bs.Has(ctx, c)
+		assert.NoError(t, err)
+		assert.True(t, has)
+	}
+
+	// a car of a DAG with blocks of another one in it is refused
+	other := merkledag.NewRawNode([]byte("somebody else's block"))
+	sneaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{root.Cid()}, Version: 1}, w)
+		_ = carutil.LdWrite(w, other.Cid().Bytes(), other.RawData())
+	}))
+	defer sneaky.Close()
+	err = New([]string{sneaky.URL}, time.Second*10).FetchCAR(ctx, root.Cid(), newBlockstore(), func(int64) {})
+	assert.Error(t, err)
+}
+
+func TestOriginURLs(t *testing.T) {
+	addrs := func(s ...string) []multiaddr.Multiaddr {
+		var out []multiaddr.Multiaddr
+		for _, a := range s {
+			out = append(out, multiaddr.StringCast(a))
+		}
+		return out
+	}
+
+	urls := OriginURLs([]*peer.AddrInfo{
+		{Addrs: addrs("/ip4/1.2.3.4/tcp/4001", "/dns4/example.com/tcp/443/https")},
+		{Addrs: addrs("/ip4/1.2.3.4/tcp/8080/http", "/ip6/2001:db8::1/tcp/443/tls/http", "/ip4/1.2.3.4/udp/4001/quic")},
+		// only reachable from the network of the node
+		{Addrs: addrs("/ip4/127.0.0.1/tcp/80/http", "/ip6/::1/tcp/443/https", "/ip4/10.0.0.1/tcp/80/http",
+			"/ip4/169.254.169.254/tcp/80/http", "/ip6/fe80::1/tcp/80/http", "/ip4/100.64.0.1/tcp/80/http")},
+	})
+	assert.Equal(t, []string{"https://example.com:443", "http://1.2.3.4:8080", "https://[2001:db8::1]:443"}, urls)
+}
+
+func TestOriginFetcherRefusesPrivateAddresses(t *testing.T) {
+	ctx := context.Background()
+	root := merkledag.NewRawNode([]byte("hello"))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(root.RawData())
+	}))
+	defer srv.Close()
+
+	// a name that resolves to loopback gets through OriginURLs, the dialer
+	// has to refuse it
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	assert.NoError(t, err)
+	_, err = newOriginFetcher([]string{"http://localhost:" + port}).GetBlock(ctx, root.Cid())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "non public address")
+
+	ok := FetchFromOrigins(ctx, []*peer.AddrInfo{{
+		Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/dns4/localhost/tcp/" + port + "/http")},
+	}}, root.Cid(), newBlockstore(), func(int64) {})
+	assert.False(t, ok)
+}
@@ -0,0 +1,529 @@
+// Package inclusion proves that a content is inside the piece of the
+// aggregate it was stored in, along the lines of the data segment inclusion
+// proofs of FRC-0058. Aggregates are a directory linking to the roots of
+// their contents and their piece is computed over the CAR of that
+// directory's DAG, so every content is a range of bytes of that CAR. The
+// index lists those ranges, and the proof of a content carries the Merkle
+// paths in the piece tree from the leaves of its range up to the piece
+// commitment. A verifier holding only the blocks of its content can check
+// it against the piece CID of the deals on chain.
+package inclusion
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/bits"
+
+	"github.com/application-research/estuary/util/carindex"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/extern/sector-storage/fr32"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	carutil "github.com/ipld/go-car/util"
+)
+
+const (
+	nodeSize = 32
+	// quads of 127 bytes of data are fr32 padded into 4 leaves
+	quadSize   = 127
+	quadLeaves = 4
+	// minPayload is the fewest bytes a piece is computed over, shorter data
+	// is zero padded
+	minPayload = 65
+)
+
+// Segment is the range of the CAR of the aggregate a content is in, from
+// the section of its root block on
+type Segment struct {
+	Root   cid.Cid `json:"root"`
+	Offset uint64  `json:"offset"`
+	Size   uint64  `json:"size"`
+}
+
+// Path is the root of a subtree of the piece tree covering part of the
+// segment, at Index of Level with the leaves at level 0, and the hashes of
+// its siblings from there up to the piece commitment
+type Path struct {
+	Level    int      `json:"level"`
+	Index    uint64   `json:"index"`
+	Siblings [][]byte `json:"siblings"`
+}
+
+// Proof is the evidence that Segment of the CAR PieceCID was computed over
+// holds the content rooted at Segment.Root
+type Proof struct {
+	PieceCID      cid.Cid             `json:"pieceCid"`
+	PieceSize     abi.PaddedPieceSize `json:"pieceSize"`
+	CarSize       uint64              `json:"carSize"`
+	AggregateRoot cid.Cid             `json:"aggregateRoot"`
+	// Index is the data segment index of the aggregate, the segment of
+	// every content in it
+	Index   []Segment `json:"index"`
+	Segment Segment   `json:"segment"`
+	// Blocks are the blocks of the segment in the order they are in the
+	// CAR. Blocks the content shares with contents before it in the
+	// aggregate are only in the segments of those.
+	Blocks []cid.Cid `json:"blocks"`
+	// Prefix and Suffix are the bytes of the piece around the segment up to
+	// the quads its leaves start and end in
+	Prefix []byte `json:"prefix"`
+	Suffix []byte `json:"suffix"`
+	// Paths are the subtrees covering the leaves of the segment, left to
+	// right
+	Paths []Path `json:"paths"`
+}
+
+// PieceSize is the padded size of the piece computed over a CAR of carSize
+func PieceSize(carSize uint64) abi.PaddedPieceSize {
+	if carSize < minPayload {
+		carSize = minPayload
+	}
+	quads := (carSize + quadSize - 1) / quadSize
+	return abi.PaddedPieceSize(1) << bits.Len64(quads*quadLeaves*nodeSize-1)
+}
+
+func hashNodes(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write(left)  //nolint:errcheck
+	h.Write(right) //nolint:errcheck
+	out := h.Sum(nil)
+	// nodes are field elements, the top two bits are always cleared
+	out[nodeSize-1] &= 0x3f
+	return out
+}
+
+// zeroHashes returns the root of the subtrees of only zeros of every level
+func zeroHashes(depth int) [][]byte {
+	z := make([][]byte, depth+1)
+	z[0] = make([]byte, nodeSize)
+	for i := 1; i <= depth; i++ {
+		z[i] = hashNodes(z[i-1], z[i-1])
+	}
+	return z
+}
+
+// cover returns the largest aligned subtrees that together are the leaves
+// from lo up to hi
+func cover(lo, hi uint64) []Path {
+	var out []Path
+	for lo < hi {
+		lvl := 0
+		for lo&(uint64(2)<<lvl-1) == 0 && lo+uint64(2)<<lvl <= hi {
+			lvl++
+		}
+		out = append(out, Path{Level: lvl, Index: lo >> lvl})
+		lo += uint64(1) << lvl
+	}
+	return out
+}
+
+// leaves fr32 pads data, a whole number of quads, into the leaves of the
+// piece tree
+func leaves(data []byte) [][]byte {
+	out := make([][]byte, 0, len(data)/quadSize*quadLeaves)
+	padded := make([]byte, quadSize+1)
+	for off := 0; off < len(data); off += quadSize {
+		fr32.Pad(data[off:off+quadSize], padded)
+		for i := 0; i < quadLeaves; i++ {
+			out = append(out, append([]byte{}, padded[i*nodeSize:(i+1)*nodeSize]...))
+		}
+	}
+	return out
+}
+
+// segments returns the data segment index of the aggregate, the ranges
+// from the root of every content it links to up to the next one
+func segments(l *carindex.Layout, rootBlock []byte) ([]Segment, error) {
+	nd, err := merkledag.DecodeProtobuf(rootBlock)
+	if err != nil {
+		return nil, fmt.Errorf("decoding root block: %w", err)
+	}
+
+	links := nd.Links()
+	out := make([]Segment, 0, len(links))
+	next := 0
+	for _, lnk := range links {
+		i := next
+		for i < len(l.Sections) && !l.Sections[i].Cid.Equals(lnk.Cid) {
+			i++
+		}
+		if i == len(l.Sections) {
+			// the same content linked again is only written once
+			dup := false
+			for _, s := range out {
+				if s.Root.Equals(lnk.Cid) {
+					out = append(out, s)
+					dup = true
+					break
+				}
+			}
+			if !dup {
+				return nil, fmt.Errorf("content %s is not in the car of the aggregate", lnk.Cid)
+			}
+			continue
+		}
+		out = append(out, Segment{Root: lnk.Cid, Offset: l.Sections[i].Offset})
+		next = i + 1
+	}
+
+	for i := range out {
+		end := l.Size()
+		for _, s := range out[i+1:] {
+			if s.Offset > out[i].Offset {
+				end = s.Offset
+				break
+			}
+		}
+		out[i].Size = end - out[i].Offset
+	}
+	return out, nil
+}
+
+type slot struct {
+	path int
+	at   int
+}
+
+type nodeKey struct {
+	level int
+	index uint64
+}
+
+// tree hashes the leaves of a piece as they come, keeping the siblings the
+// paths need
+type tree struct {
+	depth  int
+	counts []uint64
+	left   [][]byte
+	wanted map[nodeKey][]slot
+	paths  []Path
+	root   []byte
+}
+
+func newTree(depth int, paths []Path) *tree {
+	t := &tree{
+		depth:  depth,
+		counts: make([]uint64, depth+1),
+		left:   make([][]byte, depth+1),
+		wanted: make(map[nodeKey][]slot),
+		paths:  paths,
+	}
+	for pi := range paths {
+		p := &paths[pi]
+		p.Siblings = make([][]byte, depth-p.Level)
+		for lvl := p.Level; lvl < depth; lvl++ {
+			k := nodeKey{level: lvl, index: (p.Index >> (lvl - p.Level)) ^ 1}
+			t.wanted[k] = append(t.wanted[k], slot{path: pi, at: lvl - p.Level})
+		}
+	}
+	return t
+}
+
+func (t *tree) add(level int, h []byte) {
+	for {
+		idx := t.counts[level]
+		t.counts[level]++
+		for _, s := range t.wanted[nodeKey{level: level, index: idx}] {
+			t.paths[s.path].Siblings[s.at] = h
+		}
+		if level == t.depth {
+			t.root = h
+			return
+		}
+		if idx%2 == 0 {
+			t.left[level] = h
+			return
+		}
+		h = hashNodes(t.left[level], h)
+		level++
+	}
+}
+
+// finish fills the rest of the piece with zeros
+func (t *tree) finish() {
+	z := zeroHashes(t.depth)
+	for lvl := 0; lvl < t.depth; lvl++ {
+		if t.counts[lvl]%2 == 1 {
+			t.add(lvl, z[lvl])
+		}
+	}
+}
+
+// proofWriter is written the CAR and hashes it into the tree, keeping the
+// bytes of the prefix and suffix
+type proofWriter struct {
+	t    *tree
+	quad [quadSize]byte
+	fill int
+	pos  uint64
+
+	start, segStart, segEnd, end uint64
+	prefix, suffix               []byte
+}
+
+func (w *proofWriter) Write(b []byte) (int, error) {
+	for i, r := range [][2]uint64{{w.start, w.segStart}, {w.segEnd, w.end}} {
+		lo, hi := r[0], r[1]
+		if lo < w.pos {
+			lo = w.pos
+		}
+		if bend := w.pos + uint64(len(b)); hi > bend {
+			hi = bend
+		}
+		if lo < hi {
+			part := b[lo-w.pos : hi-w.pos]
+			if i == 0 {
+				w.prefix = append(w.prefix, part...)
+			} else {
+				w.suffix = append(w.suffix, part...)
+			}
+		}
+	}
+	w.pos += uint64(len(b))
+
+	for rest := b; len(rest) > 0; {
+		n := copy(w.quad[w.fill:], rest)
+		w.fill += n
+		rest = rest[n:]
+		if w.fill == quadSize {
+			for _, lf := range leaves(w.quad[:]) {
+				w.t.add(0, lf)
+			}
+			w.fill = 0
+		}
+	}
+	return len(b), nil
+}
+
+// Prove returns the proof that the content rooted at content is in the
+// piece of the CAR laid out in l, reading its blocks with get. The whole CAR
+// is read to hash the piece tree.
+func Prove(ctx context.Context, l *carindex.Layout, get carindex.Getter, content cid.Cid) (*Proof, error) {
+	rootBlock, err := get(ctx, l.Root)
+	if err != nil {
+		return nil, fmt.Errorf("reading root block of the aggregate: %w", err)
+	}
+	index, err := segments(l, rootBlock.RawData())
+	if err != nil {
+		return nil, err
+	}
+
+	var seg Segment
+	found := false
+	for _, s := range index {
+		if s.Root.Equals(content) {
+			seg = s
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("aggregate %s has no link to %s", l.Root, content)
+	}
+
+	carSize := l.Size()
+	pieceSize := PieceSize(carSize)
+	depth := bits.TrailingZeros64(uint64(pieceSize) / nodeSize)
+
+	start := seg.Offset / quadSize * quadSize
+	end := (seg.Offset + seg.Size + quadSize - 1) / quadSize * quadSize
+	paths := cover(start/quadSize*quadLeaves, end/quadSize*quadLeaves)
+
+	w := &proofWriter{
+		t:        newTree(depth, paths),
+		start:    start,
+		segStart: seg.Offset,
+		segEnd:   seg.Offset + seg.Size,
+		end:      end,
+	}
+	if err := l.WriteFrom(ctx, get, 0, w); err != nil {
+		return nil, fmt.Errorf("writing car: %w", err)
+	}
+	if w.pos != carSize {
+		return nil, fmt.Errorf("car is %d bytes, expected %d", w.pos, carSize)
+	}
+	// the piece goes on with zeros after the car
+	if w.pos < minPayload {
+		w.Write(make([]byte, minPayload-w.pos)) //nolint:errcheck
+	}
+	if w.pos < end {
+		w.Write(make([]byte, end-w.pos)) //nolint:errcheck
+	}
+	if w.fill > 0 {
+		w.Write(make([]byte, quadSize-w.fill)) //nolint:errcheck
+	}
+	w.t.finish()
+
+	pc, err := commcid.DataCommitmentV1ToCID(w.t.root)
+	if err != nil {
+		return nil, err
+	}
+
+	var blks []cid.Cid
+	for _, s := range l.Sections {
+		if s.Offset >= seg.Offset && s.Offset < seg.Offset+seg.Size {
+			blks = append(blks, s.Cid)
+		}
+	}
+
+	return &Proof{
+		PieceCID:      pc,
+		PieceSize:     pieceSize,
+		CarSize:       carSize,
+		AggregateRoot: l.Root,
+		Index:         index,
+		Segment:       seg,
+		Blocks:        blks,
+		Prefix:        w.prefix,
+		Suffix:        w.suffix,
+		Paths:         w.t.paths,
+	}, nil
+}
+
+// Verify checks that data, the bytes of the segment as the blocks of the
+// content are written in a CAR, is in the piece at the offset of the
+// segment. That the deals on chain are for PieceCID is for the verifier to
+// look up.
+func (p *Proof) Verify(data []byte) error {
+	if uint64(len(data)) != p.Segment.Size {
+		return fmt.Errorf("segment is %d bytes, got %d", p.Segment.Size, len(data))
+	}
+	if err := p.checkBlocks(data); err != nil {
+		return err
+	}
+	if err := p.checkIndex(); err != nil {
+		return err
+	}
+
+	if p.PieceSize != PieceSize(p.CarSize) {
+		return fmt.Errorf("a car of %d bytes makes a piece of %d bytes, not %d", p.CarSize, PieceSize(p.CarSize), p.PieceSize)
+	}
+	depth := bits.TrailingZeros64(uint64(p.PieceSize) / nodeSize)
+
+	if uint64(len(p.Prefix)) > p.Segment.Offset {
+		return fmt.Errorf("prefix of %d bytes is longer than the offset of the segment", len(p.Prefix))
+	}
+	start := p.Segment.Offset - uint64(len(p.Prefix))
+	full := make([]byte, 0, len(p.Prefix)+len(data)+len(p.Suffix))
+	full = append(full, p.Prefix...)
+	full = append(full, data...)
+	full = append(full, p.Suffix...)
+	if start%quadSize != 0 || len(full)%quadSize != 0 {
+		return fmt.Errorf("prefix and suffix don't align the segment to quads")
+	}
+	end := start + uint64(len(full))
+	if end > uint64(p.PieceSize.Unpadded()) {
+		return fmt.Errorf("segment ends past the end of the piece")
+	}
+
+	lo := start / quadSize * quadLeaves
+	want := cover(lo, end/quadSize*quadLeaves)
+	if len(want) != len(p.Paths) {
+		return fmt.Errorf("segment is covered by %d subtrees, proof has %d", len(want), len(p.Paths))
+	}
+
+	commP, err := commcid.CIDToDataCommitmentV1(p.PieceCID)
+	if err != nil {
+		return err
+	}
+
+	lvs := leaves(full)
+	for i, path := range p.Paths {
+		if path.Level != want[i].Level || path.Index != want[i].Index {
+			return fmt.Errorf("subtree %d is at level %d index %d, expected level %d index %d", i, path.Level, path.Index, want[i].Level, want[i].Index)
+		}
+		if len(path.Siblings) != depth-path.Level {
+			return fmt.Errorf("subtree %d has %d siblings, expected %d", i, len(path.Siblings), depth-path.Level)
+		}
+
+		first := path.Index<<path.Level - lo
+		layer := lvs[first : first+uint64(1)<<path.Level]
+		for len(layer) > 1 {
+			next := make([][]byte, len(layer)/2)
+			for j := range next {
+				next[j] = hashNodes(layer[2*j], layer[2*j+1])
+			}
+			layer = next
+		}
+
+		h, idx := layer[0], path.Index
+		for _, sib := range path.Siblings {
+			if len(sib) != nodeSize {
+				return fmt.Errorf("subtree %d has a sibling of %d bytes", i, len(sib))
+			}
+			if idx%2 == 0 {
+				h = hashNodes(h, sib)
+			} else {
+				h = hashNodes(sib, h)
+			}
+			idx /= 2
+		}
+		if !bytes.Equal(h, commP) {
+			return fmt.Errorf("subtree %d does not lead up to the piece commitment", i)
+		}
+	}
+	return nil
+}
+
+// checkBlocks checks that data is the blocks of the proof, each hashing to
+// its cid, starting with the root of the content
+func (p *Proof) checkBlocks(data []byte) error {
+	br := bufio.NewReader(bytes.NewReader(data))
+	for i := 0; ; i++ {
+		c, blk, err := carutil.ReadNode(br)
+		if err == io.EOF {
+			if i != len(p.Blocks) {
+				return fmt.Errorf("segment has %d blocks, expected %d", i, len(p.Blocks))
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading block %d of the segment: %w", i, err)
+		}
+		if i >= len(p.Blocks) || !c.Equals(p.Blocks[i]) {
+			return fmt.Errorf("block %d of the segment is %s, not the one of the proof", i, c)
+		}
+		if i == 0 && !c.Equals(p.Segment.Root) {
+			return fmt.Errorf("segment starts with %s, not the root %s", c, p.Segment.Root)
+		}
+		sum, err := c.Prefix().Sum(blk)
+		if err != nil {
+			return err
+		}
+		if !sum.Equals(c) {
+			return fmt.Errorf("block %s of the segment hashes to %s", c, sum)
+		}
+	}
+}
+
+// checkIndex checks that the segment is in the index and the index is in
+// order within the CAR
+func (p *Proof) checkIndex() error {
+	found := false
+	var prevEnd uint64
+	for _, s := range p.Index {
+		if s == p.Segment {
+			found = true
+		}
+		if s.Offset+s.Size > p.CarSize {
+			return fmt.Errorf("segment of %s ends past the end of the car", s.Root)
+		}
+		if s.Offset+s.Size <= prevEnd && s.Offset < prevEnd {
+			// a repeated link shares the segment written before
+			continue
+		}
+		if s.Offset < prevEnd {
+			return fmt.Errorf("segment of %s overlaps the one before it", s.Root)
+		}
+		prevEnd = s.Offset + s.Size
+	}
+	if !found {
+		return fmt.Errorf("segment of %s is not in the index", p.Segment.Root)
+	}
+	return nil
+}
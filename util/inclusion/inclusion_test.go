@@ -0,0 +1,118 @@
+package inclusion
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/application-research/estuary/util/piece"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	carutil "github.com/ipld/go-car/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// buildContent stores a file of n leaves, the last one shared by every file
+func buildContent(t *testing.T, bs blockstore.Blockstore, name string, n int) cid.Cid {
+	ctx := context.Background()
+	root := merkledag.NodeWithData([]byte(name))
+	for i := 0; i < n; i++ {
+		leaf := merkledag.NewRawNode(bytes.Repeat([]byte(fmt.Sprintf("%s-%d", name, i)), 300))
+		require.NoError(t, bs.Put(ctx, leaf))
+		require.NoError(t, root.AddNodeLink(fmt.Sprint(i), leaf))
+	}
+	shared := merkledag.NewRawNode([]byte("shared by every file"))
+	require.NoError(t, bs.Put(ctx, shared))
+	require.NoError(t, root.AddNodeLink("shared", shared))
+	require.NoError(t, bs.Put(ctx, root))
+	return root.Cid()
+}
+
+func segmentData(t *testing.T, bs blockstore.Blockstore, p *Proof) []byte {
+	var buf bytes.Buffer
+	for _, c := range p.Blocks {
+		blk, err := bs.Get(context.Background(), c)
+		require.NoError(t, err)
+		require.NoError(t, carutil.LdWrite(&buf, c.Bytes(), blk.RawData()))
+	}
+	return buf.Bytes()
+}
+
+func TestProof(t *testing.T) {
+	ctx := context.Background()
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+
+	var conts []cid.Cid
+	sizes := []int{3, 40, 1, 17}
+	agg := merkledag.NodeWithData([]byte("aggregate"))
+	for i, n := range sizes {
+		c := buildContent(t, bs, fmt.Sprintf("file%d", i), n)
+		conts = append(conts, c)
+		require.NoError(t, agg.AddRawLink(fmt.Sprintf("%d-file", i), &ipld.Link{Cid: c}))
+	}
+	require.NoError(t, bs.Put(ctx, agg))
+
+	pc, err := piece.Generate(ctx, agg.Cid(), bs)
+	require.NoError(t, err)
+
+	for i, c := range conts {
+		p, err := Prove(ctx, pc.Layout, bs.Get, c)
+		require.NoError(t, err)
+		assert.Equal(t, pc.PieceCID, p.PieceCID)
+		assert.Equal(t, pc.PieceSize.Padded(), p.PieceSize)
+		assert.Equal(t, pc.CarSize, p.CarSize)
+		assert.Len(t, p.Index, len(conts))
+		assert.Equal(t, c, p.Segment.Root)
+		if i == 0 {
+			assert.Len(t, p.Blocks, sizes[i]+2)
+		} else {
+			// the shared block is only in the segment of the first file
+			assert.Len(t, p.Blocks, sizes[i]+1)
+			assert.NotContains(t, p.Blocks, merkledag.NewRawNode([]byte("shared by every file")).Cid())
+		}
+
+		data := segmentData(t, bs, p)
+		require.NoError(t, p.Verify(data))
+
+		bad := append([]byte{}, data...)
+		bad[len(bad)-1] ^= 1
+		assert.Error(t, p.Verify(bad))
+
+		sib := p.Paths[0].Siblings[0]
+		p.Paths[0].Siblings[0] = make([]byte, len(sib))
+		assert.Error(t, p.Verify(data))
+		p.Paths[0].Siblings[0] = sib
+
+		p.Segment.Offset++
+		assert.Error(t, p.Verify(data))
+	}
+
+	_, err = Prove(ctx, pc.Layout, bs.Get, merkledag.NewRawNode([]byte("other")).Cid())
+	assert.Error(t, err)
+}
+
+func TestPieceSize(t *testing.T) {
+	assert.EqualValues(t, 128, PieceSize(1))
+	assert.EqualValues(t, 128, PieceSize(127))
+	assert.EqualValues(t, 256, PieceSize(128))
+	assert.EqualValues(t, 1024, PieceSize(1016))
+	assert.EqualValues(t, 2048, PieceSize(1017))
+}
+
+func TestCover(t *testing.T) {
+	for _, r := range [][2]uint64{{0, 1}, {0, 8}, {3, 17}, {4, 12}, {5, 6}, {12, 100}} {
+		next := r[0]
+		for _, p := range cover(r[0], r[1]) {
+			assert.Equal(t, next, p.Index<<p.Level)
+			assert.Zero(t, p.Index<<p.Level%(uint64(1)<<p.Level))
+			next += uint64(1) << p.Level
+		}
+		assert.Equal(t, r[1], next)
+	}
+}
@@ -0,0 +1,105 @@
+package util
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	logging "github.com/ipfs/go-log/v2"
+	"go.uber.org/zap/zapcore"
+)
+
+// SetupLogFormat switches the output format of every logger. It resets
+// subsystem levels to the go-log defaults, so call it before setting levels.
+func SetupLogFormat(format string) error {
+	cfg := logging.GetConfig()
+	switch strings.ToLower(format) {
+	case "", "color":
+		cfg.Format = logging.ColorizedOutput
+	case "nocolor", "plaintext":
+		cfg.Format = logging.PlaintextOutput
+	case "json":
+		cfg.Format = logging.JSONOutput
+	default:
+		return fmt.Errorf("unrecognized log format %q, must be one of: color, nocolor, json", format)
+	}
+
+	logging.SetupLogging(cfg)
+	return nil
+}
+
+type SubsystemLogLevel struct {
+	System string `json:"system"`
+	Level  string `json:"level"`
+}
+
+var logLevels = []zapcore.Level{
+	zapcore.DebugLevel,
+	zapcore.InfoLevel,
+	zapcore.WarnLevel,
+	zapcore.ErrorLevel,
+	zapcore.DPanicLevel,
+	zapcore.PanicLevel,
+	zapcore.FatalLevel,
+}
+
+// GetLogLevels returns the current level of every registered logging subsystem
+func GetLogLevels() []SubsystemLogLevel {
+	subs := logging.GetSubsystems()
+	sort.Strings(subs)
+
+	out := make([]SubsystemLogLevel, 0, len(subs))
+	for _, s := range subs {
+		core := logging.Logger(s).Desugar().Core()
+
+		lvl := zapcore.FatalLevel
+		for _, l := range logLevels {
+			if core.Enabled(l) {
+				lvl = l
+				break
+			}
+		}
+		out = append(out, SubsystemLogLevel{System: s, Level: lvl.String()})
+	}
+	return out
+}
+
+// SetLogLevel changes the level of a subsystem at runtime. system may be "*"
+// for every subsystem, or a regular expression if regex is set.
+func SetLogLevel(system, level string, regex bool) error {
+	var err error
+	if regex {
+		err = logging.SetLogLevelRegex(system, level)
+	} else {
+		err = logging.SetLogLevel(system, level)
+	}
+	if err != nil {
+		return &HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("failed to set log level of %q to %q: %s", system, level, err),
+		}
+	}
+	return nil
+}
+
+// ApplyLogLevels sets the level of each subsystem in levels. The "*" entry,
+// if any, is applied first so that individual subsystems can override it.
+func ApplyLogLevels(levels map[string]string) error {
+	if lvl, ok := levels["*"]; ok {
+		if err := logging.SetLogLevel("*", lvl); err != nil {
+			return fmt.Errorf("failed to set log level of all subsystems to %q: %w", lvl, err)
+		}
+	}
+
+	for system, lvl := range levels {
+		if system == "*" {
+			continue
+		}
+		if err := logging.SetLogLevel(system, lvl); err != nil {
+			return fmt.Errorf("failed to set log level of %q to %q: %w", system, lvl, err)
+		}
+	}
+	return nil
+}
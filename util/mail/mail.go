@@ -0,0 +1,180 @@
+// Package mail sends plain text emails over SMTP, rendered from templates
+// that carry their own subject line.
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Sender delivers mail through an SMTP server. Connections are upgraded
+// with STARTTLS when the server offers it, or use TLS from the start with
+// ImplicitTLS, as on port 465.
+type Sender struct {
+	Host        string
+	Port        int
+	Username    string
+	Password    string
+	From        string
+	ImplicitTLS bool
+}
+
+// Send mails a plain text message to a single recipient
+func (s *Sender) Send(ctx context.Context, to, subject, body string) error {
+	if !ValidAddress(to) {
+		return fmt.Errorf("invalid recipient %q", to)
+	}
+
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(dl); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	if s.ImplicitTLS {
+		conn = tls.Client(conn, &tls.Config{ServerName: s.Host})
+	}
+
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if !s.ImplicitTLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(&tls.Config{ServerName: s.Host}); err != nil {
+				return err
+			}
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(address(s.From)); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(Message(s.From, to, subject, body, time.Now())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// ValidAddress reports whether s is a bare email address, like a@b.c
+func ValidAddress(s string) bool {
+	a, err := netmail.ParseAddress(s)
+	return err == nil && a.Address == s
+}
+
+// address returns the bare address of a From like "Estuary <a@b.c>"
+func address(from string) string {
+	if i := strings.LastIndex(from, "<"); i >= 0 {
+		return strings.TrimSuffix(from[i+1:], ">")
+	}
+	return from
+}
+
+// Message formats a plain text email with its headers
+func Message(from, to, subject, body string, date time.Time) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", messageID(), domain(address(from)))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+
+	sc := bufio.NewScanner(strings.NewReader(body))
+	for sc.Scan() {
+		buf.WriteString(sc.Text())
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes()
+}
+
+func messageID() string {
+	b := make([]byte, 16)
+	rand.Read(b) //nolint:errcheck
+	return hex.EncodeToString(b)
+}
+
+func domain(addr string) string {
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		return addr[i+1:]
+	}
+	return "localhost"
+}
+
+// Template renders a subject and a body. The first line of its text is
+// the subject, as "Subject: ...", followed by an empty line and the body.
+type Template struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+// ParseTemplate parses the text of a template
+func ParseTemplate(name, text string) (*Template, error) {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	parts := strings.SplitN(text, "\n\n", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "Subject:") || strings.Contains(parts[0], "\n") {
+		return nil, fmt.Errorf("template %s must start with a subject line followed by an empty line", name)
+	}
+
+	subject, err := template.New(name + ".subject").Parse(strings.TrimSpace(strings.TrimPrefix(parts[0], "Subject:")))
+	if err != nil {
+		return nil, err
+	}
+	body, err := template.New(name).Parse(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return &Template{subject: subject, body: body}, nil
+}
+
+// Execute renders the subject and the body with data
+func (t *Template) Execute(data interface{}) (string, string, error) {
+	var subject, body bytes.Buffer
+	if err := t.subject.Execute(&subject, data); err != nil {
+		return "", "", err
+	}
+	if err := t.body.Execute(&body, data); err != nil {
+		return "", "", err
+	}
+	// subjects are a single header line
+	return strings.Join(strings.Fields(subject.String()), " "), body.String(), nil
+}
@@ -0,0 +1,110 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTemplate(t *testing.T) {
+	_, err := ParseTemplate("test", "Subject: {{.N}} pins\n  failed\n\nHello {{.Name}},\n")
+	require.Error(t, err)
+
+	tmpl, err := ParseTemplate("test", "Subject: {{.N}} pins failed\n\nHello {{.Name}},\n")
+	require.NoError(t, err)
+
+	subject, body, err := tmpl.Execute(map[string]interface{}{"N": 2, "Name": "alice"})
+	require.NoError(t, err)
+	assert.Equal(t, "2 pins failed", subject)
+	assert.Equal(t, "Hello alice,\n", body)
+
+	_, err = ParseTemplate("test", "Hello\n")
+	require.Error(t, err)
+}
+
+// serveSMTP accepts a single message and sends its data on msgs
+func serveSMTP(t *testing.T, l net.Listener, msgs chan<- string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(s string) {
+		_, err := conn.Write([]byte(s + "\r\n"))
+		require.NoError(t, err)
+	}
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL"), strings.HasPrefix(cmd, "RCPT"):
+			reply("250 ok")
+		case cmd == "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			msgs <- data.String()
+			reply("250 queued")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 unknown")
+		}
+	}
+}
+
+func TestValidAddress(t *testing.T) {
+	assert.True(t, ValidAddress("alice@example.com"))
+	assert.False(t, ValidAddress("Alice <alice@example.com>"))
+	assert.False(t, ValidAddress("alice"))
+	assert.False(t, ValidAddress("alice@example.com\r\nBcc: eve@example.com"))
+}
+
+func TestSend(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	msgs := make(chan string, 1)
+	go serveSMTP(t, l, msgs)
+
+	addr := l.Addr().(*net.TCPAddr)
+	s := &Sender{Host: "127.0.0.1", Port: addr.Port, From: "Estuary <noreply@estuary.test>"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	require.NoError(t, s.Send(ctx, "alice@example.com", "Pin failed", "line one\nline two\n"))
+
+	msg := <-msgs
+	assert.Contains(t, msg, "To: alice@example.com\r\n")
+	assert.Contains(t, msg, "Subject: Pin failed\r\n")
+	assert.Contains(t, msg, "@estuary.test>\r\n")
+	assert.True(t, strings.HasSuffix(msg, "\r\n\r\nline one\r\nline two\r\n"))
+
+	require.Error(t, s.Send(ctx, "bob@example.com\r\nBcc: eve@example.com", "x", "y"))
+}
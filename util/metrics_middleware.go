@@ -0,0 +1,49 @@
+package util
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/application-research/estuary/metrics"
+	"github.com/labstack/echo/v4"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"golang.org/x/xerrors"
+)
+
+// MetricsMiddleware records the latency of every api request, tagged by
+// route template, method and the status code that will be sent back
+func MetricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		ctx, _ := tag.New(c.Request().Context(),
+			tag.Upsert(metrics.Route, c.Path()),
+			tag.Upsert(metrics.Method, c.Request().Method),
+			tag.Upsert(metrics.StatusCode, strconv.Itoa(responseStatus(c, err))),
+		)
+		stats.Record(ctx, metrics.APIRequestDuration.M(metrics.SinceInMilliseconds(start)))
+		return err
+	}
+}
+
+// responseStatus mirrors the status code selection done by ErrorHandler for
+// errors that have not been written to the response yet
+func responseStatus(c echo.Context, err error) int {
+	if err == nil || c.Response().Committed {
+		return c.Response().Status
+	}
+
+	var httpRespErr *HttpError
+	if xerrors.As(err, &httpRespErr) {
+		return httpRespErr.Code
+	}
+
+	var echoErr *echo.HTTPError
+	if xerrors.As(err, &echoErr) {
+		return echoErr.Code
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,257 @@
+// Package oidc logs users in through an OpenID Connect provider with the
+// authorization code flow. Providers that don't issue id tokens, like
+// GitHub, work as plain OAuth2 providers whose user info endpoint is read
+// instead.
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config is a provider. With Issuer set its endpoints are discovered,
+// AuthURL, TokenURL and UserInfoURL override them or configure OAuth2 only
+// providers. GroupsClaim is the claim the users groups are read from.
+type Config struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	AuthURL      string
+	TokenURL     string
+	UserInfoURL  string
+	Scopes       []string
+	GroupsClaim  string
+	Timeout      time.Duration
+}
+
+// Identity is who logged in
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Groups        []string
+}
+
+// Provider logs users in with one identity provider
+type Provider struct {
+	cfg     Config
+	client  *http.Client
+	jwksURL string
+
+	lk          sync.Mutex
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+type discovery struct {
+	Issuer      string `json:"issuer"`
+	AuthURL     string `json:"authorization_endpoint"`
+	TokenURL    string `json:"token_endpoint"`
+	UserInfoURL string `json:"userinfo_endpoint"`
+	JwksURL     string `json:"jwks_uri"`
+}
+
+// New sets up a provider, discovering its endpoints if it has an issuer
+func New(ctx context.Context, cfg Config) (*Provider, error) {
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	p := &Provider{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+	}
+
+	if cfg.Issuer != "" {
+		var d discovery
+		if err := p.getJSON(ctx, strings.TrimSuffix(cfg.Issuer, "/")+"/.well-known/openid-configuration", "", &d); err != nil {
+			return nil, fmt.Errorf("discovering %s: %w", cfg.Issuer, err)
+		}
+		if d.Issuer != cfg.Issuer {
+			return nil, fmt.Errorf("discovery of %s returned issuer %s", cfg.Issuer, d.Issuer)
+		}
+		if p.cfg.AuthURL == "" {
+			p.cfg.AuthURL = d.AuthURL
+		}
+		if p.cfg.TokenURL == "" {
+			p.cfg.TokenURL = d.TokenURL
+		}
+		if p.cfg.UserInfoURL == "" {
+			p.cfg.UserInfoURL = d.UserInfoURL
+		}
+		p.jwksURL = d.JwksURL
+	}
+
+	if p.cfg.AuthURL == "" || p.cfg.TokenURL == "" {
+		return nil, fmt.Errorf("provider %s needs an issuer or auth and token urls", cfg.Name)
+	}
+	if p.jwksURL == "" && p.cfg.UserInfoURL == "" {
+		return nil, fmt.Errorf("provider %s needs an issuer or a user info url", cfg.Name)
+	}
+	return p, nil
+}
+
+func (p *Provider) Name() string {
+	return p.cfg.Name
+}
+
+// AuthCodeURL is where users are sent to log in, they come back to
+// redirectURL with a code and state
+func (p *Provider) AuthCodeURL(state, nonce, redirectURL string) string {
+	scopes := p.cfg.Scopes
+	if len(scopes) == 0 && p.jwksURL != "" {
+		scopes = []string{"openid", "email", "profile"}
+	}
+
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.cfg.ClientID)
+	v.Set("redirect_uri", redirectURL)
+	v.Set("state", state)
+	if len(scopes) > 0 {
+		v.Set("scope", strings.Join(scopes, " "))
+	}
+	if p.jwksURL != "" {
+		v.Set("nonce", nonce)
+	}
+
+	sep := "?"
+	if strings.Contains(p.cfg.AuthURL, "?") {
+		sep = "&"
+	}
+	return p.cfg.AuthURL + sep + v.Encode()
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	Error       string `json:"error"`
+	ErrorDesc   string `json:"error_description"`
+}
+
+// Exchange trades the code a user came back with for their identity
+func (p *Provider) Exchange(ctx context.Context, code, nonce, redirectURL string) (*Identity, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURL)
+	form.Set("client_id", p.cfg.ClientID)
+	form.Set("client_secret", p.cfg.ClientSecret)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// github answers with a form unless asked for json
+	req.Header.Set("Accept", "application/json")
+
+	var tok tokenResponse
+	if err := p.doJSON(req, &tok); err != nil {
+		return nil, fmt.Errorf("exchanging code: %w", err)
+	}
+	if tok.Error != "" {
+		return nil, fmt.Errorf("exchanging code: %s %s", tok.Error, tok.ErrorDesc)
+	}
+
+	var claims map[string]interface{}
+	if tok.IDToken != "" && p.jwksURL != "" {
+		claims, err = p.verifyIDToken(ctx, tok.IDToken, nonce)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if tok.AccessToken == "" || p.cfg.UserInfoURL == "" {
+			return nil, fmt.Errorf("provider returned no id token")
+		}
+		if err := p.getJSON(ctx, p.cfg.UserInfoURL, tok.AccessToken, &claims); err != nil {
+			return nil, fmt.Errorf("getting user info: %w", err)
+		}
+	}
+	return p.identity(claims)
+}
+
+func (p *Provider) identity(claims map[string]interface{}) (*Identity, error) {
+	str := func(k string) string {
+		switch v := claims[k].(type) {
+		case string:
+			return v
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		return ""
+	}
+
+	id := &Identity{
+		Subject: str("sub"),
+		Email:   str("email"),
+		Name:    str("preferred_username"),
+	}
+	// plain OAuth2 providers like github have ids and logins instead
+	if id.Subject == "" {
+		id.Subject = str("id")
+	}
+	if id.Name == "" {
+		id.Name = str("login")
+	}
+	if id.Name == "" {
+		id.Name = str("name")
+	}
+	if id.Subject == "" {
+		return nil, fmt.Errorf("provider returned no subject")
+	}
+
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		id.EmailVerified = v
+	case string:
+		id.EmailVerified = v == "true"
+	}
+
+	switch v := claims[p.cfg.GroupsClaim].(type) {
+	case []interface{}:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				id.Groups = append(id.Groups, s)
+			}
+		}
+	case string:
+		id.Groups = strings.Fields(v)
+	}
+	return id, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, u, bearer string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	return p.doJSON(req, out)
+}
+
+func (p *Provider) doJSON(req *http.Request, out interface{}) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %d: %s", req.URL.Path, resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,166 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signToken(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	return signTokenWithKid(t, key, "k1", claims)
+}
+
+func signTokenWithKid(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	enc := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signing := enc(map[string]string{"alg": "RS256", "kid": kid}) + "." + enc(claims)
+	digest := sha256.Sum256([]byte(signing))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	return signing + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	ctx := context.Background()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	var srv *httptest.Server
+	claims := map[string]interface{}{}
+	kid := "k1"
+	jwksFetches := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{ //nolint:errcheck
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/auth",
+			"token_endpoint":         srv.URL + "/token",
+			"jwks_uri":               srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwksFetches++
+		json.NewEncoder(w).Encode(map[string]interface{}{ //nolint:errcheck
+			"keys": []map[string]string{{
+				"kid": "k1",
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "thecode", r.Form.Get("code"))
+		assert.Equal(t, "secret", r.Form.Get("client_secret"))
+		json.NewEncoder(w).Encode(map[string]string{ //nolint:errcheck
+			"access_token": "at",
+			"id_token":     signTokenWithKid(t, key, kid, claims),
+		})
+	})
+	srv = httptest.NewServer(mux)
+	defer srv.Close()
+
+	p, err := New(ctx, Config{Name: "idp", Issuer: srv.URL, ClientID: "estuary", ClientSecret: "secret", Timeout: time.Second * 5})
+	require.NoError(t, err)
+
+	u, err := url.Parse(p.AuthCodeURL("st", "nc", "http://localhost/cb"))
+	require.NoError(t, err)
+	assert.Equal(t, "/auth", u.Path)
+	assert.Equal(t, "st", u.Query().Get("state"))
+	assert.Equal(t, "nc", u.Query().Get("nonce"))
+	assert.Equal(t, "openid email profile", u.Query().Get("scope"))
+
+	valid := func() {
+		claims = map[string]interface{}{
+			"iss":            srv.URL,
+			"aud":            "estuary",
+			"sub":            "1234",
+			"email":          "a@b.c",
+			"email_verified": true,
+			"groups":         []string{"eng", "ops"},
+			"nonce":          "nc",
+			"exp":            time.Now().Add(time.Hour).Unix(),
+		}
+	}
+
+	valid()
+	id, err := p.Exchange(ctx, "thecode", "nc", "http://localhost/cb")
+	require.NoError(t, err)
+	assert.Equal(t, "1234", id.Subject)
+	assert.Equal(t, "a@b.c", id.Email)
+	assert.True(t, id.EmailVerified)
+	assert.Equal(t, []string{"eng", "ops"}, id.Groups)
+
+	_, err = p.Exchange(ctx, "thecode", "other", "http://localhost/cb")
+	assert.Error(t, err, "nonce must match")
+
+	claims["aud"] = "someone-else"
+	_, err = p.Exchange(ctx, "thecode", "nc", "http://localhost/cb")
+	assert.Error(t, err)
+
+	valid()
+	claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	_, err = p.Exchange(ctx, "thecode", "nc", "http://localhost/cb")
+	assert.Error(t, err)
+
+	// unknown key ids get the key set fetched again, but not for every token
+	assert.Equal(t, 1, jwksFetches)
+	valid()
+	kid = "k2"
+	_, err = p.Exchange(ctx, "thecode", "nc", "http://localhost/cb")
+	assert.Error(t, err)
+	_, err = p.Exchange(ctx, "thecode", "nc", "http://localhost/cb")
+	assert.Error(t, err)
+	assert.Equal(t, 1, jwksFetches)
+}
+
+func TestOAuth2UserInfo(t *testing.T) {
+	ctx := context.Background()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Accept"))
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "at"}) //nolint:errcheck
+	})
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer at", r.Header.Get("Authorization"))
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": 42, "login": "octocat"}) //nolint:errcheck
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	_, err := New(ctx, Config{Name: "gh", AuthURL: srv.URL + "/auth", TokenURL: srv.URL + "/token"})
+	assert.Error(t, err, "needs a way to get the identity")
+
+	p, err := New(ctx, Config{
+		Name:        "gh",
+		AuthURL:     srv.URL + "/auth",
+		TokenURL:    srv.URL + "/token",
+		UserInfoURL: srv.URL + "/user",
+		Scopes:      []string{"read:user"},
+	})
+	require.NoError(t, err)
+
+	id, err := p.Exchange(ctx, "code", "", "http://localhost/cb")
+	require.NoError(t, err)
+	assert.Equal(t, "42", id.Subject)
+	assert.Equal(t, "octocat", id.Name)
+	assert.False(t, id.EmailVerified)
+}
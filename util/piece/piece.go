@@ -0,0 +1,216 @@
+// Package piece prepares the piece for a deal in a single pass over a DAG.
+//
+// Generating a piece commitment used to walk the DAG once to size the CAR and
+// a second time to stream it into the commP hasher. Here the CAR is written
+// straight into the hasher while counting bytes, so every block is read from
+// the blockstore exactly once.
+//
+// An aggregate is hashed along with writing its CAR the same way, except
+// that the contents in it whose CAR layout is stored already have their
+// blocks read in that order, with no walk of their DAGs.
+package piece
+
+import (
+	"context"
+	"io"
+
+	"github.com/application-research/estuary/util/carindex"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/filecoin-project/go-fil-markets/shared"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	car "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"golang.org/x/xerrors"
+)
+
+// maxTraversalLinks matches the limit filclient uses, so the CAR we hash is
+// the same one a provider rebuilds on its side
+const maxTraversalLinks = 32 * (1 << 20)
+
+// ReadStore is the subset of a blockstore needed to read a DAG.
+type ReadStore = car.ReadStore
+
+type Piece struct {
+	PieceCID  cid.Cid
+	PieceSize abi.UnpaddedPieceSize
+	CarSize   uint64
+	Blocks    int
+	// Layout is where every block is in the CAR
+	Layout *carindex.Layout
+}
+
+type countingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += uint64(n)
+	return n, err
+}
+
+func newCar(ctx context.Context, root cid.Cid, bs ReadStore) car.SelectiveCar {
+	return car.NewSelectiveCar(ctx, bs,
+		[]car.Dag{{Root: root, Selector: shared.AllSelector()}},
+		car.MaxTraversalLinks(maxTraversalLinks),
+		car.TraverseLinksOnlyOnce(),
+	)
+}
+
+// WriteCar writes the CAR for root that the piece is computed over, for
+// providers that fetch the data of a deal from us
+func WriteCar(ctx context.Context, root cid.Cid, bs ReadStore, w io.Writer) error {
+	return newCar(ctx, root, bs).Write(w)
+}
+
+// Layout returns where every block is in the CAR for root, without
+// computing the piece
+func Layout(ctx context.Context, root cid.Cid, bs ReadStore) (*carindex.Layout, error) {
+	layout, err := carindex.New(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := newCar(ctx, root, bs).Write(io.Discard, layout.Add); err != nil {
+		return nil, xerrors.Errorf("writing car: %w", err)
+	}
+	return layout, nil
+}
+
+// Generate writes the CAR for root into a commP calculator and returns the
+// resulting piece, along with the size of the CAR it was computed over.
+func Generate(ctx context.Context, root cid.Cid, bs ReadStore) (*Piece, error) {
+	calc := new(commp.Calc)
+	cw := &countingWriter{w: calc}
+
+	layout, err := carindex.New(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := newCar(ctx, root, bs).Write(cw, layout.Add); err != nil {
+		return nil, xerrors.Errorf("writing car: %w", err)
+	}
+	return digest(calc, cw.n, layout)
+}
+
+// Layouts returns the stored CAR layout of root, if there is one
+type Layouts func(root cid.Cid) (*carindex.Layout, bool)
+
+// GenerateAggregate is Generate for an aggregate, whose root links the
+// contents aggregated in it. The contents layouts has the CAR layout of are
+// read block by block in that order instead of being walked, the others are
+// walked as Generate does. The CAR and piece are the same as Generate's.
+func GenerateAggregate(ctx context.Context, root cid.Cid, bs ReadStore, layouts Layouts) (*Piece, error) {
+	if root.Type() != cid.DagProtobuf {
+		return Generate(ctx, root, bs)
+	}
+
+	rblk, err := bs.Get(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := merkledag.DecodeProtobuf(rblk.RawData())
+	if err != nil {
+		return nil, err
+	}
+
+	calc := new(commp.Calc)
+	aw := &aggregateWriter{
+		cw:   &countingWriter{w: calc},
+		seen: cid.NewSet(),
+	}
+	aw.layout, err = carindex.New(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{root}, Version: 1}, aw.cw); err != nil {
+		return nil, err
+	}
+	if err := aw.put(root, rblk.RawData()); err != nil {
+		return nil, err
+	}
+
+	// the contents are written in the order the walk of the whole aggregate
+	// visits them, skipping the blocks it would have visited already
+	for _, lnk := range dir.Links() {
+		if aw.seen.Has(lnk.Cid) {
+			continue
+		}
+
+		if l, ok := layouts(lnk.Cid); ok && l.Root.Equals(lnk.Cid) {
+			for _, s := range l.Sections {
+				if aw.seen.Has(s.Cid) {
+					continue
+				}
+				blk, err := bs.Get(ctx, s.Cid)
+				if err != nil {
+					return nil, xerrors.Errorf("reading block %s: %w", s.Cid, err)
+				}
+				if err := aw.put(s.Cid, blk.RawData()); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		if err := newCar(ctx, lnk.Cid, bs).Write(io.Discard, func(b car.Block) error {
+			return aw.put(b.BlockCID, b.Data)
+		}); err != nil {
+			return nil, xerrors.Errorf("writing car of %s: %w", lnk.Cid, err)
+		}
+	}
+	return digest(calc, aw.cw.n, aw.layout)
+}
+
+// aggregateWriter writes the blocks of an aggregate to its CAR, each once
+type aggregateWriter struct {
+	cw     *countingWriter
+	layout *carindex.Layout
+	seen   *cid.Set
+}
+
+func (aw *aggregateWriter) put(c cid.Cid, data []byte) error {
+	if !aw.seen.Visit(c) {
+		return nil
+	}
+
+	offset := aw.cw.n
+	if err := carutil.LdWrite(aw.cw, c.Bytes(), data); err != nil {
+		return err
+	}
+	return aw.layout.Add(car.Block{BlockCID: c, Data: data, Offset: offset, Size: aw.cw.n - offset})
+}
+
+// digest finishes the piece of a CAR of carSize bytes written into calc
+func digest(calc *commp.Calc, carSize uint64, layout *carindex.Layout) (*Piece, error) {
+	// very small cars are zero padded, which is what the piece gets padded
+	// with anyway
+	if carSize < commp.MinPiecePayload {
+		if _, err := calc.Write(make([]byte, commp.MinPiecePayload-carSize)); err != nil {
+			return nil, err
+		}
+	}
+
+	raw, paddedSize, err := calc.Digest()
+	if err != nil {
+		return nil, xerrors.Errorf("computing commP: %w", err)
+	}
+
+	pc, err := commcid.DataCommitmentV1ToCID(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Piece{
+		PieceCID:  pc,
+		PieceSize: abi.PaddedPieceSize(paddedSize).Unpadded(),
+		CarSize:   carSize,
+		Blocks:    len(layout.Sections),
+		Layout:    layout,
+	}, nil
+}
@@ -0,0 +1,147 @@
+package piece
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/application-research/estuary/util/carindex"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/filecoin-project/go-fil-markets/shared"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	car "github.com/ipld/go-car"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingStore struct {
+	blockstore.Blockstore
+	gets int
+}
+
+func (cs *countingStore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	cs.gets++
+	return cs.Blockstore.Get(ctx, c)
+}
+
+func buildDag(t *testing.T, bs blockstore.Blockstore, fanout int) (cid.Cid, int) {
+	ctx := context.Background()
+	root := merkledag.NodeWithData([]byte("root"))
+	dup := merkledag.NewRawNode([]byte("shared"))
+	assert.NoError(t, bs.Put(ctx, dup))
+	for i := 0; i < fanout; i++ {
+		leaf := merkledag.NewRawNode(bytes.Repeat([]byte(fmt.Sprint(i)), 1000))
+		assert.NoError(t, bs.Put(ctx, leaf))
+		assert.NoError(t, root.AddNodeLink(fmt.Sprint(i), leaf))
+		// every child links the same block, which must only be written once
+		assert.NoError(t, root.AddNodeLink(fmt.Sprintf("s%d", i), dup))
+	}
+	assert.NoError(t, bs.Put(ctx, root))
+	return root.Cid(), fanout + 2
+}
+
+// twoPass computes the piece the way filclient does, preparing the car first
+// and then dumping it into the hasher
+func twoPass(t *testing.T, root cid.Cid, bs blockstore.Blockstore) (cid.Cid, uint64) {
+	ctx := context.Background()
+	prepared, err := car.NewSelectiveCar(ctx, bs,
+		[]car.Dag{{Root: root, Selector: shared.AllSelector()}},
+		car.TraverseLinksOnlyOnce(),
+	).Prepare()
+	assert.NoError(t, err)
+
+	calc := new(commp.Calc)
+	assert.NoError(t, prepared.Dump(ctx, calc))
+	raw, _, err := calc.Digest()
+	assert.NoError(t, err)
+	pc, err := commcid.DataCommitmentV1ToCID(raw)
+	assert.NoError(t, err)
+	return pc, prepared.Size()
+}
+
+func TestGenerateMatchesTwoPass(t *testing.T) {
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	root, nblocks := buildDag(t, bs, 20)
+
+	cs := &countingStore{Blockstore: bs}
+	p, err := Generate(context.Background(), root, cs)
+	assert.NoError(t, err)
+
+	pc, carSize := twoPass(t, root, bs)
+	assert.Equal(t, pc, p.PieceCID)
+	assert.Equal(t, carSize, p.CarSize)
+	assert.Equal(t, nblocks, p.Blocks)
+	assert.Equal(t, nblocks, cs.gets)
+	assert.True(t, uint64(p.PieceSize) >= p.CarSize)
+}
+
+func TestWriteCar(t *testing.T) {
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	root, _ := buildDag(t, bs, 20)
+
+	p, err := Generate(context.Background(), root, bs)
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	assert.NoError(t, WriteCar(context.Background(), root, bs, &buf))
+	assert.Equal(t, p.CarSize, uint64(buf.Len()))
+
+	calc := new(commp.Calc)
+	_, err = calc.Write(buf.Bytes())
+	assert.NoError(t, err)
+	raw, _, err := calc.Digest()
+	assert.NoError(t, err)
+	pc, err := commcid.DataCommitmentV1ToCID(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, p.PieceCID, pc)
+}
+
+func TestGenerateMissingBlock(t *testing.T) {
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	root := merkledag.NodeWithData([]byte("root"))
+	assert.NoError(t, root.AddNodeLink("gone", merkledag.NewRawNode([]byte("gone"))))
+	assert.NoError(t, bs.Put(context.Background(), root))
+
+	_, err := Generate(context.Background(), root.Cid(), bs)
+	assert.Error(t, err)
+}
+
+func TestGenerateAggregateMatchesGenerate(t *testing.T) {
+	ctx := context.Background()
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	indexed, _ := buildDag(t, bs, 10)
+	walked, _ := buildDag(t, bs, 5)
+	leaf := merkledag.NewRawNode([]byte("leaf"))
+	assert.NoError(t, bs.Put(ctx, leaf))
+
+	// the contents share the block every child of buildDag links
+	dir := merkledag.NodeWithData([]byte("aggregate"))
+	assert.NoError(t, dir.AddRawLink("1-indexed", &ipld.Link{Cid: indexed}))
+	assert.NoError(t, dir.AddRawLink("2-walked", &ipld.Link{Cid: walked}))
+	assert.NoError(t, dir.AddRawLink("3-leaf", &ipld.Link{Cid: leaf.Cid()}))
+	assert.NoError(t, dir.AddRawLink("4-again", &ipld.Link{Cid: indexed}))
+	assert.NoError(t, bs.Put(ctx, dir))
+
+	l, err := Layout(ctx, indexed, bs)
+	assert.NoError(t, err)
+	layouts := func(root cid.Cid) (*carindex.Layout, bool) {
+		return l, root.Equals(indexed)
+	}
+
+	want, err := Generate(ctx, dir.Cid(), bs)
+	assert.NoError(t, err)
+	p, err := GenerateAggregate(ctx, dir.Cid(), bs, layouts)
+	assert.NoError(t, err)
+	assert.Equal(t, want.PieceCID, p.PieceCID)
+	assert.Equal(t, want.PieceSize, p.PieceSize)
+	assert.Equal(t, want.CarSize, p.CarSize)
+	assert.Equal(t, want.Blocks, p.Blocks)
+	assert.Equal(t, want.Layout, p.Layout)
+}
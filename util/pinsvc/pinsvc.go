@@ -0,0 +1,127 @@
+// Package pinsvc is a client for remote services that implement the IPFS
+// Pinning Service API, the same api estuary serves under /pinning. It is
+// what pins are delegated through when the node can't take them itself.
+package pinsvc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/application-research/estuary/pinner/types"
+	"golang.org/x/xerrors"
+)
+
+// ErrNotFound is returned for pins the service doesn't know
+var ErrNotFound = xerrors.New("pin not found on the remote service")
+
+// Client talks to the service at Endpoint, with Token as bearer token
+type Client struct {
+	endpoint string
+	token    string
+	client   *http.Client
+}
+
+func New(endpoint, token string, timeout time.Duration) *Client {
+	return &Client{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		token:    token,
+		client:   &http.Client{Timeout: timeout},
+	}
+}
+
+func (c *Client) Endpoint() string {
+	return c.endpoint
+}
+
+// Add asks the service to pin pin, the status it returns carries the
+// request id the pin is known by from then on
+func (c *Client) Add(ctx context.Context, pin types.IpfsPin) (*types.IpfsPinStatusResponse, error) {
+	body, err := json.Marshal(pin)
+	if err != nil {
+		return nil, err
+	}
+
+	var st types.IpfsPinStatusResponse
+	if err := c.do(ctx, http.MethodPost, "/pins", body, http.StatusAccepted, &st); err != nil {
+		return nil, err
+	}
+	if st.RequestID == "" {
+		return nil, fmt.Errorf("remote pinning service returned no request id")
+	}
+	return &st, nil
+}
+
+// Get returns the status of the pin with the given request id
+func (c *Client) Get(ctx context.Context, requestID string) (*types.IpfsPinStatusResponse, error) {
+	var st types.IpfsPinStatusResponse
+	if err := c.do(ctx, http.MethodGet, "/pins/"+url.PathEscape(requestID), nil, http.StatusOK, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// Remove asks the service to drop the pin with the given request id, a pin
+// it doesn't know is already gone
+func (c *Client) Remove(ctx context.Context, requestID string) error {
+	err := c.do(ctx, http.MethodDelete, "/pins/"+url.PathEscape(requestID), nil, http.StatusAccepted, nil)
+	if xerrors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// failure is the error body of the api
+type failure struct {
+	Error struct {
+		Reason  string `json:"reason"`
+		Details string `json:"details"`
+	} `json:"error"`
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body []byte, want int, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	// some services answer 200 where the spec says 202
+	if resp.StatusCode != want && resp.StatusCode != http.StatusOK {
+		var f failure
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&f); err == nil && f.Error.Reason != "" {
+			return fmt.Errorf("remote pinning service returned %d: %s: %s", resp.StatusCode, f.Error.Reason, f.Error.Details)
+		}
+		return fmt.Errorf("remote pinning service returned %d", resp.StatusCode)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,69 @@
+package pinsvc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+
+	pins := map[string]*types.IpfsPinStatusResponse{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":{"reason":"UNAUTHORIZED","details":"bad token"}}`)) //nolint:errcheck
+			return
+		}
+
+		id := strings.TrimPrefix(r.URL.Path, "/pins/")
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/pins":
+			var pin types.IpfsPin
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&pin))
+			st := &types.IpfsPinStatusResponse{RequestID: "r1", Status: types.PinningStatusQueued, Pin: pin}
+			pins[st.RequestID] = st
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(st) //nolint:errcheck
+		case r.Method == http.MethodGet && pins[id] != nil:
+			json.NewEncoder(w).Encode(pins[id]) //nolint:errcheck
+		case r.Method == http.MethodDelete && pins[id] != nil:
+			delete(pins, id)
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL+"/", "secret", time.Second*5)
+
+	st, err := c.Add(ctx, types.IpfsPin{CID: "bafkqaaa", Name: "empty"})
+	require.NoError(t, err)
+	assert.Equal(t, "r1", st.RequestID)
+
+	pins["r1"].Status = types.PinningStatusPinned
+	st, err = c.Get(ctx, "r1")
+	require.NoError(t, err)
+	assert.Equal(t, types.PinningStatusPinned, st.Status)
+	assert.Equal(t, "empty", st.Pin.Name)
+
+	assert.NoError(t, c.Remove(ctx, "r1"))
+	assert.NoError(t, c.Remove(ctx, "r1"), "removing a pin that is gone is fine")
+	_, err = c.Get(ctx, "r1")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = New(srv.URL, "wrong", time.Second*5).Add(ctx, types.IpfsPin{CID: "bafkqaaa"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "UNAUTHORIZED")
+	}
+}
@@ -0,0 +1,181 @@
+// Package provide picks which blocks of a dag are announced to the dht.
+package provide
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	blockservice "github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	unixfs "github.com/ipfs/go-unixfs"
+)
+
+// Strategy is which blocks of a dag get provided
+type Strategy string
+
+const (
+	// Roots provides the root only
+	Roots Strategy = "roots"
+	// Dirs provides the root and every unixfs directory below it, so
+	// paths into the dag can be resolved from any provider
+	Dirs Strategy = "dirs"
+	// All provides every block
+	All Strategy = "all"
+)
+
+// ParseStrategy checks s is a known strategy, an empty one is Roots
+func ParseStrategy(s string) (Strategy, error) {
+	switch Strategy(s) {
+	case "":
+		return Roots, nil
+	case Roots, Dirs, All:
+		return Strategy(s), nil
+	default:
+		return "", fmt.Errorf("unknown provide strategy %q", s)
+	}
+}
+
+// Class applies Strategy to content of at most MaxSize bytes
+type Class struct {
+	MaxSize  int64
+	Strategy Strategy
+}
+
+// Policy picks the strategy for a content by its size
+type Policy struct {
+	Default Strategy
+	Classes []Class
+}
+
+// NewPolicy sorts the classes so the smallest one that fits is used
+func NewPolicy(def Strategy, classes []Class) Policy {
+	cl := append([]Class(nil), classes...)
+	sort.Slice(cl, func(i, j int) bool {
+		return cl[i].MaxSize < cl[j].MaxSize
+	})
+	return Policy{Default: def, Classes: cl}
+}
+
+// For returns the strategy for content of size bytes
+func (p Policy) For(size int64) Strategy {
+	for _, c := range p.Classes {
+		if size <= c.MaxSize {
+			return c.Strategy
+		}
+	}
+	if p.Default == "" {
+		return Roots
+	}
+	return p.Default
+}
+
+// RootsOnly is whether content of any size only has its root provided
+func (p Policy) RootsOnly() bool {
+	for _, c := range p.Classes {
+		if c.Strategy != Roots {
+			return false
+		}
+	}
+	return p.Default == "" || p.Default == Roots
+}
+
+// Keys calls cb with the cids s provides for the dag under root, the root
+// first. Only bs is read, blocks missing from it are skipped.
+func Keys(ctx context.Context, bs blockstore.Blockstore, s Strategy, root cid.Cid, cb func(cid.Cid) error) error {
+	if err := cb(root); err != nil {
+		return err
+	}
+	if s != Dirs && s != All {
+		return nil
+	}
+
+	dserv := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+	nd, err := get(ctx, dserv, root)
+	if err != nil || nd == nil {
+		return err
+	}
+	seen := cid.NewSet()
+	seen.Add(root)
+	return walk(ctx, dserv, s, nd, seen, cb)
+}
+
+// get returns nil for blocks that are raw or missing
+func get(ctx context.Context, ng ipld.NodeGetter, c cid.Cid) (ipld.Node, error) {
+	if c.Type() == cid.Raw {
+		return nil, nil
+	}
+	nd, err := ng.Get(ctx, c)
+	if err != nil {
+		if errors.Is(err, ipld.ErrNotFound) || errors.Is(err, blockstore.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return nd, nil
+}
+
+// walk goes depth first through the dag under nd, calling cb in the same
+// order a recursive walk would. It keeps its own stack so a deep dag can't
+// overflow the goroutine's.
+func walk(ctx context.Context, ng ipld.NodeGetter, s Strategy, nd ipld.Node, seen *cid.Set, cb func(cid.Cid) error) error {
+	type frame struct {
+		links []*ipld.Link
+		next  int
+	}
+
+	var stack []*frame
+	push := func(nd ipld.Node) {
+		if s == Dirs && !isDir(nd) {
+			return
+		}
+		stack = append(stack, &frame{links: nd.Links()})
+	}
+
+	push(nd)
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		if top.next == len(top.links) {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		l := top.links[top.next]
+		top.next++
+
+		if !seen.Visit(l.Cid) {
+			continue
+		}
+		child, err := get(ctx, ng, l.Cid)
+		if err != nil {
+			return err
+		}
+		// under Dirs, whether a child is a directory is only known once it is read
+		if s == All || (child != nil && isDir(child)) {
+			if err := cb(l.Cid); err != nil {
+				return err
+			}
+		}
+		if child != nil {
+			push(child)
+		}
+	}
+	return nil
+}
+
+func isDir(nd ipld.Node) bool {
+	fsn, err := unixfs.ExtractFSNode(nd)
+	if err != nil {
+		return false
+	}
+	switch fsn.Type() {
+	case unixfs.TDirectory, unixfs.THAMTShard:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,96 @@
+package provide
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy(t *testing.T) {
+	p := NewPolicy(Dirs, []Class{{MaxSize: 1 << 30, Strategy: Roots}, {MaxSize: 1 << 20, Strategy: All}})
+	assert.Equal(t, All, p.For(100))
+	assert.Equal(t, Roots, p.For(1<<20+1))
+	assert.Equal(t, Dirs, p.For(1<<31))
+	assert.Equal(t, Roots, Policy{}.For(1))
+	assert.False(t, p.RootsOnly())
+	assert.True(t, NewPolicy(Roots, []Class{{MaxSize: 10, Strategy: Roots}}).RootsOnly())
+
+	s, err := ParseStrategy("")
+	require.NoError(t, err)
+	assert.Equal(t, Roots, s)
+	_, err = ParseStrategy("leaves")
+	assert.Error(t, err)
+}
+
+func TestKeys(t *testing.T) {
+	ctx := context.Background()
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+
+	// root/sub/file, where file is a node over a raw leaf
+	leaf := merkledag.NewRawNode([]byte("leaf"))
+	file := unixfs.EmptyFileNode()
+	require.NoError(t, file.AddNodeLink("", leaf))
+	sub := unixfs.EmptyDirNode()
+	require.NoError(t, sub.AddNodeLink("file", file))
+	root := unixfs.EmptyDirNode()
+	require.NoError(t, root.AddNodeLink("sub", sub))
+	require.NoError(t, dserv.AddMany(ctx, []ipld.Node{leaf, file, sub, root}))
+
+	keys := func(s Strategy) []cid.Cid {
+		var out []cid.Cid
+		require.NoError(t, Keys(ctx, bs, s, root.Cid(), func(c cid.Cid) error {
+			out = append(out, c)
+			return nil
+		}))
+		return out
+	}
+
+	assert.Equal(t, []cid.Cid{root.Cid()}, keys(Roots))
+	assert.Equal(t, []cid.Cid{root.Cid(), sub.Cid()}, keys(Dirs))
+	assert.Equal(t, []cid.Cid{root.Cid(), sub.Cid(), file.Cid(), leaf.Cid()}, keys(All))
+
+	// missing blocks are skipped
+	require.NoError(t, bs.DeleteBlock(ctx, sub.Cid()))
+	assert.Equal(t, []cid.Cid{root.Cid(), sub.Cid()}, keys(All))
+}
+
+func TestKeysDeepDag(t *testing.T) {
+	ctx := context.Background()
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+
+	// a chain of directories, each holding the next one
+	const depth = 10000
+	nodes := make([]ipld.Node, 0, depth)
+	var next *merkledag.ProtoNode
+	for i := 0; i < depth; i++ {
+		nd := unixfs.EmptyDirNode()
+		if next != nil {
+			require.NoError(t, nd.AddNodeLink("next", next))
+		}
+		nodes = append(nodes, nd)
+		next = nd
+	}
+	require.NoError(t, dserv.AddMany(ctx, nodes))
+
+	var out []cid.Cid
+	require.NoError(t, Keys(ctx, bs, Dirs, next.Cid(), func(c cid.Cid) error {
+		out = append(out, c)
+		return nil
+	}))
+	require.Len(t, out, depth)
+	for i, c := range out {
+		assert.Equal(t, nodes[depth-1-i].Cid(), c)
+	}
+}
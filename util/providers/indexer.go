@@ -0,0 +1,118 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-varint"
+)
+
+// the transport codes indexer metadata starts with, see the multicodec table
+const (
+	transportBitswap   = 0x0900
+	transportGraphsync = 0x0910
+)
+
+const defaultIndexerTimeout = time.Second * 10
+
+// IndexerClient looks up providers at a network indexer with a cid.contact
+// style http api
+type IndexerClient struct {
+	url    string
+	client *http.Client
+}
+
+func NewIndexerClient(url string) *IndexerClient {
+	return &IndexerClient{
+		url:    strings.TrimSuffix(url, "/"),
+		client: &http.Client{Timeout: defaultIndexerTimeout},
+	}
+}
+
+// Provider is a provider the indexer knows of, and the transports it
+// announced the content over
+type Provider struct {
+	peer.AddrInfo
+	Bitswap   bool
+	Graphsync bool
+}
+
+type findResponse struct {
+	MultihashResults []struct {
+		ProviderResults []struct {
+			Metadata []byte
+			Provider peer.AddrInfo
+		}
+	}
+}
+
+// FindProviders returns the providers the indexer knows of for c, without
+// duplicates. Content the indexer has never heard of has no providers.
+func (ic *IndexerClient) FindProviders(ctx context.Context, c cid.Cid) ([]Provider, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ic.url+"/cid/"+c.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := ic.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("indexer returned status %d", resp.StatusCode)
+	}
+
+	var fr findResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&fr); err != nil {
+		return nil, fmt.Errorf("failed to decode indexer response: %w", err)
+	}
+
+	var out []Provider
+	seen := make(map[peer.ID]int)
+	for _, mr := range fr.MultihashResults {
+		for _, pr := range mr.ProviderResults {
+			i, ok := seen[pr.Provider.ID]
+			if !ok {
+				i = len(out)
+				seen[pr.Provider.ID] = i
+				out = append(out, Provider{AddrInfo: pr.Provider})
+			}
+
+			switch transport(pr.Metadata) {
+			case transportBitswap:
+				out[i].Bitswap = true
+			case transportGraphsync:
+				out[i].Graphsync = true
+			case 0:
+				// nothing announced, bitswap is the best guess
+				out[i].Bitswap = true
+			}
+		}
+	}
+	return out, nil
+}
+
+func transport(md []byte) uint64 {
+	if len(md) == 0 {
+		return 0
+	}
+	code, _, err := varint.FromUvarint(md)
+	if err != nil {
+		return 0
+	}
+	return code
+}
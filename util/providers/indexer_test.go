@@ -0,0 +1,73 @@
+package providers
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-varint"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexerFindProviders(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	c, _ := cid.Decode("bafkqabiaaa")
+	bs := "12D3KooWBsqhbD6jh1j6G1KRQnb3d2cHCtDmz6zx6nDLCDhaJRJK"
+	gs := "12D3KooWHiYSaKsZ7Uo8m5zP5NeLyMQgYtmQbfz6kd1nK5gWvoJP"
+	md := func(code uint64) string {
+		return base64.StdEncoding.EncodeToString(varint.ToUvarint(code))
+	}
+
+	indexer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cid/"+c.String() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"MultihashResults":[{"ProviderResults":[
+			{"Metadata":%q,"Provider":{"ID":%q,"Addrs":["/ip4/1.2.3.4/tcp/4001"]}},
+			{"Metadata":%q,"Provider":{"ID":%q,"Addrs":[]}},
+			{"Metadata":%q,"Provider":{"ID":%q,"Addrs":[]}}
+		]}]}`, md(transportBitswap), bs, md(transportGraphsync), gs, md(transportBitswap), bs)
+	}))
+	defer indexer.Close()
+
+	ic := NewIndexerClient(indexer.URL)
+	provs, err := ic.FindProviders(ctx, c)
+	assert.NoError(err)
+	if assert.Len(provs, 2) {
+		assert.Equal(bs, provs[0].ID.String())
+		assert.Len(provs[0].Addrs, 1)
+		assert.True(provs[0].Bitswap)
+		assert.False(provs[0].Graphsync)
+		assert.Equal(gs, provs[1].ID.String())
+		assert.True(provs[1].Graphsync)
+		assert.False(provs[1].Bitswap)
+	}
+
+	other, _ := cid.Decode("bafkqaaa")
+	provs, err = ic.FindProviders(ctx, other)
+	assert.NoError(err)
+	assert.Empty(provs)
+
+	// only the bitswap provider is of use to the router
+	dhtPeer := peer.AddrInfo{ID: peer.ID("dht")}
+	r := NewRouter(&fakeRouting{providers: map[cid.Cid][]peer.AddrInfo{c: {dhtPeer}}}, ic)
+	var found []string
+	for ai := range r.FindProvidersAsync(ctx, c, 0) {
+		found = append(found, ai.ID.String())
+	}
+	assert.ElementsMatch([]string{dhtPeer.ID.String(), bs}, found)
+
+	var n int
+	for range r.FindProvidersAsync(ctx, c, 1) {
+		n++
+	}
+	assert.Equal(1, n)
+}
@@ -0,0 +1,87 @@
+// Package providers checks whether anybody on the network provides a cid,
+// by asking the dht and, if one is configured, a network indexer at the same
+// time. It is used to fail pins of content nobody has before they take up a
+// worker for the whole pin timeout.
+package providers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/routing"
+)
+
+// Finder looks for providers in Routing and at Indexer, either may be left
+// unset
+type Finder struct {
+	Routing routing.ContentRouting
+	Indexer *IndexerClient
+}
+
+type result struct {
+	found bool
+	err   error
+}
+
+// HasProviders returns true as soon as any of the sources knows of a
+// provider of c. It returns false when all of them were asked and found
+// nobody, or ctx ended first, and an error only when every source failed.
+func (f *Finder) HasProviders(ctx context.Context, c cid.Cid) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var sources int
+	results := make(chan result, 2)
+	if f.Routing != nil {
+		sources++
+		go func() {
+			results <- f.findInRouting(ctx, c)
+		}()
+	}
+	if f.Indexer != nil {
+		sources++
+		go func() {
+			results <- f.findInIndexer(ctx, c)
+		}()
+	}
+	if sources == 0 {
+		return true, nil
+	}
+
+	var errs []string
+	for i := 0; i < sources; i++ {
+		r := <-results
+		if r.found {
+			return true, nil
+		}
+		if r.err != nil {
+			errs = append(errs, r.err.Error())
+		}
+	}
+
+	if len(errs) == sources {
+		return false, fmt.Errorf("failed to look up providers: %s", strings.Join(errs, "; "))
+	}
+	return false, nil
+}
+
+func (f *Finder) findInRouting(ctx context.Context, c cid.Cid) result {
+	for range f.Routing.FindProvidersAsync(ctx, c, 1) {
+		return result{found: true}
+	}
+	return result{}
+}
+
+func (f *Finder) findInIndexer(ctx context.Context, c cid.Cid) result {
+	provs, err := f.Indexer.FindProviders(ctx, c)
+	if err != nil {
+		if ctx.Err() != nil {
+			// out of time is an answer, not a failure of the indexer
+			return result{}
+		}
+		return result{err: err}
+	}
+	return result{found: len(provs) > 0}
+}
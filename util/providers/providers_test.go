@@ -0,0 +1,74 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeRouting struct {
+	providers map[cid.Cid][]peer.AddrInfo
+}
+
+func (r *fakeRouting) Provide(context.Context, cid.Cid, bool) error {
+	return nil
+}
+
+func (r *fakeRouting) FindProvidersAsync(ctx context.Context, c cid.Cid, n int) <-chan peer.AddrInfo {
+	out := make(chan peer.AddrInfo, len(r.providers[c]))
+	for _, ai := range r.providers[c] {
+		out <- ai
+	}
+	close(out)
+	return out
+}
+
+func TestHasProviders(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	inDht, _ := cid.Decode("bafkqaaa")
+	inIndexer, _ := cid.Decode("bafkqabiaaa")
+	nowhere, _ := cid.Decode("bafkqac3imvwgy3zao5xxe3de")
+
+	indexer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/cid/"+inIndexer.String()) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"MultihashResults":[{"ProviderResults":[{"Provider":{"ID":"12D3KooWBsqhbD6jh1j6G1KRQnb3d2cHCtDmz6zx6nDLCDhaJRJK","Addrs":[]}}]}]}`)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer indexer.Close()
+
+	f := &Finder{
+		Routing: &fakeRouting{providers: map[cid.Cid][]peer.AddrInfo{inDht: {{ID: peer.ID("provider")}}}},
+		Indexer: NewIndexerClient(indexer.URL + "/"),
+	}
+
+	for c, want := range map[cid.Cid]bool{inDht: true, inIndexer: true, nowhere: false} {
+		found, err := f.HasProviders(ctx, c)
+		assert.NoError(err)
+		assert.Equal(want, found, c.String())
+	}
+
+	// a broken indexer is no reason to say there are no providers
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	_, err := (&Finder{Indexer: NewIndexerClient(broken.URL)}).HasProviders(ctx, nowhere)
+	assert.Error(err)
+
+	found, err := (&Finder{}).HasProviders(ctx, nowhere)
+	assert.NoError(err)
+	assert.True(found, "nothing to ask means nothing to rule the content out")
+}
@@ -0,0 +1,108 @@
+package providers
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+)
+
+var log = logging.Logger("providers")
+
+// Router finds providers in the dht and at an indexer at the same time, for
+// content that was only ever announced to indexers. Provides only go to the
+// dht, announcing to indexers is done separately.
+type Router struct {
+	dht     routing.ContentRouting
+	indexer *IndexerClient
+}
+
+var _ routing.ContentRouting = (*Router)(nil)
+
+// NewRouter returns dht itself when there is no indexer to ask
+func NewRouter(dht routing.ContentRouting, indexer *IndexerClient) routing.ContentRouting {
+	if indexer == nil {
+		return dht
+	}
+	return &Router{dht: dht, indexer: indexer}
+}
+
+func (r *Router) Provide(ctx context.Context, c cid.Cid, announce bool) error {
+	return r.dht.Provide(ctx, c, announce)
+}
+
+// FindProvidersAsync merges the providers found by both, each peer once, up
+// to count of them or all of them if count is 0. Only providers reachable
+// over bitswap are taken from the indexer.
+func (r *Router) FindProvidersAsync(ctx context.Context, c cid.Cid, count int) <-chan peer.AddrInfo {
+	ctx, cancel := context.WithCancel(ctx)
+	out := make(chan peer.AddrInfo)
+
+	var lk sync.Mutex
+	seen := make(map[peer.ID]struct{})
+	// send reports whether more providers are wanted
+	send := func(ai peer.AddrInfo) bool {
+		lk.Lock()
+		if _, ok := seen[ai.ID]; ok {
+			lk.Unlock()
+			return true
+		}
+		if count > 0 && len(seen) >= count {
+			lk.Unlock()
+			return false
+		}
+		seen[ai.ID] = struct{}{}
+		full := count > 0 && len(seen) >= count
+		lk.Unlock()
+
+		select {
+		case out <- ai:
+		case <-ctx.Done():
+			return false
+		}
+		if full {
+			cancel()
+			return false
+		}
+		return true
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for ai := range r.dht.FindProvidersAsync(ctx, c, count) {
+			if !send(ai) {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		provs, err := r.indexer.FindProviders(ctx, c)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Debugw("indexer provider lookup failed", "cid", c, "err", err)
+			}
+			return
+		}
+		for _, p := range provs {
+			if !p.Bitswap {
+				continue
+			}
+			if !send(p.AddrInfo) {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		cancel()
+		close(out)
+	}()
+	return out
+}
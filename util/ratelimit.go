@@ -0,0 +1,153 @@
+package util
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Headers describing the limit a request counted against, sent with every
+// response that is limited and with the 429 and 507 responses that turn a
+// request away, so clients can back off without guessing
+const (
+	HeaderRateLimitLimit     = "X-RateLimit-Limit"
+	HeaderRateLimitRemaining = "X-RateLimit-Remaining"
+	// HeaderRateLimitReset is the unix time in seconds at which the limit
+	// has room again
+	HeaderRateLimitReset = "X-RateLimit-Reset"
+	HeaderRetryAfter     = "Retry-After"
+)
+
+// LimitInfo describes the state of a rate limit or quota
+type LimitInfo struct {
+	Limit     int64
+	Remaining int64
+	// Reset is how long until the limit has room again
+	Reset time.Duration
+}
+
+// SetHeaders writes the limit headers to a response
+func (li LimitInfo) SetHeaders(c echo.Context) {
+	h := c.Response().Header()
+	h.Set(HeaderRateLimitLimit, strconv.FormatInt(li.Limit, 10))
+	h.Set(HeaderRateLimitRemaining, strconv.FormatInt(li.Remaining, 10))
+	h.Set(HeaderRateLimitReset, strconv.FormatInt(time.Now().Add(li.Reset).Unix(), 10))
+}
+
+// TooManyRequests turns a request away with a 429 because a rate limit or
+// quota was hit, the limit headers and a Retry-After are set on the response
+func TooManyRequests(c echo.Context, reason string, li LimitInfo, details string) error {
+	return limitExceeded(c, http.StatusTooManyRequests, reason, li, details)
+}
+
+// InsufficientStorage turns a request away with a 507 because there is no
+// room to store what it would add, the limit headers and a Retry-After are
+// set on the response
+func InsufficientStorage(c echo.Context, reason string, li LimitInfo, details string) error {
+	return limitExceeded(c, http.StatusInsufficientStorage, reason, li, details)
+}
+
+// PaymentRequired turns a request away with a 402 because a paid allowance
+// ran out, the limit headers and a Retry-After are set on the response
+func PaymentRequired(c echo.Context, reason string, li LimitInfo, details string) error {
+	return limitExceeded(c, http.StatusPaymentRequired, reason, li, details)
+}
+
+func limitExceeded(c echo.Context, code int, reason string, li LimitInfo, details string) error {
+	li.SetHeaders(c)
+	c.Response().Header().Set(HeaderRetryAfter, strconv.Itoa(int(math.Ceil(li.Reset.Seconds()))))
+	return &HttpError{
+		Code:    code,
+		Reason:  reason,
+		Details: details,
+	}
+}
+
+// idle buckets are dropped after this long, by then they would be full
+// again anyway
+const rateLimiterIdle = time.Minute * 10
+
+// RateLimiter keeps a token bucket for each key, e.g. each user, allowing
+// rate requests a second on average and bursts of up to burst requests
+type RateLimiter struct {
+	lk        sync.Mutex
+	rate      float64
+	burst     int
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:      rate,
+		burst:     burst,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket of key if there is one, and reports
+// the state of the bucket afterwards
+func (rl *RateLimiter) Allow(key string) (bool, LimitInfo) {
+	return rl.allowAt(key, time.Now())
+}
+
+func (rl *RateLimiter) allowAt(key string, now time.Time) (bool, LimitInfo) {
+	rl.lk.Lock()
+	defer rl.lk.Unlock()
+
+	if now.Sub(rl.lastSweep) > rateLimiterIdle {
+		for k, b := range rl.buckets {
+			if now.Sub(b.last) > rateLimiterIdle {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(rl.burst), last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(rl.burst), b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+
+	info := LimitInfo{
+		Limit:     int64(rl.burst),
+		Remaining: int64(b.tokens),
+	}
+	if b.tokens < 1 && rl.rate > 0 {
+		info.Reset = time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+	}
+	return allowed, info
+}
+
+// Check applies the limit of key to a request, setting the limit headers
+// on the response and returning a 429 if the limit was hit
+func (rl *RateLimiter) Check(c echo.Context, key string) error {
+	ok, info := rl.Allow(key)
+	if !ok {
+		return TooManyRequests(c, ERR_RATE_LIMITED, info, "too many requests, slow down")
+	}
+	info.SetHeaders(c)
+	return nil
+}
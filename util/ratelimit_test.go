@@ -0,0 +1,41 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	rl := NewRateLimiter(2, 3)
+	now := time.Now()
+
+	for i := 2; i >= 0; i-- {
+		ok, info := rl.allowAt("a", now)
+		assert.True(ok)
+		assert.Equal(int64(3), info.Limit)
+		assert.Equal(int64(i), info.Remaining)
+	}
+
+	ok, info := rl.allowAt("a", now)
+	assert.False(ok)
+	assert.Equal(int64(0), info.Remaining)
+	assert.Equal(time.Millisecond*500, info.Reset)
+
+	// other keys have their own bucket
+	ok, _ = rl.allowAt("b", now)
+	assert.True(ok)
+
+	ok, _ = rl.allowAt("a", now.Add(time.Millisecond*500))
+	assert.True(ok)
+
+	// buckets never fill past the burst
+	ok, info = rl.allowAt("a", now.Add(time.Hour))
+	assert.True(ok)
+	assert.Equal(int64(2), info.Remaining)
+	_, stillThere := rl.buckets["b"]
+	assert.False(stillThere, "idle buckets are swept")
+}
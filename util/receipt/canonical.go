@@ -0,0 +1,60 @@
+package receipt
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// Receipts are signed over their canonical encoding, so that anyone holding
+// a receipt can rebuild the exact bytes that were signed: the domain,
+// followed by the receipt as json with no whitespace, object keys sorted,
+// no html escaping, times in UTC to the second, locations sorted and deals
+// sorted by miner and then deal id.
+
+func canonicalPayload(domain string, v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	// going through a generic value sorts the object keys, as maps are
+	// encoded with their keys sorted
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var generic interface{}
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBufferString(domain)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(generic); err != nil {
+		return nil, err
+	}
+	// the encoder ends with a newline that isn't part of the payload
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func canonicalTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Second)
+}
+
+func canonicalLocations(locs []string) []string {
+	out := append([]string{}, locs...)
+	sort.Strings(out)
+	return out
+}
+
+func canonicalDeals(deals []Deal) []Deal {
+	out := append([]Deal{}, deals...)
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Miner != out[j].Miner {
+			return out[i].Miner < out[j].Miner
+		}
+		return out[i].DealID < out[j].DealID
+	})
+	return out
+}
@@ -0,0 +1,94 @@
+package receipt
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// purge receipts are signed under a domain of their own, so a storage
+// receipt can't pass for one
+const purgeDomain = "estuary-purge-receipt:"
+
+// Purge is what the issuer attests to once it has deleted a content, with
+// when each step of the deletion was done
+type Purge struct {
+	Issuer string `json:"issuer"`
+	Cid    string `json:"cid"`
+	Size   int64  `json:"size"`
+
+	RequestedAt       time.Time `json:"requestedAt"`
+	PinsCancelledAt   time.Time `json:"pinsCancelledAt"`
+	UnpinnedAt        time.Time `json:"unpinnedAt"`
+	BlocksReclaimedAt time.Time `json:"blocksReclaimedAt"`
+	DealsStoppedAt    time.Time `json:"dealsStoppedAt"`
+	CompletedAt       time.Time `json:"completedAt"`
+
+	// Locations are the nodes the content was removed from
+	Locations []string `json:"locations"`
+	// Deals are the deals that are no longer tracked or renewed, they
+	// run on until they end as deals can't be ended early
+	Deals []Deal `json:"deals"`
+
+	// BlocksReclaimed are the blocks of the content deleted from the
+	// issuer, BlocksKept the ones other content still references
+	BlocksReclaimed int `json:"blocksReclaimed,omitempty"`
+	BlocksKept      int `json:"blocksKept,omitempty"`
+	// Aggregate is the aggregate the content was dealt in with other
+	// content, whose AggregateDeals still hold it until they end
+	Aggregate      string `json:"aggregate,omitempty"`
+	AggregateDeals []Deal `json:"aggregateDeals,omitempty"`
+}
+
+// canonical is p the way it is signed
+func (p Purge) canonical() Purge {
+	for _, t := range []*time.Time{&p.RequestedAt, &p.PinsCancelledAt, &p.UnpinnedAt, &p.BlocksReclaimedAt, &p.DealsStoppedAt, &p.CompletedAt} {
+		*t = canonicalTime(*t)
+	}
+	p.Locations = canonicalLocations(p.Locations)
+	p.Deals = canonicalDeals(p.Deals)
+	if len(p.AggregateDeals) > 0 {
+		p.AggregateDeals = canonicalDeals(p.AggregateDeals)
+	}
+	return p
+}
+
+func (p *Purge) payload() ([]byte, error) {
+	return canonicalPayload(purgeDomain, p.canonical())
+}
+
+// SignedPurge is a purge receipt with the signature of its issuer
+type SignedPurge struct {
+	Receipt   Purge  `json:"receipt"`
+	Signature []byte `json:"signature"`
+}
+
+// SignPurge issues p, its issuer is set to the peer id of key
+func SignPurge(p Purge, key crypto.PrivKey) (*SignedPurge, error) {
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	p.Issuer = id.String()
+	p = p.canonical()
+
+	b, err := p.payload()
+	if err != nil {
+		return nil, err
+	}
+	sig, err := key.Sign(b)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedPurge{Receipt: p, Signature: sig}, nil
+}
+
+// Verify checks the signature against the issuer, like Signed.Verify
+func (s *SignedPurge) Verify() error {
+	b, err := s.Receipt.payload()
+	if err != nil {
+		return err
+	}
+	return verify(s.Receipt.Issuer, b, s.Signature)
+}
@@ -0,0 +1,101 @@
+// Package receipt issues storage receipts: statements, signed with the
+// libp2p key of a node, that it stores some content. Anyone can check a
+// receipt against the peer id of the node that issued it.
+package receipt
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// signing with a prefix keeps receipt signatures from being valid for
+// anything else signed with the node key
+const domain = "estuary-storage-receipt:"
+
+// Deal is a storage deal the content is in
+type Deal struct {
+	Miner  string `json:"miner"`
+	DealID int64  `json:"dealId"`
+}
+
+// Receipt is what the issuer attests to
+type Receipt struct {
+	Issuer   string    `json:"issuer"`
+	Cid      string    `json:"cid"`
+	Size     int64     `json:"size"`
+	IssuedAt time.Time `json:"issuedAt"`
+	// Locations are the nodes holding a copy
+	Locations []string `json:"locations"`
+	Deals     []Deal   `json:"deals"`
+}
+
+// canonical is r the way it is signed
+func (r Receipt) canonical() Receipt {
+	r.IssuedAt = canonicalTime(r.IssuedAt)
+	r.Locations = canonicalLocations(r.Locations)
+	r.Deals = canonicalDeals(r.Deals)
+	return r
+}
+
+func (r *Receipt) payload() ([]byte, error) {
+	return canonicalPayload(domain, r.canonical())
+}
+
+// Signed is a receipt with the signature of its issuer
+type Signed struct {
+	Receipt   Receipt `json:"receipt"`
+	Signature []byte  `json:"signature"`
+}
+
+// Sign issues r, its issuer is set to the peer id of key
+func Sign(r Receipt, key crypto.PrivKey) (*Signed, error) {
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	r.Issuer = id.String()
+	r = r.canonical()
+
+	b, err := r.payload()
+	if err != nil {
+		return nil, err
+	}
+	sig, err := key.Sign(b)
+	if err != nil {
+		return nil, err
+	}
+	return &Signed{Receipt: r, Signature: sig}, nil
+}
+
+// Verify checks the signature against the issuer, it only works for
+// issuers whose public key is in their peer id, like ed25519 keys
+func (s *Signed) Verify() error {
+	b, err := s.Receipt.payload()
+	if err != nil {
+		return err
+	}
+	return verify(s.Receipt.Issuer, b, s.Signature)
+}
+
+func verify(issuer string, payload, sig []byte) error {
+	id, err := peer.Decode(issuer)
+	if err != nil {
+		return fmt.Errorf("invalid issuer: %w", err)
+	}
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("cannot get public key of %s: %w", id, err)
+	}
+
+	ok, err := pub.Verify(payload, sig)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("signature does not match receipt")
+	}
+	return nil
+}
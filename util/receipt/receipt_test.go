@@ -0,0 +1,98 @@
+package receipt
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignVerify(t *testing.T) {
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	s, err := Sign(Receipt{
+		Cid:       "bafkqaaa",
+		Size:      1024,
+		IssuedAt:  time.Now(),
+		Locations: []string{"local"},
+		Deals:     []Deal{{Miner: "f01000", DealID: 7}},
+	}, key)
+	require.NoError(t, err)
+	require.NoError(t, s.Verify())
+
+	// receipts are passed around as json
+	b, err := json.Marshal(s)
+	require.NoError(t, err)
+	var got Signed
+	require.NoError(t, json.Unmarshal(b, &got))
+	assert.NoError(t, got.Verify())
+
+	got.Receipt.Size = 2048
+	assert.Error(t, got.Verify())
+
+	other, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	forged, err := Sign(s.Receipt, other)
+	require.NoError(t, err)
+	forged.Receipt.Issuer = s.Receipt.Issuer
+	assert.Error(t, forged.Verify())
+}
+
+func TestSignVerifyPurge(t *testing.T) {
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	now := time.Now()
+	s, err := SignPurge(Purge{
+		Cid:               "bafkqaaa",
+		Size:              1024,
+		RequestedAt:       now.Add(-time.Minute),
+		PinsCancelledAt:   now,
+		UnpinnedAt:        now,
+		BlocksReclaimedAt: now,
+		DealsStoppedAt:    now,
+		CompletedAt:       now,
+		Deals:             []Deal{{Miner: "f01000", DealID: 7}},
+	}, key)
+	require.NoError(t, err)
+
+	b, err := json.Marshal(s)
+	require.NoError(t, err)
+	var got SignedPurge
+	require.NoError(t, json.Unmarshal(b, &got))
+	assert.NoError(t, got.Verify())
+
+	// a purge signature is no good for a storage receipt
+	sr := Signed{Receipt: Receipt{Issuer: s.Receipt.Issuer, Cid: "bafkqaaa"}, Signature: s.Signature}
+	assert.Error(t, sr.Verify())
+
+	got.Receipt.CompletedAt = got.Receipt.CompletedAt.Add(time.Hour)
+	assert.Error(t, got.Verify())
+}
+
+func TestCanonicalPayload(t *testing.T) {
+	r := Receipt{
+		Issuer:    "12D3KooWissuer",
+		Cid:       "bafkqaaa",
+		Size:      1024,
+		IssuedAt:  time.Date(2022, 6, 1, 14, 30, 0, 500, time.FixedZone("CEST", 2*60*60)),
+		Locations: []string{"b<peer>", "a&peer"},
+		Deals:     []Deal{{Miner: "f02000", DealID: 1}, {Miner: "f01000", DealID: 9}, {Miner: "f01000", DealID: 7}},
+	}
+	b, err := r.payload()
+	require.NoError(t, err)
+	assert.Equal(t, `estuary-storage-receipt:{"cid":"bafkqaaa","deals":[{"dealId":7,"miner":"f01000"},{"dealId":9,"miner":"f01000"},{"dealId":1,"miner":"f02000"}],"issuedAt":"2022-06-01T12:30:00Z","issuer":"12D3KooWissuer","locations":["a&peer","b<peer>"],"size":1024}`, string(b))
+
+	// the order deals and locations are listed in doesn't change what is
+	// signed
+	r.Locations = []string{"a&peer", "b<peer>"}
+	r.Deals = []Deal{{Miner: "f01000", DealID: 7}, {Miner: "f02000", DealID: 1}, {Miner: "f01000", DealID: 9}}
+	again, err := r.payload()
+	require.NoError(t, err)
+	assert.Equal(t, b, again)
+}
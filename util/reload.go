@@ -0,0 +1,52 @@
+package util
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// WatchConfig calls reload whenever the process receives SIGHUP, or when the
+// modification time of the file at path changes. The file is polled every
+// interval rather than watched so that editors replacing the file instead of
+// writing to it are picked up too. Errors from reload are logged, the node
+// keeps running with its previous settings.
+func WatchConfig(ctx context.Context, path string, interval time.Duration, reload func() error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastMod := configModTime(path)
+	for {
+		select {
+		case <-hup:
+			log.Infof("received SIGHUP, reloading config from %s", path)
+		case <-ticker.C:
+			mod := configModTime(path)
+			if mod.Equal(lastMod) {
+				continue
+			}
+			lastMod = mod
+			log.Infof("config file %s changed, reloading", path)
+		case <-ctx.Done():
+			return
+		}
+
+		if err := reload(); err != nil {
+			log.Errorf("failed to reload config: %s", err)
+		}
+	}
+}
+
+func configModTime(path string) time.Time {
+	st, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return st.ModTime()
+}
@@ -0,0 +1,124 @@
+// Package reputation scores storage providers from how the deals made with
+// them and the retrievals from them went. Every part of a score starts at
+// Prior and moves towards what was observed as observations add up, so a
+// provider with one failed deal isn't written off and one with a single
+// good deal isn't trusted fully.
+package reputation
+
+import "time"
+
+// Observations is what was seen of a provider
+type Observations struct {
+	// Proposed deals got an answer, Accepted ones made it on chain, Faults
+	// failed or were slashed after that
+	Proposed int
+	Accepted int
+	Faults   int
+
+	// Sealed deals took SealTime on average from proposal to sealing
+	Sealed   int
+	SealTime time.Duration
+
+	// Retrievals succeeded in RetrievalLatency on average, RetrievalFailures
+	// didn't
+	Retrievals        int
+	RetrievalFailures int
+	RetrievalLatency  time.Duration
+}
+
+// Params is how observations are scored. SealTarget and LatencyTarget
+// score 1, twice as long scores 0.5.
+type Params struct {
+	SealTarget    time.Duration
+	LatencyTarget time.Duration
+	Prior         float64
+	PriorWeight   float64
+}
+
+// Score is a provider's reputation between 0 and 1, and its parts
+type Score struct {
+	Total       float64 `json:"total"`
+	Acceptance  float64 `json:"acceptance"`
+	Reliability float64 `json:"reliability"`
+	Retrieval   float64 `json:"retrieval"`
+	SealSpeed   float64 `json:"sealSpeed"`
+	Latency     float64 `json:"latency"`
+}
+
+// how much each part counts towards the total
+const (
+	weightAcceptance  = 0.3
+	weightReliability = 0.3
+	weightRetrieval   = 0.2
+	weightSealSpeed   = 0.1
+	weightLatency     = 0.1
+)
+
+// DefaultParams are used for the params that are zero
+var DefaultParams = Params{
+	SealTarget:    time.Hour * 48,
+	LatencyTarget: time.Second * 30,
+	Prior:         0.5,
+	PriorWeight:   5,
+}
+
+func (p Params) withDefaults() Params {
+	if p.SealTarget <= 0 {
+		p.SealTarget = DefaultParams.SealTarget
+	}
+	if p.LatencyTarget <= 0 {
+		p.LatencyTarget = DefaultParams.LatencyTarget
+	}
+	if p.Prior <= 0 {
+		p.Prior = DefaultParams.Prior
+	}
+	if p.PriorWeight <= 0 {
+		p.PriorWeight = DefaultParams.PriorWeight
+	}
+	return p
+}
+
+// blend weighs value, seen n times, against the prior
+func (p Params) blend(value float64, n int) float64 {
+	return (value*float64(n) + p.Prior*p.PriorWeight) / (float64(n) + p.PriorWeight)
+}
+
+func (p Params) ratio(good, total int) float64 {
+	if total <= 0 {
+		return p.Prior
+	}
+	return p.blend(float64(good)/float64(total), total)
+}
+
+func speed(target, took time.Duration) float64 {
+	if took <= target {
+		return 1
+	}
+	return float64(target) / float64(took)
+}
+
+// Score scores what was seen of a provider
+func (p Params) Score(o Observations) Score {
+	p = p.withDefaults()
+
+	s := Score{
+		Acceptance:  p.ratio(o.Accepted, o.Proposed),
+		Reliability: p.ratio(o.Accepted-o.Faults, o.Accepted),
+		Retrieval:   p.ratio(o.Retrievals, o.Retrievals+o.RetrievalFailures),
+		SealSpeed:   p.Prior,
+		Latency:     p.Prior,
+	}
+	if o.Sealed > 0 {
+		s.SealSpeed = p.blend(speed(p.SealTarget, o.SealTime), o.Sealed)
+	}
+	if o.Retrievals > 0 {
+		s.Latency = p.blend(speed(p.LatencyTarget, o.RetrievalLatency), o.Retrievals)
+	}
+
+	s.Total = s.Acceptance*weightAcceptance +
+		s.Reliability*weightReliability +
+		s.Retrieval*weightRetrieval +
+		s.SealSpeed*weightSealSpeed +
+		s.Latency*weightLatency
+	return s
+}
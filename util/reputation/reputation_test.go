@@ -0,0 +1,33 @@
+package reputation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScoreStartsAtPrior(t *testing.T) {
+	s := DefaultParams.Score(Observations{})
+	assert.InDelta(t, 0.5, s.Total, 1e-9)
+	assert.InDelta(t, 0.5, s.Acceptance, 1e-9)
+}
+
+func TestScoreMovesWithObservations(t *testing.T) {
+	p := Params{}
+	good := p.Score(Observations{
+		Proposed: 100, Accepted: 100, Sealed: 100, SealTime: time.Hour,
+		Retrievals: 50, RetrievalLatency: time.Second,
+	})
+	bad := p.Score(Observations{
+		Proposed: 100, Accepted: 20, Faults: 10, Sealed: 10, SealTime: time.Hour * 24 * 8,
+		Retrievals: 5, RetrievalFailures: 45, RetrievalLatency: time.Minute * 5,
+	})
+	assert.Greater(t, good.Total, 0.9)
+	assert.Less(t, bad.Total, 0.35)
+	assert.InDelta(t, 0.25, speed(time.Hour, time.Hour*4), 1e-9)
+
+	// one failed deal doesn't sink a provider
+	one := p.Score(Observations{Proposed: 1})
+	assert.Greater(t, one.Acceptance, 0.4)
+}
@@ -0,0 +1,75 @@
+// Package requestid tags each api request with an id that follows the work
+// it spawns, through the pin queue and rpc messages to shuttles, so that a
+// failure a user reports can be traced through the whole system from the id
+// they were given.
+package requestid
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// Header carries the request id, clients may set it to use an id of their
+// own, and it is always set on responses
+const Header = echo.HeaderXRequestID
+
+// maxLength bounds ids given by clients, longer ones are replaced
+const maxLength = 64
+
+type ctxKey struct{}
+
+// WithID returns a context carrying a request id
+func WithID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// FromContext returns the request id carried by ctx, or an empty string
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKey{}).(string)
+	return id
+}
+
+// New generates a request id
+func New() string {
+	return uuid.New().String()
+}
+
+func valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Middleware gives every request an id, taken from the request header if
+// the client sent a usable one, and returns it in the response header
+func Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		id := req.Header.Get(Header)
+		if !valid(id) {
+			id = New()
+		}
+
+		c.Response().Header().Set(Header, id)
+		c.SetRequest(req.WithContext(WithID(req.Context(), id)))
+		return next(c)
+	}
+}
+
+// Get returns the id of an echo request
+func Get(c echo.Context) string {
+	return FromContext(c.Request().Context())
+}
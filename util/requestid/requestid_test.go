@@ -0,0 +1,46 @@
+package requestid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware(t *testing.T) {
+	e := echo.New()
+	var seen string
+	h := Middleware(func(c echo.Context) error {
+		seen = Get(c)
+		return c.NoContent(http.StatusOK)
+	})
+
+	for _, tc := range []struct {
+		sent string
+		keep bool
+	}{
+		{"", false},
+		{"client-id_1.2", true},
+		{strings.Repeat("a", 65), false},
+		{"bad id\n", false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tc.sent != "" {
+			req.Header.Set(Header, tc.sent)
+		}
+		rec := httptest.NewRecorder()
+		assert.NoError(t, h(e.NewContext(req, rec)))
+
+		got := rec.Header().Get(Header)
+		assert.NotEmpty(t, got)
+		assert.Equal(t, got, seen)
+		if tc.keep {
+			assert.Equal(t, tc.sent, got)
+		} else {
+			assert.NotEqual(t, tc.sent, got)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package s3
+
+import (
+	"sort"
+	"strings"
+)
+
+// DefaultMaxKeys is the number of keys listed if the client doesn't ask
+// for fewer
+const DefaultMaxKeys = 1000
+
+// ListResult is one page of a listing
+type ListResult struct {
+	Keys        []string
+	Prefixes    []string
+	IsTruncated bool
+	// Next is the key to continue the listing after
+	Next string
+}
+
+// List lists the keys that start with prefix and sort after after, up to
+// max of them. Keys with delimiter in them after the prefix are rolled up
+// into common prefixes, which count against max like keys do.
+func List(keys []string, prefix, delimiter, after string, max int) ListResult {
+	sorted := make([]string, len(keys))
+	copy(sorted, keys)
+	sort.Strings(sorted)
+
+	var res ListResult
+	if max <= 0 {
+		return res
+	}
+
+	seen := make(map[string]bool)
+	for _, k := range sorted {
+		if k <= after || !strings.HasPrefix(k, prefix) {
+			continue
+		}
+
+		entry, isPrefix := k, false
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				entry, isPrefix = k[:len(prefix)+i+len(delimiter)], true
+			}
+		}
+		if isPrefix && seen[entry] {
+			continue
+		}
+		// a prefix listed on an earlier page
+		if isPrefix && entry <= after {
+			continue
+		}
+
+		if len(res.Keys)+len(res.Prefixes) == max {
+			res.IsTruncated = true
+			return res
+		}
+
+		if isPrefix {
+			seen[entry] = true
+			res.Prefixes = append(res.Prefixes, entry)
+		} else {
+			res.Keys = append(res.Keys, entry)
+		}
+		res.Next = entry
+	}
+	return res
+}
@@ -0,0 +1,256 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// emptySHA256 is the sha256 of nothing, hex encoded
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Payload returns the body of r as the client meant it, r must have been
+// verified with a. aws-chunked bodies are decoded and the signature of each
+// of their chunks, and of their trailing headers, is checked as it is read.
+// Bodies signed with their sha256 fail to read at the end if they don't
+// match it.
+func (a *Auth) Payload(r *http.Request) (io.Reader, error) {
+	switch h := r.Header.Get("X-Amz-Content-Sha256"); h {
+	case "", UnsignedPayload:
+		return r.Body, nil
+	case StreamingUnsignedTrailer:
+		return &chunkedReader{r: bufio.NewReader(r.Body)}, nil
+	case StreamingPayload, StreamingPayloadTrailer:
+		if a.key == nil {
+			return nil, ErrAccessDenied
+		}
+		return &chunkedReader{
+			r:       bufio.NewReader(r.Body),
+			auth:    a,
+			prev:    a.Signature,
+			h:       sha256.New(),
+			trailer: h == StreamingPayloadTrailer,
+		}, nil
+	default:
+		want, err := hex.DecodeString(h)
+		if err != nil || len(want) != sha256.Size {
+			return nil, ErrContentSHA256Mismatch
+		}
+		return &hashReader{r: r.Body, h: sha256.New(), want: want}, nil
+	}
+}
+
+// DecodedLength is the length of the body of r once decoded, or -1 if it
+// isn't known
+func DecodedLength(r *http.Request) int64 {
+	if dl := r.Header.Get("X-Amz-Decoded-Content-Length"); dl != "" {
+		n, err := strconv.ParseInt(dl, 10, 64)
+		if err != nil {
+			return -1
+		}
+		return n
+	}
+	switch r.Header.Get("X-Amz-Content-Sha256") {
+	case StreamingPayload, StreamingPayloadTrailer, StreamingUnsignedTrailer:
+		return -1
+	}
+	return r.ContentLength
+}
+
+// LimitReader reads from r and fails with ErrEntityTooLarge once more than
+// n bytes were read
+func LimitReader(r io.Reader, n int64) io.Reader {
+	return &limitedReader{r: r, left: n}
+}
+
+type limitedReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if lr.left < 0 {
+		return 0, ErrEntityTooLarge
+	}
+	if int64(len(p)) > lr.left+1 {
+		// one more byte tells an exact fit from too much
+		p = p[:lr.left+1]
+	}
+	n, err := lr.r.Read(p)
+	lr.left -= int64(n)
+	if lr.left < 0 {
+		return n, ErrEntityTooLarge
+	}
+	return n, err
+}
+
+type hashReader struct {
+	r    io.Reader
+	h    hash.Hash
+	want []byte
+}
+
+func (hr *hashReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n]) //nolint:errcheck
+	if err == io.EOF && !bytes.Equal(hr.h.Sum(nil), hr.want) {
+		return n, ErrContentSHA256Mismatch
+	}
+	return n, err
+}
+
+// chunkedReader decodes an aws-chunked body, chunks of
+// "<hex size>[;chunk-signature=<sig>]\r\n<data>\r\n" that end with an empty
+// chunk, which may be followed by trailing headers. With auth set, every
+// chunk is signed with the signature of the one before it, the first with
+// the one of the request.
+type chunkedReader struct {
+	r       *bufio.Reader
+	left    int64
+	started bool
+	done    bool
+
+	auth    *Auth
+	trailer bool
+	// prev is the signature of the last chunk checked, sig the one of the
+	// chunk being read, and h hashes its data
+	prev string
+	sig  string
+	h    hash.Hash
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	for cr.left == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+		if err := cr.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(p)) > cr.left {
+		p = p[:cr.left]
+	}
+	n, err := cr.r.Read(p)
+	cr.left -= int64(n)
+	if cr.auth != nil {
+		cr.h.Write(p[:n]) //nolint:errcheck
+	}
+	if err == io.EOF {
+		return n, ErrIncompleteBody
+	}
+	return n, err
+}
+
+func (cr *chunkedReader) next() error {
+	if cr.started {
+		// the data of the last chunk ends with a newline
+		var crlf [2]byte
+		if _, err := io.ReadFull(cr.r, crlf[:]); err != nil || string(crlf[:]) != "\r\n" {
+			return ErrIncompleteBody
+		}
+		if err := cr.checkChunk(); err != nil {
+			return err
+		}
+	}
+	cr.started = true
+
+	line, err := cr.r.ReadString('\n')
+	if err != nil {
+		return ErrIncompleteBody
+	}
+	line = strings.TrimRight(line, "\r\n")
+	cr.sig = ""
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		cr.sig = strings.TrimPrefix(line[i+1:], "chunk-signature=")
+		line = line[:i]
+	}
+	size, err := strconv.ParseInt(line, 16, 64)
+	if err != nil || size < 0 {
+		return ErrIncompleteBody
+	}
+
+	if size == 0 {
+		cr.done = true
+		// the empty chunk is signed too
+		if err := cr.checkChunk(); err != nil {
+			return err
+		}
+		return cr.readTrailer()
+	}
+	cr.left = size
+	return nil
+}
+
+// checkChunk checks the signature of the chunk that was read
+func (cr *chunkedReader) checkChunk() error {
+	if cr.auth == nil {
+		return nil
+	}
+	sts := strings.Join([]string{
+		algorithm + "-PAYLOAD",
+		cr.auth.amzDate,
+		cr.auth.scope(),
+		cr.prev,
+		emptySHA256,
+		hex.EncodeToString(cr.h.Sum(nil)),
+	}, "\n")
+	want := hex.EncodeToString(hmacSHA256(cr.auth.key, sts))
+	if !hmac.Equal([]byte(cr.sig), []byte(want)) {
+		return ErrSignatureDoesNotMatch
+	}
+	cr.prev = cr.sig
+	cr.h.Reset()
+	return nil
+}
+
+// readTrailer reads the trailing headers after the last chunk, and checks
+// their signature when the payload is signed. The checksums in them aren't
+// checked.
+func (cr *chunkedReader) readTrailer() error {
+	if cr.auth == nil || !cr.trailer {
+		_, err := io.Copy(io.Discard, cr.r)
+		return err
+	}
+
+	var headers strings.Builder
+	var sig string
+	for {
+		line, err := cr.r.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if kv := strings.SplitN(line, ":", 2); len(kv) == 2 {
+			if strings.EqualFold(kv[0], "x-amz-trailer-signature") {
+				sig = strings.TrimSpace(kv[1])
+			} else {
+				headers.WriteString(strings.ToLower(kv[0]) + ":" + strings.TrimSpace(kv[1]) + "\n")
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ErrIncompleteBody
+		}
+	}
+
+	sts := strings.Join([]string{
+		algorithm + "-TRAILER",
+		cr.auth.amzDate,
+		cr.auth.scope(),
+		cr.prev,
+		hashHex([]byte(headers.String())),
+	}, "\n")
+	want := hex.EncodeToString(hmacSHA256(cr.auth.key, sts))
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return ErrSignatureDoesNotMatch
+	}
+	return nil
+}
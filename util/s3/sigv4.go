@@ -0,0 +1,226 @@
+// Package s3 has the parts of the S3 REST API that estuary's S3 frontend
+// needs: AWS signature version 4 request authentication, aws-chunked
+// payload decoding, the XML documents of the API and key listing.
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	algorithm = "AWS4-HMAC-SHA256"
+
+	amzDateFormat = "20060102T150405Z"
+
+	// MaxSkew is how far the time a request was signed at may be off
+	MaxSkew = time.Minute * 15
+
+	// payload hashes that aren't hashes
+	UnsignedPayload          = "UNSIGNED-PAYLOAD"
+	StreamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	StreamingPayloadTrailer  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	StreamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+)
+
+// Auth is the signature version 4 authorization of a request
+type Auth struct {
+	AccessKey     string
+	Date          string
+	Region        string
+	Service       string
+	SignedHeaders []string
+	Signature     string
+
+	amzDate string
+	// key is the signing key of the secret the request was verified with
+	key []byte
+}
+
+// ParseAuth parses the authorization of r, signed no further than MaxSkew
+// away from now
+func ParseAuth(r *http.Request, now time.Time) (*Auth, error) {
+	h := r.Header.Get("Authorization")
+	if h == "" {
+		return nil, ErrAccessDenied
+	}
+	if !strings.HasPrefix(h, algorithm+" ") {
+		return nil, ErrSignatureVersion
+	}
+
+	var a Auth
+	for _, f := range strings.Split(strings.TrimPrefix(h, algorithm+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+		if len(kv) != 2 {
+			return nil, ErrAuthorizationHeaderMalformed
+		}
+		switch kv[0] {
+		case "Credential":
+			scope := strings.Split(kv[1], "/")
+			if len(scope) != 5 || scope[4] != "aws4_request" {
+				return nil, ErrAuthorizationHeaderMalformed
+			}
+			a.AccessKey, a.Date, a.Region, a.Service = scope[0], scope[1], scope[2], scope[3]
+		case "SignedHeaders":
+			a.SignedHeaders = strings.Split(kv[1], ";")
+		case "Signature":
+			a.Signature = kv[1]
+		}
+	}
+	if a.AccessKey == "" || a.Signature == "" || len(a.SignedHeaders) == 0 {
+		return nil, ErrAuthorizationHeaderMalformed
+	}
+	// a signature that doesn't cover the host could be replayed to another
+	hostSigned := false
+	for _, h := range a.SignedHeaders {
+		hostSigned = hostSigned || h == "host"
+	}
+	if !hostSigned {
+		return nil, ErrAuthorizationHeaderMalformed
+	}
+
+	a.amzDate = r.Header.Get("X-Amz-Date")
+	t, err := time.Parse(amzDateFormat, a.amzDate)
+	if err != nil {
+		if t, err = http.ParseTime(r.Header.Get("Date")); err != nil {
+			return nil, ErrAccessDenied
+		}
+		a.amzDate = t.UTC().Format(amzDateFormat)
+	}
+	if !strings.HasPrefix(a.amzDate, a.Date) {
+		return nil, ErrAuthorizationHeaderMalformed
+	}
+	if d := now.Sub(t); d > MaxSkew || d < -MaxSkew {
+		return nil, ErrRequestTimeTooSkewed
+	}
+	return &a, nil
+}
+
+// Verify reports whether the request was signed with secret. The payload
+// of a verified request is read with Payload.
+func (a *Auth) Verify(r *http.Request, secret string) bool {
+	key := a.signingKey(secret)
+	if !hmac.Equal([]byte(a.Signature), []byte(a.sign(r, key))) {
+		return false
+	}
+	a.key = key
+	return true
+}
+
+func (a *Auth) scope() string {
+	return strings.Join([]string{a.Date, a.Region, a.Service, "aws4_request"}, "/")
+}
+
+func (a *Auth) signingKey(secret string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), a.Date)
+	for _, s := range []string{a.Region, a.Service, "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	return key
+}
+
+func (a *Auth) sign(r *http.Request, key []byte) string {
+	sts := strings.Join([]string{
+		algorithm,
+		a.amzDate,
+		a.scope(),
+		hashHex([]byte(a.canonicalRequest(r))),
+	}, "\n")
+	return hex.EncodeToString(hmacSHA256(key, sts))
+}
+
+func (a *Auth) canonicalRequest(r *http.Request) string {
+	var headers strings.Builder
+	for _, name := range a.SignedHeaders {
+		var vals []string
+		switch name {
+		case "host":
+			vals = []string{r.Host}
+		case "content-length":
+			vals = r.Header.Values(name)
+			if len(vals) == 0 && r.ContentLength >= 0 {
+				vals = []string{strconv.FormatInt(r.ContentLength, 10)}
+			}
+		default:
+			vals = r.Header.Values(name)
+		}
+		for i, v := range vals {
+			vals[i] = strings.Join(strings.Fields(v), " ")
+		}
+		headers.WriteString(name + ":" + strings.Join(vals, ",") + "\n")
+	}
+
+	payload := r.Header.Get("X-Amz-Content-Sha256")
+	if payload == "" {
+		payload = UnsignedPayload
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		uriEncode(r.URL.Path, false),
+		canonicalQuery(r.URL.RawQuery),
+		headers.String(),
+		strings.Join(a.SignedHeaders, ";"),
+		payload,
+	}, "\n")
+}
+
+func canonicalQuery(raw string) string {
+	var params []string
+	for _, p := range strings.Split(raw, "&") {
+		if p == "" {
+			continue
+		}
+		kv := strings.SplitN(p, "=", 2)
+		k, err := url.QueryUnescape(kv[0])
+		if err != nil {
+			k = kv[0]
+		}
+		var v string
+		if len(kv) == 2 {
+			if v, err = url.QueryUnescape(kv[1]); err != nil {
+				v = kv[1]
+			}
+		}
+		params = append(params, uriEncode(k, true)+"="+uriEncode(v, true))
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// uriEncode encodes s the way signature version 4 wants it, everything but
+// the unreserved characters and, in paths, the slashes
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return b.String()
+}
+
+func hashHex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data)) //nolint:errcheck
+	return h.Sum(nil)
+}
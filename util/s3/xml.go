@@ -0,0 +1,226 @@
+package s3
+
+import (
+	"encoding/xml"
+	"net/http"
+	"time"
+)
+
+// TimeFormat is the format of times in the documents of the api
+const TimeFormat = "2006-01-02T15:04:05.000Z"
+
+const xmlns = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// Error is an error of the api, with the status it is returned with
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	ErrAccessDenied                 = &Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	ErrInvalidAccessKeyID           = &Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key id you provided does not exist in our records"}
+	ErrSignatureDoesNotMatch        = &Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided"}
+	ErrSignatureVersion             = &Error{http.StatusBadRequest, "InvalidRequest", "Only AWS4-HMAC-SHA256 signatures are supported"}
+	ErrAuthorizationHeaderMalformed = &Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed"}
+	ErrRequestTimeTooSkewed         = &Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large"}
+	ErrContentSHA256Mismatch        = &Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed"}
+	ErrIncompleteBody               = &Error{http.StatusBadRequest, "IncompleteBody", "The request body is malformed or ended early"}
+	ErrNoSuchBucket                 = &Error{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"}
+	ErrNoSuchKey                    = &Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist"}
+	ErrNoSuchUpload                 = &Error{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist"}
+	ErrBucketAlreadyOwnedByYou      = &Error{http.StatusConflict, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it"}
+	ErrBucketNotEmpty               = &Error{http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty"}
+	ErrInvalidBucketName            = &Error{http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid"}
+	ErrInvalidKey                   = &Error{http.StatusBadRequest, "KeyTooLongError", "The specified key is not valid"}
+	ErrInvalidPart                  = &Error{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found"}
+	ErrInvalidPartOrder             = &Error{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order"}
+	ErrInvalidArgument              = &Error{http.StatusBadRequest, "InvalidArgument", "Invalid Argument"}
+	ErrMalformedXML                 = &Error{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed"}
+	ErrEntityTooLarge               = &Error{http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size"}
+	ErrNotImplemented               = &Error{http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented"}
+	ErrInternal                     = &Error{http.StatusInternalServerError, "InternalError", "We encountered an internal error, please try again"}
+)
+
+// ErrorResponse is the body errors are returned with
+type ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource,omitempty"`
+	RequestID string   `xml:"RequestId,omitempty"`
+}
+
+// WriteXML writes v as the body of a response with the given status
+func WriteXML(w http.ResponseWriter, status int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(v)
+}
+
+// WriteError writes err as an error response about resource
+func WriteError(w http.ResponseWriter, err *Error, resource, requestID string) error {
+	return WriteXML(w, err.Status, &ErrorResponse{
+		Code:      err.Code,
+		Message:   err.Message,
+		Resource:  resource,
+		RequestID: requestID,
+	})
+}
+
+type Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type ListAllMyBucketsResult struct {
+	XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Owner   Owner    `xml:"Owner"`
+	Buckets []Bucket `xml:"Buckets>Bucket"`
+}
+
+func NewListAllMyBucketsResult(owner Owner, buckets []Bucket) *ListAllMyBucketsResult {
+	return &ListAllMyBucketsResult{Xmlns: xmlns, Owner: owner, Buckets: buckets}
+}
+
+type LocationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Region  string   `xml:",chardata"`
+}
+
+func NewLocationConstraint(region string) *LocationConstraint {
+	// us-east-1 is the region without a location constraint
+	if region == "us-east-1" {
+		region = ""
+	}
+	return &LocationConstraint{Xmlns: xmlns, Region: region}
+}
+
+type Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// ListBucketResult is the result of both versions of ListObjects, the
+// fields of the other version are left empty
+type ListBucketResult struct {
+	XMLName        xml.Name       `xml:"ListBucketResult"`
+	Xmlns          string         `xml:"xmlns,attr"`
+	Name           string         `xml:"Name"`
+	Prefix         string         `xml:"Prefix"`
+	Delimiter      string         `xml:"Delimiter,omitempty"`
+	MaxKeys        int            `xml:"MaxKeys"`
+	EncodingType   string         `xml:"EncodingType,omitempty"`
+	IsTruncated    bool           `xml:"IsTruncated"`
+	Contents       []Object       `xml:"Contents"`
+	CommonPrefixes []CommonPrefix `xml:"CommonPrefixes"`
+
+	// version 1
+	Marker     string `xml:"Marker,omitempty"`
+	NextMarker string `xml:"NextMarker,omitempty"`
+
+	// version 2
+	KeyCount              int    `xml:"KeyCount,omitempty"`
+	ContinuationToken     string `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string `xml:"StartAfter,omitempty"`
+}
+
+func NewListBucketResult(bucket string) *ListBucketResult {
+	return &ListBucketResult{Xmlns: xmlns, Name: bucket}
+}
+
+type InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+func NewInitiateMultipartUploadResult(bucket, key, uploadID string) *InitiateMultipartUploadResult {
+	return &InitiateMultipartUploadResult{Xmlns: xmlns, Bucket: bucket, Key: key, UploadID: uploadID}
+}
+
+type CompletePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// CompleteMultipartUpload is the body of a request to complete an upload
+type CompleteMultipartUpload struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []CompletePart `xml:"Part"`
+}
+
+type CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+func NewCompleteMultipartUploadResult(location, bucket, key, etag string) *CompleteMultipartUploadResult {
+	return &CompleteMultipartUploadResult{Xmlns: xmlns, Location: location, Bucket: bucket, Key: key, ETag: etag}
+}
+
+type ObjectIdentifier struct {
+	Key string `xml:"Key"`
+}
+
+// Delete is the body of a request to delete objects
+type Delete struct {
+	XMLName xml.Name           `xml:"Delete"`
+	Quiet   bool               `xml:"Quiet"`
+	Objects []ObjectIdentifier `xml:"Object"`
+}
+
+type DeletedObject struct {
+	Key string `xml:"Key"`
+}
+
+type DeleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type DeleteResult struct {
+	XMLName xml.Name        `xml:"DeleteResult"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Deleted []DeletedObject `xml:"Deleted"`
+	Errors  []DeleteError   `xml:"Error"`
+}
+
+func NewDeleteResult() *DeleteResult {
+	return &DeleteResult{Xmlns: xmlns}
+}
+
+// FormatTime formats t the way the documents of the api do
+func FormatTime(t time.Time) string {
+	return t.UTC().Format(TimeFormat)
+}
@@ -0,0 +1,135 @@
+// Package scan runs content past an external scanner, for operators to
+// detect malware or abuse material before content is pinned. Scanners
+// get the dag of the content as a car and answer whether it is flagged.
+package scan
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	car "github.com/ipld/go-car"
+)
+
+// Result is the verdict of a scanner
+type Result struct {
+	Flagged bool   `json:"flagged"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// Scanner scans the car of the dag under root
+type Scanner interface {
+	Scan(ctx context.Context, root cid.Cid, car io.Reader) (*Result, error)
+}
+
+// New returns the scanner for url, or else for command, nil for neither
+func New(url string, command []string) Scanner {
+	switch {
+	case url != "":
+		return &HTTP{URL: url}
+	case len(command) > 0:
+		return &Command{Path: command[0], Args: command[1:]}
+	default:
+		return nil
+	}
+}
+
+// Dag streams the dag under root in ng to the scanner as a car. ng should
+// be offline, so the scan doesn't fetch what isn't stored. Content is only
+// clean if the scanner saw all of it.
+func Dag(ctx context.Context, s Scanner, ng format.NodeGetter, root cid.Cid) (*Result, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := car.WriteCar(ctx, ng, []cid.Cid{root}, pw)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	res, err := s.Scan(ctx, root, pr)
+	// the scanner may stop reading before the end
+	pr.Close()
+	werr := <-done
+	if err != nil {
+		return nil, err
+	}
+	if werr != nil && !res.Flagged {
+		return nil, fmt.Errorf("failed to write the car of %s: %w", root, werr)
+	}
+	return res, nil
+}
+
+// HTTP posts the car to URL, with the root in the X-Content-Cid header,
+// and expects a 200 with a json Result
+type HTTP struct {
+	URL    string
+	Client *http.Client
+}
+
+func (h *HTTP) Scan(ctx context.Context, root cid.Cid, car io.Reader) (*Result, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, car)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.ipld.car")
+	req.Header.Set("X-Content-Cid", root.String())
+
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("scanner returned status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	var res Result
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("invalid scanner response: %w", err)
+	}
+	return &res, nil
+}
+
+// Command runs Path with Args and the root as its last argument, and the
+// car on stdin. It exits 0 for clean content and 1 for flagged content,
+// with the reason on stdout. Any other exit is a failure to scan.
+type Command struct {
+	Path string
+	Args []string
+}
+
+func (c *Command) Scan(ctx context.Context, root cid.Cid, car io.Reader) (*Result, error) {
+	cmd := exec.CommandContext(ctx, c.Path, append(append([]string{}, c.Args...), root.String())...)
+	cmd.Stdin = car
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	var exit *exec.ExitError
+	switch {
+	case err == nil:
+		return &Result{}, nil
+	case errors.As(err, &exit) && exit.ExitCode() == 1:
+		return &Result{Flagged: true, Reason: strings.TrimSpace(stdout.String())}, nil
+	default:
+		return nil, fmt.Errorf("scanner failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+}
@@ -0,0 +1,100 @@
+package scan
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTP(t *testing.T) {
+	root, err := cid.Decode("bafkqaaa")
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, root.String(), r.Header.Get("X-Content-Cid"))
+		if string(body) == "bad" {
+			json.NewEncoder(w).Encode(Result{Flagged: true, Reason: "eicar"}) //nolint:errcheck
+			return
+		}
+		if string(body) == "broken" {
+			http.Error(w, "nope", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(Result{}) //nolint:errcheck
+	}))
+	defer srv.Close()
+
+	s := &HTTP{URL: srv.URL}
+	res, err := s.Scan(context.Background(), root, strings.NewReader("good"))
+	require.NoError(t, err)
+	assert.False(t, res.Flagged)
+
+	res, err = s.Scan(context.Background(), root, strings.NewReader("bad"))
+	require.NoError(t, err)
+	assert.True(t, res.Flagged)
+	assert.Equal(t, "eicar", res.Reason)
+
+	_, err = s.Scan(context.Background(), root, strings.NewReader("broken"))
+	assert.Error(t, err)
+}
+
+func TestCommand(t *testing.T) {
+	root, err := cid.Decode("bafkqaaa")
+	require.NoError(t, err)
+
+	script := `if grep -q bad; then echo "flagged $0"; exit 1; fi; [ "$0" = bafkqaaa ] || exit 2`
+	s := &Command{Path: "sh", Args: []string{"-c", script}}
+
+	res, err := s.Scan(context.Background(), root, strings.NewReader("good"))
+	require.NoError(t, err)
+	assert.False(t, res.Flagged)
+
+	res, err = s.Scan(context.Background(), root, strings.NewReader("bad"))
+	require.NoError(t, err)
+	assert.True(t, res.Flagged)
+	assert.Equal(t, "flagged bafkqaaa", res.Reason)
+
+	_, err = (&Command{Path: "sh", Args: []string{"-c", "exit 3"}}).Scan(context.Background(), root, strings.NewReader(""))
+	assert.Error(t, err)
+}
+
+func TestDag(t *testing.T) {
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+
+	good := merkledag.NewRawNode([]byte("good"))
+	bad := merkledag.NewRawNode([]byte("bad"))
+	require.NoError(t, bs.PutMany(context.Background(), []blocks.Block{good, bad}))
+	missing := merkledag.NewRawNode([]byte("missing"))
+
+	s := &Command{Path: "sh", Args: []string{"-c", `if grep -q bad; then echo flagged; exit 1; fi`}}
+
+	res, err := Dag(context.Background(), s, dserv, good.Cid())
+	require.NoError(t, err)
+	assert.False(t, res.Flagged)
+
+	res, err = Dag(context.Background(), s, dserv, bad.Cid())
+	require.NoError(t, err)
+	assert.True(t, res.Flagged)
+
+	// blocks that aren't stored aren't fetched, nor is content clean
+	// without them
+	_, err = Dag(context.Background(), s, dserv, missing.Cid())
+	assert.Error(t, err)
+}
@@ -0,0 +1,205 @@
+// Package sessionpool shares bitswap sessions between related pin
+// operations. Pins fetched from the same origins, or that are parts of the
+// same dataset, find their blocks on the same peers, so rather than every
+// operation starting a fresh session and discovering those peers again, the
+// operations with the same key use one session for as long as any of them
+// is running, and for an idle timeout after, with the connections to their
+// origins protected from the connection manager in the meantime.
+package sessionpool
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// NewSessionFunc starts a session that lives until ctx is cancelled
+type NewSessionFunc func(ctx context.Context) ipld.NodeGetter
+
+type Stats struct {
+	Sessions int   `json:"sessions"`
+	Created  int64 `json:"created"`
+	Reused   int64 `json:"reused"`
+}
+
+type session struct {
+	key    string
+	ng     ipld.NodeGetter
+	cancel context.CancelFunc
+	peers  map[peer.ID]struct{}
+	refs   int
+	// gen changes every time the session is released for the last time, so
+	// an expiry timer can tell whether the session was used since it was set
+	gen   int
+	timer *time.Timer
+}
+
+type Pool struct {
+	newSession NewSessionFunc
+	cmgr       connmgr.ConnManager
+
+	lk       sync.Mutex
+	idle     time.Duration
+	sessions map[string]*session
+	stats    Stats
+}
+
+// New creates a pool that keeps unused sessions around for idle. An idle of
+// zero turns reuse off, every Get then starts its own session. cmgr may be
+// nil.
+func New(newSession NewSessionFunc, cmgr connmgr.ConnManager, idle time.Duration) *Pool {
+	return &Pool{
+		newSession: newSession,
+		cmgr:       cmgr,
+		idle:       idle,
+		sessions:   make(map[string]*session),
+	}
+}
+
+// SetIdleTimeout changes how long unused sessions are kept, it applies to
+// sessions released from now on
+func (p *Pool) SetIdleTimeout(idle time.Duration) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.idle = idle
+}
+
+// Key returns the key of the operations that share origins, or of the
+// given group when there are no origins to go by
+func Key(group string, origins []*peer.AddrInfo) string {
+	if len(origins) == 0 {
+		return group
+	}
+
+	ids := make([]string, 0, len(origins))
+	for _, ai := range origins {
+		ids = append(ids, ai.ID.String())
+	}
+	sort.Strings(ids)
+	return "origins:" + strings.Join(ids, ",")
+}
+
+// Get returns the session for key, starting one if there is none, and a
+// func to call once the caller is done with it. The connections to origins
+// are protected for as long as the session lives.
+func (p *Pool) Get(key string, origins []*peer.AddrInfo) (ipld.NodeGetter, func()) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	if p.idle <= 0 || key == "" {
+		ctx, cancel := context.WithCancel(context.Background())
+		p.stats.Created++
+		return p.newSession(ctx), cancel
+	}
+
+	s, ok := p.sessions[key]
+	if ok {
+		p.stats.Reused++
+		if s.timer != nil {
+			s.timer.Stop()
+			s.timer = nil
+		}
+	} else {
+		ctx, cancel := context.WithCancel(context.Background())
+		s = &session{
+			key:    key,
+			ng:     p.newSession(ctx),
+			cancel: cancel,
+			peers:  make(map[peer.ID]struct{}),
+		}
+		p.sessions[key] = s
+		p.stats.Created++
+	}
+	s.refs++
+	p.protect(s, origins)
+
+	var once sync.Once
+	return s.ng, func() {
+		once.Do(func() { p.release(s) })
+	}
+}
+
+func (p *Pool) protect(s *session, origins []*peer.AddrInfo) {
+	if p.cmgr == nil {
+		return
+	}
+	for _, ai := range origins {
+		if _, ok := s.peers[ai.ID]; ok {
+			continue
+		}
+		p.cmgr.Protect(ai.ID, p.tag(s))
+		s.peers[ai.ID] = struct{}{}
+	}
+}
+
+func (p *Pool) tag(s *session) string {
+	return "session:" + s.key
+}
+
+func (p *Pool) release(s *session) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	s.refs--
+	if s.refs > 0 {
+		return
+	}
+
+	s.gen++
+	gen := s.gen
+	s.timer = time.AfterFunc(p.idle, func() {
+		p.expire(s, gen)
+	})
+}
+
+func (p *Pool) expire(s *session, gen int) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	if s.refs > 0 || s.gen != gen {
+		return
+	}
+	p.close(s)
+}
+
+// close ends a session, p.lk must be held
+func (p *Pool) close(s *session) {
+	if p.sessions[s.key] == s {
+		delete(p.sessions, s.key)
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.cancel()
+
+	if p.cmgr != nil {
+		for pid := range s.peers {
+			p.cmgr.Unprotect(pid, p.tag(s))
+		}
+	}
+}
+
+func (p *Pool) Stats() Stats {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	st := p.stats
+	st.Sessions = len(p.sessions)
+	return st
+}
+
+// Close ends every session, including the ones still in use
+func (p *Pool) Close() {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	for _, s := range p.sessions {
+		p.close(s)
+	}
+}
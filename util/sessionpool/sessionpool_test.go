@@ -0,0 +1,102 @@
+package sessionpool
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	ipld "github.com/ipfs/go-ipld-format"
+	mdtest "github.com/ipfs/go-merkledag/test"
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+type protectRecorder struct {
+	connmgr.NullConnMgr
+
+	lk        sync.Mutex
+	protected map[peer.ID]int
+}
+
+func (r *protectRecorder) Protect(p peer.ID, tag string) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.protected[p]++
+}
+
+func (r *protectRecorder) Unprotect(p peer.ID, tag string) bool {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.protected[p]--
+	return false
+}
+
+func (r *protectRecorder) count(p peer.ID) int {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	return r.protected[p]
+}
+
+func TestPool(t *testing.T) {
+	assert := assert.New(t)
+
+	var lk sync.Mutex
+	var ctxs []context.Context
+	ds := mdtest.Mock()
+	newSession := func(ctx context.Context) ipld.NodeGetter {
+		lk.Lock()
+		defer lk.Unlock()
+		ctxs = append(ctxs, ctx)
+		return ds
+	}
+
+	cmgr := &protectRecorder{protected: make(map[peer.ID]int)}
+	p := New(newSession, cmgr, time.Millisecond*100)
+
+	p1 := peer.ID("origin-1")
+	p2 := peer.ID("origin-2")
+	origins := []*peer.AddrInfo{{ID: p2}, {ID: p1}}
+	key := Key("user-1", origins)
+	assert.Equal(key, Key("user-2", []*peer.AddrInfo{{ID: p1}, {ID: p2}}), "the key doesn't depend on the order of origins")
+	assert.Equal("user-1", Key("user-1", nil))
+
+	_, release1 := p.Get(key, origins)
+	_, release2 := p.Get(key, origins[1:])
+	_, release3 := p.Get("other", nil)
+	assert.Len(ctxs, 2)
+	assert.Equal(1, cmgr.count(p1))
+
+	release1()
+	release1()
+	release2()
+
+	// released sessions are kept for the idle timeout and reused
+	_, release4 := p.Get(key, nil)
+	assert.Len(ctxs, 2)
+	assert.NoError(ctxs[0].Err())
+	release4()
+
+	assert.Equal(Stats{Sessions: 2, Created: 2, Reused: 2}, p.Stats())
+
+	time.Sleep(time.Millisecond * 300)
+	assert.Error(ctxs[0].Err(), "idle session is closed")
+	assert.NoError(ctxs[1].Err(), "session in use is kept")
+	assert.Equal(0, cmgr.count(p1))
+	assert.Equal(0, cmgr.count(p2))
+	assert.Equal(1, p.Stats().Sessions)
+
+	release3()
+	p.Close()
+	assert.Error(ctxs[1].Err())
+
+	// without an idle timeout every operation gets its own session
+	p = New(newSession, nil, 0)
+	_, r1 := p.Get(key, nil)
+	_, r2 := p.Get(key, nil)
+	r1()
+	r2()
+	assert.Len(ctxs, 4)
+	assert.Error(ctxs[2].Err())
+}
@@ -37,6 +37,9 @@ type ShuttleCreateContentBody struct {
 	Collections  []string `json:"collections"`
 	DagSplitRoot uint     `json:"dagSplitRoot"`
 	User         uint     `json:"user"`
+	// Namespace is the namespace of the key the content was added with,
+	// pieces of a split dag are always in the namespace of the whole
+	Namespace string `json:"namespace,omitempty"`
 }
 
 type ChanTrack struct {
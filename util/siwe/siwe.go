@@ -0,0 +1,215 @@
+// Package siwe verifies Sign-In With Ethereum (EIP-4361) messages: a
+// wallet signs a message naming the site, its address and a nonce the site
+// handed out, which proves the user holds the address.
+package siwe
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	crypto "github.com/filecoin-project/go-crypto"
+	"golang.org/x/crypto/sha3"
+)
+
+const header = " wants you to sign in with your Ethereum account:"
+
+// Message is a parsed sign in message
+type Message struct {
+	Domain         string
+	Address        string
+	Statement      string
+	URI            string
+	Version        string
+	ChainID        int64
+	Nonce          string
+	IssuedAt       time.Time
+	ExpirationTime time.Time
+	NotBefore      time.Time
+	RequestID      string
+	Resources      []string
+}
+
+// Parse parses a message in the EIP-4361 format
+func Parse(s string) (*Message, error) {
+	lines := strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+	if len(lines) < 2 || !strings.HasSuffix(lines[0], header) {
+		return nil, fmt.Errorf("not a sign in message")
+	}
+
+	m := &Message{
+		Domain:  strings.TrimSuffix(lines[0], header),
+		Address: lines[1],
+	}
+	if _, err := ParseAddress(m.Address); err != nil {
+		return nil, err
+	}
+
+	i := 2
+	skipEmpty := func() {
+		for i < len(lines) && lines[i] == "" {
+			i++
+		}
+	}
+	skipEmpty()
+	if i < len(lines) && !strings.HasPrefix(lines[i], "URI: ") {
+		m.Statement = lines[i]
+		i++
+		skipEmpty()
+	}
+
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if line == "" {
+			continue
+		}
+		if line == "Resources:" {
+			for i++; i < len(lines) && strings.HasPrefix(lines[i], "- "); i++ {
+				m.Resources = append(m.Resources, strings.TrimPrefix(lines[i], "- "))
+			}
+			i--
+			continue
+		}
+
+		kv := strings.SplitN(line, ": ", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed line %q", line)
+		}
+		k, v := kv[0], kv[1]
+		var err error
+		switch k {
+		case "URI":
+			m.URI = v
+		case "Version":
+			m.Version = v
+		case "Chain ID":
+			m.ChainID, err = strconv.ParseInt(v, 10, 64)
+		case "Nonce":
+			m.Nonce = v
+		case "Issued At":
+			m.IssuedAt, err = time.Parse(time.RFC3339, v)
+		case "Expiration Time":
+			m.ExpirationTime, err = time.Parse(time.RFC3339, v)
+		case "Not Before":
+			m.NotBefore, err = time.Parse(time.RFC3339, v)
+		case "Request ID":
+			m.RequestID = v
+		default:
+			return nil, fmt.Errorf("unknown field %q", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", k, err)
+		}
+	}
+
+	if m.URI == "" || m.Version != "1" || m.Nonce == "" || m.IssuedAt.IsZero() {
+		return nil, fmt.Errorf("message needs a uri, version 1, a nonce and when it was issued")
+	}
+	return m, nil
+}
+
+// Expect is what a message has to be for
+type Expect struct {
+	// Domain is the host the message is for, its URI has to be on it too
+	Domain string
+	// ChainIDs are the chains the message may be for
+	ChainIDs []int64
+}
+
+// Verify checks that the message was signed by its address with sig, and
+// is meant for exp right now
+func (m *Message) Verify(raw string, sig []byte, exp Expect, now time.Time) error {
+	if m.Domain != exp.Domain {
+		return fmt.Errorf("message is for %s", m.Domain)
+	}
+	u, err := url.Parse(m.URI)
+	if err != nil || u.Host != exp.Domain || (u.Scheme != "https" && u.Scheme != "http") {
+		return fmt.Errorf("message uri %q is not on %s", m.URI, exp.Domain)
+	}
+	chainOK := false
+	for _, id := range exp.ChainIDs {
+		if m.ChainID == id {
+			chainOK = true
+			break
+		}
+	}
+	if !chainOK {
+		return fmt.Errorf("message is for chain %d", m.ChainID)
+	}
+	if !m.ExpirationTime.IsZero() && now.After(m.ExpirationTime) {
+		return fmt.Errorf("message expired")
+	}
+	if !m.NotBefore.IsZero() && now.Before(m.NotBefore) {
+		return fmt.Errorf("message is not valid yet")
+	}
+
+	signer, err := Recover(raw, sig)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(signer, m.Address) {
+		return fmt.Errorf("message was signed by %s", signer)
+	}
+	return nil
+}
+
+// Recover returns the address that signed msg with personal_sign
+func Recover(msg string, sig []byte) (string, error) {
+	if len(sig) != 65 {
+		return "", fmt.Errorf("signature must be 65 bytes, got %d", len(sig))
+	}
+	rsv := make([]byte, 65)
+	copy(rsv, sig)
+	// wallets add 27 to the recovery id
+	if rsv[64] >= 27 {
+		rsv[64] -= 27
+	}
+
+	pub, err := crypto.EcRecover(hashMessage(msg), rsv)
+	if err != nil {
+		return "", fmt.Errorf("invalid signature: %w", err)
+	}
+	return Checksum(keccak256(pub[1:])[12:]), nil
+}
+
+// ParseAddress parses a 0x prefixed hex address, mixed case addresses must
+// have a valid EIP-55 checksum
+func ParseAddress(s string) ([]byte, error) {
+	if !strings.HasPrefix(s, "0x") || len(s) != 42 {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	b, err := hex.DecodeString(s[2:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	if s != strings.ToLower(s) && s != "0x"+strings.ToUpper(s[2:]) && s != Checksum(b) {
+		return nil, fmt.Errorf("address %q has an invalid checksum", s)
+	}
+	return b, nil
+}
+
+// Checksum formats an address with its EIP-55 checksum
+func Checksum(addr []byte) string {
+	h := hex.EncodeToString(addr)
+	hash := hex.EncodeToString(keccak256([]byte(h)))
+	out := []byte(h)
+	for i, c := range out {
+		if c >= 'a' && hash[i] >= '8' {
+			out[i] = c - 'a' + 'A'
+		}
+	}
+	return "0x" + string(out)
+}
+
+func hashMessage(msg string) []byte {
+	return keccak256([]byte(fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(msg), msg)))
+}
+
+func keccak256(data []byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	h.Write(data) //nolint:errcheck
+	return h.Sum(nil)
+}
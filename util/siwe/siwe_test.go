@@ -0,0 +1,88 @@
+package siwe
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	crypto "github.com/filecoin-project/go-crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the private key of the EIP-155 example and its address
+const (
+	testKey  = "4646464646464646464646464646464646464646464646464646464646464646"
+	testAddr = "0x9d8A62f656a8d1615C1294fd71e9CFb3E4855A4F"
+)
+
+const testMessage = `estuary.tech wants you to sign in with your Ethereum account:
+0x9d8A62f656a8d1615C1294fd71e9CFb3E4855A4F
+
+Sign in to Estuary
+
+URI: https://estuary.tech
+Version: 1
+Chain ID: 314
+Nonce: 32891756
+Issued At: 2022-09-01T16:25:24Z
+Expiration Time: 2022-09-01T17:25:24Z
+Resources:
+- https://estuary.tech/terms`
+
+func sign(t *testing.T, msg string) []byte {
+	key, err := hex.DecodeString(testKey)
+	require.NoError(t, err)
+	sig, err := crypto.Sign(key, hashMessage(msg))
+	require.NoError(t, err)
+	sig[64] += 27
+	return sig
+}
+
+func TestChecksum(t *testing.T) {
+	b, err := ParseAddress("0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed")
+	require.NoError(t, err)
+	assert.Equal(t, "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed", Checksum(b))
+
+	_, err = ParseAddress("0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAeD")
+	assert.Error(t, err)
+	_, err = ParseAddress("0x1234")
+	assert.Error(t, err)
+}
+
+func TestVerify(t *testing.T) {
+	m, err := Parse(testMessage)
+	require.NoError(t, err)
+	assert.Equal(t, "estuary.tech", m.Domain)
+	assert.Equal(t, testAddr, m.Address)
+	assert.Equal(t, "Sign in to Estuary", m.Statement)
+	assert.Equal(t, int64(314), m.ChainID)
+	assert.Equal(t, "32891756", m.Nonce)
+	assert.Equal(t, []string{"https://estuary.tech/terms"}, m.Resources)
+
+	now := m.IssuedAt.Add(time.Minute)
+	sig := sign(t, testMessage)
+
+	signer, err := Recover(testMessage, sig)
+	require.NoError(t, err)
+	assert.Equal(t, testAddr, signer)
+
+	exp := Expect{Domain: "estuary.tech", ChainIDs: []int64{1, 314}}
+	assert.NoError(t, m.Verify(testMessage, sig, exp, now))
+	assert.Error(t, m.Verify(testMessage, sig, Expect{Domain: "evil.example", ChainIDs: exp.ChainIDs}, now))
+	assert.Error(t, m.Verify(testMessage, sig, Expect{Domain: exp.Domain, ChainIDs: []int64{1}}, now))
+	assert.Error(t, m.Verify(testMessage, sig, exp, m.ExpirationTime.Add(time.Second)))
+
+	// a signature over another message recovers to another address
+	assert.Error(t, m.Verify(testMessage, sign(t, testMessage+" "), exp, now))
+
+	// the uri has to be on the domain as well
+	evil := strings.Replace(testMessage, "URI: https://estuary.tech", "URI: https://evil.example", 1)
+	em, err := Parse(evil)
+	require.NoError(t, err)
+	assert.Error(t, em.Verify(evil, sign(t, evil), exp, now))
+
+	_, err = Parse("hello")
+	assert.Error(t, err)
+}
@@ -0,0 +1,249 @@
+// Package spconn manages the connections to storage providers. Every
+// interaction with a provider (proposing deals, checking on them, starting
+// transfers, querying for retrievals) goes through Connect first, which
+// reuses the connection if there is one, joins a dial that is already in
+// flight, limits how many providers are dialed at once and backs off from
+// providers whose dials keep failing, so an unreachable provider costs one
+// failed dial per backoff period rather than one per piece.
+package spconn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+var ErrBackoff = errors.New("backing off from provider")
+
+// ResolveFunc looks up the peer info of a provider, usually from chain
+type ResolveFunc func(ctx context.Context, sp address.Address) (peer.AddrInfo, error)
+
+// Dialer is the part of a libp2p host the pool needs
+type Dialer interface {
+	Connect(ctx context.Context, ai peer.AddrInfo) error
+	Connected(p peer.ID) bool
+	Protect(p peer.ID, tag string)
+	Unprotect(p peer.ID, tag string) bool
+}
+
+type hostDialer struct {
+	h host.Host
+}
+
+func (hd hostDialer) Connect(ctx context.Context, ai peer.AddrInfo) error {
+	return hd.h.Connect(ctx, ai)
+}
+
+func (hd hostDialer) Connected(p peer.ID) bool {
+	return hd.h.Network().Connectedness(p) == network.Connected
+}
+
+func (hd hostDialer) Protect(p peer.ID, tag string) {
+	hd.h.ConnManager().Protect(p, tag)
+}
+
+func (hd hostDialer) Unprotect(p peer.ID, tag string) bool {
+	return hd.h.ConnManager().Unprotect(p, tag)
+}
+
+// HostDialer dials through a libp2p host
+func HostDialer(h host.Host) Dialer {
+	return hostDialer{h: h}
+}
+
+type Options struct {
+	// MaxDials is how many providers are dialed at the same time
+	MaxDials int
+	// BackoffBase is the backoff after the first failed dial, it doubles
+	// with every failure after that up to BackoffMax
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+	// AddrTTL is how long a resolved provider address is used before it is
+	// looked up again
+	AddrTTL time.Duration
+}
+
+type Stats struct {
+	Providers  int   `json:"providers"`
+	BackingOff int   `json:"backingOff"`
+	Dials      int64 `json:"dials"`
+	DialErrors int64 `json:"dialErrors"`
+	Reused     int64 `json:"reused"`
+	Skipped    int64 `json:"skipped"`
+}
+
+type provider struct {
+	ai         peer.AddrInfo
+	resolvedAt time.Time
+
+	failures int
+	lastErr  error
+	retryAt  time.Time
+
+	// dialing is closed when the dial in flight finishes
+	dialing chan struct{}
+}
+
+type Pool struct {
+	dialer  Dialer
+	resolve ResolveFunc
+	dials   chan struct{}
+
+	opts Options
+
+	lk    sync.Mutex
+	sps   map[address.Address]*provider
+	stats Stats
+}
+
+func New(d Dialer, resolve ResolveFunc, opts Options) *Pool {
+	if opts.MaxDials <= 0 {
+		opts.MaxDials = 1
+	}
+	return &Pool{
+		dialer:  d,
+		resolve: resolve,
+		dials:   make(chan struct{}, opts.MaxDials),
+		opts:    opts,
+		sps:     make(map[address.Address]*provider),
+	}
+}
+
+func (p *Pool) backoff(failures int) time.Duration {
+	d := p.opts.BackoffBase
+	for i := 1; i < failures && d < p.opts.BackoffMax; i++ {
+		d *= 2
+	}
+	if d > p.opts.BackoffMax {
+		d = p.opts.BackoffMax
+	}
+	return d
+}
+
+// Connect makes sure there is a connection to the provider and returns its
+// peer id
+func (p *Pool) Connect(ctx context.Context, sp address.Address) (peer.ID, error) {
+	for {
+		p.lk.Lock()
+		st, ok := p.sps[sp]
+		if !ok {
+			st = &provider{}
+			p.sps[sp] = st
+		}
+
+		if st.dialing != nil {
+			wait := st.dialing
+			p.lk.Unlock()
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}
+
+		if st.ai.ID != "" && p.dialer.Connected(st.ai.ID) {
+			p.stats.Reused++
+			id := st.ai.ID
+			p.lk.Unlock()
+			return id, nil
+		}
+
+		if now := time.Now(); now.Before(st.retryAt) {
+			p.stats.Skipped++
+			err := fmt.Errorf("%w %s until %s: %s", ErrBackoff, sp, st.retryAt.Format(time.RFC3339), st.lastErr)
+			p.lk.Unlock()
+			return "", err
+		}
+
+		st.dialing = make(chan struct{})
+		ai, resolvedAt := st.ai, st.resolvedAt
+		p.lk.Unlock()
+
+		return p.dial(ctx, sp, st, ai, resolvedAt)
+	}
+}
+
+func (p *Pool) dial(ctx context.Context, sp address.Address, st *provider, ai peer.AddrInfo, resolvedAt time.Time) (peer.ID, error) {
+	var err error
+	defer func() {
+		p.lk.Lock()
+		defer p.lk.Unlock()
+
+		p.stats.Dials++
+		// a dial cut short by our own context says nothing about the provider
+		if err != nil && ctx.Err() == nil {
+			p.stats.DialErrors++
+			st.failures++
+			st.lastErr = err
+			st.retryAt = time.Now().Add(p.backoff(st.failures))
+			// the provider may have moved, look it up again next time
+			st.ai = peer.AddrInfo{}
+		} else if err == nil {
+			st.failures = 0
+			st.lastErr = nil
+			st.retryAt = time.Time{}
+			st.ai = ai
+			st.resolvedAt = resolvedAt
+		}
+		close(st.dialing)
+		st.dialing = nil
+	}()
+
+	select {
+	case p.dials <- struct{}{}:
+		defer func() { <-p.dials }()
+	case <-ctx.Done():
+		err = ctx.Err()
+		return "", err
+	}
+
+	if ai.ID == "" || time.Since(resolvedAt) > p.opts.AddrTTL {
+		ai, err = p.resolve(ctx, sp)
+		if err != nil {
+			return "", err
+		}
+		resolvedAt = time.Now()
+	}
+
+	if err = p.dialer.Connect(ctx, ai); err != nil {
+		return "", err
+	}
+	return ai.ID, nil
+}
+
+// Acquire connects to the provider and protects the connection from the
+// connection manager until release is called
+func (p *Pool) Acquire(ctx context.Context, sp address.Address, tag string) (peer.ID, func(), error) {
+	id, err := p.Connect(ctx, sp)
+	if err != nil {
+		return "", nil, err
+	}
+
+	p.dialer.Protect(id, tag)
+	return id, func() {
+		p.dialer.Unprotect(id, tag)
+	}, nil
+}
+
+func (p *Pool) Stats() Stats {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	st := p.stats
+	st.Providers = len(p.sps)
+	now := time.Now()
+	for _, sp := range p.sps {
+		if now.Before(sp.retryAt) {
+			st.BackingOff++
+		}
+	}
+	return st
+}
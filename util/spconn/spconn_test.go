@@ -0,0 +1,168 @@
+package spconn
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeDialer struct {
+	lk        sync.Mutex
+	connected map[peer.ID]bool
+	protected map[peer.ID]int
+	dials     int
+	inflight  int
+	maxFlight int
+	delay     time.Duration
+	fail      bool
+}
+
+func newFakeDialer() *fakeDialer {
+	return &fakeDialer{connected: make(map[peer.ID]bool), protected: make(map[peer.ID]int)}
+}
+
+func (fd *fakeDialer) Connect(ctx context.Context, ai peer.AddrInfo) error {
+	fd.lk.Lock()
+	fd.dials++
+	fd.inflight++
+	if fd.inflight > fd.maxFlight {
+		fd.maxFlight = fd.inflight
+	}
+	fail := fd.fail
+	fd.lk.Unlock()
+
+	time.Sleep(fd.delay)
+
+	fd.lk.Lock()
+	defer fd.lk.Unlock()
+	fd.inflight--
+	if fail {
+		return errors.New("dial failed")
+	}
+	fd.connected[ai.ID] = true
+	return nil
+}
+
+func (fd *fakeDialer) Connected(p peer.ID) bool {
+	fd.lk.Lock()
+	defer fd.lk.Unlock()
+	return fd.connected[p]
+}
+
+func (fd *fakeDialer) Protect(p peer.ID, tag string) {
+	fd.lk.Lock()
+	defer fd.lk.Unlock()
+	fd.protected[p]++
+}
+
+func (fd *fakeDialer) Unprotect(p peer.ID, tag string) bool {
+	fd.lk.Lock()
+	defer fd.lk.Unlock()
+	fd.protected[p]--
+	return fd.protected[p] > 0
+}
+
+func resolver(ctx context.Context, sp address.Address) (peer.AddrInfo, error) {
+	return peer.AddrInfo{ID: peer.ID("peer-" + sp.String())}, nil
+}
+
+func sp(t *testing.T, id uint64) address.Address {
+	a, err := address.NewIDAddress(id)
+	assert.NoError(t, err)
+	return a
+}
+
+func TestConnectReuses(t *testing.T) {
+	fd := newFakeDialer()
+	fd.delay = 20 * time.Millisecond
+	p := New(fd, resolver, Options{MaxDials: 4, BackoffBase: time.Second, BackoffMax: time.Minute, AddrTTL: time.Hour})
+
+	// concurrent callers for the same provider share a single dial
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := p.Connect(context.Background(), sp(t, 1000))
+			assert.NoError(t, err)
+			assert.Equal(t, peer.ID("peer-"+sp(t, 1000).String()), id)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, fd.dials)
+	st := p.Stats()
+	assert.Equal(t, int64(1), st.Dials)
+	assert.Equal(t, int64(9), st.Reused)
+}
+
+func TestMaxDials(t *testing.T) {
+	fd := newFakeDialer()
+	fd.delay = 10 * time.Millisecond
+	p := New(fd, resolver, Options{MaxDials: 2, AddrTTL: time.Hour})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := p.Connect(context.Background(), sp(t, uint64(1000+i)))
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 8, fd.dials)
+	assert.LessOrEqual(t, fd.maxFlight, 2)
+}
+
+func TestBackoff(t *testing.T) {
+	fd := newFakeDialer()
+	fd.fail = true
+	p := New(fd, resolver, Options{MaxDials: 1, BackoffBase: 30 * time.Millisecond, BackoffMax: time.Minute, AddrTTL: time.Hour})
+
+	_, err := p.Connect(context.Background(), sp(t, 1000))
+	assert.EqualError(t, err, "dial failed")
+
+	// the provider isn't dialed again until the backoff is over
+	_, err = p.Connect(context.Background(), sp(t, 1000))
+	assert.ErrorIs(t, err, ErrBackoff)
+	assert.Equal(t, 1, fd.dials)
+	assert.Equal(t, 1, p.Stats().BackingOff)
+
+	time.Sleep(40 * time.Millisecond)
+	fd.lk.Lock()
+	fd.fail = false
+	fd.lk.Unlock()
+
+	_, err = p.Connect(context.Background(), sp(t, 1000))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, fd.dials)
+	assert.Equal(t, 0, p.Stats().BackingOff)
+}
+
+func TestBackoffGrows(t *testing.T) {
+	p := New(newFakeDialer(), resolver, Options{BackoffBase: time.Second, BackoffMax: 5 * time.Second})
+	assert.Equal(t, time.Second, p.backoff(1))
+	assert.Equal(t, 2*time.Second, p.backoff(2))
+	assert.Equal(t, 4*time.Second, p.backoff(3))
+	assert.Equal(t, 5*time.Second, p.backoff(4))
+	assert.Equal(t, 5*time.Second, p.backoff(40))
+}
+
+func TestAcquireProtects(t *testing.T) {
+	fd := newFakeDialer()
+	p := New(fd, resolver, Options{MaxDials: 1, AddrTTL: time.Hour})
+
+	id, release, err := p.Acquire(context.Background(), sp(t, 1000), "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fd.protected[id])
+	release()
+	assert.Equal(t, 0, fd.protected[id])
+}
@@ -0,0 +1,237 @@
+// Package ucan issues and checks UCANs (user controlled authorization
+// networks): JWTs in which a did:key delegates capabilities to another did,
+// carrying the tokens that delegated those capabilities to it as proofs. A
+// chain of them is checked with nothing but the tokens themselves.
+package ucan
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/mr-tron/base58"
+)
+
+const (
+	version = "0.8.1"
+	alg     = "EdDSA"
+
+	didKeyPrefix = "did:key:z"
+
+	// maxDepth bounds how many delegations a chain can have
+	maxDepth = 16
+)
+
+// multicodec prefix of ed25519 public keys
+var ed25519Codec = []byte{0xed, 0x01}
+
+// Capability is the ability to do Can with the resource With. Capabilities
+// are delegated as they are or attenuated: with the same resource, a
+// narrower ability and a smaller MaxSize.
+type Capability struct {
+	With string `json:"with"`
+	Can  string `json:"can"`
+	// MaxSize caps how many bytes can be uploaded with the capability, no
+	// cap when 0
+	MaxSize int64 `json:"maxSize,omitempty"`
+}
+
+// Covers reports whether c can be delegated as o
+func (c Capability) Covers(o Capability) bool {
+	if c.With != o.With {
+		return false
+	}
+	if c.Can != o.Can && c.Can != "*" &&
+		!(strings.HasSuffix(c.Can, "/*") && strings.HasPrefix(o.Can, strings.TrimSuffix(c.Can, "*"))) {
+		return false
+	}
+	return c.MaxSize == 0 || (o.MaxSize > 0 && o.MaxSize <= c.MaxSize)
+}
+
+// Token is the payload of a UCAN. Times are unix seconds.
+type Token struct {
+	Issuer       string       `json:"iss"`
+	Audience     string       `json:"aud"`
+	NotBefore    int64        `json:"nbf,omitempty"`
+	Expiry       int64        `json:"exp"`
+	Nonce        string       `json:"nnc,omitempty"`
+	Capabilities []Capability `json:"att"`
+	// Proofs are the encoded tokens that delegated the capabilities to the
+	// issuer, none when the issuer owns them
+	Proofs []string `json:"prf"`
+}
+
+type header struct {
+	Alg     string `json:"alg"`
+	Typ     string `json:"typ"`
+	Version string `json:"ucv"`
+}
+
+// Issue signs t with key, which has to be an ed25519 key, and returns the
+// encoded token. The issuer of t is set to the did of key.
+func Issue(key crypto.PrivKey, t Token) (string, error) {
+	iss, err := DID(key.GetPublic())
+	if err != nil {
+		return "", err
+	}
+	t.Issuer = iss
+	if t.Proofs == nil {
+		t.Proofs = []string{}
+	}
+
+	h, err := json.Marshal(header{Alg: alg, Typ: "JWT", Version: version})
+	if err != nil {
+		return "", err
+	}
+	p, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+
+	signing := encode(h) + "." + encode(p)
+	sig, err := key.Sign([]byte(signing))
+	if err != nil {
+		return "", err
+	}
+	return signing + "." + encode(sig), nil
+}
+
+// Verify checks that raw is a UCAN to audience, valid at now, whose
+// capabilities were all delegated by its proofs, and so on up the chain.
+// It returns the token along with the root of the chain: the token that
+// first delegated the capabilities, whose issuer owns them.
+//
+// Only linear chains are supported, every token has at most one proof.
+func Verify(raw, audience string, now time.Time) (*Token, *Token, error) {
+	t, err := Parse(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t.Audience != audience {
+		return nil, nil, fmt.Errorf("token is for %s", t.Audience)
+	}
+	if t.Expiry < now.Unix() {
+		return nil, nil, fmt.Errorf("token expired")
+	}
+	if t.NotBefore > now.Unix() {
+		return nil, nil, fmt.Errorf("token is not valid yet")
+	}
+
+	cur := t
+	for depth := 0; len(cur.Proofs) > 0; depth++ {
+		if depth == maxDepth {
+			return nil, nil, fmt.Errorf("delegation chain is longer than %d", maxDepth)
+		}
+		if len(cur.Proofs) > 1 {
+			return nil, nil, fmt.Errorf("tokens can have only one proof")
+		}
+
+		prf, err := Parse(cur.Proofs[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid proof: %w", err)
+		}
+		if prf.Audience != cur.Issuer {
+			return nil, nil, fmt.Errorf("proof was delegated to %s, not %s", prf.Audience, cur.Issuer)
+		}
+		if cur.Expiry > prf.Expiry || cur.NotBefore < prf.NotBefore {
+			return nil, nil, fmt.Errorf("token outlives its proof")
+		}
+		for _, c := range cur.Capabilities {
+			if !prf.covers(c) {
+				return nil, nil, fmt.Errorf("capability %s on %s was not delegated", c.Can, c.With)
+			}
+		}
+		cur = prf
+	}
+	return t, cur, nil
+}
+
+func (t *Token) covers(c Capability) bool {
+	for _, pc := range t.Capabilities {
+		if pc.Covers(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse decodes a UCAN and checks its signature, it does not check its
+// proofs or whether it is valid right now
+func Parse(raw string) (*Token, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	var h header
+	if err := decodeJSON(parts[0], &h); err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+	if h.Alg != alg {
+		return nil, fmt.Errorf("unsupported signature algorithm %q", h.Alg)
+	}
+
+	var t Token
+	if err := decodeJSON(parts[1], &t); err != nil {
+		return nil, fmt.Errorf("malformed token payload: %w", err)
+	}
+	if t.Expiry == 0 {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+
+	pub, err := ParseDID(t.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %w", err)
+	}
+	ok, err := pub.Verify([]byte(parts[0]+"."+parts[1]), sig)
+	if err != nil || !ok {
+		return nil, fmt.Errorf("invalid token signature")
+	}
+	return &t, nil
+}
+
+// DID returns the did:key of an ed25519 public key
+func DID(pub crypto.PubKey) (string, error) {
+	if pub.Type() != crypto.Ed25519 {
+		return "", fmt.Errorf("only ed25519 keys are supported")
+	}
+	raw, err := pub.Raw()
+	if err != nil {
+		return "", err
+	}
+	return didKeyPrefix + base58.Encode(append(append([]byte{}, ed25519Codec...), raw...)), nil
+}
+
+// ParseDID returns the public key of an ed25519 did:key
+func ParseDID(did string) (crypto.PubKey, error) {
+	if !strings.HasPrefix(did, didKeyPrefix) {
+		return nil, fmt.Errorf("%q is not a did:key", did)
+	}
+	b, err := base58.Decode(strings.TrimPrefix(did, didKeyPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid did %q: %w", did, err)
+	}
+	if len(b) < 2 || b[0] != ed25519Codec[0] || b[1] != ed25519Codec[1] {
+		return nil, fmt.Errorf("did %q is not an ed25519 key", did)
+	}
+	return crypto.UnmarshalEd25519PublicKey(b[2:])
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeJSON(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
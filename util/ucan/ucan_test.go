@@ -0,0 +1,100 @@
+package ucan
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tamper flips a bit of the signature of tok. Editing the encoded signature
+// could decode to the same bytes, its last character has spare bits.
+func tamper(t *testing.T, tok string) string {
+	i := strings.LastIndex(tok, ".")
+	sig, err := base64.RawURLEncoding.DecodeString(tok[i+1:])
+	require.NoError(t, err)
+	sig[len(sig)/2] ^= 1
+	return tok[:i+1] + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newKey(t *testing.T) (crypto.PrivKey, string) {
+	k, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	did, err := DID(k.GetPublic())
+	require.NoError(t, err)
+	return k, did
+}
+
+func TestDID(t *testing.T) {
+	k, did := newKey(t)
+	assert.True(t, strings.HasPrefix(did, "did:key:z6Mk"))
+
+	pub, err := ParseDID(did)
+	require.NoError(t, err)
+	assert.True(t, pub.Equals(k.GetPublic()))
+
+	_, err = ParseDID("did:web:estuary.tech")
+	assert.Error(t, err)
+}
+
+func TestDelegation(t *testing.T) {
+	node, nodeDID := newKey(t)
+	user, userDID := newKey(t)
+	app, appDID := newKey(t)
+
+	now := time.Now()
+	exp := now.Add(time.Hour).Unix()
+	pin := Capability{With: "estuary:user/1", Can: "pin/*"}
+
+	root, err := Issue(node, Token{Audience: userDID, Expiry: exp, Capabilities: []Capability{pin}})
+	require.NoError(t, err)
+
+	delegate := func(caps ...Capability) string {
+		tok, err := Issue(user, Token{Audience: appDID, Expiry: exp, Capabilities: caps, Proofs: []string{root}})
+		require.NoError(t, err)
+		return tok
+	}
+	invoke := func(prf string, caps ...Capability) string {
+		tok, err := Issue(app, Token{Audience: nodeDID, Expiry: exp, Capabilities: caps, Proofs: []string{prf}})
+		require.NoError(t, err)
+		return tok
+	}
+
+	add := Capability{With: "estuary:user/1", Can: "pin/add", MaxSize: 1 << 20}
+	tok := invoke(delegate(add), add)
+	got, gotRoot, err := Verify(tok, nodeDID, now)
+	require.NoError(t, err)
+	assert.Equal(t, appDID, got.Issuer)
+	assert.Equal(t, []Capability{add}, got.Capabilities)
+	assert.Equal(t, nodeDID, gotRoot.Issuer)
+
+	_, _, err = Verify(tok, userDID, now)
+	assert.Error(t, err, "wrong audience")
+	_, _, err = Verify(tok, nodeDID, now.Add(2*time.Hour))
+	assert.Error(t, err, "expired")
+	_, _, err = Verify(tamper(t, tok), nodeDID, now)
+	assert.Error(t, err, "tampered signature")
+
+	bigger := add
+	bigger.MaxSize = 2 << 20
+	_, _, err = Verify(invoke(delegate(add), bigger), nodeDID, now)
+	assert.Error(t, err, "size cap can not grow")
+
+	other := Capability{With: "estuary:user/2", Can: "pin/add"}
+	_, _, err = Verify(invoke(delegate(other), other), nodeDID, now)
+	assert.Error(t, err, "resource was never delegated")
+
+	admin := Capability{With: "estuary:user/1", Can: "admin/*"}
+	_, _, err = Verify(invoke(delegate(admin), admin), nodeDID, now)
+	assert.Error(t, err, "ability was never delegated")
+
+	long, err := Issue(user, Token{Audience: appDID, Expiry: exp + 60, Capabilities: []Capability{add}, Proofs: []string{root}})
+	require.NoError(t, err)
+	_, _, err = Verify(invoke(long, add), nodeDID, now)
+	assert.Error(t, err, "delegation can not outlive its proof")
+}
@@ -1,9 +1,12 @@
 package util
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 
 	"github.com/ipfs/go-cidutil"
 	chunker "github.com/ipfs/go-ipfs-chunker"
@@ -17,24 +20,258 @@ import (
 
 var DefaultHashFunction = uint64(mh.SHA2_256)
 
+// DefaultChunker is how uploads are split into blocks unless they ask for
+// something else, fixed 1MiB chunks
+const DefaultChunker = "size-1048576"
+
+// Chunkers that can be asked for by name
+const (
+	ChunkerSize    = "size"
+	ChunkerRabin   = "rabin"
+	ChunkerBuzhash = "buzhash"
+)
+
+// ChunkerFromParams turns the chunker and chunk size an upload asked for
+// into a chunker spec as taken by go-ipfs-chunker. A fixed size chunker
+// splits into chunks of exactly size bytes, rabin into chunks of size bytes
+// on average, and buzhash into chunks of its own choosing, so it takes no
+// size. A full spec, eg. "rabin-131072-262144-524288", is passed through.
+func ChunkerFromParams(name, size string) (string, error) {
+	if name == "" && size == "" {
+		return DefaultChunker, nil
+	}
+
+	var spec string
+	switch name {
+	case "", ChunkerSize:
+		if size == "" {
+			return DefaultChunker, nil
+		}
+		spec = ChunkerSize + "-" + size
+	case ChunkerRabin:
+		spec = ChunkerRabin
+		if size != "" {
+			spec += "-" + size
+		}
+	case ChunkerBuzhash:
+		if size != "" {
+			return "", errors.New("the buzhash chunker does not take a chunk size")
+		}
+		spec = ChunkerBuzhash
+	default:
+		if size != "" {
+			return "", fmt.Errorf("chunker %q already sets its chunk size", name)
+		}
+		spec = name
+	}
+
+	if err := ValidateChunker(spec); err != nil {
+		return "", err
+	}
+	return spec, nil
+}
+
+// MinChunkSize is the smallest chunk size a chunker can be asked for, so a
+// file can't be split into a block per byte
+const MinChunkSize = 1 << 10
+
+// ValidateChunker checks that spec is a chunker go-ipfs-chunker knows, with
+// no chunk size below MinChunkSize
+func ValidateChunker(spec string) error {
+	if _, err := chunker.FromString(bytes.NewReader(nil), spec); err != nil {
+		return err
+	}
+	for _, p := range strings.Split(spec, "-")[1:] {
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err == nil && n < MinChunkSize {
+			return fmt.Errorf("chunk sizes must be at least %d bytes", MinChunkSize)
+		}
+	}
+	return nil
+}
+
+// HashFunctions are the hash functions content can be added with, by the
+// names uploads ask for them by. They are the ones the blockservice accepts
+// blocks hashed with, which leaves out blake3 until go-verifcid is upgraded.
+var HashFunctions = map[string]uint64{
+	"sha2-256":    mh.SHA2_256,
+	"sha2-512":    mh.SHA2_512,
+	"sha3-256":    mh.SHA3_256,
+	"blake2b-256": mh.BLAKE2B_MIN + 31,
+}
+
+// DefaultInlineLimit is the size up to which blocks are inlined into the
+// cids linking to them by default, MaxInlineLimit is as far as it goes so
+// cids stay small
+const (
+	DefaultInlineLimit = 32
+	MaxInlineLimit     = 128
+)
+
+// ImportOptions controls how a file is turned into a DAG
+type ImportOptions struct {
+	// Chunker is a chunker spec, see ChunkerFromParams
+	Chunker string
+	// CidVersion is 0 or 1. Version 0 cids only come as sha2-256 dag-pb, so
+	// leaves are wrapped in dag-pb and nothing is inlined.
+	CidVersion   int
+	HashFunction uint64
+	// InlineLimit is the size up to which blocks are not stored at all but
+	// inlined into the cids linking to them as identity cids, which saves a
+	// block per tiny leaf. Zero turns inlining off.
+	InlineLimit int
+}
+
+func DefaultImportOptions() ImportOptions {
+	return ImportOptions{
+		Chunker:      DefaultChunker,
+		CidVersion:   1,
+		HashFunction: DefaultHashFunction,
+		InlineLimit:  DefaultInlineLimit,
+	}
+}
+
+// ImportDefaults is the node's default import options, from the cid
+// version, hash function name and inline limit it is configured with
+func ImportDefaults(cidVersion int, hashFunction string, inlineLimit int) (ImportOptions, error) {
+	opts := DefaultImportOptions()
+	opts.CidVersion = cidVersion
+	opts.InlineLimit = inlineLimit
+	if hashFunction != "" {
+		code, err := ParseHashFunction(hashFunction)
+		if err != nil {
+			return ImportOptions{}, err
+		}
+		opts.HashFunction = code
+	}
+	return opts, opts.Validate()
+}
+
+// ParseHashFunction looks a hash function up by name
+func ParseHashFunction(name string) (uint64, error) {
+	code, ok := HashFunctions[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unsupported hash function %q", name)
+	}
+	return code, nil
+}
+
+// ImportParams are the import options an upload asked for, as given
+type ImportParams struct {
+	Chunker     string
+	ChunkSize   string
+	CidVersion  string
+	Hash        string
+	InlineLimit string
+}
+
+// ImportParamsFrom reads the import params of an upload with get, eg. an
+// echo context's FormValue
+func ImportParamsFrom(get func(string) string) ImportParams {
+	return ImportParams{
+		Chunker:     get("chunker"),
+		ChunkSize:   get("chunk-size"),
+		CidVersion:  get("cid-version"),
+		Hash:        get("hash"),
+		InlineLimit: get("inline-limit"),
+	}
+}
+
+// ImportOptionsFromParams applies the import params of an upload on top of
+// the node's defaults
+func ImportOptionsFromParams(defaults ImportOptions, p ImportParams) (ImportOptions, error) {
+	opts := defaults
+
+	if p.Chunker != "" || p.ChunkSize != "" {
+		spec, err := ChunkerFromParams(p.Chunker, p.ChunkSize)
+		if err != nil {
+			return ImportOptions{}, err
+		}
+		opts.Chunker = spec
+	}
+
+	if p.CidVersion != "" {
+		v, err := strconv.Atoi(p.CidVersion)
+		if err != nil {
+			return ImportOptions{}, fmt.Errorf("invalid cid version %q", p.CidVersion)
+		}
+		opts.CidVersion = v
+		// an explicit v0 means sha2-256 unless the upload says otherwise
+		if v == 0 && p.Hash == "" {
+			opts.HashFunction = mh.SHA2_256
+		}
+	}
+
+	if p.Hash != "" {
+		code, err := ParseHashFunction(p.Hash)
+		if err != nil {
+			return ImportOptions{}, err
+		}
+		opts.HashFunction = code
+	}
+
+	if p.InlineLimit != "" {
+		n, err := strconv.Atoi(p.InlineLimit)
+		if err != nil {
+			return ImportOptions{}, fmt.Errorf("invalid inline limit %q", p.InlineLimit)
+		}
+		opts.InlineLimit = n
+	}
+
+	if err := opts.Validate(); err != nil {
+		return ImportOptions{}, err
+	}
+	return opts, nil
+}
+
+func (o ImportOptions) Validate() error {
+	switch o.CidVersion {
+	case 0:
+		if o.HashFunction != mh.SHA2_256 {
+			return errors.New("cid version 0 only supports sha2-256")
+		}
+	case 1:
+	default:
+		return fmt.Errorf("unsupported cid version %d", o.CidVersion)
+	}
+	if o.InlineLimit < 0 || o.InlineLimit > MaxInlineLimit {
+		return fmt.Errorf("inline limit must be between 0 and %d", MaxInlineLimit)
+	}
+	return ValidateChunker(o.Chunker)
+}
+
 func ImportFile(dserv ipld.DAGService, fi io.Reader) (ipld.Node, error) {
-	prefix, err := merkledag.PrefixForCidVersion(1)
+	return ImportFileWithOptions(dserv, fi, DefaultImportOptions())
+}
+
+// ImportFileWithOptions imports fi as a UnixFS file
+func ImportFileWithOptions(dserv ipld.DAGService, fi io.Reader, opts ImportOptions) (ipld.Node, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	prefix, err := merkledag.PrefixForCidVersion(opts.CidVersion)
 	if err != nil {
 		return nil, err
 	}
-	prefix.MhType = DefaultHashFunction
+	prefix.MhType = opts.HashFunction
+	prefix.MhLength = -1
 
-	spl := chunker.NewSizeSplitter(fi, 1024*1024)
+	spl, err := chunker.FromString(fi, opts.Chunker)
+	if err != nil {
+		return nil, err
+	}
 	dbp := ihelper.DagBuilderParams{
-		Maxlinks:  1024,
-		RawLeaves: true,
-
-		CidBuilder: cidutil.InlineBuilder{
+		Maxlinks:   1024,
+		RawLeaves:  opts.CidVersion > 0,
+		CidBuilder: prefix,
+		Dagserv:    dserv,
+	}
+	if opts.CidVersion > 0 && opts.InlineLimit > 0 {
+		dbp.CidBuilder = cidutil.InlineBuilder{
 			Builder: prefix,
-			Limit:   32,
-		},
-
-		Dagserv: dserv,
+			Limit:   opts.InlineLimit,
+		}
 	}
 
 	db, err := dbp.New(spl)
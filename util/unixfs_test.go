@@ -0,0 +1,152 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+
+	mdtest "github.com/ipfs/go-merkledag/test"
+	uio "github.com/ipfs/go-unixfs/io"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkerFromParams(t *testing.T) {
+	for _, tc := range []struct {
+		name, size string
+		spec       string
+		err        bool
+	}{
+		{"", "", DefaultChunker, false},
+		{"size", "", DefaultChunker, false},
+		{"", "262144", "size-262144", false},
+		{"size", "262144", "size-262144", false},
+		{"size", "0", "", true},
+		{"size", "1", "", true},
+		{"size", "1023", "", true},
+		{"size", "1024", "size-1024", false},
+		{"rabin", "16", "", true},
+		{"rabin-16-4096-8192", "", "", true},
+		{"size", "2097152", "", true},
+		{"rabin", "", "rabin", false},
+		{"rabin", "262144", "rabin-262144", false},
+		{"buzhash", "", "buzhash", false},
+		{"buzhash", "1024", "", true},
+		{"rabin-1024-4096-8192", "", "rabin-1024-4096-8192", false},
+		{"rabin-1024-4096-8192", "4096", "", true},
+		{"zigzag", "", "", true},
+	} {
+		spec, err := ChunkerFromParams(tc.name, tc.size)
+		if tc.err {
+			assert.Error(t, err, "%q %q", tc.name, tc.size)
+			continue
+		}
+		if assert.NoError(t, err, "%q %q", tc.name, tc.size) {
+			assert.Equal(t, tc.spec, spec)
+		}
+	}
+}
+
+func TestImportOptionsFromParams(t *testing.T) {
+	def := DefaultImportOptions()
+
+	opts, err := ImportOptionsFromParams(def, ImportParams{})
+	require.NoError(t, err)
+	assert.Equal(t, def, opts)
+
+	opts, err = ImportOptionsFromParams(def, ImportParams{Chunker: "buzhash", CidVersion: "1", Hash: "blake2b-256", InlineLimit: "0"})
+	require.NoError(t, err)
+	assert.Equal(t, ImportOptions{Chunker: "buzhash", CidVersion: 1, HashFunction: mh.BLAKE2B_MIN + 31}, opts)
+
+	opts, err = ImportOptionsFromParams(ImportOptions{Chunker: DefaultChunker, CidVersion: 1, HashFunction: mh.SHA2_512}, ImportParams{CidVersion: "0"})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(mh.SHA2_256), opts.HashFunction)
+
+	for _, bad := range []ImportParams{
+		{CidVersion: "0", Hash: "sha2-512"},
+		{CidVersion: "2"},
+		{CidVersion: "one"},
+		{Hash: "md5"},
+		{Hash: "blake3"},
+		{InlineLimit: "-1"},
+		{InlineLimit: "4096"},
+		{InlineLimit: "lots"},
+	} {
+		_, err := ImportOptionsFromParams(def, bad)
+		assert.Error(t, err, "%+v", bad)
+	}
+}
+
+func TestImportFileWithOptions(t *testing.T) {
+	data := make([]byte, 3<<20)
+	rand.New(rand.NewSource(1)).Read(data) //nolint:errcheck
+
+	dserv := mdtest.Mock()
+	def, err := ImportFile(dserv, bytes.NewReader(data))
+	require.NoError(t, err)
+
+	same, err := ImportFileWithOptions(dserv, bytes.NewReader(data), DefaultImportOptions())
+	require.NoError(t, err)
+	assert.Equal(t, def.Cid(), same.Cid())
+
+	seen := map[string]string{def.Cid().String(): DefaultChunker}
+	for spec, opts := range map[string]ImportOptions{
+		"size-262144": {Chunker: "size-262144", CidVersion: 1, HashFunction: mh.SHA2_256, InlineLimit: DefaultInlineLimit},
+		"rabin":       {Chunker: "rabin", CidVersion: 1, HashFunction: mh.SHA2_256, InlineLimit: DefaultInlineLimit},
+		"buzhash":     {Chunker: "buzhash", CidVersion: 1, HashFunction: mh.SHA2_256, InlineLimit: DefaultInlineLimit},
+		"v0":          {Chunker: DefaultChunker, CidVersion: 0, HashFunction: mh.SHA2_256},
+		"sha2-512":    {Chunker: DefaultChunker, CidVersion: 1, HashFunction: mh.SHA2_512, InlineLimit: DefaultInlineLimit},
+		"blake2b-256": {Chunker: DefaultChunker, CidVersion: 1, HashFunction: mh.BLAKE2B_MIN + 31, InlineLimit: DefaultInlineLimit},
+	} {
+		nd, err := ImportFileWithOptions(dserv, bytes.NewReader(data), opts)
+		require.NoError(t, err)
+		if prev, ok := seen[nd.Cid().String()]; ok {
+			t.Fatalf("%s and %s produced the same dag", spec, prev)
+		}
+		seen[nd.Cid().String()] = spec
+		assert.Equal(t, uint64(opts.CidVersion), nd.Cid().Version(), spec)
+		assert.Equal(t, opts.HashFunction, nd.Cid().Prefix().MhType, spec)
+
+		// every chunking holds the same file
+		dr, err := uio.NewDagReader(context.Background(), nd, dserv)
+		require.NoError(t, err)
+		read, err := io.ReadAll(dr)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(data, read), spec)
+	}
+}
+
+func TestImportInlining(t *testing.T) {
+	ctx := context.Background()
+	data := make([]byte, 1000)
+	rand.New(rand.NewSource(2)).Read(data) //nolint:errcheck
+
+	opts := DefaultImportOptions()
+	opts.Chunker = "size-100"
+
+	// leaves of 100 bytes are stored when they are over the limit ...
+	dserv := mdtest.Mock()
+	nd, err := ImportFileWithOptions(dserv, bytes.NewReader(data), opts)
+	require.NoError(t, err)
+	for _, l := range nd.Links() {
+		assert.NotEqual(t, uint64(mh.IDENTITY), l.Cid.Prefix().MhType)
+	}
+
+	// ... and inlined when they are not
+	opts.InlineLimit = MaxInlineLimit
+	inl, err := ImportFileWithOptions(dserv, bytes.NewReader(data), opts)
+	require.NoError(t, err)
+	assert.Len(t, inl.Links(), 10)
+	for _, l := range inl.Links() {
+		assert.Equal(t, uint64(mh.IDENTITY), l.Cid.Prefix().MhType)
+	}
+
+	dr, err := uio.NewDagReader(ctx, inl, dserv)
+	require.NoError(t, err)
+	read, err := io.ReadAll(dr)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, read))
+}
@@ -0,0 +1,69 @@
+// Package withhold decides which blocks are kept from peers that ask for
+// them over bitswap. The answers of the lookup, which goes to the database,
+// are cached for a while, bitswap asks for every block it is sent a want
+// for.
+package withhold
+
+import (
+	"context"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("withhold")
+
+// Lookup reports whether the block c is withheld
+type Lookup func(ctx context.Context, c cid.Cid) (bool, error)
+
+type entry struct {
+	withheld bool
+	expiry   time.Time
+}
+
+// Filter caches the answers of a lookup for ttl
+type Filter struct {
+	lookup Lookup
+	ttl    time.Duration
+	now    func() time.Time
+	cache  *lru.Cache
+}
+
+func New(lookup Lookup, size int, ttl time.Duration) (*Filter, error) {
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{
+		lookup: lookup,
+		ttl:    ttl,
+		now:    time.Now,
+		cache:  cache,
+	}, nil
+}
+
+// Withheld reports whether the block c is withheld. Blocks the lookup
+// fails for are withheld, and asked about again the next time.
+func (f *Filter) Withheld(ctx context.Context, c cid.Cid) bool {
+	now := f.now()
+	v, ok := f.cache.Get(c)
+	if ok && now.Before(v.(entry).expiry) {
+		return v.(entry).withheld
+	}
+
+	withheld, err := f.lookup(ctx, c)
+	if err != nil {
+		log.Warnf("failed to look up whether %s is withheld: %s", c, err)
+		return true
+	}
+
+	f.cache.Add(c, entry{withheld: withheld, expiry: now.Add(f.ttl)})
+	return withheld
+}
+
+// Forget drops the cached answers, after what is withheld changed
+func (f *Filter) Forget() {
+	f.cache.Purge()
+}
@@ -0,0 +1,54 @@
+package withhold
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testCid(t *testing.T, s string) cid.Cid {
+	h, err := multihash.Sum([]byte(s), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	return cid.NewCidV1(cid.Raw, h)
+}
+
+func TestFilter(t *testing.T) {
+	ctx := context.Background()
+	private := testCid(t, "private")
+	public := testCid(t, "public")
+
+	var lookups int
+	var fail bool
+	f, err := New(func(ctx context.Context, c cid.Cid) (bool, error) {
+		lookups++
+		if fail {
+			return false, errors.New("database is down")
+		}
+		return c.Equals(private), nil
+	}, 10, time.Minute)
+	require.NoError(t, err)
+	now := time.Now()
+	f.now = func() time.Time { return now }
+
+	assert.True(t, f.Withheld(ctx, private))
+	assert.False(t, f.Withheld(ctx, public))
+	assert.False(t, f.Withheld(ctx, public))
+	assert.Equal(t, 2, lookups, "answers are cached")
+
+	now = now.Add(2 * time.Minute)
+	assert.False(t, f.Withheld(ctx, public))
+	assert.Equal(t, 3, lookups, "answers expire")
+
+	f.Forget()
+	fail = true
+	assert.True(t, f.Withheld(ctx, public), "blocks are withheld when the lookup fails")
+	fail = false
+	assert.False(t, f.Withheld(ctx, public))
+	assert.Equal(t, 5, lookups, "failures aren't cached")
+}